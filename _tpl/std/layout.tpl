@@ -99,11 +99,16 @@
       </ul>
     </div>
     <div id="main">
+      {{if .TestNetwork}}
+      <div class="testnotice">
+        This server resolves names on the Namecoin {{.Network}} network. They are not the real names of the same spelling, and nothing shown here applies to them.
+      </div>
+      {{end}}
       <div id="imain">
         {{template "Main" .}}
       </div>
       <div id="statusline">
-        Served by {{.SelfName}} at {{.Time}}
+        Served by {{.SelfName}} from the Namecoin {{.Network}} network at {{.Time}}
       </div>
     </div>
   </body>
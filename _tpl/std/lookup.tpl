@@ -19,7 +19,7 @@ Domain Name:    <span class="rv">{{.DomainName}}</span>
 Bare Name:      <span class="rv">{{.BareName}}</span>
 
 Exists:         {{if .ExistenceError}}{{.ExistenceError}}{{else}}Yes{{end}}
-{{if not .ExistenceError}}Expired:        {{.Expired}}{{end}}
+{{if not .ExistenceError}}Expired:        {{if .Expired}}<strong>Yes</strong>{{else}}No{{end}}{{if .Expiry}} ({{.Expiry}}){{end}}{{end}}
 {{if not .ExistenceError}}
 Valid:          {{.Valid}}
 
@@ -19,7 +19,7 @@
 		   to convert domain names into Namecoin suffixes, or directly to query the .bit zone.</p>
 		<ol>
 			<li><p>The {{.CanonicalSuffix}} nameservers are authoritative for the .bit zone. For example:</p>
-				<pre>$ dig A nf.bit. @{{.SelfName}}
+				<pre>$ dig A nf.bit. @{{.SelfName}}{{if .DNSPort}} -p {{.DNSPort}}{{end}}
 94.23.252.190</pre>
 				<p>You can use the nameservers in this mode by configuring a suitable DNS resolver.
 				   Unbound is recommended due to its support for {{if .HasDNSSEC}} DNSSEC and {{end}} configurable
@@ -57,7 +57,7 @@
   trust-anchor-file: "/etc/unbound/keys/{{.CanonicalSuffix}}.key"{{end}}
   stub-zone:
     name: bit.
-{{range .CanonicalNameservers}}    stub-host: {{.}}
+{{range .CanonicalNameservers}}    stub-host: {{.}}{{if $.DNSPort}}@{{$.DNSPort}}{{end}}
 {{end}}    stub-prime: yes</pre>
 		{{if .HasDNSSEC}}<p>You will need to place the {{.CanonicalSuffix}} trust anchor (a DS record) in <code>/etc/unbound/keys/{{.CanonicalSuffix}}.key</code>. See <a href="#dnssec">DNSSEC</a>.</p>{{end}}
 		<p>See the <a href="http://www.unbound.net/">Unbound</a> documentation for information on setting up Unbound.</p>
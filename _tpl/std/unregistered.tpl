@@ -0,0 +1,23 @@
+
+{{define "Main"}}
+		<form method="POST" action="/lookup" class="lookup-form">
+			<fieldset>
+				<legend>Check a domain name</legend>
+				<input type="text" name="q" value="{{.Query}}" autofocus="autofocus" placeholder="Enter domain name in form d/example or example.bit" size="67" required="required" maxlength="67" pattern="^(d/[a-z0-9_-]+|[a-z0-9_-]+\.bit\.?)$" x-moz-errormessage="Must be in the form d/example or example.bit." />
+				<input type="submit" value="Lookup Domain" />
+			</fieldset>
+		</form>
+
+		<h2>{{.DomainName}} isn't registered</h2>
+		<p>No one holds the Namecoin name <span class="rv">{{.NamecoinName}}</span>, which {{.DomainName}} maps to, so it's free to register.</p>
+{{if .RegistrationCost}}
+		<p>Registering it costs about <strong>{{.RegistrationCost}}</strong>: 0.01 NMC locked in the name for as long as it's held, and the fees of two transactions at the network's current rates.</p>
+{{else if .RegistrationCostError}}
+		<p>The cost of registering it couldn't be estimated ({{.RegistrationCostError}}), but is 0.01 NMC locked in the name for as long as it's held, and the fees of two transactions.</p>
+{{end}}
+		<p>To register it with Namecoin Core, first commit to the name without revealing it:</p>
+		<pre class="commands">namecoin-cli name_new {{.NamecoinName}}</pre>
+		<p>This prints a transaction ID and a random value. Once the transaction has 12 confirmations, about two hours later, register the name with its value, filling them in:</p>
+		<pre class="commands">namecoin-cli name_firstupdate {{.NamecoinName}} RANDOM TXID '{"ip":["192.0.2.1"]}'</pre>
+		<p>Replace the value with your own; the <a href="/lookup">lookup tool</a> checks that it's valid before you spend anything.</p>
+{{end}}
@@ -0,0 +1,67 @@
+package backend
+
+import (
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// The TTL of the A and AAAA records of VanityIPs.
+const vanityIPTTL = 86400
+
+// Returns the records placed at the zone apex besides the SOA and NS
+// records: the A and AAAA records of VanityIPs, then ApexRecords. They're
+// owned by bit., and merged into RRsets: a record given twice is kept once,
+// and every record of an RRset takes the lowest TTL among them, as records
+// of an RRset mustn't have different TTLs (RFC 2181 section 5.2).
+func mergeApexRecords(vanityIPs []net.IP, apexRecords []dns.RR) []dns.RR {
+	var rrs []dns.RR
+	for _, ip := range vanityIPs {
+		hdr := dns.RR_Header{Name: "bit.", Ttl: vanityIPTTL, Class: dns.ClassINET}
+		if ip4 := ip.To4(); ip4 != nil {
+			hdr.Rrtype = dns.TypeA
+			rrs = append(rrs, &dns.A{Hdr: hdr, A: ip4})
+		} else {
+			hdr.Rrtype = dns.TypeAAAA
+			rrs = append(rrs, &dns.AAAA{Hdr: hdr, AAAA: ip})
+		}
+	}
+	for _, rr := range apexRecords {
+		rr = dns.Copy(rr)
+		rr.Header().Name = "bit."
+		rrs = append(rrs, rr)
+	}
+
+	var merged []dns.RR
+	minTTL := map[uint16]uint32{}
+	for _, rr := range rrs {
+		dup := false
+		for _, m := range merged {
+			dup = dup || dns.IsDuplicate(m, rr)
+		}
+		if dup {
+			continue
+		}
+		merged = append(merged, rr)
+
+		rrtype := rr.Header().Rrtype
+		if ttl, ok := minTTL[rrtype]; !ok || rr.Header().Ttl < ttl {
+			minTTL[rrtype] = rr.Header().Ttl
+		}
+	}
+	for _, rr := range merged {
+		rr.Header().Ttl = minTTL[rr.Header().Rrtype]
+	}
+	return merged
+}
+
+// Returns copies of the records of mergeApexRecords, which the caller may
+// change, owned by the apex rootname.
+func (tx *btx) apexRecords() []dns.RR {
+	rrs := make([]dns.RR, len(tx.b.apexRecords))
+	for i, rr := range tx.b.apexRecords {
+		rrs[i] = dns.Copy(rr)
+		rrs[i].Header().Name = dns.Fqdn(tx.rootname)
+	}
+	return rrs
+}
@@ -1,14 +1,17 @@
 package backend
 
 import "github.com/miekg/dns"
-import "github.com/golang/groupcache/lru"
 import "gopkg.in/hlandau/madns.v2/merr"
+import "github.com/namecoin/ncdns/clock"
 import "github.com/namecoin/ncdns/namecoin"
 import "github.com/namecoin/ncdns/util"
 import "github.com/namecoin/ncdns/ncdomain"
 import "github.com/namecoin/ncdns/tlshook"
+import "github.com/namecoin/ncdns/tracing"
 import "github.com/hlandau/xlog"
+import "context"
 import "sync"
+import "sync/atomic"
 import "fmt"
 import "net"
 import "net/mail"
@@ -17,37 +20,250 @@ import "time"
 
 // Provides an abstract zone file for the Namecoin .bit TLD.
 type Backend struct {
+	// First, so that they're aligned for atomic access on 32-bit platforms
+	cacheHits, cacheMisses uint64 // accessed atomically
+	negativeCacheHits      uint64 // accessed atomically
+	staleAnswers           uint64 // accessed atomically
+
+	lookupsSaturated, lookupsCoalesced uint64 // accessed atomically
+	lookupsTimedOut, lookupsCancelled  uint64 // accessed atomically
+	lookupsInFlight, lookupsQueued     int64  // accessed atomically
+
 	//s *Server
-	nc *namecoin.Client
-	// caches map keys are stream isolation ID's; items are of type *Domain
-	caches     map[string]*lru.Cache
-	cacheMutex sync.Mutex
-	cfg        Config
+	fetcher Fetcher
+	// caches map keys are stream isolation ID's
+	caches map[string]*nameCache
+	// parseCaches map keys are stream isolation ID's
+	parseCaches map[string]*parseCache
+	cacheMutex  sync.Mutex
+	cfg         Config
+
+	// negativeCaches map keys are stream isolation ID's; nil if
+	// NegativeCacheMaxEntries is zero. Guarded by cacheMutex, as is
+	// cacheGeneration.
+	negativeCaches map[string]*negativeCache
+	// staleCaches map keys are stream isolation ID's; nil if
+	// StaleAnswerTTL is zero. Guarded by cacheMutex.
+	staleCaches map[string]*staleCache
+	// valueAges map keys are stream isolation ID's; nil if AdaptiveTTL
+	// isn't set. Guarded by cacheMutex. Unlike the name caches, they're kept
+	// across flushes.
+	valueAges map[string]*valueAgeCache
+	// Incremented whenever the name caches are flushed, so that what was
+	// fetched before a flush isn't cached after it.
+	cacheGeneration uint64
+
+	// SelfName relative to the suffix, if it is under it
+	selfName string
+
+	// The records of VanityIPs and ApexRecords, owned by bit.
+	apexRecords []dns.RR
+
+	// nil if FailureRetryDelay is zero
+	retrier *retrier
+
+	// Holds a value for each fetch in progress; nil if MaxConcurrentLookups
+	// is zero.
+	lookupSem   chan struct{}
+	flights     map[flightKey]*flight
+	flightMutex sync.Mutex
+
+	clock clock.Clock
 }
 
 var log, Log = xlog.New("ncdns.backend")
 
 // Backend configuration.
 type Config struct {
+	// Source of name values. If nil, names are fetched from namecoind via
+	// NamecoinConn.
+	Fetcher Fetcher
+
 	NamecoinConn *namecoin.Client
 
 	// Timeout (in milliseconds) for Namecoin RPC requests
 	NamecoinTimeout int
 
-	// Maximum entries to permit in name cache.
+	// Maximum entries to permit in name cache. The cache of parsed values is
+	// bounded separately by the same limit.
 	CacheMaxEntries int
 
+	// Maximum approximate number of bytes to permit in name cache. Zero means
+	// no limit. Enforced alongside CacheMaxEntries. The cache of parsed values
+	// is bounded separately by the same limit.
+	CacheMaxBytes int
+
+	// Time after which entries of the name caches, and of the caches of parsed
+	// values, which haven't been used are evicted by EvictIdle, however much
+	// room is left in them. Zero means entries are only evicted to make room.
+	CacheIdleEviction time.Duration
+
+	// Maximum entries to permit in the cache of names which don't exist.
+	// Zero disables negative caching, so that every query for a name which
+	// doesn't exist asks namecoind.
+	NegativeCacheMaxEntries int
+
+	// Time for which a name is remembered not to exist. Negative cache
+	// entries are dropped sooner by FlushCache.
+	NegativeCacheTTL time.Duration
+
+	// Tells the time for CacheIdleEviction, NegativeCacheTTL and StaleAnswerTTL.
+	// If nil, the system clock is used.
+	Clock clock.Clock
+
 	// Nameservers to advertise at zone apex. The first is considered the primary.
-	// If empty, a pseudo-hostname resolvable to SelfIP is used.
+	// If empty, SelfName is used, or if that is empty, a pseudo-hostname
+	// resolvable to SelfIPs.
 	CanonicalNameservers []string
 
 	// Vanity IPs to place at the zone apex.
 	VanityIPs []net.IP
 
-	// Used only if CanonicalNameservers is left blank. An IP which the internal
-	// pseudo-hostname should resolve to. This should be the public IP of the
+	// Other records to place at the zone apex, such as CAA and TXT records.
+	// Whatever their owner names, they're served at the apex asked about,
+	// merged into RRsets with the records of VanityIPs.
+	ApexRecords []dns.RR
+
+	// TTL of the SOA and NS records at the zone apex. If zero,
+	// DefaultApexTTL is used. The TTL of negative answers is the SOA's
+	// minimum field, whatever this is.
+	ApexTTL uint32
+
+	// The timers of the SOA record at the zone apex, for secondaries: how
+	// often they check the serial, how soon they try again if that fails,
+	// and after how long without success they stop serving the zone. If
+	// zero, DefaultSOARefresh, DefaultSOARetry and DefaultSOAExpire are used.
+	SOARefresh uint32
+	SOARetry   uint32
+	SOAExpire  uint32
+
+	// The minimum field of the SOA record at the zone apex, which is the TTL
+	// of negative answers. If zero, DefaultSOAMinTTL is used.
+	SOAMinTTL uint32
+
+	// Returns the serial of the SOA record at the zone apex, e.g. derived
+	// from the block height, so that secondaries can tell when the zone has
+	// changed. If nil, the serial is 1.
+	SOASerial func() uint32
+
+	// Returns the height of namecoind's best block, or zero if it isn't
+	// known. Needed for AdaptiveTTL.
+	ChainHeight func() int64
+
+	// If set, the records of names whose values haven't changed for a while
+	// are served with longer TTLs: AdaptiveMinTTL for a value which has just
+	// changed, growing to AdaptiveMaxTTL for one which hasn't for
+	// AdaptiveTTLBlocks blocks (DefaultAdaptiveTTLBlocks if zero). The heights
+	// from which names have had their values are remembered for up to
+	// CacheMaxEntries names per stream isolation ID.
+	AdaptiveTTL       bool
+	AdaptiveMinTTL    uint32
+	AdaptiveMaxTTL    uint32
+	AdaptiveTTLBlocks int64
+
+	// TTL of the records of names, unless AdaptiveTTL is set. If zero, the
+	// TTL of records generated from values (600 seconds) is kept.
+	RecordTTL uint32
+
+	// If set, the TTLs of the records of a name are capped by the time left
+	// until it expires, reckoning namecoin.BlockInterval per block, but not
+	// below MinRecordTTL, so that a name about to expire isn't cached beyond
+	// its expiry.
+	CapTTLByExpiry bool
+	MinRecordTTL   uint32
+
+	// If nonzero, the TTLs of the records of a name are capped at this when
+	// some of the names its value imports couldn't be fetched, e.g. as
+	// namecoind failed, so that resolvers don't hold on to the incomplete
+	// records for long. The names which failed are fetched again in the
+	// background if FailureRetryDelay is set, and the next lookup takes them
+	// from the name cache.
+	PartialResultTTL uint32
+
+	// The FQDN of this nameserver. If it is under the suffix (e.g.
+	// "ns1.bit."), it resolves to SelfIPs.
+	SelfName string
+
+	// The IPv4 and IPv6 addresses which SelfName and the internal
+	// pseudo-hostname should resolve to. These should be the public IPs of the
 	// nameserver serving the zone expressed by this backend.
-	SelfIP string
+	SelfIPs []net.IP
+
+	// Returns the label of the meta domain under which the pseudo-hostname is
+	// generated, so that it can be moved should the Namecoin name of that
+	// label be registered. If nil, DefaultMetaLabel is used.
+	MetaLabel func() string
+
+	// Namespaces (e.g. "d") whose names values may import from. If nil,
+	// ncdomain.DefaultImportNamespaces is used.
+	ImportNamespaces []string
+
+	// The form of the TLSA records generated from dehydrated certificates. If
+	// nil, ncdomain.DefaultGeneratedTLSA is used.
+	GeneratedTLSA *ncdomain.TLSAForm
+
+	// If set, fields of the original domain name specification which have
+	// since been replaced are ignored rather than translated.
+	IgnoreLegacyFields bool
+
+	// If set, onion services given by "tor" fields aren't published.
+	OmitTorRecords bool
+
+	// The DNSSEC algorithms which DS records may name. If nil,
+	// ncdomain.DefaultDSAlgorithms is used.
+	DSAlgorithms []uint8
+
+	// If set, DS records naming other algorithms are published anyway.
+	AllowUnknownDSAlgorithms bool
+
+	// Values larger than this percentage of namecoin.ConsensusMaxValueSize
+	// are warned about when parsed. Zero disables the warning.
+	ValueSizeWarnPercent int
+
+	// If set, called to fetch the JSON which values include with
+	// "include_url" statements; see ncdomain.ParseOptions.FetchURL. If nil,
+	// they're ignored with a warning.
+	FetchURL func(url string) (string, error)
+
+	// If set, called with each error or warning found parsing the value of
+	// a name. Parsed values are cached, so this is called when a value is
+	// first served, and again only once it has dropped out of the cache, or
+	// for a traced lookup.
+	Problem func(name string, err error, isWarning bool)
+
+	// Number of blocks after a name expires during which it continues to be
+	// served, with a shortened TTL. Zero means expired names are treated as
+	// nonexistent as soon as they expire.
+	ServeExpiredNamesFor int
+
+	// Time after a name fails to be fetched at which it is fetched again in
+	// the background. Zero disables retries.
+	FailureRetryDelay time.Duration
+
+	// Time for which the names emptied from the name caches by FlushCache
+	// are kept, so that a lookup of one which then fails to be fetched again
+	// (e.g. as namecoind is restarting) is answered from what it was before,
+	// as RFC 8767 describes, with TTLs of at most StaleTTL. The name is
+	// fetched again in the background if FailureRetryDelay is set. Names
+	// which namecoind says don't exist are never answered from stale data.
+	// Zero disables this.
+	StaleAnswerTTL time.Duration
+
+	// The most names fetched at once, e.g. by name_show calls to namecoind,
+	// so that a flood of queries for names which aren't cached doesn't
+	// exhaust namecoind's RPC threads. Zero means no limit. Up to
+	// MaxQueuedLookups more fetches wait for one to finish; beyond that,
+	// they fail at once with ErrLookupsSaturated. Lookups of a name being
+	// fetched wait for that fetch rather than making another, whatever the
+	// limits.
+	MaxConcurrentLookups int
+	MaxQueuedLookups     int
+
+	// Time after which a fetch of a name fails, including any time spent
+	// waiting for one of MaxConcurrentLookups. Zero means only the Fetcher's
+	// own timeout applies. A fetch which no lookup is waiting for any more
+	// is cancelled, through the context passed to the Fetcher.
+	LookupTimeout time.Duration
 
 	// Hostmaster in e. mail form (e.g. "hostmaster@example.com").
 	Hostmaster string
@@ -62,9 +278,29 @@ func New(cfg *Config) (backend *Backend, err error) {
 	b := &Backend{}
 
 	b.cfg = *cfg
-	b.nc = b.cfg.NamecoinConn
+	b.fetcher = b.cfg.Fetcher
+	if b.fetcher == nil {
+		b.fetcher = NewNamecoinFetcher(b.cfg.NamecoinConn, time.Duration(b.cfg.NamecoinTimeout)*time.Millisecond)
+	}
 
-	b.caches = make(map[string]*lru.Cache)
+	b.caches = make(map[string]*nameCache)
+	b.parseCaches = make(map[string]*parseCache)
+	if b.cfg.NegativeCacheMaxEntries > 0 {
+		b.negativeCaches = make(map[string]*negativeCache)
+	}
+	if b.cfg.StaleAnswerTTL > 0 {
+		b.staleCaches = make(map[string]*staleCache)
+	}
+	if b.cfg.AdaptiveTTL {
+		if b.cfg.AdaptiveMinTTL > b.cfg.AdaptiveMaxTTL {
+			return nil, fmt.Errorf("AdaptiveMinTTL is greater than AdaptiveMaxTTL")
+		}
+		if b.cfg.AdaptiveTTLBlocks <= 0 {
+			b.cfg.AdaptiveTTLBlocks = DefaultAdaptiveTTLBlocks
+		}
+		b.valueAges = make(map[string]*valueAgeCache)
+	}
+	b.clock = clock.Or(b.cfg.Clock)
 
 	hostmaster, err := convertEmail(b.cfg.Hostmaster)
 	if err != nil {
@@ -72,6 +308,34 @@ func New(cfg *Config) (backend *Backend, err error) {
 	}
 	b.cfg.Hostmaster = hostmaster
 
+	b.selfName = relativeSelfName(b.cfg.SelfName)
+	b.apexRecords = mergeApexRecords(b.cfg.VanityIPs, b.cfg.ApexRecords)
+
+	if b.cfg.ApexTTL == 0 {
+		b.cfg.ApexTTL = DefaultApexTTL
+	}
+	if b.cfg.SOARefresh == 0 {
+		b.cfg.SOARefresh = DefaultSOARefresh
+	}
+	if b.cfg.SOARetry == 0 {
+		b.cfg.SOARetry = DefaultSOARetry
+	}
+	if b.cfg.SOAExpire == 0 {
+		b.cfg.SOAExpire = DefaultSOAExpire
+	}
+	if b.cfg.SOAMinTTL == 0 {
+		b.cfg.SOAMinTTL = DefaultSOAMinTTL
+	}
+
+	if b.cfg.FailureRetryDelay > 0 {
+		b.retrier = newRetrier(b, b.cfg.FailureRetryDelay)
+	}
+
+	if b.cfg.MaxConcurrentLookups > 0 {
+		b.lookupSem = make(chan struct{}, b.cfg.MaxConcurrentLookups)
+	}
+	b.flights = make(map[flightKey]*flight)
+
 	backend = b
 
 	return
@@ -100,26 +364,68 @@ func convertEmail(email string) (string, error) {
 	return dns.Fqdn(parts[0] + "." + parts[1]), nil
 }
 
+// Returns an error if the backend isn't ready to answer queries yet.
+func (b *Backend) Ready() error {
+	return lookupReadyError()
+}
+
 // Do low-level queries against an abstract zone file. This is the per-query
-// entrypoint from madns.
+// entrypoint from madns, which has no context to give, so it's LookupContext
+// with context.Background().
 func (b *Backend) Lookup(qname, streamIsolationID string) (rrs []dns.RR, err error) {
+	return b.LookupContext(context.Background(), qname, streamIsolationID)
+}
+
+// Like Lookup, but any spans created while processing the query are children
+// of the span in ctx, and the steps taken are recorded to the LookupTrace in
+// ctx, if any. Once ctx is done, e.g. as the query is abandoned, the lookup
+// stops waiting for the names it fetches and fails. The work done is spent from
+// the WorkBudget in ctx, if any; a lookup which would exceed it fails with
+// ErrWorkBudgetExhausted.
+func (b *Backend) LookupContext(ctx context.Context, qname, streamIsolationID string) (rrs []dns.RR, err error) {
 	err = lookupReadyError()
 	if err != nil {
 		return
 	}
 
+	trace := lookupTraceFrom(ctx)
+	trace.Add(TraceStep{Step: "lookup", Name: qname})
+
+	stage, optional := workBudgetFrom(ctx).lookupStage(qname)
+	err = spendWork(ctx, stage, qname, WorkUsage{Lookups: 1}, optional)
+	if err != nil {
+		return
+	}
+
 	btx := &btx{}
 	btx.b = b
+	btx.ctx = ctx
+	btx.trace = trace
 	btx.qname = qname
 	btx.streamIsolationID = streamIsolationID
-	return btx.Do()
+	rrs, err = btx.Do()
+	if err == nil && workBudgetFrom(ctx) != nil {
+		if err = spendWork(ctx, stage, qname, WorkUsage{Bytes: rrsBytes(rrs)}, optional); err != nil {
+			rrs = nil
+		}
+	}
+
+	if trace != nil {
+		trace.addResult(TraceStep{Step: "answer", Name: qname, Records: traceRRs(rrs)}, err)
+	}
+	return
 }
 
 // Things to keep track of while processing a query.
 type btx struct {
 	b     *Backend
+	ctx   context.Context
 	qname string
 
+	// The trace the steps of the lookup are recorded to, or nil, so that
+	// untraced lookups needn't even build them.
+	trace *LookupTrace
+
 	streamIsolationID string
 
 	subname, basename, rootname string
@@ -149,11 +455,15 @@ func (tx *btx) Do() (rrs []dns.RR, err error) {
 		return tx.doRootDomain()
 	}
 
+	if tx.isSelfName() {
+		return tx.doSelfName()
+	}
+
 	// Where ncdns has not been configured with a hostname to identify itself by,
-	// it generates one under a special meta domain "x--nmc". This domain is not
-	// a valid Namecoin domain name, so it does not confict with the Namecoin
-	// domain name namespace.
-	if tx.basename == "x--nmc" && len(tx.b.cfg.CanonicalNameservers) == 0 {
+	// it generates one under a special meta domain, "x--nmc" by default. This
+	// domain is not a valid Namecoin domain name, so it does not confict with
+	// the Namecoin domain name namespace.
+	if strings.EqualFold(tx.basename, tx.b.metaLabel()) && len(tx.b.cfg.CanonicalNameservers) == 0 {
 		return tx.doMetaDomain()
 	}
 
@@ -163,38 +473,52 @@ func (tx *btx) Do() (rrs []dns.RR, err error) {
 }
 
 func (tx *btx) determineDomain() (subname, basename, rootname string, err error) {
-	return util.SplitDomainByFloatingAnchor(tx.qname, "bit")
+	// Names are case-insensitive, but Namecoin names are in lower case.
+	return util.SplitDomainByFloatingAnchor(strings.ToLower(tx.qname), "bit")
 }
 
+// The TTL of the SOA and NS records at the zone apex if Config.ApexTTL isn't
+// set.
+const DefaultApexTTL = 86400
+
+// The fields of the SOA record at the zone apex if the Config fields setting
+// them aren't set.
+const (
+	DefaultSOARefresh = 600
+	DefaultSOARetry   = 600
+	DefaultSOAExpire  = 7200
+	DefaultSOAMinTTL  = 600
+)
+
 func (tx *btx) doRootDomain() (rrs []dns.RR, err error) {
 	nss := tx.b.cfg.CanonicalNameservers
 	if len(tx.b.cfg.CanonicalNameservers) == 0 {
-		nss = []string{dns.Fqdn("this.x--nmc." + tx.rootname)}
+		nss = []string{tx.b.selfHostname(tx.rootname)}
 	}
 
 	soa := &dns.SOA{
 		Hdr: dns.RR_Header{
 			Name:   dns.Fqdn(tx.rootname),
-			Ttl:    86400,
+			Ttl:    tx.b.cfg.ApexTTL,
 			Class:  dns.ClassINET,
 			Rrtype: dns.TypeSOA,
 		},
 		Ns:      nss[0],
 		Mbox:    tx.b.cfg.Hostmaster,
-		Serial:  1,
-		Refresh: 600,
-		Retry:   600,
-		Expire:  7200,
-		Minttl:  600,
+		Serial:  tx.b.soaSerial(),
+		Refresh: tx.b.cfg.SOARefresh,
+		Retry:   tx.b.cfg.SOARetry,
+		Expire:  tx.b.cfg.SOAExpire,
+		Minttl:  tx.b.cfg.SOAMinTTL,
 	}
 
-	rrs = make([]dns.RR, 0, 1+len(nss)+len(tx.b.cfg.VanityIPs))
+	rrs = make([]dns.RR, 0, 1+len(nss)+len(tx.b.apexRecords))
 	rrs = append(rrs, soa)
 	for _, cn := range nss {
 		ns := &dns.NS{
 			Hdr: dns.RR_Header{
 				Name:   dns.Fqdn(tx.rootname),
-				Ttl:    86400,
+				Ttl:    tx.b.cfg.ApexTTL,
 				Class:  dns.ClassINET,
 				Rrtype: dns.TypeNS,
 			},
@@ -204,54 +528,31 @@ func (tx *btx) doRootDomain() (rrs []dns.RR, err error) {
 		rrs = append(rrs, ns)
 	}
 
-	for _, ip := range tx.b.cfg.VanityIPs {
-		if ip.To4() != nil {
-			a := &dns.A{
-				Hdr: dns.RR_Header{
-					Name:   dns.Fqdn(tx.rootname),
-					Ttl:    86400,
-					Class:  dns.ClassINET,
-					Rrtype: dns.TypeA,
-				},
-				A: ip,
-			}
-			rrs = append(rrs, a)
-		} else {
-			a := &dns.AAAA{
-				Hdr: dns.RR_Header{
-					Name:   dns.Fqdn(tx.rootname),
-					Ttl:    86400,
-					Class:  dns.ClassINET,
-					Rrtype: dns.TypeAAAA,
-				},
-				AAAA: ip,
-			}
-			rrs = append(rrs, a)
-		}
-	}
-
+	rrs = append(rrs, tx.apexRecords()...)
 	return
 }
 
-func (tx *btx) doMetaDomain() (rrs []dns.RR, err error) {
-	ip := net.ParseIP(tx.b.cfg.SelfIP)
-	if ip == nil || ip.To4() == nil {
-		return nil, fmt.Errorf("invalid value specified for SelfIP")
+// The label of the meta domain if Config.MetaLabel isn't set.
+const DefaultMetaLabel = "x--nmc"
+
+func (b *Backend) metaLabel() string {
+	if b.cfg.MetaLabel == nil {
+		return DefaultMetaLabel
 	}
+	return b.cfg.MetaLabel()
+}
 
-	switch tx.subname {
+func (b *Backend) soaSerial() uint32 {
+	if b.cfg.SOASerial == nil {
+		return 1
+	}
+	return b.cfg.SOASerial()
+}
+
+func (tx *btx) doMetaDomain() (rrs []dns.RR, err error) {
+	switch strings.ToLower(tx.subname) {
 	case "this":
-		rrs = []dns.RR{
-			&dns.A{
-				Hdr: dns.RR_Header{
-					Name:   dns.Fqdn("this." + tx.basename + "." + tx.rootname),
-					Ttl:    86400,
-					Class:  dns.ClassINET,
-					Rrtype: dns.TypeA,
-				},
-				A: ip,
-			},
-		}
+		return tx.doSelfName()
 	case "aia":
 		// TODO: Make AIA address configurable (currently hardcoded to "this.x--nmc.bit")
 		rrs = []dns.RR{
@@ -273,30 +574,131 @@ func (tx *btx) doMetaDomain() (rrs []dns.RR, err error) {
 }
 
 func (tx *btx) doUserDomain() (rrs []dns.RR, err error) {
-	ncname, err := util.BasenameToNamecoinKey(tx.basename)
+	ncname, subPath, err := util.QnameToNamecoinKey(tx.qname, tx.rootname)
+	if err == util.ErrInvalidDomainName {
+		// No Namecoin name can be registered for it.
+		return nil, merr.ErrNoSuchDomain
+	}
 	if err != nil {
 		return
 	}
 
-	d, err := tx.b.getNamecoinEntry(ncname, tx.streamIsolationID)
+	d, nameData, stale, err := tx.b.getNamecoinEntry(tx.ctx, ncname, tx.streamIsolationID)
+	if err != nil {
+		return nil, err
+	}
+
+	rrs, err = tx.doUnderDomain(d, subPath)
+	if err != nil {
+		return nil, err
+	}
+
+	tx.b.setNameTTLs(rrs, ncname, tx.streamIsolationID, nameData)
+	if len(d.failedImports) > 0 {
+		if tx.trace != nil {
+			tx.trace.Add(TraceStep{Step: "partial", Name: ncname, Detail: strings.Join(d.failedImports, ",")})
+		}
+		if tx.b.cfg.PartialResultTTL != 0 {
+			capTTLs(rrs, tx.b.cfg.PartialResultTTL)
+		}
+	}
+	if stale {
+		capTTLs(rrs, StaleTTL)
+	}
+	return rrs, nil
+}
+
+// Returns the records of a Namecoin name (e.g. "d/example") and of the names
+// under it, as they're served, given its data, e.g. as found by walking all
+// the names for a zone transfer. rootname is the apex of the zone (e.g.
+// "bit."). Records below a delegation are left out, but for glue. If the name
+// isn't served, e.g. because it has expired, the error is
+// merr.ErrNoSuchDomain.
+func (b *Backend) NameRecords(ctx context.Context, ncname string, nameData *namecoin.NameData, rootname string) ([]dns.RR, error) {
+	basename, err := util.NamecoinKeyToBasename(ncname)
+	if err != nil || !b.servable(nameData) {
+		return nil, merr.ErrNoSuchDomain
+	}
+
+	d, err := b.jsonToDomain(ctx, ncname, nameData.Value, "")
 	if err != nil {
 		return nil, err
 	}
 
-	rrs, err = tx.doUnderDomain(d)
+	name := dns.Fqdn(basename + "." + strings.TrimSuffix(rootname, "."))
+	rrs, err := d.ncv.RRsRecursive(nil, name, name)
 	if err != nil {
 		return nil, err
 	}
 
+	b.setNameTTLs(rrs, ncname, "", nameData)
 	return rrs, nil
 }
 
+// Returns true if the name is to be served. Expired names are only served
+// within the ServeExpiredNamesFor grace period.
+func (b *Backend) servable(nameData *namecoin.NameData) bool {
+	return !nameData.Expired || expiredFor(nameData) < b.cfg.ServeExpiredNamesFor
+}
+
+// Returns the number of blocks since an expired name expired.
+func expiredFor(nameData *namecoin.NameData) int {
+	if nameData.ExpiresIn > 0 {
+		return 0
+	}
+	return -int(nameData.ExpiresIn)
+}
+
+// If the name a query falls under is an expired name being served within the
+// grace period, returns the name and the number of blocks since it expired.
+// Only names already in the cache are considered, so this never fetches
+// anything.
+func (b *Backend) ExpiredName(qname, streamIsolationID string) (ncname string, blocksAgo int, ok bool) {
+	_, _, rootname, err := util.SplitDomainByFloatingAnchor(strings.ToLower(qname), "bit")
+	if err != nil {
+		return "", 0, false
+	}
+
+	ncname, _, err = util.QnameToNamecoinKey(qname, rootname)
+	if err != nil || ncname == "" {
+		return "", 0, false
+	}
+
+	nameData := b.resolveNameCache(ncname, streamIsolationID)
+	if nameData == nil || !nameData.Expired || !b.servable(nameData) {
+		return "", 0, false
+	}
+
+	return ncname, expiredFor(nameData), true
+}
+
 // Keep domains in parsed format.
 type domain struct {
 	ncv *ncdomain.Value
+
+	// The names imported by the value which couldn't be fetched, e.g. as
+	// namecoind failed, and whose records are therefore missing. Only values
+	// which don't import are parse cached, so a domain with these is never
+	// cached.
+	failedImports []string
 }
 
-func (b *Backend) resolveNameCache(name, streamIsolationID string) *string {
+func containsString(a []string, s string) bool {
+	for _, x := range a {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
+
+// CachedNameData returns the data of a name as cached, or nil if it isn't, e.g.
+// because it doesn't exist.
+func (b *Backend) CachedNameData(ncname, streamIsolationID string) *namecoin.NameData {
+	return b.resolveNameCache(ncname, streamIsolationID)
+}
+
+func (b *Backend) resolveNameCache(name, streamIsolationID string) *namecoin.NameData {
 	b.cacheMutex.Lock()
 	defer b.cacheMutex.Unlock()
 
@@ -305,103 +707,749 @@ func (b *Backend) resolveNameCache(name, streamIsolationID string) *string {
 		return nil
 	}
 
-	if dd, ok := cache.Get(name); ok {
-		v := dd.(*string)
-
+	if v, ok := cache.Get(name); ok {
 		return v
 	}
 
 	return nil
 }
 
-func (b *Backend) addNamecoinJSONToCache(name string, jsonValue *string, streamIsolationID string) {
+// Returns the generation of the name caches, to be passed to
+// addNamecoinJSONToCache or addNonexistentToCache along with what's fetched
+// after calling it.
+func (b *Backend) currentCacheGeneration() uint64 {
 	b.cacheMutex.Lock()
 	defer b.cacheMutex.Unlock()
 
+	return b.cacheGeneration
+}
+
+// Caches nameData, which was fetched during the given generation of the name
+// caches. If they've been flushed since, e.g. because the name changed in a
+// new block, it may be stale and isn't cached.
+func (b *Backend) addNamecoinJSONToCache(name string, nameData *namecoin.NameData, streamIsolationID string, generation uint64) {
+	b.cacheMutex.Lock()
+	defer b.cacheMutex.Unlock()
+
+	if generation != b.cacheGeneration {
+		return
+	}
+
 	cache, ok := b.caches[streamIsolationID]
 	if !ok {
-		b.caches[streamIsolationID] = &lru.Cache{
-			MaxEntries: b.cfg.CacheMaxEntries,
+		cache = newNameCache(b.cfg.CacheMaxEntries, b.cfg.CacheMaxBytes)
+		cache.clock = b.clock
+		b.caches[streamIsolationID] = cache
+	}
+
+	cache.Add(name, nameData)
+	if neg := b.negativeCaches[streamIsolationID]; neg != nil {
+		neg.Remove(name)
+	}
+	if stale := b.staleCaches[streamIsolationID]; stale != nil {
+		stale.Remove(name)
+	}
+}
+
+// A name held in the name cache, e.g. to be saved across a restart.
+type CachedName struct {
+	StreamIsolationID string
+	Name              string
+	NameData          namecoin.NameData
+	Added             time.Time // when it was fetched
+}
+
+// CachedNames returns the names held in the name caches of all stream
+// isolation IDs, those of each cache from the least recently used to the
+// most.
+func (b *Backend) CachedNames() (names []CachedName) {
+	b.cacheMutex.Lock()
+	defer b.cacheMutex.Unlock()
+
+	for id, cache := range b.caches {
+		cache.each(func(e *cacheEntry) {
+			names = append(names, CachedName{
+				StreamIsolationID: id,
+				Name:              e.key,
+				NameData:          *e.value.(cachedNameData).NameData,
+				Added:             e.added,
+			})
+		})
+	}
+	return names
+}
+
+// CacheGeneration returns the generation of the name caches, which is
+// incremented whenever they're flushed, to be passed to RestoreCachedNames.
+func (b *Backend) CacheGeneration() uint64 {
+	return b.currentCacheGeneration()
+}
+
+// RestoreCachedNames adds names, as returned by CachedNames, to the name
+// caches, and returns how many were added. Names already cached are kept, as
+// they were fetched since. Nothing is added if the caches have been flushed
+// since the given generation, e.g. because of a new block.
+func (b *Backend) RestoreCachedNames(names []CachedName, generation uint64) int {
+	b.cacheMutex.Lock()
+	defer b.cacheMutex.Unlock()
+
+	if generation != b.cacheGeneration {
+		return 0
+	}
+
+	n := 0
+	for i := range names {
+		cn := &names[i]
+		cache, ok := b.caches[cn.StreamIsolationID]
+		if !ok {
+			cache = newNameCache(b.cfg.CacheMaxEntries, b.cfg.CacheMaxBytes)
+			cache.clock = b.clock
+			b.caches[cn.StreamIsolationID] = cache
+		}
+		if _, ok := cache.items[cn.Name]; ok {
+			continue
+		}
+
+		nameData := cn.NameData
+		cache.addAt(cn.Name, &nameData, cn.Added)
+		n++
+	}
+	return n
+}
+
+// Returns whether name is known not to exist.
+func (b *Backend) resolveNegativeCache(name, streamIsolationID string) bool {
+	b.cacheMutex.Lock()
+	defer b.cacheMutex.Unlock()
+
+	neg, ok := b.negativeCaches[streamIsolationID]
+	return ok && neg.Get(name)
+}
+
+// Remembers that name doesn't exist, as namecoind said during the given
+// generation of the name caches. Does nothing if negative caching is
+// disabled, or if the caches have been flushed since, as the name may have
+// been registered in the new block.
+func (b *Backend) addNonexistentToCache(name, streamIsolationID string, generation uint64) {
+	b.cacheMutex.Lock()
+	defer b.cacheMutex.Unlock()
+
+	if b.negativeCaches == nil || generation != b.cacheGeneration {
+		return
+	}
+
+	neg, ok := b.negativeCaches[streamIsolationID]
+	if !ok {
+		neg = newNegativeCache(b.cfg.NegativeCacheMaxEntries, b.cfg.NegativeCacheTTL)
+		neg.clock = b.clock
+		b.negativeCaches[streamIsolationID] = neg
+	}
+
+	neg.Add(name)
+	if cache := b.caches[streamIsolationID]; cache != nil {
+		cache.Remove(name)
+	}
+}
+
+// Returns the stale data of name, kept since the name caches were last
+// flushed, or nil if there is none, and whether this is the first time it's
+// been answered from.
+func (b *Backend) resolveStaleCache(name, streamIsolationID string) (nameData *namecoin.NameData, first bool) {
+	b.cacheMutex.Lock()
+	defer b.cacheMutex.Unlock()
+
+	stale, ok := b.staleCaches[streamIsolationID]
+	if !ok {
+		return nil, false
+	}
+
+	sd := stale.Get(name)
+	if sd == nil {
+		return nil, false
+	}
+
+	first = !sd.served
+	sd.served = true
+	return sd.NameData, first
+}
+
+// Forgets the stale data of name, which namecoind has said doesn't exist, so
+// that it's never answered from, whether or not negative caching is enabled.
+func (b *Backend) removeStale(name, streamIsolationID string) {
+	b.cacheMutex.Lock()
+	defer b.cacheMutex.Unlock()
+
+	if stale := b.staleCaches[streamIsolationID]; stale != nil {
+		stale.Remove(name)
+	}
+}
+
+// Number of entries evicted from each cache at a time, with cacheMutex held,
+// when SetCacheParams shrinks the caches.
+const cacheShrinkBatch = 1000
+
+// The parameters of the caches which may be changed while the backend is in
+// use, as in Config.
+type CacheParams struct {
+	MaxEntries         int
+	MaxBytes           int
+	NegativeMaxEntries int
+	NegativeTTL        time.Duration
+}
+
+func (b *Backend) CacheParams() CacheParams {
+	b.cacheMutex.Lock()
+	defer b.cacheMutex.Unlock()
+
+	return CacheParams{
+		MaxEntries:         b.cfg.CacheMaxEntries,
+		MaxBytes:           b.cfg.CacheMaxBytes,
+		NegativeMaxEntries: b.cfg.NegativeCacheMaxEntries,
+		NegativeTTL:        b.cfg.NegativeCacheTTL,
+	}
+}
+
+// Changes the parameters of the caches, keeping what they hold. Caches
+// over their new bounds are shrunk by evicting their least recently used
+// entries a batch at a time, so that queries aren't held up meanwhile;
+// setting NegativeMaxEntries to zero drops the negative caches, as it
+// disables them. A new NegativeTTL applies to names added from then on.
+func (b *Backend) SetCacheParams(p CacheParams) {
+	b.cacheMutex.Lock()
+	b.cfg.CacheMaxEntries = p.MaxEntries
+	b.cfg.CacheMaxBytes = p.MaxBytes
+	b.cfg.NegativeCacheMaxEntries = p.NegativeMaxEntries
+	b.cfg.NegativeCacheTTL = p.NegativeTTL
+	if p.NegativeMaxEntries == 0 {
+		b.negativeCaches = nil
+	} else if b.negativeCaches == nil {
+		b.negativeCaches = make(map[string]*negativeCache)
+	}
+	b.cacheMutex.Unlock()
+
+	for !b.boundCaches(cacheShrinkBatch) {
+	}
+}
+
+// Applies the bounds of the configuration to the caches, evicting at most n
+// entries from each. Returns true once they're all within them.
+func (b *Backend) boundCaches(n int) bool {
+	b.cacheMutex.Lock()
+	defer b.cacheMutex.Unlock()
+
+	done := true
+	for _, cache := range b.caches {
+		done = cache.SetBounds(b.cfg.CacheMaxEntries, b.cfg.CacheMaxBytes, n) && done
+	}
+	for _, cache := range b.parseCaches {
+		done = cache.SetBounds(b.cfg.CacheMaxEntries, b.cfg.CacheMaxBytes, n) && done
+	}
+	for _, cache := range b.negativeCaches {
+		cache.ttl = b.cfg.NegativeCacheTTL
+		done = cache.SetBounds(b.cfg.NegativeCacheMaxEntries, 0, n) && done
+	}
+	for _, cache := range b.staleCaches {
+		done = cache.SetBounds(b.cfg.CacheMaxEntries, b.cfg.CacheMaxBytes, n) && done
+	}
+	return done
+}
+
+// Counts of the lookups of names in the name caches since the backend was
+// created.
+type CacheStats struct {
+	Hits   uint64 `json:"hits"`
+	Misses uint64 `json:"misses"`
+
+	// Lookups of names found in the negative caches, answered NXDOMAIN
+	// without asking namecoind. These are counted as misses of the name
+	// caches too.
+	NegativeHits uint64 `json:"negative_hits"`
+
+	// Lookups of names which failed to be fetched, answered from their
+	// data as it was before the name caches were last flushed (see
+	// StaleAnswerTTL).
+	StaleAnswers uint64 `json:"stale_answers"`
+}
+
+func (b *Backend) CacheStats() CacheStats {
+	return CacheStats{
+		Hits:         atomic.LoadUint64(&b.cacheHits),
+		Misses:       atomic.LoadUint64(&b.cacheMisses),
+		NegativeHits: atomic.LoadUint64(&b.negativeCacheHits),
+		StaleAnswers: atomic.LoadUint64(&b.staleAnswers),
+	}
+}
+
+// Returns the approximate number of bytes currently used by the name caches
+// of all stream isolation IDs.
+func (b *Backend) CacheBytes() int {
+	b.cacheMutex.Lock()
+	defer b.cacheMutex.Unlock()
+
+	n := 0
+	for _, cache := range b.caches {
+		n += cache.Bytes()
+	}
+
+	return n
+}
+
+// The numbers of entries in the caches, summed over all stream isolation IDs.
+type CacheSizes struct {
+	Names         int `json:"names"`
+	ParsedValues  int `json:"parsed_values"`
+	NegativeNames int `json:"negative_names"`
+	StaleNames    int `json:"stale_names"`
+}
+
+func (b *Backend) CacheSizes() CacheSizes {
+	b.cacheMutex.Lock()
+	defer b.cacheMutex.Unlock()
+
+	var sizes CacheSizes
+	for _, cache := range b.caches {
+		sizes.Names += cache.Len()
+	}
+	for _, cache := range b.parseCaches {
+		sizes.ParsedValues += cache.Len()
+	}
+	for _, cache := range b.negativeCaches {
+		sizes.NegativeNames += cache.Len()
+	}
+	for _, cache := range b.staleCaches {
+		sizes.StaleNames += cache.Len()
+	}
+	return sizes
+}
+
+// Returns the approximate numbers of bytes used by the entries of the caches,
+// summed over all stream isolation IDs, as they are counted against
+// CacheMaxBytes. A parsed value is estimated from the records it gives.
+func (b *Backend) CacheByteSizes() CacheSizes {
+	b.cacheMutex.Lock()
+	defer b.cacheMutex.Unlock()
+
+	var sizes CacheSizes
+	for _, cache := range b.caches {
+		sizes.Names += cache.Bytes()
+	}
+	for _, cache := range b.parseCaches {
+		sizes.ParsedValues += cache.Bytes()
+	}
+	for _, cache := range b.negativeCaches {
+		sizes.NegativeNames += cache.Bytes()
+	}
+	for _, cache := range b.staleCaches {
+		sizes.StaleNames += cache.Bytes()
+	}
+	return sizes
+}
+
+// Empties the name caches and negative caches of all stream isolation IDs,
+// so that names are fetched again, e.g. once a new block may have changed
+// them. Parsed values are kept, since they're keyed by the values themselves.
+// Fetches already under way when this is called aren't cached. If
+// StaleAnswerTTL is set, the names emptied are kept for that long, to answer
+// from should they fail to be fetched again.
+func (b *Backend) FlushCache() {
+	b.cacheMutex.Lock()
+	defer b.cacheMutex.Unlock()
+
+	if b.staleCaches != nil {
+		expires := b.clock.Now().Add(b.cfg.StaleAnswerTTL)
+		for id, cache := range b.caches {
+			stale, ok := b.staleCaches[id]
+			if !ok {
+				stale = newStaleCache(b.cfg.CacheMaxEntries, b.cfg.CacheMaxBytes)
+				stale.clock = b.clock
+				b.staleCaches[id] = stale
+			}
+			stale.addFrom(cache, expires)
+		}
+	}
+
+	b.caches = make(map[string]*nameCache)
+	b.flushNegativeCache()
+}
+
+// Empties the negative caches of all stream isolation IDs, so that names
+// which didn't exist are fetched again, e.g. once a new block may have
+// registered them. Names which exist stay cached.
+func (b *Backend) FlushNegativeCache() {
+	b.cacheMutex.Lock()
+	defer b.cacheMutex.Unlock()
+
+	b.flushNegativeCache()
+}
+
+func (b *Backend) flushNegativeCache() {
+	if b.negativeCaches != nil {
+		b.negativeCaches = make(map[string]*negativeCache)
+	}
+	b.cacheGeneration++
+}
+
+// Evicts the entries of the name caches and of the caches of parsed values
+// which haven't been used for CacheIdleEviction, and returns how many there
+// were. The caches of stream isolation IDs which are left empty are dropped
+// altogether. Names queried once would otherwise stay cached until pushed
+// out by others, which with generous limits may be never. Does nothing if
+// CacheIdleEviction is zero.
+func (b *Backend) EvictIdle() int {
+	if b.cfg.CacheIdleEviction <= 0 {
+		return 0
+	}
+
+	b.cacheMutex.Lock()
+	defer b.cacheMutex.Unlock()
+
+	before := b.clock.Now().Add(-b.cfg.CacheIdleEviction)
+	n := 0
+	for id, cache := range b.caches {
+		n += cache.EvictIdle(before)
+		if cache.Len() == 0 {
+			delete(b.caches, id)
+		}
+	}
+	for id, cache := range b.parseCaches {
+		n += cache.EvictIdle(before)
+		if cache.Len() == 0 {
+			delete(b.parseCaches, id)
+		}
+	}
+	for id, cache := range b.negativeCaches {
+		n += cache.EvictIdle(before)
+		if cache.Len() == 0 {
+			delete(b.negativeCaches, id)
 		}
-		cache = b.caches[streamIsolationID]
 	}
 
-	cache.Add(name, jsonValue)
+	return n
+}
+
+// NameData returns the data of a Namecoin name as lookups get it: from the name
+// cache, or else fetched, sharing any fetch of it already in progress, and
+// cached. Unlike lookups, it returns names which have expired even once past
+// the grace period, with Expired set; ErrNoSuchDomain means the name doesn't
+// exist.
+//
+// Anything else needing a name's value, such as the webserver's lookups,
+// should get it this way, so that a name being looked up both over DNS and
+// otherwise is fetched only once.
+//
+// Like lookups, it returns a name's stale data if the name fails to be
+// fetched and StaleAnswerTTL kept some.
+func (b *Backend) NameData(ctx context.Context, name, streamIsolationID string) (*namecoin.NameData, error) {
+	ctx, span := tracing.Start(ctx, "backend.fetch")
+	defer span.End()
+	span.SetAttribute("namecoin.name", name)
+
+	v, _, err := b.nameData(ctx, span, name, streamIsolationID)
+	return v, err
+}
+
+// Returns the parsed value of a name, and its data, e.g. whether it has
+// expired (in which case it is within the grace period), and whether the data
+// is stale, as the name couldn't be fetched.
+func (b *Backend) getNamecoinEntry(ctx context.Context, name, streamIsolationID string) (*domain, *namecoin.NameData, bool, error) {
+	if err := spendWork(ctx, "fetch", name, WorkUsage{Fetches: 1}, false); err != nil {
+		return nil, nil, false, err
+	}
+
+	ctx, span := tracing.Start(ctx, "backend.fetch")
+	defer span.End()
+	span.SetAttribute("namecoin.name", name)
+
+	v, stale, err := b.nameData(ctx, span, name, streamIsolationID)
+	if err != nil {
+		return nil, nil, false, err
+	}
+
+	if !b.servable(v) {
+		span.SetAttribute("namecoin.expired", true)
+		lookupTraceFrom(ctx).Add(TraceStep{Step: "expired", Name: name, Detail: "past the grace period"})
+		return nil, nil, false, merr.ErrNoSuchDomain
+	}
+
+	d, err := b.jsonToDomain(ctx, name, v.Value, streamIsolationID)
+	if err != nil {
+		span.SetError(err)
+		return nil, nil, false, err
+	}
+
+	return d, v, stale, nil
 }
 
-func (b *Backend) getNamecoinEntry(name, streamIsolationID string) (*domain, error) {
+// Returns the data of a name from the cache, or else fetches and caches it,
+// recording to span whether it was cached. If it fails to be fetched, other
+// than because it doesn't exist, its stale data is returned if there is any,
+// with stale set.
+func (b *Backend) nameData(ctx context.Context, span tracing.Span, name, streamIsolationID string) (nameData *namecoin.NameData, stale bool, err error) {
 	// Try the cache first
 	v := b.resolveNameCache(name, streamIsolationID)
+	cacheStatus := "hit"
 
 	// If the cache misses, resolve it via namecoind
 	if v == nil {
-		vv, err := b.resolveName(name, streamIsolationID)
+		cacheStatus = "miss"
+		atomic.AddUint64(&b.cacheMisses, 1)
+		lookupTraceFrom(ctx).Add(TraceStep{Step: "cache", Name: name, Detail: cacheStatus})
+
+		if b.resolveNegativeCache(name, streamIsolationID) {
+			atomic.AddUint64(&b.negativeCacheHits, 1)
+			lookupTraceFrom(ctx).Add(TraceStep{Step: "negative_cache", Name: name, Detail: "hit"})
+			span.SetAttribute("ncdns.negative_cache", "hit")
+			tracing.SetRootAttribute(ctx, "ncdns.cache", "negative")
+			return nil, false, merr.ErrNoSuchDomain
+		}
+
+		// Only namecoind's saying the name doesn't exist is cached, not
+		// failing to ask it.
+		generation := b.currentCacheGeneration()
+		vv, err := b.resolveName(ctx, name, streamIsolationID)
+		if err == merr.ErrNoSuchDomain {
+			b.addNonexistentToCache(name, streamIsolationID, generation)
+			b.removeStale(name, streamIsolationID)
+		}
 		if err != nil {
-			return nil, err
+			if b.retrier != nil {
+				b.retrier.failed(name, streamIsolationID, err)
+			}
+			if err != merr.ErrNoSuchDomain {
+				if sv, first := b.resolveStaleCache(name, streamIsolationID); sv != nil {
+					if first {
+						log.Warne(err, "couldn't fetch ", name, "; answering from its data from before the cache was last flushed")
+					}
+					atomic.AddUint64(&b.staleAnswers, 1)
+					lookupTraceFrom(ctx).Add(TraceStep{Step: "stale", Name: name, Detail: err.Error()})
+					span.SetAttribute("ncdns.cache", "stale")
+					tracing.SetRootAttribute(ctx, "ncdns.cache", "stale")
+					return sv, true, nil
+				}
+			}
+			span.SetError(err)
+			tracing.SetRootAttribute(ctx, "ncdns.cache", cacheStatus)
+			return nil, false, err
 		}
 
-		v = &vv
-		b.addNamecoinJSONToCache(name, v, streamIsolationID)
+		// Expired names are cached too, so that they aren't fetched again
+		// on every query.
+		v = vv
+		b.addNamecoinJSONToCache(name, v, streamIsolationID, generation)
 	}
 
-	d, err := b.jsonToDomain(name, *v, streamIsolationID)
-	if err != nil {
-		return nil, err
+	if cacheStatus == "hit" {
+		atomic.AddUint64(&b.cacheHits, 1)
+		lookupTraceFrom(ctx).Add(TraceStep{Step: "cache", Name: name, Detail: cacheStatus})
 	}
-
-	return d, nil
+	span.SetAttribute("ncdns.cache", cacheStatus)
+	tracing.SetRootAttribute(ctx, "ncdns.cache", cacheStatus)
+	return v, false, nil
 }
 
-func (b *Backend) resolveName(name, streamIsolationID string) (jsonValue string, err error) {
+func (b *Backend) resolveName(ctx context.Context, name, streamIsolationID string) (nameData *namecoin.NameData, err error) {
+	ctx, span := tracing.Start(ctx, "backend.resolve")
+	defer span.End()
+	span.SetAttribute("namecoin.name", name)
+	defer func() {
+		span.SetError(err)
+	}()
+
+	if trace := lookupTraceFrom(ctx); trace != nil {
+		start := b.clock.Now()
+		defer func() {
+			step := TraceStep{Step: "fetch", Name: name, DurationMicros: micros(b.clock.Now().Sub(start))}
+			if nameData != nil {
+				step.Detail = nameData.Value
+			}
+			trace.addResult(step, err)
+		}()
+	}
+
 	if fv, ok := b.cfg.FakeNames[name]; ok {
 		if fv == "NX" {
-			return "", merr.ErrNoSuchDomain
+			return nil, merr.ErrNoSuchDomain
 		}
-		return fv, nil
-	}
-
-	// The rpcclient package has quite a long timeout, far in excess of standard
-	// DNS timeouts. We need to return an error response rapidly if we can't
-	// query the backend. Be generous with the timeout as responses from the
-	// Namecoin JSON-RPC seem sluggish sometimes.
-	result := make(chan struct{}, 1)
-	go func() {
-		jsonValue, err = b.nc.NameQuery(name, streamIsolationID)
-		log.Errore(err, "failed to query namecoin")
-		result <- struct{}{}
-	}()
+		return &namecoin.NameData{Value: fv}, nil
+	}
 
-	select {
-	case <-result:
-		return
-	case <-time.After(time.Duration(b.cfg.NamecoinTimeout) * time.Millisecond):
-		return "", fmt.Errorf("timeout")
+	if g := fetchGuardFrom(ctx); g != nil {
+		if gerr := g.AllowFetch(); gerr != nil {
+			return nil, &fetchRefusedError{gerr}
+		}
+		defer func() {
+			g.FetchDone(err)
+		}()
 	}
+
+	return b.fetch(ctx, name, streamIsolationID)
 }
 
-func (b *Backend) jsonToDomain(name, jsonValue, streamIsolationID string) (*domain, error) {
+func (b *Backend) jsonToDomain(ctx context.Context, name, jsonValue, streamIsolationID string) (*domain, error) {
+	// A traced lookup parses the value again even if it was cached, so that
+	// the trace shows what parsing it involves.
+	trace := lookupTraceFrom(ctx)
+	if d := b.resolveParseCache(name, jsonValue, streamIsolationID); d != nil {
+		if trace == nil {
+			return d, nil
+		}
+		trace.Add(TraceStep{Step: "parse_cache", Name: name, Detail: "hit, parsed again for the trace"})
+	}
+
 	d := &domain{}
 
+	// The parsed form of a value which imports or delegates to other names
+	// depends on those names too, so it can't be cached on its own value.
+	referencesOtherNames := false
 	resolveExtraIsolated := func(n string) (string, error) {
-		return b.resolveExtraName(n, streamIsolationID)
+		referencesOtherNames = true
+		v, err := b.resolveExtraName(ctx, n, streamIsolationID)
+		if err != nil && err != merr.ErrNoSuchDomain && !containsString(d.failedImports, n) {
+			d.failedImports = append(d.failedImports, n)
+			if b.retrier != nil {
+				b.retrier.failed(n, streamIsolationID, err)
+			}
+		}
+		return v, err
 	}
 
-	v := ncdomain.ParseValue(name, jsonValue, resolveExtraIsolated, nil)
+	opts := &ncdomain.ParseOptions{
+		ImportNamespaces:   b.cfg.ImportNamespaces,
+		GeneratedTLSA:      b.cfg.GeneratedTLSA,
+		IgnoreLegacyFields: b.cfg.IgnoreLegacyFields,
+		OmitTorRecords:     b.cfg.OmitTorRecords,
+
+		DSAlgorithms:             b.cfg.DSAlgorithms,
+		AllowUnknownDSAlgorithms: b.cfg.AllowUnknownDSAlgorithms,
+	}
+	if b.cfg.FetchURL != nil {
+		// A document that failed to be fetched shortens the TTL like a
+		// failed import, but isn't retried in the background, as that
+		// fetches names.
+		opts.FetchURL = func(u string) (string, error) {
+			referencesOtherNames = true
+			var v string
+			err := spendWork(ctx, "url_include", u, WorkUsage{Fetches: 1}, true)
+			if err == nil {
+				v, err = b.cfg.FetchURL(u)
+			}
+			if err != nil && !containsString(d.failedImports, u) {
+				d.failedImports = append(d.failedImports, u)
+			}
+			return v, err
+		}
+	}
+	if b.cfg.ValueSizeWarnPercent > 0 {
+		opts.MaxValueSize = namecoin.ConsensusMaxValueSize
+		opts.ValueSizeWarnPercent = b.cfg.ValueSizeWarnPercent
+	}
+	var errFunc ncdomain.ErrorFunc
+	if b.cfg.Problem != nil || trace != nil {
+		errFunc = func(err error, isWarning bool) {
+			if b.cfg.Problem != nil {
+				b.cfg.Problem(name, err, isWarning)
+			}
+			if trace == nil {
+				return
+			}
+			step := "error"
+			if isWarning {
+				step = "warning"
+			}
+			trace.Add(TraceStep{Step: step, Name: name, Detail: err.Error()})
+		}
+	}
+	if trace != nil {
+		opts.Unnormalized = func(v *ncdomain.Value) {
+			recs, err := traceRecords(v, name, true)
+			trace.addResult(TraceStep{Step: "parsed", Name: name, Records: recs}, err)
+		}
+	}
+
+	v := ncdomain.ParseValueWithOptions(name, jsonValue, resolveExtraIsolated, errFunc, opts)
 	if v == nil {
 		return nil, fmt.Errorf("couldn't parse value")
 	}
+	if trace != nil {
+		recs, err := traceRecords(v, name, false)
+		trace.addResult(TraceStep{Step: "normalized", Name: name, Records: recs}, err)
+	}
 
 	d.ncv = v
 
+	if !referencesOtherNames {
+		b.addDomainToParseCache(name, jsonValue, d, streamIsolationID)
+	}
+
 	return d, nil
 }
 
-func (b *Backend) resolveExtraName(name, streamIsolationID string) (jsonValue string, err error) {
-	return b.resolveName(name, streamIsolationID)
+func (b *Backend) resolveParseCache(name, jsonValue, streamIsolationID string) *domain {
+	b.cacheMutex.Lock()
+	defer b.cacheMutex.Unlock()
+
+	cache, ok := b.parseCaches[streamIsolationID]
+	if !ok {
+		return nil
+	}
+
+	if d, ok := cache.Get(name, jsonValue); ok {
+		return d
+	}
+
+	return nil
+}
+
+func (b *Backend) addDomainToParseCache(name, jsonValue string, d *domain, streamIsolationID string) {
+	b.cacheMutex.Lock()
+	defer b.cacheMutex.Unlock()
+
+	cache, ok := b.parseCaches[streamIsolationID]
+	if !ok {
+		cache = newParseCache(b.cfg.CacheMaxEntries, b.cfg.CacheMaxBytes)
+		cache.clock = b.clock
+		b.parseCaches[streamIsolationID] = cache
+	}
+
+	cache.Add(name, jsonValue, d)
+}
+
+// Imported names which have expired are treated like those which don't exist,
+// subject to the same grace period.
+func (b *Backend) resolveExtraName(ctx context.Context, name, streamIsolationID string) (jsonValue string, err error) {
+	// Imports are optional work: a value whose imports are left out still
+	// gives its own records, as a partial result.
+	if err := spendWork(ctx, "import", name, WorkUsage{Fetches: 1}, true); err != nil {
+		return "", err
+	}
+
+	ctx, span := tracing.Start(ctx, "backend.import")
+	defer span.End()
+	span.SetAttribute("namecoin.name", name)
+	lookupTraceFrom(ctx).Add(TraceStep{Step: "import", Name: name})
+
+	// Imported names aren't cached themselves, but one may be in the cache
+	// from a lookup of its own, or from a retry after it failed to be
+	// imported.
+	nameData := b.resolveNameCache(name, streamIsolationID)
+	if nameData != nil {
+		lookupTraceFrom(ctx).Add(TraceStep{Step: "cache", Name: name, Detail: "hit"})
+	} else {
+		nameData, err = b.resolveName(ctx, name, streamIsolationID)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	if !b.servable(nameData) {
+		return "", merr.ErrNoSuchDomain
+	}
+
+	return nameData.Value, nil
 }
 
-func (tx *btx) doUnderDomain(d *domain) (rrs []dns.RR, err error) {
-	rrs, err = tx.addAnswersUnderNCValue(d.ncv, tx.subname)
+func (tx *btx) doUnderDomain(d *domain, subPath []string) (rrs []dns.RR, err error) {
+	rrs, err = tx.addAnswersUnderNCValue(d.ncv, subPath)
 	if err == merr.ErrNoResults {
 		err = nil
 	}
@@ -409,8 +1457,18 @@ func (tx *btx) doUnderDomain(d *domain) (rrs []dns.RR, err error) {
 	return
 }
 
-func (tx *btx) addAnswersUnderNCValue(rncv *ncdomain.Value, subname string) (rrs []dns.RR, err error) {
-	ncv, sn, err := tx.findNCValue(rncv, subname, nil /*hasNS*/)
+func (tx *btx) addAnswersUnderNCValue(rncv *ncdomain.Value, subPath []string) (rrs []dns.RR, err error) {
+	// A delegated name is delegation-only, so names at or below it are
+	// answered with the delegation's records, owned by the delegation point,
+	// whatever its map holds.
+	if ncv, sn, err := tx.findNCValue(rncv, subPath, hasNS); err == nil {
+		if tx.trace != nil {
+			tx.trace.Add(TraceStep{Step: "delegation", Name: dns.Fqdn(sn + tx.basename + "." + tx.rootname), Detail: "answered with the delegation's records, whatever its map holds"})
+		}
+		return ncv.RRs(nil, dns.Fqdn(sn+tx.basename+"."+tx.rootname), dns.Fqdn(tx.basename+"."+tx.rootname))
+	}
+
+	ncv, sn, err := tx.findNCValue(rncv, subPath, nil)
 	if err != nil {
 		return
 	}
@@ -418,26 +1476,43 @@ func (tx *btx) addAnswersUnderNCValue(rncv *ncdomain.Value, subname string) (rrs
 	return tx.addAnswersUnderNCValueActual(ncv, sn)
 }
 
-func (tx *btx) findNCValue(ncv *ncdomain.Value, subname string, shortCircuitFunc func(curNCV *ncdomain.Value) bool) (xncv *ncdomain.Value, sn string, err error) {
-	return tx._findNCValue(ncv, subname, "", 0, shortCircuitFunc)
+func hasNS(ncv *ncdomain.Value) bool {
+	return len(ncv.NS) > 0
 }
 
-func (tx *btx) _findNCValue(ncv *ncdomain.Value, isubname, subname string, depth int,
+// Follows the path, as returned by util.QnameToNamecoinKey, through the maps
+// of ncv, falling back to wildcards.
+func (tx *btx) findNCValue(ncv *ncdomain.Value, subPath []string, shortCircuitFunc func(curNCV *ncdomain.Value) bool) (xncv *ncdomain.Value, sn string, err error) {
+	return tx._findNCValue(ncv, subPath, "", 0, shortCircuitFunc)
+}
+
+func (tx *btx) _findNCValue(ncv *ncdomain.Value, subPath []string, subname string, depth int,
 	shortCircuitFunc func(curNCV *ncdomain.Value) bool) (xncv *ncdomain.Value, sn string, err error) {
 
 	if shortCircuitFunc != nil && shortCircuitFunc(ncv) {
 		return ncv, subname, nil
 	}
 
-	if isubname != "" {
-		head, rest := util.SplitDomainHead(isubname)
+	if len(subPath) > 0 {
+		head, rest := subPath[0], subPath[1:]
 
+		// Only the keys consulted to find the answer are traced, not
+		// those consulted looking for a delegation.
+		traced := tx.trace != nil && shortCircuitFunc == nil
 		sub, ok := ncv.Map[head]
 		if !ok {
 			sub, ok = ncv.Map["*"]
 			if !ok {
+				if traced {
+					tx.traceMap(head, subname, fmt.Sprintf("no key %q or \"*\"", head), merr.ErrNoSuchDomain)
+				}
 				return nil, "", merr.ErrNoSuchDomain
 			}
+			if traced {
+				tx.traceMap(head, subname, fmt.Sprintf("no key %q, so key \"*\"", head), nil)
+			}
+		} else if traced {
+			tx.traceMap(head, subname, fmt.Sprintf("key %q", head), nil)
 		}
 		return tx._findNCValue(sub, rest, head+"."+subname, depth+1, shortCircuitFunc)
 	}
@@ -449,6 +1524,13 @@ func (tx *btx) _findNCValue(ncv *ncdomain.Value, isubname, subname string, depth
 	return ncv, subname, nil
 }
 
+// Records the key of the map consulted for the label head of the name whose
+// labels below the Namecoin name are subname, and what was found.
+func (tx *btx) traceMap(head, subname, detail string, err error) {
+	name := dns.Fqdn(head + "." + subname + tx.basename + "." + tx.rootname)
+	tx.trace.addResult(TraceStep{Step: "map", Name: name, Detail: detail}, err)
+}
+
 func (tx *btx) addAnswersUnderNCValueActual(ncv *ncdomain.Value, sn string) (rrs []dns.RR, err error) {
 	rrs, err = ncv.RRs(nil, dns.Fqdn(tx.qname), dns.Fqdn(tx.basename+"."+tx.rootname))
 
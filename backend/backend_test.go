@@ -0,0 +1,207 @@
+package backend
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+	"gopkg.in/hlandau/madns.v2/merr"
+)
+
+func TestQueryNameMatching(t *testing.T) {
+	b, err := New(&Config{
+		CacheMaxEntries: 100,
+		FakeNames: map[string]string{
+			"d/example": `{"ip":["192.0.2.1"],"map":{"www":{"ip":["192.0.2.2"]},"a":{"map":{"b":{"map":{"c":{"map":{"d":{"map":{"e":{"map":{"f":{"map":{"g":{"map":{"h":{"ip":["192.0.2.8"]}}}}}}}}}}}}}}},"*":{"ip":["192.0.2.3"]}}}`,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Names differing only in case are the same name, under any suffix.
+	for qname, ip := range map[string]string{
+		"example.bit.":                 "192.0.2.1",
+		"Example.BIT.":                 "192.0.2.1",
+		"WWW.example.Bit.":             "192.0.2.2",
+		"www.example.bit.example.com.": "192.0.2.2",
+
+		// Labels are followed down the map one at a time; an escaped dot
+		// doesn't separate them.
+		"h.g.f.e.d.c.b.a.example.bit.": "192.0.2.8",
+		`www\.x.example.bit.`:          "192.0.2.3",
+	} {
+		if a := lookupA(t, b, qname); a.A.String() != ip {
+			t.Errorf("%s: got %v, expected %s", qname, a, ip)
+		}
+	}
+
+	// Names which no Namecoin name could hold don't exist.
+	for _, qname := range []string{"-example.bit.", "www.ex--ample.bit.", "under_score.bit."} {
+		if rrs, err := b.Lookup(qname, ""); err != merr.ErrNoSuchDomain {
+			t.Errorf("%s: got %v, %v; expected no such domain", qname, rrs, err)
+		}
+	}
+
+	// Only a whole "bit" label is the suffix.
+	for _, qname := range []string{"examplebit.", "example.xbit.", "example.bitx.", `example\.bit.`} {
+		if rrs, err := b.Lookup(qname, ""); err != merr.ErrNotInZone {
+			t.Errorf("%s: got %v, %v; expected not in zone", qname, rrs, err)
+		}
+	}
+}
+
+// A name with only IPv6 addresses exists: the engine is given its AAAA
+// records, so that it answers an A query with NODATA rather than NXDOMAIN.
+func TestIP6Only(t *testing.T) {
+	b, err := New(&Config{
+		CacheMaxEntries: 100,
+		FakeNames: map[string]string{
+			"d/example": `{"ip6":"2001:db8::1","map":{"www":"2001:db8::2"}}`,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for qname, ip := range map[string]string{
+		"example.bit.":     "2001:db8::1",
+		"www.example.bit.": "2001:db8::2",
+	} {
+		rrs, err := b.Lookup(qname, "")
+		if err != nil || len(rrs) != 1 {
+			t.Errorf("%s: got %v, %v; expected one AAAA record", qname, rrs, err)
+			continue
+		}
+		if aaaa, ok := rrs[0].(*dns.AAAA); !ok || aaaa.AAAA.String() != ip {
+			t.Errorf("%s: got %v, expected AAAA %s", qname, rrs[0], ip)
+		}
+	}
+
+	if rrs, err := b.Lookup("nonexistent.example.bit.", ""); err != merr.ErrNoSuchDomain {
+		t.Errorf("got %v, %v for a nonexistent name; expected no such domain", rrs, err)
+	}
+}
+
+// A delegated name is delegation-only: it and every name below it are
+// answered with its NS records, owned by the name itself, so that the engine
+// can refer the client to the delegation.
+func TestDelegationOnly(t *testing.T) {
+	b, err := New(&Config{
+		CacheMaxEntries: 100,
+		FakeNames: map[string]string{
+			"d/example": `{"ip":"192.0.2.1","ns":"ns1.example.com.","map":{"www":{"ip":"192.0.2.2"}}}`,
+			"d/parent":  `{"ip":"192.0.2.3","map":{"child":{"ns":"ns1.child.example.","ip":"192.0.2.4"}}}`,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for qname, expected := range map[string]string{
+		"example.bit.":              "example.bit.\t600\tIN\tNS\tns1.example.com.",
+		"www.example.bit.":          "example.bit.\t600\tIN\tNS\tns1.example.com.",
+		"child.parent.bit.":         "child.parent.bit.\t600\tIN\tNS\tns1.child.example.",
+		"a.b.child.parent.bit.":     "child.parent.bit.\t600\tIN\tNS\tns1.child.example.",
+		"parent.bit.":               "parent.bit.\t600\tIN\tA\t192.0.2.3",
+		"www.example.bit.xyz.test.": "example.bit.xyz.test.\t600\tIN\tNS\tns1.example.com.",
+	} {
+		rrs, err := b.Lookup(qname, "")
+		if err != nil || len(rrs) != 1 || rrs[0].String() != expected {
+			t.Errorf("%s: got %v, %v; expected %s", qname, rrs, err, expected)
+		}
+	}
+}
+
+// The SOA and NS records at the apex have ApexTTL, leaving the negative TTL
+// and the TTLs of names' records alone.
+func TestApexTTL(t *testing.T) {
+	b, err := New(&Config{
+		CacheMaxEntries: 100,
+		ApexTTL:         172800,
+		FakeNames: map[string]string{
+			"d/example": `{"ip":"192.0.2.1"}`,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rrs, err := b.Lookup("bit.", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	for _, rr := range rrs {
+		switch rr := rr.(type) {
+		case *dns.SOA:
+			if rr.Minttl != 600 {
+				t.Errorf("SOA minimum changed to %d", rr.Minttl)
+			}
+		case *dns.NS:
+		default:
+			continue
+		}
+		n++
+		if rr.Header().Ttl != 172800 {
+			t.Errorf("apex record has TTL %d: %v", rr.Header().Ttl, rr)
+		}
+	}
+	if n < 2 {
+		t.Errorf("expected SOA and NS records, got %v", rrs)
+	}
+
+	if a := lookupA(t, b, "example.bit."); a.Hdr.Ttl == 172800 {
+		t.Errorf("name's record given the apex TTL: %v", a)
+	}
+}
+
+// VanityIPs and ApexRecords are merged into the RRsets at the apex, whatever
+// the suffix.
+func TestApexRecords(t *testing.T) {
+	var apexRecords []dns.RR
+	for _, s := range []string{
+		`bit. 3600 IN CAA 0 issue ";"`,
+		`bit. 600 IN TXT "v=spf1 -all"`,
+		`bit. 3600 IN TXT "verification=1234"`,
+		`bit. 3600 IN CAA 0 issue ";"`,
+	} {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		apexRecords = append(apexRecords, rr)
+	}
+
+	b, err := New(&Config{
+		CacheMaxEntries: 100,
+		VanityIPs:       []net.IP{net.ParseIP("192.0.2.1"), net.ParseIP("2001:db8::1"), net.ParseIP("192.0.2.1")},
+		ApexRecords:     apexRecords,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, apex := range []string{"bit.", "bit.example.com."} {
+		var got []string
+		for _, rr := range lookupTypes(t, b, apex, dns.TypeA, dns.TypeAAAA, dns.TypeCAA, dns.TypeTXT) {
+			got = append(got, rr.String())
+		}
+		expected := []string{
+			apex + "\t86400\tIN\tA\t192.0.2.1",
+			apex + "\t86400\tIN\tAAAA\t2001:db8::1",
+			apex + "\t3600\tIN\tCAA\t0 issue \";\"",
+			apex + "\t600\tIN\tTXT\t\"v=spf1 -all\"",
+			apex + "\t600\tIN\tTXT\t\"verification=1234\"",
+		}
+		if strings.Join(got, "\n") != strings.Join(expected, "\n") {
+			t.Errorf("%s: got\n%s\nexpected\n%s", apex, strings.Join(got, "\n"), strings.Join(expected, "\n"))
+		}
+	}
+
+	// The records given aren't changed.
+	if apexRecords[1].Header().Ttl != 600 || apexRecords[2].Header().Ttl != 3600 {
+		t.Errorf("ApexRecords changed: %v", apexRecords)
+	}
+}
@@ -0,0 +1,233 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// ErrWorkBudgetExhausted is returned by lookups, and the query answered
+// SERVFAIL, when work needed to answer a query would exceed its WorkBudget.
+var ErrWorkBudgetExhausted = errors.New("the work budget of the query is exhausted")
+
+// The cost, in units of a WorkBudget, of each kind of work: each lookup, each
+// name whose data is consulted, whether from the cache or fetched, and each
+// signature cost a unit, and so does each WorkBytesPerUnit bytes of records
+// synthesized.
+const WorkBytesPerUnit = 1024
+
+// The share of a WorkBudget, in percent, which optional work, such as imports
+// and the lookups of aliases' targets, may not use, so that it's left for
+// the lookup of the name asked about.
+const workReservePercent = 25
+
+// The work done on one kind of task for a query.
+type WorkUsage struct {
+	Lookups    int `json:"lookups,omitempty"`
+	Fetches    int `json:"fetches,omitempty"`
+	Signatures int `json:"signatures,omitempty"`
+	Bytes      int `json:"bytes,omitempty"`
+
+	// Work which wasn't done, as the budget was exhausted.
+	Refused int `json:"refused,omitempty"`
+}
+
+func (u WorkUsage) units() int {
+	return u.Lookups + u.Fetches + u.Signatures + (u.Bytes+WorkBytesPerUnit-1)/WorkBytesPerUnit
+}
+
+// The work done for a query, as reported in traces.
+type WorkReport struct {
+	Limit int `json:"limit,omitempty"` // 0: unlimited
+	Spent int `json:"spent"`
+
+	// The work done by stage, e.g. "import".
+	Stages map[string]WorkUsage `json:"stages"`
+
+	// The stages which had work refused, in order, and whether work needed
+	// for the answer was refused.
+	Refused   []string `json:"refused,omitempty"`
+	Exhausted bool     `json:"exhausted,omitempty"`
+}
+
+// A WorkBudget bounds the work done to answer one query, however it's spread
+// over the lookups made for it, the names each imports, the lookups of
+// aliases' targets and of additional records, the delegation checks and the
+// signing of the answer. Each limits its own work, but a crafted value could
+// reach every limit at once, multiplying them; the budget is shared, so the
+// work done for a query is bounded as a whole.
+//
+// Optional work, whose absence leaves a smaller but still correct answer,
+// stops before the budget runs out, leaving a reserve for the work needed to
+// answer at all, which stops once it does. Lookups spend the budget carried
+// by their context, given with WithWorkBudget; those without one are
+// unlimited.
+type WorkBudget struct {
+	limit int
+	qname string // the name asked about, lowercased
+
+	mu        sync.Mutex
+	spent     int
+	stages    map[string]*WorkUsage
+	refused   []string
+	exhausted bool
+}
+
+// NewWorkBudget returns a budget of limit units for a query for qname. A limit
+// of 0 or less makes an unlimited budget, which still counts the work done.
+func NewWorkBudget(limit int, qname string) *WorkBudget {
+	if limit < 0 {
+		limit = 0
+	}
+	return &WorkBudget{
+		limit:  limit,
+		qname:  strings.ToLower(dns.Fqdn(qname)),
+		stages: map[string]*WorkUsage{},
+	}
+}
+
+type workBudgetKey struct{}
+
+// WithWorkBudget returns a context which causes lookups made with it to spend
+// wb.
+func WithWorkBudget(ctx context.Context, wb *WorkBudget) context.Context {
+	return context.WithValue(ctx, workBudgetKey{}, wb)
+}
+
+// Returns the budget carried by ctx, or nil.
+func workBudgetFrom(ctx context.Context) *WorkBudget {
+	wb, _ := ctx.Value(workBudgetKey{}).(*WorkBudget)
+	return wb
+}
+
+// Spend records work done for stage, e.g. "import", unless it would exceed
+// the budget, in which case it isn't to be done, and ErrWorkBudgetExhausted
+// is returned. Optional work is refused once only the reserve is left. It
+// does nothing if wb is nil.
+func (wb *WorkBudget) Spend(stage string, u WorkUsage, optional bool) error {
+	if wb == nil {
+		return nil
+	}
+
+	wb.mu.Lock()
+	defer wb.mu.Unlock()
+
+	usage := wb.stage(stage)
+	units := u.units()
+	limit := wb.limit
+	if optional {
+		limit -= wb.limit * workReservePercent / 100
+	}
+	if wb.limit > 0 && wb.spent+units > limit {
+		usage.Refused++
+		if len(wb.refused) == 0 || wb.refused[len(wb.refused)-1] != stage {
+			wb.refused = append(wb.refused, stage)
+		}
+		if !optional {
+			wb.exhausted = true
+		}
+		return ErrWorkBudgetExhausted
+	}
+
+	wb.add(usage, u)
+	return nil
+}
+
+// Charge records work which has already been done for stage, such as
+// signing, whatever the budget has left. It does nothing if wb is nil.
+func (wb *WorkBudget) Charge(stage string, u WorkUsage) {
+	if wb == nil {
+		return
+	}
+
+	wb.mu.Lock()
+	defer wb.mu.Unlock()
+
+	wb.add(wb.stage(stage), u)
+}
+
+// Returns the work done for stage. Must be called with mu held.
+func (wb *WorkBudget) stage(stage string) *WorkUsage {
+	usage := wb.stages[stage]
+	if usage == nil {
+		usage = &WorkUsage{}
+		wb.stages[stage] = usage
+	}
+	return usage
+}
+
+// Adds u to usage and to the work spent. Must be called with mu held.
+func (wb *WorkBudget) add(usage *WorkUsage, u WorkUsage) {
+	wb.spent += u.units()
+	usage.Lookups += u.Lookups
+	usage.Fetches += u.Fetches
+	usage.Signatures += u.Signatures
+	usage.Bytes += u.Bytes
+}
+
+// Exhausted returns true if work needed to answer the query was refused, so
+// that the query must be answered SERVFAIL.
+func (wb *WorkBudget) Exhausted() bool {
+	if wb == nil {
+		return false
+	}
+
+	wb.mu.Lock()
+	defer wb.mu.Unlock()
+	return wb.exhausted
+}
+
+// Report returns the work done so far.
+func (wb *WorkBudget) Report() WorkReport {
+	if wb == nil {
+		return WorkReport{Stages: map[string]WorkUsage{}}
+	}
+
+	wb.mu.Lock()
+	defer wb.mu.Unlock()
+
+	r := WorkReport{
+		Limit:     wb.limit,
+		Spent:     wb.spent,
+		Stages:    make(map[string]WorkUsage, len(wb.stages)),
+		Refused:   append([]string(nil), wb.refused...),
+		Exhausted: wb.exhausted,
+	}
+	for stage, u := range wb.stages {
+		r.Stages[stage] = *u
+	}
+	return r
+}
+
+// Returns the stage a lookup of name spends the budget in, and whether it's
+// optional: the lookups of the name asked about and of the names above it,
+// which find delegations, are needed for any answer, while the others, e.g. of
+// aliases' targets and of nameservers' addresses, only add to it.
+func (wb *WorkBudget) lookupStage(name string) (string, bool) {
+	if wb == nil || dns.IsSubDomain(strings.ToLower(name), wb.qname) {
+		return "query", false
+	}
+	return "additional", true
+}
+
+// Spends work for a lookup from the budget carried by ctx, recording any
+// refusal to its trace.
+func spendWork(ctx context.Context, stage, name string, u WorkUsage, optional bool) error {
+	err := workBudgetFrom(ctx).Spend(stage, u, optional)
+	if err != nil {
+		lookupTraceFrom(ctx).Add(TraceStep{Step: "budget", Name: name, Detail: stage + " refused", Error: err.Error()})
+	}
+	return err
+}
+
+// Returns the size of records in wire format, uncompressed.
+func rrsBytes(rrs []dns.RR) int {
+	if len(rrs) == 0 {
+		return 0
+	}
+	// Less the 12 bytes of the message header.
+	return (&dns.Msg{Answer: rrs}).Len() - 12
+}
@@ -0,0 +1,158 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"gopkg.in/hlandau/madns.v2/merr"
+
+	"github.com/namecoin/ncdns/namecoin"
+)
+
+// Serves values from a map, each fetch taking delay.
+type slowFetcher struct {
+	values  map[string]string
+	delay   time.Duration
+	fetches int64
+}
+
+func (f *slowFetcher) Fetch(ctx context.Context, name, streamIsolationID string) (*namecoin.NameData, error) {
+	atomic.AddInt64(&f.fetches, 1)
+	select {
+	case <-time.After(f.delay):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	v, ok := f.values[name]
+	if !ok {
+		return nil, merr.ErrNoSuchDomain
+	}
+	return &namecoin.NameData{Value: v, ExpiresIn: 30000}, nil
+}
+
+// A value reaching every limit at once: it imports names which each import
+// more, down to the import depth limit, with a wide map and an alias at each
+// level.
+func worstCaseValues() map[string]string {
+	values := map[string]string{}
+	var imports func(prefix string, depth int) string
+	imports = func(prefix string, depth int) string {
+		if depth == 0 {
+			return ""
+		}
+		var names []string
+		for i := 0; i < 6; i++ {
+			name := fmt.Sprintf("%s%d", prefix, i)
+			names = append(names, fmt.Sprintf("[%q]", name))
+			values[name] = fmt.Sprintf(`{"ip":"192.0.2.%d","map":{"w%d":{"txt":%q},"a%d":{"alias":"elsewhere.example."}}%s}`, depth+10, i, strings.Repeat("x", 200), i, imports(name, depth-1))
+		}
+		return `,"import":[` + strings.Join(names, ",") + `]`
+	}
+
+	var m []string
+	for i := 0; i < 50; i++ {
+		m = append(m, fmt.Sprintf(`"h%d":{"ip":"192.0.2.%d"}`, i, i+1))
+	}
+	values["d/worst"] = `{"ip":"192.0.2.1","map":{` + strings.Join(m, ",") + `}` + imports("dd/w", 3) + `}`
+	return values
+}
+
+// The worst-case value is looked up with and without a work budget: with
+// one, the imports stop once only the reserve is left, in bounded time, and
+// the name's own records are still answered.
+func TestWorkBudget(t *testing.T) {
+	const fetchDelay = 2 * time.Millisecond
+	type result struct {
+		rrs     []dns.RR
+		err     error
+		work    WorkReport
+		elapsed time.Duration
+		fetches int64
+	}
+	lookup := func(limit int) result {
+		f := &slowFetcher{values: worstCaseValues(), delay: fetchDelay}
+		b, err := New(&Config{Fetcher: f, CacheMaxEntries: 1000})
+		if err != nil {
+			t.Fatal(err)
+		}
+		wb := NewWorkBudget(limit, "worst.bit.")
+		trace := NewLookupTrace()
+		ctx := WithWorkBudget(WithLookupTrace(context.Background(), trace), wb)
+
+		start := time.Now()
+		rrs, err := b.LookupContext(ctx, "worst.bit.", "")
+		elapsed := time.Since(start)
+
+		if limit > 0 {
+			refusals := 0
+			for _, step := range trace.Steps() {
+				if step.Step == "budget" {
+					refusals++
+				}
+			}
+			if refusals == 0 {
+				t.Errorf("budget of %d: no refusals traced", limit)
+			}
+		}
+		return result{rrs, err, wb.Report(), elapsed, atomic.LoadInt64(&f.fetches)}
+	}
+
+	res := lookup(0)
+	if res.err != nil {
+		t.Fatal(res.err)
+	}
+	if res.work.Spent <= 100 || res.fetches <= 100 {
+		t.Fatalf("the fixture only took %d units and %d fetches", res.work.Spent, res.fetches)
+	}
+
+	res = lookup(100)
+	if res.err != nil {
+		t.Fatal(res.err)
+	}
+	found := false
+	for _, rr := range res.rrs {
+		if a, ok := rr.(*dns.A); ok && a.A.String() == "192.0.2.1" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("got partial answer %v", res.rrs)
+	}
+	r := res.work
+	if r.Spent > r.Limit || r.Exhausted || res.fetches > 100 {
+		t.Errorf("budget exceeded: %+v, %d fetches", r, res.fetches)
+	}
+	if r.Stages["import"].Refused == 0 || r.Stages["query"].Lookups != 1 || r.Stages["fetch"].Fetches != 1 {
+		t.Errorf("got work by stage %+v", r.Stages)
+	}
+	if res.elapsed > time.Duration(r.Limit)*fetchDelay+time.Second {
+		t.Errorf("the lookup took %v", res.elapsed)
+	}
+
+	// Lookups of other names, as of aliases' targets, are optional too.
+	wb := NewWorkBudget(4, "worst.bit.")
+	if err := wb.Spend("query", WorkUsage{Lookups: 3}, false); err != nil {
+		t.Fatal(err)
+	}
+	if stage, optional := wb.lookupStage("other.bit."); stage != "additional" || !optional {
+		t.Errorf("a lookup of another name is %s, optional %v", stage, optional)
+	}
+	if stage, optional := wb.lookupStage("BIT."); stage != "query" || optional {
+		t.Errorf("a lookup above the name asked about is %s, optional %v", stage, optional)
+	}
+	if err := wb.Spend("additional", WorkUsage{Lookups: 1}, true); err != ErrWorkBudgetExhausted || wb.Exhausted() {
+		t.Errorf("optional work beyond the reserve: %v, exhausted %v", err, wb.Exhausted())
+	}
+
+	// Work needed for the answer stops only once the budget runs out, and
+	// the lookup fails.
+	res = lookup(1)
+	if res.err != ErrWorkBudgetExhausted || res.rrs != nil || !res.work.Exhausted {
+		t.Errorf("budget of 1: got %v, %v, %+v", res.rrs, res.err, res.work)
+	}
+}
@@ -0,0 +1,313 @@
+package backend
+
+import "container/list"
+import "time"
+import "github.com/namecoin/ncdns/clock"
+import "github.com/namecoin/ncdns/namecoin"
+
+// Approximate fixed cost of a cache entry beyond the bytes of its key and
+// value: the LRU list element, the map bucket slot, the string headers and
+// the entry struct itself.
+const cacheEntryOverhead = 128
+
+// An LRU cache bounded by entry count and, optionally, by the approximate
+// number of bytes its entries occupy. When either bound is exceeded the least
+// recently used entries are evicted until the cache is back within both
+// bounds. Callers supply the size of each entry.
+//
+// The time each entry was last used is recorded too, so that entries which
+// haven't been used for a while can be evicted whatever room is left.
+type boundedCache struct {
+	maxEntries int
+	maxBytes   int
+	curBytes   int
+
+	// Most recently used at the front.
+	ll    *list.List
+	items map[string]*list.Element
+
+	clock clock.Clock
+}
+
+type cacheEntry struct {
+	key      string
+	value    cachedValue
+	size     int
+	added    time.Time // when value was added
+	lastUsed time.Time
+}
+
+// Creates a new bounded cache. A maxEntries or maxBytes of zero means that
+// bound is not enforced.
+func newBoundedCache(maxEntries, maxBytes int) *boundedCache {
+	return &boundedCache{
+		maxEntries: maxEntries,
+		maxBytes:   maxBytes,
+		ll:         list.New(),
+		items:      map[string]*list.Element{},
+		clock:      clock.Real,
+	}
+}
+
+func (c *boundedCache) Get(key string) (cachedValue, bool) {
+	el, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+
+	e := el.Value.(*cacheEntry)
+	e.lastUsed = c.clock.Now()
+	c.ll.MoveToFront(el)
+	return e.value, true
+}
+
+func (c *boundedCache) Add(key string, value cachedValue, size int) {
+	c.addAt(key, value, size, c.clock.Now())
+}
+
+// Adds an entry as Add does, recording that value was added at the given
+// time, e.g. when it was first cached before a restart.
+func (c *boundedCache) addAt(key string, value cachedValue, size int, added time.Time) {
+	// An entry which can never fit is not worth evicting everything else for.
+	if c.maxBytes > 0 && size > c.maxBytes {
+		c.Remove(key)
+		return
+	}
+
+	if el, ok := c.items[key]; ok {
+		e := el.Value.(*cacheEntry)
+		c.curBytes += size - e.size
+		e.value, e.size, e.added, e.lastUsed = value, size, added, c.clock.Now()
+		c.ll.MoveToFront(el)
+	} else {
+		c.items[key] = c.ll.PushFront(&cacheEntry{
+			key:      key,
+			value:    value,
+			size:     size,
+			added:    added,
+			lastUsed: c.clock.Now(),
+		})
+		c.curBytes += size
+	}
+
+	for (c.maxEntries > 0 && c.ll.Len() > c.maxEntries) || (c.maxBytes > 0 && c.curBytes > c.maxBytes) {
+		c.removeElement(c.ll.Back())
+	}
+}
+
+func (c *boundedCache) Remove(key string) {
+	if el, ok := c.items[key]; ok {
+		c.removeElement(el)
+	}
+}
+
+func (c *boundedCache) removeElement(el *list.Element) {
+	e := c.ll.Remove(el).(*cacheEntry)
+	delete(c.items, e.key)
+	c.curBytes -= e.size
+}
+
+// Sets the bounds of the cache, evicting at most n of the entries beyond
+// them. While more are, the bounds are kept at the cache's current size, so
+// that Add doesn't evict them all at once either: a cache shrunk by a lot is
+// shrunk a batch at a time, by calling this again, rather than holding its
+// lock for as long as it takes. Returns true once the cache is within the
+// bounds.
+func (c *boundedCache) SetBounds(maxEntries, maxBytes, n int) bool {
+	over := func() bool {
+		return (maxEntries > 0 && c.ll.Len() > maxEntries) || (maxBytes > 0 && c.curBytes > maxBytes)
+	}
+	for ; n > 0 && over(); n-- {
+		c.removeElement(c.ll.Back())
+	}
+
+	c.maxEntries, c.maxBytes = maxEntries, maxBytes
+	if !over() {
+		return true
+	}
+	if maxEntries > 0 && c.ll.Len() > maxEntries {
+		c.maxEntries = c.ll.Len()
+	}
+	if maxBytes > 0 && c.curBytes > maxBytes {
+		c.maxBytes = c.curBytes
+	}
+	return false
+}
+
+// Evicts the entries last used before the given time, and returns how many
+// there were. Since entries are kept in the order they were last used, only
+// those evicted are looked at.
+func (c *boundedCache) EvictIdle(before time.Time) int {
+	n := 0
+	for el := c.ll.Back(); el != nil && el.Value.(*cacheEntry).lastUsed.Before(before); el = c.ll.Back() {
+		c.removeElement(el)
+		n++
+	}
+	return n
+}
+
+// Calls f with each entry, from the least recently used to the most.
+func (c *boundedCache) each(f func(e *cacheEntry)) {
+	for el := c.ll.Back(); el != nil; el = el.Prev() {
+		f(el.Value.(*cacheEntry))
+	}
+}
+
+// Returns the number of entries in the cache.
+func (c *boundedCache) Len() int {
+	return c.ll.Len()
+}
+
+// Returns the approximate number of bytes used by entries in the cache.
+func (c *boundedCache) Bytes() int {
+	return c.curBytes
+}
+
+// A value held by the backend's caches. Only the data of names, as fetched
+// from Namecoin and as parsed, is cached: it's the same whatever the
+// transport, DO bit or EDNS buffer size of the queries it answers, so any
+// query may be answered from it. Responses depend on those, and are built
+// afresh for each query by the engine, so no type of response implements
+// this.
+type cachedValue interface {
+	protocolIndependent()
+}
+
+// A name's data as fetched from Namecoin.
+type cachedNameData struct {
+	*namecoin.NameData
+}
+
+func (cachedNameData) protocolIndependent() {}
+
+// A cache of raw Namecoin JSON values along with their expiry status, keyed
+// by Namecoin name.
+type nameCache struct {
+	*boundedCache
+}
+
+func newNameCache(maxEntries, maxBytes int) *nameCache {
+	return &nameCache{newBoundedCache(maxEntries, maxBytes)}
+}
+
+// Estimates the memory used by caching nameData under name. Only the JSON is
+// held here: the records parsed from it are held, and counted, by the parse
+// cache.
+func cacheEntrySize(name string, nameData *namecoin.NameData) int {
+	return cacheEntryOverhead + len(name) + len(nameData.Value)
+}
+
+func (c *nameCache) Get(name string) (*namecoin.NameData, bool) {
+	v, ok := c.boundedCache.Get(name)
+	if !ok {
+		return nil, false
+	}
+
+	return v.(cachedNameData).NameData, true
+}
+
+func (c *nameCache) Add(name string, nameData *namecoin.NameData) {
+	c.boundedCache.Add(name, cachedNameData{nameData}, cacheEntrySize(name, nameData))
+}
+
+func (c *nameCache) addAt(name string, nameData *namecoin.NameData, added time.Time) {
+	c.boundedCache.addAt(name, cachedNameData{nameData}, cacheEntrySize(name, nameData), added)
+}
+
+// The fact that a name doesn't exist, until expires.
+type cachedNonexistence struct {
+	expires time.Time
+}
+
+func (cachedNonexistence) protocolIndependent() {}
+
+// A cache of the names which namecoind said don't exist, so that a burst of
+// queries for random names doesn't become a burst of RPC calls. Each entry
+// expires after a while, as the name may be registered in the meantime.
+type negativeCache struct {
+	*boundedCache
+	ttl time.Duration
+}
+
+func newNegativeCache(maxEntries int, ttl time.Duration) *negativeCache {
+	return &negativeCache{newBoundedCache(maxEntries, 0), ttl}
+}
+
+// Returns whether name is known not to exist. An expired entry is removed.
+func (c *negativeCache) Get(name string) bool {
+	v, ok := c.boundedCache.Get(name)
+	if !ok {
+		return false
+	}
+
+	if !c.clock.Now().Before(v.(cachedNonexistence).expires) {
+		c.Remove(name)
+		return false
+	}
+
+	return true
+}
+
+func (c *negativeCache) Add(name string) {
+	c.boundedCache.Add(name, cachedNonexistence{c.clock.Now().Add(c.ttl)}, cacheEntryOverhead+len(name))
+}
+
+// A name's data as it was in a name cache when that was flushed, kept until
+// expires in case the name can't be fetched again.
+type staleNameData struct {
+	*namecoin.NameData
+	expires time.Time
+
+	// Whether a lookup has been answered from it, so that falling back on
+	// it is logged once rather than for every query.
+	served bool
+}
+
+func (*staleNameData) protocolIndependent() {}
+
+// A cache of the names emptied from a name cache by FlushCache, so that while
+// namecoind can't be reached, lookups of them are answered with what they were
+// rather than failing. Data which may be out of date is better than none for
+// Namecoin names, which change seldom.
+type staleCache struct {
+	*boundedCache
+}
+
+func newStaleCache(maxEntries, maxBytes int) *staleCache {
+	return &staleCache{newBoundedCache(maxEntries, maxBytes)}
+}
+
+// Returns the stale data of name, or nil if there is none. An expired entry
+// is removed.
+func (c *staleCache) Get(name string) *staleNameData {
+	v, ok := c.boundedCache.Get(name)
+	if !ok {
+		return nil
+	}
+
+	sd := v.(*staleNameData)
+	if !c.clock.Now().Before(sd.expires) {
+		c.Remove(name)
+		return nil
+	}
+
+	return sd
+}
+
+// Adds the entries of cache, to be kept until expires, in place of any stale
+// data of the same names, and removes the entries which have expired.
+func (c *staleCache) addFrom(cache *nameCache, expires time.Time) {
+	now := c.clock.Now()
+	for el := c.ll.Back(); el != nil; {
+		prev := el.Prev()
+		if !now.Before(el.Value.(*cacheEntry).value.(*staleNameData).expires) {
+			c.removeElement(el)
+		}
+		el = prev
+	}
+
+	cache.each(func(e *cacheEntry) {
+		nameData := e.value.(cachedNameData).NameData
+		c.Add(e.key, &staleNameData{NameData: nameData, expires: expires}, cacheEntrySize(e.key, nameData))
+	})
+}
@@ -0,0 +1,502 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/hlandau/madns.v2/merr"
+
+	"github.com/namecoin/ncdns/namecoin"
+	"github.com/namecoin/ncdns/testutil"
+)
+
+func sizedValue(n int) *namecoin.NameData {
+	return &namecoin.NameData{Value: strings.Repeat("x", n)}
+}
+
+func TestNameCacheByteLimit(t *testing.T) {
+	// Each entry is exactly 256 bytes: 128 overhead + 3 (name) + 125 (value).
+	const entrySize = 256
+	c := newNameCache(0, 4*entrySize)
+
+	c.Add("d/a", sizedValue(125))
+	c.Add("d/b", sizedValue(125))
+	c.Add("d/c", sizedValue(125))
+	c.Add("d/d", sizedValue(125))
+	if c.Len() != 4 || c.Bytes() != 4*entrySize {
+		t.Fatalf("filling the budget exactly should not evict: %d entries using %d bytes", c.Len(), c.Bytes())
+	}
+
+	// Touch d/a so that d/b becomes the least recently used entry.
+	if _, ok := c.Get("d/a"); !ok {
+		t.Fatalf("d/a missing from cache")
+	}
+
+	// Replacing d/d with a value one byte larger crosses the boundary and
+	// evicts exactly one entry.
+	c.Add("d/d", sizedValue(126))
+	if c.Len() != 3 || c.Bytes() != 3*entrySize+1 {
+		t.Errorf("unexpected cache state after eviction: %d entries using %d bytes", c.Len(), c.Bytes())
+	}
+	if _, ok := c.Get("d/b"); ok {
+		t.Errorf("least recently used entry d/b was not evicted")
+	}
+	for _, name := range []string{"d/a", "d/c", "d/d"} {
+		if _, ok := c.Get(name); !ok {
+			t.Errorf("entry %s was evicted unexpectedly", name)
+		}
+	}
+}
+
+func TestNameCacheReplaceAccounting(t *testing.T) {
+	c := newNameCache(0, 0)
+
+	c.Add("d/a", sizedValue(100))
+	c.Add("d/a", sizedValue(10))
+	if c.Len() != 1 || c.Bytes() != cacheEntryOverhead+3+10 {
+		t.Errorf("replacing an entry should not leak its old size: %d entries using %d bytes", c.Len(), c.Bytes())
+	}
+}
+
+func TestNameCacheOversizedEntry(t *testing.T) {
+	c := newNameCache(0, 512)
+
+	c.Add("d/a", sizedValue(100))
+	c.Add("d/huge", sizedValue(1000))
+	if _, ok := c.Get("d/huge"); ok {
+		t.Errorf("entry larger than the whole budget was cached")
+	}
+	if _, ok := c.Get("d/a"); !ok {
+		t.Errorf("oversized entry evicted an existing entry")
+	}
+}
+
+func TestNameCacheEntryLimit(t *testing.T) {
+	c := newNameCache(2, 0)
+
+	c.Add("d/a", sizedValue(1))
+	c.Add("d/b", sizedValue(1))
+	c.Add("d/c", sizedValue(1))
+	if c.Len() != 2 || c.Bytes() != 2*(cacheEntryOverhead+3+1) {
+		t.Errorf("entry limit not enforced with byte accounting: %d entries using %d bytes", c.Len(), c.Bytes())
+	}
+}
+
+func TestNameCacheSetBounds(t *testing.T) {
+	c := newNameCache(10, 0)
+	for _, name := range []string{"d/a", "d/b", "d/c", "d/d", "d/e"} {
+		c.Add(name, sizedValue(1))
+	}
+
+	// Shrunk two entries at a time, the cache holds what it's got left
+	// until it's within the new bound.
+	if c.SetBounds(1, 0, 2) {
+		t.Errorf("cache of 5 entries within a bound of 1 after evicting 2")
+	}
+	if c.Len() != 3 {
+		t.Errorf("cache holds %d entries after evicting 2 of 5", c.Len())
+	}
+	c.Add("d/f", sizedValue(1))
+	if c.Len() != 3 {
+		t.Errorf("cache holds %d entries after adding one while shrinking", c.Len())
+	}
+	if !c.SetBounds(1, 0, 2) {
+		t.Errorf("cache of %d entries not within a bound of 1 after evicting 2", c.Len())
+	}
+	if _, ok := c.Get("d/f"); c.Len() != 1 || !ok {
+		t.Errorf("cache holds %d entries, and not the most recently used one", c.Len())
+	}
+
+	// Growing it evicts nothing.
+	if !c.SetBounds(0, 1<<20, 2) || c.Len() != 1 {
+		t.Errorf("cache holds %d entries after growing it", c.Len())
+	}
+}
+
+func TestSetCacheParams(t *testing.T) {
+	names := fakeRPCFetcher{}
+	for _, name := range []string{"a", "b", "c", "d"} {
+		names["d/"+name] = &namecoin.NameData{Value: `{"ip":["192.0.2.1"]}`, ExpiresIn: 30000}
+	}
+	b, err := New(&Config{Fetcher: names, CacheMaxEntries: 100, NegativeCacheMaxEntries: 100, NegativeCacheTTL: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, qname := range []string{"a.bit.", "b.bit.", "c.bit.", "d.bit."} {
+		lookupA(t, b, qname)
+	}
+	b.Lookup("missing.bit.", "")
+
+	p := CacheParams{MaxEntries: 2, MaxBytes: 1 << 20, NegativeMaxEntries: 0, NegativeTTL: time.Minute}
+	b.SetCacheParams(p)
+	if got := b.CacheParams(); got != p {
+		t.Errorf("got %+v, expected %+v", got, p)
+	}
+	if n := b.caches[""].Len(); n != 2 {
+		t.Errorf("name cache holds %d entries, expected what it held, shrunk to 2", n)
+	}
+	if b.negativeCaches != nil {
+		t.Errorf("negative caches kept after being disabled")
+	}
+
+	// The new bounds apply to names cached from then on, and negative
+	// caching comes back when enabled again.
+	lookupA(t, b, "a.bit.")
+	lookupA(t, b, "b.bit.")
+	lookupA(t, b, "c.bit.")
+	if n := b.caches[""].Len(); n != 2 {
+		t.Errorf("name cache holds %d entries", n)
+	}
+	b.SetCacheParams(CacheParams{MaxEntries: 2, NegativeMaxEntries: 10, NegativeTTL: time.Minute})
+	b.Lookup("missing.bit.", "")
+	if neg := b.negativeCaches[""]; neg == nil || neg.Len() != 1 || neg.ttl != time.Minute {
+		t.Errorf("negative cache not used once enabled again: %+v", neg)
+	}
+}
+
+func TestFlushCache(t *testing.T) {
+	names := fakeRPCFetcher{"d/example": {Value: `{"ip":["192.0.2.1"]}`, ExpiresIn: 30000}}
+	b, err := New(&Config{Fetcher: names, CacheMaxEntries: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A changed value isn't served until the cache is flushed.
+	lookupA(t, b, "example.bit.")
+	names["d/example"] = &namecoin.NameData{Value: `{"ip":["192.0.2.2"]}`, ExpiresIn: 30000}
+	if a := lookupA(t, b, "example.bit."); a.A.String() != "192.0.2.1" {
+		t.Errorf("got %v from the cache, expected 192.0.2.1", a)
+	}
+
+	b.FlushCache()
+	if b.CacheBytes() != 0 {
+		t.Errorf("cache holds %d bytes after flushing", b.CacheBytes())
+	}
+	if a := lookupA(t, b, "example.bit."); a.A.String() != "192.0.2.2" {
+		t.Errorf("got %v after flushing, expected 192.0.2.2", a)
+	}
+}
+
+// The names cached by one backend are served by another once restored,
+// without being fetched again.
+func TestRestoreCachedNames(t *testing.T) {
+	names := fakeRPCFetcher{
+		"d/a": {Value: `{"ip":["192.0.2.1"]}`, ExpiresIn: 30000, Height: 500},
+		"d/b": {Value: `{"ip":["192.0.2.2"]}`, ExpiresIn: 30000},
+	}
+	clock := testutil.NewFakeClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	b, err := New(&Config{Fetcher: names, CacheMaxEntries: 100, Clock: clock})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lookupA(t, b, "a.bit.")
+	clock.Advance(time.Hour)
+	lookupA(t, b, "b.bit.")
+
+	cached := b.CachedNames()
+	if len(cached) != 2 || cached[0].Name != "d/a" || cached[0].NameData.Height != 500 ||
+		!cached[0].Added.Equal(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)) || cached[1].Name != "d/b" {
+		t.Fatalf("got cached names %+v", cached)
+	}
+
+	b2, err := New(&Config{Fetcher: names, CacheMaxEntries: 100, Clock: clock})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lookupA(t, b2, "b.bit.")
+	names["d/a"] = &namecoin.NameData{Value: `{"ip":["192.0.2.3"]}`, ExpiresIn: 30000}
+	names["d/b"] = &namecoin.NameData{Value: `{"ip":["192.0.2.4"]}`, ExpiresIn: 30000}
+
+	// A restore after a flush is too late.
+	generation := b2.CacheGeneration()
+	b2.FlushNegativeCache()
+	if n := b2.RestoreCachedNames(cached, generation); n != 0 {
+		t.Errorf("restored %d names after a flush", n)
+	}
+
+	// d/b is already cached, so only d/a is restored.
+	if n := b2.RestoreCachedNames(cached, b2.CacheGeneration()); n != 1 {
+		t.Errorf("restored %d names, expected 1", n)
+	}
+	if a := lookupA(t, b2, "a.bit."); a.A.String() != "192.0.2.1" {
+		t.Errorf("got %v, expected the restored 192.0.2.1", a)
+	}
+	again := b2.CachedNames()
+	for _, cn := range again {
+		if cn.Name == "d/a" && !cn.Added.Equal(cached[0].Added) {
+			t.Errorf("restored d/a as added at %v, expected %v", cn.Added, cached[0].Added)
+		}
+	}
+}
+
+func TestNameCacheEvictIdle(t *testing.T) {
+	clock := testutil.NewFakeClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	c := newNameCache(0, 0)
+	c.clock = clock
+
+	c.Add("d/a", sizedValue(1))
+	c.Add("d/b", sizedValue(1))
+	clock.Advance(12 * time.Hour)
+	c.Add("d/c", sizedValue(1))
+	clock.Advance(6 * time.Hour)
+	c.Get("d/a")
+
+	// d/b was last used 18 hours ago and d/c 6 hours ago, so neither is
+	// idle for a day yet.
+	clock.Advance(4 * time.Hour)
+	if n := c.EvictIdle(clock.Now().Add(-24 * time.Hour)); n != 0 {
+		t.Errorf("evicted %d entries, none of which were idle", n)
+	}
+
+	clock.Advance(4 * time.Hour)
+	if n := c.EvictIdle(clock.Now().Add(-24 * time.Hour)); n != 1 {
+		t.Errorf("evicted %d entries, expected only d/b", n)
+	}
+	if _, ok := c.Get("d/b"); ok {
+		t.Errorf("idle entry d/b was not evicted")
+	}
+	for _, name := range []string{"d/a", "d/c"} {
+		if _, ok := c.Get(name); !ok {
+			t.Errorf("entry %s was evicted unexpectedly", name)
+		}
+	}
+	if c.Len() != 2 || c.Bytes() != 2*(cacheEntryOverhead+3+1) {
+		t.Errorf("unexpected cache state after eviction: %d entries using %d bytes", c.Len(), c.Bytes())
+	}
+}
+
+func TestBackendEvictIdle(t *testing.T) {
+	names := fakeRPCFetcher{
+		"d/a": {Value: `{"ip":["192.0.2.1"]}`, ExpiresIn: 30000},
+		"d/b": {Value: `{"ip":["192.0.2.2"]}`, ExpiresIn: 30000},
+	}
+	clock := testutil.NewFakeClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	b, err := New(&Config{Fetcher: names, CacheMaxEntries: 100, CacheMaxBytes: 1 << 20, CacheIdleEviction: 24 * time.Hour, Clock: clock})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lookupA(t, b, "a.bit.")
+	clock.Advance(20 * time.Hour)
+	lookupA(t, b, "b.bit.")
+	full := b.CacheBytes()
+
+	clock.Advance(5 * time.Hour)
+	if n := b.EvictIdle(); n != 2 {
+		t.Errorf("evicted %d entries, expected the value and parsed value of d/a", n)
+	}
+	if b.CacheBytes() == 0 || b.CacheBytes() >= full {
+		t.Errorf("cache holds %d bytes after evicting d/a, and held %d before", b.CacheBytes(), full)
+	}
+
+	clock.Advance(24 * time.Hour)
+	b.EvictIdle()
+	if len(b.caches) != 0 || len(b.parseCaches) != 0 {
+		t.Errorf("emptied caches were kept: %d name caches, %d parse caches", len(b.caches), len(b.parseCaches))
+	}
+}
+
+func TestCacheStats(t *testing.T) {
+	names := fakeRPCFetcher{
+		"d/a": {Value: `{"ip":["192.0.2.1"]}`, ExpiresIn: 30000},
+	}
+	b, err := New(&Config{Fetcher: names, CacheMaxEntries: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lookupA(t, b, "a.bit.")
+	lookupA(t, b, "a.bit.")
+	lookupA(t, b, "a.bit.")
+	if st := b.CacheStats(); st.Hits != 2 || st.Misses != 1 {
+		t.Errorf("got %+v, expected 2 hits and 1 miss", st)
+	}
+}
+
+// Counts the fetches of each name from names, calling during, if set, once
+// each name has been looked up but before it's returned. Names in fail fail
+// to be fetched with the error given.
+type countingFetcher struct {
+	names   fakeRPCFetcher
+	fail    map[string]error
+	fetches map[string]int
+	during  func(name string)
+}
+
+func (f *countingFetcher) Fetch(ctx context.Context, name, streamIsolationID string) (*namecoin.NameData, error) {
+	f.fetches[name]++
+	nameData, err := f.names.Fetch(ctx, name, streamIsolationID)
+	if failure, ok := f.fail[name]; ok {
+		nameData, err = nil, failure
+	}
+	if f.during != nil {
+		f.during(name)
+	}
+	return nameData, err
+}
+
+func TestNegativeCache(t *testing.T) {
+	f := &countingFetcher{
+		names:   fakeRPCFetcher{},
+		fail:    map[string]error{"d/broken": errors.New("connection refused")},
+		fetches: map[string]int{},
+	}
+	clock := testutil.NewFakeClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	b, err := New(&Config{Fetcher: f, CacheMaxEntries: 100, NegativeCacheMaxEntries: 2, NegativeCacheTTL: time.Minute, Clock: clock})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// namecoind is asked once, however many queries there are for the name
+	// and names under it.
+	for _, qname := range []string{"missing.bit.", "missing.bit.", "www.missing.bit."} {
+		if _, err := b.Lookup(qname, ""); err != merr.ErrNoSuchDomain {
+			t.Errorf("lookup of %s: got %v, expected NXDOMAIN", qname, err)
+		}
+	}
+	if f.fetches["d/missing"] != 1 {
+		t.Errorf("d/missing fetched %d times", f.fetches["d/missing"])
+	}
+	if st := b.CacheStats(); st.NegativeHits != 2 {
+		t.Errorf("got %+v, expected 2 negative hits", st)
+	}
+
+	// Failing to ask isn't remembered.
+	for i := 0; i < 2; i++ {
+		if _, err := b.Lookup("broken.bit.", ""); err == nil || err == merr.ErrNoSuchDomain {
+			t.Errorf("lookup of broken.bit.: got %v", err)
+		}
+	}
+	if f.fetches["d/broken"] != 2 {
+		t.Errorf("d/broken fetched %d times, expected every time", f.fetches["d/broken"])
+	}
+
+	// Nor is a name once the TTL has passed.
+	clock.Advance(time.Minute)
+	b.Lookup("missing.bit.", "")
+	if f.fetches["d/missing"] != 2 {
+		t.Errorf("d/missing fetched %d times, expected again after the TTL", f.fetches["d/missing"])
+	}
+
+	// The cache is bounded.
+	b.Lookup("a.bit.", "")
+	b.Lookup("b.bit.", "")
+	if n := b.negativeCaches[""].Len(); n != 2 {
+		t.Errorf("negative cache holds %d names", n)
+	}
+
+	// A name registered in a new block is served once the caches are
+	// flushed, and no longer remembered not to exist.
+	f.names["d/b"] = &namecoin.NameData{Value: `{"ip":["192.0.2.1"]}`, ExpiresIn: 30000}
+	b.FlushNegativeCache()
+	lookupA(t, b, "b.bit.")
+	if _, ok := b.negativeCaches[""]; ok {
+		t.Errorf("negative cache kept after being flushed")
+	}
+}
+
+// A fetch which namecoind answers before a new block, but which finishes
+// after the caches are flushed for it, isn't cached, as the new block may have
+// changed the name.
+func TestNegativeCacheFlushRace(t *testing.T) {
+	f := &countingFetcher{names: fakeRPCFetcher{}, fetches: map[string]int{}}
+	b, err := New(&Config{Fetcher: f, CacheMaxEntries: 100, NegativeCacheMaxEntries: 100, NegativeCacheTTL: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f.during = func(name string) {
+		f.during = nil
+		b.FlushCache()
+	}
+	if _, err := b.Lookup("new.bit.", ""); err != merr.ErrNoSuchDomain {
+		t.Fatalf("got %v, expected NXDOMAIN", err)
+	}
+
+	f.names["d/new"] = &namecoin.NameData{Value: `{"ip":["192.0.2.1"]}`, ExpiresIn: 30000}
+	lookupA(t, b, "new.bit.")
+
+	// Likewise a value which changes.
+	f.during = func(name string) {
+		f.during = nil
+		b.FlushCache()
+		f.names["d/new"] = &namecoin.NameData{Value: `{"ip":["192.0.2.2"]}`, ExpiresIn: 30000}
+	}
+	b.FlushCache()
+	lookupA(t, b, "new.bit.")
+	if a := lookupA(t, b, "new.bit."); a.A.String() != "192.0.2.2" {
+		t.Errorf("got %v, expected the value of the new block", a)
+	}
+	if f.fetches["d/new"] != 4 {
+		t.Errorf("d/new fetched %d times", f.fetches["d/new"])
+	}
+}
+
+// Names emptied from the cache are answered as they were while they fail to
+// be fetched, but never once namecoind says they don't exist.
+func TestStaleAnswers(t *testing.T) {
+	f := &countingFetcher{
+		names: fakeRPCFetcher{
+			"d/a": {Value: `{"ip":["192.0.2.1"]}`, ExpiresIn: 30000},
+			"d/b": {Value: `{"ip":["192.0.2.2"]}`, ExpiresIn: 30000},
+		},
+		fail:    map[string]error{},
+		fetches: map[string]int{},
+	}
+	clock := testutil.NewFakeClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	b, err := New(&Config{Fetcher: f, CacheMaxEntries: 100, StaleAnswerTTL: time.Hour, Clock: clock})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lookupA(t, b, "a.bit.")
+	lookupA(t, b, "b.bit.")
+	b.FlushCache()
+	f.fail["d/a"] = errors.New("connection refused")
+	f.fail["d/b"] = errors.New("connection refused")
+
+	for i := 0; i < 2; i++ {
+		if a := lookupA(t, b, "a.bit."); a.A.String() != "192.0.2.1" || a.Hdr.Ttl != StaleTTL {
+			t.Errorf("got %v while d/a fails, expected its stale data", a)
+		}
+	}
+	if f.fetches["d/a"] != 3 {
+		t.Errorf("d/a fetched %d times, expected again for each lookup", f.fetches["d/a"])
+	}
+	if st := b.CacheStats(); st.StaleAnswers != 2 {
+		t.Errorf("got %+v, expected 2 stale answers", st)
+	}
+
+	// Once fetched again, the name is answered as it is now.
+	delete(f.fail, "d/a")
+	if a := lookupA(t, b, "a.bit."); a.Hdr.Ttl == StaleTTL {
+		t.Errorf("got %v once d/a is fetched, expected its usual TTL", a)
+	}
+	if sizes := b.CacheSizes(); sizes.StaleNames != 1 {
+		t.Errorf("got %+v, expected only d/b's stale data left", sizes)
+	}
+
+	// A name which doesn't exist any more isn't answered from stale data,
+	// even once fetching it fails again.
+	f.fail["d/b"] = merr.ErrNoSuchDomain
+	if _, err := b.Lookup("b.bit.", ""); err != merr.ErrNoSuchDomain {
+		t.Errorf("got %v, expected NXDOMAIN", err)
+	}
+	f.fail["d/b"] = errors.New("connection refused")
+	if _, err := b.Lookup("b.bit.", ""); err == nil || err == merr.ErrNoSuchDomain {
+		t.Errorf("got %v for a name which didn't exist, expected the failure", err)
+	}
+
+	// Stale data is kept for StaleAnswerTTL.
+	b.FlushCache()
+	f.fail["d/a"] = errors.New("connection refused")
+	lookupA(t, b, "a.bit.")
+	clock.Advance(time.Hour)
+	if _, err := b.Lookup("a.bit.", ""); err == nil {
+		t.Errorf("answered from stale data after StaleAnswerTTL")
+	}
+}
@@ -0,0 +1,200 @@
+package backend
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+	"gopkg.in/hlandau/madns.v2/merr"
+
+	"github.com/namecoin/ncdns/namecoin"
+)
+
+// Serves canned name_show results, as namecoind would return them.
+type fakeRPCFetcher map[string]*namecoin.NameData
+
+func (f fakeRPCFetcher) Fetch(ctx context.Context, name, streamIsolationID string) (*namecoin.NameData, error) {
+	nameData, ok := f[name]
+	if !ok {
+		return nil, merr.ErrNoSuchDomain
+	}
+	return nameData, nil
+}
+
+var expiryNames = fakeRPCFetcher{
+	"d/fresh":   {Value: `{"ip":["192.0.2.1"]}`, ExpiresIn: 30000},
+	"d/nearexp": {Value: `{"ip":["192.0.2.2"]}`, ExpiresIn: 3},
+	"d/expired": {Value: `{"ip":["192.0.2.3"]}`, ExpiresIn: -10, Expired: true},
+	"d/importer": {Value: `{"ip":["192.0.2.4"],"map":{"www":{"import":"d/expired"}}}`,
+		ExpiresIn: 30000},
+}
+
+func newExpiryBackend(t *testing.T, grace int) *Backend {
+	b, err := New(&Config{
+		Fetcher:              expiryNames,
+		CacheMaxEntries:      100,
+		ServeExpiredNamesFor: grace,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func lookupA(t *testing.T, b *Backend, qname string) *dns.A {
+	rrs, err := b.Lookup(qname, "")
+	if err != nil {
+		t.Fatalf("lookup of %s failed: %v", qname, err)
+	}
+	for _, rr := range rrs {
+		if a, ok := rr.(*dns.A); ok {
+			return a
+		}
+	}
+	t.Fatalf("no A record for %s in %v", qname, rrs)
+	return nil
+}
+
+func TestExpiredNamesDontExist(t *testing.T) {
+	b := newExpiryBackend(t, 0)
+
+	for _, qname := range []string{"fresh.bit.", "nearexp.bit."} {
+		if a := lookupA(t, b, qname); a.Hdr.Ttl != 600 {
+			t.Errorf("%s served with TTL %d", qname, a.Hdr.Ttl)
+		}
+		if _, _, ok := b.ExpiredName(qname, ""); ok {
+			t.Errorf("%s reported as expired", qname)
+		}
+	}
+
+	// Looked up twice, so that the second lookup is served from the cache.
+	for i := 0; i < 2; i++ {
+		if _, err := b.Lookup("expired.bit.", ""); err != merr.ErrNoSuchDomain {
+			t.Errorf("expected no such domain for expired name, got %v", err)
+		}
+	}
+
+	rrs, err := b.Lookup("www.importer.bit.", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rr := range rrs {
+		if _, ok := rr.(*dns.A); ok {
+			t.Errorf("records imported from expired name: %v", rr)
+		}
+	}
+}
+
+func TestExpiredNamesGracePeriod(t *testing.T) {
+	b := newExpiryBackend(t, 100)
+
+	if a := lookupA(t, b, "expired.bit."); a.Hdr.Ttl != expiredTTL || a.A.String() != "192.0.2.3" {
+		t.Errorf("unexpected record for expired name within grace period: %v", a)
+	}
+	if a := lookupA(t, b, "www.importer.bit."); a.A.String() != "192.0.2.3" {
+		t.Errorf("expired name within grace period not imported: %v", a)
+	}
+
+	ncname, blocksAgo, ok := b.ExpiredName("www.expired.bit.", "")
+	if !ok || ncname != "d/expired" || blocksAgo != 10 {
+		t.Errorf("got %q, %d, %v for expired name", ncname, blocksAgo, ok)
+	}
+	if _, _, ok := b.ExpiredName("nearexp.bit.", ""); ok {
+		t.Errorf("unexpired name reported as expired")
+	}
+
+	// The grace period is shorter than the time since expiry.
+	b = newExpiryBackend(t, 10)
+	if _, err := b.Lookup("expired.bit.", ""); err != merr.ErrNoSuchDomain {
+		t.Errorf("expected no such domain past the grace period, got %v", err)
+	}
+	if _, _, ok := b.ExpiredName("expired.bit.", ""); ok {
+		t.Errorf("name past the grace period reported as served")
+	}
+}
+
+func TestNameRecords(t *testing.T) {
+	b := newExpiryBackend(t, 20)
+
+	rrs, err := b.NameRecords(context.Background(), "d/deleg", &namecoin.NameData{
+		Value:     `{"ip":"192.0.2.1","map":{"www":{"ip":"192.0.2.2"},"sub":{"ns":["ns1.sub.deleg.bit."],"map":{"ns1":{"ip":"192.0.2.53"},"hidden":{"ip":"192.0.2.99"}}}}}`,
+		ExpiresIn: 30000,
+	}, "bit.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, rr := range rrs {
+		got = append(got, rr.Header().Name+" "+dns.TypeToString[rr.Header().Rrtype])
+	}
+	sort.Strings(got)
+	expected := []string{"deleg.bit. A", "ns1.sub.deleg.bit. A", "sub.deleg.bit. NS", "www.deleg.bit. A"}
+	if strings.Join(got, ", ") != strings.Join(expected, ", ") {
+		t.Errorf("got records %v, expected %v", got, expected)
+	}
+
+	// Expired names within the grace period are served with a short TTL,
+	// and those beyond it not at all.
+	rrs, err = b.NameRecords(context.Background(), "d/old", &namecoin.NameData{Value: `{"ip":"192.0.2.1"}`, ExpiresIn: -10, Expired: true}, "bit.")
+	if err != nil || len(rrs) != 1 || rrs[0].Header().Ttl > expiredTTL {
+		t.Errorf("expired name within the grace period: got %v, %v", rrs, err)
+	}
+	if _, err := b.NameRecords(context.Background(), "d/old", &namecoin.NameData{Value: `{"ip":"192.0.2.1"}`, ExpiresIn: -30, Expired: true}, "bit."); err != merr.ErrNoSuchDomain {
+		t.Errorf("expired name beyond the grace period: got %v", err)
+	}
+	if _, err := b.NameRecords(context.Background(), "id/example", &namecoin.NameData{Value: `{}`}, "bit."); err != merr.ErrNoSuchDomain {
+		t.Errorf("name outside d/: got %v", err)
+	}
+}
+
+func TestCapTTLByExpiry(t *testing.T) {
+	names := fakeRPCFetcher{
+		"d/fresh":   expiryNames["d/fresh"],
+		"d/nearexp": expiryNames["d/nearexp"],
+		"d/twoblks": {Value: `{"ip":["192.0.2.5"]}`, ExpiresIn: 2},
+		"d/oneblk":  {Value: `{"ip":["192.0.2.6"]}`, ExpiresIn: 1},
+		"d/expired": expiryNames["d/expired"],
+		"d/unknown": {Value: `{"ip":["192.0.2.7"]}`},
+	}
+	b, err := New(&Config{
+		Fetcher:              names,
+		CacheMaxEntries:      100,
+		RecordTTL:            86400,
+		SOAMinTTL:            300,
+		CapTTLByExpiry:       true,
+		MinRecordTTL:         900,
+		ServeExpiredNamesFor: 100,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for qname, ttl := range map[string]uint32{
+		"fresh.bit.":   86400,
+		"unknown.bit.": 86400, // expiry not known
+		"nearexp.bit.": 1800,
+		"twoblks.bit.": 1200,
+		"oneblk.bit.":  900, // floored at MinRecordTTL
+		"expired.bit.": expiredTTL,
+	} {
+		if a := lookupA(t, b, qname); a.Hdr.Ttl != ttl {
+			t.Errorf("%s served with TTL %d, expected %d", qname, a.Hdr.Ttl, ttl)
+		}
+	}
+
+	rrs, err := b.Lookup("bit.", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if soa, ok := rrs[0].(*dns.SOA); !ok || soa.Minttl != 300 {
+		t.Errorf("expected an SOA with minimum 300, got %v", rrs[0])
+	}
+
+	// Without CapTTLByExpiry, only expired names are capped.
+	b = newExpiryBackend(t, 100)
+	if a := lookupA(t, b, "nearexp.bit."); a.Hdr.Ttl != 600 {
+		t.Errorf("name near expiry served with TTL %d without CapTTLByExpiry", a.Hdr.Ttl)
+	}
+}
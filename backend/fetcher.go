@@ -0,0 +1,184 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/hlandau/madns.v2/merr"
+
+	"github.com/namecoin/ncdns/namecoin"
+	"github.com/namecoin/ncdns/tracing"
+)
+
+// A Fetcher retrieves the raw JSON value of a name. The backend converts
+// fetched values into DNS records, so a Fetcher is all that is needed to serve
+// names from a source other than namecoind.
+type Fetcher interface {
+	// Returns the JSON value of name, which is in Namecoin form (e.g.
+	// "d/example"), along with its expiry status. If the name doesn't exist,
+	// the error must be merr.ErrNoSuchDomain. Expired names which are still
+	// known should be returned with Expired set; whether they are served is up
+	// to the backend.
+	Fetch(ctx context.Context, name, streamIsolationID string) (*namecoin.NameData, error)
+}
+
+// Fetches names from namecoind.
+type NamecoinFetcher struct {
+	conn    *namecoin.Client
+	timeout time.Duration
+}
+
+// Creates a Fetcher which queries namecoind via conn, failing any query which
+// takes longer than timeout.
+func NewNamecoinFetcher(conn *namecoin.Client, timeout time.Duration) *NamecoinFetcher {
+	return &NamecoinFetcher{
+		conn:    conn,
+		timeout: timeout,
+	}
+}
+
+func (f *NamecoinFetcher) Fetch(ctx context.Context, name, streamIsolationID string) (*namecoin.NameData, error) {
+	_, span := tracing.Start(ctx, "namecoin.name_show")
+	defer span.End()
+
+	// The rpcclient package has quite a long timeout, far in excess of standard
+	// DNS timeouts. We need to return an error response rapidly if we can't
+	// query the backend. Be generous with the timeout as responses from the
+	// Namecoin JSON-RPC seem sluggish sometimes.
+	type fetchResult struct {
+		nameData *namecoin.NameData
+		err      error
+	}
+	result := make(chan fetchResult, 1)
+	go func() {
+		nameData, err := f.conn.NameData(name, streamIsolationID)
+		log.Errore(err, "failed to query namecoin")
+		result <- fetchResult{nameData, err}
+	}()
+
+	// The RPC client can't be interrupted, as ncrpcclient makes its HTTP
+	// requests itself, without a context, so the call is left to finish in
+	// the background if ctx is done first.
+	select {
+	case r := <-result:
+		span.SetError(r.err)
+		return r.nameData, r.err
+	// The system clock's, as it bounds a real call to namecoind.
+	case <-time.After(f.timeout):
+		span.SetError(fmt.Errorf("timeout"))
+		return nil, fmt.Errorf("timeout")
+	case <-ctx.Done():
+		span.SetError(ctx.Err())
+		return nil, ctx.Err()
+	}
+}
+
+// Fetches names from JSON files in a directory. The value of "d/example" is
+// read from "d/example.json" under the directory. This is useful for testing
+// and for static deployments which don't need a blockchain.
+type StaticFetcher struct {
+	dir string
+}
+
+// Creates a Fetcher which reads values from files under dir.
+func NewStaticFetcher(dir string) (*StaticFetcher, error) {
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return nil, fmt.Errorf("Static data path is not a directory: %s", dir)
+	}
+
+	return &StaticFetcher{dir: dir}, nil
+}
+
+// Static names never expire.
+func (f *StaticFetcher) Fetch(ctx context.Context, name, streamIsolationID string) (*namecoin.NameData, error) {
+	fn, ok := f.path(name)
+	if !ok {
+		return nil, merr.ErrNoSuchDomain
+	}
+
+	b, err := ioutil.ReadFile(fn)
+	if os.IsNotExist(err) {
+		return nil, merr.ErrNoSuchDomain
+	} else if err != nil {
+		return nil, err
+	}
+
+	return &namecoin.NameData{Value: string(b)}, nil
+}
+
+// Maps a name to the file containing its value. Names which can't be mapped
+// to a file within the directory (e.g. because they contain "..") don't exist.
+func (f *StaticFetcher) path(name string) (string, bool) {
+	if name == "" || strings.ContainsAny(name, "\\\x00") {
+		return "", false
+	}
+
+	parts := strings.Split(name, "/")
+	for _, p := range parts {
+		if p == "" || p == "." || p == ".." {
+			return "", false
+		}
+	}
+
+	return filepath.Join(f.dir, filepath.Join(parts...)+".json"), true
+}
+
+// Fetches names from a fixture: a single JSON file holding an object whose
+// keys are Namecoin names and whose values are their values, e.g.
+//
+//	{"d/example": {"ip": "192.0.2.1", "map": {"www": {"ip": "192.0.2.2"}}}}
+//
+// A value may also be a string, holding the value as namecoind returns it,
+// e.g. to test a value which doesn't parse. Unlike StaticFetcher, the names
+// are all read at once, so that a whole set of names, for an end-to-end test
+// or an experiment, can be kept in one file.
+type FixtureFetcher struct {
+	values map[string]string
+}
+
+// Creates a Fetcher which serves the names of the fixture file fn.
+func NewFixtureFetcher(fn string) (*FixtureFetcher, error) {
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return nil, fmt.Errorf("Couldn't parse fixture %s: %v", fn, err)
+	}
+
+	f := &FixtureFetcher{values: make(map[string]string, len(raw))}
+	for name, v := range raw {
+		value := string(v)
+		if bytes.HasPrefix(v, []byte(`"`)) {
+			if err := json.Unmarshal(v, &value); err != nil {
+				return nil, fmt.Errorf("Couldn't parse fixture %s: value of %s: %v", fn, name, err)
+			}
+		}
+		f.values[name] = value
+	}
+
+	return f, nil
+}
+
+// Fixture names never expire.
+func (f *FixtureFetcher) Fetch(ctx context.Context, name, streamIsolationID string) (*namecoin.NameData, error) {
+	value, ok := f.values[name]
+	if !ok {
+		return nil, merr.ErrNoSuchDomain
+	}
+
+	return &namecoin.NameData{Value: value}, nil
+}
@@ -0,0 +1,138 @@
+package backend
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/miekg/dns"
+	"gopkg.in/hlandau/madns.v2/merr"
+)
+
+func newStaticDir(t *testing.T, values map[string]string) string {
+	dir, err := ioutil.TempDir("", "ncdns-static")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, value := range values {
+		fn := filepath.Join(dir, filepath.FromSlash(name)+".json")
+		if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(fn, []byte(value), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return dir
+}
+
+func TestStaticFetcher(t *testing.T) {
+	dir := newStaticDir(t, map[string]string{
+		"d/example": `{"ip":["192.0.2.1"]}`,
+		"secret":    `{}`,
+	})
+	defer os.RemoveAll(dir)
+
+	f, err := NewStaticFetcher(filepath.Join(dir, "d", ".."))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v, err := f.Fetch(context.Background(), "d/example", "")
+	if err != nil || v.Value != `{"ip":["192.0.2.1"]}` || v.Expired {
+		t.Errorf("got %+v, %v for d/example", v, err)
+	}
+
+	for _, name := range []string{"d/missing", "d/../secret", "../secret", "d//example", "d\\example", ""} {
+		if _, err := f.Fetch(context.Background(), name, ""); err != merr.ErrNoSuchDomain {
+			t.Errorf("expected no such domain for %q, got %v", name, err)
+		}
+	}
+
+	if _, err := NewStaticFetcher(filepath.Join(dir, "d", "example.json")); err == nil {
+		t.Errorf("static fetcher accepted a file as its directory")
+	}
+}
+
+func TestLookupWithStaticFetcher(t *testing.T) {
+	dir := newStaticDir(t, map[string]string{
+		"d/example": `{"ip":["192.0.2.1"],"map":{"www":{"import":"d/other"}}}`,
+		"d/other":   `{"ip":["192.0.2.2"]}`,
+	})
+	defer os.RemoveAll(dir)
+
+	f, err := NewStaticFetcher(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := New(&Config{
+		Fetcher:         f,
+		CacheMaxEntries: 100,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for qname, ip := range map[string]string{
+		"example.bit.":     "192.0.2.1",
+		"www.example.bit.": "192.0.2.2",
+	} {
+		rrs, err := b.Lookup(qname, "")
+		if err != nil {
+			t.Fatalf("lookup of %s failed: %v", qname, err)
+		}
+
+		found := false
+		for _, rr := range rrs {
+			if a, ok := rr.(*dns.A); ok && a.A.String() == ip {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("no A record %s for %s in %v", ip, qname, rrs)
+		}
+	}
+
+	if _, err := b.Lookup("missing.bit.", ""); err != merr.ErrNoSuchDomain {
+		t.Errorf("expected no such domain for missing.bit., got %v", err)
+	}
+}
+
+func TestFixtureFetcher(t *testing.T) {
+	dir := newStaticDir(t, map[string]string{
+		"fixture": `{
+			"d/example": {"ip": "192.0.2.1", "map": {"www": {"ip": "192.0.2.2"}}},
+			"d/broken": "{\"ip\":"
+		}`,
+		"invalid": `["d/example"]`,
+	})
+	defer os.RemoveAll(dir)
+
+	f, err := NewFixtureFetcher(filepath.Join(dir, "fixture.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v, err := f.Fetch(context.Background(), "d/example", "")
+	if err != nil || v.Value != `{"ip": "192.0.2.1", "map": {"www": {"ip": "192.0.2.2"}}}` || v.Expired {
+		t.Errorf("got %+v, %v for d/example", v, err)
+	}
+	v, err = f.Fetch(context.Background(), "d/broken", "")
+	if err != nil || v.Value != `{"ip":` {
+		t.Errorf("got %+v, %v for d/broken", v, err)
+	}
+	if _, err := f.Fetch(context.Background(), "d/missing", ""); err != merr.ErrNoSuchDomain {
+		t.Errorf("expected no such domain for d/missing, got %v", err)
+	}
+
+	for _, fn := range []string{"invalid.json", "missing.json"} {
+		if _, err := NewFixtureFetcher(filepath.Join(dir, fn)); err == nil {
+			t.Errorf("fixture %s accepted", fn)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package backend
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrFetchRefused is matched, with errors.Is, by the errors of lookups which
+// failed because their FetchGuard refused to let them fetch a name. The error
+// also wraps the one the guard gave.
+var ErrFetchRefused = errors.New("fetch refused")
+
+// A FetchGuard decides whether a lookup may fetch a name which isn't cached,
+// e.g. to stop lookups made on behalf of HTTP clients from piling onto an
+// overloaded namecoind. Names answered from the cache, including the negative
+// cache and stale data, aren't fetched and so are never refused. A lookup is
+// guarded by passing it a context made by WithFetchGuard.
+type FetchGuard interface {
+	// Returns nil if the fetch may be made, or otherwise the error to fail
+	// the lookup with. Every fetch allowed is followed by a call to
+	// FetchDone.
+	AllowFetch() error
+
+	// Called with the outcome of a fetch allowed by AllowFetch.
+	FetchDone(err error)
+}
+
+type fetchGuardKey struct{}
+
+// WithFetchGuard returns a context which causes lookups made with it to ask g
+// before fetching each name, including those imported.
+func WithFetchGuard(ctx context.Context, g FetchGuard) context.Context {
+	return context.WithValue(ctx, fetchGuardKey{}, g)
+}
+
+func fetchGuardFrom(ctx context.Context) FetchGuard {
+	g, _ := ctx.Value(fetchGuardKey{}).(FetchGuard)
+	return g
+}
+
+// The error of a fetch refused by a FetchGuard.
+type fetchRefusedError struct {
+	err error
+}
+
+func (e *fetchRefusedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *fetchRefusedError) Is(target error) bool {
+	return target == ErrFetchRefused
+}
+
+func (e *fetchRefusedError) Unwrap() error {
+	return e.err
+}
@@ -0,0 +1,80 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+var errShut = errors.New("shut")
+
+// Refuses fetches while shut, and records the outcomes of those it allows.
+type testGuard struct {
+	shut     bool
+	outcomes []error
+}
+
+func (g *testGuard) AllowFetch() error {
+	if g.shut {
+		return errShut
+	}
+	return nil
+}
+
+func (g *testGuard) FetchDone(err error) {
+	g.outcomes = append(g.outcomes, err)
+}
+
+func TestFetchGuard(t *testing.T) {
+	f := &flakyFetcher{failures: map[string]int{"d/down": 1}, fetches: map[string]int{}}
+	b, err := New(&Config{
+		Fetcher:           f,
+		CacheMaxEntries:   100,
+		FailureRetryDelay: time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.retrier.sched.Stop()
+
+	g := &testGuard{}
+	ctx := WithFetchGuard(context.Background(), g)
+
+	if _, err := b.NameData(ctx, "d/cached", ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.NameData(ctx, "d/down", ""); err == nil {
+		t.Fatalf("lookup of failing name succeeded")
+	}
+	if len(g.outcomes) != 2 || g.outcomes[0] != nil || g.outcomes[1] == nil {
+		t.Errorf("guard told of outcomes %v", g.outcomes)
+	}
+
+	// Cached names are still answered while the guard refuses fetches.
+	g.shut = true
+	if _, err := b.NameData(ctx, "d/cached", ""); err != nil {
+		t.Errorf("cached name not answered: %v", err)
+	}
+
+	_, err = b.NameData(ctx, "d/uncached", "")
+	if !errors.Is(err, ErrFetchRefused) || !errors.Is(err, errShut) {
+		t.Errorf("refused lookup failed with %v", err)
+	}
+	if n := f.fetchCount("d/uncached"); n != 0 {
+		t.Errorf("refused name fetched %d times", n)
+	}
+	if len(g.outcomes) != 2 {
+		t.Errorf("guard told of the outcome of a refused fetch")
+	}
+
+	// Only the fetch which failed is retried, not the one refused.
+	if st := b.RetryStats(); st.Pending != 1 {
+		t.Errorf("unexpected retry stats %+v", st)
+	}
+
+	// Lookups without the guard aren't affected by it.
+	if _, err := b.NameData(context.Background(), "d/uncached", ""); err != nil {
+		t.Errorf("unguarded lookup failed: %v", err)
+	}
+}
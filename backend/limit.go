@@ -0,0 +1,197 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/namecoin/ncdns/namecoin"
+)
+
+// ErrLookupsSaturated is returned, and the query answered SERVFAIL, when a
+// name must be fetched but MaxConcurrentLookups fetches are in progress and
+// MaxQueuedLookups more are already waiting for one of them to finish.
+var ErrLookupsSaturated = errors.New("too many names being fetched at once")
+
+// Counts of the fetches of names, e.g. name_show calls to namecoind, made by
+// lookups which missed the caches.
+type LookupStats struct {
+	InFlight int64 `json:"in_flight"`
+	Queued   int64 `json:"queued"` // waiting for one of MaxConcurrentLookups
+
+	// Fetches which failed at once with ErrLookupsSaturated.
+	Saturated uint64 `json:"saturated"`
+
+	// Lookups which waited for a fetch of the same name already in progress
+	// rather than making their own.
+	Coalesced uint64 `json:"coalesced"`
+
+	// Lookups which gave up waiting for a fetch at their deadline: after
+	// LookupTimeout, including any time spent waiting, or at that of the
+	// query they were made for.
+	TimedOut uint64 `json:"timed_out"`
+
+	// Lookups which gave up waiting for a fetch as the query they were made
+	// for was abandoned, e.g. as its TCP client disconnected.
+	Cancelled uint64 `json:"cancelled"`
+}
+
+func (b *Backend) LookupStats() LookupStats {
+	return LookupStats{
+		InFlight:  atomic.LoadInt64(&b.lookupsInFlight),
+		Queued:    atomic.LoadInt64(&b.lookupsQueued),
+		Saturated: atomic.LoadUint64(&b.lookupsSaturated),
+		Coalesced: atomic.LoadUint64(&b.lookupsCoalesced),
+		TimedOut:  atomic.LoadUint64(&b.lookupsTimedOut),
+		Cancelled: atomic.LoadUint64(&b.lookupsCancelled),
+	}
+}
+
+type flightKey struct {
+	name, streamIsolationID string
+}
+
+// A fetch of a name in progress, whose result is shared by every lookup of
+// the name made while it is.
+type flight struct {
+	done     chan struct{} // closed once nameData and err are set
+	nameData *namecoin.NameData
+	err      error
+
+	waiters int                // the lookups waiting for it; guarded by flightMutex
+	cancel  context.CancelFunc // abandons the fetch
+}
+
+// Fetches a name, joining a fetch of it already in progress if there is one,
+// so that a burst of queries for a name which isn't cached makes a single
+// request to namecoind.
+//
+// The fetch runs on its own, so that a lookup which gives up on it, as ctx is
+// done, doesn't fail the others waiting for it; it's only abandoned once all
+// of them have.
+func (b *Backend) fetch(ctx context.Context, name, streamIsolationID string) (*namecoin.NameData, error) {
+	if b.cfg.LookupTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, b.cfg.LookupTimeout)
+		defer cancel()
+	}
+
+	// Nothing is fetched for a query which has already been abandoned.
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	key := flightKey{name, streamIsolationID}
+	b.flightMutex.Lock()
+	f, coalesced := b.flights[key]
+	if !coalesced {
+		var fctx context.Context
+		f = &flight{done: make(chan struct{})}
+		fctx, f.cancel = context.WithCancel(detachedContext{ctx})
+		b.flights[key] = f
+		go b.fly(fctx, key, f)
+	}
+	f.waiters++
+	b.flightMutex.Unlock()
+
+	if coalesced {
+		atomic.AddUint64(&b.lookupsCoalesced, 1)
+		lookupTraceFrom(ctx).Add(TraceStep{Step: "coalesced", Name: name, Detail: "waiting for a fetch already in progress"})
+	}
+
+	select {
+	case <-f.done:
+		if f.err != nil && ctx.Err() != nil {
+			return nil, b.lookupAborted(name, ctx.Err())
+		}
+		return f.nameData, f.err
+	case <-ctx.Done():
+		b.leaveFlight(key, f)
+		return nil, b.lookupAborted(name, ctx.Err())
+	}
+}
+
+// Makes the fetch of a flight, which no longer takes further lookups once
+// it's done.
+func (b *Backend) fly(ctx context.Context, key flightKey, f *flight) {
+	f.nameData, f.err = b.fetchLimited(ctx, key.name, key.streamIsolationID)
+
+	b.flightMutex.Lock()
+	if b.flights[key] == f {
+		delete(b.flights, key)
+	}
+	b.flightMutex.Unlock()
+	f.cancel()
+	close(f.done)
+}
+
+// Stops waiting for a flight. If no other lookup is waiting for it, its fetch
+// is abandoned, so that it stops taking up one of MaxConcurrentLookups, and
+// the next lookup of the name makes a fetch of its own.
+func (b *Backend) leaveFlight(key flightKey, f *flight) {
+	b.flightMutex.Lock()
+	defer b.flightMutex.Unlock()
+
+	f.waiters--
+	if f.waiters == 0 {
+		f.cancel()
+		if b.flights[key] == f {
+			delete(b.flights, key)
+		}
+	}
+}
+
+// Carries the values of a context, e.g. the trace and span of the lookup
+// which started a fetch, without its deadline or cancellation, which are
+// those of that lookup alone.
+type detachedContext struct {
+	context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}       { return nil }
+func (detachedContext) Err() error                  { return nil }
+
+// Fetches a name once one of MaxConcurrentLookups is free, or fails at once if
+// MaxQueuedLookups are already waiting.
+func (b *Backend) fetchLimited(ctx context.Context, name, streamIsolationID string) (*namecoin.NameData, error) {
+	if b.lookupSem != nil {
+		select {
+		case b.lookupSem <- struct{}{}:
+		default:
+			if atomic.AddInt64(&b.lookupsQueued, 1) > int64(b.cfg.MaxQueuedLookups) {
+				atomic.AddInt64(&b.lookupsQueued, -1)
+				atomic.AddUint64(&b.lookupsSaturated, 1)
+				return nil, ErrLookupsSaturated
+			}
+
+			select {
+			case b.lookupSem <- struct{}{}:
+				atomic.AddInt64(&b.lookupsQueued, -1)
+			case <-ctx.Done():
+				atomic.AddInt64(&b.lookupsQueued, -1)
+				return nil, ctx.Err()
+			}
+		}
+		defer func() { <-b.lookupSem }()
+	}
+
+	atomic.AddInt64(&b.lookupsInFlight, 1)
+	defer atomic.AddInt64(&b.lookupsInFlight, -1)
+
+	return b.fetcher.Fetch(ctx, name, streamIsolationID)
+}
+
+// Counts a lookup which gave up waiting for a fetch as ctx was done with err,
+// returning the error it fails with.
+func (b *Backend) lookupAborted(name string, err error) error {
+	if err != context.DeadlineExceeded {
+		atomic.AddUint64(&b.lookupsCancelled, 1)
+		return err
+	}
+
+	atomic.AddUint64(&b.lookupsTimedOut, 1)
+	return fmt.Errorf("fetching %s timed out", name)
+}
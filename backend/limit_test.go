@@ -0,0 +1,217 @@
+package backend
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/namecoin/ncdns/namecoin"
+)
+
+// Blocks each fetch until release is closed or its context is done.
+type blockingFetcher struct {
+	release chan struct{}
+
+	mu      sync.Mutex
+	fetches map[string]int
+}
+
+func (f *blockingFetcher) Fetch(ctx context.Context, name, streamIsolationID string) (*namecoin.NameData, error) {
+	f.mu.Lock()
+	f.fetches[name]++
+	f.mu.Unlock()
+
+	select {
+	case <-f.release:
+		return &namecoin.NameData{Value: `{"ip":["192.0.2.1"]}`, ExpiresIn: 30000}, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (f *blockingFetcher) fetchCount(name string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.fetches[name]
+}
+
+func waitForLookupStats(t *testing.T, b *Backend, ok func(st LookupStats) bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !ok(b.LookupStats()) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for lookups: %+v", b.LookupStats())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestLookupCoalescing(t *testing.T) {
+	f := &blockingFetcher{release: make(chan struct{}), fetches: map[string]int{}}
+	b, err := New(&Config{
+		Fetcher:              f,
+		CacheMaxEntries:      100,
+		MaxConcurrentLookups: 4,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const n = 10
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		go func() {
+			_, err := b.Lookup("example.bit.", "")
+			errs <- err
+		}()
+	}
+	waitForLookupStats(t, b, func(st LookupStats) bool { return st.Coalesced == n-1 })
+
+	close(f.release)
+	for i := 0; i < n; i++ {
+		if err := <-errs; err != nil {
+			t.Errorf("lookup failed: %v", err)
+		}
+	}
+	if c := f.fetchCount("d/example"); c != 1 {
+		t.Errorf("%d fetches of a name looked up at once, expected 1", c)
+	}
+}
+
+func TestLookupSaturation(t *testing.T) {
+	f := &blockingFetcher{release: make(chan struct{}), fetches: map[string]int{}}
+	b, err := New(&Config{
+		Fetcher:              f,
+		CacheMaxEntries:      100,
+		MaxConcurrentLookups: 1,
+		MaxQueuedLookups:     1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errs := make(chan error, 2)
+	go func() {
+		_, err := b.Lookup("a.bit.", "")
+		errs <- err
+	}()
+	waitForLookupStats(t, b, func(st LookupStats) bool { return st.InFlight == 1 })
+	go func() {
+		_, err := b.Lookup("b.bit.", "")
+		errs <- err
+	}()
+	waitForLookupStats(t, b, func(st LookupStats) bool { return st.Queued == 1 })
+
+	// Neither running nor waiting, so it fails at once.
+	if _, err := b.Lookup("c.bit.", ""); err != ErrLookupsSaturated {
+		t.Errorf("got %v, expected ErrLookupsSaturated", err)
+	}
+
+	close(f.release)
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			t.Errorf("lookup failed: %v", err)
+		}
+	}
+	if st := b.LookupStats(); st.Saturated != 1 || st.InFlight != 0 || st.Queued != 0 {
+		t.Errorf("unexpected stats %+v", st)
+	}
+}
+
+func TestLookupTimeout(t *testing.T) {
+	f := &blockingFetcher{release: make(chan struct{}), fetches: map[string]int{}}
+	b, err := New(&Config{
+		Fetcher:              f,
+		CacheMaxEntries:      100,
+		MaxConcurrentLookups: 1,
+		MaxQueuedLookups:     1,
+		LookupTimeout:        20 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The second waits for the first, and both time out.
+	errs := make(chan error, 2)
+	for _, name := range []string{"a.bit.", "b.bit."} {
+		go func(name string) {
+			_, err := b.Lookup(name, "")
+			errs <- err
+		}(name)
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err == nil {
+			t.Errorf("lookup of a wedged name succeeded")
+		}
+	}
+	// The fetches given up on finish once they've been cancelled.
+	waitForLookupStats(t, b, func(st LookupStats) bool { return st.InFlight == 0 && st.Queued == 0 })
+	if st := b.LookupStats(); st.TimedOut != 2 || st.Cancelled != 0 {
+		t.Errorf("unexpected stats %+v", st)
+	}
+}
+
+// A lookup whose query is abandoned stops waiting for its fetch, which goes on
+// for the other lookups waiting for it, and is only cancelled once none are.
+func TestLookupCancellation(t *testing.T) {
+	f := &blockingFetcher{release: make(chan struct{}), fetches: map[string]int{}}
+	b, err := New(&Config{
+		Fetcher:              f,
+		CacheMaxEntries:      100,
+		MaxConcurrentLookups: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lookup := func(ctx context.Context, errs chan<- error) {
+		_, err := b.LookupContext(ctx, "example.bit.", "")
+		errs <- err
+	}
+	ctx1, cancel1 := context.WithCancel(context.Background())
+	errs1 := make(chan error, 1)
+	go lookup(ctx1, errs1)
+	waitForLookupStats(t, b, func(st LookupStats) bool { return st.InFlight == 1 })
+	ctx2, cancel2 := context.WithCancel(context.Background())
+	defer cancel2()
+	errs2 := make(chan error, 1)
+	go lookup(ctx2, errs2)
+	waitForLookupStats(t, b, func(st LookupStats) bool { return st.Coalesced == 1 })
+
+	// The lookup which started the fetch gives up on it.
+	cancel1()
+	if err := <-errs1; err != context.Canceled {
+		t.Errorf("got %v from the cancelled lookup, expected context.Canceled", err)
+	}
+	close(f.release)
+	if err := <-errs2; err != nil {
+		t.Errorf("the other lookup failed: %v", err)
+	}
+	if st := b.LookupStats(); st.Cancelled != 1 || st.TimedOut != 0 {
+		t.Errorf("unexpected stats %+v", st)
+	}
+
+	// With no lookup left waiting, the fetch is cancelled, and the name is
+	// fetched again by the next lookup.
+	f.release = make(chan struct{})
+	ctx3, cancel3 := context.WithCancel(context.Background())
+	errs3 := make(chan error, 1)
+	go func() {
+		_, err := b.LookupContext(ctx3, "other.bit.", "")
+		errs3 <- err
+	}()
+	waitForLookupStats(t, b, func(st LookupStats) bool { return st.InFlight == 1 })
+	cancel3()
+	if err := <-errs3; err != context.Canceled {
+		t.Errorf("got %v from the cancelled lookup, expected context.Canceled", err)
+	}
+	waitForLookupStats(t, b, func(st LookupStats) bool { return st.InFlight == 0 })
+
+	close(f.release)
+	if _, err := b.Lookup("other.bit.", ""); err != nil {
+		t.Errorf("lookup after the cancelled fetch failed: %v", err)
+	}
+	if c := f.fetchCount("d/other"); c != 2 {
+		t.Errorf("%d fetches of a name whose first fetch was cancelled, expected 2", c)
+	}
+}
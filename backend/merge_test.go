@@ -0,0 +1,146 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"gopkg.in/hlandau/madns.v2/merr"
+
+	"github.com/namecoin/ncdns/namecoin"
+)
+
+// Serves values from a map, completing the fetches of names in the given
+// order: each waits for those before it to complete, or for a while if they
+// aren't being fetched, as a name is only imported once the name importing
+// it has been fetched.
+type orderedFetcher struct {
+	values map[string]string
+	order  []string
+
+	mu   sync.Mutex
+	done map[string]chan struct{}
+}
+
+func newOrderedFetcher(values map[string]string, order []string) *orderedFetcher {
+	f := &orderedFetcher{values: values, order: order, done: map[string]chan struct{}{}}
+	for _, name := range order {
+		f.done[name] = make(chan struct{})
+	}
+	return f
+}
+
+func (f *orderedFetcher) Fetch(ctx context.Context, name, streamIsolationID string) (*namecoin.NameData, error) {
+	for _, before := range f.order {
+		if before == name {
+			break
+		}
+		select {
+		case <-f.done[before]:
+		case <-time.After(20 * time.Millisecond):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	f.mu.Lock()
+	if ch, ok := f.done[name]; ok {
+		select {
+		case <-ch:
+		default:
+			close(ch)
+		}
+	}
+	f.mu.Unlock()
+
+	v, ok := f.values[name]
+	if !ok {
+		return nil, merr.ErrNoSuchDomain
+	}
+	return &namecoin.NameData{Value: v, ExpiresIn: 30000}, nil
+}
+
+func permutations(a []string) [][]string {
+	if len(a) <= 1 {
+		return [][]string{append([]string(nil), a...)}
+	}
+	var out [][]string
+	for i := range a {
+		rest := append(append([]string(nil), a[:i]...), a[i+1:]...)
+		for _, p := range permutations(rest) {
+			out = append(out, append([]string{a[i]}, p...))
+		}
+	}
+	return out
+}
+
+// Values giving records at the same owner names, through imports, are looked
+// up concurrently with their fetches completing in every order. The answers
+// must be the same each time: the name's own records win over what it
+// imports, and duplicates collapse.
+func TestImportMergeOrder(t *testing.T) {
+	values := map[string]string{
+		"d/example":     `{"import":[["d/example-cdn"],["dd/common"]],"ip":"192.0.2.1","txt":"v=spf1 -all","map":{"www":{"ip":"192.0.2.2","txt":"own"},"api":{"import":[["d/example-cdn","www"]]}}}`,
+		"d/example-cdn": `{"ip":"192.0.2.100","map":{"www":{"alias":"edge.cdn.example.","txt":"cdn"}}}`,
+		"dd/common":     `{"txt":"v=spf1 -all","mx":[[10,"mx.example.com."]],"map":{"www":{"txt":"own"}}}`,
+	}
+	qnames := []string{"example.bit.", "www.example.bit.", "api.example.bit.", "www.example-cdn.bit."}
+
+	lookupAll := func(order []string) map[string]string {
+		b, err := New(&Config{Fetcher: newOrderedFetcher(values, order), CacheMaxEntries: 100})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		answers := map[string]string{}
+		var mu sync.Mutex
+		var wg sync.WaitGroup
+		for _, qname := range qnames {
+			wg.Add(1)
+			go func(qname string) {
+				defer wg.Done()
+				rrs, err := b.LookupContext(context.Background(), qname, "")
+				var lines []string
+				for _, rr := range rrs {
+					lines = append(lines, rr.String())
+				}
+				sort.Strings(lines)
+				mu.Lock()
+				defer mu.Unlock()
+				answers[qname] = fmt.Sprintf("%s%v", strings.Join(lines, "\n"), err)
+			}(qname)
+		}
+		wg.Wait()
+		return answers
+	}
+
+	var first map[string]string
+	for _, order := range permutations([]string{"d/example", "d/example-cdn", "dd/common"}) {
+		answers := lookupAll(order)
+		if first == nil {
+			first = answers
+			continue
+		}
+		for _, qname := range qnames {
+			if answers[qname] != first[qname] {
+				t.Errorf("%s, fetched in order %v: got\n%s\nrather than\n%s", qname, order, answers[qname], first[qname])
+			}
+		}
+	}
+
+	// The name's own address and text records at www win over the
+	// imported CNAME.
+	if www := first["www.example.bit."]; strings.Contains(www, "CNAME") || !strings.Contains(www, "192.0.2.2") || strings.Count(www, "\"own\"") != 1 || !strings.Contains(www, "\"cdn\"") {
+		t.Errorf("www.example.bit.: got\n%s", www)
+	}
+	if api := first["api.example.bit."]; !strings.Contains(api, "CNAME") {
+		t.Errorf("api.example.bit.: got\n%s", api)
+	}
+	if apex := first["example.bit."]; strings.Count(apex, "v=spf1 -all") != 1 || strings.Contains(apex, "192.0.2.100") {
+		t.Errorf("example.bit.: got\n%s", apex)
+	}
+}
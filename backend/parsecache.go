@@ -0,0 +1,79 @@
+package backend
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+
+	"github.com/miekg/dns"
+
+	"github.com/namecoin/ncdns/ncdomain"
+	"github.com/namecoin/ncdns/util"
+)
+
+// Parsed values are considerably larger than their JSON. This is a rough
+// multiplier used to estimate the memory used by a parsed value from the
+// length of the JSON it was parsed from, where its records can't be listed.
+const parsedValueExpansion = 8
+
+// Approximate cost of each record of a parsed value beyond its wire length:
+// the RR struct and its header, the strings of its names and the provenance
+// kept with it.
+const parsedRecordOverhead = 96
+
+// A cache of parsed values, so that re-fetching a value which hasn't changed
+// (e.g. after a cache flush on a new block) doesn't parse it again. Entries
+// are keyed on the name, a hash of the raw value and the parser version.
+//
+// Values which reference other names via "import" or "delegate" are never
+// cached here, since their parsed form depends on the values of those other
+// names as well as their own.
+type parseCache struct {
+	*boundedCache
+}
+
+func newParseCache(maxEntries, maxBytes int) *parseCache {
+	return &parseCache{newBoundedCache(maxEntries, maxBytes)}
+}
+
+// A parsed value is built from the value's JSON alone.
+func (*domain) protocolIndependent() {}
+
+func parseCacheKey(name, jsonValue string) string {
+	h := sha256.Sum256([]byte(jsonValue))
+	return strconv.Itoa(ncdomain.ParserVersion) + ":" + name + ":" + hex.EncodeToString(h[:])
+}
+
+func (c *parseCache) Get(name, jsonValue string) (*domain, bool) {
+	v, ok := c.boundedCache.Get(parseCacheKey(name, jsonValue))
+	if !ok {
+		return nil, false
+	}
+
+	return v.(*domain), true
+}
+
+func (c *parseCache) Add(name, jsonValue string, d *domain) {
+	key := parseCacheKey(name, jsonValue)
+	c.boundedCache.Add(key, d, cacheEntryOverhead+len(key)+parsedValueSize(name, jsonValue, d))
+}
+
+// Estimates the memory used by a parsed value from the records it gives,
+// which hold most of it, along with the JSON it was parsed from.
+func parsedValueSize(name, jsonValue string, d *domain) int {
+	basename, err := util.NamecoinKeyToBasename(name)
+	if err != nil {
+		return parsedValueExpansion * len(jsonValue)
+	}
+	suffix := basename + ".bit."
+	recs, err := d.ncv.RecordsRecursive(nil, suffix, suffix)
+	if err != nil {
+		return parsedValueExpansion * len(jsonValue)
+	}
+
+	n := len(jsonValue)
+	for _, rec := range recs {
+		n += parsedRecordOverhead + dns.Len(rec.RR)
+	}
+	return n
+}
@@ -0,0 +1,168 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/namecoin/ncdns/ncdomain"
+)
+
+// Builds a value with n subdomains, each carrying a handful of records.
+func heavyValue(n int) string {
+	items := make([]string, n)
+	for i := range items {
+		items[i] = fmt.Sprintf(`"h%d":{"ip":["192.0.2.%d"],"ip6":["2001:db8::%x"],"txt":["record %d"],"mx":[[10,"mx%d"]]}`,
+			i, i%256, i, i, i)
+	}
+	return `{"ip":["192.0.2.1"],"map":{` + strings.Join(items, ",") + `}}`
+}
+
+func newTestBackend(t testing.TB, fakeNames map[string]string) *Backend {
+	b, err := New(&Config{
+		CacheMaxEntries: 100,
+		FakeNames:       fakeNames,
+	})
+	if err != nil {
+		t.Fatalf("couldn't create backend: %v", err)
+	}
+	return b
+}
+
+func TestParseCacheReusesParsedValue(t *testing.T) {
+	b := newTestBackend(t, nil)
+	value := heavyValue(3)
+
+	d1, err := b.jsonToDomain(context.Background(), "d/example", value, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d2, err := b.jsonToDomain(context.Background(), "d/example", value, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d1 != d2 {
+		t.Fatalf("unchanged value was parsed again")
+	}
+
+	d3, err := b.jsonToDomain(context.Background(), "d/example", value, "other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d3 == d1 {
+		t.Fatalf("parsed value was shared across stream isolation IDs")
+	}
+
+	d4, err := b.jsonToDomain(context.Background(), "d/example", heavyValue(4), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d4 == d1 {
+		t.Fatalf("changed value was served from the parse cache")
+	}
+}
+
+func TestParseCacheSkipsImports(t *testing.T) {
+	fakeNames := map[string]string{
+		"d/imported": `{"ip":["192.0.2.1"]}`,
+	}
+	b := newTestBackend(t, fakeNames)
+	value := `{"import":"d/imported"}`
+
+	d1, err := b.jsonToDomain(context.Background(), "d/example", value, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fakeNames["d/imported"] = `{"ip":["192.0.2.2"]}`
+
+	d2, err := b.jsonToDomain(context.Background(), "d/example", value, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d1 == d2 || d2.ncv.IP[0].String() != "192.0.2.2" {
+		t.Fatalf("value with an import was served from the parse cache")
+	}
+}
+
+// A parsed value is estimated from its records, so one giving many records
+// is counted as larger than one with a single long record from JSON of the
+// same length.
+func TestParsedValueSize(t *testing.T) {
+	b := newTestBackend(t, nil)
+	many := heavyValue(20)
+	one := fmt.Sprintf(`{"txt":%q}`, strings.Repeat("x", len(many)-len(`{"txt":""}`)))
+	if len(one) != len(many) {
+		t.Fatalf("values of %d and %d bytes", len(one), len(many))
+	}
+
+	var sizes []int
+	for _, value := range []string{many, one} {
+		d, err := b.jsonToDomain(context.Background(), "d/example", value, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		sizes = append(sizes, parsedValueSize("d/example", value, d))
+	}
+	if sizes[0] <= sizes[1] || sizes[1] <= len(one) {
+		t.Errorf("estimated %d bytes for many records and %d for one", sizes[0], sizes[1])
+	}
+
+	if st := b.CacheByteSizes(); st.ParsedValues < sizes[0]+sizes[1] || st.Names != 0 {
+		t.Errorf("got cache bytes %+v", st)
+	}
+}
+
+func TestParseCacheRRsStable(t *testing.T) {
+	b := newTestBackend(t, nil)
+	value := `{"mx":[[10,"mx"]],"ds":[[1,8,2,"l9VV8yYOhbonRnuJBjHIwyrYQNKvl8OW6tzhTw5GWCE="]]}`
+
+	var first string
+	for i := 0; i < 3; i++ {
+		d, err := b.jsonToDomain(context.Background(), "d/example", value, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rrs, err := d.ncv.RRs(nil, "example.bit.", "example.bit.")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		s := fmt.Sprint(rrs)
+		if i == 0 {
+			first = s
+		} else if s != first {
+			t.Fatalf("generating records modified the cached value:\n%s\n%s", first, s)
+		}
+	}
+}
+
+// A heavyweight value re-fetched many times, as happens when the name cache is
+// flushed on each new block but the value itself hasn't changed.
+func BenchmarkParseCache(b *testing.B) {
+	value := heavyValue(100)
+
+	b.Run("uncached", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for j := 0; j < 1000; j++ {
+				if ncdomain.ParseValue("d/example", value, nil, nil) == nil {
+					b.Fatal("couldn't parse value")
+				}
+			}
+		}
+	})
+
+	b.Run("cached", func(b *testing.B) {
+		be := newTestBackend(b, nil)
+		for i := 0; i < b.N; i++ {
+			for j := 0; j < 1000; j++ {
+				if _, err := be.jsonToDomain(context.Background(), "d/example", value, ""); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+}
@@ -0,0 +1,189 @@
+package backend
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+
+	"gopkg.in/hlandau/madns.v2/merr"
+
+	"github.com/namecoin/ncdns/namecoin"
+)
+
+// The code of the error namecoind returns from name_show for a name which
+// doesn't exist, as recorded.
+const recordedNoSuchName = -4
+
+// Returned by ReplayFetcher for a name which wasn't recorded.
+var ErrNotRecorded = errors.New("not recorded")
+
+// A name_show call as recorded by RecordingFetcher, in the form of a JSON-RPC
+// request and its response.
+type recordedCall struct {
+	Method string          `json:"method"`
+	Params []string        `json:"params"`
+	Result *recordedResult `json:"result"`
+	Error  *recordedError  `json:"error"`
+}
+
+type recordedResult struct {
+	Name      string `json:"name"`
+	Value     string `json:"value"`
+	ExpiresIn int32  `json:"expires_in"`
+	Expired   bool   `json:"expired"`
+	Height    int32  `json:"height"`
+}
+
+type recordedError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// Returns the file in dir in which a call of method with params is recorded,
+// named after a hash of them, so that a call is always recorded in the same
+// file, whatever characters the name has.
+func recordPath(dir, method string, params ...string) string {
+	b, _ := json.Marshal(append([]string{method}, params...))
+	h := sha256.Sum256(b)
+	return filepath.Join(dir, method+"-"+hex.EncodeToString(h[:16])+".json")
+}
+
+// Fetches names through another Fetcher, recording the name_show call made
+// for each name matching one of a list of patterns in a directory, from
+// which a ReplayFetcher can serve them, e.g. to reproduce a bug in how a
+// name is served without the namecoind it was found with. Names a recorded
+// name imports must match the patterns too to be replayed.
+//
+// Only the name and what namecoind returned are recorded, not the RPC
+// credentials or the stream isolation ID. A name which doesn't exist is
+// recorded as such, while calls which fail otherwise, e.g. by timing out,
+// aren't recorded.
+type RecordingFetcher struct {
+	f        Fetcher
+	dir      string
+	patterns []string
+}
+
+// Creates a Fetcher which records the calls of f fetching the names matching
+// patterns, as path.Match matches them (e.g. "d/example" or "d/*"), in dir,
+// which is created if it doesn't exist.
+func NewRecordingFetcher(f Fetcher, dir string, patterns []string) (*RecordingFetcher, error) {
+	for _, p := range patterns {
+		if _, err := path.Match(p, ""); err != nil {
+			return nil, fmt.Errorf("Invalid name pattern %q: %v", p, err)
+		}
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	return &RecordingFetcher{f: f, dir: dir, patterns: patterns}, nil
+}
+
+func (f *RecordingFetcher) Fetch(ctx context.Context, name, streamIsolationID string) (*namecoin.NameData, error) {
+	nameData, err := f.f.Fetch(ctx, name, streamIsolationID)
+	if f.matches(name) {
+		log.Warne(f.record(name, nameData, err), "couldn't record name_show of ", name)
+	}
+	return nameData, err
+}
+
+func (f *RecordingFetcher) matches(name string) bool {
+	for _, p := range f.patterns {
+		if ok, _ := path.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *RecordingFetcher) record(name string, nameData *namecoin.NameData, err error) error {
+	call := &recordedCall{Method: "name_show", Params: []string{name}}
+	switch {
+	case errors.Is(err, merr.ErrNoSuchDomain):
+		call.Error = &recordedError{Code: recordedNoSuchName, Message: "name not found"}
+	case err != nil:
+		return nil
+	default:
+		call.Result = &recordedResult{
+			Name:      name,
+			Value:     nameData.Value,
+			ExpiresIn: nameData.ExpiresIn,
+			Expired:   nameData.Expired,
+			Height:    nameData.Height,
+		}
+	}
+
+	b, err := json.MarshalIndent(call, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// Written to a temporary file first, so that a replay never reads half
+	// a recording.
+	fn := recordPath(f.dir, call.Method, name)
+	tmp := fn + ".tmp"
+	if err := ioutil.WriteFile(tmp, append(b, '\n'), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, fn)
+}
+
+// Serves names from the calls a RecordingFetcher recorded in a directory.
+// Names which weren't recorded fail with ErrNotRecorded, rather than not
+// existing, so that a replay never serves a name differently than it was
+// served when recorded.
+type ReplayFetcher struct {
+	dir string
+}
+
+// Creates a Fetcher which replays the calls recorded in dir.
+func NewReplayFetcher(dir string) (*ReplayFetcher, error) {
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return nil, fmt.Errorf("Replay path is not a directory: %s", dir)
+	}
+
+	return &ReplayFetcher{dir: dir}, nil
+}
+
+func (f *ReplayFetcher) Fetch(ctx context.Context, name, streamIsolationID string) (*namecoin.NameData, error) {
+	fn := recordPath(f.dir, "name_show", name)
+	b, err := ioutil.ReadFile(fn)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("name_show of %s: %w in %s", name, ErrNotRecorded, f.dir)
+	} else if err != nil {
+		return nil, err
+	}
+
+	var call recordedCall
+	if err := json.Unmarshal(b, &call); err != nil {
+		return nil, fmt.Errorf("Couldn't parse recording %s: %v", fn, err)
+	}
+
+	switch {
+	case call.Error != nil && call.Error.Code == recordedNoSuchName:
+		return nil, merr.ErrNoSuchDomain
+	case call.Error != nil:
+		return nil, fmt.Errorf("name_show of %s: recorded error %d: %s", name, call.Error.Code, call.Error.Message)
+	case call.Result == nil || call.Result.Name != name:
+		return nil, fmt.Errorf("Recording %s isn't of name_show of %s", fn, name)
+	}
+
+	return &namecoin.NameData{
+		Value:     call.Result.Value,
+		ExpiresIn: call.Result.ExpiresIn,
+		Expired:   call.Result.Expired,
+		Height:    call.Result.Height,
+	}, nil
+}
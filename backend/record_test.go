@@ -0,0 +1,99 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gopkg.in/hlandau/madns.v2/merr"
+)
+
+func TestRecordReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ncdns-record")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	names := fakeRPCFetcher{
+		"d/example": {Value: `{"ip":["192.0.2.1"],"map":{"www":{"import":"d/other"}}}`, ExpiresIn: 30000, Height: 100},
+		"d/other":   {Value: `{"ip":["192.0.2.2"]}`, ExpiresIn: -10, Expired: true},
+		"d/secret":  {Value: `{"ip":["192.0.2.3"]}`},
+	}
+	rec, err := NewRecordingFetcher(names, filepath.Join(dir, "rec"), []string{"d/example", "d/o*", "d/missing"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lookups := []string{"example.bit.", "www.example.bit.", "missing.bit.", "secret.bit."}
+	lookup := func(f Fetcher) []string {
+		b, err := New(&Config{Fetcher: f, CacheMaxEntries: 100, ServeExpiredNamesFor: 100})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var results []string
+		for _, qname := range lookups {
+			rrs, err := b.Lookup(qname, "isolation-id")
+			results = append(results, fmt.Sprint(rrs, err))
+		}
+		return results
+	}
+	recorded := lookup(rec)
+
+	files, err := ioutil.ReadDir(filepath.Join(dir, "rec"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 3 {
+		t.Errorf("recorded %d calls, expected 3", len(files))
+	}
+	for _, fi := range files {
+		b, err := ioutil.ReadFile(filepath.Join(dir, "rec", fi.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(string(b), "isolation-id") || strings.Contains(string(b), "secret") {
+			t.Errorf("%s records more than it should: %s", fi.Name(), b)
+		}
+	}
+
+	// Every name recorded is served as it was, and others fail.
+	replay, err := NewReplayFetcher(filepath.Join(dir, "rec"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	replayed := lookup(replay)
+	for i := range lookups[:3] {
+		if replayed[i] != recorded[i] {
+			t.Errorf("%s: replayed %s, recorded %s", lookups[i], replayed[i], recorded[i])
+		}
+	}
+
+	for name, expected := range names {
+		nameData, err := replay.Fetch(context.Background(), name, "")
+		if name == "d/secret" {
+			if !errors.Is(err, ErrNotRecorded) {
+				t.Errorf("got %v, %v for unrecorded %s", nameData, err, name)
+			}
+			continue
+		}
+		if err != nil || *nameData != *expected {
+			t.Errorf("got %+v, %v for %s, expected %+v", nameData, err, name, expected)
+		}
+	}
+	if _, err := replay.Fetch(context.Background(), "d/missing", ""); err != merr.ErrNoSuchDomain {
+		t.Errorf("expected no such domain for d/missing, got %v", err)
+	}
+
+	if _, err := NewRecordingFetcher(names, dir, []string{"d/["}); err == nil {
+		t.Errorf("invalid pattern accepted")
+	}
+	if _, err := NewReplayFetcher(filepath.Join(dir, "none")); err == nil {
+		t.Errorf("missing replay directory accepted")
+	}
+}
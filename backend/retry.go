@@ -0,0 +1,142 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"gopkg.in/hlandau/madns.v2/merr"
+
+	"github.com/namecoin/ncdns/scheduler"
+)
+
+// The most names awaiting a retry at once. Failures beyond this aren't
+// retried, so that an RPC outage doesn't queue up a retry for every name
+// queried during it.
+const maxRetryNames = 1000
+
+// Statistics about background retries of names which failed to be fetched.
+type RetryStats struct {
+	Pending   int    `json:"pending"`
+	Attempted uint64 `json:"attempted"`
+	Succeeded uint64 `json:"succeeded"`
+
+	// Failures which weren't retried because maxRetryNames were pending
+	Dropped uint64 `json:"dropped"`
+}
+
+type retryKey struct {
+	name, streamIsolationID string
+}
+
+// Fetches names which failed to be fetched (e.g. because of a transient RPC
+// error) once more in the background, shortly after the failure. Resolvers
+// cache the SERVFAIL, so without this the name would stay unresolvable until
+// a query happened to arrive after the cause of the failure went away.
+type retrier struct {
+	b     *Backend
+	delay time.Duration
+	sched *scheduler.Scheduler
+
+	mu      sync.Mutex
+	pending map[retryKey]struct{}
+	stats   RetryStats
+}
+
+func newRetrier(b *Backend, delay time.Duration) *retrier {
+	return &retrier{
+		b:     b,
+		delay: delay,
+		sched: scheduler.New(&scheduler.Config{
+			Jitter:        delay / 4,
+			MaxConcurrent: 4,
+			Clock:         b.clock,
+		}),
+		pending: map[retryKey]struct{}{},
+	}
+}
+
+// Called when a name couldn't be fetched. The name is retried unless it is
+// already awaiting a retry, or the lookup was abandoned, left out by its
+// query's work budget or refused by its FetchGuard, rather than failing.
+func (r *retrier) failed(name, streamIsolationID string, err error) {
+	if err == merr.ErrNoSuchDomain || err == context.Canceled || err == ErrWorkBudgetExhausted || errors.Is(err, ErrFetchRefused) {
+		return
+	}
+
+	key := retryKey{name, streamIsolationID}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.pending[key]; ok {
+		return
+	}
+	if len(r.pending) >= maxRetryNames {
+		r.stats.Dropped++
+		return
+	}
+
+	r.pending[key] = struct{}{}
+	r.sched.ScheduleAfter(r.delay, func() {
+		r.retry(key)
+	})
+}
+
+func (r *retrier) retry(key retryKey) {
+	// A query may have fetched the name in the meantime.
+	fetched := r.b.resolveNameCache(key.name, key.streamIsolationID) != nil
+
+	var err error
+	if !fetched {
+		generation := r.b.currentCacheGeneration()
+		nameData, err1 := r.b.resolveName(context.Background(), key.name, key.streamIsolationID)
+		err = err1
+		if err == nil {
+			r.b.addNamecoinJSONToCache(key.name, nameData, key.streamIsolationID, generation)
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// The name is retried only once; a failure in the retry isn't retried
+	// again.
+	delete(r.pending, key)
+	if fetched {
+		return
+	}
+
+	r.stats.Attempted++
+	if err == nil {
+		r.stats.Succeeded++
+	} else {
+		log.Infoe(err, "background retry of ", key.name, " failed")
+	}
+}
+
+// Returns statistics about background retries of names which failed to be
+// fetched, or nil if they're disabled.
+func (b *Backend) RetryStats() *RetryStats {
+	if b.retrier == nil {
+		return nil
+	}
+
+	b.retrier.mu.Lock()
+	defer b.retrier.mu.Unlock()
+
+	st := b.retrier.stats
+	st.Pending = len(b.retrier.pending)
+	return &st
+}
+
+// Returns the scheduler of background retries, for its statistics, or nil
+// if they're disabled.
+func (b *Backend) RetryScheduler() *scheduler.Scheduler {
+	if b.retrier == nil {
+		return nil
+	}
+
+	return b.retrier.sched
+}
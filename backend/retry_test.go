@@ -0,0 +1,132 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"gopkg.in/hlandau/madns.v2/merr"
+
+	"github.com/namecoin/ncdns/namecoin"
+)
+
+// Fails each name's first fetches, as given by the test.
+type flakyFetcher struct {
+	mu       sync.Mutex
+	failures map[string]int
+	fetches  map[string]int
+}
+
+func (f *flakyFetcher) Fetch(ctx context.Context, name, streamIsolationID string) (*namecoin.NameData, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.fetches[name]++
+	if f.failures[name] > 0 {
+		f.failures[name]--
+		return nil, fmt.Errorf("connection refused")
+	}
+	return &namecoin.NameData{Value: `{"ip":["192.0.2.1"]}`, ExpiresIn: 30000}, nil
+}
+
+func (f *flakyFetcher) fetchCount(name string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.fetches[name]
+}
+
+func waitForRetries(t *testing.T, b *Backend, attempted uint64) *RetryStats {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		st := b.RetryStats()
+		if st.Attempted >= attempted && st.Pending == 0 {
+			return st
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for retries: %+v", st)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestFailureRetry(t *testing.T) {
+	f := &flakyFetcher{
+		failures: map[string]int{"d/transient": 1, "d/down": 100},
+		fetches:  map[string]int{},
+	}
+	b, err := New(&Config{
+		Fetcher:           f,
+		CacheMaxEntries:   100,
+		FailureRetryDelay: time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := b.Lookup("transient.bit.", ""); err == nil {
+		t.Fatalf("first lookup succeeded")
+	}
+	st := waitForRetries(t, b, 1)
+	if st.Succeeded != 1 {
+		t.Errorf("retry didn't succeed: %+v", st)
+	}
+
+	// The retry filled the cache, so the next query is answered from it.
+	lookupA(t, b, "transient.bit.")
+	if n := f.fetchCount("d/transient"); n != 2 {
+		t.Errorf("%d fetches, expected 2", n)
+	}
+
+	// A name which fails again is only retried once per failed query.
+	if _, err := b.Lookup("down.bit.", ""); err == nil {
+		t.Fatalf("lookup of failing name succeeded")
+	}
+	st = waitForRetries(t, b, 2)
+	if st.Succeeded != 1 {
+		t.Errorf("failed retry counted as a success: %+v", st)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if n := f.fetchCount("d/down"); n != 2 {
+		t.Errorf("%d fetches of a failing name, expected 2", n)
+	}
+
+	// Nonexistent names aren't failures.
+	b.retrier.failed("d/nonexistent", "", merr.ErrNoSuchDomain)
+	if st := b.RetryStats(); st.Pending != 0 || st.Attempted != 2 || st.Dropped != 0 {
+		t.Errorf("unexpected stats %+v", st)
+	}
+}
+
+func TestFailureRetryLimit(t *testing.T) {
+	f := &flakyFetcher{failures: map[string]int{}, fetches: map[string]int{}}
+	b, err := New(&Config{
+		Fetcher:           f,
+		CacheMaxEntries:   100,
+		FailureRetryDelay: time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < maxRetryNames+10; i++ {
+		b.retrier.failed(fmt.Sprintf("d/name%d", i), "", fmt.Errorf("connection refused"))
+	}
+	b.retrier.failed("d/name0", "", fmt.Errorf("connection refused"))
+
+	if st := b.RetryStats(); st.Pending != maxRetryNames || st.Dropped != 10 {
+		t.Errorf("unexpected stats %+v", st)
+	}
+	b.retrier.sched.Stop()
+}
+
+func TestFailureRetryDisabled(t *testing.T) {
+	b, err := New(&Config{CacheMaxEntries: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st := b.RetryStats(); st != nil {
+		t.Errorf("stats reported with retries disabled: %+v", st)
+	}
+}
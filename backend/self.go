@@ -0,0 +1,86 @@
+package backend
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+
+	"github.com/namecoin/ncdns/util"
+)
+
+// Unless CanonicalNameservers are configured, this nameserver's own name is
+// published as the NS of the zone apex: SelfName, or if that is empty a
+// pseudo-hostname under the meta domain. The address records of the
+// pseudo-hostname, and of SelfName if it is under the served suffix, are
+// served both in answer to queries for them and as glue. They are relative to
+// the suffix, so that they exist under every suffix the backend serves (e.g.
+// "bit." and "bit.example.com.").
+
+// Returns SelfName relative to the suffix (e.g. "ns1" for "ns1.bit."), or ""
+// if it is empty or not under the suffix.
+func relativeSelfName(selfName string) string {
+	subname, basename, _, err := util.SplitDomainByFloatingAnchor(strings.ToLower(selfName), "bit")
+	if err != nil || basename == "" {
+		return ""
+	}
+
+	if subname == "" {
+		return basename
+	}
+	return subname + "." + basename
+}
+
+// Returns the name of this nameserver as it appears under the given rootname
+// (e.g. "bit").
+func (b *Backend) selfHostname(rootname string) string {
+	if b.selfName == "" {
+		if b.cfg.SelfName != "" {
+			// Outside the suffix, so it can be used but not served.
+			return dns.Fqdn(b.cfg.SelfName)
+		}
+		return dns.Fqdn("this." + b.metaLabel() + "." + rootname)
+	}
+
+	return dns.Fqdn(b.selfName + "." + rootname)
+}
+
+// Returns true if the query is for SelfName under the suffix.
+func (tx *btx) isSelfName() bool {
+	name := tx.basename
+	if tx.subname != "" {
+		name = tx.subname + "." + tx.basename
+	}
+
+	return tx.b.selfName != "" && strings.EqualFold(name, tx.b.selfName)
+}
+
+// Serves the address records of this nameserver's name.
+func (tx *btx) doSelfName() (rrs []dns.RR, err error) {
+	name := dns.Fqdn(tx.qname)
+
+	for _, ip := range tx.b.cfg.SelfIPs {
+		if ip4 := ip.To4(); ip4 != nil {
+			rrs = append(rrs, &dns.A{
+				Hdr: dns.RR_Header{
+					Name:   name,
+					Ttl:    86400,
+					Class:  dns.ClassINET,
+					Rrtype: dns.TypeA,
+				},
+				A: ip4,
+			})
+		} else {
+			rrs = append(rrs, &dns.AAAA{
+				Hdr: dns.RR_Header{
+					Name:   name,
+					Ttl:    86400,
+					Class:  dns.ClassINET,
+					Rrtype: dns.TypeAAAA,
+				},
+				AAAA: ip,
+			})
+		}
+	}
+
+	return rrs, nil
+}
@@ -0,0 +1,131 @@
+package backend
+
+import (
+	"net"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func newSelfBackend(t *testing.T, selfName string) *Backend {
+	b, err := New(&Config{
+		CacheMaxEntries: 100,
+		SelfName:        selfName,
+		SelfIPs:         []net.IP{net.ParseIP("192.0.2.53"), net.ParseIP("2001:db8::53")},
+		FakeNames: map[string]string{
+			"d/ns1":       `{"ip":["192.0.2.99"]}`,
+			"d/delegated": `{"ns":["this.x--nmc.bit.","ns1.bit."]}`,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// Returns the records of the given types in a lookup's result.
+func lookupTypes(t *testing.T, b *Backend, qname string, rrtypes ...uint16) []dns.RR {
+	rrs, err := b.Lookup(qname, "")
+	if err != nil {
+		t.Fatalf("lookup of %s failed: %v", qname, err)
+	}
+
+	var out []dns.RR
+	for _, rr := range rrs {
+		for _, rrtype := range rrtypes {
+			if rr.Header().Rrtype == rrtype {
+				out = append(out, rr)
+			}
+		}
+	}
+	return out
+}
+
+// Returns the addresses of a name, as glue would be looked up for it.
+func selfAddrs(t *testing.T, b *Backend, name string) string {
+	var ss []string
+	for _, rr := range lookupTypes(t, b, name, dns.TypeA, dns.TypeAAAA) {
+		if !strings.EqualFold(rr.Header().Name, name) {
+			t.Errorf("record %v for %s has the wrong owner", rr, name)
+		}
+		ss = append(ss, rr.String()[len(rr.Header().Name):])
+	}
+	sort.Strings(ss)
+	return strings.Join(ss, " ")
+}
+
+const expectedSelfAddrs = "\t86400\tIN\tA\t192.0.2.53 \t86400\tIN\tAAAA\t2001:db8::53"
+
+func TestSelfNameQueryShapes(t *testing.T) {
+	tests := []struct {
+		selfName string
+		rootname string
+		expected string // the NS at the apex
+	}{
+		{"", "bit.", "this.x--nmc.bit."},
+		{"", "bit.example.com.", "this.x--nmc.bit.example.com."},
+		{"ns1.bit.", "bit.", "ns1.bit."},
+		{"NS1.bit", "bit.example.com.", "ns1.bit.example.com."},
+	}
+
+	for _, test := range tests {
+		b := newSelfBackend(t, test.selfName)
+
+		// NS at the apex, with the addresses of the nameserver as glue.
+		nss := lookupTypes(t, b, test.rootname, dns.TypeNS)
+		if len(nss) != 1 || nss[0].(*dns.NS).Ns != test.expected {
+			t.Errorf("%q under %s: apex NS %v, expected %s", test.selfName, test.rootname, nss, test.expected)
+			continue
+		}
+		if got := selfAddrs(t, b, test.expected); got != expectedSelfAddrs {
+			t.Errorf("%q under %s: glue for apex NS %q", test.selfName, test.rootname, got)
+		}
+
+		// Direct A and AAAA queries. The labels below the suffix may be in
+		// any case.
+		direct := strings.Replace(test.expected, "this.x--nmc", "This.X--NMC", 1)
+		direct = strings.Replace(direct, "ns1", "Ns1", 1)
+		if got := selfAddrs(t, b, direct); got != expectedSelfAddrs {
+			t.Errorf("%q under %s: direct query for %s got %q", test.selfName, test.rootname, direct, got)
+		}
+
+		// The referral for a name delegated to this nameserver.
+		nss = lookupTypes(t, b, "delegated."+test.rootname, dns.TypeNS)
+		if len(nss) != 2 {
+			t.Fatalf("unexpected referral %v", nss)
+		}
+		for _, ns := range nss {
+			target := ns.(*dns.NS).Ns
+			if target != "ns1.bit." && target != "this.x--nmc.bit." {
+				t.Errorf("unexpected NS %v", ns)
+			}
+			if target != dns.Fqdn(strings.ToLower(test.selfName)) && target != "this.x--nmc.bit." {
+				continue
+			}
+			if got := selfAddrs(t, b, target); got != expectedSelfAddrs {
+				t.Errorf("%q: glue for referral to %s got %q", test.selfName, target, got)
+			}
+		}
+	}
+}
+
+func TestSelfNameOutsideSuffix(t *testing.T) {
+	b := newSelfBackend(t, "ns1.example.com.")
+
+	nss := lookupTypes(t, b, "bit.", dns.TypeNS)
+	if len(nss) != 1 || nss[0].(*dns.NS).Ns != "ns1.example.com." {
+		t.Errorf("apex NS %v", nss)
+	}
+
+	// ns1.bit is then an ordinary name.
+	if got := selfAddrs(t, b, "ns1.bit."); got != "\t600\tIN\tA\t192.0.2.99" {
+		t.Errorf("ns1.bit. got %q", got)
+	}
+
+	// The pseudo-hostname is still served, since AIA URLs refer to it.
+	if got := selfAddrs(t, b, "this.x--nmc.bit."); got != expectedSelfAddrs {
+		t.Errorf("pseudo-hostname got %q", got)
+	}
+}
@@ -0,0 +1,138 @@
+package backend
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/namecoin/ncdns/ncdomain"
+)
+
+// A LookupTrace records, in order, the steps taken to answer a lookup, so that
+// a single misbehaving name can be debugged without enabling debug logging for
+// everything. A lookup is traced by passing LookupContext a context made by
+// WithLookupTrace. Untraced lookups have a nil trace, to which nothing is
+// recorded.
+type LookupTrace struct {
+	mu    sync.Mutex
+	steps []TraceStep
+}
+
+// A step of a traced lookup.
+type TraceStep struct {
+	// What was done: "lookup", "cache", "fetch", "coalesced", "stale"
+	// (with why the name was answered from stale data), "expired", "import",
+	// "parse_cache", "warning", "error", "parsed", "normalized", "partial"
+	// (with the imports which failed, comma-separated), "map"
+	// (with the key of a map consulted for a label of the name),
+	// "delegation" or "answer", or a step recorded by the caller of the
+	// backend, such as "sign".
+	Step string `json:"step"`
+
+	// The Namecoin name or query name the step concerns.
+	Name string `json:"name,omitempty"`
+
+	// The outcome of the step, e.g. "hit" or "miss" for a cache check, or
+	// the value fetched.
+	Detail string `json:"detail,omitempty"`
+
+	// The error the step failed with, if any.
+	Error string `json:"error,omitempty"`
+
+	// How long the step took, in microseconds, for those which are timed.
+	DurationMicros int64 `json:"duration_us,omitempty"`
+
+	// The records the name gave at this step, each followed by where it came
+	// from.
+	Records []string `json:"records,omitempty"`
+}
+
+func NewLookupTrace() *LookupTrace {
+	return &LookupTrace{}
+}
+
+type lookupTraceKey struct{}
+
+// WithLookupTrace returns a context which causes lookups made with it to be
+// recorded to t.
+func WithLookupTrace(ctx context.Context, t *LookupTrace) context.Context {
+	return context.WithValue(ctx, lookupTraceKey{}, t)
+}
+
+// Returns the trace carried by ctx, or nil if the lookup isn't traced.
+func lookupTraceFrom(ctx context.Context) *LookupTrace {
+	t, _ := ctx.Value(lookupTraceKey{}).(*LookupTrace)
+	return t
+}
+
+// Add records a step. It does nothing if t is nil.
+func (t *LookupTrace) Add(step TraceStep) {
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.steps = append(t.steps, step)
+}
+
+// Adds a step which failed with err, if it isn't nil.
+func (t *LookupTrace) addResult(step TraceStep, err error) {
+	if err != nil {
+		step.Error = err.Error()
+	}
+	t.Add(step)
+}
+
+// Steps returns the steps recorded so far.
+func (t *LookupTrace) Steps() []TraceStep {
+	if t == nil {
+		return nil
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]TraceStep(nil), t.steps...)
+}
+
+// Returns the records given by a parsed value, with where they came from, as
+// recorded in a trace. If all is set, those which would be occluded by
+// records of higher precedence are included.
+func traceRecords(v *ncdomain.Value, name string, all bool) ([]string, error) {
+	suffix := "bit."
+	if strings.HasPrefix(name, "d/") {
+		suffix = strings.TrimPrefix(name, "d/") + ".bit."
+	}
+
+	records := v.RecordsRecursive
+	if all {
+		records = v.AllRecordsRecursive
+	}
+	recs, err := records(nil, suffix, "bit.")
+	out := make([]string, len(recs))
+	for i, r := range recs {
+		out[i] = r.RR.String()
+		if r.Provenance.Source != "" {
+			out[i] += "\t; " + r.Provenance.String()
+		}
+	}
+	sort.Strings(out)
+
+	return out, err
+}
+
+func traceRRs(rrs []dns.RR) []string {
+	out := make([]string, len(rrs))
+	for i, rr := range rrs {
+		out[i] = rr.String()
+	}
+	return out
+}
+
+func micros(d time.Duration) int64 {
+	return int64(d / time.Microsecond)
+}
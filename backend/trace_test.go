@@ -0,0 +1,71 @@
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/namecoin/ncdns/testutil"
+)
+
+var update = flag.Bool("update", false, "rewrite golden files")
+
+// An import-heavy name is looked up twice, the second time from the cache,
+// and the steps of both lookups are compared against a golden file.
+func TestLookupTrace(t *testing.T) {
+	b, err := New(&Config{
+		CacheMaxEntries: 100,
+		Clock:           testutil.NewFakeClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)),
+		FakeNames: map[string]string{
+			"d/example": `{"import":[["dd/common"],["dd/mail"]],"ip":["192.0.2.1","192.0.2.1"],"alias":"example.com.","map":{"www":{"import":[["dd/common","www"]],"ip6":"2001:db8::1"}}}`,
+			"dd/common": `{"ip":"192.0.2.1","map":{"www":{"ip6":["2001:db8::1","2001:db8::2"],"txt":"shared www"}}}`,
+			"dd/mail":   `{"mx":[[10,"mx.example.com."]],"import":"s/elsewhere"}`,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var traces [][]TraceStep
+	for i := 0; i < 2; i++ {
+		trace := NewLookupTrace()
+		if _, err := b.LookupContext(WithLookupTrace(context.Background(), trace), "www.example.bit.", ""); err != nil {
+			t.Fatal(err)
+		}
+		traces = append(traces, trace.Steps())
+	}
+
+	got, err := json.MarshalIndent(traces, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkGolden(t, "testdata/trace.golden", string(got)+"\n")
+
+	// Untraced lookups record nothing, and don't fail for want of a trace.
+	if _, err := b.Lookup("www.example.bit.", ""); err != nil {
+		t.Fatal(err)
+	}
+	if steps := (*LookupTrace)(nil).Steps(); steps != nil {
+		t.Errorf("a nil trace has steps %v", steps)
+	}
+}
+
+func checkGolden(t *testing.T, golden, got string) {
+	if *update {
+		if err := ioutil.WriteFile(golden, []byte(got), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expected, err := ioutil.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got != string(expected) {
+		t.Errorf("trace didn't match %s (run with -update to rewrite it):\n%s", golden, got)
+	}
+}
@@ -0,0 +1,69 @@
+package backend
+
+import (
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/namecoin/ncdns/namecoin"
+)
+
+// The maximum TTL of records of expired names served within the grace period.
+const expiredTTL = 60
+
+// The maximum TTL of records answered from stale data (see StaleAnswerTTL),
+// so that resolvers ask again soon, once namecoind may be back.
+const StaleTTL = 30
+
+// Sets the TTLs of the records of a Namecoin name, given its data: RecordTTL,
+// or as stretched by AdaptiveTTL, capped by the time left until the name
+// expires if CapTTLByExpiry is set, and capped further if it has expired and
+// is served within the grace period. Every record gets the same TTL, so that
+// the TTLs of each RRset stay the same.
+func (b *Backend) setNameTTLs(rrs []dns.RR, ncname, streamIsolationID string, nameData *namecoin.NameData) {
+	if t := b.adaptiveTTL(ncname, streamIsolationID, nameData); t != nil {
+		setAdaptiveTTL(rrs, t)
+	} else if b.cfg.RecordTTL != 0 {
+		for _, rr := range rrs {
+			rr.Header().Ttl = b.cfg.RecordTTL
+		}
+	}
+
+	if b.cfg.CapTTLByExpiry {
+		if limit, ok := expiryTTL(nameData, b.cfg.MinRecordTTL); ok {
+			capTTLs(rrs, limit)
+		}
+	}
+
+	// Names served within the grace period after expiry are likely to
+	// disappear soon, so resolvers shouldn't hold on to them for long.
+	if nameData.Expired {
+		capTTLs(rrs, expiredTTL)
+	}
+}
+
+// Returns the time (in seconds) left until a name expires, reckoned from the
+// number of blocks left when it was fetched, but at least floor. Returns false
+// if that isn't known.
+func expiryTTL(nameData *namecoin.NameData, floor uint32) (uint32, bool) {
+	if nameData.ExpiresIn == 0 && !nameData.Expired {
+		return 0, false
+	}
+
+	left := int64(nameData.ExpiresIn) * int64(namecoin.BlockInterval/time.Second)
+	if left < int64(floor) {
+		return floor, true
+	}
+	if left > int64(^uint32(0)) {
+		return ^uint32(0), true
+	}
+	return uint32(left), true
+}
+
+func capTTLs(rrs []dns.RR, limit uint32) {
+	for _, rr := range rrs {
+		if hdr := rr.Header(); hdr.Ttl > limit {
+			hdr.Ttl = limit
+		}
+	}
+}
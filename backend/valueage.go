@@ -0,0 +1,160 @@
+package backend
+
+import (
+	"crypto/sha256"
+	"math"
+
+	"github.com/miekg/dns"
+
+	"github.com/namecoin/ncdns/namecoin"
+)
+
+// The number of blocks for which a name's value must stay the same for its
+// records to be served with AdaptiveMaxTTL, if Config.AdaptiveTTLBlocks isn't
+// set: about 30 days.
+const DefaultAdaptiveTTLBlocks = 4320
+
+// A name's TTL as stretched by Config.AdaptiveTTL.
+type AdaptiveTTL struct {
+	TTL uint32 `json:"ttl"`
+
+	// The height from which the name has had its value, and the number of
+	// blocks since, or zero if unknown.
+	Since        int64 `json:"since_height"`
+	StableBlocks int64 `json:"stable_blocks"`
+}
+
+// Remembers a hash of the value of each name and the height from which the
+// name has had it. namecoind only says when a name was last updated, which
+// for a name which is merely renewed isn't when its value changed.
+type valueAgeCache struct {
+	*boundedCache
+}
+
+type valueAge struct {
+	hash  [sha256.Size]byte
+	since int64 // zero if unknown
+}
+
+func (*valueAge) protocolIndependent() {}
+
+func newValueAgeCache(maxEntries int) *valueAgeCache {
+	return &valueAgeCache{newBoundedCache(maxEntries, 0)}
+}
+
+// Notes the value of a name as fetched at the given height, returning the
+// height from which the name has had it, or zero if unknown.
+func (c *valueAgeCache) observe(name string, nameData *namecoin.NameData, height int64) int64 {
+	hash := sha256.Sum256([]byte(nameData.Value))
+	since := int64(nameData.Height)
+	if v, ok := c.boundedCache.Get(name); ok {
+		// An update which kept the value doesn't make it any younger.
+		if age := v.(*valueAge); age.hash == hash && age.since > 0 && (since <= 0 || age.since < since) {
+			since = age.since
+		}
+	}
+	if since <= 0 {
+		// As far as can be told, the value is new.
+		since = height
+	}
+
+	c.Add(name, &valueAge{hash: hash, since: since}, cacheEntryOverhead+len(name)+sha256.Size+8)
+	return since
+}
+
+func (c *valueAgeCache) since(name string) (int64, bool) {
+	v, ok := c.boundedCache.Get(name)
+	if !ok {
+		return 0, false
+	}
+	return v.(*valueAge).since, true
+}
+
+// Scales a TTL from minTTL, for a value which has just changed, to maxTTL,
+// for one which hasn't for fullBlocks blocks, logarithmically in the number
+// of blocks, so that it grows fastest over the first few. A value is most
+// likely to change again soon after it was changed.
+func scaleTTL(stableBlocks, fullBlocks int64, minTTL, maxTTL uint32) uint32 {
+	if stableBlocks <= 0 || maxTTL <= minTTL {
+		return minTTL
+	}
+	if stableBlocks >= fullBlocks {
+		return maxTTL
+	}
+
+	f := math.Log1p(float64(stableBlocks)) / math.Log1p(float64(fullBlocks))
+	return minTTL + uint32(f*float64(maxTTL-minTTL))
+}
+
+func (b *Backend) chainHeight() int64 {
+	if b.cfg.ChainHeight == nil {
+		return 0
+	}
+	return b.cfg.ChainHeight()
+}
+
+// Returns the TTL of the records of a name with the given data, as stretched
+// by AdaptiveTTL, noting its value. Returns nil if AdaptiveTTL isn't set.
+func (b *Backend) adaptiveTTL(name, streamIsolationID string, nameData *namecoin.NameData) *AdaptiveTTL {
+	if b.valueAges == nil {
+		return nil
+	}
+
+	height := b.chainHeight()
+
+	b.cacheMutex.Lock()
+	ages, ok := b.valueAges[streamIsolationID]
+	if !ok {
+		ages = newValueAgeCache(b.cfg.CacheMaxEntries)
+		ages.clock = b.clock
+		b.valueAges[streamIsolationID] = ages
+	}
+	since := ages.observe(name, nameData, height)
+	b.cacheMutex.Unlock()
+
+	return b.scaledTTL(since, height)
+}
+
+func (b *Backend) scaledTTL(since, height int64) *AdaptiveTTL {
+	t := &AdaptiveTTL{Since: since}
+	if since > 0 && height > since {
+		t.StableBlocks = height - since
+	}
+	t.TTL = scaleTTL(t.StableBlocks, b.cfg.AdaptiveTTLBlocks, b.cfg.AdaptiveMinTTL, b.cfg.AdaptiveMaxTTL)
+	return t
+}
+
+// Returns the TTL with which the records of a Namecoin name (e.g.
+// "d/example") were last served to the given stream isolation ID, as
+// stretched by AdaptiveTTL, for debugging. Returns false if AdaptiveTTL isn't
+// set or the name hasn't been served lately.
+func (b *Backend) NameTTL(ncname, streamIsolationID string) (*AdaptiveTTL, bool) {
+	if b.valueAges == nil {
+		return nil, false
+	}
+
+	b.cacheMutex.Lock()
+	ages, ok := b.valueAges[streamIsolationID]
+	var since int64
+	if ok {
+		since, ok = ages.since(ncname)
+	}
+	b.cacheMutex.Unlock()
+	if !ok {
+		return nil, false
+	}
+
+	return b.scaledTTL(since, b.chainHeight()), true
+}
+
+// Gives the records of a name the TTL of t, if it's set. Values can't give
+// TTLs of their own, so the only limits on it are those of setNameTTLs, which
+// are applied afterwards.
+func setAdaptiveTTL(rrs []dns.RR, t *AdaptiveTTL) {
+	if t == nil {
+		return
+	}
+	for _, rr := range rrs {
+		rr.Header().Ttl = t.TTL
+	}
+}
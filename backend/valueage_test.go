@@ -0,0 +1,109 @@
+package backend
+
+import (
+	"testing"
+
+	"github.com/namecoin/ncdns/namecoin"
+)
+
+func TestScaleTTL(t *testing.T) {
+	tests := []struct {
+		blocks   int64
+		min, max uint32
+	}{
+		{-5, 600, 600},
+		{0, 600, 600},
+		{1, 7000, 8500},
+		{65, 40000, 47000}, // about halfway, on a log scale
+		{1000, 70000, 80000},
+		{4319, 86000, 86400},
+		{4320, 86400, 86400},
+		{100000, 86400, 86400},
+	}
+
+	last := uint32(0)
+	for _, test := range tests {
+		ttl := scaleTTL(test.blocks, 4320, 600, 86400)
+		if ttl < test.min || ttl > test.max {
+			t.Errorf("%d blocks: TTL %d, expected %d to %d", test.blocks, ttl, test.min, test.max)
+		}
+		if ttl < last {
+			t.Errorf("%d blocks: TTL %d is less than for fewer blocks", test.blocks, ttl)
+		}
+		last = ttl
+	}
+
+	if ttl := scaleTTL(100, 4320, 600, 600); ttl != 600 {
+		t.Errorf("TTL %d with equal bounds", ttl)
+	}
+}
+
+func TestAdaptiveTTL(t *testing.T) {
+	height := int64(1000)
+	names := fakeRPCFetcher{
+		"d/example": {Value: `{"ip":["192.0.2.1"]}`, ExpiresIn: 30000, Height: 1000},
+		"d/expired": {Value: `{"ip":["192.0.2.3"]}`, ExpiresIn: -10, Expired: true, Height: 100},
+	}
+	b, err := New(&Config{
+		Fetcher:              names,
+		CacheMaxEntries:      100,
+		ServeExpiredNamesFor: 100,
+		ChainHeight:          func() int64 { return height },
+		AdaptiveTTL:          true,
+		AdaptiveMinTTL:       600,
+		AdaptiveMaxTTL:       86400,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Updated in the best block.
+	if a := lookupA(t, b, "example.bit."); a.Hdr.Ttl != 600 {
+		t.Errorf("TTL %d for a value which has just changed", a.Hdr.Ttl)
+	}
+
+	// The TTL grows as blocks are found, even while the name stays cached.
+	height += DefaultAdaptiveTTLBlocks
+	if a := lookupA(t, b, "example.bit."); a.Hdr.Ttl != 86400 {
+		t.Errorf("TTL %d for a value which hasn't changed for %d blocks", a.Hdr.Ttl, DefaultAdaptiveTTLBlocks)
+	}
+
+	// Renewing the name without changing its value doesn't reset it.
+	height += 10
+	names["d/example"] = &namecoin.NameData{Value: `{"ip":["192.0.2.1"]}`, ExpiresIn: 36000, Height: int32(height)}
+	b.FlushCache()
+	if a := lookupA(t, b, "example.bit."); a.Hdr.Ttl != 86400 {
+		t.Errorf("TTL %d after a renewal", a.Hdr.Ttl)
+	}
+
+	// Changing it does.
+	names["d/example"] = &namecoin.NameData{Value: `{"ip":["192.0.2.2"]}`, ExpiresIn: 36000, Height: int32(height)}
+	height += 20
+	b.FlushCache()
+	a := lookupA(t, b, "example.bit.")
+	if expected := scaleTTL(20, DefaultAdaptiveTTLBlocks, 600, 86400); a.Hdr.Ttl != expected {
+		t.Errorf("TTL %d after a change 20 blocks ago, expected %d", a.Hdr.Ttl, expected)
+	}
+	if at, ok := b.NameTTL("d/example", ""); !ok || at.TTL != a.Hdr.Ttl || at.StableBlocks != 20 || at.Since != height-20 {
+		t.Errorf("unexpected NameTTL %+v", at)
+	}
+	if _, ok := b.NameTTL("d/example", "other"); ok {
+		t.Errorf("NameTTL given for another stream isolation ID")
+	}
+
+	// Expired names are still served with a short TTL, however old.
+	if a := lookupA(t, b, "expired.bit."); a.Hdr.Ttl != expiredTTL {
+		t.Errorf("TTL %d for an expired name", a.Hdr.Ttl)
+	}
+
+	// A value seen for the first time, whose height namecoind doesn't give,
+	// is taken to have just changed.
+	names["d/new"] = &namecoin.NameData{Value: `{"ip":["192.0.2.4"]}`, ExpiresIn: 36000}
+	if a := lookupA(t, b, "new.bit."); a.Hdr.Ttl != 600 {
+		t.Errorf("TTL %d for a name of unknown height", a.Hdr.Ttl)
+	}
+
+	if _, err := New(&Config{AdaptiveTTL: true, AdaptiveMinTTL: 600, AdaptiveMaxTTL: 60}); err == nil {
+		t.Errorf("AdaptiveMinTTL greater than AdaptiveMaxTTL accepted")
+	}
+}
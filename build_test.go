@@ -0,0 +1,80 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+// The build tags leaving out optional features, alone and together as the
+// minimal build profile.
+var buildProfiles = []string{
+	"no_namecoin_tls",
+	"no_webserver",
+	"no_acme",
+	"no_namecoin_tls no_webserver no_acme",
+}
+
+// ncdns builds with each profile, reporting the size of the binary, so that
+// code used only by an optional feature isn't left outside its tag, and its
+// tests pass in the minimal build. They're run with -short, which skips this
+// test among the slower ones.
+func TestBuildProfiles(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds ncdns once per profile and tests the minimal build")
+	}
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("go command not found")
+	}
+
+	dir, err := ioutil.TempDir("", "ncdns-build")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for i, tags := range append([]string{""}, buildProfiles...) {
+		out := filepath.Join(dir, "ncdns"+strconv.Itoa(i))
+		cmd := exec.Command("go", "build", "-tags", tags, "-o", out, ".")
+		if output, err := cmd.CombinedOutput(); err != nil {
+			t.Errorf("tags %q: %v\n%s", tags, err, output)
+			continue
+		}
+		if fi, err := os.Stat(out); err == nil {
+			t.Logf("tags %q: %d bytes", tags, fi.Size())
+		}
+	}
+
+	minimal := buildProfiles[len(buildProfiles)-1]
+	cmd := exec.Command("go", "test", "-short", "-tags", minimal, "./...")
+	if output, err := cmd.CombinedOutput(); err != nil {
+		t.Errorf("tests with tags %q: %v\n%s", minimal, err, output)
+	}
+}
+
+// ncdns builds for Windows, where the service support and the daemon's
+// control by the service control manager are built instead of the signal
+// handling.
+func TestBuildWindows(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds ncdns for Windows")
+	}
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("go command not found")
+	}
+
+	dir, err := ioutil.TempDir("", "ncdns-build")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cmd := exec.Command("go", "build", "-o", filepath.Join(dir, "ncdns.exe"), ".")
+	cmd.Env = append(os.Environ(), "GOOS=windows", "GOARCH=amd64")
+	if output, err := cmd.CombinedOutput(); err != nil {
+		t.Errorf("%v\n%s", err, output)
+	}
+}
@@ -270,3 +270,15 @@ func FillRehydratedCertTemplate(template x509.Certificate, name string) ([]byte,
 	return derBytes, nil
 
 }
+
+// RehydrateCertForName reconstructs the DER certificate represented by a
+// dehydrated certificate for the given domain name (e.g. "www.example.bit").
+// The result depends only on its inputs.
+func RehydrateCertForName(dehydrated *DehydratedCertificate, name string) ([]byte, error) {
+	template, err := RehydrateCert(dehydrated)
+	if err != nil {
+		return nil, err
+	}
+
+	return FillRehydratedCertTemplate(*template, name)
+}
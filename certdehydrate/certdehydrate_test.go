@@ -1,8 +1,11 @@
 package certdehydrate_test
 
 import (
+	"bytes"
 	"crypto/x509"
 	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
 	"reflect"
 	"testing"
 
@@ -114,3 +117,56 @@ func TestDehydratedCertSignatureInvalid(t *testing.T) {
 		t.Error("Invalid signature accepted:", err)
 	}
 }
+
+// Reconstruction must reproduce, byte for byte, the certificate which was
+// dehydrated. The fixture's signature only verifies if it does.
+func TestRehydrateCertForNameFixture(t *testing.T) {
+	bytesJson, err := ioutil.ReadFile("testdata/www.veclabs.bit.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectedPEM, err := ioutil.ReadFile("testdata/www.veclabs.bit.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, _ := pem.Decode(expectedPEM)
+	if expected == nil {
+		t.Fatal("Couldn't decode expected certificate")
+	}
+
+	var parsedJson interface{}
+	if err := json.Unmarshal(bytesJson, &parsedJson); err != nil {
+		t.Fatal("Error parsing JSON:", err)
+	}
+
+	dehydrated, err := certdehydrate.ParseDehydratedCert(parsedJson)
+	if err != nil {
+		t.Fatal("Error parsing dehydrated certificate:", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		derBytes, err := certdehydrate.RehydrateCertForName(dehydrated, "www.veclabs.bit")
+		if err != nil {
+			t.Fatal("Error rehydrating certificate:", err)
+		}
+
+		if !bytes.Equal(derBytes, expected.Bytes) {
+			t.Fatalf("Rehydrated certificate differs from the known-good certificate")
+		}
+	}
+
+	cert, err := x509.ParseCertificate(expected.Bytes)
+	if err != nil {
+		t.Fatal("Error parsing DER certificate:", err)
+	}
+
+	err = cert.CheckSignature(cert.SignatureAlgorithm, cert.RawTBSCertificate, cert.Signature)
+	if err != nil {
+		t.Error("Known-good certificate has an invalid signature:", err)
+	}
+
+	if len(cert.DNSNames) != 1 || cert.DNSNames[0] != "www.veclabs.bit" {
+		t.Errorf("Got DNS names %v", cert.DNSNames)
+	}
+}
@@ -16,8 +16,11 @@ var log, _ = xlog.New("ncdumpzone-main")
 
 var (
 	flagGroup   = cflag.NewGroup(nil, "ncdumpzone")
-	rpchostFlag = cflag.String(flagGroup, "namecoinrpcaddress",
-		"127.0.0.1:8336", "Namecoin RPC host:port")
+	networkFlag = cflag.String(flagGroup, "namecoinnetwork", "mainnet",
+		"Namecoin network: mainnet, testnet or regtest")
+	rpchostFlag = cflag.String(flagGroup, "namecoinrpcaddress", "",
+		"Namecoin RPC host:port (default: the network's default RPC port "+
+			"on 127.0.0.1)")
 	rpcuserFlag = cflag.String(flagGroup, "namecoinrpcusername", "",
 		"Namecoin RPC username")
 	rpcpassFlag = cflag.String(flagGroup, "namecoinrpcpassword", "",
@@ -27,7 +30,14 @@ var (
 	formatFlag = cflag.String(flagGroup, "format", "zonefile", "Output "+
 		"format.  \"zonefile\" = DNS zone file.  "+
 		"\"firefox-override\" = Firefox cert_override.txt format.  "+
-		"\"url-list\" = URL list.")
+		"\"url-list\" = URL list.  "+
+		"\"stats\" = counts of names publishing IPv4 and IPv6 addresses.")
+	namesPerSecondFlag = cflag.Int(flagGroup, "namespersecond", 0,
+		"Maximum rate at which names are fetched from Namecoin Core "+
+			"(0: no limit)")
+	canonicalFlag = cflag.Bool(flagGroup, "canonical", false,
+		"Write the records of each name in canonical order, so that "+
+			"dumps of the same names are identical")
 )
 
 var conn *namecoin.Client
@@ -42,6 +52,11 @@ func main() {
 		log.Fatalf("Couldn't parse configuration: %s", err)
 	}
 
+	network, err := namecoin.NetworkByName(networkFlag.Value())
+	if err != nil {
+		log.Fatale(err)
+	}
+
 	// Connect to local namecoin core RPC server using HTTP POST mode.
 	connCfg := &rpcclient.ConnConfig{
 		Host:         rpchostFlag.Value(),
@@ -51,6 +66,7 @@ func main() {
 		HTTPPostMode: true, // Namecoin core only supports HTTP POST mode
 		DisableTLS:   true, // Namecoin core does not provide TLS by default
 	}
+	network.SetDefaults(connCfg)
 
 	// Notice the notification parameter is nil since notifications are
 	// not supported in HTTP POST mode.
@@ -60,7 +76,12 @@ func main() {
 	}
 	defer conn.Shutdown()
 
-	err = ncdumpzone.Dump(conn, os.Stdout, formatFlag.Value())
+	err = ncdumpzone.DumpWithOptions(conn, os.Stdout, formatFlag.Value(), &ncdumpzone.Options{
+		Pacer: ncdumpzone.NewPacer(&ncdumpzone.PacerConfig{
+			NamesPerSecond: float64(namesPerSecondFlag.Value()),
+		}),
+		Canonical: canonicalFlag.Value(),
+	})
 	if err != nil {
 		log.Fatalf("Couldn't dump zone: %s", err)
 	}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/namecoin/ncdns/server"
+	"gopkg.in/hlandau/easyconfig.v1"
+)
+
+// Builds the configuration from flat, as read by config from the [ncdns]
+// section of the configuration file and the flags in args: the sections of
+// the configuration file are applied over it, then the environment, which
+// options given as flags override.
+func loadConfig(config *easyconfig.Configurator, flat interface{}, args []string) (*server.Config, error) {
+	cfg := &server.Config{}
+	cfg.SetFlat(flat)
+	if err := cfg.ApplyConfigFile(config.ConfigFilePath(), args); err != nil {
+		return nil, err
+	}
+	if err := cfg.ApplyEnv(os.Environ(), args); err != nil {
+		return nil, err
+	}
+
+	// We use the configPath to resolve paths relative to the config file.
+	cfg.ConfigDir = filepath.Dir(config.ConfigFilePath())
+	return cfg, nil
+}
@@ -0,0 +1,454 @@
+// Package conformance checks over the wire that a DNS server for a Namecoin
+// suffix, such as a running ncdns, answers as validating resolvers expect:
+// that its apex and answers validate from a trust anchor, that it proves the
+// absence of names and records, and that it handles truncation, case, names
+// outside its zone and EDNS as the standards require. Answers are validated
+// with the resolver package, the same code ncdns uses for its own queries.
+package conformance
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/namecoin/ncdns/resolver"
+	"github.com/namecoin/ncdns/trustanchor"
+)
+
+// The outcome of a check.
+type Status int
+
+const (
+	Pass Status = iota
+	Skip        // the check doesn't apply, e.g. as a feature isn't advertised
+	Fail
+)
+
+func (st Status) String() string {
+	switch st {
+	case Pass:
+		return "pass"
+	case Skip:
+		return "skip"
+	default:
+		return "fail"
+	}
+}
+
+func (st Status) MarshalJSON() ([]byte, error) {
+	return json.Marshal(st.String())
+}
+
+// The result of one of the checks made by Run.
+type CheckResult struct {
+	Name    string `json:"name"`
+	Status  Status `json:"status"`
+	Message string `json:"message"`
+}
+
+// What Run found.
+type Report struct {
+	Server string        `json:"server"`
+	Suffix string        `json:"suffix"`
+	Checks []CheckResult `json:"checks"`
+	Failed int           `json:"failed"`
+}
+
+func (r *Report) add(name string, status Status, format string, args ...interface{}) {
+	r.Checks = append(r.Checks, CheckResult{
+		Name:    name,
+		Status:  status,
+		Message: fmt.Sprintf(format, args...),
+	})
+	if status == Fail {
+		r.Failed++
+	}
+}
+
+// Writes the report in the Test Anything Protocol, a line for each check.
+func (r *Report) WriteTAP(w io.Writer) {
+	fmt.Fprintf(w, "TAP version 13\n1..%d\n", len(r.Checks))
+	for i, c := range r.Checks {
+		switch c.Status {
+		case Pass:
+			fmt.Fprintf(w, "ok %d - %s: %s\n", i+1, c.Name, c.Message)
+		case Skip:
+			fmt.Fprintf(w, "ok %d - %s # SKIP %s\n", i+1, c.Name, c.Message)
+		default:
+			fmt.Fprintf(w, "not ok %d - %s: %s\n", i+1, c.Name, c.Message)
+		}
+	}
+}
+
+// Options for Run.
+type Options struct {
+	// Address of the server to check, e.g. 127.0.0.1:53.
+	Server string
+
+	// The suffix it serves, e.g. "bit".
+	Suffix string
+
+	// The trust anchors of the suffix, e.g. its KSK, with which answers
+	// are validated.
+	Anchors []trustanchor.Anchor
+
+	// A name known to exist, e.g. example.bit, and a type of record it
+	// has. If Name is empty, no positive answer is checked. If Type is
+	// zero, A records are looked up.
+	Name string
+	Type uint16
+
+	// Timeout of each query. If zero, a default is used.
+	Timeout time.Duration
+}
+
+const defaultTimeout = 5 * time.Second
+
+// A record type which the apex of an ncdns zone never has, for the check
+// of a validated NODATA answer.
+const nodataType = dns.TypeNAPTR
+
+// Checks the server in opts, returning what was found. An error is returned
+// only if the checks can't be made at all, e.g. as there's no trust anchor;
+// a server which fails checks is reported in the Report.
+func Run(ctx context.Context, opts *Options) (*Report, error) {
+	s := &suite{opts: *opts}
+	if s.opts.Timeout <= 0 {
+		s.opts.Timeout = defaultTimeout
+	}
+	if s.opts.Type == 0 {
+		s.opts.Type = dns.TypeA
+	}
+	s.apex = dns.Fqdn(strings.ToLower(strings.Trim(s.opts.Suffix, ".")))
+	s.report.Server = s.opts.Server
+	s.report.Suffix = s.apex
+
+	var anchors []trustanchor.Anchor
+	for _, a := range s.opts.Anchors {
+		if strings.EqualFold(dns.Fqdn(a.Zone), s.apex) {
+			anchors = append(anchors, a)
+		}
+	}
+	if len(anchors) == 0 {
+		return nil, fmt.Errorf("no trust anchor for %s", s.apex)
+	}
+
+	// The server is the only upstream, and the suffix's anchor the only
+	// anchor, so answers are validated from the suffix down, as a
+	// resolver configured with that anchor would.
+	var err error
+	s.r, err = resolver.New(&resolver.Config{
+		Upstreams:       []string{s.opts.Server},
+		TrustAnchors:    anchors,
+		Timeout:         s.opts.Timeout,
+		CacheMaxEntries: 100,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	s.checkApex(ctx)
+	s.checkPositive(ctx)
+	s.checkNODATA(ctx)
+	s.checkNXDOMAIN(ctx)
+	s.checkTCPFallback(ctx)
+	s.checkCase(ctx)
+	s.checkRefused(ctx)
+	s.checkEDNSVersion(ctx)
+	s.checkNSID(ctx)
+	s.checkCookie(ctx)
+
+	return &s.report, nil
+}
+
+type suite struct {
+	opts   Options
+	apex   string
+	r      *resolver.Resolver
+	report Report
+}
+
+// Looks up name and qtype through the resolver, failing unless the answer
+// validates as secure.
+func (s *suite) validated(ctx context.Context, name string, qtype uint16) (*dns.Msg, error) {
+	res, err := s.r.Query(ctx, name, qtype)
+	if err != nil {
+		return nil, err
+	}
+	if !res.Secure {
+		return nil, fmt.Errorf("the answer for %s %s is provably insecure", name, dns.TypeToString[qtype])
+	}
+	return res.Msg, nil
+}
+
+// Sends q to the server over network ("udp" or "tcp") as it is, without
+// retrying over TCP.
+func (s *suite) exchange(ctx context.Context, network string, q *dns.Msg) (*dns.Msg, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.opts.Timeout)
+	defer cancel()
+
+	m, _, err := (&dns.Client{Net: network}).ExchangeContext(ctx, q, s.opts.Server)
+	return m, err
+}
+
+// Returns a query for name and qtype with EDNS and the DO bit, as a
+// validating resolver sends.
+func query(name string, qtype uint16, bufsize uint16) *dns.Msg {
+	q := new(dns.Msg)
+	q.SetQuestion(name, qtype)
+	q.SetEdns0(bufsize, true)
+	return q
+}
+
+func (s *suite) checkApex(ctx context.Context) {
+	for _, qtype := range []uint16{dns.TypeSOA, dns.TypeNS, dns.TypeDNSKEY} {
+		check := "apex-" + strings.ToLower(dns.TypeToString[qtype])
+		what := s.apex + " " + dns.TypeToString[qtype]
+
+		m, err := s.validated(ctx, s.apex, qtype)
+		switch {
+		case err != nil:
+			s.report.add(check, Fail, "%s: %v", what, err)
+		case countType(m.Answer, qtype) == 0:
+			s.report.add(check, Fail, "%s was answered with %s and no %s records", what, dns.RcodeToString[m.Rcode], dns.TypeToString[qtype])
+		default:
+			s.report.add(check, Pass, "%s was answered with %d records, which validate", what, countType(m.Answer, qtype))
+		}
+	}
+}
+
+func (s *suite) checkPositive(ctx context.Context) {
+	if s.opts.Name == "" {
+		s.report.add("positive", Skip, "no known name given")
+		return
+	}
+
+	name := dns.Fqdn(strings.ToLower(s.opts.Name))
+	what := name + " " + dns.TypeToString[s.opts.Type]
+	m, err := s.validated(ctx, name, s.opts.Type)
+	switch {
+	case err != nil:
+		s.report.add("positive", Fail, "%s: %v", what, err)
+	case m.Rcode != dns.RcodeSuccess || countType(m.Answer, s.opts.Type)+countType(m.Answer, dns.TypeCNAME) == 0:
+		s.report.add("positive", Fail, "%s was answered with %s and no records", what, dns.RcodeToString[m.Rcode])
+	default:
+		s.report.add("positive", Pass, "%s was answered with %d records, which validate", what, len(m.Answer))
+	}
+}
+
+func (s *suite) checkNODATA(ctx context.Context) {
+	what := s.apex + " " + dns.TypeToString[nodataType]
+	m, err := s.validated(ctx, s.apex, nodataType)
+	switch {
+	case err != nil:
+		s.report.add("nodata", Fail, "%s: %v", what, err)
+	case m.Rcode != dns.RcodeSuccess || countType(m.Answer, nodataType) != 0:
+		s.report.add("nodata", Fail, "%s was answered with %s and %d records, not NODATA", what, dns.RcodeToString[m.Rcode], len(m.Answer))
+	default:
+		s.report.add("nodata", Pass, "%s was answered with NODATA, whose proof validates", what)
+	}
+}
+
+func (s *suite) checkNXDOMAIN(ctx context.Context) {
+	label := make([]byte, 6)
+	rand.Read(label)
+	name := "ncdns-conformance-" + hex.EncodeToString(label) + "." + s.apex
+
+	m, err := s.validated(ctx, name, dns.TypeA)
+	switch {
+	case err != nil:
+		s.report.add("nxdomain", Fail, "%s A: %v", name, err)
+	case m.Rcode != dns.RcodeNameError:
+		s.report.add("nxdomain", Fail, "%s A was answered with %s, not NXDOMAIN", name, dns.RcodeToString[m.Rcode])
+	default:
+		s.report.add("nxdomain", Pass, "%s A was answered with NXDOMAIN, whose proof validates", name)
+	}
+}
+
+// Asks for the apex DNSKEYs, with their signatures too large for 512 bytes,
+// over UDP with a 512-byte buffer, expecting a truncated response, and then
+// over TCP, expecting the full answer.
+func (s *suite) checkTCPFallback(ctx context.Context) {
+	q := query(s.apex, dns.TypeDNSKEY, dns.MinMsgSize)
+	udp, err := s.exchange(ctx, "udp", q)
+	if err != nil {
+		s.report.add("tcp-fallback", Fail, "%s DNSKEY over UDP: %v", s.apex, err)
+		return
+	}
+	if !udp.Truncated {
+		if size := udp.Len(); size > dns.MinMsgSize {
+			s.report.add("tcp-fallback", Fail, "a %d-byte response was sent over UDP for a %d-byte buffer, without TC", size, dns.MinMsgSize)
+		} else {
+			s.report.add("tcp-fallback", Skip, "the %s DNSKEY response fits in %d bytes, so isn't truncated", s.apex, dns.MinMsgSize)
+		}
+		return
+	}
+
+	tcp, err := s.exchange(ctx, "tcp", q)
+	switch {
+	case err != nil:
+		s.report.add("tcp-fallback", Fail, "%s DNSKEY over TCP after truncation: %v", s.apex, err)
+	case tcp.Truncated || countType(tcp.Answer, dns.TypeDNSKEY) == 0:
+		s.report.add("tcp-fallback", Fail, "%s DNSKEY over TCP was answered with %d records (TC %v)", s.apex, len(tcp.Answer), tcp.Truncated)
+	default:
+		s.report.add("tcp-fallback", Pass, "truncated over UDP, then answered in full with %d records over TCP", len(tcp.Answer))
+	}
+}
+
+// Asks for the apex SOA by a name in mixed case, as resolvers using 0x20
+// encoding do, expecting the question back as it was asked.
+func (s *suite) checkCase(ctx context.Context) {
+	b := []byte(s.apex)
+	for i := 0; i < len(b); i += 2 {
+		if 'a' <= b[i] && b[i] <= 'z' {
+			b[i] -= 'a' - 'A'
+		}
+	}
+	name := string(b)
+
+	m, err := s.exchange(ctx, "udp", query(name, dns.TypeSOA, dns.DefaultMsgSize))
+	switch {
+	case err != nil:
+		s.report.add("case", Fail, "%s SOA: %v", name, err)
+	case len(m.Question) != 1 || m.Question[0].Name != name:
+		s.report.add("case", Fail, "the question %s was answered as %v", name, m.Question)
+	default:
+		s.report.add("case", Pass, "the question %s was answered with its case preserved", name)
+	}
+}
+
+// Asks for a name in the reserved .invalid TLD, outside the suffix, expecting
+// REFUSED rather than an answer, a referral or SERVFAIL.
+func (s *suite) checkRefused(ctx context.Context) {
+	const name = "ncdns-conformance.invalid."
+	m, err := s.exchange(ctx, "udp", query(name, dns.TypeA, dns.DefaultMsgSize))
+	switch {
+	case err != nil:
+		s.report.add("refused", Fail, "%s A: %v", name, err)
+	case m.Rcode != dns.RcodeRefused:
+		s.report.add("refused", Fail, "%s A, outside %s, was answered with %s, not REFUSED", name, s.apex, dns.RcodeToString[m.Rcode])
+	default:
+		s.report.add("refused", Pass, "%s A, outside %s, was refused", name, s.apex)
+	}
+}
+
+// Sends a query with EDNS version 1, expecting BADVERS and an OPT record of
+// version 0, as RFC 6891 requires.
+func (s *suite) checkEDNSVersion(ctx context.Context) {
+	q := query(s.apex, dns.TypeSOA, dns.DefaultMsgSize)
+	q.IsEdns0().SetVersion(1)
+
+	m, err := s.exchange(ctx, "udp", q)
+	if err != nil {
+		s.report.add("edns-version", Fail, "%s SOA with EDNS version 1: %v", s.apex, err)
+		return
+	}
+
+	opt := m.IsEdns0()
+	switch {
+	case m.Rcode != dns.RcodeBadVers:
+		s.report.add("edns-version", Fail, "a query with EDNS version 1 was answered with %s, not BADVERS", dns.RcodeToString[m.Rcode])
+	case opt == nil || opt.Version() != 0:
+		s.report.add("edns-version", Fail, "BADVERS was sent without an OPT record of version 0")
+	default:
+		s.report.add("edns-version", Pass, "a query with EDNS version 1 was answered with BADVERS and version 0")
+	}
+}
+
+// Returns the option with the given code in the OPT record of m, if any.
+func ednsOption(m *dns.Msg, code uint16) dns.EDNS0 {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+	for _, o := range opt.Option {
+		if o.Option() == code {
+			return o
+		}
+	}
+	return nil
+}
+
+func (s *suite) checkNSID(ctx context.Context) {
+	q := query(s.apex, dns.TypeSOA, dns.DefaultMsgSize)
+	opt := q.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_NSID{Code: dns.EDNS0NSID})
+
+	m, err := s.exchange(ctx, "udp", q)
+	if err != nil {
+		s.report.add("nsid", Fail, "%s SOA with NSID: %v", s.apex, err)
+		return
+	}
+
+	nsid, ok := ednsOption(m, dns.EDNS0NSID).(*dns.EDNS0_NSID)
+	if !ok {
+		s.report.add("nsid", Skip, "NSID isn't advertised")
+		return
+	}
+	id, err := hex.DecodeString(nsid.Nsid)
+	if err != nil || len(id) == 0 {
+		s.report.add("nsid", Fail, "an empty or malformed NSID was sent: %q", nsid.Nsid)
+		return
+	}
+	s.report.add("nsid", Pass, "the server identifies itself as %q", id)
+}
+
+// Sends a query with a client cookie and, if the response carries a server
+// cookie, sends it back, as RFC 7873 describes, expecting it to be accepted.
+func (s *suite) checkCookie(ctx context.Context) {
+	client := make([]byte, 8)
+	rand.Read(client)
+	clientHex := hex.EncodeToString(client)
+
+	send := func(cookie string) (*dns.Msg, error) {
+		q := query(s.apex, dns.TypeSOA, dns.DefaultMsgSize)
+		opt := q.IsEdns0()
+		opt.Option = append(opt.Option, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: cookie})
+		return s.exchange(ctx, "udp", q)
+	}
+
+	m, err := send(clientHex)
+	if err != nil {
+		s.report.add("cookie", Fail, "%s SOA with a client cookie: %v", s.apex, err)
+		return
+	}
+
+	cookie, ok := ednsOption(m, dns.EDNS0COOKIE).(*dns.EDNS0_COOKIE)
+	if !ok {
+		s.report.add("cookie", Skip, "DNS cookies aren't advertised")
+		return
+	}
+
+	// The client cookie is 8 bytes, and the server cookie 8 to 32.
+	if n := len(cookie.Cookie) / 2; n < 16 || n > 40 || !strings.EqualFold(cookie.Cookie[:16], clientHex) {
+		s.report.add("cookie", Fail, "the cookie %s sent back doesn't echo the client cookie %s with a server cookie of 8 to 32 bytes", cookie.Cookie, clientHex)
+		return
+	}
+
+	m, err = send(cookie.Cookie)
+	switch {
+	case err != nil:
+		s.report.add("cookie", Fail, "%s SOA with the server cookie: %v", s.apex, err)
+	case m.Rcode != dns.RcodeSuccess:
+		s.report.add("cookie", Fail, "a query with the server's cookie was answered with %s", dns.RcodeToString[m.Rcode])
+	default:
+		s.report.add("cookie", Pass, "a server cookie was sent, and accepted when sent back")
+	}
+}
+
+func countType(rrs []dns.RR, rrtype uint16) int {
+	n := 0
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == rrtype {
+			n++
+		}
+	}
+	return n
+}
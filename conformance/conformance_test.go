@@ -0,0 +1,162 @@
+package conformance
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/namecoin/ncdns/server"
+	"github.com/namecoin/ncdns/trustanchor"
+)
+
+// Starts an ncdns serving d/example from static data, signed with a new KSK,
+// returning its address and the KSK's trust anchor.
+func startServer(t *testing.T) (string, trustanchor.Anchor) {
+	dir, err := ioutil.TempDir("", "ncdns-conformance")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	if err := os.MkdirAll(filepath.Join(dir, "names", "d"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, "names", "d", "example.json"), []byte(`{"ip":"192.0.2.1"}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ksk, priv, err := server.GenerateKey("bit", 257, dns.RSASHA256, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	base, err := server.WriteKeyFiles(dir, ksk, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zsk, zskPriv, err := server.GenerateKey("bit", 256, dns.RSASHA256, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zskBase, err := server.WriteKeyFiles(dir, zsk, zskPriv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := server.New(&server.Config{
+		ConfigDir:     dir,
+		BindAddresses: "127.0.0.1:0",
+		DNSSEC: server.DNSSECConfig{
+			PublicKey:  filepath.Base(base) + ".key",
+			PrivateKey: filepath.Base(base) + ".private",
+
+			ZonePublicKey:  filepath.Base(zskBase) + ".key",
+			ZonePrivateKey: filepath.Base(zskBase) + ".private",
+		},
+		Fetcher:             "static",
+		StaticDataDir:       "names",
+		Cache:               server.CacheConfig{MaxEntries: 100},
+		RPC:                 server.RPCConfig{MaxValueSize: 2080},
+		HealthCheckInterval: 30,
+		HealthCheckProbe:    "tcp:80",
+		CanonicalSuffix:     "bit",
+		StopTimeout:         5,
+
+		ApexInfrastructureTTL: 86400,
+		AdaptiveTTLBlocks:     4320,
+		RecordTTL:             600,
+		MinRecordTTL:          60,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Stop() })
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	return s.UDPAddrs()[0].String(), trustanchor.Anchor{Zone: "bit.", DS: ksk.ToDS(dns.SHA256), Key: ksk}
+}
+
+func TestRun(t *testing.T) {
+	addr, anchor := startServer(t)
+
+	report, err := Run(context.Background(), &Options{
+		Server:  addr,
+		Suffix:  "bit",
+		Anchors: []trustanchor.Anchor{anchor},
+		Name:    "example.bit",
+		Timeout: 5 * time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// ncdns supports neither NSID nor cookies, so those are skipped.
+	skipped := map[string]bool{"nsid": true, "cookie": true}
+	for _, c := range report.Checks {
+		expected := Pass
+		if skipped[c.Name] {
+			expected = Skip
+		}
+		if c.Status != expected {
+			t.Errorf("%s: %s (%s), expected %s", c.Name, c.Status, c.Message, expected)
+		}
+	}
+	if len(report.Checks) != 12 || report.Failed != 0 {
+		t.Errorf("got %d checks, %d failed", len(report.Checks), report.Failed)
+	}
+
+	// Another suffix's anchor validates nothing.
+	other, _, err := server.GenerateKey("bit", 257, dns.ECDSAP256SHA256, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err = Run(context.Background(), &Options{
+		Server:  addr,
+		Suffix:  "bit",
+		Anchors: []trustanchor.Anchor{{Zone: "bit.", DS: other.ToDS(dns.SHA256), Key: other}},
+		Timeout: 5 * time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Checks[0].Name != "apex-soa" || report.Checks[0].Status != Fail {
+		t.Errorf("apex validated with the wrong anchor: %+v", report.Checks[0])
+	}
+
+	if _, err := Run(context.Background(), &Options{Server: addr, Suffix: "bit"}); err == nil {
+		t.Errorf("checks made without a trust anchor")
+	}
+}
+
+func TestWriteTAP(t *testing.T) {
+	r := &Report{}
+	r.add("apex-soa", Pass, "bit. SOA was answered")
+	r.add("nsid", Skip, "NSID isn't advertised")
+	r.add("refused", Fail, "answered with NOERROR")
+
+	var b bytes.Buffer
+	r.WriteTAP(&b)
+	expected := strings.Join([]string{
+		"TAP version 13",
+		"1..3",
+		"ok 1 - apex-soa: bit. SOA was answered",
+		"ok 2 - nsid # SKIP NSID isn't advertised",
+		"not ok 3 - refused: answered with NOERROR",
+		"",
+	}, "\n")
+	if b.String() != expected {
+		t.Errorf("got TAP output\n%s\nexpected\n%s", b.String(), expected)
+	}
+	if r.Failed != 1 {
+		t.Errorf("got %d failed, expected 1", r.Failed)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/namecoin/ncdns/conformance"
+	"github.com/namecoin/ncdns/trustanchor"
+)
+
+func init() {
+	subcommands["conformance"] = &subcommand{
+		usage: "conformance [-server=ADDRESS] [-suffix=SUFFIX] -anchor=FILE [-name=NAME] [-format=tap|json]: check over the wire that a running instance answers as validating resolvers expect",
+		run:   runConformance,
+	}
+}
+
+// Exits 0 if every check passes (or is skipped), 1 if any fails and 2 if the
+// checks couldn't be made.
+func runConformance(args []string) int {
+	// The server is only queried, so no configuration is read.
+	fs := flag.NewFlagSet("ncdns conformance", flag.ContinueOnError)
+	addr := fs.String("server", "127.0.0.1:53", "Address of the server to check")
+	suffix := fs.String("suffix", "bit", "Suffix the server serves")
+	anchorFile := fs.String("anchor", "", "File holding the suffix's trust anchor, e.g. its KSK's .key file or a DS record")
+	name := fs.String("name", "", "A name known to exist (e.g. example.bit), to check a positive answer")
+	qtype := fs.String("type", "A", "Type of record -name has")
+	timeout := fs.Duration("timeout", 5*time.Second, "Timeout of each query")
+	format := fs.String("format", "tap", "Output format: tap or json")
+	if fs.Parse(args) != nil {
+		return 2
+	}
+
+	if *anchorFile == "" {
+		fmt.Fprintf(os.Stderr, "Usage: ncdns conformance [-server=ADDRESS] [-suffix=SUFFIX] -anchor=FILE [-name=NAME]\n")
+		return 2
+	}
+	if *format != "tap" && *format != "json" {
+		fmt.Fprintf(os.Stderr, "Unknown format %q: must be tap or json\n", *format)
+		return 2
+	}
+	rrtype, ok := dns.StringToType[*qtype]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Unknown record type %q\n", *qtype)
+		return 2
+	}
+
+	f, err := os.Open(*anchorFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Couldn't open trust anchor file: %s\n", err)
+		return 2
+	}
+	anchors, err := trustanchor.Parse(f)
+	f.Close()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Couldn't parse trust anchor file: %s\n", err)
+		return 2
+	}
+
+	report, err := conformance.Run(context.Background(), &conformance.Options{
+		Server:  *addr,
+		Suffix:  *suffix,
+		Anchors: anchors,
+		Name:    *name,
+		Type:    rrtype,
+		Timeout: *timeout,
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return 2
+	}
+
+	if *format == "json" {
+		b, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			return 2
+		}
+		fmt.Printf("%s\n", b)
+	} else {
+		report.WriteTAP(os.Stdout)
+	}
+
+	if report.Failed > 0 {
+		return 1
+	}
+	return 0
+}
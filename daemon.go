@@ -0,0 +1,96 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/namecoin/ncdns/server"
+	"gopkg.in/hlandau/easyconfig.v1"
+	"gopkg.in/hlandau/service.v2"
+)
+
+// The daemon: ncdns running as configured, controlled by the platform, by
+// signals on Unix and by the service control manager when run as a Windows
+// service. The platform's files provide run, which runs it, watchSignals, stop
+// and reportStartupError; what the platform asks of it is done here, the same
+// way on every platform.
+type daemon struct {
+	config *easyconfig.Configurator
+	cfg    *server.Config
+
+	// The signals service.Main stops the daemon on, delivered here too so
+	// that stop can tell which it got. Unused on Windows.
+	stopSignals chan os.Signal
+}
+
+// The server as service.Main runs it, stopped by the daemon's stop.
+type daemonServer struct {
+	*server.Server
+	d *daemon
+}
+
+func (ds daemonServer) Stop() error {
+	return ds.d.stop(ds.Server)
+}
+
+// Creates the server, which is then started and stopped by the platform, and
+// starts watching for the signals asking it to reload.
+func (d *daemon) newServer() (*server.Server, error) {
+	s, err := server.New(d.cfg)
+	if err != nil {
+		return nil, err
+	}
+	go d.watchSignals(s)
+	return s, nil
+}
+
+// Runs the daemon as a console process, or as a Unix daemon as service.Main's
+// flags say, until it's interrupted or terminated.
+func (d *daemon) runConsole() {
+	service.Main(&service.Info{
+		Description:   serviceDescription,
+		DefaultChroot: service.EmptyChrootPath,
+		NewFunc: func() (service.Runnable, error) {
+			s, err := d.newServer()
+			if err != nil {
+				reportStartupError(err)
+				os.Exit(exitCode(err))
+			}
+			return daemonServer{s, d}, nil
+		},
+	})
+}
+
+const serviceDescription = "Namecoin to DNS Daemon"
+
+// Reloads the configuration of s, reading it as at startup: from the
+// configuration file, the environment and the command line. A reload asked
+// for while the server is starting, draining, stopped or already reloading
+// is refused. The error says what was done instead.
+func (d *daemon) reload(s *server.Server) error {
+	flat := server.NewFlatConfig()
+	err := d.config.Parse(flat)
+	var cfg *server.Config
+	if err == nil {
+		cfg, err = loadConfig(d.config, flat, os.Args[1:])
+	}
+	if err == nil {
+		err = s.Reload(cfg)
+	}
+	if errors.Is(err, server.ErrInvalidState) {
+		return fmt.Errorf("Not reloading configuration: %s", err)
+	} else if err != nil {
+		return fmt.Errorf("Couldn't reload configuration, carrying on with the old one: %s", err)
+	}
+	return nil
+}
+
+// Reopens the query log of s, so that logrotate can move it away and have
+// ncdns start a new one.
+func (d *daemon) reopenQueryLog(s *server.Server) error {
+	if err := s.ReopenQueryLog(); err != nil {
+		return fmt.Errorf("Couldn't reopen the query log: %s", err)
+	}
+	return nil
+}
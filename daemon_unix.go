@@ -0,0 +1,77 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/namecoin/ncdns/server"
+)
+
+// How long stop waits for the signal service.Main stopped the daemon on. It's
+// delivered to d.stopSignals at the same time, so this only runs out if the
+// daemon was stopped otherwise.
+const stopSignalWait = time.Second
+
+func (d *daemon) run() {
+	d.stopSignals = make(chan os.Signal, 2)
+	signal.Notify(d.stopSignals, syscall.SIGINT, syscall.SIGTERM)
+	d.runConsole()
+}
+
+// Stops s as service.Main asks, on SIGINT or SIGTERM. On SIGTERM, if
+// DrainOnSIGTERM is set, s is drained for DrainDuration first, so that load
+// balancers can move traffic elsewhere; one which can't be drained, as it's
+// being reloaded, is stopped at once.
+func (d *daemon) stop(s *server.Server) error {
+	if d.cfg.DrainOnSIGTERM && d.stoppedBy() == syscall.SIGTERM {
+		err := s.Drain(time.Duration(d.cfg.DrainDuration) * time.Second)
+		if !errors.Is(err, server.ErrInvalidState) {
+			return err
+		}
+	}
+
+	return s.Stop()
+}
+
+// Returns the signal service.Main stopped the daemon on, or nil if none came.
+func (d *daemon) stoppedBy() os.Signal {
+	select {
+	case sig := <-d.stopSignals:
+		return sig
+	case <-time.After(stopSignalWait):
+		return nil
+	}
+}
+
+// Reloads the configuration of s on each SIGHUP, and reopens its query log on
+// each SIGUSR1. SIGINT and SIGTERM, which stop it, are handled by
+// service.Main, and stop.
+func (d *daemon) watchSignals(s *server.Server) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP, syscall.SIGUSR1)
+
+	for sig := range c {
+		var err error
+		switch sig {
+		case syscall.SIGHUP:
+			err = d.reload(s)
+		case syscall.SIGUSR1:
+			err = d.reopenQueryLog(s)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+		}
+	}
+}
+
+// Reports an error which stops the daemon from starting.
+func reportStartupError(err error) {
+	fmt.Fprintf(os.Stderr, "%s\n", err)
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/eventlog"
+
+	"github.com/namecoin/ncdns/server"
+)
+
+// Runs the daemon as a Windows service if the service control manager
+// started it, or else as a console process, stopped by Ctrl+C.
+func (d *daemon) run() {
+	if !runningAsService() {
+		d.runConsole()
+		return
+	}
+
+	if err := svc.Run(serviceName, &windowsService{d: d}); err != nil {
+		reportStartupError(err)
+		os.Exit(1)
+	}
+}
+
+// There's no SIGHUP or SIGUSR1 on Windows: the service is reloaded by the
+// service control manager (see "ncdns service reload"), and QueryLogMaxBytes
+// rotates the query log.
+func (d *daemon) watchSignals(s *server.Server) {}
+
+// Stops s at once, whether on Ctrl+C or as the service control manager asks:
+// there's no SIGTERM to drain it on.
+func (d *daemon) stop(s *server.Server) error {
+	return s.Stop()
+}
+
+func runningAsService() bool {
+	isService, err := svc.IsWindowsService()
+	return err == nil && isService
+}
+
+// Reports an error which stops the daemon from starting, to the Event Log
+// too if it runs as a service, since its stderr goes nowhere.
+func reportStartupError(err error) {
+	fmt.Fprintf(os.Stderr, "%s\n", err)
+	if runningAsService() {
+		logEvent(eventlog.Error, err.Error())
+	}
+}
+
+// Writes a message to the Event Log, under the source registered by
+// "ncdns service install".
+func logEvent(kind uint32, msg string) {
+	elog, err := eventlog.Open(serviceName)
+	if err != nil {
+		return
+	}
+	defer elog.Close()
+
+	switch kind {
+	case eventlog.Error:
+		elog.Error(1, msg)
+	case eventlog.Warning:
+		elog.Warning(1, msg)
+	default:
+		elog.Info(1, msg)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/namecoin/ncdns/backend"
+	"github.com/namecoin/ncdns/server"
+)
+
+func init() {
+	subcommands["doctor"] = &subcommand{
+		usage: "doctor [-server=ADDRESS] [-name=NAME] [-replay-dir=DIR] [-json]: check the configuration, keys, namecoind and, with -server, a running instance",
+		run:   runDoctor,
+	}
+}
+
+// Exits 0 if every check passes, 1 if any only warns and 2 if any fails.
+func runDoctor(args []string) int {
+	fs, conf := newSubcommandFlags("doctor")
+	addr := fs.String("server", "", "Query the ncdns running at this address (e.g. 127.0.0.1:53) rather than checking that its ports are free")
+	name := fs.String("name", "", "Look up this name (e.g. example.bit) too")
+	timeout := fs.Duration("timeout", 5*time.Second, "Timeout of each query of -server")
+	asJSON := fs.Bool("json", false, "Write the results as JSON")
+	replayDir := fs.String("replay-dir", "", "Fetch names from the name_show calls recorded in this directory (see RPCRecordDir) rather than from namecoind")
+	if fs.Parse(args) != nil {
+		return 2
+	}
+
+	var report *server.DoctorReport
+	cfg, err := loadSubcommandConfig(*conf)
+	if err != nil {
+		// Reported like any other failed check, so that the output can be
+		// shared as it is.
+		report = &server.DoctorReport{
+			Checks: []server.CheckResult{{
+				Name:    "config",
+				Status:  server.CheckFail,
+				Message: err.Error(),
+				Hint:    "check the configuration file given by -conf",
+			}},
+			Status: server.CheckFail,
+		}
+	} else {
+		if *replayDir != "" {
+			f, err := backend.NewReplayFetcher(*replayDir)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s\n", err)
+				return 2
+			}
+			cfg.UseFetcher(f)
+			cfg.RPCRecordDir = ""
+		}
+		report = server.Doctor(cfg, &server.DoctorOptions{
+			Server:     *addr,
+			SampleName: *name,
+			Timeout:    *timeout,
+		})
+	}
+
+	if *asJSON {
+		b, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			return 2
+		}
+		fmt.Printf("%s\n", b)
+	} else {
+		report.WriteText(os.Stdout)
+	}
+
+	return int(report.Status)
+}
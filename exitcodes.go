@@ -0,0 +1,50 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/namecoin/ncdns/server"
+)
+
+// The exit codes of the daemon when it fails to start, by class of error.
+// The codes are those of sysexits.h.
+var exitCodes = []struct {
+	err         error
+	code        int
+	description string
+}{
+	{server.ErrConfigInvalid, 78, "the configuration is invalid"},
+	{server.ErrKeyLoad, 66, "the DNSSEC keys couldn't be loaded"},
+	{server.ErrBackendInit, 69, "the backend couldn't be set up"},
+	{server.ErrBindFailed, 71, "a DNS or HTTP listener couldn't be bound"},
+	{server.ErrPrivilegeDrop, 77, "privileges couldn't be dropped to RunAsUser"},
+}
+
+func exitCode(err error) int {
+	for _, ec := range exitCodes {
+		if errors.Is(err, ec.err) {
+			return ec.code
+		}
+	}
+	return 1
+}
+
+func printExitCodes(w io.Writer) {
+	fmt.Fprintf(w, "Exit codes if the daemon fails to start:\n")
+	for _, ec := range exitCodes {
+		fmt.Fprintf(w, "  %d  %s\n", ec.code, ec.description)
+	}
+	fmt.Fprintf(w, "  1  any other error\n")
+}
+
+func wantsHelp(args []string) bool {
+	for _, arg := range args {
+		switch arg {
+		case "-h", "-help", "--help":
+			return true
+		}
+	}
+	return false
+}
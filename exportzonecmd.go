@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+
+	"github.com/namecoin/ncdns/server"
+)
+
+func init() {
+	subcommands["export-zone"] = &subcommand{
+		usage: "export-zone [-sign] [-limit=N] [-out=FILE]: write the zone served at CanonicalSuffix as a master file, walking every name in namecoind",
+		run:   runExportZone,
+	}
+}
+
+// Exits 0 if the zone is exported, 1 if it is but some names had errors, and
+// 2 if it isn't.
+func runExportZone(args []string) int {
+	fs, conf := newSubcommandFlags("export-zone")
+	sign := fs.Bool("sign", false, "Sign the zone with the configured keys")
+	limit := fs.Int("limit", 0, "Stop after this many names (default: all of them)")
+	out := fs.String("out", "", "File to write the zone to (default: stdout)")
+	quiet := fs.Bool("quiet", false, "Don't report progress")
+	if fs.Parse(args) != nil {
+		return 2
+	}
+
+	cfg, err := loadSubcommandConfig(*conf)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return 2
+	}
+
+	f := os.Stdout
+	if *out != "" {
+		f, err = os.Create(*out)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Couldn't create zone file: %s\n", err)
+			return 2
+		}
+		defer f.Close()
+	}
+	w := bufio.NewWriter(f)
+
+	problems := 0
+	opts := &server.ExportOptions{
+		Sign:  *sign,
+		Limit: *limit,
+		Problem: func(name string, err error) {
+			problems++
+			fmt.Fprintf(os.Stderr, "%s: %s\n", name, err)
+		},
+	}
+	if !*quiet {
+		opts.Progress = func(names int) {
+			fmt.Fprintf(os.Stderr, "%d names exported...\n", names)
+		}
+	}
+
+	res, err := server.ExportZone(cfg, w, opts)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Couldn't export zone: %s\n", err)
+		return 2
+	}
+	if *out != "" {
+		if err := f.Close(); err != nil {
+			fmt.Fprintf(os.Stderr, "Couldn't write zone file: %s\n", err)
+			return 2
+		}
+	}
+
+	if !*quiet {
+		fmt.Fprintf(os.Stderr, "Exported %s at serial %d: %d records from %d names, %d with errors\n",
+			res.Zone, res.Serial, res.Records, res.Names, problems)
+	}
+	if problems > 0 {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/miekg/dns"
+
+	"github.com/namecoin/ncdns/server"
+)
+
+func init() {
+	subcommands["generate-keys"] = &subcommand{
+		usage: "generate-keys [-algorithm=ALGORITHM] [-bits=N] [-zone=ZONE] [-dir=DIR]: " +
+			"generate a KSK and a ZSK in dnssec-keygen's format and print the KSK's DS record",
+		run: runGenerateKeys,
+	}
+}
+
+func runGenerateKeys(args []string) int {
+	fs := flag.NewFlagSet("ncdns generate-keys", flag.ContinueOnError)
+	algorithm := fs.String("algorithm", "ECDSAP256SHA256", "DNSSEC algorithm of the keys: "+strings.Join(server.KeyAlgorithms(), ", "))
+	bits := fs.Int("bits", 0, "Size of RSA keys, in bits (default: 2048)")
+	zone := fs.String("zone", "bit", "Zone the keys are for")
+	dir := fs.String("dir", ".", "Directory to write the key files to")
+	if fs.Parse(args) != nil {
+		return 2
+	}
+
+	alg, err := server.ParseKeyAlgorithm(*algorithm)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return 2
+	}
+
+	var ksk *dns.DNSKEY
+	for _, key := range []struct {
+		kind  string
+		flags uint16
+	}{
+		{"KSK", 257},
+		{"ZSK", 256},
+	} {
+		k, privatek, err := server.GenerateKey(*zone, key.flags, alg, *bits)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Couldn't generate %s: %s\n", key.kind, err)
+			return 2
+		}
+
+		base, err := server.WriteKeyFiles(*dir, k, privatek)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Couldn't write %s: %s\n", key.kind, err)
+			return 2
+		}
+
+		fmt.Fprintf(os.Stderr, "Wrote %s to %s.key and %s.private\n", key.kind, base, base)
+		if key.flags == 257 {
+			ksk = k
+		}
+	}
+
+	fmt.Println(ksk.ToDS(dns.SHA256).String())
+	return 0
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/hlandau/xlog"
+)
+
+// Environment variable choosing how ncdns logs when run without a service
+// manager, e.g. in a container: "text" or "json" to log to stdout in that
+// format, one message per line. If unset, ncdns logs as configured by its
+// logging flags.
+const logFormatEnv = "NCDNS_LOG_FORMAT"
+
+func initLogFormat(format string) error {
+	var sink xlog.Sink
+	switch format {
+	case "":
+		return nil
+	case "text":
+		sink = xlog.NewWriterSink(os.Stdout)
+	case "json":
+		sink = &jsonSink{w: os.Stdout}
+	default:
+		return fmt.Errorf("%s must be text or json, not %q", logFormatEnv, format)
+	}
+
+	xlog.RootSink.Remove(xlog.StderrSink)
+	xlog.RootSink.Add(sink)
+	return nil
+}
+
+// Writes log messages as JSON objects, one per line.
+type jsonSink struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+type jsonLogEntry struct {
+	Time     time.Time `json:"time"`
+	Severity string    `json:"severity"`
+	Message  string    `json:"message"`
+}
+
+func (s *jsonSink) ReceiveLocally(sev xlog.Severity, format string, params ...interface{}) {
+	msg := format
+	if len(params) > 0 {
+		msg = fmt.Sprintf(format, params...)
+	}
+
+	b, err := json.Marshal(&jsonLogEntry{Time: time.Now().UTC(), Severity: sev.String(), Message: msg})
+	if err != nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.w.Write(append(b, '\n'))
+}
+
+func (s *jsonSink) ReceiveFromChild(sev xlog.Severity, format string, params ...interface{}) {
+	s.ReceiveLocally(sev, format, params...)
+}
@@ -1,33 +1,47 @@
 package main
 
 import (
-	"path/filepath"
+	"os"
 
 	"github.com/hlandau/dexlogconfig"
 	"github.com/namecoin/ncdns/server"
 	"gopkg.in/hlandau/easyconfig.v1"
-	"gopkg.in/hlandau/service.v2"
 )
 
 func main() {
-	cfg := server.Config{}
+	if len(os.Args) > 1 {
+		if sc, ok := subcommands[os.Args[1]]; ok {
+			os.Exit(sc.run(os.Args[2:]))
+		}
+	}
+
+	// The flag usage is printed by easyconfig, which then exits.
+	if wantsHelp(os.Args[1:]) {
+		printExitCodes(os.Stderr)
+	}
+
+	flat := server.NewFlatConfig()
 
 	config := easyconfig.Configurator{
 		ProgramName: "ncdns",
 	}
-	config.ParseFatal(&cfg)
+	config.ParseFatal(flat)
 	dexlogconfig.Init()
+	if err := initLogFormat(os.Getenv(logFormatEnv)); err != nil {
+		reportStartupError(err)
+		os.Exit(exitCode(server.ErrConfigInvalid))
+	}
 
-	// We use the configPath to resolve paths relative to the config file.
-	cfg.ConfigDir = filepath.Dir(config.ConfigFilePath())
+	// Options may also be given in the sections of the configuration file
+	// and in the environment, overriding the [ncdns] section but not flags.
+	cfg, err := loadConfig(&config, flat, os.Args[1:])
+	if err != nil {
+		reportStartupError(err)
+		os.Exit(exitCode(err))
+	}
 
-	service.Main(&service.Info{
-		Description:   "Namecoin to DNS Daemon",
-		DefaultChroot: service.EmptyChrootPath,
-		NewFunc: func() (service.Runnable, error) {
-			return server.New(&cfg)
-		},
-	})
+	d := &daemon{config: &config, cfg: cfg}
+	d.run()
 }
 
 // © 2014 Hugo Landau <hlandau@devever.net>    GPLv3 or later
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/namecoin/ncdns/namecoin"
+	"github.com/namecoin/ncdns/ncdomain"
+)
+
+func init() {
+	subcommands["make-value"] = &subcommand{
+		usage: "make-value [-ip=IP] [-ip6=IP] [-ns=HOST] [-ds=DS] [-map=LABEL=TARGET] [-tls-port=PORT -tls-cert=FILE]: " +
+			"print a name value with the given records (flags may be repeated)",
+		run: runMakeValue,
+	}
+}
+
+// A flag which may be given several times.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+func runMakeValue(args []string) int {
+	fs, _ := newSubcommandFlags("make-value")
+	var ips, ip6s, nss, dss, maps, tlsPorts stringList
+	fs.Var(&ips, "ip", "IPv4 address of the name")
+	fs.Var(&ip6s, "ip6", "IPv6 address of the name")
+	fs.Var(&nss, "ns", "Nameserver to delegate the name to")
+	fs.Var(&dss, "ds", "DS record for a delegation, e.g. \"12345 8 2 AB12...\"")
+	fs.Var(&maps, "map", "Subdomain, as LABEL=TARGET where TARGET is \"self\", an IP address or a name to alias")
+	fs.Var(&tlsPorts, "tls-port", "TCP port at which -tls-cert is used")
+	tlsCert := fs.String("tls-cert", "", "PEM certificate to publish a TLSA record for (the SHA-256 hash of its public key)")
+	name := fs.String("name", "d/example", "Name the value is for, used when checking that it parses")
+	if fs.Parse(args) != nil {
+		return 2
+	}
+
+	value, err := makeValue(ips, ip6s, nss, dss, maps, tlsPorts, *tlsCert)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return 2
+	}
+
+	// Make sure that what we emit is what the parser expects.
+	failed := false
+	ncdomain.ParseValue(*name, value, nil, func(err error, isWarning bool) {
+		if isWarning {
+			fmt.Fprintf(os.Stderr, "warning: %s\n", err)
+		} else {
+			fmt.Fprintf(os.Stderr, "error: %s\n", err)
+			failed = true
+		}
+	})
+	if failed {
+		fmt.Fprintf(os.Stderr, "The generated value doesn't parse cleanly: %s\n", value)
+		return 1
+	}
+
+	fmt.Println(value)
+
+	if len(value) > namecoin.ConsensusMaxValueSize {
+		warnValueSize(value)
+	}
+	return 0
+}
+
+func makeValue(ips, ip6s, nss, dss, maps, tlsPorts []string, tlsCert string) (string, error) {
+	b := ncdomain.NewValueBuilder()
+
+	for _, ip := range ips {
+		if err := b.AddIP(ip); err != nil {
+			return "", err
+		}
+	}
+	for _, ip := range ip6s {
+		if err := b.AddIP6(ip); err != nil {
+			return "", err
+		}
+	}
+	for _, ns := range nss {
+		if err := b.AddNS(ns); err != nil {
+			return "", err
+		}
+	}
+	for _, ds := range dss {
+		if err := b.AddDS(ds); err != nil {
+			return "", err
+		}
+	}
+	for _, m := range maps {
+		i := strings.IndexByte(m, '=')
+		if i < 0 {
+			return "", fmt.Errorf("-map must be of the form LABEL=TARGET: %q", m)
+		}
+		if err := b.AddMap(m[:i], m[i+1:]); err != nil {
+			return "", err
+		}
+	}
+
+	if (tlsCert == "") != (len(tlsPorts) == 0) {
+		return "", fmt.Errorf("-tls-port and -tls-cert must be given together")
+	}
+	if tlsCert != "" {
+		hash, err := publicKeyHash(tlsCert)
+		if err != nil {
+			return "", err
+		}
+
+		for _, p := range tlsPorts {
+			port, err := strconv.Atoi(p)
+			if err != nil {
+				return "", fmt.Errorf("invalid -tls-port: %q", p)
+			}
+
+			// DANE-EE, matching the SHA-256 hash of the public key.
+			if err := b.AddTLSA(port, "tcp", 3, 1, 1, hash); err != nil {
+				return "", err
+			}
+		}
+	}
+
+	return b.JSON()
+}
+
+// Returns the SHA-256 hash of the public key of the PEM certificate in a file.
+func publicKeyHash(filename string) ([]byte, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("%s doesn't contain a PEM certificate", filename)
+	}
+
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return hash[:], nil
+}
+
+// Explains that a value won't fit on chain, suggesting which of its parts to
+// move into a dd/ name imported by the value.
+func warnValueSize(value string) {
+	fmt.Fprintf(os.Stderr, "warning: the value is %d bytes, more than the %d bytes Namecoin allows\n",
+		len(value), namecoin.ConsensusMaxValueSize)
+
+	sizes, err := ncdomain.FieldSizes(value)
+	if err != nil {
+		return
+	}
+
+	// Allow for the import statement which replaces the moved parts.
+	const importSize = len(`,"import":"dd/example"`)
+	remaining := len(value) + importSize
+	var move []string
+	for _, fs := range sizes {
+		if remaining <= namecoin.ConsensusMaxValueSize {
+			break
+		}
+		move = append(move, fmt.Sprintf("%s (%d bytes)", fs.Path, fs.Bytes))
+		remaining -= fs.Bytes
+	}
+
+	fmt.Fprintf(os.Stderr, "Consider moving these into a dd/ name and importing it with \"import\": %s\n",
+		strings.Join(move, ", "))
+}
@@ -0,0 +1,175 @@
+// Package metrics provides histograms and a writer for the Prometheus text
+// exposition format, which is all ncdns needs to export its metrics without
+// depending on the Prometheus client library.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// Buckets suitable for the latency of network round trips, in seconds.
+var LatencyBuckets = []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// A Histogram counts observations in buckets with the given upper bounds. It
+// may be used concurrently.
+type Histogram struct {
+	bounds  []float64
+	counts  []uint64 // accessed atomically; the last counts those above every bound
+	sumBits uint64   // accessed atomically; a float64
+}
+
+func NewHistogram(bounds []float64) *Histogram {
+	bounds = append([]float64(nil), bounds...)
+	sort.Float64s(bounds)
+	return &Histogram{
+		bounds: bounds,
+		counts: make([]uint64, len(bounds)+1),
+	}
+}
+
+func (h *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.bounds, v)
+	atomic.AddUint64(&h.counts[i], 1)
+
+	for {
+		old := atomic.LoadUint64(&h.sumBits)
+		sum := math.Float64bits(math.Float64frombits(old) + v)
+		if atomic.CompareAndSwapUint64(&h.sumBits, old, sum) {
+			return
+		}
+	}
+}
+
+// The state of a Histogram at some point.
+type HistogramSnapshot struct {
+	Bounds []float64
+
+	// Counts[i] is the number of observations less than or equal to
+	// Bounds[i].
+	Counts []uint64
+
+	Count uint64
+	Sum   float64
+}
+
+func (h *Histogram) Snapshot() HistogramSnapshot {
+	s := HistogramSnapshot{
+		Bounds: h.bounds,
+		Counts: make([]uint64, len(h.bounds)),
+		Sum:    math.Float64frombits(atomic.LoadUint64(&h.sumBits)),
+	}
+	for i := range h.counts {
+		s.Count += atomic.LoadUint64(&h.counts[i])
+		if i < len(s.Counts) {
+			s.Counts[i] = s.Count
+		}
+	}
+
+	return s
+}
+
+// A label of a sample.
+type Label struct {
+	Name, Value string
+}
+
+// Returns the labels with the given names and values, which alternate.
+func Labels(namesAndValues ...string) []Label {
+	labels := make([]Label, len(namesAndValues)/2)
+	for i := range labels {
+		labels[i] = Label{Name: namesAndValues[2*i], Value: namesAndValues[2*i+1]}
+	}
+	return labels
+}
+
+// Writes metrics in the Prometheus text exposition format. Each metric is
+// introduced by Family, followed by its samples. Errors are sticky, and
+// returned by Err.
+type Writer struct {
+	w   *bufio.Writer
+	err error
+}
+
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: bufio.NewWriter(w)}
+}
+
+// Begins the metric called name, of the given type ("counter", "gauge" or
+// "histogram").
+func (w *Writer) Family(name, typ, help string) {
+	w.printf("# HELP %s %s\n# TYPE %s %s\n", name, escapeHelp(help), name, typ)
+}
+
+// Writes a sample of a counter or gauge.
+func (w *Writer) Sample(name string, labels []Label, v float64) {
+	w.printf("%s%s %s\n", name, formatLabels(labels), formatValue(v))
+}
+
+// Writes the samples of a histogram.
+func (w *Writer) Histogram(name string, labels []Label, s HistogramSnapshot) {
+	for i, bound := range s.Bounds {
+		w.Sample(name+"_bucket", append(labels[:len(labels):len(labels)], Label{Name: "le", Value: formatValue(bound)}), float64(s.Counts[i]))
+	}
+	w.Sample(name+"_bucket", append(labels[:len(labels):len(labels)], Label{Name: "le", Value: "+Inf"}), float64(s.Count))
+	w.Sample(name+"_sum", labels, s.Sum)
+	w.Sample(name+"_count", labels, float64(s.Count))
+}
+
+// Flushes what has been written, and returns the first error encountered.
+func (w *Writer) Err() error {
+	if w.err == nil {
+		w.err = w.w.Flush()
+	}
+	return w.err
+}
+
+func (w *Writer) printf(format string, args ...interface{}) {
+	if w.err != nil {
+		return
+	}
+	_, w.err = fmt.Fprintf(w.w, format, args...)
+}
+
+func formatLabels(labels []Label) string {
+	if len(labels) == 0 {
+		return ""
+	}
+
+	parts := make([]string, len(labels))
+	for i, l := range labels {
+		parts[i] = l.Name + `="` + escapeLabelValue(l.Value) + `"`
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	helpReplacer       = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelValueReplacer = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(s string) string {
+	return helpReplacer.Replace(s)
+}
+
+func escapeLabelValue(s string) string {
+	return labelValueReplacer.Replace(s)
+}
@@ -0,0 +1,50 @@
+package metrics
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestHistogram(t *testing.T) {
+	h := NewHistogram([]float64{1, 0.25})
+	for _, v := range []float64{0.125, 0.25, 0.5, 2} {
+		h.Observe(v)
+	}
+
+	s := h.Snapshot()
+	if s.Count != 4 || s.Sum != 2.875 {
+		t.Errorf("count %d, sum %v", s.Count, s.Sum)
+	}
+	if len(s.Counts) != 2 || s.Counts[0] != 2 || s.Counts[1] != 3 {
+		t.Errorf("cumulative counts %v for bounds %v", s.Counts, s.Bounds)
+	}
+}
+
+func TestWriter(t *testing.T) {
+	h := NewHistogram([]float64{0.5})
+	h.Observe(0.25)
+
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.Family("test_total", "counter", "A counter.\nOn two lines.")
+	w.Sample("test_total", Labels("name", `a "quoted" \ value`), 3)
+	w.Family("test_seconds", "histogram", "A histogram.")
+	w.Histogram("test_seconds", Labels("method", "x"), h.Snapshot())
+	if err := w.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `# HELP test_total A counter.\nOn two lines.
+# TYPE test_total counter
+test_total{name="a \"quoted\" \\ value"} 3
+# HELP test_seconds A histogram.
+# TYPE test_seconds histogram
+test_seconds_bucket{method="x",le="0.5"} 1
+test_seconds_bucket{method="x",le="+Inf"} 1
+test_seconds_sum{method="x"} 0.25
+test_seconds_count{method="x"} 1
+`
+	if buf.String() != expected {
+		t.Errorf("wrote:\n%s\nexpected:\n%s", buf.String(), expected)
+	}
+}
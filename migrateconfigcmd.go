@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/namecoin/ncdns/server"
+)
+
+func init() {
+	subcommands["migrate-config"] = &subcommand{
+		usage: "migrate-config [-out=FILE]: rewrite the configuration file to use the replacements of deprecated options",
+		run:   runMigrateConfig,
+	}
+}
+
+// Exits 0 if the configuration file is rewritten, or needn't be, and 2 if it
+// can't be.
+func runMigrateConfig(args []string) int {
+	fs, conf := newSubcommandFlags("migrate-config")
+	out := fs.String("out", "", "File to write the rewritten configuration to, which may be the configuration file itself (default: stdout)")
+	if fs.Parse(args) != nil {
+		return 2
+	}
+
+	_, path, err := parseSubcommandConfig(*conf)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return 2
+	}
+	if path == "" {
+		fmt.Fprintf(os.Stderr, "No configuration file found; give its path with -conf\n")
+		return 2
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Couldn't read configuration file: %s\n", err)
+		return 2
+	}
+
+	migrated, replaced, err := server.MigrateConfigFile(b)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", path, err)
+		return 2
+	}
+
+	if *out == "" {
+		os.Stdout.Write(migrated)
+	} else {
+		mode := os.FileMode(0644)
+		if fi, err := os.Stat(path); err == nil {
+			mode = fi.Mode().Perm()
+		}
+		if err := ioutil.WriteFile(*out, migrated, mode); err != nil {
+			fmt.Fprintf(os.Stderr, "Couldn't write configuration file: %s\n", err)
+			return 2
+		}
+	}
+
+	if len(replaced) == 0 {
+		fmt.Fprintf(os.Stderr, "%s uses no deprecated options\n", path)
+	} else {
+		fmt.Fprintf(os.Stderr, "Replaced deprecated options in %s: %s\n", path, strings.Join(replaced, ", "))
+	}
+	return 0
+}
@@ -0,0 +1,155 @@
+package namecoin
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcd/rpcclient"
+
+	"github.com/namecoin/ncrpcclient"
+)
+
+// How long a request waits for namecoind's cookie to appear when it doesn't
+// exist, as while namecoind starts, and the first interval at which it's
+// looked for again; the interval doubles each time.
+const (
+	cookieWait          = 5 * time.Second
+	cookieRetryInterval = 50 * time.Millisecond
+)
+
+// The RPC client of a Client which authenticates with namecoind's cookie.
+// The RPC client would read the cookie itself, but keeps using what it read,
+// or its failure to read it, for a while after namecoind writes a new one.
+// So the cookie is read here instead, again whenever namecoind refuses the
+// credentials, and the RPC client is made again with its new contents.
+type cookieAuth struct {
+	path   string
+	config rpcclient.ConnConfig // without CookiePath
+	ntfn   *rpcclient.NotificationHandlers
+	wait   time.Duration
+
+	mu     sync.Mutex
+	cookie string              // as read
+	client *ncrpcclient.Client // nil until the cookie has been read
+}
+
+func newCookieAuth(config *rpcclient.ConnConfig, ntfnHandlers *rpcclient.NotificationHandlers) *cookieAuth {
+	a := &cookieAuth{
+		path:   config.CookiePath,
+		config: *config,
+		ntfn:   ntfnHandlers,
+		wait:   cookieWait,
+	}
+	a.config.CookiePath = ""
+	return a
+}
+
+// Makes the request f with an RPC client using namecoind's current cookie.
+// If namecoind refuses it, the cookie is read again, and if it has changed,
+// the request is made once more with the new one.
+func (a *cookieAuth) call(f func(*ncrpcclient.Client) (interface{}, error)) (interface{}, error) {
+	rc, err := a.rpcClient(false)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := f(rc)
+	if !isAuthError(err) {
+		return res, err
+	}
+
+	nrc, rerr := a.rpcClient(true)
+	if rerr != nil {
+		return nil, fmt.Errorf("%v; reading the cookie again failed: %v", err, rerr)
+	}
+	if nrc == rc {
+		return res, err
+	}
+
+	return f(nrc)
+}
+
+// Returns the RPC client, made with the cookie's contents. The cookie is read
+// if it hasn't been yet, or again if reread is set. A failure to read it isn't
+// kept, so the next request reads it again.
+func (a *cookieAuth) rpcClient(reread bool) (*ncrpcclient.Client, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.client != nil && !reread {
+		return a.client, nil
+	}
+
+	cookie, err := a.read(a.wait)
+	if err != nil {
+		return nil, err
+	}
+	if a.client != nil && cookie == a.cookie {
+		return a.client, nil
+	}
+
+	err = a.connect(cookie)
+	if err != nil {
+		return nil, err
+	}
+	if reread {
+		log.Infof("namecoind's RPC cookie at %s has changed; using the new one", a.path)
+	}
+	return a.client, nil
+}
+
+// Makes the RPC client again with cookie, shutting down the one it replaces.
+// Must be called with mu held.
+func (a *cookieAuth) connect(cookie string) error {
+	parts := strings.SplitN(cookie, ":", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("malformed RPC cookie at %s", a.path)
+	}
+
+	cfg := a.config
+	cfg.User = parts[0]
+	cfg.Pass = parts[1]
+	rc, err := ncrpcclient.New(&cfg, a.ntfn)
+	if err != nil {
+		return err
+	}
+
+	if a.client != nil {
+		a.client.Shutdown()
+	}
+	a.client = rc
+	a.cookie = cookie
+	return nil
+}
+
+// Reads the cookie, waiting up to wait for it to be written if it doesn't
+// exist.
+func (a *cookieAuth) read(wait time.Duration) (string, error) {
+	deadline := time.Now().Add(wait)
+	interval := cookieRetryInterval
+	for {
+		b, err := ioutil.ReadFile(a.path)
+		if err == nil {
+			return strings.TrimSpace(string(b)), nil
+		}
+		if !os.IsNotExist(err) || time.Now().Add(interval).After(deadline) {
+			return "", fmt.Errorf("couldn't read namecoind's RPC cookie: %v", err)
+		}
+
+		time.Sleep(interval)
+		interval *= 2
+	}
+}
+
+func (a *cookieAuth) shutdown() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.client != nil {
+		a.client.Shutdown()
+	}
+}
@@ -0,0 +1,179 @@
+package namecoin
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/rpcclient"
+)
+
+// A fake namecoind which only accepts the credentials of its current cookie,
+// and writes a new one each time it's restarted.
+type cookieRPC struct {
+	fakeRPC
+	path string
+
+	mu       sync.Mutex
+	pass     string
+	refusals int
+}
+
+func (f *cookieRPC) restart(t *testing.T, pass string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.pass = pass
+	if err := ioutil.WriteFile(f.path, []byte("__cookie__:"+pass), 0600); err != nil {
+		t.Error(err)
+	}
+}
+
+func (f *cookieRPC) refused() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.refusals
+}
+
+func (f *cookieRPC) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	f.mu.Lock()
+	user, pass, _ := req.BasicAuth()
+	ok := user == "__cookie__" && pass == f.pass
+	if !ok {
+		f.refusals++
+	}
+	f.mu.Unlock()
+
+	if !ok {
+		rw.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	f.fakeRPC.ServeHTTP(rw, req)
+}
+
+func TestCookieRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ncdns-cookie")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	rpc := &cookieRPC{
+		fakeRPC: fakeRPC{
+			"name_show": func(params []json.RawMessage) interface{} {
+				return nameShowResult("d/example", `"value"`)
+			},
+		},
+		path: filepath.Join(dir, ".cookie"),
+	}
+	rpc.restart(t, "first")
+	srv := httptest.NewServer(rpc)
+	defer srv.Close()
+
+	c, err := New(&rpcclient.ConnConfig{
+		Host:         strings.TrimPrefix(srv.URL, "http://"),
+		CookiePath:   rpc.path,
+		HTTPPostMode: true,
+		DisableTLS:   true,
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Shutdown()
+
+	lookup := func() error {
+		_, err := c.NameData("d/example", "")
+		return err
+	}
+
+	if err := lookup(); err != nil {
+		t.Fatalf("lookup with the first cookie failed: %v", err)
+	}
+
+	// Once namecoind has a new cookie, the first lookup is refused, then
+	// made again with the new cookie.
+	rpc.restart(t, "second")
+	if err := lookup(); err != nil {
+		t.Errorf("lookup after the cookie changed failed: %v", err)
+	}
+	if err := lookup(); err != nil {
+		t.Errorf("lookup with the new cookie failed: %v", err)
+	}
+	if n := rpc.refused(); n != 1 {
+		t.Errorf("credentials refused %d times, expected once", n)
+	}
+
+	// While namecoind restarts, the cookie doesn't exist for a moment.
+	if err := os.Remove(rpc.path); err != nil {
+		t.Fatal(err)
+	}
+	rpc.mu.Lock()
+	rpc.pass = "third"
+	rpc.mu.Unlock()
+	time.AfterFunc(200*time.Millisecond, func() { rpc.restart(t, "third") })
+	if err := lookup(); err != nil {
+		t.Errorf("lookup while the cookie was being written failed: %v", err)
+	}
+
+	// If the cookie is refused and hasn't changed, the lookup fails, and
+	// isn't made again.
+	rpc.mu.Lock()
+	rpc.pass = "fourth"
+	rpc.refusals = 0
+	rpc.mu.Unlock()
+	if err := lookup(); c.ClassifyError(err) != FailureAuth {
+		t.Errorf("expected the credentials to be refused, got %v", err)
+	}
+	if n := rpc.refused(); n != 1 {
+		t.Errorf("credentials refused %d times, expected once", n)
+	}
+}
+
+func TestCookieMissing(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ncdns-cookie")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	rpc := &cookieRPC{
+		fakeRPC: fakeRPC{
+			"name_show": func(params []json.RawMessage) interface{} {
+				return nameShowResult("d/example", `"value"`)
+			},
+		},
+		path: filepath.Join(dir, ".cookie"),
+	}
+	srv := httptest.NewServer(rpc)
+	defer srv.Close()
+
+	// A cookie which doesn't exist yet when the client is made is waited
+	// for by the first request, and a failure isn't kept.
+	c, err := New(&rpcclient.ConnConfig{
+		Host:         strings.TrimPrefix(srv.URL, "http://"),
+		CookiePath:   rpc.path,
+		HTTPPostMode: true,
+		DisableTLS:   true,
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Shutdown()
+	c.cookie.wait = 100 * time.Millisecond
+
+	if _, err := c.NameData("d/example", ""); err == nil || !strings.Contains(err.Error(), "cookie") {
+		t.Errorf("expected the cookie not to be found, got %v", err)
+	}
+
+	rpc.restart(t, "first")
+	if _, err := c.NameData("d/example", ""); err != nil {
+		t.Errorf("lookup once the cookie was written failed: %v", err)
+	}
+}
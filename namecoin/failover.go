@@ -0,0 +1,324 @@
+package namecoin
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/btcsuite/btcd/rpcclient"
+
+	"github.com/namecoin/ncrpcclient"
+)
+
+// How often the namecoind nodes which failed are asked whether they're
+// answering again.
+const failoverProbeInterval = 10 * time.Second
+
+// One of the namecoind nodes of a client made with NewFailover.
+type Endpoint struct {
+	Config *rpcclient.ConnConfig
+
+	// If not nil, the node is connected to over TLS, as by NewTLS.
+	TLS *TLSConfig
+
+	// If not nil, the node is connected to through this SOCKS5 proxy, as
+	// by NewProxied.
+	Proxy *Proxy
+}
+
+// The state of one of the namecoind nodes of a client made with NewFailover.
+type EndpointStatus struct {
+	Address string `json:"address"`
+	Active  bool   `json:"active"`
+	Healthy bool   `json:"healthy"`
+
+	// Requests which failed as the node couldn't be reached or didn't
+	// answer in time.
+	Failures uint64 `json:"failures"`
+}
+
+// The state of the namecoind nodes of a client made with NewFailover.
+type FailoverStatus struct {
+	Endpoints []EndpointStatus `json:"endpoints"`
+
+	// Times requests moved from one node to another, after the active
+	// node failed or a preferred one recovered.
+	Failovers uint64 `json:"failovers"`
+}
+
+type endpoint struct {
+	addr     string
+	client   *Client
+	down     int32  // accessed atomically; 1 once a request has failed, until a probe succeeds
+	failures uint64 // accessed atomically
+}
+
+func (e *endpoint) healthy() bool {
+	return atomic.LoadInt32(&e.down) == 0
+}
+
+type failover struct {
+	endpoints []*endpoint
+	timeout   time.Duration
+
+	mu        sync.Mutex
+	active    int // index into endpoints
+	failovers uint64
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// A request to a namecoind node which didn't answer in time. The request is
+// left running, but its result is ignored.
+type attemptTimeoutError struct {
+	addr    string
+	timeout time.Duration
+}
+
+func (e *attemptTimeoutError) Error() string {
+	return fmt.Sprintf("namecoind at %s didn't answer within %v", e.addr, e.timeout)
+}
+
+func (e *attemptTimeoutError) Timeout() bool {
+	return true
+}
+
+// NewFailover is like New, but the client makes its requests to the first of
+// several namecoind nodes which is working, in order of preference. When a
+// request to the active node can't connect or takes longer than timeout, the
+// node is marked as down and the request is made to the next one instead, so
+// a request can take up to timeout for each node. The nodes which are down
+// are probed in the background with getblockcount, and requests return to
+// the most preferred node once it answers again.
+func NewFailover(endpoints []*Endpoint, timeout time.Duration) (*Client, error) {
+	if len(endpoints) == 0 {
+		return nil, fmt.Errorf("no namecoind nodes to connect to")
+	}
+
+	fo := &failover{
+		timeout: timeout,
+		stop:    make(chan struct{}),
+	}
+	for _, ep := range endpoints {
+		var c *Client
+		var err error
+		if ep.TLS != nil || ep.Proxy != nil {
+			c, err = NewProxied(ep.Config, ep.TLS, ep.Proxy)
+		} else {
+			c, err = New(ep.Config, nil)
+		}
+		if err != nil {
+			fo.shutdown()
+			return nil, fmt.Errorf("namecoind at %s: %v", ep.Config.Host, err)
+		}
+
+		fo.endpoints = append(fo.endpoints, &endpoint{addr: ep.Config.Host, client: c})
+	}
+
+	go fo.run(failoverProbeInterval)
+
+	return &Client{
+		Client:       fo.endpoints[0].client.Client,
+		MaxValueSize: DefaultMaxValueSize,
+		failover:     fo,
+	}, nil
+}
+
+// Makes the request f with the RPC client of the active namecoind node,
+// returning its result. For a client made with NewFailover, a request which
+// fails as the node is down is made again to the next node.
+func (c *Client) rpc(f func(*ncrpcclient.Client) (interface{}, error)) (interface{}, error) {
+	if c.failover != nil {
+		return c.failover.call(f)
+	}
+	if c.cookie != nil {
+		return c.cookie.call(f)
+	}
+
+	return f(c.Client)
+}
+
+func (fo *failover) activeEndpoint() (int, *endpoint) {
+	fo.mu.Lock()
+	defer fo.mu.Unlock()
+	return fo.active, fo.endpoints[fo.active]
+}
+
+func (fo *failover) call(f func(*ncrpcclient.Client) (interface{}, error)) (interface{}, error) {
+	var res interface{}
+	var err error
+	for tried := 0; tried < len(fo.endpoints); tried++ {
+		i, e := fo.activeEndpoint()
+		res, err = fo.attempt(e, f)
+		if !fo.isDown(e, err) {
+			return res, err
+		}
+
+		atomic.AddUint64(&e.failures, 1)
+		atomic.StoreInt32(&e.down, 1)
+		fo.moveFrom(i, err)
+	}
+
+	return res, err
+}
+
+// Makes the request f to the node e, giving up after the attempt timeout.
+func (fo *failover) attempt(e *endpoint, f func(*ncrpcclient.Client) (interface{}, error)) (interface{}, error) {
+	if fo.timeout <= 0 {
+		return e.client.rpc(f)
+	}
+
+	type result struct {
+		res interface{}
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		res, err := e.client.rpc(f)
+		done <- result{res, err}
+	}()
+
+	t := time.NewTimer(fo.timeout)
+	defer t.Stop()
+	select {
+	case r := <-done:
+		return r.res, r.err
+	case <-t.C:
+		return nil, &attemptTimeoutError{addr: e.addr, timeout: fo.timeout}
+	}
+}
+
+// Whether err, returned by a request to e, means e is down rather than that
+// the request itself failed.
+func (fo *failover) isDown(e *endpoint, err error) bool {
+	if err == nil {
+		return false
+	}
+	if _, ok := err.(*attemptTimeoutError); ok {
+		return true
+	}
+
+	// A request which got no response at all, e.g. as the node closed the
+	// connection, is as much a failure of the node as one which couldn't
+	// connect.
+	var uerr *url.Error
+	if errors.As(err, &uerr) {
+		return true
+	}
+
+	switch e.client.ClassifyError(err) {
+	case FailureUnreachable, FailureTLS, FailureProxy, FailureProxyTarget:
+		return true
+	default:
+		return false
+	}
+}
+
+// Moves requests on from the node at index i, which failed with err, to the
+// next node which isn't down, or simply the next one if they all are. If
+// requests have already moved on, e.g. by a concurrent request, they're left
+// where they are.
+func (fo *failover) moveFrom(i int, err error) {
+	fo.mu.Lock()
+	defer fo.mu.Unlock()
+
+	if fo.active != i || len(fo.endpoints) < 2 {
+		return
+	}
+
+	next := (i + 1) % len(fo.endpoints)
+	for j := 1; j < len(fo.endpoints); j++ {
+		k := (i + j) % len(fo.endpoints)
+		if fo.endpoints[k].healthy() {
+			next = k
+			break
+		}
+	}
+
+	fo.active = next
+	fo.failovers++
+	log.Warnf("namecoind at %s failed (%v); failing over to %s", fo.endpoints[i].addr, err, fo.endpoints[next].addr)
+}
+
+// Asks each node which is down whether it's answering again, and moves
+// requests to the most preferred node which is up, if that's preferred over
+// the active one or the active one is down.
+func (fo *failover) probe() {
+	for _, e := range fo.endpoints {
+		if e.healthy() {
+			continue
+		}
+
+		_, err := fo.attempt(e, func(rc *ncrpcclient.Client) (interface{}, error) {
+			return rc.GetBlockCount()
+		})
+		if err == nil {
+			atomic.StoreInt32(&e.down, 0)
+			log.Infof("namecoind at %s is answering again", e.addr)
+		}
+	}
+
+	fo.mu.Lock()
+	defer fo.mu.Unlock()
+
+	for i, e := range fo.endpoints {
+		if !e.healthy() {
+			continue
+		}
+		if i != fo.active && (i < fo.active || !fo.endpoints[fo.active].healthy()) {
+			log.Infof("failing back from namecoind at %s to %s", fo.endpoints[fo.active].addr, e.addr)
+			fo.active = i
+			fo.failovers++
+		}
+		break
+	}
+}
+
+func (fo *failover) run(interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			fo.probe()
+		case <-fo.stop:
+			return
+		}
+	}
+}
+
+func (fo *failover) shutdown() {
+	fo.stopOnce.Do(func() { close(fo.stop) })
+	for _, e := range fo.endpoints {
+		e.client.Shutdown()
+	}
+}
+
+// FailoverStatus returns the state of the namecoind nodes of a client made
+// with NewFailover, or nil for any other client.
+func (c *Client) FailoverStatus() *FailoverStatus {
+	if c.failover == nil {
+		return nil
+	}
+
+	fo := c.failover
+	fo.mu.Lock()
+	defer fo.mu.Unlock()
+
+	st := &FailoverStatus{Failovers: fo.failovers}
+	for i, e := range fo.endpoints {
+		st.Endpoints = append(st.Endpoints, EndpointStatus{
+			Address:  e.addr,
+			Active:   i == fo.active,
+			Healthy:  e.healthy(),
+			Failures: atomic.LoadUint64(&e.failures),
+		})
+	}
+
+	return st
+}
@@ -0,0 +1,135 @@
+package namecoin
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/rpcclient"
+	"gopkg.in/hlandau/madns.v2/merr"
+)
+
+// A fake namecoind which drops every connection while down is set.
+type flakyRPC struct {
+	fakeRPC
+	down int32
+}
+
+func (f *flakyRPC) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if atomic.LoadInt32(&f.down) != 0 {
+		conn, _, err := rw.(http.Hijacker).Hijack()
+		if err == nil {
+			conn.Close()
+		}
+		return
+	}
+
+	f.fakeRPC.ServeHTTP(rw, req)
+}
+
+func TestFailover(t *testing.T) {
+	nameShow := func(value string) fakeRPC {
+		return fakeRPC{
+			"name_show": func(params []json.RawMessage) interface{} {
+				var name string
+				json.Unmarshal(params[0], &name)
+				if name != "d/example" {
+					return nil
+				}
+				return nameShowResult(name, value)
+			},
+			"getblockcount": func([]json.RawMessage) interface{} { return 100 },
+		}
+	}
+
+	primary := &flakyRPC{fakeRPC: nameShow(`"primary"`)}
+	secondary := &flakyRPC{fakeRPC: nameShow(`"secondary"`)}
+	var endpoints []*Endpoint
+	for _, rpc := range []*flakyRPC{primary, secondary} {
+		srv := httptest.NewServer(rpc)
+		defer srv.Close()
+		endpoints = append(endpoints, &Endpoint{Config: &rpcclient.ConnConfig{
+			Host:         strings.TrimPrefix(srv.URL, "http://"),
+			User:         "user",
+			Pass:         "pass",
+			HTTPPostMode: true,
+			DisableTLS:   true,
+		}})
+	}
+
+	c, err := NewFailover(endpoints, 200*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Shutdown()
+
+	value := func() string {
+		nd, err := c.NameData("d/example", "")
+		if err != nil {
+			t.Fatalf("lookup failed: %v", err)
+		}
+		return nd.Value
+	}
+	active := func() string {
+		for _, e := range c.FailoverStatus().Endpoints {
+			if e.Active {
+				return e.Address
+			}
+		}
+		return ""
+	}
+
+	if v := value(); v != `"primary"` {
+		t.Fatalf("got value %s from a healthy primary", v)
+	}
+
+	// A name which doesn't exist is an answer, not a failure.
+	if _, err := c.NameData("d/missing", ""); err != merr.ErrNoSuchDomain {
+		t.Errorf("expected no such domain, got %v", err)
+	}
+	if st := c.FailoverStatus(); st.Failovers != 0 || active() != endpoints[0].Config.Host {
+		t.Errorf("failed over without a failure: %+v", st)
+	}
+
+	// Once the primary is down, lookups go to the secondary.
+	atomic.StoreInt32(&primary.down, 1)
+	if v := value(); v != `"secondary"` {
+		t.Errorf("got value %s with the primary down", v)
+	}
+	if v := value(); v != `"secondary"` {
+		t.Errorf("got value %s with the primary down", v)
+	}
+	st := c.FailoverStatus()
+	if st.Failovers != 1 || active() != endpoints[1].Config.Host || st.Endpoints[0].Healthy || st.Endpoints[0].Failures != 1 {
+		t.Errorf("unexpected status after failover: %+v", st)
+	}
+
+	// A probe finds the primary down still, then back up.
+	c.failover.probe()
+	if active() != endpoints[1].Config.Host {
+		t.Errorf("failed back to a primary which is down")
+	}
+	atomic.StoreInt32(&primary.down, 0)
+	c.failover.probe()
+	if st := c.FailoverStatus(); st.Failovers != 2 || active() != endpoints[0].Config.Host || !st.Endpoints[0].Healthy {
+		t.Errorf("didn't fail back to the primary: %+v", st)
+	}
+	if v := value(); v != `"primary"` {
+		t.Errorf("got value %s after failing back", v)
+	}
+
+	// With every node down, a lookup fails within a timeout for each.
+	atomic.StoreInt32(&primary.down, 1)
+	atomic.StoreInt32(&secondary.down, 1)
+	start := time.Now()
+	if _, err := c.NameData("d/example", ""); err == nil {
+		t.Errorf("lookup succeeded with every node down")
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("lookup with every node down took %v", d)
+	}
+}
@@ -0,0 +1,43 @@
+package namecoin
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/namecoin/ncrpcclient"
+)
+
+// The amount, in NMC, locked in a name's output for as long as it's held.
+const NameLockedAmount = 0.01
+
+// EstimateFeeRate returns namecoind's estimate, from estimatesmartfee, of the
+// fee rate in NMC per kilobyte at which a transaction is confirmed within
+// target blocks. namecoind has no estimate until it has seen enough
+// transactions, e.g. soon after it starts.
+func (c *Client) EstimateFeeRate(target int) (float64, error) {
+	start := time.Now()
+	res, err := c.rpc(func(rc *ncrpcclient.Client) (interface{}, error) {
+		return rc.RawRequest("estimatesmartfee", []json.RawMessage{json.RawMessage(fmt.Sprint(target))})
+	})
+	c.observe("estimatesmartfee", start, err)
+	if err != nil {
+		return 0, err
+	}
+	raw, _ := res.(json.RawMessage)
+
+	var r struct {
+		FeeRate float64  `json:"feerate"`
+		Errors  []string `json:"errors"`
+	}
+	err = json.Unmarshal(raw, &r)
+	if err != nil {
+		return 0, err
+	}
+	if r.FeeRate <= 0 {
+		return 0, fmt.Errorf("namecoind has no fee estimate yet (%s)", strings.Join(r.Errors, "; "))
+	}
+
+	return r.FeeRate, nil
+}
@@ -1,6 +1,9 @@
 package namecoin
 
 import (
+	"fmt"
+	"time"
+
 	"github.com/btcsuite/btcd/btcjson"
 	"github.com/btcsuite/btcd/rpcclient"
 	"gopkg.in/hlandau/madns.v2/merr"
@@ -9,41 +12,205 @@ import (
 	"github.com/namecoin/ncrpcclient"
 )
 
+// The maximum length of a name's value permitted by Namecoin consensus rules.
+// It's the same on mainnet, testnet and regtest.
+const ConsensusMaxValueSize = 520
+
+// The default maximum size of values accepted from namecoind. This leaves
+// headroom over the consensus limit in case it is raised, while still
+// rejecting the absurdly large values a buggy or compromised namecoind could
+// return.
+const DefaultMaxValueSize = 4 * ConsensusMaxValueSize
+
+// The average time between Namecoin blocks, by which a number of blocks, such
+// as the time left until a name expires, is reckoned in time.
+const BlockInterval = 10 * time.Minute
+
 // Client represents an ncrpcclient.Client with an additional DNS-friendly
 // convenience wrapper around NameShow.
 type Client struct {
 	*ncrpcclient.Client
+
+	// Responses containing values longer than this (in bytes) are rejected
+	// with a *ValueTooLargeError.
+	MaxValueSize int
+
+	forwarder *forwarder  // set by NewTLS and NewProxied
+	failover  *failover   // set by NewFailover
+	cookie    *cookieAuth // set if namecoind's cookie is used
+
+	calls callStats
 }
 
+// New makes a client for the namecoind at config.Host. If config has a
+// CookiePath but no password, namecoind's cookie is read again whenever
+// namecoind refuses it, as it does once restarted with a new one, and waited
+// for while it doesn't exist; the embedded RPC client is then only the one
+// made first.
 func New(config *rpcclient.ConnConfig, ntfnHandlers *rpcclient.NotificationHandlers) (*Client, error) {
+	if config.CookiePath != "" && config.Pass == "" {
+		a := newCookieAuth(config, ntfnHandlers)
+		c := &Client{MaxValueSize: DefaultMaxValueSize, cookie: a}
+
+		// If the cookie can't be read yet, the first request waits for it.
+		if cookie, err := a.read(0); err == nil && a.connect(cookie) == nil {
+			c.Client = a.client
+		}
+
+		return c, nil
+	}
+
 	ncClient, err := ncrpcclient.New(config, ntfnHandlers)
 	if err != nil {
 		return nil, err
 	}
 
-	return &Client{ncClient}, nil
+	return &Client{
+		Client:       ncClient,
+		MaxValueSize: DefaultMaxValueSize,
+	}, nil
 }
 
-// NameQuery returns the value of a name.  If the name doesn't exist, the error
-// returned will be merr.ErrNoSuchDomain.
-func (c *Client) NameQuery(name string, streamIsolationID string) (string, error) {
-	nameData, err := c.NameShow(name, &ncbtcjson.NameShowOptions{StreamID: streamIsolationID})
+// ValueTooLargeError is returned when namecoind returns a value larger than
+// the client's MaxValueSize. Such a value can't have come from a valid name,
+// so namecoind is misbehaving.
+type ValueTooLargeError struct {
+	Name  string
+	Size  int
+	Limit int
+}
+
+func (e *ValueTooLargeError) Error() string {
+	return fmt.Sprintf("namecoind returned a value of %d bytes for %q, exceeding the limit of %d bytes", e.Size, e.Name, e.Limit)
+}
+
+// NameMismatchError is returned when namecoind returns data for a different
+// name than the one requested, which suggests a bug in an RPC proxy.
+type NameMismatchError struct {
+	Requested string
+	Returned  string
+}
+
+func (e *NameMismatchError) Error() string {
+	return fmt.Sprintf("namecoind returned data for %q when asked for %q", e.Returned, e.Requested)
+}
+
+// Returns an error if the value in r is too large.
+func (c *Client) checkValueSize(r *ncbtcjson.NameShowResult) error {
+	if c.MaxValueSize > 0 && len(r.Value) > c.MaxValueSize {
+		return &ValueTooLargeError{Name: r.Name, Size: len(r.Value), Limit: c.MaxValueSize}
+	}
+	return nil
+}
+
+// NameScan is like ncrpcclient.Client.NameScan, but rejects responses with
+// more results than requested or with values which are too large.
+func (c *Client) NameScan(start string, maxReturned uint32) (ncbtcjson.NameScanResult, error) {
+	called := time.Now()
+	res, err := c.rpc(func(rc *ncrpcclient.Client) (interface{}, error) {
+		return rc.NameScan(start, maxReturned)
+	})
+	c.observe("name_scan", called, err)
+	if err != nil {
+		return nil, err
+	}
+	results, _ := res.(ncbtcjson.NameScanResult)
+
+	if len(results) > int(maxReturned) {
+		return nil, fmt.Errorf("namecoind returned %d results from name_scan when asked for at most %d", len(results), maxReturned)
+	}
+
+	for i := range results {
+		if err := c.checkValueSize(&results[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	return results, nil
+}
+
+// NameData describes the current state of a name.
+type NameData struct {
+	// The name's JSON value.
+	Value string
+
+	// The number of blocks until the name expires. This is zero or negative
+	// for expired names, and zero if unknown.
+	ExpiresIn int32
+
+	// Set if the name has expired. Some versions of namecoind still return
+	// the value of an expired name, which shouldn't be used.
+	Expired bool
+
+	// The height of the block in which the name was last updated, or zero
+	// if unknown. Names are updated to renew them as well as to change
+	// their values, so the value may be older.
+	Height int32
+}
+
+// NameData returns the value of a name along with its expiry status. Expired
+// names are returned with Expired set. If the name doesn't exist, the error
+// returned will be merr.ErrNoSuchDomain. Values larger than MaxValueSize, and
+// responses for another name, are rejected with a *ValueTooLargeError or a
+// *NameMismatchError respectively.
+func (c *Client) NameData(name string, streamIsolationID string) (*NameData, error) {
+	start := time.Now()
+	res, err := c.rpc(func(rc *ncrpcclient.Client) (interface{}, error) {
+		return rc.NameShow(name, &ncbtcjson.NameShowOptions{StreamID: streamIsolationID})
+	})
+	if jerr, ok := err.(*btcjson.RPCError); ok && jerr.Code == btcjson.ErrRPCWallet {
+		c.observe("name_show", start, nil)
+	} else {
+		c.observe("name_show", start, err)
+	}
 	if err != nil {
 		if jerr, ok := err.(*btcjson.RPCError); ok {
 			if jerr.Code == btcjson.ErrRPCWallet {
 				// ErrRPCWallet from name_show indicates that
 				// the name does not exist.
-				return "", merr.ErrNoSuchDomain
+				return nil, merr.ErrNoSuchDomain
 			}
 		}
 
 		// Some error besides NXDOMAIN happened; pass that error
 		// through unaltered.
-		return "", err
+		return nil, err
+	}
+
+	nameData, _ := res.(*ncbtcjson.NameShowResult)
+
+	// A name which can't be represented in the requested encoding has no
+	// "name" field, only a "name_error".
+	if nameData.NameError == "" && nameData.Name != name {
+		return nil, &NameMismatchError{Requested: name, Returned: nameData.Name}
+	}
+
+	if err := c.checkValueSize(nameData); err != nil {
+		return nil, err
 	}
 
 	// TODO: check the "value_error" field for errors and report those to the caller.
 
+	return &NameData{
+		Value:     nameData.Value,
+		ExpiresIn: nameData.ExpiresIn,
+		Expired:   nameData.Expired || nameData.ExpiresIn < 0,
+		Height:    nameData.Height,
+	}, nil
+}
+
+// NameQuery returns the value of a name.  If the name doesn't exist or has
+// expired, the error returned will be merr.ErrNoSuchDomain.
+func (c *Client) NameQuery(name string, streamIsolationID string) (string, error) {
+	nameData, err := c.NameData(name, streamIsolationID)
+	if err != nil {
+		return "", err
+	}
+
+	if nameData.Expired {
+		return "", merr.ErrNoSuchDomain
+	}
+
 	// We got the name data.  Return the value.
 	return nameData.Value, nil
 }
@@ -0,0 +1,163 @@
+package namecoin
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/btcsuite/btcd/rpcclient"
+	"gopkg.in/hlandau/madns.v2/merr"
+)
+
+// A fake namecoind which answers each JSON-RPC method with a canned result.
+// A nil result is answered with the "name not found" RPC error.
+type fakeRPC map[string]func(params []json.RawMessage) interface{}
+
+func (f fakeRPC) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	var call struct {
+		Method string            `json:"method"`
+		Params []json.RawMessage `json:"params"`
+		ID     interface{}       `json:"id"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&call); err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	res := map[string]interface{}{"id": call.ID, "result": nil, "error": nil}
+	if h, ok := f[call.Method]; ok {
+		res["result"] = h(call.Params)
+	}
+	if res["result"] == nil {
+		res["error"] = map[string]interface{}{"code": -4, "message": "name not found"}
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(res)
+}
+
+func newFakeClient(t *testing.T, rpc fakeRPC) (*Client, func()) {
+	srv := httptest.NewServer(rpc)
+
+	c, err := New(&rpcclient.ConnConfig{
+		Host:         strings.TrimPrefix(srv.URL, "http://"),
+		User:         "user",
+		Pass:         "pass",
+		HTTPPostMode: true,
+		DisableTLS:   true,
+	}, nil)
+	if err != nil {
+		srv.Close()
+		t.Fatal(err)
+	}
+
+	return c, func() {
+		c.Shutdown()
+		srv.Close()
+	}
+}
+
+func nameShowResult(name, value string) map[string]interface{} {
+	return map[string]interface{}{
+		"name":       name,
+		"value":      value,
+		"expires_in": 30000,
+		"expired":    false,
+	}
+}
+
+func TestNameDataValueSize(t *testing.T) {
+	values := map[string]string{
+		"d/small":   `{"ip":["192.0.2.1"]}`,
+		"d/limit":   strings.Repeat("x", DefaultMaxValueSize),
+		"d/toolong": strings.Repeat("x", DefaultMaxValueSize+1),
+		"d/huge":    strings.Repeat("x", 4<<20),
+	}
+	c, done := newFakeClient(t, fakeRPC{
+		"name_show": func(params []json.RawMessage) interface{} {
+			var name string
+			json.Unmarshal(params[0], &name)
+			if v, ok := values[name]; ok {
+				return nameShowResult(name, v)
+			}
+			return nil
+		},
+	})
+	defer done()
+
+	for _, name := range []string{"d/small", "d/limit"} {
+		nd, err := c.NameData(name, "")
+		if err != nil || nd.Value != values[name] {
+			t.Errorf("%s: got error %v", name, err)
+		}
+	}
+
+	for _, name := range []string{"d/toolong", "d/huge"} {
+		_, err := c.NameData(name, "")
+		if e, ok := err.(*ValueTooLargeError); !ok || e.Size != len(values[name]) || e.Limit != DefaultMaxValueSize {
+			t.Errorf("%s: expected ValueTooLargeError, got %v", name, err)
+		}
+		if _, err := c.NameQuery(name, ""); err == nil || err == merr.ErrNoSuchDomain {
+			t.Errorf("%s: NameQuery returned %v for oversized value", name, err)
+		}
+	}
+
+	if _, err := c.NameData("d/missing", ""); err != merr.ErrNoSuchDomain {
+		t.Errorf("expected no such domain, got %v", err)
+	}
+
+	c.MaxValueSize = 0
+	if _, err := c.NameData("d/toolong", ""); err != nil {
+		t.Errorf("value rejected with no limit: %v", err)
+	}
+}
+
+func TestNameDataNameMismatch(t *testing.T) {
+	c, done := newFakeClient(t, fakeRPC{
+		"name_show": func(params []json.RawMessage) interface{} {
+			return nameShowResult("d/other", `{}`)
+		},
+	})
+	defer done()
+
+	_, err := c.NameData("d/example", "")
+	if e, ok := err.(*NameMismatchError); !ok || e.Requested != "d/example" || e.Returned != "d/other" {
+		t.Errorf("expected NameMismatchError, got %v", err)
+	}
+}
+
+func TestNameScanLimits(t *testing.T) {
+	oversized := false
+	c, done := newFakeClient(t, fakeRPC{
+		"name_scan": func(params []json.RawMessage) interface{} {
+			// Ignores the requested count, returning too many results.
+			results := []interface{}{}
+			for _, name := range []string{"d/a", "d/b", "d/c"} {
+				results = append(results, nameShowResult(name, `{}`))
+			}
+			if oversized {
+				results = results[:1]
+				results[0] = nameShowResult("d/a", strings.Repeat("x", 1<<20))
+			}
+			return results
+		},
+	})
+	defer done()
+
+	if results, err := c.NameScan("d/", 3); err != nil || len(results) != 3 {
+		t.Errorf("got %d results, %v", len(results), err)
+	}
+
+	if _, err := c.NameScan("d/", 2); err == nil {
+		t.Errorf("name_scan returning more results than requested wasn't rejected")
+	}
+
+	oversized = true
+	if _, err := c.NameScan("d/", 3); err == nil {
+		t.Errorf("name_scan returning an oversized value wasn't rejected")
+	} else if _, ok := err.(*ValueTooLargeError); !ok {
+		t.Errorf("expected ValueTooLargeError, got %v", err)
+	}
+}
@@ -0,0 +1,157 @@
+package namecoin
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"time"
+
+	"github.com/btcsuite/btcd/rpcclient"
+
+	"github.com/namecoin/ncrpcclient"
+)
+
+// A Namecoin network, and the defaults Namecoin Core uses for it.
+type Network struct {
+	// The name used to select the network in configuration.
+	Name string
+
+	// The name of the chain as reported by getblockchaininfo.
+	Chain string
+
+	// The port Namecoin Core listens for RPC connections on by default.
+	RPCPort int
+
+	// The subdirectory of the Namecoin Core data directory holding the
+	// network's files, including the RPC cookie.
+	DataSubdir string
+}
+
+var (
+	Mainnet = &Network{Name: "mainnet", Chain: "main", RPCPort: 8336}
+	Testnet = &Network{Name: "testnet", Chain: "test", RPCPort: 18336, DataSubdir: "testnet3"}
+	Regtest = &Network{Name: "regtest", Chain: "regtest", RPCPort: 18443, DataSubdir: "regtest"}
+)
+
+// Returns the network with the given name. The empty name means mainnet.
+func NetworkByName(name string) (*Network, error) {
+	switch name {
+	case "", Mainnet.Name:
+		return Mainnet, nil
+	case Testnet.Name:
+		return Testnet, nil
+	case Regtest.Name:
+		return Regtest, nil
+	default:
+		return nil, fmt.Errorf("unknown Namecoin network %q: must be mainnet, testnet or regtest", name)
+	}
+}
+
+// Whether names on the network have any real-world meaning.
+func (n *Network) IsTest() bool {
+	return n != Mainnet
+}
+
+// The address of a Namecoin Core on this machine listening on its default RPC
+// port.
+func (n *Network) DefaultRPCAddress() string {
+	return net.JoinHostPort("127.0.0.1", strconv.Itoa(n.RPCPort))
+}
+
+// The path of the RPC cookie written by a Namecoin Core on this machine using
+// its default data directory, or "" if the data directory can't be
+// determined.
+func (n *Network) DefaultCookiePath() string {
+	dir := defaultDataDir()
+	if dir == "" {
+		return ""
+	}
+
+	return filepath.Join(dir, n.DataSubdir, ".cookie")
+}
+
+func defaultDataDir() string {
+	if runtime.GOOS == "windows" {
+		if appData := os.Getenv("APPDATA"); appData != "" {
+			return filepath.Join(appData, "Namecoin")
+		}
+		return ""
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+
+	if runtime.GOOS == "darwin" {
+		return filepath.Join(home, "Library", "Application Support", "Namecoin")
+	}
+
+	return filepath.Join(home, ".namecoin")
+}
+
+// SetDefaults fills in the RPC address of cfg, if empty, with the default
+// address for the network. If no credentials are given, it also sets the
+// cookie path to the default one.
+func (n *Network) SetDefaults(cfg *rpcclient.ConnConfig) {
+	if cfg.Host == "" {
+		cfg.Host = n.DefaultRPCAddress()
+	}
+	if cfg.CookiePath == "" && cfg.User == "" && cfg.Pass == "" {
+		cfg.CookiePath = n.DefaultCookiePath()
+	}
+}
+
+// The state of namecoind's block chain, as reported by getblockchaininfo.
+type BlockchainInfo struct {
+	// The name of the chain, as used in Network.Chain.
+	Chain string `json:"chain"`
+
+	// The height of the best block, and of the best header known, which is
+	// higher while blocks are still being downloaded.
+	Blocks  int64 `json:"blocks"`
+	Headers int64 `json:"headers"`
+
+	// The median time of the last 11 blocks, in seconds since the epoch,
+	// which lags the time of the best block by about an hour.
+	MedianTime int64 `json:"mediantime"`
+
+	// Whether namecoind is still catching up with the network.
+	InitialBlockDownload bool `json:"initialblockdownload"`
+}
+
+// BlockchainInfo returns the state of namecoind's block chain.
+func (c *Client) BlockchainInfo() (*BlockchainInfo, error) {
+	start := time.Now()
+	res, err := c.rpc(func(rc *ncrpcclient.Client) (interface{}, error) {
+		return rc.RawRequest("getblockchaininfo", nil)
+	})
+	c.observe("getblockchaininfo", start, err)
+	if err != nil {
+		return nil, err
+	}
+	raw, _ := res.(json.RawMessage)
+
+	info := &BlockchainInfo{}
+	err = json.Unmarshal(raw, info)
+	if err != nil {
+		return nil, err
+	}
+
+	return info, nil
+}
+
+// Chain returns the name of the chain namecoind is running on, as used in
+// Network.Chain.
+func (c *Client) Chain() (string, error) {
+	info, err := c.BlockchainInfo()
+	if err != nil {
+		return "", err
+	}
+
+	return info.Chain, nil
+}
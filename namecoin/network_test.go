@@ -0,0 +1,83 @@
+package namecoin
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"testing"
+
+	"github.com/btcsuite/btcd/rpcclient"
+)
+
+func TestNetworkDefaults(t *testing.T) {
+	for _, test := range []struct {
+		name, address, cookieDir string
+	}{
+		{"", "127.0.0.1:8336", ""},
+		{"mainnet", "127.0.0.1:8336", ""},
+		{"testnet", "127.0.0.1:18336", "testnet3"},
+		{"regtest", "127.0.0.1:18443", "regtest"},
+	} {
+		n, err := NetworkByName(test.name)
+		if err != nil {
+			t.Fatalf("%q: %v", test.name, err)
+		}
+
+		cfg := &rpcclient.ConnConfig{}
+		n.SetDefaults(cfg)
+		if cfg.Host != test.address {
+			t.Errorf("%q: default address %s, expected %s", test.name, cfg.Host, test.address)
+		}
+		if cfg.CookiePath != "" && filepath.Dir(cfg.CookiePath) != filepath.Join(defaultDataDir(), test.cookieDir) {
+			t.Errorf("%q: default cookie path %s", test.name, cfg.CookiePath)
+		}
+
+		// Given credentials, the cookie isn't used.
+		cfg = &rpcclient.ConnConfig{Host: "192.0.2.1:1234", User: "user", Pass: "pass"}
+		n.SetDefaults(cfg)
+		if cfg.Host != "192.0.2.1:1234" || cfg.CookiePath != "" {
+			t.Errorf("%q: defaults override configuration: %+v", test.name, cfg)
+		}
+	}
+
+	if _, err := NetworkByName("signet"); err == nil {
+		t.Errorf("unknown network accepted")
+	}
+	if Mainnet.IsTest() || !Testnet.IsTest() || !Regtest.IsTest() {
+		t.Errorf("wrong networks marked as test networks")
+	}
+}
+
+func TestChain(t *testing.T) {
+	c, done := newFakeClient(t, fakeRPC{
+		"getblockchaininfo": func(params []json.RawMessage) interface{} {
+			return map[string]interface{}{"chain": "regtest", "blocks": 101}
+		},
+	})
+	defer done()
+
+	chain, err := c.Chain()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chain != Regtest.Chain {
+		t.Errorf("got chain %q", chain)
+	}
+}
+
+func TestBlockchainInfo(t *testing.T) {
+	c, done := newFakeClient(t, fakeRPC{
+		"getblockchaininfo": func(params []json.RawMessage) interface{} {
+			return map[string]interface{}{"chain": "main", "blocks": 100, "headers": 120, "mediantime": 1600000000, "initialblockdownload": true}
+		},
+	})
+	defer done()
+
+	info, err := c.BlockchainInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := BlockchainInfo{Chain: "main", Blocks: 100, Headers: 120, MedianTime: 1600000000, InitialBlockDownload: true}
+	if *info != expected {
+		t.Errorf("got %+v, expected %+v", *info, expected)
+	}
+}
@@ -0,0 +1,222 @@
+package namecoin
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// How long setting up a connection through a SOCKS5 proxy may take. Tor can
+// take tens of seconds to build a circuit to an onion service.
+const proxyTimeout = time.Minute
+
+// A SOCKS5 proxy, such as Tor's SOCKSPort, through which namecoind is
+// connected to, e.g. at a .onion address. The host of namecoind's address is
+// passed to the proxy as it is, so that a name is resolved by the proxy and
+// never looked up locally.
+type Proxy struct {
+	// The host:port of the proxy.
+	Addr string
+
+	// If set, each connection authenticates with a random username and
+	// password, which Tor takes as a request for a circuit of its own, so
+	// that the connections can't be linked with each other.
+	Isolate bool
+}
+
+// ParseProxyURL parses a proxy given as socks5://host:port. socks5h:// is
+// taken to mean the same, as names are always resolved by the proxy.
+func ParseProxyURL(s string) (*Proxy, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "socks5" && u.Scheme != "socks5h" {
+		return nil, fmt.Errorf("unsupported proxy %q: must be given as socks5://host:port", s)
+	}
+	if u.User != nil || (u.Path != "" && u.Path != "/") {
+		return nil, fmt.Errorf("unsupported proxy %q: must be given as socks5://host:port", s)
+	}
+	if _, _, err := net.SplitHostPort(u.Host); err != nil {
+		return nil, fmt.Errorf("proxy %q has no port: %v", s, err)
+	}
+
+	return &Proxy{Addr: u.Host}, nil
+}
+
+// ProxyError is returned when a connection to namecoind through a SOCKS5
+// proxy can't be set up.
+type ProxyError struct {
+	Proxy  string // the address of the proxy
+	Target string // the address of namecoind
+
+	// Set if the proxy was reached but couldn't connect to namecoind;
+	// otherwise the proxy couldn't be connected to or failed the SOCKS5
+	// handshake.
+	TargetUnreachable bool
+
+	Err error
+}
+
+func (e *ProxyError) Error() string {
+	if e.TargetUnreachable {
+		return fmt.Sprintf("namecoind at %s unreachable through the SOCKS5 proxy at %s: %v", e.Target, e.Proxy, e.Err)
+	}
+	return fmt.Sprintf("SOCKS5 proxy at %s unreachable: %v", e.Proxy, e.Err)
+}
+
+func (e *ProxyError) Unwrap() error {
+	return e.Err
+}
+
+// The reasons given by a SOCKS5 proxy for failing to connect, by reply code
+// (RFC 1928).
+var socksReplies = map[byte]string{
+	1: "general SOCKS server failure",
+	2: "connection not allowed by ruleset",
+	3: "network unreachable",
+	4: "host unreachable",
+	5: "connection refused",
+	6: "TTL expired",
+	7: "command not supported",
+	8: "address type not supported",
+}
+
+// Connects to target, a host:port, through the proxy.
+func (p *Proxy) dial(target string) (net.Conn, error) {
+	host, portStr, err := net.SplitHostPort(target)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("malformed port in %q", target)
+	}
+
+	conn, err := net.DialTimeout("tcp", p.Addr, proxyTimeout)
+	if err != nil {
+		return nil, &ProxyError{Proxy: p.Addr, Target: target, Err: err}
+	}
+
+	conn.SetDeadline(time.Now().Add(proxyTimeout))
+	if err := p.handshake(conn, host, uint16(port)); err != nil {
+		conn.Close()
+		if pe, ok := err.(*ProxyError); ok {
+			pe.Proxy, pe.Target = p.Addr, target
+			return nil, pe
+		}
+		return nil, &ProxyError{Proxy: p.Addr, Target: target, Err: err}
+	}
+	conn.SetDeadline(time.Time{})
+
+	return conn, nil
+}
+
+func (p *Proxy) handshake(conn net.Conn, host string, port uint16) error {
+	method := byte(0) // no authentication
+	if p.Isolate {
+		method = 2 // username and password
+	}
+	if _, err := conn.Write([]byte{5, 1, method}); err != nil {
+		return err
+	}
+
+	var b [4]byte
+	if _, err := io.ReadFull(conn, b[:2]); err != nil {
+		return err
+	}
+	if b[0] != 5 {
+		return errors.New("not a SOCKS5 proxy")
+	}
+	if b[1] != method {
+		return fmt.Errorf("proxy doesn't support authentication method %d", method)
+	}
+
+	if p.Isolate {
+		if err := isolationAuth(conn); err != nil {
+			return err
+		}
+	}
+
+	// The host is sent as a name unless it's an IP address, so that the
+	// proxy resolves it.
+	req := []byte{5, 1, 0}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return fmt.Errorf("host name %q is too long", host)
+		}
+		req = append(req, 3, byte(len(host)))
+		req = append(req, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		req = append(req, 1)
+		req = append(req, ip4...)
+	} else {
+		req = append(req, 4)
+		req = append(req, ip.To16()...)
+	}
+	req = append(req, byte(port>>8), byte(port))
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	if _, err := io.ReadFull(conn, b[:4]); err != nil {
+		return err
+	}
+	if b[1] != 0 {
+		reason, ok := socksReplies[b[1]]
+		if !ok {
+			reason = fmt.Sprintf("reply code %d", b[1])
+		}
+		return &ProxyError{TargetUnreachable: true, Err: errors.New(reason)}
+	}
+
+	// Skip the address the proxy connected from.
+	var n int
+	switch b[3] {
+	case 1:
+		n = net.IPv4len
+	case 4:
+		n = net.IPv6len
+	case 3:
+		if _, err := io.ReadFull(conn, b[:1]); err != nil {
+			return err
+		}
+		n = int(b[0])
+	default:
+		return fmt.Errorf("unknown address type %d in reply", b[3])
+	}
+	_, err := io.ReadFull(conn, make([]byte, n+2))
+	return err
+}
+
+// Authenticates with a random username and password (RFC 1929).
+func isolationAuth(conn net.Conn) error {
+	var creds [16]byte
+	if _, err := rand.Read(creds[:]); err != nil {
+		return err
+	}
+	user, pass := hex.EncodeToString(creds[:8]), hex.EncodeToString(creds[8:])
+
+	req := []byte{1, byte(len(user))}
+	req = append(req, user...)
+	req = append(req, byte(len(pass)))
+	req = append(req, pass...)
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	var b [2]byte
+	if _, err := io.ReadFull(conn, b[:]); err != nil {
+		return err
+	}
+	if b[1] != 0 {
+		return errors.New("proxy refused the isolation credentials")
+	}
+	return nil
+}
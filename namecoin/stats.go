@@ -0,0 +1,99 @@
+package namecoin
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"gopkg.in/hlandau/madns.v2/merr"
+
+	"github.com/namecoin/ncrpcclient"
+
+	"github.com/namecoin/ncdns/metrics"
+)
+
+// Statistics of the calls of one RPC method made by a Client.
+type CallStats struct {
+	Method string
+
+	// Calls which failed, other than those for names which don't exist.
+	Errors uint64
+
+	// The time taken by each call, in seconds, including failed ones.
+	Latency metrics.HistogramSnapshot
+}
+
+type callStats struct {
+	mu      sync.Mutex
+	methods map[string]*methodStats
+}
+
+type methodStats struct {
+	errors  uint64
+	latency *metrics.Histogram
+}
+
+// Records a call of method which started at start and returned err.
+func (c *Client) observe(method string, start time.Time, err error) {
+	c.calls.mu.Lock()
+	defer c.calls.mu.Unlock()
+
+	if c.calls.methods == nil {
+		c.calls.methods = map[string]*methodStats{}
+	}
+	m, ok := c.calls.methods[method]
+	if !ok {
+		m = &methodStats{latency: metrics.NewHistogram(metrics.LatencyBuckets)}
+		c.calls.methods[method] = m
+	}
+
+	m.latency.Observe(time.Since(start).Seconds())
+	if err != nil && err != merr.ErrNoSuchDomain {
+		m.errors++
+	}
+}
+
+// CallStats returns statistics of the RPC calls made by the client, by
+// method, in order of method. Only the calls made by the methods of Client
+// itself, rather than of the ncrpcclient.Client it embeds, are counted.
+func (c *Client) CallStats() []CallStats {
+	c.calls.mu.Lock()
+	defer c.calls.mu.Unlock()
+
+	stats := make([]CallStats, 0, len(c.calls.methods))
+	for method, m := range c.calls.methods {
+		stats = append(stats, CallStats{
+			Method:  method,
+			Errors:  m.errors,
+			Latency: m.latency.Snapshot(),
+		})
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Method < stats[j].Method })
+
+	return stats
+}
+
+// GetBestBlockHash is like ncrpcclient.Client.GetBestBlockHash, but counted
+// in CallStats.
+func (c *Client) GetBestBlockHash() (hash *chainhash.Hash, err error) {
+	start := time.Now()
+	defer func() { c.observe("getbestblockhash", start, err) }()
+	res, err := c.rpc(func(rc *ncrpcclient.Client) (interface{}, error) {
+		return rc.GetBestBlockHash()
+	})
+	hash, _ = res.(*chainhash.Hash)
+	return hash, err
+}
+
+// GetBlockCount is like ncrpcclient.Client.GetBlockCount, but counted in
+// CallStats.
+func (c *Client) GetBlockCount() (count int64, err error) {
+	start := time.Now()
+	defer func() { c.observe("getblockcount", start, err) }()
+	res, err := c.rpc(func(rc *ncrpcclient.Client) (interface{}, error) {
+		return rc.GetBlockCount()
+	})
+	count, _ = res.(int64)
+	return count, err
+}
@@ -0,0 +1,45 @@
+package namecoin
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestCallStats(t *testing.T) {
+	c, done := newFakeClient(t, fakeRPC{
+		"name_show": func(params []json.RawMessage) interface{} {
+			var name string
+			json.Unmarshal(params[0], &name)
+			if name == "d/example" {
+				return nameShowResult(name, `{}`)
+			}
+			return nil
+		},
+	})
+	defer done()
+
+	c.NameData("d/example", "")
+	c.NameData("d/missing", "")
+	c.GetBlockCount()
+
+	stats := c.CallStats()
+	if len(stats) != 2 {
+		t.Fatalf("got stats %+v", stats)
+	}
+
+	// A name which doesn't exist isn't an error, but getblockcount isn't
+	// answered by the fake.
+	for i, expected := range []struct {
+		method        string
+		calls, errors uint64
+	}{
+		{"getblockcount", 1, 1},
+		{"name_show", 2, 0},
+	} {
+		st := stats[i]
+		if st.Method != expected.method || st.Latency.Count != expected.calls || st.Errors != expected.errors {
+			t.Errorf("got %s: %d calls, %d errors; expected %s: %d calls, %d errors",
+				st.Method, st.Latency.Count, st.Errors, expected.method, expected.calls, expected.errors)
+		}
+	}
+}
@@ -0,0 +1,355 @@
+package namecoin
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/btcsuite/btcd/rpcclient"
+	"github.com/hlandau/xlog"
+)
+
+var log, Log = xlog.New("ncdns.namecoin")
+
+// How namecoind's TLS certificate is checked by a client made with NewTLS.
+type TLSConfig struct {
+	// CA certificates trusted to issue namecoind's certificate. If nil, the
+	// system's are used.
+	RootCAs *x509.CertPool
+
+	// If not empty, the SHA-256 hash of the SubjectPublicKeyInfo of
+	// namecoind's certificate must be one of these.
+	PinSPKI [][]byte
+
+	// If set, the certificate is checked only against PinSPKI, and not
+	// against the CAs.
+	PinOnly bool
+
+	// The name namecoind's certificate must be issued for. If empty, the
+	// host of the RPC address is used. Setting it allows a certificate for a
+	// fixed name, e.g. a self-signed one, to be used whatever address
+	// namecoind is reached at.
+	ServerName string
+
+	// Client certificates presented to namecoind (or the proxy in front of
+	// it), if it requires them.
+	Certificates []tls.Certificate
+}
+
+// Parses a comma-separated list of base64 SHA-256 SPKI hashes, as in the
+// output of:
+//
+//	openssl x509 -pubkey -noout | openssl pkey -pubin -outform der | openssl dgst -sha256 -binary | base64
+func ParseSPKIPins(s string) ([][]byte, error) {
+	var pins [][]byte
+	for _, p := range strings.Split(s, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+
+		pin, err := base64.StdEncoding.DecodeString(p)
+		if err != nil || len(pin) != sha256.Size {
+			return nil, fmt.Errorf("malformed SPKI pin %q: must be a base64 SHA-256 hash", p)
+		}
+		pins = append(pins, pin)
+	}
+
+	return pins, nil
+}
+
+// SPKIHash returns the base64 SHA-256 hash of the SubjectPublicKeyInfo of a
+// certificate, in the form taken by ParseSPKIPins.
+func SPKIHash(cert *x509.Certificate) string {
+	h := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(h[:])
+}
+
+// SPKIPinError is returned when namecoind's certificate matches none of the
+// pins.
+type SPKIPinError struct {
+	// The hash of the certificate presented, to which the pin may need to
+	// be updated.
+	Observed string
+}
+
+func (e *SPKIPinError) Error() string {
+	return fmt.Sprintf("namecoind's TLS certificate has SPKI hash %s, which matches none of the configured pins", e.Observed)
+}
+
+func (c *TLSConfig) tlsConfig(serverName string) *tls.Config {
+	if c.ServerName != "" {
+		serverName = c.ServerName
+	}
+
+	tc := &tls.Config{
+		ServerName:         serverName,
+		RootCAs:            c.RootCAs,
+		Certificates:       c.Certificates,
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: c.PinOnly, // verified against the pins below
+	}
+
+	if len(c.PinSPKI) > 0 {
+		tc.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return fmt.Errorf("namecoind presented no TLS certificate")
+			}
+
+			leaf, err := x509.ParseCertificate(rawCerts[0])
+			if err != nil {
+				return err
+			}
+
+			h := sha256.Sum256(leaf.RawSubjectPublicKeyInfo)
+			for _, pin := range c.PinSPKI {
+				if subtle.ConstantTimeCompare(h[:], pin) == 1 {
+					return nil
+				}
+			}
+
+			return &SPKIPinError{Observed: base64.StdEncoding.EncodeToString(h[:])}
+		}
+	}
+
+	return tc
+}
+
+// NewTLS is like New, but connects to namecoind over TLS, checking its
+// certificate as tlsCfg says. The client can't be given a TLS configuration
+// of its own, so it talks to a forwarder on the loopback interface, which
+// makes a TLS connection to namecoind for each connection it accepts. A
+// connection whose certificate fails the checks is closed, and the reason
+// logged.
+func NewTLS(config *rpcclient.ConnConfig, tlsCfg *TLSConfig) (*Client, error) {
+	return NewProxied(config, tlsCfg, nil)
+}
+
+// NewProxied is like NewTLS, but connects to namecoind through proxy, if it
+// isn't nil, and over TLS only if tlsCfg isn't nil. The forwarder makes a
+// connection through the proxy for each connection it accepts.
+func NewProxied(config *rpcclient.ConnConfig, tlsCfg *TLSConfig, proxy *Proxy) (*Client, error) {
+	return newForwarded(config, tlsCfg, proxy, func(err error) {
+		log.Errore(err, "connection to namecoind")
+	})
+}
+
+func newTLS(config *rpcclient.ConnConfig, tlsCfg *TLSConfig, onError func(error)) (*Client, error) {
+	return newForwarded(config, tlsCfg, nil, onError)
+}
+
+func newForwarded(config *rpcclient.ConnConfig, tlsCfg *TLSConfig, proxy *Proxy, onError func(error)) (*Client, error) {
+	serverName, _, err := net.SplitHostPort(config.Host)
+	if err != nil {
+		return nil, err
+	}
+
+	addr := config.Host
+	dial := func() (net.Conn, error) {
+		return net.Dial("tcp", addr)
+	}
+	if proxy != nil {
+		dial = func() (net.Conn, error) {
+			return proxy.dial(addr)
+		}
+	}
+	if tlsCfg != nil {
+		tc := tlsCfg.tlsConfig(serverName)
+		dialPlain := dial
+		dial = func() (net.Conn, error) {
+			conn, err := dialPlain()
+			if err != nil {
+				return nil, err
+			}
+
+			tconn := tls.Client(conn, tc)
+			if err := tconn.Handshake(); err != nil {
+				conn.Close()
+				return nil, err
+			}
+			return tconn, nil
+		}
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	f := &forwarder{
+		l:       l,
+		dial:    dial,
+		onError: onError,
+	}
+	go f.run()
+
+	cfg := *config
+	cfg.Host = l.Addr().String()
+	cfg.DisableTLS = true
+
+	c, err := New(&cfg, nil)
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+
+	c.forwarder = f
+	return c, nil
+}
+
+// Shutdown shuts down the client, and the forwarder if there is one. A
+// client made with NewFailover shuts down the clients of all its nodes.
+func (c *Client) Shutdown() {
+	if c.failover != nil {
+		c.failover.shutdown()
+		return
+	}
+
+	if c.cookie != nil {
+		c.cookie.shutdown()
+	} else {
+		c.Client.Shutdown()
+	}
+	if c.forwarder != nil {
+		c.forwarder.l.Close()
+	}
+}
+
+type forwarder struct {
+	l       net.Listener
+	dial    func() (net.Conn, error) // connects to namecoind
+	onError func(error)
+
+	mu      sync.Mutex
+	lastErr error // of the latest connection to namecoind; nil if it succeeded
+}
+
+func (f *forwarder) setLastError(err error) {
+	f.mu.Lock()
+	f.lastErr = err
+	f.mu.Unlock()
+}
+
+func (f *forwarder) lastError() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.lastErr
+}
+
+func (f *forwarder) run() {
+	for {
+		conn, err := f.l.Accept()
+		if err != nil {
+			return
+		}
+
+		go f.forward(conn)
+	}
+}
+
+func (f *forwarder) forward(conn net.Conn) {
+	defer conn.Close()
+
+	remote, err := f.dial()
+	f.setLastError(err)
+	if err != nil {
+		f.onError(err)
+		return
+	}
+	defer remote.Close()
+
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(remote, conn)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(conn, remote)
+		done <- struct{}{}
+	}()
+	<-done
+}
+
+// Why a request to namecoind failed, as far as can be told, so that the user
+// can be told what to fix.
+type FailureKind int
+
+const (
+	FailureUnknown     FailureKind = iota
+	FailureUnreachable             // nothing accepted the connection
+	FailureTLS                     // the TLS handshake failed, e.g. as the certificate wasn't trusted
+	FailureAuth                    // namecoind refused the RPC credentials
+	FailureProxy                   // the SOCKS5 proxy couldn't be reached, or failed the handshake
+	FailureProxyTarget             // the SOCKS5 proxy couldn't connect to namecoind
+)
+
+// ClassifyError returns why err, returned by a request made with c, came
+// about. For a client made with NewTLS or NewProxied, the request itself
+// only sees the connection to namecoind being closed, so the error of the
+// latest attempt to connect is looked at instead. For a client made with
+// NewFailover, the error is taken to be from the active node.
+func (c *Client) ClassifyError(err error) FailureKind {
+	if err == nil {
+		return FailureUnknown
+	}
+
+	if c.failover != nil {
+		_, e := c.failover.activeEndpoint()
+		return e.client.ClassifyError(err)
+	}
+
+	if c.forwarder != nil {
+		if ferr := c.forwarder.lastError(); ferr != nil {
+			var perr *ProxyError
+			if errors.As(ferr, &perr) {
+				if perr.TargetUnreachable {
+					return FailureProxyTarget
+				}
+				return FailureProxy
+			}
+			if isDialError(ferr) {
+				return FailureUnreachable
+			}
+			return FailureTLS
+		}
+	}
+
+	if isAuthError(err) {
+		return FailureAuth
+	}
+
+	if isDialError(err) {
+		return FailureUnreachable
+	}
+	return FailureUnknown
+}
+
+// The RPC client reports an unsuccessful HTTP response by its status, e.g.
+// "401 Unauthorized" when namecoind's body is empty, as it is when the
+// credentials are wrong, or "status code: 401, ..." in older versions.
+func isAuthError(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	msg := err.Error()
+	for _, code := range []string{"401", "403"} {
+		if strings.HasPrefix(msg, code+" ") || strings.Contains(msg, "status code: "+code) {
+			return true
+		}
+	}
+	return false
+}
+
+func isDialError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
@@ -0,0 +1,254 @@
+package namecoin
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/rpcclient"
+)
+
+// Returns a self-signed certificate for 127.0.0.1 and namecoind.test with a
+// new key.
+func newTestCert(t *testing.T) (tls.Certificate, *x509.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "namecoind"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		DNSNames:              []string{"namecoind.test"},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, cert
+}
+
+func newTLSFakeRPC(t *testing.T, cert tls.Certificate) *httptest.Server {
+	srv := httptest.NewUnstartedServer(fakeRPC{
+		"name_show": func(params []json.RawMessage) interface{} {
+			return nameShowResult("d/example", `{"ip":"192.0.2.1"}`)
+		},
+	})
+	srv.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+	srv.StartTLS()
+	return srv
+}
+
+func TestTLSPinning(t *testing.T) {
+	certA, leafA := newTestCert(t)
+	certB, leafB := newTestCert(t)
+	srvA, srvB := newTLSFakeRPC(t, certA), newTLSFakeRPC(t, certB)
+	defer srvA.Close()
+	defer srvB.Close()
+
+	pinsA, err := ParseSPKIPins(" " + SPKIHash(leafA) + ",")
+	if err != nil || len(pinsA) != 1 {
+		t.Fatalf("couldn't parse pin: %v", err)
+	}
+	pinsB, _ := ParseSPKIPins(SPKIHash(leafB))
+	rootsA := x509.NewCertPool()
+	rootsA.AddCert(leafA)
+
+	tests := []struct {
+		name     string
+		srv      *httptest.Server
+		cfg      *TLSConfig
+		ok       bool
+		observed string // the hash reported by a pin mismatch
+	}{
+		{"pinned key", srvA, &TLSConfig{PinSPKI: pinsA, PinOnly: true}, true, ""},
+		{"other key", srvB, &TLSConfig{PinSPKI: pinsA, PinOnly: true}, false, SPKIHash(leafB)},
+		{"either key", srvB, &TLSConfig{PinSPKI: append(pinsA, pinsB...), PinOnly: true}, true, ""},
+		{"CA and pin", srvA, &TLSConfig{RootCAs: rootsA, PinSPKI: pinsA}, true, ""},
+		{"CA but not pin", srvA, &TLSConfig{RootCAs: rootsA, PinSPKI: pinsB}, false, SPKIHash(leafA)},
+		{"pin but not CA", srvB, &TLSConfig{RootCAs: rootsA, PinSPKI: pinsB}, false, ""},
+	}
+
+	for _, test := range tests {
+		errs := make(chan error, 10)
+		c, err := newTLS(&rpcclient.ConnConfig{
+			Host:         strings.TrimPrefix(test.srv.URL, "https://"),
+			User:         "user",
+			Pass:         "pass",
+			HTTPPostMode: true,
+		}, test.cfg, func(err error) { errs <- err })
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+
+		if test.ok {
+			if _, err := c.NameData("d/example", ""); err != nil {
+				t.Errorf("%s: lookup failed: %v", test.name, err)
+			}
+			c.Shutdown()
+			continue
+		}
+
+		// The client retries failed requests for some time, so talk to the
+		// forwarder directly. The connection fails closed, saying why.
+		conn, err := net.Dial("tcp", c.forwarder.l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Write([]byte("POST / HTTP/1.1\r\nHost: namecoind\r\nContent-Length: 2\r\n\r\n{}"))
+		if n, err := conn.Read(make([]byte, 1)); n != 0 || err == nil {
+			t.Errorf("%s: forwarded connection to untrusted namecoind", test.name)
+		}
+		conn.Close()
+		c.Shutdown()
+
+		select {
+		case err := <-errs:
+			pinErr, isPinErr := err.(*SPKIPinError)
+			if test.observed != "" && (!isPinErr || pinErr.Observed != test.observed) {
+				t.Errorf("%s: expected pin mismatch for %s, got %v", test.name, test.observed, err)
+			}
+			if test.observed == "" && isPinErr {
+				t.Errorf("%s: expected CA validation failure, got %v", test.name, err)
+			}
+		default:
+			t.Errorf("%s: no TLS error reported", test.name)
+		}
+	}
+
+	if _, err := ParseSPKIPins("not base64!"); err == nil {
+		t.Errorf("malformed pin accepted")
+	}
+	if _, err := ParseSPKIPins("AAAA"); err == nil {
+		t.Errorf("short pin accepted")
+	}
+}
+
+func TestTLSServerNameAndClientCert(t *testing.T) {
+	cert, leaf := newTestCert(t)
+	clientCert, clientLeaf := newTestCert(t)
+	roots := x509.NewCertPool()
+	roots.AddCert(leaf)
+	clientRoots := x509.NewCertPool()
+	clientRoots.AddCert(clientLeaf)
+
+	srv := httptest.NewUnstartedServer(fakeRPC{
+		"name_show": func(params []json.RawMessage) interface{} {
+			return nameShowResult("d/example", `{"ip":"192.0.2.1"}`)
+		},
+	})
+	srv.TLS = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientRoots,
+
+		// Under TLS 1.3, a missing client certificate is only reported
+		// after the client's side of the handshake has finished.
+		MaxVersion: tls.VersionTLS12,
+	}
+	srv.StartTLS()
+	defer srv.Close()
+
+	tests := []struct {
+		name string
+		cfg  *TLSConfig
+		ok   bool
+	}{
+		{"name and client certificate", &TLSConfig{RootCAs: roots, ServerName: "namecoind.test", Certificates: []tls.Certificate{clientCert}}, true},
+		{"wrong name", &TLSConfig{RootCAs: roots, ServerName: "other.test", Certificates: []tls.Certificate{clientCert}}, false},
+		{"no client certificate", &TLSConfig{RootCAs: roots, ServerName: "namecoind.test"}, false},
+	}
+
+	for _, test := range tests {
+		errs := make(chan error, 10)
+		c, err := newTLS(&rpcclient.ConnConfig{
+			Host:         strings.TrimPrefix(srv.URL, "https://"),
+			User:         "user",
+			Pass:         "pass",
+			HTTPPostMode: true,
+		}, test.cfg, func(err error) { errs <- err })
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+
+		if test.ok {
+			if _, err := c.NameData("d/example", ""); err != nil {
+				t.Errorf("%s: lookup failed: %v", test.name, err)
+			}
+			c.Shutdown()
+			continue
+		}
+
+		conn, err := net.Dial("tcp", c.forwarder.l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Write([]byte("POST / HTTP/1.1\r\nHost: namecoind\r\nContent-Length: 2\r\n\r\n{}"))
+		conn.Read(make([]byte, 1))
+		conn.Close()
+		c.Shutdown()
+
+		select {
+		case err := <-errs:
+			if kind := c.ClassifyError(err); kind != FailureTLS {
+				t.Errorf("%s: failure classified as %d, not a TLS failure: %v", test.name, kind, err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Errorf("%s: no TLS error reported", test.name)
+		}
+	}
+}
+
+func TestClassifyError(t *testing.T) {
+	c := &Client{}
+
+	for _, test := range []struct {
+		err  error
+		kind FailureKind
+	}{
+		{errors.New("401 Unauthorized"), FailureAuth},
+		{errors.New("status code: 401, response: \"\""), FailureAuth},
+		{&url.Error{Op: "Post", URL: "http://127.0.0.1:8336", Err: &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}}, FailureUnreachable},
+		{errors.New("-8: name not found"), FailureUnknown},
+	} {
+		if kind := c.ClassifyError(test.err); kind != test.kind {
+			t.Errorf("%v: got kind %d, expected %d", test.err, kind, test.kind)
+		}
+	}
+
+	// Through the TLS forwarder, a failure to reach namecoind is told apart
+	// from a failed handshake.
+	c.forwarder = &forwarder{}
+	c.forwarder.setLastError(&net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")})
+	if kind := c.ClassifyError(errors.New("EOF")); kind != FailureUnreachable {
+		t.Errorf("unreachable namecoind classified as %d", kind)
+	}
+	c.forwarder.setLastError(&SPKIPinError{Observed: "x"})
+	if kind := c.ClassifyError(errors.New("EOF")); kind != FailureTLS {
+		t.Errorf("pin mismatch classified as %d", kind)
+	}
+}
@@ -0,0 +1,182 @@
+package namecoin
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// The largest ZeroMQ frame accepted from namecoind. Its notifications are far
+// smaller; anything larger means the other end isn't namecoind.
+const zmqMaxFrameSize = 1 << 16
+
+// The flags of a ZMTP frame.
+const (
+	zmqFlagMore    = 0x01
+	zmqFlagLong    = 0x02
+	zmqFlagCommand = 0x04
+)
+
+// BlockNotifications receives the hashes of new blocks as namecoind announces
+// them over ZeroMQ, when it's run with -zmqpubhashblock. Only as much of
+// ZMTP 3.0 as a SUB socket without security needs is spoken.
+type BlockNotifications struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// DialBlockNotifications subscribes to the hashblock notifications published
+// at addr, e.g. "tcp://127.0.0.1:28332" as given to namecoind's
+// -zmqpubhashblock, or simply "127.0.0.1:28332". The handshake must be done
+// within timeout.
+func DialBlockNotifications(addr string, timeout time.Duration) (*BlockNotifications, error) {
+	hostport := strings.TrimPrefix(addr, "tcp://")
+	if strings.Contains(hostport, "://") {
+		return nil, fmt.Errorf("unsupported ZeroMQ address %q: only tcp:// is supported", addr)
+	}
+
+	conn, err := net.DialTimeout("tcp", hostport, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	n := &BlockNotifications{conn: conn, r: bufio.NewReader(conn)}
+	conn.SetDeadline(time.Now().Add(timeout))
+	err = n.handshake()
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("ZeroMQ handshake with %s: %v", addr, err)
+	}
+	conn.SetDeadline(time.Time{})
+
+	return n, nil
+}
+
+func (n *BlockNotifications) handshake() error {
+	// The greeting: signature, version 3.0, the NULL mechanism, and not
+	// being the server.
+	greeting := make([]byte, 64)
+	greeting[0], greeting[9] = 0xff, 0x7f
+	greeting[10], greeting[11] = 3, 0
+	copy(greeting[12:32], "NULL")
+	if _, err := n.conn.Write(greeting); err != nil {
+		return err
+	}
+
+	peer := make([]byte, 64)
+	if _, err := io.ReadFull(n.r, peer); err != nil {
+		return err
+	}
+	if peer[0] != 0xff || peer[9]&1 != 1 || peer[10] < 3 {
+		return fmt.Errorf("the other end doesn't speak ZMTP 3")
+	}
+	if mech := string(bytes.TrimRight(peer[12:32], "\x00")); mech != "NULL" {
+		return fmt.Errorf("unsupported security mechanism %q", mech)
+	}
+
+	var ready bytes.Buffer
+	ready.WriteString("\x05READY\x0bSocket-Type")
+	binary.Write(&ready, binary.BigEndian, uint32(3))
+	ready.WriteString("SUB")
+	if err := n.writeFrame(zmqFlagCommand, ready.Bytes()); err != nil {
+		return err
+	}
+
+	flags, body, err := n.readFrame()
+	if err != nil {
+		return err
+	}
+	if flags&zmqFlagCommand == 0 || !bytes.HasPrefix(body, []byte("\x05READY")) {
+		return fmt.Errorf("expected READY")
+	}
+
+	// A subscription is a message of 1 followed by the topic.
+	return n.writeFrame(0, []byte("\x01hashblock"))
+}
+
+func (n *BlockNotifications) writeFrame(flags byte, body []byte) error {
+	var b bytes.Buffer
+	if len(body) > 255 {
+		b.WriteByte(flags | zmqFlagLong)
+		binary.Write(&b, binary.BigEndian, uint64(len(body)))
+	} else {
+		b.WriteByte(flags)
+		b.WriteByte(byte(len(body)))
+	}
+	b.Write(body)
+
+	_, err := n.conn.Write(b.Bytes())
+	return err
+}
+
+func (n *BlockNotifications) readFrame() (flags byte, body []byte, err error) {
+	flags, err = n.r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	var size uint64
+	if flags&zmqFlagLong != 0 {
+		err = binary.Read(n.r, binary.BigEndian, &size)
+	} else {
+		var b byte
+		b, err = n.r.ReadByte()
+		size = uint64(b)
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+	if size > zmqMaxFrameSize {
+		return 0, nil, fmt.Errorf("ZeroMQ frame of %d bytes is too large", size)
+	}
+
+	body = make([]byte, size)
+	_, err = io.ReadFull(n.r, body)
+	return flags, body, err
+}
+
+// Reads the frames of the next message, skipping commands.
+func (n *BlockNotifications) readMessage() ([][]byte, error) {
+	var msg [][]byte
+	for {
+		flags, body, err := n.readFrame()
+		if err != nil {
+			return nil, err
+		}
+		if flags&zmqFlagCommand != 0 {
+			continue
+		}
+
+		msg = append(msg, body)
+		if flags&zmqFlagMore == 0 {
+			return msg, nil
+		}
+	}
+}
+
+// Next waits for the next block to be announced, and returns its hash. The
+// hash is in the usual form, as returned by getbestblockhash.
+func (n *BlockNotifications) Next() (string, error) {
+	for {
+		msg, err := n.readMessage()
+		if err != nil {
+			return "", err
+		}
+
+		// The topic, the hash, and a sequence number.
+		if len(msg) >= 2 && string(msg[0]) == "hashblock" && len(msg[1]) == 32 {
+			return hex.EncodeToString(msg[1]), nil
+		}
+	}
+}
+
+// Close closes the connection, making a Next in progress return an error.
+func (n *BlockNotifications) Close() error {
+	return n.conn.Close()
+}
@@ -0,0 +1,101 @@
+package namecoin
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// Plays namecoind's ZeroMQ publisher to one subscriber, publishing the given
+// block hashes once it has subscribed.
+func fakeZMQPublisher(t *testing.T, hashes ...string) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		n := &BlockNotifications{conn: conn, r: bufio.NewReader(conn)}
+
+		greeting := make([]byte, 64)
+		greeting[0], greeting[9], greeting[10] = 0xff, 0x7f, 3
+		copy(greeting[12:], "NULL")
+		greeting[32] = 1 // as-server
+		conn.Write(greeting)
+		if _, err := io.ReadFull(n.r, make([]byte, 64)); err != nil {
+			t.Error(err)
+			return
+		}
+
+		if _, body, err := n.readFrame(); err != nil || !bytes.Contains(body, []byte("SUB")) {
+			t.Errorf("expected READY from a SUB socket, got %q (%v)", body, err)
+			return
+		}
+		n.writeFrame(zmqFlagCommand, []byte("\x05READY\x0bSocket-Type\x00\x00\x00\x03PUB"))
+		if _, body, err := n.readFrame(); err != nil || string(body) != "\x01hashblock" {
+			t.Errorf("expected a subscription to hashblock, got %q (%v)", body, err)
+			return
+		}
+
+		for i, h := range hashes {
+			b, _ := hex.DecodeString(h)
+			n.writeFrame(zmqFlagMore, []byte("hashblock"))
+			n.writeFrame(zmqFlagMore, b)
+			n.writeFrame(0, []byte{byte(i), 0, 0, 0})
+		}
+
+		// Wait for the subscriber to hang up.
+		conn.Read(make([]byte, 1))
+	}()
+
+	return "tcp://" + l.Addr().String()
+}
+
+func TestBlockNotifications(t *testing.T) {
+	hashes := []string{
+		"00000000000000000c8f3a3d7d6e5d2b1c1b0a0908070605040302010000abcd",
+		"000000000000000012a1b2c3d4e5f60718293a4b5c6d7e8f9011223344556677",
+	}
+	addr := fakeZMQPublisher(t, hashes...)
+
+	n, err := DialBlockNotifications(addr, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Close()
+
+	for _, expected := range hashes {
+		h, err := n.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if h != expected {
+			t.Errorf("got block %s, expected %s", h, expected)
+		}
+	}
+
+	// Closing interrupts a wait for the next block.
+	done := make(chan error)
+	go func() {
+		_, err := n.Next()
+		done <- err
+	}()
+	n.Close()
+	if err := <-done; err == nil {
+		t.Errorf("Next returned without error after Close")
+	}
+
+	if _, err := DialBlockNotifications("ipc:///tmp/namecoind", time.Second); err == nil {
+		t.Errorf("subscribed to an IPC address")
+	}
+}
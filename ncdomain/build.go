@@ -0,0 +1,235 @@
+package ncdomain
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/namecoin/ncdns/util"
+)
+
+// A ValueBuilder builds a domain name value from individual records, as an
+// alternative to writing the JSON by hand.
+type ValueBuilder struct {
+	v map[string]interface{}
+}
+
+func NewValueBuilder() *ValueBuilder {
+	return &ValueBuilder{v: map[string]interface{}{}}
+}
+
+func appendItem(v map[string]interface{}, key string, item interface{}) {
+	items, _ := v[key].([]interface{})
+	v[key] = append(items, item)
+}
+
+// Returns the object for the given key of an object's map, creating it if
+// necessary.
+func mapItem(v map[string]interface{}, key string) map[string]interface{} {
+	m, ok := v["map"].(map[string]interface{})
+	if !ok {
+		m = map[string]interface{}{}
+		v["map"] = m
+	}
+
+	sub, ok := m[key].(map[string]interface{})
+	if !ok {
+		sub = map[string]interface{}{}
+		m[key] = sub
+	}
+	return sub
+}
+
+// Adds an IPv4 address.
+func (b *ValueBuilder) AddIP(ip string) error {
+	pip := net.ParseIP(ip)
+	if pip == nil || pip.To4() == nil {
+		return fmt.Errorf("invalid IPv4 address: %q", ip)
+	}
+
+	appendItem(b.v, "ip", pip.To4().String())
+	return nil
+}
+
+// Adds an IPv6 address.
+func (b *ValueBuilder) AddIP6(ip string) error {
+	pip := net.ParseIP(ip)
+	if pip == nil || pip.To4() != nil {
+		return fmt.Errorf("invalid IPv6 address: %q", ip)
+	}
+
+	appendItem(b.v, "ip6", pip.String())
+	return nil
+}
+
+// Adds a nameserver, which is taken to be a fully qualified name.
+func (b *ValueBuilder) AddNS(name string) error {
+	name = absoluteName(name)
+	if !util.ValidateHostName(name) {
+		return fmt.Errorf("invalid nameserver name: %q", name)
+	}
+
+	appendItem(b.v, "ns", name)
+	return nil
+}
+
+// Adds a DS record given in zone file form, e.g. "12345 8 2 AB12...".
+func (b *ValueBuilder) AddDS(ds string) error {
+	fields := strings.Fields(ds)
+	if len(fields) != 4 {
+		return fmt.Errorf("DS must have four fields (key tag, algorithm, digest type, digest): %q", ds)
+	}
+
+	var nums [3]uint64
+	for i, bits := range []int{16, 8, 8} {
+		n, err := strconv.ParseUint(fields[i], 10, bits)
+		if err != nil {
+			return fmt.Errorf("invalid DS field %q: %v", fields[i], err)
+		}
+		nums[i] = n
+	}
+
+	digest, err := hex.DecodeString(fields[3])
+	if err != nil || len(digest) == 0 {
+		return fmt.Errorf("DS digest must be hexadecimal: %q", fields[3])
+	}
+
+	appendItem(b.v, "ds", []interface{}{nums[0], nums[1], nums[2], base64.StdEncoding.EncodeToString(digest)})
+	return nil
+}
+
+// Adds a TLSA record for the given port and protocol (e.g. 443 and "tcp"),
+// under the subdomain _443._tcp.
+func (b *ValueBuilder) AddTLSA(port int, protocol string, usage, selector, matchingType uint8, data []byte) error {
+	if port <= 0 || port > 65535 {
+		return fmt.Errorf("invalid port: %d", port)
+	}
+	if protocol != "tcp" && protocol != "udp" && protocol != "sctp" {
+		return fmt.Errorf("invalid protocol: %q", protocol)
+	}
+
+	sub := mapItem(mapItem(b.v, "_"+protocol), fmt.Sprintf("_%d", port))
+	appendItem(sub, "tls", []interface{}{usage, selector, matchingType, base64.StdEncoding.EncodeToString(data)})
+	return nil
+}
+
+// Adds a subdomain. The target may be "self" to make the subdomain an alias
+// of the name itself, an IPv4 or IPv6 address for the subdomain, or another
+// name for it to be an alias of. Names containing a dot are taken to be fully
+// qualified.
+func (b *ValueBuilder) AddMap(label, target string) error {
+	if !util.ValidateOwnerLabel(label) {
+		return fmt.Errorf("invalid subdomain label: %q", label)
+	}
+
+	ip := net.ParseIP(target)
+	if ip != nil && util.HasUnderscoreLabel(label) {
+		return fmt.Errorf("subdomain %q can't have an address: labels beginning with an underscore aren't hostnames", label)
+	}
+
+	sub := mapItem(b.v, label)
+	if ip != nil {
+		if ip.To4() != nil {
+			appendItem(sub, "ip", ip.To4().String())
+		} else {
+			appendItem(sub, "ip6", ip.String())
+		}
+		return nil
+	}
+
+	alias := ""
+	if target != "self" {
+		alias = target
+		if strings.Contains(target, ".") {
+			alias = absoluteName(target)
+		}
+		if !util.ValidateRelOwnerName(alias) && !util.ValidateHostName(alias) {
+			return fmt.Errorf("invalid alias target: %q", target)
+		}
+	}
+
+	if _, ok := sub["alias"]; ok {
+		return fmt.Errorf("subdomain %q already has an alias", label)
+	}
+	sub["alias"] = alias
+	return nil
+}
+
+func absoluteName(name string) string {
+	if strings.HasSuffix(name, ".") {
+		return name
+	}
+	return name + "."
+}
+
+// Returns the value as minified JSON.
+func (b *ValueBuilder) JSON() (string, error) {
+	return minifiedJSON(b.v)
+}
+
+func minifiedJSON(v interface{}) (string, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(buf.String(), "\n"), nil
+}
+
+// The number of bytes a part of a value takes up.
+type FieldSize struct {
+	// The location of the part, e.g. "ip" or "map.www".
+	Path  string
+	Bytes int
+}
+
+// Returns how many bytes each top-level field of a JSON value, and each
+// entry of its "map" field, take up in the value's minified form, largest
+// first. These are the parts which could be moved into another name and
+// imported from there.
+func FieldSizes(value string) ([]FieldSize, error) {
+	var v map[string]interface{}
+	if err := json.Unmarshal([]byte(value), &v); err != nil {
+		return nil, err
+	}
+
+	var sizes []FieldSize
+	add := func(path, key string, item interface{}) error {
+		s, err := minifiedJSON(map[string]interface{}{key: item})
+		if err != nil {
+			return err
+		}
+		// Exclude the braces, but include the separating comma.
+		sizes = append(sizes, FieldSize{Path: path, Bytes: len(s) - 1})
+		return nil
+	}
+
+	for key, item := range v {
+		if m, ok := item.(map[string]interface{}); ok && key == "map" {
+			for label, sub := range m {
+				if err := add(parseLocation{}.mapItem(label).path, label, sub); err != nil {
+					return nil, err
+				}
+			}
+			continue
+		}
+		if err := add(key, key, item); err != nil {
+			return nil, err
+		}
+	}
+
+	sort.Slice(sizes, func(i, j int) bool {
+		if sizes[i].Bytes != sizes[j].Bytes {
+			return sizes[i].Bytes > sizes[j].Bytes
+		}
+		return sizes[i].Path < sizes[j].Path
+	})
+	return sizes, nil
+}
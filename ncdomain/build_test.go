@@ -0,0 +1,146 @@
+package ncdomain_test
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/namecoin/ncdns/ncdomain"
+)
+
+func TestValueBuilderRoundTrip(t *testing.T) {
+	b := ncdomain.NewValueBuilder()
+	for _, err := range []error{
+		b.AddIP("192.0.2.1"),
+		b.AddIP6("2001:db8::1"),
+		b.AddDS("12345 8 2 " + strings.Repeat("ab", 32)),
+		b.AddTLSA(443, "tcp", 3, 1, 1, make([]byte, 32)),
+		b.AddMap("www", "self"),
+		b.AddMap("mail", "192.0.2.25"),
+		b.AddMap("v6", "2001:db8::25"),
+		b.AddMap("blog", "example.com"),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	value, err := b.JSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	json := `{"ds":[[12345,8,2,"q6urq6urq6urq6urq6urq6urq6urq6urq6urq6urq6s="]],"ip":["192.0.2.1"],"ip6":["2001:db8::1"],` +
+		`"map":{"_tcp":{"map":{"_443":{"tls":[[3,1,1,"AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA="]]}}},` +
+		`"blog":{"alias":"example.com."},"mail":{"ip":["192.0.2.25"]},"v6":{"ip6":["2001:db8::25"]},"www":{"alias":""}}}`
+	if value != json {
+		t.Errorf("got %s", value)
+	}
+
+	v := ncdomain.ParseValue("d/example", value, nil, func(err error, isWarning bool) {
+		t.Errorf("parsing built value: %v (warning: %v)", err, isWarning)
+	})
+	if v == nil {
+		t.Fatalf("built value didn't parse")
+	}
+
+	rrs, err := v.RRsRecursive(nil, "example.bit.", "bit.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := map[string]bool{}
+	for _, rr := range rrs {
+		found[rr.String()] = true
+	}
+	expected := []string{
+		"example.bit.\t600\tIN\tDS\t12345 8 2 " + strings.ToUpper(strings.Repeat("ab", 32)),
+		"www.example.bit.\t600\tIN\tCNAME\texample.bit.",
+		"blog.example.bit.\t600\tIN\tCNAME\texample.com.",
+		"mail.example.bit.\t600\tIN\tA\t192.0.2.25",
+	}
+	if !tlsaDisabled {
+		expected = append(expected,
+			"_443._tcp.example.bit.\t600\tIN\tTLSA\t3 1 1 "+strings.ToUpper(hex.EncodeToString(make([]byte, 32))))
+	}
+	for _, rr := range expected {
+		if !found[rr] {
+			t.Errorf("missing record %q in %v", rr, rrs)
+		}
+	}
+
+	// A delegated name, which holds nothing else.
+	b = ncdomain.NewValueBuilder()
+	if err := b.AddNS("ns1.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	value, err = b.JSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != `{"ns":["ns1.example.com."]}` {
+		t.Errorf("got %s", value)
+	}
+	v = ncdomain.ParseValue("d/example", value, nil, func(err error, isWarning bool) {
+		t.Errorf("parsing built value: %v (warning: %v)", err, isWarning)
+	})
+	if rrs, _ = v.RRsRecursive(nil, "example.bit.", "bit."); len(rrs) != 1 || rrs[0].String() != "example.bit.\t600\tIN\tNS\tns1.example.com." {
+		t.Errorf("got %v", rrs)
+	}
+}
+
+func TestValueBuilderErrors(t *testing.T) {
+	b := ncdomain.NewValueBuilder()
+	for name, err := range map[string]error{
+		"IPv6 as ip":   b.AddIP("2001:db8::1"),
+		"IPv4 as ip6":  b.AddIP6("192.0.2.1"),
+		"bad ns":       b.AddNS("-bad-.example"),
+		"short DS":     b.AddDS("12345 8 2"),
+		"big key tag":  b.AddDS("123456 8 2 ab"),
+		"non-hex DS":   b.AddDS("12345 8 2 xyz"),
+		"bad port":     b.AddTLSA(0, "tcp", 3, 1, 1, nil),
+		"bad protocol": b.AddTLSA(443, "http", 3, 1, 1, nil),
+		"bad label":    b.AddMap("a.b", "self"),
+		"bad target":   b.AddMap("www", "not a name"),
+		"address at _": b.AddMap("_dmarc", "192.0.2.1"),
+	} {
+		if err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+func TestFieldSizes(t *testing.T) {
+	value := `{"ip":["192.0.2.1"],"map":{"www":{"alias":""},"_tcp":{"map":{"_443":{"tls":[[3,1,1,"AAAA"]]}}}},"ns":["ns1.example.com."]}`
+
+	sizes, err := ncdomain.FieldSizes(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []ncdomain.FieldSize{
+		{`map._tcp`, len(`"_tcp":{"map":{"_443":{"tls":[[3,1,1,"AAAA"]]}}},`)},
+		{`ns`, len(`"ns":["ns1.example.com."],`)},
+		{`ip`, len(`"ip":["192.0.2.1"],`)},
+		{`map.www`, len(`"www":{"alias":""},`)},
+	}
+	if len(sizes) != len(expected) {
+		t.Fatalf("got %+v", sizes)
+	}
+	total := 0
+	for i := range expected {
+		if sizes[i] != expected[i] {
+			t.Errorf("field %d: got %+v, expected %+v", i, sizes[i], expected[i])
+		}
+		total += sizes[i].Bytes
+	}
+
+	// Everything is accounted for except the braces of the value and of the
+	// map item, the map item's key, and the missing trailing comma.
+	if overhead := len(value) - total; overhead != len(`{"map":{}}`)-1 {
+		t.Errorf("sizes account for %d of %d bytes", total, len(value))
+	}
+
+	if _, err := ncdomain.FieldSizes(`[]`); err == nil {
+		t.Errorf("expected error for a non-object value")
+	}
+}
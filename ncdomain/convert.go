@@ -2,11 +2,13 @@ package ncdomain
 
 import "encoding/json"
 import "net"
+import "net/url"
 import "fmt"
 import "github.com/miekg/dns"
 import "encoding/base64"
 import "encoding/hex"
 import "github.com/namecoin/ncdns/util"
+import "sort"
 import "strings"
 import "strconv"
 
@@ -14,6 +16,12 @@ const depthLimit = 16
 const mergeDepthLimit = 4
 const defaultTTL = 600
 
+// ParserVersion identifies the behaviour of ParseValue. It must be incremented
+// whenever a change to the parser could produce a different Value for the same
+// input, so that anything caching parsed values keyed on their input can tell
+// stale entries apart.
+const ParserVersion = 11
+
 // Note: Name values in Value (e.g. those in Alias and Target, Services, MXs,
 // etc.) are not necessarily fully qualified and must be fully qualified before
 // being used. Non-fully-qualified names are relative to the name apex, and
@@ -41,8 +49,15 @@ type valueWithoutTLSA struct {
 	Hostmaster   string    // "hostmaster@example.com"
 	MX           []*dns.MX // header name is left blank
 	TLSA         []*dns.TLSA
+	Redirect     string            // http or https URL to which web requests for the name are redirected
+	Tor          string            // v3 onion address of an onion service alternative to the name, e.g. "xxx.onion"
+	TorPort      uint16            // port of the onion service, if given
 	Map          map[string]*Value // may contain and "*", will not contain ""
 
+	// Where each record came from, by field name (e.g. "IP"): a slice parallel
+	// to the field, or of length one for single-valued fields such as Alias.
+	Provenance map[string][]Provenance
+
 	// set if the value is at the top level (alas necessary for relname interpretation)
 	IsTopLevel bool
 }
@@ -59,6 +74,12 @@ func (v *Value) mkString(i string) string {
 	if v.Hostmaster != "" {
 		s += i + "Hostmaster: " + v.Hostmaster
 	}
+	if v.Redirect != "" {
+		s += i + "Redirect: " + v.Redirect
+	}
+	if v.Tor != "" {
+		s += i + "Onion Service: " + v.Tor
+	}
 	for _, ip := range v.IP {
 		s += i + "IPv4 Address: " + ip.String()
 	}
@@ -98,18 +119,48 @@ func (v *Value) String() string {
 }
 
 func (v *Value) RRs(out []dns.RR, suffix, apexSuffix string) ([]dns.RR, error) {
+	recs, err := v.Records(nil, suffix, apexSuffix)
+	return appendRecordRRs(out, recs), err
+}
+
+func appendRecordRRs(out []dns.RR, recs []Record) []dns.RR {
+	if cap(out)-len(out) < len(recs) {
+		out = append(make([]dns.RR, 0, len(out)+len(recs)), out...)
+	}
+	for _, r := range recs {
+		out = append(out, r.RR)
+	}
+	return out
+}
+
+// Like RRs, but also returns where each record came from.
+func (v *Value) Records(out []Record, suffix, apexSuffix string) ([]Record, error) {
+	return v.records(out, suffix, apexSuffix, false)
+}
+
+// If all is set, the records which those of higher precedence would occlude
+// are returned too.
+func (v *Value) records(out []Record, suffix, apexSuffix string, all bool) ([]Record, error) {
 	il := len(out)
 	suffix = dns.Fqdn(suffix)
 	apexSuffix = dns.Fqdn(apexSuffix)
 
+	// Make room for the usual records at once, rather than growing out for
+	// each kind.
+	if n := v.recordCount(); cap(out)-len(out) < n {
+		out = append(make([]Record, 0, len(out)+n), out...)
+	}
+
 	out, _ = v.appendNSs(out, suffix, apexSuffix)
-	if len(v.NS) == 0 {
+	if len(v.NS) == 0 || all {
 		out, _ = v.appendTranslate(out, suffix, apexSuffix)
-		if !v.HasTranslate {
+		if !v.HasTranslate || all {
 			out, _ = v.appendAlias(out, suffix, apexSuffix)
-			if !v.HasAlias {
-				out, _ = v.appendIPs(out, suffix, apexSuffix)
-				out, _ = v.appendIP6s(out, suffix, apexSuffix)
+			if !v.HasAlias || all {
+				if !util.HasUnderscoreLabel(suffix) {
+					out, _ = v.appendIPs(out, suffix, apexSuffix)
+					out, _ = v.appendIP6s(out, suffix, apexSuffix)
+				}
 				out, _ = v.appendTXTs(out, suffix, apexSuffix)
 				out, _ = v.appendMXs(out, suffix, apexSuffix)
 				out, _ = v.appendSRVs(out, suffix, apexSuffix)
@@ -121,7 +172,7 @@ func (v *Value) RRs(out []dns.RR, suffix, apexSuffix string) ([]dns.RR, error) {
 
 	xout := out[il:]
 	for i := range xout {
-		h := xout[i].Header()
+		h := xout[i].RR.Header()
 		if rrtypeHasPrefix(h.Rrtype) {
 			h.Name += suffix
 		} else {
@@ -136,149 +187,191 @@ func rrtypeHasPrefix(t uint16) bool {
 	return t == dns.TypeSRV || t == dns.TypeTLSA
 }
 
-func (v *Value) appendIPs(out []dns.RR, suffix, apexSuffix string) ([]dns.RR, error) {
-	for _, ip := range v.IP {
-		out = append(out, &dns.A{
-			Hdr: dns.RR_Header{
-				Name:   suffix,
-				Rrtype: dns.TypeA,
-				Class:  dns.ClassINET,
-				Ttl:    defaultTTL,
+// Returns the number of records v's own fields hold, other than generated
+// TLSA records.
+func (v *Value) recordCount() int {
+	n := len(v.IP) + len(v.IP6) + len(v.NS) + len(v.DS) + len(v.TXT) + len(v.SRV) + len(v.MX) + len(v.TLSA)
+	if v.HasAlias {
+		n++
+	}
+	if v.HasTranslate {
+		n++
+	}
+	return n
+}
+
+func (v *Value) appendIPs(out []Record, suffix, apexSuffix string) ([]Record, error) {
+	for i, ip := range v.IP {
+		out = append(out, Record{
+			RR: &dns.A{
+				Hdr: dns.RR_Header{
+					Name:   suffix,
+					Rrtype: dns.TypeA,
+					Class:  dns.ClassINET,
+					Ttl:    defaultTTL,
+				},
+				A: ip,
 			},
-			A: ip,
+			Provenance: v.provenance("IP", i),
 		})
 	}
 
 	return out, nil
 }
 
-func (v *Value) appendIP6s(out []dns.RR, suffix, apexSuffix string) ([]dns.RR, error) {
-	for _, ip := range v.IP6 {
-		out = append(out, &dns.AAAA{
-			Hdr: dns.RR_Header{
-				Name:   suffix,
-				Rrtype: dns.TypeAAAA,
-				Class:  dns.ClassINET,
-				Ttl:    defaultTTL,
+func (v *Value) appendIP6s(out []Record, suffix, apexSuffix string) ([]Record, error) {
+	for i, ip := range v.IP6 {
+		out = append(out, Record{
+			RR: &dns.AAAA{
+				Hdr: dns.RR_Header{
+					Name:   suffix,
+					Rrtype: dns.TypeAAAA,
+					Class:  dns.ClassINET,
+					Ttl:    defaultTTL,
+				},
+				AAAA: ip,
 			},
-			AAAA: ip,
+			Provenance: v.provenance("IP6", i),
 		})
 	}
 
 	return out, nil
 }
 
-func (v *Value) appendNSs(out []dns.RR, suffix, apexSuffix string) ([]dns.RR, error) {
-	for _, ns := range v.NS {
+func (v *Value) appendNSs(out []Record, suffix, apexSuffix string) ([]Record, error) {
+	for i, ns := range v.NS {
 		qn, ok := v.qualify(ns, suffix, apexSuffix)
 		if !ok {
 			continue
 		}
 
-		out = append(out, &dns.NS{
-			Hdr: dns.RR_Header{
-				Name:   suffix,
-				Rrtype: dns.TypeNS,
-				Class:  dns.ClassINET,
-				Ttl:    defaultTTL,
+		out = append(out, Record{
+			RR: &dns.NS{
+				Hdr: dns.RR_Header{
+					Name:   suffix,
+					Rrtype: dns.TypeNS,
+					Class:  dns.ClassINET,
+					Ttl:    defaultTTL,
+				},
+				Ns: qn,
 			},
-			Ns: qn,
+			Provenance: v.provenance("NS", i),
 		})
 	}
 
 	return out, nil
 }
 
-func (v *Value) appendTXTs(out []dns.RR, suffix, apexSuffix string) ([]dns.RR, error) {
-	for _, txt := range v.TXT {
-		out = append(out, &dns.TXT{
-			Hdr: dns.RR_Header{
-				Name:   suffix,
-				Rrtype: dns.TypeTXT,
-				Class:  dns.ClassINET,
-				Ttl:    defaultTTL,
+func (v *Value) appendTXTs(out []Record, suffix, apexSuffix string) ([]Record, error) {
+	for i, txt := range v.TXT {
+		out = append(out, Record{
+			RR: &dns.TXT{
+				Hdr: dns.RR_Header{
+					Name:   suffix,
+					Rrtype: dns.TypeTXT,
+					Class:  dns.ClassINET,
+					Ttl:    defaultTTL,
+				},
+				Txt: txt,
 			},
-			Txt: txt,
+			Provenance: v.provenance("TXT", i),
 		})
 	}
 
 	return out, nil
 }
 
-func (v *Value) appendDSs(out []dns.RR, suffix, apexSuffix string) ([]dns.RR, error) {
-	for _, ds := range v.DS {
-		out = append(out, ds)
+func (v *Value) appendDSs(out []Record, suffix, apexSuffix string) ([]Record, error) {
+	// RRs rewrites the owner names of the records it returns, so return
+	// copies, leaving the Value intact for reuse.
+	for i, ds := range v.DS {
+		out = append(out, Record{
+			RR:         dns.Copy(ds),
+			Provenance: v.provenance("DS", i),
+		})
 	}
 
 	return out, nil
 }
 
-func (v *Value) appendMXs(out []dns.RR, suffix, apexSuffix string) ([]dns.RR, error) {
-	for _, mx := range v.MX {
-		out = append(out, mx)
+func (v *Value) appendMXs(out []Record, suffix, apexSuffix string) ([]Record, error) {
+	for i, mx := range v.MX {
+		out = append(out, Record{
+			RR:         dns.Copy(mx),
+			Provenance: v.provenance("MX", i),
+		})
 	}
 
 	return out, nil
 }
 
-func (v *Value) appendSRVs(out []dns.RR, suffix, apexSuffix string) ([]dns.RR, error) {
-	for _, svc := range v.SRV {
+func (v *Value) appendSRVs(out []Record, suffix, apexSuffix string) ([]Record, error) {
+	for i, svc := range v.SRV {
 		qn, ok := v.qualify(svc.Target, suffix, apexSuffix)
 		if !ok {
 			continue
 		}
 
-		out = append(out, &dns.SRV{
-			Hdr: dns.RR_Header{
-				Name:   "",
-				Rrtype: dns.TypeSRV,
-				Class:  dns.ClassINET,
-				Ttl:    defaultTTL,
+		out = append(out, Record{
+			RR: &dns.SRV{
+				Hdr: dns.RR_Header{
+					Name:   "",
+					Rrtype: dns.TypeSRV,
+					Class:  dns.ClassINET,
+					Ttl:    defaultTTL,
+				},
+				Priority: svc.Priority,
+				Weight:   svc.Weight,
+				Port:     svc.Port,
+				Target:   qn,
 			},
-			Priority: svc.Priority,
-			Weight:   svc.Weight,
-			Port:     svc.Port,
-			Target:   qn,
+			Provenance: v.provenance("SRV", i),
 		})
 	}
 
 	return out, nil
 }
 
-func (v *Value) appendAlias(out []dns.RR, suffix, apexSuffix string) ([]dns.RR, error) {
+func (v *Value) appendAlias(out []Record, suffix, apexSuffix string) ([]Record, error) {
 	if v.HasAlias {
-		qn, ok := v.qualify(v.Alias, suffix, apexSuffix)
+		qn, ok := v.qualifyOwner(v.Alias, suffix, apexSuffix)
 		if !ok {
 			return out, fmt.Errorf("bad alias")
 		}
-		out = append(out, &dns.CNAME{
-			Hdr: dns.RR_Header{
-				Name:   suffix,
-				Rrtype: dns.TypeCNAME,
-				Class:  dns.ClassINET,
-				Ttl:    defaultTTL,
+		out = append(out, Record{
+			RR: &dns.CNAME{
+				Hdr: dns.RR_Header{
+					Name:   suffix,
+					Rrtype: dns.TypeCNAME,
+					Class:  dns.ClassINET,
+					Ttl:    defaultTTL,
+				},
+				Target: qn,
 			},
-			Target: qn,
+			Provenance: v.provenance("Alias", 0),
 		})
 	}
 
 	return out, nil
 }
 
-func (v *Value) appendTranslate(out []dns.RR, suffix, apexSuffix string) ([]dns.RR, error) {
+func (v *Value) appendTranslate(out []Record, suffix, apexSuffix string) ([]Record, error) {
 	if v.HasTranslate {
-		qn, ok := v.qualify(v.Translate, suffix, apexSuffix)
+		qn, ok := v.qualifyOwner(v.Translate, suffix, apexSuffix)
 		if !ok {
 			return out, fmt.Errorf("bad translate")
 		}
-		out = append(out, &dns.DNAME{
-			Hdr: dns.RR_Header{
-				Name:   suffix,
-				Rrtype: dns.TypeDNAME,
-				Class:  dns.ClassINET,
-				Ttl:    defaultTTL,
+		out = append(out, Record{
+			RR: &dns.DNAME{
+				Hdr: dns.RR_Header{
+					Name:   suffix,
+					Rrtype: dns.TypeDNAME,
+					Class:  dns.ClassINET,
+					Ttl:    defaultTTL,
+				},
+				Target: qn,
 			},
-			Target: qn,
+			Provenance: v.provenance("Translate", 0),
 		})
 	}
 
@@ -286,17 +379,44 @@ func (v *Value) appendTranslate(out []dns.RR, suffix, apexSuffix string) ([]dns.
 }
 
 func (v *Value) RRsRecursive(out []dns.RR, suffix, apexSuffix string) ([]dns.RR, error) {
-	out, err := v.RRs(out, suffix, apexSuffix)
+	recs, err := v.RecordsRecursive(nil, suffix, apexSuffix)
+	if err != nil {
+		return nil, err
+	}
+
+	return appendRecordRRs(out, recs), nil
+}
+
+// Like RRsRecursive, but also returns where each record came from.
+func (v *Value) RecordsRecursive(out []Record, suffix, apexSuffix string) ([]Record, error) {
+	return v.recordsRecursive(out, suffix, apexSuffix, false)
+}
+
+// Like RecordsRecursive, but every record given is returned, including those
+// which records of higher precedence at the same name occlude (e.g. addresses
+// alongside an alias) and those beneath a delegation. This shows what a value
+// gave before it was normalized.
+func (v *Value) AllRecordsRecursive(out []Record, suffix, apexSuffix string) ([]Record, error) {
+	return v.recordsRecursive(out, suffix, apexSuffix, true)
+}
+
+func (v *Value) recordsRecursive(out []Record, suffix, apexSuffix string, all bool) ([]Record, error) {
+	out, err := v.records(out, suffix, apexSuffix, all)
 	if err != nil {
 		return nil, err
 	}
 
+	// Nothing below a delegation is ours to publish, but for glue.
+	if len(v.NS) > 0 && !all {
+		return v.appendGlue(out, suffix, apexSuffix), nil
+	}
+
 	for mk, mv := range v.Map {
 		if !util.ValidateOwnerLabel(mk) && mk != "" && mk != "*" {
 			continue
 		}
 
-		out, err = mv.RRsRecursive(out, mk+"."+suffix, apexSuffix)
+		out, err = mv.recordsRecursive(out, mk+"."+suffix, apexSuffix, all)
 		//if err != nil {
 		//	return nil, err
 		//}
@@ -305,6 +425,32 @@ func (v *Value) RRsRecursive(out []dns.RR, suffix, apexSuffix string) ([]dns.RR,
 	return out, nil
 }
 
+// Appends glue for v, which is delegated: the addresses of those of its
+// nameservers which are at or below v itself, taken from v or the subdomain of
+// v they name. Without them, the nameservers couldn't be found, since queries
+// for their addresses would be referred to the nameservers themselves.
+func (v *Value) appendGlue(out []Record, suffix, apexSuffix string) []Record {
+	seen := map[string]bool{}
+	for _, ns := range v.NS {
+		target, ok := v.qualify(ns, suffix, apexSuffix)
+		if !ok || !dns.IsSubDomain(suffix, target) || seen[strings.ToLower(target)] {
+			continue
+		}
+		seen[strings.ToLower(target)] = true
+
+		rel := strings.TrimSuffix(strings.TrimSuffix(strings.ToLower(target), strings.ToLower(suffix)), ".")
+		sub, err := v.findSubdomainByName(rel)
+		if err != nil {
+			continue
+		}
+
+		out, _ = sub.appendIPs(out, target, apexSuffix)
+		out, _ = sub.appendIP6s(out, target, apexSuffix)
+	}
+
+	return out
+}
+
 func (v *Value) findSubdomainByName(subdomain string) (*Value, error) {
 	if subdomain == "" {
 		return v, nil
@@ -338,21 +484,169 @@ func (ef ErrorFunc) addWarning(err error) {
 	}
 }
 
+// The namespaces whose names may be referenced by "import" and "delegate"
+// statements unless ParseOptions says otherwise: domain names themselves, and
+// the "dd/" namespace set aside by the domain name specification for data to
+// be imported by domain names.
+var DefaultImportNamespaces = []string{"d", "dd"}
+
+// Options for ParseValueWithOptions.
+type ParseOptions struct {
+	// Namespaces (e.g. "d", without the trailing slash) whose names may be
+	// referenced by "import" and "delegate" statements. References to names
+	// in other namespaces are ignored with a warning. If nil,
+	// DefaultImportNamespaces is used.
+	ImportNamespaces []string
+
+	// The form of the TLSA records generated from dehydrated certificates.
+	// If nil, DefaultGeneratedTLSA is used.
+	GeneratedTLSA *TLSAForm
+
+	// If set, fields of the original domain name specification which have
+	// since been replaced are ignored rather than translated.
+	IgnoreLegacyFields bool
+
+	// If set, onion services given by "tor" fields aren't published as
+	// records.
+	OmitTorRecords bool
+
+	// The DNSSEC algorithms which DS records may name. A DS record naming
+	// an algorithm a resolver doesn't implement makes the delegation bogus
+	// for it, so records naming other algorithms are ignored with a
+	// warning. If nil, DefaultDSAlgorithms is used.
+	DSAlgorithms []uint8
+
+	// If set, DS records naming algorithms not in DSAlgorithms are
+	// published anyway, still with a warning.
+	AllowUnknownDSAlgorithms bool
+
+	// If set, called with the value once it has been parsed, before
+	// records given more than once or conflicting with one another are
+	// dealt with (see normalize), e.g. to show what they were. The value
+	// must not be modified or kept.
+	Unnormalized func(v *Value)
+
+	// If MaxValueSize is set, values larger than ValueSizeWarnPercent
+	// percent of it are warned about with a *ValueSizeWarning, as their
+	// owners may find there's no room left to add to them.
+	MaxValueSize         int
+	ValueSizeWarnPercent int
+
+	// If set, called to obtain the JSON at each URL referenced by an
+	// "include_url" statement, which is merged like an import, with the URL
+	// as the source of its records. It's for private deployments, and must
+	// itself refuse URLs which aren't allowed, since anyone can put any URL
+	// in a value on the public chain. If nil, "include_url" statements are
+	// ignored with a warning.
+	FetchURL func(url string) (string, error)
+}
+
+// A warning that a value is nearly as large as the largest value which may be
+// stored in a name, so that an update adding records to it may be too large
+// to be accepted.
+type ValueSizeWarning struct {
+	Size  int // of the value, in bytes
+	Limit int // the largest size allowed
+}
+
+func (w *ValueSizeWarning) Error() string {
+	return fmt.Sprintf("value is %d bytes, %d%% of the %d-byte limit; an update adding to it may not fit",
+		w.Size, w.Size*100/w.Limit, w.Limit)
+}
+
+// Returns a *ValueSizeWarning if a value of the given size is larger than
+// percent percent of limit, or nil.
+func checkValueSize(size, limit, percent int) error {
+	if limit <= 0 || size*100 <= limit*percent {
+		return nil
+	}
+	return &ValueSizeWarning{Size: size, Limit: limit}
+}
+
+// The usage, selector and matching type of a TLSA record.
+type TLSAForm struct {
+	Usage, Selector, MatchingType uint8
+}
+
+// By default, TLSA records generated from dehydrated certificates contain the
+// whole certificate, as needed by e.g. the Firefox override sync.
+var DefaultGeneratedTLSA = TLSAForm{Usage: 3, Selector: 0, MatchingType: 0}
+
+// Parses a TLSA form given as three numbers, e.g. "3 1 1".
+func ParseTLSAForm(s string) (*TLSAForm, error) {
+	var f TLSAForm
+	_, err := fmt.Sscanf(s, "%d %d %d", &f.Usage, &f.Selector, &f.MatchingType)
+	if err != nil || f.Usage > 3 || f.Selector > 1 || f.MatchingType > 2 {
+		return nil, fmt.Errorf("malformed TLSA form %q: must be usage, selector and matching type, e.g. \"3 1 1\"", s)
+	}
+
+	return &f, nil
+}
+
+// By default, DS records may name the algorithms which RFC 8624 says
+// validating resolvers must or should implement, and Ed448. The deprecated
+// RSAMD5 (1), DSA (3) and DSA-NSEC3-SHA1 (6) aren't among them.
+var DefaultDSAlgorithms = []uint8{
+	dns.RSASHA1, dns.RSASHA1NSEC3SHA1, dns.RSASHA256, dns.RSASHA512,
+	dns.ECDSAP256SHA256, dns.ECDSAP384SHA384, dns.ED25519, dns.ED448,
+}
+
+// Parses a comma-separated list of DNSSEC algorithms, each given by number or
+// mnemonic, e.g. "8,13" or "RSASHA256,ECDSAP256SHA256".
+func ParseDSAlgorithms(s string) ([]uint8, error) {
+	algs := []uint8{}
+	for _, a := range strings.Split(s, ",") {
+		a = strings.TrimSpace(a)
+		if a == "" {
+			continue
+		}
+		if n, err := strconv.ParseUint(a, 10, 8); err == nil {
+			algs = append(algs, uint8(n))
+		} else if n, ok := dns.StringToAlgorithm[strings.ToUpper(a)]; ok {
+			algs = append(algs, n)
+		} else {
+			return nil, fmt.Errorf("unknown DNSSEC algorithm %q", a)
+		}
+	}
+
+	return algs, nil
+}
+
 // Call to convert a given JSON value to a parsed Namecoin domain value.
 //
 // If ResolveFunc is given, it will be called to obtain the values for domains
 // referenced by "import" and "delegate" statements. The name passed is in
-// Namecoin form (e.g. "d/example"). The JSON value or an error should be
-// returned. If no ResolveFunc is passed, "import" and "delegate" statements
-// always fail.
+// Namecoin form (e.g. "d/example"); a reference given as a bare name
+// ("example") is taken to mean the domain name "d/example". The JSON value or
+// an error should be returned. If no ResolveFunc is passed, "import" and
+// "delegate" statements always fail.
 //
 // Returns nil if the JSON could not be parsed. For all other errors processing
 // continues and recovers as much as possible; errFunc is called for all errors
 // and warnings if specified.
+//
+// Imports are merged in the order they are listed, each before the fields of
+// the object importing it, and map items in the order of their keys, so the
+// result doesn't depend on the order in which the names imported are fetched.
+// Once imports and maps have been merged, records given more than once are
+// kept only once, records which the name gives itself win over conflicting
+// ones it imports, and other conflicts at a name are resolved in a fixed order
+// of precedence (see normalize), with a warning saying where each of the
+// records came from.
 func ParseValue(name, jsonValue string, resolve ResolveFunc, errFunc ErrorFunc) (value *Value) {
+	return ParseValueWithOptions(name, jsonValue, resolve, errFunc, nil)
+}
+
+// Like ParseValue, but with options. opts may be nil.
+func ParseValueWithOptions(name, jsonValue string, resolve ResolveFunc, errFunc ErrorFunc, opts *ParseOptions) (value *Value) {
 	var rv interface{}
 	v := &Value{}
 
+	if opts != nil {
+		err := checkValueSize(len(jsonValue), opts.MaxValueSize, opts.ValueSizeWarnPercent)
+		parseLocation{source: name}.wrapErrorFunc(errFunc).addWarning(err)
+	}
+
 	err := json.Unmarshal([]byte(jsonValue), &rv)
 	if err != nil {
 		errFunc.add(err)
@@ -365,17 +659,59 @@ func ParseValue(name, jsonValue string, resolve ResolveFunc, errFunc ErrorFunc)
 		}
 	}
 
+	namespaces := DefaultImportNamespaces
+	if opts != nil && opts.ImportNamespaces != nil {
+		namespaces = opts.ImportNamespaces
+	}
+	var fetchURL func(string) (string, error)
+	if opts != nil {
+		fetchURL = opts.FetchURL
+	}
+	resolve = validatingResolveFunc(resolve, namespaces, fetchURL)
+
 	mergedNames := map[string]struct{}{}
 	mergedNames[name] = struct{}{}
 
-	parse(rv, v, resolve, errFunc, 0, 0, "", "", mergedNames)
+	legacy := opts == nil || !opts.IgnoreLegacyFields
+	parse(rv, v, resolve, errFunc, 0, 0, "", "", mergedNames, legacy, parseLocation{source: name})
 	v.IsTopLevel = true
+	if opts != nil && opts.Unnormalized != nil {
+		opts.Unnormalized(v)
+	}
+	v.normalize(errFunc, parseLocation{source: name})
+
+	dsAlgorithms := DefaultDSAlgorithms
+	if opts != nil && opts.DSAlgorithms != nil {
+		dsAlgorithms = opts.DSAlgorithms
+	}
+	v.checkDS(dsAlgorithms, opts != nil && opts.AllowUnknownDSAlgorithms, errFunc, parseLocation{source: name})
+
+	// Only the values of names under d/ are served as domains, and so have
+	// delegations which need glue.
+	if basename, err := util.NamecoinKeyToBasename(name); err == nil {
+		fqdn := basename + ".bit."
+		v.checkGlue(fqdn, fqdn, errFunc, parseLocation{source: name})
+	}
+
+	tlsaForm := DefaultGeneratedTLSA
+	if opts != nil && opts.GeneratedTLSA != nil {
+		tlsaForm = *opts.GeneratedTLSA
+	}
+	v.setGeneratedTLSA(tlsaForm)
+
+	if opts == nil || !opts.OmitTorRecords {
+		v.addTorRecords()
+	}
 
 	value = v
 	return
 }
 
-func parse(rv interface{}, v *Value, resolve ResolveFunc, errFunc ErrorFunc, depth, mergeDepth int, subdomain, relname string, mergedNames map[string]struct{}) {
+// loc identifies the object being parsed, and is recorded as the provenance of
+// the records found in it.
+func parse(rv interface{}, v *Value, resolve ResolveFunc, errFunc ErrorFunc, depth, mergeDepth int, subdomain, relname string, mergedNames map[string]struct{}, legacy bool, loc parseLocation) {
+	errFunc = loc.wrapErrorFunc(errFunc)
+
 	rvm, ok := rv.(map[string]interface{})
 	if !ok {
 		errFunc.add(fmt.Errorf("value is not an object"))
@@ -394,28 +730,34 @@ func parse(rv interface{}, v *Value, resolve ResolveFunc, errFunc ErrorFunc, dep
 		v = &Value{}
 	}
 
-	ok, _ = parseDelegate(rvm, v, resolve, errFunc, depth, mergeDepth, relname, mergedNames)
+	ok, _ = parseDelegate(rvm, v, resolve, errFunc, depth, mergeDepth, relname, mergedNames, legacy)
 	if ok {
 		return
 	}
 
-	_ = parseImport(rvm, v, resolve, errFunc, depth, mergeDepth, relname, mergedNames)
+	_ = parseImport(rvm, v, resolve, errFunc, depth, mergeDepth, relname, mergedNames, legacy)
+	parseIncludeURL(rvm, v, resolve, errFunc, depth, mergeDepth, relname, mergedNames, legacy)
 	if ip, ok := rvm["ip"]; ok {
-		parseIP(rvm, v, errFunc, ip, false)
+		parseIP(rvm, v, errFunc, ip, false, loc)
 	}
 	if ip6, ok := rvm["ip6"]; ok {
-		parseIP(rvm, v, errFunc, ip6, true)
-	}
-	parseNS(rvm, v, errFunc, relname)
-	parseAlias(rvm, v, errFunc, relname)
-	parseTranslate(rvm, v, errFunc, relname)
-	parseHostmaster(rvm, v, errFunc)
-	parseDS(rvm, v, errFunc)
-	parseTXT(rvm, v, errFunc)
-	parseSRV(rvm, v, errFunc, relname)
-	parseMX(rvm, v, errFunc, relname)
-	parseTLSA(rvm, v, errFunc)
-	parseMap(rvm, v, resolve, errFunc, depth, mergeDepth, relname)
+		parseIP(rvm, v, errFunc, ip6, true, loc)
+	}
+	parseNS(rvm, v, errFunc, relname, loc)
+	parseAlias(rvm, v, errFunc, relname, loc)
+	parseTranslate(rvm, v, errFunc, relname, loc)
+	parseHostmaster(rvm, v, errFunc, loc)
+	parseRedirect(rvm, v, errFunc, loc)
+	parseDS(rvm, v, errFunc, loc)
+	parseTXT(rvm, v, errFunc, loc)
+	parseSRV(rvm, v, errFunc, relname, loc)
+	parseMX(rvm, v, errFunc, relname, loc)
+	parseTor(rvm, v, errFunc, loc)
+	parseTLSA(rvm, v, errFunc, loc)
+	if legacy {
+		parseLegacyFields(rvm, v, errFunc, depth, loc)
+	}
+	parseMap(rvm, v, resolve, errFunc, depth, mergeDepth, relname, legacy, loc)
 	v.moveEmptyMapItems()
 
 	if subdomain != "" {
@@ -452,6 +794,7 @@ func (v *Value) qualifyIntl(name, suffix, apexSuffix string) string {
 	return name + "." + suffix
 }
 
+// Qualifies the name of a host, as for the targets of NS, MX and SRV records.
 func (v *Value) qualify(name, suffix, apexSuffix string) (string, bool) {
 	s := v.qualifyIntl(name, suffix, apexSuffix)
 	if !util.ValidateHostName(s) {
@@ -461,7 +804,18 @@ func (v *Value) qualify(name, suffix, apexSuffix string) (string, bool) {
 	return s, true
 }
 
-func parseMerge(rv map[string]interface{}, mergeValue string, v *Value, resolve ResolveFunc, errFunc ErrorFunc, depth, mergeDepth int, subdomain, relname string, mergedNames map[string]struct{}) error {
+// Qualifies any owner name, as for the targets of CNAME and DNAME records.
+// Unlike hostnames, these may have labels such as "_acme-challenge".
+func (v *Value) qualifyOwner(name, suffix, apexSuffix string) (string, bool) {
+	s := v.qualifyIntl(name, suffix, apexSuffix)
+	if !util.ValidateOwnerName(s) {
+		return "", false
+	}
+
+	return s, true
+}
+
+func parseMerge(rv map[string]interface{}, mergeValue string, v *Value, resolve ResolveFunc, errFunc ErrorFunc, depth, mergeDepth int, subdomain, relname string, mergedNames map[string]struct{}, legacy bool, loc parseLocation) error {
 	var rv2 interface{}
 
 	if mergeDepth > mergeDepthLimit {
@@ -477,37 +831,43 @@ func parseMerge(rv map[string]interface{}, mergeValue string, v *Value, resolve
 		return err
 	}
 
-	parse(rv2, v, resolve, errFunc, depth, mergeDepth, subdomain, relname, mergedNames)
+	parse(rv2, v, resolve, errFunc, depth, mergeDepth, subdomain, relname, mergedNames, legacy, loc)
 	return nil
 }
 
-func parseIP(rv map[string]interface{}, v *Value, errFunc ErrorFunc, ipi interface{}, ipv6 bool) {
+func parseIP(rv map[string]interface{}, v *Value, errFunc ErrorFunc, ipi interface{}, ipv6 bool, loc parseLocation) {
+	key, field := "ip", "IP"
 	if ipv6 {
 		v.IP6 = nil
+		key, field = "ip6", "IP6"
 	} else {
 		v.IP = nil
 	}
+	v.resetProvenance(field)
 
 	if ipi == nil {
 		return
 	}
 
-	if ipa, ok := ipi.([]interface{}); ok {
-		for _, ip := range ipa {
-			if ips, ok := ip.(string); ok {
-				addIP(rv, v, errFunc, ips, ipv6)
+	// "ip" and "ip6" accept the same shapes and report the same problems.
+	switch ipi := ipi.(type) {
+	case []interface{}:
+		for i, ip := range ipi {
+			ips, ok := ip.(string)
+			if !ok {
+				errFunc.addWarning(fmt.Errorf("ignoring %s item %d: not a string", key, i))
+				continue
 			}
+			addIP(rv, v, errFunc, ips, ipv6, loc.item(key, i))
 		}
-
-		return
-	}
-
-	if ip, ok := ipi.(string); ok {
-		addIP(rv, v, errFunc, ip, ipv6)
+	case string:
+		addIP(rv, v, errFunc, ipi, ipv6, loc.field(key))
+	default:
+		errFunc.addWarning(fmt.Errorf("ignoring %s field: not a string or array", key))
 	}
 }
 
-func addIP(rv map[string]interface{}, v *Value, errFunc ErrorFunc, ips string, ipv6 bool) {
+func addIP(rv map[string]interface{}, v *Value, errFunc ErrorFunc, ips string, ipv6 bool, prov Provenance) {
 	pip := net.ParseIP(ips)
 	if pip == nil || (pip.To4() == nil) != ipv6 {
 		errFunc.add(fmt.Errorf("malformed IP: %s", ips))
@@ -516,15 +876,19 @@ func addIP(rv map[string]interface{}, v *Value, errFunc ErrorFunc, ips string, i
 
 	if ipv6 {
 		v.IP6 = append(v.IP6, pip)
+		v.addProvenance("IP6", prov)
 	} else {
 		v.IP = append(v.IP, pip)
+		v.addProvenance("IP", prov)
 	}
 }
 
-func parseNS(rv map[string]interface{}, v *Value, errFunc ErrorFunc, relname string) {
+func parseNS(rv map[string]interface{}, v *Value, errFunc ErrorFunc, relname string, loc parseLocation) {
 	// "dns" takes precedence
+	key := "ns"
 	if dns, ok := rv["dns"]; ok && dns != nil {
 		rv["ns"] = dns
+		key = "dns"
 	}
 
 	ns, ok := rv["ns"]
@@ -533,6 +897,7 @@ func parseNS(rv map[string]interface{}, v *Value, errFunc ErrorFunc, relname str
 	}
 
 	v.NS = nil
+	v.resetProvenance("NS")
 
 	if _, ok := rv["_nsSet"]; !ok {
 		rv["_nsSet"] = map[string]struct{}{}
@@ -540,34 +905,35 @@ func parseNS(rv map[string]interface{}, v *Value, errFunc ErrorFunc, relname str
 
 	switch ns.(type) {
 	case []interface{}:
-		for _, si := range ns.([]interface{}) {
+		for i, si := range ns.([]interface{}) {
 			s, ok := si.(string)
 			if !ok {
 				continue
 			}
-			addNS(rv, v, errFunc, s, relname)
+			addNS(rv, v, errFunc, s, relname, loc.item(key, i))
 		}
 		return
 	case string:
 		s := ns.(string)
-		addNS(rv, v, errFunc, s, relname)
+		addNS(rv, v, errFunc, s, relname, loc.field(key))
 		return
 	default:
 		errFunc.add(fmt.Errorf("unknown NS field format"))
 	}
 }
 
-func addNS(rv map[string]interface{}, v *Value, errFunc ErrorFunc, s, relname string) {
+func addNS(rv map[string]interface{}, v *Value, errFunc ErrorFunc, s, relname string, prov Provenance) {
 	if !util.ValidateOwnerName(s) {
 		errFunc.add(fmt.Errorf("malformed domain name in NS field"))
 	}
 	if _, ok := (rv["_nsSet"].(map[string]struct{}))[s]; !ok {
 		v.NS = append(v.NS, s)
+		v.addProvenance("NS", prov)
 		(rv["_nsSet"].(map[string]struct{}))[s] = struct{}{}
 	}
 }
 
-func parseAlias(rv map[string]interface{}, v *Value, errFunc ErrorFunc, relname string) {
+func parseAlias(rv map[string]interface{}, v *Value, errFunc ErrorFunc, relname string, loc parseLocation) {
 	alias, ok := rv["alias"]
 	if !ok {
 		return
@@ -576,6 +942,7 @@ func parseAlias(rv map[string]interface{}, v *Value, errFunc ErrorFunc, relname
 	if alias == nil {
 		v.Alias = ""
 		v.HasAlias = false
+		v.resetProvenance("Alias")
 		return
 	}
 
@@ -585,15 +952,18 @@ func parseAlias(rv map[string]interface{}, v *Value, errFunc ErrorFunc, relname
 			return
 		}
 
+		prov := loc.field("alias")
+		v.warnReplaced(errFunc, "alias", "Alias", v.HasAlias && v.Alias != s, prov)
 		v.Alias = s
 		v.HasAlias = true
+		v.setProvenance("Alias", prov)
 		return
 	}
 
 	errFunc.add(fmt.Errorf("unknown alias field format"))
 }
 
-func parseTranslate(rv map[string]interface{}, v *Value, errFunc ErrorFunc, relname string) {
+func parseTranslate(rv map[string]interface{}, v *Value, errFunc ErrorFunc, relname string, loc parseLocation) {
 	translate, ok := rv["translate"]
 	if !ok {
 		return
@@ -602,6 +972,7 @@ func parseTranslate(rv map[string]interface{}, v *Value, errFunc ErrorFunc, reln
 	if translate == nil {
 		v.Translate = ""
 		v.HasTranslate = false
+		v.resetProvenance("Translate")
 		return
 	}
 
@@ -610,8 +981,11 @@ func parseTranslate(rv map[string]interface{}, v *Value, errFunc ErrorFunc, reln
 			errFunc.add(fmt.Errorf("malformed translate name"))
 			return
 		}
+		prov := loc.field("translate")
+		v.warnReplaced(errFunc, "translate", "Translate", v.HasTranslate && v.Translate != s, prov)
 		v.Translate = s
 		v.HasTranslate = true
+		v.setProvenance("Translate", prov)
 		return
 	}
 
@@ -636,7 +1010,7 @@ func isAllString(x []interface{}) bool {
 	return true
 }
 
-func parseImportImpl(rv map[string]interface{}, val *Value, resolve ResolveFunc, errFunc ErrorFunc, depth, mergeDepth int, relname string, mergedNames map[string]struct{}, delegate bool) (bool, error) {
+func parseImportImpl(rv map[string]interface{}, val *Value, resolve ResolveFunc, errFunc ErrorFunc, depth, mergeDepth int, relname string, mergedNames map[string]struct{}, legacy, delegate bool) (bool, error) {
 	var err error
 	succeeded := false
 	xname := "import"
@@ -672,6 +1046,7 @@ func parseImportImpl(rv map[string]interface{}, val *Value, resolve ResolveFunc,
 
 				subs := ""
 				if k, ok := v[0].(string); ok {
+					k = normalizeImportName(k)
 					if len(v) > 1 {
 						if sub, ok := v[1].(string); ok {
 							subs = sub
@@ -687,12 +1062,15 @@ func parseImportImpl(rv map[string]interface{}, val *Value, resolve ResolveFunc,
 					var dv string
 					dv, err = resolve(k)
 					if err != nil {
+						if _, ok := err.(*importRejectedError); ok {
+							errFunc.addWarning(err)
+						}
 						continue
 					}
 
 					mergedNames[k] = struct{}{}
 
-					err = parseMerge(rv, dv, val, resolve, errFunc, depth, mergeDepth+1, subs, relname, mergedNames)
+					err = parseMerge(rv, dv, val, resolve, errFunc, depth, mergeDepth+1, subs, relname, mergedNames, legacy, parseLocation{source: k})
 					if err != nil {
 						errFunc.add(err)
 						continue
@@ -717,16 +1095,156 @@ func parseImportImpl(rv map[string]interface{}, val *Value, resolve ResolveFunc,
 	return succeeded, err
 }
 
-func parseImport(rv map[string]interface{}, v *Value, resolve ResolveFunc, errFunc ErrorFunc, depth, mergeDepth int, relname string, mergedNames map[string]struct{}) error {
-	_, err := parseImportImpl(rv, v, resolve, errFunc, depth, mergeDepth, relname, mergedNames, false)
+// A bare name in an import or delegate statement is shorthand for a domain
+// name.
+func normalizeImportName(name string) string {
+	if !strings.Contains(name, "/") {
+		return "d/" + name
+	}
+
+	return name
+}
+
+// Namecoin names may be up to 255 bytes.
+const maxNameLength = 255
+
+// Checks that a name referenced by an import or delegate statement is a valid
+// name in one of the given namespaces.
+func validateImportName(name string, namespaces []string) error {
+	parts := strings.SplitN(name, "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" || len(name) > maxNameLength {
+		return fmt.Errorf("malformed name")
+	}
+
+	allowed := false
+	for _, ns := range namespaces {
+		if parts[0] == ns {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		return fmt.Errorf("namespace %q may not be imported from", parts[0])
+	}
+
+	if parts[0] == "d" {
+		if _, err := util.NamecoinKeyToBasename(name); err != nil {
+			return err
+		}
+		return nil
+	}
+
+	for _, c := range []byte(parts[1]) {
+		if c <= ' ' || c >= 0x7f {
+			return fmt.Errorf("malformed name")
+		}
+	}
+
+	return nil
+}
+
+// Returned by the ResolveFunc for a name which may not be imported. Unlike
+// other resolution errors, it is reported as a warning.
+type importRejectedError struct {
+	name string
+	err  error
+}
+
+func (e *importRejectedError) Error() string {
+	return fmt.Sprintf("not importing %q: %v", e.name, e.err)
+}
+
+// Wraps resolve so that references to invalid names, or names outside the
+// allowed namespaces, are rejected without being resolved. The URLs of
+// "include_url" statements are passed to fetchURL instead, and rejected if
+// it's nil; failures to fetch them are reported as warnings too, as they
+// aren't the value's fault.
+func validatingResolveFunc(resolve ResolveFunc, namespaces []string, fetchURL func(string) (string, error)) ResolveFunc {
+	return func(name string) (string, error) {
+		if isIncludeURL(name) {
+			if fetchURL == nil {
+				return "", &importRejectedError{name: name, err: fmt.Errorf("include_url isn't enabled")}
+			}
+			v, err := fetchURL(name)
+			if err != nil {
+				return "", &importRejectedError{name: name, err: err}
+			}
+			return v, nil
+		}
+
+		if err := validateImportName(name, namespaces); err != nil {
+			return "", &importRejectedError{name: name, err: err}
+		}
+
+		return resolve(name)
+	}
+}
+
+func parseImport(rv map[string]interface{}, v *Value, resolve ResolveFunc, errFunc ErrorFunc, depth, mergeDepth int, relname string, mergedNames map[string]struct{}, legacy bool) error {
+	_, err := parseImportImpl(rv, v, resolve, errFunc, depth, mergeDepth, relname, mergedNames, legacy, false)
 	return err
 }
 
-func parseDelegate(rv map[string]interface{}, v *Value, resolve ResolveFunc, errFunc ErrorFunc, depth, mergeDepth int, relname string, mergedNames map[string]struct{}) (bool, error) {
-	return parseImportImpl(rv, v, resolve, errFunc, depth, mergeDepth, relname, mergedNames, true)
+// Whether a reference is the URL of an "include_url" statement rather than a
+// Namecoin name, which can't contain "://" in the namespaces imported from.
+func isIncludeURL(ref string) bool {
+	return strings.HasPrefix(ref, "https://") || strings.HasPrefix(ref, "http://")
 }
 
-func parseHostmaster(rv map[string]interface{}, v *Value, errFunc ErrorFunc) {
+// Merges the JSON at the URL, or each of the array of URLs, given by the
+// "include_url" field, as an import of a name would be.
+func parseIncludeURL(rv map[string]interface{}, v *Value, resolve ResolveFunc, errFunc ErrorFunc, depth, mergeDepth int, relname string, mergedNames map[string]struct{}, legacy bool) {
+	src, ok := rv["include_url"]
+	if !ok || src == nil {
+		return
+	}
+
+	var urls []string
+	switch src := src.(type) {
+	case string:
+		urls = []string{src}
+	case []interface{}:
+		for _, u := range src {
+			s, ok := u.(string)
+			if !ok {
+				errFunc.add(fmt.Errorf("include_url item is not a string"))
+				continue
+			}
+			urls = append(urls, s)
+		}
+	default:
+		errFunc.add(fmt.Errorf("unknown include_url field format"))
+		return
+	}
+
+	for _, u := range urls {
+		if !isIncludeURL(u) {
+			errFunc.add(fmt.Errorf("include_url %q is not an http or https URL", u))
+			continue
+		}
+		if _, ok := mergedNames[u]; ok {
+			continue
+		}
+
+		dv, err := resolve(u)
+		if err != nil {
+			errFunc.addWarning(err)
+			continue
+		}
+		mergedNames[u] = struct{}{}
+
+		err = parseMerge(rv, dv, v, resolve, errFunc, depth, mergeDepth+1, "", relname, mergedNames, legacy, parseLocation{source: u})
+		if err != nil {
+			errFunc.add(err)
+		}
+	}
+}
+
+func parseDelegate(rv map[string]interface{}, v *Value, resolve ResolveFunc, errFunc ErrorFunc, depth, mergeDepth int, relname string, mergedNames map[string]struct{}, legacy bool) (bool, error) {
+	return parseImportImpl(rv, v, resolve, errFunc, depth, mergeDepth, relname, mergedNames, legacy, true)
+}
+
+func parseHostmaster(rv map[string]interface{}, v *Value, errFunc ErrorFunc, loc parseLocation) {
 	hm, ok := rv["email"]
 	if !ok || hm == nil {
 		return
@@ -738,23 +1256,60 @@ func parseHostmaster(rv map[string]interface{}, v *Value, errFunc ErrorFunc) {
 			return
 		}
 
+		prov := loc.field("email")
+		v.warnReplaced(errFunc, "email", "Hostmaster", v.Hostmaster != "" && v.Hostmaster != s, prov)
 		v.Hostmaster = s
+		v.setProvenance("Hostmaster", prov)
 		return
 	}
 
 	errFunc.add(fmt.Errorf("unknown email field format"))
 }
 
-func parseDS(rv map[string]interface{}, v *Value, errFunc ErrorFunc) {
+// The "redirect" field (or "url", as used by some older values) gives a URL to
+// which web requests for the name should be redirected. Only absolute http and
+// https URLs are accepted, so a value can't redirect browsers to e.g. a
+// javascript: URL.
+func parseRedirect(rv map[string]interface{}, v *Value, errFunc ErrorFunc, loc parseLocation) {
+	key := "redirect"
+	r, ok := rv["redirect"]
+	if !ok || r == nil {
+		key = "url"
+		r, ok = rv["url"]
+		if !ok || r == nil {
+			return
+		}
+	}
+
+	s, ok := r.(string)
+	if !ok {
+		errFunc.add(fmt.Errorf("unknown redirect field format"))
+		return
+	}
+
+	u, err := url.Parse(s)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.User != nil {
+		errFunc.add(fmt.Errorf("redirect field must be an absolute http or https URL"))
+		return
+	}
+
+	v.Redirect = u.String()
+	prov := loc.field(key)
+	prov.Modified = v.Redirect != s
+	v.setProvenance("Redirect", prov)
+}
+
+func parseDS(rv map[string]interface{}, v *Value, errFunc ErrorFunc, loc parseLocation) {
 	rds, ok := rv["ds"]
 	if !ok || rds == nil {
 		return
 	}
 
 	v.DS = nil
+	v.resetProvenance("DS")
 
 	if dsa, ok := rds.([]interface{}); ok {
-		for _, ds1 := range dsa {
+		for i, ds1 := range dsa {
 			if ds, ok := ds1.([]interface{}); ok {
 				if len(ds) < 4 {
 					errFunc.add(fmt.Errorf("DS item must have four items"))
@@ -762,14 +1317,14 @@ func parseDS(rv map[string]interface{}, v *Value, errFunc ErrorFunc) {
 				}
 
 				a1, ok := ds[0].(float64)
-				if !ok {
-					errFunc.add(fmt.Errorf("First item in DS value must be an integer (key tag)"))
+				if !ok || truncatesInt(a1, 16) {
+					errFunc.add(fmt.Errorf("First item in DS value must be an integer from 0 to 65535 (key tag)"))
 					continue
 				}
 
 				a2, ok := ds[1].(float64)
-				if !ok {
-					errFunc.add(fmt.Errorf("Second item in DS value must be an integer (algorithm)"))
+				if !ok || truncatesInt(a2, 8) {
+					errFunc.add(fmt.Errorf("Second item in DS value must be an integer from 0 to 255 (algorithm)"))
 					continue
 				}
 
@@ -799,6 +1354,9 @@ func parseDS(rv map[string]interface{}, v *Value, errFunc ErrorFunc) {
 					DigestType: uint8(a3),
 					Digest:     a4h,
 				})
+				prov := loc.item("ds", i)
+				prov.Modified = truncatesInt(a3, 8)
+				v.addProvenance("DS", prov)
 			} else {
 				errFunc.add(fmt.Errorf("DS item must be an array"))
 			}
@@ -809,7 +1367,7 @@ func parseDS(rv map[string]interface{}, v *Value, errFunc ErrorFunc) {
 	errFunc.add(fmt.Errorf("malformed DS field format"))
 }
 
-func parseTXT(rv map[string]interface{}, v *Value, errFunc ErrorFunc) {
+func parseTXT(rv map[string]interface{}, v *Value, errFunc ErrorFunc, loc parseLocation) {
 	rtxt, ok := rv["txt"]
 	if !ok || rtxt == nil {
 		return
@@ -817,7 +1375,7 @@ func parseTXT(rv map[string]interface{}, v *Value, errFunc ErrorFunc) {
 
 	if txta, ok := rtxt.([]interface{}); ok {
 		// ["...", "..."] or [["...", "..."], ["...", "..."]]
-		for _, vv := range txta {
+		for i, vv := range txta {
 			if sa, ok := vv.([]interface{}); ok {
 				// [["...", "..."], ["...", "..."]]
 				a := []string{}
@@ -828,9 +1386,13 @@ func parseTXT(rv map[string]interface{}, v *Value, errFunc ErrorFunc) {
 				}
 				if len(a) > 0 {
 					v.TXT = append(v.TXT, a)
+					prov := loc.item("txt", i)
+					prov.Modified = len(a) != len(sa)
+					v.addProvenance("TXT", prov)
 				}
 			} else if s, ok := vv.(string); ok {
 				v.TXT = append(v.TXT, segmentizeTXT(s))
+				v.addProvenance("TXT", loc.item("txt", i))
 			} else {
 				errFunc.add(fmt.Errorf("malformed TXT value"))
 				return
@@ -840,6 +1402,7 @@ func parseTXT(rv map[string]interface{}, v *Value, errFunc ErrorFunc) {
 		// "..."
 		if s, ok := rtxt.(string); ok {
 			v.TXT = append(v.TXT, segmentizeTXT(s))
+			v.addProvenance("TXT", loc.field("txt"))
 		} else {
 			errFunc.add(fmt.Errorf("malformed TXT value"))
 			return
@@ -861,6 +1424,7 @@ func parseTXT(rv map[string]interface{}, v *Value, errFunc ErrorFunc) {
 
 			// Pop segments until under the limit.
 			v.TXT[i] = v.TXT[i][0 : len(v.TXT[i])-1]
+			v.markModified("TXT", i)
 		}
 	}
 }
@@ -874,15 +1438,15 @@ func segmentizeTXT(txt string) (a []string) {
 	return
 }
 
-func parseMX(rv map[string]interface{}, v *Value, errFunc ErrorFunc, relname string) {
+func parseMX(rv map[string]interface{}, v *Value, errFunc ErrorFunc, relname string, loc parseLocation) {
 	rmx, ok := rv["mx"]
 	if !ok || rmx == nil {
 		return
 	}
 
 	if sa, ok := rmx.([]interface{}); ok {
-		for _, s := range sa {
-			parseSingleMX(rv, s, v, errFunc, relname)
+		for i, s := range sa {
+			parseSingleMX(rv, s, v, errFunc, relname, loc.item("mx", i))
 		}
 		return
 	}
@@ -890,7 +1454,7 @@ func parseMX(rv map[string]interface{}, v *Value, errFunc ErrorFunc, relname str
 	errFunc.add(fmt.Errorf("malformed MX value"))
 }
 
-func parseSingleMX(rv map[string]interface{}, s interface{}, v *Value, errFunc ErrorFunc, relname string) {
+func parseSingleMX(rv map[string]interface{}, s interface{}, v *Value, errFunc ErrorFunc, relname string, prov Provenance) {
 	sa, ok := s.([]interface{})
 	if !ok {
 		errFunc.add(fmt.Errorf("malformed MX value"))
@@ -919,26 +1483,29 @@ func parseSingleMX(rv map[string]interface{}, s interface{}, v *Value, errFunc E
 		Preference: uint16(prio),
 		Mx:         hostname,
 	})
+	prov.Modified = truncatesInt(prio, 16)
+	v.addProvenance("MX", prov)
 }
 
-func parseSRV(rv map[string]interface{}, v *Value, errFunc ErrorFunc, relname string) {
+func parseSRV(rv map[string]interface{}, v *Value, errFunc ErrorFunc, relname string, loc parseLocation) {
 	rsvc, ok := rv["srv"]
 	if !ok || rsvc == nil {
 		return
 	}
 
 	v.SRV = nil
+	v.resetProvenance("SRV")
 
 	if sa, ok := rsvc.([]interface{}); ok {
-		for _, s := range sa {
-			parseSingleService(rv, s, v, errFunc, relname)
+		for i, s := range sa {
+			parseSingleService(rv, s, v, errFunc, relname, loc.item("srv", i))
 		}
 	} else {
 		errFunc.add(fmt.Errorf("malformed service value"))
 	}
 }
 
-func parseSingleService(rv map[string]interface{}, svc interface{}, v *Value, errFunc ErrorFunc, relname string) {
+func parseSingleService(rv map[string]interface{}, svc interface{}, v *Value, errFunc ErrorFunc, relname string, prov Provenance) {
 	svca, ok := svc.([]interface{})
 	if !ok {
 		errFunc.add(fmt.Errorf("malformed service value"))
@@ -988,6 +1555,8 @@ func parseSingleService(rv map[string]interface{}, svc interface{}, v *Value, er
 		Port:     uint16(port),
 		Target:   hostname,
 	})
+	prov.Modified = truncatesInt(priority, 16) || truncatesInt(weight, 16) || truncatesInt(port, 16)
+	v.addProvenance("SRV", prov)
 }
 
 func convServiceValue(x interface{}) (string, error) {
@@ -1002,7 +1571,7 @@ func convServiceValue(x interface{}) (string, error) {
 	}
 }
 
-func parseMap(rv map[string]interface{}, v *Value, resolve ResolveFunc, errFunc ErrorFunc, depth, mergeDepth int, relname string) {
+func parseMap(rv map[string]interface{}, v *Value, resolve ResolveFunc, errFunc ErrorFunc, depth, mergeDepth int, relname string, legacy bool, loc parseLocation) {
 	rmap, ok := rv["map"]
 	if !ok || rmap == nil {
 		return
@@ -1014,10 +1583,24 @@ func parseMap(rv map[string]interface{}, v *Value, resolve ResolveFunc, errFunc
 		return
 	}
 
-	for mk, mv := range m {
+	// The items are parsed in the order of their keys, so that the names
+	// they import are resolved in the same order every time.
+	keys := make([]string, 0, len(m))
+	for mk := range m {
+		keys = append(keys, mk)
+	}
+	sort.Strings(keys)
+
+	for _, mk := range keys {
+		mv := m[mk]
 		if s, ok := mv.(string); ok {
-			// deprecated case: "map": { "": "127.0.0.1" }
-			mv = map[string]interface{}{"ip": []interface{}{s}}
+			// deprecated case: "map": { "": "127.0.0.1" }, or an IPv6
+			// address as for "ip6"
+			key := "ip"
+			if ip := net.ParseIP(s); ip != nil && ip.To4() == nil {
+				key = "ip6"
+			}
+			mv = map[string]interface{}{key: []interface{}{s}}
 			m[mk] = mv
 		}
 
@@ -1032,7 +1615,10 @@ func parseMap(rv map[string]interface{}, v *Value, resolve ResolveFunc, errFunc
 			}
 
 			mergedNames := map[string]struct{}{}
-			parse(mvm, v2, resolve, errFunc, depth+1, mergeDepth, "", relname, mergedNames)
+			parse(mvm, v2, resolve, errFunc, depth+1, mergeDepth, "", relname, mergedNames, legacy, loc.mapItem(mk))
+			if strings.HasPrefix(mk, "_") && (len(v2.IP) > 0 || len(v2.IP6) > 0) {
+				errFunc.addWarning(fmt.Errorf("addresses under map key %q aren't served: names with labels beginning with an underscore aren't hostnames", mk))
+			}
 
 			v.Map[mk] = v2
 
@@ -1049,33 +1635,51 @@ func (v *Value) moveEmptyMapItems() {
 	if ev, ok := v.Map[""]; ok {
 		if len(v.IP) == 0 {
 			v.IP = ev.IP
+			v.copyProvenance(ev, "IP")
 		}
 		if len(v.IP6) == 0 {
 			v.IP6 = ev.IP6
+			v.copyProvenance(ev, "IP6")
 		}
 		if len(v.NS) == 0 {
 			v.NS = ev.NS
+			v.copyProvenance(ev, "NS")
 		}
 		if len(v.DS) == 0 {
 			v.DS = ev.DS
+			v.copyProvenance(ev, "DS")
 		}
 		if len(v.TXT) == 0 {
 			v.TXT = ev.TXT
+			v.copyProvenance(ev, "TXT")
 		}
 		if len(v.SRV) == 0 {
 			v.SRV = ev.SRV
+			v.copyProvenance(ev, "SRV")
 		}
 		if len(v.MX) == 0 {
 			v.MX = ev.MX
+			v.copyProvenance(ev, "MX")
 		}
 		if len(v.Alias) == 0 {
 			v.Alias = ev.Alias
+			v.copyProvenance(ev, "Alias")
 		}
 		if len(v.Translate) == 0 {
 			v.Translate = ev.Translate
+			v.copyProvenance(ev, "Translate")
 		}
 		if len(v.Hostmaster) == 0 {
 			v.Hostmaster = ev.Hostmaster
+			v.copyProvenance(ev, "Hostmaster")
+		}
+		if len(v.Redirect) == 0 {
+			v.Redirect = ev.Redirect
+			v.copyProvenance(ev, "Redirect")
+		}
+		if len(v.Tor) == 0 {
+			v.Tor, v.TorPort = ev.Tor, ev.TorPort
+			v.copyProvenance(ev, "Tor")
 		}
 		delete(v.Map, "")
 		if len(v.Map) == 0 {
@@ -3,18 +3,18 @@
 
 package ncdomain
 
-import (
-	"github.com/miekg/dns"
-)
-
 type Value struct {
 	valueWithoutTLSA
 }
 
-func (v *Value) appendTLSA(out []dns.RR, suffix, apexSuffix string) ([]dns.RR, error) {
+func (v *Value) appendTLSA(out []Record, suffix, apexSuffix string) ([]Record, error) {
 	return out, nil
 }
 
-func parseTLSA(rv map[string]interface{}, v *Value, errFunc ErrorFunc) {
+func parseTLSA(rv map[string]interface{}, v *Value, errFunc ErrorFunc, loc parseLocation) {
 	v.TLSA = nil
+	v.resetProvenance("TLSA")
+}
+
+func (v *Value) setGeneratedTLSA(form TLSAForm) {
 }
@@ -1,5 +1,6 @@
 package ncdomain_test
 
+import "github.com/namecoin/ncdns/namecoin"
 import "github.com/namecoin/ncdns/ncdomain"
 import "github.com/namecoin/ncdns/testutil"
 import _ "github.com/hlandau/nctestsuite"
@@ -267,3 +268,365 @@ func eqValueMap(a *ncdomain.Value, b *ncdomain.Value) bool {
 
 	return true
 }*/
+
+func TestParseRedirect(t *testing.T) {
+	for jsonValue, expected := range map[string]string{
+		`{"redirect":"https://example.com/a?b=c"}`:                     "https://example.com/a?b=c",
+		`{"url":"http://example.com/"}`:                                "http://example.com/",
+		`{"redirect":"https://a.example/","url":"https://b.example/"}`: "https://a.example/",
+		`{"redirect":"javascript:alert(1)"}`:                           "",
+		`{"redirect":"data:text/html,hi"}`:                             "",
+		`{"redirect":"//example.com/"}`:                                "",
+		`{"redirect":"https://user@example.com/"}`:                     "",
+		`{"redirect":42}`:                                              "",
+		`{"map":{"":{"redirect":"https://example.com/"}}}`:             "https://example.com/",
+	} {
+		v := ncdomain.ParseValue("d/example", jsonValue, nil, nil)
+		if v == nil {
+			t.Fatalf("couldn't parse %s", jsonValue)
+		}
+		if v.Redirect != expected {
+			t.Errorf("%s: got redirect %q, expected %q", jsonValue, v.Redirect, expected)
+		}
+	}
+}
+
+func TestImportNamespaces(t *testing.T) {
+	names := map[string]string{
+		"d/imported":  `{"ip":["192.0.2.1"]}`,
+		"dd/imported": `{"ip":["192.0.2.2"]}`,
+		"id/imported": `{"ip":["192.0.2.3"]}`,
+	}
+
+	tests := []struct {
+		jsonValue  string
+		namespaces []string
+		resolved   string
+		ip         string
+		warnings   int
+	}{
+		{`{"import":"d/imported"}`, nil, "d/imported", "192.0.2.1", 0},
+		{`{"import":"imported"}`, nil, "d/imported", "192.0.2.1", 0},
+		{`{"import":[["imported"],["d/imported"]]}`, nil, "d/imported", "192.0.2.1", 0},
+		{`{"import":"dd/imported"}`, nil, "dd/imported", "192.0.2.2", 0},
+		{`{"import":"id/imported"}`, nil, "", "", 1},
+		{`{"import":"id/imported"}`, []string{"d", "id"}, "id/imported", "192.0.2.3", 0},
+		{`{"import":"dd/imported"}`, []string{"d"}, "", "", 1},
+		{`{"import":"d/Not_A_Domain"}`, nil, "", "", 1},
+		{`{"import":"d/"}`, nil, "", "", 1},
+		{`{"import":"/imported"}`, nil, "", "", 1},
+		{`{"import":"dd/has space"}`, nil, "", "", 1},
+		{`{"import":"dd/` + strings.Repeat("x", 300) + `"}`, nil, "", "", 1},
+	}
+
+	for _, test := range tests {
+		var resolved []string
+		resolve := func(name string) (string, error) {
+			resolved = append(resolved, name)
+			v, ok := names[name]
+			if !ok {
+				return "", fmt.Errorf("not found")
+			}
+			return v, nil
+		}
+
+		warnings := 0
+		errFunc := func(err error, isWarning bool) {
+			if isWarning {
+				warnings++
+			}
+		}
+
+		v := ncdomain.ParseValueWithOptions("d/example", test.jsonValue, resolve, errFunc,
+			&ncdomain.ParseOptions{ImportNamespaces: test.namespaces})
+		if v == nil {
+			t.Fatalf("couldn't parse %s", test.jsonValue)
+		}
+
+		if strings.Join(resolved, ",") != test.resolved {
+			t.Errorf("%s: resolved %v, expected %q", test.jsonValue, resolved, test.resolved)
+		}
+
+		ip := ""
+		if len(v.IP) > 0 {
+			ip = v.IP[0].String()
+		}
+		if ip != test.ip {
+			t.Errorf("%s: got IP %q, expected %q", test.jsonValue, ip, test.ip)
+		}
+
+		if warnings != test.warnings {
+			t.Errorf("%s: got %d warnings, expected %d", test.jsonValue, warnings, test.warnings)
+		}
+	}
+}
+
+// Labels beginning with an underscore name services and attributes rather than
+// hosts: they may own any records except addresses, and be CNAME targets.
+func TestUnderscoreLabels(t *testing.T) {
+	for jsonValue, expected := range map[string]string{
+		`{"txt":"v=spf1 ip4:192.0.2.1 -all"}`:                                                `example.bit. TXT "v=spf1 ip4:192.0.2.1 -all"`,
+		`{"map":{"_dmarc":{"txt":"v=DMARC1; p=reject"}}}`:                                    `_dmarc.example.bit. TXT "v=DMARC1; p=reject"`,
+		`{"map":{"_domainkey":{"map":{"sel1":{"txt":"v=DKIM1; p=MIIB"}}}}}`:                  `sel1._domainkey.example.bit. TXT "v=DKIM1; p=MIIB"`,
+		`{"map":{"_acme-challenge":{"txt":"token"}}}`:                                        `_acme-challenge.example.bit. TXT "token"`,
+		`{"map":{"_acme-challenge":{"alias":"_acme-challenge.example.com."}}}`:               `_acme-challenge.example.bit. CNAME _acme-challenge.example.com.`,
+		`{"map":{"_acme-challenge":{"ip":"192.0.2.1","txt":"token"}}}`:                       `_acme-challenge.example.bit. TXT "token"`,
+		`{"map":{"_tcp":{"map":{"www":{"ip":"192.0.2.1"}}}}}`:                                "",
+		`{"map":{"_tcp":{"map":{"_xmpp-client":{"srv":[[0,0,5222,"xmpp.example.com."]]}}}}}`: "_xmpp-client._tcp.example.bit. SRV 0 0 5222 xmpp.example.com.",
+	} {
+		v := ncdomain.ParseValue("d/example", jsonValue, nil, nil)
+		rrs, err := v.RRsRecursive(nil, "example.bit.", "example.bit.")
+		if err != nil {
+			t.Fatalf("%s: %v", jsonValue, err)
+		}
+
+		var rrstrs []string
+		for _, rr := range rrs {
+			s := strings.Replace(rr.String(), "\t600\tIN\t", " ", 1)
+			rrstrs = append(rrstrs, strings.Replace(s, "\t", " ", -1))
+		}
+		sort.Strings(rrstrs)
+		if got := strings.Join(rrstrs, "\n"); got != expected {
+			t.Errorf("%s: got\n%s\nexpected\n%s", jsonValue, got, expected)
+		}
+	}
+}
+
+// Every "ip" case, with the addresses swapped for IPv6 ones, is an "ip6" case
+// giving the same records (as AAAA rather than A) and the same problems.
+func TestIP6Parity(t *testing.T) {
+	tests := []struct {
+		jsonValue        string
+		rrs              string
+		errors, warnings int
+	}{
+		{`{"ip":"192.0.2.1"}`, "example.bit. A 192.0.2.1", 0, 0},
+		{`{"ip":["192.0.2.1"]}`, "example.bit. A 192.0.2.1", 0, 0},
+		{`{"ip":["192.0.2.1","192.0.2.2"]}`, "example.bit. A 192.0.2.1\nexample.bit. A 192.0.2.2", 0, 0},
+		{`{"ip":[]}`, "", 0, 0},
+		{`{"ip":null}`, "", 0, 0},
+		{`{"ip":"bogus"}`, "", 1, 0},
+		{`{"ip":"2001:db8::1"}`, "", 1, 0},
+		{`{"ip":["192.0.2.1","bogus","192.0.2.2"]}`, "example.bit. A 192.0.2.1\nexample.bit. A 192.0.2.2", 1, 0},
+		{`{"ip":["192.0.2.1",7]}`, "example.bit. A 192.0.2.1", 0, 1},
+		{`{"ip":7}`, "", 0, 1},
+		{`{"ip":{"a":"192.0.2.1"}}`, "", 0, 1},
+		{`{"map":{"":{"ip":"192.0.2.1"}}}`, "example.bit. A 192.0.2.1", 0, 0},
+		{`{"ip":"192.0.2.2","map":{"":{"ip":"192.0.2.1"}}}`, "example.bit. A 192.0.2.2", 0, 0},
+		{`{"map":{"www":{"ip":"192.0.2.1"}}}`, "www.example.bit. A 192.0.2.1", 0, 0},
+		{`{"map":{"www":"192.0.2.1"}}`, "www.example.bit. A 192.0.2.1", 0, 0},
+		{`{"map":{"":"192.0.2.1"}}`, "example.bit. A 192.0.2.1", 0, 0},
+		{`{"map":{"*":{"ip":"192.0.2.1"}}}`, "*.example.bit. A 192.0.2.1", 0, 0},
+		{`{"map":{"_tcp":{"ip":"192.0.2.1"}}}`, "", 0, 1},
+		{`{"import":"d/imported"}`, "example.bit. A 192.0.2.1", 0, 0},
+		{`{"ip":"192.0.2.2","import":"d/imported"}`, "example.bit. A 192.0.2.2", 0, 0},
+	}
+
+	swap := strings.NewReplacer(`"ip"`, `"ip6"`, "192.0.2.1", "2001:db8::1", "192.0.2.2", "2001:db8::2", "2001:db8::1", "192.0.2.1", " A ", " AAAA ")
+	imported := `{"ip":"192.0.2.1"}`
+
+	check := func(jsonValue, imported, expected string, errors, warnings int) {
+		resolve := func(name string) (string, error) {
+			if name != "d/imported" {
+				return "", fmt.Errorf("not found")
+			}
+			return imported, nil
+		}
+
+		errCount, warnCount := 0, 0
+		errFunc := func(err error, isWarning bool) {
+			if isWarning {
+				warnCount++
+			} else {
+				errCount++
+			}
+		}
+
+		v := ncdomain.ParseValue("d/example", jsonValue, resolve, errFunc)
+		rrs, err := v.RRsRecursive(nil, "example.bit.", "example.bit.")
+		if err != nil {
+			t.Fatalf("%s: %v", jsonValue, err)
+		}
+
+		var rrstrs []string
+		for _, rr := range rrs {
+			s := strings.Replace(rr.String(), "\t600\tIN\t", " ", 1)
+			rrstrs = append(rrstrs, strings.Replace(s, "\t", " ", -1))
+		}
+		if got := strings.Join(rrstrs, "\n"); got != expected {
+			t.Errorf("%s: got\n%s\nexpected\n%s", jsonValue, got, expected)
+		}
+		if errCount != errors || warnCount != warnings {
+			t.Errorf("%s: got %d errors and %d warnings, expected %d and %d", jsonValue, errCount, warnCount, errors, warnings)
+		}
+	}
+
+	for _, test := range tests {
+		check(test.jsonValue, imported, test.rrs, test.errors, test.warnings)
+		check(swap.Replace(test.jsonValue), swap.Replace(imported), swap.Replace(test.rrs), test.errors, test.warnings)
+	}
+}
+
+// Fields of a delegated name other than its NS and DS records are ignored,
+// with a warning.
+func TestDelegatedWarnings(t *testing.T) {
+	var warnings []string
+	errFunc := func(err error, isWarning bool) {
+		if !isWarning {
+			t.Errorf("unexpected error %v", err)
+		}
+		warnings = append(warnings, err.Error())
+	}
+
+	v := ncdomain.ParseValue("d/example", `{"ip":"192.0.2.1","ns":"ns1.example.com.","map":{"www":{"ip":"192.0.2.2"},"sub":{"ns":"ns1.example.net.","txt":"x"}}}`, nil, errFunc)
+	expected := []string{"d/example: ignoring ip (d/example at ip), map: the name is delegated by its ns field (d/example at ns); addresses of any of its nameservers at or below it are still published as glue"}
+	if strings.Join(warnings, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("got warnings %q, expected %q", warnings, expected)
+	}
+	if rrs, _ := v.RRsRecursive(nil, "example.bit.", "example.bit."); len(rrs) != 1 {
+		t.Errorf("got %v, expected only the NS record", rrs)
+	}
+
+	warnings = nil
+	ncdomain.ParseValue("d/example", `{"ip":"192.0.2.1","map":{"www":{"ns":"ns1.example.com.","ds":[[12345,8,2,"4tPJFvbe6scylOgmj7WIUESoM/xUWViPSpGEz8QaV2Y="]]},"sub":{"ns":"ns1.example.net.","txt":"x","ip6":"2001:db8::1"}}}`, nil, errFunc)
+	expected = []string{"d/example: map.sub: ignoring ip6 (d/example at map.sub.ip6), txt (d/example at map.sub.txt): the name is delegated by its ns field (d/example at map.sub.ns); addresses of any of its nameservers at or below it are still published as glue"}
+	if strings.Join(warnings, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("got warnings %q, expected %q", warnings, expected)
+	}
+}
+
+// Addresses of the nameservers of a delegated name which are at or below it
+// are published as glue, and no others.
+func TestDelegationGlue(t *testing.T) {
+	v := ncdomain.ParseValue("d/example", `{"ns":["ns1.example.bit.","ns2","ns1.example.com."],"ip":"192.0.2.9","map":{"ns1":{"ip":"192.0.2.1","ip6":"2001:db8::1"},"ns2":{"ip":"192.0.2.2"},"www":{"ip":"192.0.2.3"}}}`, nil, nil)
+	rrs, err := v.RRsRecursive(nil, "example.bit.", "example.bit.")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, rr := range rrs {
+		got = append(got, strings.Replace(rr.String(), "\t", " ", -1))
+	}
+	expected := []string{
+		"example.bit. 600 IN NS ns1.example.bit.",
+		"example.bit. 600 IN NS ns2.example.bit.",
+		"example.bit. 600 IN NS ns1.example.com.",
+		"ns1.example.bit. 600 IN A 192.0.2.1",
+		"ns1.example.bit. 600 IN AAAA 2001:db8::1",
+		"ns2.example.bit. 600 IN A 192.0.2.2",
+	}
+	if strings.Join(got, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("got\n%s\nexpected\n%s", strings.Join(got, "\n"), strings.Join(expected, "\n"))
+	}
+}
+
+// Values larger than 90% of the consensus limit are warned about, with their
+// size and the limit.
+func TestValueSizeWarning(t *testing.T) {
+	const limit = namecoin.ConsensusMaxValueSize
+	opts := &ncdomain.ParseOptions{MaxValueSize: limit, ValueSizeWarnPercent: 90}
+
+	tests := []struct {
+		size int
+		warn bool
+	}{
+		{100, false},
+		{limit * 90 / 100, false},
+		{limit*90/100 + 1, true},
+		{limit - 1, true},
+		{limit, true},
+	}
+
+	for _, test := range tests {
+		// {"txt":"..."}, padded to the size.
+		value := `{"txt":"` + strings.Repeat("x", test.size-10) + `"}`
+		var warnings []error
+		errFunc := func(err error, isWarning bool) {
+			if !isWarning {
+				t.Errorf("%d bytes: unexpected error %v", test.size, err)
+			}
+			warnings = append(warnings, err)
+		}
+
+		ncdomain.ParseValueWithOptions("d/example", value, nil, errFunc, opts)
+		switch {
+		case !test.warn && len(warnings) != 0:
+			t.Errorf("%d bytes: unexpected warnings %v", test.size, warnings)
+		case test.warn && len(warnings) != 1:
+			t.Errorf("%d bytes: got warnings %v, expected one", test.size, warnings)
+		case test.warn && !strings.Contains(warnings[0].Error(), fmt.Sprintf("is %d bytes, %d%% of the %d-byte limit", test.size, test.size*100/limit, limit)):
+			t.Errorf("%d bytes: unexpected warning %v", test.size, warnings[0])
+		}
+	}
+
+	// Without a limit, or with the warning at 100%, there's nothing to warn
+	// about.
+	value := `{"txt":"` + strings.Repeat("x", limit-10) + `"}`
+	for _, opts := range []*ncdomain.ParseOptions{nil, {ValueSizeWarnPercent: 90}, {MaxValueSize: limit, ValueSizeWarnPercent: 100}} {
+		ncdomain.ParseValueWithOptions("d/example", value, nil, func(err error, isWarning bool) {
+			t.Errorf("%+v: unexpected warning %v", opts, err)
+		}, opts)
+	}
+}
+
+func TestIncludeURL(t *testing.T) {
+	const url = "https://config.internal/example.json"
+	docs := map[string]string{
+		url:                                `{"ip":["192.0.2.1"],"map":{"www":{"include_url":"https://config.internal/www.json"}}}`,
+		"https://config.internal/www.json": `{"ip6":["2001:db8::1"]}`,
+	}
+	fetchURL := func(u string) (string, error) {
+		v, ok := docs[u]
+		if !ok {
+			return "", fmt.Errorf("not found")
+		}
+		return v, nil
+	}
+
+	var warnings []error
+	errFunc := func(err error, isWarning bool) {
+		if !isWarning {
+			t.Errorf("unexpected error %v", err)
+		}
+		warnings = append(warnings, err)
+	}
+
+	value := `{"txt":"local","include_url":"` + url + `"}`
+	v := ncdomain.ParseValueWithOptions("d/example", value, nil, errFunc, &ncdomain.ParseOptions{FetchURL: fetchURL})
+	if v == nil {
+		t.Fatal("couldn't parse value")
+	}
+	if len(warnings) != 0 {
+		t.Errorf("unexpected warnings %v", warnings)
+	}
+	recs, err := v.RecordsRecursive(nil, "example.bit.", "bit.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sources := map[string]string{}
+	for _, r := range recs {
+		sources[r.RR.String()] = r.Provenance.Source
+	}
+	if len(sources) != 3 {
+		t.Errorf("unexpected records %v", sources)
+	}
+	for rr, source := range sources {
+		switch {
+		case strings.Contains(rr, "192.0.2.1") && source != url,
+			strings.Contains(rr, "2001:db8::1") && source != "https://config.internal/www.json",
+			strings.Contains(rr, "local") && source != "d/example":
+			t.Errorf("%s has source %q", rr, source)
+		}
+	}
+
+	// Without FetchURL, the statement is ignored with a warning, as is a
+	// document which can't be fetched.
+	for _, opts := range []*ncdomain.ParseOptions{nil, {FetchURL: func(string) (string, error) { return "", fmt.Errorf("refused") }}} {
+		warnings = nil
+		v = ncdomain.ParseValueWithOptions("d/example", value, nil, errFunc, opts)
+		if len(v.IP) != 0 || len(v.TXT) != 1 || len(warnings) != 1 || !strings.Contains(warnings[0].Error(), url) {
+			t.Errorf("include_url not ignored with a warning: IPs %v, TXT %v, warnings %v", v.IP, v.TXT, warnings)
+		}
+	}
+}
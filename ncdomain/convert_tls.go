@@ -20,14 +20,28 @@ import (
 type Value struct {
 	valueWithoutTLSA
 	TLSAGenerated []x509.Certificate // Certs can be dehydrated in the blockchain, they will be put here without SAN values.  SAN must be filled in before use.
+
+	generatedTLSA TLSAForm // the form of the TLSA records generated from TLSAGenerated
 }
 
-func (v *Value) appendTLSA(out []dns.RR, suffix, apexSuffix string) ([]dns.RR, error) {
-	for _, tlsa := range v.TLSA {
-		out = append(out, tlsa)
+// Sets the form of the TLSA records generated from dehydrated certificates in
+// v and all of its subdomains.
+func (v *Value) setGeneratedTLSA(form TLSAForm) {
+	v.generatedTLSA = form
+	for _, sub := range v.Map {
+		sub.setGeneratedTLSA(form)
 	}
+}
 
-	for _, cert := range v.TLSAGenerated {
+func (v *Value) appendTLSA(out []Record, suffix, apexSuffix string) ([]Record, error) {
+	for i, tlsa := range v.TLSA {
+		out = append(out, Record{
+			RR:         dns.Copy(tlsa),
+			Provenance: v.provenance("TLSA", i),
+		})
+	}
+
+	for i, cert := range v.TLSAGenerated {
 
 		template := cert
 
@@ -45,15 +59,21 @@ func (v *Value) appendTLSA(out []dns.RR, suffix, apexSuffix string) ([]dns.RR, e
 			continue
 		}
 
-		derBytesHex := hex.EncodeToString(derBytes)
+		data, err := tlsaData(derBytes, v.generatedTLSA)
+		if err != nil {
+			continue
+		}
 
-		out = append(out, &dns.TLSA{
-			Hdr: dns.RR_Header{Name: "", Rrtype: dns.TypeTLSA, Class: dns.ClassINET,
-				Ttl: defaultTTL},
-			Usage:        uint8(3),
-			Selector:     uint8(0),
-			MatchingType: uint8(0),
-			Certificate:  strings.ToUpper(derBytesHex),
+		out = append(out, Record{
+			RR: &dns.TLSA{
+				Hdr: dns.RR_Header{Name: "", Rrtype: dns.TypeTLSA, Class: dns.ClassINET,
+					Ttl: defaultTTL},
+				Usage:        v.generatedTLSA.Usage,
+				Selector:     v.generatedTLSA.Selector,
+				MatchingType: v.generatedTLSA.MatchingType,
+				Certificate:  data,
+			},
+			Provenance: v.provenance("TLSAGenerated", i),
 		})
 
 	}
@@ -61,7 +81,27 @@ func (v *Value) appendTLSA(out []dns.RR, suffix, apexSuffix string) ([]dns.RR, e
 	return out, nil
 }
 
-func parseTLSADehydrated(tlsa1dehydrated interface{}, v *Value) error {
+// Returns the certificate association data of a TLSA record of the given form
+// for a DER certificate.
+func tlsaData(derBytes []byte, form TLSAForm) (string, error) {
+	if form.Selector == 0 && form.MatchingType == 0 {
+		return strings.ToUpper(hex.EncodeToString(derBytes)), nil
+	}
+
+	cert, err := x509.ParseCertificate(derBytes)
+	if err != nil {
+		return "", err
+	}
+
+	data, err := dns.CertificateToDANE(form.Selector, form.MatchingType, cert)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.ToUpper(data), nil
+}
+
+func parseTLSADehydrated(tlsa1dehydrated interface{}, v *Value, prov Provenance) error {
 	dehydrated, err := certdehydrate.ParseDehydratedCert(tlsa1dehydrated)
 	if err != nil {
 		return fmt.Errorf("Error parsing dehydrated certificate: %s", err)
@@ -73,11 +113,12 @@ func parseTLSADehydrated(tlsa1dehydrated interface{}, v *Value) error {
 	}
 
 	v.TLSAGenerated = append(v.TLSAGenerated, *template)
+	v.addProvenance("TLSAGenerated", prov)
 
 	return nil
 }
 
-func parseTLSADANE(tlsa1dane interface{}, v *Value) error {
+func parseTLSADANE(tlsa1dane interface{}, v *Value, prov Provenance) error {
 	if tlsa, ok := tlsa1dane.([]interface{}); ok {
 		// Format: [1, 2, 3, "base64 certificate data"]
 		if len(tlsa) < 4 {
@@ -119,6 +160,8 @@ func parseTLSADANE(tlsa1dane interface{}, v *Value) error {
 			MatchingType: uint8(a3),
 			Certificate:  strings.ToUpper(a4h),
 		})
+		prov.Modified = truncatesInt(a1, 8) || truncatesInt(a2, 8) || truncatesInt(a3, 8)
+		v.addProvenance("TLSA", prov)
 
 		// Handle compressed public keys specially
 		// Check if this TLSA is a public key preimage
@@ -148,6 +191,7 @@ func parseTLSADANE(tlsa1dane interface{}, v *Value) error {
 				MatchingType: uint8(a3),
 				Certificate:  strings.ToUpper(pubDecompressedHex),
 			})
+			v.addProvenance("TLSA", prov)
 		}
 
 		return nil
@@ -156,36 +200,56 @@ func parseTLSADANE(tlsa1dane interface{}, v *Value) error {
 	}
 }
 
-func parseTLSA(rv map[string]interface{}, v *Value, errFunc ErrorFunc) {
+func init() {
+	registerField(&Field{
+		Name:        "tls",
+		Types:       []string{"array"},
+		Description: "Array of TLSA records, each an array [usage, selector, matching type, base64 data] or an object with a \"dane\" item of that form or a \"d8\" dehydrated certificate",
+		Limits:      "place under map keys such as _443._tcp",
+	})
+}
+
+func parseTLSA(rv map[string]interface{}, v *Value, errFunc ErrorFunc, loc parseLocation) {
 	tlsa, ok := rv["tls"]
 	if !ok || tlsa == nil {
 		return
 	}
 
 	v.TLSA = nil
+	v.resetProvenance("TLSA")
 
 	if tlsaa, ok := tlsa.([]interface{}); ok {
-		for _, tlsa1 := range tlsaa {
+		for i, tlsa1 := range tlsaa {
+			prov := loc.item("tls", i)
+
 			var tlsa1m map[string]interface{}
 
 			if _, ok := tlsa1.([]interface{}); ok {
 				tlsa1m = map[string]interface{}{
 					"dane": tlsa1,
 				}
+			} else if m, ok := tlsa1.(map[string]interface{}); ok {
+				tlsa1m = m
 			} else {
-				tlsa1m = tlsa1.(map[string]interface{})
+				errFunc.add(fmt.Errorf("TLSA item must be an array or an object"))
+				continue
 			}
 
+			// A dehydrated certificate which can't be used is skipped, since
+			// the rest of the value may still be usable.
 			if tlsa1dehydrated, ok := tlsa1m["d8"]; ok {
-				err := parseTLSADehydrated(tlsa1dehydrated, v)
+				err := parseTLSADehydrated(tlsa1dehydrated, v, prov)
 				if err == nil {
 					continue
 				}
-				errFunc.add(err)
+				errFunc.addWarning(err)
+				if _, ok := tlsa1m["dane"]; !ok {
+					continue
+				}
 			}
 
 			if tlsa1dane, ok := tlsa1m["dane"]; ok {
-				err := parseTLSADANE(tlsa1dane, v)
+				err := parseTLSADANE(tlsa1dane, v, prov)
 				if err == nil {
 					continue
 				}
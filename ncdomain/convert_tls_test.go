@@ -3,4 +3,107 @@
 
 package ncdomain_test
 
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+
+	"github.com/namecoin/ncdns/ncdomain"
+)
+
 const tlsaDisabled = false
+
+const veclabsValue = `{"map":{"www":{"map":{"_tcp":{"map":{"_443":{"tls":[
+	{"d8":[1,"MFkwEwYHKoZIzj0CAQYIKoZIzj0DAQcDQgAEGm0zZlzrnwEYvub3BG3+VTKjvXWdMntoTanw3cwGAqcb0ALFrt5MdChT9t4josaefnGdVHa+ZBNmSEIaNZNhnw==",4944096,5154336,10,"MEUCIQCEkb4Q+AV8FsQgRoWSZ3S+1Ww/SySl4238SjTv5d/WAgIgX2rAhfCQ3gGG1Abhme8mDTG641vIYHJuz8d6m7IrgJo="]},
+	{"d8":[1,"not base64",4944096,5154336,10,"MEUCIQ=="]},
+	{"d8":"malformed"},
+	"not an array or object"
+]}}}}}},"ip":["192.0.2.1"]}`
+
+func dehydratedTLSA(t *testing.T, form *ncdomain.TLSAForm) (tlsas []*dns.TLSA, errs, warnings int) {
+	errFunc := func(err error, isWarning bool) {
+		if isWarning {
+			warnings++
+		} else {
+			errs++
+		}
+	}
+
+	v := ncdomain.ParseValueWithOptions("d/veclabs", veclabsValue, nil, errFunc, &ncdomain.ParseOptions{
+		GeneratedTLSA: form,
+	})
+	if v == nil {
+		t.Fatal("couldn't parse value")
+	}
+
+	rrs, err := v.RRsRecursive(nil, "veclabs.bit.", "bit.")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hasIP := false
+	for _, rr := range rrs {
+		switch rr := rr.(type) {
+		case *dns.TLSA:
+			if rr.Hdr.Name != "_443._tcp.www.veclabs.bit." {
+				t.Errorf("unexpected TLSA owner name %q", rr.Hdr.Name)
+			}
+			tlsas = append(tlsas, rr)
+		case *dns.A:
+			hasIP = true
+		}
+	}
+	if !hasIP {
+		t.Errorf("unusable dehydrated certificates caused the rest of the value to be dropped")
+	}
+
+	return
+}
+
+func TestDehydratedTLSA(t *testing.T) {
+	certPEM, err := ioutil.ReadFile("../certdehydrate/testdata/www.veclabs.bit.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(certPEM)
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tlsas, errs, warnings := dehydratedTLSA(t, nil)
+	if len(tlsas) != 1 || tlsas[0].Usage != 3 || tlsas[0].Selector != 0 || tlsas[0].MatchingType != 0 ||
+		!strings.EqualFold(tlsas[0].Certificate, hex.EncodeToString(block.Bytes)) {
+		t.Errorf("expected a 3 0 0 TLSA record of the known-good certificate, got %v", tlsas)
+	}
+
+	// The bad dehydrated certificates are warnings; only the item which is
+	// neither an array nor an object is an error.
+	if errs != 1 || warnings != 2 {
+		t.Errorf("got %d errors and %d warnings, expected 1 and 2", errs, warnings)
+	}
+
+	form, err := ncdomain.ParseTLSAForm("3 1 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	spki := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+
+	tlsas, _, _ = dehydratedTLSA(t, form)
+	if len(tlsas) != 1 || tlsas[0].Usage != 3 || tlsas[0].Selector != 1 || tlsas[0].MatchingType != 1 ||
+		!strings.EqualFold(tlsas[0].Certificate, hex.EncodeToString(spki[:])) {
+		t.Errorf("expected a 3 1 1 TLSA record of the known-good certificate, got %v", tlsas)
+	}
+
+	for _, bad := range []string{"", "3 1", "3 2 1", "3 1 3", "a b c"} {
+		if _, err := ncdomain.ParseTLSAForm(bad); err == nil {
+			t.Errorf("accepted TLSA form %q", bad)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package ncdomain
+
+import "fmt"
+import "sort"
+import "github.com/miekg/dns"
+
+// Checks the DS records of v and of the names beneath it once they have been
+// normalized. Records naming an algorithm not in algorithms are ignored with a
+// warning, unless allowUnknown is set, in which case they are only warned
+// about: a resolver which doesn't implement the algorithm of any of a
+// delegation's DS records treats the delegated zone as bogus. A delegation
+// whose DS records all give SHA-1 digests is warned about too, since resolvers
+// are expected to stop accepting them.
+func (v *Value) checkDS(algorithms []uint8, allowUnknown bool, errFunc ErrorFunc, loc parseLocation) {
+	errFunc = loc.wrapErrorFunc(errFunc)
+
+	// Remove from the end, so that the indices of those still to be checked
+	// stay the same.
+	for i := len(v.DS) - 1; i >= 0; i-- {
+		alg := v.DS[i].Algorithm
+		if containsAlgorithm(algorithms, alg) {
+			continue
+		}
+
+		from := ""
+		if p := v.provenance("DS", i); p.Source != "" {
+			from = " from " + p.String()
+		}
+		if allowUnknown {
+			errFunc.addWarning(fmt.Errorf("ds record%s names %s, which isn't an accepted DNSSEC algorithm; resolvers which don't implement it will treat the delegation as bogus", from, algorithmName(alg)))
+			continue
+		}
+
+		errFunc.addWarning(fmt.Errorf("ignoring ds record%s: %s isn't an accepted DNSSEC algorithm", from, algorithmName(alg)))
+		v.DS = append(v.DS[:i], v.DS[i+1:]...)
+		if ps := v.Provenance["DS"]; i < len(ps) {
+			v.Provenance["DS"] = append(ps[:i], ps[i+1:]...)
+		}
+	}
+	if len(v.DS) == 0 {
+		v.DS = nil
+	}
+
+	sha1Only := len(v.DS) > 0
+	for _, ds := range v.DS {
+		sha1Only = sha1Only && ds.DigestType == dns.SHA1
+	}
+	if sha1Only {
+		errFunc.addWarning(fmt.Errorf("the ds field%s gives only SHA-1 digests, which resolvers may not accept; a SHA-256 (digest type 2) digest should be given too", v.provenanceNote("DS")))
+	}
+
+	keys := make([]string, 0, len(v.Map))
+	for k := range v.Map {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		v.Map[k].checkDS(algorithms, allowUnknown, errFunc, loc.mapItem(k))
+	}
+}
+
+func containsAlgorithm(algorithms []uint8, alg uint8) bool {
+	for _, a := range algorithms {
+		if a == alg {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the number and, if it has one, mnemonic of a DNSSEC algorithm, e.g.
+// "algorithm 8 (RSASHA256)".
+func algorithmName(alg uint8) string {
+	if s, ok := dns.AlgorithmToString[alg]; ok {
+		return fmt.Sprintf("algorithm %d (%s)", alg, s)
+	}
+	return fmt.Sprintf("algorithm %d", alg)
+}
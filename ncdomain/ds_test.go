@@ -0,0 +1,33 @@
+package ncdomain_test
+
+import "fmt"
+import "strings"
+import "testing"
+import "github.com/namecoin/ncdns/ncdomain"
+
+// Each fixture gives DS records which are kept, ignored or warned about for
+// one reason, the last a mixture of them as found in the wild.
+func TestDSValidation(t *testing.T) {
+	var fixtures []fixture
+	readFixture(t, "testdata/ds.json", &fixtures)
+
+	var out []string
+	for _, f := range fixtures {
+		out = append(out, "== "+f.Conflict+"\n"+f.dump(t))
+	}
+
+	checkGolden(t, "testdata/ds.golden", strings.Join(out, "\n"))
+}
+
+func TestParseDSAlgorithms(t *testing.T) {
+	algs, err := ncdomain.ParseDSAlgorithms(" 8, ecdsap256sha256,ED25519 ,")
+	if err != nil || fmt.Sprint(algs) != "[8 13 15]" {
+		t.Errorf("got %v, %v", algs, err)
+	}
+
+	for _, s := range []string{"256", "-1", "RSASHA3"} {
+		if _, err := ncdomain.ParseDSAlgorithms(s); err == nil {
+			t.Errorf("%q was accepted", s)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package ncdomain
+
+import "fmt"
+import "sort"
+import "strings"
+import "github.com/miekg/dns"
+import "github.com/namecoin/ncdns/util"
+
+// Checks that the delegations of v and of the names beneath it once they have
+// been normalized have glue for their in-bailiwick nameservers: those at or
+// below the delegated name, which are only found by the addresses given for
+// them in the value. A nameserver with no addresses is warned about, since
+// the delegation can't be followed to it, as is one with addresses of only one
+// family. Nameservers elsewhere need no glue and aren't checked. suffix is
+// the FQDN of v; apexSuffix that of the Namecoin name.
+func (v *Value) checkGlue(suffix, apexSuffix string, errFunc ErrorFunc, loc parseLocation) {
+	errFunc = loc.wrapErrorFunc(errFunc)
+
+	if len(v.NS) > 0 {
+		seen := map[string]bool{}
+		for _, ns := range v.NS {
+			target, ok := v.qualify(ns, suffix, apexSuffix)
+			if !ok || !dns.IsSubDomain(suffix, target) || seen[strings.ToLower(target)] {
+				continue
+			}
+			seen[strings.ToLower(target)] = true
+
+			var has4, has6 bool
+			rel := strings.TrimSuffix(strings.TrimSuffix(strings.ToLower(target), strings.ToLower(suffix)), ".")
+			if sub, err := v.findSubdomainByName(rel); err == nil {
+				has4, has6 = len(sub.IP) > 0, len(sub.IP6) > 0
+			}
+
+			name := strings.TrimSuffix(target, ".")
+			switch {
+			case !has4 && !has6:
+				errFunc.addWarning(fmt.Errorf("in-zone nameserver %s has no address records; delegation will not resolve", name))
+			case !has6:
+				errFunc.addWarning(fmt.Errorf("in-zone nameserver %s has IPv4 but no IPv6 address records; resolvers with only IPv6 can't follow the delegation to it", name))
+			case !has4:
+				errFunc.addWarning(fmt.Errorf("in-zone nameserver %s has IPv6 but no IPv4 address records; resolvers with only IPv4 can't follow the delegation to it", name))
+			}
+		}
+
+		// Nothing below a delegation is published, but for glue.
+		return
+	}
+
+	keys := make([]string, 0, len(v.Map))
+	for k := range v.Map {
+		if util.ValidateOwnerLabel(k) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		v.Map[k].checkGlue(k+"."+suffix, apexSuffix, errFunc, loc.mapItem(k))
+	}
+}
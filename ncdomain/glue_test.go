@@ -0,0 +1,74 @@
+package ncdomain_test
+
+import "strings"
+import "testing"
+import "github.com/namecoin/ncdns/ncdomain"
+
+// Nameservers at or below the names they serve are warned about unless the
+// value gives them addresses of both families; others need no glue.
+func TestGlueValidation(t *testing.T) {
+	fixtures := []struct {
+		conflict string
+		value    string
+		expected []string
+	}{
+		{
+			"full glue",
+			`{"ns":["ns1.example.bit.","ns2"],"map":{"ns1":{"ip":"192.0.2.1","ip6":"2001:db8::1"},"ns2":{"ip":["192.0.2.2"],"ip6":["2001:db8::2"]}}}`,
+			nil,
+		},
+		{
+			"missing glue",
+			`{"ns":["ns1.example.bit.","ns2.example.com."]}`,
+			[]string{"d/example: in-zone nameserver ns1.example.bit has no address records; delegation will not resolve"},
+		},
+		{
+			"missing glue beneath the name",
+			`{"ip":"192.0.2.9","map":{"sub":{"ns":["ns1.sub.example.bit.","ns1.sub.example.bit."],"map":{"ns1":{"txt":"no addresses"}}}}}`,
+			[]string{"d/example: map.sub: in-zone nameserver ns1.sub.example.bit has no address records; delegation will not resolve"},
+		},
+		{
+			"partial glue",
+			`{"ns":["ns1.example.bit.","ns2"],"map":{"ns1":{"ip":"192.0.2.1"},"ns2":{"ip6":"2001:db8::2"}}}`,
+			[]string{
+				"d/example: in-zone nameserver ns1.example.bit has IPv4 but no IPv6 address records; resolvers with only IPv6 can't follow the delegation to it",
+				"d/example: in-zone nameserver ns2.example.bit has IPv6 but no IPv4 address records; resolvers with only IPv4 can't follow the delegation to it",
+			},
+		},
+		{
+			"out-of-bailiwick nameservers",
+			`{"ns":["ns1.example.com.","ns1.other.bit."]}`,
+			nil,
+		},
+		{
+			"nameserver elsewhere in the name",
+			`{"ip":"192.0.2.9","map":{"sub":{"ns":["ns1.example.bit."]},"ns1":{"txt":"served by ncdns, not glue"}}}`,
+			nil,
+		},
+	}
+
+	for _, f := range fixtures {
+		var warnings []string
+		errFunc := func(err error, isWarning bool) {
+			if !isWarning {
+				t.Errorf("%s: unexpected error %v", f.conflict, err)
+			}
+			// Delegations giving glue in a map are warned about too.
+			if strings.Contains(err.Error(), "in-zone nameserver") {
+				warnings = append(warnings, err.Error())
+			}
+		}
+
+		ncdomain.ParseValue("d/example", f.value, nil, errFunc)
+		if strings.Join(warnings, "\n") != strings.Join(f.expected, "\n") {
+			t.Errorf("%s: got warnings %q, expected %q", f.conflict, warnings, f.expected)
+		}
+	}
+
+	// Values of names which aren't domains aren't checked.
+	var warnings int
+	ncdomain.ParseValue("dd/example", `{"ns":["ns1.example.bit."]}`, nil, func(err error, isWarning bool) { warnings++ })
+	if warnings != 0 {
+		t.Errorf("got %d warnings for a value outside d/", warnings)
+	}
+}
@@ -0,0 +1,121 @@
+package ncdomain
+
+import "fmt"
+import "strings"
+
+// Some old values still carry fields of the original (2011) domain name
+// specification, which nmcontrol understood but which were later replaced or
+// dropped. Unless ParseOptions.IgnoreLegacyFields is set, they are handled as
+// follows:
+//
+//   "service": [[service, protocol, priority, weight, port, target], ...]
+//     Translated to SRV records under map._protocol.map._service, as if given
+//     there as "srv": [[priority, weight, port, target], ...]. A relative
+//     target is relative to the name the field appears in, which can only be
+//     expressed at the top level of a value.
+//
+//   "fingerprint": [SHA-1 fingerprint, ...]
+//     Dropped. SHA-1 certificate fingerprints have no TLSA equivalent.
+//
+//   "i2p", "freenet"
+//     Dropped. These give addresses on other networks, which have no DNS
+//     meaning.
+//
+// Records given in the modern form take precedence over translated ones. A
+// warning is reported for each legacy field found, and records translated from
+// them are marked as such in their provenance.
+
+func parseLegacyFields(rv map[string]interface{}, v *Value, errFunc ErrorFunc, depth int, loc parseLocation) {
+	parseLegacyService(rv, v, errFunc, depth, loc)
+
+	dropped := []struct {
+		present     bool
+		key, reason string
+	}{
+		{rv["fingerprint"] != nil, "fingerprint", "SHA-1 certificate fingerprints have no TLSA equivalent; use tls instead"},
+		{rv["i2p"] != nil, "i2p", "I2P addresses have no DNS meaning"},
+		{rv["freenet"] != nil, "freenet", "Freenet keys have no DNS meaning"},
+	}
+	for _, d := range dropped {
+		if d.present {
+			errFunc.addWarning(fmt.Errorf("ignoring legacy %s field: %s", d.key, d.reason))
+		}
+	}
+}
+
+func parseLegacyService(rv map[string]interface{}, v *Value, errFunc ErrorFunc, depth int, loc parseLocation) {
+	rsvc, ok := rv["service"]
+	if !ok || rsvc == nil {
+		return
+	}
+
+	sa, ok := rsvc.([]interface{})
+	if !ok {
+		errFunc.add(fmt.Errorf("malformed legacy service value"))
+		return
+	}
+
+	for i, s := range sa {
+		prov := loc.item("service", i)
+		prov.Legacy = true
+
+		svca, ok := s.([]interface{})
+		if !ok || len(svca) < 6 {
+			errFunc.add(fmt.Errorf("malformed legacy service value: must have six items"))
+			continue
+		}
+
+		svcName, err := convServiceValue(svca[0])
+		if err != nil {
+			errFunc.add(err)
+			continue
+		}
+
+		proto, ok := svca[1].(string)
+		if !ok {
+			errFunc.add(fmt.Errorf("malformed legacy service value: second item must be a string (transport protocol)"))
+			continue
+		}
+
+		svcLabel, protoLabel := "_"+strings.ToLower(svcName), "_"+strings.ToLower(proto)
+
+		item := append([]interface{}{}, svca[2:6]...)
+		if target, ok := item[3].(string); ok && !strings.HasSuffix(target, ".") && target != "@" && !strings.HasSuffix(target, ".@") {
+			if depth > 0 {
+				errFunc.add(fmt.Errorf("relative target in legacy service field is only supported at the top level of a value"))
+				continue
+			}
+			if target == "" {
+				item[3] = "@"
+			} else {
+				item[3] = target + ".@"
+			}
+		}
+
+		tmp := &Value{}
+		parseSingleService(rv, item, tmp, errFunc, "", prov)
+		if len(tmp.SRV) == 0 {
+			continue
+		}
+
+		sv := v.subValue(protoLabel).subValue(svcLabel)
+		sv.SRV = append(sv.SRV, tmp.SRV...)
+		sv.addProvenance("SRV", tmp.provenance("SRV", 0))
+		errFunc.addWarning(fmt.Errorf("translated item %d of legacy service field to an SRV record under map.%s.map.%s", i, protoLabel, svcLabel))
+	}
+}
+
+// Returns the value of a map item, creating it if necessary.
+func (v *Value) subValue(key string) *Value {
+	if v.Map == nil {
+		v.Map = make(map[string]*Value)
+	}
+
+	sub, ok := v.Map[key]
+	if !ok {
+		sub = &Value{}
+		v.Map[key] = sub
+	}
+
+	return sub
+}
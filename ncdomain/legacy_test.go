@@ -0,0 +1,84 @@
+package ncdomain_test
+
+import "encoding/json"
+import "fmt"
+import "io/ioutil"
+import "reflect"
+import "sort"
+import "strings"
+import "testing"
+import "github.com/namecoin/ncdns/ncdomain"
+
+// Each legacy field mapping is exercised by a case in testdata/legacy.json,
+// which is parsed with legacy field support on and off.
+func TestLegacyFields(t *testing.T) {
+	fixture, err := ioutil.ReadFile("testdata/legacy.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var cases []struct {
+		ID             string                     `json:"id"`
+		Names          map[string]json.RawMessage `json:"names"`
+		Value          json.RawMessage            `json:"value"`
+		Records        []string                   `json:"records"`
+		Errors         []string                   `json:"errors"`
+		IgnoredRecords []string                   `json:"ignored_records"`
+	}
+	if err := json.Unmarshal(fixture, &cases); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range cases {
+		resolve := func(name string) (string, error) {
+			v, ok := c.Names[name]
+			if !ok {
+				return "", fmt.Errorf("not found")
+			}
+			return string(v), nil
+		}
+
+		parse := func(ignore bool) (records, errs []string) {
+			errFunc := func(err error, isWarning bool) {
+				kind := "error"
+				if isWarning {
+					kind = "warning"
+				}
+				errs = append(errs, kind+": "+err.Error())
+			}
+			v := ncdomain.ParseValueWithOptions("d/example", string(c.Value), resolve, errFunc, &ncdomain.ParseOptions{
+				IgnoreLegacyFields: ignore,
+			})
+			recs, err := v.RecordsRecursive(nil, "example.bit.", "example.bit.")
+			if err != nil {
+				t.Fatalf("%s: %v", c.ID, err)
+			}
+			for _, r := range recs {
+				s := strings.Replace(r.RR.String(), "\t", " ", -1)
+				if r.Provenance.Legacy {
+					s += " ; legacy " + r.Provenance.Path
+				}
+				records = append(records, s)
+			}
+			sort.Strings(records)
+			return
+		}
+
+		records, errs := parse(false)
+		if !reflect.DeepEqual(records, c.Records) {
+			t.Errorf("%s: records\n%s\nexpected\n%s", c.ID, strings.Join(records, "\n"), strings.Join(c.Records, "\n"))
+		}
+		if !reflect.DeepEqual(errs, c.Errors) {
+			t.Errorf("%s: errors\n%s\nexpected\n%s", c.ID, strings.Join(errs, "\n"), strings.Join(c.Errors, "\n"))
+		}
+
+		// Without legacy field support, the fields are silently ignored.
+		records, errs = parse(true)
+		if !reflect.DeepEqual(records, c.IgnoredRecords) {
+			t.Errorf("%s: records when ignoring legacy fields\n%s\nexpected\n%s", c.ID, strings.Join(records, "\n"), strings.Join(c.IgnoredRecords, "\n"))
+		}
+		if len(errs) != 0 {
+			t.Errorf("%s: errors when ignoring legacy fields\n%s", c.ID, strings.Join(errs, "\n"))
+		}
+	}
+}
@@ -0,0 +1,287 @@
+package ncdomain
+
+import "fmt"
+import "sort"
+import "strings"
+
+// Normalizes v and its subdomains once everything they import has been merged
+// into them, and before records are generated from their tor fields, reporting
+// what is dropped along with where it came from:
+//
+//   - A record given more than once at a name, e.g. by the name itself and by
+//     a value it imports, is kept only once: as the name's own if the name
+//     gives it, and otherwise as given first.
+//
+//   - An NS, DNAME or CNAME record which the name only imports is ignored if
+//     the name gives itself records it would occlude, so that what a value
+//     imports never hides what it gives itself.
+//
+//   - Otherwise, records which can't coexist at a name are resolved in this
+//     order of
+//     precedence, those of lower precedence being ignored:
+//
+//     1. NS records: a delegated name has no records of its own but NS and
+//     DS, and no subdomains. Addresses of its nameservers at or below it are
+//     kept, but only as glue (see appendGlue).
+//     2. A DNAME (translate): the name has no records but DNAME and DS, and
+//     no subdomains (nor onion service records), since the DNAME occludes
+//     them.
+//     3. A CNAME (alias): the name has no records but CNAME and DS. Its
+//     subdomains are kept.
+//
+// Single-valued fields given more than once aren't dealt with here, since by
+// now only the one parsed last is left; see warnReplaced.
+//
+// The result depends only on v, so the same value is always normalized the
+// same way.
+func (v *Value) normalize(errFunc ErrorFunc, loc parseLocation) {
+	errFunc = loc.wrapErrorFunc(errFunc)
+
+	// The records from any other source than loc's, the name being
+	// parsed, were imported.
+	v.removeDuplicates(errFunc, loc.source)
+	v.yieldImported(errFunc, loc.source)
+
+	fields := v.occludableFields()
+	switch {
+	case len(v.NS) > 0:
+		v.warnOccludedGlue(errFunc, "the name is delegated by its ns field", "NS", fields, glueFields)
+		return
+	case v.HasTranslate:
+		v.warnOccluded(errFunc, "the name is translated by its translate field", "Translate", fields, "translate")
+		v.Map = nil
+		v.Tor, v.TorPort = "", 0
+		return
+	case v.HasAlias:
+		v.warnOccluded(errFunc, "the name is aliased by its alias field", "Alias", fields, "alias", "translate", "tor", "map")
+	}
+
+	keys := make([]string, 0, len(v.Map))
+	for k := range v.Map {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		v.Map[k].normalize(errFunc, loc.mapItem(k))
+	}
+}
+
+// A field of Value which the record of higher precedence at a name may cause
+// to be ignored.
+type occludedField struct {
+	key   string // as in JSON, e.g. "ip"
+	field string // name of the field of Value, for its provenance
+	set   bool
+}
+
+// Returns the fields of v which may be ignored, in the order they are
+// reported.
+func (v *Value) occludableFields() []occludedField {
+	return []occludedField{
+		{"ip", "IP", len(v.IP) > 0},
+		{"ip6", "IP6", len(v.IP6) > 0},
+		{"alias", "Alias", v.HasAlias},
+		{"translate", "Translate", v.HasTranslate},
+		{"txt", "TXT", len(v.TXT) > 0},
+		{"mx", "MX", len(v.MX) > 0},
+		{"srv", "SRV", len(v.SRV) > 0},
+		{"tls", "TLSA", len(v.TLSA) > 0},
+		{"tor", "Tor", v.Tor != ""},
+		{"map", "", len(v.Map) > 0},
+	}
+}
+
+// Ignores each NS, DNAME and CNAME record of v which came only from values the
+// name imports, rather than from primary, the name itself, if primary gives
+// records at v which it would occlude.
+func (v *Value) yieldImported(errFunc ErrorFunc, primary string) {
+	for _, o := range []struct {
+		key, field string
+		set        bool
+		kept       []string // as for warnOccluded
+		ignore     func()
+	}{
+		{"ns", "NS", len(v.NS) > 0, nil, func() { v.NS = nil }},
+		{"translate", "Translate", v.HasTranslate, []string{"translate"}, func() { v.Translate, v.HasTranslate = "", false }},
+		{"alias", "Alias", v.HasAlias, []string{"alias", "translate", "tor", "map"}, func() { v.Alias, v.HasAlias = "", false }},
+	} {
+		if !o.set || !v.onlyImported(o.field, primary) {
+			continue
+		}
+		own, ok := v.ownField(primary, o.kept)
+		if !ok {
+			continue
+		}
+
+		errFunc.addWarning(fmt.Errorf("ignoring %s%s: it was imported, and would hide the name's own %s%s", o.key, v.provenanceNote(o.field), own.key, v.provenanceNote(own.field)))
+		o.ignore()
+		v.resetProvenance(o.field)
+	}
+}
+
+// Returns true if the records of the given field all came from other values
+// than primary's. Fields without provenance aren't known to be imported.
+func (v *Value) onlyImported(field, primary string) bool {
+	ps := v.Provenance[field]
+	for _, p := range ps {
+		if p.Source == "" || p.Source == primary {
+			return false
+		}
+	}
+	return len(ps) > 0
+}
+
+// Returns the first field of v, other than those whose keys are in kept,
+// with a record from primary.
+func (v *Value) ownField(primary string, kept []string) (occludedField, bool) {
+	for _, f := range v.occludableFields() {
+		if !f.set || f.field == "" || containsString(kept, f.key) {
+			continue
+		}
+		for _, p := range v.Provenance[f.field] {
+			if p.Source == primary {
+				return f, true
+			}
+		}
+	}
+	return occludedField{}, false
+}
+
+// The fields of a delegated name from which glue may be taken.
+var glueFields = []string{"ip", "ip6", "map"}
+
+// Warns that the fields which are set, other than those whose keys are kept,
+// are ignored because of the record given by the field by.
+func (v *Value) warnOccluded(errFunc ErrorFunc, reason, by string, fields []occludedField, kept ...string) {
+	v.warnOccludedGlue(errFunc, reason, by, fields, nil, kept...)
+}
+
+// Like warnOccluded, but fields whose keys are in glue are only partly
+// ignored, since glue may still be taken from them, and the warning says so.
+func (v *Value) warnOccludedGlue(errFunc ErrorFunc, reason, by string, fields []occludedField, glue []string, kept ...string) {
+	var ignored []string
+	partly := false
+	for _, f := range fields {
+		if !f.set || containsString(kept, f.key) {
+			continue
+		}
+		ignored = append(ignored, f.key+v.provenanceNote(f.field))
+		partly = partly || containsString(glue, f.key)
+	}
+	if len(ignored) == 0 {
+		return
+	}
+
+	msg := fmt.Sprintf("ignoring %s: %s%s", strings.Join(ignored, ", "), reason, v.provenanceNote(by))
+	if partly {
+		msg += "; addresses of any of its nameservers at or below it are still published as glue"
+	}
+	errFunc.addWarning(fmt.Errorf("%s", msg))
+}
+
+// Returns where the first record of the given field came from, in
+// parentheses with a leading space, or "" if that isn't known.
+func (v *Value) provenanceNote(field string) string {
+	if field == "" {
+		return ""
+	}
+	p := v.provenance(field, 0)
+	if p.Source == "" {
+		return ""
+	}
+	return " (" + p.String() + ")"
+}
+
+func containsString(a []string, s string) bool {
+	for _, x := range a {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Removes the records of each multi-valued field of v which are the same as an
+// earlier record of the field. The record kept is the first one, but if a
+// later one came from primary, the name itself, it's kept as that one. Names
+// are compared as given, so a relative name and the absolute name it stands
+// for aren't recognised as the same.
+func (v *Value) removeDuplicates(errFunc ErrorFunc, primary string) {
+	for _, f := range []struct {
+		key, field string
+		keys       []string
+		remove     func(i int)
+	}{
+		{"ip", "IP", keysOf(len(v.IP), func(i int) string { return v.IP[i].String() }), func(i int) { v.IP = append(v.IP[:i], v.IP[i+1:]...) }},
+		{"ip6", "IP6", keysOf(len(v.IP6), func(i int) string { return v.IP6[i].String() }), func(i int) { v.IP6 = append(v.IP6[:i], v.IP6[i+1:]...) }},
+		{"ns", "NS", v.NS, func(i int) { v.NS = append(v.NS[:i], v.NS[i+1:]...) }},
+		{"ds", "DS", keysOf(len(v.DS), func(i int) string { return v.DS[i].String() }), func(i int) { v.DS = append(v.DS[:i], v.DS[i+1:]...) }},
+		{"txt", "TXT", keysOf(len(v.TXT), func(i int) string { return fmt.Sprintf("%q", v.TXT[i]) }), func(i int) { v.TXT = append(v.TXT[:i], v.TXT[i+1:]...) }},
+		{"srv", "SRV", keysOf(len(v.SRV), func(i int) string { return v.SRV[i].String() }), func(i int) { v.SRV = append(v.SRV[:i], v.SRV[i+1:]...) }},
+		{"mx", "MX", keysOf(len(v.MX), func(i int) string { return v.MX[i].String() }), func(i int) { v.MX = append(v.MX[:i], v.MX[i+1:]...) }},
+		{"tls", "TLSA", keysOf(len(v.TLSA), func(i int) string { return v.TLSA[i].String() }), func(i int) { v.TLSA = append(v.TLSA[:i], v.TLSA[i+1:]...) }},
+	} {
+		first := map[string]int{}
+		var dups []int
+		for i, k := range f.keys {
+			j, ok := first[k]
+			if !ok {
+				first[k] = i
+				continue
+			}
+
+			dups = append(dups, i)
+			if ps := v.Provenance[f.field]; i < len(ps) && ps[i].Source == primary && ps[j].Source != primary {
+				// The records are the same, so only their provenance
+				// needs swapping.
+				ps[i], ps[j] = ps[j], ps[i]
+			}
+			msg := fmt.Sprintf("ignoring duplicate %s record", f.key)
+			if p := v.provenance(f.field, i); p.Source != "" {
+				msg += " from " + p.String()
+			}
+			if p := v.provenance(f.field, j); p.Source != "" {
+				msg += ", already given by " + p.String()
+			}
+			errFunc.addWarning(fmt.Errorf("%s", msg))
+		}
+
+		// Remove from the end, so that the indices of those still to be
+		// removed stay the same.
+		for n := len(dups) - 1; n >= 0; n-- {
+			i := dups[n]
+			f.remove(i)
+			if ps := v.Provenance[f.field]; i < len(ps) {
+				v.Provenance[f.field] = append(ps[:i], ps[i+1:]...)
+			}
+		}
+	}
+}
+
+func keysOf(n int, key func(i int) string) []string {
+	keys := make([]string, n)
+	for i := range keys {
+		keys[i] = key(i)
+	}
+	return keys
+}
+
+// Warns, before the single-valued field with the given key is set from prov,
+// if it was already given a different value by another object, e.g. one the
+// name imports. The value parsed last is the one used: the name's own fields
+// are parsed after its imports, which are parsed in the order they are listed,
+// so a name's own value replaces what it imports, and a later import replaces
+// an earlier one.
+//
+// The "email" field is the hostmaster of the SOA record of the name's zone, so
+// this is how conflicting SOA records given by merged values are reported.
+func (v *Value) warnReplaced(errFunc ErrorFunc, key, field string, replaced bool, prov Provenance) {
+	if !replaced {
+		return
+	}
+	old := v.provenance(field, 0)
+	if old.Source == "" || old == prov {
+		return
+	}
+	errFunc.addWarning(fmt.Errorf("%s field from %v replaces the one from %v", key, prov, old))
+}
@@ -0,0 +1,25 @@
+package ncdomain_test
+
+import "strings"
+import "testing"
+
+// Each fixture brings about one kind of conflict through imports. The records
+// served and the warnings reported must be the same every time.
+func TestConflicts(t *testing.T) {
+	var fixtures []fixture
+	readFixture(t, "testdata/conflicts.json", &fixtures)
+
+	var out []string
+	for _, f := range fixtures {
+		got := f.dump(t)
+		for i := 0; i < 10; i++ {
+			if again := f.dump(t); again != got {
+				t.Errorf("%s: parsing again gave\n%s\nrather than\n%s", f.Conflict, again, got)
+				break
+			}
+		}
+		out = append(out, "== "+f.Conflict+"\n"+got)
+	}
+
+	checkGolden(t, "testdata/conflicts.golden", strings.Join(out, "\n"))
+}
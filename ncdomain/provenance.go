@@ -0,0 +1,163 @@
+package ncdomain
+
+import "fmt"
+import "strconv"
+import "strings"
+import "github.com/miekg/dns"
+
+// Provenance describes where a record in a Value came from.
+type Provenance struct {
+	// The Namecoin name whose value contained the record (e.g. "d/example").
+	// This differs from the name being parsed if the record was imported, and
+	// is a URL if it was included with "include_url".
+	Source string `json:"source"`
+
+	// The location of the record within that value, e.g. "map.www.ip[1]".
+	Path string `json:"path"`
+
+	// Set if the record was truncated or otherwise altered to make it
+	// acceptable, so that it doesn't exactly match what the value says.
+	Modified bool `json:"modified,omitempty"`
+
+	// Set if the record was translated from a field of the original domain
+	// name specification which has since been replaced.
+	Legacy bool `json:"legacy,omitempty"`
+}
+
+func (p Provenance) String() string {
+	if p.Path == "" {
+		return p.Source
+	}
+	return p.Source + " at " + p.Path
+}
+
+// A Record is a resource record synthesized from a Value, together with where
+// it came from.
+type Record struct {
+	RR         dns.RR
+	Provenance Provenance
+}
+
+// Identifies the JSON object being parsed, for provenance and error messages.
+type parseLocation struct {
+	source string // Namecoin name, or URL of an included document
+	path   string // path of the object within the name's value; "" for the top level
+}
+
+// Returns the location of the value of the given key of the "map" item.
+func (l parseLocation) mapItem(key string) parseLocation {
+	return parseLocation{
+		source: l.source,
+		path:   l.join("map") + pathKey(key),
+	}
+}
+
+func (l parseLocation) join(key string) string {
+	if l.path == "" {
+		return key
+	}
+	return l.path + "." + key
+}
+
+// Map keys which wouldn't be readable in a dotted path are quoted.
+func pathKey(key string) string {
+	if key == "" || strings.ContainsAny(key, ".[]\" ") {
+		return "[" + strconv.Quote(key) + "]"
+	}
+	return "." + key
+}
+
+// Returns the provenance of the value of the given field, which has a single
+// value.
+func (l parseLocation) field(key string) Provenance {
+	return Provenance{Source: l.source, Path: l.join(key)}
+}
+
+// Returns the provenance of the i-th item of the given field.
+func (l parseLocation) item(key string, i int) Provenance {
+	return Provenance{Source: l.source, Path: l.join(key) + "[" + strconv.Itoa(i) + "]"}
+}
+
+func (l parseLocation) String() string {
+	if l.path == "" {
+		return l.source
+	}
+	return l.source + ": " + l.path
+}
+
+// An error or warning noted while parsing a given object.
+type locatedError struct {
+	loc parseLocation
+	err error
+}
+
+func (e *locatedError) Error() string {
+	return fmt.Sprintf("%v: %v", e.loc, e.err)
+}
+
+// Wraps errFunc so that errors are reported along with the location of the
+// object being parsed. Errors already located by a nested object are passed
+// through unchanged.
+func (l parseLocation) wrapErrorFunc(errFunc ErrorFunc) ErrorFunc {
+	if errFunc == nil || l.source == "" {
+		return errFunc
+	}
+
+	return func(err error, isWarning bool) {
+		if _, ok := err.(*locatedError); !ok {
+			err = &locatedError{loc: l, err: err}
+		}
+		errFunc(err, isWarning)
+	}
+}
+
+// Provenance is tracked per field of Value, as a slice parallel to the field's
+// own slice (or of length one for single-valued fields). The fields are named
+// after those of Value, e.g. "IP".
+
+func (v *Value) addProvenance(field string, p Provenance) {
+	if v.Provenance == nil {
+		v.Provenance = map[string][]Provenance{}
+	}
+	v.Provenance[field] = append(v.Provenance[field], p)
+}
+
+func (v *Value) setProvenance(field string, p Provenance) {
+	v.resetProvenance(field)
+	v.addProvenance(field, p)
+}
+
+func (v *Value) resetProvenance(field string) {
+	delete(v.Provenance, field)
+}
+
+// Marks the i-th record of the given field as modified.
+func (v *Value) markModified(field string, i int) {
+	if ps := v.Provenance[field]; i < len(ps) {
+		ps[i].Modified = true
+	}
+}
+
+// Returns the provenance of the i-th record of the given field. Values which
+// weren't produced by the parser have no provenance.
+func (v *Value) provenance(field string, i int) Provenance {
+	if ps := v.Provenance[field]; i < len(ps) {
+		return ps[i]
+	}
+	return Provenance{}
+}
+
+// Copies the provenance of a field from another value, for use when the field
+// itself is copied.
+func (v *Value) copyProvenance(from *Value, field string) {
+	v.resetProvenance(field)
+	for _, p := range from.Provenance[field] {
+		v.addProvenance(field, p)
+	}
+}
+
+// Returns true if f isn't exactly representable as a value of the given
+// number of bits, and so will be altered when converted.
+func truncatesInt(f float64, bits uint) bool {
+	return f < 0 || f >= float64(uint64(1)<<bits) || f != float64(uint64(f))
+}
@@ -0,0 +1,107 @@
+package ncdomain_test
+
+import "encoding/json"
+import "flag"
+import "fmt"
+import "io/ioutil"
+import "sort"
+import "strings"
+import "testing"
+import "github.com/namecoin/ncdns/ncdomain"
+
+var update = flag.Bool("update", false, "rewrite golden files")
+
+// An import-heavy value is parsed and each record is printed with where it
+// came from, along with any errors and warnings, and compared against a
+// golden file.
+func TestProvenance(t *testing.T) {
+	var f fixture
+	readFixture(t, "testdata/provenance.json", &f)
+	checkGolden(t, "testdata/provenance.golden", f.dump(t))
+}
+
+// A value to be parsed, along with the values of the names it imports.
+type fixture struct {
+	Conflict string            `json:"conflict,omitempty"` // what the fixture is for
+	Name     string            `json:"name"`
+	Names    map[string]string `json:"names"`
+
+	Options *ncdomain.ParseOptions `json:"options,omitempty"`
+}
+
+func readFixture(t *testing.T, path string, f interface{}) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(b, f); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Parses the fixture's value and returns its records, each with where it came
+// from, followed by any errors and warnings.
+func (f *fixture) dump(t *testing.T) string {
+	resolve := func(name string) (string, error) {
+		v, ok := f.Names[name]
+		if !ok {
+			return "", fmt.Errorf("not found")
+		}
+		return v, nil
+	}
+
+	var errs []string
+	errFunc := func(err error, isWarning bool) {
+		kind := "error"
+		if isWarning {
+			kind = "warning"
+		}
+		errs = append(errs, kind+": "+err.Error())
+	}
+
+	v := ncdomain.ParseValueWithOptions(f.Name, f.Names[f.Name], resolve, errFunc, f.Options)
+	if v == nil {
+		t.Fatalf("couldn't parse value")
+	}
+
+	recs, err := v.RecordsRecursive(nil, "example.bit.", "bit.")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var lines []string
+	for _, r := range recs {
+		line := fmt.Sprintf("%s\t; %s %s", r.RR, r.Provenance.Source, r.Provenance.Path)
+		if r.Provenance.Modified {
+			line += " (modified)"
+		}
+		lines = append(lines, line)
+	}
+	sort.Strings(lines)
+	sort.Strings(errs)
+
+	// The records must be those RRsRecursive would return.
+	rrs, _ := v.RRsRecursive(nil, "example.bit.", "bit.")
+	if len(rrs) != len(recs) {
+		t.Errorf("RRsRecursive returned %d records, but RecordsRecursive returned %d", len(rrs), len(recs))
+	}
+
+	return strings.Join(append(lines, errs...), "\n") + "\n"
+}
+
+func checkGolden(t *testing.T, golden, got string) {
+	if *update {
+		if err := ioutil.WriteFile(golden, []byte(got), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expected, err := ioutil.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got != string(expected) {
+		t.Errorf("records didn't match %s (run with -update to rewrite it):\n%s", golden, got)
+	}
+}
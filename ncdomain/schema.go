@@ -0,0 +1,205 @@
+package ncdomain
+
+import "sort"
+
+// A Field describes a field of a name value understood by ParseValue.
+type Field struct {
+	Name string `json:"name"`
+
+	// The JSON types the field accepts: "string", "number", "array" or
+	// "object".
+	Types []string `json:"types"`
+
+	Description string `json:"description"`
+
+	// Limits on the field's contents beyond its JSON type, if any.
+	Limits string `json:"limits,omitempty"`
+
+	// If set, the field is an alternative name for the given field.
+	AliasOf string `json:"alias_of,omitempty"`
+
+	// Set if the field's contents are themselves parsed as values (or pull in
+	// values from other names), so that the fields listed here apply
+	// recursively within it.
+	Recursive bool `json:"recursive,omitempty"`
+
+	// Set if the field is from the original domain name specification and
+	// has since been replaced or dropped. Such fields are only understood if
+	// legacy field support is enabled.
+	Legacy bool `json:"legacy,omitempty"`
+}
+
+// A Schema describes the name values understood by this version of the
+// parser. Every field may also appear in the values of subdomains given under
+// "map".
+type Schema struct {
+	ParserVersion    int     `json:"parser_version"`
+	MapDepthLimit    int     `json:"map_depth_limit"`
+	ImportDepthLimit int     `json:"import_depth_limit"`
+	Fields           []Field `json:"fields"`
+}
+
+var fields = map[string]*Field{}
+
+// Registers a field understood by the parser. Every field which the parser
+// reads must be registered; this is enforced by a test.
+func registerField(f *Field) {
+	if _, ok := fields[f.Name]; ok {
+		panic("ncdomain: field registered twice: " + f.Name)
+	}
+	fields[f.Name] = f
+}
+
+// ValueSchema returns a description of every field understood by the parser.
+func ValueSchema() *Schema {
+	s := &Schema{
+		ParserVersion:    ParserVersion,
+		MapDepthLimit:    depthLimit,
+		ImportDepthLimit: mergeDepthLimit,
+	}
+
+	for _, f := range fields {
+		s.Fields = append(s.Fields, *f)
+	}
+	sort.Slice(s.Fields, func(i, j int) bool {
+		return s.Fields[i].Name < s.Fields[j].Name
+	})
+
+	return s
+}
+
+func init() {
+	registerField(&Field{
+		Name:        "ip",
+		Types:       []string{"string", "array"},
+		Description: "IPv4 address or array of IPv4 addresses (A records)",
+	})
+	registerField(&Field{
+		Name:        "ip6",
+		Types:       []string{"string", "array"},
+		Description: "IPv6 address or array of IPv6 addresses (AAAA records)",
+	})
+	registerField(&Field{
+		Name:        "ns",
+		Types:       []string{"string", "array"},
+		Description: "Nameserver hostname or array of nameserver hostnames (NS records); delegates the name, so other record fields are ignored",
+		Limits:      "hostnames must be valid; relative names are relative to the name",
+	})
+	registerField(&Field{
+		Name:        "dns",
+		Types:       []string{"string", "array"},
+		Description: "Alternative name for ns, taking precedence over it",
+		AliasOf:     "ns",
+	})
+	registerField(&Field{
+		Name:        "alias",
+		Types:       []string{"string"},
+		Description: "Target of a CNAME record for the name; other record fields are ignored",
+		Limits:      "must be a valid domain name; relative names are relative to the name",
+	})
+	registerField(&Field{
+		Name:        "translate",
+		Types:       []string{"string"},
+		Description: "Target of a DNAME record for the name's subdomains",
+		Limits:      "must be a valid domain name; relative names are relative to the name",
+	})
+	registerField(&Field{
+		Name:        "email",
+		Types:       []string{"string"},
+		Description: "Hostmaster e. mail address",
+		Limits:      "must be a valid e. mail address",
+	})
+	registerField(&Field{
+		Name:        "ds",
+		Types:       []string{"array"},
+		Description: "Array of DS records, each [key tag, algorithm, digest type, base64 digest]; records naming algorithms resolvers aren't expected to implement are ignored",
+	})
+	registerField(&Field{
+		Name:        "txt",
+		Types:       []string{"string", "array"},
+		Description: "TXT record string, or array of TXT records, each a string or an array of strings",
+		Limits:      "strings longer than 255 bytes are split; each record is truncated to 65535 bytes",
+	})
+	registerField(&Field{
+		Name:        "srv",
+		Types:       []string{"array"},
+		Description: "Array of SRV records, each [priority, weight, port, target hostname]; place under map keys such as _http._tcp",
+	})
+	registerField(&Field{
+		Name:        "mx",
+		Types:       []string{"array"},
+		Description: "Array of MX records, each [preference, mail server hostname]",
+	})
+	registerField(&Field{
+		Name:        "redirect",
+		Types:       []string{"string"},
+		Description: "URL to which web requests for the name may be redirected",
+		Limits:      "must be an absolute http or https URL without user information",
+	})
+	registerField(&Field{
+		Name:        "url",
+		Types:       []string{"string"},
+		Description: "Alternative name for redirect, used if redirect is absent",
+		Limits:      "must be an absolute http or https URL without user information",
+		AliasOf:     "redirect",
+	})
+	registerField(&Field{
+		Name:        "tor",
+		Types:       []string{"string"},
+		Description: "Onion service alternative to the name, as \"address.onion\" or \"address.onion:port\"; published as a TXT record at _tor and, with a port, an SRV record at _tor._tcp",
+		Limits:      "v3 onion addresses only",
+	})
+	registerField(&Field{
+		Name:        "map",
+		Types:       []string{"object"},
+		Description: "Values of subdomains, keyed by label; \"*\" is a wildcard and \"\" applies to the name itself",
+		Limits:      "nesting is limited to map_depth_limit levels",
+		Recursive:   true,
+	})
+	registerField(&Field{
+		Name:        "service",
+		Types:       []string{"array"},
+		Description: "Array of SRV records, each [service, protocol, priority, weight, port, target hostname]; translated to srv under map._protocol.map._service",
+		Limits:      "relative targets only at the top level of a value",
+		Legacy:      true,
+	})
+	registerField(&Field{
+		Name:        "fingerprint",
+		Types:       []string{"array"},
+		Description: "Array of SHA-1 certificate fingerprints; ignored, as there is no TLSA equivalent",
+		Legacy:      true,
+	})
+	registerField(&Field{
+		Name:        "i2p",
+		Types:       []string{"object"},
+		Description: "I2P destination; ignored",
+		Legacy:      true,
+	})
+	registerField(&Field{
+		Name:        "freenet",
+		Types:       []string{"string"},
+		Description: "Freenet key; ignored",
+		Legacy:      true,
+	})
+	registerField(&Field{
+		Name:        "import",
+		Types:       []string{"string", "array"},
+		Description: "Name (e.g. \"dd/example\"), or array of [name] or [name, subdomain] items, whose values are merged into this one; fields given here override imported ones",
+		Limits:      "only names in the configured import namespaces; imports nest to at most import_depth_limit levels",
+		Recursive:   true,
+	})
+	registerField(&Field{
+		Name:        "include_url",
+		Types:       []string{"string", "array"},
+		Description: "URL, or array of URLs, of JSON objects merged into this value like imports, for private deployments keeping large record sets off-chain",
+		Limits:      "ignored with a warning unless the server allows URLs with the given prefix; nests like import",
+		Recursive:   true,
+	})
+	registerField(&Field{
+		Name:        "delegate",
+		Types:       []string{"string", "array"},
+		Description: "Like import, but the referenced value replaces this one entirely",
+		Limits:      "as for import",
+		Recursive:   true,
+	})
+}
@@ -0,0 +1,59 @@
+package ncdomain_test
+
+import "github.com/namecoin/ncdns/ncdomain"
+import "io/ioutil"
+import "path/filepath"
+import "regexp"
+import "strings"
+import "testing"
+
+// Fields are read from the JSON object as rv["field"], except for import and
+// delegate, whose field name is held in a variable.
+var reFieldRead = regexp.MustCompile(`\brvm?\["([a-z0-9_]+)"\]|\bxname :?= "([a-z0-9]+)"`)
+
+// Every field the parser reads must be registered in the schema, and every
+// registered field must be read by the parser.
+func TestSchemaComplete(t *testing.T) {
+	files, err := filepath.Glob("*.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	read := map[string]struct{}{}
+	for _, fn := range files {
+		if strings.HasSuffix(fn, "_test.go") ||
+			(tlsaDisabled && strings.HasSuffix(fn, "_tls.go")) ||
+			(!tlsaDisabled && strings.HasSuffix(fn, "_notls.go")) {
+			continue
+		}
+
+		b, err := ioutil.ReadFile(fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, m := range reFieldRead.FindAllStringSubmatch(string(b), -1) {
+			read[m[1]+m[2]] = struct{}{}
+		}
+	}
+
+	registered := map[string]struct{}{}
+	for _, f := range ncdomain.ValueSchema().Fields {
+		registered[f.Name] = struct{}{}
+		if f.Description == "" || len(f.Types) == 0 {
+			t.Errorf("field %q is registered without a description or types", f.Name)
+		}
+	}
+
+	for name := range read {
+		if _, ok := registered[name]; !ok {
+			t.Errorf("field %q is parsed but not registered in the schema", name)
+		}
+	}
+
+	for name := range registered {
+		if _, ok := read[name]; !ok {
+			t.Errorf("field %q is registered in the schema but never parsed", name)
+		}
+	}
+}
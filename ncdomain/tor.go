@@ -0,0 +1,129 @@
+package ncdomain
+
+import "fmt"
+import "strconv"
+import "strings"
+import "github.com/miekg/dns"
+
+// The "tor" field names an onion service which is an alternative to the name,
+// as "address.onion" or "address.onion:port". Unless ParseOptions says
+// otherwise, it is published so that Tor-aware clients can find it by DNS: the
+// address as a TXT record at _tor.NAME, and, if a port is given, an SRV record
+// at _tor._tcp.NAME.
+//
+// Only v3 onion addresses are accepted. Tor no longer supports v2 ones.
+
+const (
+	onionV3Length = 56 // base32 characters, encoding the key, a checksum and a version byte
+	onionV2Length = 16
+)
+
+func parseTor(rv map[string]interface{}, v *Value, errFunc ErrorFunc, loc parseLocation) {
+	rtor, ok := rv["tor"]
+	if !ok || rtor == nil {
+		return
+	}
+
+	v.Tor, v.TorPort = "", 0
+	v.resetProvenance("Tor")
+
+	s, ok := rtor.(string)
+	if !ok {
+		errFunc.add(fmt.Errorf("unknown tor field format"))
+		return
+	}
+
+	addr, port, err := parseOnionAddress(s)
+	if err != nil {
+		if _, ok := err.(onionV2Error); ok {
+			errFunc.addWarning(err)
+		} else {
+			errFunc.add(err)
+		}
+		return
+	}
+
+	v.Tor, v.TorPort = addr, port
+	prov := loc.field("tor")
+	prov.Modified = strings.ToLower(s) != s
+	v.setProvenance("Tor", prov)
+}
+
+// Returned by parseOnionAddress for a well-formed v2 onion address.
+type onionV2Error struct{}
+
+func (onionV2Error) Error() string {
+	return "not publishing v2 onion address in tor field: Tor no longer supports v2 onion services"
+}
+
+// Parses "address.onion" or "address.onion:port", returning the address in
+// lowercase.
+func parseOnionAddress(s string) (addr string, port uint16, err error) {
+	addr = strings.ToLower(s)
+	if i := strings.LastIndexByte(addr, ':'); i >= 0 {
+		p, err := strconv.ParseUint(addr[i+1:], 10, 16)
+		if err != nil || p == 0 {
+			return "", 0, fmt.Errorf("malformed port in tor field")
+		}
+		addr, port = addr[:i], uint16(p)
+	}
+
+	label := strings.TrimSuffix(addr, ".onion")
+	if label == addr || !isBase32(label) {
+		return "", 0, fmt.Errorf("malformed onion address in tor field")
+	}
+
+	switch len(label) {
+	case onionV3Length:
+		// The last character encodes the low bits of the version byte, 3.
+		if label[onionV3Length-1] != 'd' {
+			return "", 0, fmt.Errorf("malformed onion address in tor field: not version 3")
+		}
+		return addr, port, nil
+	case onionV2Length:
+		return "", 0, onionV2Error{}
+	default:
+		return "", 0, fmt.Errorf("malformed onion address in tor field")
+	}
+}
+
+func isBase32(s string) bool {
+	for _, c := range []byte(s) {
+		if (c < 'a' || c > 'z') && (c < '2' || c > '7') {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// Adds the records publishing the onion services of v and all of its
+// subdomains.
+func (v *Value) addTorRecords() {
+	for _, sub := range v.Map {
+		sub.addTorRecords()
+	}
+
+	if v.Tor == "" {
+		return
+	}
+
+	prov := v.provenance("Tor", 0)
+
+	txt := v.subValue("_tor")
+	txt.TXT = append(txt.TXT, []string{v.Tor})
+	txt.addProvenance("TXT", prov)
+
+	if v.TorPort != 0 {
+		srv := v.subValue("_tcp").subValue("_tor")
+		srv.SRV = append(srv.SRV, &dns.SRV{
+			Hdr: dns.RR_Header{
+				Rrtype: dns.TypeSRV,
+				Class:  dns.ClassINET,
+				Ttl:    defaultTTL,
+			},
+			Port:   v.TorPort,
+			Target: v.Tor + ".",
+		})
+		srv.addProvenance("SRV", prov)
+	}
+}
@@ -0,0 +1,80 @@
+package ncdomain_test
+
+import "sort"
+import "strings"
+import "testing"
+import "github.com/namecoin/ncdns/ncdomain"
+
+const onionV3 = "duckduckgogg42xjoc72x3sjasowoarfbgcmvfimaftt6twagswzczad.onion"
+
+func TestTorRecords(t *testing.T) {
+	tests := []struct {
+		value    string
+		records  []string
+		errors   int
+		warnings int
+	}{
+		{`{"tor":"` + onionV3 + `"}`, []string{
+			"_tor.example.bit. 600 IN TXT \"" + onionV3 + "\"",
+		}, 0, 0},
+		{`{"tor":"` + strings.ToUpper(onionV3) + `:443"}`, []string{
+			"_tor._tcp.example.bit. 600 IN SRV 0 0 443 " + onionV3 + ".",
+			"_tor.example.bit. 600 IN TXT \"" + onionV3 + "\"",
+		}, 0, 0},
+		{`{"map":{"www":{"tor":"` + onionV3 + `"}}}`, []string{
+			"_tor.www.example.bit. 600 IN TXT \"" + onionV3 + "\"",
+		}, 0, 0},
+		{`{"tor":"` + onionV3 + `","map":{"_tor":{"txt":"other"}}}`, []string{
+			"_tor.example.bit. 600 IN TXT \"" + onionV3 + "\"",
+			"_tor.example.bit. 600 IN TXT \"other\"",
+		}, 0, 0},
+
+		// legacy v2 address
+		{`{"tor":"eqt5g4fuenphqinx.onion"}`, nil, 0, 1},
+
+		// junk
+		{`{"tor":"example.com"}`, nil, 1, 0},
+		{`{"tor":"eqt5g4fuenphqinx1.onion"}`, nil, 1, 0},
+		{`{"tor":"` + strings.Replace(onionV3, "ad.onion", "aa.onion", 1) + `"}`, nil, 1, 0},
+		{`{"tor":"` + onionV3 + `:http"}`, nil, 1, 0},
+		{`{"tor":["` + onionV3 + `"]}`, nil, 1, 0},
+	}
+
+	for _, test := range tests {
+		errors, warnings := 0, 0
+		errFunc := func(err error, isWarning bool) {
+			if isWarning {
+				warnings++
+			} else {
+				errors++
+			}
+		}
+
+		v := ncdomain.ParseValue("d/example", test.value, nil, errFunc)
+		rrs, err := v.RRsRecursive(nil, "example.bit.", "example.bit.")
+		if err != nil {
+			t.Fatalf("%s: %v", test.value, err)
+		}
+		var records []string
+		for _, rr := range rrs {
+			records = append(records, strings.Replace(rr.String(), "\t", " ", -1))
+		}
+		sort.Strings(records)
+
+		if strings.Join(records, "\n") != strings.Join(test.records, "\n") {
+			t.Errorf("%s: records\n%s\nexpected\n%s", test.value, strings.Join(records, "\n"), strings.Join(test.records, "\n"))
+		}
+		if errors != test.errors || warnings != test.warnings {
+			t.Errorf("%s: %d errors and %d warnings, expected %d and %d", test.value, errors, warnings, test.errors, test.warnings)
+		}
+
+		// The records can be turned off.
+		v = ncdomain.ParseValueWithOptions("d/example", test.value, nil, nil, &ncdomain.ParseOptions{OmitTorRecords: true})
+		rrs, _ = v.RRsRecursive(nil, "example.bit.", "example.bit.")
+		for _, rr := range rrs {
+			if strings.HasPrefix(rr.Header().Name, "_tor.") && !strings.Contains(rr.String(), "other") {
+				t.Errorf("%s: published %v with tor records omitted", test.value, rr)
+			}
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package ncdumpzone
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"strings"
@@ -11,6 +12,7 @@ import (
 	"github.com/namecoin/ncbtcjson"
 	"github.com/namecoin/ncdns/namecoin"
 	"github.com/namecoin/ncdns/ncdomain"
+	"github.com/namecoin/ncdns/rrsort"
 	"github.com/namecoin/ncdns/rrtourl"
 	"github.com/namecoin/ncdns/tlsoverridefirefox"
 	"github.com/namecoin/ncdns/util"
@@ -20,6 +22,8 @@ var log, Log = xlog.New("ncdumpzone")
 
 const defaultPerCall uint32 = 1000
 
+const defaultProgressInterval = 10000
+
 func dumpRR(rr dns.RR, dest io.Writer, format string) error {
 	switch format {
 	case "zonefile":
@@ -42,7 +46,7 @@ func dumpRR(rr dns.RR, dest io.Writer, format string) error {
 }
 
 func dumpName(item *ncbtcjson.NameShowResult, conn *namecoin.Client,
-	dest io.Writer, format string) error {
+	dest io.Writer, format string, stats *Stats, signDS SignFunc, canonical bool) error {
 	// The order in which name_scan returns results is seemingly rather
 	// random, so we can't stop when we see a non-d/ name, so just skip it.
 	if !strings.HasPrefix(item.Name, "d/") {
@@ -58,9 +62,13 @@ func dumpName(item *ncbtcjson.NameShowResult, conn *namecoin.Client,
 		return conn.NameQuery(k, "")
 	}
 
+	// Names are dumped in spite of warnings, as they are served, e.g. a
+	// delegated name with addresses for glue.
 	var errors []error
 	errFunc := func(err error, isWarning bool) {
-		errors = append(errors, err)
+		if !isWarning {
+			errors = append(errors, err)
+		}
 	}
 
 	value := ncdomain.ParseValue(item.Name, item.Value, getNameFunc, errFunc)
@@ -70,6 +78,18 @@ func dumpName(item *ncbtcjson.NameShowResult, conn *namecoin.Client,
 
 	rrs, err := value.RRsRecursive(nil, suffix+".bit.", "bit.")
 	log.Warne(err, "error generating RRs")
+	stats.add(rrs)
+
+	if canonical {
+		rrsort.Sort(rrs)
+	}
+
+	if format == "zonefile" && signDS != nil {
+		rrs, err = appendDSSigs(rrs, signDS)
+		if err != nil {
+			return err
+		}
+	}
 
 	for _, rr := range rrs {
 		err = dumpRR(rr, dest, format)
@@ -81,34 +101,265 @@ func dumpName(item *ncbtcjson.NameShowResult, conn *namecoin.Client,
 	return nil
 }
 
+// Signs an RRset, returning its RRSIG.
+type SignFunc func(rrset []dns.RR) (*dns.RRSIG, error)
+
+// Returns rrs with the RRSIG of each DS RRset, made by sign, after the last
+// record of the RRset. Delegations are otherwise published unsigned, as in a
+// signed zone: the NS records at a delegation and glue aren't authoritative
+// data of the parent, so have no signatures.
+func appendDSSigs(rrs []dns.RR, sign SignFunc) ([]dns.RR, error) {
+	rrsets := map[string][]dns.RR{}
+	last := map[string]int{}
+	for i, rr := range rrs {
+		if rr.Header().Rrtype != dns.TypeDS {
+			continue
+		}
+		owner := strings.ToLower(rr.Header().Name)
+		rrsets[owner] = append(rrsets[owner], rr)
+		last[owner] = i
+	}
+	if len(rrsets) == 0 {
+		return rrs, nil
+	}
+
+	out := make([]dns.RR, 0, len(rrs)+len(rrsets))
+	for i, rr := range rrs {
+		out = append(out, rr)
+		if rr.Header().Rrtype != dns.TypeDS {
+			continue
+		}
+		owner := strings.ToLower(rr.Header().Name)
+		if last[owner] != i {
+			continue
+		}
+
+		sig, err := sign(rrsets[owner])
+		if err != nil {
+			return nil, fmt.Errorf("couldn't sign DS records of %s: %v", rr.Header().Name, err)
+		}
+		out = append(out, sig)
+	}
+
+	return out, nil
+}
+
+// Options for DumpWithOptions.
+type Options struct {
+	// Limits the rate at which names are fetched, and the number of dumps
+	// running at once. If nil, there are no limits.
+	Pacer *Pacer
+
+	// Progress is logged each time this many more names have been fetched.
+	// If zero, a default is used.
+	ProgressInterval int
+
+	// If set, the dump starts after this Namecoin name, as returned in
+	// Progress.Last by an earlier dump, rather than at the beginning.
+	After string
+
+	// If non-zero, the dump stops after this many domain names.
+	Limit int
+
+	// If set, the dump stops when the context is done.
+	Context context.Context
+
+	// If set, the DS records of delegated names in the zonefile format are
+	// signed with this, so that the delegations can be validated from the
+	// dump. Nothing else is signed.
+	SignDS SignFunc
+
+	// If set, the records of each name are written in canonical order (see
+	// package rrsort), rather than in the order the name's value gives them,
+	// which for subdomains differs from one dump to the next. This costs a
+	// sort of each name's records.
+	Canonical bool
+}
+
+// Counts of the domain names dumped, by the addresses they publish at the
+// name itself or any of its subdomains. Names whose values have errors aren't
+// dumped, and aren't counted.
+type Stats struct {
+	Names    int // all names
+	IPv4     int // names publishing A records
+	IPv6     int // names publishing AAAA records
+	IPv6Only int // names publishing AAAA records but no A records
+}
+
+func (st *Stats) add(rrs []dns.RR) {
+	var v4, v6 bool
+	for _, rr := range rrs {
+		switch rr.Header().Rrtype {
+		case dns.TypeA:
+			v4 = true
+		case dns.TypeAAAA:
+			v6 = true
+		}
+	}
+
+	st.Names++
+	if v4 {
+		st.IPv4++
+	}
+	if v6 {
+		st.IPv6++
+		if !v4 {
+			st.IPv6Only++
+		}
+	}
+}
+
+// Writes the counts, as the "stats" format does.
+func (st *Stats) write(dest io.Writer) {
+	percent := func(n int) float64 {
+		if st.Names == 0 {
+			return 0
+		}
+		return 100 * float64(n) / float64(st.Names)
+	}
+
+	fmt.Fprintf(dest, "names: %d\n", st.Names)
+	fmt.Fprintf(dest, "names with IPv4 addresses: %d (%.1f%%)\n", st.IPv4, percent(st.IPv4))
+	fmt.Fprintf(dest, "names with IPv6 addresses: %d (%.1f%%)\n", st.IPv6, percent(st.IPv6))
+	fmt.Fprintf(dest, "names with only IPv6 addresses: %d (%.1f%%)\n", st.IPv6Only, percent(st.IPv6Only))
+}
+
+// Where a dump stopped.
+type Progress struct {
+	// The last Namecoin name dumped. A dump with Options.After set to this
+	// carries on from the next name.
+	Last string
+
+	// The number of domain names dumped.
+	Names int
+
+	// Whether the dump reached the end of the names.
+	Complete bool
+
+	// Counts of the names dumped.
+	Stats Stats
+}
+
 // Dump extracts all domain names from conn, formats them according to the
-// specified format, and writes the result to dest.
+// specified format, and writes the result to dest. The "stats" format writes
+// counts of the names (see Stats) rather than their records, once the dump
+// stops.
 func Dump(conn *namecoin.Client, dest io.Writer, format string) error {
+	return DumpWithOptions(conn, dest, format, nil)
+}
+
+// Like Dump, but with options. opts may be nil.
+func DumpWithOptions(conn *namecoin.Client, dest io.Writer, format string, opts *Options) error {
+	_, err := DumpPage(conn, dest, format, opts)
+	return err
+}
+
+// Like DumpWithOptions, but returns where the dump stopped, so that another
+// dump can carry on from there. If the dump is cut short by Options.Context,
+// the context's error is returned along with the progress made.
+func DumpPage(conn *namecoin.Client, dest io.Writer, format string, opts *Options) (*Progress, error) {
 	if format != "zonefile" && format != "firefox-override" &&
-		format != "url-list" {
-		return fmt.Errorf("Invalid \"format\" argument: %s", format)
+		format != "url-list" && format != "stats" {
+		return nil, fmt.Errorf("Invalid \"format\" argument: %s", format)
+	}
+
+	progress, err := dumpPage(conn, dest, format, opts)
+	if format == "stats" && err == nil {
+		progress.Stats.write(dest)
+	}
+	return progress, err
+}
+
+func dumpPage(conn *namecoin.Client, dest io.Writer, format string, opts *Options) (*Progress, error) {
+	var signDS SignFunc
+	canonical := false
+	if opts != nil {
+		signDS, canonical = opts.SignDS, opts.Canonical
 	}
 
+	return walk(conn, opts, func(r *ncbtcjson.NameShowResult, progress *Progress) error {
+		return dumpName(r, conn, dest, format, &progress.Stats, signDS, canonical)
+	})
+}
+
+// WalkNames calls f with the name and data of each domain name (a Namecoin
+// name in the d/ namespace), in the order a dump would write them, e.g. to
+// convert them to records some other way. Expired names are included, with
+// Expired set. The options apply as they do to a dump, but for SignDS and Canonical; opts
+// may be nil. The progress returned has no Stats. If f returns an error, the walk stops there and returns it.
+func WalkNames(conn *namecoin.Client, opts *Options, f func(name string, nameData *namecoin.NameData) error) (*Progress, error) {
+	return walk(conn, opts, func(r *ncbtcjson.NameShowResult, progress *Progress) error {
+		if !strings.HasPrefix(r.Name, "d/") {
+			return nil
+		}
+
+		return f(r.Name, &namecoin.NameData{
+			Value:     r.Value,
+			ExpiresIn: r.ExpiresIn,
+			Expired:   r.Expired || r.ExpiresIn < 0,
+			Height:    r.Height,
+		})
+	})
+}
+
+// Calls visit with each name returned by name_scan, from opts.After on, until
+// the names run out or a limit of opts is reached.
+func walk(conn *namecoin.Client, opts *Options, visit func(r *ncbtcjson.NameShowResult, progress *Progress) error) (*Progress, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+	pacer := opts.Pacer
+	progressInterval := defaultProgressInterval
+	if opts.ProgressInterval > 0 {
+		progressInterval = opts.ProgressInterval
+	}
+	ctx := opts.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	pacer.acquire()
+	defer pacer.release()
+
+	progress := &Progress{Last: opts.After}
 	currentName := "d/"
 	continuing := 0
+	if opts.After != "" {
+		currentName = opts.After
+		continuing = 1
+	}
 	perCall := defaultPerCall
+	fetched, nextProgress := 0, progressInterval
 
 	for {
+		if err := ctx.Err(); err != nil {
+			return progress, err
+		}
+
 		results, err := conn.NameScan(currentName, perCall)
 		if err != nil {
-			return fmt.Errorf("scan: %s", err)
+			return progress, fmt.Errorf("scan: %s", err)
 		}
 
-		if len(results) <= continuing {
-			log.Info("out of results, stopping")
-			break
+		fetched += len(results)
+		if fetched >= nextProgress {
+			log.Infof("fetched %d names so far", fetched)
+			nextProgress = fetched + progressInterval
 		}
+		pacer.fetched(len(results))
 
-		// scan is [x,y] not (x,y], so exclude the first result
-		if continuing != 0 {
+		// scan is [x,y] not (x,y], so exclude the first result. A dump
+		// carrying on from an earlier one may start from a name which no
+		// longer exists, though.
+		if continuing != 0 && len(results) > 0 && results[0].Name == currentName {
 			results = results[1:]
-		} else {
-			continuing = 1
+		}
+		continuing = 1
+
+		if len(results) == 0 {
+			log.Info("out of results, stopping")
+			progress.Complete = true
+			break
 		}
 
 		// Temporary hack to fix
@@ -130,6 +381,7 @@ func Dump(conn *namecoin.Client, dest io.Writer, format string) error {
 			// at the end of the results, so not a problem.
 			if lenResults < int(perCall)-1 {
 				log.Info("out of results, stopping")
+				progress.Complete = true
 				break
 			}
 
@@ -141,14 +393,26 @@ func Dump(conn *namecoin.Client, dest io.Writer, format string) error {
 		for i := range results {
 			r := &results[i]
 
-			err = dumpName(r, conn, dest, format)
+			if opts.Limit > 0 && progress.Names >= opts.Limit && strings.HasPrefix(r.Name, "d/") {
+				return progress, nil
+			}
+			if err := ctx.Err(); err != nil {
+				return progress, err
+			}
+
+			err = visit(r, progress)
 			if err != nil {
-				return err
+				return progress, err
+			}
+
+			progress.Last = r.Name
+			if strings.HasPrefix(r.Name, "d/") {
+				progress.Names++
 			}
 		}
 
 		currentName = results[len(results)-1].Name
 	}
 
-	return nil
+	return progress, nil
 }
@@ -0,0 +1,470 @@
+package ncdumpzone
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/rpcclient"
+	"github.com/miekg/dns"
+
+	"github.com/namecoin/ncdns/clock"
+	"github.com/namecoin/ncdns/namecoin"
+)
+
+// A clock whose timers fire at once, moving the time forward to when they
+// were due.
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+type fakeTimer struct {
+	c chan time.Time
+}
+
+func (t fakeTimer) C() <-chan time.Time {
+	return t.c
+}
+
+func (fakeTimer) Stop() bool {
+	return false
+}
+
+func (fakeTimer) Reset(d time.Duration) bool {
+	panic("not used by the pacer")
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) NewTimer(d time.Duration) clock.Timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if at := c.now.Add(d); at.After(c.now) {
+		c.now = at
+	}
+	t := fakeTimer{make(chan time.Time, 1)}
+	t.c <- c.now
+	return t
+}
+
+func (c *fakeClock) NewTicker(d time.Duration) clock.Ticker {
+	panic("not used by the pacer")
+}
+
+type scanCall struct {
+	start string
+	at    time.Time
+}
+
+// A fake namecoind holding the given names, which returns at most pageSize
+// names from each name_scan call, and logs the calls. Names not in values
+// have the value {"ip":"192.0.2.1"}. Names in expired have expired.
+type fakeScanRPC struct {
+	names    []string
+	values   map[string]string
+	expired  map[string]bool
+	pageSize int
+	clock    *fakeClock
+
+	mu    sync.Mutex
+	calls []scanCall
+}
+
+func (f *fakeScanRPC) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	var call struct {
+		Method string            `json:"method"`
+		Params []json.RawMessage `json:"params"`
+		ID     interface{}       `json:"id"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&call); err != nil || call.Method != "name_scan" {
+		http.Error(rw, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	var start string
+	var count int
+	json.Unmarshal(call.Params[0], &start)
+	json.Unmarshal(call.Params[1], &count)
+
+	f.mu.Lock()
+	f.calls = append(f.calls, scanCall{start, f.clock.Now()})
+	f.mu.Unlock()
+
+	if count > f.pageSize {
+		count = f.pageSize
+	}
+	results := []map[string]interface{}{}
+	i := sort.SearchStrings(f.names, start)
+	for ; i < len(f.names) && len(results) < count; i++ {
+		value, ok := f.values[f.names[i]]
+		if !ok {
+			value = `{"ip":"192.0.2.1"}`
+		}
+		result := map[string]interface{}{
+			"name":       f.names[i],
+			"value":      value,
+			"expires_in": 1000,
+		}
+		if f.expired[f.names[i]] {
+			result["expires_in"] = -10
+			result["expired"] = true
+		}
+		results = append(results, result)
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(map[string]interface{}{"id": call.ID, "result": results, "error": nil})
+}
+
+func newFakeScanClient(t *testing.T, rpc *fakeScanRPC) (*namecoin.Client, func()) {
+	srv := httptest.NewServer(rpc)
+
+	c, err := namecoin.New(&rpcclient.ConnConfig{
+		Host:         strings.TrimPrefix(srv.URL, "http://"),
+		User:         "user",
+		Pass:         "pass",
+		HTTPPostMode: true,
+		DisableTLS:   true,
+	}, nil)
+	if err != nil {
+		srv.Close()
+		t.Fatal(err)
+	}
+
+	return c, func() {
+		c.Shutdown()
+		srv.Close()
+	}
+}
+
+func newFakeScanRPC(n, pageSize int, clock *fakeClock) *fakeScanRPC {
+	rpc := &fakeScanRPC{pageSize: pageSize, clock: clock}
+	for i := 0; i < n; i++ {
+		rpc.names = append(rpc.names, fmt.Sprintf("d/a%02d", i))
+	}
+	return rpc
+}
+
+func TestDumpPacing(t *testing.T) {
+	t0 := time.Unix(1000, 0)
+	clock := &fakeClock{now: t0}
+	rpc := newFakeScanRPC(25, 10, clock)
+	conn, cleanup := newFakeScanClient(t, rpc)
+	defer cleanup()
+
+	var out bytes.Buffer
+	err := DumpWithOptions(conn, &out, "zonefile", &Options{
+		Pacer: NewPacer(&PacerConfig{NamesPerSecond: 20, Clock: clock}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(out.String(), "\n"); n != 25 {
+		t.Errorf("dumped %d records, expected 25", n)
+	}
+
+	// Each page is paid for at 20 names per second before the next is
+	// fetched. Pages overlap by one name.
+	expected := []scanCall{
+		{"d/", t0},
+		{"d/a09", t0.Add(500 * time.Millisecond)},
+		{"d/a18", t0.Add(1000 * time.Millisecond)},
+		{"d/a24", t0.Add(1350 * time.Millisecond)},
+	}
+	if len(rpc.calls) != len(expected) {
+		t.Fatalf("made calls %v, expected %v", rpc.calls, expected)
+	}
+	for i, c := range rpc.calls {
+		if c.start != expected[i].start || !c.at.Equal(expected[i].at) {
+			t.Errorf("call %d started at %s at %v, expected %s at %v", i, c.start, c.at.Sub(t0), expected[i].start, expected[i].at.Sub(t0))
+		}
+	}
+}
+
+// The rate limit applies to concurrent walks together, and at most
+// MaxConcurrent walks run at once.
+func TestDumpSharedPacer(t *testing.T) {
+	for _, maxConcurrent := range []int{0, 1} {
+		t0 := time.Unix(1000, 0)
+		clock := &fakeClock{now: t0}
+		rpc := newFakeScanRPC(25, 10, clock)
+		conn, cleanup := newFakeScanClient(t, rpc)
+
+		pacer := NewPacer(&PacerConfig{NamesPerSecond: 20, MaxConcurrent: maxConcurrent, Clock: clock})
+
+		var wg sync.WaitGroup
+		for i := 0; i < 2; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				var out bytes.Buffer
+				err := DumpWithOptions(conn, &out, "zonefile", &Options{Pacer: pacer})
+				if err != nil {
+					t.Error(err)
+				}
+			}()
+		}
+		wg.Wait()
+		cleanup()
+
+		// Both walks fetch 28 names.
+		if d := clock.Now().Sub(t0); d < 2800*time.Millisecond {
+			t.Errorf("max %d: both walks finished after %v, expected at least 2.8s", maxConcurrent, d)
+		}
+
+		if maxConcurrent == 1 {
+			var starts []string
+			for _, c := range rpc.calls {
+				starts = append(starts, c.start)
+			}
+			if s := strings.Join(starts, " "); s != "d/ d/a09 d/a18 d/a24 d/ d/a09 d/a18 d/a24" {
+				t.Errorf("walks overlapped: calls %s", s)
+			}
+		}
+	}
+}
+
+func TestDumpPage(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	rpc := newFakeScanRPC(25, 10, clock)
+	conn, cleanup := newFakeScanClient(t, rpc)
+	defer cleanup()
+
+	var out bytes.Buffer
+	progress, err := DumpPage(conn, &out, "zonefile", &Options{After: "d/a04", Limit: 7})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if progress.Last != "d/a11" || progress.Names != 7 || progress.Complete {
+		t.Errorf("unexpected progress %+v", progress)
+	}
+	if !strings.HasPrefix(out.String(), "a05.bit.") {
+		t.Errorf("dump didn't start after d/a04:\n%s", out.String())
+	}
+
+	// A dump may carry on after a name which doesn't exist.
+	out.Reset()
+	progress, err = DumpPage(conn, &out, "zonefile", &Options{After: "d/a11x"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if progress.Last != "d/a24" || progress.Names != 13 || !progress.Complete {
+		t.Errorf("unexpected progress %+v", progress)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	progress, err = DumpPage(conn, &out, "zonefile", &Options{After: "d/a04", Context: ctx})
+	if err != context.Canceled || progress.Last != "d/a04" || progress.Names != 0 {
+		t.Errorf("cancelled dump: %+v, %v", progress, err)
+	}
+}
+
+func TestDumpStats(t *testing.T) {
+	rpc := newFakeScanRPC(8, 10, &fakeClock{now: time.Unix(1000, 0)})
+	rpc.values = map[string]string{
+		"d/a01": `{"ip6":"2001:db8::1"}`,
+		"d/a02": `{"ip":"192.0.2.1","ip6":"2001:db8::1"}`,
+		"d/a03": `{"map":{"www":{"ip6":["2001:db8::1","2001:db8::2"]}}}`,
+		"d/a04": `{"txt":"no addresses"}`,
+		"d/a05": `{"ip":"bogus"}`,
+	}
+	conn, cleanup := newFakeScanClient(t, rpc)
+	defer cleanup()
+
+	var out bytes.Buffer
+	progress, err := DumpPage(conn, &out, "stats", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// d/a05 has an error, so isn't counted.
+	expected := Stats{Names: 7, IPv4: 4, IPv6: 3, IPv6Only: 2}
+	if progress.Stats != expected {
+		t.Errorf("counted %+v, expected %+v", progress.Stats, expected)
+	}
+	if !strings.Contains(out.String(), "names with IPv6 addresses: 3 (42.9%)\n") {
+		t.Errorf("unexpected output:\n%s", out.String())
+	}
+}
+
+// With Canonical set, repeated dumps of names whose records come in a
+// different order each time, as those of subdomains do, are byte-identical,
+// and in canonical order.
+func TestDumpCanonical(t *testing.T) {
+	rpc := newFakeScanRPC(2, 10, &fakeClock{now: time.Unix(1000, 0)})
+	rpc.values = map[string]string{
+		"d/a00": `{"ip":["192.0.2.10","192.0.2.9"],"map":{"www":{"ip":"192.0.2.1"},"mail":{"ip":"192.0.2.25"},"*":{"ip":"192.0.2.2"},"ftp":{"ip6":"2001:db8::21","ip":"192.0.2.21"},"z":{"txt":"z"}}}`,
+	}
+	conn, cleanup := newFakeScanClient(t, rpc)
+	defer cleanup()
+
+	dump := func() string {
+		var out bytes.Buffer
+		if err := DumpWithOptions(conn, &out, "zonefile", &Options{Canonical: true}); err != nil {
+			t.Fatal(err)
+		}
+		return out.String()
+	}
+
+	first := dump()
+	for i := 0; i < 10; i++ {
+		if d := dump(); d != first {
+			t.Fatalf("dumps differ:\n%s\n---\n%s", first, d)
+		}
+	}
+
+	var lines []string
+	for _, line := range strings.Split(strings.TrimSpace(first), "\n") {
+		f := strings.Fields(line)
+		lines = append(lines, f[0]+" "+f[3]+" "+f[4])
+	}
+	expected := []string{
+		"a00.bit. A 192.0.2.9",
+		"a00.bit. A 192.0.2.10",
+		"*.a00.bit. A 192.0.2.2",
+		"ftp.a00.bit. A 192.0.2.21",
+		"ftp.a00.bit. AAAA 2001:db8::21",
+		"mail.a00.bit. A 192.0.2.25",
+		"www.a00.bit. A 192.0.2.1",
+		"z.a00.bit. TXT \"z\"",
+		"a01.bit. A 192.0.2.1",
+	}
+	if strings.Join(lines, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("dumped in the order:\n%s", strings.Join(lines, "\n"))
+	}
+}
+
+// A dump of a zone with a delegated child can be read back with a zone file
+// parser, and has what's needed to follow the delegation: the NS records of
+// the child, the addresses of its nameserver in the zone, and its DS records,
+// signed.
+func TestDumpDelegation(t *testing.T) {
+	rpc := newFakeScanRPC(3, 10, &fakeClock{now: time.Unix(1000, 0)})
+	rpc.values = map[string]string{
+		"d/a01": `{"ns":["ns1.a01.bit.","ns.example.com."],"ds":[[12345,8,2,"4tPJFvbe6scylOgmj7WIUESoM/xUWViPSpGEz8QaV2Y="]],"map":{"ns1":{"ip":"192.0.2.53","ip6":"2001:db8::53"},"www":{"ip":"192.0.2.80"}}}`,
+	}
+	conn, cleanup := newFakeScanClient(t, rpc)
+	defer cleanup()
+
+	zsk := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: "bit.", Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags:     256,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+	priv, err := zsk.Generate(256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sign := func(rrset []dns.RR) (*dns.RRSIG, error) {
+		sig := &dns.RRSIG{
+			Hdr:        dns.RR_Header{Name: rrset[0].Header().Name, Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: rrset[0].Header().Ttl},
+			Algorithm:  zsk.Algorithm,
+			KeyTag:     zsk.KeyTag(),
+			SignerName: zsk.Hdr.Name,
+			Inception:  uint32(time.Now().Add(-time.Hour).Unix()),
+			Expiration: uint32(time.Now().Add(time.Hour).Unix()),
+		}
+		return sig, sig.Sign(priv.(crypto.Signer), rrset)
+	}
+
+	var out bytes.Buffer
+	if err := DumpWithOptions(conn, &out, "zonefile", &Options{SignDS: sign}); err != nil {
+		t.Fatal(err)
+	}
+
+	byType := map[uint16][]dns.RR{}
+	zp := dns.NewZoneParser(strings.NewReader(out.String()), "bit.", "dump")
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		if rr.Header().Name == "a01.bit." || dns.IsSubDomain("a01.bit.", rr.Header().Name) {
+			byType[rr.Header().Rrtype] = append(byType[rr.Header().Rrtype], rr)
+		}
+	}
+	if err := zp.Err(); err != nil {
+		t.Fatalf("couldn't parse dump: %v\n%s", err, out.String())
+	}
+
+	var nsTargets []string
+	for _, rr := range byType[dns.TypeNS] {
+		nsTargets = append(nsTargets, rr.(*dns.NS).Ns)
+	}
+	if s := strings.Join(nsTargets, " "); s != "ns1.a01.bit. ns.example.com." {
+		t.Errorf("got NS %s", s)
+	}
+
+	// Only the nameserver in the zone has glue, and nothing else below the
+	// delegation is published.
+	a, aaaa := byType[dns.TypeA], byType[dns.TypeAAAA]
+	if len(a) != 1 || a[0].Header().Name != "ns1.a01.bit." || len(aaaa) != 1 || aaaa[0].Header().Name != "ns1.a01.bit." {
+		t.Errorf("got glue %v %v", a, aaaa)
+	}
+
+	ds, sigs := byType[dns.TypeDS], byType[dns.TypeRRSIG]
+	if len(ds) != 1 || len(sigs) != 1 {
+		t.Fatalf("got DS %v, RRSIG %v", ds, sigs)
+	}
+	sig := sigs[0].(*dns.RRSIG)
+	if sig.TypeCovered != dns.TypeDS {
+		t.Errorf("RRSIG covers %s, expected DS", dns.TypeToString[sig.TypeCovered])
+	}
+	if err := sig.Verify(zsk, ds); err != nil {
+		t.Errorf("DS signature doesn't verify: %v", err)
+	}
+}
+
+func TestWalkNames(t *testing.T) {
+	rpc := newFakeScanRPC(5, 2, &fakeClock{now: time.Unix(1000, 0)})
+	rpc.names = append(rpc.names, "id/a00")
+	rpc.values = map[string]string{"d/a01": `{"ip":"192.0.2.2"}`}
+	rpc.expired = map[string]bool{"d/a03": true}
+	conn, cleanup := newFakeScanClient(t, rpc)
+	defer cleanup()
+
+	var walked []string
+	progress, err := WalkNames(conn, &Options{After: "d/a00"}, func(name string, nameData *namecoin.NameData) error {
+		walked = append(walked, fmt.Sprintf("%s %s %v", name, nameData.Value, nameData.Expired))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		`d/a01 {"ip":"192.0.2.2"} false`,
+		`d/a02 {"ip":"192.0.2.1"} false`,
+		`d/a03 {"ip":"192.0.2.1"} true`,
+		`d/a04 {"ip":"192.0.2.1"} false`,
+	}
+	if strings.Join(walked, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("walked %q, expected %q", walked, expected)
+	}
+	if progress.Names != 4 || !progress.Complete {
+		t.Errorf("unexpected progress %+v", progress)
+	}
+
+	// An error from f stops the walk.
+	stop := fmt.Errorf("stop")
+	walked = nil
+	_, err = WalkNames(conn, nil, func(name string, nameData *namecoin.NameData) error {
+		walked = append(walked, name)
+		return stop
+	})
+	if err != stop || len(walked) != 1 {
+		t.Errorf("walk returned %v after %v", err, walked)
+	}
+}
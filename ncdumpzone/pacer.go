@@ -0,0 +1,76 @@
+package ncdumpzone
+
+import (
+	"sync"
+	"time"
+
+	"github.com/namecoin/ncdns/clock"
+)
+
+// A Pacer limits how fast zone walks fetch names from namecoind, and how many
+// walks run at once, so that they don't compete with queries for namecoind's
+// attention. A single Pacer should be shared by every walk using the same
+// namecoind; the rate limit applies to all of them together.
+type Pacer struct {
+	cfg   PacerConfig
+	slots chan struct{}
+
+	mu   sync.Mutex
+	next time.Time // when the names fetched so far will have been paid for
+}
+
+// Pacer configuration.
+type PacerConfig struct {
+	// Maximum rate at which names are fetched, averaged over each page of
+	// name_scan results. Zero means no limit.
+	NamesPerSecond float64
+
+	// Maximum number of walks running at once; further walks wait for one to
+	// finish. Zero means no limit.
+	MaxConcurrent int
+
+	// If nil, the system clock is used.
+	Clock clock.Clock
+}
+
+func NewPacer(cfg *PacerConfig) *Pacer {
+	p := &Pacer{cfg: *cfg}
+	p.cfg.Clock = clock.Or(p.cfg.Clock)
+	if p.cfg.MaxConcurrent > 0 {
+		p.slots = make(chan struct{}, p.cfg.MaxConcurrent)
+	}
+	return p
+}
+
+// Waits until fewer than MaxConcurrent walks are running. Must be followed by
+// a call to release.
+func (p *Pacer) acquire() {
+	if p != nil && p.slots != nil {
+		p.slots <- struct{}{}
+	}
+}
+
+func (p *Pacer) release() {
+	if p != nil && p.slots != nil {
+		<-p.slots
+	}
+}
+
+// Called after n names have been fetched. Waits until fetching them is within
+// the rate limit.
+func (p *Pacer) fetched(n int) {
+	if p == nil || p.cfg.NamesPerSecond <= 0 || n <= 0 {
+		return
+	}
+
+	p.mu.Lock()
+	now := p.cfg.Clock.Now()
+	if p.next.Before(now) {
+		p.next = now
+	}
+	p.next = p.next.Add(time.Duration(float64(n) / p.cfg.NamesPerSecond * float64(time.Second)))
+	wait := p.next.Sub(now)
+	p.mu.Unlock()
+
+	<-p.cfg.Clock.NewTimer(wait).C()
+}
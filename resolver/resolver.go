@@ -0,0 +1,364 @@
+// Package resolver makes the DNS queries ncdns needs to make on its own
+// behalf, e.g. to check the DS records published for its suffix. Queries are
+// sent to configured recursive resolvers, which needn't validate, and the
+// answers are validated with DNSSEC by ncdns itself.
+package resolver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/groupcache/lru"
+	"github.com/miekg/dns"
+
+	"github.com/namecoin/ncdns/trustanchor"
+)
+
+var (
+	// Returned (wrapped, saying why) for an answer which fails validation.
+	ErrBogus = errors.New("DNSSEC validation failed")
+
+	// Returned when a query couldn't be sent to any upstream without
+	// exceeding its rate limit.
+	ErrRateLimited = errors.New("outbound query rate limit reached")
+)
+
+// The root zone's trust anchors, as published by IANA, used when the system
+// has none.
+const builtinRootAnchors = `
+. IN DS 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBB683457104237C7F8EC8D
+. IN DS 38696 8 2 683D2D0ACB8C9B712A1948B27F741219298D0A450D612C483AF444A4C0FB2B16
+`
+
+// Where systems keep the root zone's trust anchor, kept up to date by their
+// package managers or by unbound-anchor, in order of preference.
+var systemAnchorFiles = []string{
+	"/usr/share/dns/root.ds",
+	"/usr/share/dns/root.key",
+	"/var/lib/unbound/root.key",
+	"/etc/unbound/root.key",
+}
+
+// Answers are cached for no longer than this, whatever their TTLs.
+const maxCacheTTL = time.Hour
+
+// Validating an answer can lead to queries for the DS and DNSKEY records of
+// the zones above it, and so on. Chains longer than this are given up on.
+const maxDepth = 32
+
+// Resolver configuration.
+type Config struct {
+	// Addresses (host:port) of the recursive resolvers to which queries are
+	// sent, tried in turn until one answers. They must pass on DNSSEC
+	// records, but needn't validate them.
+	Upstreams []string
+
+	// The trust anchors with which answers are validated. An anchor for a
+	// zone is used in place of the DS records in its parent, so that (for
+	// instance) names under ncdns's own suffix can be validated with its own
+	// key. Usually includes SystemTrustAnchors.
+	TrustAnchors []trustanchor.Anchor
+
+	// Timeout of each query to an upstream, and the longest a query waits
+	// for its turn under the rate limit. Default: 5 seconds.
+	Timeout time.Duration
+
+	// Maximum rate of queries to each upstream. Zero means no limit.
+	QueriesPerSecond float64
+
+	// Maximum number of answers (and validated DNSKEY sets) cached. Zero
+	// disables caching.
+	CacheMaxEntries int
+}
+
+// The validated answer to a query.
+type Result struct {
+	// The answer, as the upstream gave it. Results may be shared, so this
+	// must not be modified.
+	Msg *dns.Msg
+
+	// Whether the answer was validated up to a trust anchor. If false, it is
+	// provably insecure: a zone above the name is delegated without DS
+	// records, so there is nothing to validate it with.
+	Secure bool
+}
+
+// Counts of what the resolver has done, for /status.
+type Stats struct {
+	Queries     uint64 `json:"queries"`
+	CacheHits   uint64 `json:"cache_hits"`
+	Bogus       uint64 `json:"bogus"`
+	RateLimited uint64 `json:"rate_limited"`
+}
+
+// A Resolver makes validated DNS queries through the configured upstreams. It
+// may be shared, and queries made through it share its cache and rate limits.
+type Resolver struct {
+	// Accessed atomically, so kept first for alignment.
+	stats Stats
+
+	cfg     Config
+	anchors map[string][]trustanchor.Anchor // by lower-case zone
+	now     func() time.Time
+
+	mu    sync.Mutex
+	cache *lru.Cache
+	next  map[string]time.Time // when each upstream may next be sent a query
+}
+
+type cacheEntry struct {
+	expires time.Time
+	res     *Result
+	den     *denial
+	keys    []*dns.DNSKEY // for DNSKEY sets
+}
+
+func New(cfg *Config) (*Resolver, error) {
+	if len(cfg.Upstreams) == 0 {
+		return nil, fmt.Errorf("no upstream resolvers configured")
+	}
+
+	r := &Resolver{
+		cfg:     *cfg,
+		anchors: make(map[string][]trustanchor.Anchor),
+		now:     time.Now,
+		next:    make(map[string]time.Time),
+	}
+	if r.cfg.Timeout <= 0 {
+		r.cfg.Timeout = 5 * time.Second
+	}
+	if r.cfg.CacheMaxEntries > 0 {
+		r.cache = lru.New(r.cfg.CacheMaxEntries)
+	}
+
+	for _, a := range cfg.TrustAnchors {
+		zone := strings.ToLower(dns.Fqdn(a.Zone))
+		r.anchors[zone] = append(r.anchors[zone], a)
+	}
+	if len(r.anchors) == 0 {
+		return nil, fmt.Errorf("no trust anchors configured")
+	}
+
+	return r, nil
+}
+
+// Returns the root zone's trust anchors from the system's anchor file, or if
+// it has none, those built in.
+func SystemTrustAnchors() ([]trustanchor.Anchor, error) {
+	for _, fn := range systemAnchorFiles {
+		f, err := os.Open(fn)
+		if err != nil {
+			continue
+		}
+
+		anchors, err := trustanchor.Parse(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", fn, err)
+		}
+		if len(anchors) > 0 {
+			return anchors, nil
+		}
+	}
+
+	return trustanchor.Parse(strings.NewReader(builtinRootAnchors))
+}
+
+// Looks up the records of the given type at name, returning the validated
+// answer. An answer which fails validation is an error wrapping ErrBogus. So
+// is an error (other than NXDOMAIN) from every upstream.
+func (r *Resolver) Query(ctx context.Context, name string, qtype uint16) (*Result, error) {
+	res, _, err := r.query(ctx, strings.ToLower(dns.Fqdn(name)), qtype, 0)
+	if errors.Is(err, ErrBogus) {
+		atomic.AddUint64(&r.stats.Bogus, 1)
+	}
+	return res, err
+}
+
+func (r *Resolver) query(ctx context.Context, name string, qtype uint16, depth int) (*Result, *denial, error) {
+	if depth > maxDepth {
+		return nil, nil, fmt.Errorf("%w: chain of trust for %s is too long", ErrBogus, name)
+	}
+
+	key := fmt.Sprintf("%s/%d", name, qtype)
+	if e := r.cached(key); e != nil {
+		return e.res, e.den, nil
+	}
+
+	m, err := r.send(ctx, name, qtype)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	v := &validation{r: r, ctx: ctx, depth: depth + 1, now: r.now()}
+	secure, den, err := v.response(m, name, qtype)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	res := &Result{Msg: m, Secure: secure}
+	r.store(key, &cacheEntry{res: res, den: den}, responseTTL(m, v.now))
+	return res, den, nil
+}
+
+// Sends a query to the upstreams, returning the first NOERROR or NXDOMAIN
+// answer.
+func (r *Resolver) send(ctx context.Context, name string, qtype uint16) (*dns.Msg, error) {
+	q := new(dns.Msg)
+	q.SetQuestion(name, qtype)
+	q.SetEdns0(4096, true)
+	q.CheckingDisabled = true // we validate the answer
+	atomic.AddUint64(&r.stats.Queries, 1)
+
+	err := fmt.Errorf("no upstream answered")
+	for _, upstream := range r.cfg.Upstreams {
+		if err = r.pace(ctx, upstream); err != nil {
+			continue
+		}
+
+		var m *dns.Msg
+		m, err = r.exchange(ctx, q, upstream)
+		if err != nil {
+			continue
+		}
+		if len(m.Question) != 1 || !strings.EqualFold(m.Question[0].Name, name) || m.Question[0].Qtype != qtype {
+			err = fmt.Errorf("%s answered a different question", upstream)
+			continue
+		}
+		if m.Rcode != dns.RcodeSuccess && m.Rcode != dns.RcodeNameError {
+			err = fmt.Errorf("%s answered %s for %s %s", upstream, dns.RcodeToString[m.Rcode], name, dns.TypeToString[qtype])
+			continue
+		}
+
+		return m, nil
+	}
+
+	return nil, err
+}
+
+func (r *Resolver) exchange(ctx context.Context, q *dns.Msg, upstream string) (*dns.Msg, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.cfg.Timeout)
+	defer cancel()
+
+	m, _, err := (&dns.Client{Net: "udp"}).ExchangeContext(ctx, q, upstream)
+	if err == nil && m.Truncated {
+		m, _, err = (&dns.Client{Net: "tcp"}).ExchangeContext(ctx, q, upstream)
+	}
+
+	return m, err
+}
+
+// Waits until a query may be sent to upstream under the rate limit, or
+// returns ErrRateLimited if that's longer than the timeout, or than the
+// context allows.
+func (r *Resolver) pace(ctx context.Context, upstream string) error {
+	if r.cfg.QueriesPerSecond <= 0 {
+		return nil
+	}
+
+	r.mu.Lock()
+	now := r.now()
+	next := r.next[upstream]
+	if next.Before(now) {
+		next = now
+	}
+	wait := next.Sub(now)
+	deadline, ok := ctx.Deadline()
+	if wait > r.cfg.Timeout || (ok && now.Add(wait).After(deadline)) {
+		r.mu.Unlock()
+		atomic.AddUint64(&r.stats.RateLimited, 1)
+		return ErrRateLimited
+	}
+	r.next[upstream] = next.Add(time.Duration(float64(time.Second) / r.cfg.QueriesPerSecond))
+	r.mu.Unlock()
+
+	if wait <= 0 {
+		return nil
+	}
+
+	t := time.NewTimer(wait)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (r *Resolver) cached(key string) *cacheEntry {
+	if r.cache == nil {
+		return nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	v, ok := r.cache.Get(key)
+	if !ok {
+		return nil
+	}
+
+	e := v.(*cacheEntry)
+	if !r.now().Before(e.expires) {
+		r.cache.Remove(key)
+		return nil
+	}
+
+	atomic.AddUint64(&r.stats.CacheHits, 1)
+	return e
+}
+
+func (r *Resolver) store(key string, e *cacheEntry, ttl time.Duration) {
+	if r.cache == nil || ttl <= 0 {
+		return
+	}
+	if ttl > maxCacheTTL {
+		ttl = maxCacheTTL
+	}
+	e.expires = r.now().Add(ttl)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.cache.Add(key, e)
+}
+
+// Returns how long an answer may be cached: the smallest TTL in it (or the
+// SOA's negative TTL, if smaller), and no later than its signatures expire.
+func responseTTL(m *dns.Msg, now time.Time) time.Duration {
+	ttl := maxCacheTTL
+	for _, rr := range append(append([]dns.RR{}, m.Answer...), m.Ns...) {
+		t := time.Duration(rr.Header().Ttl) * time.Second
+		switch rr := rr.(type) {
+		case *dns.SOA:
+			if min := time.Duration(rr.Minttl) * time.Second; min < t {
+				t = min
+			}
+		case *dns.RRSIG:
+			if exp := time.Duration(int32(rr.Expiration-uint32(now.Unix()))) * time.Second; exp < t {
+				t = exp
+			}
+		}
+		if t < ttl {
+			ttl = t
+		}
+	}
+
+	return ttl
+}
+
+func (r *Resolver) Stats() Stats {
+	return Stats{
+		Queries:     atomic.LoadUint64(&r.stats.Queries),
+		CacheHits:   atomic.LoadUint64(&r.stats.CacheHits),
+		Bogus:       atomic.LoadUint64(&r.stats.Bogus),
+		RateLimited: atomic.LoadUint64(&r.stats.RateLimited),
+	}
+}
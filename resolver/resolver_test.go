@@ -0,0 +1,552 @@
+package resolver
+
+import (
+	"context"
+	"crypto"
+	"errors"
+	"net"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/namecoin/ncdns/rrsort"
+	"github.com/namecoin/ncdns/trustanchor"
+)
+
+// An in-memory zone, served by testUpstream.
+type testZone struct {
+	apex    string
+	key     *dns.DNSKEY // nil if unsigned
+	priv    crypto.Signer
+	records map[string]map[uint16][]dns.RR
+	sigs    map[string]map[uint16]*dns.RRSIG
+	cuts    map[string]bool
+}
+
+func newTestZone(t *testing.T, apex string, signed bool) *testZone {
+	z := &testZone{
+		apex:    apex,
+		records: make(map[string]map[uint16][]dns.RR),
+		sigs:    make(map[string]map[uint16]*dns.RRSIG),
+		cuts:    make(map[string]bool),
+	}
+	z.add(t, apex+" 3600 IN SOA ns.example.net. hostmaster.example.net. 1 3600 600 86400 300")
+	z.add(t, apex+" 3600 IN NS ns.example.net.")
+
+	if signed {
+		z.key = &dns.DNSKEY{
+			Hdr:       dns.RR_Header{Name: apex, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+			Flags:     dns.ZONE | dns.SEP,
+			Protocol:  3,
+			Algorithm: dns.ECDSAP256SHA256,
+		}
+		priv, err := z.key.Generate(256)
+		if err != nil {
+			t.Fatal(err)
+		}
+		z.priv = priv.(crypto.Signer)
+		z.addRR(z.key)
+	}
+
+	return z
+}
+
+func (z *testZone) add(t *testing.T, s string) {
+	rr, err := dns.NewRR(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	z.addRR(rr)
+}
+
+func (z *testZone) addRR(rr dns.RR) {
+	name := strings.ToLower(rr.Header().Name)
+	if z.records[name] == nil {
+		z.records[name] = make(map[uint16][]dns.RR)
+	}
+	z.records[name][rr.Header().Rrtype] = append(z.records[name][rr.Header().Rrtype], rr)
+}
+
+// Delegates child's zone, with a DS record for its key if withDS.
+func (z *testZone) delegate(t *testing.T, child *testZone, withDS bool) {
+	z.cuts[child.apex] = true
+	z.add(t, child.apex+" 3600 IN NS ns.example.net.")
+	if withDS {
+		z.addRR(child.key.ToDS(dns.SHA256))
+	}
+}
+
+// Adds the NSEC chain and signs the zone.
+func (z *testZone) finish(t *testing.T) {
+	if z.key == nil {
+		return
+	}
+
+	var names []string
+	for name := range z.records {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return rrsort.CompareNames(names[i], names[j]) < 0
+	})
+	for i, name := range names {
+		types := []uint16{dns.TypeNSEC, dns.TypeRRSIG}
+		for t := range z.records[name] {
+			types = append(types, t)
+		}
+		sort.Slice(types, func(i, j int) bool { return types[i] < types[j] })
+		z.addRR(&dns.NSEC{
+			Hdr:        dns.RR_Header{Name: name, Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: 300},
+			NextDomain: names[(i+1)%len(names)],
+			TypeBitMap: types,
+		})
+	}
+
+	now := time.Now()
+	for name, types := range z.records {
+		z.sigs[name] = make(map[uint16]*dns.RRSIG)
+		for typ, rrs := range types {
+			if z.cuts[name] && typ == dns.TypeNS {
+				continue // not authoritative
+			}
+
+			sig := &dns.RRSIG{
+				Hdr:         dns.RR_Header{Name: name, Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: rrs[0].Header().Ttl},
+				TypeCovered: typ,
+				Algorithm:   z.key.Algorithm,
+				Labels:      uint8(dns.CountLabel(name)),
+				OrigTtl:     rrs[0].Header().Ttl,
+				Expiration:  uint32(now.Add(time.Hour).Unix()),
+				Inception:   uint32(now.Add(-time.Hour).Unix()),
+				KeyTag:      z.key.KeyTag(),
+				SignerName:  z.apex,
+			}
+			if err := sig.Sign(z.priv, rrs); err != nil {
+				t.Fatal(err)
+			}
+			z.sigs[name][typ] = sig
+		}
+	}
+}
+
+func (z *testZone) rrset(name string, typ uint16) []dns.RR {
+	rrs := z.records[name][typ]
+	if len(rrs) == 0 {
+		return nil
+	}
+	if sig := z.sigs[name][typ]; sig != nil {
+		rrs = append(append([]dns.RR{}, rrs...), sig)
+	}
+	return rrs
+}
+
+// Answers queries from the zones it has, as a non-validating recursive
+// resolver would, but without following delegations to zones it doesn't have.
+type testUpstream struct {
+	zones   []*testZone
+	queries int64
+	addr    string
+
+	// If set, answers the queries it returns a response to in place of the
+	// zones.
+	forge func(req *dns.Msg) *dns.Msg
+}
+
+func (u *testUpstream) zoneFor(name string, qtype uint16) *testZone {
+	var best *testZone
+	for _, z := range u.zones {
+		if !dns.IsSubDomain(z.apex, name) || (qtype == dns.TypeDS && z.apex == name) {
+			continue
+		}
+		if best == nil || dns.CountLabel(z.apex) > dns.CountLabel(best.apex) {
+			best = z
+		}
+	}
+	return best
+}
+
+func (u *testUpstream) ServeDNS(rw dns.ResponseWriter, req *dns.Msg) {
+	atomic.AddInt64(&u.queries, 1)
+	if u.forge != nil {
+		if m := u.forge(req); m != nil {
+			rw.WriteMsg(m)
+			return
+		}
+	}
+
+	m := new(dns.Msg)
+	m.SetReply(req)
+	q := req.Question[0]
+	name := strings.ToLower(q.Name)
+	z := u.zoneFor(name, q.Qtype)
+	if z == nil {
+		m.Rcode = dns.RcodeServerFailure
+		rw.WriteMsg(m)
+		return
+	}
+
+	// A name which doesn't exist is answered from the wildcard at its
+	// closest encloser, if there is one, with the NSEC record proving that
+	// the name itself doesn't exist, as RFC 4035 section 3.1.3 describes.
+	source, wildcard := name, ""
+	if z.records[name] == nil && !z.exists(name) {
+		wildcard = "*." + z.closestEncloser(name)
+		if z.records[wildcard] != nil {
+			source = wildcard
+		}
+	}
+
+	if rrs := z.rrset(source, q.Qtype); rrs != nil {
+		m.Answer = expand(rrs, name)
+	} else if rrs := z.rrset(source, dns.TypeCNAME); rrs != nil {
+		m.Answer = expand(rrs, name)
+		target := strings.ToLower(rrs[0].(*dns.CNAME).Target)
+		m.Answer = append(m.Answer, z.rrset(target, q.Qtype)...)
+	} else if z.records[source] != nil {
+		m.Ns = append(z.rrset(z.apex, dns.TypeSOA), z.rrset(source, dns.TypeNSEC)...)
+	} else if z.exists(name) {
+		// An empty non-terminal.
+		m.Ns = append(z.rrset(z.apex, dns.TypeSOA), z.covering(name)...)
+	} else {
+		m.Rcode = dns.RcodeNameError
+		m.Ns = append(z.rrset(z.apex, dns.TypeSOA), z.covering(name)...)
+		m.Ns = appendMissing(m.Ns, z.covering(wildcard))
+	}
+	if source != name {
+		m.Ns = appendMissing(m.Ns, z.covering(name))
+	}
+
+	rw.WriteMsg(m)
+}
+
+// Returns true if name owns records or is an empty non-terminal.
+func (z *testZone) exists(name string) bool {
+	for n := range z.records {
+		if dns.IsSubDomain(name, n) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the longest ancestor of name which exists in the zone.
+func (z *testZone) closestEncloser(name string) string {
+	for n := dns.CountLabel(name) - 1; n > 0; n-- {
+		if a := ancestor(name, n); z.exists(a) {
+			return a
+		}
+	}
+	return "."
+}
+
+// Returns the NSEC record whose span covers name, with its RRSIG.
+func (z *testZone) covering(name string) []dns.RR {
+	for n := range z.records {
+		nsec := z.rrset(n, dns.TypeNSEC)
+		if nsec != nil && covers(nsec[0].(*dns.NSEC), name) {
+			return nsec
+		}
+	}
+	return nil
+}
+
+// Appends rrs to section unless they're in it already, as the NSEC record
+// covering a name may also cover its wildcard, or be the wildcard's own.
+func appendMissing(section, rrs []dns.RR) []dns.RR {
+	for _, rr := range section {
+		if len(rrs) > 0 && rr == rrs[0] {
+			return section
+		}
+	}
+	return append(section, rrs...)
+}
+
+// Returns copies of rrs owned by name, for an answer synthesized from a
+// wildcard; their RRSIG still gives the labels of the wildcard.
+func expand(rrs []dns.RR, name string) []dns.RR {
+	out := make([]dns.RR, len(rrs))
+	for i, rr := range rrs {
+		out[i] = dns.Copy(rr)
+		out[i].Header().Name = name
+	}
+	return out
+}
+
+func (u *testUpstream) start(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &dns.Server{PacketConn: pc, Handler: u}
+	go srv.ActivateAndServe()
+	t.Cleanup(func() { srv.Shutdown() })
+	u.addr = pc.LocalAddr().String()
+}
+
+type testZones struct {
+	root, bit, example *testZone
+	upstream           *testUpstream
+}
+
+func newTestZones(t *testing.T) *testZones {
+	root := newTestZone(t, ".", true)
+	com := newTestZone(t, "com.", true)
+	example := newTestZone(t, "example.com.", true)
+	insecure := newTestZone(t, "insecure.com.", false)
+	bogus := newTestZone(t, "bogus.com.", true)
+	bit := newTestZone(t, "bit.", true)
+
+	example.add(t, "www.example.com. 300 IN A 192.0.2.1")
+	example.add(t, "alias.example.com. 300 IN CNAME www.example.com.")
+	example.add(t, "*.wild.example.com. 300 IN A 192.0.2.5")
+	example.add(t, "host.wild.example.com. 300 IN A 192.0.2.6")
+	example.add(t, "*.cname.example.com. 300 IN CNAME www.example.com.")
+	insecure.add(t, "www.insecure.com. 300 IN A 192.0.2.2")
+	bogus.add(t, "www.bogus.com. 300 IN A 192.0.2.3")
+	bit.add(t, "example.bit. 300 IN A 192.0.2.4")
+
+	root.delegate(t, com, true)
+	root.delegate(t, bit, false) // as Namecoin's suffix is
+	com.delegate(t, example, true)
+	com.delegate(t, insecure, false)
+	com.delegate(t, bogus, true)
+
+	zones := []*testZone{root, com, example, insecure, bogus, bit}
+	for _, z := range zones {
+		z.finish(t)
+	}
+
+	// Tampered with after signing.
+	bogus.records["www.bogus.com."][dns.TypeA][0].(*dns.A).A = net.ParseIP("198.51.100.1")
+
+	u := &testUpstream{zones: zones}
+	u.start(t)
+	return &testZones{root: root, bit: bit, example: example, upstream: u}
+}
+
+func anchorFor(z *testZone) trustanchor.Anchor {
+	return trustanchor.Anchor{Zone: z.apex, DS: z.key.ToDS(dns.SHA256)}
+}
+
+func (tz *testZones) resolver(t *testing.T, anchors ...trustanchor.Anchor) *Resolver {
+	if anchors == nil {
+		anchors = []trustanchor.Anchor{anchorFor(tz.root)}
+	}
+	r, err := New(&Config{
+		Upstreams:       []string{tz.upstream.addr},
+		TrustAnchors:    anchors,
+		Timeout:         time.Second,
+		CacheMaxEntries: 100,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestQuery(t *testing.T) {
+	tz := newTestZones(t)
+	r := tz.resolver(t)
+
+	for _, test := range []struct {
+		name   string
+		qtype  uint16
+		rcode  int
+		secure bool
+		answer int
+	}{
+		{"www.example.com.", dns.TypeA, dns.RcodeSuccess, true, 2},
+		{"WWW.Example.COM", dns.TypeA, dns.RcodeSuccess, true, 2},
+		{"alias.example.com.", dns.TypeA, dns.RcodeSuccess, true, 4},
+		{"nope.example.com.", dns.TypeA, dns.RcodeNameError, true, 0},
+		{"www.example.com.", dns.TypeAAAA, dns.RcodeSuccess, true, 0},
+		{"example.com.", dns.TypeDS, dns.RcodeSuccess, true, 2},
+		{"insecure.com.", dns.TypeDS, dns.RcodeSuccess, true, 0},
+		{"www.insecure.com.", dns.TypeA, dns.RcodeSuccess, false, 1},
+		{"nope.insecure.com.", dns.TypeA, dns.RcodeNameError, false, 0},
+		{"example.bit.", dns.TypeA, dns.RcodeSuccess, false, 2},
+	} {
+		res, err := r.Query(context.Background(), test.name, test.qtype)
+		if err != nil {
+			t.Errorf("%s %s: %v", test.name, dns.TypeToString[test.qtype], err)
+			continue
+		}
+		if res.Msg.Rcode != test.rcode || res.Secure != test.secure || len(res.Msg.Answer) != test.answer {
+			t.Errorf("%s %s: got rcode %d, secure %v, %d answers, expected %d, %v, %d", test.name, dns.TypeToString[test.qtype],
+				res.Msg.Rcode, res.Secure, len(res.Msg.Answer), test.rcode, test.secure, test.answer)
+		}
+	}
+
+	_, err := r.Query(context.Background(), "www.bogus.com.", dns.TypeA)
+	if !errors.Is(err, ErrBogus) {
+		t.Errorf("tampered answer: got error %v", err)
+	}
+	if st := r.Stats(); st.Bogus != 1 {
+		t.Errorf("unexpected stats %+v", st)
+	}
+}
+
+// Answers synthesized from a wildcard validate with the proof that the name
+// sought doesn't exist, in each of the shapes they take.
+func TestWildcards(t *testing.T) {
+	tz := newTestZones(t)
+	r := tz.resolver(t)
+
+	for _, test := range []struct {
+		desc   string
+		name   string
+		qtype  uint16
+		rcode  int
+		answer int
+	}{
+		{"expansion", "a.wild.example.com.", dns.TypeA, dns.RcodeSuccess, 2},
+		{"expansion over two labels", "b.a.wild.example.com.", dns.TypeA, dns.RcodeSuccess, 2},
+		{"name beside the wildcard", "host.wild.example.com.", dns.TypeA, dns.RcodeSuccess, 2},
+		{"wildcard NODATA", "a.wild.example.com.", dns.TypeAAAA, dns.RcodeSuccess, 0},
+		{"NXDOMAIN under the wildcard's owner", "nope.host.wild.example.com.", dns.TypeA, dns.RcodeNameError, 0},
+		{"empty non-terminal owning the wildcard", "wild.example.com.", dns.TypeA, dns.RcodeSuccess, 0},
+		{"CNAME from a wildcard", "a.cname.example.com.", dns.TypeA, dns.RcodeSuccess, 4},
+	} {
+		res, err := r.Query(context.Background(), test.name, test.qtype)
+		if err != nil {
+			t.Errorf("%s: %v", test.desc, err)
+			continue
+		}
+		if res.Msg.Rcode != test.rcode || !res.Secure || len(res.Msg.Answer) != test.answer {
+			t.Errorf("%s: got rcode %d, secure %v, %d answers, expected %d, true, %d", test.desc,
+				res.Msg.Rcode, res.Secure, len(res.Msg.Answer), test.rcode, test.answer)
+		}
+	}
+
+	// An answer from the wildcard for a name below host.wild.example.com.,
+	// which exists, doesn't validate, though its NSEC record does cover the
+	// name: the wildcard doesn't apply there.
+	z := tz.example
+	forged := &testUpstream{zones: tz.upstream.zones}
+	forged.forge = func(req *dns.Msg) *dns.Msg {
+		q := req.Question[0]
+		if !strings.EqualFold(q.Name, "x.host.wild.example.com.") {
+			return nil
+		}
+		m := new(dns.Msg)
+		m.SetReply(req)
+		m.Answer = expand(z.rrset("*.wild.example.com.", dns.TypeA), q.Name)
+		m.Ns = z.covering(q.Name)
+		return m
+	}
+	forged.start(t)
+	tz.upstream = forged
+	_, err := tz.resolver(t).Query(context.Background(), "x.host.wild.example.com.", dns.TypeA)
+	if !errors.Is(err, ErrBogus) {
+		t.Errorf("expansion of a wildcard which doesn't apply: got error %v", err)
+	}
+}
+
+func TestTrustAnchors(t *testing.T) {
+	tz := newTestZones(t)
+
+	// Names under a suffix delegated insecurely validate with its own key.
+	r := tz.resolver(t, anchorFor(tz.root), anchorFor(tz.bit))
+	res, err := r.Query(context.Background(), "example.bit.", dns.TypeA)
+	if err != nil || !res.Secure {
+		t.Errorf("anchored suffix: got %v, %v", res, err)
+	}
+
+	// Only the suffix's key is needed for that.
+	r = tz.resolver(t, anchorFor(tz.bit))
+	res, err = r.Query(context.Background(), "example.bit.", dns.TypeA)
+	if err != nil || !res.Secure {
+		t.Errorf("suffix anchor alone: got %v, %v", res, err)
+	}
+
+	other := newTestZone(t, ".", true)
+	r = tz.resolver(t, anchorFor(other))
+	if _, err = r.Query(context.Background(), "www.example.com.", dns.TypeA); !errors.Is(err, ErrBogus) {
+		t.Errorf("wrong root anchor: got error %v", err)
+	}
+
+	defer func(files []string) { systemAnchorFiles = files }(systemAnchorFiles)
+	systemAnchorFiles = nil
+	anchors, err := SystemTrustAnchors()
+	if err != nil || len(anchors) != 2 || anchors[0].Zone != "." {
+		t.Errorf("built-in anchors: got %v, %v", anchors, err)
+	}
+}
+
+func TestFailover(t *testing.T) {
+	tz := newTestZones(t)
+
+	// Receives queries, but never answers them.
+	dead, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dead.Close()
+
+	r, err := New(&Config{
+		Upstreams:    []string{dead.LocalAddr().String(), tz.upstream.addr},
+		TrustAnchors: []trustanchor.Anchor{anchorFor(tz.bit)},
+		Timeout:      100 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := r.Query(context.Background(), "example.bit.", dns.TypeA)
+	if err != nil || !res.Secure {
+		t.Errorf("got %v, %v", res, err)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	tz := newTestZones(t)
+	r, err := New(&Config{
+		Upstreams:        []string{tz.upstream.addr},
+		TrustAnchors:     []trustanchor.Anchor{anchorFor(tz.bit)},
+		Timeout:          100 * time.Millisecond,
+		QueriesPerSecond: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Validating the answer needs a second query, for the DNSKEYs, which
+	// would have to wait a second.
+	_, err = r.Query(context.Background(), "example.bit.", dns.TypeA)
+	if !errors.Is(err, ErrRateLimited) {
+		t.Errorf("got error %v", err)
+	}
+	if st := r.Stats(); st.RateLimited != 1 || st.Queries != 2 {
+		t.Errorf("unexpected stats %+v", st)
+	}
+}
+
+func TestCache(t *testing.T) {
+	tz := newTestZones(t)
+	r := tz.resolver(t)
+
+	if _, err := r.Query(context.Background(), "www.example.com.", dns.TypeA); err != nil {
+		t.Fatal(err)
+	}
+	n := atomic.LoadInt64(&tz.upstream.queries)
+
+	res, err := r.Query(context.Background(), "www.example.com.", dns.TypeA)
+	if err != nil || !res.Secure {
+		t.Fatalf("got %v, %v", res, err)
+	}
+	if atomic.LoadInt64(&tz.upstream.queries) != n {
+		t.Errorf("cached answer was queried again")
+	}
+
+	// The zones' keys are cached too.
+	if _, err := r.Query(context.Background(), "alias.example.com.", dns.TypeA); err != nil {
+		t.Fatal(err)
+	}
+	if q := atomic.LoadInt64(&tz.upstream.queries) - n; q != 1 {
+		t.Errorf("%d queries for a name in a known zone", q)
+	}
+}
@@ -0,0 +1,648 @@
+package resolver
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/namecoin/ncdns/rrsort"
+	"github.com/namecoin/ncdns/trustanchor"
+)
+
+// Answers from zones using NSEC3 with more iterations than this are treated
+// as insecure, as RFC 9276 recommends, since checking them costs too much.
+const maxNSEC3Iterations = 150
+
+// Longest chain of CNAMEs and DNAMEs followed in an answer.
+const maxChain = 16
+
+// Algorithms and digest types miekg/dns can verify. A zone whose DS records
+// use none of them is treated as insecure, as RFC 4035 says.
+var (
+	supportedAlgorithms = map[uint8]bool{
+		dns.RSASHA1: true, dns.RSASHA1NSEC3SHA1: true, dns.RSASHA256: true,
+		dns.RSASHA512: true, dns.ECDSAP256SHA256: true, dns.ECDSAP384SHA384: true,
+		dns.ED25519: true,
+	}
+	supportedDigests = map[uint8]bool{
+		dns.SHA1: true, dns.SHA256: true, dns.SHA384: true,
+	}
+)
+
+// What a validated negative answer proved.
+type denial struct {
+	nxdomain bool
+
+	// The name is a delegation without DS records (or, with NSEC3 opt-out,
+	// may be), so the zone below it is insecure.
+	delegation bool
+	optOut     bool
+}
+
+// The state of the validation of one answer.
+type validation struct {
+	r     *Resolver
+	ctx   context.Context
+	depth int
+	now   time.Time
+}
+
+type rrset struct {
+	rrs  []dns.RR
+	sigs []*dns.RRSIG
+}
+
+// Groups the records of a section into RRsets, each with its signatures.
+func rrsets(section []dns.RR) map[string]*rrset {
+	sets := make(map[string]*rrset)
+	get := func(name string, t uint16) *rrset {
+		key := setKey(name, t)
+		s, ok := sets[key]
+		if !ok {
+			s = &rrset{}
+			sets[key] = s
+		}
+		return s
+	}
+
+	for _, rr := range section {
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			s := get(sig.Hdr.Name, sig.TypeCovered)
+			s.sigs = append(s.sigs, sig)
+			continue
+		}
+		s := get(rr.Header().Name, rr.Header().Rrtype)
+		s.rrs = append(s.rrs, rr)
+	}
+
+	for key, s := range sets {
+		if len(s.rrs) == 0 {
+			delete(sets, key)
+		}
+	}
+
+	return sets
+}
+
+func setKey(name string, t uint16) string {
+	return fmt.Sprintf("%s/%d", strings.ToLower(dns.Fqdn(name)), t)
+}
+
+func bogus(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s", ErrBogus, fmt.Sprintf(format, args...))
+}
+
+// Validates an answer to a query for name and qtype, following any CNAMEs and
+// DNAMEs in it to the records sought, or to the proof that they don't exist.
+// Returns whether the answer is secure (false if it is provably insecure), and
+// for a negative answer, what was proven.
+func (v *validation) response(m *dns.Msg, name string, qtype uint16) (bool, *denial, error) {
+	answer := rrsets(m.Answer)
+	authority := rrsets(m.Ns)
+	secure := true
+
+	for i := 0; ; i++ {
+		if i > maxChain {
+			return false, nil, bogus("CNAME chain from %s is too long", name)
+		}
+
+		if s, ok := answer[setKey(name, qtype)]; ok {
+			sec, err := v.verifyAnswer(s, authority, qtype == dns.TypeDS)
+			return secure && sec, nil, err
+		}
+
+		if s, ok := answer[setKey(name, dns.TypeCNAME)]; ok {
+			sec, err := v.verifyAnswer(s, authority, false)
+			if err != nil {
+				return false, nil, err
+			}
+			secure = secure && sec
+			name = strings.ToLower(s.rrs[0].(*dns.CNAME).Target)
+			continue
+		}
+
+		if owner, target := findDNAME(answer, name); owner != "" {
+			// The CNAME synthesized from the DNAME is unsigned, so it's the
+			// DNAME which must validate.
+			sec, err := v.verifyRRset(answer[setKey(owner, dns.TypeDNAME)], false)
+			if err != nil {
+				return false, nil, err
+			}
+			secure = secure && sec
+			name = target
+			continue
+		}
+
+		sec, den, err := v.negative(authority, name, qtype, m.Rcode == dns.RcodeNameError)
+		return secure && sec, den, err
+	}
+}
+
+// Returns the owner of a DNAME in the answer above name, and the name to
+// which it redirects name.
+func findDNAME(answer map[string]*rrset, name string) (owner, target string) {
+	labels := dns.SplitDomainName(name)
+	for i := 1; i <= len(labels); i++ {
+		owner := dns.Fqdn(strings.Join(labels[i:], "."))
+		if s, ok := answer[setKey(owner, dns.TypeDNAME)]; ok {
+			d := s.rrs[0].(*dns.DNAME)
+			return owner, strings.ToLower(dns.Fqdn(strings.Join(labels[:i], ".") + "." + d.Target))
+		}
+	}
+	return "", ""
+}
+
+// Verifies an RRset in the answer, and if it was synthesized from a wildcard,
+// the proof in the authority section that the name sought doesn't exist.
+func (v *validation) verifyAnswer(s *rrset, authority map[string]*rrset, isDS bool) (bool, error) {
+	secure, err := v.verifyRRset(s, isDS)
+	if err != nil || !secure {
+		return secure, err
+	}
+
+	name := strings.ToLower(s.rrs[0].Header().Name)
+	for _, sig := range s.sigs {
+		labels := dns.CountLabel(name)
+		if int(sig.Labels) >= labels {
+			continue
+		}
+
+		// sig.Labels is the number of labels in the wildcard's owner, less
+		// the asterisk: the closest encloser.
+		ce := ancestor(name, int(sig.Labels))
+		nextCloser := ancestor(name, int(sig.Labels)+1)
+		nsecs, nsec3s, sec, err := v.denialRecords(authority)
+		if err != nil || !sec {
+			return sec, err
+		}
+		// The NSEC record must show not only that name doesn't exist, but
+		// that no name between it and the closest encloser does, else the
+		// answer could have been synthesized from a closer wildcard or be
+		// NXDOMAIN (RFC 4035 section 5.3.4).
+		for _, n := range nsecs {
+			if covers(n, name) && closestEncloser(name, n) == ce {
+				return true, nil
+			}
+		}
+		for _, n := range nsec3s {
+			if n.Cover(nextCloser) {
+				return n.Flags&1 == 0, nil
+			}
+		}
+		return false, bogus("no proof that %s doesn't exist for the wildcard at %s", name, ce)
+	}
+
+	return true, nil
+}
+
+// Verifies an RRset's signatures. Returns false without error if it is
+// unsigned because it's in an insecure zone. isDS makes the signer be a
+// proper ancestor, as a DS RRset is signed by the parent zone.
+func (v *validation) verifyRRset(s *rrset, isDS bool) (bool, error) {
+	name := strings.ToLower(s.rrs[0].Header().Name)
+
+	var lastErr error
+	for _, sig := range s.sigs {
+		signer := strings.ToLower(dns.Fqdn(sig.SignerName))
+		if !dns.IsSubDomain(signer, name) || (isDS && signer == name) {
+			continue
+		}
+
+		keys, secure, err := v.zoneKeys(signer)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if !secure {
+			return false, nil
+		}
+
+		if !sig.ValidityPeriod(v.now) {
+			lastErr = bogus("signature by %s over %s %s has expired or isn't valid yet", signer, name, dns.TypeToString[sig.TypeCovered])
+			continue
+		}
+
+		for _, k := range keys {
+			if k.KeyTag() == sig.KeyTag && k.Algorithm == sig.Algorithm && sig.Verify(k, s.rrs) == nil {
+				return true, nil
+			}
+		}
+		lastErr = bogus("signature by %s over %s %s doesn't verify", signer, name, dns.TypeToString[sig.TypeCovered])
+	}
+
+	if lastErr != nil {
+		return false, lastErr
+	}
+
+	if v.insecure(name, isDS) {
+		return false, nil
+	}
+	return false, bogus("%s %s isn't signed", name, dns.TypeToString[s.rrs[0].Header().Rrtype])
+}
+
+// Returns the zone's validated DNSKEYs, or false if it is provably insecure.
+func (v *validation) zoneKeys(zone string) ([]*dns.DNSKEY, bool, error) {
+	key := "keys/" + zone
+	if e := v.r.cached(key); e != nil {
+		return e.keys, e.keys != nil, nil
+	}
+
+	if v.depth > maxDepth {
+		return nil, false, bogus("chain of trust for %s is too long", zone)
+	}
+
+	// The DS records which say which keys sign the zone's DNSKEYs: its trust
+	// anchor, or those published by its parent.
+	var matches func(k *dns.DNSKEY) bool
+	supported := false
+	if anchors := v.r.anchors[zone]; anchors != nil {
+		for _, a := range anchors {
+			supported = supported || (supportedAlgorithms[a.DS.Algorithm] && supportedDigests[a.DS.DigestType])
+		}
+		matches = func(k *dns.DNSKEY) bool {
+			for i := range anchors {
+				if anchors[i].Matches(k) {
+					return true
+				}
+			}
+			return false
+		}
+	} else {
+		if zone == "." || !v.belowAnchor(zone) {
+			// Nothing can validate it.
+			v.r.store(key, &cacheEntry{}, maxCacheTTL)
+			return nil, false, nil
+		}
+
+		res, den, err := v.r.query(v.ctx, zone, dns.TypeDS, v.depth)
+		if err != nil {
+			return nil, false, err
+		}
+		if den != nil && den.nxdomain {
+			return nil, false, bogus("zone %s doesn't exist", zone)
+		}
+		if !res.Secure || (den != nil && (den.delegation || den.optOut)) {
+			v.r.store(key, &cacheEntry{}, responseTTL(res.Msg, v.now))
+			return nil, false, nil
+		}
+		if den != nil {
+			// Proven to have no DS records, but also not to be a delegation:
+			// whatever signed with this name, it isn't a zone.
+			return nil, false, bogus("%s isn't a zone", zone)
+		}
+
+		var dss []trustanchor.Anchor
+		for _, rr := range res.Msg.Answer {
+			if ds, ok := rr.(*dns.DS); ok && strings.EqualFold(ds.Hdr.Name, zone) {
+				dss = append(dss, trustanchor.Anchor{Zone: zone, DS: ds})
+				supported = supported || (supportedAlgorithms[ds.Algorithm] && supportedDigests[ds.DigestType])
+			}
+		}
+		matches = func(k *dns.DNSKEY) bool {
+			for i := range dss {
+				if dss[i].Matches(k) {
+					return true
+				}
+			}
+			return false
+		}
+	}
+
+	if !supported {
+		v.r.store(key, &cacheEntry{}, maxCacheTTL)
+		return nil, false, nil
+	}
+
+	m, err := v.r.send(v.ctx, zone, dns.TypeDNSKEY)
+	if err != nil {
+		return nil, false, err
+	}
+	s, ok := rrsets(m.Answer)[setKey(zone, dns.TypeDNSKEY)]
+	if !ok {
+		return nil, false, bogus("%s has no DNSKEY records", zone)
+	}
+
+	var keys []*dns.DNSKEY
+	for _, rr := range s.rrs {
+		if k, ok := rr.(*dns.DNSKEY); ok && k.Flags&dns.ZONE != 0 {
+			keys = append(keys, k)
+		}
+	}
+
+	for _, k := range keys {
+		if !matches(k) {
+			continue
+		}
+		for _, sig := range s.sigs {
+			if sig.KeyTag == k.KeyTag() && sig.Algorithm == k.Algorithm && sig.ValidityPeriod(v.now) && sig.Verify(k, s.rrs) == nil {
+				v.r.store(key, &cacheEntry{keys: keys}, responseTTL(m, v.now))
+				return keys, true, nil
+			}
+		}
+	}
+
+	return nil, false, bogus("DNSKEY records of %s aren't signed by a key its DS records designate", zone)
+}
+
+// Returns true if a trust anchor is configured for an ancestor of name.
+func (v *validation) belowAnchor(name string) bool {
+	return v.closestAnchor(name) != ""
+}
+
+func (v *validation) closestAnchor(name string) string {
+	labels := dns.SplitDomainName(name)
+	for i := 1; i <= len(labels); i++ {
+		zone := dns.Fqdn(strings.Join(labels[i:], "."))
+		if _, ok := v.r.anchors[zone]; ok {
+			return zone
+		}
+	}
+	return ""
+}
+
+// Returns true if name is provably in an insecure zone: below a delegation
+// without DS records from a zone validated from the closest trust anchor.
+// isDS means name's own delegation doesn't count, as for a DS RRset.
+func (v *validation) insecure(name string, isDS bool) bool {
+	if _, ok := v.r.anchors[name]; ok && !isDS {
+		return false
+	}
+	anchor := v.closestAnchor(name)
+	if anchor == "" {
+		return true
+	}
+
+	last := dns.CountLabel(name)
+	if isDS {
+		last--
+	}
+	for n := dns.CountLabel(anchor) + 1; n <= last; n++ {
+		cut := ancestor(name, n)
+		if _, ok := v.r.anchors[cut]; ok {
+			continue
+		}
+
+		res, den, err := v.r.query(v.ctx, cut, dns.TypeDS, v.depth)
+		if err != nil {
+			return false
+		}
+		if !res.Secure {
+			return true
+		}
+		if den != nil {
+			if den.nxdomain {
+				return false
+			}
+			if den.delegation || den.optOut {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Collects and verifies the NSEC and NSEC3 records in the authority section.
+func (v *validation) denialRecords(authority map[string]*rrset) (nsecs []*dns.NSEC, nsec3s []*dns.NSEC3, secure bool, err error) {
+	secure = true
+	for _, s := range authority {
+		switch s.rrs[0].(type) {
+		case *dns.NSEC, *dns.NSEC3:
+		default:
+			continue
+		}
+
+		sec, err := v.verifyRRset(s, false)
+		if err != nil {
+			return nil, nil, false, err
+		}
+		secure = secure && sec
+
+		for _, rr := range s.rrs {
+			switch rr := rr.(type) {
+			case *dns.NSEC:
+				nsecs = append(nsecs, rr)
+			case *dns.NSEC3:
+				if rr.Iterations > maxNSEC3Iterations {
+					secure = false
+				}
+				nsec3s = append(nsec3s, rr)
+			}
+		}
+	}
+
+	return nsecs, nsec3s, secure, nil
+}
+
+// Validates the proof in the authority section that name has no records of
+// type qtype, or with nxdomain, that it doesn't exist at all.
+func (v *validation) negative(authority map[string]*rrset, name string, qtype uint16, nxdomain bool) (bool, *denial, error) {
+	den := &denial{nxdomain: nxdomain}
+
+	for _, s := range authority {
+		if _, ok := s.rrs[0].(*dns.SOA); ok {
+			if _, err := v.verifyRRset(s, false); err != nil {
+				return false, nil, err
+			}
+		}
+	}
+
+	nsecs, nsec3s, secure, err := v.denialRecords(authority)
+	if err != nil {
+		return false, nil, err
+	}
+	if len(nsecs) == 0 && len(nsec3s) == 0 {
+		if v.insecure(name, qtype == dns.TypeDS) {
+			return false, den, nil
+		}
+		return false, nil, bogus("no proof that %s %s doesn't exist", name, dns.TypeToString[qtype])
+	}
+	if !secure {
+		return false, den, nil
+	}
+
+	var ok bool
+	if len(nsecs) > 0 {
+		ok = nsecDenial(nsecs, name, qtype, den)
+	} else {
+		ok = nsec3Denial(nsec3s, name, qtype, den)
+	}
+	if !ok {
+		return false, nil, bogus("NSEC records don't prove that %s %s doesn't exist", name, dns.TypeToString[qtype])
+	}
+
+	return !den.optOut, den, nil
+}
+
+func nsecDenial(nsecs []*dns.NSEC, name string, qtype uint16, den *denial) bool {
+	if !den.nxdomain {
+		for _, n := range nsecs {
+			if strings.EqualFold(n.Hdr.Name, name) {
+				if hasType(n.TypeBitMap, qtype) || hasType(n.TypeBitMap, dns.TypeCNAME) {
+					return false
+				}
+				den.delegation = hasType(n.TypeBitMap, dns.TypeNS) && !hasType(n.TypeBitMap, dns.TypeSOA)
+				return true
+			}
+		}
+	}
+
+	// Either name doesn't exist, or (for NODATA) it's an empty non-terminal,
+	// or it was synthesized from a wildcard without records of the type.
+	var cover *dns.NSEC
+	for _, n := range nsecs {
+		if covers(n, name) {
+			cover = n
+			break
+		}
+	}
+	if cover == nil {
+		return false
+	}
+
+	if !den.nxdomain && dns.IsSubDomain(name, strings.ToLower(cover.NextDomain)) && !strings.EqualFold(name, cover.NextDomain) {
+		return true
+	}
+
+	ce := closestEncloser(name, cover)
+	wildcard := "*." + ce
+	if ce == "." {
+		wildcard = "*."
+	}
+	for _, n := range nsecs {
+		if den.nxdomain && covers(n, wildcard) {
+			return true
+		}
+		if !den.nxdomain && strings.EqualFold(n.Hdr.Name, wildcard) {
+			return !hasType(n.TypeBitMap, qtype) && !hasType(n.TypeBitMap, dns.TypeCNAME)
+		}
+	}
+
+	return false
+}
+
+func nsec3Denial(nsec3s []*dns.NSEC3, name string, qtype uint16, den *denial) bool {
+	if !den.nxdomain {
+		for _, n := range nsec3s {
+			if n.Match(name) {
+				if hasType(n.TypeBitMap, qtype) || hasType(n.TypeBitMap, dns.TypeCNAME) {
+					return false
+				}
+				den.delegation = hasType(n.TypeBitMap, dns.TypeNS) && !hasType(n.TypeBitMap, dns.TypeSOA)
+				return true
+			}
+		}
+	}
+
+	// The closest encloser proof of RFC 5155 section 7.2.1: the closest
+	// ancestor which exists, and a record covering the name one label
+	// longer.
+	ce, nextCloser := "", ""
+	labels := dns.CountLabel(name)
+	for n := labels - 1; n >= 0 && ce == ""; n-- {
+		candidate := ancestor(name, n)
+		for _, r := range nsec3s {
+			if r.Match(candidate) {
+				ce, nextCloser = candidate, ancestor(name, n+1)
+				break
+			}
+		}
+	}
+	if ce == "" {
+		return false
+	}
+
+	var cover *dns.NSEC3
+	for _, r := range nsec3s {
+		if r.Cover(nextCloser) {
+			cover = r
+			break
+		}
+	}
+	if cover == nil {
+		return false
+	}
+
+	if cover.Flags&1 != 0 {
+		// Opt-out: there may be an unsigned delegation at nextCloser, so
+		// nothing is proven about names at or below it.
+		den.optOut = true
+		return true
+	}
+
+	wildcard := "*." + ce
+	if ce == "." {
+		wildcard = "*."
+	}
+	for _, r := range nsec3s {
+		if den.nxdomain && r.Cover(wildcard) {
+			return true
+		}
+		if !den.nxdomain && r.Match(wildcard) {
+			return !hasType(r.TypeBitMap, qtype) && !hasType(r.TypeBitMap, dns.TypeCNAME)
+		}
+	}
+
+	return false
+}
+
+func hasType(bitmap []uint16, t uint16) bool {
+	for _, b := range bitmap {
+		if b == t {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the ancestor of name (or name itself) with n labels.
+func ancestor(name string, n int) string {
+	labels := dns.SplitDomainName(name)
+	if n >= len(labels) {
+		return dns.Fqdn(strings.ToLower(name))
+	}
+	if n <= 0 {
+		return "."
+	}
+	return strings.ToLower(dns.Fqdn(strings.Join(labels[len(labels)-n:], ".")))
+}
+
+// Returns the closest encloser of a name an NSEC record covers: the longest
+// ancestor it shares with the owner or next name.
+func closestEncloser(name string, n *dns.NSEC) string {
+	common := dns.CompareDomainName(name, n.Hdr.Name)
+	if c := dns.CompareDomainName(name, n.NextDomain); c > common {
+		common = c
+	}
+	return ancestor(name, common)
+}
+
+// Returns true if the NSEC record proves that name doesn't exist: it falls
+// strictly between the owner and next name in canonical order, or after the
+// owner of the last record in the zone.
+func covers(n *dns.NSEC, name string) bool {
+	owner, next := n.Hdr.Name, n.NextDomain
+	if !dns.IsSubDomain(zoneOf(n), name) {
+		return false
+	}
+
+	if rrsort.CompareNames(owner, next) < 0 {
+		return rrsort.CompareNames(owner, name) < 0 && rrsort.CompareNames(name, next) < 0
+	}
+	// The last NSEC in the zone, whose next name is the apex.
+	return rrsort.CompareNames(owner, name) < 0 && dns.IsSubDomain(next, name)
+}
+
+// Returns the zone an NSEC record belongs to, from its signatures' signer
+// name, which the caller has verified, or failing that its next name (the
+// apex, for the last record).
+func zoneOf(n *dns.NSEC) string {
+	if rrsort.CompareNames(n.Hdr.Name, n.NextDomain) >= 0 {
+		return n.NextDomain
+	}
+	common := dns.CompareDomainName(n.Hdr.Name, n.NextDomain)
+	return ancestor(n.Hdr.Name, common)
+}
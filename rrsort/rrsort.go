@@ -0,0 +1,182 @@
+// Package rrsort puts DNS records in a canonical order, so that output
+// listing them, such as zone dumps, is the same from one run to the next
+// whatever order the records were built in. Names are in the canonical order
+// of RFC 4034 section 6.1, types in numeric order, as in NSEC type bitmaps,
+// and the records of each RRset in the canonical order of their RDATA, as
+// RFC 4034 section 6.3 gives for signing them.
+package rrsort
+
+import (
+	"bytes"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Compares domain names in the canonical order of RFC 4034 section 6.1:
+// label by label from the root, as unescaped octets without regard to case,
+// so that a name sorts just after its parent.
+func CompareNames(a, b string) int {
+	la, lb := wireLabels(a), wireLabels(b)
+	for i := 1; i <= len(la) && i <= len(lb); i++ {
+		if c := strings.Compare(la[len(la)-i], lb[len(lb)-i]); c != 0 {
+			return c
+		}
+	}
+	return len(la) - len(lb)
+}
+
+// Returns the labels of a name, unescaped and in lower case.
+func wireLabels(name string) []string {
+	buf := make([]byte, 256)
+	off, err := dns.PackDomainName(dns.CanonicalName(name), buf, 0, nil, false)
+	if err != nil {
+		return dns.SplitDomainName(strings.ToLower(name))
+	}
+
+	var labels []string
+	for i := 0; i < off && buf[i] != 0; i += int(buf[i]) + 1 {
+		labels = append(labels, string(buf[i+1:i+1+int(buf[i])]))
+	}
+	return labels
+}
+
+// Compares records by owner name, then type, then class, then RDATA in
+// canonical form, and then, as records of an RRset should have the same TTL
+// anyway, TTL, so that no two different records compare equal.
+func Compare(a, b dns.RR) int {
+	ha, hb := a.Header(), b.Header()
+	if c := CompareNames(ha.Name, hb.Name); c != 0 {
+		return c
+	}
+	if ha.Rrtype != hb.Rrtype {
+		return int(ha.Rrtype) - int(hb.Rrtype)
+	}
+	if ha.Class != hb.Class {
+		return int(ha.Class) - int(hb.Class)
+	}
+	if c := compareRDATA(a, b, canonicalRDATA(a), canonicalRDATA(b)); c != 0 {
+		return c
+	}
+	return compareTTLs(ha.Ttl, hb.Ttl)
+}
+
+// Sorts records by Compare. The order of records which compare equal is kept.
+func Sort(rrs []dns.RR) {
+	if len(rrs) < 2 {
+		return
+	}
+	s := &sorter{rrs: rrs, rdata: make([][]byte, len(rrs))}
+	for i, rr := range rrs {
+		s.rdata[i] = canonicalRDATA(rr)
+	}
+	sort.Stable(s)
+}
+
+// Sorts the records of an RRset, which share their owner name, type and
+// class, as Sort would, without comparing their names.
+func SortRRset(rrset []dns.RR) {
+	if len(rrset) < 2 {
+		return
+	}
+	s := &sorter{rrs: rrset, rdata: make([][]byte, len(rrset)), rdataOnly: true}
+	for i, rr := range rrset {
+		s.rdata[i] = canonicalRDATA(rr)
+	}
+	sort.Stable(s)
+}
+
+// Sorts records with their canonical RDATA worked out once each, rather
+// than on every comparison.
+type sorter struct {
+	rrs       []dns.RR
+	rdata     [][]byte
+	rdataOnly bool
+}
+
+func (s *sorter) Len() int {
+	return len(s.rrs)
+}
+
+func (s *sorter) Swap(i, j int) {
+	s.rrs[i], s.rrs[j] = s.rrs[j], s.rrs[i]
+	s.rdata[i], s.rdata[j] = s.rdata[j], s.rdata[i]
+}
+
+func (s *sorter) Less(i, j int) bool {
+	a, b := s.rrs[i], s.rrs[j]
+	if !s.rdataOnly {
+		ha, hb := a.Header(), b.Header()
+		if c := CompareNames(ha.Name, hb.Name); c != 0 {
+			return c < 0
+		}
+		if ha.Rrtype != hb.Rrtype {
+			return ha.Rrtype < hb.Rrtype
+		}
+		if ha.Class != hb.Class {
+			return ha.Class < hb.Class
+		}
+	}
+	if c := compareRDATA(a, b, s.rdata[i], s.rdata[j]); c != 0 {
+		return c < 0
+	}
+	return a.Header().Ttl < b.Header().Ttl
+}
+
+func compareTTLs(a, b uint32) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// Compares the canonical RDATA of a and b, as an unsigned left-justified
+// octet string. If either couldn't be packed, their text is compared
+// instead, so that the order is still stable.
+func compareRDATA(a, b dns.RR, ra, rb []byte) int {
+	if ra == nil || rb == nil {
+		return strings.Compare(a.String(), b.String())
+	}
+	return bytes.Compare(ra, rb)
+}
+
+// Returns the RDATA of rr in the canonical form of RFC 4034 section 6.2,
+// uncompressed and with the domain names of the types listed there, as
+// amended by RFC 6840 section 5.1, in lower case. Returns nil if rr can't be
+// packed.
+func canonicalRDATA(rr dns.RR) []byte {
+	c := dns.Copy(rr)
+	switch rr := c.(type) {
+	case *dns.NS:
+		rr.Ns = strings.ToLower(rr.Ns)
+	case *dns.CNAME:
+		rr.Target = strings.ToLower(rr.Target)
+	case *dns.DNAME:
+		rr.Target = strings.ToLower(rr.Target)
+	case *dns.PTR:
+		rr.Ptr = strings.ToLower(rr.Ptr)
+	case *dns.MX:
+		rr.Mx = strings.ToLower(rr.Mx)
+	case *dns.SRV:
+		rr.Target = strings.ToLower(rr.Target)
+	case *dns.SOA:
+		rr.Ns, rr.Mbox = strings.ToLower(rr.Ns), strings.ToLower(rr.Mbox)
+	case *dns.RRSIG:
+		rr.SignerName = strings.ToLower(rr.SignerName)
+	}
+
+	// With the root as its owner name, the header is the 11 octets before
+	// the RDATA.
+	const headerLen = 11
+	c.Header().Name = "."
+	buf := make([]byte, dns.Len(c)+headerLen)
+	off, err := dns.PackRR(c, buf, 0, nil, false)
+	if err != nil || off < headerLen {
+		return nil
+	}
+	return buf[headerLen:off]
+}
@@ -0,0 +1,106 @@
+package rrsort
+
+import (
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// The example of RFC 4034 section 6.1.
+func TestCompareNames(t *testing.T) {
+	ordered := []string{
+		"example.",
+		"a.example.",
+		"yljkjljk.a.example.",
+		"Z.a.example.",
+		"zABC.a.EXAMPLE.",
+		"z.example.",
+		"*.z.example.",
+	}
+	for i := range ordered {
+		for j := range ordered {
+			c := CompareNames(ordered[i], ordered[j])
+			if (c < 0) != (i < j) || (c == 0) != (i == j) {
+				t.Errorf("CompareNames(%q, %q) = %d", ordered[i], ordered[j], c)
+			}
+		}
+	}
+	if c := CompareNames("EXAMPLE.bit.", "example.BIT."); c != 0 {
+		t.Errorf("names differing in case compare %d", c)
+	}
+}
+
+func mustRR(t *testing.T, s string) dns.RR {
+	rr, err := dns.NewRR(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rr
+}
+
+// However the records are shuffled, they're sorted the same way.
+func TestSort(t *testing.T) {
+	expected := []string{
+		"bit.\t600\tIN\tNS\tns.example.com.",
+		"bit.\t600\tIN\tNS\tns1.example.bit.",
+		"example.bit.\t600\tIN\tA\t192.0.2.1",
+		"example.bit.\t300\tIN\tA\t192.0.2.2",
+		"example.bit.\t600\tIN\tA\t192.0.2.2",
+		"example.bit.\t600\tIN\tA\t192.0.2.10",
+		"example.bit.\t600\tIN\tTXT\t\"a\"",
+		"example.bit.\t600\tIN\tTXT\t\"b\" \"c\"",
+		"example.bit.\t600\tIN\tAAAA\t2001:db8::1",
+		"*.example.bit.\t600\tIN\tA\t192.0.2.3",
+		"www.example.bit.\t600\tIN\tCNAME\texample.bit.",
+	}
+	var rrs []dns.RR
+	for _, s := range expected {
+		rrs = append(rrs, mustRR(t, s))
+	}
+
+	r := rand.New(rand.NewSource(1))
+	for n := 0; n < 20; n++ {
+		r.Shuffle(len(rrs), func(i, j int) { rrs[i], rrs[j] = rrs[j], rrs[i] })
+		Sort(rrs)
+		var got []string
+		for _, rr := range rrs {
+			got = append(got, rr.String())
+		}
+		if strings.Join(got, "\n") != strings.Join(expected, "\n") {
+			t.Fatalf("sorted to:\n%s", strings.Join(got, "\n"))
+		}
+	}
+}
+
+// RDATA is compared in canonical form, so that case in the domain names of an
+// NS record doesn't change its place, and TTLs only break ties.
+func TestCompareRDATA(t *testing.T) {
+	for _, c := range []struct {
+		a, b     string
+		expected int
+	}{
+		{"bit. 600 IN NS NS.EXAMPLE.COM.", "bit. 600 IN NS ns.example.com.", 0},
+		{"bit. 600 IN NS NS.EXAMPLE.COM.", "bit. 600 IN NS ns1.example.bit.", -1},
+		{"a.bit. 60 IN A 192.0.2.1", "a.bit. 600 IN A 192.0.2.1", -1},
+		{"a.bit. 600 IN A 192.0.2.1", "a.bit. 60 IN A 192.0.2.2", -1},
+		{"a.bit. 600 IN A 192.0.2.200", "a.bit. 600 IN A 192.0.2.30", 1},
+		{"a.bit. 600 IN MX 10 mx.a.bit.", "a.bit. 600 IN MX 5 mx.a.bit.", 1},
+	} {
+		got := Compare(mustRR(t, c.a), mustRR(t, c.b))
+		if (got < 0) != (c.expected < 0) || (got == 0) != (c.expected == 0) {
+			t.Errorf("Compare(%s, %s) = %d, expected %d", c.a, c.b, got, c.expected)
+		}
+	}
+
+	rrset := []dns.RR{
+		mustRR(t, "a.bit. 600 IN A 192.0.2.30"),
+		mustRR(t, "a.bit. 600 IN A 192.0.2.200"),
+		mustRR(t, "a.bit. 600 IN A 192.0.2.4"),
+	}
+	SortRRset(rrset)
+	if s := rrset[0].(*dns.A).A.String() + " " + rrset[1].(*dns.A).A.String() + " " + rrset[2].(*dns.A).A.String(); s != "192.0.2.4 192.0.2.30 192.0.2.200" {
+		t.Errorf("sorted to %s", s)
+	}
+}
@@ -0,0 +1,219 @@
+// Package scheduler spreads outgoing background work, such as NOTIFY messages
+// and health probes, over time and bounds how much of it runs at once.
+//
+// Work triggered by a single event (e.g. a new block) would otherwise be
+// started at the same instant, causing synchronized bursts of outbound
+// traffic. Each task is instead started after a random delay of up to the
+// configured jitter, and no more than the configured number of tasks run
+// concurrently; the rest wait in a queue.
+package scheduler
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/namecoin/ncdns/clock"
+)
+
+// Scheduler configuration.
+type Config struct {
+	// Tasks are started after a random delay between zero and Jitter.
+	Jitter time.Duration
+
+	// Maximum number of tasks to run concurrently. Zero means no limit.
+	MaxConcurrent int
+
+	// If nil, the system clock is used.
+	Clock clock.Clock
+
+	// Returns a random number in [0, n). If nil, math/rand is used.
+	Rand func(n int64) int64
+}
+
+// Statistics about a scheduler's tasks.
+type Stats struct {
+	// Tasks waiting for their jittered start time.
+	Delayed int
+
+	// Tasks whose start time has passed, waiting for a free slot.
+	Queued int
+
+	// Tasks currently running.
+	Running int
+
+	// Tasks which have finished running.
+	Completed uint64
+
+	// Total time finished tasks spent queued after their start time, and
+	// running. Divide by Completed for averages.
+	TotalWait, TotalRun time.Duration
+
+	// The longest time any task has spent queued.
+	MaxWait time.Duration
+}
+
+// A Scheduler runs tasks with jitter and a concurrency limit.
+type Scheduler struct {
+	cfg Config
+
+	mu       sync.Mutex
+	timers   map[*task]func() // cancel the wait for each task's start time
+	queue    []*task
+	stats    Stats
+	stopped  bool
+	finished sync.WaitGroup
+}
+
+type task struct {
+	f       func()
+	due     time.Time
+	started time.Time
+}
+
+// Creates a scheduler.
+func New(cfg *Config) *Scheduler {
+	s := &Scheduler{
+		cfg:    *cfg,
+		timers: map[*task]func(){},
+	}
+	s.cfg.Clock = clock.Or(s.cfg.Clock)
+	if s.cfg.Rand == nil {
+		s.cfg.Rand = rand.Int63n
+	}
+
+	return s
+}
+
+// Schedules f to be run once, after a random delay of up to the configured
+// jitter and once fewer than the maximum number of tasks are running. Does
+// nothing if the scheduler has been stopped.
+func (s *Scheduler) Schedule(f func()) {
+	s.ScheduleAfter(0, f)
+}
+
+// Like Schedule, but the random delay is added to d.
+func (s *Scheduler) ScheduleAfter(d time.Duration, f func()) {
+	delay := d
+	if s.cfg.Jitter > 0 {
+		delay += time.Duration(s.cfg.Rand(int64(s.cfg.Jitter)))
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.stopped {
+		return
+	}
+
+	t := &task{
+		f:   f,
+		due: s.cfg.Clock.Now().Add(delay),
+	}
+
+	s.stats.Delayed++
+	timer := s.cfg.Clock.NewTimer(delay)
+	cancel := make(chan struct{})
+	s.timers[t] = func() {
+		timer.Stop()
+		close(cancel)
+	}
+	go func() {
+		select {
+		case <-timer.C():
+			s.ready(t)
+		case <-cancel:
+		}
+	}()
+}
+
+// Called when a task's start time arrives.
+func (s *Scheduler) ready(t *task) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.timers[t]; !ok {
+		// Cancelled by Stop.
+		return
+	}
+	delete(s.timers, t)
+	s.stats.Delayed--
+
+	if s.cfg.MaxConcurrent > 0 && s.stats.Running >= s.cfg.MaxConcurrent {
+		s.queue = append(s.queue, t)
+		s.stats.Queued++
+		return
+	}
+
+	s.start(t)
+}
+
+// Must be called with mu held.
+func (s *Scheduler) start(t *task) {
+	t.started = s.cfg.Clock.Now()
+	s.stats.Running++
+	s.finished.Add(1)
+	go s.run(t)
+}
+
+func (s *Scheduler) run(t *task) {
+	defer s.finished.Done()
+
+	t.f()
+	ran := s.cfg.Clock.Now().Sub(t.started)
+	wait := t.started.Sub(t.due)
+	if wait < 0 {
+		wait = 0
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.stats.Running--
+	s.stats.Completed++
+	s.stats.TotalWait += wait
+	s.stats.TotalRun += ran
+	if wait > s.stats.MaxWait {
+		s.stats.MaxWait = wait
+	}
+
+	if len(s.queue) > 0 && !s.stopped {
+		next := s.queue[0]
+		s.queue = s.queue[1:]
+		s.stats.Queued--
+		s.start(next)
+	}
+}
+
+// Returns statistics about the scheduler's tasks.
+func (s *Scheduler) Stats() Stats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.stats
+}
+
+// Returns the number of tasks which have been scheduled but not started.
+func (s *Scheduler) QueueDepth() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.stats.Delayed + s.stats.Queued
+}
+
+// Discards tasks which haven't started yet and waits for running tasks to
+// finish. Tasks scheduled after Stop are ignored.
+func (s *Scheduler) Stop() {
+	s.mu.Lock()
+	s.stopped = true
+	for t, cancel := range s.timers {
+		cancel()
+		delete(s.timers, t)
+	}
+	s.stats.Delayed = 0
+	s.queue = nil
+	s.stats.Queued = 0
+	s.mu.Unlock()
+
+	s.finished.Wait()
+}
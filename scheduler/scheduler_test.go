@@ -0,0 +1,172 @@
+package scheduler
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/namecoin/ncdns/testutil"
+)
+
+func waitFor(t *testing.T, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for condition")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestJitterSpreadsTasks(t *testing.T) {
+	clock := testutil.NewFakeClock(time.Unix(1000, 0))
+	delays := []int64{int64(3 * time.Second), int64(1 * time.Second), int64(2 * time.Second)}
+	i := 0
+	s := New(&Config{
+		Jitter: 10 * time.Second,
+		Clock:  clock,
+		Rand: func(n int64) int64 {
+			if n != int64(10*time.Second) {
+				t.Errorf("random delay requested in [0, %d)", n)
+			}
+			d := delays[i]
+			i++
+			return d
+		},
+	})
+	defer s.Stop()
+
+	var mu sync.Mutex
+	var order []int
+	for n := 0; n < 3; n++ {
+		n := n
+		s.Schedule(func() {
+			mu.Lock()
+			order = append(order, n)
+			mu.Unlock()
+		})
+	}
+
+	if d := s.QueueDepth(); d != 3 {
+		t.Fatalf("queue depth %d before any start time, expected 3", d)
+	}
+
+	clock.Advance(1500 * time.Millisecond)
+	waitFor(t, func() bool { return s.Stats().Completed == 1 })
+	if d := s.QueueDepth(); d != 2 {
+		t.Errorf("queue depth %d after one start time, expected 2", d)
+	}
+
+	clock.Advance(time.Second)
+	waitFor(t, func() bool { return s.Stats().Completed == 2 })
+	clock.Advance(time.Second)
+	waitFor(t, func() bool { return s.Stats().Completed == 3 })
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(order) != 3 || order[0] != 1 || order[1] != 2 || order[2] != 0 {
+		t.Errorf("tasks ran in order %v, expected [1 2 0]", order)
+	}
+}
+
+func TestConcurrencyLimit(t *testing.T) {
+	clock := testutil.NewFakeClock(time.Unix(1000, 0))
+	s := New(&Config{
+		MaxConcurrent: 2,
+		Clock:         clock,
+	})
+	defer s.Stop()
+
+	release := make(chan struct{})
+	var mu sync.Mutex
+	running, maxRunning := 0, 0
+	for n := 0; n < 5; n++ {
+		s.Schedule(func() {
+			mu.Lock()
+			running++
+			if running > maxRunning {
+				maxRunning = running
+			}
+			mu.Unlock()
+
+			<-release
+
+			mu.Lock()
+			running--
+			mu.Unlock()
+		})
+	}
+
+	clock.Advance(0)
+	waitFor(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return running == 2
+	})
+
+	waitFor(t, func() bool { return s.Stats().Queued == 3 })
+	if d := s.QueueDepth(); d != 3 {
+		t.Errorf("queue depth %d, expected 3", d)
+	}
+
+	// Queued tasks wait for a slot; that wait is recorded as latency.
+	clock.Advance(time.Second)
+	close(release)
+	waitFor(t, func() bool { return s.Stats().Completed == 5 })
+
+	mu.Lock()
+	defer mu.Unlock()
+	if maxRunning != 2 {
+		t.Errorf("%d tasks ran concurrently, expected at most 2", maxRunning)
+	}
+
+	st := s.Stats()
+	if st.MaxWait != time.Second || st.TotalWait != 3*time.Second {
+		t.Errorf("got max wait %v and total wait %v, expected 1s and 3s", st.MaxWait, st.TotalWait)
+	}
+}
+
+func TestStopDiscardsPendingTasks(t *testing.T) {
+	clock := testutil.NewFakeClock(time.Unix(1000, 0))
+	s := New(&Config{
+		Jitter: time.Minute,
+		Clock:  clock,
+		Rand:   func(n int64) int64 { return n - 1 },
+	})
+
+	ran := make(chan struct{}, 2)
+	s.Schedule(func() { ran <- struct{}{} })
+	s.Stop()
+	s.Schedule(func() { ran <- struct{}{} })
+
+	clock.Advance(2 * time.Minute)
+	select {
+	case <-ran:
+		t.Errorf("task ran after Stop")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	if d := s.QueueDepth(); d != 0 {
+		t.Errorf("queue depth %d after Stop", d)
+	}
+}
+
+func TestScheduleAfter(t *testing.T) {
+	clock := testutil.NewFakeClock(time.Unix(1000, 0))
+	s := New(&Config{
+		Jitter: time.Second,
+		Clock:  clock,
+		Rand:   func(n int64) int64 { return n / 2 },
+	})
+	defer s.Stop()
+
+	s.ScheduleAfter(10*time.Second, func() {})
+
+	clock.Advance(10 * time.Second)
+	if st := s.Stats(); st.Delayed != 1 {
+		t.Errorf("task started before its delay and jitter passed: %+v", st)
+	}
+
+	clock.Advance(500 * time.Millisecond)
+	waitFor(t, func() bool { return s.Stats().Completed == 1 })
+}
@@ -0,0 +1,110 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+
+	"github.com/miekg/dns"
+)
+
+// Parses a comma-separated list of IP addresses and CIDR prefixes, given as
+// the option named. An address on its own is a prefix of just itself. IPv4
+// prefixes match IPv4 clients whether they're seen as such or as
+// IPv4-mapped IPv6 addresses, as on a dual-stack socket.
+func parseIPNets(option, s string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		if !strings.Contains(item, "/") {
+			ip := net.ParseIP(item)
+			if ip == nil {
+				return nil, fmt.Errorf("Couldn't parse %s: %s", option, item)
+			}
+			ip = canonicalIP(ip)
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(8*len(ip), 8*len(ip))})
+			continue
+		}
+
+		_, n, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, fmt.Errorf("Couldn't parse %s: %s", option, item)
+		}
+		nets = append(nets, n)
+	}
+
+	return nets, nil
+}
+
+func ipNetsContain(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Decides which clients may query the server at all, by AllowQueriesFrom and
+// DenyQueriesFrom.
+type queryACL struct {
+	refused uint64 // accessed atomically
+
+	allow []*net.IPNet // empty: all clients not denied
+	deny  []*net.IPNet
+}
+
+// Sets up the access control list if AllowQueriesFrom or DenyQueriesFrom is
+// set.
+func (s *Server) setupQueryACL() error {
+	allow, err := parseIPNets("AllowQueriesFrom", s.cfg.AllowQueriesFrom)
+	if err != nil {
+		return err
+	}
+	deny, err := parseIPNets("DenyQueriesFrom", s.cfg.DenyQueriesFrom)
+	if err != nil {
+		return err
+	}
+	if len(allow) == 0 && len(deny) == 0 {
+		return nil
+	}
+
+	s.queryACL = &queryACL{allow: allow, deny: deny}
+	return nil
+}
+
+// Returns whether a client may query the server: if it isn't in the deny
+// list, and the allow list is empty or it's in it. A client whose address
+// can't be told is refused if there's an allow list.
+func (acl *queryACL) allowed(ip net.IP) bool {
+	if ip == nil {
+		return len(acl.allow) == 0
+	}
+	if ipNetsContain(acl.deny, ip) {
+		return false
+	}
+	return len(acl.allow) == 0 || ipNetsContain(acl.allow, ip)
+}
+
+// Answers REFUSED to a client which may not query the server, returning true
+// if it did.
+func (s *Server) refuseDenied(rw dns.ResponseWriter, req *dns.Msg) bool {
+	if s.queryACL == nil || s.queryACL.allowed(clientIP(rw)) {
+		return false
+	}
+
+	atomic.AddUint64(&s.queryACL.refused, 1)
+	m := new(dns.Msg)
+	m.SetRcode(req, dns.RcodeRefused)
+	if opt := req.IsEdns0(); opt != nil {
+		m.SetEdns0(s.ednsUDPSize(), false)
+		m.IsEdns0().Option = append(m.IsEdns0().Option, &dns.EDNS0_EDE{InfoCode: dns.ExtendedErrorCodeProhibited})
+	}
+	rw.WriteMsg(m)
+	return true
+}
@@ -0,0 +1,77 @@
+package server
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestQueryACL(t *testing.T) {
+	s := newDrainTestServer(t)
+	s.cfg.AllowQueriesFrom = "192.168.0.0/16, fd00::/8,127.0.0.1"
+	s.cfg.DenyQueriesFrom = "192.168.66.0/24"
+	if err := s.setupQueryACL(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		addr    net.Addr
+		allowed bool
+	}{
+		{&net.UDPAddr{IP: net.ParseIP("192.168.1.1"), Port: 1234}, true},
+		{&net.UDPAddr{IP: net.ParseIP("::ffff:192.168.1.1"), Port: 1234}, true},
+		{&net.TCPAddr{IP: net.ParseIP("fd12::1"), Port: 1234}, true},
+		{&net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 1234}, true},
+		{&net.UDPAddr{IP: net.ParseIP("127.0.0.2"), Port: 1234}, false},
+		{&net.UDPAddr{IP: net.ParseIP("198.51.100.1"), Port: 1234}, false},
+		{&net.UDPAddr{IP: net.ParseIP("::ffff:198.51.100.1"), Port: 1234}, false},
+		{&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 1234}, false},
+		{&net.UDPAddr{IP: net.ParseIP("192.168.66.1"), Port: 1234}, false},
+		{&net.UDPAddr{IP: net.ParseIP("::ffff:192.168.66.1"), Port: 1234}, false},
+	}
+
+	refused := 0
+	for _, test := range tests {
+		req := new(dns.Msg)
+		req.SetQuestion("example.bit.", dns.TypeA)
+		req.SetEdns0(1232, false)
+		rw := &fakeResponseWriter{addr: test.addr}
+		s.ServeDNS(rw, req)
+
+		switch {
+		case rw.msg == nil:
+			t.Errorf("%s: no response", test.addr)
+		case test.allowed && (rw.msg.Rcode != dns.RcodeSuccess || len(rw.msg.Answer) == 0):
+			t.Errorf("%s: not answered: %v", test.addr, rw.msg)
+		case !test.allowed && (rw.msg.Rcode != dns.RcodeRefused || len(rw.msg.Answer) != 0):
+			t.Errorf("%s: not refused: %v", test.addr, rw.msg)
+		}
+		if !test.allowed {
+			refused++
+		}
+	}
+	if s.queryACL.refused != uint64(refused) {
+		t.Errorf("counted %d refused queries, expected %d", s.queryACL.refused, refused)
+	}
+
+	// Without an allow list, only those denied are refused.
+	s.cfg.AllowQueriesFrom = ""
+	if err := s.setupQueryACL(); err != nil {
+		t.Fatal(err)
+	}
+	for ip, allowed := range map[string]bool{"198.51.100.1": true, "2001:db8::1": true, "192.168.66.1": false} {
+		if s.queryACL.allowed(canonicalIP(net.ParseIP(ip))) != allowed {
+			t.Errorf("%s: allowed %v", ip, !allowed)
+		}
+	}
+
+	for _, bad := range []string{"192.168.0.0/33", "192.168.0.300", "fd00::/8/8", "example.com"} {
+		s.cfg.DenyQueriesFrom = "10.0.0.0/8, " + bad
+		err := s.setupQueryACL()
+		if err == nil || !strings.Contains(err.Error(), "DenyQueriesFrom: "+bad) {
+			t.Errorf("%q: got error %v, expected one naming it", bad, err)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+//go:build !no_acme
+// +build !no_acme
+
+package server
+
+import (
+	"crypto/tls"
+	"net/http"
+	"strings"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// The certificates for DNS over TLS obtained from an ACME CA such as Let's
+// Encrypt for ACMEHostnames. They're renewed in the background before they
+// expire, each renewed certificate being used for new connections at once.
+// Until one has been obtained for a hostname, or if it can't be, the
+// certificate of TLSCert and TLSKey is served instead, if they're set.
+type acmeCerts struct {
+	m        *autocert.Manager
+	hosts    []string
+	fallback *certReloader // nil if TLSCert isn't set
+}
+
+func (a *acmeCerts) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	// Clients connecting by address, as DNS over TLS clients often do, give
+	// no name, so they're served the certificate of the first hostname.
+	if hello.ServerName == "" {
+		h := *hello
+		h.ServerName = a.hosts[0]
+		hello = &h
+	}
+
+	cert, err := a.m.GetCertificate(hello)
+	if err == nil || a.fallback == nil {
+		return cert, err
+	}
+	log.Warne(err, "couldn't get an ACME certificate for ", hello.ServerName, "; serving TLSCert instead")
+	return a.fallback.getCertificate(hello)
+}
+
+// Wraps h, the webserver's handler, so that it answers the HTTP-01 challenges
+// of the CA. They're made to port 80, so the webserver must be reachable
+// there, e.g. with HTTPListenAddr set to :80, for them to succeed; otherwise
+// TLS-ALPN-01 challenges, made to port 443, can be answered by a TLSBind
+// listener there.
+func (a *acmeCerts) httpHandler(h http.Handler) http.Handler {
+	return a.m.HTTPHandler(h)
+}
+
+// Obtains the certificates of the hostnames which don't have one yet, so
+// that the first clients needn't wait for them. Called once the listeners
+// answering the CA's challenges have started.
+func (a *acmeCerts) obtain() {
+	for _, host := range a.hosts {
+		// As asked for by a client supporting ECDSA, as most do, so that
+		// it's an ECDSA certificate which is obtained.
+		_, err := a.m.GetCertificate(&tls.ClientHelloInfo{
+			ServerName:   host,
+			CipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+		})
+		if err != nil {
+			log.Warne(err, "couldn't get an ACME certificate for ", host)
+			continue
+		}
+		log.Info("have an ACME certificate for ", host)
+	}
+}
+
+// Sets up certificates from an ACME CA, if ACMEHostnames is set. Setting it
+// agrees to the CA's terms of service.
+func (s *Server) setupACME() error {
+	if s.cfg.ACMEHostnames == "" {
+		return nil
+	}
+
+	var hosts []string
+	for _, h := range strings.Split(s.cfg.ACMEHostnames, ",") {
+		h = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(h)), ".")
+		if h == "" {
+			continue
+		}
+		if strings.HasSuffix(h, ".bit") {
+			return configError("ACMEHostnames can't include %s: a CA can't issue certificates for .bit names", h)
+		}
+		hosts = append(hosts, h)
+	}
+	if len(hosts) == 0 {
+		return configError("ACMEHostnames has no hostnames")
+	}
+	if s.cfg.ACMECacheDir == "" {
+		return configError("ACMEHostnames requires ACMECacheDir, so that certificates aren't requested again at each start")
+	}
+
+	s.acme = &acmeCerts{
+		m: &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			Cache:      autocert.DirCache(s.cfg.cpath(s.cfg.ACMECacheDir)),
+			HostPolicy: autocert.HostWhitelist(hosts...),
+			Email:      s.cfg.ACMEEmail,
+			Client:     &acme.Client{DirectoryURL: s.cfg.ACMEDirectoryURL},
+		},
+		hosts:    hosts,
+		fallback: s.certReloader,
+	}
+	return nil
+}
+
+func init() {
+	registerOptional("acme", func(s *Server) bool {
+		return s.cfg.ACMEHostnames != ""
+	})
+}
@@ -0,0 +1,34 @@
+//go:build no_acme
+// +build no_acme
+
+package server
+
+import (
+	"crypto/tls"
+	"net/http"
+)
+
+// Never set up in a build without ACME support; s.acme is always nil.
+type acmeCerts struct{}
+
+func (a *acmeCerts) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return nil, nil
+}
+
+func (a *acmeCerts) httpHandler(h http.Handler) http.Handler {
+	return h
+}
+
+func (a *acmeCerts) obtain() {
+}
+
+func (s *Server) setupACME() error {
+	if s.cfg.ACMEHostnames != "" {
+		return configError("this build of ncdns leaves out ACME support; rebuild it without the no_acme tag to set ACMEHostnames")
+	}
+	return nil
+}
+
+func init() {
+	registerExcluded("acme")
+}
@@ -0,0 +1,122 @@
+//go:build pebble
+// +build pebble
+
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Obtains a certificate from a Pebble test CA, answering its HTTP-01
+// challenge, and serves it for DNS over TLS. Run Pebble with its default
+// configuration and pebble-challtestsrv resolving every name to 127.0.0.1:
+//
+//	pebble-challtestsrv -defaultIPv4 127.0.0.1 &
+//	pebble -config test/config/pebble-config.json -dnsserver 127.0.0.1:8053 &
+//	PEBBLE_CA=test/certs/pebble.minica.pem go test -tags pebble ./server -run ACME
+//
+// PEBBLE_DIRECTORY gives the directory URL, if not Pebble's default.
+func TestACMEPebble(t *testing.T) {
+	caFile := os.Getenv("PEBBLE_CA")
+	if caFile == "" {
+		t.Skip("PEBBLE_CA isn't set")
+	}
+	directory := os.Getenv("PEBBLE_DIRECTORY")
+	if directory == "" {
+		directory = "https://127.0.0.1:14000/dir"
+	}
+
+	// Pebble's API is served with a certificate of its own CA.
+	pem, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(pem) {
+		t.Fatalf("no certificates in %s", caFile)
+	}
+
+	dir, err := ioutil.TempDir("", "ncdns-acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.MkdirAll(filepath.Join(dir, "names", "d"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, "names", "d", "example.json"), []byte(`{"ip":"192.0.2.1"}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const host = "dot.ncdns.test"
+	cfg := newErrorTestConfig(dir)
+	cfg.Fetcher = "static"
+	cfg.StaticDataDir = "names"
+	// At Pebble's tlsPort and httpPort, so that either challenge can be
+	// answered.
+	cfg.TLSBind = "127.0.0.1:5001"
+	cfg.HTTP.ListenAddr = "127.0.0.1:5002"
+	cfg.HTTP.ProbesOnly = true
+	cfg.ACMEHostnames = host
+	cfg.ACMECacheDir = "acme"
+	cfg.ACMEDirectoryURL = directory
+	cfg.StopTimeout = 5
+	if err := os.Mkdir(filepath.Join(dir, "acme"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+	s.acme.m.Client.HTTPClient = &http.Client{
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}},
+	}
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Pebble's certificates chain to a root made afresh at each start, so
+	// only the name is checked.
+	var presented *x509.Certificate
+	c := &dns.Client{
+		Net: "tcp-tls",
+		TLSConfig: &tls.Config{
+			ServerName:         host,
+			InsecureSkipVerify: true,
+			VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+				presented, err = x509.ParseCertificate(rawCerts[0])
+				return err
+			},
+		},
+		Timeout: time.Minute,
+	}
+	req := new(dns.Msg)
+	req.SetQuestion("example.bit.", dns.TypeA)
+	res, _, err := c.Exchange(req, s.TLSAddrs()[0].String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Answer) == 0 {
+		t.Errorf("no answer in %v", res)
+	}
+	if presented == nil || presented.VerifyHostname(host) != nil || !strings.Contains(presented.Issuer.CommonName, "Pebble") {
+		t.Errorf("presented certificate issued by %v", presented.Issuer)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "acme", host)); err != nil {
+		t.Errorf("certificate not cached: %v", err)
+	}
+}
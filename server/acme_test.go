@@ -0,0 +1,160 @@
+//go:build !no_acme
+// +build !no_acme
+
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+func TestACMEConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ncdns-acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, c := range []struct {
+		tlsBind, hosts, cacheDir string
+	}{
+		{"", "dot.example.com", "acme"},        // nothing to serve the certificates at
+		{"127.0.0.1:0", "dot.example.com", ""}, // no cache
+		{"127.0.0.1:0", "example.bit", "acme"}, // not a name a CA can issue for
+		{"127.0.0.1:0", " , ", "acme"},         // no hostnames
+		{"127.0.0.1:0", "", "acme"},            // neither TLSCert nor ACMEHostnames
+	} {
+		cfg := newErrorTestConfig(dir)
+		cfg.TLSBind = c.tlsBind
+		cfg.ACMEHostnames = c.hosts
+		cfg.ACMECacheDir = c.cacheDir
+
+		s, err := New(cfg)
+		if err == nil {
+			s.closeListeners()
+			t.Errorf("started with TLSBind %q, ACMEHostnames %q and ACMECacheDir %q", c.tlsBind, c.hosts, c.cacheDir)
+			continue
+		}
+		if !errors.Is(err, ErrConfigInvalid) {
+			t.Errorf("got %v, expected a configuration error", err)
+		}
+	}
+}
+
+// Writes a certificate for host to the autocert cache in dir, as if it had
+// been obtained from the CA.
+func writeACMECert(t *testing.T, dir, host string, serial int64) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: host},
+		DNSNames:     []string{host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	b = append(b, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	if err := ioutil.WriteFile(filepath.Join(dir, host), b, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestACMEFallback(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ncdns-acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeTestCert(t, dir, 1)
+	fallback, err := newCertReloader(filepath.Join(dir, "dot.crt"), filepath.Join(dir, "dot.key"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A CA which can't be reached.
+	ca := httptest.NewServer(nil)
+	ca.Close()
+
+	cacheDir := filepath.Join(dir, "acme")
+	if err := os.Mkdir(cacheDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	a := &acmeCerts{
+		m: &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			Cache:      autocert.DirCache(cacheDir),
+			HostPolicy: autocert.HostWhitelist("dot.example.com"),
+			Client:     &acme.Client{DirectoryURL: ca.URL},
+		},
+		hosts:    []string{"dot.example.com"},
+		fallback: fallback,
+	}
+
+	serial := func(name string) int64 {
+		cert, err := a.getCertificate(&tls.ClientHelloInfo{
+			ServerName:   name,
+			CipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+		})
+		if err != nil {
+			t.Fatalf("%q: %v", name, err)
+		}
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return leaf.SerialNumber.Int64()
+	}
+
+	// Until a certificate is obtained, TLSCert is served, both for the
+	// hostname and for names which aren't in ACMEHostnames.
+	for _, name := range []string{"", "dot.example.com", "other.example.com"} {
+		if n := serial(name); n != 1 {
+			t.Errorf("%q: served certificate %d, expected TLSCert", name, n)
+		}
+	}
+
+	// Once there's one, it's served, to clients giving no name too.
+	writeACMECert(t, cacheDir, "dot.example.com", 2)
+	for _, name := range []string{"", "dot.example.com"} {
+		if n := serial(name); n != 2 {
+			t.Errorf("%q: served certificate %d, expected the ACME certificate", name, n)
+		}
+	}
+
+	// Without TLSCert, the error is passed on.
+	a.fallback = nil
+	if _, err := a.getCertificate(&tls.ClientHelloInfo{ServerName: "other.example.com"}); err == nil {
+		t.Errorf("certificate served for a name not in ACMEHostnames")
+	}
+}
@@ -0,0 +1,233 @@
+package server
+
+import (
+	"net"
+	"os"
+	"strconv"
+)
+
+// The first file descriptor passed by systemd's socket activation.
+const listenFDsStart = 3
+
+// Returns the sockets passed by systemd if ncdns was started by socket
+// activation, or nil if it wasn't. The variables describing them are removed
+// from the environment, so that they're taken only once and not passed on to
+// other processes.
+func listenFDs() []*os.File {
+	defer func() {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}()
+
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil
+	}
+
+	files := make([]*os.File, n)
+	for i := range files {
+		fd := listenFDsStart + i
+		files[i] = os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd))
+	}
+	return files
+}
+
+// A socket passed by systemd, and the address of BindAddresses or TLSBind it's
+// for.
+type adoptedSocket struct {
+	udpConn     *net.UDPConn
+	tcpListener *net.TCPListener
+	addr        *bindAddr
+	tls         bool
+}
+
+func (as *adoptedSocket) proto() string {
+	if as.udpConn != nil {
+		return "udp"
+	}
+	return "tcp"
+}
+
+func (as *adoptedSocket) close() {
+	if as.udpConn != nil {
+		as.udpConn.Close()
+	} else {
+		as.tcpListener.Close()
+	}
+}
+
+// Takes the sockets passed by systemd as the listeners for BindAddresses and
+// TLSBind instead of creating them, so that the unit's socket may bind
+// privileged ports on ncdns's behalf. Each socket must be for one of the
+// addresses given, and each address must have the sockets listen would have
+// created for it, except that those of a wildcard address, as with listen, need
+// only be for one family: a dual-stack socket for [::]:53, say, serves both.
+// The files are closed. If any socket doesn't match, none is taken.
+func (s *Server) adoptSockets(files []*os.File, items [][]bindAddr) (err error) {
+	var tlsAddrs []bindAddr
+	if s.cfg.TLSBind != "" {
+		tlsAddrs, err = bindAddrs(s.cfg.TLSBind, net.LookupIP)
+		if err != nil {
+			return wrapError(ErrConfigInvalid, err)
+		}
+		for i := range tlsAddrs {
+			tlsAddrs[i].proto = "tcp"
+		}
+	}
+
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+
+	var sockets []*adoptedSocket
+	defer func() {
+		if err != nil {
+			for _, as := range sockets {
+				as.close()
+			}
+		}
+	}()
+
+	for _, f := range files {
+		as, err := adoptSocket(f)
+		if err != nil {
+			return err
+		}
+		sockets = append(sockets, as)
+		if as.udpConn != nil {
+			err := setReceiveBuffer(as.udpConn, s.cfg.UDPReceiveBufferBytes)
+			if err != nil {
+				return err
+			}
+		}
+
+		as.addr, as.tls = matchSocket(as, items, tlsAddrs)
+		if as.addr == nil {
+			return configError("the socket passed by systemd for %s %s isn't for any address of BindAddresses or TLSBind", as.proto(), as.localAddr())
+		}
+	}
+
+	for _, addrs := range items {
+		if err := checkAdopted(sockets, addrs, false); err != nil {
+			return err
+		}
+	}
+	if tlsAddrs != nil {
+		if err := checkAdopted(sockets, tlsAddrs, true); err != nil {
+			return err
+		}
+	}
+
+	for _, as := range sockets {
+		switch {
+		case as.tls:
+			s.tlsListeners = append(s.tlsListeners, as.tcpListener)
+		case as.udpConn != nil:
+			s.udpConns = append(s.udpConns, as.udpConn)
+		default:
+			s.tcpListeners = append(s.tcpListeners, as.tcpListener)
+		}
+	}
+	log.Infof("took %d sockets passed by systemd", len(sockets))
+	return nil
+}
+
+// Makes a listener of a socket passed by systemd, which must be a UDP or TCP
+// socket.
+func adoptSocket(f *os.File) (*adoptedSocket, error) {
+	if pc, err := net.FilePacketConn(f); err == nil {
+		if c, ok := pc.(*net.UDPConn); ok {
+			return &adoptedSocket{udpConn: c}, nil
+		}
+		pc.Close()
+	}
+	if l, err := net.FileListener(f); err == nil {
+		if tl, ok := l.(*net.TCPListener); ok {
+			return &adoptedSocket{tcpListener: tl}, nil
+		}
+		l.Close()
+	}
+	return nil, configError("the socket %s passed by systemd is neither a UDP socket nor a listening TCP socket", f.Name())
+}
+
+func (as *adoptedSocket) localAddr() net.Addr {
+	if as.udpConn != nil {
+		return as.udpConn.LocalAddr()
+	}
+	return as.tcpListener.Addr()
+}
+
+// Returns the address of items or tlsAddrs which a socket is for, and
+// whether it's one of tlsAddrs, or nil if it's for none.
+func matchSocket(as *adoptedSocket, items [][]bindAddr, tlsAddrs []bindAddr) (*bindAddr, bool) {
+	var ip net.IP
+	var port int
+	switch a := as.localAddr().(type) {
+	case *net.UDPAddr:
+		ip, port = a.IP, a.Port
+	case *net.TCPAddr:
+		ip, port = a.IP, a.Port
+	default:
+		return nil, false
+	}
+	ip = canonicalIP(ip)
+
+	matches := func(ba *bindAddr) bool {
+		return (ba.proto == "" || ba.proto == as.proto()) &&
+			(ba.port == 0 || ba.port == port) && ba.ip.Equal(ip)
+	}
+	for i := range items {
+		for j := range items[i] {
+			if matches(&items[i][j]) {
+				return &items[i][j], false
+			}
+		}
+	}
+	if as.tcpListener != nil {
+		for i := range tlsAddrs {
+			if matches(&tlsAddrs[i]) {
+				return &tlsAddrs[i], true
+			}
+		}
+	}
+	return nil, false
+}
+
+// Checks that the sockets taken include those for the addresses of an item of
+// BindAddresses, or of TLSBind.
+func checkAdopted(sockets []*adoptedSocket, addrs []bindAddr, tls bool) error {
+	have := func(ba *bindAddr, proto string) bool {
+		for _, as := range sockets {
+			if as.addr == ba && as.tls == tls && as.proto() == proto {
+				return true
+			}
+		}
+		return false
+	}
+
+	for _, proto := range []string{"udp", "tcp"} {
+		found := false
+		for i := range addrs {
+			ba := &addrs[i]
+			if ba.proto != "" && ba.proto != proto {
+				continue
+			}
+			if have(ba, proto) {
+				found = true
+			} else if !ba.wildcard {
+				return configError("systemd passed no %s socket for %s", proto, ba)
+			}
+		}
+		if !found && addrs[0].wildcard && (addrs[0].proto == "" || addrs[0].proto == proto) {
+			return configError("systemd passed no %s socket for :%d", proto, addrs[0].port)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// Returns the files of a UDP socket and a TCP listener on the same port of
+// 127.0.0.1, as systemd would pass them, and the port.
+func systemdSockets(t *testing.T) ([]*os.File, int) {
+	s := &Server{cfg: Config{BindAddresses: "127.0.0.1:0"}}
+	if err := s.listen(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.closeListeners()
+
+	udp, err := s.udpConns[0].File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tcp, err := s.tcpListeners[0].(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return []*os.File{udp, tcp}, s.DNSPort()
+}
+
+func TestAdoptSockets(t *testing.T) {
+	adopt := func(bind string, files []*os.File) (*Server, error) {
+		s := &Server{cfg: Config{BindAddresses: bind}}
+		items, err := parseBind(bind, net.LookupIP)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s, s.adoptSockets(files, items)
+	}
+
+	files, port := systemdSockets(t)
+	bind := "127.0.0.1:" + strconv.Itoa(port)
+	s, err := adopt(bind, files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.UDPAddrs()) != 1 || len(s.TCPAddrs()) != 1 || s.DNSPort() != port {
+		t.Errorf("took UDP %v and TCP %v, expected port %d", s.UDPAddrs(), s.TCPAddrs(), port)
+	}
+	// The sockets taken are those passed: nothing else can listen there.
+	if l, err := net.ListenTCP("tcp4", s.TCPAddrs()[0]); err == nil {
+		l.Close()
+		t.Errorf("port %d not in use", port)
+	}
+	s.closeListeners()
+
+	for _, test := range []struct {
+		name    string
+		bind    string // PORT is replaced with the port of the sockets
+		udpOnly bool
+		ok      bool
+	}{
+		{"another port", "127.0.0.1:1", false, false},
+		{"UDP only", "127.0.0.1:PORT", true, false},
+		{"udp:// with UDP only", "udp://127.0.0.1:PORT", true, true},
+		{"udp:// with TCP too", "udp://127.0.0.1:PORT", false, false},
+		{"wildcard", ":PORT", false, false},
+	} {
+		files, port := systemdSockets(t)
+		if test.udpOnly {
+			files[1].Close()
+			files = files[:1]
+		}
+
+		s, err := adopt(strings.Replace(test.bind, "PORT", strconv.Itoa(port), 1), files)
+		if test.ok != (err == nil) {
+			t.Errorf("%s: got %v", test.name, err)
+		}
+		if err != nil {
+			if !errors.Is(err, ErrConfigInvalid) {
+				t.Errorf("%s: error %v isn't ErrConfigInvalid", test.name, err)
+			}
+			if s.udpConns != nil || s.tcpListeners != nil {
+				t.Errorf("%s: sockets taken despite the error", test.name)
+			}
+		}
+		s.closeListeners()
+	}
+}
+
+// Sockets are only taken by the process systemd started.
+func TestListenFDsPID(t *testing.T) {
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()+1))
+	os.Setenv("LISTEN_FDS", "2")
+	if files := listenFDs(); files != nil {
+		t.Errorf("took %d sockets passed to another process", len(files))
+	}
+	if os.Getenv("LISTEN_PID") != "" || os.Getenv("LISTEN_FDS") != "" {
+		t.Errorf("LISTEN_PID and LISTEN_FDS left in the environment")
+	}
+}
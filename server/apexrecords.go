@@ -0,0 +1,43 @@
+package server
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// The types of the records which ApexRecords may give.
+var apexRecordTypes = map[uint16]bool{
+	dns.TypeTXT:   true,
+	dns.TypeCAA:   true,
+	dns.TypeSSHFP: true,
+}
+
+// Parses ApexRecords: records in zone file syntax, one per line, owned by
+// bit. They're served at whatever apex is asked about. Blank lines and
+// comments are skipped.
+func parseApexRecords(s string) ([]dns.RR, error) {
+	var rrs []dns.RR
+	for _, line := range strings.Split(s, "\n") {
+		line = strings.TrimSpace(line)
+		rr, err := dns.NewRR(line)
+		if err != nil {
+			return nil, configError("ApexRecords: couldn't parse %q: %v", line, err)
+		}
+		if rr == nil {
+			continue
+		}
+
+		hdr := rr.Header()
+		switch {
+		case !strings.EqualFold(hdr.Name, "bit."):
+			return nil, configError("ApexRecords: %q isn't owned by bit.", line)
+		case hdr.Class != dns.ClassINET:
+			return nil, configError("ApexRecords: %q isn't of class IN", line)
+		case !apexRecordTypes[hdr.Rrtype]:
+			return nil, configError("ApexRecords: %q is a %s record; only TXT, CAA and SSHFP records are allowed", line, dns.TypeToString[hdr.Rrtype])
+		}
+		rrs = append(rrs, rr)
+	}
+	return rrs, nil
+}
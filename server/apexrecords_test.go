@@ -0,0 +1,45 @@
+package server
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestParseApexRecords(t *testing.T) {
+	rrs, err := parseApexRecords(`
+bit. 86400 IN CAA 0 issue ";"
+  ; SPF
+BIT. IN TXT "v=spf1 -all"
+bit. 3600 IN SSHFP 4 2 123456789abcdef67890123456789abcdef67890123456789abcdef123456789a
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var types []string
+	for _, rr := range rrs {
+		types = append(types, dns.TypeToString[rr.Header().Rrtype])
+	}
+	if strings.Join(types, " ") != "CAA TXT SSHFP" {
+		t.Errorf("got records %v", rrs)
+	}
+
+	if rrs, err := parseApexRecords(""); err != nil || len(rrs) != 0 {
+		t.Errorf("got %v, %v for no records", rrs, err)
+	}
+
+	for _, test := range []struct{ records, quoted string }{
+		{"bit. IN TXT \"ok\"\nbit. IN CAA nonsense", "bit. IN CAA nonsense"},
+		{"example.bit. IN TXT \"v=spf1 -all\"", "example.bit. IN TXT \\\"v=spf1 -all\\\""},
+		{"bit. CH TXT \"v=spf1 -all\"", "bit. CH TXT"},
+		{"bit. IN A 192.0.2.1", "bit. IN A 192.0.2.1"},
+		{"bit. IN NS ns1.example.com.", "bit. IN NS"},
+	} {
+		_, err := parseApexRecords(test.records)
+		if !errors.Is(err, ErrConfigInvalid) || !strings.Contains(err.Error(), test.quoted) {
+			t.Errorf("%q: got %v, expected an invalid configuration quoting the line", test.records, err)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package server
+
+import (
+	"crypto"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/namecoin/ncdns/clock"
+)
+
+// The record types at a zone apex which are given ApexInfrastructureTTL.
+// They change rarely, so long TTLs spare resolvers from asking for them
+// again, while the records of names stay short-lived.
+var apexInfrastructureTypes = map[uint16]bool{
+	dns.TypeSOA:    true,
+	dns.TypeNS:     true,
+	dns.TypeDNSKEY: true,
+	dns.TypeNSEC:   true,
+}
+
+// Wraps rw so that the SOA, NS, DNSKEY and NSEC records at the apex of a zone
+// have ApexInfrastructureTTL, whatever TTL the engine gave them, with their
+// RRSIGs made again to match. The SOA of a negative answer has at most its
+// minimum field as its TTL, so that negative caching is governed by that
+// alone.
+func (s *Server) apexTTLWriter(rw dns.ResponseWriter) dns.ResponseWriter {
+	if s.cfg.ApexInfrastructureTTL <= 0 {
+		return rw
+	}
+
+	return &apexTTLWriter{ResponseWriter: rw, s: s}
+}
+
+type apexTTLWriter struct {
+	dns.ResponseWriter
+	s *Server
+}
+
+func (rw *apexTTLWriter) WriteMsg(m *dns.Msg) error {
+	rw.s.setApexTTLs(m, uint32(rw.s.cfg.ApexInfrastructureTTL))
+	return rw.ResponseWriter.WriteMsg(m)
+}
+
+// Gives the infrastructure records at the apexes in m the TTL ttl. An apex is
+// recognised by its SOA or DNSKEY records, which only an apex has.
+func (s *Server) setApexTTLs(m *dns.Msg, ttl uint32) {
+	apexes := map[string]bool{}
+	for _, section := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, rr := range section {
+			if t := rr.Header().Rrtype; t == dns.TypeSOA || t == dns.TypeDNSKEY {
+				apexes[strings.ToLower(rr.Header().Name)] = true
+			}
+		}
+	}
+
+	if len(apexes) > 0 {
+		now := clock.Or(s.clock).Now()
+		sigs := responseSigs{}
+		for _, section := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+			type rrsetKey struct {
+				name   string
+				rrtype uint16
+			}
+			done := map[rrsetKey]bool{}
+			for _, rr := range section {
+				hdr := rr.Header()
+				k := rrsetKey{strings.ToLower(hdr.Name), hdr.Rrtype}
+				if !apexInfrastructureTypes[k.rrtype] || !apexes[k.name] || done[k] {
+					continue
+				}
+				done[k] = true
+
+				err := s.setRRsetTTL(section, hdr.Name, hdr.Rrtype, ttl, now, sigs)
+				if err != nil {
+					log.Debugf("couldn't give %s %s TTL %d: %v", hdr.Name, dns.TypeToString[hdr.Rrtype], ttl, err)
+				}
+			}
+		}
+	}
+
+	if newResponseBuilder(m).isNegative(m.Answer, m.Ns) {
+		for i, rr := range m.Ns {
+			if soa, ok := rr.(*dns.SOA); ok && soa.Hdr.Ttl > soa.Minttl {
+				soa = dns.Copy(soa).(*dns.SOA)
+				soa.Hdr.Ttl = soa.Minttl
+				m.Ns[i] = soa
+			}
+		}
+	}
+}
+
+// Replaces the records of the RRset name/rrtype in section with copies whose
+// TTL is ttl, and the RRSIGs covering them with signatures over the copies,
+// made with the same keys and validity periods. The TTL is shortened if need
+// be so that the records don't outlive their signatures. If a signature can't
+// be made again, section is left as it was. Signatures made already for
+// another section of the response are taken from shared.
+func (s *Server) setRRsetTTL(section []dns.RR, name string, rrtype uint16, ttl uint32, now time.Time, shared responseSigs) error {
+	var rrs, sigs []int
+	for i, rr := range section {
+		hdr := rr.Header()
+		if !strings.EqualFold(hdr.Name, name) {
+			continue
+		}
+		if hdr.Rrtype == rrtype {
+			rrs = append(rrs, i)
+		} else if sig, ok := rr.(*dns.RRSIG); ok && sig.TypeCovered == rrtype {
+			sigs = append(sigs, i)
+		}
+	}
+
+	changed := false
+	for _, i := range sigs {
+		sig := section[i].(*dns.RRSIG)
+		if left := sigSecondsFrom(now, sig.Expiration); left < int64(ttl) {
+			if left < 0 {
+				left = 0
+			}
+			ttl = uint32(left)
+		}
+	}
+	for _, i := range rrs {
+		changed = changed || section[i].Header().Ttl != ttl
+	}
+	for _, i := range sigs {
+		changed = changed || section[i].(*dns.RRSIG).OrigTtl != ttl
+	}
+	if !changed {
+		return nil
+	}
+
+	// The records may be shared with the engine, so they're copied rather
+	// than changed.
+	rrset := make([]dns.RR, len(rrs))
+	for j, i := range rrs {
+		rrset[j] = dns.Copy(section[i])
+		rrset[j].Header().Ttl = ttl
+	}
+
+	nsigs := make([]dns.RR, len(sigs))
+	for j, i := range sigs {
+		nsig, err := s.resignRRset(section[i].(*dns.RRSIG), rrset, shared)
+		if err != nil {
+			return err
+		}
+		nsigs[j] = nsig
+	}
+
+	for j, i := range rrs {
+		section[i] = rrset[j]
+	}
+	for j, i := range sigs {
+		section[i] = nsigs[j]
+	}
+	return nil
+}
+
+// Returns a signature over rrset replacing sig, with the same validity
+// period, made with the key which made sig, or taken from sigs if it has been
+// made already.
+func (s *Server) resignRRset(sig *dns.RRSIG, rrset []dns.RR, sigs responseSigs) (*dns.RRSIG, error) {
+	key, priv := s.keySetForName(sig.SignerName).signingKey(sig)
+	if key == nil {
+		return nil, fmt.Errorf("no private key with tag %d", sig.KeyTag)
+	}
+	signer, ok := priv.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("private key with tag %d can't sign", sig.KeyTag)
+	}
+
+	tmpl := *sig
+	tmpl.Hdr.Ttl = rrset[0].Header().Ttl
+	return sigs.sign(&tmpl, signer, rrset)
+}
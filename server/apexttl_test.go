@@ -0,0 +1,123 @@
+package server
+
+import (
+	"crypto"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/namecoin/ncdns/testutil"
+)
+
+// Returns the records of rrs signed by priv as key, valid from t for a week,
+// followed by their RRSIG.
+func signedRRset(t *testing.T, key *dns.DNSKEY, priv crypto.PrivateKey, at time.Time, rrs ...string) []dns.RR {
+	var rrset []dns.RR
+	for _, s := range rrs {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rrset = append(rrset, rr)
+	}
+
+	hdr := rrset[0].Header()
+	sig := &dns.RRSIG{
+		Hdr:        dns.RR_Header{Name: hdr.Name, Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: hdr.Ttl},
+		KeyTag:     key.KeyTag(),
+		Algorithm:  key.Algorithm,
+		SignerName: "bit.",
+		Inception:  uint32(at.Unix()),
+		Expiration: uint32(at.Add(7 * 24 * time.Hour).Unix()),
+	}
+	if err := sig.Sign(priv.(crypto.Signer), rrset); err != nil {
+		t.Fatal(err)
+	}
+
+	return append(rrset, sig)
+}
+
+func TestApexTTL(t *testing.T) {
+	ks, err := generateKeySet("bit.")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t0 := time.Unix(1700000000, 0)
+	s := &Server{globalKeySet: ks, clock: testutil.NewFakeClock(t0)}
+	s.cfg.ApexInfrastructureTTL = 172800
+
+	serve := func(m *dns.Msg) *dns.Msg {
+		frw := &fakeResponseWriter{}
+		s.apexTTLWriter(frw).WriteMsg(m)
+		return frw.msg
+	}
+
+	m := new(dns.Msg)
+	m.SetQuestion("bit.", dns.TypeANY)
+	m.Response = true
+	m.Answer = append(m.Answer, signedRRset(t, ks.ZSK, ks.ZSKPrivate, t0, "bit. 86400 IN SOA ns.bit. . 1 600 600 7200 600")...)
+	m.Answer = append(m.Answer, signedRRset(t, ks.ZSK, ks.ZSKPrivate, t0, "bit. 86400 IN NS ns1.example.com.", "bit. 86400 IN NS ns2.example.com.")...)
+	m.Answer = append(m.Answer, signedRRset(t, ks.KSK, ks.KSKPrivate, t0, ks.KSK.String(), ks.ZSK.String())...)
+	m.Answer = append(m.Answer, signedRRset(t, ks.ZSK, ks.ZSKPrivate, t0, "bit. 600 IN NSEC \\000.bit. NS SOA RRSIG NSEC DNSKEY")...)
+	m.Extra = signedRRset(t, ks.ZSK, ks.ZSKPrivate, t0, "example.bit. 600 IN A 192.0.2.1")
+
+	res := serve(m)
+	types := map[uint16]bool{}
+	for _, rr := range res.Answer {
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			key := ks.ZSK
+			if sig.TypeCovered == dns.TypeDNSKEY {
+				key = ks.KSK
+			}
+			if err := sig.Verify(key, coveredRRset(res.Answer, sig)); err != nil {
+				t.Errorf("signature over %s doesn't verify: %v", dns.TypeToString[sig.TypeCovered], err)
+			}
+			if sig.OrigTtl != 172800 {
+				t.Errorf("signature over %s has original TTL %d", dns.TypeToString[sig.TypeCovered], sig.OrigTtl)
+			}
+			continue
+		}
+
+		types[rr.Header().Rrtype] = true
+		if rr.Header().Ttl != 172800 {
+			t.Errorf("apex record has TTL %d: %v", rr.Header().Ttl, rr)
+		}
+	}
+	for _, rrtype := range []uint16{dns.TypeSOA, dns.TypeNS, dns.TypeDNSKEY, dns.TypeNSEC} {
+		if !types[rrtype] {
+			t.Errorf("no %s records in %v", dns.TypeToString[rrtype], res)
+		}
+	}
+
+	// Records not at the apex keep their TTLs.
+	if ttl := res.Extra[0].Header().Ttl; ttl != 600 {
+		t.Errorf("non-apex record has TTL %d, not 600", ttl)
+	}
+	if sig := res.Extra[1].(*dns.RRSIG); sig.OrigTtl != 600 {
+		t.Errorf("non-apex signature has original TTL %d, not 600", sig.OrigTtl)
+	}
+
+	// The SOA of a negative answer has the negative TTL.
+	m = new(dns.Msg)
+	m.SetQuestion("nonexistent.bit.", dns.TypeA)
+	m.Response = true
+	m.Rcode = dns.RcodeNameError
+	m.Ns = signedRRset(t, ks.ZSK, ks.ZSKPrivate, t0, "bit. 86400 IN SOA ns.bit. . 1 600 600 7200 600")
+	res = serve(m)
+	if ttl := res.Ns[0].Header().Ttl; ttl != 600 {
+		t.Errorf("SOA of negative answer has TTL %d, not 600", ttl)
+	}
+
+	// Records don't outlive their signatures.
+	s.cfg.ApexInfrastructureTTL = 30 * 86400
+	m = new(dns.Msg)
+	m.SetQuestion("bit.", dns.TypeNS)
+	m.Response = true
+	m.Answer = signedRRset(t, ks.ZSK, ks.ZSKPrivate, t0, "bit. 86400 IN NS ns1.example.com.")
+	res = serve(m)
+	if ttl := res.Answer[0].Header().Ttl; ttl != 7*86400 {
+		t.Errorf("NS record has TTL %d, beyond its signature's expiry", ttl)
+	}
+}
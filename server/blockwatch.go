@@ -0,0 +1,297 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/hlandau/madns.v2/merr"
+
+	"github.com/namecoin/ncdns/clock"
+	"github.com/namecoin/ncdns/namecoin"
+)
+
+// How long connecting to namecoind's ZeroMQ notifications may take.
+const zmqDialTimeout = 10 * time.Second
+
+// The number of poll intervals after which the block watcher, if it hasn't
+// reached namecoind since, reports the best block it knows of as stale.
+const blockStalePolls = 3
+
+// Polls namecoind for new blocks, publishing each on the server's bus. If
+// namecoind announces blocks over ZeroMQ, it polls as soon as one is
+// announced too.
+type blockWatcher struct {
+	// First, so that it's aligned for atomic access on 32-bit platforms
+	polled int64 // accessed atomically; Unix time namecoind was last reached, or 0
+
+	interval time.Duration
+	bus      *eventBus
+	zmqAddr  string      // if set, where namecoind announces blocks
+	clock    clock.Clock // the system clock if nil
+
+	// Returns the best block.
+	bestBlock func() (height int64, hash string, err error)
+
+	hash string
+
+	wake     chan struct{} // buffered; polls at once when sent to
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+func (w *blockWatcher) run() {
+	if w.zmqAddr != "" {
+		go w.subscribe()
+	}
+
+	t := clock.Or(w.clock).NewTicker(w.interval)
+	defer t.Stop()
+	for {
+		w.poll()
+		select {
+		case <-t.C():
+		case <-w.wake:
+		case <-w.stop:
+			return
+		}
+	}
+}
+
+func (w *blockWatcher) shutdown() {
+	w.stopOnce.Do(func() { close(w.stop) })
+}
+
+// Wakes the watcher whenever namecoind announces a block, connecting again
+// after the poll interval if the connection fails. Polling carries on
+// meanwhile, so blocks are still noticed, if later.
+func (w *blockWatcher) subscribe() {
+	for {
+		err := w.receive()
+		log.Warne(err, "lost namecoind's ZeroMQ block notifications at ", w.zmqAddr, "; polling until they're back")
+
+		select {
+		case <-w.stop:
+			return
+		case <-clock.Or(w.clock).NewTimer(w.interval).C():
+		}
+	}
+}
+
+func (w *blockWatcher) receive() error {
+	n, err := namecoin.DialBlockNotifications(w.zmqAddr, zmqDialTimeout)
+	if err != nil {
+		return err
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-w.stop:
+		case <-done:
+		}
+		n.Close()
+	}()
+
+	// A block may have been found while not subscribed.
+	w.notify()
+	for {
+		if _, err := n.Next(); err != nil {
+			return err
+		}
+		w.notify()
+	}
+}
+
+func (w *blockWatcher) notify() {
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Checks for a new block. The first check publishes the best block as the
+// initial one.
+func (w *blockWatcher) poll() {
+	height, hash, err := w.bestBlock()
+	if err != nil {
+		log.Warne(err, "couldn't get the best block from namecoind")
+		return
+	}
+	atomic.StoreInt64(&w.polled, clock.Or(w.clock).Now().Unix())
+	if hash == w.hash {
+		return
+	}
+
+	first := w.hash == ""
+	w.hash = hash
+	w.bus.publish(&blockConnected{Height: height, Hash: hash, Initial: first})
+}
+
+// Reports whether namecoind hasn't been reached for blockStalePolls poll
+// intervals, so that a block may have been found which the best block known,
+// and the SOA serial, don't yet reflect.
+func (w *blockWatcher) stale() bool {
+	polled := atomic.LoadInt64(&w.polled)
+	return polled == 0 || clock.Or(w.clock).Now().Sub(time.Unix(polled, 0)) > blockStalePolls*w.interval
+}
+
+// Checks the watched names at each new block, reporting the changes to them
+// as events. Names changed by a block can't yet be found from the block
+// itself, so only the watched names are reported.
+type nameWatcher struct {
+	names  []string
+	events *eventHub
+
+	// Returns the current state of a name.
+	nameData func(name string) (*namecoin.NameData, error)
+
+	values map[string]*event // the last name event for each watched name
+}
+
+// Handles the events of the server's bus. The initial block only notes the
+// values of the names, against which later ones are compared.
+func (nw *nameWatcher) handle(ev interface{}) {
+	block, ok := ev.(*blockConnected)
+	if !ok {
+		return
+	}
+
+	for _, name := range nw.names {
+		ev, err := nw.nameEvent(name, block.Height)
+		if err != nil {
+			log.Warne(err, "couldn't check watched name ", name)
+			continue
+		}
+
+		last, ok := nw.values[name]
+		nw.values[name] = ev
+		if !block.Initial && (!ok || last.Value != ev.Value || last.Expired != ev.Expired || last.Missing != ev.Missing) {
+			nw.events.publish(ev)
+		}
+	}
+}
+
+func (nw *nameWatcher) nameEvent(name string, height int64) (*event, error) {
+	ev := &event{Type: eventName, Height: height, Name: name}
+
+	nd, err := nw.nameData(name)
+	switch {
+	case errors.Is(err, merr.ErrNoSuchDomain):
+		ev.Missing = true
+	case err != nil:
+		return nil, err
+	default:
+		ev.Value, ev.Expired = nd.Value, nd.Expired
+	}
+
+	return ev, nil
+}
+
+// Sets up events, and the block watcher which finds most of them, if
+// configured. The features acting on new blocks and on the circuit breaker
+// subscribe to them on the server's bus, synchronously so that the events
+// streamed are in order: a block, the cache flush it caused, then the changes
+// to the watched names.
+func (s *Server) setupEvents() error {
+	s.httpBreaker.onChange = func(st breakerState) {
+		s.bus.publish(&degradedModeChanged{State: st.String()})
+	}
+
+	if s.cfg.EventWatchNames != "" && !s.cfg.HTTP.Events {
+		return fmt.Errorf("EventWatchNames requires HTTPEvents")
+	}
+	// Zone transfers and AdaptiveTTL need the height of the best block, for
+	// the SOA serial and the ages of values.
+	if !s.cfg.HTTP.Events && !s.cfg.FlushCacheOnBlock && s.xfer == nil && !s.cfg.AdaptiveTTL {
+		if s.cfg.RPC.ZMQAddress != "" {
+			return fmt.Errorf("NamecoinZMQAddress requires HTTPEvents, FlushCacheOnBlock, AdaptiveTTL or zone transfers")
+		}
+		return nil
+	}
+
+	if !s.cfg.usesNamecoind() {
+		return fmt.Errorf("HTTPEvents, FlushCacheOnBlock, AdaptiveTTL and NamecoinZMQAddress require the namecoind fetcher")
+	}
+	if s.cfg.BlockPollInterval < 1 {
+		return fmt.Errorf("BlockPollInterval must be at least 1")
+	}
+
+	if s.cfg.HTTP.Events {
+		if s.cfg.EventClientBuffer < 1 {
+			return fmt.Errorf("EventClientBuffer must be at least 1")
+		}
+		s.events = newEventHub(s.cfg.EventClientBuffer, s.clock)
+		s.bus.subscribe("event stream", func(ev interface{}) {
+			switch ev := ev.(type) {
+			case *blockConnected:
+				if !ev.Initial {
+					s.events.publish(&event{Type: eventBlock, Height: ev.Height, Hash: ev.Hash})
+				}
+			case *degradedModeChanged:
+				s.events.publish(&event{Type: eventDegraded, State: ev.State})
+			case *valueProblem:
+				s.events.publish(&event{Type: eventProblem, Name: ev.Name, Problem: ev.Problem, Warning: ev.Warning})
+			}
+		})
+	}
+
+	if s.cfg.FlushCacheOnBlock {
+		s.bus.subscribe("name cache", func(ev interface{}) {
+			if block, ok := ev.(*blockConnected); ok && !block.Initial {
+				s.currentBackend().FlushCache()
+				s.events.publish(&event{Type: eventCache, Height: block.Height})
+			}
+		})
+	} else if s.cfg.Cache.NegativeMaxEntries > 0 {
+		// Names which didn't exist may have been registered in the block.
+		s.bus.subscribe("negative cache", func(ev interface{}) {
+			if block, ok := ev.(*blockConnected); ok && !block.Initial {
+				s.currentBackend().FlushNegativeCache()
+			}
+		})
+	}
+
+	nw := &nameWatcher{
+		events: s.events,
+		nameData: func(name string) (*namecoin.NameData, error) {
+			return s.namecoinConn.NameData(name, "")
+		},
+		values: map[string]*event{},
+	}
+	for _, name := range strings.Split(s.cfg.EventWatchNames, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			nw.names = append(nw.names, name)
+		}
+	}
+	if len(nw.names) > 0 {
+		s.bus.subscribe("watched names", nw.handle)
+	}
+
+	s.blockWatcher = &blockWatcher{
+		interval: time.Duration(s.cfg.BlockPollInterval) * time.Second,
+		bus:      s.bus,
+		zmqAddr:  s.cfg.RPC.ZMQAddress,
+		clock:    s.clock,
+		bestBlock: func() (int64, string, error) {
+			hash, err := s.namecoinConn.GetBestBlockHash()
+			if err != nil {
+				return 0, "", err
+			}
+			height, err := s.namecoinConn.GetBlockCount()
+			return height, hash.String(), err
+		},
+		wake: make(chan struct{}, 1),
+		stop: make(chan struct{}),
+	}
+	s.shutdown.register(shutdownDrain, "block watcher", func(context.Context) error {
+		s.blockWatcher.shutdown()
+		return nil
+	})
+	return nil
+}
@@ -0,0 +1,228 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"gopkg.in/hlandau/madns.v2/merr"
+
+	"github.com/namecoin/ncdns/clock"
+)
+
+var errBreakerOpen = errors.New("Namecoin RPC circuit breaker open")
+
+// The error with which the breaker refuses a fetch made through it as a
+// backend.FetchGuard. It matches errBreakerOpen.
+type breakerOpenError struct {
+	retryAfter time.Duration
+}
+
+func (e *breakerOpenError) Error() string {
+	return errBreakerOpen.Error()
+}
+
+func (e *breakerOpenError) Is(target error) bool {
+	return target == errBreakerOpen
+}
+
+// Returns whether err is, or wraps, a refusal by an open breaker, and if so
+// the time after which the lookup should be retried.
+func breakerRetryAfter(err error) (retryAfter time.Duration, refused bool) {
+	var e *breakerOpenError
+	if errors.As(err, &e) {
+		return e.retryAfter, true
+	}
+	return 0, false
+}
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+func (st breakerState) String() string {
+	switch st {
+	case breakerClosed:
+		return "closed"
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	default:
+		return "unknown"
+	}
+}
+
+// A circuitBreaker stops HTTP-initiated RPC calls from piling onto an
+// overloaded namecoind. After threshold consecutive failures it opens and
+// rejects calls for the cooldown period. It then lets a single probe call
+// through (half-open); the probe's outcome closes or reopens the breaker.
+//
+// The breaker is only used on HTTP paths; DNS queries bypass it. Lookups made
+// by the webserver pass it to the backend as their backend.FetchGuard, so
+// that only fetches of names which aren't cached are refused and counted.
+type circuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+	clock     clock.Clock
+
+	// If set, called with the new state whenever it changes, with the
+	// breaker locked.
+	onChange func(breakerState)
+
+	mu       sync.Mutex
+	state    breakerState
+	failures int
+	openedAt time.Time
+	probing  bool
+	trips    uint64
+}
+
+// The state of the circuit breaker, as reported at /status.
+type breakerStatus struct {
+	// closed, open or half-open, or disabled if BreakerFailureThreshold is
+	// 0.
+	State string `json:"state"`
+
+	// Times the breaker has opened.
+	Trips uint64 `json:"trips"`
+}
+
+// Creates a circuit breaker. A threshold of zero or less disables it.
+func newCircuitBreaker(threshold int, cooldown time.Duration, clk clock.Clock) *circuitBreaker {
+	return &circuitBreaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+		clock:     clock.Or(clk),
+	}
+}
+
+// Determines whether a call may proceed. If it may not, returns the time
+// after which the caller should retry. Every allowed call must be followed by
+// a call to done.
+func (b *circuitBreaker) allow() (ok bool, retryAfter time.Duration) {
+	if b.threshold <= 0 {
+		return true, 0
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		elapsed := b.clock.Now().Sub(b.openedAt)
+		if elapsed < b.cooldown {
+			return false, b.cooldown - elapsed
+		}
+		b.setState(breakerHalfOpen)
+		b.probing = true
+		return true, 0
+	case breakerHalfOpen:
+		if b.probing {
+			return false, b.cooldown
+		}
+		b.probing = true
+		return true, 0
+	default:
+		return true, 0
+	}
+}
+
+// Records the outcome of a call allowed by allow. A nonexistent name is a
+// successful RPC call as far as the breaker is concerned. A call abandoned by
+// its caller says nothing about namecoind, so only gives up the probe.
+func (b *circuitBreaker) done(err error) {
+	if b.threshold <= 0 {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if errors.Is(err, context.Canceled) {
+		b.probing = false
+		return
+	}
+
+	if err == nil || errors.Is(err, merr.ErrNoSuchDomain) {
+		b.setState(breakerClosed)
+		b.failures = 0
+		b.probing = false
+		return
+	}
+
+	b.failures++
+	if b.state == breakerHalfOpen || b.failures >= b.threshold {
+		b.setState(breakerOpen)
+		b.openedAt = b.clock.Now()
+		b.probing = false
+	}
+}
+
+func (b *circuitBreaker) setState(st breakerState) {
+	if st == b.state {
+		return
+	}
+	b.state = st
+	if st == breakerOpen {
+		b.trips++
+	}
+	if b.onChange != nil {
+		b.onChange(st)
+	}
+}
+
+// Returns the current state of the breaker.
+func (b *circuitBreaker) State() breakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == breakerOpen && b.clock.Now().Sub(b.openedAt) >= b.cooldown {
+		return breakerHalfOpen
+	}
+
+	return b.state
+}
+
+// Returns the state of the breaker and the number of times it has opened.
+func (b *circuitBreaker) Status() breakerStatus {
+	if b.threshold <= 0 {
+		return breakerStatus{State: "disabled"}
+	}
+
+	st := b.State()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return breakerStatus{State: st.String(), Trips: b.trips}
+}
+
+// Calls f under the protection of the breaker, returning errBreakerOpen
+// without calling f if the breaker is open.
+func (b *circuitBreaker) call(f func() (string, error)) (string, time.Duration, error) {
+	ok, retryAfter := b.allow()
+	if !ok {
+		return "", retryAfter, errBreakerOpen
+	}
+
+	v, err := f()
+	b.done(err)
+	return v, 0, err
+}
+
+// AllowFetch implements backend.FetchGuard.
+func (b *circuitBreaker) AllowFetch() error {
+	if ok, retryAfter := b.allow(); !ok {
+		return &breakerOpenError{retryAfter}
+	}
+	return nil
+}
+
+// FetchDone implements backend.FetchGuard.
+func (b *circuitBreaker) FetchDone(err error) {
+	b.done(err)
+}
@@ -0,0 +1,144 @@
+package server
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"gopkg.in/hlandau/madns.v2/merr"
+
+	"github.com/namecoin/ncdns/testutil"
+)
+
+// A fake RPC endpoint which fails whenever down is set.
+type flappingRPC struct {
+	down  bool
+	calls int
+}
+
+var errRPCDown = errors.New("connection refused")
+
+func (f *flappingRPC) nameQuery() (string, error) {
+	f.calls++
+	if f.down {
+		return "", errRPCDown
+	}
+	return `{"ip":"192.0.2.1"}`, nil
+}
+
+func TestCircuitBreakerFlapping(t *testing.T) {
+	clock := testutil.NewFakeClock(time.Unix(1000000, 0))
+	b := newCircuitBreaker(3, 30*time.Second, clock)
+	rpc := &flappingRPC{}
+
+	// Healthy calls pass through.
+	if _, _, err := b.call(rpc.nameQuery); err != nil {
+		t.Fatalf("healthy call failed: %v", err)
+	}
+
+	// Two failures followed by a success must not open the breaker.
+	rpc.down = true
+	b.call(rpc.nameQuery)
+	b.call(rpc.nameQuery)
+	rpc.down = false
+	b.call(rpc.nameQuery)
+	if b.State() != breakerClosed {
+		t.Fatalf("breaker opened without consecutive failures: %v", b.State())
+	}
+
+	// Three consecutive failures open it.
+	rpc.down = true
+	for i := 0; i < 3; i++ {
+		if _, _, err := b.call(rpc.nameQuery); err != errRPCDown {
+			t.Fatalf("call %d: expected RPC error, got %v", i, err)
+		}
+	}
+	if b.State() != breakerOpen {
+		t.Fatalf("breaker not open after threshold failures: %v", b.State())
+	}
+
+	// While open, calls are rejected without reaching the RPC server.
+	calls := rpc.calls
+	clock.Advance(10 * time.Second)
+	_, retryAfter, err := b.call(rpc.nameQuery)
+	if err != errBreakerOpen {
+		t.Fatalf("expected errBreakerOpen, got %v", err)
+	}
+	if retryAfter != 20*time.Second {
+		t.Errorf("expected retry after 20s, got %v", retryAfter)
+	}
+	if rpc.calls != calls {
+		t.Errorf("open breaker let a call through")
+	}
+
+	// After the cooldown a single probe is let through; it fails and the
+	// breaker reopens.
+	clock.Advance(20 * time.Second)
+	if b.State() != breakerHalfOpen {
+		t.Fatalf("breaker not half-open after cooldown: %v", b.State())
+	}
+	if _, _, err := b.call(rpc.nameQuery); err != errRPCDown {
+		t.Fatalf("half-open probe not attempted: %v", err)
+	}
+	if b.State() != breakerOpen {
+		t.Fatalf("failed probe didn't reopen breaker: %v", b.State())
+	}
+
+	// The next probe succeeds and closes it.
+	clock.Advance(30 * time.Second)
+	rpc.down = false
+	if _, _, err := b.call(rpc.nameQuery); err != nil {
+		t.Fatalf("half-open probe failed: %v", err)
+	}
+	if b.State() != breakerClosed {
+		t.Fatalf("successful probe didn't close breaker: %v", b.State())
+	}
+
+	// It opened twice: at the threshold, and when the first probe failed.
+	if st := b.Status(); st != (breakerStatus{State: "closed", Trips: 2}) {
+		t.Errorf("got status %+v", st)
+	}
+}
+
+func TestCircuitBreakerSingleProbe(t *testing.T) {
+	clock := testutil.NewFakeClock(time.Unix(1000000, 0))
+	b := newCircuitBreaker(1, time.Second, clock)
+
+	b.call((&flappingRPC{down: true}).nameQuery)
+	clock.Advance(time.Second)
+
+	if ok, _ := b.allow(); !ok {
+		t.Fatalf("probe not allowed after cooldown")
+	}
+	if ok, _ := b.allow(); ok {
+		t.Fatalf("second concurrent probe allowed while half-open")
+	}
+	b.done(nil)
+	if ok, _ := b.allow(); !ok {
+		t.Fatalf("call rejected after successful probe")
+	}
+	b.done(nil)
+}
+
+func TestCircuitBreakerNXDomainIsSuccess(t *testing.T) {
+	b := newCircuitBreaker(1, time.Minute, nil)
+
+	b.call(func() (string, error) { return "", merr.ErrNoSuchDomain })
+	if b.State() != breakerClosed {
+		t.Errorf("nonexistent name counted as an RPC failure")
+	}
+}
+
+func TestCircuitBreakerDisabled(t *testing.T) {
+	b := newCircuitBreaker(0, time.Minute, nil)
+	rpc := &flappingRPC{down: true}
+
+	for i := 0; i < 10; i++ {
+		if _, _, err := b.call(rpc.nameQuery); err != errRPCDown {
+			t.Fatalf("disabled breaker rejected call: %v", err)
+		}
+	}
+	if st := b.Status(); st != (breakerStatus{State: "disabled"}) {
+		t.Errorf("got status %+v", st)
+	}
+}
@@ -0,0 +1,283 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+
+	"github.com/namecoin/ncdns/clock"
+)
+
+// The events published on the server's internal bus, so that the features
+// which act on something happening needn't know about each other. Each is
+// published as a pointer.
+
+// namecoind has a new best block. The first is published when ncdns first
+// asks, with Initial set; it's the state of the chain consumers start from,
+// rather than a change.
+type blockConnected struct {
+	Height  int64
+	Hash    string
+	Initial bool
+}
+
+// Signing started with a new KSK or ZSK, e.g. after a reload or a ZSK
+// rollover.
+type keysReloaded struct {
+	KSKTag uint16
+	ZSKTag uint16
+}
+
+// The configuration was reloaded, changing the options named.
+type configReloaded struct {
+	Changed []string
+}
+
+// The circuit breaker for the webserver's lookups changed state: closed,
+// open or half-open.
+type degradedModeChanged struct {
+	State string
+}
+
+// An error or warning was found parsing the value of a name being served,
+// such as its being close to the size limit, or a name was found registered
+// whose records are shadowed by this nameserver's own names.
+type valueProblem struct {
+	Name    string
+	Problem string
+	Warning bool
+}
+
+// The number of events queued for each asynchronous subscriber before more
+// are dropped.
+const busQueueSize = 64
+
+// Delivers the events published to the features subscribed to them.
+//
+// A synchronous subscriber is called in the publisher's goroutine, before
+// publish returns; those subscribed synchronously are called in the order
+// they subscribed. An asynchronous subscriber is called in a goroutine of its
+// own, from a queue which, if the subscriber falls behind, drops events
+// rather than hold up the publisher. Either way, a subscriber sees the events
+// published by any one goroutine in the order they were published, and a
+// subscriber which panics is logged and carries on with the next event,
+// without affecting the others.
+//
+// Subscribers may publish events themselves. An event published by a
+// synchronous subscriber reaches the synchronous subscribers after it before
+// the event it's handling does.
+type eventBus struct {
+	mu     sync.RWMutex
+	subs   []*busSub
+	closed bool
+
+	panics  uint64 // accessed atomically
+	dropped uint64 // accessed atomically
+}
+
+type busSub struct {
+	name  string
+	f     func(ev interface{})
+	queue chan interface{} // nil if synchronous
+	done  chan struct{}    // closed once the queue is closed and emptied
+}
+
+func newEventBus() *eventBus {
+	return &eventBus{}
+}
+
+// Calls f with each event published from now on, in the publisher's
+// goroutine. name identifies the subscriber in logs.
+func (b *eventBus) subscribe(name string, f func(ev interface{})) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.subs = append(b.subs, &busSub{name: name, f: f})
+}
+
+// Calls f with each event published from now on, in a goroutine of its own,
+// until the bus is closed.
+func (b *eventBus) subscribeAsync(name string, f func(ev interface{})) {
+	sub := &busSub{name: name, f: f, queue: make(chan interface{}, busQueueSize), done: make(chan struct{})}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return
+	}
+	b.subs = append(b.subs, sub)
+	go func() {
+		defer close(sub.done)
+		for ev := range sub.queue {
+			b.deliver(sub, ev)
+		}
+	}()
+}
+
+// Sends ev to every subscriber. Does nothing if b is nil or closed.
+func (b *eventBus) publish(ev interface{}) {
+	if b == nil {
+		return
+	}
+
+	b.mu.RLock()
+	if b.closed {
+		b.mu.RUnlock()
+		return
+	}
+	subs := b.subs
+	for _, sub := range subs {
+		if sub.queue == nil {
+			continue
+		}
+		select {
+		case sub.queue <- ev:
+		default:
+			atomic.AddUint64(&b.dropped, 1)
+			log.Warnf("event bus: dropped %T for %s, which fell behind", ev, sub.name)
+		}
+	}
+	b.mu.RUnlock()
+
+	// The lock isn't held, so that synchronous subscribers can publish.
+	for _, sub := range subs {
+		if sub.queue == nil {
+			b.deliver(sub, ev)
+		}
+	}
+}
+
+// Calls sub with ev, recovering if it panics.
+func (b *eventBus) deliver(sub *busSub, ev interface{}) {
+	defer func() {
+		if r := recover(); r != nil {
+			atomic.AddUint64(&b.panics, 1)
+			log.Errorf("event bus: %s panicked handling %T: %v\n%s", sub.name, ev, r, debug.Stack())
+		}
+	}()
+
+	sub.f(ev)
+}
+
+// Stops delivering events, ending the goroutines of asynchronous
+// subscribers once they've handled the events queued for them.
+func (b *eventBus) close() {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return
+	}
+	b.closed = true
+	for _, sub := range b.subs {
+		if sub.queue != nil {
+			close(sub.queue)
+		}
+	}
+}
+
+// Closes the bus, then waits until ctx is done for the asynchronous
+// subscribers to handle the events queued for them.
+func (b *eventBus) drain(ctx context.Context) error {
+	if b == nil {
+		return nil
+	}
+	b.close()
+
+	b.mu.RLock()
+	subs := b.subs
+	b.mu.RUnlock()
+	for _, sub := range subs {
+		if sub.done == nil {
+			continue
+		}
+		select {
+		case <-sub.done:
+		case <-ctx.Done():
+			return fmt.Errorf("%s still has events queued", sub.name)
+		}
+	}
+	return nil
+}
+
+type busStatus struct {
+	Subscribers int    `json:"subscribers"`
+	Panics      uint64 `json:"panics"`
+	Dropped     uint64 `json:"dropped"`
+}
+
+func (b *eventBus) Status() busStatus {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	return busStatus{
+		Subscribers: len(b.subs),
+		Panics:      atomic.LoadUint64(&b.panics),
+		Dropped:     atomic.LoadUint64(&b.dropped),
+	}
+}
+
+// Keeps what the events of the bus say for /metrics.
+type busMetrics struct {
+	height        int64  // accessed atomically; of the best block, or 0 if none is known
+	blockTime     int64  // accessed atomically; Unix time the best block was noticed, or 0
+	configReloads uint64 // accessed atomically
+	keyChanges    uint64 // accessed atomically
+
+	hash  atomic.Value // string; of the best block, once known
+	clock clock.Clock  // the system clock if nil
+}
+
+func (m *busMetrics) handle(ev interface{}) {
+	switch ev := ev.(type) {
+	case *blockConnected:
+		m.hash.Store(ev.Hash)
+		atomic.StoreInt64(&m.height, ev.Height)
+		// Kept increasing, for SOASerialMode unixtime, even if two blocks
+		// are noticed in the same second.
+		t := clock.Or(m.clock).Now().Unix()
+		if last := atomic.LoadInt64(&m.blockTime); t <= last {
+			t = last + 1
+		}
+		atomic.StoreInt64(&m.blockTime, t)
+	case *configReloaded:
+		atomic.AddUint64(&m.configReloads, 1)
+	case *keysReloaded:
+		atomic.AddUint64(&m.keyChanges, 1)
+	}
+}
+
+// Returns the height of namecoind's best block as last seen by the block
+// watcher, or 0 if it isn't known, e.g. because nothing needs the watcher.
+func (s *Server) chainHeight() int64 {
+	if s.busMetrics == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&s.busMetrics.height)
+}
+
+// Returns the hash of namecoind's best block as last seen by the block
+// watcher, or "" if it isn't known.
+func (s *Server) chainHash() string {
+	if s.busMetrics == nil {
+		return ""
+	}
+	hash, _ := s.busMetrics.hash.Load().(string)
+	return hash
+}
+
+// Returns the Unix time at which the block watcher noticed the best block, or
+// 0 if it hasn't.
+func (s *Server) blockTime() int64 {
+	if s.busMetrics == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&s.busMetrics.blockTime)
+}
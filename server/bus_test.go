@@ -0,0 +1,143 @@
+package server
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestEventBusOrdering(t *testing.T) {
+	b := newEventBus()
+	defer b.close()
+
+	var calls []string
+	record := func(s string) { calls = append(calls, s) }
+
+	// Synchronous subscribers are called in order before publish returns.
+	b.subscribe("first", func(ev interface{}) { record("first " + ev.(*degradedModeChanged).State) })
+	b.subscribe("second", func(ev interface{}) { record("second " + ev.(*degradedModeChanged).State) })
+
+	// An asynchronous subscriber sees the events in the order published.
+	var async []string
+	done := make(chan struct{})
+	b.subscribeAsync("async", func(ev interface{}) {
+		async = append(async, ev.(*degradedModeChanged).State)
+		if len(async) == 3 {
+			close(done)
+		}
+	})
+
+	for _, state := range []string{"open", "half-open", "closed"} {
+		b.publish(&degradedModeChanged{State: state})
+	}
+
+	expected := []string{"first open", "second open", "first half-open", "second half-open", "first closed", "second closed"}
+	if !reflect.DeepEqual(calls, expected) {
+		t.Errorf("synchronous subscribers called as %v, expected %v", calls, expected)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("asynchronous subscriber got %v", async)
+	}
+	if !reflect.DeepEqual(async, []string{"open", "half-open", "closed"}) {
+		t.Errorf("asynchronous subscriber got %v", async)
+	}
+}
+
+func TestEventBusIsolation(t *testing.T) {
+	b := newEventBus()
+
+	// A subscriber which panics doesn't stop the others, or itself handling
+	// the next event.
+	var handled []int64
+	b.subscribe("panicky", func(ev interface{}) {
+		if ev, ok := ev.(*blockConnected); ok && ev.Height == 1 {
+			panic("boom")
+		}
+	})
+	b.subscribe("after", func(ev interface{}) {
+		if ev, ok := ev.(*blockConnected); ok {
+			handled = append(handled, ev.Height)
+		}
+	})
+
+	asyncHandled := make(chan int64, 2)
+	b.subscribeAsync("async panicky", func(ev interface{}) {
+		if ev, ok := ev.(*blockConnected); ok {
+			if ev.Height == 1 {
+				panic("boom")
+			}
+			asyncHandled <- ev.Height
+		}
+	})
+
+	b.publish(&blockConnected{Height: 1})
+	b.publish(&blockConnected{Height: 2})
+
+	if !reflect.DeepEqual(handled, []int64{1, 2}) {
+		t.Errorf("subscriber after the one which panicked handled %v", handled)
+	}
+	select {
+	case height := <-asyncHandled:
+		if height != 2 {
+			t.Errorf("asynchronous subscriber handled block %d", height)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("asynchronous subscriber stopped after panicking")
+	}
+	if st := b.Status(); st.Panics != 2 || st.Subscribers != 3 {
+		t.Errorf("unexpected status %+v", st)
+	}
+
+	// A slow asynchronous subscriber has events dropped rather than holding
+	// up the publisher.
+	block := make(chan struct{})
+	b.subscribeAsync("slow", func(ev interface{}) { <-block })
+	for i := 0; i < busQueueSize+10; i++ {
+		b.publish(&configReloaded{})
+	}
+	close(block)
+	if st := b.Status(); st.Dropped == 0 {
+		t.Errorf("no events dropped for a subscriber which fell behind: %+v", st)
+	}
+
+	// Once closed, nothing is delivered.
+	b.close()
+	b.close()
+	n := len(handled)
+	b.publish(&blockConnected{Height: 3})
+	if len(handled) != n {
+		t.Errorf("event delivered after the bus was closed")
+	}
+}
+
+// A synchronous subscriber may publish an event of its own.
+func TestEventBusPublishFromSubscriber(t *testing.T) {
+	b := newEventBus()
+	defer b.close()
+
+	var got []string
+	b.subscribe("reloader", func(ev interface{}) {
+		if _, ok := ev.(*configReloaded); ok {
+			b.publish(&keysReloaded{KSKTag: 1, ZSKTag: 2})
+		}
+	})
+	b.subscribe("recorder", func(ev interface{}) {
+		switch ev.(type) {
+		case *configReloaded:
+			got = append(got, "config")
+		case *keysReloaded:
+			got = append(got, "keys")
+		}
+	})
+
+	b.publish(&configReloaded{Changed: []string{"PublicKey"}})
+	if !reflect.DeepEqual(got, []string{"keys", "config"}) {
+		t.Errorf("got %v", got)
+	}
+
+	var nilBus *eventBus
+	nilBus.publish(&configReloaded{})
+}
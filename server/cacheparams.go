@@ -0,0 +1,119 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/namecoin/ncdns/backend"
+)
+
+// The cache options in effect, as shown by /status and the cache options API.
+type cacheParamsInfo struct {
+	CacheMaxEntries         int `json:"cache_max_entries"`
+	CacheMaxBytes           int `json:"cache_max_bytes"`
+	NegativeCacheMaxEntries int `json:"negative_cache_max_entries"`
+	NegativeCacheTTL        int `json:"negative_cache_ttl"`
+}
+
+// A change to the cache options which may be made while ncdns is running.
+// Options left out keep their values.
+type cacheParamsChange struct {
+	CacheMaxEntries         *int `json:"cache_max_entries"`
+	CacheMaxBytes           *int `json:"cache_max_bytes"`
+	NegativeCacheMaxEntries *int `json:"negative_cache_max_entries"`
+	NegativeCacheTTL        *int `json:"negative_cache_ttl"`
+}
+
+func (cfg *Config) cacheParams() cacheParamsInfo {
+	return cacheParamsInfo{
+		CacheMaxEntries:         cfg.Cache.MaxEntries,
+		CacheMaxBytes:           cfg.Cache.MaxBytes,
+		NegativeCacheMaxEntries: cfg.Cache.NegativeMaxEntries,
+		NegativeCacheTTL:        cfg.Cache.NegativeTTL,
+	}
+}
+
+// Checks the cache options, reporting every one which is invalid at once.
+func (cfg *Config) checkCacheOptions() error {
+	var problems []string
+	for _, opt := range []struct {
+		name  string
+		value int
+	}{
+		{"CacheMaxEntries", cfg.Cache.MaxEntries},
+		{"CacheMaxBytes", cfg.Cache.MaxBytes},
+		{"NegativeCacheMaxEntries", cfg.Cache.NegativeMaxEntries},
+		{"NegativeCacheTTL", cfg.Cache.NegativeTTL},
+	} {
+		if opt.value < 0 {
+			problems = append(problems, fmt.Sprintf("%s must not be negative", opt.name))
+		}
+	}
+
+	if problems != nil {
+		return configError("%s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// Sets the options of cfg given by ch, and returns a description of each
+// which changed.
+func (ch *cacheParamsChange) apply(cfg *Config) (changed []string) {
+	for _, opt := range []struct {
+		name string
+		v    *int
+		p    *int
+	}{
+		{"CacheMaxEntries", ch.CacheMaxEntries, &cfg.Cache.MaxEntries},
+		{"CacheMaxBytes", ch.CacheMaxBytes, &cfg.Cache.MaxBytes},
+		{"NegativeCacheMaxEntries", ch.NegativeCacheMaxEntries, &cfg.Cache.NegativeMaxEntries},
+		{"NegativeCacheTTL", ch.NegativeCacheTTL, &cfg.Cache.NegativeTTL},
+	} {
+		if opt.v == nil || *opt.v == *opt.p {
+			continue
+		}
+		changed = append(changed, fmt.Sprintf("%s %d -> %d", opt.name, *opt.p, *opt.v))
+		*opt.p = *opt.v
+	}
+	return changed
+}
+
+// Changes the cache options of the running server, on behalf of who, and
+// returns those then in effect. Unlike Reload, the backend is kept with what
+// it has cached: caches over their new bounds are shrunk by evicting their
+// least recently used entries, a batch at a time. If any option is invalid,
+// none is changed.
+//
+// The change is made to the configuration as reloaded, so a later Reload
+// keeps it, unless the configuration file changes the option too.
+func (s *Server) setCacheParams(ch *cacheParamsChange, who string) (cacheParamsInfo, error) {
+	// A reload in progress would build its backend with the old options.
+	if _, err := s.lifecycle.transition("change the cache options of", stateReloading, nil); err != nil {
+		return cacheParamsInfo{}, err
+	}
+	defer s.lifecycle.transition("finish changing the cache options", stateRunning, nil)
+
+	ncfg := *s.currentConfig()
+	changed := ch.apply(&ncfg)
+	if err := ncfg.checkCacheOptions(); err != nil {
+		return cacheParamsInfo{}, err
+	}
+	if changed == nil {
+		return ncfg.cacheParams(), nil
+	}
+
+	s.currentBackend().SetCacheParams(backend.CacheParams{
+		MaxEntries:         ncfg.Cache.MaxEntries,
+		MaxBytes:           ncfg.Cache.MaxBytes,
+		NegativeMaxEntries: ncfg.Cache.NegativeMaxEntries,
+		NegativeTTL:        time.Duration(ncfg.Cache.NegativeTTL) * time.Second,
+	})
+
+	s.stateMu.Lock()
+	s.reloadedCfg = &ncfg
+	s.stateMu.Unlock()
+
+	log.Infof("%s changed the cache options: %s", who, strings.Join(changed, ", "))
+	return ncfg.cacheParams(), nil
+}
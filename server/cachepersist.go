@@ -0,0 +1,227 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/namecoin/ncdns/backend"
+	"github.com/namecoin/ncdns/clock"
+	"github.com/namecoin/ncdns/namecoin"
+)
+
+// Version of the format of cache snapshots. A snapshot of another version is
+// ignored, so that a format changed by a later version never stops ncdns
+// starting; bump it whenever a change means older code would misread one.
+const cacheSnapshotVersion = 1
+
+// The names in the name cache, as saved in CachePersistPath, and the best
+// block when they were, which must still be the best block for them to be
+// loaded again.
+type cacheSnapshot struct {
+	Version   int                  `json:"version"`
+	Saved     time.Time            `json:"saved"`
+	TipHeight int64                `json:"tip_height"`
+	TipHash   string               `json:"tip_hash"`
+	Names     []cacheSnapshotEntry `json:"names"`
+}
+
+type cacheSnapshotEntry struct {
+	StreamIsolationID string    `json:"stream_isolation_id,omitempty"`
+	Name              string    `json:"name"`
+	Value             string    `json:"value"`
+	Height            int32     `json:"height,omitempty"`
+	ExpiresIn         int32     `json:"expires_in,omitempty"`
+	Expired           bool      `json:"expired,omitempty"`
+	Added             time.Time `json:"added"`
+}
+
+// Saves the name cache every interval, and when the server stops, and loads
+// it again when the server starts, so that a restart doesn't send namecoind a
+// burst of lookups for every name being queried.
+type cachePersister struct {
+	path     string
+	interval time.Duration
+	clock    clock.Clock
+
+	// Returns the backend whose cache is saved.
+	backend func() *backend.Backend
+
+	// Returns the best block.
+	bestBlock func() (height int64, hash string, err error)
+
+	mu     sync.Mutex
+	loaded bool // set once the snapshot has been loaded, or found unusable
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+func (s *Server) setupCachePersist() error {
+	if s.cfg.Cache.PersistPath == "" {
+		return nil
+	}
+	if !s.cfg.usesNamecoind() {
+		return configError("CachePersistPath requires the namecoind fetcher")
+	}
+	if s.cfg.Cache.PersistInterval < 0 {
+		return configError("CachePersistInterval must not be negative")
+	}
+
+	p := &cachePersister{
+		path:     s.cfg.cpath(s.cfg.Cache.PersistPath),
+		interval: time.Duration(s.cfg.Cache.PersistInterval) * time.Second,
+		clock:    clock.Or(s.clock),
+		backend:  s.currentBackend,
+		bestBlock: func() (int64, string, error) {
+			hash, err := s.namecoinConn.GetBestBlockHash()
+			if err != nil {
+				return 0, "", err
+			}
+			height, err := s.namecoinConn.GetBlockCount()
+			return height, hash.String(), err
+		},
+		stop: make(chan struct{}),
+	}
+	s.cachePersister = p
+	s.shutdown.register(shutdownDrain, "name cache snapshots", func(context.Context) error {
+		p.stopOnce.Do(func() { close(p.stop) })
+		return nil
+	})
+	s.shutdown.register(shutdownFlush, "name cache snapshot", func(context.Context) error {
+		return p.save()
+	})
+	return nil
+}
+
+// Loads the snapshot, then saves the cache every interval.
+func (p *cachePersister) run() {
+	p.load()
+	if p.interval <= 0 {
+		return
+	}
+
+	t := p.clock.NewTicker(p.interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C():
+			log.Warne(p.save(), "couldn't save the name cache to ", p.path)
+		case <-p.stop:
+			return
+		}
+	}
+}
+
+// Loads the snapshot into the cache, unless it was saved at another best
+// block, in which case the names may have changed since. Loading is best
+// effort: if the snapshot can't be read, the cache starts empty, with a
+// warning.
+func (p *cachePersister) load() {
+	defer func() {
+		p.mu.Lock()
+		p.loaded = true
+		p.mu.Unlock()
+	}()
+
+	b, err := ioutil.ReadFile(p.path)
+	if os.IsNotExist(err) {
+		return
+	} else if err != nil {
+		log.Warne(err, "couldn't read the name cache snapshot; starting with an empty cache")
+		return
+	}
+
+	var snap cacheSnapshot
+	if err := json.Unmarshal(b, &snap); err != nil {
+		log.Warnf("couldn't parse the name cache snapshot %s, starting with an empty cache: %v", p.path, err)
+		return
+	}
+	if snap.Version != cacheSnapshotVersion {
+		log.Warnf("the name cache snapshot %s is of version %d, which this version of ncdns doesn't read; starting with an empty cache", p.path, snap.Version)
+		return
+	}
+
+	be := p.backend()
+	generation := be.CacheGeneration()
+	height, hash, err := p.bestBlock()
+	if err != nil {
+		log.Warne(err, "couldn't get the best block to check the name cache snapshot against; starting with an empty cache")
+		return
+	}
+	if hash != snap.TipHash {
+		log.Infof("Not loading the name cache snapshot, saved at block %d, as the best block is now %d", snap.TipHeight, height)
+		return
+	}
+
+	names := make([]backend.CachedName, len(snap.Names))
+	for i, e := range snap.Names {
+		names[i] = backend.CachedName{
+			StreamIsolationID: e.StreamIsolationID,
+			Name:              e.Name,
+			NameData: namecoin.NameData{
+				Value:     e.Value,
+				Height:    e.Height,
+				ExpiresIn: e.ExpiresIn,
+				Expired:   e.Expired,
+			},
+			Added: e.Added,
+		}
+	}
+	n := be.RestoreCachedNames(names, generation)
+	log.Infof("Loaded %d names into the name cache from %s, saved at block %d", n, p.path, snap.TipHeight)
+}
+
+// Saves the cache, along with the best block, unless the snapshot hasn't
+// been loaded yet, as it would be overwritten with a cache which hasn't had
+// the chance to be filled from it.
+func (p *cachePersister) save() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.loaded {
+		return nil
+	}
+
+	// If a new block comes between asking for the best block and taking
+	// the names, the snapshot is saved at the old block, and so won't be
+	// loaded, since the best block will have moved on.
+	height, hash, err := p.bestBlock()
+	if err != nil {
+		return fmt.Errorf("couldn't get the best block: %v", err)
+	}
+	names := p.backend().CachedNames()
+
+	snap := cacheSnapshot{
+		Version:   cacheSnapshotVersion,
+		Saved:     p.clock.Now().UTC(),
+		TipHeight: height,
+		TipHash:   hash,
+		Names:     make([]cacheSnapshotEntry, len(names)),
+	}
+	for i, cn := range names {
+		snap.Names[i] = cacheSnapshotEntry{
+			StreamIsolationID: cn.StreamIsolationID,
+			Name:              cn.Name,
+			Value:             cn.NameData.Value,
+			Height:            cn.NameData.Height,
+			ExpiresIn:         cn.NameData.ExpiresIn,
+			Expired:           cn.NameData.Expired,
+			Added:             cn.Added.UTC(),
+		}
+	}
+
+	b, err := json.Marshal(&snap)
+	if err != nil {
+		return err
+	}
+	// Names looked up say what's been queried, so the snapshot is kept as
+	// private as the query log.
+	if err := ioutil.WriteFile(p.path+".tmp", b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(p.path+".tmp", p.path)
+}
@@ -0,0 +1,139 @@
+package server
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/namecoin/ncdns/clock"
+)
+
+func newTestCachePersister(s *Server, path string, tipHash *string) *cachePersister {
+	return &cachePersister{
+		path:    path,
+		clock:   clock.Real,
+		backend: s.currentBackend,
+		bestBlock: func() (int64, string, error) {
+			return 500, *tipHash, nil
+		},
+		stop: make(chan struct{}),
+	}
+}
+
+func cachedNames(s *Server) []string {
+	var names []string
+	for _, cn := range s.currentBackend().CachedNames() {
+		names = append(names, cn.Name)
+	}
+	return names
+}
+
+func TestCachePersist(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ncdns-cachepersist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "cache.json")
+	tip := "00aa"
+
+	// Nothing is saved until the snapshot has been loaded, or found
+	// missing.
+	s := newEDNSTestServer(t)
+	p := newTestCachePersister(s, path, &tip)
+	if _, err := s.currentBackend().Lookup("example.bit.", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.save(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("snapshot saved before loading: %v", err)
+	}
+
+	p.load()
+	if err := p.save(); err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0600 {
+		t.Fatalf("snapshot not saved privately: %v", err)
+	}
+
+	// A restarted server loads it, while the best block is the same.
+	s2 := newEDNSTestServer(t)
+	newTestCachePersister(s2, path, &tip).load()
+	if names := cachedNames(s2); len(names) != 1 || names[0] != "d/example" {
+		t.Errorf("got cached names %v after loading", names)
+	}
+
+	tip = "00bb"
+	s3 := newEDNSTestServer(t)
+	newTestCachePersister(s3, path, &tip).load()
+	if names := cachedNames(s3); len(names) != 0 {
+		t.Errorf("got cached names %v after a new block", names)
+	}
+
+	// A snapshot which can't be read leaves the cache empty, and is
+	// overwritten.
+	for _, snapshot := range []string{
+		`{"version":1,"names":[`,
+		`{"version":2,"tip_hash":"00bb","names":[{"name":"d/example","value":3}]}`,
+	} {
+		if err := ioutil.WriteFile(path, []byte(snapshot), 0600); err != nil {
+			t.Fatal(err)
+		}
+		s := newEDNSTestServer(t)
+		p := newTestCachePersister(s, path, &tip)
+		p.load()
+		if names := cachedNames(s); len(names) != 0 {
+			t.Errorf("%s: got cached names %v", snapshot, names)
+		}
+		if err := p.save(); err != nil {
+			t.Errorf("%s: %v", snapshot, err)
+		}
+	}
+}
+
+// A snapshot is loaded when the server starts and saved when it stops.
+func TestCachePersistLifecycle(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ncdns-cachepersist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tip := "00aa"
+
+	s := newEDNSTestServer(t)
+	s.cfg.ConfigDir = dir
+	s.cfg.Cache.PersistPath = "cache.json"
+	s.cfg.Cache.PersistInterval = 3600
+	if err := s.setupCachePersist(); err != nil {
+		t.Fatal(err)
+	}
+	s.cachePersister.bestBlock = func() (int64, string, error) { return 500, tip, nil }
+
+	go s.cachePersister.run()
+	if _, err := s.currentBackend().Lookup("example.bit.", ""); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		s.cachePersister.mu.Lock()
+		loaded := s.cachePersister.loaded
+		s.cachePersister.mu.Unlock()
+		if loaded || time.Now().After(deadline) {
+			break
+		}
+	}
+	if err := s.shutdown.run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	s2 := newEDNSTestServer(t)
+	newTestCachePersister(s2, filepath.Join(dir, "cache.json"), &tip).load()
+	if names := cachedNames(s2); len(names) != 1 {
+		t.Errorf("got cached names %v after stopping and loading", names)
+	}
+}
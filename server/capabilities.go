@@ -0,0 +1,116 @@
+package server
+
+import (
+	"sort"
+	"strconv"
+
+	"github.com/namecoin/ncdns/ncdomain"
+	"github.com/namecoin/ncdns/tracing"
+)
+
+// The states of a feature, as described by /api/v1/capabilities and CH TXT
+// capabilities.bind. A feature with a version of its own, such as that of the
+// value parser, gives the version instead.
+const (
+	capabilityEnabled  = "enabled"
+	capabilityDisabled = "disabled"
+
+	// Left out of this build by a build tag, e.g. the webserver by
+	// no_webserver, so that no configuration enables it.
+	capabilityExcluded = "excluded"
+)
+
+// The features described, by name, each with a function returning its state
+// on a server. A feature missing from it isn't supported by this version of
+// ncdns at all.
+//
+// Each optional subsystem registers itself from init, both in the file which
+// builds it and in the one standing in for it when a build tag leaves it out,
+// so that the description is always that of the binary at hand.
+var capabilities = map[string]func(s *Server) string{}
+
+// Registers a feature. Each feature must be registered exactly once, whatever
+// the build tags.
+func registerCapability(name string, state func(s *Server) string) {
+	if _, ok := capabilities[name]; ok {
+		panic("server: capability registered twice: " + name)
+	}
+	capabilities[name] = state
+}
+
+// Registers a feature which is enabled on a server if enabled returns true.
+func registerOptional(name string, enabled func(s *Server) bool) {
+	registerCapability(name, func(s *Server) string {
+		if enabled(s) {
+			return capabilityEnabled
+		}
+		return capabilityDisabled
+	})
+}
+
+// Registers a feature left out of this build.
+func registerExcluded(name string) {
+	registerCapability(name, func(*Server) string {
+		return capabilityExcluded
+	})
+}
+
+// Returns the state of each feature of s, by name.
+func (s *Server) capabilities() map[string]string {
+	caps := make(map[string]string, len(capabilities))
+	for name, state := range capabilities {
+		caps[name] = state(s)
+	}
+	return caps
+}
+
+// Returns the states of the features of s in the compact form served over
+// DNS: "name=state" for each, sorted by name.
+func (s *Server) capabilityStrings() []string {
+	var txt []string
+	for name, state := range s.capabilities() {
+		txt = append(txt, name+"="+state)
+	}
+	sort.Strings(txt)
+	return txt
+}
+
+func init() {
+	registerCapability("edns", func(*Server) string {
+		return "0"
+	})
+	registerCapability("value_parser", func(*Server) string {
+		return strconv.Itoa(ncdomain.ParserVersion)
+	})
+	registerOptional("dnssec", func(s *Server) bool {
+		return s.cfg.DNSSEC.PublicKey != ""
+	})
+	registerOptional("dot", func(s *Server) bool {
+		return s.cfg.TLSBind != ""
+	})
+	registerOptional("cookies", func(s *Server) bool {
+		return s.cfg.CookieSecretLifetime > 0
+	})
+	registerOptional("rrl", func(s *Server) bool {
+		return s.cfg.RRLRatePerSecond > 0
+	})
+	registerOptional("zone_transfers", func(s *Server) bool {
+		return s.xfer != nil
+	})
+	registerOptional("ixfr", func(s *Server) bool {
+		return s.xfer != nil && s.xfer.journal != nil
+	})
+	registerOptional("notify", func(s *Server) bool {
+		return s.cfg.NotifyTargets != ""
+	})
+	registerOptional("serve_stale", func(s *Server) bool {
+		return s.cfg.Cache.StaleTTL > 0 && s.cfg.FlushCacheOnBlock
+	})
+	if tracing.Available {
+		registerOptional("tracing", func(s *Server) bool {
+			return s.cfg.OTLPEndpoint != ""
+		})
+	} else {
+		registerExcluded("tracing")
+	}
+}
@@ -0,0 +1,20 @@
+//go:build no_webserver && no_acme && no_namecoin_tls
+// +build no_webserver,no_acme,no_namecoin_tls
+
+package server
+
+import "testing"
+
+// The minimal build describes the features it leaves out as excluded, even
+// with a configuration which would enable them.
+func TestCapabilitiesMinimal(t *testing.T) {
+	s := &Server{cfg: Config{ACMEHostnames: "ns1.example.com"}}
+	s.cfg.HTTP.ListenAddr = "127.0.0.1:8202"
+	s.cfg.HTTP.Events = true
+	caps := s.capabilities()
+	for _, name := range []string{"webserver", "http_events", "zone_dump", "acme", "namecoin_tls"} {
+		if caps[name] != capabilityExcluded {
+			t.Errorf("%s: got %q, expected it excluded", name, caps[name])
+		}
+	}
+}
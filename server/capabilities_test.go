@@ -0,0 +1,40 @@
+package server
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// Every feature is described whatever the build tags, those left out of the
+// build as excluded.
+func TestCapabilitiesRegistered(t *testing.T) {
+	var names []string
+	for name := range capabilities {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	expected := []string{
+		"acme", "cookies", "dnssec", "dot", "edns", "http_events", "ixfr", "namecoin_tls", "notify",
+		"rrl", "serve_stale", "tracing", "value_parser", "webserver", "zone_dump", "zone_transfers",
+	}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("got capabilities %q, expected %q", names, expected)
+	}
+
+	s := &Server{cfg: Config{TLSBind: ":853", NotifyTargets: "192.0.2.53:53"}}
+	s.cfg.DNSSEC.PublicKey = "Kbit.+008+12345.key"
+	caps := s.capabilities()
+	for name, state := range map[string]string{
+		"dnssec":  capabilityEnabled,
+		"dot":     capabilityEnabled,
+		"notify":  capabilityEnabled,
+		"cookies": capabilityDisabled,
+		"ixfr":    capabilityDisabled,
+		"edns":    "0",
+	} {
+		if caps[name] != state {
+			t.Errorf("%s: got %q, expected %q", name, caps[name], state)
+		}
+	}
+}
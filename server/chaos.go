@@ -0,0 +1,128 @@
+package server
+
+import (
+	"os"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// The VersionString which refuses queries for the version.
+const versionHidden = "hidden"
+
+// Answers queries of class CH, as BIND and most other nameservers do: the
+// version at version.bind. and version.server., and the server's identity at
+// hostname.bind. and id.server. (RFC 4892). The features of the server, as
+// /api/v1/capabilities describes them, are at capabilities.bind., a string
+// for each. These never reach the backend, so they're answered even when
+// namecoind is down.
+type chaosHandler struct {
+	version string
+	hidden  bool // version and capabilities queries are refused
+	id      string
+	udpSize uint16 // advertised in responses with EDNS
+
+	capabilities func() []string
+}
+
+// Sets up the handler of CH queries from VersionString and ServerID.
+func (s *Server) setupChaos() {
+	h := &chaosHandler{
+		version: s.cfg.VersionString,
+		hidden:  s.cfg.VersionString == versionHidden,
+		id:      s.cfg.ServerID,
+		udpSize: s.ednsUDPSize(),
+
+		capabilities: s.capabilityStrings,
+	}
+	if h.version == "" {
+		h.version = ncdnsVersion
+	}
+	if h.id == "" {
+		h.id = strings.TrimSuffix(s.cfg.SelfName, ".")
+	}
+	if h.id == "" {
+		h.id, _ = os.Hostname()
+	}
+	s.chaos = h
+}
+
+func (h *chaosHandler) ServeDNS(rw dns.ResponseWriter, req *dns.Msg) {
+	q := req.Question[0]
+	name := strings.ToLower(q.Name)
+
+	var txt []string
+	switch name {
+	case "version.bind.", "version.server.", "capabilities.bind.":
+		// Which features a server has narrows down its version, so
+		// they're hidden along with it.
+		if h.hidden {
+			h.write(rw, req, dns.RcodeRefused, nil)
+			return
+		}
+		if name == "capabilities.bind." {
+			txt = h.capabilities()
+		} else {
+			txt = splitTXT(h.version)
+		}
+	case "hostname.bind.", "id.server.":
+		txt = splitTXT(h.id)
+	default:
+		h.write(rw, req, dns.RcodeNameError, nil)
+		return
+	}
+
+	if q.Qtype != dns.TypeTXT && q.Qtype != dns.TypeANY {
+		h.write(rw, req, dns.RcodeSuccess, nil)
+		return
+	}
+	h.write(rw, req, dns.RcodeSuccess, &dns.TXT{
+		Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeTXT, Class: dns.ClassCHAOS},
+		Txt: txt,
+	})
+}
+
+// Writes a response with the given answer, or if there is none, the SOA of
+// the zone of the name asked about in the authority section, as negative
+// responses have.
+func (h *chaosHandler) write(rw dns.ResponseWriter, req *dns.Msg, rcode int, answer dns.RR) {
+	m := new(dns.Msg)
+	m.SetRcode(req, rcode)
+	m.Authoritative = rcode != dns.RcodeRefused
+	if answer != nil {
+		m.Answer = []dns.RR{answer}
+	} else if rcode != dns.RcodeRefused {
+		m.Ns = []dns.RR{chaosSOA(req.Question[0].Name)}
+	}
+	if req.IsEdns0() != nil {
+		m.SetEdns0(h.udpSize, false)
+	}
+	rw.WriteMsg(m)
+}
+
+// Returns the SOA of the CH zone a name is in: bind. or server., where the
+// names answered are, or the root for any other name.
+func chaosSOA(name string) *dns.SOA {
+	zone := "."
+	for _, z := range []string{"bind.", "server."} {
+		if dns.IsSubDomain(z, strings.ToLower(name)) {
+			zone = z
+		}
+	}
+	return &dns.SOA{
+		Hdr:  dns.RR_Header{Name: zone, Rrtype: dns.TypeSOA, Class: dns.ClassCHAOS},
+		Ns:   zone,
+		Mbox: dns.Fqdn("hostmaster." + strings.TrimSuffix(zone, ".")),
+	}
+}
+
+// Splits a string into the character strings of a TXT record, of at most 255
+// bytes each.
+func splitTXT(s string) []string {
+	var out []string
+	for len(s) > 255 {
+		out = append(out, s[:255])
+		s = s[255:]
+	}
+	return append(out, s)
+}
@@ -0,0 +1,100 @@
+package server
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestChaosQueries(t *testing.T) {
+	// Without a backend: the mux fails any query reaching it.
+	newChaosServer := func(cfg Config) *Server {
+		s := &Server{cfg: cfg, mux: dns.NewServeMux()}
+		s.mux.HandleFunc(".", func(rw dns.ResponseWriter, req *dns.Msg) {
+			t.Errorf("CH query for %s reached the mux", req.Question[0].Name)
+			m := new(dns.Msg)
+			m.SetRcode(req, dns.RcodeServerFailure)
+			rw.WriteMsg(m)
+		})
+		if err := s.setupOutOfZone(); err != nil {
+			t.Fatal(err)
+		}
+		s.setupChaos()
+		return s
+	}
+	query := func(s *Server, name string, qtype uint16) *dns.Msg {
+		req := new(dns.Msg)
+		req.SetQuestion(name, qtype)
+		req.Question[0].Qclass = dns.ClassCHAOS
+		rw := &fakeResponseWriter{}
+		s.ServeDNS(rw, req)
+		if rw.msg == nil {
+			t.Fatalf("no response to CH %s %s", name, dns.TypeToString[qtype])
+		}
+		return rw.msg
+	}
+	txt := func(m *dns.Msg) string {
+		if len(m.Answer) != 1 {
+			return ""
+		}
+		rr, ok := m.Answer[0].(*dns.TXT)
+		if !ok || rr.Hdr.Class != dns.ClassCHAOS {
+			return ""
+		}
+		return strings.Join(rr.Txt, "")
+	}
+
+	s := newChaosServer(Config{SelfName: "ns1.example.com."})
+	for _, name := range []string{"version.bind.", "VERSION.SERVER."} {
+		if m := query(s, name, dns.TypeTXT); m.Rcode != dns.RcodeSuccess || txt(m) != ncdnsVersion {
+			t.Errorf("%s: got %v, expected the version", name, m)
+		}
+	}
+	for _, name := range []string{"hostname.bind.", "id.server."} {
+		if m := query(s, name, dns.TypeTXT); txt(m) != "ns1.example.com" {
+			t.Errorf("%s: got %v, expected SelfName", name, m)
+		}
+	}
+
+	// The features, a string for each.
+	if m := query(s, "capabilities.bind.", dns.TypeTXT); len(m.Answer) != 1 ||
+		!reflect.DeepEqual(m.Answer[0].(*dns.TXT).Txt, s.capabilityStrings()) || !strings.Contains(txt(m), "dnssec=disabled") {
+		t.Errorf("capabilities.bind.: got %v, expected %q", m, s.capabilityStrings())
+	}
+
+	// Other types and other names are answered with the SOA of their zone.
+	if m := query(s, "version.bind.", dns.TypeA); m.Rcode != dns.RcodeSuccess || len(m.Answer) != 0 || len(typeOnly(m.Ns, dns.TypeSOA)) != 1 {
+		t.Errorf("CH A version.bind.: got %v, expected NODATA", m)
+	}
+	for _, name := range []string{"authors.bind.", "example.com.", "example.bit."} {
+		m := query(s, name, dns.TypeTXT)
+		if m.Rcode != dns.RcodeNameError || len(m.Answer) != 0 || len(typeOnly(m.Ns, dns.TypeSOA)) != 1 {
+			t.Errorf("%s: got %v, expected NXDOMAIN with an SOA", name, m)
+		}
+	}
+
+	// A query without a question is refused before its class is looked at.
+	rw := &fakeResponseWriter{}
+	s.ServeDNS(rw, new(dns.Msg))
+	if rw.msg == nil || rw.msg.Rcode != dns.RcodeFormatError {
+		t.Errorf("no question: got %v, expected FORMERR", rw.msg)
+	}
+
+	s = newChaosServer(Config{VersionString: "ncdns for example.com", ServerID: "a1"})
+	if m := query(s, "version.bind.", dns.TypeTXT); txt(m) != "ncdns for example.com" {
+		t.Errorf("custom version: got %v", m)
+	}
+	if m := query(s, "id.server.", dns.TypeTXT); txt(m) != "a1" {
+		t.Errorf("custom ID: got %v", m)
+	}
+
+	s = newChaosServer(Config{VersionString: "hidden"})
+	if m := query(s, "version.server.", dns.TypeTXT); m.Rcode != dns.RcodeRefused || len(m.Answer) != 0 {
+		t.Errorf("hidden version: got %v, expected REFUSED", m)
+	}
+	if m := query(s, "capabilities.bind.", dns.TypeTXT); m.Rcode != dns.RcodeRefused || len(m.Answer) != 0 {
+		t.Errorf("capabilities with a hidden version: got %v, expected REFUSED", m)
+	}
+}
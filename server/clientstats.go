@@ -0,0 +1,328 @@
+package server
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/namecoin/ncdns/clock"
+)
+
+// Query counts are kept in this many buckets, each covering an equal part of
+// the window, so that old queries stop counting a bucket at a time.
+const clientStatsBuckets = 10
+
+// Clients are counted by prefix rather than by address, since a single abuser
+// usually has many addresses in one of these.
+const (
+	clientPrefixBitsIPv4 = 24
+	clientPrefixBitsIPv6 = 48
+)
+
+// Number of prefixes listed by /api/v1/clients unless the limit parameter
+// says otherwise.
+const clientStatsDefaultLimit = 20
+
+type clientCounts struct {
+	queries  uint64
+	servFail uint64
+	nxDomain uint64
+}
+
+type prefixStats struct {
+	buckets [clientStatsBuckets]clientCounts
+	epochs  [clientStatsBuckets]int64 // number of the bucket each holds
+	banned  time.Time                 // refused until then
+}
+
+// Keeps rolling query counts for the client prefixes sent queries, and bans
+// those which send more than the threshold. At most max prefixes are kept:
+// when a new one arrives and there's no room, the prefixes with no recent
+// queries are forgotten, then, if that frees less than a quarter of the room,
+// the least active half of those not banned. A flood of queries from many
+// (perhaps spoofed) prefixes thus can't exhaust memory, or push out the
+// prefixes sending the most.
+type clientStats struct {
+	max         int
+	window      time.Duration
+	threshold   float64 // queries per second; 0: never ban
+	banDuration time.Duration
+	clock       clock.Clock
+
+	mu       sync.Mutex
+	prefixes map[string]*prefixStats
+	evicted  uint64
+	bans     uint64
+}
+
+func newClientStats(max int, window time.Duration, threshold float64, banDuration time.Duration, clk clock.Clock) *clientStats {
+	return &clientStats{
+		max:         max,
+		window:      window,
+		threshold:   threshold,
+		banDuration: banDuration,
+		clock:       clock.Or(clk),
+		prefixes:    make(map[string]*prefixStats),
+	}
+}
+
+// Returns the prefix an address is counted under, e.g. 192.0.2.0/24, or ""
+// if it isn't an IP address.
+func clientPrefix(ip net.IP) string {
+	bits, size := clientPrefixBitsIPv6, net.IPv6len*8
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, bits, size = ip4, clientPrefixBitsIPv4, net.IPv4len*8
+	} else if len(ip) != net.IPv6len {
+		return ""
+	}
+
+	n := &net.IPNet{IP: ip.Mask(net.CIDRMask(bits, size)), Mask: net.CIDRMask(bits, size)}
+	return n.String()
+}
+
+func (cs *clientStats) bucket(now time.Time) int64 {
+	return now.UnixNano() / int64(cs.window/clientStatsBuckets)
+}
+
+// Returns the counts for the prefix's bucket for now, emptying it if it holds
+// an older one.
+func (ps *prefixStats) current(n int64) *clientCounts {
+	i := n % clientStatsBuckets
+	if ps.epochs[i] != n {
+		ps.epochs[i] = n
+		ps.buckets[i] = clientCounts{}
+	}
+	return &ps.buckets[i]
+}
+
+// Returns the counts over the window ending with bucket n.
+func (ps *prefixStats) total(n int64) clientCounts {
+	var c clientCounts
+	for i, b := range ps.buckets {
+		if ps.epochs[i] > n-clientStatsBuckets {
+			c.queries += b.queries
+			c.servFail += b.servFail
+			c.nxDomain += b.nxDomain
+		}
+	}
+	return c
+}
+
+// Counts a query from prefix. Returns false if the prefix is banned, or has
+// just been, in which case the query should be refused.
+func (cs *clientStats) admit(prefix string) bool {
+	now := cs.clock.Now()
+	n := cs.bucket(now)
+
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	ps, ok := cs.prefixes[prefix]
+	if !ok {
+		if len(cs.prefixes) >= cs.max {
+			cs.evict(now, n)
+		}
+		if len(cs.prefixes) >= cs.max {
+			// Every prefix is banned; there's no room to count this one.
+			return true
+		}
+
+		ps = &prefixStats{}
+		cs.prefixes[prefix] = ps
+	}
+
+	ps.current(n).queries++
+	if now.Before(ps.banned) {
+		return false
+	}
+
+	if cs.threshold > 0 {
+		qps := float64(ps.total(n).queries) / cs.window.Seconds()
+		if qps > cs.threshold {
+			ps.banned = now.Add(cs.banDuration)
+			cs.bans++
+			log.Warnf("client prefix %s sent %.1f queries per second over the last %v, more than AbuseThresholdQPS; refusing its queries for %v",
+				prefix, qps, cs.window, cs.banDuration)
+			return false
+		}
+	}
+
+	return true
+}
+
+// Counts the response code of an answer to prefix.
+func (cs *clientStats) record(prefix string, rcode int) {
+	if rcode != dns.RcodeServerFailure && rcode != dns.RcodeNameError {
+		return
+	}
+
+	n := cs.bucket(cs.clock.Now())
+
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	ps, ok := cs.prefixes[prefix]
+	if !ok {
+		return
+	}
+
+	c := ps.current(n)
+	if rcode == dns.RcodeServerFailure {
+		c.servFail++
+	} else {
+		c.nxDomain++
+	}
+}
+
+// Makes room for new prefixes. Called with mu held.
+func (cs *clientStats) evict(now time.Time, n int64) {
+	type candidate struct {
+		prefix  string
+		queries uint64
+	}
+
+	var candidates []candidate
+	for prefix, ps := range cs.prefixes {
+		if now.Before(ps.banned) {
+			continue
+		}
+
+		queries := ps.total(n).queries
+		if queries == 0 {
+			delete(cs.prefixes, prefix)
+			cs.evicted++
+			continue
+		}
+		candidates = append(candidates, candidate{prefix, queries})
+	}
+
+	// Free a good part of the space at once, so that this isn't done again
+	// for each new prefix.
+	if len(cs.prefixes) <= cs.max*3/4 {
+		return
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].queries < candidates[j].queries
+	})
+	for _, c := range candidates[:(len(candidates)+1)/2] {
+		delete(cs.prefixes, c.prefix)
+		cs.evicted++
+	}
+}
+
+type clientPrefixInfo struct {
+	Prefix        string     `json:"prefix"`
+	Queries       uint64     `json:"queries"`
+	QPS           float64    `json:"qps"`
+	ServFailRatio float64    `json:"servfail_ratio"`
+	NXDomainRatio float64    `json:"nxdomain_ratio"`
+	BannedUntil   *time.Time `json:"banned_until,omitempty"`
+}
+
+type clientStatsInfo struct {
+	WindowSeconds int                `json:"window_seconds"`
+	Tracked       int                `json:"tracked_prefixes"`
+	Evicted       uint64             `json:"evicted_prefixes"`
+	TotalBans     uint64             `json:"total_bans"`
+	Top           []clientPrefixInfo `json:"top"`
+	Banned        []clientPrefixInfo `json:"banned"`
+}
+
+// Returns the limit prefixes sending the most queries over the window, and
+// all of those banned.
+func (cs *clientStats) Status(limit int) clientStatsInfo {
+	now := cs.clock.Now()
+	n := cs.bucket(now)
+
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	info := clientStatsInfo{
+		WindowSeconds: int(cs.window / time.Second),
+		Tracked:       len(cs.prefixes),
+		Evicted:       cs.evicted,
+		TotalBans:     cs.bans,
+		Top:           []clientPrefixInfo{},
+		Banned:        []clientPrefixInfo{},
+	}
+
+	for prefix, ps := range cs.prefixes {
+		c := ps.total(n)
+		pi := clientPrefixInfo{
+			Prefix:  prefix,
+			Queries: c.queries,
+			QPS:     float64(c.queries) / cs.window.Seconds(),
+		}
+		if c.queries > 0 {
+			pi.ServFailRatio = float64(c.servFail) / float64(c.queries)
+			pi.NXDomainRatio = float64(c.nxDomain) / float64(c.queries)
+		}
+		if now.Before(ps.banned) {
+			banned := ps.banned
+			pi.BannedUntil = &banned
+			info.Banned = append(info.Banned, pi)
+		}
+		if c.queries > 0 {
+			info.Top = append(info.Top, pi)
+		}
+	}
+
+	sort.Slice(info.Top, func(i, j int) bool {
+		if info.Top[i].Queries != info.Top[j].Queries {
+			return info.Top[i].Queries > info.Top[j].Queries
+		}
+		return info.Top[i].Prefix < info.Top[j].Prefix
+	})
+	if len(info.Top) > limit {
+		info.Top = info.Top[:limit]
+	}
+	sort.Slice(info.Banned, func(i, j int) bool {
+		return info.Banned[i].BannedUntil.Before(*info.Banned[j].BannedUntil)
+	})
+
+	return info
+}
+
+// Counts a query, refusing it if its client's prefix is banned. Returns the
+// writer through which to answer it, or nil if it has been refused.
+func (s *Server) admitClient(rw dns.ResponseWriter, req *dns.Msg) dns.ResponseWriter {
+	if s.clientStats == nil {
+		return rw
+	}
+
+	prefix := clientPrefix(clientIP(rw))
+	if prefix == "" {
+		return rw
+	}
+
+	if !s.clientStats.admit(prefix) {
+		m := new(dns.Msg)
+		m.SetRcode(req, dns.RcodeRefused)
+		if opt := req.IsEdns0(); opt != nil {
+			m.SetEdns0(s.ednsUDPSize(), false)
+			m.IsEdns0().Option = append(m.IsEdns0().Option, &dns.EDNS0_EDE{
+				InfoCode:  dns.ExtendedErrorCodeProhibited,
+				ExtraText: "too many queries from your network",
+			})
+		}
+		rw.WriteMsg(m)
+		return nil
+	}
+
+	return &clientStatsWriter{ResponseWriter: rw, cs: s.clientStats, prefix: prefix}
+}
+
+type clientStatsWriter struct {
+	dns.ResponseWriter
+	cs     *clientStats
+	prefix string
+}
+
+func (rw *clientStatsWriter) WriteMsg(m *dns.Msg) error {
+	rw.cs.record(rw.prefix, m.Rcode)
+	return rw.ResponseWriter.WriteMsg(m)
+}
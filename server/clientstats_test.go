@@ -0,0 +1,171 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/namecoin/ncdns/testutil"
+)
+
+func TestClientPrefix(t *testing.T) {
+	for _, test := range []struct {
+		ip, prefix string
+	}{
+		{"192.0.2.123", "192.0.2.0/24"},
+		{"::ffff:192.0.2.123", "192.0.2.0/24"},
+		{"2001:db8:1234:5678::1", "2001:db8:1234::/48"},
+	} {
+		if p := clientPrefix(net.ParseIP(test.ip)); p != test.prefix {
+			t.Errorf("%s: got prefix %q, expected %q", test.ip, p, test.prefix)
+		}
+	}
+
+	if p := clientPrefix(nil); p != "" {
+		t.Errorf("got prefix %q for no address", p)
+	}
+}
+
+func TestClientStatsDecay(t *testing.T) {
+	clock := testutil.NewFakeClock(time.Unix(1700000000, 0))
+	cs := newClientStats(100, 10*time.Second, 0, 0, clock)
+
+	for i := 0; i < 10; i++ {
+		cs.admit("192.0.2.0/24")
+		cs.record("192.0.2.0/24", dns.RcodeNameError)
+		clock.Advance(time.Second)
+	}
+	cs.record("192.0.2.0/24", dns.RcodeServerFailure)
+
+	// The oldest query has just left the window.
+	st := cs.Status(10)
+	if len(st.Top) != 1 || st.Top[0].Queries != 9 || st.Top[0].QPS != 0.9 {
+		t.Fatalf("unexpected counts %+v", st.Top)
+	}
+	if r := st.Top[0].NXDomainRatio; r != 1 {
+		t.Errorf("unexpected NXDOMAIN ratio %v", r)
+	}
+	if r := st.Top[0].ServFailRatio; r < 0.1 || r > 0.12 {
+		t.Errorf("unexpected SERVFAIL ratio %v", r)
+	}
+
+	clock.Advance(10 * time.Second)
+	if st := cs.Status(10); len(st.Top) != 0 || st.Tracked != 1 {
+		t.Errorf("queries didn't decay: %+v", st)
+	}
+
+	// A prefix with no queries in the window is forgotten first. That frees
+	// too little room, so the least active half of the others go too.
+	for i := 0; i < 99; i++ {
+		cs.admit(fmt.Sprintf("198.51.%d.0/24", i))
+	}
+	cs.admit("203.0.113.0/24")
+	if _, ok := cs.prefixes["192.0.2.0/24"]; ok {
+		t.Errorf("idle prefix kept")
+	}
+	if _, ok := cs.prefixes["203.0.113.0/24"]; !ok || len(cs.prefixes) != 50 {
+		t.Errorf("tracking %d prefixes, expected 50 including the new one", len(cs.prefixes))
+	}
+}
+
+func TestClientStatsFlood(t *testing.T) {
+	clock := testutil.NewFakeClock(time.Unix(1700000000, 0))
+	cs := newClientStats(1000, time.Minute, 0, 0, clock)
+
+	// A flood of a million queries from spoofed prefixes, each sending one,
+	// among which a few real clients send more.
+	heavy := []string{"192.0.2.0/24", "2001:db8:1::/48", "2001:db8:2::/48"}
+	for i := 0; i < 1000000; i++ {
+		ip := net.IPv4(byte(i>>16), byte(i>>8), byte(i), 1)
+		cs.admit(clientPrefix(ip))
+		if i%100 == 0 {
+			cs.admit(heavy[(i/100)%len(heavy)])
+		}
+		if i%1000 == 0 {
+			clock.Advance(time.Millisecond)
+		}
+
+		if len(cs.prefixes) > 1000 {
+			t.Fatalf("tracking %d prefixes after %d queries", len(cs.prefixes), i)
+		}
+	}
+
+	st := cs.Status(len(heavy))
+	top := map[string]bool{}
+	for _, p := range st.Top {
+		top[p.Prefix] = true
+	}
+	for _, p := range heavy {
+		if !top[p] {
+			t.Errorf("%s not among the top prefixes %+v", p, st.Top)
+		}
+	}
+	if st.Evicted == 0 {
+		t.Errorf("no prefixes evicted")
+	}
+}
+
+func TestClientStatsBan(t *testing.T) {
+	clock := testutil.NewFakeClock(time.Unix(1700000000, 0))
+	cs := newClientStats(10, 10*time.Second, 5, time.Minute, clock)
+
+	// 50 queries in the window are 5 per second: not over the threshold.
+	for i := 0; i < 50; i++ {
+		if !cs.admit("192.0.2.0/24") {
+			t.Fatalf("refused query %d", i)
+		}
+	}
+	if cs.admit("192.0.2.0/24") {
+		t.Fatalf("query over threshold not refused")
+	}
+	if !cs.admit("198.51.100.0/24") {
+		t.Errorf("other prefix refused")
+	}
+
+	// Banned prefixes are kept and listed, however many others arrive.
+	for i := 0; i < 100; i++ {
+		cs.admit(fmt.Sprintf("203.0.%d.0/24", i))
+	}
+	st := cs.Status(0)
+	if len(st.Banned) != 1 || st.Banned[0].Prefix != "192.0.2.0/24" || !st.Banned[0].BannedUntil.Equal(clock.Now().Add(time.Minute)) || st.TotalBans != 1 {
+		t.Errorf("unexpected bans %+v", st)
+	}
+	if len(st.Top) != 0 {
+		t.Errorf("limit ignored: %+v", st.Top)
+	}
+
+	clock.Advance(59 * time.Second)
+	if cs.admit("192.0.2.0/24") {
+		t.Errorf("query refused before ban expired")
+	}
+
+	clock.Advance(time.Second)
+	if !cs.admit("192.0.2.0/24") {
+		t.Errorf("query refused after ban expired")
+	}
+	if st := cs.Status(0); len(st.Banned) != 0 {
+		t.Errorf("expired ban listed: %+v", st.Banned)
+	}
+}
+
+func TestAdmitClient(t *testing.T) {
+	s := &Server{clientStats: newClientStats(10, time.Second, 1, time.Minute, nil)}
+	req := new(dns.Msg)
+	req.SetQuestion("example.bit.", dns.TypeA)
+	req.SetEdns0(4096, false)
+
+	frw := &fakeResponseWriter{addr: &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1234}}
+	if rw := s.admitClient(frw, req); rw == nil {
+		t.Fatalf("first query refused")
+	}
+	if rw := s.admitClient(frw, req); rw != nil {
+		t.Fatalf("query over threshold admitted")
+	}
+	if frw.msg == nil || frw.msg.Rcode != dns.RcodeRefused || frw.msg.IsEdns0() == nil {
+		t.Errorf("unexpected response %v", frw.msg)
+	}
+
+}
@@ -0,0 +1,186 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// An option superseded by another, which is still accepted: its value is
+// moved to the replacement when the server is set up, with a warning, and
+// "ncdns migrate-config" rewrites configuration files to use the
+// replacement. Deprecating an option is one entry in configMigrations.
+type configMigration struct {
+	Old, New string // flat option names; see configOptions
+
+	// Converts a value of Old to one of New. If nil, the value is kept as
+	// it is.
+	convert func(value string) (string, error)
+}
+
+var configMigrations = []configMigration{
+	{Old: "Bind", New: "BindAddresses"},
+	{Old: "NamecoinRPCAddress", New: "NamecoinRPCEndpoints"},
+}
+
+// A deprecated option found set, as reported in /status.
+type deprecatedOption struct {
+	Option      string `json:"option"`
+	Replacement string `json:"replacement"`
+}
+
+func (d deprecatedOption) String() string {
+	return fmt.Sprintf("%s is deprecated; use %s instead (see \"ncdns migrate-config\")", d.Option, d.Replacement)
+}
+
+// Moves the values of the deprecated options of cfg to their replacements,
+// logging a warning for each, and returns those set. The deprecated options
+// are left empty, so that a configuration has the same effect whichever
+// form it's given in.
+//
+// A deprecated option overrides its replacement at the replacement's
+// default; if both are set to different values, that's an error of class
+// ErrConfigInvalid.
+func (cfg *Config) migrateOptions() ([]deprecatedOption, error) {
+	var deprecated []deprecatedOption
+	v := reflect.ValueOf(cfg).Elem()
+	opts := configOptions()
+
+	for _, m := range configMigrations {
+		oldField := opts[strings.ToLower(m.Old)]
+		newField := opts[strings.ToLower(m.New)]
+		oldValue, newValue := v.FieldByIndex(oldField.Index), v.FieldByIndex(newField.Index)
+		if oldValue.String() == "" {
+			continue
+		}
+
+		value, err := m.convertValue(oldValue.String())
+		if err != nil {
+			return nil, configError("%s: %v", m.Old, err)
+		}
+		if newValue.String() != newField.Tag.Get("default") && newValue.String() != value {
+			return nil, configError("%s and %s are both set; remove %s, which is deprecated", m.Old, m.New, m.Old)
+		}
+
+		newValue.SetString(value)
+		oldValue.SetString("")
+		d := deprecatedOption{Option: m.Old, Replacement: m.New}
+		log.Warnf("%s", d)
+		deprecated = append(deprecated, d)
+	}
+
+	return deprecated, nil
+}
+
+func (m *configMigration) convertValue(value string) (string, error) {
+	if m.convert == nil {
+		return value, nil
+	}
+	return m.convert(value)
+}
+
+// MigrateConfigFile rewrites an ncdns configuration file so that it uses the
+// replacements of deprecated options, keeping its comments and layout, and
+// returns the rewritten file and the options replaced. Commented-out options,
+// as in the example configuration file, are renamed too, as are options in
+// sections, within their section. An option whose replacement is also set
+// is an error, as it would be when ncdns starts.
+func MigrateConfigFile(conf []byte) (migrated []byte, replaced []string, err error) {
+	migrations := map[string]*configMigration{}
+	for i := range configMigrations {
+		m := &configMigrations[i]
+		migrations[strings.ToLower(m.Old)] = m
+	}
+	paths := sectionOptions()
+	optionPaths := map[string]string{} // section.key paths, by option key
+	for path, key := range paths {
+		optionPaths[key] = path
+	}
+
+	// The section of each line, and the key of its option, if it's one, as
+	// in configOptions.
+	var lines, sections, keys []string
+	set := map[string]bool{}
+	section := ""
+	sc := bufio.NewScanner(bytes.NewReader(conf))
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if strings.HasPrefix(line, "[") {
+			section = strings.ToLower(strings.TrimSpace(strings.SplitN(line[1:], "]", 2)[0]))
+		}
+		key, _, ok := splitConfigLine(strings.TrimPrefix(line, "#"))
+		if ok && isOptionSection(section) {
+			key = paths[section+"."+key]
+		}
+		if ok && !strings.HasPrefix(line, "#") {
+			set[key] = true
+		}
+		lines = append(lines, sc.Text())
+		sections = append(sections, section)
+		keys = append(keys, key)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	var buf bytes.Buffer
+	for n, line := range lines {
+		key, value, ok := splitConfigLine(strings.TrimPrefix(strings.TrimSpace(line), "#"))
+		m := migrations[keys[n]]
+		if !ok || m == nil {
+			buf.WriteString(line + "\n")
+			continue
+		}
+
+		commented := strings.HasPrefix(strings.TrimSpace(line), "#")
+		newKey := strings.ToLower(m.New)
+		if section := sections[n]; isOptionSection(section) {
+			if !strings.HasPrefix(optionPaths[newKey], section+".") {
+				return nil, nil, fmt.Errorf("line %d: %s's replacement %s isn't in [%s]", n+1, m.Old, m.New, section)
+			}
+			newKey = strings.TrimPrefix(optionPaths[newKey], section+".")
+		}
+		if !commented && set[strings.ToLower(m.New)] {
+			return nil, nil, fmt.Errorf("line %d: %s and %s are both set; remove %s, which is deprecated", n+1, m.Old, m.New, m.Old)
+		}
+
+		if m.convert != nil {
+			s, err := strconv.Unquote(value)
+			if err != nil {
+				return nil, nil, fmt.Errorf("line %d: %s must be a quoted string", n+1, m.Old)
+			}
+			s, err = m.convert(s)
+			if err != nil {
+				return nil, nil, fmt.Errorf("line %d: %s: %v", n+1, m.Old, err)
+			}
+			value = strconv.Quote(s)
+		}
+
+		prefix := line[:strings.Index(strings.ToLower(line), key)]
+		buf.WriteString(prefix + newKey + "=" + value + "\n")
+		if !commented {
+			replaced = append(replaced, m.Old)
+		}
+	}
+
+	return buf.Bytes(), replaced, nil
+}
+
+// Splits a key=value line of a configuration file, returning the key in
+// lower case and the value as written. ok is false for other lines, such as
+// comments and section headers.
+func splitConfigLine(line string) (key, value string, ok bool) {
+	line = strings.TrimSpace(line)
+	i := strings.IndexByte(line, '=')
+	if i <= 0 || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "[") {
+		return "", "", false
+	}
+	key = strings.ToLower(strings.TrimSpace(line[:i]))
+	if strings.ContainsAny(key, " \t\"") {
+		return "", "", false
+	}
+	return key, strings.TrimSpace(line[i+1:]), true
+}
@@ -0,0 +1,223 @@
+package server
+
+import (
+	"errors"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// Each deprecated option is an option of its own, naming its replacement.
+func TestConfigMigrations(t *testing.T) {
+	opts := configOptions()
+	for _, m := range configMigrations {
+		old, ok := opts[strings.ToLower(m.Old)]
+		if !ok || old.Type.Kind() != reflect.String || old.Tag.Get("default") != "" {
+			t.Errorf("%s isn't a string option without a default", m.Old)
+		}
+		if usage := old.Tag.Get("usage"); usage != "Deprecated: use "+m.New {
+			t.Errorf("%s has usage %q", m.Old, usage)
+		}
+		if f, ok := opts[strings.ToLower(m.New)]; !ok || f.Type.Kind() != reflect.String {
+			t.Errorf("%s, replacing %s, isn't a string option", m.New, m.Old)
+		}
+	}
+}
+
+// Returns the configuration with the given options set over the defaults,
+// as by a configuration file, and migrated.
+func migratedConfig(t *testing.T, options map[string]string) (*Config, []deprecatedOption, error) {
+	cfg := defaultConfig(t)
+	for key, value := range options {
+		if err := cfg.setOption(key, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	deprecated, err := cfg.migrateOptions()
+	return cfg, deprecated, err
+}
+
+// A configuration has the same effect whether given with the deprecated
+// options or their replacements.
+func TestMigrateOptions(t *testing.T) {
+	for _, test := range []struct {
+		name       string
+		old, new   map[string]string
+		deprecated []string
+	}{
+		{
+			"bind",
+			map[string]string{"bind": "127.0.0.1:5353"},
+			map[string]string{"bindaddresses": "127.0.0.1:5353"},
+			[]string{"Bind"},
+		},
+		{
+			"namecoinrpcaddress",
+			map[string]string{"namecoinrpcaddress": "192.0.2.1:8336,alice:secret@192.0.2.2:8336"},
+			map[string]string{"namecoinrpcendpoints": "192.0.2.1:8336,alice:secret@192.0.2.2:8336"},
+			[]string{"NamecoinRPCAddress"},
+		},
+		{
+			"both",
+			map[string]string{"bind": ":5300", "namecoinrpcaddress": "namecoind:8336", "cachemaxentries": "300"},
+			map[string]string{"bindaddresses": ":5300", "namecoinrpcendpoints": "namecoind:8336", "cachemaxentries": "300"},
+			[]string{"Bind", "NamecoinRPCAddress"},
+		},
+		{
+			"old and new the same",
+			map[string]string{"bind": ":5300", "bindaddresses": ":5300"},
+			map[string]string{"bindaddresses": ":5300"},
+			[]string{"Bind"},
+		},
+		{
+			"new only",
+			map[string]string{"bindaddresses": ":5300"},
+			map[string]string{"bindaddresses": ":5300"},
+			nil,
+		},
+		{
+			"defaults",
+			nil,
+			nil,
+			nil,
+		},
+	} {
+		oldCfg, deprecated, err := migratedConfig(t, test.old)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		newCfg, newDeprecated, err := migratedConfig(t, test.new)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(oldCfg, newCfg) {
+			t.Errorf("%s: got configuration\n%+v\nexpected\n%+v", test.name, oldCfg, newCfg)
+		}
+		var got []string
+		for _, d := range deprecated {
+			got = append(got, d.Option)
+		}
+		if !reflect.DeepEqual(got, test.deprecated) || len(newDeprecated) != 0 {
+			t.Errorf("%s: got deprecated options %v and %v", test.name, got, newDeprecated)
+		}
+	}
+}
+
+// The deprecated options may also be given in the environment.
+func TestMigrateOptionsEnv(t *testing.T) {
+	cfg := defaultConfig(t)
+	if err := cfg.ApplyEnv([]string{"NCDNS_BIND=:5300"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cfg.migrateOptions(); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.BindAddresses != ":5300" || cfg.Bind != "" {
+		t.Errorf("got BindAddresses %q and Bind %q", cfg.BindAddresses, cfg.Bind)
+	}
+}
+
+func TestMigrateOptionsConflict(t *testing.T) {
+	_, _, err := migratedConfig(t, map[string]string{"bind": ":5300", "bindaddresses": ":5301"})
+	if !errors.Is(err, ErrConfigInvalid) || !strings.Contains(err.Error(), "Bind and BindAddresses") {
+		t.Errorf("got %v, expected an invalid configuration naming both options", err)
+	}
+}
+
+const oldConfigFile = `[ncdns]
+### The interface to bind to.
+bind=":5300"
+#bind="127.0.0.1:53"
+
+  NamecoinRPCAddress = "192.0.2.1:8336"
+namecoinrpcusername="user"
+cachemaxentries=300
+`
+
+const migratedConfigFile = `[ncdns]
+### The interface to bind to.
+bindaddresses=":5300"
+#bindaddresses="127.0.0.1:53"
+
+  namecoinrpcendpoints="192.0.2.1:8336"
+namecoinrpcusername="user"
+cachemaxentries=300
+`
+
+// Parses the key=value lines of a configuration file, far enough for the
+// files above.
+func parseTestConfigFile(t *testing.T, conf string) map[string]string {
+	options := map[string]string{}
+	for _, line := range strings.Split(conf, "\n") {
+		key, value, ok := splitConfigLine(line)
+		if !ok {
+			continue
+		}
+		if s, err := strconv.Unquote(value); err == nil {
+			value = s
+		}
+		options[key] = value
+	}
+	return options
+}
+
+func TestMigrateConfigFile(t *testing.T) {
+	migrated, replaced, err := MigrateConfigFile([]byte(oldConfigFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(migrated) != migratedConfigFile {
+		t.Errorf("got file\n%s", migrated)
+	}
+	if strings.Join(replaced, ",") != "Bind,NamecoinRPCAddress" {
+		t.Errorf("got replaced options %v", replaced)
+	}
+
+	// The rewritten file has the same effect, without deprecated options.
+	oldCfg, _, err := migratedConfig(t, parseTestConfigFile(t, oldConfigFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	newCfg, deprecated, err := migratedConfig(t, parseTestConfigFile(t, string(migrated)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(oldCfg, newCfg) || len(deprecated) != 0 {
+		t.Errorf("got configuration\n%+v\nexpected\n%+v", newCfg, oldCfg)
+	}
+
+	// Rewriting it again changes nothing.
+	again, replaced, err := MigrateConfigFile(migrated)
+	if err != nil || string(again) != string(migrated) || len(replaced) != 0 {
+		t.Errorf("rewrote the rewritten file to\n%s", again)
+	}
+
+	_, _, err = MigrateConfigFile([]byte("bind=\":5300\"\nbindaddresses=\":5301\"\n"))
+	if err == nil || !strings.Contains(err.Error(), "line 1") {
+		t.Errorf("got %v, expected an error for line 1", err)
+	}
+}
+
+// Deprecated options in sections are replaced within their section.
+func TestMigrateConfigFileSections(t *testing.T) {
+	conf := "[ncdns]\nbind=\":5300\"\n\n[rpc]\n#address=\"127.0.0.1:8336\"\naddress = \"192.0.2.1:8336\"\nusername=\"user\"\n"
+	migrated, replaced, err := MigrateConfigFile([]byte(conf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "[ncdns]\nbindaddresses=\":5300\"\n\n[rpc]\n#endpoints=\"127.0.0.1:8336\"\nendpoints=\"192.0.2.1:8336\"\nusername=\"user\"\n"
+	if string(migrated) != expected || strings.Join(replaced, ",") != "Bind,NamecoinRPCAddress" {
+		t.Errorf("got file\n%s\nreplacing %v", migrated, replaced)
+	}
+
+	// A deprecated option in a section conflicts with its replacement by
+	// its flat name.
+	_, _, err = MigrateConfigFile([]byte("[ncdns]\nnamecoinrpcendpoints=\"a:8336\"\n[rpc]\naddress=\"b:8336\"\n"))
+	if err == nil || !strings.Contains(err.Error(), "line 4") {
+		t.Errorf("got %v, expected an error for line 4", err)
+	}
+}
@@ -0,0 +1,307 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// The options of Config which are grouped in sections of the configuration
+// file are the fields of the section fields of Config, those with a section
+// tag naming the section, e.g. Config.RPC for [rpc]. Their keys within the
+// section are their lower-cased field names, e.g. endpoints in [rpc] for
+// RPC.Endpoints.
+//
+// Before there were sections, every option was given in the [ncdns] section,
+// and they still can be, by their flat names: the field name, unless the
+// field has a flat tag giving another, e.g. NamecoinRPCEndpoints for
+// RPC.Endpoints. Flags and the environment name them the same way, and
+// configOptions returns them by their flat names, so that code dealing with
+// options in general, such as Reload, needn't know about sections.
+
+// The options of the [dnssec] section: the keys with which the zone is signed,
+// and how they're kept.
+type DNSSECConfig struct {
+	PublicKey            string `default:"" usage:"Path to the DNSKEY KSK public key file"`
+	PrivateKey           string `default:"" usage:"Path to the KSK's corresponding private key file"`
+	ZonePublicKey        string `default:"" usage:"Path to the DNSKEY ZSK public key file; if one is not specified, one is generated in KeyStateDir, or a temporary one is generated on startup and used only for the duration of that process"`
+	ZonePrivateKey       string `default:"" usage:"Path to the ZSK's corresponding private key file"`
+	SuffixKeys           string `default:"" usage:"Comma-separated list of per-suffix keys, each either suffix=publickey|privatekey|zonepublickey|zoneprivatekey or suffix=auto to generate temporary keys; other suffixes use the keys above"`
+	KeyDir               string `default:"" usage:"Directory in which the keys of suffixes with SuffixKeys auto are saved when first generated, and loaded from on later starts, e.g. a container volume (default: they last only for the lifetime of the process)"`
+	SetupMode            bool   `flat:"Setup" default:"false" usage:"Start in setup mode: answer only the SOA, NS and DNSKEY records at the zone apexes, refusing other queries, while the DS records and trust anchors of the KSKs are logged and served at /api/v1/setup, until the setup is confirmed by creating setup-confirmed in KeyDir or with a POST to /api/v1/setup/confirm with a JSON body; a restart resumes the setup with the keys saved in KeyDir"`
+	KeyStateDir          string `default:"" usage:"Directory in which the ZSK is generated if ZonePublicKey isn't set, and rolled over every ZSKLifetime, along with the state of the rollover (default: a temporary ZSK is used)"`
+	ZSKLifetime          int    `default:"7776000" usage:"Time (in seconds) for which each ZSK generated in KeyStateDir signs before it's rolled over (0: never)"`
+	ZSKPrePublish        int    `default:"604800" usage:"Time (in seconds) for which the successor of a ZSK generated in KeyStateDir is published before it starts signing; at least the TTL of the DNSKEY records, 86400"`
+	DSRecordsFile        string `default:"ds-records.txt" usage:"Path to a file to which the DS records of the KSK, with SHA-256 and SHA-384 digests, are written at startup and whenever the keys change, for setting up the chain of trust from the parent zone (empty: not written)"`
+	StrictKeyPermissions bool   `default:"false" usage:"Refuse to start if a private key file is readable by other users, rather than warning"`
+}
+
+// The options of the [rpc] section: how namecoind is reached.
+type RPCConfig struct {
+	Network        string `flat:"NamecoinNetwork" default:"mainnet" usage:"Namecoin network to resolve names from: mainnet, testnet or regtest; sets the defaults of NamecoinRPCEndpoints and NamecoinRPCCookiePath"`
+	Username       string `flat:"NamecoinRPCUsername" default:"" usage:"Namecoin RPC username"`
+	Password       string `flat:"NamecoinRPCPassword" default:"" usage:"Namecoin RPC password"`
+	Endpoints      string `flat:"NamecoinRPCEndpoints" default:"" usage:"Comma-separated list of Namecoin RPC server addresses to fail over between in order of preference, each optionally as user:password@host:port (default: 127.0.0.1 at the network's RPC port, 8336 for mainnet, 18336 for testnet or 18443 for regtest)"`
+	Address        string `flat:"NamecoinRPCAddress" default:"" usage:"Deprecated: use NamecoinRPCEndpoints"`
+	CookiePath     string `flat:"NamecoinRPCCookiePath" default:"" usage:"Namecoin RPC cookie path, or a comma-separated list with one for each address (used if password is unspecified; default: the network's cookie in Namecoin Core's data directory, e.g. ~/.namecoin/testnet3/.cookie, if username is unspecified too)"`
+	TLS            bool   `flat:"NamecoinRPCTLS" default:"false" usage:"Connect to the Namecoin RPC server over TLS, e.g. to a remote namecoind behind a TLS proxy"`
+	TLSCAFile      string `flat:"NamecoinRPCTLSCAFile" default:"" usage:"Path to a PEM file of the CA certificates trusted to issue the Namecoin RPC server's TLS certificate (default: the system's)"`
+	TLSPinSPKI     string `flat:"NamecoinRPCTLSPinSPKI" default:"" usage:"Comma-separated list of base64 SHA-256 hashes of SubjectPublicKeyInfo, one of which the Namecoin RPC server's TLS certificate must match"`
+	TLSPinOnly     bool   `flat:"NamecoinRPCTLSPinOnly" default:"false" usage:"Check the Namecoin RPC server's TLS certificate only against NamecoinRPCTLSPinSPKI, not against CAs, e.g. for a self-signed certificate"`
+	TLSServerName  string `flat:"NamecoinRPCTLSServerName" default:"" usage:"Name the Namecoin RPC server's TLS certificate must be issued for, e.g. that of a self-signed certificate (default: the host of NamecoinRPCEndpoints)"`
+	TLSClientCert  string `flat:"NamecoinRPCTLSClientCert" default:"" usage:"Path to a PEM client certificate chain presented to the Namecoin RPC server over TLS, if it requires one"`
+	TLSClientKey   string `flat:"NamecoinRPCTLSClientKey" default:"" usage:"Path to the PEM private key of NamecoinRPCTLSClientCert"`
+	Proxy          string `flat:"NamecoinRPCProxy" default:"" usage:"SOCKS5 proxy to connect to the Namecoin RPC server through, as socks5://host:port, e.g. Tor's socks5://127.0.0.1:9050 to reach namecoind at a .onion address; the host of NamecoinRPCEndpoints is resolved by the proxy, never locally (default: connect directly)"`
+	ProxyIsolation bool   `flat:"NamecoinRPCProxyIsolation" default:"true" usage:"Authenticate to NamecoinRPCProxy with a random username and password for each connection, so that Tor builds a separate circuit for each"`
+	Timeout        int    `flat:"NamecoinRPCTimeout" default:"1500" usage:"Timeout (in milliseconds) for Namecoin RPC requests; with several addresses, each gets an equal share before failing over"`
+	MaxValueSize   int    `flat:"NamecoinMaxValueSize" default:"2080" usage:"Maximum size (in bytes) of name values accepted from Namecoin RPC; larger values are rejected (must be at least the consensus limit of 520)"`
+	ZMQAddress     string `flat:"NamecoinZMQAddress" default:"" usage:"Address at which namecoind announces new blocks over ZeroMQ, as given to its -zmqpubhashblock option (e.g. tcp://127.0.0.1:28332), so that HTTPEvents and FlushCacheOnBlock notice them at once; BlockPollInterval polling carries on as a fallback (default: polling only)"`
+}
+
+// The options of the [http] section: the webserver.
+type HTTPConfig struct {
+	ListenAddr          string `flat:"HTTPListenAddr" default:"" usage:"Address for webserver to listen at, or unix:PATH to listen on a Unix socket, e.g. for fronting it with nginx (default: disabled)"`
+	TLSCert             string `flat:"HTTPTLSCert" default:"" usage:"Path to the PEM certificate chain with which the webserver serves HTTPS rather than HTTP, reloaded every TLSCertReloadInterval if it changes (default: HTTP)"`
+	TLSKey              string `flat:"HTTPTLSKey" default:"" usage:"Path to the PEM private key of HTTPTLSCert"`
+	ProbesOnly          bool   `flat:"HTTPProbesOnly" default:"false" usage:"Serve only /healthz, /readyz and /statusz from the webserver, for orchestration, without the templates of its site or its other pages"`
+	Redirects           bool   `flat:"HTTPRedirects" default:"false" usage:"Redirect webserver requests whose Host is a name under CanonicalSuffix to the URL in the name's redirect field, if any"`
+	RedirectPermanent   bool   `flat:"HTTPRedirectPermanent" default:"false" usage:"Use 301 rather than 302 responses for HTTPRedirects"`
+	ZoneDump            bool   `flat:"HTTPZoneDump" default:"false" usage:"Serve a dump of the whole zone from the webserver at /api/v1/zone, a page at a time with ?after=NAME&limit=N"`
+	ZoneDumpTimeout     int    `flat:"HTTPZoneDumpTimeout" default:"300" usage:"Time (in seconds) after which a zone dump over HTTP is cut short, with a trailer saying where to carry on from (0: no limit)"`
+	TemplateTimeout     int    `flat:"HTTPTemplateTimeout" default:"5" usage:"Time (in seconds) after which rendering a webserver page from its template, e.g. one in TplPath, is abandoned, answering with a 500 error (0: no limit)"`
+	Events              bool   `flat:"HTTPEvents" default:"false" usage:"Stream events affecting the zone (new blocks, changes to EventWatchNames, name cache flushes, the webserver's circuit breaker opening and closing, and problems with the values of names served) from the webserver at /api/v1/events as server-sent events, optionally filtered with ?types=block,name,cache,degraded,problem"`
+	TraceMaxValueBytes  int    `flat:"HTTPTraceMaxValueBytes" default:"4096" usage:"Number of bytes of each name value shown in the traces of /api/v1/trace/ and /api/v1/lookup?trace=1, beyond which it's truncated (0: no limit)"`
+	LookupRatePerSecond int    `flat:"HTTPLookupRatePerSecond" default:"10" usage:"Maximum rate (in lookups per second) of lookups through /api/v1/lookup/ from the same client network (/24 for IPv4, /56 for IPv6); those over it are answered with 429 (0: no limit)"`
+}
+
+// The options of the [cache] section: the name caches.
+type CacheConfig struct {
+	MaxEntries         int    `flat:"CacheMaxEntries" default:"100" usage:"Maximum name cache entries"`
+	MaxBytes           int    `flat:"CacheMaxBytes" default:"0" usage:"Maximum approximate memory (in bytes) used by the name cache (0: no limit)"`
+	IdleEviction       int    `flat:"CacheIdleEviction" default:"86400" usage:"Time (in seconds) after which name cache entries which haven't been used are evicted, however much room is left in the cache (0: never)"`
+	PersistPath        string `flat:"CachePersistPath" default:"" usage:"File (relative to the configuration file) in which the name cache is saved every CachePersistInterval and on stopping, and from which it's loaded on starting, unless namecoind's best block has changed since (default: the cache starts empty)"`
+	PersistInterval    int    `flat:"CachePersistInterval" default:"300" usage:"Time (in seconds) between saves of the name cache to CachePersistPath (0: only on stopping)"`
+	NegativeMaxEntries int    `flat:"NegativeCacheMaxEntries" default:"1000" usage:"Maximum number of names which namecoind said don't exist remembered, so that queries for them are answered NXDOMAIN without asking again (0: disabled); failures to ask namecoind aren't remembered"`
+	NegativeTTL        int    `flat:"NegativeCacheTTL" default:"300" usage:"Time (in seconds) for which a name is remembered not to exist, unless a new block is noticed sooner (see FlushCacheOnBlock and HTTPEvents)"`
+	StaleTTL           int    `flat:"StaleAnswerTTL" default:"3600" usage:"Time (in seconds) for which names emptied from the name cache at a new block (see FlushCacheOnBlock) are kept, so that while namecoind can't be reached they're answered as they were, with a TTL of 30 seconds, rather than with SERVFAIL; names namecoind says don't exist never are (0: disabled)"`
+}
+
+// Returns the options of the section field f of Config, named by their flat
+// names, with the Index of their path through Config.
+func sectionFields(f reflect.StructField) []reflect.StructField {
+	var fields []reflect.StructField
+	for i := 0; i < f.Type.NumField(); i++ {
+		sf := f.Type.Field(i)
+		if sf.PkgPath != "" || sf.Tag.Get("usage") == "" {
+			continue
+		}
+		if flat := sf.Tag.Get("flat"); flat != "" {
+			sf.Name = flat
+		}
+		sf.Index = append(append([]int{}, f.Index...), sf.Index...)
+		fields = append(fields, sf)
+	}
+	return fields
+}
+
+// Returns the keys of the options of the sections of the configuration file,
+// as section.key paths (e.g. rpc.endpoints), mapped to the keys of the same
+// options in configOptions (e.g. namecoinrpcendpoints).
+func sectionOptions() map[string]string {
+	paths := map[string]string{}
+	t := reflect.TypeOf(Config{})
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		section := f.Tag.Get("section")
+		if section == "" {
+			continue
+		}
+		for j := 0; j < f.Type.NumField(); j++ {
+			sf := f.Type.Field(j)
+			if sf.PkgPath != "" || sf.Tag.Get("usage") == "" {
+				continue
+			}
+			flat := sf.Tag.Get("flat")
+			if flat == "" {
+				flat = sf.Name
+			}
+			paths[section+"."+strings.ToLower(sf.Name)] = strings.ToLower(flat)
+		}
+	}
+	return paths
+}
+
+// Reports whether name is a section of options of the configuration file.
+func isOptionSection(name string) bool {
+	t := reflect.TypeOf(Config{})
+	for i := 0; i < t.NumField(); i++ {
+		if name != "" && t.Field(i).Tag.Get("section") == name {
+			return true
+		}
+	}
+	return false
+}
+
+// NewFlatConfig returns a pointer to a new struct with a field for each
+// option of Config, named by its flat name, for the configuration file
+// loader to read the [ncdns] section and flags into, as it did before there
+// were sections. SetFlat then copies the options into a Config, and
+// ApplyConfigFile adds those of the other sections.
+func NewFlatConfig() interface{} {
+	var fields []reflect.StructField
+	for _, f := range optionFields() {
+		fields = append(fields, reflect.StructField{Name: f.Name, Type: f.Type, Tag: f.Tag})
+	}
+	return reflect.New(reflect.StructOf(fields)).Interface()
+}
+
+// SetFlat sets the options of cfg to their values in flat, as returned by
+// NewFlatConfig.
+func (cfg *Config) SetFlat(flat interface{}) {
+	fv := reflect.ValueOf(flat).Elem()
+	v := reflect.ValueOf(cfg).Elem()
+	for _, f := range optionFields() {
+		v.FieldByIndex(f.Index).Set(fv.FieldByName(f.Name))
+	}
+}
+
+// ApplyConfigFile sets the options given in the sections of the
+// configuration file at path, such as endpoints in [rpc], once the options
+// of its [ncdns] section have been read, by their flat names, into cfg. If
+// path is "", there is no configuration file, and nothing is set.
+//
+// An option may be given by either name, but if it's given by both, with
+// different values, that's an error. As with ApplyEnv, options given in args,
+// the command line arguments, are left alone, since flags take precedence
+// over the file. Every problem with the sections, such as keys which aren't
+// options and values of the wrong type, is reported in the one error, each
+// by its line and section.key path. Errors are of class ErrConfigInvalid.
+func (cfg *Config) ApplyConfigFile(path string, args []string) error {
+	if path == "" {
+		return nil
+	}
+	conf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return configError("couldn't read configuration file: %v", err)
+	}
+	if problems := cfg.applyConfigSections(conf, args); len(problems) != 0 {
+		return configError("%s: %s", path, strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// Sets the options given in the sections of the configuration file conf, as
+// ApplyConfigFile does, and returns the problems found.
+func (cfg *Config) applyConfigSections(conf []byte, args []string) (problems []string) {
+	type sectionValue struct {
+		line             int
+		path, key, value string
+		problem          string
+	}
+	var values []sectionValue
+	flatValues := map[string]string{} // given in [ncdns], by key
+	paths := sectionOptions()
+
+	section := ""
+	sc := bufio.NewScanner(bytes.NewReader(conf))
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if strings.HasPrefix(line, "[") {
+			section = strings.ToLower(strings.TrimSpace(strings.SplitN(line[1:], "]", 2)[0]))
+			if section != "ncdns" && !isOptionSection(section) {
+				log.Warnf("ignoring section [%s] of the configuration file at line %d, which isn't a section of options", section, n)
+			}
+			continue
+		}
+
+		key, raw, ok := splitConfigLine(line)
+		if !ok {
+			continue
+		}
+		value, err := configValue(raw)
+		switch {
+		case section == "ncdns":
+			if err == nil {
+				flatValues[key] = value
+			}
+		case isOptionSection(section):
+			sv := sectionValue{line: n, path: section + "." + key, value: value}
+			sv.key = paths[sv.path]
+			if sv.key == "" {
+				sv.problem = fmt.Sprintf("%s isn't an option", sv.path)
+			} else if err != nil {
+				sv.problem = fmt.Sprintf("%s: %v", sv.path, err)
+			}
+			values = append(values, sv)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return []string{err.Error()}
+	}
+
+	opts := configOptions()
+	flags := flagKeys(args)
+	for _, sv := range values {
+		if sv.problem != "" {
+			problems = append(problems, fmt.Sprintf("line %d: %s", sv.line, sv.problem))
+			continue
+		}
+		f := opts[sv.key]
+		if flat, ok := flatValues[sv.key]; ok && flat != sv.value {
+			problems = append(problems, fmt.Sprintf("line %d: %s and %s are both set, to different values", sv.line, sv.path, f.Name))
+			continue
+		}
+		if flags[sv.key] {
+			continue
+		}
+		if err := setField(reflect.ValueOf(cfg).Elem().FieldByIndex(f.Index), sv.path, sv.value); err != nil {
+			problems = append(problems, fmt.Sprintf("line %d: %v", sv.line, err))
+		}
+	}
+	return problems
+}
+
+// Returns the value of a key=value line of a configuration file in the
+// string form setOption takes: the contents of a quoted string, or a number
+// or boolean as written, without any comment following it.
+func configValue(raw string) (string, error) {
+	var value, rest string
+	switch {
+	case strings.HasPrefix(raw, `"`):
+		end := 1
+		for end < len(raw) && raw[end] != '"' {
+			if raw[end] == '\\' {
+				end++
+			}
+			end++
+		}
+		if end >= len(raw) {
+			return "", fmt.Errorf("unterminated string")
+		}
+		s, err := strconv.Unquote(raw[:end+1])
+		if err != nil {
+			return "", fmt.Errorf("invalid string %s", raw[:end+1])
+		}
+		value, rest = s, raw[end+1:]
+	case strings.HasPrefix(raw, "'"):
+		end := strings.IndexByte(raw[1:], '\'')
+		if end < 0 {
+			return "", fmt.Errorf("unterminated string")
+		}
+		value, rest = raw[1:end+1], raw[end+2:]
+	default:
+		value = strings.TrimSpace(strings.SplitN(raw, "#", 2)[0])
+		if value == "" {
+			return "", fmt.Errorf("no value")
+		}
+	}
+
+	if rest = strings.TrimSpace(rest); rest != "" && !strings.HasPrefix(rest, "#") {
+		return "", fmt.Errorf("unexpected %q after the value", rest)
+	}
+	return value, nil
+}
@@ -0,0 +1,266 @@
+package server
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Loads a configuration file as ncdns does: the [ncdns] section and the
+// flags in args, given as -key=value, as the configuration file loader reads
+// them, then the other sections. Returns the configuration, migrated, and the
+// problems with the sections.
+func loadTestConfig(t *testing.T, conf string, args []string) (*Config, []string) {
+	cfg := defaultConfig(t)
+	section := ""
+	for _, line := range strings.Split(conf, "\n") {
+		if line = strings.TrimSpace(line); strings.HasPrefix(line, "[") {
+			section = strings.Trim(line, "[]")
+		}
+		key, raw, ok := splitConfigLine(line)
+		if !ok || section != "ncdns" {
+			continue
+		}
+		value, err := configValue(raw)
+		if err != nil {
+			t.Fatalf("%s: %v", key, err)
+		}
+		if err := cfg.setOption(key, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, arg := range args {
+		kv := strings.SplitN(strings.TrimLeft(arg, "-"), "=", 2)
+		if err := cfg.setOption(strings.ToLower(kv[0]), kv[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	problems := cfg.applyConfigSections([]byte(conf), args)
+	if _, err := cfg.migrateOptions(); err != nil {
+		t.Fatal(err)
+	}
+	return cfg, problems
+}
+
+func readTestConfig(t *testing.T, name string) string {
+	b, err := ioutil.ReadFile(filepath.Join("testdata/config", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+// Configuration files from before there were sections have the same effect
+// as their equivalents in sections.
+func TestConfigSectionsCompat(t *testing.T) {
+	flat, problems := loadTestConfig(t, readTestConfig(t, "remote-namecoind.conf"), nil)
+	if len(problems) != 0 {
+		t.Fatal(problems)
+	}
+	for _, test := range []struct {
+		name          string
+		got, expected interface{}
+	}{
+		{"deprecated", flat.BindAddresses, "0.0.0.0:53"},
+		{"deprecated in a section", flat.RPC.Endpoints, "rpc.example.onion:18336"},
+		{"renamed", flat.RPC.Network, "testnet"},
+		{"literal string", flat.RPC.Password, "secret#1"},
+		{"bool", flat.RPC.TLSPinOnly, true},
+		{"int with a comment", flat.RPC.Timeout, 5000},
+		{"default", flat.RPC.ProxyIsolation, true},
+		{"cache", flat.Cache.NegativeTTL, 60},
+		{"outside sections", flat.SelfName, "ns1.example.com."},
+	} {
+		if test.got != test.expected {
+			t.Errorf("%s: got %v, expected %v", test.name, test.got, test.expected)
+		}
+	}
+
+	for _, name := range []string{"remote-namecoind", "signing-webserver"} {
+		flat, problems := loadTestConfig(t, readTestConfig(t, name+".conf"), nil)
+		if len(problems) != 0 {
+			t.Errorf("%s: %v", name, problems)
+		}
+		sections, problems := loadTestConfig(t, readTestConfig(t, name+".sections.conf"), nil)
+		if len(problems) != 0 {
+			t.Errorf("%s in sections: %v", name, problems)
+		}
+		if !reflect.DeepEqual(flat, sections) {
+			t.Errorf("%s: got configuration\n%+v\nfrom sections, expected\n%+v", name, sections, flat)
+		}
+		if reflect.DeepEqual(flat, defaultConfig(t)) {
+			t.Errorf("%s: got the defaults", name)
+		}
+	}
+
+	// The example configuration file, whose options are all commented out.
+	b, err := ioutil.ReadFile("../_doc/ncdns.conf.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	example, problems := loadTestConfig(t, string(b), nil)
+	if len(problems) != 0 || !reflect.DeepEqual(example, defaultConfig(t)) {
+		t.Errorf("example configuration file: got %v and\n%+v", problems, example)
+	}
+}
+
+func TestConfigSectionsPrecedence(t *testing.T) {
+	conf := `[ncdns]
+cachemaxentries=300
+httpevents=true
+
+[rpc]
+username="fileuser"
+password="pass"
+
+[cache]
+maxentries=300
+
+[unknown]
+maxentries=5
+`
+	cfg, problems := loadTestConfig(t, conf, []string{"-namecoinrpcusername=flaguser"})
+	if len(problems) != 0 {
+		t.Fatal(problems)
+	}
+	for _, test := range []struct {
+		name          string
+		got, expected interface{}
+	}{
+		{"flag over section", cfg.RPC.Username, "flaguser"},
+		{"section", cfg.RPC.Password, "pass"},
+		{"section and [ncdns] the same", cfg.Cache.MaxEntries, 300},
+		{"[ncdns]", cfg.HTTP.Events, true},
+		{"default", cfg.HTTP.ZoneDumpTimeout, 300},
+	} {
+		if test.got != test.expected {
+			t.Errorf("%s: got %v, expected %v", test.name, test.got, test.expected)
+		}
+	}
+}
+
+// Every problem with the sections is reported, by its line and path.
+func TestConfigSectionsProblems(t *testing.T) {
+	conf := `[ncdns]
+cachemaxentries=300
+
+[rpc]
+nosuchoption="x"
+timeout="soon"
+username="unterminated
+
+[http]
+events=maybe
+listenaddr="127.0.0.1:8202" trailing
+
+[cache]
+maxentries=200
+`
+	_, problems := loadTestConfig(t, conf, nil)
+	expected := []string{
+		"line 5: rpc.nosuchoption isn't an option",
+		`line 6: rpc.timeout must be an integer, not "soon"`,
+		"line 7: rpc.username: unterminated string",
+		`line 10: http.events must be true or false, not "maybe"`,
+		`line 11: http.listenaddr: unexpected "trailing" after the value`,
+		"line 14: cache.maxentries and CacheMaxEntries are both set, to different values",
+	}
+	if !reflect.DeepEqual(problems, expected) {
+		t.Errorf("got problems\n%s\nexpected\n%s", strings.Join(problems, "\n"), strings.Join(expected, "\n"))
+	}
+
+	dir, err := ioutil.TempDir("", "ncdns-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "ncdns.conf")
+	if err := ioutil.WriteFile(path, []byte(conf), 0644); err != nil {
+		t.Fatal(err)
+	}
+	err = defaultConfig(t).ApplyConfigFile(path, nil)
+	if !errors.Is(err, ErrConfigInvalid) || !strings.Contains(err.Error(), path+": line 5: ") ||
+		!strings.Contains(err.Error(), "; line 14: ") {
+		t.Errorf("got %v, expected an invalid configuration with every problem", err)
+	}
+
+	if err := defaultConfig(t).ApplyConfigFile("", nil); err != nil {
+		t.Errorf("without a configuration file: %v", err)
+	}
+}
+
+func TestConfigValue(t *testing.T) {
+	for _, test := range []struct {
+		raw, value string
+		ok         bool
+	}{
+		{`"plain"`, "plain", true},
+		{`"escaped \"quote\" and \\ # not a comment" # comment`, `escaped "quote" and \ # not a comment`, true},
+		{`'C:\literal' # comment`, `C:\literal`, true},
+		{`""`, "", true},
+		{`42`, "42", true},
+		{`true#comment`, "true", true},
+		{`"unterminated`, "", false},
+		{`'unterminated`, "", false},
+		{`"one" "two"`, "", false},
+		{`# comment`, "", false},
+	} {
+		value, err := configValue(test.raw)
+		if (err == nil) != test.ok || value != test.value {
+			t.Errorf("%s: got %q, %v", test.raw, value, err)
+		}
+	}
+}
+
+// The flat configuration read by the configuration file loader has every
+// option, with its tags, and is copied into the sections of Config.
+func TestFlatConfig(t *testing.T) {
+	flat := NewFlatConfig()
+	v := reflect.ValueOf(flat).Elem()
+	opts := configOptions()
+	if v.NumField() != len(opts) {
+		t.Errorf("got %d fields for %d options", v.NumField(), len(opts))
+	}
+	for i := 0; i < v.NumField(); i++ {
+		f := v.Type().Field(i)
+		opt, ok := opts[strings.ToLower(f.Name)]
+		if !ok || f.Type != opt.Type || f.Tag.Get("default") != opt.Tag.Get("default") || f.Tag.Get("usage") != opt.Tag.Get("usage") {
+			t.Errorf("%s doesn't match its option", f.Name)
+		}
+	}
+
+	v.FieldByName("NamecoinRPCEndpoints").SetString("192.0.2.1:8336")
+	v.FieldByName("CacheMaxEntries").SetInt(300)
+	v.FieldByName("StrictKeyPermissions").SetBool(true)
+	v.FieldByName("HTTPEvents").SetBool(true)
+	v.FieldByName("BindAddresses").SetString(":5300")
+	cfg := &Config{}
+	cfg.SetFlat(flat)
+	if cfg.RPC.Endpoints != "192.0.2.1:8336" || cfg.Cache.MaxEntries != 300 || !cfg.DNSSEC.StrictKeyPermissions ||
+		!cfg.HTTP.Events || cfg.BindAddresses != ":5300" {
+		t.Errorf("got configuration %+v", cfg)
+	}
+}
+
+// Each option of a section has its own flat name, which no other option has.
+func TestSectionOptions(t *testing.T) {
+	opts := configOptions()
+	flatKeys := map[string]bool{}
+	for path, key := range sectionOptions() {
+		if _, ok := opts[key]; !ok {
+			t.Errorf("%s has flat key %q, which isn't an option", path, key)
+		}
+		if flatKeys[key] {
+			t.Errorf("%s has flat key %q, as another option does", path, key)
+		}
+		flatKeys[key] = true
+	}
+	if len(opts) != len(optionFields()) {
+		t.Errorf("got %d option keys for %d options", len(opts), len(optionFields()))
+	}
+}
@@ -0,0 +1,418 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/namecoin/ncdns/clock"
+)
+
+// The file in ConfigDir in which the server cookie secrets are kept, so that
+// cookies given out before a restart are still accepted after it.
+const cookieSecretFile = "cookie-secrets.json"
+
+// Server cookies are made as RFC 9018 lays them out: a version, three
+// reserved octets, a timestamp and an 8-octet hash, here an HMAC-SHA256 of
+// the client cookie, the version, reserved octets and timestamp, and the
+// client's address, truncated. A cookie is accepted for cookieMaxAge after
+// its timestamp, and up to cookieMaxSkew before it.
+const (
+	cookieVersion = 1
+	cookieMaxAge  = time.Hour
+	cookieMaxSkew = 5 * time.Minute
+
+	clientCookieLen = 8
+	serverCookieLen = 16
+)
+
+// How often the numbers of queries rejected, or which would have been
+// rejected, for want of a valid server cookie are logged, if there were any.
+const cookieReportInterval = time.Minute
+
+// What a query's COOKIE option says about it.
+type cookieState int
+
+const (
+	cookieNone       cookieState = iota // no COOKIE option
+	cookieClientOnly                    // a client cookie alone, as in a client's first query
+	cookieValid                         // a server cookie ncdns made for this client
+	cookieInvalid                       // a server cookie ncdns didn't make, or which is too old
+	cookieMalformed                     // a COOKIE option of the wrong length
+)
+
+// DNS cookies (RFC 7873). Responses to queries with a client cookie carry a
+// server cookie made for that client, which it sends back in its next
+// queries, proving that it receives responses at its address. If enforce is
+// set, queries over UDP without a valid server cookie are answered BADCOOKIE
+// with a fresh one, or truncated if they carry no cookie at all, so that the
+// client retries over TCP; otherwise they're only counted. Queries with a
+// valid server cookie aren't rate limited. Queries over TCP are always
+// answered, since their source addresses can't be spoofed.
+//
+// The secret is replaced every lifetime, the one before it being accepted
+// until the next replacement, so that no cookie given out just before a
+// replacement is rejected.
+type cookies struct {
+	enforce  bool
+	lifetime time.Duration
+	path     string // where the secrets are saved, or "" if they aren't
+	clock    clock.Clock
+
+	mu       sync.RWMutex
+	current  []byte
+	previous []byte // nil if there was none
+	created  time.Time
+
+	counts cookieStatus // accessed atomically
+}
+
+type cookieStatus struct {
+	Valid      uint64 `json:"valid"`
+	ClientOnly uint64 `json:"client_only"`
+	Invalid    uint64 `json:"invalid"`
+	Missing    uint64 `json:"missing"`  // queries over UDP without a COOKIE option
+	Rejected   uint64 `json:"rejected"` // or would have been, if not enforced
+	Enforced   bool   `json:"enforced"`
+}
+
+// The secrets as saved in cookieSecretFile.
+type cookieSecrets struct {
+	Current  string    `json:"current"`
+	Previous string    `json:"previous,omitempty"`
+	Created  time.Time `json:"created"`
+}
+
+func (s *Server) setupCookies() error {
+	if s.cfg.CookieSecretLifetime == 0 {
+		if s.cfg.CookieEnforce {
+			return configError("CookieEnforce requires a CookieSecretLifetime")
+		}
+		return nil
+	}
+	if s.cfg.CookieSecretLifetime < 0 {
+		return configError("CookieSecretLifetime must not be negative")
+	}
+
+	c := &cookies{
+		enforce:  s.cfg.CookieEnforce,
+		lifetime: time.Duration(s.cfg.CookieSecretLifetime) * time.Second,
+		clock:    clock.Or(s.clock),
+	}
+	// A Config made in code has no ConfigDir to keep the secrets in.
+	if s.cfg.ConfigDir != "" {
+		c.path = s.cfg.cpath(cookieSecretFile)
+	}
+	if err := c.load(); err != nil {
+		return err
+	}
+	if c.current == nil || c.clock.Now().Sub(c.created) >= c.lifetime {
+		if err := c.rotate(); err != nil {
+			return err
+		}
+	}
+	s.cookies = c
+	return nil
+}
+
+// Loads the secrets from path, if it exists.
+func (c *cookies) load() error {
+	if c.path == "" {
+		return nil
+	}
+	b, err := ioutil.ReadFile(c.path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var secrets cookieSecrets
+	if err := json.Unmarshal(b, &secrets); err != nil {
+		return fmt.Errorf("couldn't parse cookie secret file %s: %v", c.path, err)
+	}
+	current, err := hex.DecodeString(secrets.Current)
+	if err != nil || len(current) == 0 {
+		return fmt.Errorf("cookie secret file %s has no valid current secret", c.path)
+	}
+	previous, err := hex.DecodeString(secrets.Previous)
+	if err != nil {
+		return fmt.Errorf("cookie secret file %s has an invalid previous secret", c.path)
+	}
+
+	c.current, c.created = current, secrets.Created
+	if len(previous) > 0 {
+		c.previous = previous
+	}
+	return nil
+}
+
+// Replaces the secret with a new one, keeping the current one as the
+// previous, and saves them. A failure to save them is only logged, since
+// cookies still work until the next restart.
+func (c *cookies) rotate() error {
+	secret := make([]byte, 16)
+	if _, err := rand.Read(secret); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	c.previous, c.current, c.created = c.current, secret, c.clock.Now()
+	secrets := cookieSecrets{
+		Current:  hex.EncodeToString(c.current),
+		Previous: hex.EncodeToString(c.previous),
+		Created:  c.created,
+	}
+	c.mu.Unlock()
+
+	if c.path == "" {
+		return nil
+	}
+	b, err := json.MarshalIndent(&secrets, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(c.path+".tmp", append(b, '\n'), 0600)
+	if err == nil {
+		err = os.Rename(c.path+".tmp", c.path)
+	}
+	log.Warne(err, "couldn't save the DNS cookie secrets; cookies given out will be rejected after a restart")
+	return nil
+}
+
+// Replaces the secret every lifetime, and logs the numbers of queries
+// rejected for want of a valid cookie every cookieReportInterval.
+func (c *cookies) run() {
+	last, lastAt := c.Status(), c.clock.Now()
+	for {
+		c.mu.RLock()
+		next := c.created.Add(c.lifetime).Sub(c.clock.Now())
+		c.mu.RUnlock()
+		if report := lastAt.Add(cookieReportInterval).Sub(c.clock.Now()); report < next {
+			next = report
+		}
+		<-c.clock.NewTimer(next).C()
+
+		now := c.clock.Now()
+		c.mu.RLock()
+		due := now.Sub(c.created) >= c.lifetime
+		c.mu.RUnlock()
+		if due {
+			log.Errore(c.rotate(), "couldn't replace the DNS cookie secret")
+		}
+		if now.Sub(lastAt) < cookieReportInterval {
+			continue
+		}
+
+		cur := c.Status()
+		if n := cur.Rejected - last.Rejected; n > 0 {
+			missing := cur.Missing - last.Missing
+			if c.enforce {
+				log.Infof("DNS cookies: rejected %d queries over UDP in the last %v (%d without cookies, %d without a valid server cookie)", n, now.Sub(lastAt), missing, n-missing)
+			} else {
+				log.Infof("DNS cookies: %d queries over UDP in the last %v would have been rejected with CookieEnforce set (%d without cookies, %d without a valid server cookie)", n, now.Sub(lastAt), missing, n-missing)
+			}
+		}
+		last, lastAt = cur, now
+	}
+}
+
+func (c *cookies) Status() cookieStatus {
+	return cookieStatus{
+		Valid:      atomic.LoadUint64(&c.counts.Valid),
+		ClientOnly: atomic.LoadUint64(&c.counts.ClientOnly),
+		Invalid:    atomic.LoadUint64(&c.counts.Invalid),
+		Missing:    atomic.LoadUint64(&c.counts.Missing),
+		Rejected:   atomic.LoadUint64(&c.counts.Rejected),
+		Enforced:   c.enforce,
+	}
+}
+
+// Returns the COOKIE option of req, if any, split into the client cookie and
+// server cookie, as raw octets.
+func splitCookie(req *dns.Msg) (client, server []byte, state cookieState) {
+	opt := req.IsEdns0()
+	if opt == nil {
+		return nil, nil, cookieNone
+	}
+	for _, o := range opt.Option {
+		e, ok := o.(*dns.EDNS0_COOKIE)
+		if !ok {
+			continue
+		}
+		b, err := hex.DecodeString(e.Cookie)
+		switch {
+		case err != nil, len(b) < clientCookieLen,
+			len(b) > clientCookieLen && len(b) < clientCookieLen+8,
+			len(b) > clientCookieLen+32:
+			return nil, nil, cookieMalformed
+		case len(b) == clientCookieLen:
+			return b, nil, cookieClientOnly
+		default:
+			return b[:clientCookieLen], b[clientCookieLen:], cookieInvalid
+		}
+	}
+	return nil, nil, cookieNone
+}
+
+// Returns the server cookie for client at ip, made with secret at t.
+func serverCookie(secret, client []byte, ip net.IP, t time.Time) []byte {
+	b := make([]byte, serverCookieLen)
+	b[0] = cookieVersion
+	binary.BigEndian.PutUint32(b[4:8], uint32(t.Unix()))
+
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(client)
+	mac.Write(b[:8])
+	mac.Write(ip)
+	copy(b[8:], mac.Sum(nil))
+	return b
+}
+
+// Returns the state of req's cookie, checking any server cookie it has.
+func (c *cookies) check(req *dns.Msg, ip net.IP) (client []byte, state cookieState) {
+	client, server, state := splitCookie(req)
+	if state != cookieInvalid || len(server) != serverCookieLen || server[0] != cookieVersion {
+		return client, state
+	}
+
+	t := time.Unix(int64(binary.BigEndian.Uint32(server[4:8])), 0)
+	now := c.clock.Now()
+	if now.Sub(t) > cookieMaxAge || t.Sub(now) > cookieMaxSkew {
+		return client, cookieInvalid
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for _, secret := range [][]byte{c.current, c.previous} {
+		if secret != nil && hmac.Equal(serverCookie(secret, client, ip, t), server) {
+			return client, cookieValid
+		}
+	}
+	return client, cookieInvalid
+}
+
+// Returns the COOKIE option to send to the client at ip with the client
+// cookie client: the client cookie and a fresh server cookie.
+func (c *cookies) option(client []byte, ip net.IP) *dns.EDNS0_COOKIE {
+	c.mu.RLock()
+	server := serverCookie(c.current, client, ip, c.clock.Now())
+	c.mu.RUnlock()
+	return &dns.EDNS0_COOKIE{
+		Code:   dns.EDNS0COOKIE,
+		Cookie: hex.EncodeToString(client) + hex.EncodeToString(server),
+	}
+}
+
+// Returns whether req has a valid server cookie, so that its response needn't
+// be rate limited.
+func (s *Server) hasValidCookie(rw dns.ResponseWriter, req *dns.Msg) bool {
+	if s.cookies == nil {
+		return false
+	}
+	_, state := s.cookies.check(req, clientIP(rw))
+	return state == cookieValid
+}
+
+// Checks the cookie of req, counting it. Answers a query with a malformed
+// COOKIE option FORMERR, as RFC 7873 requires, and, if CookieEnforce is set,
+// one over UDP without a valid server cookie BADCOOKIE, or with an empty
+// truncated response if it has no cookie at all, rather than answering its
+// question. Returns false for any other query.
+func (s *Server) serveBadCookie(rw dns.ResponseWriter, req *dns.Msg) bool {
+	c := s.cookies
+	if c == nil {
+		return false
+	}
+
+	ip := clientIP(rw)
+	client, state := c.check(req, ip)
+	udp := s.transport(rw) == "udp"
+	switch state {
+	case cookieValid:
+		atomic.AddUint64(&c.counts.Valid, 1)
+	case cookieClientOnly:
+		atomic.AddUint64(&c.counts.ClientOnly, 1)
+	case cookieInvalid:
+		atomic.AddUint64(&c.counts.Invalid, 1)
+	case cookieNone:
+		if udp {
+			atomic.AddUint64(&c.counts.Missing, 1)
+		}
+	case cookieMalformed:
+		m := new(dns.Msg)
+		m.SetRcode(req, dns.RcodeFormatError)
+		m.SetEdns0(s.ednsUDPSize(), false)
+		rw.WriteMsg(m)
+		return true
+	}
+
+	if !udp || state == cookieValid {
+		return false
+	}
+	atomic.AddUint64(&c.counts.Rejected, 1)
+	if !c.enforce {
+		return false
+	}
+
+	m := new(dns.Msg)
+	if state == cookieNone {
+		m.SetReply(req)
+		m.Truncated = true
+		if req.IsEdns0() != nil {
+			m.SetEdns0(s.ednsUDPSize(), false)
+		}
+		rw.WriteMsg(m)
+		return true
+	}
+
+	m.SetRcode(req, dns.RcodeBadCookie)
+	m.SetEdns0(s.ednsUDPSize(), false)
+	opt := m.IsEdns0()
+	opt.Option = append(opt.Option, c.option(client, ip))
+	rw.WriteMsg(m)
+	return true
+}
+
+// Returns the COOKIE option to send in the response to req, or nil if req
+// has no client cookie.
+func (s *Server) cookieResponse(rw dns.ResponseWriter, req *dns.Msg) *dns.EDNS0_COOKIE {
+	if s.cookies == nil {
+		return nil
+	}
+	client, _, state := splitCookie(req)
+	if state == cookieNone || state == cookieMalformed {
+		return nil
+	}
+	return s.cookies.option(client, clientIP(rw))
+}
+
+// Returns options, without any COOKIE option, with cookie added unless it's
+// nil. options itself isn't changed, since it may be shared.
+func withCookie(options []dns.EDNS0, cookie *dns.EDNS0_COOKIE) []dns.EDNS0 {
+	res := make([]dns.EDNS0, 0, len(options)+1)
+	for _, o := range options {
+		if o.Option() != dns.EDNS0COOKIE {
+			res = append(res, o)
+		}
+	}
+	if cookie != nil {
+		res = append(res, cookie)
+	}
+	return res
+}
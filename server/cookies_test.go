@@ -0,0 +1,156 @@
+package server
+
+import (
+	"encoding/hex"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/namecoin/ncdns/testutil"
+)
+
+func newCookieTestServer(t *testing.T, dir string, clk *testutil.FakeClock) *Server {
+	s := newEDNSTestServer(t)
+	s.clock = clk
+	s.cfg.ConfigDir = dir
+	s.cfg.CookieSecretLifetime = 86400
+	if err := s.setupCookies(); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestCookies(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ncdns-cookies")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	clk := testutil.NewFakeClock(time.Unix(1600000000, 0))
+	s := newCookieTestServer(t, dir, clk)
+
+	client := "0102030405060708"
+	udp := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1234}
+	query := func(s *Server, cookie string, addr net.Addr) *dns.Msg {
+		rw := &fakeResponseWriter{addr: addr}
+		s.ServeDNS(rw, cookieRequest(cookie))
+		if rw.msg == nil {
+			t.Fatal("no response")
+		}
+		return rw.msg
+	}
+	cookieOf := func(m *dns.Msg) string {
+		if opt := m.IsEdns0(); opt != nil {
+			for _, o := range opt.Option {
+				if c, ok := o.(*dns.EDNS0_COOKIE); ok {
+					return c.Cookie
+				}
+			}
+		}
+		return ""
+	}
+
+	// A client's first query is answered with a server cookie, which is
+	// accepted in its next.
+	m := query(s, client, udp)
+	cookie := cookieOf(m)
+	if m.Rcode != dns.RcodeSuccess || len(m.Answer) == 0 || len(cookie) != 2*(clientCookieLen+serverCookieLen) || !strings.HasPrefix(cookie, client) {
+		t.Fatalf("got response %v", m)
+	}
+	if m := query(s, cookie, udp); m.Rcode != dns.RcodeSuccess || !strings.HasPrefix(cookieOf(m), client) {
+		t.Fatalf("got response %v", m)
+	}
+	if st := s.cookies.Status(); st.ClientOnly != 1 || st.Valid != 1 || st.Rejected != 1 || st.Enforced {
+		t.Errorf("got counts %+v", st)
+	}
+
+	// The cookie isn't valid from another address, nor with another client
+	// cookie. Not enforced, they're only counted.
+	other := &net.UDPAddr{IP: net.ParseIP("192.0.2.2"), Port: 1234}
+	if m := query(s, cookie, other); m.Rcode != dns.RcodeSuccess {
+		t.Errorf("got %s without CookieEnforce", dns.RcodeToString[m.Rcode])
+	}
+	query(s, "1112131415161718"+cookie[16:], udp)
+	if st := s.cookies.Status(); st.Invalid != 2 || st.Rejected != 3 {
+		t.Errorf("got counts %+v", st)
+	}
+
+	// A malformed cookie is answered FORMERR.
+	if m := query(s, "0102030405", udp); m.Rcode != dns.RcodeFormatError {
+		t.Errorf("got %s for a malformed cookie", dns.RcodeToString[m.Rcode])
+	}
+
+	// Enforced, a query over UDP without a valid server cookie is answered
+	// BADCOOKIE with a fresh one, and one without a cookie is truncated. Over
+	// TCP, a query without a cookie is answered.
+	s.cookies.enforce = true
+	m = query(s, client, udp)
+	if m.Rcode != dns.RcodeBadCookie || len(m.Answer) != 0 || !strings.HasPrefix(cookieOf(m), client) {
+		t.Errorf("got response %v, expected BADCOOKIE with a cookie", m)
+	}
+	if m := query(s, cookieOf(m), udp); m.Rcode != dns.RcodeSuccess || len(m.Answer) == 0 {
+		t.Errorf("got response %v to the cookie given with BADCOOKIE", m)
+	}
+	if m := query(s, cookie, other); m.Rcode != dns.RcodeBadCookie {
+		t.Errorf("got %s for another client's cookie", dns.RcodeToString[m.Rcode])
+	}
+	if m := query(s, "", udp); !m.Truncated || len(m.Answer) != 0 {
+		t.Errorf("got response %v, expected it truncated", m)
+	}
+	if m := query(s, "", &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1234}); m.Rcode != dns.RcodeSuccess || len(m.Answer) == 0 {
+		t.Errorf("got response %v over TCP", m)
+	}
+
+	// The secret survives a restart.
+	s2 := newCookieTestServer(t, dir, clk)
+	if _, state := s2.cookies.check(cookieRequest(cookie), udp.IP); state != cookieValid {
+		t.Errorf("cookie not accepted after a restart: %v", state)
+	}
+
+	// A cookie is accepted for a rotation of the secret, but not two.
+	s.cookies.rotate()
+	if _, state := s.cookies.check(cookieRequest(cookie), udp.IP); state != cookieValid {
+		t.Errorf("cookie not accepted after a rotation: %v", state)
+	}
+	s.cookies.rotate()
+	if _, state := s.cookies.check(cookieRequest(cookie), udp.IP); state != cookieInvalid {
+		t.Errorf("cookie accepted after two rotations: %v", state)
+	}
+
+	// Nor once it's too old.
+	cookie = cookieOf(query(s, cookie, udp))
+	clk.Advance(cookieMaxAge + time.Second)
+	if _, state := s.cookies.check(cookieRequest(cookie), udp.IP); state != cookieInvalid {
+		t.Errorf("expired cookie accepted: %v", state)
+	}
+}
+
+// Returns a query with the given COOKIE option, in hex, or none if it's "".
+func cookieRequest(cookie string) *dns.Msg {
+	req := new(dns.Msg)
+	req.SetQuestion("example.bit.", dns.TypeA)
+	req.SetEdns0(4096, false)
+	if cookie != "" {
+		opt := req.IsEdns0()
+		opt.Option = append(opt.Option, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: cookie})
+	}
+	return req
+}
+
+// The server cookie is made as RFC 9018 lays it out.
+func TestServerCookieLayout(t *testing.T) {
+	client, _ := hex.DecodeString("0102030405060708")
+	b := serverCookie([]byte("secret"), client, net.ParseIP("192.0.2.1"), time.Unix(0x5f5e1000, 0))
+	if len(b) != serverCookieLen || hex.EncodeToString(b[:8]) != "010000005f5e1000" {
+		t.Errorf("got server cookie %x", b)
+	}
+	if c := serverCookie([]byte("secret"), client, net.ParseIP("::ffff:192.0.2.1"), time.Unix(0x5f5e1000, 0)); string(c) != string(b) {
+		t.Errorf("cookie differs for the IPv4-mapped address")
+	}
+}
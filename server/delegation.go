@@ -0,0 +1,128 @@
+package server
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+
+	"github.com/namecoin/ncdns/util"
+)
+
+// Wraps rw so that responses have the shape their query calls for with
+// respect to delegations. A name with NS records, other than the zone apex,
+// is delegated, and is delegation-only: whatever else its value holds, the
+// only records of its own which ncdns serves are its NS and DS records.
+//
+//   - NS at the zone apex is answered with our own NS records, with AA set.
+//   - NS at a delegated name is answered with the delegation's NS records,
+//     AA clear, since the child zone is authoritative for them.
+//   - Other queries at or below a delegated name get a referral: no answer,
+//     the delegation's NS (and DS, or the proof that it has none) in the
+//     authority section, AA clear. Our apex NS records don't belong in it.
+//   - DS at a delegated name is answered by the parent, with AA set.
+//   - Any other answer from the zone is authoritative, with AA set.
+func (s *Server) delegationWriter(rw dns.ResponseWriter, req *dns.Msg) dns.ResponseWriter {
+	if len(req.Question) == 0 || req.Question[0].Qclass != dns.ClassINET {
+		return rw
+	}
+
+	return &delegationWriter{ResponseWriter: rw, q: req.Question[0], isApex: s.isApex}
+}
+
+type delegationWriter struct {
+	dns.ResponseWriter
+	q      dns.Question
+	isApex func(name string) bool
+}
+
+func (rw *delegationWriter) WriteMsg(m *dns.Msg) error {
+	shapeDelegation(m, rw.q, rw.isApex)
+	return rw.ResponseWriter.WriteMsg(m)
+}
+
+// Reshapes m, the response to q, as described for delegationWriter. isApex
+// tells whether a name is the apex of a zone we serve, such as isZoneApex.
+func shapeDelegation(m *dns.Msg, q dns.Question, isApex func(name string) bool) {
+	if m.Rcode != dns.RcodeSuccess && m.Rcode != dns.RcodeNameError {
+		return
+	}
+	if _, _, _, err := util.SplitDomainByFloatingAnchor(strings.ToLower(q.Name), "bit"); err != nil {
+		return
+	}
+
+	cut := delegationPoint(q, isApex, m.Answer, m.Ns)
+	if cut == "" {
+		m.Authoritative = true
+		return
+	}
+
+	var ns, proof []dns.RR
+	for _, section := range [][]dns.RR{m.Answer, m.Ns} {
+		for _, rr := range section {
+			switch {
+			case rr.Header().Rrtype == dns.TypeNS && strings.EqualFold(rr.Header().Name, cut):
+				ns = append(ns, rr)
+			case isDelegationProof(rr, cut):
+				proof = append(proof, rr)
+			}
+		}
+	}
+
+	m.Authoritative = false
+	m.Rcode = dns.RcodeSuccess
+	if q.Qtype == dns.TypeNS && strings.EqualFold(q.Name, cut) {
+		m.Answer, m.Ns = ns, proof
+	} else {
+		m.Answer, m.Ns = nil, append(ns, proof...)
+	}
+}
+
+// Returns the highest delegated name at or above the query name with NS
+// records in the given sections, or "" if there is none. A DS query's own
+// name doesn't count, since its DS records come from the parent.
+func delegationPoint(q dns.Question, isApex func(name string) bool, sections ...[]dns.RR) string {
+	cut := ""
+	for _, section := range sections {
+		for _, rr := range section {
+			owner := rr.Header().Name
+			if rr.Header().Rrtype != dns.TypeNS || !dns.IsSubDomain(owner, q.Name) || isApex(owner) {
+				continue
+			}
+			if q.Qtype == dns.TypeDS && strings.EqualFold(owner, q.Name) {
+				continue
+			}
+			if cut == "" || dns.CountLabel(owner) < dns.CountLabel(cut) {
+				cut = owner
+			}
+		}
+	}
+
+	return cut
+}
+
+// Whether name is the apex of a zone served by ncdns, e.g. "bit." or
+// "bit.example.com.", rather than a Namecoin name or a name below one.
+func isZoneApex(name string) bool {
+	_, basename, _, err := util.SplitDomainByFloatingAnchor(strings.ToLower(name), "bit")
+	return err == nil && basename == ""
+}
+
+// Whether rr belongs in a referral to cut as its DNSSEC data: the DS records
+// of cut, or the NSEC or NSEC3 records proving it has none, and their RRSIGs.
+// The signatures of the delegation's NS records don't, since the parent isn't
+// authoritative for them.
+func isDelegationProof(rr dns.RR, cut string) bool {
+	rrtype := rr.Header().Rrtype
+	if sig, ok := rr.(*dns.RRSIG); ok {
+		rrtype = sig.TypeCovered
+	}
+
+	switch rrtype {
+	case dns.TypeDS, dns.TypeNSEC:
+		return strings.EqualFold(rr.Header().Name, cut)
+	case dns.TypeNSEC3:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,239 @@
+package server
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/namecoin/ncdns/backend"
+)
+
+const testSig = " 8 2 600 20300101000000 20200101000000 12345 bit. AAAA"
+
+// Returns the lines a response would hold with or without DO: DNSSEC records
+// are only sent to clients which set it.
+func withDO(lines []string, do bool) []string {
+	var out []string
+	for _, line := range lines {
+		f := strings.Fields(line)
+		if !do && (f[3] == "RRSIG" || f[3] == "DS" || f[3] == "NSEC") {
+			continue
+		}
+		out = append(out, line)
+	}
+	return out
+}
+
+func TestShapeDelegation(t *testing.T) {
+	tests := []struct {
+		name   string
+		qname  string
+		qtype  uint16
+		an, ns []string
+
+		aa           bool
+		expAn, expNs []string
+	}{
+		{
+			name:  "NS at the apex",
+			qname: "bit.", qtype: dns.TypeNS,
+			an: []string{
+				"bit. 600 IN NS this.x--nmc.bit.",
+				"bit. 600 IN RRSIG NS" + testSig,
+			},
+			aa: true,
+			expAn: []string{
+				"bit. 600 IN NS this.x--nmc.bit.",
+				"bit. 600 IN RRSIG NS" + testSig,
+			},
+		},
+		{
+			name:  "NS at a delegated name",
+			qname: "child.example.bit.", qtype: dns.TypeNS,
+			an: []string{
+				"child.example.bit. 600 IN NS ns1.child.example.",
+				"child.example.bit. 600 IN RRSIG NS" + testSig,
+			},
+			ns: []string{
+				"bit. 600 IN NS this.x--nmc.bit.",
+				"child.example.bit. 600 IN DS 12345 8 2 4E8DBF9A3F2E2F0D0B2C5C8D4B3A3A1F0E63E1BBCFDAAF5A3F0D8C9B0E4C10C2",
+				"child.example.bit. 600 IN RRSIG DS" + testSig,
+			},
+			expAn: []string{
+				"child.example.bit. 600 IN NS ns1.child.example.",
+			},
+			expNs: []string{
+				"child.example.bit. 600 IN DS 12345 8 2 4E8DBF9A3F2E2F0D0B2C5C8D4B3A3A1F0E63E1BBCFDAAF5A3F0D8C9B0E4C10C2",
+				"child.example.bit. 600 IN RRSIG DS" + testSig,
+			},
+		},
+		{
+			name:  "A below a delegated name",
+			qname: "www.child.example.bit.", qtype: dns.TypeA,
+			an: []string{
+				"child.example.bit. 600 IN NS ns1.child.example.",
+				"child.example.bit. 600 IN NSEC zzz.example.bit. NS RRSIG NSEC",
+				"child.example.bit. 600 IN RRSIG NSEC" + testSig,
+			},
+			ns: []string{
+				"bit. 600 IN NS this.x--nmc.bit.",
+			},
+			expNs: []string{
+				"child.example.bit. 600 IN NS ns1.child.example.",
+				"child.example.bit. 600 IN NSEC zzz.example.bit. NS RRSIG NSEC",
+				"child.example.bit. 600 IN RRSIG NSEC" + testSig,
+			},
+		},
+		{
+			name:  "A at a delegated name with addresses",
+			qname: "example.bit.", qtype: dns.TypeA,
+			an: []string{
+				"example.bit. 600 IN A 192.0.2.1",
+				"example.bit. 600 IN RRSIG A" + testSig,
+				"example.bit. 600 IN NS ns1.example.com.",
+			},
+			expNs: []string{
+				"example.bit. 600 IN NS ns1.example.com.",
+			},
+		},
+		{
+			name:  "DS at a delegated name",
+			qname: "child.example.bit.", qtype: dns.TypeDS,
+			an: []string{
+				"child.example.bit. 600 IN DS 12345 8 2 4E8DBF9A3F2E2F0D0B2C5C8D4B3A3A1F0E63E1BBCFDAAF5A3F0D8C9B0E4C10C2",
+				"child.example.bit. 600 IN RRSIG DS" + testSig,
+			},
+			aa: true,
+			expAn: []string{
+				"child.example.bit. 600 IN DS 12345 8 2 4E8DBF9A3F2E2F0D0B2C5C8D4B3A3A1F0E63E1BBCFDAAF5A3F0D8C9B0E4C10C2",
+				"child.example.bit. 600 IN RRSIG DS" + testSig,
+			},
+		},
+		{
+			name:  "A at an undelegated name",
+			qname: "www.example.bit.", qtype: dns.TypeA,
+			an: []string{
+				"www.example.bit. 600 IN A 192.0.2.2",
+				"www.example.bit. 600 IN RRSIG A" + testSig,
+			},
+			ns: []string{
+				"bit. 600 IN NS this.x--nmc.bit.",
+			},
+			aa: true,
+			expAn: []string{
+				"www.example.bit. 600 IN A 192.0.2.2",
+				"www.example.bit. 600 IN RRSIG A" + testSig,
+			},
+			expNs: []string{
+				"bit. 600 IN NS this.x--nmc.bit.",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		for _, do := range []bool{false, true} {
+			m := testReply(test.qname, test.qtype, dns.RcodeSuccess)
+			m.Authoritative = !test.aa
+			m.Answer = mustRRs(t, withDO(test.an, do)...)
+			m.Ns = mustRRs(t, withDO(test.ns, do)...)
+
+			shapeDelegation(m, m.Question[0], isZoneApex)
+
+			if m.Authoritative != test.aa {
+				t.Errorf("%s (DO %v): AA %v, expected %v", test.name, do, m.Authoritative, test.aa)
+			}
+			for _, s := range []struct {
+				name          string
+				got, expected string
+			}{
+				{"answer", sectionStrings(m.Answer), sectionStrings(mustRRs(t, withDO(test.expAn, do)...))},
+				{"authority", sectionStrings(m.Ns), sectionStrings(mustRRs(t, withDO(test.expNs, do)...))},
+			} {
+				if s.got != s.expected {
+					t.Errorf("%s (DO %v): %s section is [%s], expected [%s]", test.name, do, s.name, s.got, s.expected)
+				}
+			}
+		}
+	}
+}
+
+// The four query shapes, through the whole path from the backend.
+func TestServeDelegation(t *testing.T) {
+	be, err := backend.New(&backend.Config{
+		CacheMaxEntries: 100,
+		FakeNames: map[string]string{
+			"d/example": `{"ip":"192.0.2.1","ns":"ns1.example.com.","map":{"www":{"ip":"192.0.2.2"}}}`,
+			"d/parent":  `{"ip":"192.0.2.3","map":{"child":{"ns":"ns1.child.example."}}}`,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := newEngine(be, &keySet{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{
+		backend:      be,
+		globalKeySet: &keySet{},
+		mux:          dns.NewServeMux(),
+		clientStats:  newClientStats(10000, time.Minute, 0, 0, nil),
+	}
+	s.mux.Handle(".", e)
+
+	tests := []struct {
+		qname        string
+		qtype        uint16
+		aa           bool
+		expAn, expNs string
+	}{
+		{"bit.", dns.TypeNS, true, "bit. NS", ""},
+		{"child.parent.bit.", dns.TypeNS, false, "child.parent.bit. NS", ""},
+		{"www.child.parent.bit.", dns.TypeA, false, "", "child.parent.bit. NS"},
+		{"example.bit.", dns.TypeA, false, "", "example.bit. NS"},
+		{"www.example.bit.", dns.TypeA, false, "", "example.bit. NS"},
+		{"parent.bit.", dns.TypeA, true, "parent.bit. A", ""},
+	}
+
+	for _, test := range tests {
+		for _, do := range []bool{false, true} {
+			req := new(dns.Msg)
+			req.SetQuestion(test.qname, test.qtype)
+			if do {
+				req.SetEdns0(4096, true)
+			}
+			frw := &fakeResponseWriter{addr: &net.UDPAddr{IP: net.ParseIP("192.0.2.100"), Port: 1234}}
+			s.ServeDNS(frw, req)
+
+			m := frw.msg
+			if m == nil || m.Rcode != dns.RcodeSuccess {
+				t.Errorf("%s %s (DO %v): unexpected response %v", test.qname, dns.TypeToString[test.qtype], do, m)
+				continue
+			}
+
+			// Whatever else the engine answers with, the NS records must
+			// be in the right section, and a referral has no answer.
+			an, ns := sectionStrings(m.Answer), sectionStrings(typeOnly(m.Ns, dns.TypeNS))
+			if test.qtype == dns.TypeNS {
+				an = sectionStrings(typeOnly(m.Answer, dns.TypeNS))
+			}
+			if m.Authoritative != test.aa || an != test.expAn || ns != test.expNs {
+				t.Errorf("%s %s (DO %v): got AA %v, answer [%s], authority [%s]; expected AA %v, answer [%s], authority [%s]",
+					test.qname, dns.TypeToString[test.qtype], do, m.Authoritative, an, ns, test.aa, test.expAn, test.expNs)
+			}
+		}
+	}
+}
+
+func typeOnly(rrs []dns.RR, rrtype uint16) []dns.RR {
+	var out []dns.RR
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == rrtype {
+			out = append(out, rr)
+		}
+	}
+	return out
+}
@@ -0,0 +1,111 @@
+package server
+
+import (
+	"net"
+	"sync/atomic"
+
+	"github.com/miekg/dns"
+)
+
+// The types of the records stripped from responses to clients in
+// StripDNSSECForClients. Those other than RRSIG, NSEC and NSEC3 are kept in
+// the answer to a query asking for them.
+var strippedDNSSECTypes = map[uint16]bool{
+	dns.TypeRRSIG:      true,
+	dns.TypeNSEC:       true,
+	dns.TypeNSEC3:      true,
+	dns.TypeDNSKEY:     false,
+	dns.TypeDS:         false,
+	dns.TypeNSEC3PARAM: false,
+	dns.TypeCDS:        false,
+	dns.TypeCDNSKEY:    false,
+}
+
+// Strips DNSSEC records from the responses to the clients in
+// StripDNSSECForClients, whether or not they set the DO bit, for stub
+// resolvers which fail on any response holding them.
+type dnssecStrip struct {
+	stripped uint64 // accessed atomically; responses with records stripped
+
+	clients []*net.IPNet
+}
+
+// Sets up stripping if StripDNSSECForClients is set.
+func (s *Server) setupDNSSECStrip() error {
+	clients, err := parseIPNets("StripDNSSECForClients", s.cfg.StripDNSSECForClients)
+	if err != nil {
+		return err
+	}
+	if len(clients) == 0 {
+		return nil
+	}
+
+	log.Warnf("DNSSEC records will be stripped from responses to %s, even if they ask for them; those clients can't validate anything ncdns answers",
+		s.cfg.StripDNSSECForClients)
+	s.dnssecStrip = &dnssecStrip{clients: clients}
+	return nil
+}
+
+// Wraps rw so that DNSSEC records are stripped from the response, if the
+// client is in StripDNSSECForClients.
+func (s *Server) dnssecStripWriter(rw dns.ResponseWriter, req *dns.Msg) dns.ResponseWriter {
+	ds := s.dnssecStrip
+	if ds == nil {
+		return rw
+	}
+	ip := clientIP(rw)
+	if ip == nil || !ipNetsContain(ds.clients, ip) {
+		return rw
+	}
+
+	qtype := uint16(0)
+	if len(req.Question) > 0 {
+		qtype = req.Question[0].Qtype
+	}
+	return &dnssecStripWriter{ResponseWriter: rw, ds: ds, qtype: qtype}
+}
+
+type dnssecStripWriter struct {
+	dns.ResponseWriter
+	ds    *dnssecStrip
+	qtype uint16
+}
+
+func (rw *dnssecStripWriter) WriteMsg(m *dns.Msg) error {
+	n := len(m.Answer) + len(m.Ns) + len(m.Extra)
+	m.Answer = stripDNSSEC(m.Answer, rw.qtype)
+	m.Ns = stripDNSSEC(m.Ns, 0)
+	m.Extra = stripDNSSEC(m.Extra, 0)
+	if len(m.Answer)+len(m.Ns)+len(m.Extra) != n {
+		atomic.AddUint64(&rw.ds.stripped, 1)
+	}
+	if opt := m.IsEdns0(); opt != nil {
+		opt.SetDo(false)
+	}
+
+	return rw.ResponseWriter.WriteMsg(m)
+}
+
+// Returns the records of section which aren't DNSSEC records, other than
+// those of type keep. The section is copied if anything is stripped.
+func stripDNSSEC(section []dns.RR, keep uint16) []dns.RR {
+	var out []dns.RR
+	for i, rr := range section {
+		t := rr.Header().Rrtype
+		always, isDNSSEC := strippedDNSSECTypes[t]
+		if !isDNSSEC || (!always && t == keep) {
+			if out != nil {
+				out = append(out, rr)
+			}
+			continue
+		}
+		if out == nil {
+			out = append(make([]dns.RR, 0, len(section)-1), section[:i]...)
+		}
+	}
+
+	if out == nil {
+		return section
+	}
+	return out
+}
@@ -0,0 +1,89 @@
+package server
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+
+	"github.com/namecoin/ncdns/backend"
+)
+
+func TestDNSSECStrip(t *testing.T) {
+	be, err := backend.New(&backend.Config{
+		CacheMaxEntries: 100,
+		FakeNames:       map[string]string{"d/example": `{"ip":["192.0.2.1"]}`},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ks, err := generateKeySet("bit.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := newEngine(be, ks)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Server{backend: be, globalKeySet: ks, mux: dns.NewServeMux()}
+	s.mux.Handle(".", e)
+	s.cfg.StripDNSSECForClients = "192.0.2.0/24"
+	if err := s.setupDNSSECStrip(); err != nil {
+		t.Fatal(err)
+	}
+
+	query := func(name string, qtype uint16, ip string) *dns.Msg {
+		req := new(dns.Msg)
+		req.SetQuestion(name, qtype)
+		req.SetEdns0(4096, true)
+		frw := &fakeResponseWriter{addr: &net.UDPAddr{IP: net.ParseIP(ip), Port: 1234}}
+		s.ServeDNS(frw, req)
+		if frw.msg == nil {
+			t.Fatalf("no response to %s from %s", name, ip)
+		}
+		return frw.msg
+	}
+	dnssecRecords := func(m *dns.Msg) int {
+		n := 0
+		for _, section := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+			for _, t := range []uint16{dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNSEC3} {
+				n += countType(section, t)
+			}
+		}
+		return n
+	}
+
+	for _, q := range []struct {
+		name  string
+		rcode int
+	}{
+		{"example.bit.", dns.RcodeSuccess},
+		{"nonexistent.bit.", dns.RcodeNameError},
+	} {
+		if m := query(q.name, dns.TypeA, "198.51.100.1"); m.Rcode != q.rcode || dnssecRecords(m) == 0 || !m.IsEdns0().Do() {
+			t.Errorf("%s from a client not listed: expected a signed answer, got %v", q.name, m)
+		}
+		if m := query(q.name, dns.TypeA, "192.0.2.53"); m.Rcode != q.rcode || dnssecRecords(m) != 0 || m.IsEdns0().Do() {
+			t.Errorf("%s from a listed client: expected an unsigned answer, got %v", q.name, m)
+		}
+	}
+	if m := query("example.bit.", dns.TypeA, "192.0.2.53"); countType(m.Answer, dns.TypeA) != 1 {
+		t.Errorf("expected the address to be kept, got %v", m)
+	}
+	if s.dnssecStrip.stripped != 3 {
+		t.Errorf("%d responses stripped, expected 3", s.dnssecStrip.stripped)
+	}
+
+	// A DNSKEY asked for is kept, but not its RRSIG.
+	section := []dns.RR{
+		&dns.DNSKEY{Hdr: dns.RR_Header{Name: "bit.", Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET}},
+		&dns.RRSIG{Hdr: dns.RR_Header{Name: "bit.", Rrtype: dns.TypeRRSIG, Class: dns.ClassINET}, TypeCovered: dns.TypeDNSKEY},
+	}
+	if out := stripDNSSEC(section, dns.TypeDNSKEY); len(out) != 1 || out[0] != section[0] || len(section) != 2 {
+		t.Errorf("stripping %v asking for DNSKEY gave %v", section, out)
+	}
+	if out := stripDNSSEC(section, dns.TypeA); len(out) != 0 {
+		t.Errorf("stripping %v asking for A gave %v", section, out)
+	}
+}
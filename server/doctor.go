@@ -0,0 +1,672 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/namecoin/ncdns/clock"
+	"github.com/namecoin/ncdns/namecoin"
+	"github.com/namecoin/ncdns/ncdomain"
+	"github.com/namecoin/ncdns/util"
+)
+
+// The outcome of a check made by Doctor, from best to worst.
+type CheckStatus int
+
+const (
+	CheckPass CheckStatus = iota
+	CheckWarn
+	CheckFail
+)
+
+func (st CheckStatus) String() string {
+	switch st {
+	case CheckPass:
+		return "pass"
+	case CheckWarn:
+		return "warn"
+	default:
+		return "fail"
+	}
+}
+
+func (st CheckStatus) MarshalJSON() ([]byte, error) {
+	return json.Marshal(st.String())
+}
+
+// The result of one of the checks made by Doctor.
+type CheckResult struct {
+	Name    string      `json:"name"`
+	Status  CheckStatus `json:"status"`
+	Message string      `json:"message"`
+	Hint    string      `json:"hint,omitempty"` // how to put it right, unless it passed
+}
+
+// What Doctor found.
+type DoctorReport struct {
+	Checks []CheckResult `json:"checks"`
+	Status CheckStatus   `json:"status"` // the worst of the checks
+}
+
+func (r *DoctorReport) add(name string, status CheckStatus, hint, format string, args ...interface{}) {
+	if status == CheckPass {
+		hint = ""
+	}
+	r.Checks = append(r.Checks, CheckResult{
+		Name:    name,
+		Status:  status,
+		Message: fmt.Sprintf(format, args...),
+		Hint:    hint,
+	})
+	if status > r.Status {
+		r.Status = status
+	}
+}
+
+// Writes the report as text, a line for each check followed by its hint, if
+// any, and the worst result.
+func (r *DoctorReport) WriteText(w io.Writer) {
+	for _, c := range r.Checks {
+		fmt.Fprintf(w, "%-4s  %-12s  %s\n", c.Status, c.Name, c.Message)
+		if c.Hint != "" {
+			fmt.Fprintf(w, "%-4s  %-12s  hint: %s\n", "", "", c.Hint)
+		}
+	}
+	fmt.Fprintf(w, "overall: %s\n", r.Status)
+}
+
+// Options for Doctor.
+type DoctorOptions struct {
+	// Address of a running instance to query, e.g. 127.0.0.1:53. If empty,
+	// the server set up from the configuration is queried in-process, and
+	// BindAddresses is checked to be free.
+	Server string
+
+	// A name to look up, e.g. example.bit: through the running instance if
+	// Server is set, otherwise as the webserver's lookup page would.
+	SampleName string
+
+	// Timeout of each query of the running instance. If zero, a default is
+	// used.
+	Timeout time.Duration
+}
+
+const defaultDoctorTimeout = 5 * time.Second
+
+// Checks a deployment of ncdns from end to end, for diagnosing a broken setup:
+// that the configuration is valid and its keys load, that namecoind can be
+// reached and is in sync, that the ports ncdns listens on are free, that it
+// answers with valid signatures (queried in-process, or over the network
+// given a running instance, whose ports aren't checked), that the templates
+// load and that the clock is right. Nothing is left running. opts may be nil.
+//
+// Checks which don't apply to the configuration, e.g. those of namecoind with
+// the static fetcher, aren't reported.
+func Doctor(cfg *Config, opts *DoctorOptions) *DoctorReport {
+	d := &doctor{cfg: cfg, clock: clock.Real}
+	if opts != nil {
+		d.opts = *opts
+	}
+	if d.opts.Timeout <= 0 {
+		d.opts.Timeout = defaultDoctorTimeout
+	}
+
+	d.run()
+	return &d.report
+}
+
+type doctor struct {
+	cfg    *Config
+	opts   DoctorOptions
+	s      *Server
+	clock  clock.Clock
+	report DoctorReport
+}
+
+func (d *doctor) run() {
+	if !d.checkConfig() {
+		// The cookie is read when connecting, so it may be why the
+		// configuration couldn't be used.
+		d.checkCookie()
+		return
+	}
+	defer d.s.namecoinConn.Shutdown()
+
+	d.checkKeys()
+	d.checkParentDS()
+	d.checkCookie()
+	d.checkNamecoind()
+	d.checkTemplates()
+
+	if d.opts.Server == "" {
+		d.checkBind()
+		d.checkSampleValue()
+	}
+	d.checkRunning()
+}
+
+// Sets the server up as the daemon would, without listening.
+func (d *doctor) checkConfig() bool {
+	s, err := newServer(d.cfg)
+	switch {
+	case err == nil:
+		d.s = s
+		if len(s.deprecated) != 0 {
+			var msgs []string
+			for _, dep := range s.deprecated {
+				msgs = append(msgs, dep.String())
+			}
+			d.report.add("config", CheckWarn, "run \"ncdns migrate-config\" to rewrite the configuration file",
+				"the configuration is valid, but %s", strings.Join(msgs, "; "))
+			return true
+		}
+		d.report.add("config", CheckPass, "", "the configuration is valid")
+		return true
+
+	case errors.Is(err, ErrKeyLoad):
+		d.report.add("keys", CheckFail,
+			"check that the key options (PublicKey, PrivateKey, ZonePublicKey, ZonePrivateKey and SuffixKeys) name the halves of the same keys, readable by ncdns",
+			"%v", err)
+
+	case errors.Is(err, ErrBackendInit):
+		d.report.add("config", CheckFail,
+			"check the Fetcher and NamecoinRPC options",
+			"couldn't set up the backend: %v", err)
+
+	default:
+		d.report.add("config", CheckFail,
+			"fix the option named, in the configuration file or its "+EnvPrefix+" environment variable",
+			"%v", err)
+	}
+
+	return false
+}
+
+func (d *doctor) checkKeys() {
+	const hint = "make private key files readable only by the user ncdns runs as, e.g. chmod 600"
+
+	ks := d.s.globalKeys()
+	if ks.KSK == nil {
+		d.report.add("keys", CheckWarn,
+			"generate a KSK and ZSK, e.g. with dnssec-keygen, and set PublicKey, PrivateKey, ZonePublicKey and ZonePrivateKey",
+			"no KSK is configured, so responses can't be validated by resolvers")
+		return
+	}
+
+	privateKeys := []string{d.cfg.DNSSEC.PrivateKey, d.cfg.DNSSEC.ZonePrivateKey}
+	for _, spec := range d.s.cfg.suffixKeys {
+		privateKeys = append(privateKeys, spec.privateKey, spec.zonePrivateKey)
+	}
+	for _, fn := range privateKeys {
+		if fn == "" {
+			continue
+		}
+		fn = d.cfg.cpath(fn)
+		if fi, err := os.Stat(fn); err == nil {
+			if err := keyPermissionsError(fn, fi.Mode()); err != nil {
+				d.report.add("keys", CheckWarn, hint, "%v", err)
+				return
+			}
+		}
+	}
+
+	msg := fmt.Sprintf("the KSK (key tag %d) and ZSK (key tag %d) match their private keys", ks.KSK.KeyTag(), ks.ZSK.KeyTag())
+	if n := len(d.s.suffixKeySets); n > 0 {
+		msg += fmt.Sprintf(", as do the keys of %d suffixes", n)
+	}
+	d.report.add("keys", CheckPass, "", "%s", msg)
+}
+
+// Compares the DS records published in the parent zone with the KSK, if
+// ParentCheckResolver is set.
+func (d *doctor) checkParentDS() {
+	c := d.s.parentChecker
+	if c == nil {
+		return
+	}
+
+	const hint = "publish the DS record given by ncdns export-trust-anchor -format=ds in the parent zone"
+
+	state, parentDS, err := c.query()
+	switch state {
+	case parentDSMatch:
+		d.report.add("parent-ds", CheckPass, "", "the DS records for %s in its parent match the KSK", c.suffix)
+	case parentDSMismatch:
+		d.report.add("parent-ds", CheckFail, hint, "none of the DS records for %s in its parent match the KSK: %s", c.suffix, strings.Join(parentDS, "; "))
+	case parentDSMissing:
+		d.report.add("parent-ds", CheckWarn, hint, "the parent of %s publishes no DS records for it", c.suffix)
+	default:
+		d.report.add("parent-ds", CheckWarn, "check ParentCheckResolver, or OutboundResolvers if set",
+			"couldn't check the DS records for %s: %v", c.suffix, err)
+	}
+}
+
+// Returns the RPC cookie files used to connect to namecoind, if any.
+func (d *doctor) cookiePaths() []string {
+	if !d.cfg.usesNamecoind() || d.cfg.RPC.Password != "" {
+		return nil
+	}
+	if d.cfg.RPC.CookiePath != "" || d.cfg.RPC.Username != "" {
+		return splitList(d.cfg.RPC.CookiePath)
+	}
+
+	network, err := namecoin.NetworkByName(d.cfg.RPC.Network)
+	if err != nil {
+		return nil
+	}
+	if path := network.DefaultCookiePath(); path != "" {
+		return []string{path}
+	}
+	return nil
+}
+
+func (d *doctor) checkCookie() {
+	for _, path := range d.cookiePaths() {
+		d.checkCookieFile(path)
+	}
+}
+
+func (d *doctor) checkCookieFile(path string) {
+	b, err := ioutil.ReadFile(path)
+	switch {
+	case os.IsNotExist(err):
+		d.report.add("cookie", CheckFail,
+			"start namecoind, or set NamecoinRPCCookiePath to the .cookie file in its data directory (or NamecoinRPCUsername and NamecoinRPCPassword)",
+			"the RPC cookie file %s doesn't exist", path)
+	case err != nil:
+		d.report.add("cookie", CheckFail,
+			"let the user ncdns runs as read the cookie file, e.g. by adding it to namecoind's group and starting namecoind with -rpccookieperms=group",
+			"couldn't read the RPC cookie file: %v", err)
+	case !strings.Contains(string(b), ":"):
+		d.report.add("cookie", CheckFail,
+			"check that NamecoinRPCCookiePath names namecoind's .cookie file",
+			"the RPC cookie file %s isn't a cookie", path)
+	default:
+		d.report.add("cookie", CheckPass, "", "the RPC cookie file %s is readable", path)
+	}
+}
+
+// How far namecoind's best block may be behind the best header before it
+// counts as not in sync.
+const doctorSyncBlocks = 6
+
+// How old namecoind's latest blocks may be, by their median time, before
+// either namecoind or the clock is suspected of being wrong.
+const doctorStaleBlocks = 24 * time.Hour
+
+// Checks that namecoind can be reached, is on the configured network and is
+// in sync, and compares the clock with the times of its latest blocks.
+func (d *doctor) checkNamecoind() {
+	if !d.cfg.usesNamecoind() {
+		return
+	}
+
+	addr := d.cfg.RPC.Endpoints
+	if addr == "" {
+		addr = d.s.network.DefaultRPCAddress()
+	}
+
+	info, err := d.s.namecoinConn.BlockchainInfo()
+	if err != nil {
+		hint := d.s.namecoinFailureHint(err)
+		if hint == "" {
+			hint = "check that namecoind is running with server=1, and NamecoinRPCEndpoints and the RPC credentials"
+		}
+		d.report.add("namecoind", CheckFail, hint, "couldn't reach namecoind at %s: %v", addr, err)
+		return
+	}
+
+	if info.Chain != d.s.network.Chain {
+		d.report.add("namecoind", CheckFail,
+			"set NamecoinNetwork, or point NamecoinRPCEndpoints at a namecoind on the right network",
+			"namecoind at %s is on the %q chain, but ncdns is configured for the %s network", addr, info.Chain, d.s.network.Name)
+		return
+	}
+	d.report.add("namecoind", CheckPass, "", "namecoind at %s is reachable, on the %s network", addr, d.s.network.Name)
+
+	if info.InitialBlockDownload || info.Headers-info.Blocks > doctorSyncBlocks {
+		d.report.add("sync", CheckWarn,
+			"wait for namecoind to catch up; until then, names are served from out of date values",
+			"namecoind is still syncing, at block %d of %d", info.Blocks, info.Headers)
+	} else {
+		d.report.add("sync", CheckPass, "", "namecoind is in sync, at block %d", info.Blocks)
+	}
+
+	now := d.clock.Now()
+	median := time.Unix(info.MedianTime, 0)
+	const hint = "set the clock right, e.g. with NTP; resolvers reject signatures made with a wrong clock"
+	switch {
+	case now.Before(median):
+		d.report.add("clock", CheckFail, hint,
+			"the clock is at least %v behind the times of namecoind's latest blocks, so signatures made now aren't valid yet", median.Sub(now).Round(time.Second))
+	case !info.InitialBlockDownload && now.Sub(median) > doctorStaleBlocks:
+		d.report.add("clock", CheckWarn, "if namecoind is in sync, "+hint,
+			"namecoind's latest blocks are %v old, so either namecoind isn't getting blocks or the clock is ahead", now.Sub(median).Round(time.Minute))
+	default:
+		d.report.add("clock", CheckPass, "", "the clock agrees with the times of namecoind's latest blocks")
+	}
+}
+
+func (d *doctor) checkTemplates() {
+	if d.cfg.HTTP.ListenAddr == "" {
+		return
+	}
+
+	_, _, _, _, err := d.s.loadTemplates()
+	if err != nil {
+		d.report.add("templates", CheckFail,
+			"set TplPath to the tpl directory shipped with ncdns, or leave it empty to use the built-in templates",
+			"couldn't load the %s templates: %v", d.cfg.TplSet, err)
+		return
+	}
+	d.report.add("templates", CheckPass, "", "the %s templates load", d.cfg.TplSet)
+}
+
+// Checks that the DNS and HTTP listeners could be created, closing them again.
+func (d *doctor) checkBind() {
+	err := d.s.listen()
+	d.s.closeListeners()
+	addr := d.cfg.BindAddresses
+	if err == nil && d.cfg.HTTP.ListenAddr != "" {
+		var l net.Listener
+		l, err = net.Listen(webListenAddr(d.cfg.HTTP.ListenAddr))
+		if err == nil {
+			l.Close()
+		}
+		addr = d.cfg.HTTP.ListenAddr
+	}
+
+	switch {
+	case err == nil:
+		d.report.add("bind", CheckPass, "", "can listen at %s", strings.Join(nonEmpty(d.cfg.BindAddresses, d.cfg.TLSBind, d.cfg.HTTP.ListenAddr), " and "))
+	case errors.Is(err, syscall.EADDRINUSE):
+		d.report.add("bind", CheckWarn,
+			"if ncdns is running, check it with -server=ADDRESS instead; otherwise stop whatever is using the port",
+			"%s is in use: %v", addr, err)
+	case errors.Is(err, syscall.EACCES):
+		d.report.add("bind", CheckFail,
+			"ports below 1024 need root or CAP_NET_BIND_SERVICE, e.g. setcap cap_net_bind_service=+ep ncdns",
+			"not allowed to listen at %s: %v", addr, err)
+	default:
+		d.report.add("bind", CheckFail, "check BindAddresses, TLSBind and HTTPListenAddr", "couldn't listen at %s: %v", addr, err)
+	}
+}
+
+func nonEmpty(ss ...string) []string {
+	var out []string
+	for _, s := range ss {
+		if s != "" {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// Looks the sample name up as the webserver's lookup page does, without a
+// running instance.
+func (d *doctor) checkSampleValue() {
+	if d.opts.SampleName == "" {
+		return
+	}
+
+	bareName, namecoinName, err := util.ParseFuzzyDomainNameNC(d.opts.SampleName)
+	if err != nil {
+		d.report.add("sample", CheckFail, "give a name such as example.bit", "%v", err)
+		return
+	}
+
+	fetcher, err := d.s.newFetcher()
+	if err != nil {
+		d.report.add("sample", CheckFail, "check the Fetcher options", "%v", err)
+		return
+	}
+	nameQuery := func(name string) (string, error) {
+		nd, err := fetcher.Fetch(context.Background(), name, "")
+		if err != nil {
+			return "", err
+		}
+		return nd.Value, nil
+	}
+	resolve := func(name string) (string, error) {
+		v, _, err := d.s.httpBreaker.call(func() (string, error) {
+			return nameQuery(name)
+		})
+		return v, err
+	}
+
+	value, err := nameQuery(namecoinName)
+	if err != nil {
+		d.report.add("sample", CheckFail, "check that the name exists, e.g. with namecoin-cli name_show "+namecoinName,
+			"couldn't fetch %s: %v", namecoinName, err)
+		return
+	}
+
+	var errs, warnings []string
+	v := ncdomain.ParseValueWithOptions(namecoinName, value, resolve, func(err error, isWarning bool) {
+		if isWarning {
+			warnings = append(warnings, err.Error())
+		} else {
+			errs = append(errs, err.Error())
+		}
+	}, d.s.parseOptions())
+	var rrs []dns.RR
+	if v != nil {
+		rrs, err = v.RRsRecursive(nil, bareName+".bit.", "bit.")
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	const hint = "fix the value; the webserver's lookup page shows what's wrong with it"
+	switch {
+	case len(errs) > 0:
+		d.report.add("sample", CheckFail, hint, "the value of %s is invalid: %s", namecoinName, strings.Join(errs, "; "))
+	case len(warnings) > 0:
+		d.report.add("sample", CheckWarn, hint, "%s has %d records, but its value has warnings: %s", bareName+".bit", len(rrs), strings.Join(warnings, "; "))
+	default:
+		d.report.add("sample", CheckPass, "", "%s has %d records", bareName+".bit", len(rrs))
+	}
+}
+
+// Queries the running instance at opts.Server for the SOA and DNSKEY records
+// of the apex and the sample name, validating the signatures of the answers.
+// Without a running instance, the server set up from the configuration is
+// queried in-process for those of the apex instead, as a self-test.
+func (d *doctor) checkRunning() {
+	apex := dns.Fqdn(strings.ToLower(d.cfg.CanonicalSuffix))
+	const unreachableHint = "check that ncdns is running and that -server is the address it listens at (BindAddresses)"
+
+	dnskeyRes, err := d.query(apex, dns.TypeDNSKEY)
+	if err != nil {
+		d.report.add("query", CheckFail, unreachableHint, "no answer from %s: %v", d.target(), err)
+		return
+	}
+
+	var keys []*dns.DNSKEY
+	for _, rr := range dnskeyRes.Answer {
+		if k, ok := rr.(*dns.DNSKEY); ok {
+			keys = append(keys, k)
+		}
+	}
+
+	signed := false
+	if ks := d.s.keySetForName(apex); ks != nil && ks.KSK != nil {
+		signed = true
+		if !hasKey(keys, ks.KSK) {
+			d.report.add("dnskey", CheckFail,
+				"restart ncdns with the configured keys, or check that it's ncdns answering at "+d.target(),
+				"the DNSKEY records served for %s don't include the configured KSK (key tag %d)", apex, ks.KSK.KeyTag())
+		} else {
+			d.report.add("dnskey", CheckPass, "", "the DNSKEY records served for %s include the KSK (key tag %d)", apex, ks.KSK.KeyTag())
+		}
+	}
+
+	responses := []*dns.Msg{dnskeyRes}
+
+	soaRes, err := d.query(apex, dns.TypeSOA)
+	switch {
+	case err != nil:
+		d.report.add("soa", CheckFail, unreachableHint, "no answer for %s SOA: %v", apex, err)
+	case soaRes.Rcode != dns.RcodeSuccess || !hasType(soaRes.Answer, dns.TypeSOA):
+		d.report.add("soa", CheckFail, "check that CanonicalSuffix is the suffix ncdns serves",
+			"%s SOA was answered with %s and no SOA record", apex, dns.RcodeToString[soaRes.Rcode])
+	default:
+		d.report.add("soa", CheckPass, "", "%s SOA is answered", apex)
+		responses = append(responses, soaRes)
+	}
+
+	// Without a running instance, the sample name was checked by
+	// checkSampleValue.
+	if d.opts.SampleName != "" && d.opts.Server != "" {
+		qname := dns.Fqdn(strings.ToLower(d.opts.SampleName))
+		res, err := d.query(qname, dns.TypeA)
+		switch {
+		case err != nil:
+			d.report.add("sample", CheckFail, unreachableHint, "no answer for %s A: %v", qname, err)
+		case res.Rcode != dns.RcodeSuccess:
+			d.report.add("sample", CheckFail, "check that the name exists, and that namecoind is reachable from ncdns",
+				"%s A was answered with %s", qname, dns.RcodeToString[res.Rcode])
+		default:
+			d.report.add("sample", CheckPass, "", "%s A was answered with %d records", qname, len(res.Answer))
+			responses = append(responses, res)
+		}
+	}
+
+	if signed {
+		d.checkSignatures(responses, keys)
+	}
+}
+
+// Describes what checkRunning queries.
+func (d *doctor) target() string {
+	if d.opts.Server == "" {
+		return "the configured server, queried in-process"
+	}
+	return d.opts.Server
+}
+
+// Sends a query with the DO bit to the running instance, or to the server
+// in-process if there isn't one, again over TCP if the answer is truncated.
+func (d *doctor) query(qname string, qtype uint16) (*dns.Msg, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(qname, qtype)
+	m.SetEdns0(4096, true)
+
+	if d.opts.Server == "" {
+		ctx, cancel := context.WithTimeout(context.Background(), d.opts.Timeout)
+		defer cancel()
+
+		client := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5353}
+		res, err := d.s.Query(ctx, m, client)
+		if err == nil && res != nil && res.Truncated {
+			res, err = d.s.Query(ctx, m, &net.TCPAddr{IP: client.IP, Port: client.Port})
+		}
+		if err == nil && res == nil {
+			err = errors.New("the query was dropped")
+		}
+		return res, err
+	}
+
+	c := &dns.Client{Timeout: d.opts.Timeout}
+	res, _, err := c.Exchange(m, d.opts.Server)
+	if err == nil && res.Truncated {
+		c.Net = "tcp"
+		res, _, err = c.Exchange(m, d.opts.Server)
+	}
+	return res, err
+}
+
+// Verifies the RRSIGs of the answers and authority sections of the responses
+// with the keys, and checks that they're valid at the current time.
+func (d *doctor) checkSignatures(responses []*dns.Msg, keys []*dns.DNSKEY) {
+	now := d.clock.Now()
+	n := 0
+	for _, res := range responses {
+		for _, section := range [][]dns.RR{res.Answer, res.Ns} {
+			for _, rr := range section {
+				sig, ok := rr.(*dns.RRSIG)
+				if !ok {
+					continue
+				}
+				n++
+
+				what := sig.Hdr.Name + " " + dns.TypeToString[sig.TypeCovered]
+				key := keyForSig(keys, sig)
+				if key == nil {
+					d.report.add("signatures", CheckFail, "restart ncdns, so that it signs with the keys it serves",
+						"the RRSIG for %s was made by key %d, which isn't served", what, sig.KeyTag)
+					return
+				}
+				if err := sig.Verify(key, coveredRRset(section, sig)); err != nil {
+					d.report.add("signatures", CheckFail, "restart ncdns, so that it signs with the keys it serves",
+						"the RRSIG for %s doesn't verify: %v", what, err)
+					return
+				}
+				if !sig.ValidityPeriod(now) {
+					d.report.add("clock", CheckFail,
+						"set the clock right, e.g. with NTP; resolvers reject signatures made with a wrong clock",
+						"the RRSIG for %s is valid from %s to %s, which doesn't include the current time, %s", what,
+						dns.TimeToString(sig.Inception), dns.TimeToString(sig.Expiration), now.UTC().Format("20060102150405"))
+					return
+				}
+			}
+		}
+	}
+
+	if n == 0 {
+		d.report.add("signatures", CheckFail, "check that ncdns was started with the configured keys",
+			"the answers aren't signed")
+		return
+	}
+	d.report.add("signatures", CheckPass, "", "the %d RRSIGs in the answers verify, and are valid now", n)
+}
+
+func hasKey(keys []*dns.DNSKEY, k *dns.DNSKEY) bool {
+	for _, key := range keys {
+		if key.Algorithm == k.Algorithm && key.PublicKey == k.PublicKey {
+			return true
+		}
+	}
+	return false
+}
+
+func hasType(rrs []dns.RR, rrtype uint16) bool {
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == rrtype {
+			return true
+		}
+	}
+	return false
+}
+
+func keyForSig(keys []*dns.DNSKEY, sig *dns.RRSIG) *dns.DNSKEY {
+	for _, k := range keys {
+		if k.Algorithm == sig.Algorithm && k.KeyTag() == sig.KeyTag && strings.EqualFold(k.Hdr.Name, sig.SignerName) {
+			return k
+		}
+	}
+	return nil
+}
+
+// Returns the records of section covered by sig.
+func coveredRRset(section []dns.RR, sig *dns.RRSIG) []dns.RR {
+	var rrset []dns.RR
+	for _, rr := range section {
+		h := rr.Header()
+		if h.Rrtype == sig.TypeCovered && h.Class == sig.Hdr.Class && strings.EqualFold(h.Name, sig.Hdr.Name) {
+			rrset = append(rrset, rr)
+		}
+	}
+	return rrset
+}
@@ -0,0 +1,324 @@
+//go:build !no_webserver
+// +build !no_webserver
+
+package server
+
+import (
+	"bytes"
+	"crypto"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// A namecoind whose getblockchaininfo result can be changed, holding
+// d/example.
+type fakeDoctorRPC struct {
+	info map[string]interface{}
+}
+
+func (f *fakeDoctorRPC) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	var call struct {
+		Method string      `json:"method"`
+		ID     interface{} `json:"id"`
+	}
+	json.NewDecoder(req.Body).Decode(&call)
+
+	res := map[string]interface{}{"id": call.ID, "error": nil}
+	switch call.Method {
+	case "getblockchaininfo":
+		res["result"] = f.info
+	case "name_show":
+		res["result"] = map[string]interface{}{
+			"name":       "d/example",
+			"value":      `{"ip":["192.0.2.1"],"map":{"www":{"ip":"192.0.2.2"}}}`,
+			"expires_in": 20000,
+		}
+	default:
+		res["error"] = map[string]interface{}{"code": -32601, "message": "Method not found"}
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(res)
+}
+
+// A configuration with keys, a webserver and a namecoind reached with a
+// cookie, all of which pass.
+func newDoctorTestConfig(t *testing.T, dir, rpcAddr string) *Config {
+	cfg := newErrorTestConfig(dir)
+	cfg.DNSSEC.PublicKey, cfg.DNSSEC.PrivateKey = writeKeyPair(t, dir, "ksk", dns.ECDSAP256SHA256, 256)
+	cfg.DNSSEC.ZonePublicKey, cfg.DNSSEC.ZonePrivateKey = writeKeyPair(t, dir, "zsk", dns.ECDSAP256SHA256, 256)
+	cfg.RPC.Network = "regtest"
+	cfg.RPC.Endpoints = rpcAddr
+	cfg.RPC.CookiePath = filepath.Join(dir, ".cookie")
+	cfg.RPC.Timeout = 1500
+	cfg.HTTP.ListenAddr = "127.0.0.1:0"
+	cfg.TplPath = filepath.Join("..", "_tpl")
+	cfg.TplSet = "std"
+	cfg.CanonicalSuffix = "bit"
+	cfg.ClockSkewPolicy = clockSkewServFail
+
+	err := ioutil.WriteFile(cfg.RPC.CookiePath, []byte("__cookie__:secret"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+func checkStatuses(r *DoctorReport) map[string]CheckStatus {
+	statuses := map[string]CheckStatus{}
+	for _, c := range r.Checks {
+		statuses[c.Name] = c.Status
+	}
+	return statuses
+}
+
+func TestDoctor(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ncdns-doctor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	rpc := &fakeDoctorRPC{}
+	rpcSrv := httptest.NewServer(rpc)
+	defer rpcSrv.Close()
+
+	busy, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+
+	tests := []struct {
+		name     string
+		modify   func(cfg *Config, info map[string]interface{})
+		expected map[string]CheckStatus // of the checks which don't pass
+	}{
+		{"ok", func(cfg *Config, info map[string]interface{}) {}, nil},
+		{"bad option", func(cfg *Config, info map[string]interface{}) {
+			cfg.ClockSkewPolicy = "bogus"
+		}, map[string]CheckStatus{"config": CheckFail}},
+		{"no cookie", func(cfg *Config, info map[string]interface{}) {
+			cfg.RPC.CookiePath = filepath.Join(cfg.ConfigDir, "missing")
+		}, map[string]CheckStatus{"cookie": CheckFail, "namecoind": CheckFail, "sample": CheckFail}},
+		{"readable private key", func(cfg *Config, info map[string]interface{}) {
+			os.Chmod(filepath.Join(cfg.ConfigDir, cfg.DNSSEC.PrivateKey), 0644)
+		}, map[string]CheckStatus{"keys": CheckWarn}},
+		{"wrong chain", func(cfg *Config, info map[string]interface{}) {
+			info["chain"] = "main"
+		}, map[string]CheckStatus{"namecoind": CheckFail}},
+		{"syncing", func(cfg *Config, info map[string]interface{}) {
+			info["headers"] = 500
+			info["initialblockdownload"] = true
+		}, map[string]CheckStatus{"sync": CheckWarn}},
+		{"clock behind", func(cfg *Config, info map[string]interface{}) {
+			info["mediantime"] = time.Now().Add(3 * time.Hour).Unix()
+		}, map[string]CheckStatus{"clock": CheckFail}},
+		{"stale blocks", func(cfg *Config, info map[string]interface{}) {
+			info["mediantime"] = time.Now().Add(-72 * time.Hour).Unix()
+		}, map[string]CheckStatus{"clock": CheckWarn}},
+		{"port in use", func(cfg *Config, info map[string]interface{}) {
+			cfg.BindAddresses = busy.Addr().String()
+		}, map[string]CheckStatus{"bind": CheckWarn}},
+		{"no templates", func(cfg *Config, info map[string]interface{}) {
+			cfg.TplPath = cfg.ConfigDir
+		}, map[string]CheckStatus{"templates": CheckFail}},
+	}
+
+	for _, test := range tests {
+		testDir, err := ioutil.TempDir(dir, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg := newDoctorTestConfig(t, testDir, strings.TrimPrefix(rpcSrv.URL, "http://"))
+		rpc.info = map[string]interface{}{
+			"chain":      "regtest",
+			"blocks":     150,
+			"headers":    150,
+			"mediantime": time.Now().Add(-time.Hour).Unix(),
+		}
+		test.modify(cfg, rpc.info)
+
+		report := Doctor(cfg, &DoctorOptions{SampleName: "example.bit"})
+
+		worst := CheckPass
+		for _, c := range report.Checks {
+			expected, ok := test.expected[c.Name]
+			if !ok {
+				expected = CheckPass
+			}
+			if c.Status != expected {
+				t.Errorf("%s: %s: got %s (%s), expected %s", test.name, c.Name, c.Status, c.Message, expected)
+			}
+			if c.Status != CheckPass && c.Hint == "" {
+				t.Errorf("%s: %s has no hint", test.name, c.Name)
+			}
+			if c.Status > worst {
+				worst = c.Status
+			}
+		}
+		if report.Status != worst {
+			t.Errorf("%s: got overall status %s, expected %s", test.name, report.Status, worst)
+		}
+
+		statuses := checkStatuses(report)
+		for name := range test.expected {
+			if _, ok := statuses[name]; !ok {
+				t.Errorf("%s: %s wasn't checked", test.name, name)
+			}
+		}
+		if test.name == "ok" {
+			for _, name := range []string{"config", "keys", "cookie", "namecoind", "sync", "clock", "templates", "bind", "sample"} {
+				if _, ok := statuses[name]; !ok {
+					t.Errorf("%s wasn't checked", name)
+				}
+			}
+		}
+	}
+}
+
+// Answers for bit. and example.bit as ncdns would, signed with ks, and with
+// signatures valid from the given time.
+func newSignedTestDNS(t *testing.T, ks *keySet, validFrom time.Time) (string, func()) {
+	sign := func(key *dns.DNSKEY, priv crypto.PrivateKey, rrset []dns.RR) dns.RR {
+		sig := &dns.RRSIG{
+			Hdr:        dns.RR_Header{Name: rrset[0].Header().Name, Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: 600},
+			Algorithm:  key.Algorithm,
+			KeyTag:     key.KeyTag(),
+			SignerName: key.Hdr.Name,
+			Inception:  uint32(validFrom.Unix()),
+			Expiration: uint32(validFrom.Add(2 * time.Hour).Unix()),
+		}
+		if err := sig.Sign(priv.(crypto.Signer), rrset); err != nil {
+			t.Error(err)
+		}
+		return sig
+	}
+
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		res := new(dns.Msg)
+		res.SetReply(req)
+		q := req.Question[0]
+		switch {
+		case q.Name == "bit." && q.Qtype == dns.TypeDNSKEY:
+			rrset := []dns.RR{ks.KSK, ks.ZSK}
+			res.Answer = append(rrset, sign(ks.KSK, ks.KSKPrivate, rrset))
+		case q.Name == "bit." && q.Qtype == dns.TypeSOA:
+			rrset := mustRRs(t, "bit. 600 IN SOA this.x--nmc.bit. hostmaster.example.com. 1 600 600 7200 600")
+			res.Answer = append(rrset, sign(ks.ZSK, ks.ZSKPrivate, rrset))
+		case q.Name == "example.bit." && q.Qtype == dns.TypeA:
+			rrset := mustRRs(t, "example.bit. 600 IN A 192.0.2.1")
+			res.Answer = append(rrset, sign(ks.ZSK, ks.ZSKPrivate, rrset))
+		default:
+			res.Rcode = dns.RcodeNameError
+		}
+		w.WriteMsg(res)
+	})
+
+	pc, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &dns.Server{PacketConn: pc, Handler: handler}
+	go srv.ActivateAndServe()
+
+	return pc.LocalAddr().String(), func() { srv.Shutdown() }
+}
+
+func TestDoctorRunning(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ncdns-doctor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := newDoctorTestConfig(t, dir, "127.0.0.1:1")
+	cfg.Fetcher = "static"
+	cfg.StaticDataDir = "."
+	cfg.HTTP.ListenAddr = ""
+
+	s, err := newServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := generateKeySet("bit.")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		ks        *keySet
+		validFrom time.Time
+		expected  map[string]CheckStatus
+	}{
+		{"ok", s.globalKeySet, time.Now().Add(-time.Hour), nil},
+		{"expired", s.globalKeySet, time.Now().Add(-3 * time.Hour), map[string]CheckStatus{"clock": CheckFail}},
+		{"other keys", other, time.Now().Add(-time.Hour), map[string]CheckStatus{"dnskey": CheckFail}},
+	}
+
+	for _, test := range tests {
+		addr, done := newSignedTestDNS(t, test.ks, test.validFrom)
+		report := Doctor(cfg, &DoctorOptions{Server: addr, SampleName: "example.bit", Timeout: 2 * time.Second})
+		done()
+
+		statuses := checkStatuses(report)
+		for _, name := range []string{"config", "keys", "dnskey", "soa", "sample"} {
+			if _, ok := statuses[name]; !ok {
+				t.Errorf("%s: %s wasn't checked", test.name, name)
+			}
+		}
+		if _, ok := statuses["bind"]; ok {
+			t.Errorf("%s: the ports were checked, though an instance was given", test.name)
+		}
+		for _, c := range report.Checks {
+			expected, ok := test.expected[c.Name]
+			if !ok {
+				expected = CheckPass
+			}
+			if c.Status != expected {
+				t.Errorf("%s: %s: got %s (%s), expected %s", test.name, c.Name, c.Status, c.Message, expected)
+			}
+		}
+	}
+
+	// Nothing answers at all.
+	report := Doctor(cfg, &DoctorOptions{Server: "127.0.0.1:1", Timeout: 100 * time.Millisecond})
+	if statuses := checkStatuses(report); statuses["query"] != CheckFail || report.Status != CheckFail {
+		t.Errorf("unreachable instance: got %+v", report.Checks)
+	}
+}
+
+func TestDoctorReportOutput(t *testing.T) {
+	r := &DoctorReport{}
+	r.add("config", CheckPass, "ignored", "the configuration is valid")
+	r.add("sync", CheckWarn, "wait", "namecoind is still syncing, at block %d of %d", 1, 2)
+
+	var text bytes.Buffer
+	r.WriteText(&text)
+	expected := "pass  config        the configuration is valid\n" +
+		"warn  sync          namecoind is still syncing, at block 1 of 2\n" +
+		"                    hint: wait\n" +
+		"overall: warn\n"
+	if text.String() != expected {
+		t.Errorf("got text\n%s\nexpected\n%s", text.String(), expected)
+	}
+
+	b, err := json.Marshal(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := string(b); s != `{"checks":[{"name":"config","status":"pass","message":"the configuration is valid"},{"name":"sync","status":"warn","message":"namecoind is still syncing, at block 1 of 2","hint":"wait"}],"status":"warn"}` {
+		t.Errorf("got JSON %s", s)
+	}
+}
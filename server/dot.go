@@ -0,0 +1,174 @@
+package server
+
+import (
+	"crypto/tls"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+
+	"github.com/namecoin/ncdns/clock"
+)
+
+// A TLS certificate and key loaded from files, which are loaded again when
+// either changes, e.g. when a certificate from Let's Encrypt is renewed.
+type certReloader struct {
+	certFile, keyFile string
+	clock             clock.Clock
+
+	mu       sync.RWMutex
+	cert     *tls.Certificate
+	modTimes [2]time.Time
+}
+
+func newCertReloader(certFile, keyFile string, clk clock.Clock) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile, clock: clock.Or(clk)}
+	if _, err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Loads the certificate and key if either file has changed since they were
+// last loaded. If they can't be loaded, the certificate previously loaded
+// stays in use.
+func (r *certReloader) reload() (changed bool, err error) {
+	var modTimes [2]time.Time
+	for i, fn := range []string{r.certFile, r.keyFile} {
+		fi, err := os.Stat(fn)
+		if err != nil {
+			return false, err
+		}
+		modTimes[i] = fi.ModTime()
+	}
+
+	r.mu.RLock()
+	unchanged := r.cert != nil && modTimes == r.modTimes
+	r.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return false, err
+	}
+
+	r.mu.Lock()
+	r.cert = &cert
+	r.modTimes = modTimes
+	r.mu.Unlock()
+
+	log.Info("loaded TLS certificate ", r.certFile)
+	return true, nil
+}
+
+func (r *certReloader) run(interval time.Duration) {
+	for {
+		<-r.clock.NewTimer(interval).C()
+		_, err := r.reload()
+		log.Warne(err, "couldn't reload TLS certificate ", r.certFile)
+	}
+}
+
+func (r *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.cert, nil
+}
+
+// Loads the certificate for DNS over TLS, if TLSBind is set, and sets up
+// those obtained from an ACME CA.
+func (s *Server) setupTLS() error {
+	if s.cfg.TLSBind == "" {
+		if s.cfg.ACMEHostnames != "" {
+			return configError("ACMEHostnames requires TLSBind")
+		}
+		return nil
+	}
+
+	if (s.cfg.TLSCert == "") != (s.cfg.TLSKey == "") {
+		return configError("TLSCert and TLSKey must be set together")
+	}
+	if s.cfg.TLSCert == "" && s.cfg.ACMEHostnames == "" {
+		return configError("TLSBind requires TLSCert and TLSKey, or ACMEHostnames")
+	}
+	if s.cfg.TLSCertReloadInterval < 0 {
+		return configError("TLSCertReloadInterval must not be negative")
+	}
+
+	if s.cfg.TLSCert != "" {
+		var err error
+		s.certReloader, err = newCertReloader(s.cfg.cpath(s.cfg.TLSCert), s.cfg.cpath(s.cfg.TLSKey), s.clock)
+		if err != nil {
+			return configError("Couldn't load TLSCert and TLSKey for TLSBind: %v", err)
+		}
+	}
+
+	return s.setupACME()
+}
+
+// Creates the TCP listeners for DNS over TLS on every address in the TLSBind
+// setting, as listen does for BindAddresses.
+func (s *Server) listenTLS() error {
+	if s.cfg.TLSBind == "" {
+		return nil
+	}
+
+	addrs, err := bindAddrs(s.cfg.TLSBind, net.LookupIP)
+	if err != nil {
+		return wrapError(ErrConfigInvalid, err)
+	}
+
+	var firstErr error
+	for i := range addrs {
+		l, err := net.ListenTCP("tcp"+addrs[i].family(), &net.TCPAddr{IP: addrs[i].ip, Port: addrs[i].port})
+		if err == nil {
+			s.tlsListeners = append(s.tlsListeners, l)
+			continue
+		}
+		if !addrs[i].wildcard {
+			return err
+		}
+
+		log.Warne(err, "couldn't listen for DNS over TLS on ", addrs[i].String())
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	if len(s.tlsListeners) == 0 {
+		return firstErr
+	}
+
+	return nil
+}
+
+// Returns the addresses the DNS over TLS listeners are bound to.
+func (s *Server) TLSAddrs() []*net.TCPAddr {
+	var addrs []*net.TCPAddr
+	for _, l := range s.tlsListeners {
+		addrs = append(addrs, l.Addr().(*net.TCPAddr))
+	}
+	return addrs
+}
+
+func (s *Server) tlsConfig() *tls.Config {
+	if s.acme != nil {
+		return &tls.Config{
+			MinVersion:     tls.VersionTLS12,
+			GetCertificate: s.acme.getCertificate,
+			// acme-tls/1 is offered only by the CA, for TLS-ALPN-01
+			// challenges.
+			NextProtos: []string{"dot", acme.ALPNProto},
+		}
+	}
+
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: s.certReloader.getCertificate,
+	}
+}
@@ -0,0 +1,190 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Writes a new self-signed certificate for 127.0.0.1 and its key to dir,
+// returning the certificate.
+func writeTestCert(t *testing.T, dir string, serial int64) *x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(serial),
+		Subject:               pkix.Name{CommonName: "ncdns"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err := ioutil.WriteFile(filepath.Join(dir, "dot.crt"), certPEM, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "dot.key"), keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+// Queries a DNS over TLS listener, trusting only cert, and returns the
+// certificate it presented.
+func queryTLS(t *testing.T, addr string, cert *x509.Certificate) (*dns.Msg, *x509.Certificate) {
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+
+	var presented *x509.Certificate
+	c := &dns.Client{
+		Net: "tcp-tls",
+		TLSConfig: &tls.Config{
+			RootCAs: roots,
+			VerifyPeerCertificate: func(rawCerts [][]byte, chains [][]*x509.Certificate) error {
+				presented = chains[0][0]
+				return nil
+			},
+		},
+		Timeout: 5 * time.Second,
+	}
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.bit.", dns.TypeA)
+	res, _, err := c.Exchange(req, addr)
+	if err != nil {
+		t.Fatalf("DNS over TLS query: %v", err)
+	}
+	return res, presented
+}
+
+func TestDNSOverTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ncdns-dot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := os.MkdirAll(filepath.Join(dir, "names", "d"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, "names", "d", "example.json"), []byte(`{"ip":"192.0.2.1"}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := writeTestCert(t, dir, 1)
+
+	cfg := newErrorTestConfig(dir)
+	cfg.Fetcher = "static"
+	cfg.StaticDataDir = "names"
+	cfg.TLSBind = "127.0.0.1:0"
+	cfg.TLSCert = "dot.crt"
+	cfg.TLSKey = "dot.key"
+	cfg.StopTimeout = 5
+
+	s, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	addr := s.TLSAddrs()[0].String()
+
+	res, presented := queryTLS(t, addr, first)
+	if len(res.Answer) == 0 {
+		t.Errorf("no answer in %v", res)
+	}
+	if presented.SerialNumber.Int64() != 1 {
+		t.Errorf("presented certificate %v", presented.SerialNumber)
+	}
+
+	// A renewed certificate is used for new connections once reloaded.
+	second := writeTestCert(t, dir, 2)
+	os.Chtimes(filepath.Join(dir, "dot.crt"), time.Now().Add(time.Minute), time.Now().Add(time.Minute))
+	if changed, err := s.certReloader.reload(); !changed || err != nil {
+		t.Fatalf("reload: changed %v, error %v", changed, err)
+	}
+	if _, presented = queryTLS(t, addr, second); presented.SerialNumber.Int64() != 2 {
+		t.Errorf("presented certificate %v after reload", presented.SerialNumber)
+	}
+
+	// A broken certificate isn't loaded, and the old one stays in use.
+	ioutil.WriteFile(filepath.Join(dir, "dot.crt"), []byte("garbage"), 0644)
+	os.Chtimes(filepath.Join(dir, "dot.crt"), time.Now().Add(2*time.Minute), time.Now().Add(2*time.Minute))
+	if _, err := s.certReloader.reload(); err == nil {
+		t.Errorf("broken certificate loaded")
+	}
+	if _, presented = queryTLS(t, addr, second); presented.SerialNumber.Int64() != 2 {
+		t.Errorf("presented certificate %v after failed reload", presented.SerialNumber)
+	}
+
+	if err := s.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatalf("DNS over TLS port not released: %v", err)
+	}
+	l.Close()
+}
+
+// TLSBind without a usable certificate is a configuration error.
+func TestDNSOverTLSMissingCert(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ncdns-dot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, files := range [][2]string{{"", ""}, {"dot.crt", "dot.key"}} {
+		cfg := newErrorTestConfig(dir)
+		cfg.TLSBind = "127.0.0.1:0"
+		cfg.TLSCert, cfg.TLSKey = files[0], files[1]
+
+		s, err := New(cfg)
+		if err == nil {
+			s.closeListeners()
+			t.Errorf("started with TLSCert %q and TLSKey %q", files[0], files[1])
+			continue
+		}
+		if !errors.Is(err, ErrConfigInvalid) {
+			t.Errorf("got %v, expected a configuration error", err)
+		}
+	}
+}
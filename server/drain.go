@@ -0,0 +1,81 @@
+package server
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/namecoin/ncdns/clock"
+)
+
+// How often to check whether queries in progress have been answered once the
+// drain window has elapsed.
+const drainPollInterval = 10 * time.Millisecond
+
+// Drain takes the server out of rotation ahead of planned maintenance. Health
+// checks fail immediately, so that load balancers stop sending it traffic,
+// and NotifyTargets are notified, but DNS queries continue to be answered for
+// d. Once d has elapsed and any queries in progress have been answered
+// (waiting at most d again for them), the server is stopped. Drain blocks
+// until then. If a drain is already in progress, Drain waits for it to finish
+// instead. Otherwise, the server must be running, and not in the middle of a
+// reload, or an error of kind ErrInvalidState is returned.
+func (s *Server) Drain(d time.Duration) error {
+	started, err := s.beginDrain()
+	if err != nil {
+		return err
+	}
+	if !started {
+		<-s.lifecycle.done()
+		return s.stop()
+	}
+
+	return s.drain(d)
+}
+
+// Moves the server to stateDraining. Returns false, without an error, if a
+// drain is already in progress.
+func (s *Server) beginDrain() (bool, error) {
+	from, err := s.lifecycle.transition("drain", stateDraining, nil)
+	if err != nil && from == stateDraining {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Answers queries for d, then stops the server once they've been answered.
+// Called once the server has been moved to stateDraining.
+func (s *Server) drain(d time.Duration) error {
+	log.Info("draining: failing health checks, answering queries for another ", d)
+	// So that secondaries have the latest zone before they're asked for it
+	// in place of this server.
+	if s.notifier != nil {
+		s.notifier.notifyAll()
+	}
+	<-clock.Or(s.clock).NewTimer(d).C()
+
+	if !s.waitIdle(d) {
+		log.Warnf("draining: %d queries still in progress, stopping anyway", atomic.LoadInt64(&s.inflight))
+	}
+
+	log.Info("draining: done, stopping")
+	return s.stop()
+}
+
+// Returns true while a drain is in progress.
+func (s *Server) isDraining() bool {
+	return s.lifecycle.current() == stateDraining
+}
+
+// Waits for DNS queries in progress to be answered. Returns false if there
+// are still queries in progress after timeout.
+func (s *Server) waitIdle(timeout time.Duration) bool {
+	clk := clock.Or(s.clock)
+	deadline := clk.Now().Add(timeout)
+	for atomic.LoadInt64(&s.inflight) > 0 {
+		if clk.Now().After(deadline) {
+			return false
+		}
+		<-clk.NewTimer(drainPollInterval).C()
+	}
+	return true
+}
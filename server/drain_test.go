@@ -0,0 +1,58 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/namecoin/ncdns/backend"
+)
+
+func newDrainTestServer(t *testing.T) *Server {
+	b, err := backend.New(&backend.Config{
+		CacheMaxEntries: 100,
+		FakeNames: map[string]string{
+			"d/example":     `{"ip":["192.0.2.1"]}`,
+			"d/nonexistent": "NX",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e, err := newEngine(b, &keySet{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Server{
+		backend:      b,
+		globalKeySet: &keySet{},
+		mux:          dns.NewServeMux(),
+	}
+	s.mux.Handle(".", e)
+	markRunning(s)
+	return s
+}
+
+// Stop doesn't drain the server, even with DrainOnSIGTERM set, which only the
+// daemon acts on.
+func TestStopDoesntDrain(t *testing.T) {
+	s := newDrainTestServer(t)
+	s.cfg.DrainOnSIGTERM = true
+	s.cfg.DrainDuration = 3600
+
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- s.Stop()
+	}()
+	select {
+	case err := <-stopped:
+		if err != nil {
+			t.Errorf("stop failed: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("stop drained the server")
+	}
+}
@@ -0,0 +1,87 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/miekg/dns"
+)
+
+// The digest types of the DS records exported for the KSK.
+var dsDigestTypes = []uint8{dns.SHA256, dns.SHA384}
+
+// Returns the DS records of the global KSK, which the parent zone publishes
+// to make a chain of trust to the zone, or nil if there's no KSK.
+func (s *Server) kskDS() []*dns.DS {
+	ks := s.globalKeys()
+	if ks == nil || ks.KSK == nil {
+		return nil
+	}
+
+	var dss []*dns.DS
+	for _, t := range dsDigestTypes {
+		if ds := ks.KSK.ToDS(t); ds != nil {
+			dss = append(dss, ds)
+		}
+	}
+	return dss
+}
+
+// Returns the DS records in zone file syntax, one to a line.
+func formatDS(dss []*dns.DS) []byte {
+	var b bytes.Buffer
+	for _, ds := range dss {
+		fmt.Fprintln(&b, ds.String())
+	}
+	return b.Bytes()
+}
+
+// Logs the DS records of the KSK and writes them to DSRecordsFile, so that
+// they needn't be worked out from the KSK to set up the chain of trust.
+// Called at startup and whenever the keys change. Without a KSK, nothing is
+// written, and a file written before, e.g. before a reload removed the KSK,
+// is removed.
+func (s *Server) exportDS() {
+	dss := s.kskDS()
+	for _, ds := range dss {
+		log.Infof("DS record of the KSK: %s", ds)
+	}
+	if s.cfg.DNSSEC.DSRecordsFile == "" {
+		return
+	}
+
+	s.dsExportMu.Lock()
+	defer s.dsExportMu.Unlock()
+
+	fn := s.cfg.cpath(s.cfg.DNSSEC.DSRecordsFile)
+	if dss == nil {
+		if s.dsExported {
+			log.Warne(os.Remove(fn), "couldn't remove the DS records of the KSK from ", fn)
+			s.dsExported = false
+		}
+		return
+	}
+
+	err := ioutil.WriteFile(fn+".tmp", formatDS(dss), 0644)
+	if err == nil {
+		err = os.Rename(fn+".tmp", fn)
+	}
+	if err != nil {
+		log.Warne(err, "couldn't write the DS records of the KSK to ", fn)
+		return
+	}
+	s.dsExported = true
+}
+
+// Keeps DSRecordsFile up to date as the keys change, by a reload or a ZSK
+// rollover.
+func (s *Server) setupDSExport() {
+	s.bus.subscribeAsync("DS records", func(ev interface{}) {
+		switch ev.(type) {
+		case *keysReloaded, *configReloaded:
+			s.exportDS()
+		}
+	})
+}
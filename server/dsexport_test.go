@@ -0,0 +1,25 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Nothing is written for a server which never had a KSK.
+func TestExportDSWithoutKSK(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ncdns-ds")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := newDrainTestServer(t)
+	s.cfg.ConfigDir = dir
+	s.cfg.DNSSEC.DSRecordsFile = "ds-records.txt"
+	s.exportDS()
+	if _, err := os.Stat(filepath.Join(dir, "ds-records.txt")); !os.IsNotExist(err) {
+		t.Errorf("DS records written without a KSK: %v", err)
+	}
+}
@@ -0,0 +1,415 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/namecoin/ncdns/clock"
+)
+
+// A query over TCP for the same question from the same client within this
+// long of a truncated response over UDP is counted as retrying it.
+const truncationRetryWindow = 30 * time.Second
+
+// The most truncated responses waiting for a retry over TCP to be tracked.
+// Beyond this, truncated responses are counted, but retries of them aren't.
+const maxTruncationsTracked = 10000
+
+// Counts of the queries whose clients would be affected by stricter EDNS
+// handling, as checked on DNS Flag Day: those without EDNS, with an EDNS
+// version ncdns doesn't support, or with EDNS flags it doesn't know, and
+// whether clients retry over TCP when a response over UDP is truncated, and
+// how many queries carry the EDNS Client Subnet option, which ncdns ignores,
+// since it answers every client alike.
+type ednsStats struct {
+	counts ednsCounts // accessed atomically
+
+	clock clock.Clock
+
+	mu        sync.Mutex
+	truncated map[truncationKey]time.Time
+}
+
+type ednsCounts struct {
+	Queries      uint64 `json:"queries"`
+	NoEDNS       uint64 `json:"no_edns"`
+	BadVersion   uint64 `json:"bad_version"`
+	UnknownFlags uint64 `json:"unknown_flags"`
+	Truncated    uint64 `json:"truncated"`
+	TCPRetries   uint64 `json:"tcp_retries"`
+	ClientSubnet uint64 `json:"client_subnet"`
+	BadSubnet    uint64 `json:"bad_client_subnet"`
+}
+
+type truncationKey struct {
+	client string
+	q      dns.Question
+}
+
+func newEDNSStats(clk clock.Clock) *ednsStats {
+	return &ednsStats{truncated: map[truncationKey]time.Time{}, clock: clock.Or(clk)}
+}
+
+func (st *ednsStats) Status() ednsCounts {
+	return ednsCounts{
+		Queries:      atomic.LoadUint64(&st.counts.Queries),
+		NoEDNS:       atomic.LoadUint64(&st.counts.NoEDNS),
+		BadVersion:   atomic.LoadUint64(&st.counts.BadVersion),
+		UnknownFlags: atomic.LoadUint64(&st.counts.UnknownFlags),
+		Truncated:    atomic.LoadUint64(&st.counts.Truncated),
+		TCPRetries:   atomic.LoadUint64(&st.counts.TCPRetries),
+		ClientSubnet: atomic.LoadUint64(&st.counts.ClientSubnet),
+		BadSubnet:    atomic.LoadUint64(&st.counts.BadSubnet),
+	}
+}
+
+// Counts the EDNS of a query, and whether it retries a truncated response.
+func (st *ednsStats) query(req *dns.Msg, key truncationKey, tcp bool, now time.Time) {
+	atomic.AddUint64(&st.counts.Queries, 1)
+
+	switch opt := req.IsEdns0(); {
+	case opt == nil:
+		atomic.AddUint64(&st.counts.NoEDNS, 1)
+	case opt.Version() > 0:
+		atomic.AddUint64(&st.counts.BadVersion, 1)
+	case opt.Z() != 0:
+		atomic.AddUint64(&st.counts.UnknownFlags, 1)
+	}
+	if hasClientSubnet(req) {
+		atomic.AddUint64(&st.counts.ClientSubnet, 1)
+	}
+
+	if !tcp {
+		return
+	}
+
+	st.mu.Lock()
+	t, ok := st.truncated[key]
+	if ok {
+		delete(st.truncated, key)
+	}
+	st.mu.Unlock()
+
+	if ok && now.Sub(t) <= truncationRetryWindow {
+		atomic.AddUint64(&st.counts.TCPRetries, 1)
+	}
+}
+
+// Records a truncated response over UDP, to be matched with a retry.
+func (st *ednsStats) truncatedResponse(key truncationKey, now time.Time) {
+	atomic.AddUint64(&st.counts.Truncated, 1)
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if len(st.truncated) >= maxTruncationsTracked {
+		st.expire(now)
+	}
+	if len(st.truncated) < maxTruncationsTracked {
+		st.truncated[key] = now
+	}
+}
+
+// Forgets truncated responses which are too old to be retried. Must be
+// called with mu held.
+func (st *ednsStats) expire(now time.Time) {
+	for k, t := range st.truncated {
+		if now.Sub(t) > truncationRetryWindow {
+			delete(st.truncated, k)
+		}
+	}
+}
+
+// Logs a summary of the queries counted in each interval.
+func (st *ednsStats) run(interval time.Duration) {
+	last := st.Status()
+	for {
+		<-st.clock.NewTimer(interval).C()
+
+		st.mu.Lock()
+		st.expire(st.clock.Now())
+		st.mu.Unlock()
+
+		cur := st.Status()
+		st.report(interval, cur, last)
+		last = cur
+	}
+}
+
+func (st *ednsStats) report(interval time.Duration, cur, last ednsCounts) {
+	n := cur.Queries - last.Queries
+	if n == 0 {
+		return
+	}
+
+	retried := "none were truncated"
+	if truncated := cur.Truncated - last.Truncated; truncated > 0 {
+		retried = fmt.Sprintf("%s of %d truncated were retried over TCP", percentOf(cur.TCPRetries-last.TCPRetries, truncated), truncated)
+	}
+
+	log.Infof("EDNS over the last %v: %d queries, %s without EDNS, %s with an EDNS version above 0 (answered BADVERS), %s with unknown EDNS flags, %s with EDNS Client Subnet (%d malformed, answered FORMERR); %s",
+		interval, n, percentOf(cur.NoEDNS-last.NoEDNS, n), percentOf(cur.BadVersion-last.BadVersion, n),
+		percentOf(cur.UnknownFlags-last.UnknownFlags, n), percentOf(cur.ClientSubnet-last.ClientSubnet, n),
+		cur.BadSubnet-last.BadSubnet, retried)
+}
+
+func percentOf(n, total uint64) string {
+	return fmt.Sprintf("%.1f%%", 100*float64(n)/float64(total))
+}
+
+// Wraps rw so that the query and its response are counted in the EDNS
+// statistics, and EDNS flags the client set which ncdns doesn't know aren't
+// echoed in the response, as RFC 6891 requires.
+func (s *Server) ednsWriter(rw dns.ResponseWriter, req *dns.Msg) dns.ResponseWriter {
+	if s.ednsStats == nil || len(req.Question) == 0 {
+		return rw
+	}
+
+	q := req.Question[0]
+	q.Name = strings.ToLower(q.Name)
+	key := truncationKey{client: clientIP(rw).String(), q: q}
+	tcp := s.transport(rw) != "udp"
+	s.ednsStats.query(req, key, tcp, s.ednsStats.clock.Now())
+
+	return &ednsWriter{ResponseWriter: rw, st: s.ednsStats, key: key, tcp: tcp}
+}
+
+type ednsWriter struct {
+	dns.ResponseWriter
+	st  *ednsStats
+	key truncationKey
+	tcp bool
+}
+
+func (rw *ednsWriter) WriteMsg(m *dns.Msg) error {
+	if opt := m.IsEdns0(); opt != nil {
+		opt.SetZ(0)
+	}
+	if m.Truncated && !rw.tcp {
+		rw.st.truncatedResponse(rw.key, rw.st.clock.Now())
+	}
+
+	return rw.ResponseWriter.WriteMsg(m)
+}
+
+// Answers a query with an EDNS version above 0, the only one ncdns supports,
+// with BADVERS and an OPT record giving version 0, as RFC 6891 requires,
+// rather than answering its question. Returns false for any other query.
+func (s *Server) serveBadEDNSVersion(rw dns.ResponseWriter, req *dns.Msg) bool {
+	opt := req.IsEdns0()
+	if opt == nil || opt.Version() == 0 {
+		return false
+	}
+
+	m := new(dns.Msg)
+	m.SetRcode(req, dns.RcodeBadVers)
+	m.SetEdns0(s.ednsUDPSize(), false)
+	rw.WriteMsg(m)
+	return true
+}
+
+// Returns the EDNS Client Subnet option of req, or nil if it has none, or an
+// error if the option is malformed in a way RFC 7871 says is answered
+// FORMERR. Options whose family or prefix lengths are out of range don't get
+// this far, as the whole query fails to unpack, which is answered FORMERR too.
+func clientSubnet(req *dns.Msg) (*dns.EDNS0_SUBNET, error) {
+	opt := req.IsEdns0()
+	if opt == nil {
+		return nil, nil
+	}
+
+	var ecs *dns.EDNS0_SUBNET
+	for _, o := range opt.Option {
+		e, ok := o.(*dns.EDNS0_SUBNET)
+		if !ok {
+			continue
+		}
+		if ecs != nil {
+			return nil, errors.New("more than one client subnet option")
+		}
+		ecs = e
+	}
+	if ecs == nil {
+		return nil, nil
+	}
+
+	bits := 0
+	switch ecs.Family {
+	case 1:
+		bits = 8 * net.IPv4len
+	case 2:
+		bits = 8 * net.IPv6len
+	default:
+		return nil, fmt.Errorf("unknown client subnet family %d", ecs.Family)
+	}
+	if ecs.SourceScope != 0 {
+		return nil, errors.New("client subnet scope prefix length set in a query")
+	}
+	if int(ecs.SourceNetmask) > bits {
+		return nil, fmt.Errorf("client subnet prefix length %d too long", ecs.SourceNetmask)
+	}
+	ip := ecs.Address.To16()
+	if bits == 8*net.IPv4len {
+		ip = ecs.Address.To4()
+	}
+	if ip == nil {
+		return nil, errors.New("client subnet address doesn't match its family")
+	}
+	if !ip.Mask(net.CIDRMask(int(ecs.SourceNetmask), bits)).Equal(ip) {
+		return nil, errors.New("client subnet address has bits set beyond its prefix length")
+	}
+	return ecs, nil
+}
+
+func hasClientSubnet(req *dns.Msg) bool {
+	if opt := req.IsEdns0(); opt != nil {
+		for _, o := range opt.Option {
+			if o.Option() == dns.EDNS0SUBNET {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Answers a query with a malformed EDNS Client Subnet option with FORMERR, as
+// RFC 7871 requires, rather than answering its question, unless
+// EDNSStripClientSubnet is set, in which case the option is ignored as if
+// ncdns didn't support it at all. Returns false for any other query.
+func (s *Server) serveBadClientSubnet(rw dns.ResponseWriter, req *dns.Msg) bool {
+	if s.cfg.EDNSStripClientSubnet {
+		return false
+	}
+	_, err := clientSubnet(req)
+	if err == nil {
+		return false
+	}
+	if s.ednsStats != nil {
+		atomic.AddUint64(&s.ednsStats.counts.BadSubnet, 1)
+	}
+
+	m := new(dns.Msg)
+	m.SetRcode(req, dns.RcodeFormatError)
+	m.SetEdns0(s.ednsUDPSize(), false)
+	rw.WriteMsg(m)
+	return true
+}
+
+// Returns the EDNS Client Subnet option to send in the response to req, or
+// nil if none is. As ncdns gives every client the same answers, this echoes
+// the query's family, prefix length and address with a scope prefix length
+// of 0, which tells resolvers they can cache the answer for every client. If
+// EDNSStripClientSubnet is set, no option is sent, so that the client's
+// subnet isn't repeated back over the network.
+func (s *Server) clientSubnetResponse(req *dns.Msg) *dns.EDNS0_SUBNET {
+	if s.cfg.EDNSStripClientSubnet {
+		return nil
+	}
+	ecs, err := clientSubnet(req)
+	if ecs == nil || err != nil {
+		return nil
+	}
+	return &dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		Family:        ecs.Family,
+		SourceNetmask: ecs.SourceNetmask,
+		SourceScope:   0,
+		Address:       ecs.Address,
+	}
+}
+
+// Returns options, without any EDNS Client Subnet option, with ecs added
+// unless it's nil. options itself isn't changed, since it may be shared.
+func withClientSubnet(options []dns.EDNS0, ecs *dns.EDNS0_SUBNET) []dns.EDNS0 {
+	res := make([]dns.EDNS0, 0, len(options)+1)
+	for _, o := range options {
+		if o.Option() != dns.EDNS0SUBNET {
+			res = append(res, o)
+		}
+	}
+	if ecs != nil {
+		res = append(res, ecs)
+	}
+	return res
+}
+
+// The largest response sent over UDP if EDNSMaxUDPSize is left at 0, as in a
+// Config made in code rather than loaded: the size DNS Flag Day 2020 settled
+// on, which avoids IP fragmentation on nearly all networks.
+const defaultEDNSMaxUDPSize = 1232
+
+// Checks EDNSMaxUDPSize and EDNSPadding.
+func (s *Server) setupEDNS() error {
+	if s.cfg.EDNSMaxUDPSize == 0 {
+		s.cfg.EDNSMaxUDPSize = defaultEDNSMaxUDPSize
+	}
+	if s.cfg.EDNSMaxUDPSize < dns.MinMsgSize || s.cfg.EDNSMaxUDPSize > dns.MaxMsgSize {
+		return fmt.Errorf("EDNSMaxUDPSize must be between %d and %d", dns.MinMsgSize, dns.MaxMsgSize)
+	}
+	if s.cfg.EDNSPadding < 0 || s.cfg.EDNSPadding > dns.MaxMsgSize {
+		return fmt.Errorf("EDNSPadding must be between 0 and %d", dns.MaxMsgSize)
+	}
+	return nil
+}
+
+// The EDNS buffer size advertised in responses, and the most sent over UDP.
+func (s *Server) ednsUDPSize() uint16 {
+	if s.cfg.EDNSMaxUDPSize == 0 {
+		return defaultEDNSMaxUDPSize
+	}
+	return uint16(s.cfg.EDNSMaxUDPSize)
+}
+
+// Returns the block size to a multiple of which the response to req is
+// padded, or 0 if it isn't. As RFC 7830 requires, only responses to padded
+// queries are, and as RFC 8467 recommends, only over encrypted transports,
+// since over UDP and TCP anyone who can see the size can see the names too.
+func (s *Server) paddingBlockSize(rw dns.ResponseWriter, req *dns.Msg) int {
+	if s.cfg.EDNSPadding == 0 {
+		return 0
+	}
+	opt := req.IsEdns0()
+	if opt == nil || s.transport(rw) != "tls" {
+		return 0
+	}
+	for _, o := range opt.Option {
+		if o.Option() == dns.EDNS0PADDING {
+			return s.cfg.EDNSPadding
+		}
+	}
+	return 0
+}
+
+// Pads m, a response with an OPT record, with the EDNS padding option to a
+// multiple of block bytes, replacing any padding it has. The OPT record is
+// replaced rather than changed, since it may be shared.
+func padResponse(m *dns.Msg, block int) {
+	for i := len(m.Extra) - 1; i >= 0; i-- {
+		opt, ok := m.Extra[i].(*dns.OPT)
+		if !ok {
+			continue
+		}
+
+		padding := &dns.EDNS0_PADDING{}
+		padded := &dns.OPT{Hdr: opt.Hdr, Option: make([]dns.EDNS0, 0, len(opt.Option)+1)}
+		for _, o := range opt.Option {
+			if o.Option() != dns.EDNS0PADDING {
+				padded.Option = append(padded.Option, o)
+			}
+		}
+		padded.Option = append(padded.Option, padding)
+		m.Extra[i] = padded
+
+		if n := m.Len() % block; n != 0 {
+			padding.Padding = make([]byte, block-n)
+		}
+		return
+	}
+}
@@ -0,0 +1,360 @@
+package server
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/namecoin/ncdns/backend"
+)
+
+func newEDNSTestServer(t *testing.T) *Server {
+	var ips []string
+	for i := 1; i <= 60; i++ {
+		ips = append(ips, fmt.Sprintf("192.0.2.%d", i))
+	}
+	big, err := json.Marshal(map[string]interface{}{"ip": ips})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	be, err := backend.New(&backend.Config{
+		CacheMaxEntries: 100,
+		FakeNames: map[string]string{
+			"d/example": `{"ip":"192.0.2.1"}`,
+			"d/big":     string(big),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Server{
+		backend:   be,
+		mux:       dns.NewServeMux(),
+		ednsStats: newEDNSStats(nil),
+	}
+	s.mux.Handle(".", &testSigningEngine{b: be, ks: &keySet{}})
+	return s
+}
+
+func TestBadEDNSVersion(t *testing.T) {
+	s := newEDNSTestServer(t)
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.bit.", dns.TypeA)
+	req.SetEdns0(4096, true)
+	req.IsEdns0().SetVersion(1)
+
+	rw := &fakeResponseWriter{}
+	s.ServeDNS(rw, req)
+	if rw.msg == nil {
+		t.Fatal("no response")
+	}
+
+	// The extended rcode is carried in the OPT record, so check it as sent.
+	wire, err := rw.msg.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := new(dns.Msg)
+	if err := m.Unpack(wire); err != nil {
+		t.Fatal(err)
+	}
+
+	if m.Rcode != dns.RcodeBadVers {
+		t.Errorf("got rcode %s, expected BADVERS", dns.RcodeToString[m.Rcode])
+	}
+	if m.Id != req.Id || len(m.Answer) != 0 || len(m.Ns) != 0 {
+		t.Errorf("got response %v", m)
+	}
+	opt := m.IsEdns0()
+	if opt == nil || len(m.Extra) != 1 {
+		t.Fatalf("expected only an OPT record, got %v", m.Extra)
+	}
+	if opt.Version() != 0 || len(opt.Option) != 0 {
+		t.Errorf("got OPT %v, expected version 0 and no options", opt)
+	}
+
+	if st := s.ednsStats.Status(); st.Queries != 1 || st.BadVersion != 1 {
+		t.Errorf("got counts %+v", st)
+	}
+}
+
+func TestEDNSFlags(t *testing.T) {
+	s := newEDNSTestServer(t)
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.bit.", dns.TypeA)
+	req.SetEdns0(4096, true)
+	req.IsEdns0().SetZ(0x4000)
+
+	rw := &fakeResponseWriter{}
+	s.ServeDNS(rw, req)
+	if rw.msg == nil || rw.msg.Rcode != dns.RcodeSuccess || len(rw.msg.Answer) == 0 {
+		t.Fatalf("got response %v", rw.msg)
+	}
+	if opt := rw.msg.IsEdns0(); opt != nil && opt.Z() != 0 {
+		t.Errorf("unknown flags %#x echoed in the response", opt.Z())
+	}
+
+	req = new(dns.Msg)
+	req.SetQuestion("example.bit.", dns.TypeA)
+	s.ServeDNS(&fakeResponseWriter{}, req)
+
+	if st := s.ednsStats.Status(); st.Queries != 2 || st.UnknownFlags != 1 || st.NoEDNS != 1 || st.BadVersion != 0 {
+		t.Errorf("got counts %+v", st)
+	}
+}
+
+func TestEDNSClientSubnet(t *testing.T) {
+	s := newEDNSTestServer(t)
+
+	query := func(ecs ...*dns.EDNS0_SUBNET) *dns.Msg {
+		req := new(dns.Msg)
+		req.SetQuestion("example.bit.", dns.TypeA)
+		req.SetEdns0(4096, true)
+		opt := req.IsEdns0()
+		for _, e := range ecs {
+			opt.Option = append(opt.Option, e)
+		}
+		rw := &fakeResponseWriter{}
+		s.ServeDNS(rw, req)
+		if rw.msg == nil {
+			t.Fatal("no response")
+		}
+		return rw.msg
+	}
+	subnet := func(family uint16, netmask, scope uint8, addr string) *dns.EDNS0_SUBNET {
+		return &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: family, SourceNetmask: netmask, SourceScope: scope, Address: net.ParseIP(addr)}
+	}
+	echoed := func(m *dns.Msg) *dns.EDNS0_SUBNET {
+		if opt := m.IsEdns0(); opt != nil {
+			for _, o := range opt.Option {
+				if e, ok := o.(*dns.EDNS0_SUBNET); ok {
+					return e
+				}
+			}
+		}
+		return nil
+	}
+
+	for _, ecs := range []*dns.EDNS0_SUBNET{
+		subnet(1, 24, 0, "192.0.2.0"),
+		subnet(2, 56, 0, "2001:db8:0:100::"),
+		subnet(1, 0, 0, "0.0.0.0"),
+	} {
+		m := query(ecs)
+		if m.Rcode != dns.RcodeSuccess || len(m.Answer) == 0 {
+			t.Fatalf("%v: got response %v", ecs, m)
+		}
+		e := echoed(m)
+		if e == nil || e.Family != ecs.Family || e.SourceNetmask != ecs.SourceNetmask || e.SourceScope != 0 || !e.Address.Equal(ecs.Address) {
+			t.Errorf("%v: got client subnet %v in the response", ecs, e)
+		}
+	}
+
+	for _, ecs := range [][]*dns.EDNS0_SUBNET{
+		{subnet(1, 24, 16, "192.0.2.0")},
+		{subnet(1, 24, 0, "192.0.2.1")},
+		{subnet(2, 32, 0, "192.0.2.0")},
+		{subnet(1, 24, 0, "192.0.2.0"), subnet(1, 16, 0, "192.0.0.0")},
+	} {
+		if m := query(ecs...); m.Rcode != dns.RcodeFormatError || len(m.Answer) != 0 {
+			t.Errorf("%v: got response %v, expected FORMERR", ecs, m)
+		}
+	}
+
+	if m := query(); echoed(m) != nil {
+		t.Errorf("client subnet added to a response to a query without one")
+	}
+	if st := s.ednsStats.Status(); st.Queries != 8 || st.ClientSubnet != 7 || st.BadSubnet != 4 {
+		t.Errorf("got counts %+v", st)
+	}
+
+	// Stripped, the option is neither echoed nor checked.
+	s.cfg.EDNSStripClientSubnet = true
+	if m := query(subnet(1, 24, 0, "192.0.2.0")); echoed(m) != nil {
+		t.Errorf("client subnet echoed with EDNSStripClientSubnet set")
+	}
+	if m := query(subnet(1, 24, 0, "192.0.2.1")); m.Rcode != dns.RcodeSuccess {
+		t.Errorf("got %s with EDNSStripClientSubnet set", dns.RcodeToString[m.Rcode])
+	}
+	if st := s.ednsStats.Status(); st.ClientSubnet != 9 || st.BadSubnet != 4 {
+		t.Errorf("got counts %+v", st)
+	}
+}
+
+func TestTruncationRetries(t *testing.T) {
+	s := newEDNSTestServer(t)
+
+	client := net.ParseIP("192.0.2.100")
+	query := func(qname string, addr net.Addr) *dns.Msg {
+		req := new(dns.Msg)
+		req.SetQuestion(qname, dns.TypeA)
+		rw := &fakeResponseWriter{addr: addr}
+		s.ServeDNS(rw, req)
+		if rw.msg == nil {
+			t.Fatalf("no response to %s", qname)
+		}
+		return rw.msg
+	}
+	udp := &net.UDPAddr{IP: client, Port: 1234}
+	tcp := &net.TCPAddr{IP: client, Port: 1234}
+
+	if m := query("big.bit.", udp); !m.Truncated {
+		t.Fatalf("expected a truncated response, got %v", m)
+	}
+	if m := query("BIG.bit.", tcp); m.Truncated {
+		t.Fatalf("got a truncated response over TCP")
+	}
+	// Neither a second query over TCP nor one for a response which wasn't
+	// truncated is a retry.
+	query("big.bit.", tcp)
+	query("example.bit.", udp)
+	query("example.bit.", tcp)
+
+	if st := s.ednsStats.Status(); st.Truncated != 1 || st.TCPRetries != 1 {
+		t.Errorf("got counts %+v", st)
+	}
+
+	// Nor is a query long after the truncated response.
+	query("big.bit.", udp)
+	s.ednsStats.mu.Lock()
+	for k := range s.ednsStats.truncated {
+		s.ednsStats.truncated[k] = time.Now().Add(-2 * truncationRetryWindow)
+	}
+	s.ednsStats.mu.Unlock()
+	query("big.bit.", tcp)
+
+	if st := s.ednsStats.Status(); st.Truncated != 2 || st.TCPRetries != 1 {
+		t.Errorf("got counts %+v", st)
+	}
+}
+
+// Returns a response to a DNSKEY query for bit. with an RRset of keys too
+// large to fit in 1232 bytes, as a zone with several 4096-bit RSA keys has.
+func largeDNSKEYResponse(req *dns.Msg) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetReply(req)
+	m.Authoritative = true
+	m.SetEdns0(4096, true)
+
+	hdr := dns.RR_Header{Name: "bit.", Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 600}
+	for i := 0; i < 4; i++ {
+		m.Answer = append(m.Answer, &dns.DNSKEY{
+			Hdr:       hdr,
+			Flags:     256,
+			Protocol:  3,
+			Algorithm: dns.RSASHA256,
+			PublicKey: base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{byte(i + 1)}, 516)),
+		})
+	}
+	hdr.Rrtype = dns.TypeRRSIG
+	m.Answer = append(m.Answer, &dns.RRSIG{
+		Hdr:         hdr,
+		TypeCovered: dns.TypeDNSKEY,
+		Algorithm:   dns.RSASHA256,
+		Labels:      1,
+		OrigTtl:     600,
+		Expiration:  2000000000,
+		Inception:   1000000000,
+		KeyTag:      12345,
+		SignerName:  "bit.",
+		Signature:   base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{0xff}, 512)),
+	})
+	return m
+}
+
+func TestEDNSMaxUDPSize(t *testing.T) {
+	s := &Server{cfg: Config{EDNSMaxUDPSize: 1232}}
+
+	req := new(dns.Msg)
+	req.SetQuestion("bit.", dns.TypeDNSKEY)
+	req.SetEdns0(4096, true)
+	m := largeDNSKEYResponse(req)
+	if n := m.Len(); n <= 1232 || n > 4096 {
+		t.Fatalf("response of %d bytes doesn't test the limit", n)
+	}
+
+	// Over UDP, the response is truncated at EDNSMaxUDPSize though the
+	// client gives a larger buffer size.
+	frw := &fakeResponseWriter{}
+	s.sectionWriter(frw, req).WriteMsg(m)
+	if !frw.msg.Truncated || frw.msg.Len() > 1232 {
+		t.Errorf("response of %d bytes not truncated to 1232: TC %v", frw.msg.Len(), frw.msg.Truncated)
+	}
+	if opt := frw.msg.IsEdns0(); opt == nil || opt.UDPSize() != 1232 {
+		t.Errorf("got OPT %v, expected a buffer size of 1232", opt)
+	}
+
+	// Over TCP, it fits.
+	frw = &fakeResponseWriter{addr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53}}
+	s.sectionWriter(frw, req).WriteMsg(largeDNSKEYResponse(req))
+	if frw.msg.Truncated || len(frw.msg.Answer) != 5 {
+		t.Errorf("TCP response truncated: TC %v, %d answers", frw.msg.Truncated, len(frw.msg.Answer))
+	}
+
+	for _, size := range []int{100, 512, 65535} {
+		s := &Server{cfg: Config{EDNSMaxUDPSize: size}}
+		if err := s.setupEDNS(); (err == nil) != (size != 100) {
+			t.Errorf("EDNSMaxUDPSize %d: got %v", size, err)
+		}
+	}
+}
+
+func TestEDNSPadding(t *testing.T) {
+	tls, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tls.Close()
+	s := &Server{cfg: Config{EDNSPadding: 468}, tlsListeners: []net.Listener{tls}}
+
+	tcp := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1234}
+	for _, test := range []struct {
+		name   string
+		rw     *localAddrWriter
+		padded bool // whether the query is
+		expect bool // whether the response should be
+	}{
+		{"TLS", &localAddrWriter{&fakeResponseWriter{addr: tcp}, tls.Addr()}, true, true},
+		{"TLS, unpadded query", &localAddrWriter{&fakeResponseWriter{addr: tcp}, tls.Addr()}, false, false},
+		{"TCP", &localAddrWriter{&fakeResponseWriter{addr: tcp}, &net.TCPAddr{Port: 53}}, true, false},
+		{"UDP", &localAddrWriter{&fakeResponseWriter{}, &net.UDPAddr{Port: 53}}, true, false},
+	} {
+		req := new(dns.Msg)
+		req.SetQuestion("example.bit.", dns.TypeA)
+		req.SetEdns0(4096, true)
+		if test.padded {
+			opt := req.IsEdns0()
+			opt.Option = append(opt.Option, &dns.EDNS0_PADDING{Padding: make([]byte, 50)})
+		}
+		m := testReply("example.bit.", dns.TypeA, dns.RcodeSuccess)
+		m.SetEdns0(4096, true)
+		m.Answer = mustRRs(t, "example.bit. 600 IN A 192.0.2.1")
+
+		s.sectionWriter(test.rw, req).WriteMsg(m)
+		res := test.rw.msg
+		padded := false
+		for _, o := range res.IsEdns0().Option {
+			padded = padded || o.Option() == dns.EDNS0PADDING
+		}
+		if padded != test.expect {
+			t.Errorf("%s: padded %v, expected %v", test.name, padded, test.expect)
+		}
+		if padded && res.Len()%468 != 0 {
+			t.Errorf("%s: response of %d bytes isn't padded to a multiple of 468", test.name, res.Len())
+		}
+		// The OPT record of the response given isn't changed.
+		if len(m.IsEdns0().Option) != 0 {
+			t.Errorf("%s: padding added to the OPT record written", test.name)
+		}
+	}
+}
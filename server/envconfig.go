@@ -0,0 +1,162 @@
+package server
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Prefix of the environment variables from which options are read, e.g.
+// NCDNS_BINDADDRESSES for BindAddresses.
+const EnvPrefix = "NCDNS_"
+
+// Environment variables under EnvPrefix which aren't options.
+var nonOptionEnv = map[string]bool{
+	EnvPrefix + "CONF":       true, // read by the configuration file loader
+	EnvPrefix + "LOG_FORMAT": true, // see main
+}
+
+// Returns the options of Config: its exported fields with a usage tag, by key
+// (the lower-cased field name, as in the configuration file and flags).
+func configOptions() map[string]reflect.StructField {
+	opts := map[string]reflect.StructField{}
+	for _, f := range optionFields() {
+		opts[strings.ToLower(f.Name)] = f
+	}
+	return opts
+}
+
+// Returns the options of Config in the order they're declared. The options
+// of a section are included by their flat names, with the Index of their
+// path through Config; see sectionFields.
+func optionFields() []reflect.StructField {
+	var fields []reflect.StructField
+	t := reflect.TypeOf(Config{})
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		switch {
+		case f.PkgPath != "":
+		case f.Tag.Get("section") != "":
+			fields = append(fields, sectionFields(f)...)
+		case f.Tag.Get("usage") != "":
+			fields = append(fields, f)
+		}
+	}
+	return fields
+}
+
+// Returns the environment variable from which the option with the given key
+// is read.
+func envName(key string) string {
+	return EnvPrefix + strings.ToUpper(key)
+}
+
+// Sets the option with the given key from its string form, as it would be
+// given in the environment or as a flag.
+func (cfg *Config) setOption(key, value string) error {
+	f, ok := configOptions()[key]
+	if !ok {
+		return fmt.Errorf("unknown option %q", key)
+	}
+
+	return setField(reflect.ValueOf(cfg).Elem().FieldByIndex(f.Index), f.Name, value)
+}
+
+// Sets v, the field of the option with the given name, from its string form.
+func setField(v reflect.Value, name, value string) error {
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("%s must be true or false, not %q", name, value)
+		}
+		v.SetBool(b)
+	case reflect.Int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("%s must be an integer, not %q", name, value)
+		}
+		v.SetInt(int64(n))
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return fmt.Errorf("%s must be a number, not %q", name, value)
+		}
+		v.SetFloat(f)
+	default:
+		return fmt.Errorf("%s can't be set from a string", name)
+	}
+	return nil
+}
+
+// Sets options from environment variables named after them, e.g.
+// NCDNS_NAMECOINRPCENDPOINTS for NamecoinRPCEndpoints, or, for the options of
+// a section, after their section and key, e.g. NCDNS_RPC_ENDPOINTS. Every
+// option can be given this way, so that ncdns can be configured without a
+// configuration file, as in a container. environ is as returned by
+// os.Environ.
+//
+// The environment takes precedence over the configuration file, so this is
+// called once it has been read, but flags take precedence over the
+// environment: options given in args, the command line arguments, are left
+// alone. An option given by both of its names, with different values, is an
+// error. Errors are of class ErrConfigInvalid.
+func (cfg *Config) ApplyEnv(environ, args []string) error {
+	opts := configOptions()
+	paths := sectionOptions()
+	flags := flagKeys(args)
+	given := map[string][2]string{} // variable and value, by option key
+
+	for _, kv := range environ {
+		kv := strings.SplitN(kv, "=", 2)
+		if len(kv) != 2 || !strings.HasPrefix(kv[0], EnvPrefix) || nonOptionEnv[kv[0]] {
+			continue
+		}
+
+		key := strings.ToLower(strings.TrimPrefix(kv[0], EnvPrefix))
+		if flatKey, ok := paths[strings.Replace(key, "_", ".", 1)]; ok {
+			key = flatKey
+		}
+		if _, ok := opts[key]; !ok {
+			log.Warnf("ignoring environment variable %s, which isn't an option", kv[0])
+			continue
+		}
+		if prev, ok := given[key]; ok && prev[1] != kv[1] {
+			return configError("%s and %s are both set, to different values", prev[0], kv[0])
+		}
+		given[key] = [2]string{kv[0], kv[1]}
+		if flags[key] {
+			continue
+		}
+
+		if err := cfg.setOption(key, kv[1]); err != nil {
+			return configError("%s: %v", kv[0], err)
+		}
+	}
+
+	return nil
+}
+
+// Returns the keys of the options given as flags in args, in any of the forms
+// the flag package accepts: -key, --key, -key=value or -key value.
+func flagKeys(args []string) map[string]bool {
+	keys := map[string]bool{}
+	for _, arg := range args {
+		if arg == "--" {
+			break
+		}
+		if !strings.HasPrefix(arg, "-") {
+			continue
+		}
+
+		key := strings.TrimLeft(arg, "-")
+		if i := strings.IndexByte(key, '='); i >= 0 {
+			key = key[:i]
+		}
+		keys[strings.ToLower(key)] = true
+	}
+	return keys
+}
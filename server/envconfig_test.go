@@ -0,0 +1,144 @@
+package server
+
+import (
+	"errors"
+	"testing"
+)
+
+// Returns a Config holding the defaults of its options, as the configuration
+// file loader starts from.
+func defaultConfig(t *testing.T) *Config {
+	cfg := &Config{}
+	for key, f := range configOptions() {
+		if err := cfg.setOption(key, f.Tag.Get("default")); err != nil {
+			t.Fatalf("%s: default can't be set as an option: %v", f.Name, err)
+		}
+	}
+	return cfg
+}
+
+func TestApplyEnvPrecedence(t *testing.T) {
+	cfg := defaultConfig(t)
+
+	// The configuration file.
+	for key, value := range map[string]string{
+		"bind":                "127.0.0.1:5353",
+		"cachemaxentries":     "200",
+		"namecoinrpcusername": "fileuser",
+	} {
+		if err := cfg.setOption(key, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The environment, then the flags.
+	args := []string{"-namecoinrpcusername=flaguser", "--HTTPListenAddr", "127.0.0.1:8080"}
+	err := cfg.ApplyEnv([]string{
+		"NCDNS_CACHEMAXENTRIES=300",
+		"NCDNS_NAMECOINRPCUSERNAME=envuser",
+		"NCDNS_HTTPLISTENADDR=0.0.0.0:80",
+		"NCDNS_HTTPEVENTS=true",
+		"NCDNS_NAMECOINRPCPASSWORD=pass=word",
+		"NCDNS_LOG_FORMAT=json",
+		"NCDNS_NOSUCHOPTION=1",
+		"HOME=/root",
+	}, args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, value := range map[string]string{
+		"namecoinrpcusername": "flaguser",
+		"httplistenaddr":      "127.0.0.1:8080",
+	} {
+		if err := cfg.setOption(key, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, test := range []struct {
+		name          string
+		got, expected interface{}
+	}{
+		{"default", cfg.SelfIP, "127.127.127.127"},
+		{"default int", cfg.EventClientBuffer, 64},
+		{"file", cfg.Bind, "127.0.0.1:5353"},
+		{"env over file", cfg.Cache.MaxEntries, 300},
+		{"env over default", cfg.HTTP.Events, true},
+		{"env with =", cfg.RPC.Password, "pass=word"},
+		{"flag over env", cfg.RPC.Username, "flaguser"},
+		{"flag with separate value over env", cfg.HTTP.ListenAddr, "127.0.0.1:8080"},
+	} {
+		if test.got != test.expected {
+			t.Errorf("%s: got %v, expected %v", test.name, test.got, test.expected)
+		}
+	}
+}
+
+// A configuration can be built from the environment alone.
+func TestApplyEnvOnly(t *testing.T) {
+	cfg := defaultConfig(t)
+	err := cfg.ApplyEnv([]string{
+		"NCDNS_BIND=:5300",
+		"NCDNS_NAMECOINRPCADDRESS=namecoind:8336",
+		"NCDNS_SUFFIXKEYS=bit=auto",
+		"NCDNS_KEYDIR=/data/keys",
+		"NCDNS_LEGACYFIELDSUPPORT=false",
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.Bind != ":5300" || cfg.RPC.Address != "namecoind:8336" || cfg.DNSSEC.SuffixKeys != "bit=auto" ||
+		cfg.DNSSEC.KeyDir != "/data/keys" || cfg.LegacyFieldSupport || cfg.Cache.MaxEntries != 100 {
+		t.Errorf("unexpected configuration %+v", cfg)
+	}
+}
+
+// The options of sections may be named after their section and key.
+func TestApplyEnvSections(t *testing.T) {
+	cfg := defaultConfig(t)
+	err := cfg.ApplyEnv([]string{
+		"NCDNS_RPC_ENDPOINTS=namecoind:8336",
+		"NCDNS_NAMECOINRPCENDPOINTS=namecoind:8336",
+		"NCDNS_CACHE_NEGATIVETTL=60",
+		"NCDNS_DNSSEC_KEYDIR=/data/keys",
+		"NCDNS_HTTP_LISTENADDR=0.0.0.0:80",
+	}, []string{"-httplistenaddr=127.0.0.1:8080"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.RPC.Endpoints != "namecoind:8336" || cfg.Cache.NegativeTTL != 60 || cfg.DNSSEC.KeyDir != "/data/keys" ||
+		cfg.HTTP.ListenAddr != "" {
+		t.Errorf("unexpected configuration %+v", cfg)
+	}
+}
+
+func TestApplyEnvErrors(t *testing.T) {
+	for _, environ := range [][]string{
+		{"NCDNS_CACHEMAXENTRIES=lots"},
+		{"NCDNS_HTTPEVENTS=maybe"},
+		{"NCDNS_RPC_TIMEOUT=soon"},
+		{"NCDNS_SERVFAILALERTRATIO=half"},
+		{"NCDNS_CACHE_MAXENTRIES=200", "NCDNS_CACHEMAXENTRIES=300"},
+	} {
+		cfg := defaultConfig(t)
+		if err := cfg.ApplyEnv(environ, nil); !errors.Is(err, ErrConfigInvalid) {
+			t.Errorf("%v: got %v, expected an invalid configuration", environ, err)
+		}
+	}
+}
+
+func TestFlagKeys(t *testing.T) {
+	keys := flagKeys([]string{"-bind=:53", "--SelfName", "ns1.example.", "-conf", "x.conf", "--", "-httpevents"})
+	for key, expected := range map[string]bool{
+		"bind":         true,
+		"selfname":     true,
+		"conf":         true,
+		"httpevents":   false,
+		"ns1.example.": false,
+	} {
+		if keys[key] != expected {
+			t.Errorf("%s: got %v, expected %v", key, keys[key], expected)
+		}
+	}
+}
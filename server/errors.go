@@ -0,0 +1,69 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Classes of error returned by New. The error returned is an *Error, so
+// errors.Is can be used to tell the classes apart, and errors.Is and
+// errors.As can also be used to examine the underlying cause.
+var (
+	// The configuration is inconsistent or has an invalid setting.
+	ErrConfigInvalid = errors.New("invalid configuration")
+
+	// The DNSSEC keys couldn't be read, or are unusable.
+	ErrKeyLoad = errors.New("couldn't load keys")
+
+	// The backend, or the DNS engine serving it, couldn't be set up.
+	ErrBackendInit = errors.New("couldn't set up backend")
+
+	// A DNS or HTTP listener couldn't be created.
+	ErrBindFailed = errors.New("couldn't bind listener")
+
+	// The server couldn't switch to RunAsUser once its listeners were
+	// created.
+	ErrPrivilegeDrop = errors.New("couldn't drop privileges")
+)
+
+// The class of error returned by Start, Reload and Drain when the server isn't
+// in a state in which the operation is allowed: a reload while draining, for
+// instance, or a second Start.
+var ErrInvalidState = errors.New("operation not allowed in the server's state")
+
+// An Error is an error setting up or operating the server, together with its
+// class.
+type Error struct {
+	Kind error // ErrConfigInvalid, ErrKeyLoad, ErrBackendInit, ErrBindFailed, ErrPrivilegeDrop or ErrInvalidState
+	Err  error // the underlying cause
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+func (e *Error) Is(target error) bool {
+	return target == e.Kind
+}
+
+// Classifies err, unless it is nil or already classified.
+func wrapError(kind, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	var e *Error
+	if errors.As(err, &e) {
+		return err
+	}
+
+	return &Error{Kind: kind, Err: err}
+}
+
+func configError(format string, args ...interface{}) error {
+	return &Error{Kind: ErrConfigInvalid, Err: fmt.Errorf(format, args...)}
+}
@@ -0,0 +1,99 @@
+package server
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+)
+
+// A configuration which gets as far as binding listeners.
+func newErrorTestConfig(dir string) *Config {
+	return &Config{
+		ConfigDir:           dir,
+		CanonicalSuffix:     "bit",
+		BindAddresses:       "127.0.0.1:0",
+		Cache:               CacheConfig{MaxEntries: 100},
+		RPC:                 RPCConfig{MaxValueSize: 2080},
+		HealthCheckInterval: 30,
+		HealthCheckProbe:    "tcp:80",
+
+		ApexInfrastructureTTL: 86400,
+		AdaptiveTTLBlocks:     4320,
+		RecordTTL:             600,
+		MinRecordTTL:          60,
+	}
+}
+
+func TestNewErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ncdns-errors")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Occupy a UDP port, so that binding to it fails.
+	busy, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+
+	tests := []struct {
+		name     string
+		modify   func(cfg *Config)
+		expected error
+		cause    interface{} // a pointer to a type the cause should be, if any
+	}{
+		{"value size limit", func(cfg *Config) { cfg.RPC.MaxValueSize = 100 }, ErrConfigInvalid, nil},
+		{"vanity IP", func(cfg *Config) { cfg.VanityIPs = "not an IP" }, ErrConfigInvalid, nil},
+		{"apex record", func(cfg *Config) { cfg.ApexRecords = "bit. IN MX 10 mail.example.com." }, ErrConfigInvalid, nil},
+		{"fetcher", func(cfg *Config) { cfg.Fetcher = "carrier-pigeon" }, ErrConfigInvalid, nil},
+		{"health check probe", func(cfg *Config) {
+			cfg.HealthCheckNames = "example.bit"
+			cfg.HealthCheckProbe = "udp:53"
+		}, ErrConfigInvalid, nil},
+		{"bind address", func(cfg *Config) { cfg.BindAddresses = "127.0.0.1:notaport" }, ErrConfigInvalid, nil},
+		{"query ACL", func(cfg *Config) { cfg.DenyQueriesFrom = "192.0.2.0/24,2001:db8::/129" }, ErrConfigInvalid, nil},
+		{"static data", func(cfg *Config) {
+			cfg.Fetcher = "static"
+			cfg.StaticDataDir = "missing"
+		}, ErrBackendInit, new(*os.PathError)},
+		{"public key", func(cfg *Config) {
+			cfg.DNSSEC.PublicKey = "missing.key"
+			cfg.DNSSEC.PrivateKey = "missing.private"
+		}, ErrKeyLoad, new(*os.PathError)},
+		{"suffix key", func(cfg *Config) {
+			cfg.DNSSEC.SuffixKeys = "example.=missing.key|missing.private"
+		}, ErrKeyLoad, nil},
+		{"DNS listener", func(cfg *Config) { cfg.BindAddresses = busy.LocalAddr().String() }, ErrBindFailed, new(*net.OpError)},
+		{"RunAsUser", func(cfg *Config) { cfg.RunAsUser = "ncdns-no-such-user" }, ErrConfigInvalid, nil},
+	}
+
+	for _, test := range tests {
+		cfg := newErrorTestConfig(dir)
+		test.modify(cfg)
+
+		s, err := New(cfg)
+		if err == nil {
+			t.Errorf("%s: no error", test.name)
+			s.stop()
+			continue
+		}
+
+		var e *Error
+		if !errors.As(err, &e) {
+			t.Errorf("%s: error %v isn't an *Error", test.name, err)
+			continue
+		}
+		for _, kind := range []error{ErrConfigInvalid, ErrKeyLoad, ErrBackendInit, ErrBindFailed, ErrPrivilegeDrop} {
+			if errors.Is(err, kind) != (kind == test.expected) {
+				t.Errorf("%s: errors.Is(%v, %v) = %v", test.name, err, kind, !(kind == test.expected))
+			}
+		}
+		if test.cause != nil && !errors.As(err, test.cause) {
+			t.Errorf("%s: cause of %v is %T", test.name, err, errors.Unwrap(err))
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package server
+
+import (
+	"sync"
+	"time"
+
+	"github.com/namecoin/ncdns/clock"
+)
+
+// Types of the events streamed at /api/v1/events.
+const (
+	eventBlock    = "block"    // a new best block
+	eventName     = "name"     // a change to one of EventWatchNames
+	eventCache    = "cache"    // the name cache was flushed
+	eventDegraded = "degraded" // the Namecoin RPC circuit breaker changed state
+	eventProblem  = "problem"  // an error or warning parsing a name's value
+)
+
+var eventTypes = []string{eventBlock, eventName, eventCache, eventDegraded, eventProblem}
+
+// An event streamed at /api/v1/events. Only the fields relevant to its type
+// are set.
+type event struct {
+	ID   uint64    `json:"-"`
+	Type string    `json:"type"`
+	Time time.Time `json:"time"`
+
+	Height int64  `json:"height,omitempty"` // block, name, cache
+	Hash   string `json:"hash,omitempty"`   // block
+
+	Name    string `json:"name,omitempty"`    // name, problem
+	Value   string `json:"value,omitempty"`   // name
+	Expired bool   `json:"expired,omitempty"` // name
+	Missing bool   `json:"missing,omitempty"` // name: it doesn't exist
+
+	Problem string `json:"problem,omitempty"` // problem
+	Warning bool   `json:"warning,omitempty"` // problem: it's a warning rather than an error
+
+	State string `json:"state,omitempty"` // degraded: closed, open or half-open
+}
+
+// Fans events out to the clients of /api/v1/events. Each client has a buffer
+// of events; a client which falls so far behind that its buffer fills is
+// dropped rather than holding up the others, and can reconnect.
+type eventHub struct {
+	buffer int
+	clock  clock.Clock
+
+	mu     sync.Mutex
+	nextID uint64
+	subs   map[*eventSub]struct{}
+
+	dropped uint64
+}
+
+type eventSub struct {
+	types map[string]bool // nil: all types
+	ch    chan *event     // closed if the client is dropped
+}
+
+func newEventHub(buffer int, clk clock.Clock) *eventHub {
+	return &eventHub{
+		buffer: buffer,
+		clock:  clock.Or(clk),
+		subs:   map[*eventSub]struct{}{},
+	}
+}
+
+// Subscribes to events of the given types, or all types if types is nil.
+func (h *eventHub) subscribe(types map[string]bool) *eventSub {
+	sub := &eventSub{types: types, ch: make(chan *event, h.buffer)}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.subs[sub] = struct{}{}
+	return sub
+}
+
+func (h *eventHub) unsubscribe(sub *eventSub) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if _, ok := h.subs[sub]; ok {
+		delete(h.subs, sub)
+		close(sub.ch)
+	}
+}
+
+// Sends an event to every subscriber to its type, without blocking. Does
+// nothing if h is nil, i.e. events are disabled.
+func (h *eventHub) publish(ev *event) {
+	if h == nil {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.nextID++
+	ev.ID = h.nextID
+	if ev.Time.IsZero() {
+		ev.Time = h.clock.Now()
+	}
+
+	for sub := range h.subs {
+		if sub.types != nil && !sub.types[ev.Type] {
+			continue
+		}
+
+		select {
+		case sub.ch <- ev:
+		default:
+			delete(h.subs, sub)
+			close(sub.ch)
+			h.dropped++
+			log.Warn("dropped an events client which fell behind")
+		}
+	}
+}
+
+type eventStatus struct {
+	Clients int    `json:"clients"`
+	Dropped uint64 `json:"dropped_clients"`
+}
+
+func (h *eventHub) Status() eventStatus {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return eventStatus{Clients: len(h.subs), Dropped: h.dropped}
+}
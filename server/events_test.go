@@ -0,0 +1,119 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A fake namecoind whose chain can be advanced, holding the names in values.
+type fakeChainRPC struct {
+	mu     sync.Mutex
+	height int
+	values map[string]string
+}
+
+func (f *fakeChainRPC) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	var call struct {
+		Method string            `json:"method"`
+		Params []json.RawMessage `json:"params"`
+		ID     interface{}       `json:"id"`
+	}
+	json.NewDecoder(req.Body).Decode(&call)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	res := map[string]interface{}{"id": call.ID, "error": nil}
+	switch call.Method {
+	case "getbestblockhash":
+		res["result"] = f.hash()
+	case "getblockcount":
+		res["result"] = f.height
+	case "name_show":
+		var name string
+		json.Unmarshal(call.Params[0], &name)
+		if value, ok := f.values[name]; ok {
+			res["result"] = map[string]interface{}{"name": name, "value": value, "expires_in": 30000}
+		} else {
+			res["error"] = map[string]interface{}{"code": -4, "message": "name not found"}
+		}
+	default:
+		res["error"] = map[string]interface{}{"code": -32601, "message": "Method not found"}
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(res)
+}
+
+func (f *fakeChainRPC) hash() string {
+	return fmt.Sprintf("%064x", f.height)
+}
+
+// Mines a block which sets the given names, deleting those set to "".
+func (f *fakeChainRPC) advance(changes map[string]string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.height++
+	for name, value := range changes {
+		if value == "" {
+			delete(f.values, name)
+		} else {
+			f.values[name] = value
+		}
+	}
+}
+
+func TestBlockWatcherWake(t *testing.T) {
+	var mu sync.Mutex
+	hash := "a"
+	polled := make(chan struct{}, 10)
+	flushed := make(chan struct{}, 1)
+	w := &blockWatcher{
+		interval: time.Hour,
+		bus:      newEventBus(),
+		bestBlock: func() (int64, string, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			polled <- struct{}{}
+			return 100, hash, nil
+		},
+		wake: make(chan struct{}, 1),
+		stop: make(chan struct{}),
+	}
+	w.bus.subscribe("test", func(ev interface{}) {
+		if block, ok := ev.(*blockConnected); ok && !block.Initial {
+			flushed <- struct{}{}
+		}
+	})
+
+	stopped := make(chan struct{})
+	go func() {
+		w.run()
+		close(stopped)
+	}()
+
+	// A block announced is noticed without waiting for the next poll.
+	<-polled
+	mu.Lock()
+	hash = "b"
+	mu.Unlock()
+	w.notify()
+	select {
+	case <-flushed:
+	case <-time.After(5 * time.Second):
+		t.Errorf("block announced not published")
+	}
+
+	w.shutdown()
+	w.shutdown()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Errorf("watcher still running after shutdown")
+	}
+}
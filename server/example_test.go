@@ -0,0 +1,38 @@
+package server_test
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"github.com/miekg/dns"
+
+	"github.com/namecoin/ncdns/server"
+)
+
+// Resolves a name through the whole of ncdns, as a query from 192.0.2.1 over
+// UDP would be, without listening on any socket.
+func ExampleServer_Query() {
+	s, err := server.New(&server.Config{
+		ConfigDir:     "/etc/ncdns",
+		Fetcher:       "static",
+		StaticDataDir: "names",
+	})
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.bit.", dns.TypeA)
+	req.SetEdns0(1232, true)
+
+	res, err := s.Query(context.Background(), req, &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5353})
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	for _, rr := range res.Answer {
+		fmt.Println(rr)
+	}
+}
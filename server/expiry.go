@@ -0,0 +1,39 @@
+package server
+
+import (
+	"fmt"
+
+	"github.com/miekg/dns"
+)
+
+// Wraps rw so that answers from expired names served within the
+// ServeExpiredNamesFor grace period carry an extended DNS error saying so.
+// Returns rw unchanged if expired names are never served.
+func (s *Server) expiredNameWriter(rw dns.ResponseWriter, req *dns.Msg) dns.ResponseWriter {
+	if s.cfg.ServeExpiredNamesFor <= 0 || len(req.Question) == 0 {
+		return rw
+	}
+
+	return &expiredNameWriter{ResponseWriter: rw, s: s, qname: req.Question[0].Name}
+}
+
+type expiredNameWriter struct {
+	dns.ResponseWriter
+	s     *Server
+	qname string
+}
+
+func (rw *expiredNameWriter) WriteMsg(m *dns.Msg) error {
+	// The name was looked up to produce the response, so its expiry status is
+	// in the backend's cache. EDE can only be sent to clients using EDNS.
+	if opt := m.IsEdns0(); opt != nil && m.Rcode == dns.RcodeSuccess {
+		if ncname, blocksAgo, ok := rw.s.currentBackend().ExpiredName(rw.qname, ""); ok {
+			opt.Option = append(opt.Option, &dns.EDNS0_EDE{
+				InfoCode:  dns.ExtendedErrorCodeStaleAnswer,
+				ExtraText: fmt.Sprintf("%s expired %d blocks ago", ncname, blocksAgo),
+			})
+		}
+	}
+
+	return rw.ResponseWriter.WriteMsg(m)
+}
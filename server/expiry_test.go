@@ -0,0 +1,80 @@
+package server
+
+import (
+	"context"
+	"testing"
+
+	"github.com/miekg/dns"
+	"gopkg.in/hlandau/madns.v2/merr"
+
+	"github.com/namecoin/ncdns/backend"
+	"github.com/namecoin/ncdns/namecoin"
+)
+
+type fakeRPCFetcher map[string]*namecoin.NameData
+
+func (f fakeRPCFetcher) Fetch(ctx context.Context, name, streamIsolationID string) (*namecoin.NameData, error) {
+	nameData, ok := f[name]
+	if !ok {
+		return nil, merr.ErrNoSuchDomain
+	}
+	return nameData, nil
+}
+
+func TestExpiredNameEDE(t *testing.T) {
+	b, err := backend.New(&backend.Config{
+		Fetcher: fakeRPCFetcher{
+			"d/fresh":   {Value: `{"ip":["192.0.2.1"]}`, ExpiresIn: 30000},
+			"d/expired": {Value: `{"ip":["192.0.2.2"]}`, ExpiresIn: -5, Expired: true},
+		},
+		CacheMaxEntries:      100,
+		ServeExpiredNamesFor: 100,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{cfg: Config{ServeExpiredNamesFor: 100}, backend: b}
+
+	respond := func(qname string, edns bool) *dns.Msg {
+		if _, err := b.Lookup(qname, ""); err != nil {
+			t.Fatalf("lookup of %s failed: %v", qname, err)
+		}
+
+		req := new(dns.Msg)
+		req.SetQuestion(qname, dns.TypeA)
+		res := new(dns.Msg)
+		res.SetReply(req)
+		if edns {
+			req.SetEdns0(4096, false)
+			res.SetEdns0(4096, false)
+		}
+
+		frw := &fakeResponseWriter{}
+		s.expiredNameWriter(frw, req).WriteMsg(res)
+		return frw.msg
+	}
+
+	ede := func(m *dns.Msg) *dns.EDNS0_EDE {
+		if opt := m.IsEdns0(); opt != nil {
+			for _, o := range opt.Option {
+				if e, ok := o.(*dns.EDNS0_EDE); ok {
+					return e
+				}
+			}
+		}
+		return nil
+	}
+
+	e := ede(respond("expired.bit.", true))
+	if e == nil || e.InfoCode != dns.ExtendedErrorCodeStaleAnswer || e.ExtraText != "d/expired expired 5 blocks ago" {
+		t.Errorf("unexpected EDE for expired name: %+v", e)
+	}
+
+	if e := ede(respond("fresh.bit.", true)); e != nil {
+		t.Errorf("EDE added for unexpired name: %+v", e)
+	}
+
+	if m := respond("expired.bit.", false); m.IsEdns0() != nil {
+		t.Errorf("OPT record added to response to a query without EDNS")
+	}
+}
@@ -0,0 +1,130 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync/atomic"
+
+	"github.com/miekg/dns"
+
+	"github.com/namecoin/ncdns/clock"
+	"github.com/namecoin/ncdns/namecoin"
+	"github.com/namecoin/ncdns/ncdumpzone"
+)
+
+// Progress of an export is reported each time this many more names have been
+// walked.
+const exportProgressInterval = 1000
+
+// Options of ExportZone.
+type ExportOptions struct {
+	// Sign the zone with the configured keys, chaining its names with NSEC
+	// records, as it's transferred to secondaries.
+	Sign bool
+
+	// If non-zero, the walk of the names stops after this many domain
+	// names, e.g. to try an export against a large chain.
+	Limit int
+
+	// If set, called with each name whose value has an error, such as JSON
+	// which doesn't parse. The name is left out, or exported as it's served
+	// despite the error, as the error allows.
+	Problem func(name string, err error)
+
+	// If set, called with the number of names walked so far, every so often.
+	Progress func(names int)
+}
+
+// What ExportZone exported.
+type ExportResult struct {
+	Zone    string
+	Serial  uint32
+	Names   int // Namecoin names walked
+	Records int // records written
+}
+
+// Writes the zone ncdns serves at CanonicalSuffix, as configured by cfg, to w
+// as an RFC 1035 master file. Each Namecoin name, as found by walking them
+// all with name_scan, is made into records by the backend as it is for
+// queries, and the zone has the records served at its apex too, including
+// the DNSKEYs if it's signed. The SOA serial is that the server would have
+// now.
+func ExportZone(cfg *Config, w io.Writer, opts *ExportOptions) (*ExportResult, error) {
+	if opts == nil {
+		opts = &ExportOptions{}
+	}
+
+	s, err := newServer(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if s.namecoinConn == nil || !cfg.usesNamecoind() {
+		return nil, configError("exporting the zone requires the namecoind fetcher")
+	}
+	defer s.namecoinConn.Shutdown()
+
+	zone := strings.ToLower(dns.Fqdn(cfg.CanonicalSuffix))
+	if !isZoneApex(zone) {
+		return nil, configError("CanonicalSuffix %s isn't a zone ncdns serves, so it can't be exported", zone)
+	}
+
+	var ks *keySet
+	if opts.Sign {
+		if len(s.cfg.suffixKeys) > 0 || len(s.cfg.unsignedNames) > 0 {
+			return nil, configError("a zone can't be exported signed with SuffixKeys or UnsignedNames, whose names aren't signed with the zone's keys")
+		}
+		ks = s.keySetForName(zone)
+		if ks == nil || ks.ZSK == nil {
+			return nil, configError("no ZSK is configured for %s to sign the zone with", zone)
+		}
+	}
+
+	height, err := s.namecoinConn.GetBlockCount()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get the block count from namecoind: %w", err)
+	}
+	atomic.StoreInt64(&s.busMetrics.height, height)
+	atomic.StoreInt64(&s.busMetrics.blockTime, clock.Or(s.clock).Now().Unix())
+
+	if opts.Problem != nil {
+		s.bus.subscribe("export", func(ev interface{}) {
+			if p, ok := ev.(*valueProblem); ok && !p.Warning {
+				opts.Problem(p.Name, errors.New(p.Problem))
+			}
+		})
+	}
+
+	res := &ExportResult{Zone: zone}
+	walk := func(f func(name string, nameData *namecoin.NameData) error) error {
+		_, err := ncdumpzone.WalkNames(s.namecoinConn, &ncdumpzone.Options{Limit: opts.Limit},
+			func(name string, nameData *namecoin.NameData) error {
+				res.Names++
+				if opts.Progress != nil && res.Names%exportProgressInterval == 0 {
+					opts.Progress(res.Names)
+				}
+				return f(name, nameData)
+			})
+		return err
+	}
+	rrs, err := buildZone(s.currentBackend(), ks, zone, nil, clock.Or(s.clock).Now(), walk, opts.Problem)
+	if err != nil {
+		return nil, err
+	}
+
+	// The SOA is only repeated at the end of a transfer.
+	rrs = rrs[:len(rrs)-1]
+	res.Serial = rrs[0].(*dns.SOA).Serial
+	if _, err := fmt.Fprintf(w, "; %s exported by ncdns %s at serial %d\n", zone, ncdnsVersion, res.Serial); err != nil {
+		return nil, err
+	}
+	for _, rr := range rrs {
+		if _, err := fmt.Fprintln(w, rr.String()); err != nil {
+			return nil, err
+		}
+		res.Records++
+	}
+
+	return res, nil
+}
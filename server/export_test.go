@@ -0,0 +1,86 @@
+//go:build !no_webserver
+// +build !no_webserver
+
+package server
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestExportZone(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ncdns-export")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	rpc := newFakeZoneRPC()
+	rpc.names = append([]string{"d/broken"}, rpc.names...)
+	sort.Strings(rpc.names)
+	rpc.values = map[string]string{"d/broken": `{"ip":`}
+	rpcSrv := httptest.NewServer(rpc)
+	defer rpcSrv.Close()
+
+	cfg := newDoctorTestConfig(t, dir, strings.TrimPrefix(rpcSrv.URL, "http://"))
+	cfg.HTTP.ListenAddr = ""
+
+	var problems []string
+	var buf bytes.Buffer
+	res, err := ExportZone(cfg, &buf, &ExportOptions{
+		Sign:  true,
+		Limit: 100,
+		Problem: func(name string, err error) {
+			problems = append(problems, name)
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Zone != "bit." || res.Serial != 100 || res.Names != 100 {
+		t.Errorf("got %+v", res)
+	}
+	if len(problems) == 0 || problems[0] != "d/broken" {
+		t.Errorf("problems reported: %v", problems)
+	}
+
+	// The master file parses, and holds the names walked, signed.
+	counts := map[uint16]int{}
+	zp := dns.NewZoneParser(&buf, "", "")
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		counts[rr.Header().Rrtype]++
+	}
+	if err := zp.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if counts[dns.TypeSOA] != 1 || counts[dns.TypeDNSKEY] != 2 || counts[dns.TypeA] < 99 {
+		t.Errorf("unexpected records: %v", counts)
+	}
+	if counts[dns.TypeNSEC] == 0 || counts[dns.TypeRRSIG] == 0 {
+		t.Errorf("zone isn't signed: %v", counts)
+	}
+	sum := 0
+	for _, n := range counts {
+		sum += n
+	}
+	if sum != res.Records {
+		t.Errorf("%d records written, %d reported", sum, res.Records)
+	}
+
+	// Unsigned, without a limit.
+	buf.Reset()
+	res, err = ExportZone(cfg, &buf, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Names != len(rpc.names)-2 || strings.Contains(buf.String(), "RRSIG") {
+		t.Errorf("got %+v", res)
+	}
+}
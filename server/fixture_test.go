@@ -0,0 +1,139 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/miekg/dns"
+
+	"github.com/namecoin/ncdns/backend"
+)
+
+// Serves the names of testdata/fixture.json from a real listener, and checks
+// the signatures of the answers as a validating resolver would.
+func TestFixtureServer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ncdns-fixture")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	f, err := backend.NewFixtureFetcher("testdata/fixture.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := newErrorTestConfig(dir)
+	cfg.DNSSEC.PublicKey, cfg.DNSSEC.PrivateKey = writeKeyPair(t, dir, "ksk", dns.ECDSAP256SHA256, 256)
+	cfg.DNSSEC.ZonePublicKey, cfg.DNSSEC.ZonePrivateKey = writeKeyPair(t, dir, "zsk", dns.ECDSAP256SHA256, 256)
+	cfg.CanonicalSuffix = "bit"
+	cfg.UseFetcher(f)
+
+	s, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+	addr := s.UDPAddrs()[0].String()
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	query := func(name string, qtype uint16) *dns.Msg {
+		req := new(dns.Msg)
+		req.SetQuestion(name, qtype)
+		req.SetEdns0(4096, true)
+		c := &dns.Client{Net: "tcp"}
+		res, _, err := c.Exchange(req, addr)
+		if err != nil {
+			t.Fatalf("query of %s %s: %v", name, dns.TypeToString[qtype], err)
+		}
+		return res
+	}
+
+	keys := map[uint16]*dns.DNSKEY{}
+	for _, rr := range query("bit.", dns.TypeDNSKEY).Answer {
+		if k, ok := rr.(*dns.DNSKEY); ok {
+			keys[k.KeyTag()] = k
+		}
+	}
+	if len(keys) == 0 {
+		t.Fatal("no DNSKEY records served")
+	}
+
+	// Checks that the records of rrtype in rrs are signed by one of keys, and
+	// returns them.
+	verified := func(what string, rrs []dns.RR, rrtype uint16) []dns.RR {
+		var rrset []dns.RR
+		var sig *dns.RRSIG
+		for _, rr := range rrs {
+			if s, ok := rr.(*dns.RRSIG); ok && s.TypeCovered == rrtype {
+				sig = s
+			} else if rr.Header().Rrtype == rrtype {
+				rrset = append(rrset, rr)
+			}
+		}
+		switch {
+		case len(rrset) == 0:
+			t.Errorf("%s: no %s records in %v", what, dns.TypeToString[rrtype], rrs)
+		case sig == nil:
+			t.Errorf("%s: %s records aren't signed", what, dns.TypeToString[rrtype])
+		case keys[sig.KeyTag] == nil:
+			t.Errorf("%s: signed with unknown key %d", what, sig.KeyTag)
+		default:
+			if err := sig.Verify(keys[sig.KeyTag], rrset); err != nil {
+				t.Errorf("%s: signature doesn't verify: %v", what, err)
+			}
+		}
+		return rrset
+	}
+
+	for _, test := range []struct {
+		name     string
+		qtype    uint16
+		expected string
+	}{
+		{"example.bit.", dns.TypeA, "192.0.2.1"},
+		{"example.bit.", dns.TypeAAAA, "2001:db8::1"},
+		{"www.example.bit.", dns.TypeA, "192.0.2.2"},
+	} {
+		what := test.name + " " + dns.TypeToString[test.qtype]
+		rrs := verified(what, query(test.name, test.qtype).Answer, test.qtype)
+		if len(rrs) != 1 || !containsAddress(rrs[0], test.expected) {
+			t.Errorf("%s: got %v, expected %s", what, rrs, test.expected)
+		}
+	}
+
+	// A delegation, whether made by "ns" or by "delegate", is a referral to
+	// the nameservers, proven unsigned.
+	for _, name := range []string{"hosted.bit.", "www.delegated.bit."} {
+		res := query(name, dns.TypeA)
+		ns := 0
+		for _, rr := range res.Ns {
+			if rr.Header().Rrtype == dns.TypeNS {
+				ns++
+			}
+		}
+		if res.Rcode != dns.RcodeSuccess || len(res.Answer) != 0 || ns != 2 {
+			t.Errorf("%s: not a referral: %v", name, res)
+		}
+		verified(name+" referral", res.Ns, dns.TypeNSEC)
+	}
+
+	res := query("missing.bit.", dns.TypeA)
+	if res.Rcode != dns.RcodeNameError {
+		t.Errorf("missing.bit.: got rcode %s", dns.RcodeToString[res.Rcode])
+	}
+	verified("missing.bit.", res.Ns, dns.TypeNSEC)
+}
+
+func containsAddress(rr dns.RR, addr string) bool {
+	switch rr := rr.(type) {
+	case *dns.A:
+		return rr.A.String() == addr
+	case *dns.AAAA:
+		return rr.AAAA.String() == addr
+	}
+	return false
+}
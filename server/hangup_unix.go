@@ -0,0 +1,57 @@
+//go:build !windows
+// +build !windows
+
+package server
+
+import (
+	"net"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Calls hangup if the client closes conn, until the returned function is
+// called, which returns once conn is no longer watched.
+//
+// conn is watched by peeking at what it has to read, without taking it, which
+// the DNS server reads once the query has been answered. If the client sends
+// another query first, there's no telling whether it's closed the connection
+// after it, so it's no longer watched.
+func watchHangup(conn net.Conn, hangup func()) (stop func()) {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return func() {}
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return func() {}
+	}
+
+	var stopping int32 // accessed atomically
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		var buf [1]byte
+		rc.Read(func(fd uintptr) bool {
+			n, _, err := syscall.Recvfrom(int(fd), buf[:], syscall.MSG_PEEK)
+			if err == syscall.EAGAIN || err == syscall.EINTR {
+				return false // wait until there's something to read
+			}
+			// Nothing to read, or an error such as a reset, once it's
+			// readable: the client has closed the connection.
+			if (n == 0 || err != nil) && atomic.LoadInt32(&stopping) == 0 {
+				hangup()
+			}
+			return true
+		})
+	}()
+
+	return func() {
+		// The wait is ended by a deadline in the past. The DNS server sets
+		// its own before reading the next query.
+		atomic.StoreInt32(&stopping, 1)
+		conn.SetReadDeadline(time.Unix(1, 0))
+		<-done
+	}
+}
@@ -0,0 +1,11 @@
+package server
+
+import (
+	"net"
+)
+
+// Connections aren't watched on Windows, so a query whose client closes its
+// connection is answered as any other.
+func watchHangup(conn net.Conn, hangup func()) (stop func()) {
+	return func() {}
+}
@@ -0,0 +1,404 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	madns "gopkg.in/hlandau/madns.v2"
+
+	"github.com/namecoin/ncdns/clock"
+	"github.com/namecoin/ncdns/scheduler"
+)
+
+// Checks whether the given address of a name is up.
+type probeFunc func(ctx context.Context, name string, ip net.IP) error
+
+// Parses a probe specification: "tcp:PORT" to connect to a TCP port,
+// "http:PORT/PATH" to make an HTTP request expecting a 2xx or 3xx status, or
+// "icmp" to send an ICMP echo request.
+func parseProbe(spec string) (probeFunc, error) {
+	kind, arg := spec, ""
+	if i := strings.IndexByte(spec, ':'); i >= 0 {
+		kind, arg = spec[:i], spec[i+1:]
+	}
+
+	switch kind {
+	case "tcp":
+		port, err := parseProbePort(arg)
+		if err != nil {
+			return nil, err
+		}
+		return func(ctx context.Context, name string, ip net.IP) error {
+			var d net.Dialer
+			conn, err := d.DialContext(ctx, "tcp", net.JoinHostPort(ip.String(), port))
+			if err != nil {
+				return err
+			}
+			return conn.Close()
+		}, nil
+
+	case "http":
+		path := "/"
+		if i := strings.IndexByte(arg, '/'); i >= 0 {
+			arg, path = arg[:i], arg[i:]
+		}
+		port, err := parseProbePort(arg)
+		if err != nil {
+			return nil, err
+		}
+		return func(ctx context.Context, name string, ip net.IP) error {
+			return httpProbe(ctx, name, ip, port, path)
+		}, nil
+
+	case "icmp":
+		if arg != "" {
+			return nil, fmt.Errorf("icmp probe takes no arguments")
+		}
+		return icmpProbe, nil
+	}
+
+	return nil, fmt.Errorf("unknown probe type %q (expected tcp:PORT, http:PORT/PATH or icmp)", kind)
+}
+
+func parseProbePort(s string) (string, error) {
+	port, err := strconv.ParseUint(s, 10, 16)
+	if err != nil || port == 0 {
+		return "", fmt.Errorf("invalid probe port %q", s)
+	}
+	return s, nil
+}
+
+func httpProbe(ctx context.Context, name string, ip net.IP, port, path string) error {
+	req, err := http.NewRequest("GET", "http://"+net.JoinHostPort(ip.String(), port)+path, nil)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Host = strings.TrimSuffix(name, ".")
+
+	client := &http.Client{
+		// A redirect says the server is up.
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 399 {
+		return fmt.Errorf("HTTP status %d", res.StatusCode)
+	}
+	return nil
+}
+
+// Sends an ICMP echo request using an unprivileged ICMP socket, which on
+// Linux requires the net.ipv4.ping_group_range sysctl to include ncdns's
+// group.
+func icmpProbe(ctx context.Context, name string, ip net.IP) error {
+	network, proto := "udp6", 58
+	var echo, reply icmp.Type = ipv6.ICMPTypeEchoRequest, ipv6.ICMPTypeEchoReply
+	if ip.To4() != nil {
+		network, proto = "udp4", 1
+		echo, reply = ipv4.ICMPTypeEcho, ipv4.ICMPTypeEchoReply
+	}
+
+	conn, err := icmp.ListenPacket(network, "")
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	msg := icmp.Message{
+		Type: echo,
+		Body: &icmp.Echo{ID: os.Getpid() & 0xffff, Seq: 1, Data: []byte("ncdns")},
+	}
+	b, err := msg.Marshal(nil)
+	if err != nil {
+		return err
+	}
+	if _, err := conn.WriteTo(b, &net.UDPAddr{IP: ip}); err != nil {
+		return err
+	}
+
+	buf := make([]byte, 1500)
+	for {
+		n, peer, err := conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		if a, ok := peer.(*net.UDPAddr); !ok || !a.IP.Equal(ip) {
+			continue
+		}
+		rm, err := icmp.ParseMessage(proto, buf[:n])
+		if err == nil && rm.Type == reply {
+			return nil
+		}
+	}
+}
+
+// The health of one published address of a name.
+type addressHealth struct {
+	Address     string    `json:"address"`
+	Up          bool      `json:"up"`
+	Error       string    `json:"error,omitempty"`
+	LastChecked time.Time `json:"last_checked"`
+}
+
+// Probes the addresses published by operator-listed names, so that addresses
+// found to be down can be omitted from answers. Only listed names are ever
+// probed, since probing arbitrary addresses found in the blockchain would
+// make ncdns a tool for scanning them.
+type healthChecker struct {
+	names    map[string]bool // FQDNs, in lower case
+	probe    probeFunc
+	interval time.Duration
+	timeout  time.Duration
+	sched    *scheduler.Scheduler
+
+	// Returns the unfiltered records of a name.
+	lookup func(name string) ([]dns.RR, error)
+	clock  clock.Clock
+
+	mu     sync.Mutex
+	health map[string]map[string]*addressHealth // by name, then address
+}
+
+func newHealthChecker(names []string, probe probeFunc, interval time.Duration, lookup func(string) ([]dns.RR, error), clk clock.Clock) *healthChecker {
+	c := &healthChecker{
+		names:    map[string]bool{},
+		probe:    probe,
+		interval: interval,
+		timeout:  5 * time.Second,
+		lookup:   lookup,
+		clock:    clock.Or(clk),
+		health:   map[string]map[string]*addressHealth{},
+	}
+	if c.timeout > interval {
+		c.timeout = interval
+	}
+	for _, name := range names {
+		c.names[dns.Fqdn(strings.ToLower(name))] = true
+	}
+
+	// Spread the probes out over part of the interval.
+	c.sched = scheduler.New(&scheduler.Config{
+		Jitter:        interval / 4,
+		MaxConcurrent: 8,
+		Clock:         c.clock,
+	})
+
+	return c
+}
+
+func (c *healthChecker) run() {
+	for {
+		c.check()
+		<-c.clock.NewTimer(c.interval).C()
+	}
+}
+
+// Probes every address currently published by the listed names, returning
+// once all of the probes have finished.
+func (c *healthChecker) check() {
+	var wg sync.WaitGroup
+	for name := range c.names {
+		rrs, err := c.lookup(name)
+		if err != nil {
+			log.Warne(err, "couldn't look up addresses of ", name, " to probe")
+			continue
+		}
+
+		published := map[string]net.IP{}
+		for _, rr := range rrs {
+			if ip := rrIP(rr); ip != nil {
+				published[ip.String()] = ip
+			}
+		}
+
+		c.mu.Lock()
+		if c.health[name] == nil {
+			c.health[name] = map[string]*addressHealth{}
+		}
+		for addr := range c.health[name] {
+			if _, ok := published[addr]; !ok {
+				delete(c.health[name], addr)
+			}
+		}
+		c.mu.Unlock()
+
+		for addr, ip := range published {
+			name, addr, ip := name, addr, ip
+			wg.Add(1)
+			c.sched.Schedule(func() {
+				defer wg.Done()
+				c.probeAddress(name, addr, ip)
+			})
+		}
+	}
+	wg.Wait()
+}
+
+func (c *healthChecker) probeAddress(name, addr string, ip net.IP) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	err := c.probe(ctx, name, ip)
+	cancel()
+
+	h := &addressHealth{
+		Address:     addr,
+		Up:          err == nil,
+		LastChecked: c.clock.Now(),
+	}
+	if err != nil {
+		h.Error = err.Error()
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	prev := c.health[name][addr]
+	if prev != nil && prev.Up != h.Up {
+		if h.Up {
+			log.Info("address ", addr, " of ", name, " is up again")
+		} else {
+			log.Warnf("address %s of %s is down: %v", addr, name, err)
+		}
+	}
+	if c.health[name] != nil {
+		c.health[name][addr] = h
+	}
+}
+
+func rrIP(rr dns.RR) net.IP {
+	switch rr := rr.(type) {
+	case *dns.A:
+		return rr.A
+	case *dns.AAAA:
+		return rr.AAAA
+	}
+	return nil
+}
+
+// Omits addresses found to be down from the records of a listed name. Each
+// address type keeps at least one address: if all of them are down, they are
+// all kept, since a client retrying them may yet succeed, whereas it can do
+// nothing with no addresses at all. Addresses which haven't been probed yet
+// are taken to be up.
+func (c *healthChecker) filter(qname string, rrs []dns.RR) []dns.RR {
+	name := strings.ToLower(qname)
+	if !c.names[name] {
+		return rrs
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	health := c.health[name]
+	down := func(rr dns.RR) bool {
+		ip := rrIP(rr)
+		if ip == nil {
+			return false
+		}
+		h, ok := health[ip.String()]
+		return ok && !h.Up
+	}
+
+	upByType := map[uint16]int{}
+	for _, rr := range rrs {
+		if rrIP(rr) != nil && !down(rr) {
+			upByType[rr.Header().Rrtype]++
+		}
+	}
+
+	out := make([]dns.RR, 0, len(rrs))
+	for _, rr := range rrs {
+		if down(rr) && upByType[rr.Header().Rrtype] > 0 {
+			continue
+		}
+		out = append(out, rr)
+	}
+	return out
+}
+
+// Returns the health of the addresses of each listed name.
+func (c *healthChecker) Status() map[string][]addressHealth {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	status := map[string][]addressHealth{}
+	for name := range c.names {
+		hs := []addressHealth{}
+		for _, h := range c.health[name] {
+			hs = append(hs, *h)
+		}
+		sort.Slice(hs, func(i, j int) bool {
+			return hs[i].Address < hs[j].Address
+		})
+		status[name] = hs
+	}
+	return status
+}
+
+// Filters the answers of a backend for names being health checked.
+type healthBackend struct {
+	b       madns.Backend
+	checker *healthChecker
+}
+
+var _ madns.Backend = &healthBackend{}
+
+func (hb *healthBackend) Lookup(qname, streamIsolationID string) ([]dns.RR, error) {
+	rrs, err := hb.b.Lookup(qname, streamIsolationID)
+	if err != nil {
+		return nil, err
+	}
+
+	return hb.checker.filter(qname, rrs), nil
+}
+
+// Sets up health checks of the listed names' addresses, if configured.
+func (s *Server) setupHealthChecks() error {
+	if s.cfg.HealthCheckNames == "" {
+		return nil
+	}
+
+	if s.cfg.HealthCheckInterval <= 0 {
+		return fmt.Errorf("HealthCheckInterval must be positive")
+	}
+
+	probe, err := parseProbe(s.cfg.HealthCheckProbe)
+	if err != nil {
+		return fmt.Errorf("Invalid HealthCheckProbe: %v", err)
+	}
+
+	var names []string
+	for _, name := range strings.Split(s.cfg.HealthCheckNames, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+
+	s.healthChecker = newHealthChecker(names, probe, time.Duration(s.cfg.HealthCheckInterval)*time.Second,
+		func(name string) ([]dns.RR, error) {
+			return s.currentBackend().Lookup(name, "")
+		}, s.clock)
+	return nil
+}
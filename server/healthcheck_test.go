@@ -0,0 +1,154 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/namecoin/ncdns/backend"
+)
+
+// A probe whose results are set by the test, recording what it probed.
+type fakeProbe struct {
+	mu     sync.Mutex
+	down   map[string]bool
+	probed []string
+}
+
+func (p *fakeProbe) probe(ctx context.Context, name string, ip net.IP) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.probed = append(p.probed, name+" "+ip.String())
+	if p.down[ip.String()] {
+		return fmt.Errorf("connection refused")
+	}
+	return nil
+}
+
+func (p *fakeProbe) setDown(addrs ...string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.down = map[string]bool{}
+	for _, addr := range addrs {
+		p.down[addr] = true
+	}
+}
+
+func TestHealthChecks(t *testing.T) {
+	b, err := backend.New(&backend.Config{
+		CacheMaxEntries: 100,
+		FakeNames: map[string]string{
+			"d/example": `{"ip":["192.0.2.1","192.0.2.2"],"ip6":["2001:db8::1"],"map":{"www":{"ip":["192.0.2.3","192.0.2.4"]}}}`,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := &fakeProbe{}
+	c := newHealthChecker([]string{"WWW.example.bit"}, p.probe, time.Millisecond, func(name string) ([]dns.RR, error) {
+		return b.Lookup(name, "")
+	}, nil)
+	hb := &healthBackend{b: b, checker: c}
+
+	addrs := func(qname string) string {
+		rrs, err := hb.Lookup(qname, "")
+		if err != nil {
+			t.Fatalf("lookup of %s failed: %v", qname, err)
+		}
+		var ss []string
+		for _, rr := range rrs {
+			if ip := rrIP(rr); ip != nil {
+				ss = append(ss, ip.String())
+			}
+		}
+		sort.Strings(ss)
+		return strings.Join(ss, " ")
+	}
+
+	// Addresses which haven't been probed yet are served.
+	if got := addrs("www.example.bit."); got != "192.0.2.3 192.0.2.4" {
+		t.Errorf("before probing: got %s", got)
+	}
+
+	p.setDown("192.0.2.3", "192.0.2.1")
+	c.check()
+
+	sort.Strings(p.probed)
+	if fmt.Sprint(p.probed) != "[www.example.bit. 192.0.2.3 www.example.bit. 192.0.2.4]" {
+		t.Errorf("unexpected probes %v; only listed names should be probed", p.probed)
+	}
+	if got := addrs("www.example.bit."); got != "192.0.2.4" {
+		t.Errorf("with one address down: got %s", got)
+	}
+
+	// Names which aren't listed are never filtered.
+	if got := addrs("example.bit."); got != "192.0.2.1 192.0.2.2 2001:db8::1" {
+		t.Errorf("unlisted name: got %s", got)
+	}
+
+	// Never go below one address.
+	p.setDown("192.0.2.3", "192.0.2.4")
+	c.check()
+	if got := addrs("www.example.bit."); got != "192.0.2.3 192.0.2.4" {
+		t.Errorf("with all addresses down: got %s", got)
+	}
+
+	p.setDown()
+	c.check()
+	if got := addrs("www.example.bit."); got != "192.0.2.3 192.0.2.4" {
+		t.Errorf("after recovery: got %s", got)
+	}
+
+	status := c.Status()["www.example.bit."]
+	if len(status) != 2 || status[0].Address != "192.0.2.3" || !status[0].Up || status[0].LastChecked.IsZero() {
+		t.Errorf("unexpected status %+v", status)
+	}
+}
+
+func TestParseProbe(t *testing.T) {
+	for _, spec := range []string{"tcp:80", "http:8080/health", "http:80", "icmp"} {
+		if _, err := parseProbe(spec); err != nil {
+			t.Errorf("%s: %v", spec, err)
+		}
+	}
+
+	for _, spec := range []string{"", "tcp", "tcp:0", "tcp:http", "http:/health", "icmp:1", "udp:53"} {
+		if _, err := parseProbe(spec); err == nil {
+			t.Errorf("%s: expected error", spec)
+		}
+	}
+}
+
+func TestTCPProbe(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+
+	probe, err := parseProbe(fmt.Sprintf("tcp:%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := probe(ctx, "www.example.bit.", net.ParseIP("127.0.0.1")); err != nil {
+		t.Errorf("probe of listening port failed: %v", err)
+	}
+
+	l.Close()
+	if err := probe(ctx, "www.example.bit.", net.ParseIP("127.0.0.1")); err == nil {
+		t.Errorf("probe of closed port succeeded")
+	}
+}
@@ -0,0 +1,209 @@
+package server
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/namecoin/ncdns/rrsort"
+)
+
+// The differences between the successive versions of the zone built for
+// transfers, one for each block at which it was transferred, by which an
+// IXFR is answered with only what changed since the client's serial (RFC
+// 1995). Versions are dropped, oldest first, beyond maxVersions or once the
+// records of all the differences are more than maxRecords.
+type xferJournal struct {
+	maxVersions int
+	maxRecords  int
+
+	versions []*zoneVersion // oldest first, each following on from the one before
+	records  int            // in all the versions
+}
+
+// How a version of the zone differs from the one before it.
+type zoneVersion struct {
+	from, to *dns.SOA
+	deleted  []dns.RR
+	added    []dns.RR
+}
+
+// Records the differences between the zone last built, prev (nil if there
+// was none), and the zone next built, rrs, each with its SOA first and last.
+// Unless the serial has moved on, the versions can't be told apart, so the
+// journal is started afresh.
+func (j *xferJournal) record(prev, rrs []dns.RR) {
+	to := rrs[0].(*dns.SOA)
+	if prev == nil || int32(to.Serial-prev[0].(*dns.SOA).Serial) <= 0 {
+		j.versions, j.records = nil, 0
+		return
+	}
+
+	v := &zoneVersion{from: prev[0].(*dns.SOA), to: to}
+	v.deleted, v.added = diffZones(prev, rrs)
+	j.versions = append(j.versions, v)
+	j.records += len(v.deleted) + len(v.added)
+
+	for len(j.versions) > 0 && (len(j.versions) > j.maxVersions || j.records > j.maxRecords) {
+		j.records -= len(j.versions[0].deleted) + len(j.versions[0].added)
+		j.versions = j.versions[1:]
+	}
+}
+
+// Returns the net change from the version with the given serial to the
+// latest, which has the serial current: the records deleted and added, and
+// the SOA of the version. Records changed and changed back in between are
+// left out. ok is false if the version isn't in the journal.
+func (j *xferJournal) since(serial, current uint32) (from *dns.SOA, deleted, added []dns.RR, ok bool) {
+	if len(j.versions) == 0 || j.versions[len(j.versions)-1].to.Serial != current {
+		return nil, nil, nil, false
+	}
+	start := -1
+	for i, v := range j.versions {
+		if v.from.Serial == serial {
+			start = i
+			break
+		}
+	}
+	if start < 0 {
+		return nil, nil, nil, false
+	}
+
+	// Each record is in the zone at the start and not the end, or the other
+	// way round, if it was deleted once more than it was added, or added
+	// once more than deleted.
+	type change struct {
+		rr dns.RR
+		n  int
+	}
+	changes := map[string]*change{}
+	count := func(rrs []dns.RR, n int) {
+		for _, rr := range rrs {
+			k := rr.String()
+			c, ok := changes[k]
+			if !ok {
+				c = &change{rr: rr}
+				changes[k] = c
+			}
+			c.n += n
+		}
+	}
+	for _, v := range j.versions[start:] {
+		count(v.deleted, -1)
+		count(v.added, 1)
+	}
+
+	for _, c := range changes {
+		switch {
+		case c.n < 0:
+			deleted = append(deleted, c.rr)
+		case c.n > 0:
+			added = append(added, c.rr)
+		}
+	}
+	rrsort.Sort(deleted)
+	rrsort.Sort(added)
+	return j.versions[start].from, deleted, added, true
+}
+
+// Returns the records of the zone rrs which aren't in the zone prev, and
+// those of prev which aren't in rrs, leaving out the SOA records, which are
+// always different.
+func diffZones(prev, rrs []dns.RR) (deleted, added []dns.RR) {
+	inPrev := make(map[string]bool, len(prev))
+	for _, rr := range prev[1 : len(prev)-1] {
+		inPrev[rr.String()] = true
+	}
+	inNext := make(map[string]bool, len(rrs))
+	for _, rr := range rrs[1 : len(rrs)-1] {
+		k := rr.String()
+		inNext[k] = true
+		if !inPrev[k] {
+			added = append(added, rr)
+		}
+	}
+	for _, rr := range prev[1 : len(prev)-1] {
+		if !inNext[rr.String()] {
+			deleted = append(deleted, rr)
+		}
+	}
+	return deleted, added
+}
+
+// Returns the records with which to answer an IXFR, req, for the zone whose
+// current SOA is cur: the SOA alone if the client's serial is current, or
+// the net change since its serial, by RFC 1995's condensed form of a single
+// difference. Returns nil if the whole zone must be sent instead, as the
+// client's version isn't in the journal or it didn't give its serial.
+func (x *zoneTransfers) incremental(req *dns.Msg, cur *dns.SOA) []dns.RR {
+	var theirs *dns.SOA
+	for _, rr := range req.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			theirs = soa
+		}
+	}
+	if theirs == nil {
+		return nil
+	}
+	if theirs.Serial == cur.Serial {
+		return []dns.RR{cur}
+	}
+	if x.journal == nil {
+		return nil
+	}
+
+	x.mu.Lock()
+	from, deleted, added, ok := x.journal.since(theirs.Serial, cur.Serial)
+	x.mu.Unlock()
+	if !ok {
+		return nil
+	}
+
+	rrs := make([]dns.RR, 0, len(deleted)+len(added)+4)
+	rrs = append(rrs, cur, from)
+	rrs = append(rrs, deleted...)
+	rrs = append(rrs, cur)
+	rrs = append(rrs, added...)
+	return append(rrs, cur)
+}
+
+// Returns the signatures of a zone as built for a transfer which may sign the
+// same RRsets in the next version, by the text of the RRsets they cover:
+// those which are valid for at least half of xferSignatureValidity more.
+// Reusing them leaves unchanged RRsets out of the differences sent by IXFR.
+func reusableSignatures(rrs []dns.RR, now time.Time) map[string]*dns.RRSIG {
+	rrsets := map[rrsetKey][]dns.RR{}
+	var sigs []*dns.RRSIG
+	for _, rr := range rrs[1 : len(rrs)-1] {
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			sigs = append(sigs, sig)
+			continue
+		}
+		key := rrsetKey{strings.ToLower(rr.Header().Name), rr.Header().Rrtype}
+		rrsets[key] = append(rrsets[key], rr)
+	}
+	// The SOA is first and last, so it was skipped above.
+	rrsets[rrsetKey{strings.ToLower(rrs[0].Header().Name), dns.TypeSOA}] = rrs[:1]
+
+	reusable := map[string]*dns.RRSIG{}
+	until := uint32(now.Add(xferSignatureValidity / 2).Unix())
+	for _, sig := range sigs {
+		rrset := rrsets[rrsetKey{strings.ToLower(sig.Hdr.Name), sig.TypeCovered}]
+		if len(rrset) > 0 && int32(sig.Expiration-until) > 0 {
+			reusable[rrsetText(rrset)] = sig
+		}
+	}
+	return reusable
+}
+
+// The text of an RRset, the same whatever the order of its records.
+func rrsetText(rrset []dns.RR) string {
+	lines := make([]string, len(rrset))
+	for i, rr := range rrset {
+		lines[i] = rr.String()
+	}
+	sort.Strings(lines)
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,159 @@
+package server
+
+import (
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/namecoin/ncdns/backend"
+	"github.com/namecoin/ncdns/namecoin"
+)
+
+// Builds versions of a zone whose names change from one serial to the next,
+// as the blocks changing them would, checking that an IXFR from each version
+// turns it into the latest.
+func TestIXFRJournal(t *testing.T) {
+	ks, err := generateKeySet("bit.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var serial uint32
+	b, err := backend.New(&backend.Config{CacheMaxEntries: 100, SOASerial: func() uint32 { return serial }})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	x := &zoneTransfers{zone: "bit.", journal: &xferJournal{maxVersions: 10, maxRecords: 100000}}
+	build := func(s uint32, names map[string]string) []dns.RR {
+		serial = s
+		var prev []dns.RR
+		var reuse map[string]*dns.RRSIG
+		if x.cached != nil {
+			prev = x.cached.rrs
+			reuse = reusableSignatures(prev, time.Now())
+		}
+		rrs, err := buildZone(b, ks, "bit.", reuse, time.Now(), func(f func(name string, nameData *namecoin.NameData) error) error {
+			keys := make([]string, 0, len(names))
+			for name := range names {
+				keys = append(keys, name)
+			}
+			sort.Strings(keys)
+			for _, name := range keys {
+				if err := f(name, &namecoin.NameData{Value: names[name], ExpiresIn: 30000}); err != nil {
+					return err
+				}
+			}
+			return nil
+		}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		x.journal.record(prev, rrs)
+		x.cached = &transferredZone{serial: s, rrs: rrs}
+		return rrs
+	}
+
+	v100 := build(100, map[string]string{"d/a": `{"ip":"192.0.2.1"}`, "d/b": `{"ip":"192.0.2.2"}`, "d/c": `{"ip":"192.0.2.3"}`})
+	build(101, map[string]string{"d/a": `{"ip":"192.0.2.1"}`, "d/b": `{"ip":"192.0.2.22"}`, "d/c": `{"ip":"192.0.2.3"}`, "d/d": `{"ip":"192.0.2.4"}`})
+	v102 := build(102, map[string]string{"d/a": `{"ip":"192.0.2.1"}`, "d/b": `{"ip":"192.0.2.2"}`, "d/d": `{"ip":"192.0.2.4"}`})
+	cur := v102[0].(*dns.SOA)
+
+	ixfr := func(serial uint32) []dns.RR {
+		req := new(dns.Msg)
+		req.SetIxfr("bit.", serial, "ns.bit.", "hostmaster.bit.")
+		return x.incremental(req, cur)
+	}
+
+	// From 100, b is back as it was, so its address isn't sent, whatever
+	// happened in between; only its NSEC record, which now points to d, has
+	// changed. Signatures are only reused from the version before, so its
+	// address has been signed again.
+	diff := ixfr(100)
+	if len(diff) < 4 || diff[0] != cur || diff[1].(*dns.SOA).Serial != 100 || diff[len(diff)-1] != cur {
+		t.Fatalf("unexpected IXFR from 100: %v", diff)
+	}
+	for _, rr := range diff {
+		if _, ok := rr.(*dns.RRSIG); ok || rr.Header().Rrtype == dns.TypeNSEC {
+			continue
+		}
+		if strings.EqualFold(rr.Header().Name, "b.bit.") {
+			t.Errorf("unchanged record sent: %v", rr)
+		}
+	}
+	if got, want := applyIXFR(t, v100, diff), zoneText(v102); got != want {
+		t.Errorf("IXFR from 100 gives\n%s\nexpected\n%s", got, want)
+	}
+
+	if diff := ixfr(102); len(diff) != 1 || diff[0] != cur {
+		t.Errorf("IXFR from the current serial got %v", diff)
+	}
+	if diff := ixfr(99); diff != nil {
+		t.Errorf("IXFR from a serial not in the journal got %d records", len(diff))
+	}
+	if diff := x.incremental(new(dns.Msg).SetAxfr("bit."), cur); diff != nil {
+		t.Errorf("IXFR without a serial got %d records", len(diff))
+	}
+
+	// Only the last version is kept.
+	x.journal.maxVersions = 1
+	build(103, map[string]string{"d/a": `{"ip":"192.0.2.1"}`})
+	if _, _, _, ok := x.journal.since(101, 103); ok {
+		t.Errorf("version beyond IXFRJournalBlocks kept")
+	}
+	if _, _, _, ok := x.journal.since(102, 103); !ok {
+		t.Errorf("last version not kept")
+	}
+
+	// The serial going back starts the journal afresh.
+	build(50, map[string]string{"d/a": `{"ip":"192.0.2.1"}`})
+	if len(x.journal.versions) != 0 || x.journal.records != 0 {
+		t.Errorf("journal kept after the serial went back: %d versions", len(x.journal.versions))
+	}
+}
+
+// Applies the condensed IXFR diff to the zone rrs, returning the text of the
+// result.
+func applyIXFR(t *testing.T, rrs, diff []dns.RR) string {
+	zone := map[string]bool{}
+	for _, rr := range rrs[1 : len(rrs)-1] {
+		zone[rr.String()] = true
+	}
+
+	adding := false
+	for _, rr := range diff[2 : len(diff)-1] {
+		if _, ok := rr.(*dns.SOA); ok {
+			adding = true
+			continue
+		}
+		k := rr.String()
+		switch {
+		case adding:
+			zone[k] = true
+		case !zone[k]:
+			t.Errorf("deleted record not in the zone: %s", k)
+		default:
+			delete(zone, k)
+		}
+	}
+	return setText(zone)
+}
+
+func zoneText(rrs []dns.RR) string {
+	zone := map[string]bool{}
+	for _, rr := range rrs[1 : len(rrs)-1] {
+		zone[rr.String()] = true
+	}
+	return setText(zone)
+}
+
+func setText(zone map[string]bool) string {
+	lines := make([]string, 0, len(zone))
+	for k := range zone {
+		lines = append(lines, k)
+	}
+	sort.Strings(lines)
+	return strings.Join(lines, "\n")
+}
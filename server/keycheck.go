@@ -0,0 +1,110 @@
+package server
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/base64"
+	"fmt"
+	"math/big"
+	"os"
+	"runtime"
+
+	"github.com/miekg/dns"
+)
+
+// Checks that privatek is the private half of k, so that a mismatched key
+// pair is caught at startup rather than producing bogus signatures.
+func checkKeyPair(k *dns.DNSKEY, privatek crypto.PrivateKey, privateFn string) error {
+	pub, err := derivePublicKey(k, privatek)
+	if err != nil {
+		return fmt.Errorf("Couldn't check private key file %s against its DNSKEY: %v", privateFn, err)
+	}
+
+	actual := *k
+	actual.PublicKey = pub
+	if actual.PublicKey != k.PublicKey {
+		return fmt.Errorf("Private key file %s does not match its DNSKEY: expected key tag %d, private key has key tag %d",
+			privateFn, k.KeyTag(), actual.KeyTag())
+	}
+
+	return nil
+}
+
+// Returns the DNSKEY public key field for the private key. The DNSKEY
+// private key format is redundant with the public key, and when reading it
+// dns.DNSKEY fills in the public part from the DNSKEY rather than the private
+// key file, so the public part has to be derived from the private values.
+func derivePublicKey(k *dns.DNSKEY, privatek crypto.PrivateKey) (string, error) {
+	var buf []byte
+
+	switch p := privatek.(type) {
+	case *rsa.PrivateKey:
+		if len(p.Primes) < 2 {
+			return "", fmt.Errorf("RSA private key has no primes")
+		}
+		n := new(big.Int).Set(p.Primes[0])
+		for _, prime := range p.Primes[1:] {
+			n.Mul(n, prime)
+		}
+
+		e := big.NewInt(int64(p.E)).Bytes()
+		if len(e) < 256 {
+			buf = append(buf, byte(len(e)))
+		} else {
+			buf = append(buf, 0, byte(len(e)>>8), byte(len(e)))
+		}
+		buf = append(buf, e...)
+		buf = append(buf, n.Bytes()...)
+
+	case *ecdsa.PrivateKey:
+		// DNSKEY holds the point as X and Y, each padded to the curve size.
+		x, y := p.Curve.ScalarBaseMult(p.D.Bytes())
+		size := (p.Curve.Params().BitSize + 7) / 8
+		buf = make([]byte, 2*size)
+		x.FillBytes(buf[:size])
+		y.FillBytes(buf[size:])
+
+	case ed25519.PrivateKey:
+		buf = p.Public().(ed25519.PublicKey)
+
+	default:
+		return "", fmt.Errorf("unsupported private key type for algorithm %d", k.Algorithm)
+	}
+
+	return base64.StdEncoding.EncodeToString(buf), nil
+}
+
+// Checks that a private key file can't be read by other users. A readable file
+// is only warned about unless StrictKeyPermissions is set.
+func (s *Server) checkKeyPermissions(privateFn string) error {
+	fi, err := os.Stat(privateFn)
+	if err != nil {
+		return err
+	}
+
+	err = keyPermissionsError(privateFn, fi.Mode())
+	if err == nil || s.cfg.DNSSEC.StrictKeyPermissions {
+		return err
+	}
+
+	log.Warne(err, "insecure private key file permissions")
+	return nil
+}
+
+// Returns an error if a private key file with the given mode can be read by
+// other users.
+func keyPermissionsError(privateFn string, mode os.FileMode) error {
+	if runtime.GOOS == "windows" {
+		// Unix permission bits don't reflect Windows ACLs.
+		return nil
+	}
+
+	if mode.Perm()&0077 == 0 {
+		return nil
+	}
+
+	return fmt.Errorf("Private key file %s is accessible by other users (mode %04o); it should be readable only by its owner",
+		privateFn, mode.Perm())
+}
@@ -0,0 +1,104 @@
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// Writes a freshly generated key pair to dir, returning the file names.
+func writeKeyPair(t *testing.T, dir, name string, alg uint8, bits int) (pubFn, privFn string) {
+	k := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: "bit.", Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 86400},
+		Flags:     256,
+		Protocol:  3,
+		Algorithm: alg,
+	}
+	privatek, err := k.Generate(bits)
+	if err != nil {
+		t.Fatalf("Couldn't generate key: %v", err)
+	}
+
+	pubFn, privFn = name+".key", name+".private"
+	if err := ioutil.WriteFile(filepath.Join(dir, pubFn), []byte(k.String()+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, privFn), []byte(k.PrivateKeyString(privatek)), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return
+}
+
+func TestLoadKeyPairMatches(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ncdns-keycheck")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := &Server{cfg: Config{ConfigDir: dir}}
+
+	for _, alg := range []struct {
+		alg  uint8
+		bits int
+	}{
+		{dns.RSASHA256, 1024},
+		{dns.ECDSAP256SHA256, 256},
+		{dns.ECDSAP384SHA384, 384},
+		{dns.ED25519, 256},
+	} {
+		name := fmt.Sprintf("alg%d", alg.alg)
+		pubFn, privFn := writeKeyPair(t, dir, name, alg.alg, alg.bits)
+		if _, _, err := s.loadKey(pubFn, privFn); err != nil {
+			t.Errorf("Matching %s key pair was rejected: %v", dns.AlgorithmToString[alg.alg], err)
+		}
+
+		otherPubFn, _ := writeKeyPair(t, dir, name+"-other", alg.alg, alg.bits)
+		_, _, err := s.loadKey(otherPubFn, privFn)
+		if err == nil {
+			t.Errorf("Mismatched %s key pair was accepted", dns.AlgorithmToString[alg.alg])
+			continue
+		}
+		if !strings.Contains(err.Error(), privFn) || !strings.Contains(err.Error(), "expected key tag") {
+			t.Errorf("Mismatch error doesn't name the file and key tags: %v", err)
+		}
+	}
+}
+
+func TestLoadKeyPermissions(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("permission bits are not checked on Windows")
+	}
+
+	dir, err := ioutil.TempDir("", "ncdns-keycheck")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	pubFn, privFn := writeKeyPair(t, dir, "zsk", dns.ECDSAP256SHA256, 256)
+	if err := os.Chmod(filepath.Join(dir, privFn), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	lax := &Server{cfg: Config{ConfigDir: dir}}
+	if _, _, err := lax.loadKey(pubFn, privFn); err != nil {
+		t.Errorf("World-readable key was rejected without StrictKeyPermissions: %v", err)
+	}
+
+	strict := &Server{cfg: Config{ConfigDir: dir, DNSSEC: DNSSECConfig{StrictKeyPermissions: true}}}
+	_, _, err = strict.loadKey(pubFn, privFn)
+	if err == nil {
+		t.Fatalf("World-readable key was accepted with StrictKeyPermissions")
+	}
+	if !strings.Contains(err.Error(), privFn) {
+		t.Errorf("Permission error doesn't name the file: %v", err)
+	}
+}
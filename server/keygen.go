@@ -0,0 +1,146 @@
+package server
+
+import (
+	"crypto"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// The DNSSEC algorithms the engine can sign with, and the key size (in bits)
+// each is generated with by default.
+var signingAlgorithms = map[uint8]int{
+	dns.RSASHA1:          2048,
+	dns.RSASHA1NSEC3SHA1: 2048,
+	dns.RSASHA256:        2048,
+	dns.RSASHA512:        2048,
+	dns.ECDSAP256SHA256:  256,
+	dns.ECDSAP384SHA384:  384,
+	dns.ED25519:          256,
+}
+
+// KeyAlgorithms returns the mnemonics of the DNSSEC algorithms ncdns can sign
+// with, e.g. "ECDSAP256SHA256", in order of algorithm number.
+func KeyAlgorithms() []string {
+	algs := make([]int, 0, len(signingAlgorithms))
+	for alg := range signingAlgorithms {
+		algs = append(algs, int(alg))
+	}
+	sort.Ints(algs)
+
+	names := make([]string, len(algs))
+	for i, alg := range algs {
+		names[i] = dns.AlgorithmToString[uint8(alg)]
+	}
+	return names
+}
+
+// ParseKeyAlgorithm parses a DNSSEC algorithm given by mnemonic or number,
+// returning an error if ncdns can't sign with it.
+func ParseKeyAlgorithm(s string) (uint8, error) {
+	alg, ok := dns.StringToAlgorithm[strings.ToUpper(s)]
+	if !ok {
+		n, err := strconv.ParseUint(s, 10, 8)
+		if err != nil {
+			return 0, fmt.Errorf("Unknown DNSSEC algorithm %q", s)
+		}
+		alg = uint8(n)
+	}
+
+	return alg, checkKeyAlgorithm(alg)
+}
+
+// Returns an error naming the algorithm if the engine can't sign with it.
+func checkKeyAlgorithm(alg uint8) error {
+	if _, ok := signingAlgorithms[alg]; ok {
+		return nil
+	}
+
+	name := dns.AlgorithmToString[alg]
+	if name == "" {
+		name = "unknown"
+	}
+	return fmt.Errorf("DNSSEC algorithm %d (%s) isn't supported for signing; use one of %s",
+		alg, name, strings.Join(KeyAlgorithms(), ", "))
+}
+
+// GenerateKey generates a DNSKEY for zone with the given flags (257 for a KSK,
+// 256 for a ZSK) and algorithm. If bits is 0, the algorithm's default key size
+// is used; it is only meaningful for RSA.
+func GenerateKey(zone string, flags uint16, alg uint8, bits int) (*dns.DNSKEY, crypto.PrivateKey, error) {
+	err := checkKeyAlgorithm(alg)
+	if err != nil {
+		return nil, nil, err
+	}
+	if bits == 0 {
+		bits = signingAlgorithms[alg]
+	}
+
+	k := &dns.DNSKEY{
+		Hdr: dns.RR_Header{
+			Name:   dns.Fqdn(zone),
+			Rrtype: dns.TypeDNSKEY,
+			Class:  dns.ClassINET,
+			Ttl:    86400,
+		},
+		Flags:     flags,
+		Protocol:  3,
+		Algorithm: alg,
+	}
+
+	privatek, err := k.Generate(bits)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return k, privatek, nil
+}
+
+// WriteKeyFiles writes a key to dir as dnssec-keygen does, as a .key file
+// holding the DNSKEY and a .private file holding the private key, both named
+// K<zone>+<algorithm>+<key tag>. Returns the path of the files without their
+// extension. Existing files aren't overwritten.
+func WriteKeyFiles(dir string, k *dns.DNSKEY, privatek crypto.PrivateKey) (string, error) {
+	kind := "ZSK"
+	if k.Flags&dns.SEP != 0 {
+		kind = "KSK"
+	}
+
+	base := filepath.Join(dir, fmt.Sprintf("K%s+%03d+%05d", k.Hdr.Name, k.Algorithm, k.KeyTag()))
+	public := fmt.Sprintf("; This is a %s, keyid %d, for %s\n%s\n", kind, k.KeyTag(), k.Hdr.Name, k.String())
+
+	err := writeNewFile(base+".private", []byte(k.PrivateKeyString(privatek)), 0600)
+	if err != nil {
+		return "", err
+	}
+
+	err = writeNewFile(base+".key", []byte(public), 0644)
+	if err != nil {
+		os.Remove(base + ".private")
+		return "", err
+	}
+
+	return base, nil
+}
+
+// Like ioutil.WriteFile, but fails if the file already exists.
+func writeNewFile(path string, data []byte, perm os.FileMode) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(path)
+	}
+	return err
+}
@@ -0,0 +1,118 @@
+package server
+
+import (
+	"crypto"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestGenerateKeyFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ncdns-keygen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := &Server{cfg: Config{ConfigDir: dir}}
+	rr, err := dns.NewRR("example.bit. 600 IN A 192.0.2.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"RSASHA256", "ECDSAP256SHA256", "ED25519"} {
+		alg, err := ParseKeyAlgorithm(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		k, privatek, err := GenerateKey("bit", 257, alg, 0)
+		if err != nil {
+			t.Fatalf("Couldn't generate %s key: %v", name, err)
+		}
+		base, err := WriteKeyFiles(dir, k, privatek)
+		if err != nil {
+			t.Fatal(err)
+		}
+		base = filepath.Base(base)
+		if !strings.HasPrefix(base, "Kbit.+0") {
+			t.Errorf("%s key files named %s, not as by dnssec-keygen", name, base)
+		}
+
+		// The files are loaded as those written by dnssec-keygen are.
+		loaded, loadedPrivate, err := s.loadKey(base+".key", base+".private")
+		if err != nil {
+			t.Fatalf("Couldn't load generated %s key: %v", name, err)
+		}
+		if loaded.KeyTag() != k.KeyTag() || loaded.Algorithm != alg {
+			t.Errorf("loaded %s key %v, expected %v", name, loaded, k)
+		}
+
+		sig := &dns.RRSIG{
+			Hdr:        dns.RR_Header{Name: "example.bit.", Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: 600},
+			Algorithm:  loaded.Algorithm,
+			KeyTag:     loaded.KeyTag(),
+			SignerName: loaded.Hdr.Name,
+			Inception:  uint32(time.Now().Add(-time.Hour).Unix()),
+			Expiration: uint32(time.Now().Add(time.Hour).Unix()),
+		}
+		if err := sig.Sign(loadedPrivate.(crypto.Signer), []dns.RR{rr}); err != nil {
+			t.Fatalf("Couldn't sign with %s key: %v", name, err)
+		}
+		if err := sig.Verify(loaded, []dns.RR{rr}); err != nil {
+			t.Errorf("%s signature doesn't verify: %v", name, err)
+		}
+
+		if _, err := WriteKeyFiles(dir, k, privatek); err == nil {
+			t.Errorf("%s key files were overwritten", name)
+		}
+	}
+}
+
+func TestLoadKeyUnsupportedAlgorithm(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ncdns-keygen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	key := "bit. 86400 IN DNSKEY 257 3 16 zFwI9WSKzGvHE6m63/8cRKZa+/H5s0zper9v782a6TrXnc2uGrjIZVb1HOORnnCv4y/gg24YNOkH\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "ed448.key"), []byte(key), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "ed448.private"), []byte("Private-key-format: v1.3\nAlgorithm: 16 (ED448)\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Server{cfg: Config{ConfigDir: dir}}
+	_, _, err = s.loadKey("ed448.key", "ed448.private")
+	if err == nil || !strings.Contains(err.Error(), "ED448") || !strings.Contains(err.Error(), "ed448.key") {
+		t.Errorf("got error %v, expected one naming the algorithm and the file", err)
+	}
+
+	if _, err := ParseKeyAlgorithm("DSA"); err == nil {
+		t.Errorf("DSA was accepted for signing")
+	}
+}
+
+func TestLoadKeyBadPrivateKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ncdns-keygen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	pubFn, privFn := writeKeyPair(t, dir, "zsk", dns.ECDSAP256SHA256, 256)
+	if err := ioutil.WriteFile(filepath.Join(dir, privFn), []byte("Private-key-format: v1.3\nAlgorithm: 13 (ECDSAP256SHA256)\nPrivateKey: !!!\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Server{cfg: Config{ConfigDir: dir}}
+	if _, _, err := s.loadKey(pubFn, privFn); err == nil {
+		t.Errorf("malformed private key file was accepted")
+	}
+}
@@ -0,0 +1,349 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// An address to listen on, for one address family.
+type bindAddr struct {
+	ip   net.IP
+	port int
+
+	// Set if the address is the unspecified address of its family, in which
+	// case failing to listen on it isn't fatal so long as the other family
+	// works (e.g. on hosts with IPv6 disabled).
+	wildcard bool
+
+	// "udp" or "tcp" if only that protocol is listened for, or "" for both.
+	proto string
+}
+
+func (ba *bindAddr) family() string {
+	if ba.ip.To4() != nil {
+		return "4"
+	}
+	return "6"
+}
+
+func (ba *bindAddr) String() string {
+	return net.JoinHostPort(ba.ip.String(), strconv.Itoa(ba.port))
+}
+
+// Determines the addresses to listen on for a BindAddresses setting. An empty
+// host or "::" yields the unspecified address of each family, so that IPv4
+// clients are served from an IPv4 socket rather than as IPv4-mapped addresses
+// on a dual-stack one. A hostname yields every address it resolves to.
+func bindAddrs(bind string, lookupIP func(host string) ([]net.IP, error)) ([]bindAddr, error) {
+	host, portStr, err := net.SplitHostPort(bind)
+	if err != nil {
+		return nil, err
+	}
+
+	port, err := net.LookupPort("udp", portStr)
+	if err != nil {
+		return nil, err
+	}
+
+	var ips []net.IP
+	wildcard := false
+	switch ip := net.ParseIP(host); {
+	case host == "" || (ip != nil && ip.Equal(net.IPv6unspecified)):
+		// "::" conventionally means a dual-stack socket, so serve both families.
+		ips = []net.IP{net.IPv4zero, net.IPv6unspecified}
+		wildcard = true
+	case ip != nil:
+		ips = []net.IP{ip}
+	default:
+		ips, err = lookupIP(host)
+		if err != nil {
+			return nil, fmt.Errorf("Couldn't resolve bind host %q: %v", host, err)
+		}
+	}
+
+	var addrs []bindAddr
+	seen := map[string]struct{}{}
+	for _, ip := range ips {
+		ip = canonicalIP(ip)
+		if _, ok := seen[ip.String()]; ok {
+			continue
+		}
+		seen[ip.String()] = struct{}{}
+
+		addrs = append(addrs, bindAddr{ip: ip, port: port, wildcard: wildcard})
+	}
+
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("host %q in BindAddresses has no addresses", host)
+	}
+
+	return addrs, nil
+}
+
+// Prefixes of an address in BindAddresses restricting it to one protocol, e.g.
+// for a deployment which fronts TCP with a separate proxy.
+var bindProtoPrefixes = []string{"udp://", "tcp://"}
+
+// Determines the addresses to listen on for BindAddresses, a comma-separated
+// list of addresses, each of which may be prefixed with udp:// or tcp:// to
+// listen for only that protocol. The addresses of each item are returned
+// together, as by bindAddrs.
+func parseBind(bind string, lookupIP func(host string) ([]net.IP, error)) ([][]bindAddr, error) {
+	var items [][]bindAddr
+	for _, item := range strings.Split(bind, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		proto := ""
+		for _, prefix := range bindProtoPrefixes {
+			if len(item) > len(prefix) && strings.EqualFold(item[:len(prefix)], prefix) {
+				proto, item = prefix[:3], item[len(prefix):]
+			}
+		}
+		if strings.Contains(item, "://") {
+			return nil, fmt.Errorf("address %q in BindAddresses has an unknown protocol; use udp:// or tcp://", item)
+		}
+
+		addrs, err := bindAddrs(item, lookupIP)
+		if err != nil {
+			return nil, err
+		}
+		for i := range addrs {
+			addrs[i].proto = proto
+		}
+		items = append(items, addrs)
+	}
+
+	if len(items) == 0 {
+		return nil, fmt.Errorf("BindAddresses gives no addresses")
+	}
+
+	return items, nil
+}
+
+// Number of ports tried when BindAddresses gives port 0, in case the port
+// chosen for TCP is taken for UDP.
+const listenPortAttempts = 10
+
+// Creates UDP and TCP listeners for every address in the BindAddresses setting.
+// An address with port 0 gets the port chosen for the first such address, so
+// that clients reach every listener on the same port. If any address can't be
+// listened on, none are. The listeners for TLSBind are created too. If ncdns
+// was started by systemd's socket activation, the sockets passed are taken
+// instead.
+func (s *Server) listen() error {
+	items, err := parseBind(s.cfg.BindAddresses, net.LookupIP)
+	if err != nil {
+		return wrapError(ErrConfigInvalid, err)
+	}
+
+	if files := listenFDs(); files != nil {
+		return s.adoptSockets(files, items)
+	}
+
+	port := 0
+	for _, addrs := range items {
+		var firstErr error
+		listened := false
+		for i := range addrs {
+			if addrs[i].port == 0 && port != 0 {
+				addrs[i].port = port
+			}
+
+			err := s.listenAddr(&addrs[i])
+			if err == nil {
+				listened = true
+				if addrs[i].port == 0 {
+					port = s.DNSPort()
+				}
+				continue
+			}
+			if !addrs[i].wildcard {
+				s.closeListeners()
+				return err
+			}
+
+			log.Warne(err, "couldn't listen on ", addrs[i].String())
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+
+		// A wildcard address fails only if neither family works.
+		if !listened {
+			s.closeListeners()
+			return firstErr
+		}
+	}
+
+	err = s.listenTLS()
+	if err != nil {
+		s.closeListeners()
+		return err
+	}
+
+	return nil
+}
+
+// Creates UDP and TCP listeners on an address. For port 0, the port the OS
+// chooses for TCP is then requested for UDP, so that both get the same one.
+func (s *Server) listenAddr(ba *bindAddr) error {
+	switch ba.proto {
+	case "udp":
+		udpConn, err := net.ListenUDP("udp"+ba.family(), &net.UDPAddr{IP: ba.ip, Port: ba.port})
+		if err != nil {
+			return err
+		}
+		err = setReceiveBuffer(udpConn, s.cfg.UDPReceiveBufferBytes)
+		if err != nil {
+			udpConn.Close()
+			return err
+		}
+		s.udpConns = append(s.udpConns, udpConn)
+		return nil
+	case "tcp":
+		tcpListener, err := net.ListenTCP("tcp"+ba.family(), &net.TCPAddr{IP: ba.ip, Port: ba.port})
+		if err != nil {
+			return err
+		}
+		s.tcpListeners = append(s.tcpListeners, tcpListener)
+		return nil
+	}
+
+	var err error
+	for i := 0; i < listenPortAttempts; i++ {
+		var tcpListener *net.TCPListener
+		tcpListener, err = net.ListenTCP("tcp"+ba.family(), &net.TCPAddr{IP: ba.ip, Port: ba.port})
+		if err != nil {
+			return err
+		}
+
+		port := tcpListener.Addr().(*net.TCPAddr).Port
+		var udpConn *net.UDPConn
+		udpConn, err = net.ListenUDP("udp"+ba.family(), &net.UDPAddr{IP: ba.ip, Port: port})
+		if err != nil {
+			tcpListener.Close()
+			if ba.port == 0 {
+				continue // the port is taken for UDP; try another
+			}
+			return err
+		}
+
+		err = setReceiveBuffer(udpConn, s.cfg.UDPReceiveBufferBytes)
+		if err != nil {
+			udpConn.Close()
+			tcpListener.Close()
+			return err
+		}
+
+		s.udpConns = append(s.udpConns, udpConn)
+		s.tcpListeners = append(s.tcpListeners, tcpListener)
+		return nil
+	}
+
+	return err
+}
+
+// Returns the addresses the DNS listeners are bound to, with the port chosen
+// if BindAddresses gave port 0.
+func (s *Server) UDPAddrs() []*net.UDPAddr {
+	s.listenersMu.RLock()
+	defer s.listenersMu.RUnlock()
+
+	var addrs []*net.UDPAddr
+	for _, conn := range s.udpConns {
+		addrs = append(addrs, conn.LocalAddr().(*net.UDPAddr))
+	}
+	return addrs
+}
+
+func (s *Server) TCPAddrs() []*net.TCPAddr {
+	s.listenersMu.RLock()
+	defer s.listenersMu.RUnlock()
+
+	var addrs []*net.TCPAddr
+	for _, l := range s.tcpListeners {
+		addrs = append(addrs, l.Addr().(*net.TCPAddr))
+	}
+	return addrs
+}
+
+// Returns the address the webserver is listening at, with the port chosen if
+// HTTPListenAddr gave port 0, or nil if it isn't enabled.
+func (s *Server) HTTPAddr() net.Addr {
+	if s.web == nil {
+		return nil
+	}
+	return s.web.addr()
+}
+
+// Returns the network and address at which the webserver listens for
+// HTTPListenAddr: a Unix socket if it's unix:PATH, e.g. for fronting it with
+// nginx, and otherwise TCP.
+func webListenAddr(listenAddr string) (network, addr string) {
+	if strings.HasPrefix(listenAddr, "unix:") {
+		return "unix", strings.TrimPrefix(listenAddr, "unix:")
+	}
+	return "tcp", listenAddr
+}
+
+// Returns the port of the first DNS listener, or 0 if there are none.
+func (s *Server) DNSPort() int {
+	s.listenersMu.RLock()
+	defer s.listenersMu.RUnlock()
+
+	if len(s.udpConns) > 0 {
+		return s.udpConns[0].LocalAddr().(*net.UDPAddr).Port
+	}
+	if len(s.tcpListeners) > 0 {
+		return s.tcpListeners[0].Addr().(*net.TCPAddr).Port
+	}
+	return 0
+}
+
+// Returns ip in its shortest form, so that an IPv4-mapped IPv6 address
+// (::ffff:a.b.c.d) is treated as the IPv4 address it represents. Anything
+// which matches client addresses against prefixes must use this, or an IPv4
+// prefix will fail to match clients reaching a dual-stack socket.
+func canonicalIP(ip net.IP) net.IP {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip
+}
+
+// Returns the canonical IP address of the client which sent a query.
+func clientIP(rw dns.ResponseWriter) net.IP {
+	switch addr := rw.RemoteAddr().(type) {
+	case *net.UDPAddr:
+		return canonicalIP(addr.IP)
+	case *net.TCPAddr:
+		return canonicalIP(addr.IP)
+	default:
+		host, _, err := net.SplitHostPort(addr.String())
+		if err != nil {
+			return nil
+		}
+		return canonicalIP(net.ParseIP(host))
+	}
+}
+
+// Closes the listeners created by listen, before they have been started.
+func (s *Server) closeListeners() {
+	for _, conn := range s.udpConns {
+		conn.Close()
+	}
+	for _, l := range s.tcpListeners {
+		l.Close()
+	}
+	for _, l := range s.tlsListeners {
+		l.Close()
+	}
+	s.udpConns, s.tcpListeners, s.tlsListeners = nil, nil, nil
+}
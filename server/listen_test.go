@@ -0,0 +1,280 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestBindAddrs(t *testing.T) {
+	lookupIP := func(host string) ([]net.IP, error) {
+		switch host {
+		case "localhost":
+			return []net.IP{net.ParseIP("127.0.0.1"), net.ParseIP("::1")}, nil
+		case "mapped":
+			return []net.IP{net.ParseIP("::ffff:192.0.2.1"), net.ParseIP("192.0.2.1")}, nil
+		default:
+			return nil, fmt.Errorf("no such host")
+		}
+	}
+
+	tests := []struct {
+		bind     string
+		expected []string
+		wildcard bool
+	}{
+		{":53", []string{"0.0.0.0:53", "[::]:53"}, true},
+		{"[::]:5353", []string{"0.0.0.0:5353", "[::]:5353"}, true},
+		{"0.0.0.0:53", []string{"0.0.0.0:53"}, false},
+		{"127.0.0.1:53", []string{"127.0.0.1:53"}, false},
+		{"[::ffff:127.0.0.1]:53", []string{"127.0.0.1:53"}, false},
+		{"localhost:domain", []string{"127.0.0.1:53", "[::1]:53"}, false},
+		{"mapped:53", []string{"192.0.2.1:53"}, false},
+	}
+
+	for _, test := range tests {
+		addrs, err := bindAddrs(test.bind, lookupIP)
+		if err != nil {
+			t.Errorf("%s: %v", test.bind, err)
+			continue
+		}
+
+		var got []string
+		for i := range addrs {
+			got = append(got, addrs[i].String())
+			if addrs[i].wildcard != test.wildcard {
+				t.Errorf("%s: address %s has wildcard %v", test.bind, addrs[i].String(), addrs[i].wildcard)
+			}
+		}
+		if fmt.Sprint(got) != fmt.Sprint(test.expected) {
+			t.Errorf("%s: got %v, expected %v", test.bind, got, test.expected)
+		}
+	}
+
+	for _, bind := range []string{"nonexistent:53", "127.0.0.1", "127.0.0.1:notaport"} {
+		if _, err := bindAddrs(bind, lookupIP); err == nil {
+			t.Errorf("%s: expected error", bind)
+		}
+	}
+}
+
+func TestListenLocalhost(t *testing.T) {
+	s := &Server{cfg: Config{BindAddresses: "localhost:0"}}
+	addrs, err := bindAddrs(s.cfg.BindAddresses, net.LookupIP)
+	if err != nil {
+		t.Skipf("localhost doesn't resolve: %v", err)
+	}
+
+	for i := range addrs {
+		if err := s.listenAddr(&addrs[i]); err != nil {
+			t.Logf("couldn't listen on %s: %v", addrs[i].String(), err)
+		}
+	}
+	defer func() {
+		for i := range s.udpConns {
+			s.udpConns[i].Close()
+			s.tcpListeners[i].Close()
+		}
+	}()
+
+	if len(s.udpConns) == 0 {
+		t.Fatalf("couldn't listen on any address for localhost")
+	}
+
+	for i, conn := range s.udpConns {
+		ip := conn.LocalAddr().(*net.UDPAddr).IP
+		if !ip.IsLoopback() {
+			t.Errorf("listening on non-loopback address %s", ip)
+		}
+		if (ip.To4() == nil) != (s.tcpListeners[i].Addr().(*net.TCPAddr).IP.To4() == nil) {
+			t.Errorf("UDP and TCP listeners %d are of different families", i)
+		}
+	}
+}
+
+func TestListenPortZero(t *testing.T) {
+	s := &Server{cfg: Config{BindAddresses: ":0"}}
+	if err := s.listen(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.closeListeners()
+
+	// Every listener gets the same port, so that clients can reach any of
+	// them on the one port reported.
+	port := s.DNSPort()
+	if port == 0 {
+		t.Fatalf("no port chosen")
+	}
+	for _, a := range s.UDPAddrs() {
+		if a.Port != port {
+			t.Errorf("UDP listener %s not on port %d", a, port)
+		}
+	}
+	for _, a := range s.TCPAddrs() {
+		if a.Port != port {
+			t.Errorf("TCP listener %s not on port %d", a, port)
+		}
+	}
+}
+
+func TestParseBind(t *testing.T) {
+	lookupIP := func(host string) ([]net.IP, error) {
+		return nil, fmt.Errorf("no such host")
+	}
+
+	tests := []struct {
+		bind     string
+		expected [][]string
+	}{
+		{"127.0.0.1:53", [][]string{{"127.0.0.1:53"}}},
+		{"127.0.0.1:53, 192.0.2.1:5353", [][]string{{"127.0.0.1:53"}, {"192.0.2.1:5353"}}},
+		{"udp://127.0.0.1:53,TCP://[::1]:53", [][]string{{"udp 127.0.0.1:53"}, {"tcp [::1]:53"}}},
+		{"tcp://:53", [][]string{{"tcp 0.0.0.0:53", "tcp [::]:53"}}},
+	}
+
+	for _, test := range tests {
+		items, err := parseBind(test.bind, lookupIP)
+		if err != nil {
+			t.Errorf("%s: %v", test.bind, err)
+			continue
+		}
+
+		var got [][]string
+		for _, addrs := range items {
+			var item []string
+			for i := range addrs {
+				a := addrs[i].String()
+				if addrs[i].proto != "" {
+					a = addrs[i].proto + " " + a
+				}
+				item = append(item, a)
+			}
+			got = append(got, item)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(test.expected) {
+			t.Errorf("%s: got %v, expected %v", test.bind, got, test.expected)
+		}
+	}
+
+	for _, bind := range []string{"", " , ", "tls://127.0.0.1:853", "127.0.0.1:53,127.0.0.1"} {
+		if _, err := parseBind(bind, lookupIP); err == nil {
+			t.Errorf("%q: expected error", bind)
+		}
+	}
+}
+
+func TestListenMultiple(t *testing.T) {
+	s := &Server{cfg: Config{BindAddresses: "127.0.0.1:0,udp://127.0.0.2:0,tcp://127.0.0.3:0"}}
+	if err := s.listen(); err != nil {
+		t.Skipf("couldn't listen on the loopback addresses: %v", err)
+	}
+	defer s.closeListeners()
+
+	port := s.DNSPort()
+	var udp, tcp []string
+	for _, a := range s.UDPAddrs() {
+		udp = append(udp, a.String())
+	}
+	for _, a := range s.TCPAddrs() {
+		tcp = append(tcp, a.String())
+	}
+	expectedUDP := fmt.Sprintf("[127.0.0.1:%d 127.0.0.2:%d]", port, port)
+	expectedTCP := fmt.Sprintf("[127.0.0.1:%d 127.0.0.3:%d]", port, port)
+	if fmt.Sprint(udp) != expectedUDP || fmt.Sprint(tcp) != expectedTCP {
+		t.Errorf("listening on UDP %v and TCP %v, expected %s and %s", udp, tcp, expectedUDP, expectedTCP)
+	}
+}
+
+func TestListenFailureReleases(t *testing.T) {
+	busy, err := net.ListenTCP("tcp4", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+
+	// The first address is listened on before the second turns out to be
+	// taken, and must then be released.
+	s := &Server{cfg: Config{BindAddresses: "udp://127.0.0.1:0," + busy.Addr().String()}}
+	if err := s.listen(); err == nil {
+		s.closeListeners()
+		t.Fatalf("listening on %s, which is taken, succeeded", busy.Addr())
+	}
+	if len(s.udpConns) != 0 || len(s.tcpListeners) != 0 {
+		t.Errorf("listeners kept after a failure: %v, %v", s.UDPAddrs(), s.TCPAddrs())
+	}
+
+	cfg := newErrorTestConfig(".")
+	cfg.BindAddresses = "127.0.0.1:0," + busy.Addr().String()
+	if _, err := New(cfg); err == nil {
+		t.Errorf("New succeeded with BindAddresses %s, which is taken", busy.Addr())
+	}
+}
+
+// A dns.ResponseWriter which records the response written to it.
+type fakeResponseWriter struct {
+	dns.ResponseWriter
+	msg  *dns.Msg
+	addr net.Addr
+}
+
+// The response's sections are copied, as the caller may reuse them once
+// WriteMsg returns, but not their records.
+func (rw *fakeResponseWriter) WriteMsg(m *dns.Msg) error {
+	c := *m
+	c.Question = append([]dns.Question(nil), m.Question...)
+	c.Answer = append([]dns.RR(nil), m.Answer...)
+	c.Ns = append([]dns.RR(nil), m.Ns...)
+	c.Extra = append([]dns.RR(nil), m.Extra...)
+	rw.msg = &c
+	return nil
+}
+
+func (rw *fakeResponseWriter) RemoteAddr() net.Addr {
+	if rw.addr == nil {
+		return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53}
+	}
+	return rw.addr
+}
+
+// Port 53 on the loopback address, over the same transport as the client.
+func (rw *fakeResponseWriter) LocalAddr() net.Addr {
+	if _, ok := rw.RemoteAddr().(*net.TCPAddr); ok {
+		return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53}
+	}
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53}
+}
+
+// A fakeResponseWriter for a query received at a local address.
+type localAddrWriter struct {
+	*fakeResponseWriter
+	local net.Addr
+}
+
+func (rw *localAddrWriter) LocalAddr() net.Addr {
+	return rw.local
+}
+
+func TestClientIPv4Mapped(t *testing.T) {
+	_, prefix, _ := net.ParseCIDR("192.0.2.0/24")
+
+	for _, addr := range []net.Addr{
+		&net.UDPAddr{IP: net.ParseIP("::ffff:192.0.2.1"), Port: 1234},
+		&net.TCPAddr{IP: net.ParseIP("::ffff:192.0.2.1"), Port: 1234},
+		&net.UDPAddr{IP: net.ParseIP("192.0.2.1").To4(), Port: 1234},
+	} {
+		ip := clientIP(&fakeResponseWriter{addr: addr})
+		if len(ip) != net.IPv4len || !ip.Equal(net.ParseIP("192.0.2.1")) {
+			t.Errorf("%v: got client IP %v (length %d), expected 4-byte 192.0.2.1", addr, ip, len(ip))
+		}
+		if !prefix.Contains(ip) {
+			t.Errorf("%v: client IP doesn't match %v", addr, prefix)
+		}
+	}
+
+	ip := clientIP(&fakeResponseWriter{addr: &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 1234}})
+	if len(ip) != net.IPv6len || prefix.Contains(ip) {
+		t.Errorf("IPv6 client IP mangled: %v", ip)
+	}
+}
@@ -0,0 +1,166 @@
+//go:build !no_webserver
+// +build !no_webserver
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/miekg/dns"
+
+	"github.com/namecoin/ncdns/backend"
+	"github.com/namecoin/ncdns/clock"
+	"github.com/namecoin/ncdns/util"
+)
+
+// The result of /api/v1/trace/: the records a lookup of the name found, of
+// the type asked for, if any, the steps taken to find them and the work they
+// took, by stage, out of QueryWorkBudget.
+type traceResult struct {
+	Name   string              `json:"name"`
+	Type   string              `json:"type,omitempty"`
+	Answer []string            `json:"answer"`
+	Error  string              `json:"error,omitempty"`
+	Steps  []backend.TraceStep `json:"steps"`
+	Work   backend.WorkReport  `json:"work"`
+}
+
+// Traces a lookup of the name in the path, as made to answer a DNS query for
+// it, e.g. /api/v1/trace/www.example.bit?type=AAAA. Like ?trace=1 for
+// /api/v1/lookup, it may only be requested from a loopback address.
+func (ws *webServer) handleTrace(rw http.ResponseWriter, req *http.Request) {
+	if !isLoopbackRequest(req) {
+		writeJSON(rw, http.StatusForbidden, &apiError{Error: "lookups may only be traced from a loopback address"})
+		return
+	}
+
+	qname := dns.Fqdn(strings.ToLower(strings.TrimPrefix(req.URL.Path, "/api/v1/trace/")))
+	if _, ok := dns.IsDomainName(qname); !ok || qname == "." {
+		writeJSON(rw, http.StatusBadRequest, &apiError{Error: fmt.Sprintf("%q isn't a domain name", qname)})
+		return
+	}
+	if _, _, _, err := util.SplitDomainByFloatingAnchor(qname, "bit"); err != nil {
+		writeJSON(rw, http.StatusBadRequest, &apiError{Error: fmt.Sprintf("%s isn't a name under .bit", qname)})
+		return
+	}
+
+	res := &traceResult{Name: qname, Answer: []string{}}
+	qtype := dns.TypeANY
+	if t := req.FormValue("type"); t != "" {
+		var ok bool
+		qtype, ok = dns.StringToType[strings.ToUpper(t)]
+		if !ok {
+			writeJSON(rw, http.StatusBadRequest, &apiError{Error: fmt.Sprintf("unknown type %q", t)})
+			return
+		}
+		res.Type = dns.TypeToString[qtype]
+	}
+
+	var rrs []dns.RR
+	var err error
+	res.Steps, rrs, res.Work, err = ws.s.traceLookup(qname)
+	if err != nil {
+		res.Error = err.Error()
+	}
+	for _, rr := range rrs {
+		// A CNAME answers queries of every type.
+		if t := rr.Header().Rrtype; qtype == dns.TypeANY || t == qtype || t == dns.TypeCNAME {
+			res.Answer = append(res.Answer, rr.String())
+		}
+	}
+	writeJSON(rw, http.StatusOK, res)
+}
+
+// Traces a lookup of qname by the backend, as made to answer a DNS query for
+// it, with the same work budget, and the signing of the records found. Values
+// fetched are truncated to HTTPTraceMaxValueBytes in the steps returned.
+func (s *Server) traceLookup(qname string) (steps []backend.TraceStep, rrs []dns.RR, work backend.WorkReport, err error) {
+	trace := backend.NewLookupTrace()
+	wb := backend.NewWorkBudget(s.cfg.QueryWorkBudget, qname)
+	ctx := backend.WithWorkBudget(backend.WithLookupTrace(context.Background(), trace), wb)
+	rrs, err = s.currentBackend().LookupContext(ctx, qname, "")
+	if err == nil {
+		s.traceSigning(trace, wb, qname, rrs)
+	}
+
+	steps = trace.Steps()
+	for i := range steps {
+		if steps[i].Step == "fetch" {
+			steps[i].Detail = truncateTraceValue(steps[i].Detail, s.cfg.HTTP.TraceMaxValueBytes)
+		}
+	}
+	return steps, rrs, wb.Report(), err
+}
+
+// Truncates value to limit bytes, at a character boundary, saying how much
+// was cut. A limit of 0 or less leaves it whole.
+func truncateTraceValue(value string, limit int) string {
+	if limit <= 0 || len(value) <= limit {
+		return value
+	}
+
+	n := limit
+	for n > 0 && !utf8.RuneStart(value[n]) {
+		n--
+	}
+	return fmt.Sprintf("%s... (%d more bytes)", value[:n], len(value)-n)
+}
+
+// Signs each RRset of rrs as the engine would, recording how long it took,
+// and charging the signatures to wb.
+func (s *Server) traceSigning(trace *backend.LookupTrace, wb *backend.WorkBudget, qname string, rrs []dns.RR) {
+	ks := s.keySetForName(qname)
+	switch {
+	case s.unsignedApex(dns.Question{Name: qname}) != "":
+		trace.Add(backend.TraceStep{Step: "sign", Name: qname, Detail: "not signed: served behind an insecure delegation"})
+		return
+	case ks == nil || ks.ZSK == nil:
+		trace.Add(backend.TraceStep{Step: "sign", Name: qname, Detail: "not signed: no zone signing key"})
+		return
+	}
+
+	clk := clock.Or(s.clock)
+	start := clk.Now()
+	rrsets := splitRRsets(rrs)
+	for _, rrset := range rrsets {
+		if _, err := s.signRRset(rrset); err != nil {
+			trace.Add(backend.TraceStep{Step: "sign", Name: rrset[0].Header().Name, Error: err.Error()})
+			return
+		}
+		wb.Charge("sign", backend.WorkUsage{Signatures: 1})
+	}
+
+	trace.Add(backend.TraceStep{
+		Step:           "sign",
+		Name:           qname,
+		Detail:         fmt.Sprintf("signed %d RRsets with ZSK %d", len(rrsets), ks.ZSK.KeyTag()),
+		DurationMicros: clk.Now().Sub(start).Microseconds(),
+	})
+}
+
+// Splits records into RRsets, in the order in which each first appears.
+func splitRRsets(rrs []dns.RR) [][]dns.RR {
+	type rrsetKey struct {
+		name  string
+		rtype uint16
+	}
+
+	var rrsets [][]dns.RR
+	index := map[rrsetKey]int{}
+	for _, rr := range rrs {
+		k := rrsetKey{strings.ToLower(rr.Header().Name), rr.Header().Rrtype}
+		i, ok := index[k]
+		if !ok {
+			i = len(rrsets)
+			index[k] = i
+			rrsets = append(rrsets, nil)
+		}
+		rrsets[i] = append(rrsets[i], rr)
+	}
+
+	return rrsets
+}
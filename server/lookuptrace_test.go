@@ -0,0 +1,156 @@
+//go:build !no_webserver
+// +build !no_webserver
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/namecoin/ncdns/backend"
+)
+
+func TestAPILookupTrace(t *testing.T) {
+	names := map[string]string{
+		"d/example": `{"import":"dd/mail","ip":["192.0.2.1"]}`,
+		"dd/mail":   `{"mx":[[10,"mx.example.com."]]}`,
+	}
+	be, err := backend.New(&backend.Config{CacheMaxEntries: 100, FakeNames: names})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ks, err := generateKeySet("bit.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{backend: be, globalKeySet: ks, httpBreaker: newCircuitBreaker(0, 0, nil)}
+	ws := &webServer{
+		s: s,
+		nameQuery: func(ctx context.Context, name, streamIsolationID string) (string, error) {
+			return names[name], nil
+		},
+	}
+
+	req := httptest.NewRequest("GET", "/api/v1/lookup?q=example.bit&trace=1", nil)
+	rw := httptest.NewRecorder()
+	ws.handleAPILookup(rw, req)
+	if rw.Code != http.StatusForbidden {
+		t.Errorf("trace from %s: got status %d, expected it to be refused", req.RemoteAddr, rw.Code)
+	}
+
+	req.RemoteAddr = "127.0.0.1:1234"
+	rw = httptest.NewRecorder()
+	ws.handleAPILookup(rw, req)
+	if rw.Code != http.StatusOK {
+		t.Fatalf("got status %d", rw.Code)
+	}
+
+	var res apiLookupResult
+	if err := json.Unmarshal(rw.Body.Bytes(), &res); err != nil {
+		t.Fatalf("couldn't decode result: %v", err)
+	}
+	if len(res.Records) != 2 || !res.Valid {
+		t.Errorf("tracing changed the result: %+v", res)
+	}
+
+	var steps []string
+	for _, st := range res.Trace {
+		steps = append(steps, st.Step)
+	}
+	expected := "lookup cache fetch import fetch parsed normalized answer sign"
+	if got := strings.Join(steps, " "); got != expected {
+		t.Fatalf("got steps %q, expected %q", got, expected)
+	}
+	if sign := res.Trace[len(res.Trace)-1]; sign.Error != "" || !strings.Contains(sign.Detail, "signed 2 RRsets") {
+		t.Errorf("got signing step %+v", sign)
+	}
+
+	// Lookups aren't traced unless asked for.
+	rw = httptest.NewRecorder()
+	ws.handleAPILookup(rw, httptest.NewRequest("GET", "/api/v1/lookup?q=example.bit", nil))
+	if strings.Contains(rw.Body.String(), `"trace"`) {
+		t.Errorf("untraced lookup returned a trace: %s", rw.Body.String())
+	}
+}
+
+func TestTraceEndpoint(t *testing.T) {
+	names := map[string]string{
+		"d/example": `{"ip":"192.0.2.1","map":{"www":{"ip":"192.0.2.2","ip6":"2001:db8::2","txt":"` + strings.Repeat("x", 100) + `"}}}`,
+	}
+	be, err := backend.New(&backend.Config{CacheMaxEntries: 100, FakeNames: names})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{backend: be, globalKeySet: &keySet{}, cfg: Config{HTTP: HTTPConfig{TraceMaxValueBytes: 40}}}
+	ws := &webServer{s: s}
+
+	trace := func(url string) (int, *traceResult) {
+		req := httptest.NewRequest("GET", url, nil)
+		req.RemoteAddr = "127.0.0.1:1234"
+		rw := httptest.NewRecorder()
+		ws.handleTrace(rw, req)
+		var res traceResult
+		if rw.Code == http.StatusOK {
+			if err := json.Unmarshal(rw.Body.Bytes(), &res); err != nil {
+				t.Fatalf("%s: couldn't decode result: %v", url, err)
+			}
+		}
+		return rw.Code, &res
+	}
+
+	code, res := trace("/api/v1/trace/WWW.example.bit?type=aaaa")
+	if code != http.StatusOK || res.Name != "www.example.bit." || res.Type != "AAAA" || len(res.Answer) != 1 ||
+		!strings.Contains(res.Answer[0], "2001:db8::2") || res.Error != "" {
+		t.Fatalf("got status %d and %+v", code, res)
+	}
+	var mapped, fetched bool
+	for _, st := range res.Steps {
+		switch st.Step {
+		case "map":
+			mapped = st.Name == "www.example.bit." && st.Detail == `key "www"`
+		case "fetch":
+			fetched = st.Detail == names["d/example"][:40]+"... (140 more bytes)"
+		}
+	}
+	if !mapped || !fetched {
+		t.Errorf("got steps %+v", res.Steps)
+	}
+
+	if code, res := trace("/api/v1/trace/nonexistent.example.bit"); code != http.StatusOK || res.Error == "" || len(res.Answer) != 0 {
+		t.Errorf("name missing from the map: got status %d and %+v", code, res)
+	}
+	for _, url := range []string{"/api/v1/trace/example.bit?type=NOSUCHTYPE", "/api/v1/trace/example.com", "/api/v1/trace/"} {
+		if code, _ := trace(url); code != http.StatusBadRequest {
+			t.Errorf("%s: got status %d", url, code)
+		}
+	}
+
+	rw := httptest.NewRecorder()
+	ws.handleTrace(rw, httptest.NewRequest("GET", "/api/v1/trace/example.bit", nil))
+	if rw.Code != http.StatusForbidden {
+		t.Errorf("trace from a remote address: got status %d", rw.Code)
+	}
+}
+
+func TestTruncateTraceValue(t *testing.T) {
+	for _, test := range []struct {
+		value    string
+		limit    int
+		expected string
+	}{
+		{"short", 10, "short"},
+		{"exactly", 7, "exactly"},
+		{"truncated", 5, "trunc... (4 more bytes)"},
+		{"ünïcode", 2, "ü... (7 more bytes)"},
+		{"ünïcode", 1, "... (9 more bytes)"},
+		{"unlimited", 0, "unlimited"},
+	} {
+		if got := truncateTraceValue(test.value, test.limit); got != test.expected {
+			t.Errorf("%q truncated to %d bytes: got %q, expected %q", test.value, test.limit, got, test.expected)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime/pprof"
+	"sync"
+	"time"
+
+	"github.com/namecoin/ncdns/clock"
+)
+
+// Heap profiles are written at most this often, however long memory use stays
+// above MemoryWarnBytes.
+const heapProfileInterval = time.Hour
+
+// How often memory use is compared with MemoryWarnBytes.
+const memoryCheckInterval = time.Minute
+
+// Returns the time between sweeps of the name cache for entries unused for
+// idle: often enough that entries don't outlive it by much, but no more than
+// hourly.
+func idleSweepInterval(idle time.Duration) time.Duration {
+	interval := idle / 4
+	if interval > time.Hour {
+		interval = time.Hour
+	}
+	if interval < time.Second {
+		interval = time.Second
+	}
+	return interval
+}
+
+// Periodically evicts the entries of the name cache which haven't been used
+// for CacheIdleEviction, so that an instance running for months doesn't keep
+// every name it has ever been asked for.
+func (s *Server) runIdleEviction() {
+	t := clock.Or(s.clock).NewTicker(idleSweepInterval(time.Duration(s.cfg.Cache.IdleEviction) * time.Second))
+	for range t.C() {
+		if n := s.currentBackend().EvictIdle(); n > 0 {
+			log.Debugf("evicted %d idle name cache entries", n)
+		}
+	}
+}
+
+// Warns when the memory used by the process rises above a threshold, writing a
+// heap profile to a directory, if one is given, to show what it is used for.
+type memoryWatcher struct {
+	threshold  uint64
+	profileDir string
+
+	// Returns the memory used by the process, in bytes.
+	memory func() uint64
+	clock  clock.Clock
+
+	mu          sync.Mutex
+	lastProfile time.Time
+}
+
+func newMemoryWatcher(threshold uint64, profileDir string, clk clock.Clock) *memoryWatcher {
+	return &memoryWatcher{
+		threshold:  threshold,
+		profileDir: profileDir,
+		memory:     residentMemory,
+		clock:      clock.Or(clk),
+	}
+}
+
+func (w *memoryWatcher) run() {
+	for {
+		w.check()
+		<-w.clock.NewTimer(memoryCheckInterval).C()
+	}
+}
+
+// Compares memory use with the threshold and, if it is above it and no profile
+// has been written for heapProfileInterval, warns and writes one. Returns the
+// path of the profile written, if any.
+func (w *memoryWatcher) check() string {
+	used := w.memory()
+	if used <= w.threshold {
+		return ""
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	now := w.clock.Now()
+	if !w.lastProfile.IsZero() && now.Sub(w.lastProfile) < heapProfileInterval {
+		return ""
+	}
+	w.lastProfile = now
+
+	if w.profileDir == "" {
+		log.Warnf("memory use of %d bytes is above MemoryWarnBytes (%d bytes)", used, w.threshold)
+		return ""
+	}
+
+	path, err := writeHeapProfile(w.profileDir, now)
+	if err != nil {
+		log.Warnf("memory use of %d bytes is above MemoryWarnBytes (%d bytes), but couldn't write heap profile: %v", used, w.threshold, err)
+		return ""
+	}
+
+	log.Warnf("memory use of %d bytes is above MemoryWarnBytes (%d bytes); wrote heap profile to %s", used, w.threshold, path)
+	return path
+}
+
+// Writes a heap profile, as read by go tool pprof, to a file in dir named
+// after the time.
+func writeHeapProfile(dir string, now time.Time) (string, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return "", err
+	}
+
+	path := filepath.Join(dir, fmt.Sprintf("heap-%s.pprof", now.UTC().Format("20060102T150405Z")))
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return "", err
+	}
+
+	err = pprof.WriteHeapProfile(f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(path)
+		return "", err
+	}
+
+	return path, nil
+}
@@ -0,0 +1,17 @@
+//go:build !go1.16
+// +build !go1.16
+
+package server
+
+import (
+	"runtime"
+)
+
+// Returns the memory obtained by the Go runtime and not yet returned to the
+// OS, which is close to the resident memory of the process. runtime/metrics,
+// which reads this without stopping the world, needs Go 1.16.
+func residentMemory() uint64 {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	return ms.Sys - ms.HeapReleased
+}
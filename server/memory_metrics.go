@@ -0,0 +1,25 @@
+//go:build go1.16
+// +build go1.16
+
+package server
+
+import (
+	"runtime/metrics"
+)
+
+// Returns the memory mapped by the Go runtime and not yet returned to the OS,
+// which is close to the resident memory of the process.
+func residentMemory() uint64 {
+	samples := []metrics.Sample{
+		{Name: "/memory/classes/total:bytes"},
+		{Name: "/memory/classes/heap/released:bytes"},
+	}
+	metrics.Read(samples)
+
+	for _, s := range samples {
+		if s.Value.Kind() != metrics.KindUint64 {
+			return 0
+		}
+	}
+	return samples[0].Value.Uint64() - samples[1].Value.Uint64()
+}
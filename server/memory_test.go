@@ -0,0 +1,106 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/namecoin/ncdns/backend"
+	"github.com/namecoin/ncdns/testutil"
+)
+
+func TestMemoryWatcher(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ncdns-heap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The real memory use is well above a threshold of one byte.
+	clk := testutil.NewFakeClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	w := newMemoryWatcher(1, filepath.Join(dir, "profiles"), clk)
+
+	path := w.check()
+	if path == "" {
+		t.Fatal("no heap profile was written above the threshold")
+	}
+	if fi, err := os.Stat(path); err != nil || fi.Size() == 0 {
+		t.Errorf("heap profile %s wasn't written: %v", path, err)
+	}
+
+	clk.Advance(heapProfileInterval - time.Second)
+	if path := w.check(); path != "" {
+		t.Errorf("a second heap profile %s was written within %v", path, heapProfileInterval)
+	}
+
+	clk.Advance(time.Second)
+	if path := w.check(); path == "" {
+		t.Errorf("no heap profile was written %v after the first", heapProfileInterval)
+	}
+
+	// Below the threshold, nothing is written however long it has been.
+	w.memory = func() uint64 { return 1 }
+	clk.Advance(24 * time.Hour)
+	if path := w.check(); path != "" {
+		t.Errorf("heap profile %s was written below the threshold", path)
+	}
+
+	files, _ := ioutil.ReadDir(filepath.Join(dir, "profiles"))
+	if len(files) != 2 {
+		t.Errorf("%d heap profiles were written, expected 2", len(files))
+	}
+}
+
+func TestIdleSweepInterval(t *testing.T) {
+	for _, test := range []struct {
+		idle, interval time.Duration
+	}{
+		{24 * time.Hour, time.Hour},
+		{time.Hour, 15 * time.Minute},
+		{time.Second, time.Second},
+	} {
+		if got := idleSweepInterval(test.idle); got != test.interval {
+			t.Errorf("idleSweepInterval(%v) = %v, expected %v", test.idle, got, test.interval)
+		}
+	}
+}
+
+func TestRunIdleEviction(t *testing.T) {
+	clock := testutil.NewFakeClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	be, err := backend.New(&backend.Config{
+		CacheMaxEntries:   100,
+		CacheIdleEviction: 24 * time.Hour,
+		FakeNames:         map[string]string{"d/example": `{"ip":"192.0.2.1"}`},
+		Clock:             clock,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := be.Lookup("example.bit.", ""); err != nil {
+		t.Fatal(err)
+	}
+	if be.CacheBytes() == 0 {
+		t.Fatal("nothing was cached")
+	}
+
+	s := &Server{cfg: Config{Cache: CacheConfig{IdleEviction: 86400}}, backend: be, clock: clock}
+	go s.runIdleEviction()
+	clock.BlockUntil(1)
+
+	// The hourly sweeps keep the entry until it has been idle for more
+	// than a day.
+	clock.Advance(24 * time.Hour)
+	time.Sleep(10 * time.Millisecond)
+	if be.CacheBytes() == 0 {
+		t.Fatal("entry evicted before it was idle for a day")
+	}
+
+	clock.Advance(time.Hour)
+	for deadline := time.Now().Add(5 * time.Second); be.CacheBytes() != 0; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("idle entry wasn't evicted")
+		}
+	}
+}
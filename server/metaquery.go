@@ -0,0 +1,131 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// What is done with a query which isn't an ordinary question about a name.
+type metaAction int
+
+const (
+	metaPass    metaAction = iota // answered by the engine as usual
+	metaNotImp                    // NOTIMP
+	metaFormErr                   // FORMERR
+	metaSOAOnly                   // the zone's SOA alone
+)
+
+// Decides what to do with a query, returning the key it is counted under at
+// /status, or "" for an ordinary query.
+//
+// Unless zone transfers are enabled, when serveTransfer answers AXFR and IXFR
+// over TCP before this is reached, AXFR gets NOTIMP, as RFC 5936 allows,
+// whatever the transport. Over UDP, IXFR gets the current SOA alone, which RFC
+// 1995 says tells the client to retry over TCP; over TCP, it falls back to
+// AXFR, as RFC 1995 says a server without IXFR does. The mail types obsoleted
+// by RFC 973 and RFC 2505 and opcodes other than QUERY get NOTIMP. A query
+// with no question (e.g. sent to probe EDNS or for a cookie, which ncdns
+// doesn't support) gets FORMERR, as RFC 7873 says.
+func classifyMetaQuery(req *dns.Msg, tcp bool) (metaAction, string) {
+	if req.Opcode != dns.OpcodeQuery {
+		name, ok := dns.OpcodeToString[req.Opcode]
+		if !ok {
+			name = fmt.Sprintf("OPCODE%d", req.Opcode)
+		}
+		return metaNotImp, name
+	}
+
+	if len(req.Question) == 0 {
+		if req.IsEdns0() != nil {
+			return metaFormErr, "OPT"
+		}
+		return metaFormErr, "NOQUESTION"
+	}
+
+	switch qtype := req.Question[0].Qtype; qtype {
+	case dns.TypeAXFR:
+		return metaNotImp, "AXFR"
+	case dns.TypeIXFR:
+		if tcp {
+			return metaNotImp, "IXFR"
+		}
+		return metaSOAOnly, "IXFR"
+	case dns.TypeMAILA, dns.TypeMAILB, dns.TypeMD, dns.TypeMF:
+		return metaNotImp, dns.TypeToString[qtype]
+	}
+
+	return metaPass, ""
+}
+
+// Counts of meta-queries by type, for /status.
+type metaQueryCounts struct {
+	mu     sync.Mutex
+	counts map[string]uint64
+}
+
+func (c *metaQueryCounts) add(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.counts == nil {
+		c.counts = make(map[string]uint64)
+	}
+	c.counts[key]++
+}
+
+func (c *metaQueryCounts) Status() map[string]uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	st := make(map[string]uint64, len(c.counts))
+	for k, v := range c.counts {
+		st[k] = v
+	}
+	return st
+}
+
+// Answers a meta-query, returning false if req is an ordinary query which
+// should be passed to the engine.
+func (s *Server) serveMetaQuery(rw dns.ResponseWriter, req *dns.Msg) bool {
+	_, tcp := rw.RemoteAddr().(*net.TCPAddr)
+	action, key := classifyMetaQuery(req, tcp)
+	if action == metaPass {
+		return false
+	}
+	s.metaQueries.add(key)
+
+	if action == metaSOAOnly {
+		// Ask the engine for the SOA, but answer the question asked.
+		soa := req.Copy()
+		soa.Question[0].Qtype = dns.TypeSOA
+		s.currentMux().ServeDNS(&questionWriter{ResponseWriter: rw, question: req.Question}, soa)
+		return true
+	}
+
+	rcode := dns.RcodeNotImplemented
+	if action == metaFormErr {
+		rcode = dns.RcodeFormatError
+	}
+
+	m := new(dns.Msg)
+	m.SetRcode(req, rcode)
+	if req.IsEdns0() != nil {
+		m.SetEdns0(s.ednsUDPSize(), false)
+	}
+	rw.WriteMsg(m)
+	return true
+}
+
+// Replaces the question of the response written with the original one.
+type questionWriter struct {
+	dns.ResponseWriter
+	question []dns.Question
+}
+
+func (rw *questionWriter) WriteMsg(m *dns.Msg) error {
+	m.Question = rw.question
+	return rw.ResponseWriter.WriteMsg(m)
+}
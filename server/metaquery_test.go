@@ -0,0 +1,96 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestMetaQueries(t *testing.T) {
+	udp := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 1234}
+	tcp := &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 1234}
+
+	tests := []struct {
+		opcode int
+		qtype  uint16 // 0: no question
+		edns   bool
+		addr   net.Addr
+		rcode  int
+		key    string
+	}{
+		{dns.OpcodeQuery, dns.TypeA, false, udp, dns.RcodeSuccess, ""},
+		{dns.OpcodeQuery, dns.TypeA, false, tcp, dns.RcodeSuccess, ""},
+		{dns.OpcodeQuery, dns.TypeANY, false, udp, dns.RcodeSuccess, ""},
+		{dns.OpcodeQuery, 0, true, udp, dns.RcodeFormatError, "OPT"},
+		{dns.OpcodeQuery, 0, false, udp, dns.RcodeFormatError, "NOQUESTION"},
+		{dns.OpcodeQuery, dns.TypeAXFR, false, udp, dns.RcodeNotImplemented, "AXFR"},
+		{dns.OpcodeQuery, dns.TypeAXFR, true, tcp, dns.RcodeNotImplemented, "AXFR"},
+		{dns.OpcodeQuery, dns.TypeIXFR, false, udp, dns.RcodeSuccess, "IXFR"},
+		{dns.OpcodeQuery, dns.TypeIXFR, false, tcp, dns.RcodeNotImplemented, "IXFR"},
+		{dns.OpcodeQuery, dns.TypeMAILA, false, udp, dns.RcodeNotImplemented, "MAILA"},
+		{dns.OpcodeQuery, dns.TypeMAILB, true, udp, dns.RcodeNotImplemented, "MAILB"},
+		{dns.OpcodeQuery, dns.TypeMD, false, tcp, dns.RcodeNotImplemented, "MD"},
+		{dns.OpcodeQuery, dns.TypeMF, false, udp, dns.RcodeNotImplemented, "MF"},
+		{dns.OpcodeIQuery, dns.TypeA, false, udp, dns.RcodeNotImplemented, "IQUERY"},
+		{dns.OpcodeStatus, 0, false, udp, dns.RcodeNotImplemented, "STATUS"},
+		{dns.OpcodeNotify, dns.TypeSOA, false, udp, dns.RcodeNotImplemented, "NOTIFY"},
+		{dns.OpcodeUpdate, dns.TypeSOA, false, tcp, dns.RcodeNotImplemented, "UPDATE"},
+		{3, dns.TypeA, false, udp, dns.RcodeNotImplemented, "OPCODE3"},
+	}
+
+	// Stands in for the engine, answering SOA queries with a SOA.
+	s := &Server{mux: dns.NewServeMux()}
+	s.mux.HandleFunc(".", func(rw dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		if req.Question[0].Qtype == dns.TypeSOA {
+			soa, _ := dns.NewRR("bit. 600 IN SOA this.x--nmc.bit. . 1 600 600 7200 600")
+			m.Answer = []dns.RR{soa}
+		}
+		rw.WriteMsg(m)
+	})
+
+	expected := map[string]uint64{}
+	for _, test := range tests {
+		req := new(dns.Msg)
+		if test.qtype != 0 {
+			req.SetQuestion("bit.", test.qtype)
+		}
+		req.Opcode = test.opcode
+		if test.edns {
+			req.SetEdns0(4096, false)
+		}
+		desc := fmt.Sprintf("%s %s over %s", dns.OpcodeToString[test.opcode], dns.TypeToString[test.qtype], test.addr.Network())
+
+		rw := &fakeResponseWriter{addr: test.addr}
+		if handled := s.serveMetaQuery(rw, req); handled != (test.key != "") {
+			t.Errorf("%s: handled %v", desc, handled)
+			continue
+		}
+		if test.key == "" {
+			continue
+		}
+		expected[test.key]++
+
+		m := rw.msg
+		if m == nil || m.Rcode != test.rcode || m.Opcode != test.opcode || (m.IsEdns0() != nil) != test.edns {
+			t.Errorf("%s: unexpected response %v", desc, m)
+			continue
+		}
+		if len(req.Question) > 0 && (len(m.Question) != 1 || m.Question[0] != req.Question[0]) {
+			t.Errorf("%s: question not echoed: %v", desc, m.Question)
+		}
+
+		// The IXFR over UDP gets the SOA alone, telling the client to use TCP.
+		soaOnly := test.rcode == dns.RcodeSuccess
+		if soaOnly != (len(m.Answer) == 1 && m.Answer[0].Header().Rrtype == dns.TypeSOA) {
+			t.Errorf("%s: unexpected answer %v", desc, m.Answer)
+		}
+	}
+
+	if st := s.metaQueries.Status(); fmt.Sprint(st) != fmt.Sprint(expected) {
+		t.Errorf("counted %v, expected %v", st, expected)
+	}
+}
@@ -0,0 +1,113 @@
+package server
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/namecoin/ncdns/clock"
+	"github.com/namecoin/ncdns/metrics"
+)
+
+// Counts of the DNS queries answered, for the metrics endpoint.
+type queryMetrics struct {
+	mu     sync.Mutex
+	counts map[queryMetricsKey]uint64
+
+	duration *metrics.Histogram
+}
+
+type queryMetricsKey struct {
+	qtype, rcode, transport string
+}
+
+func newQueryMetrics() *queryMetrics {
+	return &queryMetrics{
+		counts:   map[queryMetricsKey]uint64{},
+		duration: metrics.NewHistogram(metrics.LatencyBuckets),
+	}
+}
+
+func (qm *queryMetrics) observe(k queryMetricsKey, d time.Duration) {
+	qm.mu.Lock()
+	qm.counts[k]++
+	qm.mu.Unlock()
+
+	qm.duration.Observe(d.Seconds())
+}
+
+// Wraps rw so that the response written to it is counted in the query
+// metrics.
+func (s *Server) metricsWriter(rw dns.ResponseWriter, req *dns.Msg) dns.ResponseWriter {
+	if s.queryMetrics == nil {
+		return rw
+	}
+
+	qtype := "none"
+	if len(req.Question) > 0 {
+		qtype = typeLabel(req.Question[0].Qtype)
+	}
+
+	return &metricsWriter{
+		ResponseWriter: rw,
+		qm:             s.queryMetrics,
+		alerter:        s.servfailAlerter,
+		qtype:          qtype,
+		transport:      s.transport(rw),
+		clock:          clock.Or(s.clock),
+		start:          clock.Or(s.clock).Now(),
+	}
+}
+
+type metricsWriter struct {
+	dns.ResponseWriter
+	qm               *queryMetrics
+	alerter          *servfailAlerter // nil if ServfailAlertRatio is 0
+	qtype, transport string
+	clock            clock.Clock
+	start            time.Time
+}
+
+func (rw *metricsWriter) WriteMsg(m *dns.Msg) error {
+	rcode, ok := dns.RcodeToString[m.Rcode]
+	if !ok {
+		rcode = "other"
+	}
+	rw.qm.observe(queryMetricsKey{rw.qtype, rcode, rw.transport}, rw.clock.Now().Sub(rw.start))
+	if rw.alerter != nil {
+		rw.alerter.observe(m.Rcode)
+	}
+
+	return rw.ResponseWriter.WriteMsg(m)
+}
+
+// Returns the name of a query type, for use as a label. Types with no name
+// are counted together, so that clients can't add labels without limit.
+func typeLabel(qtype uint16) string {
+	if name, ok := dns.TypeToString[qtype]; ok {
+		return name
+	}
+	return "other"
+}
+
+// Returns "udp", "tcp" or "tls", as the query written to rw was received
+// over UDP, TCP or DNS over TLS.
+func (s *Server) transport(rw dns.ResponseWriter) string {
+	if _, ok := rw.RemoteAddr().(*net.UDPAddr); ok {
+		return "udp"
+	}
+
+	if len(s.tlsListeners) == 0 {
+		return "tcp"
+	}
+	if local, ok := rw.LocalAddr().(*net.TCPAddr); ok {
+		for _, a := range s.TLSAddrs() {
+			if a.Port == local.Port {
+				return "tls"
+			}
+		}
+	}
+	return "tcp"
+}
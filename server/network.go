@@ -0,0 +1,68 @@
+package server
+
+import (
+	"github.com/namecoin/ncdns/namecoin"
+)
+
+// The network names are resolved from, for /status.
+type networkStatus struct {
+	Name      string `json:"name"`
+	Test      bool   `json:"test"`
+	NodeChain string `json:"node_chain,omitempty"`
+	Mismatch  bool   `json:"mismatch,omitempty"`
+}
+
+// Asks namecoind which chain it's on, complaining if it isn't the configured
+// network's. Names on another network would be served as if they were on this
+// one.
+func (s *Server) checkNetwork() {
+	chain, err := s.namecoinConn.Chain()
+	if err != nil {
+		if hint := s.namecoinFailureHint(err); hint != "" {
+			log.Errorf("couldn't ask namecoind which network it's on: %v; %s", err, hint)
+		} else {
+			log.Warne(err, "couldn't ask namecoind which network it's on")
+		}
+		return
+	}
+
+	s.nodeChain.Store(chain)
+	if chain != s.network.Chain {
+		log.Errorf("ncdns is configured for the Namecoin %s network, but namecoind is on the %q chain; set NamecoinNetwork or NamecoinRPCEndpoints correctly",
+			s.network.Name, chain)
+	}
+}
+
+// Says what to fix when a request to namecoind fails with err, if it can be
+// told why.
+func (s *Server) namecoinFailureHint(err error) string {
+	switch s.namecoinConn.ClassifyError(err) {
+	case namecoin.FailureUnreachable:
+		return "nothing accepted the connection to NamecoinRPCEndpoints; check that namecoind (or the TLS proxy in front of it) is running and reachable there"
+	case namecoin.FailureTLS:
+		return "the TLS handshake with namecoind failed; check NamecoinRPCTLSCAFile, NamecoinRPCTLSPinSPKI and NamecoinRPCTLSServerName against its certificate, and NamecoinRPCTLSClientCert if it requires one"
+	case namecoin.FailureProxy:
+		return "the SOCKS5 proxy couldn't be reached; check that it (e.g. Tor) is running and listening at NamecoinRPCProxy"
+	case namecoin.FailureProxyTarget:
+		return "the SOCKS5 proxy couldn't connect to NamecoinRPCEndpoints; check that namecoind (or its onion service) is running and reachable there"
+	case namecoin.FailureAuth:
+		return "namecoind refused the RPC credentials; check NamecoinRPCUsername and NamecoinRPCPassword, or that NamecoinRPCCookiePath is namecoind's current cookie"
+	default:
+		return ""
+	}
+}
+
+func (s *Server) networkStatus() *networkStatus {
+	network := s.network
+	if network == nil {
+		network = namecoin.Mainnet
+	}
+
+	st := &networkStatus{Name: network.Name, Test: network.IsTest()}
+	if chain, ok := s.nodeChain.Load().(string); ok {
+		st.NodeChain = chain
+		st.Mismatch = chain != network.Chain
+	}
+
+	return st
+}
@@ -0,0 +1,166 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+
+	"github.com/namecoin/ncdns/namecoin"
+)
+
+// A namecoind on regtest, with a few blocks mined, holding d/example.
+func fakeRegtestRPC(rw http.ResponseWriter, req *http.Request) {
+	var call struct {
+		Method string      `json:"method"`
+		ID     interface{} `json:"id"`
+	}
+	json.NewDecoder(req.Body).Decode(&call)
+
+	res := map[string]interface{}{"id": call.ID, "error": nil}
+	switch call.Method {
+	case "getblockchaininfo":
+		res["result"] = map[string]interface{}{"chain": "regtest", "blocks": 150}
+	case "name_show":
+		res["result"] = map[string]interface{}{
+			"name":       "d/example",
+			"value":      `{"ip":["192.0.2.1"]}`,
+			"expires_in": 20,
+			"expired":    false,
+		}
+	default:
+		res["error"] = map[string]interface{}{"code": -32601, "message": "Method not found"}
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(res)
+}
+
+func TestRegtest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ncdns-regtest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	rpc := httptest.NewServer(http.HandlerFunc(fakeRegtestRPC))
+	defer rpc.Close()
+
+	for _, network := range []string{"regtest", "mainnet"} {
+		cfg := newErrorTestConfig(dir)
+		cfg.RPC.Network = network
+		cfg.RPC.Endpoints = strings.TrimPrefix(rpc.URL, "http://")
+		cfg.RPC.Username = "user"
+		cfg.RPC.Password = "pass"
+		cfg.RPC.Timeout = 1500
+
+		s, err := New(cfg)
+		if err != nil {
+			t.Fatalf("%s: %v", network, err)
+		}
+
+		req := new(dns.Msg)
+		req.SetQuestion("example.bit.", dns.TypeA)
+		rw := &fakeResponseWriter{}
+		s.ServeDNS(rw, req)
+		if rw.msg == nil || rw.msg.Rcode != dns.RcodeSuccess || len(rw.msg.Answer) == 0 {
+			t.Errorf("%s: lookup failed: %v", network, rw.msg)
+		}
+
+		s.checkNetwork()
+		st := s.networkStatus()
+		if st.Name != network || st.Test != (network == "regtest") || st.NodeChain != "regtest" || st.Mismatch != (network == "mainnet") {
+			t.Errorf("%s: unexpected status %+v", network, st)
+		}
+
+		s.stop()
+	}
+
+	cfg := newErrorTestConfig(dir)
+	cfg.RPC.Network = "signet"
+	if _, err := New(cfg); err == nil || !strings.Contains(err.Error(), "signet") {
+		t.Errorf("unknown network: got %v", err)
+	}
+}
+
+func TestNamecoinConnConfigs(t *testing.T) {
+	cfg := &Config{RPC: RPCConfig{
+		Endpoints:  "192.0.2.1:8336, alice:secret@192.0.2.2:8336,192.0.2.3:8336",
+		Username:   "user",
+		Password:   "pass",
+		CookiePath: "/cookie",
+	}}
+	connCfgs, err := cfg.namecoinConnConfigs(namecoin.Mainnet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(connCfgs) != 3 {
+		t.Fatalf("got %d endpoints, expected 3", len(connCfgs))
+	}
+	for i, expected := range []struct{ host, user, pass string }{
+		{"192.0.2.1:8336", "user", "pass"},
+		{"192.0.2.2:8336", "alice", "secret"},
+		{"192.0.2.3:8336", "user", "pass"},
+	} {
+		c := connCfgs[i]
+		if c.Host != expected.host || c.User != expected.user || c.Pass != expected.pass || c.CookiePath != "/cookie" {
+			t.Errorf("endpoint %d: got %s %s:%s, cookie %s", i, c.Host, c.User, c.Pass, c.CookiePath)
+		}
+	}
+
+	// A cookie path for each address.
+	cfg = &Config{RPC: RPCConfig{Endpoints: "192.0.2.1:8336,192.0.2.2:8336", CookiePath: "/a,/b"}}
+	connCfgs, err = cfg.namecoinConnConfigs(namecoin.Mainnet)
+	if err != nil || connCfgs[0].CookiePath != "/a" || connCfgs[1].CookiePath != "/b" {
+		t.Errorf("per-endpoint cookie paths: got %v", err)
+	}
+
+	cfg.RPC.CookiePath = "/a,/b,/c"
+	if _, err := cfg.namecoinConnConfigs(namecoin.Mainnet); err == nil {
+		t.Errorf("more cookie paths than addresses accepted")
+	}
+
+	// No address means the network's default.
+	connCfgs, err = (&Config{}).namecoinConnConfigs(namecoin.Regtest)
+	if err != nil || len(connCfgs) != 1 || connCfgs[0].Host != "127.0.0.1:18443" {
+		t.Errorf("default address: got %v", err)
+	}
+}
+
+func TestNamecoinRPCProxyConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ncdns-proxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, c := range []struct {
+		addr, proxy string
+	}{
+		{"namecoindxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxx.onion:8336", ""}, // can't be reached directly
+		{"192.0.2.1:8336", "http://127.0.0.1:8080"},
+		{"192.0.2.1:8336", "socks5://127.0.0.1"},
+	} {
+		cfg := newErrorTestConfig(dir)
+		cfg.RPC.Endpoints = c.addr
+		cfg.RPC.Username = "user"
+		cfg.RPC.Password = "pass"
+		cfg.RPC.Proxy = c.proxy
+
+		s, err := New(cfg)
+		if err == nil {
+			s.closeListeners()
+			t.Errorf("started with NamecoinRPCEndpoints %q and NamecoinRPCProxy %q", c.addr, c.proxy)
+			continue
+		}
+		if !errors.Is(err, ErrConfigInvalid) {
+			t.Errorf("got %v, expected a configuration error", err)
+		}
+	}
+}
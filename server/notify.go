@@ -0,0 +1,345 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/namecoin/ncdns/clock"
+	"github.com/namecoin/ncdns/scheduler"
+)
+
+// How long a secondary has to acknowledge each NOTIFY, the delays between
+// attempts, which double from the first up to the cap, and the number of
+// attempts made before giving up until the next block. Each attempt is made
+// after a random delay of up to notifyJitter, so that the secondaries don't
+// all transfer the zone at the same instant, and no more than
+// notifyMaxConcurrent are made at once.
+const (
+	notifyTimeout       = 5 * time.Second
+	notifyFirstRetry    = 2 * time.Second
+	notifyMaxRetry      = 2 * time.Minute
+	notifyMaxAttempts   = 8
+	notifyJitter        = time.Second
+	notifyMaxConcurrent = 8
+)
+
+// Sends DNS NOTIFY messages (RFC 1996) to secondaries whenever a new block
+// changes the SOA serial, so that they transfer the zone at once rather than
+// when their refresh timer next fires.
+//
+// Each attempt to notify a target is a task of sched, which waits out the
+// delay before a retry without taking up one of its slots, so that a target
+// which doesn't answer only delays notifications to itself by the time its
+// attempts take. Blocks found while a target is being notified are coalesced
+// into a single NOTIFY, with the serial current when it's sent.
+type notifier struct {
+	zone    string
+	targets []*notifyTarget
+
+	// Returns the zone's SOA record, which each NOTIFY carries so that a
+	// secondary which is up to date needn't ask for it.
+	soa func() (*dns.SOA, error)
+
+	timeout     time.Duration
+	firstRetry  time.Duration
+	maxRetry    time.Duration
+	maxAttempts int
+
+	sched *scheduler.Scheduler
+	clock clock.Clock // the system clock if nil
+
+	mu      sync.Mutex
+	started bool // guarded by mu; blocks found before are notified of once it is
+}
+
+type notifyTarget struct {
+	// First, so that they're aligned for atomic access on 32-bit platforms
+	acknowledged uint64 // accessed atomically
+	failures     uint64 // accessed atomically; of single attempts
+	abandoned    uint64 // accessed atomically; notifications given up on
+
+	addr string // host:port
+
+	// The TSIG key the NOTIFY is signed with, if any.
+	keyName, algorithm, secret string
+
+	mu         sync.Mutex
+	due        uint64    // guarded by mu; blocks found, each superseding the notification of the last
+	sending    bool      // guarded by mu; whether an attempt is scheduled at once, or being made
+	lastSerial uint32    // guarded by mu; of the last NOTIFY acknowledged
+	lastAck    time.Time // guarded by mu; when it was, or zero if none has been
+	lastError  string    // guarded by mu; why the last attempt failed, if it did
+}
+
+// What /api/v1/zone-status reports of a target.
+type notifyStatus struct {
+	Address      string     `json:"address"`
+	Acknowledged uint64     `json:"acknowledged"`
+	Failures     uint64     `json:"failures"`
+	Abandoned    uint64     `json:"abandoned"`
+	LastSerial   uint32     `json:"last_serial,omitempty"`
+	LastAck      *time.Time `json:"last_ack,omitempty"`
+	LastError    string     `json:"last_error,omitempty"`
+}
+
+// Parses Config.NotifyTargets, a comma-separated list of host:port
+// addresses, each optionally followed by /KEYNAME to sign the NOTIFY with
+// that key of TSIGKey, whose algorithms and secrets are given by name.
+func parseNotifyTargets(s string, algorithms, secrets map[string]string) ([]*notifyTarget, error) {
+	var targets []*notifyTarget
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		t := &notifyTarget{}
+		parts := strings.SplitN(item, "/", 2)
+		t.addr = parts[0]
+		host, port, err := net.SplitHostPort(t.addr)
+		if err != nil || host == "" || port == "" {
+			return nil, fmt.Errorf("NotifyTargets entry %q isn't of the form host:port", item)
+		}
+
+		if len(parts) == 2 {
+			t.keyName = strings.ToLower(dns.Fqdn(parts[1]))
+			secret, ok := secrets[t.keyName]
+			if !ok {
+				return nil, fmt.Errorf("NotifyTargets entry %q names a key which isn't in TSIGKey", item)
+			}
+			t.algorithm, t.secret = algorithms[t.keyName], secret
+		}
+
+		for _, other := range targets {
+			if other.addr == t.addr {
+				return nil, fmt.Errorf("Duplicate NotifyTargets entry: %s", t.addr)
+			}
+		}
+		targets = append(targets, t)
+	}
+
+	return targets, nil
+}
+
+// Sets up NOTIFY messages to the secondaries of NotifyTargets, if any. They
+// transfer the zone, so zone transfers must be enabled.
+func (s *Server) setupNotify() error {
+	if s.cfg.NotifyTargets == "" {
+		return nil
+	}
+	if s.xfer == nil {
+		return fmt.Errorf("NotifyTargets requires XferAllowedIPs or TSIGKey, so that the secondaries notified can transfer the zone")
+	}
+
+	targets, err := parseNotifyTargets(s.cfg.NotifyTargets, s.xfer.algorithms, s.xfer.secrets)
+	if err != nil {
+		return err
+	}
+	if len(targets) == 0 {
+		return nil
+	}
+
+	s.notifier = &notifier{
+		zone:    s.xfer.zone,
+		targets: targets,
+		soa: func() (*dns.SOA, error) {
+			return s.apexSOA(s.xfer.zone)
+		},
+		timeout:     notifyTimeout,
+		firstRetry:  notifyFirstRetry,
+		maxRetry:    notifyMaxRetry,
+		maxAttempts: notifyMaxAttempts,
+		sched: scheduler.New(&scheduler.Config{
+			Jitter:        notifyJitter,
+			MaxConcurrent: notifyMaxConcurrent,
+			Clock:         s.clock,
+		}),
+		clock: s.clock,
+	}
+
+	// The initial block too, since the secondaries may have missed blocks
+	// while ncdns wasn't running.
+	s.bus.subscribe("notify", func(ev interface{}) {
+		if _, ok := ev.(*blockConnected); ok {
+			s.notifier.notifyAll()
+		}
+	})
+	s.shutdown.register(shutdownDrain, "notifier", func(context.Context) error {
+		s.notifier.shutdown()
+		return nil
+	})
+	return nil
+}
+
+// Notifies the targets of the blocks found before, if any.
+func (n *notifier) start() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.started = true
+	for _, t := range n.targets {
+		t.mu.Lock()
+		if t.due > 0 {
+			n.dispatch(t)
+		}
+		t.mu.Unlock()
+	}
+}
+
+// Discards the attempts not yet made, and waits for those being made.
+func (n *notifier) shutdown() {
+	n.sched.Stop()
+}
+
+// Schedules a NOTIFY to each target, without waiting for it.
+func (n *notifier) notifyAll() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	for _, t := range n.targets {
+		t.mu.Lock()
+		t.due++
+		if n.started {
+			n.dispatch(t)
+		}
+		t.mu.Unlock()
+	}
+}
+
+// Schedules the first attempt to notify t of the latest block, unless one is
+// scheduled or being made already, which finds the block once it's done.
+// Must be called with t.mu held.
+func (n *notifier) dispatch(t *notifyTarget) {
+	if t.sending {
+		return
+	}
+
+	t.sending = true
+	due := t.due
+	n.sched.Schedule(func() {
+		n.attempt(t, due, 1, n.firstRetry)
+	})
+}
+
+// Notifies t of the block due counts to, scheduling another attempt after
+// delay if it isn't acknowledged, up to maxAttempts. A block found meanwhile
+// starts the attempts afresh, with its serial.
+func (n *notifier) attempt(t *notifyTarget, due uint64, attempt int, delay time.Duration) {
+	serial, err := n.send(t)
+	t.record(serial, err, clock.Or(n.clock).Now())
+	if err == nil {
+		atomic.AddUint64(&t.acknowledged, 1)
+		log.Infof("notified %s of %s with serial %d", t.addr, n.zone, serial)
+	} else {
+		atomic.AddUint64(&t.failures, 1)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.sending = false
+	if t.due != due {
+		n.dispatch(t)
+		return
+	}
+	if err == nil {
+		return
+	}
+	if attempt >= n.maxAttempts {
+		atomic.AddUint64(&t.abandoned, 1)
+		log.Warne(err, "gave up notifying ", t.addr, " of ", n.zone, " after ", attempt, " attempts; trying again at the next block")
+		return
+	}
+	log.Warne(err, "couldn't notify ", t.addr, " of ", n.zone, "; trying again in ", delay)
+
+	next := delay * 2
+	if next > n.maxRetry {
+		next = n.maxRetry
+	}
+	n.sched.ScheduleAfter(delay, func() {
+		n.retry(t, due, attempt+1, next)
+	})
+}
+
+// Makes another attempt to notify t, unless a block found since the last
+// one has superseded it.
+func (n *notifier) retry(t *notifyTarget, due uint64, attempt int, delay time.Duration) {
+	t.mu.Lock()
+	if t.due != due || t.sending {
+		t.mu.Unlock()
+		return
+	}
+	t.sending = true
+	t.mu.Unlock()
+
+	n.attempt(t, due, attempt, delay)
+}
+
+func (t *notifyTarget) record(serial uint32, err error, now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if err != nil {
+		t.lastError = err.Error()
+		return
+	}
+	t.lastSerial, t.lastAck, t.lastError = serial, now.UTC(), ""
+}
+
+// Returns what's known of each target, in the order of NotifyTargets.
+func (n *notifier) status() []notifyStatus {
+	statuses := make([]notifyStatus, len(n.targets))
+	for i, t := range n.targets {
+		st := notifyStatus{
+			Address:      t.addr,
+			Acknowledged: atomic.LoadUint64(&t.acknowledged),
+			Failures:     atomic.LoadUint64(&t.failures),
+			Abandoned:    atomic.LoadUint64(&t.abandoned),
+		}
+		t.mu.Lock()
+		if !t.lastAck.IsZero() {
+			ack := t.lastAck
+			st.LastSerial, st.LastAck = t.lastSerial, &ack
+		}
+		st.LastError = t.lastError
+		t.mu.Unlock()
+		statuses[i] = st
+	}
+	return statuses
+}
+
+// Sends a NOTIFY to t, returning the serial it carried, or why it wasn't
+// acknowledged.
+func (n *notifier) send(t *notifyTarget) (uint32, error) {
+	soa, err := n.soa()
+	if err != nil {
+		return 0, err
+	}
+
+	m := new(dns.Msg)
+	m.SetNotify(n.zone)
+	m.Answer = []dns.RR{soa}
+	c := &dns.Client{Net: "udp", Timeout: n.timeout}
+	if t.keyName != "" {
+		// The system clock's, as the secondary checks it against its own.
+		m.SetTsig(t.keyName, t.algorithm, tsigFudge, time.Now().Unix())
+		c.TsigSecret = map[string]string{t.keyName: t.secret}
+	}
+
+	r, _, err := c.Exchange(m, t.addr)
+	if err != nil {
+		return 0, err
+	}
+	if r.Opcode != dns.OpcodeNotify || r.Rcode != dns.RcodeSuccess {
+		return 0, fmt.Errorf("NOTIFY answered %s", dns.RcodeToString[r.Rcode])
+	}
+
+	return soa.Serial, nil
+}
@@ -0,0 +1,162 @@
+package server
+
+import (
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/namecoin/ncdns/scheduler"
+)
+
+func TestParseNotifyTargets(t *testing.T) {
+	algorithms := map[string]string{"xfr.example.": dns.HmacSHA256}
+	secrets := map[string]string{"xfr.example.": "c2VjcmV0"}
+
+	targets, err := parseNotifyTargets("192.0.2.53:53, [2001:db8::53]:5353/XFR.example,ns2.example.com:53", algorithms, secrets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(targets) != 3 || targets[0].keyName != "" || targets[1].addr != "[2001:db8::53]:5353" ||
+		targets[1].keyName != "xfr.example." || targets[1].algorithm != dns.HmacSHA256 || targets[2].addr != "ns2.example.com:53" {
+		t.Errorf("unexpected targets %+v", targets)
+	}
+
+	for s, expected := range map[string]string{
+		"192.0.2.53":                     "host:port",
+		"192.0.2.53:53/other.example":    "isn't in TSIGKey",
+		"192.0.2.53:53,192.0.2.53:53":    "Duplicate",
+		":53":                            "host:port",
+		"192.0.2.53:53,2001:db8::53:53":  "host:port",
+		"192.0.2.53:53/xfr.example:junk": "isn't in TSIGKey",
+	} {
+		if _, err := parseNotifyTargets(s, algorithms, secrets); err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("%q: got error %v, expected one mentioning %q", s, err, expected)
+		}
+	}
+
+	s := &Server{cfg: Config{NotifyTargets: "192.0.2.53:53"}}
+	if err := s.setupNotify(); err == nil {
+		t.Errorf("NotifyTargets allowed without zone transfers")
+	}
+}
+
+// A secondary which answers NOTIFYs, checking that they're signed with the
+// key, if given.
+type fakeSecondary struct {
+	addr     string
+	notifies chan uint32
+}
+
+func newFakeSecondary(t *testing.T, tsigSecrets map[string]string) (*fakeSecondary, func()) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sec := &fakeSecondary{addr: pc.LocalAddr().String(), notifies: make(chan uint32, 10)}
+	started := make(chan struct{})
+	ds := &dns.Server{
+		PacketConn:        pc,
+		TsigSecret:        tsigSecrets,
+		NotifyStartedFunc: func() { close(started) },
+		Handler: dns.HandlerFunc(func(rw dns.ResponseWriter, req *dns.Msg) {
+			m := new(dns.Msg)
+			m.SetReply(req)
+			if req.Opcode != dns.OpcodeNotify || len(req.Answer) != 1 ||
+				(tsigSecrets != nil && (req.IsTsig() == nil || rw.TsigStatus() != nil)) {
+				m.Rcode = dns.RcodeRefused
+				rw.WriteMsg(m)
+				return
+			}
+			if tsig := req.IsTsig(); tsig != nil {
+				m.SetTsig(tsig.Hdr.Name, tsig.Algorithm, tsigFudge, time.Now().Unix())
+			}
+			rw.WriteMsg(m)
+			sec.notifies <- req.Answer[0].(*dns.SOA).Serial
+		}),
+	}
+	go ds.ActivateAndServe()
+	<-started
+
+	return sec, func() { ds.Shutdown() }
+}
+
+func TestNotify(t *testing.T) {
+	const keyName, secret = "xfr.example.", "c2VjcmV0LXNlY3JldC1zZWNyZXQ="
+
+	plain, done := newFakeSecondary(t, nil)
+	defer done()
+	signed, done := newFakeSecondary(t, map[string]string{keyName: secret})
+	defer done()
+
+	// A secondary which never answers.
+	wedged, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wedged.Close()
+
+	targets, err := parseNotifyTargets(wedged.LocalAddr().String()+","+plain.addr+","+signed.addr+"/"+keyName,
+		map[string]string{keyName: dns.HmacSHA256}, map[string]string{keyName: secret})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serial := uint32(100)
+	n := &notifier{
+		zone:    "bit.",
+		targets: targets,
+		soa: func() (*dns.SOA, error) {
+			return &dns.SOA{
+				Hdr:    dns.RR_Header{Name: "bit.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 600},
+				Ns:     "ns1.bit.",
+				Mbox:   "hostmaster.bit.",
+				Serial: atomic.LoadUint32(&serial),
+			}, nil
+		},
+		timeout:     time.Second,
+		firstRetry:  10 * time.Millisecond,
+		maxRetry:    40 * time.Millisecond,
+		maxAttempts: 3,
+		sched:       scheduler.New(&scheduler.Config{}),
+	}
+	n.start()
+	defer n.shutdown()
+
+	// The secondaries which answer are notified at once, whatever the one
+	// which doesn't does.
+	n.notifyAll()
+	for _, sec := range []*fakeSecondary{plain, signed} {
+		select {
+		case got := <-sec.notifies:
+			if got != 100 {
+				t.Errorf("%s notified of serial %d, expected 100", sec.addr, got)
+			}
+		case <-time.After(n.timeout / 2):
+			t.Fatalf("%s not notified before the wedged secondary timed out", sec.addr)
+		}
+	}
+
+	atomic.StoreUint32(&serial, 101)
+	n.notifyAll()
+	if got := <-plain.notifies; got != 101 {
+		t.Errorf("notified of serial %d, expected 101", got)
+	}
+
+	// The wedged secondary is tried three times, then given up on.
+	w := targets[0]
+	deadline := time.Now().Add(10 * time.Second)
+	for atomic.LoadUint64(&w.abandoned) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if f, a := atomic.LoadUint64(&w.failures), atomic.LoadUint64(&w.abandoned); a == 0 || f < 3 || atomic.LoadUint64(&w.acknowledged) != 0 {
+		t.Errorf("wedged secondary: %d failures, %d abandoned", f, a)
+	}
+	if a := atomic.LoadUint64(&targets[1].acknowledged); a != 2 {
+		t.Errorf("secondary acknowledged %d NOTIFYs, expected 2", a)
+	}
+}
@@ -0,0 +1,105 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/namecoin/ncdns/resolver"
+	"github.com/namecoin/ncdns/trustanchor"
+)
+
+// Timeout of each outbound query to a resolver.
+const outboundTimeout = 5 * time.Second
+
+// Sets up the resolver through which ncdns makes its own DNS queries, if any
+// resolvers are configured. Its answers are validated from the root zone's
+// trust anchors, and for names under CanonicalSuffix or another suffix with
+// its own keys, from the suffix's KSK, since its parent may not publish a DS
+// for it.
+func (s *Server) setupOutbound() error {
+	list := s.cfg.OutboundResolvers
+	if list == "" {
+		list = s.cfg.ParentCheckResolver
+	}
+
+	var upstreams []string
+	for _, u := range strings.Split(list, ",") {
+		u = strings.TrimSpace(u)
+		if u == "" {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(u); err != nil {
+			u = net.JoinHostPort(u, "53")
+		}
+		upstreams = append(upstreams, u)
+	}
+	if len(upstreams) == 0 {
+		return nil
+	}
+
+	if s.cfg.OutboundQueriesPerSecond < 0 {
+		return fmt.Errorf("OutboundQueriesPerSecond must not be negative")
+	}
+	if s.cfg.OutboundCacheMaxEntries < 0 {
+		return fmt.Errorf("OutboundCacheMaxEntries must not be negative")
+	}
+
+	anchors, err := s.outboundTrustAnchors()
+	if err != nil {
+		return err
+	}
+
+	s.outbound, err = resolver.New(&resolver.Config{
+		Upstreams:        upstreams,
+		TrustAnchors:     anchors,
+		Timeout:          outboundTimeout,
+		QueriesPerSecond: float64(s.cfg.OutboundQueriesPerSecond),
+		CacheMaxEntries:  s.cfg.OutboundCacheMaxEntries,
+	})
+	return err
+}
+
+func (s *Server) outboundTrustAnchors() ([]trustanchor.Anchor, error) {
+	var anchors []trustanchor.Anchor
+	if fn := s.cfg.OutboundTrustAnchorFile; fn != "" {
+		f, err := os.Open(fn)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+
+		anchors, err = trustanchor.Parse(f)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", fn, err)
+		}
+		if len(anchors) == 0 {
+			return nil, fmt.Errorf("%s contains no trust anchors", fn)
+		}
+	} else {
+		var err error
+		anchors, err = resolver.SystemTrustAnchors()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	own := []*keySet{s.keySetForName(dns.Fqdn(strings.ToLower(s.cfg.CanonicalSuffix)))}
+	for _, ks := range s.suffixKeySets {
+		own = append(own, ks)
+	}
+	for _, ks := range own {
+		if ks == nil || ks.KSK == nil {
+			continue
+		}
+		if ds := ks.KSK.ToDS(dns.SHA256); ds != nil {
+			anchors = append(anchors, trustanchor.Anchor{Zone: dns.Fqdn(ks.KSK.Hdr.Name), DS: ds, Key: ks.KSK})
+		}
+	}
+
+	return anchors, nil
+}
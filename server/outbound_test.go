@@ -0,0 +1,71 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOutboundTrustAnchors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ncdns-outbound")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fn := filepath.Join(dir, "root.ds")
+	err = ioutil.WriteFile(fn, []byte(". IN DS 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBB683457104237C7F8EC8D\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	global, err := generateKeySet("bit.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	corp, err := generateKeySet("bit.corp.example.")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Server{
+		cfg: Config{
+			CanonicalSuffix:         "bit",
+			OutboundTrustAnchorFile: fn,
+		},
+		globalKeySet:  global,
+		suffixKeySets: map[string]*keySet{"bit.corp.example.": corp},
+	}
+	anchors, err := s.outboundTrustAnchors()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The root's, and one for each suffix's own KSK.
+	if len(anchors) != 3 || anchors[0].Zone != "." || !anchors[1].Matches(global.KSK) || !anchors[2].Matches(corp.KSK) {
+		t.Errorf("unexpected anchors %+v", anchors)
+	}
+
+	s.cfg.OutboundTrustAnchorFile = filepath.Join(dir, "missing")
+	if _, err := s.outboundTrustAnchors(); err == nil {
+		t.Errorf("missing anchor file accepted")
+	}
+}
+
+func TestSetupOutbound(t *testing.T) {
+	s := &Server{cfg: Config{ParentCheckResolver: "127.0.0.1"}}
+	if err := s.setupOutbound(); err != nil || s.outbound == nil {
+		t.Fatalf("outbound resolver not set up from ParentCheckResolver: %v", err)
+	}
+
+	s = &Server{cfg: Config{OutboundResolvers: "127.0.0.1", OutboundQueriesPerSecond: -1}}
+	if err := s.setupOutbound(); err == nil {
+		t.Errorf("negative rate accepted")
+	}
+
+	s = &Server{}
+	if err := s.setupOutbound(); err != nil || s.outbound != nil {
+		t.Errorf("outbound resolver set up without resolvers: %v", err)
+	}
+}
@@ -0,0 +1,187 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/namecoin/ncdns/util"
+)
+
+// What is done with queries for names outside .bit, by OutOfZone.
+const (
+	outOfZoneRefused  = "refused"
+	outOfZoneNXDomain = "nxdomain"
+	outOfZoneForward  = "forward"
+)
+
+var errForwardSaturated = errors.New("ForwardMaxOutstanding forwarded queries are awaiting an answer")
+
+// Answers queries for names outside .bit, by OutOfZone, either itself or by
+// sending them on to ForwardUpstream and relaying its responses back, so that
+// ncdns can serve as a simple split resolver.
+type outOfZone struct {
+	// Accessed atomically.
+	answered, forwarded, failed, saturated uint64
+
+	mode     string
+	upstream string        // empty unless mode is forward
+	timeout  time.Duration // of each forwarded query
+	sem      chan struct{} // holds a value for each query awaiting an answer; nil if there's no limit
+}
+
+// Counts of the queries for names outside .bit, for /status.
+type outOfZoneStatus struct {
+	Mode     string `json:"mode"`
+	Upstream string `json:"upstream,omitempty"`
+	Answered uint64 `json:"answered"` // without being forwarded
+
+	// Queries forwarded which ForwardUpstream answered, which failed, e.g.
+	// as it didn't answer within ForwardTimeout, and which weren't forwarded
+	// as ForwardMaxOutstanding were awaiting an answer.
+	Forwarded uint64 `json:"forwarded,omitempty"`
+	Failed    uint64 `json:"failed,omitempty"`
+	Saturated uint64 `json:"saturated,omitempty"`
+}
+
+// Checks OutOfZone, and sets up forwarding if it's forward.
+func (s *Server) setupOutOfZone() error {
+	switch s.cfg.OutOfZone {
+	case "":
+		s.cfg.OutOfZone = outOfZoneRefused
+		fallthrough
+	case outOfZoneRefused, outOfZoneNXDomain:
+		if s.cfg.ForwardUpstream != "" {
+			return configError("ForwardUpstream requires OutOfZone to be forward")
+		}
+		s.outOfZone = &outOfZone{mode: s.cfg.OutOfZone}
+		return nil
+	case outOfZoneForward:
+	default:
+		return configError("OutOfZone must be refused, nxdomain or forward, not %q", s.cfg.OutOfZone)
+	}
+
+	upstream := strings.TrimSpace(s.cfg.ForwardUpstream)
+	if upstream == "" {
+		return configError("OutOfZone forward requires ForwardUpstream")
+	}
+	if _, _, err := net.SplitHostPort(upstream); err != nil {
+		upstream = net.JoinHostPort(upstream, "53")
+	}
+	if s.cfg.ForwardTimeout <= 0 {
+		return configError("ForwardTimeout must be positive")
+	}
+	if s.cfg.ForwardMaxOutstanding < 0 {
+		return configError("ForwardMaxOutstanding must not be negative")
+	}
+
+	s.outOfZone = &outOfZone{
+		mode:     outOfZoneForward,
+		upstream: upstream,
+		timeout:  time.Duration(s.cfg.ForwardTimeout) * time.Millisecond,
+	}
+	if s.cfg.ForwardMaxOutstanding > 0 {
+		s.outOfZone.sem = make(chan struct{}, s.cfg.ForwardMaxOutstanding)
+	}
+	return nil
+}
+
+// Whether a name is one the backend answers for: one with a "bit" label, such
+// as bit. itself or a name under it, or under a suffix like bit.example.com.
+func inZone(name string) bool {
+	_, _, _, err := util.SplitDomainByFloatingAnchor(strings.ToLower(name), "bit")
+	return err == nil
+}
+
+// Answers a query for a name outside .bit as OutOfZone says, without it
+// reaching the backend, returning false if the query is for a name inside it
+// or isn't an ordinary query. Zone transfers of other zones are never
+// forwarded. Queries of class CH are left to the server's chaosHandler.
+func (s *Server) serveOutOfZone(rw dns.ResponseWriter, req *dns.Msg) bool {
+	oz := s.outOfZone
+	if oz == nil || req.Opcode != dns.OpcodeQuery || len(req.Question) != 1 || inZone(req.Question[0].Name) ||
+		req.Question[0].Qclass == dns.ClassCHAOS {
+		return false
+	}
+
+	qtype := req.Question[0].Qtype
+	if oz.mode == outOfZoneForward && qtype != dns.TypeAXFR && qtype != dns.TypeIXFR {
+		res, err := oz.forward(req, s.transport(rw) != "udp")
+		if err != nil {
+			log.Debugf("couldn't forward query for %s to %s: %v", req.Question[0].Name, oz.upstream, err)
+			s.writeOutOfZone(rw, req, dns.RcodeServerFailure, 0)
+			return true
+		}
+		rw.WriteMsg(res)
+		return true
+	}
+
+	atomic.AddUint64(&oz.answered, 1)
+	if oz.mode == outOfZoneNXDomain {
+		s.writeOutOfZone(rw, req, dns.RcodeNameError, 0)
+	} else {
+		s.writeOutOfZone(rw, req, dns.RcodeRefused, dns.ExtendedErrorCodeNotAuthoritative)
+	}
+	return true
+}
+
+// Writes an empty response with rcode, with an extended DNS error of ede if
+// it isn't zero and the query has an OPT record.
+func (s *Server) writeOutOfZone(rw dns.ResponseWriter, req *dns.Msg, rcode int, ede uint16) {
+	m := new(dns.Msg)
+	m.SetRcode(req, rcode)
+	if opt := req.IsEdns0(); opt != nil {
+		m.SetEdns0(s.ednsUDPSize(), false)
+		if ede != 0 {
+			m.IsEdns0().Option = append(m.IsEdns0().Option, &dns.EDNS0_EDE{InfoCode: ede})
+		}
+	}
+	rw.WriteMsg(m)
+}
+
+// Sends req to the upstream, over TCP if it came over TCP or TLS, and returns
+// the response for the client. The query is sent as it came, EDNS options and
+// all, but with an ID of its own.
+func (oz *outOfZone) forward(req *dns.Msg, tcp bool) (*dns.Msg, error) {
+	if oz.sem != nil {
+		select {
+		case oz.sem <- struct{}{}:
+			defer func() { <-oz.sem }()
+		default:
+			atomic.AddUint64(&oz.saturated, 1)
+			return nil, errForwardSaturated
+		}
+	}
+
+	c := &dns.Client{Net: "udp", Timeout: oz.timeout}
+	if tcp {
+		c.Net = "tcp"
+	}
+
+	q := req.Copy()
+	q.Id = dns.Id()
+	res, _, err := c.Exchange(q, oz.upstream)
+	if err != nil {
+		atomic.AddUint64(&oz.failed, 1)
+		return nil, err
+	}
+
+	atomic.AddUint64(&oz.forwarded, 1)
+	res.Id = req.Id
+	return res, nil
+}
+
+func (oz *outOfZone) Status() outOfZoneStatus {
+	return outOfZoneStatus{
+		Mode:      oz.mode,
+		Upstream:  oz.upstream,
+		Answered:  atomic.LoadUint64(&oz.answered),
+		Forwarded: atomic.LoadUint64(&oz.forwarded),
+		Failed:    atomic.LoadUint64(&oz.failed),
+		Saturated: atomic.LoadUint64(&oz.saturated),
+	}
+}
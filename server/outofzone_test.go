@@ -0,0 +1,140 @@
+package server
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// Starts a resolver answering A queries with 192.0.2.53, echoing the EDNS
+// options of the query, until release is closed for names under slow.
+func newFakeUpstream(t *testing.T, release chan struct{}) (addr string, queries chan *dns.Msg, stop func()) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	queries = make(chan *dns.Msg, 10)
+	srv := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(rw dns.ResponseWriter, req *dns.Msg) {
+		queries <- req
+		if strings.HasSuffix(req.Question[0].Name, "slow.") {
+			<-release
+		}
+
+		m := new(dns.Msg)
+		m.SetReply(req)
+		m.Answer = append(m.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+			A:   net.ParseIP("192.0.2.53"),
+		})
+		if opt := req.IsEdns0(); opt != nil {
+			m.Extra = append(m.Extra, opt)
+		}
+		rw.WriteMsg(m)
+	})}
+	go srv.ActivateAndServe()
+	return pc.LocalAddr().String(), queries, func() { srv.Shutdown() }
+}
+
+func TestOutOfZone(t *testing.T) {
+	release := make(chan struct{})
+	addr, queries, stop := newFakeUpstream(t, release)
+	defer stop()
+
+	query := func(s *Server, name string) *dns.Msg {
+		req := new(dns.Msg)
+		req.SetQuestion(name, dns.TypeA)
+		req.SetEdns0(1232, true)
+		opt := req.IsEdns0()
+		opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{Code: dns.EDNS0LOCALSTART, Data: []byte("ncdns")})
+		rw := &fakeResponseWriter{}
+		s.ServeDNS(rw, req)
+		if rw.msg == nil {
+			t.Fatalf("%s: no response", name)
+		}
+		if rw.msg.Id != req.Id {
+			t.Errorf("%s: response has ID %d, expected %d", name, rw.msg.Id, req.Id)
+		}
+		return rw.msg
+	}
+
+	s := newDrainTestServer(t)
+	if err := s.setupOutOfZone(); err != nil {
+		t.Fatal(err)
+	}
+	if m := query(s, "example.com."); m.Rcode != dns.RcodeRefused {
+		t.Errorf("out of zone name not refused by default: %v", m)
+	}
+	if m := query(s, "example.bit."); m.Rcode != dns.RcodeSuccess || len(m.Answer) == 0 {
+		t.Errorf("name in zone not answered: %v", m)
+	}
+
+	s.cfg.OutOfZone = outOfZoneNXDomain
+	if err := s.setupOutOfZone(); err != nil {
+		t.Fatal(err)
+	}
+	if m := query(s, "example.com."); m.Rcode != dns.RcodeNameError {
+		t.Errorf("out of zone name not answered NXDOMAIN: %v", m)
+	}
+	if st := s.outOfZone.Status(); st.Answered != 1 {
+		t.Errorf("unexpected status %+v", st)
+	}
+
+	s.cfg.OutOfZone = outOfZoneForward
+	s.cfg.ForwardUpstream = addr
+	s.cfg.ForwardTimeout = 2000
+	s.cfg.ForwardMaxOutstanding = 1
+	if err := s.setupOutOfZone(); err != nil {
+		t.Fatal(err)
+	}
+
+	m := query(s, "example.com.")
+	if m.Rcode != dns.RcodeSuccess || len(m.Answer) != 1 {
+		t.Fatalf("forwarded query not answered: %v", m)
+	}
+	q := <-queries
+	opt := q.IsEdns0()
+	if opt == nil || !opt.Do() || len(opt.Option) != 1 || string(opt.Option[0].(*dns.EDNS0_LOCAL).Data) != "ncdns" {
+		t.Errorf("EDNS options not forwarded: %v", q)
+	}
+
+	// Neither bit. nor names under it are forwarded.
+	for _, name := range []string{"bit.", "example.bit.", "EXAMPLE.BIT."} {
+		query(s, name)
+	}
+	select {
+	case q := <-queries:
+		t.Errorf("forwarded %v", q.Question)
+	default:
+	}
+
+	// While one query awaits an answer, another isn't forwarded.
+	done := make(chan *dns.Msg)
+	go func() { done <- query(s, "a.slow.") }()
+	<-queries
+	if m := query(s, "b.slow."); m.Rcode != dns.RcodeServerFailure {
+		t.Errorf("query over ForwardMaxOutstanding not answered SERVFAIL: %v", m)
+	}
+	close(release)
+	if m := <-done; m.Rcode != dns.RcodeSuccess {
+		t.Errorf("slow query not answered: %v", m)
+	}
+
+	if st := s.outOfZone.Status(); st.Forwarded != 2 || st.Saturated != 1 || st.Upstream != addr {
+		t.Errorf("unexpected status %+v", st)
+	}
+
+	for _, bad := range []*Config{
+		{OutOfZone: "drop"},
+		{OutOfZone: outOfZoneForward},
+		{OutOfZone: outOfZoneRefused, ForwardUpstream: addr},
+		{OutOfZone: outOfZoneForward, ForwardUpstream: addr},
+	} {
+		s.cfg = *bad
+		if err := s.setupOutOfZone(); err == nil {
+			t.Errorf("%+v accepted", bad)
+		}
+	}
+}
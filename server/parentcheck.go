@@ -0,0 +1,193 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/namecoin/ncdns/clock"
+	"github.com/namecoin/ncdns/resolver"
+)
+
+// Results of comparing the DS records published in the parent zone for the
+// canonical suffix with the local KSK.
+const (
+	parentDSUnknown  = "unknown"  // not checked yet
+	parentDSMatch    = "match"    // a published DS matches a local KSK
+	parentDSMismatch = "mismatch" // DS records are published, but none match
+	parentDSMissing  = "no_ds"    // the parent publishes no DS records
+	parentDSError    = "error"    // the check couldn't be made
+)
+
+type parentDSStatus struct {
+	Suffix       string    `json:"suffix"`
+	State        string    `json:"state"`
+	Error        string    `json:"error,omitempty"`
+	LastChecked  time.Time `json:"last_checked"`
+	ParentDS     []string  `json:"parent_ds,omitempty"`
+	LocalKeyTags []uint16  `json:"local_key_tags"`
+}
+
+// Periodically checks that the DS records for a suffix published in its
+// parent zone, as validated by the outbound resolver, match the KSKs used to
+// sign the suffix.
+type parentChecker struct {
+	suffix   string
+	ksks     []*dns.DNSKEY
+	interval time.Duration
+	webhook  string
+
+	// Makes a validated query.
+	lookup func(name string, qtype uint16) (*resolver.Result, error)
+	clock  clock.Clock
+
+	mu       sync.Mutex
+	status   parentDSStatus
+	reported string // state last reported to the webhook
+}
+
+func newParentChecker(suffix string, r *resolver.Resolver, ksks []*dns.DNSKEY, interval time.Duration, webhook string, clk clock.Clock) *parentChecker {
+	c := &parentChecker{
+		suffix:   dns.Fqdn(suffix),
+		ksks:     ksks,
+		interval: interval,
+		webhook:  webhook,
+		clock:    clock.Or(clk),
+		reported: parentDSMatch,
+	}
+
+	c.lookup = func(name string, qtype uint16) (*resolver.Result, error) {
+		return r.Query(context.Background(), name, qtype)
+	}
+
+	c.status = parentDSStatus{
+		Suffix: c.suffix,
+		State:  parentDSUnknown,
+	}
+	for _, k := range ksks {
+		c.status.LocalKeyTags = append(c.status.LocalKeyTags, k.KeyTag())
+	}
+
+	return c
+}
+
+func (c *parentChecker) run() {
+	for {
+		c.check()
+		<-c.clock.NewTimer(c.interval).C()
+	}
+}
+
+// Queries the parent for the suffix's DS records and updates the status.
+func (c *parentChecker) check() {
+	state, parentDS, err := c.query()
+
+	c.mu.Lock()
+	c.status.State = state
+	c.status.ParentDS = parentDS
+	c.status.LastChecked = c.clock.Now()
+	c.status.Error = ""
+	if err != nil {
+		c.status.Error = err.Error()
+	}
+	status := c.status
+	report := state != c.reported && state != parentDSError
+	if report {
+		c.reported = state
+	}
+	c.mu.Unlock()
+
+	switch state {
+	case parentDSMismatch:
+		log.Errorf("DS records published for %s don't match its KSK (key tags %v): %v", c.suffix, status.LocalKeyTags, parentDS)
+	case parentDSMissing:
+		log.Warnf("no DS records are published for %s", c.suffix)
+	case parentDSError:
+		log.Warne(err, "couldn't check DS records for ", c.suffix)
+	}
+
+	if report && c.webhook != "" {
+		log.Warne(postWebhook(c.webhook, &status), "couldn't call parent DS check webhook")
+	}
+}
+
+func (c *parentChecker) query() (state string, parentDS []string, err error) {
+	res, err := c.lookup(c.suffix, dns.TypeDS)
+	if err != nil {
+		return parentDSError, nil, err
+	}
+
+	// An insecure answer could have been forged, and says nothing about what
+	// the parent actually publishes.
+	if !res.Secure {
+		return parentDSError, nil, fmt.Errorf("the parent zone of %s is insecure, so its DS records can't be validated", c.suffix)
+	}
+
+	var dss []*dns.DS
+	for _, rr := range res.Msg.Answer {
+		if ds, ok := rr.(*dns.DS); ok && strings.EqualFold(ds.Hdr.Name, c.suffix) {
+			dss = append(dss, ds)
+			parentDS = append(parentDS, ds.String())
+		}
+	}
+
+	if len(dss) == 0 {
+		return parentDSMissing, nil, nil
+	}
+
+	if c.matches(dss) {
+		return parentDSMatch, parentDS, nil
+	}
+
+	return parentDSMismatch, parentDS, nil
+}
+
+// Returns true if any of the DS records corresponds to a local KSK.
+func (c *parentChecker) matches(dss []*dns.DS) bool {
+	for _, ds := range dss {
+		for _, k := range c.ksks {
+			if ds.KeyTag != k.KeyTag() || ds.Algorithm != k.Algorithm {
+				continue
+			}
+
+			local := k.ToDS(ds.DigestType)
+			if local != nil && strings.EqualFold(local.Digest, ds.Digest) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func (c *parentChecker) Status() parentDSStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.status
+}
+
+// Sets up the parent DS check, if configured. Called after setupOutbound.
+func (s *Server) setupParentCheck() error {
+	if s.cfg.ParentCheckResolver == "" {
+		return nil
+	}
+
+	if s.cfg.ParentCheckInterval <= 0 {
+		return fmt.Errorf("ParentCheckInterval must be positive")
+	}
+
+	suffix := dns.Fqdn(strings.ToLower(s.cfg.CanonicalSuffix))
+	ks := s.keySetForName(suffix)
+	if ks == nil || ks.KSK == nil {
+		return fmt.Errorf("ParentCheckResolver is set, but no KSK is configured for %s", suffix)
+	}
+
+	s.parentChecker = newParentChecker(suffix, s.outbound, []*dns.DNSKEY{ks.KSK},
+		time.Duration(s.cfg.ParentCheckInterval)*time.Second, s.cfg.ParentCheckWebhook, s.clock)
+	return nil
+}
@@ -0,0 +1,90 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/namecoin/ncdns/resolver"
+)
+
+func TestParentCheck(t *testing.T) {
+	ksk, _, err := generateKey("bit.", 257)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKSK, _, err := generateKey("bit.", 257)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var posted []string
+	hook := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		var st parentDSStatus
+		if err := json.NewDecoder(req.Body).Decode(&st); err != nil {
+			t.Errorf("couldn't decode webhook body: %v", err)
+		}
+		posted = append(posted, st.State)
+	}))
+	defer hook.Close()
+
+	c := newParentChecker("bit", nil, []*dns.DNSKEY{ksk}, time.Hour, hook.URL, nil)
+	if st := c.Status(); st.State != parentDSUnknown || len(st.LocalKeyTags) != 1 || st.LocalKeyTags[0] != ksk.KeyTag() {
+		t.Fatalf("unexpected initial status: %+v", st)
+	}
+
+	tests := []struct {
+		answer   []dns.RR
+		rcode    int
+		secure   bool
+		queryErr error
+		state    string
+	}{
+		{[]dns.RR{ksk.ToDS(dns.SHA256)}, dns.RcodeSuccess, true, nil, parentDSMatch},
+		{[]dns.RR{otherKSK.ToDS(dns.SHA256)}, dns.RcodeSuccess, true, nil, parentDSMismatch},
+		// During a rollover, any matching DS will do.
+		{[]dns.RR{otherKSK.ToDS(dns.SHA256), ksk.ToDS(dns.SHA1)}, dns.RcodeSuccess, true, nil, parentDSMatch},
+		{nil, dns.RcodeSuccess, true, nil, parentDSMissing},
+		{nil, dns.RcodeNameError, true, nil, parentDSMissing},
+		{[]dns.RR{ksk.ToDS(dns.SHA256)}, dns.RcodeSuccess, false, nil, parentDSError},
+		{nil, 0, false, fmt.Errorf("%w: DS records of bit. don't verify", resolver.ErrBogus), parentDSError},
+		{nil, 0, false, fmt.Errorf("timeout"), parentDSError},
+		{[]dns.RR{otherKSK.ToDS(dns.SHA256)}, dns.RcodeSuccess, true, nil, parentDSMismatch},
+	}
+
+	for i, test := range tests {
+		c.lookup = func(name string, qtype uint16) (*resolver.Result, error) {
+			if name != "bit." || qtype != dns.TypeDS {
+				t.Errorf("unexpected query %s %s", name, dns.TypeToString[qtype])
+			}
+			if test.queryErr != nil {
+				return nil, test.queryErr
+			}
+			m := new(dns.Msg)
+			m.SetQuestion(name, qtype)
+			m.Rcode = test.rcode
+			m.Answer = test.answer
+			return &resolver.Result{Msg: m, Secure: test.secure}, nil
+		}
+
+		c.check()
+		st := c.Status()
+		if st.State != test.state {
+			t.Errorf("%d: got state %q, expected %q (%s)", i, st.State, test.state, st.Error)
+		}
+		if (st.Error != "") != (test.state == parentDSError) {
+			t.Errorf("%d: unexpected error %q", i, st.Error)
+		}
+	}
+
+	// The webhook is told about changes, but not errors or the initial match.
+	expected := []string{parentDSMismatch, parentDSMatch, parentDSMissing, parentDSMismatch}
+	if fmt.Sprint(posted) != fmt.Sprint(expected) {
+		t.Errorf("webhook got %v, expected %v", posted, expected)
+	}
+}
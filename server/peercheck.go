@@ -0,0 +1,306 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/namecoin/ncdns/clock"
+	"github.com/namecoin/ncdns/resolver"
+	"github.com/namecoin/ncdns/trustanchor"
+)
+
+// Results of comparing a peer in PeerServers with this instance.
+const (
+	peerUnknown     = "unknown"      // not checked yet
+	peerInSync      = "in_sync"      // each signs with a ZSK the other publishes
+	peerKeyMismatch = "key_mismatch" // one signs with a ZSK the other doesn't publish
+	peerBogus       = "bogus"        // the peer's answers don't validate with the local KSK
+	peerStale       = "stale"        // the peer's SOA serial is stuck behind the local one
+	peerError       = "error"        // the check couldn't be made
+)
+
+// A peer's states which are alerted on.
+func peerDiverged(state string) bool {
+	return state == peerKeyMismatch || state == peerBogus || state == peerStale
+}
+
+type peerStatus struct {
+	Address       string    `json:"address"`
+	State         string    `json:"state"`
+	Error         string    `json:"error,omitempty"`
+	LastChecked   time.Time `json:"last_checked"`
+	KeyTags       []uint16  `json:"key_tags,omitempty"`        // of the ZSKs the peer publishes
+	SigningKeyTag uint16    `json:"signing_key_tag,omitempty"` // of the ZSK signing the peer's SOA
+	Serial        uint32    `json:"serial,omitempty"`
+	SerialSince   time.Time `json:"serial_since,omitempty"` // when the peer's serial was first seen
+}
+
+// Posted to AlertWebhook when a peer diverges, and when it's back in sync.
+type peerAlert struct {
+	Alert  string     `json:"alert"` // peer
+	State  string     `json:"state"` // firing or resolved
+	Time   time.Time  `json:"time"`
+	Status peerStatus `json:"peer"`
+}
+
+// The keys and SOA serial of this instance, with which the peers' are
+// compared.
+type peerLocal struct {
+	keys   *keySet
+	serial uint32
+}
+
+// Periodically compares the DNSKEY and SOA records other instances serving the
+// same zone publish at its apex with this instance's, so that instances which
+// would fail validation when a resolver mixes their answers, such as anycast
+// instances each with a ZSK of their own, are noticed. Their answers are
+// validated with the local KSK, which they must share.
+//
+// A peer is in sync while each of the two signs with a ZSK the other
+// publishes: that allows for a ZSK being prepublished, or still published
+// after being replaced, by one of them and not the other. It's stale once its
+// serial has stayed behind the local one for maxSerialAge.
+type peerChecker struct {
+	zone         string
+	addrs        []string
+	interval     time.Duration
+	maxSerialAge time.Duration
+	webhook      string // "" if not set
+
+	local func() peerLocal
+
+	// Makes a validated query to the peer at addr, with the given trust
+	// anchor.
+	lookup func(addr string, anchor trustanchor.Anchor, name string, qtype uint16) (*resolver.Result, error)
+	clock  clock.Clock
+
+	mu       sync.Mutex
+	status   []peerStatus // in the order of addrs
+	reported []string     // state last alerted on for each peer
+}
+
+func newPeerChecker(zone string, addrs []string, interval, maxSerialAge time.Duration, webhook string, local func() peerLocal, clk clock.Clock) *peerChecker {
+	c := &peerChecker{
+		zone:         dns.Fqdn(zone),
+		addrs:        addrs,
+		interval:     interval,
+		maxSerialAge: maxSerialAge,
+		webhook:      webhook,
+		local:        local,
+		lookup:       peerLookup,
+		clock:        clock.Or(clk),
+	}
+	for _, addr := range addrs {
+		c.status = append(c.status, peerStatus{Address: addr, State: peerUnknown})
+		c.reported = append(c.reported, peerInSync)
+	}
+	return c
+}
+
+// Queries a peer through a resolver of its own, which only trusts the local
+// KSK and caches nothing, so that each check sees what the peer serves then.
+func peerLookup(addr string, anchor trustanchor.Anchor, name string, qtype uint16) (*resolver.Result, error) {
+	r, err := resolver.New(&resolver.Config{
+		Upstreams:    []string{addr},
+		TrustAnchors: []trustanchor.Anchor{anchor},
+		Timeout:      outboundTimeout,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return r.Query(context.Background(), name, qtype)
+}
+
+func (c *peerChecker) run() {
+	for {
+		c.check()
+		<-c.clock.NewTimer(c.interval).C()
+	}
+}
+
+// Checks each peer and updates its status, reporting those which diverge or
+// are back in sync.
+func (c *peerChecker) check() {
+	local := c.local()
+	for i, addr := range c.addrs {
+		c.mu.Lock()
+		st := c.status[i]
+		c.mu.Unlock()
+
+		st.LastChecked = c.clock.Now()
+		st.Error = ""
+		err := c.compare(&st, local)
+		if err != nil {
+			st.Error = err.Error()
+		}
+
+		c.mu.Lock()
+		c.status[i] = st
+		report := st.State != c.reported[i] && st.State != peerError &&
+			(peerDiverged(st.State) || peerDiverged(c.reported[i]))
+		if report {
+			c.reported[i] = st.State
+		}
+		c.mu.Unlock()
+
+		switch st.State {
+		case peerKeyMismatch:
+			log.Errorf("%s signs %s with ZSK %d and publishes ZSKs %v, while this instance signs with ZSK %d and publishes %v; resolvers mixing their answers will fail to validate them",
+				addr, c.zone, st.SigningKeyTag, st.KeyTags, local.keys.ZSK.KeyTag(), localZSKTags(local.keys))
+		case peerBogus:
+			log.Errorf("%s serves %s with keys which don't validate with this instance's KSK %d: %v", addr, c.zone, local.keys.KSK.KeyTag(), err)
+		case peerStale:
+			log.Errorf("%s has served %s with SOA serial %d since %v, behind this instance's %d", addr, c.zone, st.Serial, st.SerialSince.Format(time.RFC3339), local.serial)
+		case peerError:
+			log.Warne(err, "couldn't check peer ", addr)
+		}
+		if report && st.State == peerInSync {
+			log.Infof("%s is in sync with this instance again", addr)
+		}
+
+		if report && c.webhook != "" {
+			alert := &peerAlert{Alert: "peer", State: "resolved", Time: st.LastChecked.UTC(), Status: st}
+			if peerDiverged(st.State) {
+				alert.State = "firing"
+			}
+			log.Warne(postWebhook(c.webhook, alert), "couldn't call the alert webhook")
+		}
+	}
+}
+
+// Queries the peer for the DNSKEY and SOA records at the apex, and sets its
+// state from them.
+func (c *peerChecker) compare(st *peerStatus, local peerLocal) error {
+	ds := local.keys.KSK.ToDS(dns.SHA256)
+	if ds == nil {
+		st.State = peerError
+		return fmt.Errorf("couldn't make a DS record of KSK %d", local.keys.KSK.KeyTag())
+	}
+	anchor := trustanchor.Anchor{Zone: c.zone, DS: ds, Key: local.keys.KSK}
+
+	var records [2][]dns.RR
+	for i, qtype := range []uint16{dns.TypeDNSKEY, dns.TypeSOA} {
+		res, err := c.lookup(st.Address, anchor, c.zone, qtype)
+		if errors.Is(err, resolver.ErrBogus) {
+			st.State = peerBogus
+			return err
+		}
+		if err != nil {
+			st.State = peerError
+			return err
+		}
+		if !res.Secure {
+			st.State = peerBogus
+			return fmt.Errorf("%s answered %s %s insecurely", st.Address, c.zone, dns.TypeToString[qtype])
+		}
+		records[i] = res.Msg.Answer
+	}
+
+	st.KeyTags = nil
+	for _, rr := range records[0] {
+		if k, ok := rr.(*dns.DNSKEY); ok && k.Flags&dns.SEP == 0 && strings.EqualFold(k.Hdr.Name, c.zone) {
+			st.KeyTags = append(st.KeyTags, k.KeyTag())
+		}
+	}
+
+	var serial uint32
+	found := false
+	st.SigningKeyTag = 0
+	for _, rr := range records[1] {
+		switch rr := rr.(type) {
+		case *dns.SOA:
+			serial, found = rr.Serial, true
+		case *dns.RRSIG:
+			if rr.TypeCovered == dns.TypeSOA {
+				st.SigningKeyTag = rr.KeyTag
+			}
+		}
+	}
+	if !found {
+		st.State = peerError
+		return fmt.Errorf("%s returned no SOA record for %s", st.Address, c.zone)
+	}
+	if serial != st.Serial || st.SerialSince.IsZero() {
+		st.Serial, st.SerialSince = serial, st.LastChecked
+	}
+
+	switch {
+	case !hasKeyTag(st.KeyTags, local.keys.ZSK.KeyTag()) || !hasKeyTag(localZSKTags(local.keys), st.SigningKeyTag):
+		st.State = peerKeyMismatch
+	case st.Serial < local.serial && st.LastChecked.Sub(st.SerialSince) >= c.maxSerialAge:
+		st.State = peerStale
+	default:
+		st.State = peerInSync
+	}
+	return nil
+}
+
+// Returns the key tags of the ZSKs published by ks.
+func localZSKTags(ks *keySet) []uint16 {
+	tags := []uint16{ks.ZSK.KeyTag()}
+	for _, k := range ks.PublishedZSKs {
+		tags = append(tags, k.KeyTag())
+	}
+	return tags
+}
+
+func hasKeyTag(tags []uint16, tag uint16) bool {
+	for _, t := range tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *peerChecker) Status() []peerStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return append([]peerStatus(nil), c.status...)
+}
+
+// Sets up the check of PeerServers, if any are configured.
+func (s *Server) setupPeerCheck() error {
+	var addrs []string
+	for _, a := range strings.Split(s.cfg.PeerServers, ",") {
+		a = strings.TrimSpace(a)
+		if a == "" {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(a); err != nil {
+			a = net.JoinHostPort(a, "53")
+		}
+		addrs = append(addrs, a)
+	}
+	if len(addrs) == 0 {
+		return nil
+	}
+
+	if s.cfg.PeerCheckInterval <= 0 {
+		return configError("PeerCheckInterval must be positive")
+	}
+	if s.cfg.PeerMaxSerialAge < 0 {
+		return configError("PeerMaxSerialAge must not be negative")
+	}
+
+	zone := dns.Fqdn(strings.ToLower(s.cfg.CanonicalSuffix))
+	if ks := s.keySetForName(zone); ks == nil || ks.KSK == nil {
+		return configError("PeerServers is set, but no KSK is configured for %s", zone)
+	}
+
+	s.peerChecker = newPeerChecker(zone, addrs,
+		time.Duration(s.cfg.PeerCheckInterval)*time.Second,
+		time.Duration(s.cfg.PeerMaxSerialAge)*time.Second,
+		s.cfg.AlertWebhook, func() peerLocal {
+			return peerLocal{keys: s.keySetForName(zone), serial: s.soaSerial()}
+		}, s.clock)
+	return nil
+}
@@ -0,0 +1,157 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/namecoin/ncdns/testutil"
+)
+
+// An instance of ncdns serving bit. for the peer check, with the DNSKEY and
+// SOA records set by the test.
+type fakePeer struct {
+	mu     sync.Mutex
+	dnskey []dns.RR
+	soa    []dns.RR
+}
+
+// Makes the peer publish the KSK and ZSKs of ks, signing its SOA, with the
+// given serial, with ks.ZSK.
+func (p *fakePeer) serve(t *testing.T, ks *keySet, serial uint32) {
+	now := time.Now().Add(-time.Hour)
+	keys := []string{ks.KSK.String(), ks.ZSK.String()}
+	for _, k := range ks.PublishedZSKs {
+		keys = append(keys, k.String())
+	}
+	dnskey := signedRRset(t, ks.KSK, ks.KSKPrivate, now, keys...)
+	soa := signedRRset(t, ks.ZSK, ks.ZSKPrivate, now,
+		fmt.Sprintf("bit. 600 IN SOA this.x--nmc.bit. hostmaster.bit. %d 600 600 7200 600", serial))
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.dnskey, p.soa = dnskey, soa
+}
+
+func (p *fakePeer) ServeDNS(rw dns.ResponseWriter, req *dns.Msg) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	m := new(dns.Msg)
+	m.SetReply(req)
+	m.Authoritative = true
+	switch req.Question[0].Qtype {
+	case dns.TypeDNSKEY:
+		m.Answer = p.dnskey
+	case dns.TypeSOA:
+		m.Answer = p.soa
+	}
+	rw.WriteMsg(m)
+}
+
+func newFakePeer(t *testing.T) (*fakePeer, string, func()) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &fakePeer{}
+	started := make(chan struct{})
+	srv := &dns.Server{PacketConn: pc, Handler: p, NotifyStartedFunc: func() { close(started) }}
+	go srv.ActivateAndServe()
+	<-started
+	return p, pc.LocalAddr().String(), func() { srv.Shutdown() }
+}
+
+func TestPeerCheck(t *testing.T) {
+	local, err := generateKeySet("bit.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A peer sharing the KSK, but with a ZSK of its own.
+	own := &keySet{KSK: local.KSK, KSKPrivate: local.KSKPrivate}
+	own.ZSK, own.ZSKPrivate, err = generateKey("bit.", 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKSK, err := generateKeySet("bit.")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	peer, addr, stop := newFakePeer(t)
+	defer stop()
+
+	var posted []string
+	hook := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		var alert peerAlert
+		if err := json.NewDecoder(req.Body).Decode(&alert); err != nil {
+			t.Errorf("couldn't decode webhook body: %v", err)
+		}
+		posted = append(posted, alert.State+" "+alert.Status.State)
+	}))
+	defer hook.Close()
+
+	localKeys, localSerial := local, uint32(100)
+	clk := testutil.NewFakeClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	c := newPeerChecker("bit", []string{addr, "127.0.0.1:1"}, time.Hour, time.Hour, hook.URL, func() peerLocal {
+		return peerLocal{keys: localKeys, serial: localSerial}
+	}, clk)
+
+	// Rolling over to a new ZSK, the peer first prepublishes it, then signs
+	// with it, which is only fine once this instance publishes it too.
+	prepublished := &keySet{KSK: local.KSK, ZSK: local.ZSK, ZSKPrivate: local.ZSKPrivate, PublishedZSKs: []*dns.DNSKEY{own.ZSK}}
+	rolled := &keySet{KSK: local.KSK, ZSK: own.ZSK, ZSKPrivate: own.ZSKPrivate, PublishedZSKs: []*dns.DNSKEY{local.ZSK}}
+	rolling := &keySet{KSK: local.KSK, ZSK: local.ZSK, PublishedZSKs: []*dns.DNSKEY{own.ZSK}}
+	for _, ks := range []*keySet{prepublished, rolled} {
+		ks.KSKPrivate = local.KSKPrivate
+	}
+
+	for _, test := range []struct {
+		name   string
+		local  *keySet
+		peer   *keySet
+		serial uint32
+		after  time.Duration
+		state  string
+	}{
+		{"same keys", local, local, 100, 0, peerInSync},
+		{"a ZSK of its own", local, own, 100, 0, peerKeyMismatch},
+		{"prepublished", local, prepublished, 100, 0, peerInSync},
+		{"signing with an unpublished ZSK", local, rolled, 100, 0, peerKeyMismatch},
+		{"rolled over", rolling, rolled, 100, 0, peerInSync},
+		{"another KSK", local, otherKSK, 100, 0, peerBogus},
+		{"serial behind", local, local, 99, 0, peerInSync},
+		{"serial stuck behind", local, local, 99, time.Hour, peerStale},
+		{"serial caught up", local, local, 100, 0, peerInSync},
+	} {
+		localKeys = test.local
+		peer.serve(t, test.peer, test.serial)
+		clk.Advance(test.after)
+		c.check()
+
+		st := c.Status()
+		if st[0].State != test.state {
+			t.Errorf("%s: got %s (%s), expected %s", test.name, st[0].State, st[0].Error, test.state)
+		}
+		if st[1].State != peerError {
+			t.Errorf("%s: unreachable peer is %s", test.name, st[1].State)
+		}
+	}
+
+	expected := []string{
+		"firing key_mismatch", "resolved in_sync",
+		"firing key_mismatch", "resolved in_sync",
+		"firing bogus", "resolved in_sync",
+		"firing stale", "resolved in_sync",
+	}
+	if fmt.Sprint(posted) != fmt.Sprint(expected) {
+		t.Errorf("posted %v, expected %v", posted, expected)
+	}
+}
@@ -0,0 +1,110 @@
+//go:build !windows
+// +build !windows
+
+package server
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// The user and groups to switch to once the sockets are bound and the keys
+// loaded, if RunAsUser is set.
+type runAsUser struct {
+	uid, gid int
+	groups   []int // supplementary groups
+}
+
+// Looks up RunAsUser: a user name or numeric ID, optionally followed by a
+// colon and a group name or numeric ID. A user with no entry in the password
+// database, as in some containers, must be given with its group.
+func (s *Server) setupRunAsUser() error {
+	if s.cfg.RunAsUser == "" {
+		return nil
+	}
+
+	userSpec, groupSpec := s.cfg.RunAsUser, ""
+	if i := strings.IndexByte(userSpec, ':'); i >= 0 {
+		userSpec, groupSpec = userSpec[:i], userSpec[i+1:]
+	}
+
+	ru := &runAsUser{gid: -1}
+	u, err := user.Lookup(userSpec)
+	if err != nil {
+		u, err = user.LookupId(userSpec)
+	}
+	if err == nil {
+		ru.uid, _ = strconv.Atoi(u.Uid)
+		ru.gid, _ = strconv.Atoi(u.Gid)
+		gids, _ := u.GroupIds()
+		for _, g := range gids {
+			if gid, err := strconv.Atoi(g); err == nil {
+				ru.groups = append(ru.groups, gid)
+			}
+		}
+	} else if ru.uid, err = strconv.Atoi(userSpec); err != nil || ru.uid < 0 {
+		return configError("RunAsUser names an unknown user %q", userSpec)
+	}
+
+	if groupSpec != "" {
+		g, err := user.LookupGroup(groupSpec)
+		if err != nil {
+			g, err = user.LookupGroupId(groupSpec)
+		}
+		if err == nil {
+			ru.gid, _ = strconv.Atoi(g.Gid)
+		} else if ru.gid, err = strconv.Atoi(groupSpec); err != nil || ru.gid < 0 {
+			return configError("RunAsUser names an unknown group %q", groupSpec)
+		}
+		ru.groups = nil
+	}
+	if ru.gid < 0 {
+		return configError("RunAsUser %q has no entry in the password database; give its group too, as %s:GROUP", userSpec, userSpec)
+	}
+	if ru.uid == 0 {
+		return configError("RunAsUser must not be root")
+	}
+	if len(ru.groups) == 0 {
+		ru.groups = []int{ru.gid}
+	}
+
+	s.runAs = ru
+	return nil
+}
+
+// Switches to RunAsUser, if it's set, for good. Called once the sockets are
+// bound and the keys loaded, which needn't be readable by that user, before
+// any query is answered.
+func (s *Server) dropPrivileges() error {
+	ru := s.runAs
+	if ru == nil {
+		return nil
+	}
+
+	// Go 1.16 and later change the user of every thread of the process;
+	// earlier versions refuse to on Linux, which is as well, since they
+	// would change only one.
+	if err := syscall.Setgroups(ru.groups); err != nil {
+		return fmt.Errorf("couldn't set the groups of RunAsUser: %v", err)
+	}
+	if err := syscall.Setgid(ru.gid); err != nil {
+		return fmt.Errorf("couldn't switch to the group of RunAsUser: %v", err)
+	}
+	if err := syscall.Setuid(ru.uid); err != nil {
+		return fmt.Errorf("couldn't switch to RunAsUser: %v", err)
+	}
+
+	if os.Getuid() != ru.uid || os.Geteuid() != ru.uid || os.Getgid() != ru.gid || os.Getegid() != ru.gid {
+		return fmt.Errorf("still running as user %d, group %d after switching to RunAsUser", os.Geteuid(), os.Getegid())
+	}
+	if syscall.Setuid(0) == nil {
+		return fmt.Errorf("could switch back to root after switching to RunAsUser")
+	}
+
+	log.Infof("running as user %d, group %d", ru.uid, ru.gid)
+	return nil
+}
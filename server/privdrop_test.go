@@ -0,0 +1,99 @@
+//go:build !windows
+// +build !windows
+
+package server
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestRunAsUser(t *testing.T) {
+	for _, test := range []struct {
+		spec     string
+		uid, gid int
+		ok       bool
+	}{
+		{"12345:12346", 12345, 12346, true},
+		{"12345", 0, 0, false}, // not in the password database, so the group must be given
+		{"ncdns-no-such-user", 0, 0, false},
+		{"12345:ncdns-no-such-group", 0, 0, false},
+		{"0:0", 0, 0, false},
+	} {
+		s := &Server{cfg: Config{RunAsUser: test.spec}}
+		err := s.setupRunAsUser()
+		if test.ok != (err == nil) {
+			t.Errorf("%s: got %v", test.spec, err)
+			continue
+		}
+		if err != nil {
+			if !errors.Is(err, ErrConfigInvalid) {
+				t.Errorf("%s: error %v isn't ErrConfigInvalid", test.spec, err)
+			}
+			continue
+		}
+		if s.runAs.uid != test.uid || s.runAs.gid != test.gid || len(s.runAs.groups) != 1 || s.runAs.groups[0] != test.gid {
+			t.Errorf("%s: got %+v", test.spec, s.runAs)
+		}
+	}
+
+	// A user in the password database gets its group and supplementary
+	// groups.
+	if u, err := user.Lookup("nobody"); err == nil {
+		s := &Server{cfg: Config{RunAsUser: "nobody"}}
+		if err := s.setupRunAsUser(); err != nil {
+			t.Fatal(err)
+		}
+		if strconv.Itoa(s.runAs.uid) != u.Uid || strconv.Itoa(s.runAs.gid) != u.Gid || len(s.runAs.groups) == 0 {
+			t.Errorf("nobody: got %+v", s.runAs)
+		}
+	}
+}
+
+// A process started as root which drops privileges can't read the files
+// only root can, or become root again. It's run as a separate process, since
+// the test's own can't be given its privileges back.
+func TestDropPrivileges(t *testing.T) {
+	if spec := os.Getenv("NCDNS_TEST_RUN_AS"); spec != "" {
+		s := &Server{cfg: Config{RunAsUser: spec}}
+		if err := s.setupRunAsUser(); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.dropPrivileges(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ioutil.ReadFile(os.Getenv("NCDNS_TEST_ROOT_FILE")); !os.IsPermission(err) {
+			t.Fatalf("read a file only root can: %v", err)
+		}
+		return
+	}
+	if os.Getuid() != 0 {
+		t.Skip("not running as root")
+	}
+
+	dir, err := ioutil.TempDir("", "ncdns-privdrop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.Chmod(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "secret")
+	if err := ioutil.WriteFile(path, []byte("secret"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestDropPrivileges$", "-test.v")
+	cmd.Env = append(os.Environ(), "NCDNS_TEST_RUN_AS=12345:12345", "NCDNS_TEST_ROOT_FILE="+path)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Errorf("%v\n%s", err, out)
+	}
+}
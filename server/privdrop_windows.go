@@ -0,0 +1,14 @@
+package server
+
+type runAsUser struct{}
+
+func (s *Server) setupRunAsUser() error {
+	if s.cfg.RunAsUser != "" {
+		return configError("RunAsUser isn't supported on Windows")
+	}
+	return nil
+}
+
+func (s *Server) dropPrivileges() error {
+	return nil
+}
@@ -0,0 +1,112 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/namecoin/ncdns/clock"
+)
+
+// How long the result of the check of namecoind made by /readyz is reused for,
+// so that frequent probes don't each make an RPC call, and how long the call
+// may take before namecoind is taken to be down.
+const (
+	readyRPCCacheTime = 5 * time.Second
+	readyRPCTimeout   = 2 * time.Second
+)
+
+// Checks that namecoind answers, for /readyz. A call which hasn't returned
+// within timeout fails the check; it's left to finish in the background, and
+// no other call is made until it has, so that probes of a hung namecoind
+// don't pile calls onto it.
+type rpcProbe struct {
+	call    func() error
+	timeout time.Duration
+	clock   clock.Clock
+
+	mu       sync.Mutex
+	checked  time.Time // zero until a call has returned or timed out
+	err      error
+	inflight bool
+}
+
+func newRPCProbe(call func() error, c clock.Clock) *rpcProbe {
+	return &rpcProbe{call: call, timeout: readyRPCTimeout, clock: clock.Or(c)}
+}
+
+func (p *rpcProbe) check() error {
+	p.mu.Lock()
+	if !p.checked.IsZero() && p.clock.Now().Sub(p.checked) < readyRPCCacheTime {
+		err := p.err
+		p.mu.Unlock()
+		return err
+	}
+	if p.inflight {
+		// Still waiting for a call which timed out, or for one made by
+		// another probe.
+		err := p.err
+		if p.checked.IsZero() {
+			err = errors.New("namecoind is being checked")
+		}
+		p.mu.Unlock()
+		return err
+	}
+	p.inflight = true
+	p.mu.Unlock()
+
+	done := make(chan error, 1)
+	go func() {
+		err := p.call()
+		p.mu.Lock()
+		p.inflight = false
+		p.mu.Unlock()
+		done <- err
+	}()
+
+	// The system clock's, as it bounds a real call to namecoind.
+	t := time.NewTimer(p.timeout)
+	defer t.Stop()
+	var err error
+	select {
+	case err = <-done:
+	case <-t.C:
+		err = fmt.Errorf("namecoind didn't answer within %v", p.timeout)
+	}
+
+	p.mu.Lock()
+	p.checked, p.err = p.clock.Now(), err
+	p.mu.Unlock()
+	return err
+}
+
+// Returns an error if the DNS listeners aren't up: before Start, once
+// stopped, or while draining.
+func (s *Server) servingError() error {
+	switch st := s.lifecycle.current(); st {
+	case stateRunning, stateReloading:
+		return nil
+	case stateDraining:
+		return errors.New("draining")
+	default:
+		return fmt.Errorf("not serving: %v", st)
+	}
+}
+
+// Returns an error if DNSSEC keys are configured but those needed to sign
+// aren't loaded.
+func (s *Server) keysError() error {
+	if s.cfg.DNSSEC.PublicKey == "" {
+		return nil
+	}
+
+	ks := s.globalKeys()
+	switch {
+	case ks == nil || ks.KSK == nil || ks.KSKPrivate == nil:
+		return errors.New("the KSK isn't loaded")
+	case ks.ZSK == nil || ks.ZSKPrivate == nil:
+		return errors.New("the ZSK isn't loaded")
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package server
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/namecoin/ncdns/testutil"
+)
+
+func TestRPCProbe(t *testing.T) {
+	clk := testutil.NewFakeClock(time.Unix(1600000000, 0))
+	var calls int32
+	var fail atomic.Value
+	fail.Store(false)
+	release := make(chan struct{})
+	p := newRPCProbe(func() error {
+		atomic.AddInt32(&calls, 1)
+		if fail.Load().(bool) {
+			<-release
+			return errors.New("connection refused")
+		}
+		return nil
+	}, clk)
+	p.timeout = 20 * time.Millisecond
+
+	if err := p.check(); err != nil {
+		t.Fatal(err)
+	}
+	// The result is reused until readyRPCCacheTime has passed.
+	fail.Store(true)
+	if err := p.check(); err != nil || atomic.LoadInt32(&calls) != 1 {
+		t.Errorf("cached result not reused: %v, %d calls", err, atomic.LoadInt32(&calls))
+	}
+
+	// A call which hangs fails the check, and no other call is made until it
+	// has returned.
+	clk.Advance(readyRPCCacheTime)
+	if err := p.check(); err == nil {
+		t.Errorf("hung call passed the check")
+	}
+	clk.Advance(readyRPCCacheTime)
+	if err := p.check(); err == nil || atomic.LoadInt32(&calls) != 2 {
+		t.Errorf("got %v with %d calls; expected the hung call's error", err, atomic.LoadInt32(&calls))
+	}
+
+	fail.Store(false)
+	close(release)
+	for {
+		p.mu.Lock()
+		inflight := p.inflight
+		p.mu.Unlock()
+		if !inflight {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err := p.check(); err != nil || atomic.LoadInt32(&calls) != 3 {
+		t.Errorf("got %v with %d calls once namecoind recovered", err, atomic.LoadInt32(&calls))
+	}
+}
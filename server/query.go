@@ -0,0 +1,162 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// The local address queries made with Query appear to have been received at.
+var queryLocalIP = net.IPv4(127, 0, 0, 1)
+
+var errQueryWriterClosed = errors.New("response writer closed")
+
+// Query answers req in-process, without a socket, as if it had been received
+// from clientAddr: it's passed through the whole chain of handlers a query
+// from the network is, so that ACLs, rate limiting, EDNS handling, signing
+// and the rest apply to it as they would, and clientAddr's type, a
+// *net.UDPAddr or *net.TCPAddr, decides which transport it appears to have
+// come over. If clientAddr is nil, the query is from 127.0.0.1 over UDP.
+//
+// req is packed and unpacked, as it would be sent and received, as is the
+// response returned, which a query dropped by rate limiting doesn't have; it's
+// then nil, with no error. A query signed with TSIG is checked against
+// TSIGKey as a query from the network is, and a response signed in answer is
+// signed. Zone transfers, which are answered with more than one message,
+// can't be made with Query, and the checks dns.Server makes of a message
+// before passing it to the handlers, e.g. of its opcode, aren't made.
+//
+// Once ctx is done, Query stops waiting for the answer, and the query is
+// abandoned as one whose TCP client closes its connection is.
+func (s *Server) Query(ctx context.Context, req *dns.Msg, clientAddr net.Addr) (*dns.Msg, error) {
+	if len(req.Question) == 1 && (req.Question[0].Qtype == dns.TypeAXFR || req.Question[0].Qtype == dns.TypeIXFR) {
+		return nil, errors.New("zone transfers can't be made with Query")
+	}
+
+	rw := &queryResponseWriter{remote: clientAddr, tsigSecrets: s.tsigSecrets()}
+	switch addr := clientAddr.(type) {
+	case nil:
+		rw.remote = &net.UDPAddr{IP: queryLocalIP, Port: 53}
+		rw.local = &net.UDPAddr{IP: queryLocalIP, Port: 53}
+	case *net.UDPAddr:
+		rw.local = &net.UDPAddr{IP: queryLocalIP, Port: 53}
+	case *net.TCPAddr:
+		rw.local = &net.TCPAddr{IP: queryLocalIP, Port: 53}
+	default:
+		return nil, fmt.Errorf("client address %v is neither UDP nor TCP", addr)
+	}
+
+	wire, err := req.Pack()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't pack the query: %v", err)
+	}
+	r := new(dns.Msg)
+	if err := r.Unpack(wire); err != nil {
+		return nil, fmt.Errorf("couldn't unpack the query: %v", err)
+	}
+	rw.checkTsig(r, wire)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.serveDNS(ctx, rw, r)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	if rw.err != nil {
+		return nil, rw.err
+	}
+	return rw.res, nil
+}
+
+// The dns.ResponseWriter of a query made with Query, which behaves as the
+// dns package's does for a query from the network, but keeps the response
+// instead of sending it.
+type queryResponseWriter struct {
+	local, remote net.Addr
+
+	tsigSecrets    map[string]string
+	tsigStatus     error
+	tsigRequestMAC string
+	tsigTimersOnly bool
+
+	res    *dns.Msg
+	err    error // from unpacking a response written with Write
+	closed bool
+}
+
+// Checks the TSIG signature of req, whose wire format is wire, if it has
+// one, as dns.Server does before calling the handler.
+func (rw *queryResponseWriter) checkTsig(req *dns.Msg, wire []byte) {
+	t := req.IsTsig()
+	if t == nil {
+		return
+	}
+
+	secret, ok := rw.tsigSecrets[t.Hdr.Name]
+	if !ok {
+		rw.tsigStatus = dns.ErrSecret
+	} else {
+		rw.tsigStatus = dns.TsigVerify(wire, secret, "", false)
+	}
+	rw.tsigRequestMAC = t.MAC
+}
+
+func (rw *queryResponseWriter) LocalAddr() net.Addr  { return rw.local }
+func (rw *queryResponseWriter) RemoteAddr() net.Addr { return rw.remote }
+
+// Packs m, signing it if it has a TSIG record, as dns.Server's writer does.
+func (rw *queryResponseWriter) WriteMsg(m *dns.Msg) error {
+	var wire []byte
+	var err error
+	if t := m.IsTsig(); t != nil {
+		secret, ok := rw.tsigSecrets[t.Hdr.Name]
+		if !ok {
+			return dns.ErrSecret
+		}
+		wire, _, err = dns.TsigGenerate(m, secret, rw.tsigRequestMAC, rw.tsigTimersOnly)
+	} else {
+		wire, err = m.Pack()
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = rw.Write(wire)
+	return err
+}
+
+// Keeps the response in wire format b. Only the first response to a query is
+// kept, as a client reading one would.
+func (rw *queryResponseWriter) Write(b []byte) (int, error) {
+	if rw.closed {
+		return 0, errQueryWriterClosed
+	}
+	if rw.res != nil {
+		return len(b), nil
+	}
+
+	res := new(dns.Msg)
+	if err := res.Unpack(b); err != nil {
+		rw.err = fmt.Errorf("couldn't unpack the response: %v", err)
+	} else {
+		rw.res = res
+	}
+	return len(b), nil
+}
+
+func (rw *queryResponseWriter) Close() error {
+	rw.closed = true
+	return nil
+}
+
+func (rw *queryResponseWriter) TsigStatus() error              { return rw.tsigStatus }
+func (rw *queryResponseWriter) TsigTimersOnly(timersOnly bool) { rw.tsigTimersOnly = timersOnly }
+func (rw *queryResponseWriter) Hijack()                        {}
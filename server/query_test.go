@@ -0,0 +1,124 @@
+package server
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestQuery(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ncdns-query")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := newReloadTestConfig(t, dir)
+	cfg.AllowQueriesFrom = "192.0.2.0/24,127.0.0.1"
+	s, err := newServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := new(dns.Msg)
+	req.SetQuestion("bit.", dns.TypeSOA)
+	req.SetEdns0(4096, true)
+
+	res, err := s.Query(context.Background(), req, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Id != req.Id || res.Rcode != dns.RcodeSuccess || countType(res.Answer, dns.TypeSOA) != 1 || countType(res.Answer, dns.TypeRRSIG) != 1 {
+		t.Errorf("unexpected response %v", res)
+	}
+
+	// The response is a copy, unpacked from the wire format.
+	res.Answer[0].Header().Ttl = 1
+	if again, err := s.Query(context.Background(), req, &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1234}); err != nil || again.Answer[0].Header().Ttl == 1 {
+		t.Errorf("got %v, %v", again, err)
+	}
+
+	// The client address is checked against the ACL.
+	res, err = s.Query(context.Background(), req, &net.UDPAddr{IP: net.ParseIP("198.51.100.1"), Port: 1234})
+	if err != nil || res.Rcode != dns.RcodeRefused {
+		t.Errorf("query from outside AllowQueriesFrom: got %v, %v", res, err)
+	}
+
+	axfr := new(dns.Msg)
+	axfr.SetAxfr("bit.")
+	if _, err := s.Query(context.Background(), axfr, nil); err == nil {
+		t.Errorf("zone transfer made with Query")
+	}
+	if _, err := s.Query(context.Background(), req, &net.UnixAddr{Name: "/tmp/sock", Net: "unix"}); err == nil {
+		t.Errorf("query over a Unix socket accepted")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := s.Query(ctx, req, nil); err != context.Canceled {
+		// The query may have been answered before the cancellation was
+		// noticed.
+		t.Logf("query with a cancelled context: %v", err)
+	}
+}
+
+// TSIG signatures are checked and made as dns.Server does.
+func TestQueryResponseWriterTsig(t *testing.T) {
+	const keyName, secret = "xfr.example.", "c2VjcmV0LXNlY3JldC1zZWNyZXQ="
+
+	req := new(dns.Msg)
+	req.SetQuestion("bit.", dns.TypeSOA)
+	req.SetTsig(keyName, dns.HmacSHA256, tsigFudge, time.Now().Unix())
+	wire, mac, err := dns.TsigGenerate(req, secret, "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := new(dns.Msg)
+	if err := signed.Unpack(wire); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		secrets map[string]string
+		ok      bool
+	}{
+		{map[string]string{keyName: secret}, true},
+		{map[string]string{keyName: "b3RoZXI="}, false},
+		{nil, false},
+	} {
+		rw := &queryResponseWriter{tsigSecrets: test.secrets}
+		rw.checkTsig(signed, wire)
+		if (rw.TsigStatus() == nil) != test.ok {
+			t.Errorf("secrets %v: got TSIG status %v", test.secrets, rw.TsigStatus())
+		}
+	}
+
+	rw := &queryResponseWriter{tsigSecrets: map[string]string{keyName: secret}}
+	rw.checkTsig(signed, wire)
+	m := new(dns.Msg)
+	m.SetReply(signed)
+	m.SetTsig(keyName, dns.HmacSHA256, tsigFudge, time.Now().Unix())
+	if err := rw.WriteMsg(m); err != nil {
+		t.Fatal(err)
+	}
+	resWire, err := rw.res.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := dns.TsigVerify(resWire, secret, mac, false); err != nil {
+		t.Errorf("response signature doesn't verify: %v", err)
+	}
+
+	// Only the first response is kept, and none once closed.
+	if err := rw.WriteMsg(new(dns.Msg)); err != nil || rw.res.Id != signed.Id {
+		t.Errorf("second response replaced the first: %v", err)
+	}
+	rw.Close()
+	if _, err := rw.Write(wire); err == nil {
+		t.Errorf("written to once closed")
+	}
+}
@@ -0,0 +1,140 @@
+package server
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	madns "gopkg.in/hlandau/madns.v2"
+
+	"github.com/namecoin/ncdns/backend"
+)
+
+// Returns the context of a query's lookups, derived from ctx: it's done after
+// LookupTimeout, so that a slow fetch can't hold up the query's goroutine for
+// longer, and, if the query came over TCP, as soon as the client closes the
+// connection before it's been answered, so that nothing is fetched for a
+// client which is no longer waiting.
+//
+// A connection is taken to be closed once the client has shut down its side
+// of it, so a client which does so after sending its query, and still waits
+// for the answer, is taken to have given up. Connections aren't watched on
+// Windows.
+func (s *Server) queryContext(ctx context.Context, rw dns.ResponseWriter) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	stopWatching := func() {}
+	if _, ok := rw.RemoteAddr().(*net.TCPAddr); ok {
+		if c := s.tcpConns.conn(rw.LocalAddr(), rw.RemoteAddr()); c != nil {
+			stopWatching = watchHangup(c.Conn, cancel)
+		}
+	}
+	if s.cfg.LookupTimeout <= 0 {
+		return ctx, func() {
+			stopWatching()
+			cancel()
+		}
+	}
+
+	tctx, cancelTimeout := context.WithTimeout(ctx, time.Duration(s.cfg.LookupTimeout)*time.Millisecond)
+	return tctx, func() {
+		stopWatching()
+		cancelTimeout()
+		cancel()
+	}
+}
+
+// A dns.ResponseWriter carrying the context of the query written to it, for
+// the engine to make the query's lookups with.
+type lookupContextWriter struct {
+	dns.ResponseWriter
+	ctx context.Context
+}
+
+// Returns the context of the query written to rw, or context.Background() if
+// it has none, e.g. as it's a query made of the engine by ncdns itself.
+func lookupContext(rw dns.ResponseWriter) context.Context {
+	if cw, ok := rw.(*lookupContextWriter); ok {
+		return cw.ctx
+	}
+	return context.Background()
+}
+
+// Serves queries with madns engines whose lookups are made with the context
+// of the query being served, read from its writer. madns gives the backend no
+// way to receive a context, so each engine serves one query at a time, its
+// backend holding that query's context meanwhile; the engines are kept for
+// later queries rather than built for each.
+type contextEngine struct {
+	b    *backend.Backend
+	wrap func(madns.Backend) madns.Backend
+	ks   *keySet
+	pool sync.Pool // *pooledEngine
+}
+
+type pooledEngine struct {
+	madns.Engine
+	cb *contextBackend
+}
+
+// Returns a contextEngine answering from the view of b given by wrap, e.g.
+// with the response policy applied, and signing with ks.
+func newContextEngine(b *backend.Backend, wrap func(madns.Backend) madns.Backend, ks *keySet) (*contextEngine, error) {
+	ce := &contextEngine{b: b, wrap: wrap, ks: ks}
+
+	// One is built at once, so that keys madns can't use are found now
+	// rather than by the first query.
+	pe, err := ce.newPooledEngine()
+	if err != nil {
+		return nil, err
+	}
+	ce.pool.Put(pe)
+	return ce, nil
+}
+
+func (ce *contextEngine) newPooledEngine() (*pooledEngine, error) {
+	cb := &contextBackend{b: ce.b}
+	e, err := newEngine(ce.wrap(cb), ce.ks)
+	if err != nil {
+		return nil, err
+	}
+	return &pooledEngine{Engine: e, cb: cb}, nil
+}
+
+func (ce *contextEngine) ServeDNS(rw dns.ResponseWriter, req *dns.Msg) {
+	pe, _ := ce.pool.Get().(*pooledEngine)
+	if pe == nil {
+		var err error
+		pe, err = ce.newPooledEngine()
+		if err != nil {
+			log.Errore(err, "couldn't build an engine")
+			m := new(dns.Msg)
+			m.SetRcode(req, dns.RcodeServerFailure)
+			rw.WriteMsg(m)
+			return
+		}
+	}
+
+	pe.cb.ctx = lookupContext(rw)
+	pe.ServeDNS(rw, req)
+	pe.cb.ctx = nil
+	ce.pool.Put(pe)
+}
+
+// Passes the lookups of an engine to the backend along with the context of
+// the query it's serving.
+type contextBackend struct {
+	b   *backend.Backend
+	ctx context.Context
+}
+
+var _ madns.Backend = &contextBackend{}
+
+func (cb *contextBackend) Lookup(qname, streamIsolationID string) ([]dns.RR, error) {
+	ctx := cb.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return cb.b.LookupContext(ctx, qname, streamIsolationID)
+}
@@ -0,0 +1,101 @@
+//go:build !windows
+// +build !windows
+
+package server
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"gopkg.in/hlandau/madns.v2/merr"
+
+	"github.com/namecoin/ncdns/namecoin"
+)
+
+// Blocks each fetch of name until its context is done, reporting that it has
+// started and why it ended. Other names, such as those the server checks on
+// its own, don't exist.
+type hangingFetcher struct {
+	name    string
+	started chan struct{}
+	ended   chan error
+}
+
+func (f *hangingFetcher) Fetch(ctx context.Context, name, streamIsolationID string) (*namecoin.NameData, error) {
+	if name != f.name {
+		return nil, merr.ErrNoSuchDomain
+	}
+	f.started <- struct{}{}
+	<-ctx.Done()
+	f.ended <- ctx.Err()
+	return nil, ctx.Err()
+}
+
+// A query whose TCP client disconnects is abandoned at once, and a query which
+// takes longer than LookupTimeout times out, each counted apart.
+func TestQueryCancellation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ncdns-querycontext")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	f := &hangingFetcher{name: "d/example", started: make(chan struct{}, 1), ended: make(chan error, 1)}
+	cfg := newErrorTestConfig(dir)
+	cfg.UseFetcher(f)
+	cfg.LookupTimeout = 1000
+
+	s, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+	addr := s.TCPAddrs()[0].String()
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := dns.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := new(dns.Msg)
+	req.SetQuestion("example.bit.", dns.TypeA)
+	if err := c.WriteMsg(req); err != nil {
+		t.Fatal(err)
+	}
+	<-f.started
+	c.Close()
+
+	select {
+	case err := <-f.ended:
+		if err != context.Canceled {
+			t.Errorf("fetch ended with %v, expected context.Canceled", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("fetch not cancelled after the client disconnected")
+	}
+	if st := s.currentBackend().LookupStats(); st.Cancelled != 1 || st.TimedOut != 0 {
+		t.Errorf("unexpected stats %+v", st)
+	}
+
+	// A query is given up on after LookupTimeout, and its fetch with it.
+	res, err := s.Query(context.Background(), req, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-f.started
+	if err := <-f.ended; err != context.Canceled {
+		t.Errorf("timed out fetch ended with %v, expected context.Canceled", err)
+	}
+	if res.Rcode != dns.RcodeServerFailure {
+		t.Errorf("got %v for a query which timed out, expected SERVFAIL", res)
+	}
+	if st := s.currentBackend().LookupStats(); st.Cancelled != 1 || st.TimedOut != 1 {
+		t.Errorf("unexpected stats %+v", st)
+	}
+}
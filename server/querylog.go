@@ -0,0 +1,303 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/namecoin/ncdns/clock"
+)
+
+// The number of entries queued for writing to the query log before more are
+// dropped.
+const queryLogBuffer = 4096
+
+// Writes a line to QueryLogPath for every QueryLogSample-th query answered.
+//
+// Entries are queued to a goroutine which writes them, so that a slow disk
+// never holds up answering queries; if the queue is full, the entry is
+// dropped and counted instead. The file is reopened by ReopenQueryLog, so that
+// it can be rotated by logrotate, and rotated by ncdns itself once it grows larger
+// than QueryLogMaxBytes, if that is set.
+type queryLog struct {
+	// First, so that they're aligned for atomic access on 32-bit platforms
+	queries uint64 // accessed atomically; seen, for sampling
+	written uint64 // accessed atomically
+	dropped uint64 // accessed atomically
+
+	path     string
+	json     bool
+	sample   uint64
+	maxBytes int64
+
+	entries chan *queryLogEntry
+	reopen  chan chan error
+	stop    chan struct{}
+	done    chan struct{}
+	stopped sync.Once
+
+	// Used only by the goroutine writing entries once it has started.
+	f    *os.File
+	w    *bufio.Writer
+	size int64
+}
+
+type queryLogEntry struct {
+	Time     time.Time `json:"time"`
+	Client   string    `json:"client"`
+	Protocol string    `json:"protocol"` // udp, tcp or tls
+	Name     string    `json:"qname"`
+	Type     string    `json:"qtype"`
+	Rcode    string    `json:"rcode"`
+	Answers  int       `json:"answers"`
+	Size     int       `json:"size"`       // of the response, in bytes
+	Latency  float64   `json:"latency_ms"` // from receiving the query to answering it
+}
+
+// Sets up the query log, if QueryLogPath is set, opening the file so that a
+// path which can't be written to is reported at once.
+func (s *Server) setupQueryLog() error {
+	if s.cfg.QueryLogPath == "" {
+		return nil
+	}
+
+	ql := &queryLog{
+		path:     s.cfg.cpath(s.cfg.QueryLogPath),
+		sample:   uint64(s.cfg.QueryLogSample),
+		maxBytes: int64(s.cfg.QueryLogMaxBytes),
+		entries:  make(chan *queryLogEntry, queryLogBuffer),
+		reopen:   make(chan chan error),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	switch s.cfg.QueryLogFormat {
+	case "text":
+	case "json":
+		ql.json = true
+	default:
+		return fmt.Errorf("QueryLogFormat must be text or json")
+	}
+	if s.cfg.QueryLogSample < 1 {
+		return fmt.Errorf("QueryLogSample must be at least 1")
+	}
+	if s.cfg.QueryLogMaxBytes < 0 {
+		return fmt.Errorf("QueryLogMaxBytes must not be negative")
+	}
+
+	if err := ql.open(); err != nil {
+		return fmt.Errorf("Couldn't open QueryLogPath: %v", err)
+	}
+	s.queryLog = ql
+	go ql.run()
+	s.shutdown.register(shutdownFlush, "query log", func(context.Context) error {
+		ql.shutdown()
+		return nil
+	})
+	return nil
+}
+
+func (ql *queryLog) open() error {
+	f, err := os.OpenFile(ql.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	ql.f, ql.w, ql.size = f, bufio.NewWriter(f), fi.Size()
+	return nil
+}
+
+// Closes the file, and opens the file now at the path, which if the file was
+// moved away is a new one.
+func (ql *queryLog) reopenFile() error {
+	ql.w.Flush()
+	ql.f.Close()
+	return ql.open()
+}
+
+// Moves the file to the path with ".1" appended, replacing any file there,
+// and starts a new one.
+func (ql *queryLog) rotate() error {
+	ql.w.Flush()
+	ql.f.Close()
+	if err := os.Rename(ql.path, ql.path+".1"); err != nil {
+		log.Warne(err, "couldn't rotate the query log")
+	}
+	return ql.open()
+}
+
+// Writes the entries queued until shut down. A file which can't be reopened
+// stops the writing; entries are dropped from then on.
+func (ql *queryLog) run() {
+	defer close(ql.done)
+
+	failed := false
+	for {
+		select {
+		case e := <-ql.entries:
+			failed = !ql.write(e, failed)
+		case result := <-ql.reopen:
+			// Entries queued before the reopen belong in the old file.
+			for len(ql.entries) > 0 {
+				failed = !ql.write(<-ql.entries, failed)
+			}
+			var err error
+			if failed {
+				err = ql.open()
+			} else {
+				err = ql.reopenFile()
+			}
+			failed = err != nil
+			result <- err
+			continue
+		case <-ql.stop:
+			for {
+				select {
+				case e := <-ql.entries:
+					failed = !ql.write(e, failed)
+				default:
+					if !failed {
+						ql.w.Flush()
+						ql.f.Close()
+					}
+					return
+				}
+			}
+		}
+
+		// Written out once the queue is empty, rather than line by line.
+		if !failed && len(ql.entries) == 0 {
+			ql.w.Flush()
+		}
+	}
+}
+
+// Writes e, unless writing has failed, in which case it's dropped. Returns
+// false if writing has failed, or does now as the file had to be rotated and
+// couldn't be opened again.
+func (ql *queryLog) write(e *queryLogEntry, failed bool) bool {
+	if failed {
+		atomic.AddUint64(&ql.dropped, 1)
+		return false
+	}
+
+	var line []byte
+	if ql.json {
+		line, _ = json.Marshal(e)
+	} else {
+		line = []byte(fmt.Sprintf("%s %s %s %s %s %s %d %d %.3fms",
+			e.Time.UTC().Format("2006-01-02T15:04:05.000Z07:00"), e.Client, e.Protocol, e.Name, e.Type, e.Rcode, e.Answers, e.Size, e.Latency))
+	}
+	line = append(line, '\n')
+
+	n, err := ql.w.Write(line)
+	ql.size += int64(n)
+	if err != nil {
+		log.Warne(err, "couldn't write to the query log")
+		atomic.AddUint64(&ql.dropped, 1)
+	} else {
+		atomic.AddUint64(&ql.written, 1)
+	}
+
+	if ql.maxBytes > 0 && ql.size >= ql.maxBytes {
+		if err := ql.rotate(); err != nil {
+			log.Errore(err, "couldn't open the query log again after rotating it; no longer logging queries")
+			return false
+		}
+	}
+	return true
+}
+
+// Writes the entries already queued, then closes the file.
+func (ql *queryLog) shutdown() {
+	ql.stopped.Do(func() { close(ql.stop) })
+	<-ql.done
+}
+
+// ReopenQueryLog closes the query log and opens it again at QueryLogPath, so
+// that a log moved away by logrotate is started afresh. It's called on
+// SIGUSR1, and does nothing if QueryLogPath isn't set or the server has been
+// stopped.
+func (s *Server) ReopenQueryLog() error {
+	if s.queryLog == nil {
+		return nil
+	}
+
+	result := make(chan error, 1)
+	select {
+	case s.queryLog.reopen <- result:
+		return <-result
+	case <-s.queryLog.done:
+		return nil
+	}
+}
+
+// Queues an entry, or drops it if the queue is full.
+func (ql *queryLog) add(e *queryLogEntry) {
+	select {
+	case ql.entries <- e:
+	default:
+		atomic.AddUint64(&ql.dropped, 1)
+	}
+}
+
+// Wraps rw so that the response written to it is logged, if this query is
+// one of those sampled.
+func (s *Server) queryLogWriter(rw dns.ResponseWriter, req *dns.Msg) dns.ResponseWriter {
+	if s.queryLog == nil || atomic.AddUint64(&s.queryLog.queries, 1)%s.queryLog.sample != 0 {
+		return rw
+	}
+
+	return &queryLogWriter{
+		ResponseWriter: rw,
+		ql:             s.queryLog,
+		req:            req,
+		transport:      s.transport(rw),
+		clock:          clock.Or(s.clock),
+		start:          clock.Or(s.clock).Now(),
+	}
+}
+
+type queryLogWriter struct {
+	dns.ResponseWriter
+	ql        *queryLog
+	req       *dns.Msg
+	transport string
+	clock     clock.Clock
+	start     time.Time
+}
+
+func (rw *queryLogWriter) WriteMsg(m *dns.Msg) error {
+	e := &queryLogEntry{
+		Time:     rw.start,
+		Client:   rw.RemoteAddr().String(),
+		Protocol: rw.transport,
+		Name:     "-",
+		Type:     "-",
+		Rcode:    dns.RcodeToString[m.Rcode],
+		Answers:  len(m.Answer),
+		Size:     m.Len(),
+		Latency:  float64(rw.clock.Now().Sub(rw.start)) / float64(time.Millisecond),
+	}
+	if len(rw.req.Question) > 0 {
+		q := rw.req.Question[0]
+		e.Name, e.Type = q.Name, dns.Type(q.Qtype).String()
+	}
+	if e.Rcode == "" {
+		e.Rcode = fmt.Sprintf("RCODE%d", m.Rcode)
+	}
+	rw.ql.add(e)
+
+	return rw.ResponseWriter.WriteMsg(m)
+}
@@ -0,0 +1,165 @@
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func readLines(t *testing.T, path string) []string {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+}
+
+func TestQueryLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ncdns-querylog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := newDrainTestServer(t)
+	s.cfg.ConfigDir = dir
+	s.cfg.QueryLogPath = "queries.log"
+	s.cfg.QueryLogFormat = "json"
+	s.cfg.QueryLogSample = 2
+	if err := s.setupQueryLog(); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "queries.log")
+
+	query := func(name string) {
+		req := new(dns.Msg)
+		req.SetQuestion(name, dns.TypeA)
+		s.ServeDNS(&fakeResponseWriter{addr: &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1234}}, req)
+	}
+
+	// Every second query is logged.
+	for _, name := range []string{"nonexistent.bit.", "example.bit.", "example.bit.", "nonexistent.bit."} {
+		query(name)
+	}
+
+	s.queryLog.shutdown()
+	lines := readLines(t, path)
+	if len(lines) != 2 {
+		t.Fatalf("logged %q, expected two queries", lines)
+	}
+
+	var e queryLogEntry
+	if err := json.Unmarshal([]byte(lines[0]), &e); err != nil {
+		t.Fatal(err)
+	}
+	if e.Client != "192.0.2.1:1234" || e.Protocol != "udp" || e.Name != "example.bit." || e.Type != "A" ||
+		e.Rcode != "NOERROR" || e.Answers != 1 || e.Size == 0 || e.Latency < 0 || e.Time.IsZero() {
+		t.Errorf("unexpected entry %+v", e)
+	}
+	if err := json.Unmarshal([]byte(lines[1]), &e); err != nil || e.Name != "nonexistent.bit." || e.Rcode != "NXDOMAIN" || e.Answers != 0 {
+		t.Errorf("unexpected entry %+v (%v)", e, err)
+	}
+}
+
+func TestQueryLogReopen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ncdns-querylog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := newDrainTestServer(t)
+	s.cfg.ConfigDir = dir
+	s.cfg.QueryLogPath = "queries.log"
+	s.cfg.QueryLogFormat = "text"
+	s.cfg.QueryLogSample = 1
+	if err := s.setupQueryLog(); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "queries.log")
+
+	query := func() {
+		req := new(dns.Msg)
+		req.SetQuestion("example.bit.", dns.TypeA)
+		s.ServeDNS(&fakeResponseWriter{}, req)
+	}
+
+	query()
+	if err := os.Rename(path, path+".old"); err != nil {
+		t.Fatal(err)
+	}
+	// As logrotate would, after moving the file away.
+	if err := s.ReopenQueryLog(); err != nil {
+		t.Fatal(err)
+	}
+	query()
+	query()
+	s.queryLog.shutdown()
+
+	if lines := readLines(t, path+".old"); len(lines) != 1 {
+		t.Errorf("old log has %q, expected one query", lines)
+	}
+	lines := readLines(t, path)
+	if len(lines) != 2 {
+		t.Fatalf("new log has %q, expected two queries", lines)
+	}
+	fields := strings.Fields(lines[0])
+	if len(fields) != 9 || fields[1] != "127.0.0.1:53" || fields[2] != "udp" || fields[3] != "example.bit." ||
+		fields[4] != "A" || fields[5] != "NOERROR" || fields[6] != "1" || !strings.HasSuffix(fields[8], "ms") {
+		t.Errorf("unexpected line %q", lines[0])
+	}
+
+	// Once stopped, there's nothing to reopen.
+	if err := s.ReopenQueryLog(); err != nil {
+		t.Errorf("reopening once stopped: %v", err)
+	}
+}
+
+// The log is rotated by size, if QueryLogMaxBytes is set, and entries which
+// can't be queued are dropped rather than waited for.
+func TestQueryLogRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ncdns-querylog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "queries.log")
+	ql := &queryLog{path: path, maxBytes: 100, entries: make(chan *queryLogEntry, 1)}
+	if err := ql.open(); err != nil {
+		t.Fatal(err)
+	}
+
+	e := &queryLogEntry{Client: "192.0.2.1:1234", Protocol: "udp", Name: "example.bit.", Type: "A", Rcode: "NOERROR"}
+	for i := 0; i < 3; i++ {
+		if !ql.write(e, false) {
+			t.Fatalf("write %d failed", i)
+		}
+	}
+	ql.w.Flush()
+	if lines := readLines(t, path+".1"); len(lines) != 2 {
+		t.Errorf("rotated log has %q, expected two queries", lines)
+	}
+	if lines := readLines(t, path); len(lines) != 1 {
+		t.Errorf("new log has %q, expected one query", lines)
+	}
+	ql.f.Close()
+
+	ql.add(e)
+	ql.add(e)
+	if d := atomic.LoadUint64(&ql.dropped); d != 1 {
+		t.Errorf("%d entries dropped, expected 1", d)
+	}
+
+	s := &Server{cfg: Config{QueryLogPath: "queries.log", QueryLogFormat: "xml", QueryLogSample: 1}}
+	if err := s.setupQueryLog(); err == nil {
+		t.Errorf("unknown QueryLogFormat accepted")
+	}
+}
@@ -0,0 +1,217 @@
+package server
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+
+	"github.com/namecoin/ncdns/backend"
+)
+
+// The options which Reload applies, by their flat names. The others can't be
+// changed without restarting ncdns: BindAddresses and HTTPListenAddr, for
+// instance, because the sockets are kept open across a reload.
+var reloadableOptions = map[string]bool{
+	"CanonicalNameservers":    true,
+	"VanityIPs":               true,
+	"ApexRecords":             true,
+	"Hostmaster":              true,
+	"CacheMaxEntries":         true,
+	"CacheMaxBytes":           true,
+	"NegativeCacheMaxEntries": true,
+	"NegativeCacheTTL":        true,
+	"PublicKey":               true,
+	"PrivateKey":              true,
+	"ZonePublicKey":           true,
+	"ZonePrivateKey":          true,
+}
+
+// Reload applies cfg, the configuration as read again, to the running server
+// without closing its sockets. A new backend is created with the options
+// describing the zone apex and the name caches (CanonicalNameservers,
+// VanityIPs, ApexRecords, Hostmaster, CacheMaxEntries, CacheMaxBytes,
+// NegativeCacheMaxEntries and NegativeCacheTTL), the KSK and ZSK files are
+// read again, and both are swapped in at once, so that each query is
+// answered wholly with the old configuration or wholly with the new one. The
+// new backend's name cache starts out empty.
+//
+// Changes to the other options, such as BindAddresses and HTTPListenAddr, are
+// logged and ignored. If the new options or keys can't be loaded, the server
+// carries on as before and the error is returned.
+//
+// Reload is only allowed while the server is running, and not while another
+// reload is in progress; otherwise it returns an error of kind
+// ErrInvalidState.
+func (s *Server) Reload(cfg *Config) error {
+	if _, err := s.lifecycle.transition("reload", stateReloading, nil); err != nil {
+		return err
+	}
+	// Fails if the server was stopped meanwhile, which it may be, and
+	// stays.
+	defer s.lifecycle.transition("finish reloading", stateRunning, nil)
+
+	if _, err := cfg.migrateOptions(); err != nil {
+		return err
+	}
+
+	ncfg := *s.currentConfig()
+	changed := ncfg.applyReloadable(cfg)
+
+	err := ncfg.checkCacheOptions()
+	if err != nil {
+		return err
+	}
+
+	err = ncfg.parseZoneOptions()
+	if err != nil {
+		return err
+	}
+
+	b, err := s.newBackend(&ncfg)
+	if err != nil {
+		return err
+	}
+
+	ks, err := s.loadGlobalKeys(&ncfg)
+	if err != nil {
+		return wrapError(ErrKeyLoad, err)
+	}
+
+	s.stateMu.RLock()
+	oldSuffixKeySets := s.suffixKeySets
+	s.stateMu.RUnlock()
+
+	suffixKeySets, err := s.loadSuffixKeySets(oldSuffixKeySets)
+	if err != nil {
+		return err
+	}
+
+	// Events are published once the lock is released, as subscribers may
+	// need it.
+	var events []interface{}
+	defer func() {
+		for _, ev := range events {
+			s.bus.publish(ev)
+		}
+	}()
+
+	// The mux is built with the lock held, as a ZSK rollover may otherwise
+	// change the keys signing meanwhile.
+	s.stateMu.Lock()
+	defer s.stateMu.Unlock()
+
+	if s.zskRoller != nil {
+		ks = s.zskRoller.keySet(ks, s.zskRoller.clock.Now())
+	}
+
+	mux, err := s.newMux(b, ks, suffixKeySets)
+	if err != nil {
+		return wrapError(ErrBackendInit, err)
+	}
+
+	oldKeys := s.globalKeySet
+	s.backend = b
+	s.mux = mux
+	s.globalKeySet = ks
+	s.suffixKeySets = suffixKeySets
+	s.reloadedCfg = &ncfg
+
+	events = append(events, &configReloaded{Changed: changed})
+	if len(changed) == 0 {
+		changed = []string{"none"}
+	}
+	log.Infof("Reloaded configuration (options changed: %s); the name cache was emptied", strings.Join(changed, ", "))
+	if ks.KSK != nil && (oldKeys.KSK == nil || ks.KSK.KeyTag() != oldKeys.KSK.KeyTag() ||
+		ks.ZSK.KeyTag() != oldKeys.ZSK.KeyTag()) {
+		log.Infof("Now signing with KSK %d and ZSK %d", ks.KSK.KeyTag(), ks.ZSK.KeyTag())
+		events = append(events, &keysReloaded{KSKTag: ks.KSK.KeyTag(), ZSKTag: ks.ZSK.KeyTag()})
+	}
+	return nil
+}
+
+// Sets the options of cfg which Reload applies to their values in ncfg, and
+// returns their names. Other options which differ are logged as needing a
+// restart, without their values, which may be passwords.
+func (cfg *Config) applyReloadable(ncfg *Config) (changed []string) {
+	opts := configOptions()
+	keys := make([]string, 0, len(opts))
+	for key := range opts {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		f := opts[key]
+		old := reflect.ValueOf(cfg).Elem().FieldByIndex(f.Index)
+		v := reflect.ValueOf(ncfg).Elem().FieldByIndex(f.Index)
+		if old.Interface() == v.Interface() {
+			continue
+		}
+
+		if !reloadableOptions[f.Name] {
+			log.Warnf("%s can't be changed without restarting ncdns; keeping its old value", f.Name)
+			continue
+		}
+
+		old.Set(v)
+		changed = append(changed, f.Name)
+	}
+
+	return changed
+}
+
+// Loads the global keys from the files named by cfg. If the ZSK is generated
+// in KeyStateDir, only the KSK is loaded, and the ZSK is added by the caller.
+func (s *Server) loadGlobalKeys(cfg *Config) (*keySet, error) {
+	if s.zskRoller == nil {
+		return s.loadKeySet(cfg.DNSSEC.PublicKey, cfg.DNSSEC.PrivateKey, cfg.DNSSEC.ZonePublicKey, cfg.DNSSEC.ZonePrivateKey)
+	}
+
+	if cfg.DNSSEC.ZonePublicKey != "" {
+		return nil, configError("KeyStateDir can't be used with ZonePublicKey; a ZSK is either managed manually or generated in KeyStateDir")
+	}
+	if cfg.DNSSEC.PublicKey == "" {
+		return nil, configError("KeyStateDir requires PublicKey, as a generated ZSK is only of use under a KSK")
+	}
+
+	ks, err := s.loadKSK(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.EqualFold(dns.Fqdn(ks.KSK.Hdr.Name), s.zskRoller.zone) {
+		return nil, configError("The KSK must be for %s, whose ZSK is generated in KeyStateDir", s.zskRoller.zone)
+	}
+
+	return ks, nil
+}
+
+// Returns the configuration in effect: s.cfg, but for the options changed by
+// a reload.
+func (s *Server) currentConfig() *Config {
+	s.stateMu.RLock()
+	defer s.stateMu.RUnlock()
+
+	if s.reloadedCfg != nil {
+		return s.reloadedCfg
+	}
+	return &s.cfg
+}
+
+// Returns the backend answering queries, which is replaced by a reload.
+func (s *Server) currentBackend() *backend.Backend {
+	s.stateMu.RLock()
+	defer s.stateMu.RUnlock()
+
+	return s.backend
+}
+
+// Returns the mux dispatching queries to the engines, which is replaced by a
+// reload.
+func (s *Server) currentMux() *dns.ServeMux {
+	s.stateMu.RLock()
+	defer s.stateMu.RUnlock()
+
+	return s.mux
+}
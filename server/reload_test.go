@@ -0,0 +1,201 @@
+package server
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func newReloadTestConfig(t *testing.T, dir string) *Config {
+	cfg := newErrorTestConfig(dir)
+	cfg.DNSSEC.PublicKey, cfg.DNSSEC.PrivateKey = writeKeyPair(t, dir, "ksk", dns.ECDSAP256SHA256, 256)
+	cfg.DNSSEC.ZonePublicKey, cfg.DNSSEC.ZonePrivateKey = writeKeyPair(t, dir, "zsk", dns.ECDSAP256SHA256, 256)
+	cfg.Fetcher = "static"
+	cfg.StaticDataDir = "."
+	cfg.ClockSkewPolicy = clockSkewServFail
+	cfg.CanonicalNameservers = "ns1.example.com"
+	return cfg
+}
+
+// Returns the nameservers in the answer to an NS query at the apex.
+func queryApexNS(s *Server) []string {
+	req := new(dns.Msg)
+	req.SetQuestion("bit.", dns.TypeNS)
+	rw := &fakeResponseWriter{addr: &net.UDPAddr{IP: net.ParseIP("192.0.2.100"), Port: 1234}}
+	s.ServeDNS(rw, req)
+	if rw.msg == nil {
+		return nil
+	}
+
+	var nss []string
+	for _, rr := range rw.msg.Answer {
+		if ns, ok := rr.(*dns.NS); ok {
+			nss = append(nss, ns.Ns)
+		}
+	}
+	return nss
+}
+
+func TestReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ncdns-reload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := newReloadTestConfig(t, dir)
+	s, err := newServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	markRunning(s)
+	if nss := queryApexNS(s); len(nss) != 1 || nss[0] != "ns1.example.com." {
+		t.Fatalf("apex NS %v before reloading", nss)
+	}
+	oldZSK := s.globalKeys().ZSK
+
+	ncfg := *cfg
+	ncfg.CanonicalNameservers = "ns1.example.net,ns2.example.net"
+	ncfg.Hostmaster = "hostmaster@example.net"
+	ncfg.DNSSEC.ZonePublicKey, ncfg.DNSSEC.ZonePrivateKey = writeKeyPair(t, dir, "zsk2", dns.ECDSAP256SHA256, 256)
+	ncfg.BindAddresses = "127.0.0.1:5353"
+	ncfg.HTTP.ListenAddr = "127.0.0.1:8080"
+
+	// Queries in flight see the old configuration or the new one, never a
+	// mixture.
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if nss := queryApexNS(s); len(nss) != 1 && len(nss) != 2 {
+					t.Errorf("apex NS %v while reloading", nss)
+					return
+				}
+			}
+		}()
+	}
+
+	err = s.Reload(&ncfg)
+	close(stop)
+	wg.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if nss := queryApexNS(s); len(nss) != 2 || nss[0] != "ns1.example.net." || nss[1] != "ns2.example.net." {
+		t.Errorf("apex NS %v after reloading", nss)
+	}
+	if ks := s.globalKeys(); ks.ZSK == oldZSK || ks.ZSK.KeyTag() == oldZSK.KeyTag() {
+		t.Errorf("ZSK %d wasn't replaced", oldZSK.KeyTag())
+	}
+	if got := s.currentConfig(); got.Hostmaster != ncfg.Hostmaster {
+		t.Errorf("Hostmaster %q after reloading", got.Hostmaster)
+	}
+
+	// Options which can't be changed at runtime stay as they were.
+	if got := s.currentConfig(); got.BindAddresses != cfg.BindAddresses || got.HTTP.ListenAddr != cfg.HTTP.ListenAddr {
+		t.Errorf("BindAddresses %q and HTTPListenAddr %q were changed by a reload", got.BindAddresses, got.HTTP.ListenAddr)
+	}
+	if s.cfg.CanonicalNameservers != cfg.CanonicalNameservers {
+		t.Errorf("the startup configuration was modified")
+	}
+}
+
+func TestReloadFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ncdns-reload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := newReloadTestConfig(t, dir)
+	s, err := newServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	markRunning(s)
+	oldKeys := s.globalKeys()
+
+	tests := []struct {
+		name   string
+		modify func(cfg *Config)
+		kind   error
+	}{
+		{"bad VanityIPs", func(cfg *Config) { cfg.VanityIPs = "192.0.2.1,bogus" }, ErrConfigInvalid},
+		{"bad ApexRecords", func(cfg *Config) { cfg.ApexRecords = "bit. IN CAA nonsense" }, ErrConfigInvalid},
+		{"missing ZSK", func(cfg *Config) { cfg.DNSSEC.ZonePublicKey = "missing.key" }, ErrKeyLoad},
+	}
+
+	for _, test := range tests {
+		ncfg := *cfg
+		ncfg.CanonicalNameservers = "ns1.example.net"
+		test.modify(&ncfg)
+
+		err := s.Reload(&ncfg)
+		if !errors.Is(err, test.kind) {
+			t.Errorf("%s: got error %v, expected one of kind %v", test.name, err, test.kind)
+		}
+		if nss := queryApexNS(s); len(nss) != 1 || nss[0] != "ns1.example.com." {
+			t.Errorf("%s: apex NS %v after a failed reload", test.name, nss)
+		}
+		if s.globalKeys() != oldKeys {
+			t.Errorf("%s: keys replaced by a failed reload", test.name)
+		}
+	}
+}
+
+func TestReloadZSKRollover(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ncdns-reload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := newReloadTestConfig(t, dir)
+	cfg.DNSSEC.ZonePublicKey, cfg.DNSSEC.ZonePrivateKey = "", ""
+	cfg.DNSSEC.KeyStateDir = "keys"
+	cfg.DNSSEC.ZSKLifetime = 7776000
+	cfg.DNSSEC.ZSKPrePublish = 604800
+	s, err := newServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	markRunning(s)
+	old, oldEngine := s.globalKeys(), s.zskRoller.engine
+
+	// The KSK is read again, and the ZSK generated in KeyStateDir kept.
+	ncfg := *cfg
+	ncfg.DNSSEC.PublicKey, ncfg.DNSSEC.PrivateKey = writeKeyPair(t, dir, "ksk2", dns.ECDSAP256SHA256, 256)
+	err = s.Reload(&ncfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ks := s.globalKeys()
+	if ks.KSK.KeyTag() == old.KSK.KeyTag() || ks.ZSK != old.ZSK {
+		t.Errorf("keys KSK %d and ZSK %d after reloading, from KSK %d and ZSK %d",
+			ks.KSK.KeyTag(), ks.ZSK.KeyTag(), old.KSK.KeyTag(), old.ZSK.KeyTag())
+	}
+
+	// Rollovers rebuild the engine now serving.
+	if s.zskRoller.engine == oldEngine {
+		t.Errorf("the ZSK rollover wasn't pointed at the reloaded engine")
+	}
+
+	ncfg.DNSSEC.ZonePublicKey, ncfg.DNSSEC.ZonePrivateKey = writeKeyPair(t, dir, "zsk", dns.ECDSAP256SHA256, 256)
+	if err := s.Reload(&ncfg); !errors.Is(err, ErrConfigInvalid) {
+		t.Errorf("got error %v for a ZSK given with KeyStateDir", err)
+	}
+}
@@ -0,0 +1,591 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/miekg/dns"
+
+	"github.com/namecoin/ncdns/util"
+)
+
+// Assembles a DNS response, enforcing the invariants on its sections which
+// resolvers rely on:
+//
+//   - No RR appears more than once in the message.
+//   - The answer section holds only records owned by the query name or by
+//     names on its CNAME and DNAME chain. Other records (glue, say) are moved
+//     to the additional section.
+//   - The additional section holds only records owned by names referenced by
+//     NS, MX or SRV records in the answer or authority sections, and the OPT
+//     record.
+//   - Each RRSIG immediately follows the RRset it covers, in the same section.
+//     RRSIGs covering no RRset in their section are dropped.
+//   - A negative answer (NXDOMAIN, or NOERROR with no answer which isn't a
+//     referral) has exactly one SOA, in the authority section.
+//   - The response fits in the size the client can receive, dropping records
+//     and setting TC if it doesn't.
+//   - Every record of class IN is owned by a name in the zone asked about:
+//     the .bit zone, under whatever suffix the query name has. Records owned
+//     by names outside it are dropped, whichever feature produced them, so
+//     that no name's value can put records for names outside .bit into a
+//     resolver's cache.
+//
+// Responses breaking the SOA invariant can't be repaired, and fail to build.
+type responseBuilder struct {
+	hdr      dns.MsgHdr
+	question []dns.Question
+	compress bool
+
+	an, ns, ex []dns.RR
+	opt        *dns.OPT
+
+	// Number of records dropped or moved to make the response sound, and
+	// of those, the number dropped as owned by names outside the zone.
+	repaired       int
+	outOfBailiwick int
+}
+
+// Returns a builder for a response with the header and question of m.
+func newResponseBuilder(m *dns.Msg) *responseBuilder {
+	return &responseBuilder{
+		hdr:      m.MsgHdr,
+		question: m.Question,
+		compress: m.Compress,
+	}
+}
+
+// Returns a builder holding the records of m. The builder shares m's answer
+// and authority sections, capped so that adding to them copies.
+func rebuildResponse(m *dns.Msg) *responseBuilder {
+	b := newResponseBuilder(m)
+	b.an = m.Answer[:len(m.Answer):len(m.Answer)]
+	b.ns = m.Ns[:len(m.Ns):len(m.Ns)]
+	b.addAdditional(m.Extra...)
+	return b
+}
+
+func (b *responseBuilder) setRcode(rcode int) {
+	b.hdr.Rcode = rcode
+}
+
+func (b *responseBuilder) addAnswer(rrs ...dns.RR) {
+	b.an = append(b.an, rrs...)
+}
+
+func (b *responseBuilder) addAuthority(rrs ...dns.RR) {
+	b.ns = append(b.ns, rrs...)
+}
+
+// Adds records to the additional section. An OPT record replaces any added
+// before.
+func (b *responseBuilder) addAdditional(rrs ...dns.RR) {
+	for _, rr := range rrs {
+		if opt, ok := rr.(*dns.OPT); ok {
+			b.opt = opt
+			continue
+		}
+		b.ex = append(b.ex, rr)
+	}
+}
+
+// Returns the response, truncated to maxSize bytes if maxSize is non-zero.
+func (b *responseBuilder) build(maxSize int) (*dns.Msg, error) {
+	m := new(dns.Msg)
+	if err := b.buildInto(m, maxSize); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Like build, but builds the response in m, reusing its additional section.
+// The sections of the response may share the slices added to the builder.
+func (b *responseBuilder) buildInto(m *dns.Msg, maxSize int) error {
+	an, ns, ex := b.an, b.ns, b.ex
+	if zone := b.bailiwick(); zone != "" {
+		an = b.inBailiwick(zone, an)
+		ns = b.inBailiwick(zone, ns)
+		ex = b.inBailiwick(zone, ex)
+	}
+
+	an = b.dedup(an)
+	ns = b.dedup(ns, an)
+	ex = b.dedup(ex, an, ns)
+
+	if len(b.question) > 0 {
+		var offChain []dns.RR
+		an, offChain = splitAnswerChain(b.question[0].Name, an)
+		b.repaired += len(offChain)
+		ex = append(offChain, ex...)
+	}
+
+	ex = b.referencedOnly(ex, an, ns)
+
+	if b.isNegative(an, ns) {
+		if n := countType(ns, dns.TypeSOA); n != 1 {
+			return fmt.Errorf("negative response has %d SOA records in the authority section, not one", n)
+		}
+	}
+
+	m.MsgHdr = b.hdr
+	m.Compress = b.compress
+	m.Question = b.question
+	m.Answer = b.groupSignatures(an)
+	m.Ns = b.groupSignatures(ns)
+	m.Extra = append(m.Extra[:0], b.groupSignatures(ex)...)
+	if b.opt != nil {
+		m.Extra = append(m.Extra, b.opt)
+	}
+
+	if maxSize > 0 && m.Len() > maxSize {
+		m.Truncate(maxSize)
+	}
+
+	return nil
+}
+
+// Returns the zone which the response's records must be owned by names in:
+// the .bit zone of the query name, such as bit. or bit.example.com. for a
+// name under bit.example.com. Returns "" if the question isn't for a name in
+// .bit, or is of class CH, whose answers are the server's own.
+func (b *responseBuilder) bailiwick() string {
+	if len(b.question) == 0 || b.question[0].Qclass == dns.ClassCHAOS {
+		return ""
+	}
+	_, _, rootname, err := util.SplitDomainByFloatingAnchor(strings.ToLower(b.question[0].Name), "bit")
+	if err != nil {
+		return ""
+	}
+	return dns.Fqdn(rootname)
+}
+
+// Returns rrs without the records owned by names outside zone. As with
+// dedup, rrs itself is returned if there are none.
+func (b *responseBuilder) inBailiwick(zone string, rrs []dns.RR) []dns.RR {
+	var out []dns.RR // nil until a record outside zone is found
+	for i, rr := range rrs {
+		if dns.IsSubDomain(zone, strings.ToLower(rr.Header().Name)) {
+			if out != nil {
+				out = append(out, rr)
+			}
+			continue
+		}
+
+		b.repaired++
+		b.outOfBailiwick++
+		if b.outOfBailiwick == 1 {
+			log.Warnf("dropping %s %s from the response to %s, as it's outside %s", rr.Header().Name, dns.TypeToString[rr.Header().Rrtype], b.question[0].Name, zone)
+		}
+		if out == nil {
+			out = append(make([]dns.RR, 0, len(rrs)), rrs[:i]...)
+		}
+	}
+
+	if out == nil {
+		return rrs
+	}
+	return out
+}
+
+// Returns rrs without the records which duplicate one before them or one in
+// the earlier sections. rrs itself is returned if there are none, as is
+// usual, so that nothing need be copied.
+func (b *responseBuilder) dedup(rrs []dns.RR, earlier ...[]dns.RR) []dns.RR {
+	var out []dns.RR // nil until a duplicate is found
+	for i, rr := range rrs {
+		before := rrs[:i]
+		if out != nil {
+			before = out
+		}
+
+		dup := containsDuplicate(before, rr)
+		for _, section := range earlier {
+			dup = dup || containsDuplicate(section, rr)
+		}
+
+		if dup {
+			b.repaired++
+			if out == nil {
+				out = append(make([]dns.RR, 0, len(rrs)), rrs[:i]...)
+			}
+			continue
+		}
+		if out != nil {
+			out = append(out, rr)
+		}
+	}
+
+	if out == nil {
+		return rrs
+	}
+	return out
+}
+
+// Whether rrs holds a duplicate of rr, counting RRSIGs by the same key over
+// the same RRset as duplicates even if their signatures differ.
+func containsDuplicate(rrs []dns.RR, rr dns.RR) bool {
+	for _, r := range rrs {
+		if dns.IsDuplicate(r, rr) || sameSignature(r, rr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Splits an answer section into the records on the CNAME and DNAME chain
+// starting at qname, and the rest.
+func splitAnswerChain(qname string, an []dns.RR) (chain, rest []dns.RR) {
+	if ownedBy(an, qname) {
+		// The usual case, with no chain to follow.
+		return an, nil
+	}
+
+	names := map[string]struct{}{strings.ToLower(qname): {}}
+
+	// The chain needn't be in order, so follow it until it stops growing.
+	for grown := true; grown; {
+		grown = false
+		for _, rr := range an {
+			var target string
+			switch rr := rr.(type) {
+			case *dns.CNAME:
+				if _, ok := names[strings.ToLower(rr.Hdr.Name)]; ok {
+					target = rr.Target
+				}
+			case *dns.DNAME:
+				for name := range names {
+					if owner := strings.ToLower(rr.Hdr.Name); name != owner && dns.IsSubDomain(owner, name) {
+						target = strings.TrimSuffix(name, owner) + rr.Target
+						break
+					}
+				}
+			}
+
+			if target == "" {
+				continue
+			}
+			if _, ok := names[strings.ToLower(target)]; !ok {
+				names[strings.ToLower(target)] = struct{}{}
+				grown = true
+			}
+		}
+	}
+
+	for _, rr := range an {
+		if onAnswerChain(rr, names) {
+			chain = append(chain, rr)
+		} else {
+			rest = append(rest, rr)
+		}
+	}
+
+	return
+}
+
+// Whether every record of rrs is owned by name.
+func ownedBy(rrs []dns.RR, name string) bool {
+	for _, rr := range rrs {
+		if !strings.EqualFold(rr.Header().Name, name) {
+			return false
+		}
+	}
+	return true
+}
+
+func onAnswerChain(rr dns.RR, names map[string]struct{}) bool {
+	owner := strings.ToLower(rr.Header().Name)
+	if _, ok := names[owner]; ok {
+		return true
+	}
+
+	// A DNAME is owned by an ancestor of the name it rewrites.
+	rrtype := rr.Header().Rrtype
+	if sig, ok := rr.(*dns.RRSIG); ok {
+		rrtype = sig.TypeCovered
+	}
+	if rrtype == dns.TypeDNAME {
+		for name := range names {
+			if dns.IsSubDomain(owner, name) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Returns the records of ex owned by names referenced by the other sections.
+func (b *responseBuilder) referencedOnly(ex []dns.RR, sections ...[]dns.RR) []dns.RR {
+	if len(ex) == 0 {
+		return ex
+	}
+
+	referenced := map[string]struct{}{}
+	for _, section := range sections {
+		for _, rr := range section {
+			var target string
+			switch rr := rr.(type) {
+			case *dns.NS:
+				target = rr.Ns
+			case *dns.MX:
+				target = rr.Mx
+			case *dns.SRV:
+				target = rr.Target
+			default:
+				continue
+			}
+			referenced[strings.ToLower(target)] = struct{}{}
+		}
+	}
+
+	var out []dns.RR
+	for _, rr := range ex {
+		if _, ok := referenced[strings.ToLower(rr.Header().Name)]; !ok {
+			b.repaired++
+			continue
+		}
+		out = append(out, rr)
+	}
+
+	return out
+}
+
+// Whether the response says that the name or the records asked for don't
+// exist.
+func (b *responseBuilder) isNegative(an, ns []dns.RR) bool {
+	switch b.hdr.Rcode {
+	case dns.RcodeNameError:
+		return true
+	case dns.RcodeSuccess:
+		return len(b.question) > 0 && len(an) == 0 && countType(ns, dns.TypeNS) == 0
+	default:
+		return false
+	}
+}
+
+func countType(rrs []dns.RR, rrtype uint16) int {
+	n := 0
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == rrtype {
+			n++
+		}
+	}
+
+	return n
+}
+
+// Orders a section so that each RRset is followed by the RRSIGs covering it,
+// dropping RRSIGs which cover no RRset in the section. RRsets keep the order
+// in which their first records appear.
+func (b *responseBuilder) groupSignatures(rrs []dns.RR) []dns.RR {
+	if signaturesGrouped(rrs) {
+		return rrs
+	}
+
+	type setKey struct {
+		name   string
+		rrtype uint16
+	}
+
+	var order []setKey
+	sets := map[setKey][]dns.RR{}
+	sigs := map[setKey][]dns.RR{}
+	for _, rr := range rrs {
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			k := setKey{strings.ToLower(sig.Hdr.Name), sig.TypeCovered}
+			sigs[k] = append(sigs[k], rr)
+			continue
+		}
+
+		k := setKey{strings.ToLower(rr.Header().Name), rr.Header().Rrtype}
+		if _, ok := sets[k]; !ok {
+			order = append(order, k)
+		}
+		sets[k] = append(sets[k], rr)
+	}
+
+	out := make([]dns.RR, 0, len(rrs))
+	for _, k := range order {
+		out = append(out, sets[k]...)
+		out = append(out, sigs[k]...)
+		delete(sigs, k)
+	}
+	for _, orphans := range sigs {
+		b.repaired += len(orphans)
+	}
+
+	return out
+}
+
+// Whether rrs is already in the order groupSignatures puts it in, as the
+// engine's responses usually are: each RRset's records together, followed by
+// the RRSIGs covering it.
+func signaturesGrouped(rrs []dns.RR) bool {
+	var cur dns.RR // first record of the current RRset
+	inSigs := false
+	for i, rr := range rrs {
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			if cur == nil || sig.TypeCovered != cur.Header().Rrtype || !strings.EqualFold(sig.Hdr.Name, cur.Header().Name) {
+				return false
+			}
+			inSigs = true
+			continue
+		}
+
+		if cur != nil && !inSigs && sameRRset(rr, cur) {
+			continue
+		}
+
+		// A new RRset, which mustn't have had records earlier.
+		for _, prev := range rrs[:i] {
+			if _, ok := prev.(*dns.RRSIG); !ok && sameRRset(rr, prev) {
+				return false
+			}
+		}
+		cur, inSigs = rr, false
+	}
+
+	return true
+}
+
+func sameRRset(a, b dns.RR) bool {
+	return a.Header().Rrtype == b.Header().Rrtype && strings.EqualFold(a.Header().Name, b.Header().Name)
+}
+
+// Counts of responses which had to be repaired or replaced with SERVFAIL to
+// keep the section invariants, of the records dropped from them as owned by
+// names outside the zone asked about, and of those trimmed or replaced with
+// SERVFAIL as their query's work budget ran out, for /status.
+type responseStatus struct {
+	Repaired            uint64 `json:"repaired"`
+	Rejected            uint64 `json:"rejected"`
+	OutOfBailiwick      uint64 `json:"out_of_bailiwick_records"`
+	WorkBudgetTrimmed   uint64 `json:"work_budget_trimmed"`
+	WorkBudgetExhausted uint64 `json:"work_budget_exhausted"`
+}
+
+// Wraps rw so that every response written to it is passed through a
+// responseBuilder, sized for the transport the query arrived over, and
+// advertises EDNSMaxUDPSize, echoes any EDNS Client Subnet option and carries
+// a server cookie for a client which sent a cookie. This is the last of the
+// writers to see a response, once it's been signed, so that it's truncated and
+// padded as it's sent.
+func (s *Server) sectionWriter(rw dns.ResponseWriter, req *dns.Msg) dns.ResponseWriter {
+	return &sectionWriter{
+		ResponseWriter: rw,
+		s:              s,
+		maxSize:        s.maxResponseSize(rw, req),
+		padding:        s.paddingBlockSize(rw, req),
+		ecs:            s.clientSubnetResponse(req),
+		cookie:         s.cookieResponse(rw, req),
+	}
+}
+
+type sectionWriter struct {
+	dns.ResponseWriter
+	s       *Server
+	maxSize int
+	padding int // block size to pad the response to, or 0
+	ecs     *dns.EDNS0_SUBNET
+	cookie  *dns.EDNS0_COOKIE
+}
+
+// Responses built by sectionWriter, reused once written, since every query
+// needs one. The writers below sectionWriter pack the response before
+// returning, and mustn't keep it.
+var responsePool = sync.Pool{
+	New: func() interface{} { return new(dns.Msg) },
+}
+
+func (rw *sectionWriter) WriteMsg(m *dns.Msg) error {
+	b := rebuildResponse(m)
+	res := responsePool.Get().(*dns.Msg)
+	defer releaseResponse(res)
+
+	if b.opt != nil && (b.opt.UDPSize() != rw.s.ednsUDPSize() || rw.ecs != nil || rw.cookie != nil) {
+		opt := *b.opt
+		opt.SetUDPSize(rw.s.ednsUDPSize())
+		if rw.ecs != nil {
+			opt.Option = withClientSubnet(opt.Option, rw.ecs)
+		}
+		if rw.cookie != nil {
+			opt.Option = withCookie(opt.Option, rw.cookie)
+		}
+		b.opt = &opt
+	}
+
+	err := b.buildInto(res, rw.maxSize)
+	if err != nil {
+		atomic.AddUint64(&rw.s.responsesRejected, 1)
+		log.Errore(err, "answering SERVFAIL instead of an unsound response")
+		return rw.ResponseWriter.WriteMsg(servFailResponse(m))
+	} else if b.repaired > 0 {
+		atomic.AddUint64(&rw.s.responsesRepaired, 1)
+	}
+	if b.outOfBailiwick > 0 {
+		atomic.AddUint64(&rw.s.recordsOutOfBailiwick, uint64(b.outOfBailiwick))
+	}
+
+	if rw.padding > 0 {
+		padResponse(res, rw.padding)
+	}
+
+	return rw.ResponseWriter.WriteMsg(res)
+}
+
+// Returns a response to responsePool, keeping only its additional section's
+// storage, and dropping the records it refers to.
+func releaseResponse(m *dns.Msg) {
+	extra := m.Extra[:cap(m.Extra)]
+	for i := range extra {
+		extra[i] = nil
+	}
+	*m = dns.Msg{Extra: extra[:0]}
+	responsePool.Put(m)
+}
+
+// Returns a SERVFAIL response with the header, question and OPT record of m.
+func servFailResponse(m *dns.Msg) *dns.Msg {
+	b := newResponseBuilder(m)
+	b.setRcode(dns.RcodeServerFailure)
+	b.hdr.AuthenticatedData = false
+	if opt := m.IsEdns0(); opt != nil {
+		b.addAdditional(opt)
+	}
+
+	res, _ := b.build(0) // can't fail: a SERVFAIL isn't negative
+	return res
+}
+
+// Returns the largest response which can be sent to the client: the EDNS
+// buffer size it gives (at least 512 bytes) up to EDNSMaxUDPSize over UDP, or
+// no limit over TCP.
+func (s *Server) maxResponseSize(rw dns.ResponseWriter, req *dns.Msg) int {
+	if _, ok := rw.RemoteAddr().(*net.TCPAddr); ok {
+		return 0
+	}
+
+	size := dns.MinMsgSize
+	if opt := req.IsEdns0(); opt != nil && int(opt.UDPSize()) > size {
+		size = int(opt.UDPSize())
+	}
+	if max := int(s.ednsUDPSize()); size > max {
+		size = max
+	}
+
+	return size
+}
+
+func (s *Server) responseStatus() responseStatus {
+	return responseStatus{
+		Repaired:            atomic.LoadUint64(&s.responsesRepaired),
+		Rejected:            atomic.LoadUint64(&s.responsesRejected),
+		OutOfBailiwick:      atomic.LoadUint64(&s.recordsOutOfBailiwick),
+		WorkBudgetTrimmed:   atomic.LoadUint64(&s.workBudgetTrimmed),
+		WorkBudgetExhausted: atomic.LoadUint64(&s.workBudgetExhausted),
+	}
+}
@@ -0,0 +1,403 @@
+package server
+
+import (
+	"encoding/json"
+	"math/rand"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+
+	"github.com/namecoin/ncdns/backend"
+)
+
+func mustRRs(t *testing.T, lines ...string) []dns.RR {
+	var rrs []dns.RR
+	for _, line := range lines {
+		rr, err := dns.NewRR(line)
+		if err != nil {
+			t.Fatalf("%s: %v", line, err)
+		}
+		rrs = append(rrs, rr)
+	}
+	return rrs
+}
+
+func testReply(qname string, qtype uint16, rcode int) *dns.Msg {
+	req := new(dns.Msg)
+	req.SetQuestion(qname, qtype)
+	m := new(dns.Msg)
+	m.SetRcode(req, rcode)
+	return m
+}
+
+func sectionStrings(rrs []dns.RR) string {
+	var s []string
+	for _, rr := range rrs {
+		h := rr.Header()
+		t := dns.TypeToString[h.Rrtype]
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			t += "/" + dns.TypeToString[sig.TypeCovered]
+		}
+		s = append(s, h.Name+" "+t)
+	}
+	return strings.Join(s, ", ")
+}
+
+func TestResponseBuilder(t *testing.T) {
+	tests := []struct {
+		name       string
+		rcode      int
+		qname      string
+		qtype      uint16
+		an, ns, ex []string
+
+		err                 bool
+		expAn, expNs, expEx string
+		repaired            int
+	}{
+		{
+			name:  "glue in answer",
+			qname: "example.bit.", qtype: dns.TypeA,
+			an: []string{
+				"example.bit. 600 IN A 192.0.2.1",
+				"ns1.example.bit. 600 IN A 192.0.2.53",
+			},
+			ns:       []string{"example.bit. 600 IN NS ns1.example.bit."},
+			expAn:    "example.bit. A",
+			expNs:    "example.bit. NS",
+			expEx:    "ns1.example.bit. A",
+			repaired: 1,
+		},
+		{
+			name:  "records outside .bit",
+			qname: "example.bit.", qtype: dns.TypeA,
+			an: []string{
+				"example.bit. 600 IN A 192.0.2.1",
+				"example.com. 600 IN A 192.0.2.2",
+			},
+			ns: []string{
+				"example.bit. 600 IN NS ns1.example.net.",
+				"com. 600 IN NS ns1.example.net.",
+			},
+			ex:       []string{"ns1.example.net. 600 IN A 192.0.2.53"},
+			expAn:    "example.bit. A",
+			expNs:    "example.bit. NS",
+			repaired: 3,
+		},
+		{
+			name:  "records outside the suffix asked about",
+			qname: "example.bit.example.com.", qtype: dns.TypeA,
+			an: []string{
+				"example.bit.example.com. 600 IN A 192.0.2.1",
+				"example.bit. 600 IN A 192.0.2.2",
+				"example.com. 600 IN A 192.0.2.3",
+			},
+			expAn:    "example.bit.example.com. A",
+			repaired: 2,
+		},
+		{
+			name:  "NXDOMAIN with the SOA of another zone",
+			rcode: dns.RcodeNameError,
+			qname: "missing.bit.", qtype: dns.TypeA,
+			ns:  []string{"com. 600 IN SOA ns.com. hostmaster.com. 1 600 600 7200 600"},
+			err: true,
+		},
+		{
+			name:  "CNAME and DNAME chains stay in answer",
+			qname: "www.a.example.bit.", qtype: dns.TypeA,
+			an: []string{
+				"a.example.bit. 600 IN DNAME b.example.bit.",
+				"www.a.example.bit. 600 IN CNAME www.b.example.bit.",
+				"www.b.example.bit. 600 IN CNAME host.example.bit.",
+				"host.example.bit. 600 IN A 192.0.2.1",
+			},
+			expAn: "a.example.bit. DNAME, www.a.example.bit. CNAME, www.b.example.bit. CNAME, host.example.bit. A",
+		},
+		{
+			name:  "SOA missing from NXDOMAIN",
+			rcode: dns.RcodeNameError,
+			qname: "missing.bit.", qtype: dns.TypeA,
+			err: true,
+		},
+		{
+			name:  "SOA missing from NODATA",
+			qname: "example.bit.", qtype: dns.TypeMX,
+			ns:  []string{"example.bit. 600 IN NSEC zzz.bit. A RRSIG NSEC"},
+			err: true,
+		},
+		{
+			name:  "two SOAs in negative response",
+			rcode: dns.RcodeNameError,
+			qname: "missing.bit.", qtype: dns.TypeA,
+			ns: []string{
+				"bit. 600 IN SOA ns.bit. hostmaster.bit. 1 600 600 7200 600",
+				"bit. 600 IN SOA ns.bit. hostmaster.bit. 2 600 600 7200 600",
+			},
+			err: true,
+		},
+		{
+			name:  "duplicate SOA in negative response",
+			rcode: dns.RcodeNameError,
+			qname: "missing.bit.", qtype: dns.TypeA,
+			ns: []string{
+				"bit. 600 IN SOA ns.bit. hostmaster.bit. 1 600 600 7200 600",
+				"bit. 300 IN SOA ns.bit. hostmaster.bit. 1 600 600 7200 600",
+			},
+			expNs:    "bit. SOA",
+			repaired: 1,
+		},
+		{
+			name:  "referral needs no SOA",
+			qname: "sub.example.bit.", qtype: dns.TypeA,
+			ns:    []string{"sub.example.bit. 600 IN NS ns.sub.example.bit."},
+			ex:    []string{"ns.sub.example.bit. 600 IN A 192.0.2.53"},
+			expNs: "sub.example.bit. NS",
+			expEx: "ns.sub.example.bit. A",
+		},
+		{
+			name:  "duplicate and separated RRSIGs",
+			qname: "example.bit.", qtype: dns.TypeA,
+			an: []string{
+				"example.bit. 600 IN A 192.0.2.1",
+				"example.bit. 600 IN TXT \"hello\"",
+				"example.bit. 600 IN RRSIG A 13 2 600 20300101000000 20200101000000 1234 bit. AAAA",
+				"example.bit. 600 IN A 192.0.2.2",
+				"example.bit. 600 IN RRSIG A 13 2 600 20300101000000 20200101000000 1234 bit. AAAA",
+				"example.bit. 600 IN RRSIG MX 13 2 600 20300101000000 20200101000000 1234 bit. AAAA",
+			},
+			expAn:    "example.bit. A, example.bit. A, example.bit. RRSIG/A, example.bit. TXT",
+			repaired: 2,
+		},
+		{
+			name:  "unreferenced additional records",
+			qname: "example.bit.", qtype: dns.TypeMX,
+			an: []string{"example.bit. 600 IN MX 10 mail.example.bit."},
+			ex: []string{
+				"mail.example.bit. 600 IN A 192.0.2.25",
+				"other.example.bit. 600 IN A 192.0.2.26",
+			},
+			expAn:    "example.bit. MX",
+			expEx:    "mail.example.bit. A",
+			repaired: 1,
+		},
+	}
+
+	for _, test := range tests {
+		m := testReply(test.qname, test.qtype, test.rcode)
+		m.Answer = mustRRs(t, test.an...)
+		m.Ns = mustRRs(t, test.ns...)
+		m.Extra = mustRRs(t, test.ex...)
+
+		b := rebuildResponse(m)
+		res, err := b.build(0)
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: no error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+
+		for _, s := range []struct{ name, got, expected string }{
+			{"answer", sectionStrings(res.Answer), test.expAn},
+			{"authority", sectionStrings(res.Ns), test.expNs},
+			{"additional", sectionStrings(res.Extra), test.expEx},
+		} {
+			if s.got != s.expected {
+				t.Errorf("%s: %s section is [%s], expected [%s]", test.name, s.name, s.got, s.expected)
+			}
+		}
+		if b.repaired != test.repaired {
+			t.Errorf("%s: repaired %d records, expected %d", test.name, b.repaired, test.repaired)
+		}
+	}
+}
+
+func TestSectionWriter(t *testing.T) {
+	s := &Server{}
+	req := new(dns.Msg)
+	req.SetQuestion("example.bit.", dns.TypeTXT)
+
+	// Over UDP without EDNS, the response is truncated to 512 bytes.
+	m := testReply("example.bit.", dns.TypeTXT, dns.RcodeSuccess)
+	for i := 0; i < 20; i++ {
+		m.Answer = append(m.Answer, mustRRs(t, "example.bit. 600 IN TXT \""+strings.Repeat("x", 50)+string(rune('a'+i))+"\"")...)
+	}
+	frw := &fakeResponseWriter{}
+	s.sectionWriter(frw, req).WriteMsg(m)
+	if !frw.msg.Truncated || frw.msg.Len() > dns.MinMsgSize || len(frw.msg.Answer) == 0 {
+		t.Errorf("response of %d bytes not truncated to fit: TC %v, %d answers", frw.msg.Len(), frw.msg.Truncated, len(frw.msg.Answer))
+	}
+
+	// Over TCP, it isn't.
+	frw = &fakeResponseWriter{addr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53}}
+	s.sectionWriter(frw, req).WriteMsg(m)
+	if frw.msg.Truncated || len(frw.msg.Answer) != 20 {
+		t.Errorf("TCP response truncated: TC %v, %d answers", frw.msg.Truncated, len(frw.msg.Answer))
+	}
+
+	// A negative response without an SOA is replaced with SERVFAIL.
+	req.SetEdns0(4096, true)
+	m = testReply("missing.bit.", dns.TypeA, dns.RcodeNameError)
+	m.SetEdns0(4096, true)
+	m.Ns = mustRRs(t, "missing.bit. 600 IN NSEC zzz.bit. A")
+	frw = &fakeResponseWriter{}
+	s.sectionWriter(frw, req).WriteMsg(m)
+	if frw.msg.Rcode != dns.RcodeServerFailure || len(frw.msg.Ns) != 0 || frw.msg.IsEdns0() == nil {
+		t.Errorf("unsound response not replaced: %v", frw.msg)
+	}
+
+	// A repaired response is counted.
+	m = testReply("example.bit.", dns.TypeA, dns.RcodeSuccess)
+	m.Answer = mustRRs(t, "example.bit. 600 IN A 192.0.2.1", "example.bit. 600 IN A 192.0.2.1")
+	s.sectionWriter(&fakeResponseWriter{}, req).WriteMsg(m)
+
+	// As is each record dropped for being outside .bit.
+	m = testReply("example.bit.", dns.TypeA, dns.RcodeSuccess)
+	m.Answer = mustRRs(t, "example.bit. 600 IN A 192.0.2.1", "example.com. 600 IN A 192.0.2.1", "example.net. 600 IN A 192.0.2.1")
+	s.sectionWriter(&fakeResponseWriter{}, req).WriteMsg(m)
+
+	if st := s.responseStatus(); st.Repaired != 2 || st.Rejected != 1 || st.OutOfBailiwick != 2 {
+		t.Errorf("unexpected counts %+v", st)
+	}
+
+	// Answers of class CH are the server's own, outside .bit.
+	req.SetQuestion("version.bind.", dns.TypeTXT)
+	req.Question[0].Qclass = dns.ClassCHAOS
+	m = new(dns.Msg)
+	m.SetReply(req)
+	m.Answer = mustRRs(t, "version.bind. 0 CH TXT \"ncdns\"")
+	frw = &fakeResponseWriter{}
+	s.sectionWriter(frw, req).WriteMsg(m)
+	if len(frw.msg.Answer) != 1 {
+		t.Errorf("CH answer dropped: %v", frw.msg)
+	}
+}
+
+// Absolute names outside .bit, which a name's value might give anywhere a
+// name goes, hoping to have records for them served.
+var externalNames = []string{
+	".",
+	"com.",
+	"example.com.",
+	"www.example.com.",
+	"bit.example.com.",
+	"example.bit.example.com.",
+	"bit.",
+	"other.bit.",
+	"example.bit.",
+	"xn--nmc.example.net.",
+	"_443._tcp.example.com.",
+	"*.example.com.",
+}
+
+// Returns a random value whose fields are filled with names from
+// externalNames, nested in map up to depth levels deep.
+func randomExternalValue(r *rand.Rand, depth int) map[string]interface{} {
+	name := func() string { return externalNames[r.Intn(len(externalNames))] }
+	names := func() []interface{} {
+		var a []interface{}
+		for i := r.Intn(3); i >= 0; i-- {
+			a = append(a, name())
+		}
+		return a
+	}
+
+	fields := []func(v map[string]interface{}){
+		func(v map[string]interface{}) { v["ip"] = []interface{}{"192.0.2.1"} },
+		func(v map[string]interface{}) { v["ip6"] = []interface{}{"2001:db8::1"} },
+		func(v map[string]interface{}) { v["ns"] = names() },
+		func(v map[string]interface{}) { v["dns"] = names() },
+		func(v map[string]interface{}) { v["alias"] = name() },
+		func(v map[string]interface{}) { v["translate"] = name() },
+		func(v map[string]interface{}) { v["email"] = "hostmaster@" + strings.TrimSuffix(name(), ".") },
+		func(v map[string]interface{}) { v["txt"] = name() },
+		func(v map[string]interface{}) { v["mx"] = []interface{}{[]interface{}{10.0, name()}} },
+		func(v map[string]interface{}) {
+			v["srv"] = []interface{}{[]interface{}{10.0, 0.0, 443.0, name()}}
+		},
+		func(v map[string]interface{}) {
+			v["service"] = []interface{}{[]interface{}{"https", "tcp", 10.0, 0.0, 443.0, name()}}
+		},
+		func(v map[string]interface{}) {
+			v["ds"] = []interface{}{[]interface{}{12345.0, 8.0, 2.0, "dGVzdA=="}}
+		},
+		func(v map[string]interface{}) { v["redirect"] = "https://" + name() },
+	}
+	if depth > 0 {
+		fields = append(fields, func(v map[string]interface{}) {
+			m := map[string]interface{}{}
+			for i := r.Intn(3); i >= 0; i-- {
+				m[name()] = randomExternalValue(r, depth-1)
+			}
+			m["*"] = randomExternalValue(r, depth-1)
+			m["www"] = randomExternalValue(r, depth-1)
+			v["map"] = m
+		})
+	}
+
+	v := map[string]interface{}{}
+	for i := r.Intn(5); i >= 0; i-- {
+		fields[r.Intn(len(fields))](v)
+	}
+	return v
+}
+
+// Whatever a name's value says, every record of a response is owned by a name
+// in the .bit zone asked about.
+func TestResponseBailiwickFuzz(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	qtypes := []uint16{
+		dns.TypeA, dns.TypeAAAA, dns.TypeNS, dns.TypeCNAME, dns.TypeDNAME, dns.TypeMX,
+		dns.TypeSRV, dns.TypeTXT, dns.TypeDS, dns.TypeSOA, dns.TypeTLSA, dns.TypeANY,
+	}
+
+	answered := 0
+	for i := 0; i < 200; i++ {
+		value, err := json.Marshal(randomExternalValue(r, 2))
+		if err != nil {
+			t.Fatal(err)
+		}
+		be, err := backend.New(&backend.Config{
+			CacheMaxEntries: 100,
+			FakeNames:       map[string]string{"d/example": string(value)},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := &Server{backend: be, mux: dns.NewServeMux(), ednsStats: newEDNSStats(nil)}
+		s.mux.Handle(".", &testSigningEngine{b: be, ks: &keySet{}})
+
+		for _, zone := range []string{"bit.", "bit.example.com."} {
+			for _, sub := range []string{"", "www.", "*.", "_443._tcp.", "example.com.", "bit."} {
+				qname := sub + "example." + zone
+				for _, qtype := range qtypes {
+					req := new(dns.Msg)
+					req.SetQuestion(qname, qtype)
+					rw := &fakeResponseWriter{}
+					s.ServeDNS(rw, req)
+					if rw.msg == nil {
+						t.Fatalf("%s: no response to %s %s", value, qname, dns.TypeToString[qtype])
+					}
+
+					answered += len(rw.msg.Answer) + len(rw.msg.Ns) + len(rw.msg.Extra)
+					for _, rr := range append(append(rw.msg.Answer, rw.msg.Ns...), rw.msg.Extra...) {
+						if rr.Header().Rrtype != dns.TypeOPT && !dns.IsSubDomain(zone, strings.ToLower(rr.Header().Name)) {
+							t.Errorf("%s: response to %s %s has a record outside %s: %v", value, qname, dns.TypeToString[qtype], zone, rr)
+						}
+					}
+				}
+			}
+		}
+	}
+
+	// Make sure the values gave records to check.
+	if answered == 0 {
+		t.Error("no records answered")
+	}
+}
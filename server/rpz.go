@@ -0,0 +1,293 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	madns "gopkg.in/hlandau/madns.v2"
+	"gopkg.in/hlandau/madns.v2/merr"
+
+	"github.com/namecoin/ncdns/clock"
+	"github.com/namecoin/ncdns/util"
+)
+
+// How often the RPZ file is checked for changes.
+const rpzPollInterval = 10 * time.Second
+
+// The actions a response policy zone rule can take. See
+// https://tools.ietf.org/html/draft-vixie-dnsop-dns-rpz.
+type rpzAction int
+
+const (
+	rpzNXDOMAIN  rpzAction = iota // CNAME .
+	rpzNODATA                     // CNAME *.
+	rpzPassthru                   // CNAME rpz-passthru.
+	rpzLocalData                  // any other records
+)
+
+type rpzRule struct {
+	action rpzAction
+	data   []dns.RR // for rpzLocalData, with owner names to be replaced
+}
+
+// A parsed response policy zone. Only QNAME triggers are supported.
+type rpzZone struct {
+	origin string
+
+	// Rules for exact owner names, keyed by trigger name (e.g. "bad.bit.").
+	exact map[string]*rpzRule
+
+	// Rules for wildcard owner names, keyed by the name under the wildcard
+	// (e.g. "bad.bit." for "*.bad.bit"). These match subdomains only.
+	wildcard map[string]*rpzRule
+}
+
+// Labels which mark triggers other than QNAME triggers, which aren't
+// supported.
+var rpzUnsupportedTriggers = []string{"rpz-ip", "rpz-nsdname", "rpz-nsip", "rpz-client-ip"}
+
+// Parses a response policy zone in zone file format. The zone's origin is
+// taken from its SOA record.
+func parseRPZ(r io.Reader, filename string) (*rpzZone, error) {
+	z := &rpzZone{
+		exact:    map[string]*rpzRule{},
+		wildcard: map[string]*rpzRule{},
+	}
+
+	var rrs []dns.RR
+	zp := dns.NewZoneParser(r, "", filename)
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		if soa, ok := rr.(*dns.SOA); ok && z.origin == "" {
+			z.origin = strings.ToLower(soa.Hdr.Name)
+			continue
+		}
+		rrs = append(rrs, rr)
+	}
+	if err := zp.Err(); err != nil {
+		return nil, err
+	}
+	if z.origin == "" {
+		return nil, fmt.Errorf("RPZ file %s has no SOA record", filename)
+	}
+
+	for _, rr := range rrs {
+		if err := z.add(rr); err != nil {
+			log.Warnf("ignoring RPZ record %v: %v", rr, err)
+		}
+	}
+
+	return z, nil
+}
+
+func (z *rpzZone) add(rr dns.RR) error {
+	owner := strings.ToLower(rr.Header().Name)
+	if owner == z.origin {
+		// NS records and the like at the apex aren't rules.
+		return nil
+	}
+	trigger, ok := util.TrimZone(owner, z.origin)
+	if !ok {
+		return fmt.Errorf("not in zone %s", z.origin)
+	}
+
+	trigger = dns.Fqdn(trigger)
+	for _, label := range dns.SplitDomainName(trigger) {
+		for _, t := range rpzUnsupportedTriggers {
+			if label == t {
+				return fmt.Errorf("only QNAME triggers are supported")
+			}
+		}
+	}
+
+	rules := z.exact
+	if strings.HasPrefix(trigger, "*.") {
+		rules = z.wildcard
+		trigger = trigger[2:]
+	}
+	if trigger == "" {
+		trigger = "."
+	}
+
+	rule, err := rpzRuleFor(rr)
+	if err != nil {
+		return err
+	}
+
+	existing := rules[trigger]
+	switch {
+	case existing == nil:
+		rules[trigger] = rule
+	case existing.action == rpzLocalData && rule.action == rpzLocalData:
+		existing.data = append(existing.data, rule.data...)
+	default:
+		return fmt.Errorf("conflicts with another rule for the same name")
+	}
+
+	return nil
+}
+
+func rpzRuleFor(rr dns.RR) (*rpzRule, error) {
+	if cname, ok := rr.(*dns.CNAME); ok {
+		switch strings.ToLower(cname.Target) {
+		case ".":
+			return &rpzRule{action: rpzNXDOMAIN}, nil
+		case "*.":
+			return &rpzRule{action: rpzNODATA}, nil
+		case "rpz-passthru.":
+			return &rpzRule{action: rpzPassthru}, nil
+		}
+		if strings.HasPrefix(cname.Target, "*.") || strings.HasPrefix(strings.ToLower(cname.Target), "rpz-") {
+			return nil, fmt.Errorf("unsupported action %s", cname.Target)
+		}
+	}
+
+	return &rpzRule{action: rpzLocalData, data: []dns.RR{rr}}, nil
+}
+
+// Returns the rule applying to qname, or nil if there is none. Exact rules
+// take precedence over wildcards, and more specific wildcards over less
+// specific ones.
+func (z *rpzZone) match(qname string) *rpzRule {
+	qname = dns.Fqdn(strings.ToLower(qname))
+	if rule, ok := z.exact[qname]; ok {
+		return rule
+	}
+
+	for off, end := dns.NextLabel(qname, 0); ; off, end = dns.NextLabel(qname, off) {
+		parent := "."
+		if !end {
+			parent = qname[off:]
+		}
+		if rule, ok := z.wildcard[parent]; ok {
+			return rule
+		}
+		if end {
+			break
+		}
+	}
+
+	return nil
+}
+
+// A response policy zone loaded from a file, which is reloaded when the file
+// changes.
+type rpzPolicy struct {
+	filename string
+	clock    clock.Clock
+
+	mu      sync.RWMutex
+	zone    *rpzZone
+	modTime time.Time
+	size    int64
+}
+
+func newRPZPolicy(filename string, clk clock.Clock) (*rpzPolicy, error) {
+	p := &rpzPolicy{filename: filename, clock: clock.Or(clk)}
+	if _, err := p.reload(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Loads the file if it has changed since it was last loaded. If the file
+// can't be parsed, the rules previously loaded stay in force.
+func (p *rpzPolicy) reload() (changed bool, err error) {
+	fi, err := os.Stat(p.filename)
+	if err != nil {
+		return false, err
+	}
+
+	p.mu.RLock()
+	unchanged := p.zone != nil && fi.ModTime().Equal(p.modTime) && fi.Size() == p.size
+	p.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	f, err := os.Open(p.filename)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	z, err := parseRPZ(f, p.filename)
+	if err != nil {
+		return false, err
+	}
+
+	p.mu.Lock()
+	p.zone = z
+	p.modTime = fi.ModTime()
+	p.size = fi.Size()
+	p.mu.Unlock()
+
+	log.Info("loaded RPZ ", p.filename, " (", len(z.exact)+len(z.wildcard), " rules)")
+	return true, nil
+}
+
+func (p *rpzPolicy) run() {
+	for {
+		<-p.clock.NewTimer(rpzPollInterval).C()
+		_, err := p.reload()
+		log.Warne(err, "couldn't reload RPZ ", p.filename)
+	}
+}
+
+func (p *rpzPolicy) match(qname string) *rpzRule {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return p.zone.match(qname)
+}
+
+// Applies a response policy zone to the records synthesized by a backend.
+// The engine signs whatever this returns, so rewritten answers are signed as
+// usual.
+type rpzBackend struct {
+	b      madns.Backend
+	policy *rpzPolicy
+}
+
+var _ madns.Backend = &rpzBackend{}
+
+func (rb *rpzBackend) Lookup(qname, streamIsolationID string) ([]dns.RR, error) {
+	rule := rb.policy.match(qname)
+	if rule == nil || rule.action == rpzPassthru {
+		return rb.b.Lookup(qname, streamIsolationID)
+	}
+
+	switch rule.action {
+	case rpzNXDOMAIN:
+		return nil, merr.ErrNoSuchDomain
+	case rpzNODATA:
+		return nil, nil
+	}
+
+	rrs := make([]dns.RR, 0, len(rule.data))
+	for _, rr := range rule.data {
+		rr = dns.Copy(rr)
+		rr.Header().Name = qname
+		rrs = append(rrs, rr)
+	}
+	return rrs, nil
+}
+
+// Wraps b so that addresses found to be down by health checks are omitted
+// from its answers, and then the response policy zone is applied, where these
+// are configured.
+func (s *Server) policyBackend(b madns.Backend) madns.Backend {
+	if s.healthChecker != nil {
+		b = &healthBackend{b: b, checker: s.healthChecker}
+	}
+
+	if s.rpz != nil {
+		b = &rpzBackend{b: b, policy: s.rpz}
+	}
+
+	return b
+}
@@ -0,0 +1,167 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"gopkg.in/hlandau/madns.v2/merr"
+
+	"github.com/namecoin/ncdns/backend"
+)
+
+const testRPZ = `$ORIGIN rpz.example.
+$TTL 300
+@                 SOA   ns.example. hostmaster.example. 1 3600 600 86400 60
+                  NS    ns.example.
+
+; actions
+blocked.bit       CNAME .
+*.blocked.bit     CNAME .
+nodata.bit        CNAME *.
+rewritten.bit     A     192.0.2.100
+                  TXT   "rewritten by policy"
+alias.bit         CNAME example.bit.
+
+; an exact rule overrides a wildcard, and a more specific wildcard a less
+; specific one
+*.wild.bit        CNAME .
+ok.wild.bit       CNAME rpz-passthru.
+*.sub.wild.bit    CNAME rpz-passthru.
+
+; unsupported triggers are ignored
+32.1.2.0.192.rpz-ip CNAME .
+`
+
+func writeRPZ(t *testing.T, dir, contents string) string {
+	fn := filepath.Join(dir, "rpz.zone")
+	if err := ioutil.WriteFile(fn, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return fn
+}
+
+func newRPZTestBackend(t *testing.T, policy *rpzPolicy) *rpzBackend {
+	names := map[string]string{}
+	for _, name := range []string{"example", "blocked", "nodata", "rewritten", "alias", "wild"} {
+		names["d/"+name] = `{"ip":["192.0.2.1"],"map":{"*":{"ip":["192.0.2.2"],"map":{"*":{"ip":["192.0.2.2"]}}}}}`
+	}
+
+	b, err := backend.New(&backend.Config{
+		CacheMaxEntries: 100,
+		FakeNames:       names,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &rpzBackend{b: b, policy: policy}
+}
+
+func TestRPZActions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ncdns-rpz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	policy, err := newRPZPolicy(writeRPZ(t, dir, testRPZ), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rb := newRPZTestBackend(t, policy)
+
+	tests := []struct {
+		qname    string
+		expected string // records joined with "|", or the error
+	}{
+		{"example.bit.", "example.bit.\t600\tIN\tA\t192.0.2.1"},
+		{"blocked.bit.", "No such domain"},
+		{"www.blocked.bit.", "No such domain"},
+		{"nodata.bit.", ""},
+		{"www.nodata.bit.", "www.nodata.bit.\t600\tIN\tA\t192.0.2.2"},
+		{"rewritten.bit.", "rewritten.bit.\t300\tIN\tA\t192.0.2.100|rewritten.bit.\t300\tIN\tTXT\t\"rewritten by policy\""},
+		{"Rewritten.BIT.", "Rewritten.BIT.\t300\tIN\tA\t192.0.2.100|Rewritten.BIT.\t300\tIN\tTXT\t\"rewritten by policy\""},
+		{"alias.bit.", "alias.bit.\t300\tIN\tCNAME\texample.bit."},
+		{"wild.bit.", "wild.bit.\t600\tIN\tA\t192.0.2.1"},
+		{"www.wild.bit.", "No such domain"},
+		{"ok.wild.bit.", "ok.wild.bit.\t600\tIN\tA\t192.0.2.2"},
+		{"a.sub.wild.bit.", "a.sub.wild.bit.\t600\tIN\tA\t192.0.2.2"},
+	}
+
+	for _, test := range tests {
+		rrs, err := rb.Lookup(test.qname, "")
+		got := ""
+		if err != nil {
+			got = err.Error()
+		} else {
+			var ss []string
+			for _, rr := range rrs {
+				if rr.Header().Rrtype != dns.TypeNS {
+					ss = append(ss, rr.String())
+				}
+			}
+			got = strings.Join(ss, "|")
+		}
+		if got != test.expected {
+			t.Errorf("%s: got %q, expected %q", test.qname, got, test.expected)
+		}
+	}
+
+	if _, err := rb.Lookup("blocked.bit.", ""); err != merr.ErrNoSuchDomain {
+		t.Errorf("NXDOMAIN rule returned %v", err)
+	}
+	if len(policy.zone.exact)+len(policy.zone.wildcard) != 8 {
+		t.Errorf("unexpected rules %+v %+v", policy.zone.exact, policy.zone.wildcard)
+	}
+}
+
+func TestRPZReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ncdns-rpz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fn := writeRPZ(t, dir, testRPZ)
+	policy, err := newRPZPolicy(fn, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rb := newRPZTestBackend(t, policy)
+
+	if changed, err := policy.reload(); changed || err != nil {
+		t.Errorf("unchanged file reloaded: %v, %v", changed, err)
+	}
+
+	// Lift the block on blocked.bit. The modification time is moved on
+	// explicitly since the filesystem's resolution may be coarse.
+	writeRPZ(t, dir, strings.Replace(testRPZ, "blocked.bit       CNAME .", "", 1))
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(fn, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if changed, err := policy.reload(); !changed || err != nil {
+		t.Fatalf("changed file not reloaded: %v, %v", changed, err)
+	}
+	if _, err := rb.Lookup("blocked.bit.", ""); err != nil {
+		t.Errorf("removed rule still applied: %v", err)
+	}
+
+	// A broken file leaves the rules in force.
+	writeRPZ(t, dir, "this is not a zone file\n")
+	later = later.Add(time.Minute)
+	if err := os.Chtimes(fn, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := policy.reload(); err == nil {
+		t.Errorf("broken file loaded")
+	}
+	if _, err := rb.Lookup("www.blocked.bit.", ""); err != merr.ErrNoSuchDomain {
+		t.Errorf("rules lost after failed reload: %v", err)
+	}
+}
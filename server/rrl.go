@@ -0,0 +1,252 @@
+package server
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/namecoin/ncdns/clock"
+)
+
+// Responses are limited per client prefix rather than per address, since a
+// spoofed victim is usually a network rather than one host.
+const (
+	rrlPrefixBitsIPv4 = 24
+	rrlPrefixBitsIPv6 = 56
+)
+
+// The most response accounts tracked. When there's no room for another, those
+// which have recovered their full allowance are forgotten; if none have, the
+// response is sent without being limited, so that a flood of queries under
+// many names can't exhaust memory.
+const rrlMaxAccounts = 100000
+
+// How often the numbers of responses dropped and slipped are logged, if any
+// were.
+const rrlReportInterval = time.Minute
+
+// What becomes of a response under response rate limiting.
+type rrlAction int
+
+const (
+	rrlSend rrlAction = iota // within the limit
+	rrlDrop                  // over the limit; not sent
+	rrlSlip                  // over the limit; sent truncated, so that a genuine client retries over TCP
+)
+
+// Identifies the responses counted together: those with the same answer to
+// the same client network.
+type rrlKey struct {
+	prefix string
+	qname  string
+	qtype  uint16
+	rcode  int
+}
+
+type rrlAccount struct {
+	balance float64 // responses which may be sent now; negative once over the limit
+	last    time.Time
+	slip    int // responses over the limit since the last slipped
+}
+
+// Response Rate Limiting: a token bucket for each rrlKey, refilled at rate
+// responses per second up to a burst of a second's worth. Each response
+// takes a token; once they run out, responses are dropped, except that every
+// slip'th is sent truncated instead. The balance can fall as far as window
+// seconds' worth below zero, so a client which keeps sending must slow down
+// for up to window seconds before it's answered again.
+//
+// Only responses over UDP are limited, since the source address of a query
+// over TCP can't be spoofed to make ncdns reflect responses at a victim.
+type rrl struct {
+	rate   float64
+	window time.Duration
+	slip   int
+	clock  clock.Clock
+
+	mu       sync.Mutex
+	accounts map[rrlKey]*rrlAccount
+
+	dropped uint64 // accessed atomically
+	slipped uint64 // accessed atomically
+}
+
+type rrlStatus struct {
+	Dropped uint64 `json:"dropped"`
+	Slipped uint64 `json:"slipped"`
+}
+
+func newRRL(rate int, window time.Duration, slip int, clk clock.Clock) *rrl {
+	return &rrl{
+		rate:     float64(rate),
+		window:   window,
+		slip:     slip,
+		clock:    clock.Or(clk),
+		accounts: make(map[rrlKey]*rrlAccount),
+	}
+}
+
+// Returns the prefix under which responses to ip are limited, e.g.
+// 192.0.2.0/24, or "" if it isn't an IP address.
+func rrlPrefix(ip net.IP) string {
+	bits, size := rrlPrefixBitsIPv6, net.IPv6len*8
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, bits, size = ip4, rrlPrefixBitsIPv4, net.IPv4len*8
+	} else if len(ip) != net.IPv6len {
+		return ""
+	}
+
+	n := &net.IPNet{IP: ip.Mask(net.CIDRMask(bits, size)), Mask: net.CIDRMask(bits, size)}
+	return n.String()
+}
+
+// Counts a response to the client at ip, returning what to do with it.
+func (l *rrl) account(ip net.IP, qname string, qtype uint16, rcode int) rrlAction {
+	prefix := rrlPrefix(ip)
+	if prefix == "" {
+		return rrlSend
+	}
+
+	k := rrlKey{prefix: prefix, qname: strings.ToLower(qname), qtype: qtype, rcode: rcode}
+	now := l.clock.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	a, ok := l.accounts[k]
+	if !ok {
+		if len(l.accounts) >= rrlMaxAccounts {
+			l.evict(now)
+		}
+		if len(l.accounts) >= rrlMaxAccounts {
+			return rrlSend
+		}
+
+		a = &rrlAccount{balance: l.rate, last: now}
+		l.accounts[k] = a
+	}
+
+	a.balance = l.refill(a, now)
+	a.last = now
+	a.balance--
+	if min := -l.rate * l.window.Seconds(); a.balance < min {
+		a.balance = min
+	}
+	if a.balance >= 0 {
+		a.slip = 0
+		return rrlSend
+	}
+
+	a.slip++
+	if l.slip > 0 && a.slip >= l.slip {
+		a.slip = 0
+		atomic.AddUint64(&l.slipped, 1)
+		return rrlSlip
+	}
+
+	atomic.AddUint64(&l.dropped, 1)
+	return rrlDrop
+}
+
+// Returns the balance of a at now.
+func (l *rrl) refill(a *rrlAccount, now time.Time) float64 {
+	balance := a.balance
+	if elapsed := now.Sub(a.last); elapsed > 0 {
+		balance += elapsed.Seconds() * l.rate
+	}
+	if balance > l.rate {
+		balance = l.rate
+	}
+	return balance
+}
+
+// Forgets the accounts which have recovered their full allowance, as they'd
+// be created afresh. Called with mu held.
+func (l *rrl) evict(now time.Time) {
+	for k, a := range l.accounts {
+		if l.refill(a, now) >= l.rate {
+			delete(l.accounts, k)
+		}
+	}
+}
+
+func (l *rrl) Status() rrlStatus {
+	return rrlStatus{
+		Dropped: atomic.LoadUint64(&l.dropped),
+		Slipped: atomic.LoadUint64(&l.slipped),
+	}
+}
+
+// Logs the numbers of responses dropped and slipped in each interval, if
+// there were any.
+func (l *rrl) run(interval time.Duration) {
+	last := l.Status()
+	for {
+		<-l.clock.NewTimer(interval).C()
+
+		cur := l.Status()
+		if dropped, slipped := cur.Dropped-last.Dropped, cur.Slipped-last.Slipped; dropped > 0 || slipped > 0 {
+			log.Warnf("response rate limiting over the last %v: dropped %d responses and sent %d truncated", interval, dropped, slipped)
+		}
+		last = cur
+
+		l.mu.Lock()
+		l.evict(l.clock.Now())
+		l.mu.Unlock()
+	}
+}
+
+// Wraps rw so that responses over UDP are rate limited, but for those to
+// queries with a valid DNS cookie, whose source addresses can't be spoofed.
+func (s *Server) rrlWriter(rw dns.ResponseWriter, req *dns.Msg) dns.ResponseWriter {
+	if s.rrl == nil || len(req.Question) == 0 {
+		return rw
+	}
+	if _, ok := rw.RemoteAddr().(*net.UDPAddr); !ok {
+		return rw
+	}
+	if s.hasValidCookie(rw, req) {
+		return rw
+	}
+
+	return &rrlWriter{ResponseWriter: rw, l: s.rrl}
+}
+
+type rrlWriter struct {
+	dns.ResponseWriter
+	l *rrl
+}
+
+func (rw *rrlWriter) WriteMsg(m *dns.Msg) error {
+	if len(m.Question) == 0 {
+		return rw.ResponseWriter.WriteMsg(m)
+	}
+
+	q := m.Question[0]
+	switch rw.l.account(clientIP(rw), q.Name, q.Qtype, m.Rcode) {
+	case rrlDrop:
+		return nil
+	case rrlSlip:
+		return rw.ResponseWriter.WriteMsg(truncatedResponse(m))
+	default:
+		return rw.ResponseWriter.WriteMsg(m)
+	}
+}
+
+// Returns an empty response in place of m with TC set, which a genuine client
+// retries over TCP.
+func truncatedResponse(m *dns.Msg) *dns.Msg {
+	tc := new(dns.Msg)
+	tc.MsgHdr = m.MsgHdr
+	tc.Truncated = true
+	tc.AuthenticatedData = false
+	tc.Question = m.Question
+	if opt := m.IsEdns0(); opt != nil {
+		tc.Extra = []dns.RR{opt}
+	}
+	return tc
+}
@@ -0,0 +1,128 @@
+package server
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/namecoin/ncdns/testutil"
+)
+
+func TestRRLPrefix(t *testing.T) {
+	for _, test := range []struct {
+		ip, prefix string
+	}{
+		{"192.0.2.123", "192.0.2.0/24"},
+		{"::ffff:192.0.2.123", "192.0.2.0/24"},
+		{"2001:db8:1234:5678::1", "2001:db8:1234:5600::/56"},
+	} {
+		if p := rrlPrefix(net.ParseIP(test.ip)); p != test.prefix {
+			t.Errorf("%s: got prefix %q, expected %q", test.ip, p, test.prefix)
+		}
+	}
+}
+
+func TestRRLLimit(t *testing.T) {
+	clock := testutil.NewFakeClock(time.Unix(1700000000, 0))
+	l := newRRL(2, 5*time.Second, 2, clock)
+	victim := net.ParseIP("192.0.2.1")
+
+	account := func(ip net.IP) rrlAction {
+		return l.account(ip, "Example.bit.", dns.TypeANY, dns.RcodeSuccess)
+	}
+
+	// A second's worth of responses is sent, then every other one is
+	// slipped and the rest dropped.
+	for i, expected := range []rrlAction{rrlSend, rrlSend, rrlDrop, rrlSlip, rrlDrop, rrlSlip} {
+		if a := account(victim); a != expected {
+			t.Errorf("response %d: got action %d, expected %d", i, a, expected)
+		}
+	}
+	if st := l.Status(); st.Dropped != 2 || st.Slipped != 2 {
+		t.Errorf("unexpected counts %+v", st)
+	}
+
+	// The rest of the victim's network shares its limit, but other
+	// networks, names, types and response codes don't.
+	if a := account(net.ParseIP("192.0.2.200")); a == rrlSend {
+		t.Errorf("response to the same /24 sent")
+	}
+	if a := account(net.ParseIP("192.0.3.1")); a != rrlSend {
+		t.Errorf("response to another network limited")
+	}
+	if a := l.account(victim, "other.bit.", dns.TypeANY, dns.RcodeSuccess); a != rrlSend {
+		t.Errorf("response for another name limited")
+	}
+	if a := l.account(victim, "example.bit.", dns.TypeA, dns.RcodeSuccess); a != rrlSend {
+		t.Errorf("response for another type limited")
+	}
+	if a := l.account(victim, "example.bit.", dns.TypeANY, dns.RcodeNameError); a != rrlSend {
+		t.Errorf("response with another response code limited")
+	}
+	if a := l.account(victim, "example.bit.", dns.TypeANY, dns.RcodeSuccess); a == rrlSend {
+		t.Errorf("names differing in case counted apart")
+	}
+
+	// A network which keeps sending owes up to the window's worth of
+	// responses, and is answered again only once it has slowed down for
+	// that long.
+	for i := 0; i < 100; i++ {
+		account(victim)
+	}
+	clock.Advance(5 * time.Second)
+	if a := account(victim); a == rrlSend {
+		t.Errorf("response sent before the window had passed")
+	}
+	clock.Advance(6 * time.Second)
+	if a := account(victim); a != rrlSend {
+		t.Errorf("response not sent after the window had passed")
+	}
+}
+
+func TestRRLNoSlip(t *testing.T) {
+	l := newRRL(1, time.Second, 0, testutil.NewFakeClock(time.Unix(1700000000, 0)))
+	ip := net.ParseIP("2001:db8::1")
+
+	l.account(ip, "example.bit.", dns.TypeA, dns.RcodeSuccess)
+	for i := 0; i < 10; i++ {
+		if a := l.account(ip, "example.bit.", dns.TypeA, dns.RcodeSuccess); a != rrlDrop {
+			t.Fatalf("response %d over the limit: got action %d, expected drop", i, a)
+		}
+	}
+}
+
+func TestRRLWriter(t *testing.T) {
+	s := &Server{rrl: newRRL(1, time.Second, 1, testutil.NewFakeClock(time.Unix(1700000000, 0)))}
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.bit.", dns.TypeA)
+	req.SetEdns0(4096, true)
+	res := new(dns.Msg)
+	res.SetReply(req)
+	a, _ := dns.NewRR("example.bit. 600 IN A 192.0.2.1")
+	res.Answer = []dns.RR{a}
+	res.SetEdns0(4096, true)
+
+	// Over UDP, the second response is over the limit and slipped.
+	frw := &fakeResponseWriter{}
+	s.rrlWriter(frw, req).WriteMsg(res)
+	if frw.msg == nil || frw.msg.Truncated {
+		t.Fatalf("first response not sent in full: %v", frw.msg)
+	}
+	frw = &fakeResponseWriter{}
+	s.rrlWriter(frw, req).WriteMsg(res)
+	if frw.msg == nil || !frw.msg.Truncated || len(frw.msg.Answer) != 0 || frw.msg.IsEdns0() == nil {
+		t.Errorf("expected empty truncated response, got %v", frw.msg)
+	}
+
+	// Over TCP, nothing is limited.
+	for i := 0; i < 10; i++ {
+		frw = &fakeResponseWriter{addr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53}}
+		s.rrlWriter(frw, req).WriteMsg(res)
+		if frw.msg == nil || frw.msg.Truncated {
+			t.Fatalf("response over TCP limited: %v", frw.msg)
+		}
+	}
+}
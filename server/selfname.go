@@ -0,0 +1,297 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+	"gopkg.in/hlandau/madns.v2/merr"
+
+	"github.com/namecoin/ncdns/backend"
+	"github.com/namecoin/ncdns/clock"
+	"github.com/namecoin/ncdns/namecoin"
+	"github.com/namecoin/ncdns/util"
+)
+
+// The number of labels tried in one check for a pseudo-hostname whose
+// Namecoin name isn't registered, when AvoidSelfNameCollision moves it.
+const maxMetaLabelAttempts = 16
+
+type selfNameStatus struct {
+	// The label of the meta domain the pseudo-hostname is generated under,
+	// e.g. x--nmc, and the pseudo-hostname, if it's served.
+	MetaLabel      string `json:"meta_label"`
+	PseudoHostname string `json:"pseudo_hostname,omitempty"`
+
+	// The Namecoin names found registered at the last check, whose records
+	// are shadowed by this nameserver's own.
+	Collisions  []string   `json:"collisions"`
+	LastChecked *time.Time `json:"last_checked,omitempty"`
+	Error       string     `json:"error,omitempty"`
+}
+
+// Periodically checks whether the Namecoin names corresponding to this
+// nameserver's own names, SelfName if it's under the suffix and the
+// pseudo-hostname, have been registered. The address records ncdns serves for
+// its own names shadow the owner's records, so a collision is reported, and
+// with AvoidSelfNameCollision the pseudo-hostname is moved under another
+// label. The labels are tried in a fixed order, and the one chosen is kept in
+// PseudoHostnameFile, so that the pseudo-hostname is stable across restarts.
+type selfNameChecker struct {
+	selfName string      // the Namecoin name of SelfName, e.g. d/ns1, or ""
+	pseudo   func() bool // whether the pseudo-hostname is served
+	suffix   string
+	avoid    bool
+	file     string
+	interval time.Duration
+	clock    clock.Clock
+
+	// Returns the current state of a name.
+	nameData func(name string) (*namecoin.NameData, error)
+
+	// Reports a collision found, to the problems streamed as events.
+	problem func(name, problem string)
+
+	label atomic.Value // string: the label of the meta domain
+
+	mu       sync.Mutex
+	status   selfNameStatus
+	reported map[string]bool // the collisions already reported
+}
+
+// Sets up the check of this nameserver's own names, and loads the label of
+// the pseudo-hostname kept in PseudoHostnameFile. Called before the backend,
+// which takes the label from it, is created.
+func (s *Server) setupSelfNameCheck() error {
+	if s.cfg.SelfNameCheckInterval < 0 {
+		return configError("SelfNameCheckInterval must not be negative")
+	}
+	if s.cfg.PseudoHostnameFile != "" && !s.cfg.AvoidSelfNameCollision {
+		return configError("PseudoHostnameFile requires AvoidSelfNameCollision")
+	}
+
+	c := &selfNameChecker{
+		suffix:   dns.Fqdn(strings.ToLower(s.cfg.CanonicalSuffix)),
+		avoid:    s.cfg.AvoidSelfNameCollision,
+		interval: time.Duration(s.cfg.SelfNameCheckInterval) * time.Second,
+		pseudo: func() bool {
+			return s.cfg.SelfName == "" && len(s.currentConfig().canonicalNameservers) == 0
+		},
+		nameData: func(name string) (*namecoin.NameData, error) {
+			return s.currentBackend().NameData(context.Background(), name, "")
+		},
+		problem: func(name, problem string) {
+			s.bus.publish(&valueProblem{Name: name, Problem: problem, Warning: true})
+		},
+		reported: map[string]bool{},
+		clock:    clock.Or(s.clock),
+	}
+	// SelfName shadows a name only if it's under the suffix, as the backend
+	// serves it.
+	_, basename, _, err := util.SplitDomainByFloatingAnchor(strings.ToLower(s.cfg.SelfName), "bit")
+	if err == nil && basename != "" {
+		c.selfName, _ = util.BasenameToNamecoinKey(basename)
+	}
+	c.label.Store(backend.DefaultMetaLabel)
+
+	if s.cfg.PseudoHostnameFile != "" {
+		c.file = s.cfg.cpath(s.cfg.PseudoHostnameFile)
+		b, err := ioutil.ReadFile(c.file)
+		switch {
+		case os.IsNotExist(err):
+		case err != nil:
+			return fmt.Errorf("couldn't read PseudoHostnameFile: %v", err)
+		default:
+			label := strings.TrimSpace(string(b))
+			if !validMetaLabel(label) {
+				return fmt.Errorf("PseudoHostnameFile %s holds %q, which isn't a label for the pseudo-hostname", c.file, label)
+			}
+			c.label.Store(label)
+		}
+	}
+
+	c.status.MetaLabel = c.metaLabel()
+	c.status.Collisions = []string{}
+	s.selfNames = c
+	return nil
+}
+
+// Returns the label of the meta domain the pseudo-hostname is generated
+// under, for the backend.
+func (s *Server) metaLabel() string {
+	if s.selfNames == nil {
+		return backend.DefaultMetaLabel
+	}
+	return s.selfNames.metaLabel()
+}
+
+func (c *selfNameChecker) metaLabel() string {
+	return c.label.Load().(string)
+}
+
+// Returns true if label can name the meta domain: a hostname label which, like
+// x--nmc, isn't a valid Namecoin domain name, so that no value is served
+// under it.
+func validMetaLabel(label string) bool {
+	return util.ValidateHostLabel(label) && !util.ValidateDomainLabel(label)
+}
+
+// Returns the label tried after label for the meta domain: x--nmc1 after
+// x--nmc, then x--nmc2 and so on.
+func nextMetaLabel(label string) string {
+	n, err := strconv.Atoi(strings.TrimPrefix(label, backend.DefaultMetaLabel))
+	if !strings.HasPrefix(label, backend.DefaultMetaLabel) || err != nil {
+		n = 0
+	}
+	return backend.DefaultMetaLabel + strconv.Itoa(n+1)
+}
+
+func (c *selfNameChecker) run(done <-chan struct{}) {
+	for {
+		c.check()
+		if c.interval == 0 {
+			return
+		}
+		select {
+		case <-c.clock.NewTimer(c.interval).C():
+		case <-done:
+			return
+		}
+	}
+}
+
+// Checks the Namecoin names of this nameserver's own names, moving the
+// pseudo-hostname if it collides and AvoidSelfNameCollision is set, and
+// updates the status.
+func (c *selfNameChecker) check() {
+	var collisions []string
+	var errs []string
+	if c.selfName != "" {
+		registered, err := c.registered(c.selfName)
+		if err != nil {
+			errs = append(errs, err.Error())
+		} else if registered {
+			collisions = append(collisions, c.selfName)
+		}
+	}
+
+	pseudo := c.pseudo()
+	if pseudo {
+		label := c.metaLabel()
+		for i := 0; i < maxMetaLabelAttempts; i++ {
+			registered, err := c.registered("d/" + label)
+			if err != nil {
+				errs = append(errs, err.Error())
+				break
+			}
+			if !registered {
+				if label != c.metaLabel() {
+					c.moveMetaLabel(label)
+				}
+				break
+			}
+			collisions = append(collisions, "d/"+label)
+			if !c.avoid {
+				break
+			}
+			label = nextMetaLabel(label)
+		}
+	}
+
+	now := c.clock.Now().UTC()
+	c.mu.Lock()
+	c.status.MetaLabel = c.metaLabel()
+	c.status.PseudoHostname = ""
+	if pseudo {
+		c.status.PseudoHostname = "this." + c.status.MetaLabel + "." + c.suffix
+	}
+	c.status.Collisions = append([]string{}, collisions...)
+	c.status.LastChecked = &now
+	c.status.Error = strings.Join(errs, "; ")
+
+	var found []string
+	current := map[string]bool{}
+	for _, name := range collisions {
+		current[name] = true
+		if !c.reported[name] {
+			found = append(found, name)
+		}
+	}
+	for name := range c.reported {
+		if !current[name] && len(errs) == 0 {
+			delete(c.reported, name)
+			log.Infof("The Namecoin name %s no longer collides with this nameserver's own names", name)
+		}
+	}
+	for _, name := range found {
+		c.reported[name] = true
+	}
+	c.mu.Unlock()
+
+	for _, name := range found {
+		problem := c.collision(name)
+		log.Errorf("%s", problem)
+		if c.problem != nil {
+			c.problem(name, problem)
+		}
+	}
+	for _, err := range errs {
+		log.Warnf("couldn't check whether this nameserver's own names are registered in Namecoin: %s", err)
+	}
+}
+
+// Describes the collision of the Namecoin name name with this nameserver's
+// own names.
+func (c *selfNameChecker) collision(name string) string {
+	if name == c.selfName {
+		return fmt.Sprintf("The Namecoin name %s is registered, but its records are shadowed by SelfName; choose a SelfName whose Namecoin name isn't registered", name)
+	}
+	if !c.avoid {
+		return fmt.Sprintf("The Namecoin name %s is registered, but its records are shadowed by the pseudo-hostname; set AvoidSelfNameCollision to move it", name)
+	}
+	return fmt.Sprintf("The Namecoin name %s is registered, so the pseudo-hostname is moved from under it", name)
+}
+
+// Returns true if the Namecoin name name is registered and hasn't expired.
+func (c *selfNameChecker) registered(name string) (bool, error) {
+	nd, err := c.nameData(name)
+	if errors.Is(err, merr.ErrNoSuchDomain) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("%s: %v", name, err)
+	}
+	return !nd.Expired, nil
+}
+
+// Generates the pseudo-hostname under label from now on, and keeps it in
+// PseudoHostnameFile for later starts.
+func (c *selfNameChecker) moveMetaLabel(label string) {
+	old := c.metaLabel()
+	c.label.Store(label)
+	log.Warnf("The pseudo-hostname is now generated under %s rather than %s", label, old)
+
+	if c.file == "" {
+		log.Warnf("PseudoHostnameFile isn't set, so the pseudo-hostname will be moved again at the next start")
+		return
+	}
+	err := ioutil.WriteFile(c.file, []byte(label+"\n"), 0644)
+	log.Errore(err, "couldn't write PseudoHostnameFile")
+}
+
+func (c *selfNameChecker) Status() selfNameStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	st := c.status
+	st.Collisions = append([]string{}, st.Collisions...)
+	return st
+}
@@ -0,0 +1,147 @@
+package server
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestNextMetaLabel(t *testing.T) {
+	label := "x--nmc"
+	for _, expected := range []string{"x--nmc1", "x--nmc2", "x--nmc3"} {
+		if label = nextMetaLabel(label); label != expected || !validMetaLabel(label) {
+			t.Errorf("got %q, expected %q", label, expected)
+		}
+	}
+	if label := nextMetaLabel("x--other"); label != "x--nmc1" {
+		t.Errorf("after a label of another form: got %q", label)
+	}
+	for _, label := range []string{"example", "xn--mnchen-3ya", "x--nmc.bit", ""} {
+		if validMetaLabel(label) {
+			t.Errorf("%q: valid as a meta label", label)
+		}
+	}
+}
+
+// Names registered mid-run which this nameserver's own names shadow are
+// reported, and the pseudo-hostname is moved from under them, to a label
+// which is kept across restarts.
+func TestSelfNameCollision(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ncdns-selfname")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	chain := &fakeChainRPC{height: 100, values: map[string]string{}}
+	rpcSrv := httptest.NewServer(chain)
+	defer rpcSrv.Close()
+
+	cfg := newErrorTestConfig(dir)
+	cfg.RPC.Endpoints = strings.TrimPrefix(rpcSrv.URL, "http://")
+	cfg.RPC.Username = "user"
+	cfg.RPC.Password = "pass"
+	cfg.RPC.Timeout = 1500
+	cfg.SelfIP = "192.0.2.53"
+	cfg.AvoidSelfNameCollision = true
+	cfg.PseudoHostnameFile = "pseudo-hostname"
+
+	newTestServer := func() (*Server, func() []string) {
+		s, err := New(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var mu sync.Mutex
+		var problems []string
+		s.bus.subscribe("test", func(ev interface{}) {
+			if p, ok := ev.(*valueProblem); ok && p.Warning {
+				mu.Lock()
+				defer mu.Unlock()
+				problems = append(problems, p.Name)
+			}
+		})
+		return s, func() []string {
+			mu.Lock()
+			defer mu.Unlock()
+			return append([]string(nil), problems...)
+		}
+	}
+
+	s, problems := newTestServer()
+	defer s.stop()
+	s.selfNames.check()
+	if nss := queryApexNS(s); !reflect.DeepEqual(nss, []string{"this.x--nmc.bit."}) {
+		t.Errorf("got nameservers %v", nss)
+	}
+	if st := s.selfNames.Status(); len(st.Collisions) != 0 || st.Error != "" || st.PseudoHostname != "this.x--nmc.bit." {
+		t.Errorf("got status %+v before any collision", st)
+	}
+
+	// The Namecoin name of the pseudo-hostname is registered.
+	chain.advance(map[string]string{"d/x--nmc": `{"ip":"192.0.2.1"}`})
+	s.selfNames.check()
+	if nss := queryApexNS(s); !reflect.DeepEqual(nss, []string{"this.x--nmc1.bit."}) {
+		t.Errorf("got nameservers %v after a collision", nss)
+	}
+	req := new(dns.Msg)
+	req.SetQuestion("this.x--nmc1.bit.", dns.TypeA)
+	res, err := s.Query(context.Background(), req, nil)
+	if err != nil || len(res.Answer) != 1 || res.Answer[0].(*dns.A).A.String() != "192.0.2.53" {
+		t.Errorf("pseudo-hostname moved: got %v, %v", res, err)
+	}
+	if st := s.selfNames.Status(); !reflect.DeepEqual(st.Collisions, []string{"d/x--nmc"}) || st.MetaLabel != "x--nmc1" {
+		t.Errorf("got status %+v after a collision", st)
+	}
+	if p := problems(); !reflect.DeepEqual(p, []string{"d/x--nmc"}) {
+		t.Errorf("got problems %v", p)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(dir, "pseudo-hostname"))
+	if err != nil || string(b) != "x--nmc1\n" {
+		t.Errorf("got PseudoHostnameFile %q, %v", b, err)
+	}
+
+	// A collision is reported once, for as long as it lasts.
+	s.selfNames.check()
+	if p := problems(); len(p) != 1 {
+		t.Errorf("got problems %v after checking again", p)
+	}
+
+	// After a restart, the pseudo-hostname stays where it was moved, even
+	// once the name it collided with is gone.
+	s2, _ := newTestServer()
+	defer s2.stop()
+	if nss := queryApexNS(s2); !reflect.DeepEqual(nss, []string{"this.x--nmc1.bit."}) {
+		t.Errorf("got nameservers %v after a restart", nss)
+	}
+	chain.advance(map[string]string{"d/x--nmc": ""})
+	s2.selfNames.check()
+	if nss := queryApexNS(s2); !reflect.DeepEqual(nss, []string{"this.x--nmc1.bit."}) {
+		t.Errorf("got nameservers %v once the collision is gone", nss)
+	}
+
+	// A colliding SelfName is only reported.
+	cfg.SelfName = "ns1.bit."
+	cfg.AvoidSelfNameCollision = false
+	cfg.PseudoHostnameFile = ""
+	s3, problems := newTestServer()
+	defer s3.stop()
+	chain.advance(map[string]string{"d/ns1": `{"ip":"192.0.2.1"}`})
+	s3.selfNames.check()
+	if nss := queryApexNS(s3); !reflect.DeepEqual(nss, []string{"ns1.bit."}) {
+		t.Errorf("got nameservers %v with a colliding SelfName", nss)
+	}
+	if st := s3.selfNames.Status(); !reflect.DeepEqual(st.Collisions, []string{"d/ns1"}) || st.PseudoHostname != "" {
+		t.Errorf("got status %+v with a colliding SelfName", st)
+	}
+	if p := problems(); !reflect.DeepEqual(p, []string{"d/ns1"}) {
+		t.Errorf("got problems %v with a colliding SelfName", p)
+	}
+}
@@ -0,0 +1,139 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/namecoin/ncdns/backend"
+)
+
+// Measures the whole path of a query through ServeDNS, from admission to the
+// response being written, for a name already in the backend's cache.
+func BenchmarkServeDNS(b *testing.B) {
+	be, err := backend.New(&backend.Config{
+		CacheMaxEntries: 100,
+		FakeNames: map[string]string{
+			"d/example": `{"ip":["192.0.2.1","192.0.2.2"],"ip6":["2001:db8::1"]}`,
+		},
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	s := &Server{
+		backend:      be,
+		globalKeySet: &keySet{},
+		clientStats:  newClientStats(10000, time.Minute, 0, 0, nil),
+	}
+	s.mux, err = s.newMux(be, s.globalKeySet, nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.bit.", dns.TypeA)
+	req.SetEdns0(4096, true)
+	frw := &fakeResponseWriter{addr: &net.UDPAddr{IP: net.ParseIP("192.0.2.100"), Port: 1234}}
+
+	s.ServeDNS(frw, req) // fill the cache
+	if frw.msg == nil || len(frw.msg.Answer) == 0 {
+		b.Fatalf("unexpected response %v", frw.msg)
+	}
+
+	// Unlike fakeResponseWriter, which copies it, discard the response, so as
+	// to count only the allocations made in serving it.
+	rw := &discardResponseWriter{frw}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s.ServeDNS(rw, req)
+	}
+}
+
+type discardResponseWriter struct {
+	*fakeResponseWriter
+}
+
+func (rw *discardResponseWriter) WriteMsg(m *dns.Msg) error {
+	return nil
+}
+
+// Nothing about a response is shared between queries for the same name which
+// differ in their DO bit, EDNS buffer size or transport: each client gets the
+// variant it asked for, whatever the queries before it asked for.
+func TestResponseVariants(t *testing.T) {
+	var ips []string
+	for i := 1; i <= 28; i++ {
+		ips = append(ips, fmt.Sprintf(`"192.0.2.%d"`, i))
+	}
+	be, err := backend.New(&backend.Config{
+		CacheMaxEntries: 100,
+		FakeNames: map[string]string{
+			"d/example": `{"ip":[` + strings.Join(ips, ",") + `]}`,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ks, err := generateKeySet("bit.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := newEngine(be, ks)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Server{backend: be, globalKeySet: ks, mux: dns.NewServeMux()}
+	s.mux.Handle(".", e)
+
+	udp := &net.UDPAddr{IP: net.ParseIP("192.0.2.100"), Port: 1234}
+	tcp := &net.TCPAddr{IP: net.ParseIP("192.0.2.100"), Port: 1234}
+	query := func(do bool, size uint16, addr net.Addr) *dns.Msg {
+		req := new(dns.Msg)
+		req.SetQuestion("example.bit.", dns.TypeA)
+		req.SetEdns0(size, do)
+		frw := &fakeResponseWriter{addr: addr}
+		s.ServeDNS(frw, req)
+		if frw.msg == nil {
+			t.Fatalf("no response to query with DO %v, size %d over %v", do, size, addr)
+		}
+		return frw.msg
+	}
+	signed := func(m *dns.Msg) bool {
+		return countType(m.Answer, dns.TypeRRSIG) > 0
+	}
+
+	for i := 0; i < 2; i++ {
+		full := query(true, 4096, udp)
+		if full.Truncated || !signed(full) || countType(full.Answer, dns.TypeA) != len(ips) {
+			t.Fatalf("expected full signed answer, got %v", full)
+		}
+		if full.Len() <= 512 {
+			t.Fatalf("signed answer of %d bytes is too small to test truncation", full.Len())
+		}
+
+		if m := query(false, 512, udp); m.Truncated || signed(m) || countType(m.Answer, dns.TypeA) != len(ips) || m.Len() > 512 {
+			t.Errorf("DO=0 with 512 bytes: expected full unsigned answer, got %v", m)
+		}
+		if m := query(true, 512, udp); !m.Truncated || m.Len() > 512 {
+			t.Errorf("DO=1 with 512 bytes: expected truncated answer, got %v", m)
+		}
+		if m := query(false, 4096, udp); m.Truncated || signed(m) {
+			t.Errorf("DO=0 with 4096 bytes: expected full unsigned answer, got %v", m)
+		}
+		if m := query(true, 512, tcp); m.Truncated || !signed(m) {
+			t.Errorf("DO=1 over TCP: expected full signed answer, got %v", m)
+		}
+		if m := query(false, 512, tcp); m.Truncated || signed(m) {
+			t.Errorf("DO=0 over TCP: expected full unsigned answer, got %v", m)
+		}
+	}
+}
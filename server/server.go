@@ -1,13 +1,19 @@
 package server
 
 import (
+	"bytes"
+	"context"
 	"crypto"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"io/ioutil"
 	"net"
-	"os"
 	"path/filepath"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/btcsuite/btcd/rpcclient"
 	"github.com/hlandau/buildinfo"
@@ -16,42 +22,305 @@ import (
 	madns "gopkg.in/hlandau/madns.v2"
 
 	"github.com/namecoin/ncdns/backend"
+	"github.com/namecoin/ncdns/clock"
 	"github.com/namecoin/ncdns/namecoin"
+	"github.com/namecoin/ncdns/ncdomain"
+	"github.com/namecoin/ncdns/ncdumpzone"
+	"github.com/namecoin/ncdns/resolver"
+	"github.com/namecoin/ncdns/tracing"
 )
 
 var log, Log = xlog.New("ncdns.server")
 
 type Server struct {
+	// Number of DNS queries being answered. Accessed atomically, so kept
+	// first for alignment.
+	inflight int64
+
+	// Responses repaired or rejected by sectionWriter, and records it
+	// dropped as outside the zone asked about. Accessed atomically.
+	responsesRepaired     uint64
+	responsesRejected     uint64
+	recordsOutOfBailiwick uint64
+
+	// Queries whose answer was trimmed, or which were answered SERVFAIL, as
+	// their work budget ran out. Accessed atomically.
+	workBudgetTrimmed   uint64
+	workBudgetExhausted uint64
+
 	cfg Config
 
-	engine       madns.Engine
+	// Tells the time for the signatures, caches, rate limits and key
+	// rollovers. If nil, as in some tests, the system clock is used.
+	clock clock.Clock
+
 	namecoinConn *namecoin.Client
+	network      *namecoin.Network
+	nodeChain    atomic.Value // string: the chain namecoind reported being on
+	httpBreaker  *circuitBreaker
+	bus          *eventBus
+	busMetrics   *busMetrics
+	events       *eventHub // nil if HTTPEvents isn't set
+	blockWatcher *blockWatcher
+
+	cachePersister *cachePersister // nil if CachePersistPath isn't set
+
+	// The state replaced by Reload, and by ZSK rollovers for the global
+	// keys. Each query is answered by the mux in effect when it arrived.
+	stateMu       sync.RWMutex
+	backend       *backend.Backend   // guarded by stateMu
+	mux           *dns.ServeMux      // guarded by stateMu
+	globalKeySet  *keySet            // guarded by stateMu
+	suffixKeySets map[string]*keySet // guarded by stateMu
+	reloadedCfg   *Config            // guarded by stateMu; nil until reloaded
+	deprecated    []deprecatedOption // set in the configuration at startup
+	zskRoller     *zskRoller
+
+	// The DNS listeners, which the watchdog may replace once the server has
+	// started.
+	listenersMu  sync.RWMutex
+	udpConns     []*net.UDPConn // guarded by listenersMu
+	tcpListeners []net.Listener // guarded by listenersMu
+	tlsListeners []net.Listener // for DNS over TLS
+	certReloader *certReloader  // nil if TLSBind or TLSCert isn't set
+	acme         *acmeCerts     // nil if ACMEHostnames isn't set
+	dnsServers   []*dns.Server  // guarded by listenersMu
+	wgStart      sync.WaitGroup
+	web          *webServer // nil if HTTPListenAddr isn't set
+
+	outbound        *resolver.Resolver
+	parentChecker   *parentChecker
+	peerChecker     *peerChecker // nil if PeerServers isn't set
+	watchdog        *watchdog    // nil if WatchdogInterval is 0
+	rpz             *rpzPolicy
+	healthChecker   *healthChecker
+	sigMonitor      *sigMonitor
+	sigGuard        *sigGuard
+	clientStats     *clientStats
+	rrl             *rrl             // nil if RRLRatePerSecond is 0
+	cookies         *cookies         // nil if CookieSecretLifetime is 0
+	apiLookupLimit  *rrl             // nil if HTTPLookupRatePerSecond is 0
+	servfailAlerter *servfailAlerter // nil if ServfailAlertRatio is 0
+	trustSetup      *trustSetup      // nil unless SetupMode
+	selfNames       *selfNameChecker
+	memoryWatcher   *memoryWatcher
+	metaQueries     metaQueryCounts
+	unsolicited     unsolicitedMessages
+	queryMetrics    *queryMetrics
+	ednsStats       *ednsStats
+	zoneWalkPacer   *ncdumpzone.Pacer
+	xfer            *zoneTransfers // nil if zone transfers aren't enabled
+	notifier        *notifier      // nil if NotifyTargets isn't set
+	queryLog        *queryLog      // nil if QueryLogPath isn't set
+	queryACL        *queryACL      // nil if AllowQueriesFrom and DenyQueriesFrom aren't set
+	outOfZone       *outOfZone     // nil until set up by newServer
+	chaos           *chaosHandler  // nil until set up by newServer
+	urlIncluder     *urlIncluder   // nil if AllowURLIncludes isn't set
+	dnssecStrip     *dnssecStrip   // nil if StripDNSSECForClients isn't set
+	runAs           *runAsUser     // nil if RunAsUser isn't set
+	tcpConns        tcpConnLimit
 
-	mux         *dns.ServeMux
-	udpServer   *dns.Server
-	udpConn     *net.UDPConn
-	tcpServer   *dns.Server
-	tcpListener net.Listener
-	wgStart     sync.WaitGroup
+	dsExportMu sync.Mutex
+	dsExported bool // guarded by dsExportMu; set once DSRecordsFile is written
+
+	// Unix time in nanoseconds at which Start was called, or 0. Accessed
+	// atomically.
+	startedAt int64
+
+	lifecycle lifecycle
+	stopOnce  sync.Once
+	stopErr   error
+
+	// Cancelled as the server stops, ending work done on its behalf, such as
+	// event streams. Nil, as is cancel, in some tests.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// The steps by which stop stops the components set up.
+	shutdown shutdownSequence
 }
 
 type Config struct {
-	Bind           string `default:":53" usage:"Address to bind to (e.g. 0.0.0.0:53)"`
-	PublicKey      string `default:"" usage:"Path to the DNSKEY KSK public key file"`
-	PrivateKey     string `default:"" usage:"Path to the KSK's corresponding private key file"`
-	ZonePublicKey  string `default:"" usage:"Path to the DNSKEY ZSK public key file; if one is not specified, a temporary one is generated on startup and used only for the duration of that process"`
-	ZonePrivateKey string `default:"" usage:"Path to the ZSK's corresponding private key file"`
-
-	NamecoinRPCUsername   string `default:"" usage:"Namecoin RPC username"`
-	NamecoinRPCPassword   string `default:"" usage:"Namecoin RPC password"`
-	NamecoinRPCAddress    string `default:"127.0.0.1:8336" usage:"Namecoin RPC server address"`
-	NamecoinRPCCookiePath string `default:"" usage:"Namecoin RPC cookie path (used if password is unspecified)"`
-	NamecoinRPCTimeout    int    `default:"1500" usage:"Timeout (in milliseconds) for Namecoin RPC requests"`
-	CacheMaxEntries       int    `default:"100" usage:"Maximum name cache entries"`
-	SelfName              string `default:"" usage:"The FQDN of this nameserver. If empty, a pseudo-hostname is generated."`
-	SelfIP                string `default:"127.127.127.127" usage:"The canonical IP address for this service"`
-
-	HTTPListenAddr string `default:"" usage:"Address for webserver to listen at (default: disabled)"`
+	BindAddresses string `default:":53" usage:"Comma-separated list of addresses to bind to (e.g. 0.0.0.0:53), each listened on for UDP and TCP unless prefixed udp:// or tcp://"`
+	Bind          string `default:"" usage:"Deprecated: use BindAddresses"`
+
+	// Options grouped in sections of their own in the configuration file,
+	// which can also be given by their flat names, as before there were
+	// sections; see configOptions.
+	DNSSEC DNSSECConfig `section:"dnssec"`
+	RPC    RPCConfig    `section:"rpc"`
+	HTTP   HTTPConfig   `section:"http"`
+	Cache  CacheConfig  `section:"cache"`
+
+	suffixKeys []suffixKeySpec // parsed from DNSSEC.SuffixKeys
+
+	UnsignedNames string `default:"" usage:"Comma-separated list of names (e.g. example.bit) served without DNSSEC signatures, along with everything below them, for names whose records are too large or change too often to sign; each is published as an insecure delegation to ncdns itself, so validating resolvers accept its records without being able to authenticate them"`
+	unsignedNames []string
+
+	RunAsUser string `default:"" usage:"User (a name or numeric ID, optionally followed by :group) to switch to for good once the listeners are created and the keys loaded, when started as root; ncdns refuses to start if it can't (default: don't switch)"`
+
+	TLSBind               string `default:"" usage:"Address to listen for DNS over TLS at (e.g. :853; default: disabled)"`
+	TLSCert               string `default:"" usage:"Path to the PEM certificate chain served for DNS over TLS"`
+	TLSKey                string `default:"" usage:"Path to the PEM private key of TLSCert"`
+	TLSCertReloadInterval int    `default:"3600" usage:"Time (in seconds) between checks of TLSCert and TLSKey for changes, e.g. a renewed certificate, which is then used for new connections (0: never)"`
+
+	ACMEHostnames    string `default:"" usage:"Comma-separated list of the public hostnames (not .bit names) of the server for which certificates for DNS over TLS are obtained and renewed from an ACME CA, agreeing to its terms of service; TLSCert and TLSKey, if set, are served until they're obtained, or if they can't be (default: disabled)"`
+	ACMECacheDir     string `default:"" usage:"Directory in which the ACME account key and the certificates of ACMEHostnames are kept"`
+	ACMEEmail        string `default:"" usage:"Contact address given to the ACME CA, e.g. for notices of certificates about to expire (default: none)"`
+	ACMEDirectoryURL string `default:"https://acme-v02.api.letsencrypt.org/directory" usage:"Directory URL of the ACME CA from which certificates for ACMEHostnames are obtained"`
+
+	TCPReadTimeout    int `default:"2000" usage:"Time (in milliseconds) a client has to send its first query after connecting over TCP or TLS, and to send the rest of any query once it's begun, before its connection is closed"`
+	TCPIdleTimeout    int `default:"10000" usage:"Time (in milliseconds) for which a TCP or TLS connection may wait between queries before it's closed; connections sending queries one after another are kept open"`
+	TCPMaxConnections int `default:"1000" usage:"Maximum number of TCP and TLS connections open at once; those beyond are closed as soon as they're accepted (0: no limit)"`
+
+	UDPReceiveBufferBytes int `default:"4194304" usage:"Size (in bytes) of the receive buffer of each UDP socket, which holds queries arriving faster than they are answered; the OS may cap it, e.g. at the net.core.rmem_max sysctl on Linux (0: the OS default)"`
+
+	WatchdogInterval         int  `default:"0" usage:"Time (in seconds) between the watchdog's probes of each UDP and TCP listener, sent over loopback (0: no watchdog)"`
+	WatchdogFailureThreshold int  `default:"3" usage:"Number of the watchdog's probes a listener must fail in a row to be restarted"`
+	WatchdogExitOnFailure    bool `default:"false" usage:"Exit if the watchdog can't restart a listener, for the service manager to restart ncdns"`
+
+	Fetcher        string `default:"namecoind" usage:"Source of name values: namecoind, static to read JSON files from StaticDataDir, or fixture to read them all from FixtureFile"`
+	StaticDataDir  string `default:"" usage:"Directory containing name values for the static fetcher, e.g. the value of d/example in d/example.json"`
+	FixtureFile    string `default:"" usage:"JSON file containing name values for the fixture fetcher, an object mapping each name (e.g. d/example) to its value"`
+	RPCRecordDir   string `default:"" usage:"Directory in which the name_show calls fetching the names matching RPCRecordNames are recorded, without credentials, to be replayed with the doctor's -replay-dir, e.g. to reproduce a bug offline"`
+	RPCRecordNames string `default:"" usage:"Comma-separated list of the names (e.g. d/example) whose name_show calls are recorded in RPCRecordDir, each of which may be a pattern (e.g. d/*)"`
+	fetcher        backend.Fetcher
+
+	MemoryWarnBytes      int    `default:"0" usage:"Memory use (in bytes), as reported by the Go runtime, above which a warning is logged, and a heap profile written to HeapProfileDir, at most once an hour (0: disabled)"`
+	HeapProfileDir       string `default:"" usage:"Directory in which a heap profile is written whenever memory use exceeds MemoryWarnBytes, to be read with go tool pprof (default: only warn)"`
+	RPZFile              string `default:"" usage:"Path to a response policy zone file whose QNAME rules override the answers for names, reloaded when it changes (default: none)"`
+	ImportNamespaces     string `default:"d,dd" usage:"Comma-separated list of Namecoin namespaces whose names may be referenced by import and delegate statements"`
+	importNamespaces     []string
+	DehydratedTLSA       string `default:"3 0 0" usage:"Usage, selector and matching type of the TLSA records generated from dehydrated certificates, e.g. \"3 1 1\" for the SHA-256 hash of the public key (default: the whole certificate)"`
+	generatedTLSA        *ncdomain.TLSAForm
+	LegacyFieldSupport   bool   `default:"true" usage:"Translate fields of the original domain name specification found in old values (e.g. service, for SRV records) into their modern equivalents, with a warning, rather than ignoring them"`
+	PublishTorRecords    bool   `default:"true" usage:"Publish the onion service named by a value's tor field as a TXT record at _tor.NAME and, if it gives a port, an SRV record at _tor._tcp.NAME"`
+	ServeExpiredNamesFor int    `default:"0" usage:"Number of blocks after a name expires during which it is still served, with a short TTL (0: expired names don't exist)"`
+	FailureRetryDelay    int    `default:"5" usage:"Time (in seconds) after a name fails to be fetched from namecoind at which it is fetched again in the background, so that the next query succeeds (0: disabled)"`
+	MaxConcurrentLookups int    `default:"64" usage:"Maximum number of names fetched from namecoind at once by queries which miss the cache (0: no limit)"`
+	MaxQueuedLookups     int    `default:"256" usage:"Maximum number of fetches waiting for one of MaxConcurrentLookups to finish; queries needing a fetch beyond this are answered SERVFAIL at once"`
+	LookupTimeout        int    `default:"3000" usage:"Time (in milliseconds) after which fetching a name fails, including any time spent waiting for one of MaxConcurrentLookups, and after which a query stops waiting for the names it fetches (0: only NamecoinRPCTimeout applies)"`
+	QueryWorkBudget      int    `default:"1000" usage:"Maximum work done to answer one query, shared by its lookups, the names they fetch and import, the lookups of aliases' targets and additional records, and its signatures; optional work stops first, leaving a partial answer, and a query needing more is answered SERVFAIL (0: no limit)"`
+	SelfName             string `default:"" usage:"The FQDN of this nameserver. If empty, a pseudo-hostname is generated."`
+	SelfIP               string `default:"127.127.127.127" usage:"Comma-separated list of the canonical IPv4 and IPv6 addresses for this service"`
+	selfIPs              []net.IP
+
+	SelfNameCheckInterval  int    `default:"3600" usage:"Time (in seconds) between checks of whether the Namecoin name of SelfName, if it's under the suffix, or of the pseudo-hostname (d/x--nmc) has been registered, whose records the address records of this nameserver would shadow; a collision is logged and reported in /status and the problem events (0: only checked at startup)"`
+	AvoidSelfNameCollision bool   `default:"false" usage:"If the Namecoin name of the pseudo-hostname is registered, generate the pseudo-hostname under another label (x--nmc1, then x--nmc2 and so on) rather than only reporting it; a colliding SelfName is only reported"`
+	PseudoHostnameFile     string `default:"" usage:"Path to a file in which the label chosen for the pseudo-hostname by AvoidSelfNameCollision is kept, so that it's the same after a restart (default: it's chosen again at each start)"`
+
+	DSAlgorithms             string `default:"5,7,8,10,13,14,15,16" usage:"Comma-separated list of the DNSSEC algorithms (by number or mnemonic) which DS records given by values may name; DS records naming others are ignored with a warning"`
+	dsAlgorithms             []uint8
+	AllowUnknownDSAlgorithms bool `default:"false" usage:"Publish DS records naming algorithms not in DSAlgorithms anyway, still with a warning"`
+
+	AdaptiveTTL       bool `default:"false" usage:"Serve the records of names whose values haven't changed for a while with longer TTLs, from AdaptiveMinTTL for a value which has just changed to AdaptiveMaxTTL for one which hasn't for AdaptiveTTLBlocks blocks"`
+	AdaptiveMinTTL    int  `default:"600" usage:"TTL (in seconds) of the records of names whose values have just changed, with AdaptiveTTL"`
+	AdaptiveMaxTTL    int  `default:"86400" usage:"TTL (in seconds) of the records of names whose values haven't changed for AdaptiveTTLBlocks blocks, with AdaptiveTTL"`
+	AdaptiveTTLBlocks int  `default:"4320" usage:"Number of blocks for which a name's value must stay the same for its records to be served with AdaptiveMaxTTL (4320: about 30 days)"`
+
+	RecordTTL        int  `default:"600" usage:"TTL (in seconds) of the records of names, unless AdaptiveTTL is set"`
+	CapTTLByExpiry   bool `default:"false" usage:"Cap the TTLs of a name's records by the time left until it expires, reckoning 10 minutes per block, but not below MinRecordTTL"`
+	MinRecordTTL     int  `default:"60" usage:"TTL (in seconds) below which CapTTLByExpiry doesn't cap the records of names about to expire, so that they don't bring on a storm of queries"`
+	PartialResultTTL int  `default:"30" usage:"TTL (in seconds) to which the records of a name are capped when some of the names its value imports couldn't be fetched, so that resolvers soon ask again for the complete records (0: not capped)"`
+
+	EventWatchNames   string `default:"" usage:"Comma-separated list of Namecoin names (e.g. d/example) which are checked at each new block, streaming an event when they change (requires HTTPEvents)"`
+	EventClientBuffer int    `default:"64" usage:"Number of events buffered for each client of /api/v1/events; a client which falls further behind is disconnected"`
+	FlushCacheOnBlock bool   `default:"false" usage:"Empty the name cache at each new block, so that changed names are served at once rather than when they expire from the cache; between blocks, cached names are served however long ago they were fetched, as they can only change with a block"`
+	BlockPollInterval int    `default:"10" usage:"Time (in seconds) between checks of namecoind for a new block, for HTTPEvents, FlushCacheOnBlock, AdaptiveTTL and the SOA serial of zone transfers"`
+
+	ValueSizeWarnPercent int `default:"90" usage:"Percentage of the 520-byte consensus limit on the size of name values above which a value is warned about, on the webserver's lookup page and as a problem event streamed by HTTPEvents, since its owner may find there's no room to add to it (0: no warning)"`
+
+	QueryLogPath     string `default:"" usage:"Path to a file to which a line is written for each query answered, with the client's address, the question, the response code, the number of answers, the size of the response and the time taken to answer it; reopened on SIGUSR1, for logrotate (default: no query log)"`
+	QueryLogFormat   string `default:"text" usage:"Format of the lines of QueryLogPath: text, with fields separated by spaces, or json"`
+	QueryLogSample   int    `default:"1" usage:"Log only one in this many queries to QueryLogPath"`
+	QueryLogMaxBytes int    `default:"0" usage:"Size (in bytes) above which QueryLogPath is moved to the same path with .1 appended, replacing any file there, and a new one started (0: never, e.g. if logrotate is used)"`
+
+	OTLPEndpoint         string `default:"" usage:"URL of an OTLP/HTTP collector to export query traces to, e.g. http://localhost:4318 (default: tracing disabled; requires building with -tags otel)"`
+	TracingSamplePercent int    `default:"100" usage:"Percentage of DNS queries to trace when OTLPEndpoint is set"`
+
+	OutboundResolvers        string `default:"" usage:"Comma-separated list of addresses of recursive resolvers, tried in turn, to which ncdns sends its own DNS queries, e.g. for the parent DS check; they needn't validate, as ncdns validates their answers with DNSSEC itself (default: ParentCheckResolver)"`
+	OutboundTrustAnchorFile  string `default:"" usage:"Path to a file of trust anchors for the root zone, in any format ncdns can write them in, with which outbound queries are validated (default: the system's, e.g. /usr/share/dns/root.key, or those built in)"`
+	OutboundQueriesPerSecond int    `default:"10" usage:"Maximum rate of outbound queries to each of OutboundResolvers (0: no limit)"`
+	OutboundCacheMaxEntries  int    `default:"1000" usage:"Maximum number of validated answers to outbound queries cached"`
+
+	ParentCheckResolver string `default:"" usage:"Address of a recursive resolver through which to periodically check that the DS records published for CanonicalSuffix in its parent zone match the KSK, unless OutboundResolvers is set (default: disabled)"`
+	ParentCheckInterval int    `default:"3600" usage:"Time (in seconds) between checks of the parent zone's DS records"`
+	ParentCheckWebhook  string `default:"" usage:"URL to which the result of the parent DS check is posted as JSON whenever it changes"`
+
+	PeerServers       string `default:"" usage:"Comma-separated list of addresses of other instances of ncdns serving CanonicalSuffix with the same KSK, such as anycast instances, whose DNSKEY and SOA records are periodically compared with this instance's; an error is logged and an alert posted to AlertWebhook if resolvers mixing their answers would fail to validate them, or if a peer's SOA serial is stuck behind (default: disabled)"`
+	PeerCheckInterval int    `default:"300" usage:"Time (in seconds) between checks of PeerServers"`
+	PeerMaxSerialAge  int    `default:"1800" usage:"Time (in seconds) for which the SOA serial of one of PeerServers may stay behind this instance's before it's reported as stuck on an old block"`
+
+	AlertWebhook              string  `default:"" usage:"URL to which alerts, such as that of ServfailAlertRatio, are posted as JSON when they're raised and cleared"`
+	ServfailAlertRatio        float64 `default:"0" usage:"Ratio (e.g. 0.05) of the responses over the last ServfailAlertWindow seconds which are SERVFAIL above which, once it has been for ServfailAlertDuration seconds, an error is logged and an alert posted to AlertWebhook; it's cleared once the ratio has been below half of this for as long (0: disabled)"`
+	ServfailAlertWindow       int     `default:"60" usage:"Time (in seconds) over which the ratio of SERVFAIL responses is reckoned for ServfailAlertRatio"`
+	ServfailAlertDuration     int     `default:"300" usage:"Time (in seconds) for which the ratio of SERVFAIL responses must stay above ServfailAlertRatio for an alert to be raised, or below half of it for the alert to be cleared"`
+	ServfailAlertRefused      bool    `default:"false" usage:"Count REFUSED responses, as well as SERVFAIL, for ServfailAlertRatio"`
+	ServfailAlertMinResponses int     `default:"50" usage:"Number of responses in ServfailAlertWindow below which no alert is raised, so that a few failures when there's little traffic don't raise one"`
+	ServfailAlertWarmup       int     `default:"120" usage:"Time (in seconds) after starting during which no alert is raised for ServfailAlertRatio, while the caches fill"`
+
+	SignatureSampleRate int    `default:"0" usage:"Check the RRSIGs of 1 in this many responses, reporting how close to expiry they are at /status and /metrics and warning if they aren't valid when served (0: disabled)"`
+	ClockSkewPolicy     string `default:"servfail" usage:"What to do with a response containing an expired RRSIG which can't be made again, which means the system clock is wrong: servfail to answer SERVFAIL, or unsigned to answer without RRSIGs"`
+
+	EnumerationNamesPerSecond int `default:"1000" usage:"Maximum rate at which names are fetched from namecoind when walking the whole zone, e.g. for the Firefox override sync, shared by all walks (0: no limit)"`
+	MaxConcurrentTransfers    int `default:"1" usage:"Maximum number of zone walks running at once; further walks wait for one to finish (0: no limit)"`
+
+	XferAllowedIPs string `default:"" usage:"Comma-separated list of IP addresses and CIDR prefixes (e.g. 192.0.2.1,2001:db8::/32) of secondaries which may transfer the zone CanonicalSuffix by AXFR or IXFR over TCP (default: none)"`
+	TSIGKey        string `default:"" usage:"Comma-separated list of TSIG keys, each name:algorithm:secret with the secret in base64 (e.g. xfr.example.:hmac-sha256:c2VjcmV0), with which secondaries may sign AXFR queries to transfer the zone from anywhere"`
+	NotifyTargets  string `default:"" usage:"Comma-separated list of the host:port addresses of secondaries sent a DNS NOTIFY whenever a new block changes the SOA serial, each optionally followed by /KEYNAME to sign it with that key of TSIGKey (e.g. 192.0.2.53:53/xfr.example.)"`
+
+	IXFRJournalBlocks     int `default:"2000" usage:"Number of versions of the zone, one for each block at which it's transferred, whose changes are kept in memory so that an IXFR from a secondary with one of them gets only what changed since; others get the whole zone (0: IXFR always gets the whole zone)"`
+	IXFRJournalMaxRecords int `default:"1000000" usage:"Maximum number of records changed in all the versions kept for IXFR, beyond which the oldest are dropped"`
+
+	HealthCheckNames    string `default:"" usage:"Comma-separated list of your own names (e.g. www.example.bit) whose published addresses are probed, omitting those which are down from answers (default: none)"`
+	HealthCheckProbe    string `default:"tcp:80" usage:"How to probe addresses of HealthCheckNames: tcp:PORT, http:PORT/PATH or icmp"`
+	HealthCheckInterval int    `default:"30" usage:"Time (in seconds) between probes of the addresses of HealthCheckNames"`
+
+	ClientStatsMaxPrefixes int `default:"10000" usage:"Maximum number of client prefixes (/24 for IPv4, /48 for IPv6) whose query counts are kept, listed by the webserver from a loopback address at /api/v1/clients (0: disabled)"`
+	ClientStatsWindow      int `default:"60" usage:"Time (in seconds) over which the queries of each client prefix are counted"`
+	AbuseThresholdQPS      int `default:"0" usage:"Rate (in queries per second, averaged over ClientStatsWindow) above which the queries of a client prefix are refused for AbuseBanDuration (0: never)"`
+	AbuseBanDuration       int `default:"600" usage:"Time (in seconds) for which queries from a client prefix over AbuseThresholdQPS are refused"`
+
+	AllowQueriesFrom string `default:"" usage:"Comma-separated list of IP addresses and CIDR prefixes (e.g. 192.168.0.0/16,fd00::/8) of the only clients whose queries are answered; others are refused (default: all clients)"`
+	DenyQueriesFrom  string `default:"" usage:"Comma-separated list of IP addresses and CIDR prefixes of clients whose queries are refused, even if they're in AllowQueriesFrom"`
+
+	OutOfZone             string `default:"refused" usage:"What is done with queries for names outside .bit, without them reaching namecoind: refused, nxdomain, or forward to ForwardUpstream"`
+	ForwardUpstream       string `default:"" usage:"Address (host:port, port 53 if omitted) of the resolver to which queries for names outside .bit are forwarded if OutOfZone is forward, over UDP or TCP as they came"`
+	ForwardTimeout        int    `default:"2000" usage:"Time (in milliseconds) ForwardUpstream has to answer a forwarded query before the client is answered SERVFAIL"`
+	ForwardMaxOutstanding int    `default:"100" usage:"Maximum number of forwarded queries awaiting an answer from ForwardUpstream at once, beyond which queries are answered SERVFAIL (0: no limit)"`
+
+	VersionString string `default:"" usage:"Version given in answer to CH TXT queries for version.bind and version.server (default: the version of ncdns; hidden: such queries are refused)"`
+	ServerID      string `default:"" usage:"Identity given in answer to CH TXT queries for hostname.bind and id.server (default: SelfName, or failing that the hostname)"`
+
+	AllowURLIncludes    string `default:"" usage:"Comma-separated list of URL prefixes (e.g. https://config.internal/) from under which values may include JSON with include_url statements, for private deployments keeping large record sets off-chain; any value may name any URL, so only list servers you control (default: include_url is ignored with a warning)"`
+	URLIncludeTimeout   int    `default:"5000" usage:"Time (in milliseconds) a server in AllowURLIncludes has to send a document before the value including it is served without it, with PartialResultTTL"`
+	URLIncludeMaxSize   int    `default:"65536" usage:"Maximum size (in bytes) of a document included with include_url; larger ones aren't included"`
+	URLIncludeCacheTime int    `default:"300" usage:"Time (in seconds) for which a document included with include_url is used before it's revalidated by its ETag or Last-Modified time"`
+
+	StripDNSSECForClients string `default:"" usage:"Comma-separated list of IP addresses and CIDR prefixes of clients whose responses never include DNSSEC records, even if they set the DO bit, for stub resolvers which fail on them (weakens security for those clients)"`
+
+	RRLRatePerSecond int `default:"0" usage:"Maximum rate (in responses per second) of responses over UDP with the same name, type and response code to the same client network (/24 for IPv4, /56 for IPv6), to stop ncdns being used to reflect responses at spoofed addresses (0: no limit)"`
+	RRLWindow        int `default:"15" usage:"Time (in seconds) for which a client network over RRLRatePerSecond may have to slow down before it's answered again"`
+	RRLSlip          int `default:"2" usage:"Every this many responses over RRLRatePerSecond, one is sent empty with TC set, so that genuine clients retry over TCP, rather than dropped (0: drop them all)"`
+
+	CookieSecretLifetime int  `default:"86400" usage:"Time (in seconds) for which the secret from which DNS cookies (RFC 7873) are made is used before it's replaced; cookies made with the one before are accepted until the next replacement (0: no DNS cookies)"`
+	CookieEnforce        bool `default:"false" usage:"Answer queries over UDP without a valid server cookie BADCOOKIE, or truncated if they carry no cookie, so that clients retry with a cookie or over TCP; if unset, such queries are only counted and logged"`
+
+	EDNSReportInterval int `default:"3600" usage:"Time (in seconds) between log summaries of the queries without EDNS, with an EDNS version above 0 or with unknown EDNS flags, and how often truncated responses are retried over TCP (0: never)"`
+
+	EDNSMaxUDPSize int `default:"1232" usage:"Largest response (in bytes) sent over UDP, even to clients giving a larger EDNS buffer size, and the buffer size advertised in responses; larger responses are truncated, so that clients retry over TCP (1232 avoids IP fragmentation on nearly all networks)"`
+	EDNSPadding    int `default:"468" usage:"Block size (in bytes) to a multiple of which responses over DNS over TLS are padded, when the query is padded, so that their sizes say less about the names looked up (0: never pad)"`
+
+	EDNSStripClientSubnet bool `default:"false" usage:"Ignore EDNS Client Subnet options in queries, rather than echoing them in responses with a scope prefix length of 0 (which lets resolvers cache answers for all clients) and answering FORMERR to malformed ones, so that clients' subnets are never sent back over the network"`
+
+	BreakerFailureThreshold int `default:"5" usage:"Consecutive Namecoin RPC failures on webserver lookups after which webserver lookups of names which aren't cached are rejected for BreakerCooldown (0: never)"`
+	BreakerCooldown         int `default:"30" usage:"Time (in seconds) for which webserver lookups of names which aren't cached are rejected once BreakerFailureThreshold is reached"`
+
+	DrainOnSIGTERM bool `default:"false" usage:"On SIGTERM, fail health checks but keep answering DNS queries for DrainDuration before exiting, so that load balancers can drain traffic"`
+	DrainDuration  int  `default:"30" usage:"Time (in seconds) for which DNS queries are still answered when draining"`
+	StopTimeout    int  `default:"5" usage:"Time (in seconds) for which stopping waits for DNS queries and webserver requests in progress to be answered, and for the work queued for background tasks (such as webhooks) to be done, before giving up on them"`
+
+	StartupIOTimeout int `default:"10" usage:"Time (in seconds) after which reading a key, template or RPC cookie file while starting or reloading is abandoned, failing with an error naming it, e.g. if it's a FIFO or on an unreachable network filesystem (0: no limit)"`
 
 	CanonicalSuffix      string `default:"bit" usage:"Suffix to advertise via HTTP"`
 	CanonicalNameservers string `default:"" usage:"Comma-separated list of nameservers to use for NS records. If blank, SelfName (or autogenerated pseudo-hostname) is used."`
@@ -59,8 +328,22 @@ type Config struct {
 	Hostmaster           string `default:"" usage:"Hostmaster e. mail address"`
 	VanityIPs            string `default:"" usage:"Comma separated list of IP addresses to place in A/AAAA records at the zone apex (default: don't add any records)"`
 	vanityIPs            []net.IP
+	ApexRecords          string `default:"" usage:"Records to place at the zone apex alongside VanityIPs, such as a CAA record stopping public CAs issuing certificates for .bit names, one per line in zone file syntax and owned by bit.; only TXT, CAA and SSHFP records are allowed (default: don't add any records)"`
+	apexRecords          []dns.RR
 	TplSet               string `default:"std" usage:"The template set to use"`
-	TplPath              string `default:"" usage:"The path to the tpl directory (empty: autodetect)"`
+	TplPath              string `default:"" usage:"The path to the tpl directory (empty: use the templates built into ncdns, or autodetect if it was built without them)"`
+
+	ApexInfrastructureTTL int `default:"86400" usage:"TTL (in seconds) of the SOA, NS, DNSKEY and NSEC records at the zone apex, which rarely change; the TTL of negative answers is still the SOA's minimum, and records never outlive the RRSIGs covering them"`
+
+	SOARefresh    string `default:"600" usage:"Refresh field of the SOA record at the zone apex: how often secondaries check the serial for changes, in seconds or as a duration such as 10m"`
+	SOARetry      string `default:"600" usage:"Retry field of the SOA record at the zone apex: how soon secondaries check again if checking the serial fails, in seconds or as a duration"`
+	SOAExpire     string `default:"7200" usage:"Expire field of the SOA record at the zone apex: how long secondaries go on serving the zone without reaching ncdns, in seconds or as a duration; at least SOARefresh and SOARetry"`
+	SOAMinimumTTL string `default:"600" usage:"Minimum field of the SOA record at the zone apex, which is the TTL of negative answers, in seconds or as a duration"`
+	SOASerialMode string `default:"blockheight" usage:"Serial of the SOA record at the zone apex: blockheight for the height of namecoind's best block, or unixtime for the time at which ncdns noticed it"`
+	soaRefresh    uint32
+	soaRetry      uint32
+	soaExpire     uint32
+	soaMinimumTTL uint32
 
 	ConfigDir string // path to interpret filenames relative to
 }
@@ -69,186 +352,1095 @@ func (cfg *Config) cpath(s string) string {
 	return filepath.Join(cfg.ConfigDir, s)
 }
 
+// Makes the server fetch name values from f rather than from the source
+// Fetcher names, e.g. so that a program embedding ncdns, or a test, can serve
+// names of its own. The values are made into records as those from namecoind
+// are.
+func (cfg *Config) UseFetcher(f backend.Fetcher) {
+	cfg.fetcher = f
+}
+
+// Returns true if name values are fetched from namecoind.
+func (cfg *Config) usesNamecoind() bool {
+	return cfg.fetcher == nil && (cfg.Fetcher == "" || cfg.Fetcher == "namecoind")
+}
+
+// Parses the options describing the zone apex, which can be changed by a
+// reload.
+func (cfg *Config) parseZoneOptions() error {
+	cfg.canonicalNameservers = nil
+	if cfg.CanonicalNameservers != "" {
+		cfg.canonicalNameservers = strings.Split(cfg.CanonicalNameservers, ",")
+		for i := range cfg.canonicalNameservers {
+			cfg.canonicalNameservers[i] = dns.Fqdn(cfg.canonicalNameservers[i])
+		}
+	}
+
+	cfg.vanityIPs = nil
+	if cfg.VanityIPs != "" {
+		vanityIPs := strings.Split(cfg.VanityIPs, ",")
+		for _, ips := range vanityIPs {
+			ip := net.ParseIP(ips)
+			if ip == nil {
+				return configError("Couldn't parse IP: %s", ips)
+			}
+			cfg.vanityIPs = append(cfg.vanityIPs, ip)
+		}
+	}
+
+	var err error
+	cfg.apexRecords, err = parseApexRecords(cfg.ApexRecords)
+	return err
+}
+
 var ncdnsVersion string
 
 func New(cfg *Config) (s *Server, err error) {
-	ncdnsVersion = buildinfo.VersionSummary("github.com/namecoin/ncdns", "ncdns")
+	s, err = newServer(cfg)
+	if err != nil {
+		return nil, err
+	}
 
-	// Connect to local namecoin core RPC server using HTTP POST mode.
-	connCfg := &rpcclient.ConnConfig{
-		Host:         cfg.NamecoinRPCAddress,
-		User:         cfg.NamecoinRPCUsername,
-		Pass:         cfg.NamecoinRPCPassword,
-		CookiePath:   cfg.NamecoinRPCCookiePath,
-		HTTPPostMode: true, // Namecoin core only supports HTTP POST mode
-		DisableTLS:   true, // Namecoin core does not provide TLS by default
+	err = s.listen()
+	if err != nil {
+		return nil, wrapError(ErrBindFailed, err)
 	}
 
-	// Notice the notification parameter is nil since notifications are
-	// not supported in HTTP POST mode.
-	client, err := namecoin.New(connCfg, nil)
+	if cfg.HTTP.ListenAddr != "" {
+		s.web, err = newWebServer(s)
+		if err != nil {
+			s.closeListeners()
+			return nil, wrapError(ErrBindFailed, err)
+		}
+	}
+
+	err = s.dropPrivileges()
+	if err != nil {
+		s.closeListeners()
+		if s.web != nil {
+			s.web.close()
+		}
+		return nil, wrapError(ErrPrivilegeDrop, err)
+	}
+
+	return
+}
+
+// Sets up a server as New does, checking the configuration and loading the
+// keys, but without listening.
+func newServer(cfg *Config) (s *Server, err error) {
+	ncdnsVersion = buildinfo.VersionSummary("github.com/namecoin/ncdns", "ncdns")
+
+	deprecated, err := cfg.migrateOptions()
 	if err != nil {
 		return nil, err
 	}
 
+	network, err := namecoin.NetworkByName(cfg.RPC.Network)
+	if err != nil {
+		return nil, wrapError(ErrConfigInvalid, err)
+	}
+
+	connCfgs, err := cfg.namecoinConnConfigs(network)
+	if err != nil {
+		return nil, wrapError(ErrConfigInvalid, err)
+	}
+	if cfg.usesNamecoind() {
+		var cookiePaths []string
+		for _, connCfg := range connCfgs {
+			if connCfg.Pass == "" {
+				cookiePaths = append(cookiePaths, connCfg.CookiePath)
+			}
+		}
+		if err := cfg.checkCookies(cookiePaths); err != nil {
+			return nil, wrapError(ErrBackendInit, err)
+		}
+	}
+
+	var tlsCfg *namecoin.TLSConfig
+	if cfg.RPC.TLS {
+		tlsCfg, err = cfg.namecoinTLSConfig()
+		if err != nil {
+			return nil, wrapError(ErrConfigInvalid, err)
+		}
+	} else if cfg.RPC.TLSPinSPKI != "" || cfg.RPC.TLSCAFile != "" || cfg.RPC.TLSServerName != "" || cfg.RPC.TLSClientCert != "" {
+		return nil, configError("NamecoinRPCTLSPinSPKI, NamecoinRPCTLSCAFile, NamecoinRPCTLSServerName and NamecoinRPCTLSClientCert require NamecoinRPCTLS")
+	}
+
+	var proxy *namecoin.Proxy
+	if cfg.RPC.Proxy != "" {
+		proxy, err = namecoin.ParseProxyURL(cfg.RPC.Proxy)
+		if err != nil {
+			return nil, configError("NamecoinRPCProxy: %v", err)
+		}
+		proxy.Isolate = cfg.RPC.ProxyIsolation
+	} else {
+		for _, connCfg := range connCfgs {
+			host, _, err := net.SplitHostPort(connCfg.Host)
+			if err == nil && strings.HasSuffix(strings.ToLower(host), ".onion") {
+				return nil, configError("%s in NamecoinRPCEndpoints is an onion service, which can only be reached through NamecoinRPCProxy", connCfg.Host)
+			}
+		}
+	}
+
+	var client *namecoin.Client
+	switch {
+	case len(connCfgs) > 1:
+		// Each node gets its share of the timeout, so that a lookup
+		// fails within it even if every node is down.
+		endpoints := make([]*namecoin.Endpoint, len(connCfgs))
+		for i, connCfg := range connCfgs {
+			endpoints[i] = &namecoin.Endpoint{Config: connCfg, TLS: tlsCfg, Proxy: proxy}
+		}
+		timeout := time.Duration(cfg.RPC.Timeout) * time.Millisecond / time.Duration(len(endpoints))
+		client, err = namecoin.NewFailover(endpoints, timeout)
+	case tlsCfg != nil || proxy != nil:
+		client, err = namecoin.NewProxied(connCfgs[0], tlsCfg, proxy)
+	default:
+		// Notice the notification parameter is nil since notifications
+		// are not supported in HTTP POST mode.
+		client, err = namecoin.New(connCfgs[0], nil)
+	}
+	if err != nil {
+		return nil, wrapError(ErrBackendInit, err)
+	}
+
+	if cfg.RPC.MaxValueSize < namecoin.ConsensusMaxValueSize {
+		return nil, configError("NamecoinMaxValueSize must be at least %d", namecoin.ConsensusMaxValueSize)
+	}
+	client.MaxValueSize = cfg.RPC.MaxValueSize
+	if cfg.ValueSizeWarnPercent < 0 || cfg.ValueSizeWarnPercent > 100 {
+		return nil, configError("ValueSizeWarnPercent must be between 0 and 100")
+	}
+
 	s = &Server{
 		cfg:          *cfg,
+		clock:        clock.Real,
+		network:      network,
 		namecoinConn: client,
+		queryMetrics: newQueryMetrics(),
+		ednsStats:    newEDNSStats(clock.Real),
+		bus:          newEventBus(),
+		busMetrics:   &busMetrics{clock: clock.Real},
+		deprecated:   deprecated,
 	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	s.registerShutdown()
+	// Synchronously and first, so that the height, and with it the SOA
+	// serial, has moved on by the time the other subscribers see a block.
+	s.bus.subscribe("metrics", s.busMetrics.handle)
+	s.setupDSExport()
+	s.httpBreaker = newCircuitBreaker(cfg.BreakerFailureThreshold, time.Duration(cfg.BreakerCooldown)*time.Second, s.clock)
 
-	if s.cfg.CanonicalNameservers != "" {
-		s.cfg.canonicalNameservers = strings.Split(s.cfg.CanonicalNameservers, ",")
-		for i := range s.cfg.canonicalNameservers {
-			s.cfg.canonicalNameservers[i] = dns.Fqdn(s.cfg.canonicalNameservers[i])
+	for _, ips := range strings.Split(s.cfg.SelfIP, ",") {
+		if ips = strings.TrimSpace(ips); ips == "" {
+			continue
 		}
+		ip := net.ParseIP(ips)
+		if ip == nil {
+			return nil, configError("Couldn't parse SelfIP: %s", ips)
+		}
+		s.cfg.selfIPs = append(s.cfg.selfIPs, ip)
 	}
 
-	if s.cfg.VanityIPs != "" {
-		vanityIPs := strings.Split(s.cfg.VanityIPs, ",")
-		for _, ips := range vanityIPs {
-			ip := net.ParseIP(ips)
-			if ip == nil {
-				return nil, fmt.Errorf("Couldn't parse IP: %s", ips)
-			}
-			s.cfg.vanityIPs = append(s.cfg.vanityIPs, ip)
+	err = s.cfg.parseZoneOptions()
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.ApexInfrastructureTTL < 1 {
+		return nil, configError("ApexInfrastructureTTL must be at least 1")
+	}
+	if cfg.RecordTTL < 0 || cfg.MinRecordTTL < 0 || cfg.PartialResultTTL < 0 {
+		return nil, configError("RecordTTL, MinRecordTTL and PartialResultTTL must not be negative")
+	}
+	err = s.cfg.parseSOAOptions()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, ns := range strings.Split(s.cfg.ImportNamespaces, ",") {
+		ns = strings.TrimSuffix(strings.TrimSpace(ns), "/")
+		if ns != "" {
+			s.cfg.importNamespaces = append(s.cfg.importNamespaces, ns)
+		}
+	}
+	if s.cfg.importNamespaces == nil {
+		s.cfg.importNamespaces = []string{}
+	}
+
+	if s.cfg.DehydratedTLSA != "" {
+		s.cfg.generatedTLSA, err = ncdomain.ParseTLSAForm(s.cfg.DehydratedTLSA)
+		if err != nil {
+			return nil, configError("Invalid DehydratedTLSA: %v", err)
+		}
+	}
+
+	s.cfg.dsAlgorithms, err = ncdomain.ParseDSAlgorithms(s.cfg.DSAlgorithms)
+	if err != nil {
+		return nil, configError("Invalid DSAlgorithms: %v", err)
+	}
+
+	if s.cfg.AdaptiveMinTTL < 0 || s.cfg.AdaptiveMaxTTL < s.cfg.AdaptiveMinTTL {
+		return nil, configError("AdaptiveMinTTL must not be negative or greater than AdaptiveMaxTTL")
+	}
+	if s.cfg.AdaptiveTTLBlocks < 1 {
+		return nil, configError("AdaptiveTTLBlocks must be at least 1")
+	}
+
+	s.cfg.suffixKeys, err = parseSuffixKeys(s.cfg.DNSSEC.SuffixKeys)
+	if err != nil {
+		return nil, wrapError(ErrConfigInvalid, err)
+	}
+
+	s.cfg.unsignedNames, err = parseUnsignedNames(s.cfg.UnsignedNames)
+	if err != nil {
+		return nil, wrapError(ErrConfigInvalid, err)
+	}
+	err = s.setupUnsignedNames()
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.setupURLIncludes()
+	if err != nil {
+		return nil, wrapError(ErrConfigInvalid, err)
+	}
+
+	err = s.setupSelfNameCheck()
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := s.newBackend(&s.cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	s.backend = b
+
+	err = s.setupTransfers()
+	if err != nil {
+		return nil, wrapError(ErrConfigInvalid, err)
+	}
+
+	err = s.setupNotify()
+	if err != nil {
+		return nil, wrapError(ErrConfigInvalid, err)
+	}
+
+	err = s.setupEvents()
+	if err != nil {
+		return nil, wrapError(ErrConfigInvalid, err)
+	}
+
+	err = s.setupQueryLog()
+	if err != nil {
+		return nil, wrapError(ErrConfigInvalid, err)
+	}
+
+	err = s.setupQueryACL()
+	if err != nil {
+		return nil, wrapError(ErrConfigInvalid, err)
+	}
+
+	err = s.setupOutOfZone()
+	if err != nil {
+		return nil, wrapError(ErrConfigInvalid, err)
+	}
+
+	err = s.setupDNSSECStrip()
+	if err != nil {
+		return nil, wrapError(ErrConfigInvalid, err)
+	}
+
+	err = s.setupTCPConns()
+	if err != nil {
+		return nil, wrapError(ErrConfigInvalid, err)
+	}
+
+	if cfg.RPZFile != "" {
+		s.rpz, err = newRPZPolicy(s.cfg.cpath(cfg.RPZFile), s.clock)
+		if err != nil {
+			return nil, configError("Couldn't load RPZFile: %v", err)
 		}
 	}
 
+	if cfg.EnumerationNamesPerSecond < 0 || cfg.MaxConcurrentTransfers < 0 {
+		return nil, configError("EnumerationNamesPerSecond and MaxConcurrentTransfers must not be negative")
+	}
+	s.zoneWalkPacer = ncdumpzone.NewPacer(&ncdumpzone.PacerConfig{
+		NamesPerSecond: float64(cfg.EnumerationNamesPerSecond),
+		MaxConcurrent:  cfg.MaxConcurrentTransfers,
+	})
+
+	if cfg.Cache.IdleEviction < 0 || cfg.Cache.StaleTTL < 0 || cfg.MemoryWarnBytes < 0 {
+		return nil, configError("CacheIdleEviction, StaleAnswerTTL and MemoryWarnBytes must not be negative")
+	}
+	if err := cfg.checkCacheOptions(); err != nil {
+		return nil, err
+	}
+	if cfg.MaxConcurrentLookups < 0 || cfg.MaxQueuedLookups < 0 || cfg.LookupTimeout < 0 || cfg.QueryWorkBudget < 0 {
+		return nil, configError("MaxConcurrentLookups, MaxQueuedLookups, LookupTimeout and QueryWorkBudget must not be negative")
+	}
+	if cfg.MemoryWarnBytes > 0 {
+		dir := ""
+		if cfg.HeapProfileDir != "" {
+			dir = s.cfg.cpath(cfg.HeapProfileDir)
+		}
+		s.memoryWatcher = newMemoryWatcher(uint64(cfg.MemoryWarnBytes), dir, s.clock)
+	} else if cfg.HeapProfileDir != "" {
+		return nil, configError("HeapProfileDir requires MemoryWarnBytes")
+	}
+
+	if cfg.EDNSReportInterval < 0 {
+		return nil, configError("EDNSReportInterval must not be negative")
+	}
+
+	err = s.setupEDNS()
+	if err != nil {
+		return nil, wrapError(ErrConfigInvalid, err)
+	}
+	s.setupChaos()
+
+	if cfg.SignatureSampleRate < 0 {
+		return nil, configError("SignatureSampleRate must not be negative")
+	}
+	if cfg.SignatureSampleRate > 0 {
+		s.sigMonitor = newSigMonitor(cfg.SignatureSampleRate, s.clock)
+	}
+
+	clockSkewPolicy := cfg.ClockSkewPolicy
+	switch clockSkewPolicy {
+	case "":
+		clockSkewPolicy = clockSkewServFail
+	case clockSkewServFail, clockSkewUnsigned:
+	default:
+		return nil, configError("ClockSkewPolicy must be %s or %s", clockSkewServFail, clockSkewUnsigned)
+	}
+	s.sigGuard = newSigGuard(s, clockSkewPolicy)
+
+	if cfg.ClientStatsMaxPrefixes < 0 || cfg.AbuseThresholdQPS < 0 || cfg.AbuseBanDuration < 0 {
+		return nil, configError("ClientStatsMaxPrefixes, AbuseThresholdQPS and AbuseBanDuration must not be negative")
+	}
+	if cfg.ClientStatsMaxPrefixes > 0 {
+		if cfg.ClientStatsWindow < 1 {
+			return nil, configError("ClientStatsWindow must be at least 1")
+		}
+		s.clientStats = newClientStats(cfg.ClientStatsMaxPrefixes, time.Duration(cfg.ClientStatsWindow)*time.Second,
+			float64(cfg.AbuseThresholdQPS), time.Duration(cfg.AbuseBanDuration)*time.Second, s.clock)
+	} else if cfg.AbuseThresholdQPS > 0 {
+		return nil, configError("AbuseThresholdQPS requires ClientStatsMaxPrefixes")
+	}
+
+	if cfg.RRLRatePerSecond < 0 || cfg.RRLSlip < 0 {
+		return nil, configError("RRLRatePerSecond and RRLSlip must not be negative")
+	}
+	if cfg.RRLRatePerSecond > 0 {
+		if cfg.RRLWindow < 1 {
+			return nil, configError("RRLWindow must be at least 1")
+		}
+		s.rrl = newRRL(cfg.RRLRatePerSecond, time.Duration(cfg.RRLWindow)*time.Second, cfg.RRLSlip, s.clock)
+	}
+
+	err = s.setupCookies()
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.setupCachePersist()
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.setupAPILookupLimit()
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.setupServfailAlert()
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.setupHealthChecks()
+	if err != nil {
+		return nil, wrapError(ErrConfigInvalid, err)
+	}
+
+	err = s.setupTLS()
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.setupRunAsUser()
+	if err != nil {
+		return nil, err
+	}
+
+	// key setup
+	var ks *keySet
+	if cfg.DNSSEC.KeyStateDir != "" {
+		ks, err = s.setupZSKRollover()
+	} else {
+		ks, err = s.loadKeySet(cfg.DNSSEC.PublicKey, cfg.DNSSEC.PrivateKey, cfg.DNSSEC.ZonePublicKey, cfg.DNSSEC.ZonePrivateKey)
+	}
+	if err != nil {
+		return nil, wrapError(ErrKeyLoad, err)
+	}
+
+	suffixKeySets, err := s.loadSuffixKeySets(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	s.globalKeySet = ks
+	s.suffixKeySets = suffixKeySets
+	s.mux, err = s.newMux(b, ks, suffixKeySets)
+	if err != nil {
+		return nil, wrapError(ErrBackendInit, err)
+	}
+
+	err = s.setupTrustSetup()
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.setupOutbound()
+	if err != nil {
+		return nil, wrapError(ErrConfigInvalid, err)
+	}
+
+	err = s.setupParentCheck()
+	if err != nil {
+		return nil, wrapError(ErrConfigInvalid, err)
+	}
+
+	err = s.setupPeerCheck()
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.setupWatchdog()
+	if err != nil {
+		return nil, err
+	}
+
+	err = tracing.Setup(&tracing.Config{
+		Endpoint:   cfg.OTLPEndpoint,
+		SampleRate: float64(cfg.TracingSamplePercent) / 100,
+	})
+	if err != nil {
+		return nil, wrapError(ErrConfigInvalid, err)
+	}
+
+	return
+}
+
+// Creates the backend answering queries, configured by cfg, which is s.cfg but
+// for the options changed by a reload.
+func (s *Server) newBackend(cfg *Config) (*backend.Backend, error) {
+	fetcher, err := s.newFetcher()
+	if err != nil {
+		return nil, wrapError(ErrBackendInit, err)
+	}
+
 	b, err := backend.New(&backend.Config{
+		Fetcher:              fetcher,
 		NamecoinConn:         s.namecoinConn,
-		NamecoinTimeout:      cfg.NamecoinRPCTimeout,
-		CacheMaxEntries:      cfg.CacheMaxEntries,
-		SelfIP:               cfg.SelfIP,
+		NamecoinTimeout:      cfg.RPC.Timeout,
+		CacheMaxEntries:      cfg.Cache.MaxEntries,
+		CacheMaxBytes:        cfg.Cache.MaxBytes,
+		CacheIdleEviction:    time.Duration(cfg.Cache.IdleEviction) * time.Second,
+		Clock:                s.clock,
+		SelfName:             cfg.SelfName,
+		SelfIPs:              cfg.selfIPs,
+		MetaLabel:            s.metaLabel,
 		Hostmaster:           cfg.Hostmaster,
-		CanonicalNameservers: s.cfg.canonicalNameservers,
-		VanityIPs:            s.cfg.vanityIPs,
+		ImportNamespaces:     cfg.importNamespaces,
+		GeneratedTLSA:        cfg.generatedTLSA,
+		IgnoreLegacyFields:   !cfg.LegacyFieldSupport,
+		OmitTorRecords:       !cfg.PublishTorRecords,
+		ServeExpiredNamesFor: cfg.ServeExpiredNamesFor,
+		FailureRetryDelay:    time.Duration(cfg.FailureRetryDelay) * time.Second,
+		MaxConcurrentLookups: cfg.MaxConcurrentLookups,
+		MaxQueuedLookups:     cfg.MaxQueuedLookups,
+		LookupTimeout:        time.Duration(cfg.LookupTimeout) * time.Millisecond,
+		CanonicalNameservers: cfg.canonicalNameservers,
+		VanityIPs:            cfg.vanityIPs,
+		ApexRecords:          cfg.apexRecords,
+		ApexTTL:              uint32(cfg.ApexInfrastructureTTL),
+		SOASerial:            s.soaSerial,
+
+		DSAlgorithms:             cfg.dsAlgorithms,
+		AllowUnknownDSAlgorithms: cfg.AllowUnknownDSAlgorithms,
+
+		NegativeCacheMaxEntries: cfg.Cache.NegativeMaxEntries,
+		NegativeCacheTTL:        time.Duration(cfg.Cache.NegativeTTL) * time.Second,
+		StaleAnswerTTL:          time.Duration(cfg.Cache.StaleTTL) * time.Second,
+
+		ChainHeight:       s.chainHeight,
+		AdaptiveTTL:       cfg.AdaptiveTTL,
+		AdaptiveMinTTL:    uint32(cfg.AdaptiveMinTTL),
+		AdaptiveMaxTTL:    uint32(cfg.AdaptiveMaxTTL),
+		AdaptiveTTLBlocks: int64(cfg.AdaptiveTTLBlocks),
+
+		RecordTTL:      uint32(cfg.RecordTTL),
+		CapTTLByExpiry: cfg.CapTTLByExpiry,
+		MinRecordTTL:   uint32(cfg.MinRecordTTL),
+
+		PartialResultTTL: uint32(cfg.PartialResultTTL),
+
+		SOARefresh: cfg.soaRefresh,
+		SOARetry:   cfg.soaRetry,
+		SOAExpire:  cfg.soaExpire,
+		SOAMinTTL:  cfg.soaMinimumTTL,
+
+		ValueSizeWarnPercent: cfg.ValueSizeWarnPercent,
+		FetchURL:             s.fetchURLFunc(),
+		Problem: func(name string, err error, isWarning bool) {
+			s.bus.publish(&valueProblem{Name: name, Problem: err.Error(), Warning: isWarning})
+		},
 	})
 	if err != nil {
-		return
+		return nil, wrapError(ErrBackendInit, err)
+	}
+
+	return b, nil
+}
+
+// The options with which values are parsed for the webserver's lookups and
+// the doctor, as the backend parses them for DNS.
+func (s *Server) parseOptions() *ncdomain.ParseOptions {
+	opts := &ncdomain.ParseOptions{
+		ImportNamespaces:   s.cfg.importNamespaces,
+		GeneratedTLSA:      s.cfg.generatedTLSA,
+		IgnoreLegacyFields: !s.cfg.LegacyFieldSupport,
+		OmitTorRecords:     !s.cfg.PublishTorRecords,
+
+		DSAlgorithms:             s.cfg.dsAlgorithms,
+		AllowUnknownDSAlgorithms: s.cfg.AllowUnknownDSAlgorithms,
+
+		FetchURL: s.fetchURLFunc(),
 	}
+	if s.cfg.ValueSizeWarnPercent > 0 {
+		opts.MaxValueSize = namecoin.ConsensusMaxValueSize
+		opts.ValueSizeWarnPercent = s.cfg.ValueSizeWarnPercent
+	}
+	return opts
+}
+
+// Loads the keys of each suffix in SuffixKeys. Those generated for the
+// lifetime of the process are taken from old, the keys in use, if it has them,
+// as is a temporary ZSK while the KSK it was generated with is unchanged.
+func (s *Server) loadSuffixKeySets(old map[string]*keySet) (map[string]*keySet, error) {
+	keySets := make(map[string]*keySet)
+	for _, spec := range s.cfg.suffixKeys {
+		if ks, ok := old[spec.suffix]; ok && spec.auto && s.cfg.DNSSEC.KeyDir == "" {
+			keySets[spec.suffix] = ks
+			continue
+		}
+
+		ks, err := s.loadSuffixKeySet(&spec)
+		if err != nil {
+			return nil, &Error{
+				Kind: ErrKeyLoad,
+				Err:  fmt.Errorf("Couldn't set up keys for suffix %s: %w", spec.suffix, err),
+			}
+		}
+		if oks, ok := old[spec.suffix]; ok && !spec.auto && spec.zonePublicKey == "" && oks.KSK.String() == ks.KSK.String() {
+			ks.ZSK, ks.ZSKPrivate = oks.ZSK, oks.ZSKPrivate
+		}
+		keySets[spec.suffix] = ks
+	}
+
+	return keySets, nil
+}
 
-	ecfg := &madns.EngineConfig{
-		Backend:       b,
-		VersionString: ncdnsVersion,
+// Builds the mux dispatching queries to the engines answering from b: one
+// signing with the global keys ks, one for each suffix in suffixKeySets, and
+// one for each unsigned name. Each makes a query's lookups with the context
+// its writer carries, if any.
+func (s *Server) newMux(b *backend.Backend, ks *keySet, suffixKeySets map[string]*keySet) (*dns.ServeMux, error) {
+	signedView := func(b madns.Backend) madns.Backend {
+		return s.zoneBackend(s.policyBackend(b), "")
+	}
+	var e dns.Handler
+	e, err := newContextEngine(b, signedView, ks)
+	if err != nil {
+		return nil, err
 	}
 
-	// key setup
-	if cfg.PublicKey != "" {
-		ecfg.KSK, ecfg.KSKPrivate, err = s.loadKey(cfg.PublicKey, cfg.PrivateKey)
+	var se *swappableEngine
+	if s.zskRoller != nil {
+		se = &swappableEngine{}
+		se.set(e)
+		e = se
+	}
+
+	mux := dns.NewServeMux()
+	engines := map[string]dns.Handler{".": e}
+
+	// Suffixes with their own key material get their own engine. The mux
+	// dispatches each query to the engine of the longest matching suffix.
+	for _, spec := range s.cfg.suffixKeys {
+		e, err := newContextEngine(b, signedView, suffixKeySets[spec.suffix])
 		if err != nil {
 			return nil, err
 		}
+
+		mux.Handle(spec.suffix, e)
+		engines[spec.suffix] = e
+	}
+
+	err = s.handleUnsignedNames(mux, b, engines)
+	if err != nil {
+		return nil, err
 	}
+	mux.Handle(".", &dsHandler{root: e, zones: engines})
 
-	if cfg.ZonePublicKey != "" {
-		ecfg.ZSK, ecfg.ZSKPrivate, err = s.loadKey(cfg.ZonePublicKey, cfg.ZonePrivateKey)
+	// Only now that the mux will be used is the ZSK rollover pointed at it.
+	if se != nil {
+		s.zskRoller.setEngine(se, func(ks *keySet) (dns.Handler, error) {
+			return newContextEngine(b, signedView, ks)
+		})
+	}
+	return mux, nil
+}
+
+// dns.ServeMux passes every DS query to the handler of the root, whichever
+// zone the name is in, so that a DS record at the apex of a zone is answered
+// from the zone above it. The root's handler is wrapped in this, which passes
+// DS queries for names below the apex of one of zones, by apex, to its
+// handler instead.
+type dsHandler struct {
+	root  dns.Handler
+	zones map[string]dns.Handler
+}
+
+func (h *dsHandler) ServeDNS(rw dns.ResponseWriter, req *dns.Msg) {
+	if len(req.Question) > 0 && req.Question[0].Qtype == dns.TypeDS {
+		name := strings.ToLower(req.Question[0].Name)
+		for off, end := dns.NextLabel(name, 0); !end; off, end = dns.NextLabel(name, off) {
+			if zh, ok := h.zones[name[off:]]; ok {
+				zh.ServeDNS(rw, req)
+				return
+			}
+		}
+	}
+
+	h.root.ServeDNS(rw, req)
+}
+
+func (s *Server) newFetcher() (backend.Fetcher, error) {
+	f, err := s.sourceFetcher()
+	if err != nil || s.cfg.RPCRecordDir == "" {
+		return f, err
+	}
+
+	names := splitList(s.cfg.RPCRecordNames)
+	if len(names) == 0 {
+		return nil, configError("RPCRecordDir requires RPCRecordNames")
+	}
+	rf, err := backend.NewRecordingFetcher(f, s.cfg.cpath(s.cfg.RPCRecordDir), names)
+	if err != nil {
+		return nil, configError("RPCRecordDir: %v", err)
+	}
+	return rf, nil
+}
+
+// Returns the Fetcher of the values which are served.
+func (s *Server) sourceFetcher() (backend.Fetcher, error) {
+	if s.cfg.fetcher != nil {
+		return s.cfg.fetcher, nil
+	}
+
+	switch s.cfg.Fetcher {
+	case "", "namecoind":
+		return backend.NewNamecoinFetcher(s.namecoinConn, time.Duration(s.cfg.RPC.Timeout)*time.Millisecond), nil
+	case "static":
+		if s.cfg.StaticDataDir == "" {
+			return nil, configError("Must specify StaticDataDir for the static fetcher")
+		}
+		f, err := backend.NewStaticFetcher(s.cfg.cpath(s.cfg.StaticDataDir))
+		if err != nil {
+			return nil, err
+		}
+		return f, nil
+	case "fixture":
+		if s.cfg.FixtureFile == "" {
+			return nil, configError("Must specify FixtureFile for the fixture fetcher")
+		}
+		f, err := backend.NewFixtureFetcher(s.cfg.cpath(s.cfg.FixtureFile))
 		if err != nil {
 			return nil, err
 		}
+		return f, nil
+	default:
+		return nil, configError("Unknown fetcher: %q", s.cfg.Fetcher)
 	}
+}
 
-	if ecfg.KSK != nil && ecfg.ZSK == nil {
-		return nil, fmt.Errorf("Must specify ZSK if KSK is specified")
-	}
+func (s *Server) loadKey(fn, privateFn string) (k *dns.DNSKEY, privatek crypto.PrivateKey, err error) {
+	privateFn = s.cfg.cpath(privateFn)
 
-	s.engine, err = madns.NewEngine(ecfg)
+	k, err = s.cfg.loadPublicKey(fn)
 	if err != nil {
 		return
 	}
 
-	s.mux = dns.NewServeMux()
-	s.mux.Handle(".", s.engine)
-
-	tcpAddr, err := net.ResolveTCPAddr("tcp", s.cfg.Bind)
+	err = checkKeyAlgorithm(k.Algorithm)
 	if err != nil {
+		err = fmt.Errorf("Can't use key %s: %v", s.cfg.cpath(fn), err)
 		return
 	}
 
-	s.tcpListener, err = net.ListenTCP("tcp", tcpAddr)
+	// Read before its permissions are checked, so that a read which hangs
+	// is bounded by StartupIOTimeout.
+	b, err := s.cfg.readStartupFile(keyRole(k)+" private key", privateFn)
 	if err != nil {
 		return
 	}
 
-	udpAddr, err := net.ResolveUDPAddr("udp", s.cfg.Bind)
+	err = s.checkKeyPermissions(privateFn)
 	if err != nil {
 		return
 	}
 
-	s.udpConn, err = net.ListenUDP("udp", udpAddr)
+	privatek, err = k.ReadPrivateKey(bytes.NewReader(b), privateFn)
 	if err != nil {
 		return
 	}
 
-	if cfg.HTTPListenAddr != "" {
-		err = webStart(cfg.HTTPListenAddr, s)
+	err = checkKeyPair(k, privatek, privateFn)
+	return
+}
+
+// Returns the connection configurations of the namecoind nodes in
+// NamecoinRPCEndpoints, in order of preference. Each address may carry its own
+// credentials, as "user:password@host:port"; otherwise NamecoinRPCUsername and
+// NamecoinRPCPassword are used. NamecoinRPCCookiePath is either one cookie
+// path for every node or a list with one for each.
+func (cfg *Config) namecoinConnConfigs(network *namecoin.Network) ([]*rpcclient.ConnConfig, error) {
+	addrs := splitList(cfg.RPC.Endpoints)
+	if len(addrs) == 0 {
+		addrs = []string{""}
+	}
+
+	cookiePaths := splitList(cfg.RPC.CookiePath)
+	switch len(cookiePaths) {
+	case 0:
+		cookiePaths = []string{""}
+		fallthrough
+	case 1:
+		for len(cookiePaths) < len(addrs) {
+			cookiePaths = append(cookiePaths, cookiePaths[0])
+		}
+	case len(addrs):
+	default:
+		return nil, fmt.Errorf("NamecoinRPCCookiePath must be one path, or one for each of the %d addresses in NamecoinRPCEndpoints", len(addrs))
+	}
+
+	var connCfgs []*rpcclient.ConnConfig
+	for i, addr := range addrs {
+		// Connect using HTTP POST mode, as Namecoin Core only supports
+		// that, and without TLS, which it doesn't provide.
+		connCfg := &rpcclient.ConnConfig{
+			Host:         addr,
+			User:         cfg.RPC.Username,
+			Pass:         cfg.RPC.Password,
+			CookiePath:   cookiePaths[i],
+			HTTPPostMode: true,
+			DisableTLS:   true,
+		}
+		if at := strings.LastIndex(addr, "@"); at >= 0 {
+			creds := addr[:at]
+			connCfg.Host = addr[at+1:]
+			colon := strings.Index(creds, ":")
+			if colon < 0 {
+				return nil, fmt.Errorf("credentials in NamecoinRPCEndpoints must be given as user:password@host:port")
+			}
+			connCfg.User, connCfg.Pass = creds[:colon], creds[colon+1:]
+		}
+		if len(addrs) > 1 && connCfg.Host == "" {
+			return nil, fmt.Errorf("empty address in NamecoinRPCEndpoints")
+		}
+
+		network.SetDefaults(connCfg)
+		connCfgs = append(connCfgs, connCfg)
+	}
+
+	return connCfgs, nil
+}
+
+// Returns the items of a comma-separated list, with surrounding space and
+// empty items removed.
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func (cfg *Config) namecoinTLSConfig() (*namecoin.TLSConfig, error) {
+	pins, err := namecoin.ParseSPKIPins(cfg.RPC.TLSPinSPKI)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.RPC.TLSPinOnly && len(pins) == 0 {
+		return nil, fmt.Errorf("NamecoinRPCTLSPinOnly requires NamecoinRPCTLSPinSPKI")
+	}
+
+	tlsCfg := &namecoin.TLSConfig{
+		PinSPKI:    pins,
+		PinOnly:    cfg.RPC.TLSPinOnly,
+		ServerName: cfg.RPC.TLSServerName,
+	}
+	if cfg.RPC.TLSPinOnly && cfg.RPC.TLSServerName != "" {
+		return nil, fmt.Errorf("NamecoinRPCTLSServerName has no effect with NamecoinRPCTLSPinOnly, as the certificate's names aren't checked")
+	}
+
+	if (cfg.RPC.TLSClientCert == "") != (cfg.RPC.TLSClientKey == "") {
+		return nil, fmt.Errorf("NamecoinRPCTLSClientCert and NamecoinRPCTLSClientKey must be set together")
+	}
+	if cfg.RPC.TLSClientCert != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.cpath(cfg.RPC.TLSClientCert), cfg.cpath(cfg.RPC.TLSClientKey))
 		if err != nil {
-			return
+			return nil, fmt.Errorf("couldn't load NamecoinRPCTLSClientCert: %v", err)
 		}
+		tlsCfg.Certificates = []tls.Certificate{cert}
 	}
+	if cfg.RPC.TLSCAFile != "" {
+		pem, err := ioutil.ReadFile(cfg.cpath(cfg.RPC.TLSCAFile))
+		if err != nil {
+			return nil, err
+		}
 
-	return
+		tlsCfg.RootCAs = x509.NewCertPool()
+		if !tlsCfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in NamecoinRPCTLSCAFile")
+		}
+	}
+
+	return tlsCfg, nil
 }
 
-func (s *Server) loadKey(fn, privateFn string) (k *dns.DNSKEY, privatek crypto.PrivateKey, err error) {
-	fn = s.cfg.cpath(fn)
-	privateFn = s.cfg.cpath(privateFn)
+func (cfg *Config) loadPublicKey(fn string) (*dns.DNSKEY, error) {
+	fn = cfg.cpath(fn)
 
-	f, err := os.Open(fn)
+	b, err := cfg.readStartupFile("public key", fn)
 	if err != nil {
-		return
+		return nil, err
 	}
 
-	rr, err := dns.ReadRR(f, fn)
+	rr, err := dns.ReadRR(bytes.NewReader(b), fn)
 	if err != nil {
-		return
+		return nil, err
 	}
 
 	k, ok := rr.(*dns.DNSKEY)
 	if !ok {
-		err = fmt.Errorf("Loaded record from key file, but it wasn't a DNSKEY")
-		return
+		return nil, fmt.Errorf("Loaded record from key file, but it wasn't a DNSKEY")
 	}
 
-	privatef, err := os.Open(privateFn)
-	if err != nil {
-		return
+	return k, nil
+}
+
+// Returns "KSK" or "ZSK", as k has the SEP flag or not, to name it in logs.
+func keyRole(k *dns.DNSKEY) string {
+	if k.Flags&dns.SEP != 0 {
+		return "KSK"
 	}
+	return "ZSK"
+}
 
-	privatek, err = k.ReadPrivateKey(privatef, privateFn)
-	log.Fatale(err)
+// LoadKSK loads the configured KSK public key without starting a server.
+func (cfg *Config) LoadKSK() (*dns.DNSKEY, error) {
+	if cfg.DNSSEC.PublicKey == "" {
+		return nil, fmt.Errorf("No KSK configured (publickey is not set)")
+	}
 
-	return
+	return cfg.loadPublicKey(cfg.DNSSEC.PublicKey)
 }
 
+// Start starts the DNS listeners and the background tasks. It may only be
+// called once, and not once the server has been stopped; otherwise it returns
+// an error of kind ErrInvalidState.
 func (s *Server) Start() error {
-	s.wgStart.Add(2)
-	s.udpServer = s.runListener("udp")
-	s.tcpServer = s.runListener("tcp")
+	// A reload finishing moves the server to running too, so it's only
+	// started from starting.
+	_, err := s.lifecycle.transition("start", stateRunning, func() error {
+		if s.lifecycle.state != stateStarting {
+			return s.lifecycle.refuse("start")
+		}
+		return s.start()
+	})
+	return err
+}
+
+func (s *Server) start() error {
+	atomic.StoreInt64(&s.startedAt, clock.Or(s.clock).Now().UnixNano())
+	s.exportDS()
+	s.logTrustSetup()
+
+	s.wgStart.Add(len(s.udpConns) + len(s.tcpListeners) + len(s.tlsListeners))
+	s.listenersMu.Lock()
+	for _, conn := range s.udpConns {
+		s.dnsServers = append(s.dnsServers, s.runListener("udp", conn, nil, s.wgStart.Done))
+	}
+	for _, listener := range s.tcpListeners {
+		s.dnsServers = append(s.dnsServers, s.runListener("tcp", nil, listener, s.wgStart.Done))
+	}
+	for _, listener := range s.tlsListeners {
+		s.dnsServers = append(s.dnsServers, s.runListener("tcp-tls", nil, listener, s.wgStart.Done))
+	}
+	s.listenersMu.Unlock()
 	s.wgStart.Wait()
-	log.Info("Listeners started")
+
+	var addrs []string
+	for _, a := range s.UDPAddrs() {
+		addrs = append(addrs, a.String())
+	}
+	if len(addrs) > 0 {
+		log.Infof("Listeners started on %s (UDP)", strings.Join(addrs, ", "))
+	}
+	addrs = nil
+	for _, a := range s.TCPAddrs() {
+		addrs = append(addrs, a.String())
+	}
+	if len(addrs) > 0 {
+		log.Infof("Listeners started on %s (TCP)", strings.Join(addrs, ", "))
+	}
+	if len(s.tlsListeners) > 0 {
+		addrs = nil
+		for _, a := range s.TLSAddrs() {
+			addrs = append(addrs, a.String())
+		}
+		log.Infof("Listeners started on %s (DNS over TLS)", strings.Join(addrs, ", "))
+	}
+
+	if s.web != nil {
+		s.web.start()
+		log.Infof("Webserver started on %s", s.web.addr())
+	}
+
+	if s.acme != nil {
+		go s.acme.obtain()
+	}
+
+	if s.certReloader != nil && s.cfg.TLSCertReloadInterval > 0 {
+		go s.certReloader.run(time.Duration(s.cfg.TLSCertReloadInterval) * time.Second)
+	}
+
+	if s.parentChecker != nil {
+		go s.parentChecker.run()
+	}
+
+	if s.peerChecker != nil {
+		go s.peerChecker.run()
+	}
+
+	if s.watchdog != nil {
+		go s.watchdog.run()
+	}
+
+	if s.rpz != nil {
+		go s.rpz.run()
+	}
+
+	if s.healthChecker != nil {
+		go s.healthChecker.run()
+	}
+
+	if s.blockWatcher != nil {
+		go s.blockWatcher.run()
+	}
+
+	if s.notifier != nil {
+		s.notifier.start()
+	}
+
+	if s.cfg.Cache.IdleEviction > 0 {
+		go s.runIdleEviction()
+	}
+
+	if s.cachePersister != nil {
+		go s.cachePersister.run()
+	}
+
+	if s.memoryWatcher != nil {
+		go s.memoryWatcher.run()
+	}
+
+	if s.zskRoller != nil {
+		go s.zskRoller.run()
+	}
+
+	if s.rrl != nil {
+		go s.rrl.run(rrlReportInterval)
+	}
+
+	if s.cookies != nil {
+		go s.cookies.run()
+	}
+
+	if s.servfailAlerter != nil {
+		go s.servfailAlerter.run()
+	}
+
+	if s.trustSetup != nil {
+		// start is called with the lifecycle locked.
+		go s.trustSetup.run(s.lifecycle.stoppedChan())
+	}
+
+	go s.selfNames.run(s.lifecycle.stoppedChan())
+
+	if s.cfg.EDNSReportInterval > 0 {
+		go s.ednsStats.run(time.Duration(s.cfg.EDNSReportInterval) * time.Second)
+	}
+
+	if s.cfg.usesNamecoind() {
+		go s.checkNetwork()
+	}
 
 	return s.StartBackgroundTasks()
 }
 
 func (s *Server) doRunListener(ds *dns.Server) {
 	err := ds.ActivateAndServe()
+	if err != nil && s.watchdog != nil {
+		// Left for the watchdog to restart.
+		log.Errore(err, "the DNS listener on ", ds.Addr, " stopped")
+		return
+	}
 	log.Fatale(err)
 }
 
-func (s *Server) runListener(net string) *dns.Server {
+// Serves DNS on a listener, calling started once it's serving.
+func (s *Server) runListener(net string, conn *net.UDPConn, listener net.Listener, started func()) *dns.Server {
 	ds := &dns.Server{
-		Addr:    s.cfg.Bind,
-		Net:     net,
-		Handler: s.mux,
-		NotifyStartedFunc: func() {
-			s.wgStart.Done()
-		},
+		Net:               net,
+		Handler:           s,
+		TsigSecret:        s.tsigSecrets(),
+		MsgAcceptFunc:     s.acceptMsg,
+		NotifyStartedFunc: started,
+		ReadTimeout:       time.Duration(s.cfg.TCPReadTimeout) * time.Millisecond,
+		IdleTimeout:       s.tcpIdleTimeout,
+		MaxTCPQueries:     -1,
 	}
 	switch net {
 	case "tcp":
-		ds.Listener = s.tcpListener
+		ds.Addr = listener.Addr().String()
+		ds.Listener = s.tcpConns.wrap(listener)
+	case "tcp-tls":
+		ds.Addr = listener.Addr().String()
+		ds.Listener = tls.NewListener(s.tcpConns.wrap(listener), s.tlsConfig())
 	case "udp":
-		ds.PacketConn = s.udpConn
+		ds.Addr = conn.LocalAddr().String()
+		ds.PacketConn = conn
 	default:
 		panic("unreachable")
 	}
@@ -257,6 +1449,79 @@ func (s *Server) runListener(net string) *dns.Server {
 	return ds
 }
 
+// Stops the server, closing its sockets once the DNS queries and webserver
+// requests in progress have been answered, or StopTimeout has passed. A drain
+// in progress is cut short; to drain the server first, as ncdns does on
+// SIGTERM if DrainOnSIGTERM is set, call Drain instead. It's safe to call Stop
+// in any state, including before Start, and more than once.
 func (s *Server) Stop() error {
-	return nil // TODO
+	return s.stop()
+}
+
+// Stops the server by the steps registered with s.shutdown: the DNS listeners
+// and the webserver first, waiting at most StopTimeout for the queries and
+// requests in progress to be answered and the work queued for background
+// tasks to be done, then writes out what's kept in memory and closes the
+// connections and sockets left. It's safe to call before Start, and more than
+// once: only the first call does anything, and later calls return its result.
+func (s *Server) stop() error {
+	// Any state may be left for stateStopped, so this only fails if the
+	// server is stopped already.
+	s.lifecycle.transition("stop", stateStopped, nil)
+
+	s.stopOnce.Do(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(s.cfg.StopTimeout)*time.Second)
+		defer cancel()
+
+		s.stopErr = s.shutdown.run(ctx)
+	})
+	return s.stopErr
+}
+
+// Registers the steps which stop the parts of the server set up by newServer
+// itself. Other components register theirs as they're set up.
+func (s *Server) registerShutdown() {
+	s.shutdown.register(shutdownIntake, "server context", func(context.Context) error {
+		s.cancel()
+		return nil
+	})
+	s.shutdown.register(shutdownIntake, "DNS listeners", func(ctx context.Context) error {
+		s.listenersMu.RLock()
+		dnsServers := s.dnsServers
+		s.listenersMu.RUnlock()
+
+		var wg sync.WaitGroup
+		for _, ds := range dnsServers {
+			wg.Add(1)
+			go func(ds *dns.Server) {
+				defer wg.Done()
+				err := ds.ShutdownContext(ctx)
+				if err == context.DeadlineExceeded {
+					log.Warnf("stopping: DNS queries to %s still in progress after %ds, stopping anyway", ds.Addr, s.cfg.StopTimeout)
+				} else {
+					log.Warne(err, "couldn't stop DNS listener on ", ds.Addr)
+				}
+			}(ds)
+		}
+		wg.Wait()
+		return nil
+	})
+	s.shutdown.register(shutdownDrain, "event bus", s.bus.drain)
+	s.shutdown.register(shutdownFlush, "tracing", func(context.Context) error {
+		return tracing.Shutdown()
+	})
+	s.shutdown.register(shutdownClose, "listeners", func(context.Context) error {
+		s.listenersMu.Lock()
+		defer s.listenersMu.Unlock()
+
+		s.dnsServers = nil
+		s.closeListeners()
+		return nil
+	})
+	if s.namecoinConn != nil {
+		s.shutdown.register(shutdownClose, "namecoind connection", func(context.Context) error {
+			s.namecoinConn.Shutdown()
+			return nil
+		})
+	}
 }
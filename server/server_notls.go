@@ -6,3 +6,7 @@ package server
 func (s *Server) StartBackgroundTasks() error {
 	return nil
 }
+
+func init() {
+	registerExcluded("namecoin_tls")
+}
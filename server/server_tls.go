@@ -11,7 +11,7 @@ import (
 )
 
 func (s *Server) StartBackgroundTasks() error {
-	err := tlsoverridefirefoxsync.Start(s.namecoinConn, s.cfg.CanonicalSuffix)
+	err := tlsoverridefirefoxsync.Start(s.namecoinConn, s.cfg.CanonicalSuffix, s.zoneWalkPacer)
 	if err != nil {
 		return fmt.Errorf("Couldn't start Firefox override sync: %s", err)
 	}
@@ -23,3 +23,9 @@ func (s *Server) StartBackgroundTasks() error {
 
 	return nil
 }
+
+func init() {
+	registerCapability("namecoin_tls", func(*Server) string {
+		return capabilityEnabled
+	})
+}
@@ -0,0 +1,200 @@
+package server
+
+import (
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/namecoin/ncdns/clock"
+)
+
+// An alert raised while the ratio of SERVFAIL responses stays above
+// ServfailAlertRatio clears only once it stays below this fraction of it, so
+// that a ratio hovering around the threshold doesn't raise and clear it over
+// and over.
+const servfailClearFactor = 0.5
+
+// Posted to AlertWebhook when the alert is raised or cleared.
+type servfailAlert struct {
+	Alert         string    `json:"alert"` // servfail_ratio
+	State         string    `json:"state"` // firing or resolved
+	Time          time.Time `json:"time"`
+	Ratio         float64   `json:"ratio"`
+	Threshold     float64   `json:"threshold"`
+	Responses     uint64    `json:"responses"` // in the window
+	WindowSeconds int       `json:"window_seconds"`
+}
+
+type rcodeBucket struct {
+	sec           int64 // Unix time of the second counted
+	total, failed uint64
+}
+
+// Watches the ratio of responses which are SERVFAIL, and optionally REFUSED,
+// over a sliding window, raising an alert once it has been above threshold for
+// duration, and clearing it once it has been below threshold times
+// servfailClearFactor for as long.
+type servfailAlerter struct {
+	threshold    float64
+	duration     time.Duration
+	countRefused bool
+	minResponses uint64
+
+	// No alert is raised before this, while the caches are filling.
+	warmupUntil time.Time
+
+	clock   clock.Clock
+	webhook string // "" if not set
+
+	mu      sync.Mutex
+	buckets []rcodeBucket // one for each second of the window, by Unix time modulo its length
+	firing  bool
+	since   time.Time // when the ratio crossed to the other side of the threshold from the state; zero if it hasn't
+}
+
+func newServfailAlerter(threshold float64, window, duration, warmup time.Duration, minResponses int, countRefused bool, webhook string, c clock.Clock) *servfailAlerter {
+	c = clock.Or(c)
+	n := int(window / time.Second)
+	if n < 1 {
+		n = 1
+	}
+	return &servfailAlerter{
+		threshold:    threshold,
+		duration:     duration,
+		countRefused: countRefused,
+		minResponses: uint64(minResponses),
+		warmupUntil:  c.Now().Add(warmup),
+		clock:        c,
+		webhook:      webhook,
+		buckets:      make([]rcodeBucket, n),
+	}
+}
+
+// Counts a response with the given rcode.
+func (a *servfailAlerter) observe(rcode int) {
+	sec := a.clock.Now().Unix()
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	b := &a.buckets[sec%int64(len(a.buckets))]
+	if b.sec != sec {
+		*b = rcodeBucket{sec: sec}
+	}
+	b.total++
+	if rcode == dns.RcodeServerFailure || (a.countRefused && rcode == dns.RcodeRefused) {
+		b.failed++
+	}
+}
+
+// Returns the ratio of failures among the responses in the window ending at
+// now, and the number of responses. Called with mu held.
+func (a *servfailAlerter) ratio(now time.Time) (float64, uint64) {
+	oldest := now.Unix() - int64(len(a.buckets))
+	var total, failed uint64
+	for _, b := range a.buckets {
+		if b.sec > oldest {
+			total += b.total
+			failed += b.failed
+		}
+	}
+	if total == 0 {
+		return 0, 0
+	}
+	return float64(failed) / float64(total), total
+}
+
+// Checks the ratio, returning the alert to report if it has just been raised
+// or cleared, or nil.
+func (a *servfailAlerter) evaluate() *servfailAlert {
+	now := a.clock.Now()
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	ratio, total := a.ratio(now)
+	var crossed bool
+	if a.firing {
+		crossed = ratio < a.threshold*servfailClearFactor
+	} else {
+		crossed = now.After(a.warmupUntil) && total >= a.minResponses && ratio > a.threshold
+	}
+	if !crossed {
+		a.since = time.Time{}
+		return nil
+	}
+	if a.since.IsZero() {
+		a.since = now
+	}
+	if now.Sub(a.since) < a.duration {
+		return nil
+	}
+
+	a.firing = !a.firing
+	a.since = time.Time{}
+	alert := &servfailAlert{
+		Alert:         "servfail_ratio",
+		State:         "resolved",
+		Time:          now.UTC(),
+		Ratio:         ratio,
+		Threshold:     a.threshold,
+		Responses:     total,
+		WindowSeconds: len(a.buckets),
+	}
+	if a.firing {
+		alert.State = "firing"
+	}
+	return alert
+}
+
+func (a *servfailAlerter) report(alert *servfailAlert) {
+	what := "SERVFAIL"
+	if a.countRefused {
+		what = "SERVFAIL or REFUSED"
+	}
+	if alert.State == "firing" {
+		log.Errorf("%.1f%% of the %d responses in the last %ds were %s, above ServfailAlertRatio (%.1f%%) for %v",
+			alert.Ratio*100, alert.Responses, alert.WindowSeconds, what, alert.Threshold*100, a.duration)
+	} else {
+		log.Infof("%.1f%% of the %d responses in the last %ds were %s; the alert is cleared",
+			alert.Ratio*100, alert.Responses, alert.WindowSeconds, what)
+	}
+
+	if a.webhook != "" {
+		log.Warne(postWebhook(a.webhook, alert), "couldn't call the alert webhook")
+	}
+}
+
+func (a *servfailAlerter) run() {
+	for {
+		<-a.clock.NewTimer(time.Second).C()
+		if alert := a.evaluate(); alert != nil {
+			a.report(alert)
+		}
+	}
+}
+
+// Sets up the SERVFAIL alert, if ServfailAlertRatio is set.
+func (s *Server) setupServfailAlert() error {
+	cfg := &s.cfg
+	if cfg.ServfailAlertRatio < 0 || cfg.ServfailAlertRatio >= 1 {
+		return configError("ServfailAlertRatio must be at least 0 and below 1")
+	}
+	if cfg.ServfailAlertRatio == 0 {
+		return nil
+	}
+	if cfg.ServfailAlertWindow < 1 {
+		return configError("ServfailAlertWindow must be at least 1")
+	}
+	if cfg.ServfailAlertDuration < 0 || cfg.ServfailAlertWarmup < 0 || cfg.ServfailAlertMinResponses < 0 {
+		return configError("ServfailAlertDuration, ServfailAlertWarmup and ServfailAlertMinResponses must not be negative")
+	}
+
+	s.servfailAlerter = newServfailAlerter(cfg.ServfailAlertRatio,
+		time.Duration(cfg.ServfailAlertWindow)*time.Second,
+		time.Duration(cfg.ServfailAlertDuration)*time.Second,
+		time.Duration(cfg.ServfailAlertWarmup)*time.Second,
+		cfg.ServfailAlertMinResponses, cfg.ServfailAlertRefused, cfg.AlertWebhook, s.clock)
+	return nil
+}
@@ -0,0 +1,119 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/namecoin/ncdns/testutil"
+)
+
+// Feeds a second's worth of responses, failed of which are SERVFAIL, to a,
+// then evaluates it.
+func feedSecond(a *servfailAlerter, clk *testutil.FakeClock, total, failed int) *servfailAlert {
+	for i := 0; i < total; i++ {
+		rcode := dns.RcodeSuccess
+		if i < failed {
+			rcode = dns.RcodeServerFailure
+		}
+		a.observe(rcode)
+	}
+	clk.Advance(time.Second)
+	return a.evaluate()
+}
+
+func TestServfailAlert(t *testing.T) {
+	clk := testutil.NewFakeClock(time.Unix(1600000000, 0))
+	a := newServfailAlerter(0.1, 10*time.Second, 30*time.Second, 60*time.Second, 50, false, "", clk)
+
+	var alerts []*servfailAlert
+	feed := func(seconds, total, failed int) {
+		for i := 0; i < seconds; i++ {
+			if alert := feedSecond(a, clk, total, failed); alert != nil {
+				alerts = append(alerts, alert)
+			}
+		}
+	}
+
+	// Nothing is raised while warming up, however bad it is.
+	feed(59, 100, 100)
+	if len(alerts) != 0 {
+		t.Fatalf("alert raised while warming up: %+v", alerts[0])
+	}
+	clk.Advance(10 * time.Second)
+
+	// A healthy server with the odd failure raises nothing.
+	feed(30, 100, 5)
+	if len(alerts) != 0 {
+		t.Fatalf("alert raised below the threshold: %+v", alerts[0])
+	}
+
+	// Nor do failures while there's little traffic.
+	feed(30, 2, 2)
+	if len(alerts) != 0 {
+		t.Fatalf("alert raised with fewer than the minimum of responses: %+v", alerts[0])
+	}
+
+	// A burst shorter than the duration raises nothing.
+	feed(15, 100, 5)
+	feed(3, 100, 100)
+	feed(15, 100, 0)
+	if len(alerts) != 0 {
+		t.Fatalf("alert raised by a short burst: %+v", alerts[0])
+	}
+
+	// Failures sustained for longer do.
+	feed(40, 100, 50)
+	if len(alerts) != 1 || alerts[0].State != "firing" || alerts[0].Ratio <= 0.1 || alerts[0].Threshold != 0.1 || alerts[0].WindowSeconds != 10 {
+		t.Fatalf("got %+v; expected the alert to be raised", alerts)
+	}
+
+	// The ratio dropping below the threshold, but not below half of it,
+	// doesn't clear the alert.
+	feed(40, 100, 8)
+	if len(alerts) != 1 {
+		t.Fatalf("alert cleared above half the threshold: %+v", alerts[1])
+	}
+
+	feed(50, 100, 1)
+	if len(alerts) != 2 || alerts[1].State != "resolved" || alerts[1].Ratio >= 0.05 {
+		t.Fatalf("got %+v; expected the alert to be cleared", alerts[1:])
+	}
+}
+
+func TestServfailAlertRefused(t *testing.T) {
+	clk := testutil.NewFakeClock(time.Unix(1600000000, 0))
+	for _, countRefused := range []bool{false, true} {
+		a := newServfailAlerter(0.1, 10*time.Second, 0, 0, 1, countRefused, "", clk)
+		clk.Advance(time.Second)
+		for i := 0; i < 10; i++ {
+			a.observe(dns.RcodeRefused)
+		}
+		clk.Advance(time.Second)
+		if alert := a.evaluate(); (alert != nil) != countRefused {
+			t.Errorf("countRefused %v: got alert %+v", countRefused, alert)
+		}
+	}
+}
+
+func TestServfailAlertWebhook(t *testing.T) {
+	posted := make(chan servfailAlert, 1)
+	hook := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		var alert servfailAlert
+		if err := json.NewDecoder(req.Body).Decode(&alert); err != nil {
+			t.Error(err)
+		}
+		posted <- alert
+	}))
+	defer hook.Close()
+
+	a := newServfailAlerter(0.1, time.Second, 0, 0, 1, false, hook.URL, nil)
+	a.report(&servfailAlert{Alert: "servfail_ratio", State: "firing", Ratio: 0.5, Threshold: 0.1, Responses: 10, WindowSeconds: 1})
+	if alert := <-posted; alert.State != "firing" || alert.Ratio != 0.5 {
+		t.Errorf("webhook got %+v", alert)
+	}
+}
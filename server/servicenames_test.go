@@ -0,0 +1,87 @@
+package server
+
+import (
+	"crypto"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/namecoin/ncdns/backend"
+)
+
+// Records at names with underscore labels, as used for mail authentication
+// and ACME, are answered and can be signed and validated like any other.
+func TestServiceNameRecordsSigned(t *testing.T) {
+	b, err := backend.New(&backend.Config{
+		CacheMaxEntries: 100,
+		FakeNames: map[string]string{
+			"d/example": `{"ip":"192.0.2.1","txt":"v=spf1 ip4:192.0.2.1 -all","map":{` +
+				`"_dmarc":{"txt":"v=DMARC1; p=reject; rua=mailto:dmarc@example.com"},` +
+				`"_domainkey":{"map":{"sel1":{"txt":["v=DKIM1; k=ed25519; p=11qYAYKxCrfVS/7TyWQHOg7hcvPapiMlrwIaaPcHURo="]}}},` +
+				`"_acme-challenge":{"txt":"LoqXcYV8q5ONbJQxbmR7SCTNo3tiAXDfowyjxAjEuX0"}}}`,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ks, err := generateKeySet("bit.")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for qname, expected := range map[string]string{
+		"example.bit.":                 "v=spf1 ip4:192.0.2.1 -all",
+		"_dmarc.example.bit.":          "v=DMARC1; p=reject; rua=mailto:dmarc@example.com",
+		"sel1._domainkey.example.bit.": "v=DKIM1; k=ed25519; p=11qYAYKxCrfVS/7TyWQHOg7hcvPapiMlrwIaaPcHURo=",
+		"_acme-challenge.example.bit.": "LoqXcYV8q5ONbJQxbmR7SCTNo3tiAXDfowyjxAjEuX0",
+	} {
+		rrs, err := b.Lookup(qname, "")
+		if err != nil {
+			t.Errorf("%s: %v", qname, err)
+			continue
+		}
+
+		var txts []dns.RR
+		for _, rr := range rrs {
+			if txt, ok := rr.(*dns.TXT); ok {
+				txts = append(txts, rr)
+				if len(txt.Txt) != 1 || txt.Txt[0] != expected {
+					t.Errorf("%s: got %v", qname, txt.Txt)
+				}
+			}
+		}
+		if len(txts) != 1 {
+			t.Errorf("%s: got %v, expected one TXT record", qname, rrs)
+			continue
+		}
+
+		sig := &dns.RRSIG{
+			Hdr:        dns.RR_Header{Name: qname, Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: 600},
+			KeyTag:     ks.ZSK.KeyTag(),
+			SignerName: ks.ZSK.Hdr.Name,
+			Algorithm:  ks.ZSK.Algorithm,
+			Inception:  uint32(time.Now().Add(-time.Hour).Unix()),
+			Expiration: uint32(time.Now().Add(time.Hour).Unix()),
+		}
+		if err := sig.Sign(ks.ZSKPrivate.(crypto.Signer), txts); err != nil {
+			t.Errorf("%s: couldn't sign: %v", qname, err)
+			continue
+		}
+		if err := sig.Verify(ks.ZSK, txts); err != nil {
+			t.Errorf("%s: signature didn't verify: %v", qname, err)
+		}
+	}
+
+	// Underscore names aren't hostnames, so have no addresses.
+	rrs, err := b.Lookup("_dmarc.example.bit.", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rr := range rrs {
+		if _, ok := rr.(*dns.A); ok {
+			t.Errorf("address served for _dmarc.example.bit.: %v", rr)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package server
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// The phases in which the server stops, in order. Every step of a phase is
+// done, or given up on, before the next phase starts; the steps of one phase
+// run at once.
+type shutdownPhase int
+
+const (
+	// No more DNS queries or HTTP requests are accepted, and those in
+	// progress are answered. The server's context is cancelled, ending event
+	// streams and other work done on its behalf.
+	shutdownIntake shutdownPhase = iota
+
+	// Background tasks stop, finishing the work already queued for them,
+	// such as events for webhooks and NOTIFYs.
+	shutdownDrain
+
+	// What's been kept in memory is written out: the query log, traces and
+	// the like.
+	shutdownFlush
+
+	// Connections to namecoind are closed, along with any sockets left.
+	shutdownClose
+
+	numShutdownPhases
+)
+
+var shutdownPhaseNames = [numShutdownPhases]string{"intake", "drain", "flush", "close"}
+
+func (p shutdownPhase) String() string {
+	return shutdownPhaseNames[p]
+}
+
+// Once StopTimeout has passed, the steps of each phase left are still started,
+// and given this long before they're given up on.
+const shutdownLateGrace = time.Second
+
+// The steps by which the server stops, registered by each component as it's
+// set up.
+type shutdownSequence struct {
+	mu    sync.Mutex
+	steps [numShutdownPhases][]*shutdownStep
+}
+
+type shutdownStep struct {
+	name string
+
+	// Stops the component. It should give up once ctx is done, but if it
+	// doesn't, the sequence carries on without it.
+	f func(ctx context.Context) error
+}
+
+// Adds a step named name to phase, which stops a component by calling f.
+func (q *shutdownSequence) register(phase shutdownPhase, name string, f func(ctx context.Context) error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.steps[phase] = append(q.steps[phase], &shutdownStep{name: name, f: f})
+}
+
+// Runs the steps of each phase in turn, until ctx is done, logging those which
+// fail or don't finish in time. Returns the first error.
+func (q *shutdownSequence) run(ctx context.Context) error {
+	q.mu.Lock()
+	steps := q.steps
+	q.mu.Unlock()
+
+	var firstErr error
+	for phase, phaseSteps := range steps {
+		if len(phaseSteps) == 0 {
+			continue
+		}
+
+		phaseCtx := ctx
+		if ctx.Err() != nil {
+			var cancel context.CancelFunc
+			phaseCtx, cancel = context.WithTimeout(context.Background(), shutdownLateGrace)
+			defer cancel()
+		}
+
+		errs := make([]error, len(phaseSteps))
+		done := make([]chan struct{}, len(phaseSteps))
+		for i, step := range phaseSteps {
+			done[i] = make(chan struct{})
+			go func(i int, step *shutdownStep) {
+				defer close(done[i])
+				errs[i] = step.f(phaseCtx)
+			}(i, step)
+		}
+
+		for i, step := range phaseSteps {
+			select {
+			case <-done[i]:
+				if errs[i] != nil {
+					log.Warne(errs[i], "stopping: ", step.name)
+					if firstErr == nil {
+						firstErr = errs[i]
+					}
+				}
+			case <-phaseCtx.Done():
+				log.Warnf("stopping: %s still in progress after StopTimeout (%s phase), carrying on without it", step.name, shutdownPhase(phase))
+			}
+		}
+	}
+	return firstErr
+}
@@ -0,0 +1,88 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Components registered out of order are stopped phase by phase, and one
+// which never stops holds up neither the phases after it nor stop.
+func TestShutdownSequence(t *testing.T) {
+	var q shutdownSequence
+	var mu sync.Mutex
+	var stopped []string
+	component := func(phase shutdownPhase, name string, err error) {
+		q.register(phase, name, func(context.Context) error {
+			mu.Lock()
+			defer mu.Unlock()
+			stopped = append(stopped, phase.String()+" "+name)
+			return err
+		})
+	}
+
+	stuck := make(chan struct{})
+	defer close(stuck)
+	q.register(shutdownDrain, "stuck", func(context.Context) error {
+		<-stuck
+		return nil
+	})
+	component(shutdownClose, "namecoind", nil)
+	component(shutdownFlush, "journal", errors.New("disk full"))
+	component(shutdownDrain, "webhooks", nil)
+	component(shutdownIntake, "listeners", nil)
+	component(shutdownFlush, "stats", errors.New("too late"))
+	component(shutdownIntake, "webserver", nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err := q.run(ctx)
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond+3*shutdownLateGrace {
+		t.Errorf("took %v", elapsed)
+	}
+	if err == nil || err.Error() != "disk full" {
+		t.Errorf("got error %v, expected the first step's", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(stopped) != 6 {
+		t.Fatalf("stopped %v", stopped)
+	}
+	phases := map[string]int{}
+	for i, s := range stopped {
+		phases[s] = i
+	}
+	for _, order := range [][2]string{
+		{"intake listeners", "drain webhooks"},
+		{"intake webserver", "drain webhooks"},
+		{"drain webhooks", "flush journal"},
+		{"drain webhooks", "flush stats"},
+		{"flush journal", "close namecoind"},
+		{"flush stats", "close namecoind"},
+	} {
+		if phases[order[0]] > phases[order[1]] {
+			t.Errorf("%s stopped after %s: %s", order[0], order[1], strings.Join(stopped, ", "))
+		}
+	}
+}
+
+// A server cancels its context when stopped, even if it was never started.
+func TestStopCancelsContext(t *testing.T) {
+	s := &Server{}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	s.registerShutdown()
+
+	if err := s.stop(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-s.ctx.Done():
+	default:
+		t.Error("context not cancelled")
+	}
+}
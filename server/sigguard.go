@@ -0,0 +1,237 @@
+package server
+
+import (
+	"crypto"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/namecoin/ncdns/clock"
+)
+
+// RRSIGs in a response which expire within this long of the time it's served
+// are made again before it's sent.
+const sigGuardTolerance = time.Minute
+
+// The validity period of a signature made again starts this long before it's
+// made, for clients whose clocks are behind, and lasts as long as that of the
+// signature it replaces, but at least sigGuardMinValidity.
+const (
+	sigGuardBackdate    = time.Hour
+	sigGuardMinValidity = 24 * time.Hour
+)
+
+// What to do with a response containing an expired RRSIG which couldn't be
+// made again, as given by Config.ClockSkewPolicy.
+const (
+	clockSkewServFail = "servfail" // answer SERVFAIL
+	clockSkewUnsigned = "unsigned" // strip the RRSIGs and answer unsigned
+)
+
+type sigGuardStatus struct {
+	Policy     string `json:"clock_skew_policy"`
+	Resigned   uint64 `json:"resigned"`
+	Unrepaired uint64 `json:"unrepaired"`
+}
+
+// Checks every signed response as the last step before it's sent, so that an
+// RRSIG which has expired is never served. This can happen if the system clock
+// has been stepped forward since the response was signed. Each such RRSIG is
+// replaced with a new one made from the response's copy of the RRset. If that
+// isn't possible, the response is handled according to the policy.
+type sigGuard struct {
+	s      *Server
+	policy string
+	clock  clock.Clock
+
+	resigned   uint64 // accessed atomically
+	unrepaired uint64 // accessed atomically
+
+	mu          sync.Mutex
+	lastWarning time.Time
+	lastError   time.Time
+}
+
+func newSigGuard(s *Server, policy string) *sigGuard {
+	return &sigGuard{
+		s:      s,
+		policy: policy,
+		clock:  clock.Or(s.clock),
+	}
+}
+
+// Wraps rw so that expired RRSIGs are never written to it.
+func (s *Server) sigGuardWriter(rw dns.ResponseWriter) dns.ResponseWriter {
+	if s.sigGuard == nil {
+		return rw
+	}
+
+	return &sigGuardWriter{ResponseWriter: rw, g: s.sigGuard}
+}
+
+type sigGuardWriter struct {
+	dns.ResponseWriter
+	g *sigGuard
+}
+
+func (rw *sigGuardWriter) WriteMsg(m *dns.Msg) error {
+	return rw.ResponseWriter.WriteMsg(rw.g.check(m))
+}
+
+// Replaces the expired RRSIGs in m, applying the policy to it if any of them
+// couldn't be replaced.
+func (g *sigGuard) check(m *dns.Msg) *dns.Msg {
+	now := g.clock.Now()
+	sigs := responseSigs{}
+
+	unrepaired := false
+	for _, section := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for i, rr := range section {
+			sig, ok := rr.(*dns.RRSIG)
+			if !ok || sigSecondsFrom(now, sig.Expiration) > int64(sigGuardTolerance/time.Second) {
+				continue
+			}
+
+			nsig, err := g.resign(now, sig, section, sigs)
+			if err != nil {
+				atomic.AddUint64(&g.unrepaired, 1)
+				g.logf(now, &g.lastError, log.Errorf, "RRSIG for %s %s expired %v ago and couldn't be made again (%v); the system clock is probably wrong, applying clock skew policy %q",
+					sig.Hdr.Name, dns.TypeToString[sig.TypeCovered], time.Duration(-sigSecondsFrom(now, sig.Expiration))*time.Second, err, g.policy)
+				unrepaired = true
+				continue
+			}
+
+			section[i] = nsig
+			atomic.AddUint64(&g.resigned, 1)
+			g.logf(now, &g.lastWarning, log.Warnf, "made expired RRSIG for %s %s again before serving it; check the system clock",
+				sig.Hdr.Name, dns.TypeToString[sig.TypeCovered])
+		}
+	}
+
+	if unrepaired {
+		return g.applyPolicy(m)
+	}
+
+	return m
+}
+
+// Makes a new signature to replace sig, over the records of the RRset it
+// covers in section, unless sigs has one already.
+func (g *sigGuard) resign(now time.Time, sig *dns.RRSIG, section []dns.RR, sigs responseSigs) (*dns.RRSIG, error) {
+	key, priv := g.s.keySetForName(sig.SignerName).signingKey(sig)
+	if key == nil {
+		return nil, fmt.Errorf("no private key with tag %d", sig.KeyTag)
+	}
+
+	signer, ok := priv.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("private key with tag %d can't sign", sig.KeyTag)
+	}
+
+	// A signature over a wildcard can't be made from the expanded records.
+	if int(sig.Labels) != dns.CountLabel(sig.Hdr.Name) {
+		return nil, fmt.Errorf("signature covers a wildcard")
+	}
+
+	rrset := coveredRRset(section, sig)
+	if len(rrset) == 0 {
+		return nil, fmt.Errorf("covered records not in response")
+	}
+
+	validity := time.Duration(int32(sig.Expiration-sig.Inception)) * time.Second
+	if validity < sigGuardMinValidity {
+		validity = sigGuardMinValidity
+	}
+
+	nsig, err := sigs.sign(&dns.RRSIG{
+		Hdr:        sig.Hdr,
+		Algorithm:  key.Algorithm,
+		KeyTag:     key.KeyTag(),
+		SignerName: sig.SignerName,
+		Inception:  uint32(now.Add(-sigGuardBackdate).Unix()),
+		Expiration: uint32(now.Add(validity).Unix()),
+	}, signer, rrset)
+	if err != nil {
+		return nil, err
+	}
+
+	if sigSecondsFrom(now, nsig.Expiration) <= int64(sigGuardTolerance/time.Second) || !nsig.ValidityPeriod(now) {
+		return nil, fmt.Errorf("new signature isn't valid at the current time either")
+	}
+
+	return nsig, nil
+}
+
+// Returns the key in ks which made sig, if any.
+func (ks *keySet) signingKey(sig *dns.RRSIG) (*dns.DNSKEY, crypto.PrivateKey) {
+	if ks == nil {
+		return nil, nil
+	}
+
+	for _, k := range []struct {
+		key  *dns.DNSKEY
+		priv crypto.PrivateKey
+	}{{ks.ZSK, ks.ZSKPrivate}, {ks.KSK, ks.KSKPrivate}} {
+		if k.key != nil && k.key.Algorithm == sig.Algorithm && k.key.KeyTag() == sig.KeyTag {
+			return k.key, k.priv
+		}
+	}
+
+	return nil, nil
+}
+
+// Returns a response which is safe to send in place of m, which contains
+// expired RRSIGs.
+func (g *sigGuard) applyPolicy(m *dns.Msg) *dns.Msg {
+	if g.policy == clockSkewUnsigned {
+		m.AuthenticatedData = false
+		m.Answer, m.Ns, m.Extra = stripRRSIGs(m.Answer), stripRRSIGs(m.Ns), stripRRSIGs(m.Extra)
+		return m
+	}
+
+	res := servFailResponse(m)
+	if opt := res.IsEdns0(); opt != nil {
+		opt.Option = append(opt.Option, &dns.EDNS0_EDE{
+			InfoCode:  dns.ExtendedErrorCodeSignatureExpired,
+			ExtraText: "signatures expired; the server's clock may be wrong",
+		})
+	}
+
+	return res
+}
+
+func stripRRSIGs(rrs []dns.RR) []dns.RR {
+	var out []dns.RR
+	for _, rr := range rrs {
+		if _, ok := rr.(*dns.RRSIG); !ok {
+			out = append(out, rr)
+		}
+	}
+
+	return out
+}
+
+func (g *sigGuard) logf(now time.Time, last *time.Time, logf func(string, ...interface{}), format string, args ...interface{}) {
+	g.mu.Lock()
+	if now.Sub(*last) < sigWarningInterval {
+		g.mu.Unlock()
+		return
+	}
+	*last = now
+	g.mu.Unlock()
+
+	logf(format, args...)
+}
+
+// Returns the number of expired RRSIGs replaced, and of those which couldn't
+// be.
+func (g *sigGuard) Status() sigGuardStatus {
+	return sigGuardStatus{
+		Policy:     g.policy,
+		Resigned:   atomic.LoadUint64(&g.resigned),
+		Unrepaired: atomic.LoadUint64(&g.unrepaired),
+	}
+}
@@ -0,0 +1,111 @@
+package server
+
+import (
+	"crypto"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/namecoin/ncdns/testutil"
+)
+
+// Returns a response with an A record for example.bit. signed by key, valid
+// from t for a week.
+func guardedResponse(t *testing.T, key *dns.DNSKEY, priv crypto.PrivateKey, at time.Time) *dns.Msg {
+	a, err := dns.NewRR("example.bit. 600 IN A 192.0.2.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sig := &dns.RRSIG{
+		Hdr:        dns.RR_Header{Name: "example.bit.", Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: 600},
+		KeyTag:     key.KeyTag(),
+		Algorithm:  key.Algorithm,
+		SignerName: "bit.",
+		Inception:  uint32(at.Unix()),
+		Expiration: uint32(at.Add(7 * 24 * time.Hour).Unix()),
+	}
+	if err := sig.Sign(priv.(crypto.Signer), []dns.RR{a}); err != nil {
+		t.Fatal(err)
+	}
+
+	m := new(dns.Msg)
+	m.SetQuestion("example.bit.", dns.TypeA)
+	m.Response = true
+	m.SetEdns0(4096, true)
+	m.Answer = []dns.RR{a, sig}
+	return m
+}
+
+func TestSigGuard(t *testing.T) {
+	ks, err := generateKeySet("bit.")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t0 := time.Unix(1700000000, 0)
+	clock := testutil.NewFakeClock(t0)
+	s := &Server{globalKeySet: ks, clock: clock}
+	s.sigGuard = newSigGuard(s, clockSkewServFail)
+
+	serve := func(m *dns.Msg) *dns.Msg {
+		frw := &fakeResponseWriter{}
+		s.sigGuardWriter(frw).WriteMsg(m)
+		return frw.msg
+	}
+
+	// A signature which is still valid is served as it is.
+	m := guardedResponse(t, ks.ZSK, ks.ZSKPrivate, t0)
+	sig := m.Answer[1]
+	if res := serve(m); res.Answer[1] != sig {
+		t.Errorf("valid signature replaced")
+	}
+
+	// Once the clock passes its expiry, it's made again.
+	clock.Advance(8 * 24 * time.Hour)
+	now := clock.Now()
+	res := serve(guardedResponse(t, ks.ZSK, ks.ZSKPrivate, t0))
+	if res.Rcode != dns.RcodeSuccess || len(res.Answer) != 2 {
+		t.Fatalf("unexpected response to expired signature: %v", res)
+	}
+	nsig, ok := res.Answer[1].(*dns.RRSIG)
+	if !ok {
+		t.Fatalf("signature removed: %v", res)
+	}
+	if !nsig.ValidityPeriod(now) || sigSecondsFrom(now, nsig.Expiration) < int64(7*24*time.Hour/time.Second) {
+		t.Errorf("new signature valid from %d to %d, not at %d for a week", nsig.Inception, nsig.Expiration, now.Unix())
+	}
+	if err := nsig.Verify(ks.ZSK, res.Answer[:1]); err != nil {
+		t.Errorf("new signature doesn't verify: %v", err)
+	}
+
+	// A signature by a key which ncdns doesn't have can't be made again.
+	other, otherPriv, err := generateKey("bit.", 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res = serve(guardedResponse(t, other, otherPriv, t0))
+	if res.Rcode != dns.RcodeServerFailure || len(res.Answer) != 0 {
+		t.Errorf("expected SERVFAIL, got %v", res)
+	}
+	if opt := res.IsEdns0(); opt == nil || len(opt.Option) != 1 || opt.Option[0].(*dns.EDNS0_EDE).InfoCode != dns.ExtendedErrorCodeSignatureExpired {
+		t.Errorf("expected extended error, got %v", res)
+	}
+
+	s.sigGuard.policy = clockSkewUnsigned
+	res = serve(guardedResponse(t, other, otherPriv, t0))
+	if res.Rcode != dns.RcodeSuccess || len(res.Answer) != 1 || res.Answer[0].Header().Rrtype != dns.TypeA {
+		t.Errorf("expected unsigned answer, got %v", res)
+	}
+
+	if st := s.sigGuard.Status(); st.Resigned != 1 || st.Unrepaired != 2 {
+		t.Errorf("unexpected counts %+v", st)
+	}
+}
+
+func TestSigGuardWriterDisabled(t *testing.T) {
+	if _, ok := (&Server{}).sigGuardWriter(&fakeResponseWriter{}).(*fakeResponseWriter); !ok {
+		t.Errorf("writer wrapped without a guard")
+	}
+}
@@ -0,0 +1,174 @@
+package server
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/namecoin/ncdns/clock"
+)
+
+// The validity periods of the RRSIGs in responses are reported over roughly
+// the last two of these periods.
+const sigWindow = 5 * time.Minute
+
+// Responses whose signatures expire sooner than this are counted.
+const sigExpiringSoon = time.Hour
+
+// How often a warning about signature validity periods may be logged.
+const sigWarningInterval = time.Minute
+
+// The validity periods of the RRSIGs in sampled responses.
+type signatureStatus struct {
+	SampleRate            int    `json:"sample_rate"`
+	Sampled               uint64 `json:"sampled_responses"`
+	MinSecondsUntilExpiry *int64 `json:"min_seconds_until_expiry,omitempty"`
+	ExpiringSoon          uint64 `json:"expiring_within_hour"`
+	Expired               uint64 `json:"expired"`
+	NotYetValid           uint64 `json:"not_yet_valid"`
+}
+
+// Samples served responses to check that the RRSIGs in them are valid at the
+// time they're served. A clock which is wrong, or which has been stepped since
+// the signatures were made, makes clients reject them.
+type sigMonitor struct {
+	count uint64 // responses seen, for sampling; accessed atomically
+	rate  uint64
+	clock clock.Clock
+
+	mu          sync.Mutex
+	status      signatureStatus
+	windowStart time.Time
+	windowMin   *int64 // over the current window
+	prevMin     *int64 // over the previous window
+	lastWarning time.Time
+}
+
+func newSigMonitor(rate int, clk clock.Clock) *sigMonitor {
+	return &sigMonitor{
+		rate:   uint64(rate),
+		clock:  clock.Or(clk),
+		status: signatureStatus{SampleRate: rate},
+	}
+}
+
+// Wraps rw so that a sample of responses are checked, if enabled.
+func (s *Server) signatureWriter(rw dns.ResponseWriter) dns.ResponseWriter {
+	if s.sigMonitor == nil || atomic.AddUint64(&s.sigMonitor.count, 1)%s.sigMonitor.rate != 0 {
+		return rw
+	}
+
+	return &signatureWriter{ResponseWriter: rw, m: s.sigMonitor}
+}
+
+type signatureWriter struct {
+	dns.ResponseWriter
+	m *sigMonitor
+}
+
+func (rw *signatureWriter) WriteMsg(m *dns.Msg) error {
+	rw.m.check(m)
+	return rw.ResponseWriter.WriteMsg(m)
+}
+
+// Seconds from t until a time in RRSIG form, which is serial number
+// arithmetic on 32-bit seconds since the epoch (RFC 4034 section 3.1.5).
+func sigSecondsFrom(t time.Time, sigTime uint32) int64 {
+	return int64(int32(sigTime - uint32(t.Unix())))
+}
+
+// Records the validity periods of the RRSIGs in a response.
+func (m *sigMonitor) check(msg *dns.Msg) {
+	now := m.clock.Now()
+
+	var untilExpiry, untilInception int64
+	var expiring, notYetValid *dns.RRSIG
+	for _, section := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range section {
+			sig, ok := rr.(*dns.RRSIG)
+			if !ok {
+				continue
+			}
+
+			if e := sigSecondsFrom(now, sig.Expiration); expiring == nil || e < untilExpiry {
+				untilExpiry, expiring = e, sig
+			}
+			if i := sigSecondsFrom(now, sig.Inception); i > 0 && (notYetValid == nil || i > untilInception) {
+				untilInception, notYetValid = i, sig
+			}
+		}
+	}
+	if expiring == nil {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.status.Sampled++
+	m.record(now, untilExpiry)
+
+	switch {
+	case untilExpiry <= 0:
+		m.status.Expired++
+		m.warnf(now, "served an RRSIG for %s %s which expired %v ago; check the system clock",
+			expiring.Hdr.Name, dns.TypeToString[expiring.TypeCovered], time.Duration(-untilExpiry)*time.Second)
+	case untilExpiry < int64(sigExpiringSoon/time.Second):
+		m.status.ExpiringSoon++
+	}
+
+	if notYetValid != nil {
+		m.status.NotYetValid++
+		m.warnf(now, "served an RRSIG for %s %s which isn't valid for another %v; the system clock may have gone backwards",
+			notYetValid.Hdr.Name, dns.TypeToString[notYetValid.TypeCovered], time.Duration(untilInception)*time.Second)
+	}
+}
+
+// Records the time until a response's signatures expire, in the window the
+// current time falls in.
+func (m *sigMonitor) record(now time.Time, untilExpiry int64) {
+	if since := now.Sub(m.windowStart); since >= sigWindow {
+		m.prevMin = nil
+		if since < 2*sigWindow {
+			m.prevMin = m.windowMin
+		}
+		m.windowStart = now
+		m.windowMin = nil
+	}
+
+	if m.windowMin == nil || untilExpiry < *m.windowMin {
+		m.windowMin = &untilExpiry
+	}
+}
+
+func (m *sigMonitor) warnf(now time.Time, format string, args ...interface{}) {
+	if now.Sub(m.lastWarning) < sigWarningInterval {
+		return
+	}
+
+	m.lastWarning = now
+	log.Warnf(format, args...)
+}
+
+// Returns the validity periods seen in the responses sampled recently.
+func (m *sigMonitor) Status() signatureStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	st := m.status
+
+	// Don't report windows which have passed.
+	since := m.clock.Now().Sub(m.windowStart)
+	var min *int64
+	for i, w := range []*int64{m.windowMin, m.prevMin} {
+		if w != nil && since < time.Duration(2-i)*sigWindow && (min == nil || *w < *min) {
+			v := *w
+			min = &v
+		}
+	}
+	st.MinSecondsUntilExpiry = min
+
+	return st
+}
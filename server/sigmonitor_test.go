@@ -0,0 +1,96 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/namecoin/ncdns/testutil"
+)
+
+func signedResponse(now time.Time, inception, expiration time.Duration) *dns.Msg {
+	m := new(dns.Msg)
+	m.Answer = []dns.RR{
+		&dns.A{Hdr: dns.RR_Header{Name: "example.bit.", Rrtype: dns.TypeA, Class: dns.ClassINET}},
+		&dns.RRSIG{
+			Hdr:         dns.RR_Header{Name: "example.bit.", Rrtype: dns.TypeRRSIG, Class: dns.ClassINET},
+			TypeCovered: dns.TypeA,
+			Inception:   uint32(now.Add(inception).Unix()),
+			Expiration:  uint32(now.Add(expiration).Unix()),
+		},
+	}
+	return m
+}
+
+func TestSigMonitor(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	clk := testutil.NewFakeClock(now)
+	m := newSigMonitor(1, clk)
+
+	// Unsigned responses aren't counted.
+	m.check(new(dns.Msg))
+	if st := m.Status(); st.Sampled != 0 || st.MinSecondsUntilExpiry != nil {
+		t.Errorf("unsigned response recorded: %+v", st)
+	}
+
+	m.check(signedResponse(now, -time.Hour, 7*24*time.Hour))
+	m.check(signedResponse(now, -time.Hour, 30*time.Minute))
+	m.check(signedResponse(now, -time.Hour, -time.Minute))
+	m.check(signedResponse(now, time.Hour, 7*24*time.Hour))
+
+	st := m.Status()
+	if st.Sampled != 4 || st.ExpiringSoon != 1 || st.Expired != 1 || st.NotYetValid != 1 {
+		t.Errorf("unexpected counts %+v", st)
+	}
+	if st.MinSecondsUntilExpiry == nil || *st.MinSecondsUntilExpiry != -60 {
+		t.Errorf("unexpected minimum %v", st.MinSecondsUntilExpiry)
+	}
+
+	// The minimum is only of recent responses.
+	now = now.Add(sigWindow)
+	clk.Set(now)
+	m.check(signedResponse(now, -time.Hour, 2*time.Hour))
+	if st := m.Status(); st.MinSecondsUntilExpiry == nil || *st.MinSecondsUntilExpiry != -60 {
+		t.Errorf("previous window forgotten too soon: %v", st.MinSecondsUntilExpiry)
+	}
+
+	now = now.Add(sigWindow)
+	clk.Set(now)
+	if st := m.Status(); st.MinSecondsUntilExpiry == nil || *st.MinSecondsUntilExpiry != 7200 {
+		t.Errorf("unexpected minimum after a window %v", st.MinSecondsUntilExpiry)
+	}
+
+	now = now.Add(sigWindow)
+	clk.Set(now)
+	if st := m.Status(); st.MinSecondsUntilExpiry != nil {
+		t.Errorf("minimum reported with no recent responses: %v", *st.MinSecondsUntilExpiry)
+	}
+	if st := m.Status(); st.Sampled != 5 {
+		t.Errorf("counts aren't cumulative: %+v", st)
+	}
+}
+
+func TestSigSecondsFromWraps(t *testing.T) {
+	// Signature times are 32-bit, and wrap in 2106.
+	now := time.Unix(1<<32-10, 0)
+	if got := sigSecondsFrom(now, 20); got != 30 {
+		t.Errorf("got %d", got)
+	}
+}
+
+func TestSignatureWriterSamples(t *testing.T) {
+	s := &Server{sigMonitor: newSigMonitor(3, nil)}
+	now := time.Now()
+	for i := 0; i < 9; i++ {
+		s.signatureWriter(&fakeResponseWriter{}).WriteMsg(signedResponse(now, -time.Hour, time.Hour))
+	}
+
+	if st := s.sigMonitor.Status(); st.Sampled != 3 {
+		t.Errorf("sampled %d of 9 responses, expected 3", st.Sampled)
+	}
+
+	if _, ok := (&Server{}).signatureWriter(&fakeResponseWriter{}).(*fakeResponseWriter); !ok {
+		t.Errorf("writer wrapped with monitoring disabled")
+	}
+}
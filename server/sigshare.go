@@ -0,0 +1,85 @@
+package server
+
+import (
+	"crypto"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// The signatures made while one response is assembled, by the RRset they
+// cover and how they were made. An RRset can appear in more than one section,
+// e.g. an address record both answered and given as glue; it's signed once,
+// and each section refers to the same RRSIG. The response builder later
+// keeps one copy of each RRset and its RRSIGs per message.
+type responseSigs map[string]*dns.RRSIG
+
+// Returns a signature over rrset with the header, signer, key and validity
+// period of tmpl, made with signer unless an identical one has already been
+// made for the response.
+func (sigs responseSigs) sign(tmpl *dns.RRSIG, signer crypto.Signer, rrset []dns.RR) (*dns.RRSIG, error) {
+	k := signatureKey(tmpl, rrset)
+	if sig, ok := sigs[k]; ok {
+		return sig, nil
+	}
+
+	nsig := &dns.RRSIG{
+		Hdr:        tmpl.Hdr,
+		Algorithm:  tmpl.Algorithm,
+		KeyTag:     tmpl.KeyTag,
+		SignerName: tmpl.SignerName,
+		Inception:  tmpl.Inception,
+		Expiration: tmpl.Expiration,
+	}
+	err := nsig.Sign(signer, rrset)
+	if err != nil {
+		return nil, err
+	}
+
+	if sigs != nil {
+		sigs[k] = nsig
+	}
+	return nsig, nil
+}
+
+// Identifies the signature tmpl would make over rrset. The records are put in
+// a fixed order, with their owner names in lower case and without duplicates,
+// as they are when signed, so that the same RRset in another order, case or
+// repetition is recognised.
+func signatureKey(tmpl *dns.RRSIG, rrset []dns.RR) string {
+	var rrs []string
+	seen := map[string]bool{}
+	for _, rr := range rrset {
+		rr = dns.Copy(rr)
+		rr.Header().Name = strings.ToLower(rr.Header().Name)
+		if k := rr.String(); !seen[k] {
+			seen[k] = true
+			rrs = append(rrs, k)
+		}
+	}
+	sort.Strings(rrs)
+
+	return fmt.Sprintf("%d %d %d %s %d %d\n%s", tmpl.Hdr.Ttl, tmpl.Algorithm, tmpl.KeyTag,
+		strings.ToLower(tmpl.SignerName), tmpl.Inception, tmpl.Expiration, strings.Join(rrs, "\n"))
+}
+
+// Whether a and b are both RRSIGs by the same key over the same RRset with
+// the same validity period. Such signatures are equivalent even if they
+// differ, as those made with ECDSA do each time.
+func sameSignature(a, b dns.RR) bool {
+	sa, ok := a.(*dns.RRSIG)
+	if !ok {
+		return false
+	}
+	sb, ok := b.(*dns.RRSIG)
+	if !ok {
+		return false
+	}
+
+	return strings.EqualFold(sa.Hdr.Name, sb.Hdr.Name) && sa.Hdr.Class == sb.Hdr.Class &&
+		sa.TypeCovered == sb.TypeCovered && sa.Algorithm == sb.Algorithm && sa.Labels == sb.Labels &&
+		sa.OrigTtl == sb.OrigTtl && sa.Inception == sb.Inception && sa.Expiration == sb.Expiration &&
+		sa.KeyTag == sb.KeyTag && strings.EqualFold(sa.SignerName, sb.SignerName)
+}
@@ -0,0 +1,134 @@
+package server
+
+import (
+	"crypto"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/namecoin/ncdns/testutil"
+)
+
+// Returns a response for ns1.example.bit. A in which the address RRset and
+// its RRSIG, valid from at for a week, are answered twice and repeated in the
+// additional section.
+func overlappingResponse(t testing.TB, ks *keySet, at time.Time) *dns.Msg {
+	a, err := dns.NewRR("ns1.example.bit. 600 IN A 192.0.2.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sig := &dns.RRSIG{
+		Hdr:        dns.RR_Header{Name: "ns1.example.bit.", Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: 600},
+		KeyTag:     ks.ZSK.KeyTag(),
+		Algorithm:  ks.ZSK.Algorithm,
+		SignerName: "bit.",
+		Inception:  uint32(at.Unix()),
+		Expiration: uint32(at.Add(7 * 24 * time.Hour).Unix()),
+	}
+	if err := sig.Sign(ks.ZSKPrivate.(crypto.Signer), []dns.RR{a}); err != nil {
+		t.Fatal(err)
+	}
+
+	m := new(dns.Msg)
+	m.SetQuestion("ns1.example.bit.", dns.TypeA)
+	m.Response = true
+	m.Authoritative = true
+	m.SetEdns0(4096, true)
+	m.Answer = []dns.RR{a, sig, dns.Copy(a), dns.Copy(sig)}
+	m.Extra = append([]dns.RR{dns.Copy(a), dns.Copy(sig)}, m.Extra...)
+	return m
+}
+
+func TestSignatureSharing(t *testing.T) {
+	ks, err := generateKeySet("bit.")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t0 := time.Unix(1700000000, 0)
+	clock := testutil.NewFakeClock(t0)
+	s := &Server{globalKeySet: ks, clock: clock}
+	s.sigGuard = newSigGuard(s, clockSkewServFail)
+	clock.Advance(8 * 24 * time.Hour)
+
+	// Each copy of the RRset gets the same new signature.
+	m := s.sigGuard.check(overlappingResponse(t, ks, t0))
+	if m.Rcode != dns.RcodeSuccess || m.Answer[1] != m.Answer[3] || m.Answer[1] != m.Extra[1] {
+		t.Fatalf("RRset signed more than once: %v", m)
+	}
+	if st := s.sigGuard.Status(); st.Resigned != 3 {
+		t.Errorf("unexpected counts %+v", st)
+	}
+
+	// On the wire, each section holds it once at most.
+	req := new(dns.Msg)
+	req.SetQuestion("ns1.example.bit.", dns.TypeA)
+	req.SetEdns0(4096, true)
+	frw := &fakeResponseWriter{}
+	s.sectionWriter(frw, req).WriteMsg(m)
+	buf, err := frw.msg.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := new(dns.Msg)
+	if err := res.Unpack(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, section := range map[string][]dns.RR{"answer": res.Answer, "authority": res.Ns, "additional": res.Extra} {
+		sigs := map[string]int{}
+		for _, rr := range section {
+			if sig, ok := rr.(*dns.RRSIG); ok {
+				sigs[sig.Hdr.Name+" "+dns.TypeToString[sig.TypeCovered]]++
+			}
+		}
+		for set, n := range sigs {
+			if n != 1 {
+				t.Errorf("%d RRSIGs over %s in %s section", n, set, name)
+			}
+		}
+		if name == "answer" && sigs["ns1.example.bit. A"] != 1 {
+			t.Errorf("answer lost its RRSIG: %v", res)
+		}
+	}
+}
+
+func TestSameSignature(t *testing.T) {
+	ks, err := generateKeySet("bit.")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// ECDSA signatures over the same RRset differ each time, but are
+	// equivalent.
+	t0 := time.Unix(1700000000, 0)
+	a := overlappingResponse(t, ks, t0).Answer[1]
+	b := overlappingResponse(t, ks, t0).Answer[1]
+	if dns.IsDuplicate(a, b) || !sameSignature(a, b) || !containsDuplicate([]dns.RR{a}, b) {
+		t.Errorf("equivalent signatures not recognised")
+	}
+
+	c := overlappingResponse(t, ks, t0.Add(time.Hour)).Answer[1]
+	if sameSignature(a, c) {
+		t.Errorf("signatures with different validity periods treated as the same")
+	}
+}
+
+func BenchmarkSigGuardOverlap(b *testing.B) {
+	ks, err := generateKeySet("bit.")
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	t0 := time.Unix(1700000000, 0)
+	s := &Server{globalKeySet: ks, clock: testutil.NewFakeClock(t0.Add(8 * 24 * time.Hour))}
+	s.sigGuard = newSigGuard(s, clockSkewServFail)
+	m := overlappingResponse(b, ks, t0)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s.sigGuard.check(m.Copy())
+	}
+}
@@ -0,0 +1,93 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/namecoin/ncdns/backend"
+)
+
+// The schemes by which the serial of the SOA record at the zone apex is
+// chosen, as SOASerialMode.
+const (
+	soaSerialBlockHeight = "blockheight" // the height of namecoind's best block
+	soaSerialUnixTime    = "unixtime"    // the time at which the best block was noticed
+)
+
+// Parses the SOA timers, defaulting those which are empty or zero to the
+// backend's defaults, and checks that they make sense together, and
+// SOASerialMode.
+func (cfg *Config) parseSOAOptions() error {
+	var err error
+	for _, opt := range []struct {
+		name, value string
+		parsed      *uint32
+		def         uint32
+	}{
+		{"SOARefresh", cfg.SOARefresh, &cfg.soaRefresh, backend.DefaultSOARefresh},
+		{"SOARetry", cfg.SOARetry, &cfg.soaRetry, backend.DefaultSOARetry},
+		{"SOAExpire", cfg.SOAExpire, &cfg.soaExpire, backend.DefaultSOAExpire},
+		{"SOAMinimumTTL", cfg.SOAMinimumTTL, &cfg.soaMinimumTTL, backend.DefaultSOAMinTTL},
+	} {
+		*opt.parsed, err = parseSeconds(opt.name, opt.value)
+		if err != nil {
+			return err
+		}
+		if *opt.parsed == 0 {
+			*opt.parsed = opt.def
+		}
+	}
+
+	if cfg.soaExpire < cfg.soaRefresh || cfg.soaExpire < cfg.soaRetry {
+		return configError("SOAExpire (%ds) must be at least SOARefresh (%ds) and SOARetry (%ds), or secondaries would stop serving the zone before checking it again",
+			cfg.soaExpire, cfg.soaRefresh, cfg.soaRetry)
+	}
+
+	switch cfg.SOASerialMode {
+	case "":
+		cfg.SOASerialMode = soaSerialBlockHeight
+	case soaSerialBlockHeight, soaSerialUnixTime:
+	default:
+		return configError("SOASerialMode must be %s or %s, not %q", soaSerialBlockHeight, soaSerialUnixTime, cfg.SOASerialMode)
+	}
+	return nil
+}
+
+// Returns the SOA record served at zone, which must be the apex of a zone
+// ncdns serves, as it's served: NOTIFY messages and /api/v1/zone-status take
+// the serial from it so that it's always the one queries get.
+func (s *Server) apexSOA(zone string) (*dns.SOA, error) {
+	rrs, err := s.currentBackend().Lookup(zone, "")
+	if err != nil {
+		return nil, err
+	}
+	for _, rr := range rrs {
+		if soa, ok := rr.(*dns.SOA); ok {
+			return soa, nil
+		}
+	}
+	return nil, fmt.Errorf("no SOA record at %s", zone)
+}
+
+// Parses the value of an option giving a time, either as a number of seconds
+// or as a duration such as "10m" or "1h30m". Empty means zero.
+func parseSeconds(option, s string) (uint32, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, nil
+	}
+	if n, err := strconv.ParseUint(s, 10, 32); err == nil {
+		return uint32(n), nil
+	}
+
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 || d%time.Second != 0 || d > time.Duration(math.MaxUint32)*time.Second {
+		return 0, configError("Couldn't parse %s: %s (expected a number of seconds, or a duration such as 10m)", option, s)
+	}
+	return uint32(d / time.Second), nil
+}
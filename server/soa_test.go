@@ -0,0 +1,104 @@
+package server
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/namecoin/ncdns/backend"
+)
+
+func TestParseSOAOptions(t *testing.T) {
+	cfg := &Config{SOARefresh: "15m", SOARetry: "300", SOAExpire: "1h30m", SOAMinimumTTL: " 60s "}
+	if err := cfg.parseSOAOptions(); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.soaRefresh != 900 || cfg.soaRetry != 300 || cfg.soaExpire != 5400 || cfg.soaMinimumTTL != 60 || cfg.SOASerialMode != soaSerialBlockHeight {
+		t.Errorf("parsed %+v", cfg)
+	}
+
+	// Unset, they're as they always were.
+	cfg = &Config{}
+	if err := cfg.parseSOAOptions(); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.soaRefresh != 600 || cfg.soaRetry != 600 || cfg.soaExpire != 7200 || cfg.soaMinimumTTL != 600 {
+		t.Errorf("defaults parsed as %+v", cfg)
+	}
+
+	for _, test := range []struct {
+		cfg      Config
+		expected string
+	}{
+		{Config{SOARefresh: "2h", SOAExpire: "1h"}, "SOAExpire (3600s) must be at least SOARefresh (7200s)"},
+		{Config{SOARetry: "3h"}, "must be at least SOARefresh (600s) and SOARetry (10800s)"},
+		{Config{SOARefresh: "10 minutes"}, "Couldn't parse SOARefresh: 10 minutes"},
+		{Config{SOARetry: "-5m"}, "Couldn't parse SOARetry"},
+		{Config{SOAExpire: "1.5s"}, "Couldn't parse SOAExpire"},
+		{Config{SOAMinimumTTL: "99999999999"}, "Couldn't parse SOAMinimumTTL"},
+		{Config{SOASerialMode: "date"}, `SOASerialMode must be blockheight or unixtime, not "date"`},
+	} {
+		err := test.cfg.parseSOAOptions()
+		if err == nil || !strings.Contains(err.Error(), test.expected) || !errors.Is(err, ErrConfigInvalid) {
+			t.Errorf("%+v: got error %v, expected one mentioning %q", test.cfg, err, test.expected)
+		}
+	}
+}
+
+func TestSOASerialMode(t *testing.T) {
+	s := &Server{bus: newEventBus(), busMetrics: &busMetrics{}}
+	s.bus.subscribe("metrics", s.busMetrics.handle)
+
+	for _, mode := range []string{soaSerialBlockHeight, soaSerialUnixTime} {
+		s.cfg.SOASerialMode = mode
+		if serial := s.soaSerial(); serial != 1 {
+			t.Errorf("%s: serial %d before any block", mode, serial)
+		}
+	}
+
+	start := time.Now().Unix()
+	s.bus.publish(&blockConnected{Height: 500000, Initial: true})
+	s.cfg.SOASerialMode = soaSerialBlockHeight
+	if serial := s.soaSerial(); serial != 500000 {
+		t.Errorf("blockheight: serial %d, expected 500000", serial)
+	}
+	s.cfg.SOASerialMode = soaSerialUnixTime
+	first := s.soaSerial()
+	if int64(first) < start || int64(first) > time.Now().Unix() {
+		t.Errorf("unixtime: serial %d, expected about %d", first, start)
+	}
+
+	// Blocks noticed in the same second still increase the serial.
+	s.bus.publish(&blockConnected{Height: 500001})
+	s.bus.publish(&blockConnected{Height: 500002})
+	if serial := s.soaSerial(); serial < first+2 {
+		t.Errorf("unixtime: serial %d after two more blocks, expected at least %d", serial, first+2)
+	}
+}
+
+// The SOA timers given are those of the SOA record at the apex.
+func TestSOATimers(t *testing.T) {
+	b, err := backend.New(&backend.Config{
+		CacheMaxEntries: 100,
+		SOARefresh:      900,
+		SOARetry:        300,
+		SOAExpire:       86400,
+		SOAMinTTL:       60,
+		SOASerial:       func() uint32 { return 1234 },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rrs, err := b.Lookup("bit.", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	soa, ok := rrs[0].(*dns.SOA)
+	if !ok || soa.Refresh != 900 || soa.Retry != 300 || soa.Expire != 86400 || soa.Minttl != 60 || soa.Serial != 1234 {
+		t.Errorf("unexpected SOA %v", rrs[0])
+	}
+}
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// Runs fn, which reads the file at path while starting or reloading, logging
+// how long it took, so that a slow or hung read can be told apart from the
+// others. If fn hasn't returned within StartupIOTimeout, an error naming the
+// path is returned instead. fn is then left to finish in the background, as a
+// read of a FIFO or of a file on an unreachable network filesystem can't be
+// interrupted.
+func (cfg *Config) startupIO(what, path string, fn func() error) error {
+	// The system clock's, as this is called while loading the configuration,
+	// before the Server, and its clock, exist.
+	start := time.Now()
+	log.Debugf("loading %s from %s", what, path)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- fn()
+	}()
+
+	var timeout <-chan time.Time
+	if cfg.StartupIOTimeout > 0 {
+		t := time.NewTimer(time.Duration(cfg.StartupIOTimeout) * time.Second)
+		defer t.Stop()
+		timeout = t.C
+	}
+
+	select {
+	case err := <-done:
+		if err != nil {
+			return err
+		}
+		log.Infof("loading %s from %s: done in %v", what, path, time.Since(start).Round(time.Millisecond))
+		return nil
+	case <-timeout:
+		return &startupIOTimeoutError{what: what, path: path, timeout: cfg.StartupIOTimeout}
+	}
+}
+
+type startupIOTimeoutError struct {
+	what, path string
+	timeout    int
+}
+
+func (e *startupIOTimeoutError) Error() string {
+	return fmt.Sprintf("Loading %s from %s took longer than StartupIOTimeout (%ds); is it a FIFO, or on a network filesystem which can't be reached?",
+		e.what, e.path, e.timeout)
+}
+
+// Reads the file at path with startupIO.
+func (cfg *Config) readStartupFile(what, path string) ([]byte, error) {
+	var b []byte
+	err := cfg.startupIO(what, path, func() error {
+		var err error
+		b, err = ioutil.ReadFile(path)
+		return err
+	})
+	if err != nil {
+		// b may still be written by a read which timed out.
+		return nil, err
+	}
+	return b, nil
+}
+
+// Reads the RPC cookie files which namecoind's client will read on each
+// request, so that one which would hang it, such as a FIFO, is reported at
+// startup. A cookie which doesn't exist yet, or can't be read, isn't an error
+// here, as namecoind may not have started yet; it's logged, and reported once
+// a request is made. Only a read which times out is.
+func (cfg *Config) checkCookies(paths []string) error {
+	seen := make(map[string]bool)
+	for _, path := range paths {
+		if path == "" || seen[path] {
+			continue
+		}
+		seen[path] = true
+		_, err := cfg.readStartupFile("RPC cookie", path)
+		var timeout *startupIOTimeoutError
+		switch {
+		case errors.As(err, &timeout):
+			return err
+		case os.IsNotExist(err):
+			log.Debugf("RPC cookie %s doesn't exist yet", path)
+		case err != nil:
+			log.Warne(err, "couldn't read the RPC cookie")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package server
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// Makes a FIFO at path, which reads block on until a writer opens it; the
+// writer is opened and closed when the test ends, so that they return.
+func makeFIFO(t *testing.T, path string) {
+	if err := syscall.Mkfifo(path, 0600); err != nil {
+		t.Skipf("can't make a FIFO: %v", err)
+	}
+	t.Cleanup(func() {
+		if f, err := os.OpenFile(path, os.O_WRONLY|syscall.O_NONBLOCK, 0); err == nil {
+			f.Close()
+		}
+	})
+}
+
+func TestStartupIOFIFO(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ncdns-startupio")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Removed only once the FIFOs have been written to.
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	s := &Server{cfg: Config{ConfigDir: dir, StartupIOTimeout: 1}}
+	pub, priv := writeKeyPair(t, dir, "ksk", dns.ECDSAP256SHA256, 256)
+	if err := os.Remove(filepath.Join(dir, priv)); err != nil {
+		t.Fatal(err)
+	}
+	makeFIFO(t, filepath.Join(dir, priv))
+
+	var timeout *startupIOTimeoutError
+	_, _, err = s.loadKey(pub, priv)
+	if !errors.As(err, &timeout) || !strings.Contains(err.Error(), filepath.Join(dir, priv)) {
+		t.Errorf("loading a private key from a FIFO: got error %v, expected a timeout naming it", err)
+	}
+
+	// A cookie which doesn't exist yet is fine, but not one which hangs.
+	cookie := filepath.Join(dir, ".cookie")
+	if err := s.cfg.checkCookies([]string{cookie}); err != nil {
+		t.Errorf("missing cookie: %v", err)
+	}
+	makeFIFO(t, cookie)
+	if err := s.cfg.checkCookies([]string{cookie}); !errors.As(err, &timeout) {
+		t.Errorf("cookie FIFO: got error %v, expected a timeout", err)
+	}
+}
@@ -0,0 +1,58 @@
+package server
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStartupIOTimeout(t *testing.T) {
+	cfg := &Config{StartupIOTimeout: 1}
+
+	// A read from a network filesystem which can't be reached.
+	hang := make(chan struct{})
+	defer close(hang)
+	start := time.Now()
+	err := cfg.startupIO("KSK private key", "/mnt/nfs/ksk.private", func() error {
+		<-hang
+		return nil
+	})
+	var timeout *startupIOTimeoutError
+	if !errors.As(err, &timeout) || !strings.Contains(err.Error(), "/mnt/nfs/ksk.private") {
+		t.Errorf("got error %v, expected a timeout naming the path", err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("timed out after %v", d)
+	}
+
+	// Without a limit, a slow read is waited for.
+	cfg.StartupIOTimeout = 0
+	if err := cfg.startupIO("template", "slow.tpl", func() error {
+		time.Sleep(50 * time.Millisecond)
+		return nil
+	}); err != nil {
+		t.Errorf("slow read without a limit: %v", err)
+	}
+
+	dir, err := ioutil.TempDir("", "ncdns-startupio")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg.StartupIOTimeout = 10
+	path := filepath.Join(dir, "file")
+	if _, err := cfg.readStartupFile("file", path); !os.IsNotExist(err) {
+		t.Errorf("reading a missing file: got error %v, expected one it doesn't exist", err)
+	}
+	if err := ioutil.WriteFile(path, []byte("contents"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := cfg.readStartupFile("file", path); err != nil || string(b) != "contents" {
+		t.Errorf("read %q, %v", b, err)
+	}
+}
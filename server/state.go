@@ -0,0 +1,117 @@
+package server
+
+import (
+	"fmt"
+	"sync"
+)
+
+// The lifecycle of a Server. Each operation on a running server (Start,
+// Reload, Drain and Stop, whether called directly, on a signal or over HTTP)
+// moves it from one state to another, and is refused with ErrInvalidState if
+// the server isn't in a state it can be moved from, rather than racing with
+// the operation which is.
+type serverState int
+
+const (
+	stateStarting  serverState = iota // set up by New, but not yet started
+	stateRunning                      // answering queries
+	stateReloading                    // answering queries while a Reload is in progress
+	stateDraining                     // failing health checks until the drain window ends
+	stateStopped                      // final; the sockets are closed or being closed
+)
+
+var stateNames = [...]string{
+	stateStarting:  "starting",
+	stateRunning:   "running",
+	stateReloading: "reloading",
+	stateDraining:  "draining",
+	stateStopped:   "stopped",
+}
+
+func (st serverState) String() string {
+	if st < 0 || int(st) >= len(stateNames) {
+		return fmt.Sprintf("state %d", int(st))
+	}
+	return stateNames[st]
+}
+
+// The states each state may be left for. A server may be stopped in any
+// state, and a reload or drain only begun while running.
+var stateTransitions = map[serverState][]serverState{
+	stateStarting:  {stateRunning, stateStopped},
+	stateRunning:   {stateReloading, stateDraining, stateStopped},
+	stateReloading: {stateRunning, stateStopped},
+	stateDraining:  {stateStopped},
+	stateStopped:   nil,
+}
+
+func canTransition(from, to serverState) bool {
+	for _, st := range stateTransitions[from] {
+		if st == to {
+			return true
+		}
+	}
+	return false
+}
+
+// The state of a Server. The zero value is stateStarting.
+type lifecycle struct {
+	mu      sync.Mutex
+	state   serverState
+	stopped chan struct{} // closed on entering stateStopped; made on demand
+}
+
+// Moves to state to, first calling fn, if it isn't nil, with the state
+// locked, so that no other transition can happen meanwhile. If to can't be
+// reached from the current state, an error of kind ErrInvalidState naming op
+// is returned; if fn fails, its error is. Either way the state is left as it
+// was. The state transitioned from is returned in any case.
+func (l *lifecycle) transition(op string, to serverState, fn func() error) (serverState, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	from := l.state
+	if !canTransition(from, to) {
+		return from, l.refuse(op)
+	}
+
+	if fn != nil {
+		if err := fn(); err != nil {
+			return from, err
+		}
+	}
+
+	l.state = to
+	if to == stateStopped {
+		close(l.stoppedChan())
+	}
+	return from, nil
+}
+
+// Returns the error refusing op in the current state. Called with l.mu held.
+func (l *lifecycle) refuse(op string) error {
+	return &Error{Kind: ErrInvalidState, Err: fmt.Errorf("Can't %s the server while it is %s", op, l.state)}
+}
+
+func (l *lifecycle) current() serverState {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.state
+}
+
+// Returns a channel which is closed once the server is stopped.
+func (l *lifecycle) done() <-chan struct{} {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.stoppedChan()
+}
+
+// Called with l.mu held.
+func (l *lifecycle) stoppedChan() chan struct{} {
+	if l.stopped == nil {
+		l.stopped = make(chan struct{})
+	}
+	return l.stopped
+}
@@ -0,0 +1,152 @@
+package server
+
+import (
+	"errors"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Moves a server which tests haven't started to stateRunning.
+func markRunning(s *Server) {
+	s.lifecycle.transition("start", stateRunning, nil)
+}
+
+func TestStateTransitions(t *testing.T) {
+	valid := map[[2]serverState]bool{
+		{stateStarting, stateRunning}:  true,
+		{stateStarting, stateStopped}:  true,
+		{stateRunning, stateReloading}: true,
+		{stateRunning, stateDraining}:  true,
+		{stateRunning, stateStopped}:   true,
+		{stateReloading, stateRunning}: true,
+		{stateReloading, stateStopped}: true,
+		{stateDraining, stateStopped}:  true,
+	}
+
+	for from := stateStarting; from <= stateStopped; from++ {
+		for to := stateStarting; to <= stateStopped; to++ {
+			l := &lifecycle{state: from}
+			_, err := l.transition("test", to, nil)
+			switch {
+			case valid[[2]serverState{from, to}] && err != nil:
+				t.Errorf("%s to %s refused: %v", from, to, err)
+			case !valid[[2]serverState{from, to}] && !errors.Is(err, ErrInvalidState):
+				t.Errorf("%s to %s: got error %v, expected ErrInvalidState", from, to, err)
+			case err != nil && l.current() != from:
+				t.Errorf("%s to %s refused, but the state changed to %s", from, to, l.current())
+			case err == nil && l.current() != to:
+				t.Errorf("%s to %s allowed, but the state is %s", from, to, l.current())
+			}
+		}
+	}
+
+	// A failure of the operation leaves the state as it was.
+	l := &lifecycle{}
+	failure := errors.New("failed")
+	if _, err := l.transition("start", stateRunning, func() error { return failure }); err != failure || l.current() != stateStarting {
+		t.Errorf("failed start: error %v, state %s", err, l.current())
+	}
+
+	select {
+	case <-l.done():
+		t.Fatalf("done before stopping")
+	default:
+	}
+	l.transition("stop", stateStopped, nil)
+	select {
+	case <-l.done():
+	case <-time.After(time.Second):
+		t.Fatalf("not done once stopped")
+	}
+}
+
+// Starts, reloads, drains and stops servers from several goroutines at once,
+// in a random order. Each operation must either succeed or be refused with
+// ErrInvalidState. Run with -race.
+func TestLifecycleStress(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ncdns-state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	const rounds, goroutines, ops = 4, 8, 100
+
+	for round := 0; round < rounds; round++ {
+		cfg := newReloadTestConfig(t, dir)
+		s, err := New(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ncfg := *cfg
+		ncfg.CanonicalNameservers = "ns1.example.net,ns2.example.net"
+
+		var starts, reloads uint64
+		var wg sync.WaitGroup
+		for g := 0; g < goroutines; g++ {
+			wg.Add(1)
+			go func(rng *rand.Rand) {
+				defer wg.Done()
+				for i := 0; i < ops; i++ {
+					var op string
+					var err error
+					switch n := rng.Intn(100); {
+					case n < 20:
+						op = "start"
+						if err = s.Start(); err == nil {
+							atomic.AddUint64(&starts, 1)
+						}
+					case n < 60:
+						op = "reload"
+						c := ncfg
+						if err = s.Reload(&c); err == nil {
+							atomic.AddUint64(&reloads, 1)
+						}
+					case n < 90:
+						op = "query"
+						if nss := queryApexNS(s); len(nss) != 1 && len(nss) != 2 {
+							t.Errorf("apex NS %v in state %s", nss, s.lifecycle.current())
+						}
+					case n < 95:
+						op = "drain"
+						err = s.Drain(0)
+					default:
+						op = "stop"
+						err = s.Stop()
+					}
+					if err != nil && !errors.Is(err, ErrInvalidState) {
+						t.Errorf("%s: unexpected error: %v", op, err)
+					}
+				}
+			}(rand.New(rand.NewSource(int64(round*goroutines + g))))
+		}
+		wg.Wait()
+
+		if err := s.Stop(); err != nil {
+			t.Fatal(err)
+		}
+		if st := s.lifecycle.current(); st != stateStopped {
+			t.Errorf("state %s once stopped", st)
+		}
+		if starts > 1 {
+			t.Errorf("started %d times", starts)
+		}
+		if reloads > 0 && starts == 0 {
+			t.Errorf("reloaded %d times without being started", reloads)
+		}
+		for op, f := range map[string]func() error{
+			"start":  s.Start,
+			"reload": func() error { return s.Reload(&ncfg) },
+			"drain":  func() error { return s.Drain(0) },
+		} {
+			if err := f(); !errors.Is(err, ErrInvalidState) {
+				t.Errorf("%s once stopped: got error %v, expected ErrInvalidState", op, err)
+			}
+		}
+	}
+}
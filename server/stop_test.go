@@ -0,0 +1,120 @@
+//go:build !no_webserver
+// +build !no_webserver
+
+package server
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// A server is started on ephemeral ports, answers a query, and once stopped
+// has released its sockets.
+func TestStartStop(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ncdns-stop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := os.MkdirAll(filepath.Join(dir, "names", "d"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, "names", "d", "example.json"), []byte(`{"ip":"192.0.2.1"}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := newErrorTestConfig(dir)
+	cfg.Fetcher = "static"
+	cfg.StaticDataDir = "names"
+	cfg.HTTP.ListenAddr = "127.0.0.1:0"
+	cfg.TplPath = filepath.Join("..", "_tpl")
+	cfg.TplSet = "std"
+	cfg.StopTimeout = 5
+
+	s, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Stopped in any case, should the test fail early.
+	defer s.Stop()
+	udpAddr, tcpAddr, httpAddr := s.UDPAddrs()[0].String(), s.TCPAddrs()[0].String(), s.HTTPAddr().String()
+
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.bit.", dns.TypeA)
+	for _, network := range []string{"udp", "tcp"} {
+		addr := udpAddr
+		if network == "tcp" {
+			addr = tcpAddr
+		}
+		c := &dns.Client{Net: network}
+		res, _, err := c.Exchange(req, addr)
+		if err != nil {
+			t.Fatalf("%s query: %v", network, err)
+		}
+		if len(res.Answer) == 0 {
+			t.Errorf("%s query: no answer in %v", network, res)
+		}
+	}
+	if res, err := http.Get("http://" + httpAddr + "/healthz"); err != nil {
+		t.Errorf("webserver: %v", err)
+	} else {
+		res.Body.Close()
+	}
+
+	if err := s.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Stop(); err != nil {
+		t.Errorf("stopping again: %v", err)
+	}
+
+	// The same addresses can be bound again at once.
+	if conn, err := net.ListenPacket("udp", udpAddr); err != nil {
+		t.Errorf("UDP socket not released: %v", err)
+	} else {
+		conn.Close()
+	}
+	for _, addr := range []string{tcpAddr, httpAddr} {
+		if l, err := net.Listen("tcp", addr); err != nil {
+			t.Errorf("TCP socket not released: %v", err)
+		} else {
+			l.Close()
+		}
+	}
+}
+
+func TestStopBeforeStart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ncdns-stop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := New(newErrorTestConfig(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := s.UDPAddrs()[0].String()
+
+	if err := s.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if conn, err := net.ListenPacket("udp", addr); err != nil {
+		t.Errorf("UDP socket not released: %v", err)
+	} else {
+		conn.Close()
+	}
+}
@@ -0,0 +1,305 @@
+package server
+
+import (
+	"crypto"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/miekg/dns"
+	madns "gopkg.in/hlandau/madns.v2"
+
+	"github.com/namecoin/ncdns/util"
+)
+
+// The DNSSEC key material used to sign one view of the zone.
+type keySet struct {
+	KSK        *dns.DNSKEY
+	KSKPrivate crypto.PrivateKey
+	ZSK        *dns.DNSKEY
+	ZSKPrivate crypto.PrivateKey
+
+	// ZSKs published besides ZSK, while it's being rolled over.
+	PublishedZSKs []*dns.DNSKEY
+}
+
+// A per-suffix key configuration, as parsed from Config.DNSSEC.SuffixKeys.
+type suffixKeySpec struct {
+	suffix string // fully qualified, lowercase
+
+	// If set, a temporary KSK and ZSK are generated at startup.
+	auto bool
+
+	publicKey, privateKey         string
+	zonePublicKey, zonePrivateKey string
+}
+
+// Parses a list of the form "suffix=pub|priv|zonepub|zonepriv,suffix=auto".
+// The zone key paths may be omitted, in which case a temporary ZSK is
+// generated at startup and signed with the KSK.
+func parseSuffixKeys(s string) ([]suffixKeySpec, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+
+	var specs []suffixKeySpec
+	seen := map[string]struct{}{}
+
+	for _, item := range strings.Split(s, ",") {
+		parts := strings.SplitN(strings.TrimSpace(item), "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("Malformed suffix key entry: %q", item)
+		}
+
+		spec := suffixKeySpec{
+			suffix: strings.ToLower(dns.Fqdn(parts[0])),
+		}
+		if _, ok := dns.IsDomainName(spec.suffix); !ok {
+			return nil, fmt.Errorf("Invalid suffix in suffix key entry: %q", parts[0])
+		}
+		if _, ok := seen[spec.suffix]; ok {
+			return nil, fmt.Errorf("Duplicate suffix in suffix key entries: %s", spec.suffix)
+		}
+		seen[spec.suffix] = struct{}{}
+
+		if parts[1] == "auto" {
+			spec.auto = true
+		} else {
+			paths := strings.Split(parts[1], "|")
+			if len(paths) != 2 && len(paths) != 4 {
+				return nil, fmt.Errorf("Suffix key entry for %s must specify 2 or 4 key files", spec.suffix)
+			}
+
+			spec.publicKey, spec.privateKey = paths[0], paths[1]
+			if len(paths) == 4 {
+				spec.zonePublicKey, spec.zonePrivateKey = paths[2], paths[3]
+			}
+		}
+
+		specs = append(specs, spec)
+	}
+
+	return specs, nil
+}
+
+// Returns the spec for the most specific suffix under which name falls, or
+// nil if name falls under none of them.
+func matchSuffixKeySpec(specs []suffixKeySpec, name string) *suffixKeySpec {
+	var best *suffixKeySpec
+	for i := range specs {
+		if !util.IsInZone(name, specs[i].suffix) {
+			continue
+		}
+		if best == nil || dns.CountLabel(specs[i].suffix) > dns.CountLabel(best.suffix) {
+			best = &specs[i]
+		}
+	}
+
+	return best
+}
+
+func (s *Server) loadKeySet(publicKey, privateKey, zonePublicKey, zonePrivateKey string) (ks *keySet, err error) {
+	ks = &keySet{}
+
+	if publicKey != "" {
+		ks.KSK, ks.KSKPrivate, err = s.loadKey(publicKey, privateKey)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if zonePublicKey != "" {
+		ks.ZSK, ks.ZSKPrivate, err = s.loadKey(zonePublicKey, zonePrivateKey)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if ks.KSK != nil && ks.ZSK == nil {
+		return nil, fmt.Errorf("Must specify ZSK if KSK is specified")
+	}
+
+	return ks, nil
+}
+
+func (s *Server) loadSuffixKeySet(spec *suffixKeySpec) (*keySet, error) {
+	if spec.auto && s.cfg.DNSSEC.KeyDir != "" {
+		return s.savedKeySet(spec.suffix)
+	}
+	if spec.auto {
+		return generateKeySet(spec.suffix)
+	}
+	if spec.zonePublicKey != "" {
+		return s.loadKeySet(spec.publicKey, spec.privateKey, spec.zonePublicKey, spec.zonePrivateKey)
+	}
+
+	// Only the KSK is kept, so that the DS in the parent zone stays valid
+	// across restarts, while the ZSK it signs changes with each. The ZSK
+	// uses the KSK's algorithm, as each RRset must be signed with every
+	// algorithm at the apex.
+	ks := &keySet{}
+	var err error
+	ks.KSK, ks.KSKPrivate, err = s.loadKey(spec.publicKey, spec.privateKey)
+	if err != nil {
+		return nil, err
+	}
+	ks.ZSK, ks.ZSKPrivate, err = GenerateKey(spec.suffix, 256, ks.KSK.Algorithm, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	return ks, nil
+}
+
+// Generates a temporary KSK and ZSK for zone. They last only for the
+// lifetime of the process.
+func generateKeySet(zone string) (*keySet, error) {
+	ks := &keySet{}
+
+	var err error
+	ks.KSK, ks.KSKPrivate, err = generateKey(zone, 257)
+	if err != nil {
+		return nil, err
+	}
+
+	ks.ZSK, ks.ZSKPrivate, err = generateKey(zone, 256)
+	if err != nil {
+		return nil, err
+	}
+
+	return ks, nil
+}
+
+// Like generateKeySet, but the keys are saved in KeyDir, and loaded from
+// there if they were saved before.
+func (s *Server) savedKeySet(zone string) (*keySet, error) {
+	ks := &keySet{}
+
+	var err error
+	ks.KSK, ks.KSKPrivate, err = s.savedKey(zone, 257)
+	if err != nil {
+		return nil, err
+	}
+
+	ks.ZSK, ks.ZSKPrivate, err = s.savedKey(zone, 256)
+	if err != nil {
+		return nil, err
+	}
+
+	return ks, nil
+}
+
+func (s *Server) savedKey(zone string, flags uint16) (*dns.DNSKEY, crypto.PrivateKey, error) {
+	publicKey, privateKey := s.cfg.savedKeyPaths(zone, flags)
+	if _, err := os.Stat(s.cfg.cpath(publicKey)); err == nil {
+		return s.loadKey(publicKey, privateKey)
+	} else if !os.IsNotExist(err) {
+		return nil, nil, err
+	}
+
+	k, privatek, err := generateKey(zone, flags)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := os.MkdirAll(s.cfg.cpath(s.cfg.DNSSEC.KeyDir), 0700); err != nil {
+		return nil, nil, err
+	}
+	// The private key is written first, so that a key whose public half
+	// exists is complete.
+	if err := ioutil.WriteFile(s.cfg.cpath(privateKey), []byte(k.PrivateKeyString(privatek)), 0600); err != nil {
+		return nil, nil, err
+	}
+	if err := ioutil.WriteFile(s.cfg.cpath(publicKey), []byte(k.String()+"\n"), 0644); err != nil {
+		return nil, nil, err
+	}
+
+	log.Infof("Generated a key for %s in %s", zone, s.cfg.cpath(publicKey))
+	return k, privatek, nil
+}
+
+// Returns the paths of the public and private key files of the KSK (flags
+// 257) or ZSK (256) for zone in KeyDir, e.g. "bit.ksk.key" and
+// "bit.ksk.private", relative to ConfigDir like other paths.
+func (cfg *Config) savedKeyPaths(zone string, flags uint16) (publicKey, privateKey string) {
+	name := strings.TrimSuffix(zone, ".")
+	if name == "" {
+		name = "root"
+	}
+	if flags == 257 {
+		name += ".ksk"
+	} else {
+		name += ".zsk"
+	}
+
+	return filepath.Join(cfg.DNSSEC.KeyDir, name+".key"), filepath.Join(cfg.DNSSEC.KeyDir, name+".private")
+}
+
+func generateKey(zone string, flags uint16) (*dns.DNSKEY, crypto.PrivateKey, error) {
+	return GenerateKey(zone, flags, dns.ECDSAP256SHA256, 0)
+}
+
+func newEngine(b madns.Backend, ks *keySet) (madns.Engine, error) {
+	return madns.NewEngine(&madns.EngineConfig{
+		Backend:       b,
+		VersionString: ncdnsVersion,
+		KSK:           ks.KSK,
+		KSKPrivate:    ks.KSKPrivate,
+		ZSK:           ks.ZSK,
+		ZSKPrivate:    ks.ZSKPrivate,
+	})
+}
+
+// Returns the keys used to sign responses for name: those of the most
+// specific configured suffix, falling back to the global keys.
+func (s *Server) keySetForName(name string) *keySet {
+	spec := matchSuffixKeySpec(s.cfg.suffixKeys, name)
+	if spec == nil {
+		return s.globalKeys()
+	}
+
+	s.stateMu.RLock()
+	defer s.stateMu.RUnlock()
+
+	return s.suffixKeySets[spec.suffix]
+}
+
+// Returns the global keys, which change when the ZSK is rolled over or the
+// configuration is reloaded.
+func (s *Server) globalKeys() *keySet {
+	s.stateMu.RLock()
+	defer s.stateMu.RUnlock()
+
+	return s.globalKeySet
+}
+
+// LoadSuffixKSK loads the KSK public key used for the given suffix without
+// starting a server, falling back to the global KSK if the suffix has no keys
+// of its own.
+func (cfg *Config) LoadSuffixKSK(suffix string) (*dns.DNSKEY, error) {
+	specs, err := parseSuffixKeys(cfg.DNSSEC.SuffixKeys)
+	if err != nil {
+		return nil, err
+	}
+
+	spec := matchSuffixKeySpec(specs, suffix)
+	if spec == nil {
+		return cfg.LoadKSK()
+	}
+
+	if spec.auto && cfg.DNSSEC.KeyDir != "" {
+		publicKey, _ := cfg.savedKeyPaths(spec.suffix, 257)
+		k, err := cfg.loadPublicKey(publicKey)
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("Suffix %s uses keys generated at startup, which haven't been generated in %s yet", spec.suffix, cfg.DNSSEC.KeyDir)
+		}
+		return k, err
+	}
+	if spec.auto {
+		return nil, fmt.Errorf("Suffix %s uses temporary keys, which have no persistent trust anchor", spec.suffix)
+	}
+
+	return cfg.loadPublicKey(spec.publicKey)
+}
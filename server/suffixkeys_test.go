@@ -0,0 +1,275 @@
+package server
+
+import (
+	"crypto"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/namecoin/ncdns/backend"
+)
+
+func signWith(t *testing.T, ks *keySet, name string) *dns.RRSIG {
+	rr := &dns.A{
+		Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 600},
+		A:   net.ParseIP("192.0.2.1"),
+	}
+
+	sig := &dns.RRSIG{
+		Hdr:        dns.RR_Header{Name: name, Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: 600},
+		KeyTag:     ks.ZSK.KeyTag(),
+		SignerName: ks.ZSK.Hdr.Name,
+		Algorithm:  ks.ZSK.Algorithm,
+		Inception:  uint32(time.Now().Add(-time.Hour).Unix()),
+		Expiration: uint32(time.Now().Add(time.Hour).Unix()),
+	}
+	if err := sig.Sign(ks.ZSKPrivate.(crypto.Signer), []dns.RR{rr}); err != nil {
+		t.Fatalf("Couldn't sign under %s: %v", name, err)
+	}
+	if err := sig.Verify(ks.ZSK, []dns.RR{rr}); err != nil {
+		t.Fatalf("Signature under %s didn't verify: %v", name, err)
+	}
+
+	return sig
+}
+
+func TestSuffixKeySelection(t *testing.T) {
+	specs, err := parseSuffixKeys("bit.=auto, bit.corp.example=auto")
+	if err != nil {
+		t.Fatalf("Couldn't parse suffix keys: %v", err)
+	}
+
+	global, err := generateKeySet("bit.")
+	if err != nil {
+		t.Fatalf("Couldn't generate global keys: %v", err)
+	}
+
+	s := &Server{
+		cfg:           Config{suffixKeys: specs},
+		globalKeySet:  global,
+		suffixKeySets: map[string]*keySet{},
+	}
+	for i := range specs {
+		s.suffixKeySets[specs[i].suffix], err = s.loadSuffixKeySet(&specs[i])
+		if err != nil {
+			t.Fatalf("Couldn't set up keys for %s: %v", specs[i].suffix, err)
+		}
+	}
+
+	public := signWith(t, s.keySetForName("www.example.bit."), "www.example.bit.")
+	corp := signWith(t, s.keySetForName("www.example.bit.corp.example."), "www.example.bit.corp.example.")
+	other := signWith(t, s.keySetForName("www.example.bit.other.example."), "www.example.bit.other.example.")
+
+	if public.KeyTag == corp.KeyTag {
+		t.Errorf("both suffixes were signed with key tag %d", public.KeyTag)
+	}
+	if corp.SignerName != "bit.corp.example." {
+		t.Errorf("internal view signed by %s", corp.SignerName)
+	}
+	if public.SignerName != "bit." {
+		t.Errorf("public view signed by %s", public.SignerName)
+	}
+
+	// bit.other.example has no keys of its own, and "bit." is not a suffix
+	// of it, so it falls back to the global keys.
+	if other.KeyTag != global.ZSK.KeyTag() {
+		t.Errorf("unconfigured suffix not signed with the global key: got tag %d, want %d", other.KeyTag, global.ZSK.KeyTag())
+	}
+
+	// Matching is label-aware and case-insensitive.
+	if s.keySetForName("WWW.EXAMPLE.BIT.CORP.EXAMPLE.") != s.suffixKeySets["bit.corp.example."] {
+		t.Errorf("suffix matching is case-sensitive")
+	}
+	if s.keySetForName("example.xbit.corp.example.") != global {
+		t.Errorf("suffix matched across a label boundary")
+	}
+}
+
+func TestParseSuffixKeys(t *testing.T) {
+	specs, err := parseSuffixKeys("bit.corp.example=ksk.key|ksk.private|zsk.key|zsk.private,Bit.Lab=ksk2.key|ksk2.private")
+	if err != nil {
+		t.Fatalf("Couldn't parse suffix keys: %v", err)
+	}
+	if len(specs) != 2 {
+		t.Fatalf("expected 2 specs, got %d", len(specs))
+	}
+	if specs[0].suffix != "bit.corp.example." || specs[0].zonePrivateKey != "zsk.private" {
+		t.Errorf("unexpected first spec: %+v", specs[0])
+	}
+	if specs[1].suffix != "bit.lab." || specs[1].zonePublicKey != "" || specs[1].privateKey != "ksk2.private" {
+		t.Errorf("unexpected second spec: %+v", specs[1])
+	}
+
+	for _, bad := range []string{"bit.corp.example", "=auto", "a=b|c|d", "a=auto,A.=auto"} {
+		if _, err := parseSuffixKeys(bad); err == nil {
+			t.Errorf("malformed suffix keys %q accepted", bad)
+		}
+	}
+}
+
+// A suffix given only a KSK loads it, and signs with a temporary ZSK of the
+// same algorithm.
+func TestSuffixKSKOnly(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ncdns-keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	k, privatek, err := GenerateKey("bit.lab.", 257, dns.RSASHA256, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	base, err := WriteKeyFiles(dir, k, privatek)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	specs, err := parseSuffixKeys("bit.lab=" + base + ".key|" + base + ".private")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{cfg: Config{suffixKeys: specs}}
+	ks, err := s.loadSuffixKeySet(&specs[0])
+	if err != nil {
+		t.Fatalf("Couldn't load a KSK without a ZSK: %v", err)
+	}
+	if ks.KSK.String() != k.String() {
+		t.Errorf("got KSK %v, expected %v", ks.KSK, k)
+	}
+	if ks.ZSK == nil || ks.ZSK.Flags != 256 || ks.ZSK.Algorithm != dns.RSASHA256 || ks.ZSK.Hdr.Name != "bit.lab." {
+		t.Fatalf("got ZSK %v, expected an RSASHA256 ZSK for bit.lab.", ks.ZSK)
+	}
+	signWith(t, ks, "example.bit.lab.")
+
+	// It's kept on reloading, as resolvers may have cached it.
+	reloaded, err := s.loadSuffixKeySets(map[string]*keySet{"bit.lab.": ks})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reloaded["bit.lab."].ZSK != ks.ZSK {
+		t.Errorf("temporary ZSK replaced on reloading")
+	}
+
+	if _, err := s.loadSuffixKeySet(&suffixKeySpec{suffix: "bit.lab.", publicKey: base + ".key", privateKey: filepath.Join(dir, "missing.private")}); err == nil {
+		t.Errorf("loaded a KSK without its private key")
+	}
+}
+
+// With KeyDir set, the keys of an auto suffix are saved when generated, and
+// the same keys are loaded on the next start.
+func TestSavedKeySet(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ncdns-keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := Config{DNSSEC: DNSSECConfig{KeyDir: filepath.Join(dir, "keys"), SuffixKeys: "bit=auto"}}
+	if _, err := cfg.LoadSuffixKSK("bit."); err == nil {
+		t.Errorf("got a KSK before any were generated")
+	}
+
+	s := &Server{cfg: cfg}
+	spec := suffixKeySpec{suffix: "bit.", auto: true}
+	first, err := s.loadSuffixKeySet(&spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fi, err := os.Stat(filepath.Join(dir, "keys", "bit.ksk.private"))
+	if err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("private key file %v, %v; expected mode 0600", fi, err)
+	}
+
+	second, err := s.loadSuffixKeySet(&spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.KSK.String() != first.KSK.String() || second.ZSK.String() != first.ZSK.String() || second.KSK.Flags != 257 || second.ZSK.Flags != 256 {
+		t.Errorf("got keys %v, %v; expected the saved %v, %v", second.KSK, second.ZSK, first.KSK, first.ZSK)
+	}
+	signWith(t, second, "example.bit.")
+
+	if ksk, err := cfg.LoadSuffixKSK("bit."); err != nil || ksk.String() != first.KSK.String() {
+		t.Errorf("trust anchor %v, %v; expected %v", ksk, err, first.KSK)
+	}
+}
+
+// Answers under a suffix with keys of its own are generated with their owner
+// names under it before they're signed, so a resolver trusting only the
+// suffix's DS, as published for it, validates them, while the global trust
+// anchor doesn't.
+func TestSuffixKeysValidate(t *testing.T) {
+	be, err := backend.New(&backend.Config{
+		CacheMaxEntries: 100,
+		FakeNames: map[string]string{
+			"d/example": `{"ip":"192.0.2.1","map":{"www":{"ip6":"2001:db8::1"}}}`,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	global, err := generateKeySet("bit.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{
+		backend:       be,
+		globalKeySet:  global,
+		suffixKeySets: map[string]*keySet{},
+		clientStats:   newClientStats(10000, time.Minute, 0, 0, nil),
+	}
+	s.cfg.suffixKeys, _ = parseSuffixKeys("bit.corp.example=auto")
+	corp, err := s.loadSuffixKeySet(&s.cfg.suffixKeys[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.suffixKeySets["bit.corp.example."] = corp
+	s.mux, err = s.newMux(be, global, s.suffixKeySets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	markRunning(s)
+
+	anchors := map[string]*dns.DS{}
+	for _, a := range s.setupAnchors() {
+		rr, err := dns.NewRR(a.DS[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		anchors[a.Zone] = rr.(*dns.DS)
+	}
+	if anchors["bit."] == nil || anchors["bit.corp.example."] == nil || anchors["bit.corp.example."].KeyTag != corp.KSK.KeyTag() {
+		t.Fatalf("got trust anchors %v", anchors)
+	}
+
+	for qname, qtype := range map[string]uint16{
+		"example.bit.corp.example.":     dns.TypeA,
+		"www.example.bit.corp.example.": dns.TypeAAAA,
+	} {
+		status, answer := validateUnder(t, s, "bit.corp.example.", anchors["bit.corp.example."], qname, qtype)
+		if status != "secure" || len(answer) == 0 {
+			t.Errorf("%s: %s under the suffix's trust anchor", qname, status)
+		}
+		for _, rr := range answer {
+			if !strings.EqualFold(rr.Header().Name, qname) {
+				t.Errorf("%s: answered with %v", qname, rr)
+			}
+		}
+		if status, _ := validateUnder(t, s, "bit.corp.example.", anchors["bit."], qname, qtype); status != "bogus" {
+			t.Errorf("%s: %s under the global trust anchor", qname, status)
+		}
+	}
+
+	if status, _ := validateUnder(t, s, "bit.", anchors["bit."], "example.bit.", dns.TypeA); status != "secure" {
+		t.Errorf("example.bit.: %s under the global trust anchor", status)
+	}
+}
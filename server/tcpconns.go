@@ -0,0 +1,163 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Counts the TCP connections open, over plain TCP and TLS alike, and closes
+// those accepted beyond TCPMaxConnections at once, so that clients holding
+// connections open can't exhaust the server's sockets. Connections doing
+// nothing are closed by the DNS server after TCPReadTimeout, before their
+// first query, or TCPIdleTimeout, between queries.
+type tcpConnLimit struct {
+	// Accessed atomically.
+	open     int64
+	rejected uint64
+
+	max int64 // 0 if there's no limit
+
+	// Those open, by their addresses, so that a query can find the
+	// connection it came over.
+	connsMu sync.Mutex
+	conns   map[string]*limitedConn
+}
+
+type tcpConnStatus struct {
+	Open     int64  `json:"open"`
+	Max      int64  `json:"max,omitempty"`
+	Rejected uint64 `json:"rejected"` // closed as soon as accepted, as Max were open
+}
+
+// The timeouts used if TCPReadTimeout or TCPIdleTimeout is left at 0, as in
+// a Config made in code rather than loaded.
+const (
+	defaultTCPReadTimeout = 2000
+	defaultTCPIdleTimeout = 10000
+)
+
+// Checks the TCP connection options.
+func (s *Server) setupTCPConns() error {
+	if s.cfg.TCPIdleTimeout < 0 || s.cfg.TCPReadTimeout < 0 {
+		return fmt.Errorf("TCPIdleTimeout and TCPReadTimeout must not be negative")
+	}
+	if s.cfg.TCPReadTimeout == 0 {
+		s.cfg.TCPReadTimeout = defaultTCPReadTimeout
+	}
+	if s.cfg.TCPIdleTimeout == 0 {
+		s.cfg.TCPIdleTimeout = defaultTCPIdleTimeout
+	}
+	if s.cfg.TCPMaxConnections < 0 {
+		return fmt.Errorf("TCPMaxConnections must not be negative")
+	}
+	s.tcpConns.max = int64(s.cfg.TCPMaxConnections)
+	return nil
+}
+
+// Returns a listener whose connections count towards the limit.
+func (l *tcpConnLimit) wrap(listener net.Listener) net.Listener {
+	return &limitedListener{Listener: listener, limit: l}
+}
+
+// Counts a connection as open, returning false if the limit is reached.
+func (l *tcpConnLimit) acquire() bool {
+	for {
+		n := atomic.LoadInt64(&l.open)
+		if l.max != 0 && n >= l.max {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&l.open, n, n+1) {
+			return true
+		}
+	}
+}
+
+func (l *tcpConnLimit) Status() tcpConnStatus {
+	return tcpConnStatus{
+		Open:     atomic.LoadInt64(&l.open),
+		Max:      l.max,
+		Rejected: atomic.LoadUint64(&l.rejected),
+	}
+}
+
+type limitedListener struct {
+	net.Listener
+	limit *tcpConnLimit
+}
+
+// Returns the next connection for which there's room, closing those for which
+// there isn't. The client sees its connection closed before it's sent
+// anything, and may try again later.
+func (ll *limitedListener) Accept() (net.Conn, error) {
+	for {
+		c, err := ll.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if ll.limit.acquire() {
+			lc := &limitedConn{Conn: c, limit: ll.limit}
+			ll.limit.add(lc)
+			return lc, nil
+		}
+		atomic.AddUint64(&ll.limit.rejected, 1)
+		c.Close()
+	}
+}
+
+type limitedConn struct {
+	net.Conn
+	limit     *tcpConnLimit
+	closeOnce sync.Once
+}
+
+func (c *limitedConn) Close() error {
+	err := c.Conn.Close()
+	c.closeOnce.Do(func() {
+		atomic.AddInt64(&c.limit.open, -1)
+		c.limit.remove(c)
+	})
+	return err
+}
+
+func connKey(local, remote net.Addr) string {
+	return local.String() + " " + remote.String()
+}
+
+func (l *tcpConnLimit) add(c *limitedConn) {
+	l.connsMu.Lock()
+	defer l.connsMu.Unlock()
+
+	if l.conns == nil {
+		l.conns = map[string]*limitedConn{}
+	}
+	l.conns[connKey(c.LocalAddr(), c.RemoteAddr())] = c
+}
+
+func (l *tcpConnLimit) remove(c *limitedConn) {
+	l.connsMu.Lock()
+	defer l.connsMu.Unlock()
+
+	key := connKey(c.LocalAddr(), c.RemoteAddr())
+	if l.conns[key] == c {
+		delete(l.conns, key)
+	}
+}
+
+// Returns the open connection between local and remote, or nil if there's
+// none.
+func (l *tcpConnLimit) conn(local, remote net.Addr) *limitedConn {
+	l.connsMu.Lock()
+	defer l.connsMu.Unlock()
+
+	return l.conns[connKey(local, remote)]
+}
+
+// The time for which a TCP connection may wait between queries. Those sending
+// queries one after another, as RFC 7766 allows, are kept open however long
+// they last.
+func (s *Server) tcpIdleTimeout() time.Duration {
+	return time.Duration(s.cfg.TCPIdleTimeout) * time.Millisecond
+}
@@ -0,0 +1,122 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Idle connections are closed after the timeouts, those beyond
+// TCPMaxConnections at once, while one sending query after query stays open.
+func TestTCPConnections(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ncdns-tcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := os.MkdirAll(filepath.Join(dir, "names", "d"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, "names", "d", "example.json"), []byte(`{"ip":"192.0.2.1"}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const timeout = 300 * time.Millisecond
+	cfg := newErrorTestConfig(dir)
+	cfg.Fetcher = "static"
+	cfg.StaticDataDir = "names"
+	cfg.TCPReadTimeout = int(timeout / time.Millisecond)
+	cfg.TCPIdleTimeout = int(timeout / time.Millisecond)
+	cfg.TCPMaxConnections = 3
+
+	s, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+	addr := s.TCPAddrs()[0].String()
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	dial := func() *dns.Conn {
+		c, err := dns.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+	query := func(c *dns.Conn) error {
+		req := new(dns.Msg)
+		req.SetQuestion("example.bit.", dns.TypeA)
+		c.SetDeadline(time.Now().Add(time.Second))
+		if err := c.WriteMsg(req); err != nil {
+			return err
+		}
+		_, err := c.ReadMsg()
+		return err
+	}
+	// Returns how long c stays open, waiting at most a second.
+	openFor := func(c *dns.Conn, start time.Time) time.Duration {
+		c.SetReadDeadline(start.Add(time.Second))
+		c.Conn.Read(make([]byte, 1))
+		return time.Since(start)
+	}
+
+	active, idle, silent := dial(), dial(), dial()
+	defer active.Close()
+	for _, c := range []*dns.Conn{active, idle} {
+		if err := query(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A fourth is closed at once.
+	start := time.Now()
+	extra := dial()
+	if d := openFor(extra, start); d >= timeout {
+		t.Errorf("connection over TCPMaxConnections open for %v", d)
+	}
+	extra.Close()
+
+	// The active connection queries at half the idle timeout, outlasting the
+	// others, which are closed on schedule.
+	done := make(chan error, 1)
+	go func() {
+		for i := 0; i < 6; i++ {
+			time.Sleep(timeout / 2)
+			if err := query(active); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+	for _, c := range []*dns.Conn{idle, silent} {
+		d := openFor(c, start)
+		if d < timeout/2 || d > 3*timeout {
+			t.Errorf("idle connection closed after %v, expected about %v", d, timeout)
+		}
+		c.Close()
+	}
+	if err := <-done; err != nil {
+		t.Errorf("active connection closed: %v", err)
+	}
+
+	// The connections closed make room for new ones.
+	c := dial()
+	if err := query(c); err != nil {
+		t.Errorf("no room for a new connection: %v", err)
+	}
+	c.Close()
+
+	if st := s.tcpConns.Status(); st.Rejected != 1 || st.Max != 3 {
+		t.Errorf("unexpected status %+v", st)
+	}
+}
@@ -0,0 +1,129 @@
+package server
+
+import (
+	"context"
+	"sync/atomic"
+
+	"github.com/miekg/dns"
+
+	"github.com/namecoin/ncdns/backend"
+	"github.com/namecoin/ncdns/tracing"
+)
+
+// Serves a DNS query, tracing it if tracing is enabled and the query is
+// sampled.
+func (s *Server) ServeDNS(rw dns.ResponseWriter, req *dns.Msg) {
+	s.serveDNS(context.Background(), rw, req)
+}
+
+// Serves a DNS query, whose lookups are abandoned once ctx is done.
+func (s *Server) serveDNS(ctx context.Context, rw dns.ResponseWriter, req *dns.Msg) {
+	atomic.AddInt64(&s.inflight, 1)
+	defer atomic.AddInt64(&s.inflight, -1)
+
+	rw = s.metricsWriter(rw, req)
+	rw = s.queryLogWriter(rw, req)
+	if s.refuseDenied(rw, req) {
+		return
+	}
+	rw = s.admitClient(rw, req)
+	if rw == nil {
+		return
+	}
+	if s.serveNotify(rw, req) {
+		return
+	}
+	if s.serveUnconfirmedSetup(rw, req) {
+		return
+	}
+	if s.serveTransfer(rw, req) {
+		return
+	}
+
+	rw = s.rrlWriter(rw, req)
+	if s.serveOutOfZone(rw, req) {
+		return
+	}
+	rw = s.ednsWriter(rw, req)
+	if s.serveBadEDNSVersion(rw, req) {
+		return
+	}
+	if s.serveBadClientSubnet(rw, req) {
+		return
+	}
+	if s.serveBadCookie(rw, req) {
+		return
+	}
+
+	rw = s.sectionWriter(rw, req)
+	rw = s.dnssecStripWriter(rw, req)
+	rw = s.delegationWriter(rw, req)
+	rw = s.expiredNameWriter(rw, req)
+	rw = s.signatureWriter(rw)
+	rw = s.sigGuardWriter(rw)
+	rw = s.apexTTLWriter(rw)
+	rw = s.dnskeyWriter(rw)
+
+	if s.serveMetaQuery(rw, req) {
+		return
+	}
+	if len(req.Question) == 0 {
+		s.currentMux().ServeDNS(rw, req)
+		return
+	}
+	if s.chaos != nil && req.Question[0].Qclass == dns.ClassCHAOS {
+		s.chaos.ServeDNS(rw, req)
+		return
+	}
+
+	ctx, cancel := s.queryContext(ctx, rw)
+	defer cancel()
+	if !tracing.Enabled() {
+		s.serveEngine(ctx, rw, req)
+		return
+	}
+
+	ctx, span := tracing.Start(ctx, "dns.query")
+	defer span.End()
+	if !span.Recording() {
+		s.serveEngine(ctx, rw, req)
+		return
+	}
+
+	q := req.Question[0]
+	span.SetAttribute("dns.qname", q.Name)
+	span.SetAttribute("dns.qtype", dns.TypeToString[q.Qtype])
+
+	// The engine span covers everything madns does, including DNSSEC
+	// signing.
+	ectx, espan := tracing.Start(ctx, "madns.engine")
+	trw := &rcodeRecorder{ResponseWriter: rw}
+	s.serveEngine(ectx, trw, req)
+	espan.End()
+
+	if trw.msg != nil {
+		span.SetAttribute("dns.rcode", dns.RcodeToString[trw.msg.Rcode])
+	}
+}
+
+// Answers a query with the engine the mux passes it to, whose lookups are
+// made with ctx: its deadline and cancellation, its work budget, and its span
+// if it's traced.
+func (s *Server) serveEngine(ctx context.Context, rw dns.ResponseWriter, req *dns.Msg) {
+	if wb := s.newWorkBudget(req); wb != nil {
+		ctx = backend.WithWorkBudget(ctx, wb)
+		rw = s.workBudgetWriter(rw, req, wb)
+	}
+	s.currentMux().ServeDNS(&lookupContextWriter{ResponseWriter: rw, ctx: ctx}, req)
+}
+
+// Records the response written to a dns.ResponseWriter.
+type rcodeRecorder struct {
+	dns.ResponseWriter
+	msg *dns.Msg
+}
+
+func (rw *rcodeRecorder) WriteMsg(m *dns.Msg) error {
+	rw.msg = m
+	return rw.ResponseWriter.WriteMsg(m)
+}
@@ -0,0 +1,125 @@
+//go:build otel
+// +build otel
+
+package server
+
+import (
+	"context"
+	"testing"
+
+	"github.com/miekg/dns"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+
+	"github.com/namecoin/ncdns/backend"
+	"github.com/namecoin/ncdns/tracing"
+)
+
+// The in-memory exporter forgets its spans when shut down, which happens when
+// tracing is shut down to flush them.
+type keepSpansExporter struct {
+	*tracetest.InMemoryExporter
+}
+
+func (keepSpansExporter) Shutdown(context.Context) error {
+	return nil
+}
+
+func TestQueryTrace(t *testing.T) {
+	exp := keepSpansExporter{tracetest.NewInMemoryExporter()}
+	if err := tracing.SetupWithExporter(exp, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := backend.New(&backend.Config{
+		CacheMaxEntries: 100,
+		FakeNames: map[string]string{
+			"d/example":  `{"import":"d/imported"}`,
+			"d/imported": `{"ip":["192.0.2.1"]}`,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Server{
+		backend:      b,
+		globalKeySet: &keySet{},
+		mux:          dns.NewServeMux(),
+	}
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.bit.", dns.TypeA)
+	rw := &fakeResponseWriter{}
+	s.ServeDNS(rw, req)
+	if rw.msg == nil {
+		t.Fatalf("no response written")
+	}
+
+	if err := tracing.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+
+	spans := exp.GetSpans()
+	byName := map[string]tracetest.SpanStub{}
+	for _, span := range spans {
+		if _, ok := byName[span.Name]; ok && span.Name != "backend.resolve" {
+			t.Errorf("duplicate span %s", span.Name)
+		}
+		byName[span.Name] = span
+	}
+
+	parentOf := func(child string) string {
+		c, ok := byName[child]
+		if !ok {
+			t.Fatalf("missing span %s", child)
+		}
+		for _, span := range spans {
+			if span.SpanContext.SpanID() == c.Parent.SpanID() {
+				return span.Name
+			}
+		}
+		return ""
+	}
+
+	expected := map[string]string{
+		"dns.query":      "",
+		"madns.engine":   "dns.query",
+		"backend.fetch":  "madns.engine",
+		"backend.import": "backend.fetch",
+	}
+	for child, parent := range expected {
+		if p := parentOf(child); p != parent {
+			t.Errorf("span %s has parent %q, expected %q", child, p, parent)
+		}
+	}
+
+	// One fetch for the name itself, one for its import.
+	resolveParents := map[string]int{}
+	for _, span := range spans {
+		if span.Name == "backend.resolve" {
+			for _, p := range spans {
+				if p.SpanContext.SpanID() == span.Parent.SpanID() {
+					resolveParents[p.Name]++
+				}
+			}
+		}
+	}
+	if resolveParents["backend.fetch"] != 1 || resolveParents["backend.import"] != 1 {
+		t.Errorf("unexpected resolve span parents: %v", resolveParents)
+	}
+
+	attrs := map[string]string{}
+	for _, kv := range byName["dns.query"].Attributes {
+		attrs[string(kv.Key)] = kv.Value.Emit()
+	}
+	for k, v := range map[string]string{
+		"dns.qname":   "example.bit.",
+		"dns.qtype":   "A",
+		"dns.rcode":   "NOERROR",
+		"ncdns.cache": "miss",
+	} {
+		if attrs[k] != v {
+			t.Errorf("query span attribute %s is %q, expected %q", k, attrs[k], v)
+		}
+	}
+}
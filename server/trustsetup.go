@@ -0,0 +1,211 @@
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/namecoin/ncdns/clock"
+	"github.com/namecoin/ncdns/trustanchor"
+)
+
+// The file in KeyDir whose existence confirms the trust setup begun in setup
+// mode, so that a restart after it serves as usual, and one before it resumes
+// the setup with the keys already generated there.
+const setupConfirmedFile = "setup-confirmed"
+
+// How often setupConfirmedFile is looked for.
+const setupPollInterval = time.Second
+
+// The initial trust setup of SetupMode: until the operator confirms that the
+// DS records of the KSKs are published in the parent zones, or the trust
+// anchors configured in the resolvers, only the records at the apex of each
+// zone which resolvers need to check the chain of trust are answered, so
+// that no resolver caches data it can't validate, or validates against the
+// wrong keys, while ncdns is being brought up.
+type trustSetup struct {
+	marker string // the path of setupConfirmedFile
+	clock  clock.Clock
+
+	// Accessed atomically.
+	confirmed int32
+	refused   uint64
+}
+
+// A zone whose KSK must be trusted, with its DS records and its trust anchor
+// in the syntax of each resolver export-trust-anchor supports.
+type setupAnchor struct {
+	Zone         string            `json:"zone"`
+	KeyTag       uint16            `json:"key_tag"`
+	DS           []string          `json:"ds"`
+	TrustAnchors map[string]string `json:"trust_anchors"`
+}
+
+// Sets up setup mode, if SetupMode is set, once the keys are loaded. The
+// setup is confirmed already if setupConfirmedFile exists.
+func (s *Server) setupTrustSetup() error {
+	if !s.cfg.DNSSEC.SetupMode {
+		return nil
+	}
+	if s.cfg.DNSSEC.KeyDir == "" {
+		return configError("Setup requires KeyDir, in which the keys are kept until the setup is confirmed, so that a restart resumes it")
+	}
+	if len(s.setupAnchors()) == 0 {
+		return configError("Setup requires a KSK: PublicKey, or a suffix of SuffixKeys set to auto")
+	}
+
+	ts := &trustSetup{
+		marker: s.cfg.cpath(filepath.Join(s.cfg.DNSSEC.KeyDir, setupConfirmedFile)),
+		clock:  clock.Or(s.clock),
+	}
+	if _, err := os.Stat(ts.marker); err == nil {
+		ts.confirmed = 1
+		log.Infof("Setup was confirmed by %s; serving as usual", ts.marker)
+	} else if !os.IsNotExist(err) {
+		return configError("Setup: %v", err)
+	}
+	s.trustSetup = ts
+	return nil
+}
+
+func (ts *trustSetup) isConfirmed() bool {
+	return atomic.LoadInt32(&ts.confirmed) != 0
+}
+
+// Confirms the setup, creating setupConfirmedFile so that it stays confirmed.
+// Returns false if it was already.
+func (ts *trustSetup) confirm() (bool, error) {
+	if !atomic.CompareAndSwapInt32(&ts.confirmed, 0, 1) {
+		return false, nil
+	}
+
+	err := ioutil.WriteFile(ts.marker, []byte(ts.clock.Now().UTC().Format(time.RFC3339)+"\n"), 0644)
+	if err != nil {
+		atomic.StoreInt32(&ts.confirmed, 0)
+		return false, fmt.Errorf("couldn't write %s: %v", ts.marker, err)
+	}
+	log.Infof("Setup confirmed; serving names")
+	return true, nil
+}
+
+// Confirms the setup if setupConfirmedFile has been created meanwhile, e.g.
+// by the operator touching it.
+func (ts *trustSetup) poll() {
+	if ts.isConfirmed() {
+		return
+	}
+	if _, err := os.Stat(ts.marker); err == nil && atomic.CompareAndSwapInt32(&ts.confirmed, 0, 1) {
+		log.Infof("Setup confirmed by %s; serving names", ts.marker)
+	}
+}
+
+func (ts *trustSetup) run(done <-chan struct{}) {
+	for !ts.isConfirmed() {
+		select {
+		case <-ts.clock.NewTimer(setupPollInterval).C():
+		case <-done:
+			return
+		}
+		ts.poll()
+	}
+}
+
+// Logs what the operator must do to confirm the setup: the DS records and
+// trust anchors of each KSK, and how to confirm it.
+func (s *Server) logTrustSetup() {
+	if s.trustSetup == nil || s.trustSetup.isConfirmed() {
+		return
+	}
+
+	log.Warnf("Setup mode: answering only the SOA, NS and DNSKEY records at the zone apexes until the setup is confirmed")
+	for _, a := range s.setupAnchors() {
+		for _, ds := range a.DS {
+			log.Infof("Setup mode: DS record of the KSK of %s: %s", a.Zone, ds)
+		}
+		formats := make([]string, 0, len(a.TrustAnchors))
+		for format := range a.TrustAnchors {
+			formats = append(formats, format)
+		}
+		sort.Strings(formats)
+		for _, format := range formats {
+			log.Infof("Setup mode: %s trust anchor for %s:\n%s", format, a.Zone, a.TrustAnchors[format])
+		}
+	}
+	log.Infof("Setup mode: once the DS records are published in the parent zones, or the trust anchors configured in the resolvers, confirm the setup by creating %s", s.trustSetup.marker)
+}
+
+// Returns the KSKs of the zones served, the global one and those of the
+// suffixes of SuffixKeys, as they must be trusted.
+func (s *Server) setupAnchors() []setupAnchor {
+	ksks := []*dns.DNSKEY{}
+	if ks := s.globalKeys(); ks != nil && ks.KSK != nil {
+		ksks = append(ksks, ks.KSK)
+	}
+	s.stateMu.RLock()
+	for _, spec := range s.cfg.suffixKeys {
+		if ks := s.suffixKeySets[spec.suffix]; ks != nil && ks.KSK != nil {
+			ksks = append(ksks, ks.KSK)
+		}
+	}
+	s.stateMu.RUnlock()
+
+	anchors := []setupAnchor{}
+	for _, ksk := range ksks {
+		a := setupAnchor{
+			Zone:         dns.Fqdn(ksk.Hdr.Name),
+			KeyTag:       ksk.KeyTag(),
+			TrustAnchors: map[string]string{},
+		}
+		for _, t := range dsDigestTypes {
+			if ds := ksk.ToDS(t); ds != nil {
+				a.DS = append(a.DS, ds.String())
+			}
+		}
+		for _, format := range trustanchor.Formats {
+			if format == "ds" {
+				continue
+			}
+			if anchor, err := trustanchor.Format(ksk, format); err == nil {
+				a.TrustAnchors[format] = anchor
+			}
+		}
+		anchors = append(anchors, a)
+	}
+	return anchors
+}
+
+// Answers a query REFUSED, with an extended DNS error saying ncdns isn't yet
+// configured, while the setup is unconfirmed, unless it's for the SOA, NS or
+// DNSKEY records at the apex of a zone, or of class CH. Returns false if the
+// query is left to be answered as usual.
+func (s *Server) serveUnconfirmedSetup(rw dns.ResponseWriter, req *dns.Msg) bool {
+	ts := s.trustSetup
+	if ts == nil || ts.isConfirmed() || req.Opcode != dns.OpcodeQuery || len(req.Question) != 1 ||
+		req.Question[0].Qclass == dns.ClassCHAOS {
+		return false
+	}
+
+	q := req.Question[0]
+	if s.isApex(q.Name) && (q.Qtype == dns.TypeSOA || q.Qtype == dns.TypeNS || q.Qtype == dns.TypeDNSKEY) {
+		return false
+	}
+
+	atomic.AddUint64(&ts.refused, 1)
+	m := new(dns.Msg)
+	m.SetRcode(req, dns.RcodeRefused)
+	if opt := req.IsEdns0(); opt != nil {
+		m.SetEdns0(s.ednsUDPSize(), false)
+		m.IsEdns0().Option = append(m.IsEdns0().Option, &dns.EDNS0_EDE{
+			InfoCode:  dns.ExtendedErrorCodeNotReady,
+			ExtraText: "not yet configured",
+		})
+	}
+	rw.WriteMsg(m)
+	return true
+}
@@ -0,0 +1,125 @@
+package server
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// Until the setup is confirmed, only the records at the apex which resolvers
+// need to check the chain of trust are answered, and names are served once
+// it is. A restart resumes the setup with the same keys.
+func TestTrustSetup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ncdns-setup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.Mkdir(filepath.Join(dir, "d"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "d", "example.json"), []byte(`{"ip":"192.0.2.1"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := newReloadTestConfig(t, dir)
+	cfg.DNSSEC.SetupMode = true
+	cfg.DNSSEC.KeyDir = "keys"
+	cfg.DNSSEC.SuffixKeys = "bit.corp.example=auto"
+	s, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	anchors := s.setupAnchors()
+	if len(anchors) != 2 || anchors[0].Zone != "bit." || anchors[1].Zone != "bit.corp.example." ||
+		len(anchors[1].DS) != 2 || anchors[1].TrustAnchors["unbound"] == "" {
+		t.Fatalf("got anchors %+v", anchors)
+	}
+
+	query := func(name string, qtype uint16) *dns.Msg {
+		req := new(dns.Msg)
+		req.SetQuestion(name, qtype)
+		req.SetEdns0(1232, true)
+		res, err := s.Query(context.Background(), req, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+	refused := func(res *dns.Msg) bool {
+		if res.Rcode != dns.RcodeRefused {
+			return false
+		}
+		for _, o := range res.IsEdns0().Option {
+			if ede, ok := o.(*dns.EDNS0_EDE); ok && ede.InfoCode == dns.ExtendedErrorCodeNotReady {
+				return true
+			}
+		}
+		return false
+	}
+
+	for _, q := range []struct {
+		name  string
+		qtype uint16
+	}{{"bit.", dns.TypeSOA}, {"bit.", dns.TypeNS}, {"bit.", dns.TypeDNSKEY}, {"bit.corp.example.", dns.TypeDNSKEY}} {
+		if res := query(q.name, q.qtype); res.Rcode != dns.RcodeSuccess || len(res.Answer) == 0 {
+			t.Errorf("%s %s: got %v before confirmation", q.name, dns.TypeToString[q.qtype], res)
+		}
+	}
+	for _, q := range []struct {
+		name  string
+		qtype uint16
+	}{{"example.bit.", dns.TypeA}, {"bit.", dns.TypeA}, {"example.bit.corp.example.", dns.TypeA}} {
+		if res := query(q.name, q.qtype); !refused(res) {
+			t.Errorf("%s %s: got %v before confirmation, expected REFUSED", q.name, dns.TypeToString[q.qtype], res)
+		}
+	}
+
+	// Touching the marker file confirms the setup.
+	marker := filepath.Join(dir, "keys", setupConfirmedFile)
+	if err := ioutil.WriteFile(marker, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	s.trustSetup.poll()
+	if res := query("example.bit.", dns.TypeA); res.Rcode != dns.RcodeSuccess || len(res.Answer) == 0 {
+		t.Errorf("got %v after confirmation", res)
+	}
+
+	// A restart before confirmation resumes the setup with the same keys,
+	// and one after it serves as usual.
+	if err := os.Remove(marker); err != nil {
+		t.Fatal(err)
+	}
+	s2, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a := s2.setupAnchors(); len(a) != 2 || a[1].KeyTag != anchors[1].KeyTag {
+		t.Errorf("got anchors %+v after a restart, expected key tag %d", a, anchors[1].KeyTag)
+	}
+	if s2.trustSetup.isConfirmed() {
+		t.Error("setup confirmed after a restart without the marker file")
+	}
+	if confirmed, err := s2.trustSetup.confirm(); !confirmed || err != nil {
+		t.Fatalf("confirming: %v, %v", confirmed, err)
+	}
+	if _, err := os.Stat(marker); err != nil {
+		t.Errorf("marker file not written on confirmation: %v", err)
+	}
+	s3, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s3.trustSetup.isConfirmed() {
+		t.Error("setup unconfirmed after a restart with the marker file")
+	}
+
+	cfg.DNSSEC.KeyDir = ""
+	if _, err := New(cfg); err == nil {
+		t.Error("setup mode started without KeyDir")
+	}
+}
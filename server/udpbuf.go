@@ -0,0 +1,55 @@
+package server
+
+import (
+	"net"
+)
+
+// The state of a UDP socket's receive buffer. Queries which arrive while the
+// buffer is full are dropped by the OS before ncdns sees them.
+type udpSocketStatus struct {
+	Address string `json:"address"`
+
+	// The size of the receive buffer, as reported by the OS.
+	ReceiveBufferBytes int `json:"receive_buffer_bytes,omitempty"`
+
+	// Bytes waiting in the receive buffer to be read.
+	QueuedBytes int `json:"queued_bytes"`
+
+	// Packets dropped because the receive buffer was full.
+	Drops uint64 `json:"drops"`
+}
+
+// Sets the size of a UDP socket's receive buffer, warning if the OS gave it
+// a smaller one.
+func setReceiveBuffer(conn *net.UDPConn, size int) error {
+	if size <= 0 {
+		return nil
+	}
+
+	err := conn.SetReadBuffer(size)
+	if err != nil {
+		return err
+	}
+
+	if actual, ok := receiveBufferSize(conn); ok && actual < size {
+		log.Warnf("the receive buffer of %s is %d bytes, not the %d bytes configured by UDPReceiveBufferBytes%s",
+			conn.LocalAddr(), actual, size, receiveBufferLimitHint)
+	}
+	return nil
+}
+
+// Returns the state of each UDP socket's receive buffer, where the OS
+// reports it.
+func (s *Server) udpSocketStatus() []udpSocketStatus {
+	s.listenersMu.RLock()
+	defer s.listenersMu.RUnlock()
+
+	var st []udpSocketStatus
+	for _, conn := range s.udpConns {
+		if cst, ok := readUDPSocketStatus(conn); ok {
+			cst.Address = conn.LocalAddr().String()
+			st = append(st, cst)
+		}
+	}
+	return st
+}
@@ -0,0 +1,101 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const receiveBufferLimitHint = "; raise the net.core.rmem_max sysctl to allow more"
+
+// Returns the usable size of a socket's receive buffer.
+func receiveBufferSize(conn *net.UDPConn) (int, bool) {
+	var size int
+	var err error
+	if cerr := control(conn, func(fd uintptr) {
+		size, err = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_RCVBUF)
+	}); cerr != nil || err != nil {
+		return 0, false
+	}
+
+	// Linux doubles the requested size to allow for its bookkeeping, and
+	// reports the doubled size.
+	return size / 2, true
+}
+
+func control(conn *net.UDPConn, f func(fd uintptr)) error {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	return rc.Control(f)
+}
+
+// Reads the queue length and drop count of a socket from /proc/net/udp or
+// /proc/net/udp6, where the socket is identified by its inode.
+func readUDPSocketStatus(conn *net.UDPConn) (udpSocketStatus, bool) {
+	var st udpSocketStatus
+
+	var inode string
+	if err := control(conn, func(fd uintptr) {
+		link, err := os.Readlink(fmt.Sprintf("/proc/self/fd/%d", fd))
+		if err == nil && strings.HasPrefix(link, "socket:[") {
+			inode = strings.TrimSuffix(strings.TrimPrefix(link, "socket:["), "]")
+		}
+	}); err != nil || inode == "" {
+		return st, false
+	}
+
+	if size, ok := receiveBufferSize(conn); ok {
+		st.ReceiveBufferBytes = size
+	}
+
+	for _, fn := range []string{"/proc/net/udp", "/proc/net/udp6"} {
+		f, err := os.Open(fn)
+		if err != nil {
+			continue
+		}
+		queued, drops, ok := findProcNetUDP(f, inode)
+		f.Close()
+		if ok {
+			st.QueuedBytes, st.Drops = queued, drops
+			return st, true
+		}
+	}
+
+	return st, false
+}
+
+// Finds the line of /proc/net/udp for a socket inode, returning the bytes in
+// its receive queue and its drop count.
+func findProcNetUDP(r io.Reader, inode string) (queued int, drops uint64, ok bool) {
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		// sl local_address rem_address st tx_queue:rx_queue tr:tm->when
+		// retrnsmt uid timeout inode ref pointer drops
+		fields := strings.Fields(s.Text())
+		if len(fields) < 13 || fields[9] != inode {
+			continue
+		}
+
+		queues := strings.SplitN(fields[4], ":", 2)
+		if len(queues) != 2 {
+			return 0, 0, false
+		}
+		rxQueue, err := strconv.ParseUint(queues[1], 16, 32)
+		if err != nil {
+			return 0, 0, false
+		}
+		drops, err := strconv.ParseUint(fields[12], 10, 64)
+		if err != nil {
+			return 0, 0, false
+		}
+		return int(rxQueue), drops, true
+	}
+	return 0, 0, false
+}
@@ -0,0 +1,44 @@
+package server
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+const procNetUDP = `   sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode ref pointer drops
+  123: 0100007F:0035 00000000:0000 07 00000000:00000A00 00:00000000 00000000   101        0 41265 2 0000000000000000 17
+  456: 00000000:0044 00000000:0000 07 00000000:00000000 00:00000000 00000000     0        0 18517 2 0000000000000000 0
+`
+
+func TestFindProcNetUDP(t *testing.T) {
+	queued, drops, ok := findProcNetUDP(strings.NewReader(procNetUDP), "41265")
+	if !ok || queued != 0xA00 || drops != 17 {
+		t.Errorf("got %d, %d, %v", queued, drops, ok)
+	}
+
+	if _, _, ok := findProcNetUDP(strings.NewReader(procNetUDP), "99999"); ok {
+		t.Errorf("found a socket which isn't listed")
+	}
+}
+
+func TestUDPSocketStatus(t *testing.T) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	err = setReceiveBuffer(conn, 65536)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	st, ok := readUDPSocketStatus(conn)
+	if !ok {
+		t.Skip("/proc/net/udp not available")
+	}
+	if st.ReceiveBufferBytes <= 0 || st.Drops != 0 {
+		t.Errorf("unexpected status %+v", st)
+	}
+}
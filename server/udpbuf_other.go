@@ -0,0 +1,18 @@
+//go:build !linux
+// +build !linux
+
+package server
+
+import (
+	"net"
+)
+
+const receiveBufferLimitHint = ""
+
+func receiveBufferSize(conn *net.UDPConn) (int, bool) {
+	return 0, false
+}
+
+func readUDPSocketStatus(conn *net.UDPConn) (udpSocketStatus, bool) {
+	return udpSocketStatus{}, false
+}
@@ -0,0 +1,255 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/miekg/dns"
+	madns "gopkg.in/hlandau/madns.v2"
+	"gopkg.in/hlandau/madns.v2/merr"
+
+	"github.com/namecoin/ncdns/backend"
+	"github.com/namecoin/ncdns/util"
+)
+
+// Parses Config.UnsignedNames, a comma-separated list of names under .bit,
+// e.g. "example.bit,www.other.bit".
+func parseUnsignedNames(s string) ([]string, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+
+	var names []string
+	for _, item := range strings.Split(s, ",") {
+		name := strings.ToLower(dns.Fqdn(strings.TrimSpace(item)))
+		_, basename, _, err := util.SplitDomainByFloatingAnchor(name, "bit")
+		if _, ok := dns.IsDomainName(name); !ok || err != nil || basename == "" {
+			return nil, fmt.Errorf("Unsigned name %q isn't a name under .bit", item)
+		}
+
+		for _, other := range names {
+			switch {
+			case other == name:
+				return nil, fmt.Errorf("Duplicate unsigned name: %s", name)
+			case dns.IsSubDomain(other, name), dns.IsSubDomain(name, other):
+				return nil, fmt.Errorf("Unsigned names %s and %s overlap; everything below an unsigned name is unsigned anyway", other, name)
+			}
+		}
+
+		names = append(names, name)
+	}
+
+	return names, nil
+}
+
+// Checks the unsigned names against the other settings, and warns about each
+// of them, since validating resolvers can't tell their records from forgeries.
+func (s *Server) setupUnsignedNames() error {
+	for _, name := range s.cfg.unsignedNames {
+		for _, spec := range s.cfg.suffixKeys {
+			if dns.IsSubDomain(name, spec.suffix) {
+				return configError("Suffix %s has keys of its own in SuffixKeys, but is at or below unsigned name %s", spec.suffix, name)
+			}
+		}
+
+		log.Warnf("Serving %s and everything below it without DNSSEC signatures, as an insecure delegation: validating resolvers can't authenticate its records", name)
+	}
+
+	return nil
+}
+
+// Returns the unsigned name which the query falls under, or "" if it's
+// answered from the signed zone. DS records at an unsigned name belong to the
+// signed zone above it, which proves that there are none.
+func (s *Server) unsignedApex(q dns.Question) string {
+	name := strings.ToLower(q.Name)
+	for _, apex := range s.cfg.unsignedNames {
+		if !dns.IsSubDomain(apex, name) || (q.Qtype == dns.TypeDS && name == apex) {
+			continue
+		}
+		return apex
+	}
+
+	return ""
+}
+
+// Whether name is the apex of a zone served by ncdns, including those of the
+// unsigned names.
+func (s *Server) isApex(name string) bool {
+	if isZoneApex(name) {
+		return true
+	}
+
+	name = strings.ToLower(dns.Fqdn(name))
+	for _, apex := range s.cfg.unsignedNames {
+		if name == apex {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Returns the view of b from which an engine answers queries falling under
+// the given unsigned name, or, if apex is "", queries answered from the
+// signed zone.
+func (s *Server) zoneBackend(b madns.Backend, apex string) madns.Backend {
+	if apex != "" {
+		return &unsignedZoneBackend{b: b, apex: apex}
+	}
+	if len(s.cfg.unsignedNames) > 0 {
+		return &unsignedCutBackend{b: b, names: s.cfg.unsignedNames}
+	}
+
+	return b
+}
+
+// Registers a keyless engine with mux for each unsigned name, adding its
+// handler to engines. A DS query at the unsigned name itself is passed to the
+// engine of the signed zone above it, found among engines by suffix ("." for
+// the global keys).
+func (s *Server) handleUnsignedNames(mux *dns.ServeMux, b *backend.Backend, engines map[string]dns.Handler) error {
+	for _, apex := range s.cfg.unsignedNames {
+		apex := apex
+		e, err := newContextEngine(b, func(b madns.Backend) madns.Backend {
+			return s.zoneBackend(s.policyBackend(b), apex)
+		}, &keySet{})
+		if err != nil {
+			return err
+		}
+
+		parent := engines["."]
+		if spec := matchSuffixKeySpec(s.cfg.suffixKeys, apex); spec != nil {
+			parent = engines[spec.suffix]
+		}
+
+		h := &unsignedZoneHandler{apex: apex, zone: e, parent: parent}
+		mux.Handle(apex, h)
+		engines[apex] = h
+	}
+
+	return nil
+}
+
+type unsignedZoneHandler struct {
+	apex   string
+	zone   dns.Handler
+	parent dns.Handler
+}
+
+func (h *unsignedZoneHandler) ServeDNS(rw dns.ResponseWriter, req *dns.Msg) {
+	if len(req.Question) > 0 && req.Question[0].Qtype == dns.TypeDS && strings.EqualFold(req.Question[0].Name, h.apex) {
+		h.parent.ServeDNS(rw, req)
+		return
+	}
+
+	h.zone.ServeDNS(rw, req)
+}
+
+// The signed zone's view of the unsigned names: each is delegated to our own
+// nameservers, with no DS records, so that the engine proves the delegation
+// insecure. As for any delegated name, names at or below it are answered
+// with the delegation's records.
+type unsignedCutBackend struct {
+	b     madns.Backend
+	names []string
+}
+
+var _ madns.Backend = &unsignedCutBackend{}
+
+func (cb *unsignedCutBackend) Lookup(qname, streamIsolationID string) ([]dns.RR, error) {
+	name := strings.ToLower(qname)
+	for _, apex := range cb.names {
+		if !dns.IsSubDomain(apex, name) {
+			continue
+		}
+
+		_, nss, err := apexRRs(cb.b, apex, streamIsolationID)
+		return nss, err
+	}
+
+	return cb.b.Lookup(qname, streamIsolationID)
+}
+
+// The view of an unsigned name as the apex of a zone of its own, with the SOA
+// and NS records of the zone it's under. Its own NS and DS records, if any,
+// aren't served, since the delegation has been replaced by ours.
+type unsignedZoneBackend struct {
+	b    madns.Backend
+	apex string
+}
+
+var _ madns.Backend = &unsignedZoneBackend{}
+
+func (zb *unsignedZoneBackend) Lookup(qname, streamIsolationID string) ([]dns.RR, error) {
+	name := strings.ToLower(qname)
+	if !dns.IsSubDomain(zb.apex, name) {
+		return zb.b.Lookup(qname, streamIsolationID)
+	}
+
+	rrs, err := zb.b.Lookup(qname, streamIsolationID)
+	if name == zb.apex && err == merr.ErrNoSuchDomain {
+		// The name isn't registered, but the zone still exists.
+		rrs, err = nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var out []dns.RR
+	if name == zb.apex {
+		soa, nss, err := apexRRs(zb.b, zb.apex, streamIsolationID)
+		if err != nil {
+			return nil, err
+		}
+		out = append(append(out, soa), nss...)
+	}
+
+	for _, rr := range rrs {
+		hdr := rr.Header()
+		if strings.EqualFold(hdr.Name, zb.apex) && (hdr.Rrtype == dns.TypeNS || hdr.Rrtype == dns.TypeDS || hdr.Rrtype == dns.TypeSOA) {
+			continue
+		}
+		out = append(out, rr)
+	}
+
+	if name != zb.apex && len(out) == 0 && len(rrs) > 0 {
+		// Only the records of the name's own delegation were found.
+		return nil, merr.ErrNoSuchDomain
+	}
+
+	return out, nil
+}
+
+// Returns the SOA and NS records of the zone apex is under, as if owned by
+// apex.
+func apexRRs(b madns.Backend, apex, streamIsolationID string) (*dns.SOA, []dns.RR, error) {
+	_, _, rootname, err := util.SplitDomainByFloatingAnchor(apex, "bit")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	rrs, err := b.Lookup(dns.Fqdn(rootname), streamIsolationID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var soa *dns.SOA
+	var nss []dns.RR
+	for _, rr := range rrs {
+		switch rr := rr.(type) {
+		case *dns.SOA:
+			soa = dns.Copy(rr).(*dns.SOA)
+			soa.Hdr.Name = apex
+		case *dns.NS:
+			ns := dns.Copy(rr)
+			ns.Header().Name = apex
+			nss = append(nss, ns)
+		}
+	}
+	if soa == nil || len(nss) == 0 {
+		return nil, nil, fmt.Errorf("no SOA and NS records at %s", rootname)
+	}
+
+	return soa, nss, nil
+}
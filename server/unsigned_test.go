@@ -0,0 +1,328 @@
+package server
+
+import (
+	"crypto"
+	"errors"
+	"net"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	madns "gopkg.in/hlandau/madns.v2"
+
+	"github.com/namecoin/ncdns/backend"
+)
+
+func TestParseUnsignedNames(t *testing.T) {
+	names, err := parseUnsignedNames(" Big.bit, www.other.bit.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(names, ",") != "big.bit.,www.other.bit." {
+		t.Errorf("parsed %v", names)
+	}
+
+	for _, s := range []string{"bit", "example.com", "a..bit", "big.bit,big.bit", "big.bit,www.big.bit"} {
+		if _, err := parseUnsignedNames(s); err == nil {
+			t.Errorf("%q parsed", s)
+		}
+	}
+
+	s := &Server{cfg: Config{unsignedNames: []string{"corp.bit."}}}
+	s.cfg.suffixKeys, _ = parseSuffixKeys("x.corp.bit=auto")
+	if err := s.setupUnsignedNames(); !errors.Is(err, ErrConfigInvalid) {
+		t.Errorf("suffix keys below an unsigned name: got %v", err)
+	}
+}
+
+// Answers from the backend, signed with ks as madns would sign them, for
+// validating the chain of trust: referrals at delegated names, with DS
+// records or an NSEC record proving there are none, and negative answers with
+// an NSEC record.
+type testSigningEngine struct {
+	b  madns.Backend
+	ks *keySet
+}
+
+func (e *testSigningEngine) ServeDNS(rw dns.ResponseWriter, req *dns.Msg) {
+	q := req.Question[0]
+	m := new(dns.Msg)
+	m.SetReply(req)
+
+	// The highest delegated name at or above the query name, other than
+	// the query name itself if it's a DS query, and the SOA record of the
+	// zone.
+	cut := ""
+	var soa []dns.RR
+	for off, end := 0, false; !end; off, end = dns.NextLabel(q.Name, off) {
+		name := q.Name[off:]
+		rrs, err := e.b.Lookup(name, "")
+		if soa = typeOnly(rrs, dns.TypeSOA); len(soa) > 0 {
+			break
+		}
+		if err == nil && len(typeOnly(rrs, dns.TypeNS)) > 0 && !(q.Qtype == dns.TypeDS && name == q.Name) {
+			cut = name
+		}
+	}
+
+	if cut != "" {
+		rrs, _ := e.b.Lookup(cut, "")
+		m.Ns = e.sign(typeOnly(rrs, dns.TypeNS), false)
+		if ds := typeOnly(rrs, dns.TypeDS); len(ds) > 0 {
+			m.Ns = append(m.Ns, e.sign(ds, true)...)
+		} else {
+			m.Ns = append(m.Ns, e.sign([]dns.RR{nsecFor(cut, rrs)}, true)...)
+		}
+		rw.WriteMsg(m)
+		return
+	}
+
+	rrs, err := e.b.Lookup(q.Name, "")
+	if err != nil {
+		m.Rcode = dns.RcodeNameError
+		m.Ns = e.sign(soa, true)
+		rw.WriteMsg(m)
+		return
+	}
+	if q.Qtype == dns.TypeDNSKEY && e.ks.KSK != nil && len(typeOnly(rrs, dns.TypeSOA)) > 0 {
+		rrs = append(rrs, e.ks.KSK, e.ks.ZSK)
+	}
+
+	if answer := typeOnly(rrs, q.Qtype); len(answer) > 0 {
+		m.Answer = e.sign(answer, true)
+	} else {
+		m.Ns = append(e.sign(soa, true), e.sign([]dns.RR{nsecFor(q.Name, rrs)}, true)...)
+	}
+	rw.WriteMsg(m)
+}
+
+// Returns rrset followed by its RRSIG, if it's to be signed and there are
+// keys.
+func (e *testSigningEngine) sign(rrset []dns.RR, signed bool) []dns.RR {
+	if !signed || e.ks.ZSK == nil {
+		return rrset
+	}
+
+	key, priv := e.ks.ZSK, e.ks.ZSKPrivate
+	if rrset[0].Header().Rrtype == dns.TypeDNSKEY {
+		key, priv = e.ks.KSK, e.ks.KSKPrivate
+	}
+	sig := &dns.RRSIG{
+		Hdr:        dns.RR_Header{Name: rrset[0].Header().Name, Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: 600},
+		Algorithm:  key.Algorithm,
+		KeyTag:     key.KeyTag(),
+		SignerName: key.Hdr.Name,
+		Inception:  uint32(time.Now().Add(-time.Hour).Unix()),
+		Expiration: uint32(time.Now().Add(time.Hour).Unix()),
+	}
+	if err := sig.Sign(priv.(crypto.Signer), rrset); err != nil {
+		panic(err)
+	}
+
+	return append(rrset, sig)
+}
+
+// Returns an NSEC record at name listing the types of rrs owned by it.
+func nsecFor(name string, rrs []dns.RR) dns.RR {
+	types := []uint16{dns.TypeRRSIG, dns.TypeNSEC}
+	for _, rr := range rrs {
+		if strings.EqualFold(rr.Header().Name, name) && !containsType(types, rr.Header().Rrtype) {
+			types = append(types, rr.Header().Rrtype)
+		}
+	}
+	sort.Slice(types, func(i, j int) bool { return types[i] < types[j] })
+
+	return &dns.NSEC{
+		Hdr:        dns.RR_Header{Name: name, Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: 600},
+		NextDomain: `\000.` + name,
+		TypeBitMap: types,
+	}
+}
+
+// Validates the answer to a query, as a validating stub resolver trusting
+// only anchor as the KSK of bit. would: the DNSKEY records of bit. must be
+// signed by anchor, and the answer signed by their ZSK, unless some name
+// between bit. and the query name is proven to be delegated without DS
+// records, in which case it's insecure. Returns "secure", "insecure" or
+// "bogus", and the answer.
+func validate(t *testing.T, h dns.Handler, anchor *dns.DNSKEY, qname string, qtype uint16) (string, []dns.RR) {
+	return validateUnder(t, h, "bit.", anchor, qname, qtype)
+}
+
+// Like validate, but trusting anchor, a KSK or the DS record of one, as that
+// of zone, e.g. a suffix with keys of its own.
+func validateUnder(t *testing.T, h dns.Handler, zone string, anchor dns.RR, qname string, qtype uint16) (string, []dns.RR) {
+	query := func(name string, qtype uint16) *dns.Msg {
+		req := new(dns.Msg)
+		req.SetQuestion(name, qtype)
+		req.SetEdns0(4096, true)
+		rw := &fakeResponseWriter{addr: &net.UDPAddr{IP: net.ParseIP("192.0.2.100"), Port: 1234}}
+		h.ServeDNS(rw, req)
+		if rw.msg == nil {
+			t.Fatalf("no response to %s %s", name, dns.TypeToString[qtype])
+		}
+		return rw.msg
+	}
+
+	// Returns the records of the given type owned by name in section, if
+	// an RRSIG made with one of keys covers them.
+	verified := func(section []dns.RR, name string, rrtype uint16, keys []dns.RR) []dns.RR {
+		var rrset []dns.RR
+		for _, rr := range section {
+			if rr.Header().Rrtype == rrtype && strings.EqualFold(rr.Header().Name, name) {
+				rrset = append(rrset, rr)
+			}
+		}
+		for _, rr := range section {
+			sig, ok := rr.(*dns.RRSIG)
+			if !ok || sig.TypeCovered != rrtype || len(rrset) == 0 || !sig.ValidityPeriod(time.Now()) {
+				continue
+			}
+			for _, k := range keys {
+				if sig.Verify(k.(*dns.DNSKEY), rrset) == nil {
+					return rrset
+				}
+			}
+		}
+		return nil
+	}
+
+	dnskeys := query(zone, dns.TypeDNSKEY).Answer
+	if ds, ok := anchor.(*dns.DS); ok {
+		anchor = nil
+		for _, rr := range dnskeys {
+			if k, ok := rr.(*dns.DNSKEY); ok {
+				if kds := k.ToDS(ds.DigestType); kds != nil && kds.KeyTag == ds.KeyTag && strings.EqualFold(kds.Digest, ds.Digest) {
+					anchor = k
+				}
+			}
+		}
+		if anchor == nil {
+			return "bogus", nil
+		}
+	}
+	keys := verified(dnskeys, zone, dns.TypeDNSKEY, []dns.RR{anchor})
+	if keys == nil {
+		return "bogus", nil
+	}
+
+	labels := dns.SplitDomainName(qname)
+	for i := len(labels) - dns.CountLabel(zone) - 1; i >= 0; i-- {
+		name := dns.Fqdn(strings.Join(labels[i:], "."))
+		m := query(name, dns.TypeDS)
+		if verified(m.Answer, name, dns.TypeDS, keys) != nil {
+			t.Fatalf("%s has DS records; validating below secure delegations isn't supported", name)
+		}
+
+		nsec := verified(m.Ns, name, dns.TypeNSEC, keys)
+		if nsec == nil {
+			return "bogus", nil
+		}
+		bitmap := nsec[0].(*dns.NSEC).TypeBitMap
+		if containsType(bitmap, dns.TypeNS) && !containsType(bitmap, dns.TypeDS) {
+			return "insecure", query(qname, qtype).Answer
+		}
+	}
+
+	answer := query(qname, qtype).Answer
+	if verified(answer, qname, qtype, keys) == nil {
+		return "bogus", answer
+	}
+	return "secure", answer
+}
+
+func containsType(types []uint16, rrtype uint16) bool {
+	for _, t := range types {
+		if t == rrtype {
+			return true
+		}
+	}
+	return false
+}
+
+func TestUnsignedNamesValidateInsecure(t *testing.T) {
+	be, err := backend.New(&backend.Config{
+		CacheMaxEntries: 100,
+		FakeNames: map[string]string{
+			"d/example": `{"ip":"192.0.2.1"}`,
+			"d/big":     `{"ip":"192.0.2.10","ds":[[12345,8,2,"TkjtAHtv5ZjHs6CtaMpVahYk1yWLm5Cr1ct+4OgQiSg="]],"map":{"www":{"ip":"192.0.2.11"}}}`,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ks, err := generateKeySet("bit.")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newTestServer := func(unsignedNames string) *Server {
+		s := &Server{
+			backend:      be,
+			globalKeySet: ks,
+			mux:          dns.NewServeMux(),
+			clientStats:  newClientStats(10000, time.Minute, 0, 0, nil),
+		}
+		s.cfg.unsignedNames, err = parseUnsignedNames(unsignedNames)
+		if err != nil {
+			t.Fatal(err)
+		}
+		e := &testSigningEngine{b: s.zoneBackend(be, ""), ks: ks}
+		s.mux.Handle(".", e)
+		if err := s.handleUnsignedNames(s.mux, be, map[string]dns.Handler{".": e}); err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	s := newTestServer("big.bit")
+
+	tests := []struct {
+		qname  string
+		status string
+		ip     string
+	}{
+		{"example.bit.", "secure", "192.0.2.1"},
+		{"big.bit.", "insecure", "192.0.2.10"},
+		{"www.big.bit.", "insecure", "192.0.2.11"},
+	}
+	for _, test := range tests {
+		status, answer := validate(t, s, ks.KSK, test.qname, dns.TypeA)
+		a := typeOnly(answer, dns.TypeA)
+		if status != test.status || len(a) != 1 || a[0].(*dns.A).A.String() != test.ip {
+			t.Errorf("%s: %s, answer [%v]; expected %s, %s", test.qname, status, answer, test.status, test.ip)
+		}
+		if test.status == "insecure" && len(typeOnly(answer, dns.TypeRRSIG)) > 0 {
+			t.Errorf("%s: signed answer [%v]", test.qname, answer)
+		}
+	}
+
+	// The unsigned name is the apex of a zone of its own, authoritative for
+	// its records rather than a referral.
+	req := new(dns.Msg)
+	req.SetQuestion("big.bit.", dns.TypeSOA)
+	rw := &fakeResponseWriter{}
+	s.ServeDNS(rw, req)
+	if m := rw.msg; m == nil || !m.Authoritative || len(typeOnly(m.Answer, dns.TypeSOA)) == 0 || len(typeOnly(m.Answer, dns.TypeDS)) > 0 {
+		t.Errorf("SOA at the unsigned name: %v", m)
+	}
+
+	// Leaving out the signatures from the signed zone instead breaks
+	// validation.
+	plain := newTestServer("")
+	stripped := dns.HandlerFunc(func(rw dns.ResponseWriter, req *dns.Msg) {
+		if !dns.IsSubDomain("big.bit.", req.Question[0].Name) {
+			plain.ServeDNS(rw, req)
+			return
+		}
+		frw := &fakeResponseWriter{}
+		plain.ServeDNS(frw, req)
+		frw.msg.Answer = stripRRSIGs(frw.msg.Answer)
+		frw.msg.Ns = stripRRSIGs(frw.msg.Ns)
+		rw.WriteMsg(frw.msg)
+	})
+	if status, _ := validate(t, stripped, ks.KSK, "www.big.bit.", dns.TypeA); status != "bogus" {
+		t.Errorf("stripped signatures: %s, expected bogus", status)
+	}
+}
@@ -0,0 +1,175 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/namecoin/ncdns/clock"
+)
+
+// The log lines which the messages of one client prefix (as for RRL, a /24 or
+// /56) can cause: at most unsolicitedLogBurst in each unsolicitedLogInterval,
+// so that a scanner can't fill the log. Those beyond are counted at /status.
+const (
+	unsolicitedLogBurst    = 5
+	unsolicitedLogInterval = time.Minute
+
+	// The most prefixes tracked. When there's no room for another, those
+	// whose interval has passed are forgotten; if none have, the line isn't
+	// logged.
+	unsolicitedLogMaxPrefixes = 10000
+)
+
+// The QR bit of the flags in a message's header, set in responses.
+const headerBitQR = 1 << 15
+
+// Counts of the messages which aren't queries ncdns answers as usual: those
+// rejected by acceptMsg before being parsed further than their header, and
+// NOTIFYs, along with the log lines they're allowed.
+type unsolicitedMessages struct {
+	// Accessed atomically.
+	responses     uint64 // with QR set; ignored
+	malformed     uint64 // with section counts no query has; answered FORMERR
+	badOpcode     uint64 // neither QUERY nor NOTIFY; answered NOTIMP
+	notifies      uint64 // for a zone served; acknowledged
+	notifyDropped uint64 // for any other zone; not answered
+	logSuppressed uint64
+
+	clock clock.Clock // the system clock if nil
+
+	mu     sync.Mutex
+	logged map[string]*logAllowance // by client prefix
+}
+
+type logAllowance struct {
+	since time.Time // the start of the current interval
+	lines int       // logged in it
+}
+
+type unsolicitedStatus struct {
+	Responses     uint64 `json:"responses"`
+	Malformed     uint64 `json:"malformed"`
+	BadOpcode     uint64 `json:"bad_opcode"`
+	Notifies      uint64 `json:"notifies"`
+	NotifyDropped uint64 `json:"notifies_dropped"`
+	LogSuppressed uint64 `json:"log_lines_suppressed"`
+}
+
+// Decides from its header alone whether a message is parsed and passed to
+// ServeDNS, like dns.DefaultMsgAcceptFunc, but counting those which aren't.
+// Only a NOTIFY may carry a record in the answer section (the zone's SOA, by
+// RFC 1996), and a query one in the authority section (an IXFR's SOA, by RFC
+// 1995); the additional section is limited to an OPT and a TSIG.
+func (s *Server) acceptMsg(dh dns.Header) dns.MsgAcceptAction {
+	u := &s.unsolicited
+	if dh.Bits&headerBitQR != 0 {
+		atomic.AddUint64(&u.responses, 1)
+		return dns.MsgIgnore
+	}
+
+	opcode := int(dh.Bits>>11) & 0xF
+	if opcode != dns.OpcodeQuery && opcode != dns.OpcodeNotify {
+		atomic.AddUint64(&u.badOpcode, 1)
+		return dns.MsgRejectNotImplemented
+	}
+
+	maxAnswers, maxAuthority := uint16(0), uint16(1)
+	if opcode == dns.OpcodeNotify {
+		maxAnswers, maxAuthority = 1, 0
+	}
+	if dh.Qdcount != 1 || dh.Ancount > maxAnswers || dh.Nscount > maxAuthority || dh.Arcount > 2 {
+		atomic.AddUint64(&u.malformed, 1)
+		return dns.MsgReject
+	}
+	return dns.MsgAccept
+}
+
+// Answers a NOTIFY, returning false if req isn't one. ncdns is never a
+// secondary, so it merely acknowledges a NOTIFY for the apex of a zone it
+// serves, and drops any other unanswered, so that it can't be used to reflect
+// them.
+func (s *Server) serveNotify(rw dns.ResponseWriter, req *dns.Msg) bool {
+	if req.Opcode != dns.OpcodeNotify {
+		return false
+	}
+
+	u := &s.unsolicited
+	if len(req.Question) != 1 || !isZoneApex(req.Question[0].Name) {
+		atomic.AddUint64(&u.notifyDropped, 1)
+		if len(req.Question) == 1 && u.allowLog(clientIP(rw)) {
+			log.Infof("dropped NOTIFY for %s, which isn't a zone served, from %s", req.Question[0].Name, rw.RemoteAddr())
+		}
+		return true
+	}
+
+	atomic.AddUint64(&u.notifies, 1)
+	m := new(dns.Msg)
+	m.SetReply(req)
+	m.Authoritative = true
+	rw.WriteMsg(m)
+	return true
+}
+
+// Returns whether a line about a message from the client at ip may be logged,
+// counting it as suppressed if not.
+func (u *unsolicitedMessages) allowLog(ip net.IP) bool {
+	prefix := rrlPrefix(ip)
+	now := clock.Or(u.clock).Now()
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.logged == nil {
+		u.logged = make(map[string]*logAllowance)
+	}
+	a, ok := u.logged[prefix]
+	if !ok {
+		if len(u.logged) >= unsolicitedLogMaxPrefixes {
+			for k, a := range u.logged {
+				if now.Sub(a.since) >= unsolicitedLogInterval {
+					delete(u.logged, k)
+				}
+			}
+		}
+		if len(u.logged) >= unsolicitedLogMaxPrefixes {
+			atomic.AddUint64(&u.logSuppressed, 1)
+			return false
+		}
+		a = &logAllowance{since: now}
+		u.logged[prefix] = a
+	}
+	if now.Sub(a.since) >= unsolicitedLogInterval {
+		a.since, a.lines = now, 0
+	}
+
+	if a.lines >= unsolicitedLogBurst {
+		atomic.AddUint64(&u.logSuppressed, 1)
+		return false
+	}
+	a.lines++
+	return true
+}
+
+// Logs a warning about a message from the client at ip, unless it's sent too
+// many already.
+func (u *unsolicitedMessages) warnf(ip net.IP, format string, args ...interface{}) {
+	if u.allowLog(ip) {
+		log.Warn(fmt.Sprintf(format, args...))
+	}
+}
+
+func (u *unsolicitedMessages) Status() unsolicitedStatus {
+	return unsolicitedStatus{
+		Responses:     atomic.LoadUint64(&u.responses),
+		Malformed:     atomic.LoadUint64(&u.malformed),
+		BadOpcode:     atomic.LoadUint64(&u.badOpcode),
+		Notifies:      atomic.LoadUint64(&u.notifies),
+		NotifyDropped: atomic.LoadUint64(&u.notifyDropped),
+		LogSuppressed: atomic.LoadUint64(&u.logSuppressed),
+	}
+}
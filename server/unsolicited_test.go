@@ -0,0 +1,111 @@
+package server
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/namecoin/ncdns/testutil"
+)
+
+func TestAcceptMsg(t *testing.T) {
+	header := func(opcode int, qd, an, ns, ar uint16) dns.Header {
+		return dns.Header{Bits: uint16(opcode) << 11, Qdcount: qd, Ancount: an, Nscount: ns, Arcount: ar}
+	}
+
+	tests := []struct {
+		dh     dns.Header
+		action dns.MsgAcceptAction
+	}{
+		{header(dns.OpcodeQuery, 1, 0, 0, 1), dns.MsgAccept},
+		{header(dns.OpcodeQuery, 1, 0, 1, 2), dns.MsgAccept}, // IXFR with TSIG
+		{header(dns.OpcodeNotify, 1, 1, 0, 0), dns.MsgAccept},
+		{dns.Header{Bits: headerBitQR, Qdcount: 1, Ancount: 1}, dns.MsgIgnore},
+		{header(dns.OpcodeUpdate, 1, 0, 5, 0), dns.MsgRejectNotImplemented},
+		{header(dns.OpcodeQuery, 0, 0, 0, 0), dns.MsgReject},
+		{header(dns.OpcodeQuery, 2, 0, 0, 0), dns.MsgReject},
+		{header(dns.OpcodeQuery, 1, 1, 0, 0), dns.MsgReject},
+		{header(dns.OpcodeNotify, 1, 2, 0, 0), dns.MsgReject},
+		{header(dns.OpcodeNotify, 1, 1, 1, 0), dns.MsgReject},
+		{header(dns.OpcodeQuery, 1, 0, 0, 3), dns.MsgReject},
+	}
+
+	s := &Server{}
+	for i, test := range tests {
+		if action := s.acceptMsg(test.dh); action != test.action {
+			t.Errorf("%d: got %v, expected %v", i, action, test.action)
+		}
+	}
+	if st := s.unsolicited.Status(); st.Responses != 1 || st.BadOpcode != 1 || st.Malformed != 6 {
+		t.Errorf("unexpected counts %+v", st)
+	}
+}
+
+func TestIncomingNotify(t *testing.T) {
+	s := newDrainTestServer(t)
+	s.unsolicited.clock = testutil.NewFakeClock(time.Unix(1000000, 0))
+
+	notify := func(name string, addr net.Addr) *dns.Msg {
+		req := new(dns.Msg)
+		req.SetNotify(name)
+		rw := &fakeResponseWriter{addr: addr}
+		s.ServeDNS(rw, req)
+		return rw.msg
+	}
+
+	for _, name := range []string{"bit.", "BIT.", "bit.example.com."} {
+		m := notify(name, nil)
+		if m == nil || m.Rcode != dns.RcodeSuccess || m.Opcode != dns.OpcodeNotify || !m.Response || len(m.Answer) != 0 {
+			t.Errorf("%s: NOTIFY not acknowledged: %v", name, m)
+		}
+	}
+
+	// A flood for other zones from one network gets no responses, and logs
+	// only the first few.
+	const n = 1000
+	for i := 0; i < n; i++ {
+		addr := &net.UDPAddr{IP: net.IPv4(198, 51, 100, byte(i)), Port: 1234}
+		for _, name := range []string{"example.com.", "example.bit."} {
+			if m := notify(name, addr); m != nil {
+				t.Fatalf("NOTIFY for %s answered: %v", name, m)
+			}
+		}
+	}
+	st := s.unsolicited.Status()
+	if st.Notifies != 3 || st.NotifyDropped != 2*n {
+		t.Errorf("unexpected counts %+v", st)
+	}
+	if st.LogSuppressed != 2*n-unsolicitedLogBurst {
+		t.Errorf("suppressed %d log lines, expected %d", st.LogSuppressed, 2*n-unsolicitedLogBurst)
+	}
+
+	// Another network, or the same once the interval has passed, may log
+	// again.
+	if !s.unsolicited.allowLog(net.ParseIP("203.0.113.1")) {
+		t.Error("another network's log line suppressed")
+	}
+	if s.unsolicited.allowLog(net.ParseIP("198.51.100.1")) {
+		t.Error("log line allowed over the limit")
+	}
+	s.unsolicited.clock.(*testutil.FakeClock).Advance(unsolicitedLogInterval)
+	if !s.unsolicited.allowLog(net.ParseIP("198.51.100.1")) {
+		t.Error("log line suppressed after the interval")
+	}
+}
+
+// Measures what a NOTIFY for a zone not served costs, as scanners send them
+// in floods.
+func BenchmarkForeignNotify(b *testing.B) {
+	s := &Server{}
+	req := new(dns.Msg)
+	req.SetNotify("example.com.")
+	rw := &discardResponseWriter{&fakeResponseWriter{addr: &net.UDPAddr{IP: net.ParseIP("192.0.2.100"), Port: 1234}}}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s.ServeDNS(rw, req)
+	}
+}
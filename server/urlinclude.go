@@ -0,0 +1,189 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/namecoin/ncdns/clock"
+)
+
+// The most documents kept by a urlIncluder. When there's no room for another,
+// those due to be revalidated are forgotten; if none are, it isn't kept.
+const urlIncludeMaxCached = 1000
+
+// Fetches the JSON included into values by "include_url" statements, from
+// URLs under the prefixes in AllowURLIncludes only, since any value on the
+// chain may name any URL. Documents are kept for URLIncludeCacheTime, then
+// revalidated by their ETag or Last-Modified time.
+type urlIncluder struct {
+	prefixes []string
+	client   *http.Client
+	maxSize  int64
+	ttl      time.Duration
+	clock    clock.Clock // the system clock if nil
+
+	mu     sync.Mutex
+	cached map[string]*includedDocument // by URL
+}
+
+type includedDocument struct {
+	body         string
+	etag         string
+	lastModified string
+	fetched      time.Time // or last revalidated
+}
+
+// Checks the URL include options, and sets up s.urlIncluder if
+// AllowURLIncludes is set.
+func (s *Server) setupURLIncludes() error {
+	s.urlIncluder = nil
+	if strings.TrimSpace(s.cfg.AllowURLIncludes) == "" {
+		return nil
+	}
+	if s.cfg.URLIncludeTimeout <= 0 || s.cfg.URLIncludeMaxSize <= 0 {
+		return fmt.Errorf("URLIncludeTimeout and URLIncludeMaxSize must be positive")
+	}
+	if s.cfg.URLIncludeCacheTime < 0 {
+		return fmt.Errorf("URLIncludeCacheTime must not be negative")
+	}
+
+	ui := &urlIncluder{
+		maxSize: int64(s.cfg.URLIncludeMaxSize),
+		ttl:     time.Duration(s.cfg.URLIncludeCacheTime) * time.Second,
+		clock:   s.clock,
+		cached:  make(map[string]*includedDocument),
+	}
+	for _, p := range strings.Split(s.cfg.AllowURLIncludes, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		u, err := url.Parse(p)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("AllowURLIncludes prefix %q is not an http or https URL", p)
+		}
+		// Without a path, a prefix would also allow hosts whose names merely
+		// begin with its host's.
+		if u.Path == "" {
+			p += "/"
+		}
+		ui.prefixes = append(ui.prefixes, p)
+	}
+	ui.client = &http.Client{
+		Timeout: time.Duration(s.cfg.URLIncludeTimeout) * time.Millisecond,
+		// A redirect may only lead to another allowed URL.
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 5 {
+				return fmt.Errorf("too many redirects")
+			}
+			return ui.check(req.URL.String())
+		},
+	}
+
+	s.urlIncluder = ui
+	return nil
+}
+
+// Returns an error unless rawurl is under one of the allowed prefixes.
+func (ui *urlIncluder) check(rawurl string) error {
+	for _, p := range ui.prefixes {
+		if strings.HasPrefix(rawurl, p) {
+			return nil
+		}
+	}
+	return fmt.Errorf("URL not allowed by AllowURLIncludes")
+}
+
+// Returns the document at rawurl, from the cache if it was fetched or
+// revalidated less than URLIncludeCacheTime ago. Suits
+// ncdomain.ParseOptions.FetchURL.
+func (ui *urlIncluder) fetch(rawurl string) (string, error) {
+	if err := ui.check(rawurl); err != nil {
+		return "", err
+	}
+
+	now := clock.Or(ui.clock).Now()
+	ui.mu.Lock()
+	doc := ui.cached[rawurl]
+	ui.mu.Unlock()
+	if doc != nil && now.Sub(doc.fetched) < ui.ttl {
+		return doc.body, nil
+	}
+
+	req, err := http.NewRequest("GET", rawurl, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Accept", "application/json")
+	if doc != nil {
+		if doc.etag != "" {
+			req.Header.Set("If-None-Match", doc.etag)
+		}
+		if doc.lastModified != "" {
+			req.Header.Set("If-Modified-Since", doc.lastModified)
+		}
+	}
+
+	res, err := ui.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	switch {
+	case res.StatusCode == http.StatusNotModified && doc != nil:
+		doc = &includedDocument{body: doc.body, etag: doc.etag, lastModified: doc.lastModified}
+	case res.StatusCode == http.StatusOK:
+		body, err := ioutil.ReadAll(io.LimitReader(res.Body, ui.maxSize+1))
+		if err != nil {
+			return "", err
+		}
+		if int64(len(body)) > ui.maxSize {
+			return "", fmt.Errorf("larger than URLIncludeMaxSize (%d bytes)", ui.maxSize)
+		}
+		doc = &includedDocument{
+			body:         string(body),
+			etag:         res.Header.Get("ETag"),
+			lastModified: res.Header.Get("Last-Modified"),
+		}
+	default:
+		return "", fmt.Errorf("HTTP status %s", res.Status)
+	}
+	doc.fetched = now
+
+	ui.mu.Lock()
+	ui.store(rawurl, doc, now)
+	ui.mu.Unlock()
+	return doc.body, nil
+}
+
+// Keeps doc as the document at rawurl, if there's room. Must be called with
+// mu held.
+func (ui *urlIncluder) store(rawurl string, doc *includedDocument, now time.Time) {
+	if _, ok := ui.cached[rawurl]; !ok && len(ui.cached) >= urlIncludeMaxCached {
+		for k, d := range ui.cached {
+			if now.Sub(d.fetched) >= ui.ttl {
+				delete(ui.cached, k)
+			}
+		}
+		if len(ui.cached) >= urlIncludeMaxCached {
+			return
+		}
+	}
+	ui.cached[rawurl] = doc
+}
+
+// Returns the function with which values' "include_url" statements are
+// fetched, or nil if they aren't allowed.
+func (s *Server) fetchURLFunc() func(string) (string, error) {
+	if s.urlIncluder == nil {
+		return nil
+	}
+	return s.urlIncluder.fetch
+}
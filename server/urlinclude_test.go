@@ -0,0 +1,100 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/namecoin/ncdns/testutil"
+)
+
+func TestURLIncludes(t *testing.T) {
+	var fetches, revalidations int
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/records/example.json":
+			fetches++
+			if req.Header.Get("If-None-Match") == `"v1"` {
+				revalidations++
+				rw.WriteHeader(http.StatusNotModified)
+				return
+			}
+			rw.Header().Set("ETag", `"v1"`)
+			rw.Write([]byte(`{"ip":["192.0.2.1"]}`))
+		case "/records/large.json":
+			rw.Write([]byte(`{"txt":"` + strings.Repeat("x", 100) + `"}`))
+		case "/records/elsewhere.json":
+			http.Redirect(rw, req, "/private/secret.json", http.StatusFound)
+		default:
+			t.Errorf("fetched %s", req.URL.Path)
+			http.NotFound(rw, req)
+		}
+	}))
+	defer srv.Close()
+
+	s := &Server{cfg: Config{
+		AllowURLIncludes:    srv.URL + "/records/",
+		URLIncludeTimeout:   1000,
+		URLIncludeMaxSize:   64,
+		URLIncludeCacheTime: 300,
+	}}
+	clock := testutil.NewFakeClock(time.Unix(1000000, 0))
+	s.clock = clock
+	if err := s.setupURLIncludes(); err != nil {
+		t.Fatal(err)
+	}
+	fetch := s.fetchURLFunc()
+
+	// The document is fetched once, and revalidated by its ETag once the
+	// cache time has passed.
+	for i := 0; i < 3; i++ {
+		v, err := fetch(srv.URL + "/records/example.json")
+		if err != nil || v != `{"ip":["192.0.2.1"]}` {
+			t.Fatalf("got %q, %v", v, err)
+		}
+	}
+	if fetches != 1 {
+		t.Errorf("fetched %d times while cached", fetches)
+	}
+	clock.Advance(300 * time.Second)
+	if v, err := fetch(srv.URL + "/records/example.json"); err != nil || v != `{"ip":["192.0.2.1"]}` {
+		t.Errorf("after revalidation got %q, %v", v, err)
+	}
+	if fetches != 2 || revalidations != 1 {
+		t.Errorf("%d fetches, %d revalidations, expected 2 and 1", fetches, revalidations)
+	}
+	fetch(srv.URL + "/records/example.json")
+	if fetches != 2 {
+		t.Error("revalidated document not cached again")
+	}
+
+	if _, err := fetch(srv.URL + "/records/large.json"); err == nil || !strings.Contains(err.Error(), "URLIncludeMaxSize") {
+		t.Errorf("document over URLIncludeMaxSize got %v", err)
+	}
+
+	for _, u := range []string{
+		srv.URL + "/private/secret.json",
+		srv.URL + "/records/elsewhere.json",
+		srv.URL + "/recordsx/example.json",
+		strings.Replace(srv.URL, "http://", "https://", 1) + "/records/example.json",
+	} {
+		if _, err := fetch(u); err == nil {
+			t.Errorf("%s fetched", u)
+		}
+	}
+
+	for _, bad := range []string{"config.internal", "ftp://config.internal/", "https:///records/"} {
+		s.cfg.AllowURLIncludes = bad
+		if err := s.setupURLIncludes(); err == nil {
+			t.Errorf("AllowURLIncludes %q accepted", bad)
+		}
+	}
+
+	// Without AllowURLIncludes, there's nothing to fetch with.
+	s.cfg.AllowURLIncludes = ""
+	if err := s.setupURLIncludes(); err != nil || s.fetchURLFunc() != nil {
+		t.Errorf("URL includes enabled without AllowURLIncludes")
+	}
+}
@@ -0,0 +1,287 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/namecoin/ncdns/clock"
+)
+
+// How long the watchdog waits for a listener to answer a probe, and for a
+// restarted one to start.
+const watchdogTimeout = 2 * time.Second
+
+// The state of a DNS listener as seen by the watchdog.
+type listenerHealth struct {
+	Transport string `json:"transport"` // udp or tcp
+	Address   string `json:"address"`
+	Failures  int    `json:"failures"` // probes failed in a row
+	Restarts  uint64 `json:"restarts"`
+	LastError string `json:"last_error,omitempty"`
+}
+
+// Periodically sends a query to each UDP and TCP listener over loopback, and
+// restarts a listener which fails threshold probes in a row, such as one
+// whose goroutine died, leaving its socket open but unserved. If a listener
+// can't be restarted, ncdns exits if exitOnFailure is set, for its supervisor
+// to restart it, and otherwise carries on without it, trying again after the
+// next failed probe.
+type watchdog struct {
+	s             *Server
+	interval      time.Duration
+	threshold     int
+	exitOnFailure bool
+
+	// Queries the listener at addr over network, udp or tcp.
+	probe func(network, addr string) error
+	exit  func()
+
+	mu     sync.Mutex
+	health map[string]*listenerHealth // by transport and address
+}
+
+func (s *Server) setupWatchdog() error {
+	if s.cfg.WatchdogInterval == 0 {
+		return nil
+	}
+	if s.cfg.WatchdogInterval < 0 {
+		return configError("WatchdogInterval must not be negative")
+	}
+	if s.cfg.WatchdogFailureThreshold < 1 {
+		return configError("WatchdogFailureThreshold must be at least 1")
+	}
+
+	zone := dns.Fqdn(s.cfg.CanonicalSuffix)
+	s.watchdog = &watchdog{
+		s:             s,
+		interval:      time.Duration(s.cfg.WatchdogInterval) * time.Second,
+		threshold:     s.cfg.WatchdogFailureThreshold,
+		exitOnFailure: s.cfg.WatchdogExitOnFailure,
+		probe: func(network, addr string) error {
+			return probeListener(network, addr, zone)
+		},
+		exit:   func() { os.Exit(1) },
+		health: map[string]*listenerHealth{},
+	}
+	return nil
+}
+
+// Sends a query for the SOA of zone to the listener at addr. Any answer will
+// do, whatever its code, since the listener is working if it answers at all.
+func probeListener(network, addr, zone string) error {
+	req := new(dns.Msg)
+	req.SetQuestion(zone, dns.TypeSOA)
+	c := &dns.Client{Net: network, Timeout: watchdogTimeout}
+	_, _, err := c.Exchange(req, addr)
+	return err
+}
+
+func (w *watchdog) run() {
+	for {
+		select {
+		case <-clock.Or(w.s.clock).NewTimer(w.interval).C():
+		case <-w.s.lifecycle.done():
+			return
+		}
+		w.check()
+	}
+}
+
+// Probes each listener, and restarts those which have failed too many probes.
+func (w *watchdog) check() {
+	for _, l := range w.s.watchedListeners() {
+		key := l.Transport + " " + l.Address
+		err := w.probe(l.Transport, probeAddr(l.Address))
+
+		w.mu.Lock()
+		h := w.health[key]
+		if h == nil {
+			h = &listenerHealth{Transport: l.Transport, Address: l.Address}
+			w.health[key] = h
+		}
+		failures := 0
+		if err != nil {
+			h.Failures++
+			h.LastError = err.Error()
+			failures = h.Failures
+		} else {
+			if h.Failures >= w.threshold {
+				log.Infof("the %s listener on %s answers again", l.Transport, l.Address)
+			}
+			h.Failures, h.LastError = 0, ""
+		}
+		w.mu.Unlock()
+
+		if failures == 0 {
+			continue
+		}
+		log.Warne(err, "the ", l.Transport, " listener on ", l.Address, " didn't answer the watchdog's probe")
+		if failures < w.threshold {
+			continue
+		}
+
+		log.Errorf("the %s listener on %s failed %d probes in a row; restarting it", l.Transport, l.Address, failures)
+		err = w.s.restartListener(l.Transport, l.Address)
+		if err != nil {
+			log.Errore(err, "couldn't restart the ", l.Transport, " listener on ", l.Address)
+			if w.exitOnFailure && w.s.lifecycle.current() != stateStopped {
+				log.Errorf("exiting, as WatchdogExitOnFailure is set")
+				w.exit()
+			}
+			continue
+		}
+
+		w.mu.Lock()
+		h.Restarts++
+		w.mu.Unlock()
+		log.Infof("restarted the %s listener on %s", l.Transport, l.Address)
+	}
+}
+
+// Returns the address to send a probe of a listener bound to addr to: addr
+// itself, or the loopback address of its family if it's a wildcard.
+func probeAddr(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	switch ip := net.ParseIP(host); {
+	case ip == nil || !ip.IsUnspecified():
+		return addr
+	case ip.To4() != nil:
+		return net.JoinHostPort("127.0.0.1", port)
+	default:
+		return net.JoinHostPort("::1", port)
+	}
+}
+
+func (w *watchdog) Status() []listenerHealth {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	var st []listenerHealth
+	for _, h := range w.health {
+		st = append(st, *h)
+	}
+	sort.Slice(st, func(i, j int) bool {
+		if st[i].Transport != st[j].Transport {
+			return st[i].Transport < st[j].Transport
+		}
+		return st[i].Address < st[j].Address
+	})
+	return st
+}
+
+// Returns the UDP and TCP listeners, with empty Failures.
+func (s *Server) watchedListeners() []listenerHealth {
+	s.listenersMu.RLock()
+	defer s.listenersMu.RUnlock()
+
+	var ls []listenerHealth
+	for _, conn := range s.udpConns {
+		ls = append(ls, listenerHealth{Transport: "udp", Address: conn.LocalAddr().String()})
+	}
+	for _, l := range s.tcpListeners {
+		ls = append(ls, listenerHealth{Transport: "tcp", Address: l.Addr().String()})
+	}
+	return ls
+}
+
+// Replaces the listener bound to addr for transport, udp or tcp, with a new
+// socket bound to the same address, served by a new dns.Server. The old
+// server is shut down, if it's still running, and its socket closed first, so
+// that the address can be bound again.
+func (s *Server) restartListener(transport, addr string) error {
+	s.listenersMu.Lock()
+	defer s.listenersMu.Unlock()
+
+	// Once stopping, the listeners are left to be closed.
+	if s.lifecycle.current() == stateStopped {
+		return fmt.Errorf("the server is stopping")
+	}
+
+	for i, ds := range s.dnsServers {
+		if ds.Net == transport && ds.Addr == addr {
+			ctx, cancel := context.WithTimeout(context.Background(), watchdogTimeout)
+			ds.ShutdownContext(ctx)
+			cancel()
+			s.dnsServers = append(s.dnsServers[:i], s.dnsServers[i+1:]...)
+			break
+		}
+	}
+
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	port, err := strconv.Atoi(portStr)
+	if err != nil || ip == nil {
+		return fmt.Errorf("can't rebind %s", addr)
+	}
+	family := "6"
+	if ip.To4() != nil {
+		family = "4"
+	}
+
+	var ds *dns.Server
+	started := make(chan struct{})
+	switch transport {
+	case "udp":
+		i := 0
+		for i < len(s.udpConns) && s.udpConns[i].LocalAddr().String() != addr {
+			i++
+		}
+		if i == len(s.udpConns) {
+			return fmt.Errorf("no UDP listener on %s", addr)
+		}
+		s.udpConns[i].Close()
+
+		conn, err := net.ListenUDP("udp"+family, &net.UDPAddr{IP: ip, Port: port})
+		if err != nil {
+			return err
+		}
+		if err := setReceiveBuffer(conn, s.cfg.UDPReceiveBufferBytes); err != nil {
+			conn.Close()
+			return err
+		}
+		s.udpConns[i] = conn
+		ds = s.runListener("udp", conn, nil, func() { close(started) })
+
+	case "tcp":
+		i := 0
+		for i < len(s.tcpListeners) && s.tcpListeners[i].Addr().String() != addr {
+			i++
+		}
+		if i == len(s.tcpListeners) {
+			return fmt.Errorf("no TCP listener on %s", addr)
+		}
+		s.tcpListeners[i].Close()
+
+		l, err := net.ListenTCP("tcp"+family, &net.TCPAddr{IP: ip, Port: port})
+		if err != nil {
+			return err
+		}
+		s.tcpListeners[i] = l
+		ds = s.runListener("tcp", nil, l, func() { close(started) })
+
+	default:
+		return fmt.Errorf("unknown transport %s", transport)
+	}
+	s.dnsServers = append(s.dnsServers, ds)
+
+	select {
+	case <-started:
+		return nil
+	case <-clock.Or(s.clock).NewTimer(watchdogTimeout).C():
+		return fmt.Errorf("the restarted listener on %s didn't start within %v", addr, watchdogTimeout)
+	}
+}
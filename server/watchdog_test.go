@@ -0,0 +1,129 @@
+package server
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// The TCP listener is closed out from under a running server, which the
+// watchdog notices and restarts it.
+func TestWatchdog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ncdns-watchdog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := os.MkdirAll(filepath.Join(dir, "names", "d"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, "names", "d", "example.json"), []byte(`{"ip":"192.0.2.1"}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := newErrorTestConfig(dir)
+	cfg.Fetcher = "static"
+	cfg.StaticDataDir = "names"
+	cfg.CanonicalSuffix = "bit"
+	cfg.WatchdogInterval = 3600 // probed by the test instead
+	cfg.WatchdogFailureThreshold = 2
+
+	s, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+	udpAddr, tcpAddr := s.UDPAddrs()[0].String(), s.TCPAddrs()[0].String()
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	wd := s.watchdog
+
+	query := func(network, addr string) error {
+		req := new(dns.Msg)
+		req.SetQuestion("example.bit.", dns.TypeA)
+		c := &dns.Client{Net: network, Timeout: watchdogTimeout}
+		_, _, err := c.Exchange(req, addr)
+		return err
+	}
+	health := func(transport string) listenerHealth {
+		for _, h := range wd.Status() {
+			if h.Transport == transport {
+				return h
+			}
+		}
+		return listenerHealth{}
+	}
+
+	wd.check()
+	if h := health("tcp"); h.Address != tcpAddr || h.Failures != 0 {
+		t.Fatalf("healthy listener reported as %+v", h)
+	}
+
+	s.listenersMu.RLock()
+	s.tcpListeners[0].Close()
+	s.listenersMu.RUnlock()
+	if err := query("tcp", tcpAddr); err == nil {
+		t.Fatal("TCP query answered with the listener closed")
+	}
+
+	// Restarted only once it fails the threshold of probes.
+	wd.check()
+	if h := health("tcp"); h.Failures != 1 || h.Restarts != 0 {
+		t.Errorf("after one failed probe: %+v", h)
+	}
+	wd.check()
+	if h := health("tcp"); h.Restarts != 1 {
+		t.Errorf("after two failed probes: %+v", h)
+	}
+	if err := query("tcp", tcpAddr); err != nil {
+		t.Errorf("TCP query after the restart: %v", err)
+	}
+	if err := query("udp", udpAddr); err != nil {
+		t.Errorf("UDP query: %v", err)
+	}
+	wd.check()
+	if h := health("tcp"); h.Failures != 0 || h.Restarts != 1 {
+		t.Errorf("after a successful probe: %+v", h)
+	}
+	if h := health("udp"); h.Failures != 0 || h.Restarts != 0 {
+		t.Errorf("UDP listener reported as %+v", h)
+	}
+
+	// With the address taken, the listener can't be restarted.
+	exited := false
+	wd.threshold = 1
+	wd.exitOnFailure = true
+	wd.exit = func() { exited = true }
+	s.listenersMu.RLock()
+	s.tcpListeners[0].Close()
+	s.listenersMu.RUnlock()
+	l, err := net.Listen("tcp", tcpAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	wd.check()
+	if !exited {
+		t.Errorf("didn't exit when the listener couldn't be restarted")
+	}
+}
+
+func TestProbeAddr(t *testing.T) {
+	for addr, expected := range map[string]string{
+		"192.0.2.1:53": "192.0.2.1:53",
+		"0.0.0.0:53":   "127.0.0.1:53",
+		"[::]:1153":    "[::1]:1153",
+		"[::1]:53":     "[::1]:53",
+	} {
+		if got := probeAddr(addr); got != expected {
+			t.Errorf("%s: got %s, expected %s", addr, got, expected)
+		}
+	}
+}
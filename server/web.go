@@ -1,46 +1,111 @@
+//go:build !no_webserver
+// +build !no_webserver
+
 package server
 
+import "context"
+import "net"
 import "net/http"
+import "mime"
+import "crypto/tls"
+import "encoding/json"
 import "html/template"
+import "github.com/namecoin/ncdns/backend"
 import "github.com/namecoin/ncdns/util"
 import "github.com/namecoin/ncdns/ncdomain"
+import "github.com/namecoin/ncdns/namecoin"
+import "github.com/namecoin/ncdns/resolver"
+import "github.com/namecoin/ncdns/clock"
+import "github.com/namecoin/ncdns/rrsort"
+import "gopkg.in/hlandau/madns.v2/merr"
 import "github.com/miekg/dns"
 import "github.com/kr/pretty"
 import "path/filepath"
 import "time"
 import "strings"
+import "strconv"
+import "sort"
 import "fmt"
+import "io/ioutil"
+import "errors"
+import "os"
+
+// The template sets built into ncdns (e.g. /std/layout.tpl), used unless
+// TplPath is set, or nil if it was built without them. Set by package main.
+var BuiltinTemplates http.FileSystem
 
-var layoutTpl *template.Template
-var mainPageTpl *template.Template
-var lookupPageTpl *template.Template
+// Loads the templates of the pages served.
+func (ws *webServer) initTemplates() (err error) {
+	_, ws.mainPage, ws.lookupPage, ws.unregisteredPage, err = ws.s.loadTemplates()
+	return err
+}
 
-func (s *Server) initTemplates() error {
-	if lookupPageTpl != nil {
-		return nil
+// Reads and parses the templates of TplSet, checking that they execute. A set
+// without an unregistered page, shown when a name looked up doesn't exist,
+// uses its lookup page instead.
+func (s *Server) loadTemplates() (layout, mainPage, lookupPage, unregisteredPage *template.Template, err error) {
+	text, err := s.readTemplate("layout")
+	if err != nil {
+		return
+	}
+	layout, err = template.New("layout.tpl").Parse(text)
+	if err != nil {
+		return
 	}
 
-	var err error
-	layoutTpl, err = template.ParseFiles(s.tplFilename("layout"))
+	mainPage, err = s.deriveTemplate(layout, "main")
 	if err != nil {
-		return err
+		return
 	}
 
-	mainPageTpl, err = deriveTemplate(s.tplFilename("main"))
+	lookupPage, err = s.deriveTemplate(layout, "lookup")
 	if err != nil {
-		return err
+		return
 	}
 
-	lookupPageTpl, err = deriveTemplate(s.tplFilename("lookup"))
-	return err
+	unregisteredPage, err = s.deriveTemplate(layout, "unregistered")
+	if errors.Is(err, os.ErrNotExist) {
+		unregisteredPage, err = lookupPage, nil
+	}
+	if err != nil {
+		return
+	}
+
+	err = s.checkTemplates(mainPage, lookupPage, unregisteredPage)
+	return
 }
 
-func deriveTemplate(filename string) (*template.Template, error) {
-	cl, err := layoutTpl.Clone()
+func (s *Server) deriveTemplate(layout *template.Template, name string) (*template.Template, error) {
+	text, err := s.readTemplate(name)
+	if err != nil {
+		return nil, err
+	}
+
+	cl, err := layout.Clone()
 	if err != nil {
 		return nil, err
 	}
-	return cl.ParseFiles(filename)
+	// The page is the layout, with the page's definitions added to it.
+	_, err = cl.New(name + ".tpl").Parse(text)
+	return cl, err
+}
+
+// Returns the text of a template of TplSet: from the built-in templates
+// unless TplPath is set or there are none, otherwise from the tpl directory.
+func (s *Server) readTemplate(name string) (string, error) {
+	if s.cfg.TplPath == "" && BuiltinTemplates != nil {
+		f, err := BuiltinTemplates.Open("/" + s.cfg.TplSet + "/" + name + ".tpl")
+		if err != nil {
+			return "", err
+		}
+		defer f.Close()
+
+		b, err := ioutil.ReadAll(f)
+		return string(b), err
+	}
+
+	b, err := s.cfg.readStartupFile(name+" template", s.tplFilename(name))
+	return string(b), err
 }
 
 func (s *Server) tplFilename(filename string) string {
@@ -55,6 +120,29 @@ func (s *Server) tplFilename(filename string) string {
 type webServer struct {
 	s  *Server
 	sm *http.ServeMux
+
+	// Looks up the value of a Namecoin name, for the request whose context
+	// is given.
+	nameQuery func(ctx context.Context, name, streamIsolationID string) (string, error)
+
+	// Looks up the value of a Namecoin name along with its expiry status. If
+	// nil, names looked up with nameQuery are taken to be unexpired.
+	nameData func(ctx context.Context, name, streamIsolationID string) (*namecoin.NameData, error)
+
+	// Estimates the cost of registering names which don't exist. If nil, as
+	// when names aren't fetched from namecoind, no cost is given.
+	fees *feeEstimator
+
+	// Checks namecoind for /readyz; nil if names aren't fetched from it.
+	rpcProbe *rpcProbe
+
+	// The templates of the pages, set by initTemplates.
+	mainPage, lookupPage, unregisteredPage *template.Template
+
+	// Set up by newWebServer, for the webserver New creates.
+	srv   *http.Server
+	l     net.Listener
+	certs *certReloader // nil unless HTTPTLSCert is set
 }
 
 type layoutInfo struct {
@@ -66,6 +154,9 @@ type layoutInfo struct {
 	CanonicalSuffixHTML  template.HTML
 	TLD                  string
 	HasDNSSEC            bool
+	Network              string
+	TestNetwork          bool
+	DNSPort              int // if not the standard port
 }
 
 func (ws *webServer) layoutInfo() *layoutInfo {
@@ -80,51 +171,71 @@ func (ws *webServer) layoutInfo() *layoutInfo {
 		tld = "." + csparts[1]
 	}
 
+	cfg := ws.s.currentConfig()
 	li := &layoutInfo{
 		SelfName:             ws.s.ServerName(),
-		Time:                 time.Now().Format("2006-01-02 15:04:05"),
-		CanonicalSuffix:      ws.s.cfg.CanonicalSuffix,
-		CanonicalNameservers: ws.s.cfg.canonicalNameservers,
-		Hostmaster:           ws.s.cfg.Hostmaster,
+		Time:                 clock.Or(ws.s.clock).Now().Format("2006-01-02 15:04:05"),
+		CanonicalSuffix:      cfg.CanonicalSuffix,
+		CanonicalNameservers: cfg.canonicalNameservers,
+		Hostmaster:           cfg.Hostmaster,
 		CanonicalSuffixHTML:  template.HTML(cshtml),
 		TLD:                  tld,
-		HasDNSSEC:            ws.s.cfg.ZonePublicKey != "",
+		HasDNSSEC:            cfg.DNSSEC.ZonePublicKey != "",
+	}
+
+	network := ws.s.networkStatus()
+	li.Network, li.TestNetwork = network.Name, network.Test
+
+	if port := ws.s.DNSPort(); port != 53 {
+		li.DNSPort = port
 	}
 
 	return li
 }
 
 func (ws *webServer) handleRoot(rw http.ResponseWriter, req *http.Request) {
-	err := mainPageTpl.Execute(rw, ws.layoutInfo())
-	log.Infoe(err, "tpl")
+	ws.executeTemplate(rw, ws.mainPage, ws.layoutInfo())
+}
+
+// The data of the lookup page.
+type lookupInfo struct {
+	layoutInfo
+	JSONMode       bool
+	JSONValue      string
+	Query          string
+	Advanced       bool
+	NamecoinName   string
+	DomainName     string
+	BareName       string
+	NameParseError error
+	ExistenceError error
+	Expired        bool
+	Expiry         string
+	Value          string
+	NCValue        *ncdomain.Value
+	NCValueFmt     fmt.Formatter
+	ParseErrors    []error
+	ParseWarnings  []error
+	RRs            []dns.RR
+	RRError        error
+	Valid          bool
+
+	// Set if the name doesn't exist, with the estimated cost of registering
+	// it, or why there's no estimate.
+	Unregistered          bool
+	RegistrationCost      string
+	RegistrationCostError error
 }
 
 func (ws *webServer) handleLookup(rw http.ResponseWriter, req *http.Request) {
-	info := struct {
-		layoutInfo
-		JSONMode       bool
-		JSONValue      string
-		Query          string
-		Advanced       bool
-		NamecoinName   string
-		DomainName     string
-		BareName       string
-		NameParseError error
-		ExistenceError error
-		Expired        bool
-		Value          string
-		NCValue        *ncdomain.Value
-		NCValueFmt     fmt.Formatter
-		ParseErrors    []error
-		ParseWarnings  []error
-		RRs            []dns.RR
-		RRError        error
-		Valid          bool
-	}{layoutInfo: *ws.layoutInfo()}
+	info := lookupInfo{layoutInfo: *ws.layoutInfo()}
 
 	defer func() {
-		err := lookupPageTpl.Execute(rw, &info)
-		log.Infoe(err, "lookup page tpl")
+		tpl := ws.lookupPage
+		if info.Unregistered {
+			tpl = ws.unregisteredPage
+		}
+		ws.executeTemplate(rw, tpl, &info)
 	}()
 
 	q := req.FormValue("q")
@@ -140,10 +251,21 @@ func (ws *webServer) handleLookup(rw http.ResponseWriter, req *http.Request) {
 	info.JSONValue = req.FormValue("value")
 	info.Value = strings.Trim(info.JSONValue, " \t\r\n")
 	if info.Value == "" {
-		info.Value, info.ExistenceError = ws.s.namecoinConn.NameQuery(info.NamecoinName, "")
-		if info.ExistenceError != nil {
+		nameData, err := ws.queryNameData(req.Context(), info.NamecoinName)
+		info.ExistenceError = err
+		if retryAfter, refused := breakerRetryAfter(err); refused {
+			serviceUnavailable(rw, retryAfter)
+		}
+		if err == merr.ErrNoSuchDomain {
+			ws.fillRegistrationHints(&info)
+		}
+		if err != nil {
 			return
 		}
+
+		info.Value = nameData.Value
+		info.Expired = nameData.Expired
+		info.Expiry = ws.describeExpiry(nameData)
 	} else {
 		info.JSONMode = true
 	}
@@ -156,7 +278,7 @@ func (ws *webServer) handleLookup(rw http.ResponseWriter, req *http.Request) {
 		}
 	}
 
-	info.NCValue = ncdomain.ParseValue(info.NamecoinName, info.Value, ws.resolveFunc, errorFunc)
+	info.NCValue = ws.parseValue(req.Context(), info.NamecoinName, info.Value, errorFunc)
 	if info.NCValue == nil {
 		return
 	}
@@ -169,8 +291,339 @@ func (ws *webServer) handleLookup(rw http.ResponseWriter, req *http.Request) {
 	}
 }
 
-func (ws *webServer) resolveFunc(name string) (string, error) {
-	return ws.s.namecoinConn.NameQuery(name, "")
+func (ws *webServer) queryNameData(ctx context.Context, name string) (*namecoin.NameData, error) {
+	if ws.nameData != nil {
+		return ws.nameData(ctx, name, "")
+	}
+
+	value, err := ws.nameQuery(ctx, name, "")
+	if err != nil {
+		return nil, err
+	}
+	return &namecoin.NameData{Value: value}, nil
+}
+
+// Describes when a name expires or expired, and whether it is still served
+// over DNS.
+func (ws *webServer) describeExpiry(nameData *namecoin.NameData) string {
+	if !nameData.Expired {
+		if nameData.ExpiresIn <= 0 {
+			return ""
+		}
+		return fmt.Sprintf("expires in %d blocks", nameData.ExpiresIn)
+	}
+
+	blocksAgo := -int(nameData.ExpiresIn)
+	if blocksAgo < 0 {
+		blocksAgo = 0
+	}
+	if grace := ws.s.cfg.ServeExpiredNamesFor; blocksAgo < grace {
+		return fmt.Sprintf("expired %d blocks ago; still served over DNS for %d more blocks", blocksAgo, grace-blocksAgo)
+	}
+	return fmt.Sprintf("expired %d blocks ago; not served over DNS", blocksAgo)
+}
+
+// Parses the value of a name, looking up the names it imports with the given
+// request context.
+func (ws *webServer) parseValue(ctx context.Context, name, value string, errFunc ncdomain.ErrorFunc) *ncdomain.Value {
+	resolve := func(name string) (string, error) {
+		return ws.nameQuery(ctx, name, "")
+	}
+	return ncdomain.ParseValueWithOptions(name, value, resolve, errFunc, ws.s.parseOptions())
+}
+
+type apiRecord struct {
+	RR         string              `json:"rr"`
+	Type       string              `json:"type"`
+	Provenance ncdomain.Provenance `json:"provenance"`
+}
+
+type apiLookupResult struct {
+	NamecoinName string              `json:"namecoin_name"`
+	DomainName   string              `json:"domain_name"`
+	Records      []apiRecord         `json:"records"`
+	Errors       []string            `json:"errors,omitempty"`
+	Warnings     []string            `json:"warnings,omitempty"`
+	Valid        bool                `json:"valid"`
+	Trace        []backend.TraceStep `json:"trace,omitempty"`
+
+	// The TTL with which the name's records were last served over DNS, if
+	// stretched by AdaptiveTTL. The TTLs of Records are those the value
+	// gives.
+	AdaptiveTTL *backend.AdaptiveTTL `json:"adaptive_ttl,omitempty"`
+}
+
+// A lookup which failed, with the trace of the backend's lookup if one was
+// asked for.
+type apiLookupError struct {
+	apiError
+	Trace []backend.TraceStep `json:"trace,omitempty"`
+}
+
+// Returns true if the request comes from a loopback address, or over a Unix
+// socket, and so may be given information about the server which other
+// clients aren't.
+func isLoopbackRequest(req *http.Request) bool {
+	// The clients of a Unix socket have no address, but are on this host,
+	// and only those the socket's permissions allow can connect.
+	if addr, ok := req.Context().Value(http.LocalAddrContextKey).(net.Addr); ok && addr.Network() == "unix" {
+		return true
+	}
+
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	ip := net.ParseIP(host)
+	return err == nil && ip != nil && ip.IsLoopback()
+}
+
+// Returns true if the request's body is declared as JSON. A browser sends
+// such a request to another origin only after a CORS preflight, which the
+// webserver never allows, so a page open in a browser on the local host can't
+// make it with a form, as it can a plain POST.
+func isJSONRequest(req *http.Request) bool {
+	mt, _, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	return err == nil && mt == "application/json"
+}
+
+type apiError struct {
+	Error string `json:"error"`
+}
+
+func writeJSON(rw http.ResponseWriter, status int, v interface{}) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(status)
+	err := json.NewEncoder(rw).Encode(v)
+	log.Infoe(err, "json response")
+}
+
+// Returns the HTTP status for a lookup of a name which failed with err: 404
+// only if the name doesn't exist, so that clients and caches don't take a
+// failure to reach namecoind for that.
+func lookupErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, merr.ErrNoSuchDomain):
+		return http.StatusNotFound
+	case errors.Is(err, backend.ErrLookupsSaturated):
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusBadGateway
+	}
+}
+
+// Like handleLookup, but returns the records generated for a name as JSON,
+// each with where in the name's value (or the values it imports) it came from.
+func (ws *webServer) handleAPILookup(rw http.ResponseWriter, req *http.Request) {
+	bareName, namecoinName, err := util.ParseFuzzyDomainNameNC(req.FormValue("q"))
+	if err != nil {
+		writeJSON(rw, http.StatusBadRequest, &apiError{Error: err.Error()})
+		return
+	}
+
+	// The backend's lookup of the name, as made to answer a DNS query, is
+	// traced before anything else is done, so that it shows the state of
+	// the cache as queries find it.
+	var trace []backend.TraceStep
+	if req.FormValue("trace") == "1" {
+		if !isLoopbackRequest(req) {
+			writeJSON(rw, http.StatusForbidden, &apiError{Error: "lookups may only be traced from a loopback address"})
+			return
+		}
+		trace, _, _, _ = ws.s.traceLookup(bareName + ".bit.")
+	}
+
+	value := strings.Trim(req.FormValue("value"), " \t\r\n")
+	if value == "" {
+		value, err = ws.nameQuery(req.Context(), namecoinName, "")
+		if retryAfter, refused := breakerRetryAfter(err); refused {
+			rw.Header().Set("Retry-After", strconv.Itoa(retryAfterSeconds(retryAfter)))
+			writeJSON(rw, http.StatusServiceUnavailable, &apiLookupError{apiError{Error: err.Error()}, trace})
+			return
+		}
+		if err != nil {
+			writeJSON(rw, lookupErrorStatus(err), &apiLookupError{apiError{Error: err.Error()}, trace})
+			return
+		}
+	}
+
+	res := &apiLookupResult{
+		NamecoinName: namecoinName,
+		DomainName:   bareName + ".bit.",
+		Records:      []apiRecord{},
+		Trace:        trace,
+	}
+	if b := ws.s.currentBackend(); b != nil && req.FormValue("value") == "" {
+		res.AdaptiveTTL, _ = b.NameTTL(namecoinName, "")
+	}
+
+	errorFunc := func(e error, isWarning bool) {
+		if isWarning {
+			res.Warnings = append(res.Warnings, e.Error())
+		} else {
+			res.Errors = append(res.Errors, e.Error())
+		}
+	}
+
+	v := ws.parseValue(req.Context(), namecoinName, value, errorFunc)
+	if v == nil {
+		writeJSON(rw, http.StatusOK, res)
+		return
+	}
+
+	recs, err := v.RecordsRecursive(nil, res.DomainName, "bit.")
+	if err != nil {
+		res.Errors = append(res.Errors, err.Error())
+	}
+	// The subdomains of a value come in no particular order.
+	sort.SliceStable(recs, func(i, j int) bool {
+		return rrsort.Compare(recs[i].RR, recs[j].RR) < 0
+	})
+
+	for _, r := range recs {
+		res.Records = append(res.Records, apiRecord{
+			RR:         r.RR.String(),
+			Type:       dns.TypeToString[r.RR.Header().Rrtype],
+			Provenance: r.Provenance,
+		})
+	}
+
+	res.Valid = len(res.Errors) == 0
+	writeJSON(rw, http.StatusOK, res)
+}
+
+type statusInfo struct {
+	Network      *networkStatus             `json:"network"`
+	Listen       []string                   `json:"listen"`
+	ListenTCP    []string                   `json:"listen_tcp,omitempty"`
+	State        string                     `json:"state"` // starting, running, reloading, draining or stopped
+	Draining     bool                       `json:"draining"`
+	Outbound     *resolver.Stats            `json:"outbound_resolver,omitempty"`
+	ParentDS     *parentDSStatus            `json:"parent_ds,omitempty"`
+	SelfName     *selfNameStatus            `json:"self_name,omitempty"`
+	Peers        []peerStatus               `json:"peers,omitempty"`
+	Listeners    []listenerHealth           `json:"listeners,omitempty"`
+	HealthChecks map[string][]addressHealth `json:"health_checks,omitempty"`
+	Signatures   *signatureStatus           `json:"signatures,omitempty"`
+	SigGuard     *sigGuardStatus            `json:"signature_guard,omitempty"`
+	Retries      *backend.RetryStats        `json:"retries,omitempty"`
+	Lookups      backend.LookupStats        `json:"lookups"`
+	CacheParams  cacheParamsInfo            `json:"cache_params"`
+	NamecoinRPC  *namecoin.FailoverStatus   `json:"namecoin_rpc,omitempty"`
+	Breaker      *breakerStatus             `json:"breaker,omitempty"`
+	UDPSockets   []udpSocketStatus          `json:"udp_sockets,omitempty"`
+	Responses    responseStatus             `json:"responses"`
+	MetaQueries  map[string]uint64          `json:"meta_queries"`
+	EDNS         *ednsCounts                `json:"edns,omitempty"`
+	RRL          *rrlStatus                 `json:"rrl,omitempty"`
+	Cookies      *cookieStatus              `json:"cookies,omitempty"`
+	Events       *eventStatus               `json:"events,omitempty"`
+	OutOfZone    *outOfZoneStatus           `json:"out_of_zone,omitempty"`
+	Unsolicited  unsolicitedStatus          `json:"unsolicited"`
+	TCPConns     tcpConnStatus              `json:"tcp_connections"`
+	Deprecated   []deprecatedOption         `json:"deprecated_options,omitempty"`
+}
+
+// Reports whether the server is draining and the state of its background
+// checks.
+func (ws *webServer) handleStatus(rw http.ResponseWriter, req *http.Request) {
+	info := statusInfo{
+		Network:  ws.s.networkStatus(),
+		State:    ws.s.lifecycle.current().String(),
+		Draining: ws.s.isDraining(),
+	}
+	for _, a := range ws.s.UDPAddrs() {
+		info.Listen = append(info.Listen, a.String())
+	}
+	for _, a := range ws.s.TCPAddrs() {
+		info.ListenTCP = append(info.ListenTCP, a.String())
+	}
+	if ws.s.outbound != nil {
+		st := ws.s.outbound.Stats()
+		info.Outbound = &st
+	}
+	if ws.s.parentChecker != nil {
+		st := ws.s.parentChecker.Status()
+		info.ParentDS = &st
+	}
+	if ws.s.selfNames != nil {
+		st := ws.s.selfNames.Status()
+		info.SelfName = &st
+	}
+	if ws.s.peerChecker != nil {
+		info.Peers = ws.s.peerChecker.Status()
+	}
+	if ws.s.watchdog != nil {
+		info.Listeners = ws.s.watchdog.Status()
+	}
+	if ws.s.healthChecker != nil {
+		info.HealthChecks = ws.s.healthChecker.Status()
+	}
+	if ws.s.sigMonitor != nil {
+		st := ws.s.sigMonitor.Status()
+		info.Signatures = &st
+	}
+	if ws.s.sigGuard != nil {
+		st := ws.s.sigGuard.Status()
+		info.SigGuard = &st
+	}
+	info.Retries = ws.s.currentBackend().RetryStats()
+	info.Lookups = ws.s.currentBackend().LookupStats()
+	info.CacheParams = ws.s.currentConfig().cacheParams()
+	if ws.s.namecoinConn != nil {
+		info.NamecoinRPC = ws.s.namecoinConn.FailoverStatus()
+	}
+	if ws.s.httpBreaker != nil {
+		st := ws.s.httpBreaker.Status()
+		info.Breaker = &st
+	}
+	info.UDPSockets = ws.s.udpSocketStatus()
+	info.Responses = ws.s.responseStatus()
+	info.MetaQueries = ws.s.metaQueries.Status()
+	info.Unsolicited = ws.s.unsolicited.Status()
+	info.TCPConns = ws.s.tcpConns.Status()
+	info.Deprecated = ws.s.deprecated
+	if ws.s.ednsStats != nil {
+		st := ws.s.ednsStats.Status()
+		info.EDNS = &st
+	}
+	if ws.s.rrl != nil {
+		st := ws.s.rrl.Status()
+		info.RRL = &st
+	}
+	if ws.s.cookies != nil {
+		st := ws.s.cookies.Status()
+		info.Cookies = &st
+	}
+	if ws.s.events != nil {
+		st := ws.s.events.Status()
+		info.Events = &st
+	}
+	if ws.s.outOfZone != nil {
+		st := ws.s.outOfZone.Status()
+		info.OutOfZone = &st
+	}
+
+	writeJSON(rw, http.StatusOK, &info)
+}
+
+// Describes the name value fields understood by this version of ncdns.
+func (ws *webServer) handleValueSchema(rw http.ResponseWriter, req *http.Request) {
+	rw.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(rw).Encode(ncdomain.ValueSchema())
+	log.Infoe(err, "value schema")
+}
+
+// Tells the client to come back later. Must be called before anything is
+// written to the body.
+func serviceUnavailable(rw http.ResponseWriter, retryAfter time.Duration) {
+	rw.Header().Set("Retry-After", strconv.Itoa(retryAfterSeconds(retryAfter)))
+	rw.WriteHeader(http.StatusServiceUnavailable)
+}
+
+func retryAfterSeconds(retryAfter time.Duration) int {
+	secs := int((retryAfter + time.Second - 1) / time.Second)
+	if secs < 1 {
+		secs = 1
+	}
+	return secs
 }
 
 func (ws *webServer) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
@@ -183,6 +636,14 @@ func (ws *webServer) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	//req.Header.Set("X-XSS-Protection", "0")
 	//req.Header.Set("X-Permitted-Cross-Domain-Policies", "none")
 	clearAllCookies(rw, req)
+
+	if ws.s.cfg.HTTP.Redirects && !ws.s.cfg.HTTP.ProbesOnly {
+		if ncname, subPath, ok := ws.splitHost(req.Host); ok {
+			ws.handleNameHost(rw, req, ncname, subPath)
+			return
+		}
+	}
+
 	ws.sm.ServeHTTP(rw, req)
 }
 
@@ -196,27 +657,183 @@ func clearAllCookies(rw http.ResponseWriter, req *http.Request) {
 	}
 }
 
-func webStart(listenAddr string, server *Server) error {
-	if err := server.initTemplates(); err != nil {
-		return err
-	}
-
+// Sets up the webserver for New: its templates, handlers and listener, and
+// its certificate if HTTPTLSCert is set, so that templates which can't be
+// parsed and addresses which can't be bound are reported by New rather than
+// once requests come in. It serves once the server is started.
+func newWebServer(server *Server) (*webServer, error) {
+	// Names are looked up through the backend, as for DNS queries, so that
+	// they share its cache, and any fetch of a name in progress. The breaker
+	// guards only the fetches of names which aren't cached.
 	ws := &webServer{
 		s:  server,
 		sm: http.NewServeMux(),
+		nameData: func(ctx context.Context, name, streamIsolationID string) (*namecoin.NameData, error) {
+			ctx = backend.WithFetchGuard(ctx, server.httpBreaker)
+			return server.currentBackend().NameData(ctx, name, streamIsolationID)
+		},
+	}
+	ws.nameQuery = func(ctx context.Context, name, streamIsolationID string) (string, error) {
+		nameData, err := ws.nameData(ctx, name, streamIsolationID)
+		if err != nil {
+			return "", err
+		}
+		return nameData.Value, nil
+	}
+	if !server.cfg.HTTP.ProbesOnly {
+		if err := ws.initTemplates(); err != nil {
+			return nil, wrapError(ErrConfigInvalid, err)
+		}
+	}
+	if server.cfg.usesNamecoind() {
+		ws.fees = &feeEstimator{
+			estimate: server.namecoinConn.EstimateFeeRate,
+			clock:    clock.Or(server.clock),
+		}
+		ws.rpcProbe = newRPCProbe(func() error {
+			_, err := server.namecoinConn.GetBlockCount()
+			return err
+		}, server.clock)
 	}
 
-	ws.sm.HandleFunc("/", ws.handleRoot)
-	ws.sm.HandleFunc("/lookup", ws.handleLookup)
+	ws.sm.HandleFunc("/healthz", ws.handleHealthz)
+	ws.sm.HandleFunc("/readyz", ws.handleReadyz)
+	ws.sm.HandleFunc("/statusz", ws.handleStatusz)
+	if !server.cfg.HTTP.ProbesOnly {
+		ws.registerSite()
+	}
+
+	var h http.Handler = ws
+	if server.acme != nil {
+		h = server.acme.httpHandler(h)
+	}
+	ws.srv = &http.Server{
+		Handler: h,
+		// Requests are cancelled as the server stops, so that event
+		// streams end rather than holding up Shutdown.
+		BaseContext: func(net.Listener) context.Context { return server.ctx },
+	}
+
+	if (server.cfg.HTTP.TLSCert == "") != (server.cfg.HTTP.TLSKey == "") {
+		return nil, configError("HTTPTLSCert and HTTPTLSKey must be set together")
+	}
+	if server.cfg.HTTP.TLSCert != "" {
+		certs, err := newCertReloader(server.cfg.cpath(server.cfg.HTTP.TLSCert), server.cfg.cpath(server.cfg.HTTP.TLSKey), server.clock)
+		if err != nil {
+			return nil, configError("Couldn't load HTTPTLSCert and HTTPTLSKey: %v", err)
+		}
+		ws.certs = certs
+		ws.srv.TLSConfig = &tls.Config{
+			MinVersion:     tls.VersionTLS12,
+			GetCertificate: certs.getCertificate,
+		}
+	}
 
-	s := http.Server{
-		Addr:    listenAddr,
-		Handler: ws,
+	network, addr := webListenAddr(server.cfg.HTTP.ListenAddr)
+	if network == "unix" {
+		removeStaleSocket(addr)
+	}
+	l, err := net.Listen(network, addr)
+	if err != nil {
+		return nil, wrapError(ErrBindFailed, err)
+	}
+	ws.l = l
+	server.shutdown.register(shutdownIntake, "webserver", ws.stop)
+	return ws, nil
+}
+
+// Serves requests on the webserver's listener, over TLS if HTTPTLSCert is
+// set, until it's stopped.
+func (ws *webServer) start() {
+	if ws.certs != nil && ws.s.cfg.TLSCertReloadInterval > 0 {
+		go ws.certs.run(time.Duration(ws.s.cfg.TLSCertReloadInterval) * time.Second)
 	}
 
 	go func() {
-		err := s.ListenAndServe()
-		log.Errore(err, "HTTP server")
+		var err error
+		if ws.certs != nil {
+			err = ws.srv.ServeTLS(ws.l, "", "")
+		} else {
+			err = ws.srv.Serve(ws.l)
+		}
+		if err != http.ErrServerClosed {
+			log.Errore(err, "HTTP server")
+		}
 	}()
+}
+
+// Stops the webserver once the requests in progress have been answered, or,
+// once ctx is done, by cutting the connections which stay busy.
+func (ws *webServer) stop(ctx context.Context) error {
+	if err := ws.srv.Shutdown(ctx); err != nil {
+		ws.srv.Close()
+	}
+	// Closed by Shutdown only if the server was started.
+	ws.close()
 	return nil
 }
+
+// Closes the webserver's listener, e.g. when New fails after creating it.
+func (ws *webServer) close() {
+	ws.l.Close()
+}
+
+func (ws *webServer) addr() net.Addr {
+	return ws.l.Addr()
+}
+
+// Removes the Unix socket at path if it's left over from an ncdns which
+// didn't stop cleanly, as it would stop the socket being created again, but
+// not if something is still listening on it.
+func removeStaleSocket(path string) {
+	fi, err := os.Lstat(path)
+	if err != nil || fi.Mode()&os.ModeSocket == 0 {
+		return
+	}
+	if c, err := net.Dial("unix", path); err == nil {
+		c.Close()
+		return
+	}
+	log.Warne(os.Remove(path), "couldn't remove the stale socket ", path)
+}
+
+// Registers the handlers of everything but the probes: the site and the API.
+func (ws *webServer) registerSite() {
+	ws.sm.HandleFunc("/", ws.handleRoot)
+	ws.sm.HandleFunc("/lookup", ws.handleLookup)
+	ws.sm.HandleFunc("/status", ws.handleStatus)
+	ws.sm.HandleFunc("/metrics", ws.handleMetrics)
+	ws.sm.HandleFunc("/api/v1/drain", ws.handleDrain)
+	ws.sm.HandleFunc("/api/v1/config/cache", ws.handleCacheParams)
+	ws.sm.HandleFunc("/api/v1/lookup", ws.handleAPILookup)
+	ws.sm.HandleFunc("/api/v1/lookup/", ws.handleAPIResolve)
+	ws.sm.HandleFunc("/api/v1/trace/", ws.handleTrace)
+	ws.sm.HandleFunc("/api/v1/cert/", ws.handleCert)
+	ws.sm.HandleFunc("/api/v1/value-schema", ws.handleValueSchema)
+	ws.sm.HandleFunc("/api/v1/zone-status", ws.handleZoneStatus)
+	ws.sm.HandleFunc("/api/v1/capabilities", ws.handleCapabilities)
+	ws.sm.HandleFunc("/api/v1/setup", ws.handleTrustSetup)
+	ws.sm.HandleFunc("/api/v1/setup/confirm", ws.handleConfirmTrustSetup)
+	ws.sm.HandleFunc("/ds", ws.handleDS)
+	if ws.s.clientStats != nil {
+		ws.sm.HandleFunc("/api/v1/clients", ws.handleClients)
+	}
+	if ws.s.cfg.HTTP.ZoneDump {
+		ws.sm.HandleFunc("/api/v1/zone", ws.handleZoneDump)
+	}
+	if ws.s.events != nil {
+		ws.sm.HandleFunc("/api/v1/events", ws.handleEvents)
+	}
+}
+
+func init() {
+	registerOptional("webserver", func(s *Server) bool {
+		return s.cfg.HTTP.ListenAddr != ""
+	})
+	registerOptional("http_events", func(s *Server) bool {
+		return s.cfg.HTTP.ListenAddr != "" && s.cfg.HTTP.Events
+	})
+	registerOptional("zone_dump", func(s *Server) bool {
+		return s.cfg.HTTP.ListenAddr != "" && s.cfg.HTTP.ZoneDump
+	})
+}
@@ -0,0 +1,48 @@
+//go:build no_webserver
+// +build no_webserver
+
+package server
+
+import (
+	"errors"
+	"html/template"
+	"net"
+)
+
+var errNoWebserver = errors.New("this build of ncdns leaves out the webserver; rebuild it without the no_webserver tag to set HTTPListenAddr")
+
+// Never set up in a build without the webserver; s.web is always nil.
+type webServer struct{}
+
+func newWebServer(server *Server) (*webServer, error) {
+	return nil, errNoWebserver
+}
+
+func (ws *webServer) start() {
+}
+
+func (ws *webServer) close() {
+}
+
+func (ws *webServer) addr() net.Addr {
+	return nil
+}
+
+func (s *Server) loadTemplates() (layout, mainPage, lookupPage, unregisteredPage *template.Template, err error) {
+	return nil, nil, nil, nil, errNoWebserver
+}
+
+// Refuses a configuration which enables the webserver, before anything is set
+// up for it.
+func (s *Server) setupAPILookupLimit() error {
+	if s.cfg.HTTP.ListenAddr != "" {
+		return configError("%v", errNoWebserver)
+	}
+	return nil
+}
+
+func init() {
+	registerExcluded("webserver")
+	registerExcluded("http_events")
+	registerExcluded("zone_dump")
+}
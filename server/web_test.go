@@ -0,0 +1,437 @@
+//go:build !no_webserver
+// +build !no_webserver
+
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"gopkg.in/hlandau/madns.v2/merr"
+
+	"github.com/namecoin/ncdns/backend"
+	"github.com/namecoin/ncdns/namecoin"
+	"github.com/namecoin/ncdns/ncdomain"
+)
+
+func TestValueSchemaEndpoint(t *testing.T) {
+	ws := &webServer{s: &Server{}}
+
+	rw := httptest.NewRecorder()
+	ws.handleValueSchema(rw, httptest.NewRequest("GET", "/api/v1/value-schema", nil))
+
+	if ct := rw.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("got Content-Type %q", ct)
+	}
+
+	var schema ncdomain.Schema
+	if err := json.Unmarshal(rw.Body.Bytes(), &schema); err != nil {
+		t.Fatalf("couldn't decode schema: %v", err)
+	}
+
+	if schema.ParserVersion != ncdomain.ParserVersion || len(schema.Fields) != len(ncdomain.ValueSchema().Fields) {
+		t.Errorf("served schema doesn't match the parser: %+v", schema)
+	}
+}
+
+func TestAPILookupProvenance(t *testing.T) {
+	names := map[string]string{
+		"d/example": `{"import":"dd/mail","ip":["192.0.2.1"]}`,
+		"dd/mail":   `{"map":{"mail":{"ip":["192.0.2.25"]}}}`,
+	}
+	ws := &webServer{
+		s: &Server{httpBreaker: newCircuitBreaker(0, 0, nil)},
+		nameQuery: func(ctx context.Context, name, streamIsolationID string) (string, error) {
+			switch name {
+			case "d/down":
+				return "", errors.New("connection refused")
+			case "d/busy":
+				return "", fmt.Errorf("fetching: %w", backend.ErrLookupsSaturated)
+			}
+			v, ok := names[name]
+			if !ok {
+				return "", merr.ErrNoSuchDomain
+			}
+			return v, nil
+		},
+	}
+
+	rw := httptest.NewRecorder()
+	ws.handleAPILookup(rw, httptest.NewRequest("GET", "/api/v1/lookup?q=example.bit", nil))
+	if rw.Code != http.StatusOK {
+		t.Fatalf("got status %d", rw.Code)
+	}
+
+	var res apiLookupResult
+	if err := json.Unmarshal(rw.Body.Bytes(), &res); err != nil {
+		t.Fatalf("couldn't decode result: %v", err)
+	}
+
+	expected := map[string]ncdomain.Provenance{
+		"example.bit.\t600\tIN\tA\t192.0.2.1":       {Source: "d/example", Path: "ip[0]"},
+		"mail.example.bit.\t600\tIN\tA\t192.0.2.25": {Source: "dd/mail", Path: "map.mail.ip[0]"},
+	}
+	if len(res.Records) != len(expected) || !res.Valid {
+		t.Fatalf("unexpected result: %+v", res)
+	}
+	for _, r := range res.Records {
+		if p, ok := expected[r.RR]; !ok || p != r.Provenance || r.Type != "A" {
+			t.Errorf("unexpected record %+v", r)
+		}
+	}
+
+	for q, status := range map[string]int{
+		"missing.bit": http.StatusNotFound,
+		"-bad-.bit":   http.StatusBadRequest,
+		"down.bit":    http.StatusBadGateway,
+		"busy.bit":    http.StatusServiceUnavailable,
+	} {
+		rw := httptest.NewRecorder()
+		ws.handleAPILookup(rw, httptest.NewRequest("GET", "/api/v1/lookup?q="+q, nil))
+		if rw.Code != status {
+			t.Errorf("%s: got status %d, expected %d", q, rw.Code, status)
+		}
+	}
+}
+
+// The built-in templates are used unless TplPath is set.
+func TestBuiltinTemplates(t *testing.T) {
+	defer func(fs http.FileSystem) { BuiltinTemplates = fs }(BuiltinTemplates)
+	BuiltinTemplates = http.Dir("../_tpl")
+
+	s := &Server{cfg: Config{TplSet: "std", ConfigDir: "/nonexistent"}}
+	text, err := s.readTemplate("layout")
+	if err != nil || !strings.Contains(text, "<!DOCTYPE html>") {
+		t.Errorf("built-in layout: got %q, %v", text, err)
+	}
+
+	s.cfg.TplPath = "/nonexistent"
+	if _, err := s.readTemplate("layout"); err == nil {
+		t.Errorf("TplPath not used")
+	}
+}
+
+func TestHTTPBindFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ncdns-errors")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+
+	cfg := newErrorTestConfig(dir)
+	cfg.HTTP.ListenAddr = busy.Addr().String()
+	cfg.TplPath = filepath.Join("..", "_tpl")
+	cfg.TplSet = "std"
+
+	if _, err := New(cfg); !errors.Is(err, ErrBindFailed) {
+		t.Errorf("expected ErrBindFailed, got %v", err)
+	}
+}
+
+// Returns a configuration for a server with a webserver listening at
+// listenAddr.
+func newWebTestConfig(dir, listenAddr string) *Config {
+	cfg := newErrorTestConfig(dir)
+	cfg.HTTP.ListenAddr = listenAddr
+	cfg.TplPath = filepath.Join("..", "_tpl")
+	cfg.TplSet = "std"
+	cfg.StopTimeout = 5
+	return cfg
+}
+
+// Gets /healthz from a server with client, returning the status.
+func getHealthz(t *testing.T, client *http.Client, url string) int {
+	res, err := client.Get(url + "/healthz")
+	if err != nil {
+		t.Fatalf("webserver: %v", err)
+	}
+	res.Body.Close()
+	return res.StatusCode
+}
+
+func TestWebServerTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ncdns-web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cert := writeTestCert(t, dir, 1)
+
+	cfg := newWebTestConfig(dir, "127.0.0.1:0")
+	cfg.HTTP.TLSCert, cfg.HTTP.TLSKey = "dot.crt", "dot.key"
+	s, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}}
+	if status := getHealthz(t, client, "https://"+s.HTTPAddr().String()); status != http.StatusOK {
+		t.Errorf("got status %d", status)
+	}
+
+	if err := s.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if l, err := net.Listen("tcp", s.HTTPAddr().String()); err != nil {
+		t.Errorf("TCP socket not released: %v", err)
+	} else {
+		l.Close()
+	}
+}
+
+func TestWebServerUnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ncdns-web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "ncdns.sock")
+
+	// A socket left over from a server which didn't stop cleanly is
+	// replaced.
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	s, err := New(newWebTestConfig(dir, "unix:"+path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if s.HTTPAddr().String() != path {
+		t.Errorf("got address %v", s.HTTPAddr())
+	}
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", path)
+		},
+	}}
+	if status := getHealthz(t, client, "http://ncdns"); status != http.StatusOK {
+		t.Errorf("got status %d", status)
+	}
+
+	// Its clients are on this host, so are trusted as loopback clients are,
+	// although they have no address.
+	res, err := client.Get("http://ncdns/api/v1/config/cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("cache options: got status %d", res.StatusCode)
+	}
+
+	// One which is in use isn't.
+	if _, err := New(newWebTestConfig(dir, "unix:"+path)); !errors.Is(err, ErrBindFailed) {
+		t.Errorf("expected ErrBindFailed, got %v", err)
+	}
+
+	if err := s.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("socket not removed: %v", err)
+	}
+}
+
+// Problems with the webserver's configuration are reported by New, before
+// it serves anything.
+func TestWebServerConfigErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ncdns-web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeTestCert(t, dir, 1)
+	if err := os.MkdirAll(filepath.Join(dir, "tpl", "broken"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, "tpl", "broken", "layout.tpl"), []byte("{{.Unclosed"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name string
+		set  func(cfg *Config)
+	}{
+		{"template", func(cfg *Config) { cfg.TplPath, cfg.TplSet = filepath.Join(dir, "tpl"), "broken" }},
+		{"certificate without key", func(cfg *Config) { cfg.HTTP.TLSCert = "dot.crt" }},
+		{"missing certificate", func(cfg *Config) { cfg.HTTP.TLSCert, cfg.HTTP.TLSKey = "missing.crt", "dot.key" }},
+	} {
+		cfg := newWebTestConfig(dir, "127.0.0.1:0")
+		test.set(cfg)
+		if _, err := New(cfg); !errors.Is(err, ErrConfigInvalid) {
+			t.Errorf("%s: expected ErrConfigInvalid, got %v", test.name, err)
+		}
+	}
+}
+
+func TestDescribeExpiry(t *testing.T) {
+	ws := &webServer{s: &Server{cfg: Config{ServeExpiredNamesFor: 100}}}
+
+	for _, c := range []struct {
+		nameData *namecoin.NameData
+		expected string
+	}{
+		{&namecoin.NameData{ExpiresIn: 30000}, "expires in 30000 blocks"},
+		{&namecoin.NameData{ExpiresIn: 3}, "expires in 3 blocks"},
+		{&namecoin.NameData{}, ""},
+		{&namecoin.NameData{ExpiresIn: -40, Expired: true}, "expired 40 blocks ago; still served over DNS for 60 more blocks"},
+		{&namecoin.NameData{ExpiresIn: -100, Expired: true}, "expired 100 blocks ago; not served over DNS"},
+	} {
+		if s := ws.describeExpiry(c.nameData); s != c.expected {
+			t.Errorf("%+v: got %q, expected %q", c.nameData, s, c.expected)
+		}
+	}
+}
+
+// The web pages show the port chosen for the DNS listeners and the network.
+func TestLayoutInfo(t *testing.T) {
+	s := &Server{cfg: Config{BindAddresses: ":0"}, network: namecoin.Regtest}
+	if err := s.listen(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.closeListeners()
+
+	ws := &webServer{s: s}
+	li := ws.layoutInfo()
+	if li.DNSPort != s.DNSPort() || li.DNSPort == 0 {
+		t.Errorf("main page shows port %d, expected %d", li.DNSPort, s.DNSPort())
+	}
+	if li.Network != "regtest" || !li.TestNetwork {
+		t.Errorf("web pages show network %s (test: %v)", li.Network, li.TestNetwork)
+	}
+}
+
+// A fake namecoind which counts the name_show calls made to it, answering
+// them only once release is closed.
+type slowNameRPC struct {
+	calls   int64 // accessed atomically
+	release chan struct{}
+}
+
+func (f *slowNameRPC) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	var call struct {
+		Method string            `json:"method"`
+		Params []json.RawMessage `json:"params"`
+		ID     interface{}       `json:"id"`
+	}
+	json.NewDecoder(req.Body).Decode(&call)
+
+	res := map[string]interface{}{"id": call.ID, "error": nil}
+	if call.Method == "name_show" {
+		atomic.AddInt64(&f.calls, 1)
+		<-f.release
+		res["result"] = map[string]interface{}{"name": "d/viral", "value": `{"ip":"192.0.2.1"}`, "expires_in": 30000}
+	} else {
+		res["error"] = map[string]interface{}{"code": -32601, "message": "Method not found"}
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(res)
+}
+
+// Lookups from the webserver share the backend's fetch of a name with DNS
+// queries for it, and each other, so that a burst of both for a name which
+// isn't cached makes a single name_show call.
+func TestWebLookupsShareFetches(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ncdns-web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	rpc := &slowNameRPC{release: make(chan struct{})}
+	rpcSrv := httptest.NewServer(rpc)
+	defer rpcSrv.Close()
+
+	cfg := newWebTestConfig(dir, "127.0.0.1:0")
+	cfg.RPC.Endpoints = strings.TrimPrefix(rpcSrv.URL, "http://")
+	cfg.RPC.Username = "user"
+	cfg.RPC.Password = "pass"
+	cfg.RPC.Timeout = 10000
+	s, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.stop()
+
+	const n = 50
+	errs := make(chan error, 2*n)
+	for i := 0; i < n; i++ {
+		url := "/lookup?q=viral.bit"
+		if i%2 == 1 {
+			url = "/api/v1/lookup?q=viral.bit"
+		}
+		go func() {
+			rw := httptest.NewRecorder()
+			s.web.ServeHTTP(rw, httptest.NewRequest("GET", url, nil))
+			if rw.Code != http.StatusOK || !strings.Contains(rw.Body.String(), "192.0.2.1") {
+				errs <- fmt.Errorf("%s: got status %d: %s", url, rw.Code, rw.Body.String())
+				return
+			}
+			errs <- nil
+		}()
+		go func() {
+			req := new(dns.Msg)
+			req.SetQuestion("viral.bit.", dns.TypeA)
+			res, err := s.Query(context.Background(), req, nil)
+			if err == nil && (res.Rcode != dns.RcodeSuccess || len(res.Answer) == 0) {
+				err = fmt.Errorf("DNS query answered %v", res)
+			}
+			errs <- err
+		}()
+	}
+
+	// The fetch is only answered once every other lookup is waiting for it.
+	for deadline := time.Now().Add(10 * time.Second); s.currentBackend().LookupStats().Coalesced < 2*n-1; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d lookups waiting for the fetch, expected %d", s.currentBackend().LookupStats().Coalesced, 2*n-1)
+		}
+	}
+	close(rpc.release)
+
+	for i := 0; i < 2*n; i++ {
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+	if calls := atomic.LoadInt64(&rpc.calls); calls != 1 {
+		t.Errorf("got %d name_show calls, expected 1", calls)
+	}
+}
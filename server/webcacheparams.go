@@ -0,0 +1,49 @@
+//go:build !no_webserver
+// +build !no_webserver
+
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+)
+
+// Shows the cache options in effect on GET, and changes them on PATCH, whose
+// JSON body gives the options to change. Only accepted from a loopback
+// address, like a drain, since a change affects every client of the server.
+func (ws *webServer) handleCacheParams(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" && req.Method != "PATCH" {
+		rw.Header().Set("Allow", "GET, PATCH")
+		writeJSON(rw, http.StatusMethodNotAllowed, &apiError{Error: "the cache options must be changed with PATCH"})
+		return
+	}
+
+	if !isLoopbackRequest(req) {
+		writeJSON(rw, http.StatusForbidden, &apiError{Error: "the cache options may only be managed from a loopback address"})
+		return
+	}
+
+	if req.Method == "GET" {
+		writeJSON(rw, http.StatusOK, ws.s.currentConfig().cacheParams())
+		return
+	}
+
+	var ch cacheParamsChange
+	dec := json.NewDecoder(req.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&ch); err != nil {
+		writeJSON(rw, http.StatusBadRequest, &apiError{Error: "invalid request body: " + err.Error()})
+		return
+	}
+
+	info, err := ws.s.setCacheParams(&ch, req.RemoteAddr)
+	switch {
+	case errors.Is(err, ErrConfigInvalid):
+		writeJSON(rw, http.StatusBadRequest, &apiError{Error: err.Error()})
+	case err != nil:
+		writeJSON(rw, http.StatusConflict, &apiError{Error: err.Error()})
+	default:
+		writeJSON(rw, http.StatusOK, info)
+	}
+}
@@ -0,0 +1,74 @@
+//go:build !no_webserver
+// +build !no_webserver
+
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/namecoin/ncdns/backend"
+)
+
+func TestCacheParamsHTTP(t *testing.T) {
+	s := newDrainTestServer(t)
+	s.cfg.Cache.MaxEntries = 100
+	s.cfg.Cache.NegativeMaxEntries = 1000
+	s.cfg.Cache.NegativeTTL = 300
+	ws := &webServer{s: s}
+
+	request := func(method, remoteAddr, body string) (int, string) {
+		req := httptest.NewRequest(method, "/api/v1/config/cache", strings.NewReader(body))
+		req.RemoteAddr = remoteAddr
+		rw := httptest.NewRecorder()
+		ws.handleCacheParams(rw, req)
+		return rw.Code, rw.Body.String()
+	}
+
+	if code, _ := request("POST", "127.0.0.1:1234", "{}"); code != http.StatusMethodNotAllowed {
+		t.Errorf("POST returned %d", code)
+	}
+	if code, _ := request("PATCH", "192.0.2.1:1234", `{"cache_max_entries":10}`); code != http.StatusForbidden {
+		t.Errorf("request from a non-loopback address returned %d", code)
+	}
+	if code, _ := request("PATCH", "127.0.0.1:1234", `{"cache_max_entry":10}`); code != http.StatusBadRequest {
+		t.Errorf("unknown option returned %d", code)
+	}
+
+	// Every invalid value is reported, and nothing is changed.
+	code, body := request("PATCH", "127.0.0.1:1234", `{"cache_max_entries":10,"cache_max_bytes":-1,"negative_cache_ttl":-1}`)
+	if code != http.StatusBadRequest || !strings.Contains(body, "CacheMaxBytes") || !strings.Contains(body, "NegativeCacheTTL") {
+		t.Errorf("invalid values returned %d: %s", code, body)
+	}
+	if s.currentConfig().Cache.MaxEntries != 100 || s.currentBackend().CacheParams().MaxEntries != 100 {
+		t.Errorf("cache options changed despite invalid values")
+	}
+
+	code, body = request("PATCH", "[::1]:1234", `{"cache_max_entries":10,"negative_cache_ttl":60}`)
+	var info cacheParamsInfo
+	if code != http.StatusOK || json.Unmarshal([]byte(body), &info) != nil {
+		t.Fatalf("change returned %d: %s", code, body)
+	}
+	expected := cacheParamsInfo{CacheMaxEntries: 10, NegativeCacheMaxEntries: 1000, NegativeCacheTTL: 60}
+	if info != expected {
+		t.Errorf("got %+v, expected %+v", info, expected)
+	}
+	bp := backend.CacheParams{MaxEntries: 10, NegativeMaxEntries: 1000, NegativeTTL: time.Minute}
+	if got := s.currentBackend().CacheParams(); got != bp {
+		t.Errorf("backend has %+v, expected %+v", got, bp)
+	}
+	if code, body := request("GET", "127.0.0.1:1234", ""); code != http.StatusOK || !strings.Contains(body, `"cache_max_entries":10`) {
+		t.Errorf("GET returned %d: %s", code, body)
+	}
+
+	// Not while a reload is in progress, which would build its backend with
+	// the options it started with.
+	s.lifecycle.transition("reload", stateReloading, nil)
+	if code, _ := request("PATCH", "127.0.0.1:1234", `{"cache_max_entries":20}`); code != http.StatusConflict {
+		t.Errorf("change during a reload returned %d", code)
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !no_webserver
+// +build !no_webserver
+
+package server
+
+import "net/http"
+
+// Describes the features of the server, so that tools can tell what it
+// supports without probing for each: a map of each feature's name to
+// "enabled", "disabled", "excluded" (left out of this build) or its version.
+func (ws *webServer) handleCapabilities(rw http.ResponseWriter, req *http.Request) {
+	writeJSON(rw, http.StatusOK, ws.s.capabilities())
+}
@@ -0,0 +1,31 @@
+//go:build !no_webserver
+// +build !no_webserver
+
+package server
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestCapabilitiesEndpoint(t *testing.T) {
+	s := &Server{}
+	s.cfg.HTTP.ListenAddr = "127.0.0.1:8202"
+	s.cfg.HTTP.Events = true
+	ws := &webServer{s: s}
+
+	rec := httptest.NewRecorder()
+	ws.handleCapabilities(rec, httptest.NewRequest("GET", "/api/v1/capabilities", nil))
+	var caps map[string]string
+	if err := json.Unmarshal(rec.Body.Bytes(), &caps); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(caps, s.capabilities()) {
+		t.Errorf("got %v, expected %v", caps, s.capabilities())
+	}
+	if caps["webserver"] != capabilityEnabled || caps["http_events"] != capabilityEnabled || caps["zone_dump"] != capabilityDisabled {
+		t.Errorf("got %v, expected the webserver and events enabled", caps)
+	}
+}
@@ -0,0 +1,10 @@
+//go:build no_namecoin_tls && !no_webserver
+// +build no_namecoin_tls,!no_webserver
+
+package server
+
+import "net/http"
+
+func (ws *webServer) handleCert(rw http.ResponseWriter, req *http.Request) {
+	writeJSON(rw, http.StatusNotFound, &apiError{Error: "this build of ncdns doesn't support TLS certificates"})
+}
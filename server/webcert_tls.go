@@ -0,0 +1,77 @@
+//go:build !no_namecoin_tls && !no_webserver
+// +build !no_namecoin_tls,!no_webserver
+
+package server
+
+import (
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/namecoin/ncdns/certdehydrate"
+)
+
+// Serves the certificates reconstructed from the dehydrated certificates a
+// name publishes, in PEM form, e.g. /api/v1/cert/www.example.bit. These are
+// the certificates whose TLSA records are served over DNS. The port defaults
+// to 443 and may be given with ?port=.
+func (ws *webServer) handleCert(rw http.ResponseWriter, req *http.Request) {
+	host := strings.TrimSuffix(strings.ToLower(strings.TrimPrefix(req.URL.Path, "/api/v1/cert/")), ".")
+	ncname, subPath, ok := ws.splitHost(host)
+	if !ok {
+		writeJSON(rw, http.StatusBadRequest, &apiError{Error: fmt.Sprintf("not a name under %s", ws.s.cfg.CanonicalSuffix)})
+		return
+	}
+
+	port := req.FormValue("port")
+	if port == "" {
+		port = "443"
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		writeJSON(rw, http.StatusBadRequest, &apiError{Error: "invalid port"})
+		return
+	}
+
+	v, err := ws.subdomainValue(req.Context(), ncname, subPath)
+	if retryAfter, refused := breakerRetryAfter(err); refused {
+		rw.Header().Set("Retry-After", strconv.Itoa(retryAfterSeconds(retryAfter)))
+		writeJSON(rw, http.StatusServiceUnavailable, &apiError{Error: err.Error()})
+		return
+	}
+	if err != nil {
+		writeJSON(rw, http.StatusNotFound, &apiError{Error: err.Error()})
+		return
+	}
+
+	if proto, ok := v.Map["_tcp"]; ok {
+		v = proto.Map["_"+port]
+	} else {
+		v = nil
+	}
+	if v == nil || len(v.TLSAGenerated) == 0 {
+		writeJSON(rw, http.StatusNotFound, &apiError{Error: "no dehydrated certificates are published for " + host + " on port " + port})
+		return
+	}
+
+	var out []byte
+	for _, template := range v.TLSAGenerated {
+		derBytes, err := certdehydrate.FillRehydratedCertTemplate(template, host)
+		if err != nil {
+			log.Infoe(err, "couldn't reconstruct dehydrated certificate for ", host)
+			continue
+		}
+
+		out = append(out, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: derBytes})...)
+	}
+
+	if len(out) == 0 {
+		writeJSON(rw, http.StatusNotFound, &apiError{Error: "none of the dehydrated certificates published for " + host + " could be reconstructed"})
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/x-pem-file")
+	_, err = rw.Write(out)
+	log.Infoe(err, "cert response")
+}
@@ -0,0 +1,62 @@
+//go:build !no_namecoin_tls && !no_webserver
+// +build !no_namecoin_tls,!no_webserver
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"gopkg.in/hlandau/madns.v2/merr"
+)
+
+func TestCertEndpoint(t *testing.T) {
+	expected, err := ioutil.ReadFile("../certdehydrate/testdata/www.veclabs.bit.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names := map[string]string{
+		"d/veclabs": `{"map":{"www":{"map":{"_tcp":{"map":{"_443":{"tls":[{"d8":[1,"MFkwEwYHKoZIzj0CAQYIKoZIzj0DAQcDQgAEGm0zZlzrnwEYvub3BG3+VTKjvXWdMntoTanw3cwGAqcb0ALFrt5MdChT9t4josaefnGdVHa+ZBNmSEIaNZNhnw==",4944096,5154336,10,"MEUCIQCEkb4Q+AV8FsQgRoWSZ3S+1Ww/SySl4238SjTv5d/WAgIgX2rAhfCQ3gGG1Abhme8mDTG641vIYHJuz8d6m7IrgJo="]}]}}}}}}}`,
+	}
+	ws := &webServer{
+		s: &Server{
+			cfg:         Config{CanonicalSuffix: "bit"},
+			httpBreaker: newCircuitBreaker(0, 0, nil),
+		},
+		nameQuery: func(ctx context.Context, name, streamIsolationID string) (string, error) {
+			v, ok := names[name]
+			if !ok {
+				return "", merr.ErrNoSuchDomain
+			}
+			return v, nil
+		},
+	}
+
+	rw := httptest.NewRecorder()
+	ws.handleCert(rw, httptest.NewRequest("GET", "/api/v1/cert/www.veclabs.bit", nil))
+	if rw.Code != http.StatusOK || rw.Header().Get("Content-Type") != "application/x-pem-file" {
+		t.Fatalf("got status %d: %s", rw.Code, rw.Body.String())
+	}
+	if !bytes.Equal(rw.Body.Bytes(), expected) {
+		t.Errorf("served certificate differs from the known-good certificate:\n%s", rw.Body.String())
+	}
+
+	for path, status := range map[string]int{
+		"/api/v1/cert/www.veclabs.bit?port=8443": http.StatusNotFound,
+		"/api/v1/cert/veclabs.bit":               http.StatusNotFound,
+		"/api/v1/cert/www.missing.bit":           http.StatusNotFound,
+		"/api/v1/cert/www.veclabs.bit?port=x":    http.StatusBadRequest,
+		"/api/v1/cert/example.com":               http.StatusBadRequest,
+	} {
+		rw := httptest.NewRecorder()
+		ws.handleCert(rw, httptest.NewRequest("GET", path, nil))
+		if rw.Code != status {
+			t.Errorf("%s: got status %d, expected %d", path, rw.Code, status)
+		}
+	}
+}
@@ -0,0 +1,31 @@
+//go:build !no_webserver
+// +build !no_webserver
+
+package server
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// Lists the client prefixes sending the most queries, and those banned for
+// exceeding AbuseThresholdQPS. Since this identifies clients, it may only be
+// requested from a loopback address.
+func (ws *webServer) handleClients(rw http.ResponseWriter, req *http.Request) {
+	if !isLoopbackRequest(req) {
+		writeJSON(rw, http.StatusForbidden, &apiError{Error: "client statistics may only be requested from a loopback address"})
+		return
+	}
+
+	limit := clientStatsDefaultLimit
+	if v := req.FormValue("limit"); v != "" {
+		var err error
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit < 0 {
+			writeJSON(rw, http.StatusBadRequest, &apiError{Error: "limit must be a non-negative integer"})
+			return
+		}
+	}
+
+	writeJSON(rw, http.StatusOK, ws.s.clientStats.Status(limit))
+}
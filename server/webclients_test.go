@@ -0,0 +1,30 @@
+//go:build !no_webserver
+// +build !no_webserver
+
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Only the local machine may list clients.
+func TestHandleClients(t *testing.T) {
+	ws := &webServer{s: &Server{clientStats: newClientStats(10, time.Second, 1, time.Minute, nil)}}
+	req := httptest.NewRequest("GET", "/api/v1/clients", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	rec := httptest.NewRecorder()
+	ws.handleClients(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("remote client got status %d", rec.Code)
+	}
+
+	req.RemoteAddr = "127.0.0.1:1234"
+	rec = httptest.NewRecorder()
+	ws.handleClients(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Errorf("local client got status %d: %s", rec.Code, rec.Body)
+	}
+}
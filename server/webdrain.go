@@ -0,0 +1,81 @@
+//go:build !no_webserver
+// +build !no_webserver
+
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"time"
+)
+
+// Exits the process once a drain triggered over HTTP has stopped the server.
+// Replaced in tests.
+var drainExit = func() {
+	os.Exit(0)
+}
+
+// The body of a drain request, which may be empty.
+type drainRequest struct {
+	Seconds *int `json:"seconds"` // DrainDuration if not given
+}
+
+type drainInfo struct {
+	Draining bool `json:"draining"`
+	Seconds  int  `json:"seconds"`
+}
+
+// Starts draining the server, after which the process exits. The drain
+// window defaults to DrainDuration and can be overridden with "seconds" in the
+// JSON body. Only accepted as a POST with a JSON body from a loopback address,
+// since anybody able to make this request can take the server down, and while
+// the server is running or already draining.
+func (ws *webServer) handleDrain(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		rw.Header().Set("Allow", "POST")
+		writeJSON(rw, http.StatusMethodNotAllowed, &apiError{Error: "drain must be requested with POST"})
+		return
+	}
+
+	if !isLoopbackRequest(req) {
+		writeJSON(rw, http.StatusForbidden, &apiError{Error: "drain may only be requested from a loopback address"})
+		return
+	}
+	if !isJSONRequest(req) {
+		writeJSON(rw, http.StatusUnsupportedMediaType, &apiError{Error: "drain must be requested with a JSON body"})
+		return
+	}
+
+	var dr drainRequest
+	dec := json.NewDecoder(req.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&dr); err != nil && err != io.EOF {
+		writeJSON(rw, http.StatusBadRequest, &apiError{Error: "invalid request body: " + err.Error()})
+		return
+	}
+	secs := ws.s.cfg.DrainDuration
+	if dr.Seconds != nil {
+		if *dr.Seconds < 0 {
+			writeJSON(rw, http.StatusBadRequest, &apiError{Error: "seconds must be a non-negative integer"})
+			return
+		}
+		secs = *dr.Seconds
+	}
+
+	started, err := ws.s.beginDrain()
+	if err != nil {
+		writeJSON(rw, http.StatusConflict, &apiError{Error: err.Error()})
+		return
+	}
+	if started {
+		go func() {
+			err := ws.s.drain(time.Duration(secs) * time.Second)
+			log.Errore(err, "couldn't stop after draining")
+			drainExit()
+		}()
+	}
+
+	writeJSON(rw, http.StatusAccepted, &drainInfo{Draining: true, Seconds: secs})
+}
@@ -0,0 +1,210 @@
+//go:build !no_webserver
+// +build !no_webserver
+
+package server
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/namecoin/ncdns/scheduler"
+)
+
+func healthStatus(ws *webServer, path string) int {
+	rw := httptest.NewRecorder()
+	ws.sm.ServeHTTP(rw, httptest.NewRequest("GET", path, nil))
+	return rw.Code
+}
+
+func TestDrain(t *testing.T) {
+	s := newDrainTestServer(t)
+	ws := &webServer{s: s, sm: http.NewServeMux()}
+	ws.sm.HandleFunc("/healthz", ws.handleHealthz)
+	ws.sm.HandleFunc("/readyz", ws.handleReadyz)
+	draining := func() bool {
+		rw := httptest.NewRecorder()
+		ws.handleMetrics(rw, httptest.NewRequest("GET", "/metrics", nil))
+		return strings.Contains(rw.Body.String(), "\nncdns_draining 1\n")
+	}
+
+	sec, done := newFakeSecondary(t, nil)
+	defer done()
+	targets, err := parseNotifyTargets(sec.addr, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.notifier = &notifier{
+		zone:    "bit.",
+		targets: targets,
+		soa: func() (*dns.SOA, error) {
+			return &dns.SOA{
+				Hdr:    dns.RR_Header{Name: "bit.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 600},
+				Ns:     "ns1.bit.",
+				Mbox:   "hostmaster.bit.",
+				Serial: 7,
+			}, nil
+		},
+		timeout:     time.Second,
+		maxAttempts: 1,
+		sched:       scheduler.New(&scheduler.Config{}),
+	}
+	s.notifier.start()
+	defer s.notifier.shutdown()
+
+	query := func() bool {
+		req := new(dns.Msg)
+		req.SetQuestion("example.bit.", dns.TypeA)
+		rw := &fakeResponseWriter{}
+		s.ServeDNS(rw, req)
+		return rw.msg != nil && rw.msg.Rcode == dns.RcodeSuccess && len(rw.msg.Answer) > 0
+	}
+
+	for _, path := range []string{"/healthz", "/readyz"} {
+		if code := healthStatus(ws, path); code != http.StatusOK {
+			t.Errorf("%s returned %d before draining", path, code)
+		}
+	}
+	if draining() {
+		t.Errorf("metrics flag draining before the drain")
+	}
+
+	// A query still being answered when the window ends holds up the stop.
+	atomic.AddInt64(&s.inflight, 1)
+	const window = 200 * time.Millisecond
+	start := time.Now()
+	drained := make(chan error, 1)
+	go func() {
+		drained <- s.Drain(window)
+	}()
+
+	for !s.isDraining() {
+		time.Sleep(time.Millisecond)
+	}
+
+	// Drains started meanwhile, such as one started by SIGTERM, just wait
+	// for the first.
+	joined := make(chan error, 1)
+	go func() {
+		joined <- s.Drain(time.Hour)
+	}()
+	for _, path := range []string{"/healthz", "/readyz"} {
+		if code := healthStatus(ws, path); code != http.StatusServiceUnavailable {
+			t.Errorf("%s returned %d while draining", path, code)
+		}
+	}
+	if !draining() {
+		t.Errorf("metrics don't flag draining")
+	}
+	// Secondaries are notified as the drain starts.
+	select {
+	case serial := <-sec.notifies:
+		if serial != 7 {
+			t.Errorf("secondary notified of serial %d", serial)
+		}
+	case <-time.After(window / 2):
+		t.Errorf("secondary not notified when the drain started")
+	}
+
+	for time.Since(start) < window/2 {
+		if !query() {
+			t.Fatalf("query failed during the drain window")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	time.Sleep(window)
+	select {
+	case <-drained:
+		t.Fatalf("drain finished while a query was in progress")
+	default:
+	}
+	atomic.AddInt64(&s.inflight, -1)
+
+	select {
+	case err := <-drained:
+		if err != nil {
+			t.Errorf("drain failed: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("drain didn't finish once queries were answered")
+	}
+
+	select {
+	case err := <-joined:
+		if err != nil {
+			t.Errorf("second drain failed: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("second drain didn't finish with the first")
+	}
+
+	// Once stopped, there's nothing left to drain, but stopping again is
+	// fine.
+	if err := s.Drain(time.Hour); !errors.Is(err, ErrInvalidState) {
+		t.Errorf("drain once stopped returned %v", err)
+	}
+	if err := s.Stop(); err != nil {
+		t.Errorf("stop after draining failed: %v", err)
+	}
+}
+
+func TestDrainHTTP(t *testing.T) {
+	exited := make(chan struct{})
+	oldExit := drainExit
+	drainExit = func() { close(exited) }
+	defer func() { drainExit = oldExit }()
+
+	s := newDrainTestServer(t)
+	s.cfg.DrainDuration = 3600
+	ws := &webServer{s: s}
+
+	drain := func(method, remoteAddr, contentType, body string) int {
+		req := httptest.NewRequest(method, "/api/v1/drain", strings.NewReader(body))
+		req.RemoteAddr = remoteAddr
+		req.Header.Set("Content-Type", contentType)
+		rw := httptest.NewRecorder()
+		ws.handleDrain(rw, req)
+		return rw.Code
+	}
+
+	if code := drain("GET", "127.0.0.1:1234", "application/json", ""); code != http.StatusMethodNotAllowed {
+		t.Errorf("GET returned %d", code)
+	}
+	if code := drain("POST", "192.0.2.1:1234", "application/json", ""); code != http.StatusForbidden {
+		t.Errorf("request from a non-loopback address returned %d", code)
+	}
+	// As a cross-site form would post it.
+	if code := drain("POST", "127.0.0.1:1234", "application/x-www-form-urlencoded", "seconds=0"); code != http.StatusUnsupportedMediaType {
+		t.Errorf("form request returned %d", code)
+	}
+	if code := drain("POST", "[::1]:1234", "application/json", `{"seconds":-1}`); code != http.StatusBadRequest {
+		t.Errorf("negative duration returned %d", code)
+	}
+	if code := drain("POST", "[::1]:1234", "application/json", `{"secs":1}`); code != http.StatusBadRequest {
+		t.Errorf("unknown field returned %d", code)
+	}
+	if s.isDraining() {
+		t.Fatalf("rejected requests started a drain")
+	}
+
+	if code := drain("POST", "127.0.0.1:1234", "application/json; charset=utf-8", `{"seconds":0}`); code != http.StatusAccepted {
+		t.Fatalf("drain request returned %d", code)
+	}
+
+	select {
+	case <-exited:
+	case <-time.After(time.Second):
+		t.Fatalf("process didn't exit after draining")
+	}
+
+	if code := drain("POST", "127.0.0.1:1234", "application/json", ""); code != http.StatusConflict {
+		t.Errorf("drain request once stopped returned %d", code)
+	}
+}
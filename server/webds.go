@@ -0,0 +1,52 @@
+//go:build !no_webserver
+// +build !no_webserver
+
+package server
+
+import (
+	"net/http"
+)
+
+type dsInfo struct {
+	Name       string `json:"name"`
+	KeyTag     uint16 `json:"key_tag"`
+	Algorithm  uint8  `json:"algorithm"`
+	DigestType uint8  `json:"digest_type"`
+	Digest     string `json:"digest"`
+	Record     string `json:"record"` // in zone file syntax
+}
+
+// Serves the DS records of the KSK, in zone file syntax, or as JSON with
+// ?format=json. Answered 404 if there's no KSK.
+func (ws *webServer) handleDS(rw http.ResponseWriter, req *http.Request) {
+	json := req.FormValue("format") == "json"
+	dss := ws.s.kskDS()
+	if dss == nil {
+		if json {
+			writeJSON(rw, http.StatusNotFound, &apiError{Error: "no KSK is configured"})
+		} else {
+			http.Error(rw, "no KSK is configured", http.StatusNotFound)
+		}
+		return
+	}
+
+	if !json {
+		rw.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		_, err := rw.Write(formatDS(dss))
+		log.Infoe(err, "DS records")
+		return
+	}
+
+	infos := []dsInfo{}
+	for _, ds := range dss {
+		infos = append(infos, dsInfo{
+			Name:       ds.Hdr.Name,
+			KeyTag:     ds.KeyTag,
+			Algorithm:  ds.Algorithm,
+			DigestType: ds.DigestType,
+			Digest:     ds.Digest,
+			Record:     ds.String(),
+		})
+	}
+	writeJSON(rw, http.StatusOK, infos)
+}
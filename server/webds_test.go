@@ -0,0 +1,78 @@
+//go:build !no_webserver
+// +build !no_webserver
+
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestExportDS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ncdns-ds")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := newReloadTestConfig(t, dir)
+	cfg.DNSSEC.DSRecordsFile = "ds-records.txt"
+	s, err := newServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ksk := s.globalKeys().KSK
+	var expected []string
+	for _, dt := range []uint8{dns.SHA256, dns.SHA384} {
+		expected = append(expected, ksk.ToDS(dt).String())
+	}
+
+	s.exportDS()
+	path := filepath.Join(dir, "ds-records.txt")
+	if lines := readLines(t, path); strings.Join(lines, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("wrote %q, expected %q", lines, expected)
+	}
+
+	ws := &webServer{s: s}
+	rw := httptest.NewRecorder()
+	ws.handleDS(rw, httptest.NewRequest("GET", "/ds", nil))
+	if rw.Code != http.StatusOK || rw.Body.String() != strings.Join(expected, "\n")+"\n" {
+		t.Errorf("/ds returned %d, %q", rw.Code, rw.Body.String())
+	}
+
+	rw = httptest.NewRecorder()
+	ws.handleDS(rw, httptest.NewRequest("GET", "/ds?format=json", nil))
+	var infos []dsInfo
+	if err := json.Unmarshal(rw.Body.Bytes(), &infos); err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 2 || infos[0].KeyTag != ksk.KeyTag() || infos[0].DigestType != dns.SHA256 ||
+		infos[1].DigestType != dns.SHA384 || infos[1].Record != expected[1] || infos[0].Name != ksk.Hdr.Name {
+		t.Errorf("/ds?format=json returned %+v", infos)
+	}
+
+	// Without a KSK, e.g. once a reload has removed it, nothing is served and
+	// the file is removed.
+	s.stateMu.Lock()
+	s.globalKeySet = &keySet{ZSK: s.globalKeySet.ZSK, ZSKPrivate: s.globalKeySet.ZSKPrivate}
+	s.stateMu.Unlock()
+	s.exportDS()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("DS records left in place without a KSK: %v", err)
+	}
+	for _, url := range []string{"/ds", "/ds?format=json"} {
+		rw = httptest.NewRecorder()
+		ws.handleDS(rw, httptest.NewRequest("GET", url, nil))
+		if rw.Code != http.StatusNotFound {
+			t.Errorf("%s returned %d without a KSK", url, rw.Code)
+		}
+	}
+}
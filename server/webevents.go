@@ -0,0 +1,93 @@
+//go:build !no_webserver
+// +build !no_webserver
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/namecoin/ncdns/clock"
+)
+
+// Interval at which a comment is sent to each events client when there are
+// no events, so that idle connections aren't closed by proxies.
+const eventKeepAliveInterval = 30 * time.Second
+
+// Parses the types parameter of /api/v1/events, e.g. "block,name".
+func parseEventTypes(s string) (map[string]bool, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	types := map[string]bool{}
+	for _, t := range strings.Split(s, ",") {
+		t = strings.TrimSpace(t)
+		known := false
+		for _, et := range eventTypes {
+			known = known || t == et
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown event type %q", t)
+		}
+		types[t] = true
+	}
+	return types, nil
+}
+
+// Streams events as server-sent events, each with the event's type as its
+// name and its JSON as its data, e.g.:
+//
+//	id: 7
+//	event: block
+//	data: {"type":"block","time":"...","height":500000,"hash":"..."}
+//
+// Clients may ask for only some types with ?types=block,name.
+func (ws *webServer) handleEvents(rw http.ResponseWriter, req *http.Request) {
+	types, err := parseEventTypes(req.FormValue("types"))
+	if err != nil {
+		writeJSON(rw, http.StatusBadRequest, &apiError{Error: err.Error()})
+		return
+	}
+
+	flusher, ok := rw.(http.Flusher)
+	if !ok {
+		writeJSON(rw, http.StatusInternalServerError, &apiError{Error: "streaming not supported"})
+		return
+	}
+
+	sub := ws.s.events.subscribe(types)
+	defer ws.s.events.unsubscribe(sub)
+
+	rw.Header().Set("Content-Type", "text/event-stream")
+	rw.Header().Set("Cache-Control", "no-cache")
+	fmt.Fprint(rw, ": connected\n\n")
+	flusher.Flush()
+
+	keepAlive := clock.Or(ws.s.clock).NewTicker(eventKeepAliveInterval)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case ev, ok := <-sub.ch:
+			if !ok {
+				// Dropped for falling behind.
+				return
+			}
+			data, err := json.Marshal(ev)
+			if err != nil {
+				log.Errore(err, "marshalling event")
+				continue
+			}
+			fmt.Fprintf(rw, "id: %d\nevent: %s\ndata: %s\n\n", ev.ID, ev.Type, data)
+		case <-keepAlive.C():
+			fmt.Fprint(rw, ": keepalive\n\n")
+		case <-req.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,232 @@
+//go:build !no_webserver
+// +build !no_webserver
+
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/rpcclient"
+
+	"github.com/namecoin/ncdns/backend"
+	"github.com/namecoin/ncdns/namecoin"
+)
+
+// Reads server-sent events from a stream, with a timeout.
+type sseReader struct {
+	t      *testing.T
+	events chan map[string]string
+}
+
+func newSSEReader(t *testing.T, url string) (*sseReader, func()) {
+	res, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusOK || res.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("%s: got status %d, content type %s", url, res.StatusCode, res.Header.Get("Content-Type"))
+	}
+
+	r := &sseReader{t: t, events: make(chan map[string]string, 100)}
+	go func() {
+		defer close(r.events)
+		sc := bufio.NewScanner(res.Body)
+		ev := map[string]string{}
+		for sc.Scan() {
+			line := sc.Text()
+			if line == "" {
+				if len(ev) > 0 {
+					r.events <- ev
+				}
+				ev = map[string]string{}
+				continue
+			}
+			if i := strings.Index(line, ": "); i > 0 {
+				ev[line[:i]] = line[i+2:]
+			}
+		}
+	}()
+	return r, func() { res.Body.Close() }
+}
+
+// Returns the next event's data.
+func (r *sseReader) next() *event {
+	select {
+	case raw, ok := <-r.events:
+		if !ok {
+			r.t.Fatal("event stream ended")
+		}
+		var ev event
+		if err := json.Unmarshal([]byte(raw["data"]), &ev); err != nil {
+			r.t.Fatalf("bad event %v: %v", raw, err)
+		}
+		if ev.Type != raw["event"] || raw["id"] == "" {
+			r.t.Errorf("event %v has the wrong name or no ID", raw)
+		}
+		return &ev
+	case <-time.After(5 * time.Second):
+		r.t.Fatal("timed out waiting for an event")
+		return nil
+	}
+}
+
+func TestEvents(t *testing.T) {
+	chain := &fakeChainRPC{height: 100, values: map[string]string{
+		"d/watched": `{"ip":"192.0.2.1"}`,
+		"d/gone":    `{"ip":"192.0.2.2"}`,
+	}}
+	rpcSrv := httptest.NewServer(chain)
+	defer rpcSrv.Close()
+	conn, err := namecoin.New(&rpcclient.ConnConfig{
+		Host:         strings.TrimPrefix(rpcSrv.URL, "http://"),
+		User:         "user",
+		Pass:         "pass",
+		HTTPPostMode: true,
+		DisableTLS:   true,
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Shutdown()
+
+	bus := newEventBus()
+	b, err := backend.New(&backend.Config{
+		CacheMaxEntries: 100,
+		FakeNames: map[string]string{
+			"d/big": `{"txt":"` + strings.Repeat("x", 470) + `"}`,
+		},
+		ValueSizeWarnPercent: 90,
+		Problem: func(name string, err error, isWarning bool) {
+			bus.publish(&valueProblem{Name: name, Problem: err.Error(), Warning: isWarning})
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Server{
+		cfg: Config{
+			HTTP:              HTTPConfig{Events: true},
+			EventWatchNames:   "d/watched, d/gone,d/new",
+			EventClientBuffer: 16,
+			FlushCacheOnBlock: true,
+			BlockPollInterval: 10,
+		},
+		namecoinConn: conn,
+		backend:      b,
+		httpBreaker:  newCircuitBreaker(1, time.Hour, nil),
+		bus:          bus,
+	}
+	if err := s.setupEvents(); err != nil {
+		t.Fatal(err)
+	}
+	s.blockWatcher.poll()
+
+	ws := &webServer{s: s, sm: http.NewServeMux()}
+	ws.sm.HandleFunc("/api/v1/events", ws.handleEvents)
+	srv := httptest.NewServer(ws.sm)
+	defer srv.Close()
+
+	all, closeAll := newSSEReader(t, srv.URL+"/api/v1/events")
+	defer closeAll()
+	blocks, closeBlocks := newSSEReader(t, srv.URL+"/api/v1/events?types=block,degraded")
+	defer closeBlocks()
+
+	// The block's changes to the watched names come after the block, in the
+	// order the names were listed.
+	chain.advance(map[string]string{
+		"d/watched":   `{"ip":"192.0.2.3"}`,
+		"d/gone":      "",
+		"d/new":       `{"ip":"192.0.2.4"}`,
+		"d/unwatched": `{"ip":"192.0.2.5"}`,
+	})
+	s.blockWatcher.poll()
+	s.blockWatcher.poll() // nothing new
+
+	if ev := all.next(); ev.Type != eventBlock || ev.Height != 101 || ev.Hash == "" {
+		t.Errorf("unexpected block event %+v", ev)
+	}
+	if ev := all.next(); ev.Type != eventCache || ev.Height != 101 {
+		t.Errorf("unexpected cache event %+v", ev)
+	}
+	if ev := all.next(); ev.Type != eventName || ev.Name != "d/watched" || ev.Value != `{"ip":"192.0.2.3"}` {
+		t.Errorf("unexpected name event %+v", ev)
+	}
+	if ev := all.next(); ev.Type != eventName || ev.Name != "d/gone" || !ev.Missing {
+		t.Errorf("unexpected name event %+v", ev)
+	}
+	if ev := all.next(); ev.Type != eventName || ev.Name != "d/new" || ev.Value != `{"ip":"192.0.2.4"}` {
+		t.Errorf("unexpected name event %+v", ev)
+	}
+
+	// The webserver's lookups failing.
+	s.httpBreaker.done(errors.New("namecoind unreachable"))
+	if ev := all.next(); ev.Type != eventDegraded || ev.State != "open" {
+		t.Errorf("unexpected degraded event %+v", ev)
+	}
+
+	// A value close to the size limit, found as it's served.
+	if _, err := b.Lookup("big.bit.", ""); err != nil {
+		t.Fatal(err)
+	}
+	if ev := all.next(); ev.Type != eventProblem || ev.Name != "d/big" || !ev.Warning ||
+		!strings.Contains(ev.Problem, "480 bytes, 92% of the 520-byte limit") {
+		t.Errorf("unexpected problem event %+v", ev)
+	}
+
+	// Other types are filtered out.
+	if ev := blocks.next(); ev.Type != eventBlock || ev.Height != 101 {
+		t.Errorf("unexpected block event %+v", ev)
+	}
+	if ev := blocks.next(); ev.Type != eventDegraded {
+		t.Errorf("unexpected event %+v", ev)
+	}
+
+	if st := s.events.Status(); st.Clients != 2 || st.Dropped != 0 {
+		t.Errorf("unexpected status %+v", st)
+	}
+
+	res, err := http.Get(srv.URL + "/api/v1/events?types=block,bogus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("unknown type: got status %d", res.StatusCode)
+	}
+}
+
+// A client too slow to keep up is dropped, without holding up the others.
+func TestEventsSlowClient(t *testing.T) {
+	h := newEventHub(2, nil)
+	slow := h.subscribe(nil)
+	fast := h.subscribe(nil)
+
+	for i := 0; i < 3; i++ {
+		h.publish(&event{Type: eventBlock, Height: int64(i)})
+		<-fast.ch
+	}
+
+	// The events buffered are still delivered, then the stream ends.
+	for i := 0; i < 2; i++ {
+		if ev, ok := <-slow.ch; !ok || ev.Height != int64(i) {
+			t.Fatalf("got %+v, %v; expected event %d", ev, ok, i)
+		}
+	}
+	if ev, ok := <-slow.ch; ok {
+		t.Errorf("got %+v after being dropped", ev)
+	}
+
+	if st := h.Status(); st.Clients != 1 || st.Dropped != 1 {
+		t.Errorf("unexpected status %+v", st)
+	}
+	h.unsubscribe(slow) // harmless once dropped
+	h.unsubscribe(fast)
+}
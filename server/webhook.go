@@ -0,0 +1,34 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// How long a webhook has to answer.
+const webhookTimeout = 10 * time.Second
+
+// Posts v as JSON to the webhook at url, as the parent DS check and alerts do
+// when something they watch changes.
+func postWebhook(url string, v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{Timeout: webhookTimeout}
+	res, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("webhook returned HTTP status %d", res.StatusCode)
+	}
+
+	return nil
+}
@@ -0,0 +1,387 @@
+//go:build !no_webserver
+// +build !no_webserver
+
+package server
+
+import (
+	"net/http"
+	"runtime"
+	"sort"
+	"sync/atomic"
+
+	"github.com/namecoin/ncdns/metrics"
+	"github.com/namecoin/ncdns/scheduler"
+)
+
+// Serves the metrics in the Prometheus text exposition format. The metric
+// names, and their labels, are kept the same between releases.
+func (ws *webServer) handleMetrics(rw http.ResponseWriter, req *http.Request) {
+	rw.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w := metrics.NewWriter(rw)
+
+	if qm := ws.s.queryMetrics; qm != nil {
+		qm.mu.Lock()
+		keys := make([]queryMetricsKey, 0, len(qm.counts))
+		counts := make(map[queryMetricsKey]uint64, len(qm.counts))
+		for k, n := range qm.counts {
+			keys = append(keys, k)
+			counts[k] = n
+		}
+		qm.mu.Unlock()
+		sort.Slice(keys, func(i, j int) bool {
+			a, b := keys[i], keys[j]
+			if a.qtype != b.qtype {
+				return a.qtype < b.qtype
+			}
+			if a.rcode != b.rcode {
+				return a.rcode < b.rcode
+			}
+			return a.transport < b.transport
+		})
+
+		w.Family("ncdns_dns_queries_total", "counter", "DNS queries answered, by query type (e.g. A, or other for types without a name), response code (e.g. NOERROR) and transport (udp, tcp or tls).")
+		for _, k := range keys {
+			w.Sample("ncdns_dns_queries_total", metrics.Labels("qtype", k.qtype, "rcode", k.rcode, "transport", k.transport), float64(counts[k]))
+		}
+
+		w.Family("ncdns_dns_query_duration_seconds", "histogram", "Time taken to answer DNS queries, in seconds.")
+		w.Histogram("ncdns_dns_query_duration_seconds", nil, qm.duration.Snapshot())
+	}
+
+	if st := ws.s.ednsStats; st != nil {
+		c := st.Status()
+		for _, f := range []struct {
+			name, help string
+			v          uint64
+		}{
+			{"ncdns_dns_queries_without_edns_total", "DNS queries without an OPT record.", c.NoEDNS},
+			{"ncdns_dns_queries_bad_edns_version_total", "DNS queries with an EDNS version above 0, which are answered BADVERS.", c.BadVersion},
+			{"ncdns_dns_queries_unknown_edns_flags_total", "DNS queries with EDNS flags set other than DO.", c.UnknownFlags},
+			{"ncdns_dns_queries_client_subnet_total", "DNS queries with an EDNS Client Subnet option.", c.ClientSubnet},
+			{"ncdns_dns_queries_bad_client_subnet_total", "DNS queries with a malformed EDNS Client Subnet option, which are answered FORMERR.", c.BadSubnet},
+			{"ncdns_dns_truncated_responses_total", "Responses to DNS queries over UDP which were truncated.", c.Truncated},
+			{"ncdns_dns_truncated_tcp_retries_total", "DNS queries over TCP retrying a truncated response over UDP to the same client.", c.TCPRetries},
+		} {
+			w.Family(f.name, "counter", f.help)
+			w.Sample(f.name, nil, float64(f.v))
+		}
+	}
+
+	w.Family("ncdns_dns_queries_in_flight", "gauge", "DNS queries being answered, each by a goroutine of its own.")
+	w.Sample("ncdns_dns_queries_in_flight", nil, float64(atomic.LoadInt64(&ws.s.inflight)))
+
+	draining := 0.0
+	if ws.s.isDraining() {
+		draining = 1
+	}
+	w.Family("ncdns_draining", "gauge", "Whether the server is draining ahead of maintenance: failing health checks while still answering DNS queries, until it stops.")
+	w.Sample("ncdns_draining", nil, draining)
+
+	w.Family("go_goroutines", "gauge", "Number of goroutines that currently exist.")
+	w.Sample("go_goroutines", nil, float64(runtime.NumGoroutine()))
+
+	if b := ws.s.currentBackend(); b != nil {
+		st := b.CacheStats()
+		w.Family("ncdns_backend_cache_hits_total", "counter", "Lookups of names found in the name cache.")
+		w.Sample("ncdns_backend_cache_hits_total", nil, float64(st.Hits))
+		w.Family("ncdns_backend_cache_misses_total", "counter", "Lookups of names not found in the name cache, which were fetched.")
+		w.Sample("ncdns_backend_cache_misses_total", nil, float64(st.Misses))
+		w.Family("ncdns_backend_negative_cache_hits_total", "counter", "Lookups of names remembered not to exist, answered NXDOMAIN without asking namecoind.")
+		w.Sample("ncdns_backend_negative_cache_hits_total", nil, float64(st.NegativeHits))
+		w.Family("ncdns_backend_stale_answers_total", "counter", "Lookups of names which failed to be fetched, answered from their data from before the name cache was last flushed.")
+		w.Sample("ncdns_backend_stale_answers_total", nil, float64(st.StaleAnswers))
+
+		bytes := b.CacheByteSizes()
+		w.Family("ncdns_backend_cache_bytes", "gauge", "Approximate bytes of memory used by the entries of each of the backend's caches: names (values fetched), parsed_values (estimated from their records), negative_names and stale_names.")
+		for _, c := range []struct {
+			cache string
+			v     int
+		}{
+			{"names", bytes.Names},
+			{"parsed_values", bytes.ParsedValues},
+			{"negative_names", bytes.NegativeNames},
+			{"stale_names", bytes.StaleNames},
+		} {
+			w.Sample("ncdns_backend_cache_bytes", metrics.Labels("cache", c.cache), float64(c.v))
+		}
+
+		lst := b.LookupStats()
+		w.Family("ncdns_backend_lookups_in_flight", "gauge", "Names being fetched, e.g. from namecoind, by lookups which missed the cache.")
+		w.Sample("ncdns_backend_lookups_in_flight", nil, float64(lst.InFlight))
+		w.Family("ncdns_backend_lookups_queued", "gauge", "Fetches of names waiting for one of MaxConcurrentLookups to finish.")
+		w.Sample("ncdns_backend_lookups_queued", nil, float64(lst.Queued))
+		w.Family("ncdns_backend_lookups_saturated_total", "counter", "Fetches of names which failed at once, answered SERVFAIL, as MaxQueuedLookups were already waiting.")
+		w.Sample("ncdns_backend_lookups_saturated_total", nil, float64(lst.Saturated))
+		w.Family("ncdns_backend_lookups_coalesced_total", "counter", "Lookups which waited for a fetch of the same name already in progress rather than making their own.")
+		w.Sample("ncdns_backend_lookups_coalesced_total", nil, float64(lst.Coalesced))
+		w.Family("ncdns_backend_lookups_timed_out_total", "counter", "Lookups which gave up on fetching a name at LookupTimeout or the deadline of their query.")
+		w.Sample("ncdns_backend_lookups_timed_out_total", nil, float64(lst.TimedOut))
+		w.Family("ncdns_backend_lookups_cancelled_total", "counter", "Lookups which gave up on fetching a name as their query was abandoned, e.g. as its TCP client disconnected.")
+		w.Sample("ncdns_backend_lookups_cancelled_total", nil, float64(lst.Cancelled))
+
+		if rst := b.RetryStats(); rst != nil {
+			w.Family("ncdns_backend_retries_pending", "gauge", "Names which failed to be fetched, waiting for FailureRetryDelay to be fetched again in the background.")
+			w.Sample("ncdns_backend_retries_pending", nil, float64(rst.Pending))
+			for _, f := range []struct {
+				name, help string
+				v          uint64
+			}{
+				{"ncdns_backend_retries_attempted_total", "Names which failed to be fetched, fetched again in the background.", rst.Attempted},
+				{"ncdns_backend_retries_succeeded_total", "Names fetched again in the background which were fetched successfully, and cached.", rst.Succeeded},
+				{"ncdns_backend_retries_dropped_total", "Names which failed to be fetched but weren't retried, as too many were already waiting for a retry.", rst.Dropped},
+			} {
+				w.Family(f.name, "counter", f.help)
+				w.Sample(f.name, nil, float64(f.v))
+			}
+		}
+	}
+
+	if ws.s.namecoinConn != nil {
+		calls := ws.s.namecoinConn.CallStats()
+		w.Family("ncdns_namecoind_rpc_duration_seconds", "histogram", "Time taken by RPC calls to namecoind, in seconds, by method (e.g. name_show), including those which failed.")
+		for _, st := range calls {
+			w.Histogram("ncdns_namecoind_rpc_duration_seconds", metrics.Labels("method", st.Method), st.Latency)
+		}
+		w.Family("ncdns_namecoind_rpc_errors_total", "counter", "RPC calls to namecoind which failed, by method, other than those for names which don't exist.")
+		for _, st := range calls {
+			w.Sample("ncdns_namecoind_rpc_errors_total", metrics.Labels("method", st.Method), float64(st.Errors))
+		}
+	}
+
+	if b := ws.s.httpBreaker; b != nil && b.threshold > 0 {
+		st := b.State()
+		w.Family("ncdns_namecoin_rpc_breaker_state", "gauge", "Whether the circuit breaker around the webserver's Namecoin RPC lookups is in each state: closed, open (rejecting lookups for BreakerCooldown) or half-open (letting a probe through).")
+		for _, state := range []breakerState{breakerClosed, breakerOpen, breakerHalfOpen} {
+			v := 0.0
+			if state == st {
+				v = 1
+			}
+			w.Sample("ncdns_namecoin_rpc_breaker_state", metrics.Labels("state", state.String()), v)
+		}
+		w.Family("ncdns_namecoin_rpc_breaker_trips_total", "counter", "Times the circuit breaker around the webserver's Namecoin RPC lookups opened, after BreakerFailureThreshold failures in a row or a failed probe.")
+		w.Sample("ncdns_namecoin_rpc_breaker_trips_total", nil, float64(b.Status().Trips))
+	}
+
+	if m := ws.s.busMetrics; m != nil {
+		if height := atomic.LoadInt64(&m.height); height > 0 {
+			w.Family("ncdns_namecoin_block_height", "gauge", "Height of namecoind's best block, as last seen by the block watcher.")
+			w.Sample("ncdns_namecoin_block_height", nil, float64(height))
+		}
+		w.Family("ncdns_config_reloads_total", "counter", "Reloads of the configuration which succeeded.")
+		w.Sample("ncdns_config_reloads_total", nil, float64(atomic.LoadUint64(&m.configReloads)))
+		w.Family("ncdns_signing_key_changes_total", "counter", "Times signing started with a new KSK or ZSK, by a reload or a ZSK rollover.")
+		w.Sample("ncdns_signing_key_changes_total", nil, float64(atomic.LoadUint64(&m.keyChanges)))
+	}
+
+	if n := ws.s.notifier; n != nil {
+		for _, f := range []struct {
+			name, help string
+			v          func(t *notifyTarget) uint64
+		}{
+			{"ncdns_notify_acknowledged_total", "DNS NOTIFY messages acknowledged by secondaries, by target.", func(t *notifyTarget) uint64 { return atomic.LoadUint64(&t.acknowledged) }},
+			{"ncdns_notify_failures_total", "DNS NOTIFY messages which secondaries didn't acknowledge, by target, each of which is retried.", func(t *notifyTarget) uint64 { return atomic.LoadUint64(&t.failures) }},
+			{"ncdns_notify_abandoned_total", "Notifications of secondaries given up on after repeated failures, until the next block, by target.", func(t *notifyTarget) uint64 { return atomic.LoadUint64(&t.abandoned) }},
+		} {
+			w.Family(f.name, "counter", f.help)
+			for _, t := range n.targets {
+				w.Sample(f.name, metrics.Labels("target", t.addr), float64(f.v(t)))
+			}
+		}
+	}
+
+	if scheds := ws.s.schedulers(); len(scheds) > 0 {
+		names := make([]string, 0, len(scheds))
+		for name := range scheds {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		stats := map[string]scheduler.Stats{}
+		w.Family("ncdns_scheduler_queue_depth", "gauge", "Background tasks scheduled but not yet started, by scheduler (notify, health_check or retry).")
+		for _, name := range names {
+			stats[name] = scheds[name].Stats()
+			w.Sample("ncdns_scheduler_queue_depth", metrics.Labels("scheduler", name), float64(scheds[name].QueueDepth()))
+		}
+		w.Family("ncdns_scheduler_tasks", "gauge", "Background tasks by scheduler and state: delayed (waiting for their jittered start time), queued (waiting for a free slot) or running.")
+		for _, name := range names {
+			st := stats[name]
+			w.Sample("ncdns_scheduler_tasks", metrics.Labels("scheduler", name, "state", "delayed"), float64(st.Delayed))
+			w.Sample("ncdns_scheduler_tasks", metrics.Labels("scheduler", name, "state", "queued"), float64(st.Queued))
+			w.Sample("ncdns_scheduler_tasks", metrics.Labels("scheduler", name, "state", "running"), float64(st.Running))
+		}
+		for _, f := range []struct {
+			name, typ, help string
+			v               func(st scheduler.Stats) float64
+		}{
+			{"ncdns_scheduler_tasks_completed_total", "counter", "Background tasks which have finished running, by scheduler.", func(st scheduler.Stats) float64 { return float64(st.Completed) }},
+			{"ncdns_scheduler_task_wait_seconds_total", "counter", "Time finished background tasks spent queued after their start time, by scheduler.", func(st scheduler.Stats) float64 { return st.TotalWait.Seconds() }},
+			{"ncdns_scheduler_task_run_seconds_total", "counter", "Time finished background tasks spent running, by scheduler.", func(st scheduler.Stats) float64 { return st.TotalRun.Seconds() }},
+			{"ncdns_scheduler_task_max_wait_seconds", "gauge", "The longest time any background task has spent queued, by scheduler.", func(st scheduler.Stats) float64 { return st.MaxWait.Seconds() }},
+		} {
+			w.Family(f.name, f.typ, f.help)
+			for _, name := range names {
+				w.Sample(f.name, metrics.Labels("scheduler", name), f.v(stats[name]))
+			}
+		}
+	}
+
+	if c := ws.s.peerChecker; c != nil {
+		w.Family("ncdns_peer_diverged", "gauge", "Whether each of PeerServers, by address, was found at its last check to sign with keys resolvers mixing its answers with this instance's would fail to validate, or to be stuck on an old SOA serial.")
+		for _, st := range c.Status() {
+			v := 0.0
+			if peerDiverged(st.State) {
+				v = 1
+			}
+			w.Sample("ncdns_peer_diverged", metrics.Labels("peer", st.Address), v)
+		}
+	}
+
+	if c := ws.s.parentChecker; c != nil {
+		st := c.Status()
+		w.Family("ncdns_parent_ds_state", "gauge", "Whether the DS records published in the parent zone for the canonical suffix were found at the last check to be in each state: match (one matches a local KSK), mismatch, no_ds (none are published), error (the check couldn't be made) or unknown (not checked yet).")
+		for _, state := range []string{parentDSMatch, parentDSMismatch, parentDSMissing, parentDSError, parentDSUnknown} {
+			v := 0.0
+			if state == st.State {
+				v = 1
+			}
+			w.Sample("ncdns_parent_ds_state", metrics.Labels("suffix", st.Suffix, "state", state), v)
+		}
+	}
+
+	if wd := ws.s.watchdog; wd != nil {
+		st := wd.Status()
+		w.Family("ncdns_listener_probe_failures", "gauge", "Probes of each DNS listener, by transport and address, the watchdog has sent in a row without an answer.")
+		for _, h := range st {
+			w.Sample("ncdns_listener_probe_failures", metrics.Labels("transport", h.Transport, "address", h.Address), float64(h.Failures))
+		}
+		w.Family("ncdns_listener_restarts_total", "counter", "DNS listeners restarted by the watchdog, by transport and address, after failing WatchdogFailureThreshold probes in a row.")
+		for _, h := range st {
+			w.Sample("ncdns_listener_restarts_total", metrics.Labels("transport", h.Transport, "address", h.Address), float64(h.Restarts))
+		}
+	}
+
+	if acl := ws.s.queryACL; acl != nil {
+		w.Family("ncdns_acl_refused_total", "counter", "Queries refused as their clients aren't allowed by AllowQueriesFrom or are denied by DenyQueriesFrom.")
+		w.Sample("ncdns_acl_refused_total", nil, float64(atomic.LoadUint64(&acl.refused)))
+	}
+
+	u := ws.s.unsolicited.Status()
+	w.Family("ncdns_unsolicited_messages_total", "counter", "Messages which aren't ordinary queries, by kind: response (ignored), malformed (FORMERR), bad_opcode (NOTIMP), notify (acknowledged) or notify_dropped (for a zone not served).")
+	for _, k := range []struct {
+		kind string
+		v    uint64
+	}{
+		{"response", u.Responses},
+		{"malformed", u.Malformed},
+		{"bad_opcode", u.BadOpcode},
+		{"notify", u.Notifies},
+		{"notify_dropped", u.NotifyDropped},
+	} {
+		w.Sample("ncdns_unsolicited_messages_total", metrics.Labels("kind", k.kind), float64(k.v))
+	}
+	w.Family("ncdns_unsolicited_log_lines_suppressed_total", "counter", "Log lines about unsolicited messages and refused zone transfers not written, as their client prefix had caused too many already.")
+	w.Sample("ncdns_unsolicited_log_lines_suppressed_total", nil, float64(u.LogSuppressed))
+
+	w.Family("ncdns_out_of_bailiwick_records_total", "counter", "Records dropped from responses as they were owned by names outside the .bit zone asked about.")
+	w.Sample("ncdns_out_of_bailiwick_records_total", nil, float64(atomic.LoadUint64(&ws.s.recordsOutOfBailiwick)))
+	w.Family("ncdns_work_budget_trimmed_total", "counter", "Queries answered without some optional work, such as imports or the lookups of aliases' targets, as their QueryWorkBudget ran low.")
+	w.Sample("ncdns_work_budget_trimmed_total", nil, float64(atomic.LoadUint64(&ws.s.workBudgetTrimmed)))
+	w.Family("ncdns_work_budget_exhausted_total", "counter", "Queries answered SERVFAIL as the work needed to answer exceeded their QueryWorkBudget.")
+	w.Sample("ncdns_work_budget_exhausted_total", nil, float64(atomic.LoadUint64(&ws.s.workBudgetExhausted)))
+
+	tc := ws.s.tcpConns.Status()
+	w.Family("ncdns_tcp_connections", "gauge", "TCP and TLS connections open.")
+	w.Sample("ncdns_tcp_connections", nil, float64(tc.Open))
+	w.Family("ncdns_tcp_connections_rejected_total", "counter", "TCP and TLS connections closed as soon as they were accepted, as TCPMaxConnections were open.")
+	w.Sample("ncdns_tcp_connections_rejected_total", nil, float64(tc.Rejected))
+
+	if oz := ws.s.outOfZone; oz != nil {
+		w.Family("ncdns_out_of_zone_answered_total", "counter", "Queries for names outside .bit answered by OutOfZone without being forwarded.")
+		w.Sample("ncdns_out_of_zone_answered_total", nil, float64(atomic.LoadUint64(&oz.answered)))
+		if oz.mode == outOfZoneForward {
+			for _, f := range []struct {
+				name, help string
+				v          *uint64
+			}{
+				{"ncdns_forwarded_total", "Queries for names outside .bit answered by ForwardUpstream.", &oz.forwarded},
+				{"ncdns_forward_failures_total", "Queries for names outside .bit which ForwardUpstream didn't answer, e.g. within ForwardTimeout, answered SERVFAIL.", &oz.failed},
+				{"ncdns_forward_saturated_total", "Queries for names outside .bit answered SERVFAIL as ForwardMaxOutstanding were awaiting an answer.", &oz.saturated},
+			} {
+				w.Family(f.name, "counter", f.help)
+				w.Sample(f.name, nil, float64(atomic.LoadUint64(f.v)))
+			}
+		}
+	}
+
+	if socks := ws.s.udpSocketStatus(); len(socks) > 0 {
+		w.Family("ncdns_udp_receive_drops_total", "counter", "Queries dropped by the OS, by listener address, as the UDP socket's receive buffer was full; see UDPReceiveBufferBytes.")
+		for _, st := range socks {
+			w.Sample("ncdns_udp_receive_drops_total", metrics.Labels("address", st.Address), float64(st.Drops))
+		}
+	}
+
+	if ds := ws.s.dnssecStrip; ds != nil {
+		w.Family("ncdns_dnssec_stripped_total", "counter", "Responses from which DNSSEC records were stripped as their clients are in StripDNSSECForClients.")
+		w.Sample("ncdns_dnssec_stripped_total", nil, float64(atomic.LoadUint64(&ds.stripped)))
+	}
+
+	if m := ws.s.sigMonitor; m != nil {
+		st := m.Status()
+		for _, f := range []struct {
+			name, help string
+			v          uint64
+		}{
+			{"ncdns_signatures_sampled_responses_total", "Signed responses among those sampled, one in SignatureSampleRate, whose RRSIGs' validity periods were checked.", st.Sampled},
+			{"ncdns_signatures_expiring_soon_responses_total", "Sampled responses with an RRSIG expiring within the hour.", st.ExpiringSoon},
+			{"ncdns_signatures_expired_responses_total", "Sampled responses with an RRSIG which had already expired, which validating resolvers reject.", st.Expired},
+			{"ncdns_signatures_not_yet_valid_responses_total", "Sampled responses with an RRSIG whose inception was still to come, which validating resolvers reject.", st.NotYetValid},
+		} {
+			w.Family(f.name, "counter", f.help)
+			w.Sample(f.name, nil, float64(f.v))
+		}
+		if st.MinSecondsUntilExpiry != nil {
+			w.Family("ncdns_signatures_min_seconds_until_expiry", "gauge", "The least time, in seconds, until an RRSIG in the responses sampled in roughly the last ten minutes expires; negative if one had expired.")
+			w.Sample("ncdns_signatures_min_seconds_until_expiry", nil, float64(*st.MinSecondsUntilExpiry))
+		}
+	}
+
+	if g := ws.s.sigGuard; g != nil {
+		st := g.Status()
+		w.Family("ncdns_signature_guard_resigned_total", "counter", "Expired RRSIGs made again just before being served, as the system clock had moved since they were made.")
+		w.Sample("ncdns_signature_guard_resigned_total", nil, float64(st.Resigned))
+		w.Family("ncdns_signature_guard_unrepaired_total", "counter", "Expired RRSIGs which couldn't be made again, whose responses were handled according to ClockSkewPolicy; the system clock is probably wrong.")
+		w.Sample("ncdns_signature_guard_unrepaired_total", nil, float64(st.Unrepaired))
+	}
+
+	if ql := ws.s.queryLog; ql != nil {
+		w.Family("ncdns_query_log_written_total", "counter", "Queries written to the query log.")
+		w.Sample("ncdns_query_log_written_total", nil, float64(atomic.LoadUint64(&ql.written)))
+		w.Family("ncdns_query_log_dropped_total", "counter", "Queries sampled for the query log but dropped, as it fell behind or couldn't be written to.")
+		w.Sample("ncdns_query_log_dropped_total", nil, float64(atomic.LoadUint64(&ql.dropped)))
+	}
+
+	if b := ws.s.bus; b != nil {
+		st := b.Status()
+		w.Family("ncdns_event_bus_panics_total", "counter", "Panics of the features handling the server's internal events, each recovered from.")
+		w.Sample("ncdns_event_bus_panics_total", nil, float64(st.Panics))
+		w.Family("ncdns_event_bus_dropped_total", "counter", "Internal events dropped for features which fell behind handling them.")
+		w.Sample("ncdns_event_bus_dropped_total", nil, float64(st.Dropped))
+	}
+
+	log.Infoe(w.Err(), "metrics")
+}
+
+// Returns the schedulers of background work, by what they run.
+func (s *Server) schedulers() map[string]*scheduler.Scheduler {
+	scheds := map[string]*scheduler.Scheduler{}
+	if s.notifier != nil {
+		scheds["notify"] = s.notifier.sched
+	}
+	if s.healthChecker != nil {
+		scheds["health_check"] = s.healthChecker.sched
+	}
+	if rs := s.currentBackend().RetryScheduler(); rs != nil {
+		scheds["retry"] = rs
+	}
+	return scheds
+}
@@ -0,0 +1,124 @@
+//go:build !no_webserver
+// +build !no_webserver
+
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/namecoin/ncdns/backend"
+	"github.com/namecoin/ncdns/testutil"
+)
+
+func TestMetrics(t *testing.T) {
+	be, err := backend.New(&backend.Config{
+		CacheMaxEntries:   100,
+		FakeNames:         map[string]string{"d/example": `{"ip":"192.0.2.1"}`},
+		FailureRetryDelay: time.Minute,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tls, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tls.Close()
+	udpConn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udpConn.Close()
+
+	s := &Server{
+		backend:      be,
+		mux:          dns.NewServeMux(),
+		clientStats:  newClientStats(10000, time.Minute, 0, 0, nil),
+		queryMetrics: newQueryMetrics(),
+		tlsListeners: []net.Listener{tls},
+		udpConns:     []*net.UDPConn{udpConn},
+		httpBreaker:  newCircuitBreaker(5, time.Minute, nil),
+	}
+	s.mux.Handle(".", &testSigningEngine{b: be, ks: &keySet{}})
+
+	udp := &net.UDPAddr{IP: net.ParseIP("192.0.2.100"), Port: 1234}
+	tcp := &net.TCPAddr{IP: net.ParseIP("192.0.2.100"), Port: 1234}
+	for _, q := range []struct {
+		qname string
+		qtype uint16
+		rw    dns.ResponseWriter
+	}{
+		{"example.bit.", dns.TypeA, &fakeResponseWriter{addr: udp}},
+		{"example.bit.", dns.TypeA, &fakeResponseWriter{addr: udp}},
+		{"example.bit.", dns.TypeA, &localAddrWriter{&fakeResponseWriter{addr: tcp}, &net.TCPAddr{Port: 53}}},
+		{"example.bit.", 65280, &localAddrWriter{&fakeResponseWriter{addr: tcp}, tls.Addr()}},
+	} {
+		req := new(dns.Msg)
+		req.SetQuestion(q.qname, q.qtype)
+		s.ServeDNS(q.rw, req)
+	}
+
+	// The checks of the signatures served and of the parent's DS.
+	now := time.Unix(1700000000, 0)
+	s.sigMonitor = newSigMonitor(1, testutil.NewFakeClock(now))
+	s.sigMonitor.check(signedResponse(now, -time.Hour, 30*time.Minute))
+	s.sigGuard = newSigGuard(s, clockSkewServFail)
+	atomic.AddUint64(&s.sigGuard.resigned, 2)
+	s.parentChecker = newParentChecker("bit", nil, nil, time.Hour, "", nil)
+
+	rw := httptest.NewRecorder()
+	(&webServer{s: s}).handleMetrics(rw, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := rw.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("got Content-Type %q", ct)
+	}
+
+	body := rw.Body.String()
+	lines := []string{
+		`# TYPE ncdns_dns_queries_total counter`,
+		`ncdns_dns_queries_total{qtype="A",rcode="NOERROR",transport="udp"} 2`,
+		`ncdns_dns_queries_total{qtype="A",rcode="NOERROR",transport="tcp"} 1`,
+		`ncdns_dns_queries_total{qtype="other",rcode="NOERROR",transport="tls"} 1`,
+		`ncdns_dns_query_duration_seconds_count 4`,
+		`ncdns_dns_queries_in_flight 0`,
+		`ncdns_draining 0`,
+		fmt.Sprintf("ncdns_backend_cache_hits_total %d", be.CacheStats().Hits),
+		`ncdns_backend_cache_misses_total 1`,
+		`ncdns_backend_negative_cache_hits_total 0`,
+		fmt.Sprintf(`ncdns_backend_cache_bytes{cache="names"} %d`, be.CacheByteSizes().Names),
+		`ncdns_backend_cache_bytes{cache="stale_names"} 0`,
+		`ncdns_backend_retries_pending 0`,
+		`ncdns_backend_retries_attempted_total 0`,
+		`ncdns_backend_retries_succeeded_total 0`,
+		`ncdns_namecoin_rpc_breaker_state{state="closed"} 1`,
+		`ncdns_namecoin_rpc_breaker_state{state="open"} 0`,
+		`ncdns_namecoin_rpc_breaker_trips_total 0`,
+		`ncdns_scheduler_queue_depth{scheduler="retry"} 0`,
+		`ncdns_scheduler_tasks{scheduler="retry",state="running"} 0`,
+		`ncdns_scheduler_tasks_completed_total{scheduler="retry"} 0`,
+		`ncdns_parent_ds_state{suffix="bit.",state="match"} 0`,
+		`ncdns_parent_ds_state{suffix="bit.",state="unknown"} 1`,
+		`ncdns_signatures_sampled_responses_total 1`,
+		`ncdns_signatures_expiring_soon_responses_total 1`,
+		`ncdns_signatures_expired_responses_total 0`,
+		`ncdns_signatures_min_seconds_until_expiry 1800`,
+		`ncdns_signature_guard_resigned_total 2`,
+		`ncdns_signature_guard_unrepaired_total 0`,
+	}
+	// Where the OS reports them, the drops of each UDP socket.
+	if len(s.udpSocketStatus()) > 0 {
+		lines = append(lines, fmt.Sprintf(`ncdns_udp_receive_drops_total{address="%s"} 0`, udpConn.LocalAddr()))
+	}
+	for _, line := range lines {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("no line %q in:\n%s", line, body)
+		}
+	}
+}
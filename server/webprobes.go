@@ -0,0 +1,122 @@
+//go:build !no_webserver
+// +build !no_webserver
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/namecoin/ncdns/backend"
+	"github.com/namecoin/ncdns/clock"
+)
+
+// Reports whether the server is alive: whether its DNS listeners are up.
+// Fails while draining, so that load balancers take the server out of
+// rotation.
+func (ws *webServer) handleHealthz(rw http.ResponseWriter, req *http.Request) {
+	if err := ws.s.servingError(); err != nil {
+		http.Error(rw, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	fmt.Fprintln(rw, "ok")
+}
+
+type readyCheck struct {
+	Name  string `json:"name"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+type readyInfo struct {
+	Ready  bool         `json:"ready"`
+	Checks []readyCheck `json:"checks"`
+}
+
+// Reports whether the server is ready to answer queries: besides its
+// listeners being up, whether the backend is ready, namecoind answers, if
+// names are fetched from it, and the DNSSEC keys are loaded, if configured.
+// Answered 503 if not, with the checks which failed.
+func (ws *webServer) handleReadyz(rw http.ResponseWriter, req *http.Request) {
+	info := readyInfo{Ready: true}
+	add := func(name string, err error) {
+		c := readyCheck{Name: name, OK: err == nil}
+		if err != nil {
+			c.Error = err.Error()
+			info.Ready = false
+		}
+		info.Checks = append(info.Checks, c)
+	}
+
+	add("listeners", ws.s.servingError())
+	if b := ws.s.currentBackend(); b != nil {
+		add("backend", b.Ready())
+	} else {
+		add("backend", errors.New("not set up"))
+	}
+	if ws.rpcProbe != nil {
+		add("namecoind", ws.rpcProbe.check())
+	}
+	if ws.s.cfg.DNSSEC.PublicKey != "" {
+		add("dnssec_keys", ws.s.keysError())
+	}
+
+	status := http.StatusOK
+	if !info.Ready {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(rw, status, &info)
+}
+
+type statuszInfo struct {
+	Version       string             `json:"version"`
+	State         string             `json:"state"`
+	StartedAt     *time.Time         `json:"started_at,omitempty"` // nil until started
+	UptimeSeconds int64              `json:"uptime_seconds"`
+	Height        int64              `json:"height,omitempty"` // of the best block, if known
+	Cache         backend.CacheSizes `json:"cache"`
+	CacheBytes    int                `json:"cache_bytes"`
+	Listen        []string           `json:"listen"`
+	ListenTCP     []string           `json:"listen_tcp,omitempty"`
+	ListenTLS     []string           `json:"listen_tls,omitempty"`
+	HTTP          string             `json:"http,omitempty"`
+}
+
+// Gives a summary of the server for orchestration: its version, uptime, the
+// height of the best block, the sizes of its caches and the addresses it
+// listens at. /status gives more detail.
+func (ws *webServer) handleStatusz(rw http.ResponseWriter, req *http.Request) {
+	info := statuszInfo{
+		Version: ncdnsVersion,
+		State:   ws.s.lifecycle.current().String(),
+		Height:  ws.s.chainHeight(),
+		Listen:  []string{},
+	}
+	if started := atomic.LoadInt64(&ws.s.startedAt); started != 0 {
+		t := time.Unix(0, started).UTC()
+		info.StartedAt = &t
+		info.UptimeSeconds = int64(clock.Or(ws.s.clock).Now().Sub(t) / time.Second)
+	}
+	if b := ws.s.currentBackend(); b != nil {
+		info.Cache = b.CacheSizes()
+		info.CacheBytes = b.CacheBytes()
+	}
+	for _, a := range ws.s.UDPAddrs() {
+		info.Listen = append(info.Listen, a.String())
+	}
+	for _, a := range ws.s.TCPAddrs() {
+		info.ListenTCP = append(info.ListenTCP, a.String())
+	}
+	for _, a := range ws.s.TLSAddrs() {
+		info.ListenTLS = append(info.ListenTLS, a.String())
+	}
+	if a := ws.s.HTTPAddr(); a != nil {
+		info.HTTP = a.String()
+	}
+
+	writeJSON(rw, http.StatusOK, &info)
+}
@@ -0,0 +1,78 @@
+//go:build !no_webserver
+// +build !no_webserver
+
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/namecoin/ncdns/testutil"
+)
+
+func readyzInfo(t *testing.T, ws *webServer) (int, *readyInfo) {
+	rw := httptest.NewRecorder()
+	ws.handleReadyz(rw, httptest.NewRequest("GET", "/readyz", nil))
+	var info readyInfo
+	if err := json.Unmarshal(rw.Body.Bytes(), &info); err != nil {
+		t.Fatal(err)
+	}
+	return rw.Code, &info
+}
+
+func TestReadyz(t *testing.T) {
+	s := newDrainTestServer(t)
+	ws := &webServer{s: s}
+
+	code, info := readyzInfo(t, ws)
+	if code != http.StatusOK || !info.Ready || len(info.Checks) != 2 {
+		t.Errorf("got %d, %+v; expected the listeners and backend to be ready", code, info)
+	}
+
+	ws.rpcProbe = newRPCProbe(func() error { return errors.New("connection refused") }, nil)
+	s.cfg.DNSSEC.PublicKey = "ksk.key"
+	code, info = readyzInfo(t, ws)
+	if code != http.StatusServiceUnavailable || info.Ready {
+		t.Errorf("got %d, %+v; expected not to be ready", code, info)
+	}
+	failing := make(map[string]string)
+	for _, c := range info.Checks {
+		if !c.OK {
+			failing[c.Name] = c.Error
+		}
+	}
+	if len(failing) != 2 || failing["namecoind"] != "connection refused" || failing["dnssec_keys"] == "" {
+		t.Errorf("failing checks %v; expected namecoind and dnssec_keys", failing)
+	}
+}
+
+func TestStatusz(t *testing.T) {
+	s := newDrainTestServer(t)
+	s.clock = testutil.NewFakeClock(time.Unix(1600000000, 0))
+	ws := &webServer{s: s}
+
+	rw := httptest.NewRecorder()
+	ws.handleStatusz(rw, httptest.NewRequest("GET", "/statusz", nil))
+	var info statuszInfo
+	if err := json.Unmarshal(rw.Body.Bytes(), &info); err != nil {
+		t.Fatal(err)
+	}
+	if info.State != "running" || info.StartedAt != nil || info.Listen == nil {
+		t.Errorf("unexpected status %+v", info)
+	}
+
+	atomic.StoreInt64(&s.startedAt, time.Unix(1600000000-90, 0).UnixNano())
+	rw = httptest.NewRecorder()
+	ws.handleStatusz(rw, httptest.NewRequest("GET", "/statusz", nil))
+	if err := json.Unmarshal(rw.Body.Bytes(), &info); err != nil {
+		t.Fatal(err)
+	}
+	if info.UptimeSeconds != 90 || info.StartedAt == nil {
+		t.Errorf("got uptime %d, started at %v; expected 90s", info.UptimeSeconds, info.StartedAt)
+	}
+}
@@ -0,0 +1,109 @@
+//go:build !no_webserver
+// +build !no_webserver
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/namecoin/ncdns/ncdomain"
+	"github.com/namecoin/ncdns/util"
+	"gopkg.in/hlandau/madns.v2/merr"
+)
+
+// Maps the Host header of a request for a name under the canonical suffix,
+// e.g. "www.example.bit:80", to the Namecoin name ("d/example") and the path
+// within its value (["www"]), as util.QnameToNamecoinKey does. Returns false
+// if the host is not a name under the canonical suffix.
+func (ws *webServer) splitHost(host string) (ncname string, subPath []string, ok bool) {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	if !util.ValidateOwnerName(strings.ToLower(host)) {
+		return "", nil, false
+	}
+
+	ncname, subPath, err := util.QnameToNamecoinKey(host, ws.s.cfg.CanonicalSuffix)
+	if err != nil || ncname == "" {
+		return "", nil, false
+	}
+
+	return ncname, subPath, true
+}
+
+// Serves a request whose Host header names a domain under the canonical
+// suffix, i.e. one where the name's A record points at this webserver. If the
+// name publishes a redirect URL, the request is redirected there; otherwise
+// the lookup page for the name is served.
+func (ws *webServer) handleNameHost(rw http.ResponseWriter, req *http.Request, ncname string, subPath []string) {
+	if target := ws.redirectTarget(req.Context(), ncname, subPath); target != "" {
+		code := http.StatusFound
+		if ws.s.cfg.HTTP.RedirectPermanent {
+			code = http.StatusMovedPermanently
+		}
+		http.Redirect(rw, req, target, code)
+		return
+	}
+
+	req.Form = url.Values{"q": []string{ncname}}
+	ws.handleLookup(rw, req)
+}
+
+// Returns the redirect URL published for the given name, or "" if there is
+// none or it can't be used.
+func (ws *webServer) redirectTarget(ctx context.Context, ncname string, subPath []string) string {
+	v, err := ws.subdomainValue(ctx, ncname, subPath)
+	if err != nil {
+		return ""
+	}
+
+	if v.Redirect == "" {
+		return ""
+	}
+
+	// A target under our own suffix would most likely resolve back to this
+	// webserver, which could redirect it again, and so on.
+	u, err := url.Parse(v.Redirect)
+	if err != nil {
+		return ""
+	}
+	if util.IsInZone(u.Hostname(), ws.s.cfg.CanonicalSuffix) {
+		log.Info("refusing redirect loop for ", ncname, " to ", v.Redirect)
+		return ""
+	}
+
+	return v.Redirect
+}
+
+// Looks up and parses the value of a name, and follows the path within it,
+// falling back to wildcards.
+func (ws *webServer) subdomainValue(ctx context.Context, ncname string, subPath []string) (*ncdomain.Value, error) {
+	value, err := ws.nameQuery(ctx, ncname, "")
+	if err != nil {
+		return nil, err
+	}
+
+	v := ws.parseValue(ctx, ncname, value, nil)
+	if v == nil {
+		return nil, fmt.Errorf("couldn't parse value of %s", ncname)
+	}
+
+	for _, label := range subPath {
+		sub, ok := v.Map[label]
+		if !ok {
+			sub, ok = v.Map["*"]
+			if !ok {
+				return nil, merr.ErrNoSuchDomain
+			}
+		}
+		v = sub
+	}
+
+	return v, nil
+}
@@ -0,0 +1,118 @@
+//go:build !no_webserver
+// +build !no_webserver
+
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"gopkg.in/hlandau/madns.v2/merr"
+)
+
+func newRedirectTestWebServer(t *testing.T, permanent bool) *webServer {
+	s := &Server{
+		cfg: Config{
+			CanonicalSuffix: "bit",
+			HTTP:            HTTPConfig{Redirects: true, RedirectPermanent: permanent},
+			TplPath:         "../_tpl",
+			TplSet:          "std",
+		},
+		httpBreaker: newCircuitBreaker(0, 0, nil),
+	}
+
+	names := map[string]string{
+		"d/example":    `{"ip":["192.0.2.1"],"redirect":"https://example.com/landing","map":{"www":{"url":"http://www.example.com/"},"plain":{"ip":["192.0.2.2"]}}}`,
+		"d/plain":      `{"ip":["192.0.2.1"]}`,
+		"d/javascript": `{"redirect":"javascript:alert(1)"}`,
+		"d/loop":       `{"redirect":"http://loop.bit/"}`,
+		"d/suffix":     `{"redirect":"http://BIT./"}`,
+	}
+
+	ws := &webServer{
+		s:  s,
+		sm: http.NewServeMux(),
+		nameQuery: func(ctx context.Context, name, streamIsolationID string) (string, error) {
+			v, ok := names[name]
+			if !ok {
+				return "", merr.ErrNoSuchDomain
+			}
+			return v, nil
+		},
+	}
+	if err := ws.initTemplates(); err != nil {
+		t.Fatalf("Couldn't load templates: %v", err)
+	}
+	ws.sm.HandleFunc("/", ws.handleRoot)
+	ws.sm.HandleFunc("/lookup", ws.handleLookup)
+	return ws
+}
+
+func TestHTTPRedirects(t *testing.T) {
+	ws := newRedirectTestWebServer(t, false)
+
+	tests := []struct {
+		host     string
+		code     int
+		location string
+	}{
+		{"example.bit", http.StatusFound, "https://example.com/landing"},
+		{"EXAMPLE.bit.:80", http.StatusFound, "https://example.com/landing"},
+		{"www.example.bit", http.StatusFound, "http://www.example.com/"},
+		{"plain.example.bit", http.StatusOK, ""},
+		{"missing.example.bit", http.StatusOK, ""},
+		{"plain.bit", http.StatusOK, ""},
+		{"nonexistent.bit", http.StatusOK, ""},
+		{"javascript.bit", http.StatusOK, ""},
+		{"loop.bit", http.StatusOK, ""},
+		{"suffix.bit", http.StatusOK, ""},
+		{"ncdns.example.com", http.StatusOK, ""},
+		{"example.BIT", http.StatusFound, "https://example.com/landing"},
+		{"examplebit", http.StatusOK, ""},
+		{"example.xbit", http.StatusOK, ""},
+		{"example.bit.example.com", http.StatusOK, ""},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Host = test.host
+		rw := httptest.NewRecorder()
+		ws.ServeHTTP(rw, req)
+
+		if rw.Code != test.code {
+			t.Errorf("%s: got status %d, expected %d", test.host, rw.Code, test.code)
+		}
+		if loc := rw.Header().Get("Location"); loc != test.location {
+			t.Errorf("%s: got Location %q, expected %q", test.host, loc, test.location)
+		}
+	}
+}
+
+func TestHTTPRedirectsPermanent(t *testing.T) {
+	ws := newRedirectTestWebServer(t, true)
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Host = "example.bit"
+	rw := httptest.NewRecorder()
+	ws.ServeHTTP(rw, req)
+
+	if rw.Code != http.StatusMovedPermanently {
+		t.Errorf("got status %d, expected %d", rw.Code, http.StatusMovedPermanently)
+	}
+}
+
+func TestHTTPRedirectsDisabled(t *testing.T) {
+	ws := newRedirectTestWebServer(t, false)
+	ws.s.cfg.HTTP.Redirects = false
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Host = "example.bit"
+	rw := httptest.NewRecorder()
+	ws.ServeHTTP(rw, req)
+
+	if rw.Code != http.StatusOK || rw.Header().Get("Location") != "" {
+		t.Errorf("redirected with HTTPRedirects disabled: %d %q", rw.Code, rw.Header().Get("Location"))
+	}
+}
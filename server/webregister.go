@@ -0,0 +1,77 @@
+//go:build !no_webserver
+// +build !no_webserver
+
+package server
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/namecoin/ncdns/clock"
+	"github.com/namecoin/ncdns/namecoin"
+)
+
+const (
+	// The number of blocks within which the registration transactions of
+	// the lookup page's hints are estimated to be confirmed.
+	registrationFeeTarget = 6
+
+	// The approximate size, in bytes, of each of the name_new and
+	// name_firstupdate transactions which register a name.
+	registrationTxSize = 400
+
+	// How long namecoind's fee estimate is used before it's asked again.
+	feeEstimateCacheTime = 10 * time.Minute
+)
+
+// Caches namecoind's fee estimate, which the lookup page asks for whenever a
+// name isn't registered, and which changes slowly.
+type feeEstimator struct {
+	estimate func(target int) (float64, error)
+	clock    clock.Clock
+
+	mu      sync.Mutex
+	rate    float64
+	err     error
+	fetched time.Time
+}
+
+// Returns the estimated fee rate, in NMC per kilobyte, or why there's none.
+// A failure is cached like an estimate, so that namecoind isn't asked on
+// every lookup when it has none.
+func (f *feeEstimator) feeRate() (float64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	now := f.clock.Now()
+	if f.fetched.IsZero() || now.Sub(f.fetched) >= feeEstimateCacheTime {
+		f.rate, f.err = f.estimate(registrationFeeTarget)
+		f.fetched = now
+	}
+
+	return f.rate, f.err
+}
+
+// Estimates the cost, in NMC, of registering a name: the amount locked in
+// it, and the fees of its name_new and name_firstupdate transactions.
+func (f *feeEstimator) registrationCost() (string, error) {
+	rate, err := f.feeRate()
+	if err != nil {
+		return "", err
+	}
+
+	cost := namecoin.NameLockedAmount + 2*rate*registrationTxSize/1000
+	return fmt.Sprintf("%.4f NMC", cost), nil
+}
+
+// Fills in the lookup page's hints for registering info.NamecoinName, which
+// doesn't exist.
+func (ws *webServer) fillRegistrationHints(info *lookupInfo) {
+	info.Unregistered = true
+	if ws.fees == nil {
+		return
+	}
+
+	info.RegistrationCost, info.RegistrationCostError = ws.fees.registrationCost()
+}
@@ -0,0 +1,84 @@
+//go:build !no_webserver
+// +build !no_webserver
+
+package server
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/hlandau/madns.v2/merr"
+
+	"github.com/namecoin/ncdns/testutil"
+)
+
+func TestFeeEstimator(t *testing.T) {
+	clock := testutil.NewFakeClock(time.Unix(1700000000, 0))
+	calls := 0
+	rate, err := 0.001, error(nil)
+	f := &feeEstimator{
+		estimate: func(target int) (float64, error) {
+			calls++
+			if target != registrationFeeTarget {
+				t.Errorf("fee estimated for %d blocks", target)
+			}
+			return rate, err
+		},
+		clock: clock,
+	}
+
+	// 0.01 NMC locked, and two transactions of 400 bytes at 0.001 NMC/kB.
+	if cost, err := f.registrationCost(); err != nil || cost != "0.0108 NMC" {
+		t.Errorf("got cost %q, %v", cost, err)
+	}
+
+	// The estimate is cached, failures included.
+	rate, err = 0, errors.New("no estimate")
+	clock.Advance(feeEstimateCacheTime - time.Second)
+	if cost, _ := f.registrationCost(); cost != "0.0108 NMC" || calls != 1 {
+		t.Errorf("estimate not cached: got cost %q after %d calls", cost, calls)
+	}
+	clock.Advance(time.Second)
+	if _, err := f.registrationCost(); err == nil || calls != 2 {
+		t.Errorf("estimate not fetched again once stale: %d calls", calls)
+	}
+	if _, err := f.registrationCost(); err == nil || calls != 2 {
+		t.Errorf("failure not cached: %d calls", calls)
+	}
+}
+
+func TestUnregisteredPage(t *testing.T) {
+	defer func(fs http.FileSystem) { BuiltinTemplates = fs }(BuiltinTemplates)
+	BuiltinTemplates = http.Dir("../_tpl")
+
+	s := &Server{cfg: Config{TplSet: "std", HTTP: HTTPConfig{TemplateTimeout: 5}}}
+	_, _, lookupPage, unregisteredPage, err := s.loadTemplates()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if unregisteredPage == lookupPage {
+		t.Fatalf("std set has no unregistered page")
+	}
+
+	info := &lookupInfo{
+		Query:            "example.bit",
+		NamecoinName:     "d/example",
+		DomainName:       "example.bit.",
+		ExistenceError:   merr.ErrNoSuchDomain,
+		Unregistered:     true,
+		RegistrationCost: "0.0108 NMC",
+	}
+	var buf bytes.Buffer
+	if err := executeTemplate(&buf, unregisteredPage, info, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"d/example", "0.0108 NMC", "name_new d/example", "name_firstupdate d/example"} {
+		if !strings.Contains(buf.String(), s) {
+			t.Errorf("unregistered page doesn't contain %q:\n%s", s, buf.String())
+		}
+	}
+}
@@ -0,0 +1,216 @@
+//go:build !no_webserver
+// +build !no_webserver
+
+package server
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"gopkg.in/hlandau/madns.v2/merr"
+
+	"github.com/namecoin/ncdns/backend"
+	"github.com/namecoin/ncdns/rrsort"
+	"github.com/namecoin/ncdns/util"
+)
+
+// A record served for a name, as the backend gives it to the DNS path.
+type apiResolveRecord struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	TTL  uint32 `json:"ttl"`
+	Data string `json:"data"` // the rdata, in zone file presentation format
+}
+
+type apiResolveResult struct {
+	Name         string             `json:"name"`
+	NamecoinName string             `json:"namecoin_name"`
+	Type         string             `json:"type,omitempty"` // the type asked for, if any
+	Records      []apiResolveRecord `json:"records"`
+	Value        string             `json:"value"`
+
+	// The height of the block at which the name expires, or expired, if it
+	// and the best block's height are known.
+	ExpiresAtHeight int64 `json:"expires_at_height,omitempty"`
+
+	// Set if the name's value was cached, rather than fetched from
+	// namecoind for this lookup.
+	Cached bool `json:"cached"`
+
+	// Whether every name the value imports could be fetched. If not, the
+	// records of FailedImports are missing, and the records are served with
+	// a TTL of at most PartialResultTTL.
+	Complete      bool     `json:"complete"`
+	FailedImports []string `json:"failed_imports,omitempty"`
+}
+
+// Sets the headers letting pages on any origin, such as dashboards, call the
+// lookup API from a browser.
+func setCORSHeaders(rw http.ResponseWriter) {
+	rw.Header().Set("Access-Control-Allow-Origin", "*")
+	rw.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
+	rw.Header().Set("Access-Control-Max-Age", "86400")
+}
+
+// Resolves a name as the DNS path does, through the backend and its cache,
+// returning the records served for it as JSON:
+//
+//	/api/v1/lookup/www.example.bit?type=A
+//
+// A name which doesn't exist is answered with 404, and a failure of the
+// backend, e.g. to reach namecoind, with 502. Lookups are limited to
+// HTTPLookupRatePerSecond per client network, so that the API can't be used
+// to get round the DNS side's rate limiting.
+func (ws *webServer) handleAPIResolve(rw http.ResponseWriter, req *http.Request) {
+	setCORSHeaders(rw)
+	switch req.Method {
+	case "GET", "HEAD":
+	case "OPTIONS":
+		rw.WriteHeader(http.StatusNoContent)
+		return
+	default:
+		rw.Header().Set("Allow", "GET, OPTIONS")
+		writeJSON(rw, http.StatusMethodNotAllowed, &apiError{Error: "method not allowed"})
+		return
+	}
+
+	if l := ws.s.apiLookupLimit; l != nil {
+		host, _, _ := net.SplitHostPort(req.RemoteAddr)
+		if l.account(net.ParseIP(host), "", 0, 0) != rrlSend {
+			rw.Header().Set("Retry-After", "1")
+			writeJSON(rw, http.StatusTooManyRequests, &apiError{Error: "too many lookups; slow down"})
+			return
+		}
+	}
+
+	name := strings.TrimPrefix(req.URL.Path, "/api/v1/lookup/")
+	qname, ncname, err := parseAPIResolveName(name)
+	if err != nil {
+		writeJSON(rw, http.StatusBadRequest, &apiError{Error: err.Error()})
+		return
+	}
+
+	var qtype uint16
+	typ := strings.ToUpper(req.FormValue("type"))
+	if typ != "" {
+		var ok bool
+		if qtype, ok = dns.StringToType[typ]; !ok {
+			writeJSON(rw, http.StatusBadRequest, &apiError{Error: "unknown record type " + strconv.Quote(typ)})
+			return
+		}
+	}
+
+	b := ws.s.currentBackend()
+	if b == nil {
+		writeJSON(rw, http.StatusServiceUnavailable, &apiError{Error: "not serving yet"})
+		return
+	}
+
+	// Traced, so that it's known whether the name was in the cache.
+	trace := backend.NewLookupTrace()
+	ctx := backend.WithFetchGuard(backend.WithLookupTrace(req.Context(), trace), ws.s.httpBreaker)
+	rrs, err := b.LookupContext(ctx, qname, "")
+	retryAfter, refused := breakerRetryAfter(err)
+	switch {
+	case refused:
+		rw.Header().Set("Retry-After", strconv.Itoa(retryAfterSeconds(retryAfter)))
+		writeJSON(rw, http.StatusServiceUnavailable, &apiError{Error: err.Error()})
+		return
+	case errors.Is(err, merr.ErrNoSuchDomain):
+		writeJSON(rw, http.StatusNotFound, &apiError{Error: "no such name: " + qname})
+		return
+	case err != nil:
+		writeJSON(rw, http.StatusBadGateway, &apiError{Error: err.Error()})
+		return
+	}
+
+	res := &apiResolveResult{
+		Name:         qname,
+		NamecoinName: ncname,
+		Type:         typ,
+		Records:      []apiResolveRecord{},
+	}
+	// The records may be the cache's, so they're sorted in a copy.
+	rrs = append([]dns.RR(nil), rrs...)
+	rrsort.Sort(rrs)
+	for _, rr := range rrs {
+		hdr := rr.Header()
+		if qtype != 0 && hdr.Rrtype != qtype {
+			continue
+		}
+		res.Records = append(res.Records, apiResolveRecord{
+			Name: hdr.Name,
+			Type: dns.TypeToString[hdr.Rrtype],
+			TTL:  hdr.Ttl,
+			Data: strings.TrimPrefix(rr.String(), hdr.String()),
+		})
+	}
+
+	for _, st := range trace.Steps() {
+		if st.Name != ncname {
+			continue
+		}
+		if st.Step == "cache" && st.Detail == "hit" {
+			res.Cached = true
+		}
+		if st.Step == "fetch" {
+			res.Value = st.Detail
+		}
+		if st.Step == "partial" {
+			res.FailedImports = strings.Split(st.Detail, ",")
+		}
+	}
+	res.Complete = len(res.FailedImports) == 0
+	if nameData := b.CachedNameData(ncname, ""); nameData != nil {
+		res.Value = nameData.Value
+		if height := ws.s.chainHeight(); height > 0 && (nameData.ExpiresIn != 0 || nameData.Expired) {
+			res.ExpiresAtHeight = height + int64(nameData.ExpiresIn)
+		}
+	}
+
+	writeJSON(rw, http.StatusOK, res)
+}
+
+// Returns the query name and Namecoin name of a name given to the lookup API,
+// either a domain name such as "www.example.bit" or a Namecoin name such as
+// "d/example".
+func parseAPIResolveName(name string) (qname, ncname string, err error) {
+	if strings.HasPrefix(name, "d/") {
+		basename, err := util.NamecoinKeyToBasename(name)
+		if err != nil {
+			return "", "", err
+		}
+		return basename + ".bit.", name, nil
+	}
+
+	qname = dns.Fqdn(strings.ToLower(name))
+	if _, ok := dns.IsDomainName(qname); !ok {
+		return "", "", util.ErrInvalidDomainName
+	}
+	ncname, _, err = util.QnameToNamecoinKey(qname, "bit")
+	if err != nil {
+		return "", "", err
+	}
+	if ncname == "" {
+		return "", "", errors.New("the name must be under .bit, not .bit itself")
+	}
+	return qname, ncname, nil
+}
+
+// Sets up the rate limit of lookups through the API, if
+// HTTPLookupRatePerSecond is set, counting them per client network as RRL
+// does responses.
+func (s *Server) setupAPILookupLimit() error {
+	if s.cfg.HTTP.LookupRatePerSecond < 0 {
+		return configError("HTTPLookupRatePerSecond must not be negative")
+	}
+	if s.cfg.HTTP.LookupRatePerSecond > 0 {
+		s.apiLookupLimit = newRRL(s.cfg.HTTP.LookupRatePerSecond, time.Second, 0, s.clock)
+	}
+	return nil
+}
@@ -0,0 +1,295 @@
+//go:build !no_webserver
+// +build !no_webserver
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/namecoin/ncdns/backend"
+	"github.com/namecoin/ncdns/namecoin"
+	"github.com/namecoin/ncdns/testutil"
+)
+
+type failingFetcher struct{ err error }
+
+func (f failingFetcher) Fetch(ctx context.Context, name, streamIsolationID string) (*namecoin.NameData, error) {
+	return nil, f.err
+}
+
+// Fails to fetch the names in down, as a namecoind which fails requests
+// would, counting the fetches of each name.
+type flakyRPCFetcher struct {
+	names fakeRPCFetcher
+
+	mu      sync.Mutex
+	down    map[string]bool
+	fetches map[string]int
+}
+
+func (f *flakyRPCFetcher) Fetch(ctx context.Context, name, streamIsolationID string) (*namecoin.NameData, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.fetches[name]++
+	if f.down[name] {
+		return nil, errors.New("namecoind unreachable")
+	}
+	return f.names.Fetch(ctx, name, streamIsolationID)
+}
+
+func (f *flakyRPCFetcher) setDown(name string, down bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.down[name] = down
+}
+
+func (f *flakyRPCFetcher) fetchCount(name string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.fetches[name]
+}
+
+func TestAPIResolve(t *testing.T) {
+	be, err := backend.New(&backend.Config{
+		Fetcher: fakeRPCFetcher{
+			"d/example": {Value: `{"ip":["192.0.2.1"],"ip6":["2001:db8::1"],"map":{"www":{"ip":["192.0.2.2"]}}}`, ExpiresIn: 30000},
+		},
+		CacheMaxEntries: 100,
+		RecordTTL:       600,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	clk := testutil.NewFakeClock(time.Unix(1000000, 0))
+	s := &Server{
+		backend:        be,
+		httpBreaker:    newCircuitBreaker(0, 0, nil),
+		apiLookupLimit: newRRL(3, time.Second, 0, clk),
+		busMetrics:     &busMetrics{height: 500000},
+	}
+	ws := &webServer{s: s, sm: http.NewServeMux()}
+	ws.sm.HandleFunc("/api/v1/lookup/", ws.handleAPIResolve)
+
+	get := func(path string) (*httptest.ResponseRecorder, *apiResolveResult) {
+		rw := httptest.NewRecorder()
+		ws.sm.ServeHTTP(rw, httptest.NewRequest("GET", path, nil))
+		if rw.Header().Get("Access-Control-Allow-Origin") != "*" {
+			t.Errorf("%s: no CORS headers", path)
+		}
+		var res apiResolveResult
+		if rw.Code == http.StatusOK {
+			if err := json.Unmarshal(rw.Body.Bytes(), &res); err != nil {
+				t.Fatalf("%s: couldn't decode result: %v", path, err)
+			}
+		}
+		return rw, &res
+	}
+
+	rw, res := get("/api/v1/lookup/www.example.bit?type=a")
+	if rw.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", rw.Code, rw.Body)
+	}
+	if res.Name != "www.example.bit." || res.NamecoinName != "d/example" || res.Type != "A" || res.Cached ||
+		len(res.Records) != 1 || res.Records[0] != (apiResolveRecord{"www.example.bit.", "A", 600, "192.0.2.2"}) ||
+		res.Value == "" || res.ExpiresAtHeight != 530000 {
+		t.Errorf("unexpected result %+v", res)
+	}
+
+	// The second lookup is answered from the cache.
+	if rw, res = get("/api/v1/lookup/d/example"); rw.Code != http.StatusOK || !res.Cached || len(res.Records) != 2 {
+		t.Errorf("got status %d, result %+v", rw.Code, res)
+	}
+
+	// The limit of 3 lookups a second is reached.
+	get("/api/v1/lookup/example.bit")
+	if rw, _ = get("/api/v1/lookup/example.bit"); rw.Code != http.StatusTooManyRequests {
+		t.Errorf("over the limit: got status %d", rw.Code)
+	}
+	s.apiLookupLimit = nil
+
+	for path, status := range map[string]int{
+		"/api/v1/lookup/missing.bit":            http.StatusNotFound,
+		"/api/v1/lookup/bit":                    http.StatusBadRequest,
+		"/api/v1/lookup/example.com":            http.StatusBadRequest,
+		"/api/v1/lookup/example.bit?type=BOGUS": http.StatusBadRequest,
+	} {
+		if rw, _ := get(path); rw.Code != status {
+			t.Errorf("%s: got status %d, expected %d", path, rw.Code, status)
+		}
+	}
+
+	// A failure of the backend to fetch the name is a bad gateway.
+	s.backend, err = backend.New(&backend.Config{
+		Fetcher:         failingFetcher{errors.New("namecoind unreachable")},
+		CacheMaxEntries: 100,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rw, _ := get("/api/v1/lookup/example.bit"); rw.Code != http.StatusBadGateway {
+		t.Errorf("backend failure: got status %d", rw.Code)
+	}
+
+	rw = httptest.NewRecorder()
+	ws.sm.ServeHTTP(rw, httptest.NewRequest("OPTIONS", "/api/v1/lookup/example.bit", nil))
+	if rw.Code != http.StatusNoContent || rw.Header().Get("Access-Control-Allow-Methods") == "" {
+		t.Errorf("preflight: got status %d, headers %v", rw.Code, rw.Header())
+	}
+}
+
+// One of three imports fails, so the records are served incomplete with a
+// short TTL, and complete once the import has been fetched in the background.
+func TestAPIResolvePartial(t *testing.T) {
+	f := &flakyRPCFetcher{
+		names: fakeRPCFetcher{
+			"d/example": {Value: `{"import":[["dd/a"],["dd/b"],["dd/c"]]}`, ExpiresIn: 30000},
+			"dd/a":      {Value: `{"ip":["192.0.2.1"]}`, ExpiresIn: 30000},
+			"dd/b":      {Value: `{"ip6":["2001:db8::1"]}`, ExpiresIn: 30000},
+			"dd/c":      {Value: `{"txt":"c"}`, ExpiresIn: 30000},
+		},
+		down:    map[string]bool{"dd/b": true},
+		fetches: map[string]int{},
+	}
+	be, err := backend.New(&backend.Config{
+		Fetcher:           f,
+		CacheMaxEntries:   100,
+		RecordTTL:         600,
+		PartialResultTTL:  30,
+		FailureRetryDelay: 50 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{backend: be, httpBreaker: newCircuitBreaker(0, 0, nil)}
+	ws := &webServer{s: s}
+
+	get := func() *apiResolveResult {
+		rw := httptest.NewRecorder()
+		ws.handleAPIResolve(rw, httptest.NewRequest("GET", "/api/v1/lookup/example.bit", nil))
+		if rw.Code != http.StatusOK {
+			t.Fatalf("got status %d: %s", rw.Code, rw.Body)
+		}
+		var res apiResolveResult
+		if err := json.Unmarshal(rw.Body.Bytes(), &res); err != nil {
+			t.Fatal(err)
+		}
+		return &res
+	}
+	types := func(res *apiResolveResult) map[string]uint32 {
+		ttls := map[string]uint32{}
+		for _, r := range res.Records {
+			ttls[r.Type] = r.TTL
+		}
+		return ttls
+	}
+
+	res := get()
+	ttls := types(res)
+	if res.Complete || len(res.FailedImports) != 1 || res.FailedImports[0] != "dd/b" {
+		t.Errorf("partial result reported as complete: %+v", res)
+	}
+	if _, ok := ttls["AAAA"]; ok || ttls["A"] != 30 || ttls["TXT"] != 30 {
+		t.Errorf("partial result served with records %v", res.Records)
+	}
+
+	// namecoind recovers, and the failed import, and only it, is fetched
+	// again in the background.
+	f.setDown("dd/b", false)
+	deadline := time.Now().Add(5 * time.Second)
+	for st := be.RetryStats(); st.Attempted == 0 || st.Pending != 0; st = be.RetryStats() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for the retry: %+v", st)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if n := f.fetchCount("dd/a"); n != 1 {
+		t.Errorf("import which succeeded fetched %d times", n)
+	}
+
+	res = get()
+	ttls = types(res)
+	if !res.Complete || len(res.FailedImports) != 0 {
+		t.Errorf("result reported as partial after recovery: %+v", res)
+	}
+	if ttls["AAAA"] != 600 || ttls["A"] != 600 || ttls["TXT"] != 600 {
+		t.Errorf("complete result served with records %v", res.Records)
+	}
+	if n := f.fetchCount("dd/b"); n != 2 {
+		t.Errorf("failed import fetched %d times, expected once more by the retry", n)
+	}
+}
+
+// While the breaker is open, names which are cached are still answered, and
+// only those which would have to be fetched are refused.
+func TestAPIResolveBreakerOpen(t *testing.T) {
+	f := &flakyRPCFetcher{
+		names: fakeRPCFetcher{
+			"d/example": {Value: `{"ip":["192.0.2.1"]}`, ExpiresIn: 30000},
+			"d/other":   {Value: `{"ip":["192.0.2.2"]}`, ExpiresIn: 30000},
+		},
+		down:    map[string]bool{"d/down": true},
+		fetches: map[string]int{},
+	}
+	be, err := backend.New(&backend.Config{
+		Fetcher:         f,
+		CacheMaxEntries: 100,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	clk := testutil.NewFakeClock(time.Unix(1000000, 0))
+	s := &Server{backend: be, httpBreaker: newCircuitBreaker(1, time.Minute, clk)}
+	ws := &webServer{s: s}
+
+	get := func(path string) *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		ws.handleAPIResolve(rw, httptest.NewRequest("GET", path, nil))
+		return rw
+	}
+
+	if rw := get("/api/v1/lookup/example.bit"); rw.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", rw.Code, rw.Body)
+	}
+	if rw := get("/api/v1/lookup/down.bit"); rw.Code != http.StatusBadGateway {
+		t.Fatalf("failing fetch: got status %d", rw.Code)
+	}
+	if st := s.httpBreaker.State(); st != breakerOpen {
+		t.Fatalf("breaker %v after a failure", st)
+	}
+
+	if rw := get("/api/v1/lookup/example.bit"); rw.Code != http.StatusOK {
+		t.Errorf("cached name: got status %d: %s", rw.Code, rw.Body)
+	}
+
+	rw := get("/api/v1/lookup/other.bit")
+	if rw.Code != http.StatusServiceUnavailable || rw.Header().Get("Retry-After") != "60" {
+		t.Errorf("uncached name: got status %d, Retry-After %q", rw.Code, rw.Header().Get("Retry-After"))
+	}
+	if n := f.fetchCount("d/other"); n != 0 {
+		t.Errorf("name fetched %d times while the breaker was open", n)
+	}
+
+	// A lookup abandoned by its client says nothing about namecoind.
+	clk.Advance(time.Minute)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	rw = httptest.NewRecorder()
+	ws.handleAPIResolve(rw, httptest.NewRequest("GET", "/api/v1/lookup/other.bit", nil).WithContext(ctx))
+	if st := s.httpBreaker.State(); st != breakerHalfOpen {
+		t.Errorf("breaker %v after an abandoned probe", st)
+	}
+	if rw := get("/api/v1/lookup/other.bit"); rw.Code != http.StatusOK {
+		t.Errorf("probe: got status %d: %s", rw.Code, rw.Body)
+	}
+	if st := s.httpBreaker.State(); st != breakerClosed {
+		t.Errorf("breaker %v after a successful probe", st)
+	}
+}
@@ -0,0 +1,161 @@
+//go:build !no_webserver
+// +build !no_webserver
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/kr/pretty"
+	"gopkg.in/hlandau/madns.v2/merr"
+
+	"github.com/namecoin/ncdns/ncdomain"
+)
+
+// Renders a page from tpl with data. The page is executed into a buffer before
+// being sent, so that a template which fails, panics or takes longer than
+// HTTPTemplateTimeout is answered with a plain-text 500 rather than half a
+// page or a request which never finishes.
+func (ws *webServer) executeTemplate(rw http.ResponseWriter, tpl *template.Template, data interface{}) {
+	var buf bytes.Buffer
+	err := executeTemplate(&buf, tpl, data, ws.s.templateTimeout())
+	if err != nil {
+		log.Errore(err, "webserver page template")
+		http.Error(rw, "Couldn't render the page", http.StatusInternalServerError)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+	buf.WriteTo(rw)
+}
+
+func (s *Server) templateTimeout() time.Duration {
+	return time.Duration(s.cfg.HTTP.TemplateTimeout) * time.Second
+}
+
+var errTemplateTimeout = errors.New("template took too long to execute")
+
+// Executes tpl with data into w, returning an error if it fails, panics or
+// hasn't finished within timeout (0: no limit). A template which runs out of
+// time is stopped at its next write; one which loops without writing anything
+// carries on in the background, but no longer holds up its caller.
+func executeTemplate(w io.Writer, tpl *template.Template, data interface{}, timeout time.Duration) error {
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	// Only once the template has finished is its output passed on, as one
+	// which has run out of time may still be writing.
+	var buf bytes.Buffer
+	done := make(chan error, 1)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				done <- fmt.Errorf("template panicked: %v", r)
+			}
+		}()
+
+		done <- tpl.Execute(&contextWriter{ctx: ctx, w: &buf}, data)
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			return err
+		}
+		_, err = buf.WriteTo(w)
+		return err
+
+	case <-ctx.Done():
+		return fmt.Errorf("%w after %v", errTemplateTimeout, timeout)
+	}
+}
+
+// A writer which fails once its context is done, stopping the template
+// writing to it.
+type contextWriter struct {
+	ctx context.Context
+	w   io.Writer
+}
+
+func (w *contextWriter) Write(p []byte) (int, error) {
+	if err := w.ctx.Err(); err != nil {
+		return 0, errTemplateTimeout
+	}
+	return w.w.Write(p)
+}
+
+// Executes each page's template once with synthetic data filling in its
+// fields, so that a template which fails on them is reported when it's loaded
+// rather than when the page is first requested.
+func (s *Server) checkTemplates(mainPage, lookupPage, unregisteredPage *template.Template) error {
+	layout := layoutInfo{
+		SelfName:             "ncdns.example.",
+		Time:                 "2006-01-02 15:04:05",
+		CanonicalSuffix:      "bit",
+		CanonicalNameservers: []string{"ns1.example.com."},
+		Hostmaster:           "hostmaster.example.com.",
+		CanonicalSuffixHTML:  template.HTML(`<span id="logo1">bit</span>`),
+		HasDNSSEC:            true,
+		Network:              "mainnet",
+		DNSPort:              5353,
+	}
+
+	lookup := &lookupInfo{
+		layoutInfo:    layout,
+		JSONMode:      true,
+		JSONValue:     `{"ip":["192.0.2.1"],"map":{"www":{"ip":["192.0.2.2"]}}}`,
+		Query:         "example.bit",
+		Advanced:      true,
+		NamecoinName:  "d/example",
+		DomainName:    "example.bit.",
+		BareName:      "example",
+		Expiry:        "expires in 100 blocks",
+		ParseWarnings: []error{errors.New("sample warning")},
+		ParseErrors:   []error{errors.New("sample error")},
+		RRError:       errors.New("sample error"),
+	}
+	lookup.Value = lookup.JSONValue
+	lookup.NCValue = ncdomain.ParseValue(lookup.NamecoinName, lookup.Value, nil, nil)
+	lookup.NCValueFmt = pretty.Formatter(lookup.NCValue)
+	lookup.RRs, _ = lookup.NCValue.RRsRecursive(nil, lookup.DomainName, "bit.")
+
+	unregistered := &lookupInfo{
+		layoutInfo:       layout,
+		Query:            "example.bit",
+		NamecoinName:     "d/example",
+		DomainName:       "example.bit.",
+		BareName:         "example",
+		ExistenceError:   merr.ErrNoSuchDomain,
+		Unregistered:     true,
+		RegistrationCost: "0.0108 NMC",
+	}
+
+	for _, page := range []struct {
+		name string
+		tpl  *template.Template
+		data interface{}
+	}{
+		{"main", mainPage, &layout},
+		{"lookup", lookupPage, lookup},
+		{"unregistered", unregisteredPage, unregistered},
+	} {
+		err := executeTemplate(ioutil.Discard, page.tpl, page.data, s.templateTimeout())
+		if err != nil {
+			return fmt.Errorf("Template %s.tpl fails on sample data: %v", page.name, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,109 @@
+//go:build !no_webserver
+// +build !no_webserver
+
+package server
+
+import (
+	"bytes"
+	"errors"
+	"html/template"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTemplatePanic(t *testing.T) {
+	tpl := template.Must(template.New("panic.tpl").Funcs(template.FuncMap{
+		"boom": func() string { panic("boom") },
+	}).Parse(`<p>Before</p>{{boom}}<p>After</p>`))
+
+	ws := &webServer{s: &Server{cfg: Config{HTTP: HTTPConfig{TemplateTimeout: 5}}}}
+	rec := httptest.NewRecorder()
+	ws.executeTemplate(rec, tpl, nil)
+
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("got status %d for a panicking template, expected 500", rec.Code)
+	}
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Errorf("got Content-Type %q, expected plain text", ct)
+	}
+	if strings.Contains(rec.Body.String(), "Before") {
+		t.Errorf("part of the page was sent: %q", rec.Body.String())
+	}
+}
+
+func TestTemplateTimeout(t *testing.T) {
+	// Ranging over the slice would write for hours; its elements take no
+	// memory.
+	tpl := template.Must(template.New("huge.tpl").Parse(`{{range .}}<p>{{.}}</p>{{end}}`))
+	huge := make([]struct{}, 1<<40)
+
+	start := time.Now()
+	err := executeTemplate(ioutil.Discard, tpl, huge, 100*time.Millisecond)
+	if !errors.Is(err, errTemplateTimeout) {
+		t.Errorf("got error %v, expected a timeout", err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("took %v to time out", d)
+	}
+
+	ws := &webServer{s: &Server{cfg: Config{HTTP: HTTPConfig{TemplateTimeout: 1}}}}
+	rec := httptest.NewRecorder()
+	ws.executeTemplate(rec, tpl, huge)
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("got status %d for a template which timed out, expected 500", rec.Code)
+	}
+}
+
+func TestLoadTemplatesChecked(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ncdns-tpl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	set := filepath.Join(dir, "custom")
+	if err := os.Mkdir(set, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"layout", "main", "lookup"} {
+		b, err := ioutil.ReadFile(filepath.Join("..", "_tpl", "std", name+".tpl"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(set, name+".tpl"), b, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s := &Server{cfg: Config{TplPath: dir, TplSet: "custom", HTTP: HTTPConfig{TemplateTimeout: 5}}}
+	_, _, lookupPage, unregisteredPage, err := s.loadTemplates()
+	if err != nil {
+		t.Fatalf("Couldn't load a copy of the std templates: %v", err)
+	}
+	if unregisteredPage != lookupPage {
+		t.Errorf("a set without an unregistered page doesn't fall back to its lookup page")
+	}
+
+	// Each page is the layout filled in by the page's template.
+	var buf bytes.Buffer
+	err = executeTemplate(&buf, lookupPage, &lookupInfo{Query: "example.bit", NamecoinName: "d/example"}, time.Second)
+	if err != nil || !strings.Contains(buf.String(), "<!DOCTYPE html>") || !strings.Contains(buf.String(), "d/example") {
+		t.Errorf("lookup page rendered as %q, %v", buf.String(), err)
+	}
+
+	// The template parses, so the error is only found by executing it.
+	bad := `{{define "Main"}}{{if .Query}}{{.NoSuchField}}{{end}}{{end}}`
+	if err := ioutil.WriteFile(filepath.Join(set, "lookup.tpl"), []byte(bad), 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, _, _, _, err = s.loadTemplates()
+	if err == nil || !strings.Contains(err.Error(), "lookup.tpl") {
+		t.Errorf("got error %v loading a lookup template which fails, expected one naming it", err)
+	}
+}
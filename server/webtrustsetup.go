@@ -0,0 +1,71 @@
+//go:build !no_webserver
+// +build !no_webserver
+
+package server
+
+import (
+	"net/http"
+	"sync/atomic"
+)
+
+type trustSetupInfo struct {
+	Confirmed bool          `json:"confirmed"`
+	Refused   uint64        `json:"refused"` // queries refused while unconfirmed
+	Marker    string        `json:"marker"`  // created to confirm the setup
+	Zones     []setupAnchor `json:"zones"`
+}
+
+// Serves the state of setup mode, and the DS records and trust anchors of the
+// KSKs to be trusted. Answered 404 unless SetupMode is set.
+func (ws *webServer) handleTrustSetup(rw http.ResponseWriter, req *http.Request) {
+	ts := ws.s.trustSetup
+	if ts == nil {
+		writeJSON(rw, http.StatusNotFound, &apiError{Error: "ncdns isn't in setup mode"})
+		return
+	}
+
+	writeJSON(rw, http.StatusOK, &trustSetupInfo{
+		Confirmed: ts.isConfirmed(),
+		Refused:   atomic.LoadUint64(&ts.refused),
+		Marker:    ts.marker,
+		Zones:     ws.s.setupAnchors(),
+	})
+}
+
+// Confirms the setup, after which names are served. Only accepted as a POST
+// with a JSON body, whose content is ignored, from a loopback address, as
+// handleDrain is, since anybody able to make this request could have ncdns
+// serve data resolvers can't yet validate.
+func (ws *webServer) handleConfirmTrustSetup(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		rw.Header().Set("Allow", "POST")
+		writeJSON(rw, http.StatusMethodNotAllowed, &apiError{Error: "setup must be confirmed with POST"})
+		return
+	}
+
+	if !isLoopbackRequest(req) {
+		writeJSON(rw, http.StatusForbidden, &apiError{Error: "setup may only be confirmed from a loopback address"})
+		return
+	}
+	if !isJSONRequest(req) {
+		writeJSON(rw, http.StatusUnsupportedMediaType, &apiError{Error: "setup must be confirmed with a JSON body"})
+		return
+	}
+
+	ts := ws.s.trustSetup
+	if ts == nil {
+		writeJSON(rw, http.StatusConflict, &apiError{Error: "ncdns isn't in setup mode"})
+		return
+	}
+	if _, err := ts.confirm(); err != nil {
+		writeJSON(rw, http.StatusInternalServerError, &apiError{Error: err.Error()})
+		return
+	}
+
+	writeJSON(rw, http.StatusOK, &trustSetupInfo{
+		Confirmed: true,
+		Refused:   atomic.LoadUint64(&ts.refused),
+		Marker:    ts.marker,
+		Zones:     ws.s.setupAnchors(),
+	})
+}
@@ -0,0 +1,59 @@
+//go:build !no_webserver
+// +build !no_webserver
+
+package server
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/namecoin/ncdns/clock"
+)
+
+func TestConfirmTrustSetupHTTP(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ncdns-setup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	marker := filepath.Join(dir, setupConfirmedFile)
+	ws := &webServer{s: &Server{trustSetup: &trustSetup{marker: marker, clock: clock.Real}}}
+	confirm := func(method, remoteAddr, contentType, body string) int {
+		req := httptest.NewRequest(method, "/api/v1/setup/confirm", strings.NewReader(body))
+		req.RemoteAddr = remoteAddr
+		req.Header.Set("Content-Type", contentType)
+		rw := httptest.NewRecorder()
+		ws.handleConfirmTrustSetup(rw, req)
+		return rw.Code
+	}
+
+	if code := confirm("GET", "127.0.0.1:1234", "application/json", "{}"); code != http.StatusMethodNotAllowed {
+		t.Errorf("GET returned %d", code)
+	}
+	if code := confirm("POST", "192.0.2.1:1234", "application/json", "{}"); code != http.StatusForbidden {
+		t.Errorf("request from a non-loopback address returned %d", code)
+	}
+	// As a cross-site form would post it.
+	if code := confirm("POST", "127.0.0.1:1234", "application/x-www-form-urlencoded", ""); code != http.StatusUnsupportedMediaType {
+		t.Errorf("form request returned %d", code)
+	}
+	if ws.s.trustSetup.isConfirmed() {
+		t.Fatalf("rejected requests confirmed the setup")
+	}
+
+	if code := confirm("POST", "[::1]:1234", "application/json", "{}"); code != http.StatusOK {
+		t.Fatalf("confirmation returned %d", code)
+	}
+	if !ws.s.trustSetup.isConfirmed() {
+		t.Errorf("setup not confirmed")
+	}
+	if _, err := os.Stat(marker); err != nil {
+		t.Errorf("marker file not written: %v", err)
+	}
+}
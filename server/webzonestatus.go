@@ -0,0 +1,118 @@
+//go:build !no_webserver
+// +build !no_webserver
+
+package server
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/namecoin/ncdns/util"
+)
+
+// The number of times the SOA record of a zone is looked up again if a block
+// is found while it's being looked up, so that the serial reported is that
+// of the block reported along with it.
+const zoneStatusAttempts = 3
+
+type zoneStatus struct {
+	Zone       string `json:"zone"`
+	Serial     uint32 `json:"serial"`
+	SerialMode string `json:"serial_mode"`
+
+	// The best block the serial is derived from, if the block watcher
+	// runs, and when it was noticed.
+	Height         int64      `json:"height,omitempty"`
+	Hash           string     `json:"hash,omitempty"`
+	BlockNoticedAt *time.Time `json:"block_noticed_at,omitempty"`
+
+	// Whether the circuit breaker stopping lookups from the webserver
+	// reaching namecoind is open, and whether the block watcher hasn't
+	// reached namecoind lately, so that the serial may be behind.
+	Degraded bool `json:"degraded"`
+	Stale    bool `json:"stale"`
+
+	// The secondaries which have acknowledged a NOTIFY with Serial, and
+	// each secondary notified, if NotifyTargets is set for the zone.
+	SecondariesNotified *int           `json:"secondaries_notified,omitempty"`
+	Notify              []notifyStatus `json:"notify,omitempty"`
+
+	Error string `json:"error,omitempty"`
+}
+
+type zoneStatusInfo struct {
+	Zones []zoneStatus `json:"zones"`
+}
+
+// Returns the apex of each zone ncdns serves which has keys of its own:
+// CanonicalSuffix, and those of the suffixes of SuffixKeys which are zone
+// apexes, such as bit.corp.example.
+func (s *Server) zoneApexes() []string {
+	apexes := []string{dns.Fqdn(strings.ToLower(s.cfg.CanonicalSuffix))}
+	for _, spec := range s.cfg.suffixKeys {
+		subname, basename, rootname, err := util.SplitDomainByFloatingAnchor(spec.suffix, "bit")
+		if err == nil && subname == "" && basename == "" && rootname != "" && spec.suffix != apexes[0] {
+			apexes = append(apexes, spec.suffix)
+		}
+	}
+	return apexes
+}
+
+// Reports the freshness of zone, whose serial is taken from the SOA record
+// served at its apex, so that it's the one queries get.
+func (s *Server) zoneStatus(zone string) zoneStatus {
+	st := zoneStatus{
+		Zone:       zone,
+		SerialMode: s.cfg.SOASerialMode,
+		Degraded:   s.httpBreaker != nil && s.httpBreaker.State() != breakerClosed,
+		Stale:      s.blockWatcher != nil && s.blockWatcher.stale(),
+	}
+	if st.SerialMode == "" {
+		st.SerialMode = soaSerialBlockHeight
+	}
+
+	for attempt := 1; ; attempt++ {
+		height, hash, noticed := s.chainHeight(), s.chainHash(), s.blockTime()
+		soa, err := s.apexSOA(zone)
+		if err != nil {
+			st.Error = err.Error()
+			return st
+		}
+
+		if attempt < zoneStatusAttempts && (s.chainHeight() != height || s.chainHash() != hash) {
+			continue
+		}
+		st.Serial, st.Height, st.Hash = soa.Serial, height, hash
+		if noticed > 0 {
+			t := time.Unix(noticed, 0).UTC()
+			st.BlockNoticedAt = &t
+		}
+		break
+	}
+
+	if s.notifier != nil && s.notifier.zone == zone {
+		st.Notify = s.notifier.status()
+		notified := 0
+		for _, t := range st.Notify {
+			if t.LastAck != nil && t.LastSerial == st.Serial {
+				notified++
+			}
+		}
+		st.SecondariesNotified = &notified
+	}
+	return st
+}
+
+// Reports the serial of each zone served and how fresh it is, for monitoring:
+// the best block it's derived from, whether namecoind is being reached, and
+// which secondaries have been notified of it.
+func (ws *webServer) handleZoneStatus(rw http.ResponseWriter, req *http.Request) {
+	info := zoneStatusInfo{Zones: []zoneStatus{}}
+	for _, zone := range ws.s.zoneApexes() {
+		info.Zones = append(info.Zones, ws.s.zoneStatus(zone))
+	}
+	writeJSON(rw, http.StatusOK, &info)
+}
@@ -0,0 +1,105 @@
+//go:build !no_webserver
+// +build !no_webserver
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// The serial reported is always the one a query for the SOA record gets.
+func TestZoneStatus(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ncdns-zonestatus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := newServer(newReloadTestConfig(t, dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ws := &webServer{s: s}
+
+	status := func() zoneStatus {
+		rec := httptest.NewRecorder()
+		ws.handleZoneStatus(rec, httptest.NewRequest("GET", "/api/v1/zone-status", nil))
+		var info zoneStatusInfo
+		if err := json.Unmarshal(rec.Body.Bytes(), &info); err != nil {
+			t.Fatal(err)
+		}
+		if len(info.Zones) != 1 || info.Zones[0].Zone != "bit." || info.Zones[0].Error != "" {
+			t.Fatalf("got zones %+v", info.Zones)
+		}
+		return info.Zones[0]
+	}
+	querySerial := func() uint32 {
+		req := new(dns.Msg)
+		req.SetQuestion("bit.", dns.TypeSOA)
+		res, err := s.Query(context.Background(), req, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, rr := range res.Answer {
+			if soa, ok := rr.(*dns.SOA); ok {
+				return soa.Serial
+			}
+		}
+		t.Fatalf("no SOA record in %v", res)
+		return 0
+	}
+
+	if st := status(); st.Serial != querySerial() || st.Height != 0 || st.BlockNoticedAt != nil || st.Degraded || st.Stale {
+		t.Errorf("before any block: got %+v, expected serial %d", st, querySerial())
+	}
+
+	s.busMetrics.handle(&blockConnected{Height: 500, Hash: "00aa"})
+	st := status()
+	if st.Serial != 500 || st.Serial != querySerial() || st.Height != 500 || st.Hash != "00aa" ||
+		st.SerialMode != soaSerialBlockHeight || st.BlockNoticedAt == nil {
+		t.Errorf("at block 500: got %+v, expected serial %d", st, querySerial())
+	}
+
+	s.cfg.SOASerialMode = soaSerialUnixTime
+	s.busMetrics.handle(&blockConnected{Height: 501, Hash: "00bb"})
+	st = status()
+	if st.Serial != querySerial() || st.Serial != uint32(s.blockTime()) || st.Height != 501 || st.SerialMode != soaSerialUnixTime {
+		t.Errorf("with unixtime serials: got %+v, expected serial %d", st, querySerial())
+	}
+
+	// Secondaries are counted as notified once they've acknowledged the
+	// current serial.
+	targets, err := parseNotifyTargets("192.0.2.53:53,192.0.2.54:53", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	targets[0].record(st.Serial, nil, time.Now())
+	targets[1].record(st.Serial-1, nil, time.Now())
+	targets[1].record(0, errors.New("timed out"), time.Now())
+	s.notifier = &notifier{zone: "bit.", targets: targets}
+
+	// The breaker opens after a failure, and a block watcher which hasn't
+	// reached namecoind yet is stale.
+	s.httpBreaker = newCircuitBreaker(1, time.Hour, nil)
+	s.httpBreaker.allow()
+	s.httpBreaker.done(errors.New("connection refused"))
+	s.blockWatcher = &blockWatcher{interval: time.Second}
+
+	st = status()
+	if st.SecondariesNotified == nil || *st.SecondariesNotified != 1 || len(st.Notify) != 2 ||
+		st.Notify[0].LastSerial != st.Serial || st.Notify[1].LastError != "timed out" || st.Notify[1].LastAck == nil {
+		t.Errorf("got notify status %+v", st.Notify)
+	}
+	if !st.Degraded || !st.Stale {
+		t.Errorf("got degraded %v and stale %v, expected both", st.Degraded, st.Stale)
+	}
+}
@@ -0,0 +1,228 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+var update = flag.Bool("update", false, "rewrite golden files")
+
+// A case of the wire-format corpus in testdata/wire/cases: the options set
+// over those of wireTestConfig, the values of the names served, and the query
+// made. The response is compared with the .golden file of the same name.
+type wireCase struct {
+	Config json.RawMessage            `json:"config"`
+	Names  map[string]json.RawMessage `json:"names"`
+	Query  wireQuery                  `json:"query"`
+}
+
+type wireQuery struct {
+	Name      string `json:"name"`
+	Type      string `json:"type"`
+	Transport string `json:"transport"` // udp, the default, or tcp
+	Client    string `json:"client"`    // 192.0.2.1 if not set
+	EDNS      uint16 `json:"edns"`      // the UDP size advertised; no OPT record if 0
+	Version   uint8  `json:"version"`   // of EDNS
+	DO        bool   `json:"do"`
+	CD        bool   `json:"cd"`
+	RD        bool   `json:"rd"`
+}
+
+func (q *wireQuery) String() string {
+	s := fmt.Sprintf("%s %s %s from %s", q.Transport, q.Name, q.Type, q.Client)
+	if q.EDNS != 0 {
+		s += fmt.Sprintf(" edns=%d version=%d", q.EDNS, q.Version)
+	}
+	for _, f := range []struct {
+		set  bool
+		name string
+	}{{q.DO, "do"}, {q.CD, "cd"}, {q.RD, "rd"}} {
+		if f.set {
+			s += " " + f.name
+		}
+	}
+	return s
+}
+
+// The zone is signed with the fixed keys in testdata/wire, and static names
+// never expire, so a response differs between runs only in the validity
+// period and signature of its RRSIGs, which scrubSignatures blanks.
+func wireTestConfig(dir string) *Config {
+	cfg := newErrorTestConfig(dir)
+	cfg.DNSSEC.PublicKey, cfg.DNSSEC.PrivateKey = "ksk.key", "ksk.private"
+	cfg.DNSSEC.ZonePublicKey, cfg.DNSSEC.ZonePrivateKey = "zsk.key", "zsk.private"
+	cfg.Fetcher = "static"
+	cfg.StaticDataDir = "names"
+	cfg.ClockSkewPolicy = clockSkewServFail
+	cfg.CanonicalNameservers = "ns1.example.com"
+	cfg.Hostmaster = "hostmaster@example.com"
+	return cfg
+}
+
+type wireResponseWriter struct {
+	fakeResponseWriter
+}
+
+func (rw *wireResponseWriter) LocalAddr() net.Addr {
+	if _, ok := rw.RemoteAddr().(*net.TCPAddr); ok {
+		return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53}
+	}
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53}
+}
+
+// Replaces the validity period and signature of each RRSIG in m with zeroes,
+// keeping the signature's length, and so that of the message.
+func scrubSignatures(m *dns.Msg) {
+	for _, section := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for i, rr := range section {
+			sig, ok := rr.(*dns.RRSIG)
+			if !ok {
+				continue
+			}
+			c := *sig
+			c.Inception, c.Expiration = 0, 0
+			if b, err := base64.StdEncoding.DecodeString(c.Signature); err == nil {
+				c.Signature = base64.StdEncoding.EncodeToString(make([]byte, len(b)))
+			}
+			section[i] = &c
+		}
+	}
+}
+
+func TestWireGolden(t *testing.T) {
+	cases, err := filepath.Glob("testdata/wire/cases/*.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cases) == 0 {
+		t.Fatal("no cases in testdata/wire/cases")
+	}
+
+	for _, fn := range cases {
+		fn := fn
+		t.Run(strings.TrimSuffix(filepath.Base(fn), ".json"), func(t *testing.T) {
+			runWireCase(t, fn)
+		})
+	}
+}
+
+func runWireCase(t *testing.T, fn string) {
+	data, err := ioutil.ReadFile(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var c wireCase
+	if err := json.Unmarshal(data, &c); err != nil {
+		t.Fatalf("%s: %v", fn, err)
+	}
+
+	dir, err := ioutil.TempDir("", "ncdns-wire")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, key := range []string{"ksk.key", "ksk.private", "zsk.key", "zsk.private"} {
+		b, err := ioutil.ReadFile(filepath.Join("testdata/wire", key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, key), b, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "names"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, value := range c.Names {
+		path := filepath.Join(dir, "names", filepath.FromSlash(name)+".json")
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, value, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cfg := wireTestConfig(dir)
+	if len(c.Config) != 0 {
+		if err := json.Unmarshal(c.Config, cfg); err != nil {
+			t.Fatalf("%s: config: %v", fn, err)
+		}
+	}
+	s, err := newServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	markRunning(s)
+
+	q := c.Query
+	if q.Transport == "" {
+		q.Transport = "udp"
+	}
+	if q.Client == "" {
+		q.Client = "192.0.2.1"
+	}
+	qtype, ok := dns.StringToType[q.Type]
+	if !ok {
+		t.Fatalf("%s: unknown query type %q", fn, q.Type)
+	}
+
+	req := new(dns.Msg)
+	req.SetQuestion(q.Name, qtype)
+	req.Id = 0xbeef
+	req.RecursionDesired = q.RD
+	req.CheckingDisabled = q.CD
+	if q.EDNS != 0 {
+		req.SetEdns0(q.EDNS, q.DO)
+		req.IsEdns0().SetVersion(q.Version)
+	}
+
+	rw := &wireResponseWriter{}
+	ip := net.ParseIP(q.Client)
+	switch q.Transport {
+	case "udp":
+		rw.addr = &net.UDPAddr{IP: ip, Port: 1234}
+	case "tcp":
+		rw.addr = &net.TCPAddr{IP: ip, Port: 1234}
+	default:
+		t.Fatalf("%s: unknown transport %q", fn, q.Transport)
+	}
+	s.ServeDNS(rw, req)
+	if rw.msg == nil {
+		t.Fatal("no response")
+	}
+
+	m := rw.msg
+	scrubSignatures(m)
+	wire, err := m.Pack()
+	if err != nil {
+		t.Fatalf("packing the response: %v", err)
+	}
+	got := fmt.Sprintf("; %s\n%s\n%s", q.String(), m.String(), hex.Dump(wire))
+
+	golden := strings.TrimSuffix(fn, ".json") + ".golden"
+	if *update {
+		if err := ioutil.WriteFile(golden, []byte(got), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expected, err := ioutil.ReadFile(golden)
+	if err != nil {
+		t.Fatalf("%v (run with -update to write it)", err)
+	}
+	if got != string(expected) {
+		t.Errorf("response didn't match %s (run with -update to rewrite it):\n%s", golden, got)
+	}
+}
@@ -0,0 +1,67 @@
+package server
+
+import (
+	"sync/atomic"
+
+	"github.com/miekg/dns"
+
+	"github.com/namecoin/ncdns/backend"
+)
+
+// Returns the work budget for a query, or nil if QueryWorkBudget is 0.
+func (s *Server) newWorkBudget(req *dns.Msg) *backend.WorkBudget {
+	if s.cfg.QueryWorkBudget <= 0 {
+		return nil
+	}
+	return backend.NewWorkBudget(s.cfg.QueryWorkBudget, req.Question[0].Name)
+}
+
+// Wraps rw so that the signatures of the response are charged to wb, and a
+// query whose budget ran out before it could be answered is answered
+// SERVFAIL, saying why. Returns rw unchanged if wb is nil.
+func (s *Server) workBudgetWriter(rw dns.ResponseWriter, req *dns.Msg, wb *backend.WorkBudget) dns.ResponseWriter {
+	if wb == nil {
+		return rw
+	}
+	return &workBudgetWriter{ResponseWriter: rw, s: s, req: req, wb: wb}
+}
+
+type workBudgetWriter struct {
+	dns.ResponseWriter
+	s   *Server
+	req *dns.Msg
+	wb  *backend.WorkBudget
+}
+
+func (rw *workBudgetWriter) WriteMsg(m *dns.Msg) error {
+	sigs := 0
+	for _, section := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, rr := range section {
+			if _, ok := rr.(*dns.RRSIG); ok {
+				sigs++
+			}
+		}
+	}
+	rw.wb.Charge("sign", backend.WorkUsage{Signatures: sigs})
+
+	// The engine answers SERVFAIL if it couldn't do without an optional
+	// lookup which was refused, as when the budget runs out.
+	r := rw.wb.Report()
+	switch {
+	case len(r.Refused) == 0:
+	case r.Exhausted || m.Rcode == dns.RcodeServerFailure:
+		atomic.AddUint64(&rw.s.workBudgetExhausted, 1)
+		log.Debugf("work budget of the query for %s exhausted: %d units spent, refused %v", rw.req.Question[0].Name, r.Spent, r.Refused)
+		m = servFailResponse(m)
+		if opt := m.IsEdns0(); opt != nil {
+			opt.Option = append(opt.Option, &dns.EDNS0_EDE{
+				InfoCode:  dns.ExtendedErrorCodeOther,
+				ExtraText: "the work needed to answer exceeds the query's budget",
+			})
+		}
+	default:
+		atomic.AddUint64(&rw.s.workBudgetTrimmed, 1)
+	}
+
+	return rw.ResponseWriter.WriteMsg(m)
+}
@@ -0,0 +1,89 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+
+	"github.com/namecoin/ncdns/backend"
+)
+
+// A response is passed on with the optional work left out of it, but one the
+// engine couldn't give for want of budget is replaced with SERVFAIL, saying
+// why.
+func TestWorkBudgetWriter(t *testing.T) {
+	s := &Server{cfg: Config{QueryWorkBudget: 8}}
+	req := new(dns.Msg)
+	req.SetQuestion("www.example.bit.", dns.TypeA)
+	req.SetEdns0(1232, true)
+
+	answer := func(wb *backend.WorkBudget, rcode int) *dns.Msg {
+		m := new(dns.Msg)
+		m.SetRcode(req, rcode)
+		m.SetEdns0(1232, true)
+		if rcode == dns.RcodeSuccess {
+			rr, _ := dns.NewRR("www.example.bit. 600 IN A 192.0.2.1")
+			sig, _ := dns.NewRR("www.example.bit. 600 IN RRSIG A 8 3 600 20300101000000 20200101000000 1 bit. AAAA")
+			m.Answer = []dns.RR{rr, sig}
+		}
+		rw := &fakeResponseWriter{}
+		if err := s.workBudgetWriter(rw, req, wb).WriteMsg(m); err != nil {
+			t.Fatal(err)
+		}
+		return rw.msg
+	}
+
+	// Within the budget, the response is unchanged, and its signatures are
+	// charged.
+	wb := s.newWorkBudget(req)
+	if res := answer(wb, dns.RcodeSuccess); res.Rcode != dns.RcodeSuccess || len(res.Answer) != 2 {
+		t.Errorf("got %v within the budget", res)
+	}
+	if r := wb.Report(); r.Stages["sign"].Signatures != 1 {
+		t.Errorf("got work %+v", r)
+	}
+
+	// An import left out leaves a partial answer.
+	wb = s.newWorkBudget(req)
+	wb.Spend("import", backend.WorkUsage{Fetches: 7}, true)
+	if res := answer(wb, dns.RcodeSuccess); res.Rcode != dns.RcodeSuccess || len(res.Answer) != 2 {
+		t.Errorf("got %v with optional work refused", res)
+	}
+
+	// Work refused which the answer needed makes it SERVFAIL.
+	for _, optional := range []bool{true, false} {
+		wb = s.newWorkBudget(req)
+		wb.Spend("query", backend.WorkUsage{Lookups: 9}, optional)
+		// The engine gives up on its own only if refused optional work.
+		rcode := dns.RcodeSuccess
+		if optional {
+			rcode = dns.RcodeServerFailure
+		}
+		res := answer(wb, rcode)
+		if res.Rcode != dns.RcodeServerFailure || len(res.Answer) != 0 {
+			t.Errorf("optional %v: got %v with the budget exhausted", optional, res)
+			continue
+		}
+		var ede *dns.EDNS0_EDE
+		if opt := res.IsEdns0(); opt != nil {
+			for _, o := range opt.Option {
+				if e, ok := o.(*dns.EDNS0_EDE); ok {
+					ede = e
+				}
+			}
+		}
+		if ede == nil || ede.InfoCode != dns.ExtendedErrorCodeOther {
+			t.Errorf("optional %v: got EDE %v", optional, ede)
+		}
+	}
+
+	if st := s.responseStatus(); st.WorkBudgetTrimmed != 1 || st.WorkBudgetExhausted != 2 {
+		t.Errorf("got status %+v", st)
+	}
+
+	// A budget of 0 is unlimited, and costs nothing.
+	s.cfg.QueryWorkBudget = 0
+	if wb := s.newWorkBudget(req); wb != nil {
+		t.Errorf("got a budget %+v with QueryWorkBudget 0", wb.Report())
+	}
+}
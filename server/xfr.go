@@ -0,0 +1,635 @@
+package server
+
+import (
+	"context"
+	"crypto"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"gopkg.in/hlandau/madns.v2/merr"
+
+	"github.com/namecoin/ncdns/backend"
+	"github.com/namecoin/ncdns/clock"
+	"github.com/namecoin/ncdns/namecoin"
+	"github.com/namecoin/ncdns/ncdumpzone"
+	"github.com/namecoin/ncdns/rrsort"
+)
+
+// The most bytes put in each message of a zone transfer. RFC 5936 allows up
+// to 65535, but smaller messages are kinder to secondaries which process
+// them as they arrive.
+const xferMessageSize = 16384
+
+// How long the signatures of a transferred zone are valid for. Namecoin
+// finds a block every ten minutes or so, changing the SOA serial, so
+// secondaries transfer the zone again, with fresh signatures, long before
+// they expire.
+const xferSignatureValidity = 14 * 24 * time.Hour
+
+// How far the time of a TSIG-signed message may be from the time it's
+// checked, in seconds, as RFC 8945 recommends.
+const tsigFudge = 300
+
+// The TSIG algorithms a key of TSIGKey may use, by the names they're given.
+var tsigAlgorithms = map[string]string{
+	"hmac-sha1":   dns.HmacSHA1,
+	"hmac-sha256": dns.HmacSHA256,
+	"hmac-sha384": dns.HmacSHA384,
+	"hmac-sha512": dns.HmacSHA512,
+}
+
+// Who may transfer the zone, and the zone as last built for a transfer.
+type zoneTransfers struct {
+	zone    string // the apex, fully qualified and in lower case
+	allowed []*net.IPNet
+
+	// By key name, fully qualified and in lower case. The secrets are given
+	// to the dns.Server, which checks the signatures of queries.
+	algorithms map[string]string
+	secrets    map[string]string
+
+	mu      sync.Mutex // held while the zone is built, so that it's built once
+	cached  *transferredZone
+	journal *xferJournal // guarded by mu; nil if IXFRJournalBlocks is 0
+}
+
+type transferredZone struct {
+	serial  uint32
+	backend *backend.Backend
+	keys    *keySet
+	rrs     []dns.RR
+}
+
+// Parses Config.TSIGKey, a comma-separated list of keys, each
+// name:algorithm:secret with the secret in base64, returning the algorithm
+// and the secret of each by name. Errors don't include the secrets.
+func parseTSIGKeys(s string) (algorithms, secrets map[string]string, err error) {
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		parts := strings.SplitN(item, ":", 3)
+		name := strings.ToLower(dns.Fqdn(strings.TrimSpace(parts[0])))
+		if len(parts) != 3 {
+			return nil, nil, fmt.Errorf("TSIG key %s isn't of the form name:algorithm:secret", name)
+		}
+		if _, ok := dns.IsDomainName(name); !ok || name == "." {
+			return nil, nil, fmt.Errorf("TSIG key name %q isn't a domain name", parts[0])
+		}
+
+		algorithm, ok := tsigAlgorithms[strings.ToLower(strings.TrimSuffix(strings.TrimSpace(parts[1]), "."))]
+		if !ok {
+			return nil, nil, fmt.Errorf("TSIG key %s has unknown algorithm %q; use hmac-sha256, hmac-sha384, hmac-sha512 or hmac-sha1", name, parts[1])
+		}
+
+		secret := strings.TrimSpace(parts[2])
+		if b, err := base64.StdEncoding.DecodeString(secret); err != nil || len(b) == 0 {
+			return nil, nil, fmt.Errorf("TSIG key %s has a secret which isn't base64", name)
+		}
+
+		if _, ok := secrets[name]; ok {
+			return nil, nil, fmt.Errorf("Duplicate TSIG key: %s", name)
+		}
+		if secrets == nil {
+			algorithms, secrets = map[string]string{}, map[string]string{}
+		}
+		algorithms[name], secrets[name] = algorithm, secret
+	}
+
+	return algorithms, secrets, nil
+}
+
+// Enables transfers of the zone CanonicalSuffix if XferAllowedIPs or TSIGKey
+// is set.
+func (s *Server) setupTransfers() error {
+	allowed, err := parseIPNets("XferAllowedIPs", s.cfg.XferAllowedIPs)
+	if err != nil {
+		return err
+	}
+	algorithms, secrets, err := parseTSIGKeys(s.cfg.TSIGKey)
+	if err != nil {
+		return err
+	}
+	if len(allowed) == 0 && len(secrets) == 0 {
+		return nil
+	}
+
+	if !s.cfg.usesNamecoind() {
+		return fmt.Errorf("XferAllowedIPs and TSIGKey require the namecoind fetcher")
+	}
+	if len(s.cfg.suffixKeys) > 0 || len(s.cfg.unsignedNames) > 0 {
+		return fmt.Errorf("XferAllowedIPs and TSIGKey can't be used with SuffixKeys or UnsignedNames, whose names aren't signed with the zone's keys")
+	}
+	zone := strings.ToLower(dns.Fqdn(s.cfg.CanonicalSuffix))
+	if !isZoneApex(zone) {
+		return fmt.Errorf("CanonicalSuffix %s isn't a zone ncdns serves, so it can't be transferred", zone)
+	}
+
+	if s.cfg.IXFRJournalBlocks < 0 || s.cfg.IXFRJournalMaxRecords < 0 {
+		return fmt.Errorf("IXFRJournalBlocks and IXFRJournalMaxRecords must not be negative")
+	}
+
+	s.xfer = &zoneTransfers{
+		zone:       zone,
+		allowed:    allowed,
+		algorithms: algorithms,
+		secrets:    secrets,
+	}
+	if s.cfg.IXFRJournalBlocks > 0 && s.cfg.IXFRJournalMaxRecords > 0 {
+		s.xfer.journal = &xferJournal{
+			maxVersions: s.cfg.IXFRJournalBlocks,
+			maxRecords:  s.cfg.IXFRJournalMaxRecords,
+		}
+	}
+	return nil
+}
+
+// Returns the secrets of TSIGKey by key name, for the dns.Server to check
+// the signatures of queries, or nil if there are none.
+func (s *Server) tsigSecrets() map[string]string {
+	if s.xfer == nil {
+		return nil
+	}
+	return s.xfer.secrets
+}
+
+// The serial of the zone's SOA record: by SOASerialMode, the height of
+// namecoind's best block as last seen by the block watcher, or the Unix time
+// at which the watcher noticed it, so that secondaries transfer the zone
+// again after each block. It's 1 until a block is known.
+func (s *Server) soaSerial() uint32 {
+	if s.cfg.SOASerialMode == soaSerialUnixTime {
+		if t := s.blockTime(); t > 0 {
+			return uint32(t)
+		}
+		return 1
+	}
+
+	if height := s.chainHeight(); height > 0 {
+		return uint32(height)
+	}
+	return 1
+}
+
+// Answers an AXFR over TCP, or an IXFR over TCP, if zone transfers are
+// enabled. An IXFR is answered with the changes since the client's serial if
+// they're in the journal, and otherwise with the whole zone, as RFC 1995
+// allows. Returns false if req isn't such a query, so that it's answered as
+// usual.
+//
+// A client may transfer the zone if it's in XferAllowedIPs, or if it signs
+// its query with one of the keys of TSIGKey, in which case the transfer is
+// signed with it too. A query signed with an unknown key or a bad signature
+// is refused wherever it's from.
+func (s *Server) serveTransfer(rw dns.ResponseWriter, req *dns.Msg) bool {
+	if s.xfer == nil || req.Opcode != dns.OpcodeQuery || len(req.Question) != 1 {
+		return false
+	}
+	q := req.Question[0]
+	if _, tcp := rw.RemoteAddr().(*net.TCPAddr); !tcp || (q.Qtype != dns.TypeAXFR && q.Qtype != dns.TypeIXFR) {
+		return false
+	}
+	s.metaQueries.add(dns.TypeToString[q.Qtype])
+
+	tsig, err := s.xfer.authorize(rw, req)
+	if err != nil {
+		s.unsolicited.warnf(clientIP(rw), "refused transfer of %s to %s: %v", q.Name, rw.RemoteAddr(), err)
+		writeTransferRcode(rw, req, dns.RcodeRefused, nil)
+		return true
+	}
+	if !strings.EqualFold(q.Name, s.xfer.zone) {
+		writeTransferRcode(rw, req, dns.RcodeNotAuth, tsig)
+		return true
+	}
+
+	rrs, err := s.transferZone()
+	if err != nil {
+		log.Errore(err, "couldn't build zone ", s.xfer.zone, " to transfer to ", rw.RemoteAddr())
+		writeTransferRcode(rw, req, dns.RcodeServerFailure, tsig)
+		return true
+	}
+
+	cur := rrs[0].(*dns.SOA)
+	var diff []dns.RR
+	if q.Qtype == dns.TypeIXFR {
+		diff = s.xfer.incremental(req, cur)
+	}
+	if diff != nil {
+		rrs = diff
+	}
+
+	err = writeTransfer(rw, req, rrs, tsig)
+	if err != nil {
+		log.Warne(err, "transfer of ", s.xfer.zone, " to ", rw.RemoteAddr(), " failed")
+		return true
+	}
+	switch {
+	case len(diff) == 1:
+		log.Debugf("%s already has serial %d of %s", rw.RemoteAddr(), cur.Serial, s.xfer.zone)
+	case diff != nil:
+		log.Infof("transferred %s from serial %d to %d (%d records changed) to %s", s.xfer.zone, diff[1].(*dns.SOA).Serial, cur.Serial, len(diff)-4, rw.RemoteAddr())
+	default:
+		log.Infof("transferred %s with serial %d (%d records) to %s", s.xfer.zone, cur.Serial, len(rrs)-1, rw.RemoteAddr())
+	}
+	return true
+}
+
+// Decides whether the client which sent req may transfer the zone, returning
+// the TSIG record req is signed with, if any, or why it may not.
+func (x *zoneTransfers) authorize(rw dns.ResponseWriter, req *dns.Msg) (*dns.TSIG, error) {
+	if t := req.IsTsig(); t != nil {
+		algorithm, ok := x.algorithms[strings.ToLower(t.Hdr.Name)]
+		switch {
+		case !ok:
+			return nil, fmt.Errorf("unknown TSIG key %s", t.Hdr.Name)
+		case !strings.EqualFold(t.Algorithm, algorithm):
+			return nil, fmt.Errorf("TSIG key %s used with algorithm %s", t.Hdr.Name, t.Algorithm)
+		case rw.TsigStatus() != nil:
+			return nil, fmt.Errorf("bad signature by TSIG key %s: %v", t.Hdr.Name, rw.TsigStatus())
+		}
+		return t, nil
+	}
+
+	if ip := clientIP(rw); ip != nil && ipNetsContain(x.allowed, ip) {
+		return nil, nil
+	}
+	return nil, fmt.Errorf("not in XferAllowedIPs, and not signed with a TSIG key")
+}
+
+func writeTransferRcode(rw dns.ResponseWriter, req *dns.Msg, rcode int, tsig *dns.TSIG) {
+	m := new(dns.Msg)
+	m.SetRcode(req, rcode)
+	if tsig != nil {
+		// The system clock's, as the client checks it against its own.
+		m.SetTsig(tsig.Hdr.Name, tsig.Algorithm, tsigFudge, time.Now().Unix())
+	}
+	rw.WriteMsg(m)
+}
+
+// Writes the records of a zone transfer to rw, as many to each message as
+// fit in xferMessageSize. If tsig is set, each message is signed with its
+// key, as RFC 8945 says.
+func writeTransfer(rw dns.ResponseWriter, req *dns.Msg, rrs []dns.RR, tsig *dns.TSIG) error {
+	newMsg := func() *dns.Msg {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		m.Authoritative = true
+		m.Compress = true
+		return m
+	}
+	m := newMsg()
+	send := func() error {
+		if tsig != nil {
+			// As in writeTransferRcode.
+			m.SetTsig(tsig.Hdr.Name, tsig.Algorithm, tsigFudge, time.Now().Unix())
+		}
+		if err := rw.WriteMsg(m); err != nil {
+			return err
+		}
+		// Each message's MAC covers the previous one's and only the
+		// timers of its own TSIG record.
+		rw.TsigTimersOnly(true)
+		m = newMsg()
+		return nil
+	}
+
+	for _, rr := range rrs {
+		m.Answer = append(m.Answer, rr)
+		if len(m.Answer) > 1 && m.Len() > xferMessageSize {
+			m.Answer = m.Answer[:len(m.Answer)-1]
+			if err := send(); err != nil {
+				return err
+			}
+			m.Answer = append(m.Answer, rr)
+		}
+	}
+
+	return send()
+}
+
+// Returns the records of the zone to transfer, its SOA first and last. The
+// zone is built afresh unless it was already built with the same serial,
+// backend and keys, reusing the signatures of the last version which are
+// still good, and its differences from that version are journaled.
+func (s *Server) transferZone() ([]dns.RR, error) {
+	x := s.xfer
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	b, ks := s.currentBackend(), s.globalKeys()
+	if c := x.cached; c != nil && c.serial == s.soaSerial() && c.backend == b && c.keys == ks {
+		return c.rrs, nil
+	}
+
+	now := clock.Or(s.clock).Now()
+	var prev []dns.RR
+	var reuse map[string]*dns.RRSIG
+	if c := x.cached; c != nil {
+		prev = c.rrs
+		reuse = reusableSignatures(c.rrs, now)
+	}
+	rrs, err := buildZone(b, ks, x.zone, reuse, now, func(f func(name string, nameData *namecoin.NameData) error) error {
+		_, err := ncdumpzone.WalkNames(s.namecoinConn, &ncdumpzone.Options{Pacer: s.zoneWalkPacer}, f)
+		return err
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if x.journal != nil {
+		x.journal.record(prev, rrs)
+	}
+	x.cached = &transferredZone{
+		serial:  rrs[0].(*dns.SOA).Serial,
+		backend: b,
+		keys:    ks,
+		rrs:     rrs,
+	}
+	return rrs, nil
+}
+
+// Builds the zone whose apex is zone from the records b serves: those at the
+// apex, the addresses of its nameservers if they're in the zone, and those
+// of each name walk calls its function with. If ks has a ZSK, the zone is
+// signed with ks as of now, and chained with NSEC records, reusing the
+// signatures of reuse, keyed by the text of the RRsets they cover, made by
+// the same key.
+// Response policy rules aren't applied, since they're this server's own. The
+// SOA record is first and last. A name whose records can't be made is left
+// out, and passed to skipped with the error, or logged if skipped is nil.
+func buildZone(b *backend.Backend, ks *keySet, zone string, reuse map[string]*dns.RRSIG, now time.Time, walk func(f func(name string, nameData *namecoin.NameData) error) error, skipped func(name string, err error)) ([]dns.RR, error) {
+	apex, err := b.Lookup(zone, "")
+	if err != nil {
+		return nil, err
+	}
+
+	z := &zoneBuilder{zone: zone, rrsets: map[rrsetKey][]dns.RR{}, reuse: reuse}
+	z.add(apex)
+
+	// The nameservers' own names, e.g. SelfName, are served as such, whatever
+	// Namecoin says of them.
+	for _, rr := range apex {
+		ns, ok := rr.(*dns.NS)
+		if !ok || !dns.IsSubDomain(zone, strings.ToLower(ns.Ns)) || strings.EqualFold(ns.Ns, zone) {
+			continue
+		}
+		rrs, err := b.Lookup(ns.Ns, "")
+		if err != nil && !errors.Is(err, merr.ErrNoSuchDomain) {
+			return nil, fmt.Errorf("couldn't look up nameserver %s: %v", ns.Ns, err)
+		}
+		z.add(rrs)
+		z.reserved = append(z.reserved, strings.ToLower(ns.Ns))
+	}
+
+	ctx := context.Background()
+	err = walk(func(name string, nameData *namecoin.NameData) error {
+		rrs, err := b.NameRecords(ctx, name, nameData, zone)
+		if errors.Is(err, merr.ErrNoSuchDomain) {
+			return nil
+		}
+		if err != nil {
+			if skipped == nil {
+				log.Warne(err, "leaving ", name, " out of the transfer of ", zone)
+			} else {
+				skipped(name, err)
+			}
+			return nil
+		}
+		z.add(rrs)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return z.finish(ks, now)
+}
+
+type rrsetKey struct {
+	name   string // in lower case
+	rrtype uint16
+}
+
+// Gathers the records of a zone, to be put in order, signed and chained.
+type zoneBuilder struct {
+	zone   string
+	rrsets map[rrsetKey][]dns.RR
+
+	// Names whose records have been added, and at and below which no more
+	// are.
+	reserved []string
+
+	// Signatures which may be used again, by the text of the RRsets they
+	// cover.
+	reuse map[string]*dns.RRSIG
+}
+
+func (z *zoneBuilder) add(rrs []dns.RR) {
+	for _, rr := range rrs {
+		name := strings.ToLower(rr.Header().Name)
+		if !dns.IsSubDomain(z.zone, name) || z.isReserved(name) {
+			continue
+		}
+
+		// Copied, since their TTLs may be changed, and records looked up may
+		// be the cache's.
+		key := rrsetKey{name, rr.Header().Rrtype}
+		if !containsDuplicate(z.rrsets[key], rr) {
+			z.rrsets[key] = append(z.rrsets[key], dns.Copy(rr))
+		}
+	}
+}
+
+func (z *zoneBuilder) isReserved(name string) bool {
+	for _, r := range z.reserved {
+		if dns.IsSubDomain(r, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the zone's records in canonical order, the SOA first and last,
+// with the records of each RRset in the canonical order of their RDATA.
+// Each name's records are followed by its NSEC record and the RRSIGs of
+// both, if the zone is signed.
+func (z *zoneBuilder) finish(ks *keySet, now time.Time) ([]dns.RR, error) {
+	soas := z.rrsets[rrsetKey{z.zone, dns.TypeSOA}]
+	if len(soas) != 1 {
+		return nil, fmt.Errorf("no SOA record at %s", z.zone)
+	}
+	soa := soas[0].(*dns.SOA)
+
+	signed := ks != nil && ks.ZSK != nil
+	if signed {
+		keys := []*dns.DNSKEY{ks.KSK, ks.ZSK}
+		for _, k := range append(keys, ks.PublishedZSKs...) {
+			if k == nil {
+				continue
+			}
+			k = dns.Copy(k).(*dns.DNSKEY)
+			k.Hdr.Name, k.Hdr.Ttl = z.zone, soa.Hdr.Ttl
+			z.add([]dns.RR{k})
+		}
+	}
+
+	// The types at each name, and the delegations among them.
+	types := map[string][]uint16{}
+	cuts := map[string]bool{}
+	for key := range z.rrsets {
+		types[key.name] = append(types[key.name], key.rrtype)
+		if key.rrtype == dns.TypeNS && key.name != z.zone {
+			cuts[key.name] = true
+		}
+	}
+	names := make([]string, 0, len(types))
+	for name := range types {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return rrsort.CompareNames(names[i], names[j]) < 0
+	})
+
+	// Names below a delegation hold glue, which isn't signed or chained.
+	occluded := func(name string) bool {
+		for n := name; n != z.zone; {
+			i := strings.IndexByte(n, '.')
+			if i < 0 || i == len(n)-1 {
+				return false
+			}
+			n = n[i+1:]
+			if cuts[n] {
+				return true
+			}
+		}
+		return false
+	}
+	var chain []string
+	for _, name := range names {
+		if !occluded(name) {
+			chain = append(chain, name)
+		}
+	}
+	next := map[string]string{}
+	for i, name := range chain {
+		next[name] = chain[(i+1)%len(chain)]
+	}
+
+	sign := func(rrset []dns.RR) (*dns.RRSIG, error) {
+		key, priv := ks.ZSK, ks.ZSKPrivate
+		if rrset[0].Header().Rrtype == dns.TypeDNSKEY && ks.KSK != nil {
+			key, priv = ks.KSK, ks.KSKPrivate
+		}
+		if sig, ok := z.reuse[rrsetText(rrset)]; ok && sig.KeyTag == key.KeyTag() && sig.Algorithm == key.Algorithm {
+			return sig, nil
+		}
+		signer, ok := priv.(crypto.Signer)
+		if !ok {
+			return nil, fmt.Errorf("key %d can't sign", key.KeyTag())
+		}
+
+		sig := &dns.RRSIG{
+			Hdr: dns.RR_Header{
+				Name:   rrset[0].Header().Name,
+				Rrtype: dns.TypeRRSIG,
+				Class:  dns.ClassINET,
+				Ttl:    rrset[0].Header().Ttl,
+			},
+			Algorithm:  key.Algorithm,
+			KeyTag:     key.KeyTag(),
+			SignerName: z.zone,
+			Inception:  uint32(now.Add(-sigGuardBackdate).Unix()),
+			Expiration: uint32(now.Add(xferSignatureValidity).Unix()),
+		}
+		if err := sig.Sign(signer, rrset); err != nil {
+			return nil, fmt.Errorf("couldn't sign %s %s: %v", rrset[0].Header().Name, dns.TypeToString[rrset[0].Header().Rrtype], err)
+		}
+		return sig, nil
+	}
+
+	nsecTTL := soa.Minttl
+	if soa.Hdr.Ttl < nsecTTL {
+		nsecTTL = soa.Hdr.Ttl
+	}
+
+	out := []dns.RR{soa}
+	for _, name := range names {
+		rrtypes := types[name]
+		sort.Slice(rrtypes, func(i, j int) bool { return rrtypes[i] < rrtypes[j] })
+		glue, cut := occluded(name), cuts[name]
+
+		var bitmap []uint16
+		for _, rrtype := range rrtypes {
+			rrset := z.rrsets[rrsetKey{name, rrtype}]
+			sameTTL(rrset)
+			rrsort.SortRRset(rrset)
+			if rrtype != dns.TypeSOA || name != z.zone {
+				out = append(out, rrset...)
+			}
+
+			// At a delegation, only the DS records are the zone's own.
+			authoritative := !glue && (!cut || rrtype == dns.TypeDS)
+			if !glue && (authoritative || rrtype == dns.TypeNS) {
+				bitmap = append(bitmap, rrtype)
+			}
+			if signed && authoritative {
+				sig, err := sign(rrset)
+				if err != nil {
+					return nil, err
+				}
+				out = append(out, sig)
+			}
+		}
+
+		if !signed || glue {
+			continue
+		}
+		nsec := &dns.NSEC{
+			Hdr: dns.RR_Header{
+				Name:   name,
+				Rrtype: dns.TypeNSEC,
+				Class:  dns.ClassINET,
+				Ttl:    nsecTTL,
+			},
+			NextDomain: next[name],
+			TypeBitMap: appendNSECTypes(bitmap, dns.TypeRRSIG, dns.TypeNSEC),
+		}
+		sig, err := sign([]dns.RR{nsec})
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, nsec, sig)
+	}
+
+	return append(out, soa), nil
+}
+
+// Adds rrtypes to the sorted types of an NSEC record's bitmap.
+func appendNSECTypes(bitmap []uint16, rrtypes ...uint16) []uint16 {
+	bitmap = append(bitmap, rrtypes...)
+	sort.Slice(bitmap, func(i, j int) bool { return bitmap[i] < bitmap[j] })
+	return bitmap
+}
+
+// Gives the records of an RRset the lowest of their TTLs, as RFC 2181 says
+// is done when they differ.
+func sameTTL(rrset []dns.RR) {
+	ttl := rrset[0].Header().Ttl
+	for _, rr := range rrset {
+		if rr.Header().Ttl < ttl {
+			ttl = rr.Header().Ttl
+		}
+	}
+	for _, rr := range rrset {
+		rr.Header().Ttl = ttl
+	}
+}
@@ -0,0 +1,365 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/rpcclient"
+	"github.com/miekg/dns"
+
+	"github.com/namecoin/ncdns/backend"
+	"github.com/namecoin/ncdns/namecoin"
+)
+
+func TestTransferConfig(t *testing.T) {
+	const secret = "c2VjcmV0LXNlY3JldC1zZWNyZXQ="
+
+	tests := []struct {
+		allowed, keys string
+		err           string // "": valid
+		enabled       bool
+	}{
+		{"", "", "", false},
+		{"192.0.2.1, 2001:db8::/32", "", "", true},
+		{"", "xfr.example:hmac-sha256:" + secret, "", true},
+		{"", "xfr.example.:HMAC-SHA512.:" + secret + ",other.example:hmac-sha1:" + secret, "", true},
+		{"192.0.2.300", "", "XferAllowedIPs", false},
+		{"192.0.2.0/33", "", "XferAllowedIPs", false},
+		{"", "xfr.example:hmac-sha256", "name:algorithm:secret", false},
+		{"", "xfr.example:hmac-md5:" + secret, "unknown algorithm", false},
+		{"", "xfr.example:hmac-sha256:not base64!", "isn't base64", false},
+		{"", "xfr.example:hmac-sha256:" + secret + ",XFR.example.:hmac-sha1:" + secret, "Duplicate", false},
+	}
+
+	for _, test := range tests {
+		s := &Server{cfg: Config{CanonicalSuffix: "bit", XferAllowedIPs: test.allowed, TSIGKey: test.keys}}
+		err := s.setupTransfers()
+		switch {
+		case test.err == "" && err != nil:
+			t.Errorf("%q %q: unexpected error: %v", test.allowed, test.keys, err)
+		case test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)):
+			t.Errorf("%q %q: got error %v, expected one mentioning %q", test.allowed, test.keys, err, test.err)
+		case err != nil && strings.Contains(err.Error(), secret):
+			t.Errorf("%q %q: error gives the secret away: %v", test.allowed, test.keys, err)
+		case (s.xfer != nil) != test.enabled:
+			t.Errorf("%q %q: transfers enabled: %v", test.allowed, test.keys, s.xfer != nil)
+		}
+	}
+
+	// Transfers of a zone whose names are signed with other keys aren't
+	// allowed.
+	s := &Server{cfg: Config{CanonicalSuffix: "bit", XferAllowedIPs: "192.0.2.1"}}
+	s.cfg.unsignedNames = []string{"example.bit."}
+	if err := s.setupTransfers(); err == nil {
+		t.Errorf("transfers allowed with UnsignedNames")
+	}
+}
+
+// Transfers the zone of a fake namecoind over TCP, as a secondary would.
+func TestZoneTransfer(t *testing.T) {
+	const keyName, secret = "xfr.example.", "c2VjcmV0LXNlY3JldC1zZWNyZXQ="
+
+	rpcSrv := httptest.NewServer(newFakeZoneRPC())
+	defer rpcSrv.Close()
+	conn, err := namecoin.New(&rpcclient.ConnConfig{
+		Host:         strings.TrimPrefix(rpcSrv.URL, "http://"),
+		User:         "user",
+		Pass:         "pass",
+		HTTPPostMode: true,
+		DisableTLS:   true,
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Shutdown()
+
+	ks, err := generateKeySet("bit.")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only secondaries with the key may transfer the zone from 127.0.0.1.
+	s := &Server{
+		cfg: Config{
+			CanonicalSuffix: "bit",
+			XferAllowedIPs:  "192.0.2.0/24",
+			TSIGKey:         keyName + ":hmac-sha256:" + secret,
+		},
+		namecoinConn: conn,
+		globalKeySet: ks,
+		busMetrics:   &busMetrics{},
+		clientStats:  newClientStats(10000, time.Minute, 0, 0, nil),
+	}
+	if err := s.setupTransfers(); err != nil {
+		t.Fatal(err)
+	}
+	s.backend, err = backend.New(&backend.Config{CacheMaxEntries: 100, SOASerial: s.soaSerial})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan struct{})
+	ds := &dns.Server{
+		Listener:          l,
+		Handler:           s,
+		TsigSecret:        s.tsigSecrets(),
+		NotifyStartedFunc: func() { close(started) },
+	}
+	go ds.ActivateAndServe()
+	defer ds.Shutdown()
+	<-started
+
+	transfer := func(secret string) ([]dns.RR, int, error) {
+		req := new(dns.Msg)
+		req.SetAxfr("bit.")
+		tr := &dns.Transfer{}
+		if secret != "" {
+			req.SetTsig(keyName, dns.HmacSHA256, 300, time.Now().Unix())
+			tr.TsigSecret = map[string]string{keyName: secret}
+		}
+
+		envs, err := tr.In(req, l.Addr().String())
+		if err != nil {
+			return nil, 0, err
+		}
+		var rrs []dns.RR
+		messages := 0
+		for env := range envs {
+			if env.Error != nil {
+				return nil, 0, env.Error
+			}
+			rrs = append(rrs, env.RR...)
+			messages++
+		}
+		return rrs, messages, nil
+	}
+
+	if rrs, _, err := transfer(""); err == nil {
+		t.Errorf("unsigned transfer from 127.0.0.1 not refused: %d records", len(rrs))
+	}
+	if rrs, _, err := transfer("d3Jvbmctc2VjcmV0"); err == nil {
+		t.Errorf("transfer signed with the wrong secret not refused: %d records", len(rrs))
+	}
+
+	rrs, messages, err := transfer(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if messages < 2 {
+		t.Errorf("zone transferred in %d messages, expected several", messages)
+	}
+	if len(rrs) < 2 || rrs[0].Header().Rrtype != dns.TypeSOA || rrs[len(rrs)-1].Header().Rrtype != dns.TypeSOA {
+		t.Fatalf("transfer doesn't start and end with the SOA: %d records", len(rrs))
+	}
+	if serial := rrs[0].(*dns.SOA).Serial; serial != 1 {
+		t.Errorf("SOA serial %d before a block was seen, expected 1", serial)
+	}
+
+	counts := map[uint16]int{}
+	for _, rr := range rrs[1 : len(rrs)-1] {
+		counts[rr.Header().Rrtype]++
+		if rr.Header().Rrtype == dns.TypeSOA {
+			t.Errorf("SOA in the middle of the transfer")
+		}
+	}
+	// Each of the 1000 names has an A record, an NSEC record and an RRSIG for
+	// each; so does the apex, with its NS, SOA and DNSKEY records besides.
+	if counts[dns.TypeA] != 1000 || counts[dns.TypeNSEC] != 1001 || counts[dns.TypeDNSKEY] != 2 ||
+		counts[dns.TypeRRSIG] != 2*1000+4 {
+		t.Errorf("unexpected records transferred: %v", counts)
+	}
+
+	for _, rr := range rrs {
+		nsec, ok := rr.(*dns.NSEC)
+		if ok && nsec.Hdr.Name == "bit." && nsec.NextDomain != "n0000.bit." {
+			t.Errorf("apex NSEC points to %s", nsec.NextDomain)
+		}
+		if ok && nsec.Hdr.Name == "n0999.bit." && nsec.NextDomain != "bit." {
+			t.Errorf("last NSEC points to %s", nsec.NextDomain)
+		}
+	}
+
+	// The serial follows the best block, rebuilding the zone.
+	atomic.StoreInt64(&s.busMetrics.height, 123456)
+	rrs, _, err = transfer(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if serial := rrs[0].(*dns.SOA).Serial; serial != 123456 {
+		t.Errorf("SOA serial %d, expected the block height 123456", serial)
+	}
+
+	// Over UDP, an AXFR is left to the meta-query handling.
+	req := new(dns.Msg)
+	req.SetAxfr("bit.")
+	if s.serveTransfer(&fakeResponseWriter{addr: &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1234}}, req) {
+		t.Errorf("AXFR over UDP served as a transfer")
+	}
+}
+
+// A wildcard in a name's map is transferred as such, signed as a wildcard
+// and chained, so that secondaries can answer from it with the NSEC records
+// proving the names it's expanded to don't exist.
+func TestTransferWildcard(t *testing.T) {
+	ks, err := generateKeySet("bit.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := backend.New(&backend.Config{CacheMaxEntries: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rrs, err := buildZone(b, ks, "bit.", nil, time.Now(), func(f func(name string, nameData *namecoin.NameData) error) error {
+		return f("d/wild", &namecoin.NameData{Value: `{"ip":"192.0.2.1","map":{"*":{"ip":"192.0.2.2"},"host":{"ip":"192.0.2.3"}}}`, ExpiresIn: 30000})
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var a []dns.RR
+	var sig *dns.RRSIG
+	next := map[string]string{}
+	for _, rr := range rrs {
+		switch rr := rr.(type) {
+		case *dns.A:
+			if rr.Hdr.Name == "*.wild.bit." {
+				a = append(a, rr)
+			}
+		case *dns.RRSIG:
+			if rr.Hdr.Name == "*.wild.bit." && rr.TypeCovered == dns.TypeA {
+				sig = rr
+			}
+		case *dns.NSEC:
+			next[rr.Hdr.Name] = rr.NextDomain
+		}
+	}
+	if len(a) != 1 || sig == nil {
+		t.Fatalf("wildcard not transferred: %v", rrs)
+	}
+
+	// The signature verifies over the records expanded to a name.
+	if sig.Labels != 2 {
+		t.Errorf("wildcard signed with %d labels, expected 2", sig.Labels)
+	}
+	expanded := dns.Copy(a[0])
+	expanded.Header().Name = "a.wild.bit."
+	if err := sig.Verify(ks.ZSK, []dns.RR{expanded}); err != nil {
+		t.Errorf("signature over the wildcard doesn't verify expanded: %v", err)
+	}
+
+	// The wildcard comes first among the names below wild.bit., so that
+	// the NSEC record at it covers names expanded from it.
+	if next["wild.bit."] != "*.wild.bit." || next["*.wild.bit."] != "host.wild.bit." {
+		t.Errorf("unexpected NSEC chain %v", next)
+	}
+}
+
+// A client in XferAllowedIPs may transfer the zone without a TSIG key, but
+// only the zone CanonicalSuffix.
+func TestTransferAuthorization(t *testing.T) {
+	s := &Server{cfg: Config{CanonicalSuffix: "bit", XferAllowedIPs: "192.0.2.0/24"}}
+	if err := s.setupTransfers(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		ip    string
+		zone  string
+		rcode int
+	}{
+		{"198.51.100.1", "bit.", dns.RcodeRefused},
+		{"::ffff:198.51.100.1", "bit.", dns.RcodeRefused},
+		{"192.0.2.1", "example.", dns.RcodeNotAuth},
+		{"::ffff:192.0.2.1", "example.bit.", dns.RcodeNotAuth},
+	}
+	for _, test := range tests {
+		req := new(dns.Msg)
+		req.SetAxfr(test.zone)
+		rw := &fakeResponseWriter{addr: &net.TCPAddr{IP: net.ParseIP(test.ip), Port: 1234}}
+		if !s.serveTransfer(rw, req) {
+			t.Errorf("%s %s: not handled", test.ip, test.zone)
+			continue
+		}
+		if rw.msg == nil || rw.msg.Rcode != test.rcode || len(rw.msg.Answer) != 0 {
+			t.Errorf("%s %s: unexpected response %v", test.ip, test.zone, rw.msg)
+		}
+	}
+
+	if st := s.metaQueries.Status(); st["AXFR"] != uint64(len(tests)) {
+		t.Errorf("counted %v", st)
+	}
+}
+
+// A fake namecoind holding names d/n0000 to d/n0999, and a few outside d/,
+// returning at most 50 of them from each name_scan call. Each has the value
+// {"ip":"192.0.2.1"}, unless values has another.
+type fakeZoneRPC struct {
+	names  []string
+	values map[string]string
+
+	mu        sync.Mutex
+	blockHash string
+}
+
+func newFakeZoneRPC() *fakeZoneRPC {
+	f := &fakeZoneRPC{blockHash: strings.Repeat("0", 63) + "1"}
+	for i := 0; i < 1000; i++ {
+		f.names = append(f.names, fmt.Sprintf("d/n%04d", i))
+	}
+	f.names = append(f.names, "a/other", "id/someone")
+	sort.Strings(f.names)
+	return f
+}
+
+func (f *fakeZoneRPC) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	var call struct {
+		Method string            `json:"method"`
+		Params []json.RawMessage `json:"params"`
+		ID     interface{}       `json:"id"`
+	}
+	json.NewDecoder(req.Body).Decode(&call)
+
+	var result interface{}
+	switch call.Method {
+	case "getbestblockhash":
+		f.mu.Lock()
+		result = f.blockHash
+		f.mu.Unlock()
+	case "getblockcount":
+		result = 100
+	case "name_scan":
+		var start string
+		var count int
+		json.Unmarshal(call.Params[0], &start)
+		json.Unmarshal(call.Params[1], &count)
+		if count > 50 {
+			count = 50
+		}
+
+		results := []map[string]interface{}{}
+		for i := sort.SearchStrings(f.names, start); i < len(f.names) && len(results) < count; i++ {
+			value, ok := f.values[f.names[i]]
+			if !ok {
+				value = `{"ip":"192.0.2.1"}`
+			}
+			results = append(results, map[string]interface{}{"name": f.names[i], "value": value})
+		}
+		result = results
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(map[string]interface{}{"id": call.ID, "result": result, "error": nil})
+}
@@ -0,0 +1,169 @@
+//go:build !no_webserver
+// +build !no_webserver
+
+package server
+
+import (
+	"context"
+	"crypto"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/namecoin/ncdns/clock"
+	"github.com/namecoin/ncdns/ncdumpzone"
+)
+
+// Trailers of a zone dump response. If the dump didn't reach the end of the
+// names, because of the limit or the time limit, zoneDumpNextTrailer gives the
+// value of the after parameter which carries on from where it stopped.
+const (
+	zoneDumpNextTrailer     = "Ncdns-Next-After"
+	zoneDumpCompleteTrailer = "Ncdns-Complete"
+)
+
+// A dump being streamed is flushed to the client as it's written, at most
+// this often.
+const zoneDumpFlushInterval = time.Second
+
+// Serves a dump of the whole zone, as ncdumpzone does, a page at a time:
+//
+//	/api/v1/zone?format=zonefile&after=d/example&limit=1000&order=canonical
+//
+// With order=canonical, each name's records are in canonical order, so that
+// dumps of the same names are identical.
+//
+// The ETag of a page is derived from the best block hash, so that a client
+// polling with If-None-Match gets 304 until a block changes the names.
+func (ws *webServer) handleZoneDump(rw http.ResponseWriter, req *http.Request) {
+	format := req.FormValue("format")
+	if format == "" {
+		format = "zonefile"
+	}
+
+	limit := 0
+	if l := req.FormValue("limit"); l != "" {
+		var err error
+		limit, err = strconv.Atoi(l)
+		if err != nil || limit < 0 {
+			writeJSON(rw, http.StatusBadRequest, &apiError{Error: "invalid limit"})
+			return
+		}
+	}
+
+	order := req.FormValue("order")
+	if order != "" && order != "canonical" {
+		writeJSON(rw, http.StatusBadRequest, &apiError{Error: "invalid order"})
+		return
+	}
+
+	blockHash, err := ws.s.namecoinConn.GetBestBlockHash()
+	if err != nil {
+		writeJSON(rw, http.StatusServiceUnavailable, &apiError{Error: "couldn't get best block from namecoind"})
+		return
+	}
+
+	h := sha256.Sum256([]byte(fmt.Sprintf("%s\x00%s\x00%s\x00%d\x00%s", blockHash, format, req.FormValue("after"), limit, order)))
+	etag := `"` + hex.EncodeToString(h[:16]) + `"`
+	rw.Header().Set("ETag", etag)
+	if req.Header.Get("If-None-Match") == etag {
+		rw.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	ctx := req.Context()
+	if ws.s.cfg.HTTP.ZoneDumpTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(ws.s.cfg.HTTP.ZoneDumpTimeout)*time.Second)
+		defer cancel()
+	}
+
+	rw.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	rw.Header().Set("Trailer", zoneDumpNextTrailer+", "+zoneDumpCompleteTrailer)
+
+	fw := &flushingWriter{w: rw, clock: clock.Or(ws.s.clock)}
+	fw.flusher, _ = rw.(http.Flusher)
+
+	progress, err := ncdumpzone.DumpPage(ws.s.namecoinConn, fw, format, &ncdumpzone.Options{
+		Pacer:     ws.s.zoneWalkPacer,
+		After:     req.FormValue("after"),
+		Limit:     limit,
+		Context:   ctx,
+		SignDS:    ws.s.signRRset,
+		Canonical: order == "canonical",
+	})
+	if progress == nil {
+		// Nothing was written, so the error can still be reported properly.
+		writeJSON(rw, http.StatusBadRequest, &apiError{Error: err.Error()})
+		return
+	}
+	if err != nil && ctx.Err() == nil {
+		// The status has been sent, so all that can be done is to stop,
+		// saying where to carry on from.
+		log.Warne(err, "zone dump")
+	}
+
+	if !progress.Complete && progress.Last != "" {
+		rw.Header().Set(zoneDumpNextTrailer, progress.Last)
+	}
+	rw.Header().Set(zoneDumpCompleteTrailer, strconv.FormatBool(progress.Complete))
+}
+
+// Signs an RRset with the ZSK of its owner name, e.g. the DS records of a
+// delegated name in a zone dump, as they would be signed in a referral. The
+// signature is valid from sigGuardBackdate ago for sigGuardMinValidity.
+func (s *Server) signRRset(rrset []dns.RR) (*dns.RRSIG, error) {
+	ks := s.keySetForName(rrset[0].Header().Name)
+	if ks == nil || ks.ZSK == nil {
+		return nil, fmt.Errorf("no zone signing key")
+	}
+	signer, ok := ks.ZSKPrivate.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("zone signing key can't sign")
+	}
+
+	now := clock.Or(s.clock).Now()
+	sig := &dns.RRSIG{
+		Hdr: dns.RR_Header{
+			Name:   rrset[0].Header().Name,
+			Rrtype: dns.TypeRRSIG,
+			Class:  dns.ClassINET,
+			Ttl:    rrset[0].Header().Ttl,
+		},
+		Algorithm:  ks.ZSK.Algorithm,
+		KeyTag:     ks.ZSK.KeyTag(),
+		SignerName: ks.ZSK.Hdr.Name,
+		Inception:  uint32(now.Add(-sigGuardBackdate).Unix()),
+		Expiration: uint32(now.Add(sigGuardMinValidity).Unix()),
+	}
+	if err := sig.Sign(signer, rrset); err != nil {
+		return nil, err
+	}
+
+	return sig, nil
+}
+
+// Writes to an http.ResponseWriter, flushing what has been written at most
+// every zoneDumpFlushInterval, so that it isn't buffered until the end of a
+// long response.
+type flushingWriter struct {
+	w         io.Writer
+	flusher   http.Flusher
+	clock     clock.Clock
+	lastFlush time.Time
+}
+
+func (fw *flushingWriter) Write(p []byte) (int, error) {
+	n, err := fw.w.Write(p)
+	if now := fw.clock.Now(); fw.flusher != nil && now.Sub(fw.lastFlush) >= zoneDumpFlushInterval {
+		fw.flusher.Flush()
+		fw.lastFlush = now
+	}
+	return n, err
+}
@@ -0,0 +1,132 @@
+//go:build !no_webserver
+// +build !no_webserver
+
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/btcsuite/btcd/rpcclient"
+
+	"github.com/namecoin/ncdns/namecoin"
+)
+
+func newZoneDumpTestServer(t *testing.T, rpc *fakeZoneRPC) (*httptest.Server, func()) {
+	rpcSrv := httptest.NewServer(rpc)
+	conn, err := namecoin.New(&rpcclient.ConnConfig{
+		Host:         strings.TrimPrefix(rpcSrv.URL, "http://"),
+		User:         "user",
+		Pass:         "pass",
+		HTTPPostMode: true,
+		DisableTLS:   true,
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ws := &webServer{
+		s:  &Server{namecoinConn: conn, cfg: Config{HTTP: HTTPConfig{ZoneDumpTimeout: 60}}},
+		sm: http.NewServeMux(),
+	}
+	ws.sm.HandleFunc("/api/v1/zone", ws.handleZoneDump)
+	srv := httptest.NewServer(ws.sm)
+
+	return srv, func() {
+		srv.Close()
+		conn.Shutdown()
+		rpcSrv.Close()
+	}
+}
+
+func TestZoneDumpPages(t *testing.T) {
+	srv, done := newZoneDumpTestServer(t, newFakeZoneRPC())
+	defer done()
+
+	seen := map[string]int{}
+	after := ""
+	pages := 0
+	for {
+		res, err := http.Get(srv.URL + "/api/v1/zone?limit=137&after=" + url.QueryEscape(after))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		lines := 0
+		sc := bufio.NewScanner(res.Body)
+		for sc.Scan() {
+			seen[strings.Fields(sc.Text())[0]]++
+			lines++
+		}
+		res.Body.Close()
+		pages++
+
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("page %d: status %d", pages, res.StatusCode)
+		}
+		if res.Trailer.Get(zoneDumpCompleteTrailer) == "true" {
+			break
+		}
+		if lines != 137 {
+			t.Errorf("page %d has %d names", pages, lines)
+		}
+
+		after = res.Trailer.Get(zoneDumpNextTrailer)
+		if after == "" || pages > 10 {
+			t.Fatalf("page %d: no next page, trailers %v", pages, res.Trailer)
+		}
+	}
+
+	if pages != 8 {
+		t.Errorf("dumped in %d pages, expected 8", pages)
+	}
+	if len(seen) != 1000 {
+		t.Errorf("dumped %d names, expected 1000", len(seen))
+	}
+	for i := 0; i < 1000; i++ {
+		if n := seen[fmt.Sprintf("n%04d.bit.", i)]; n != 1 {
+			t.Errorf("n%04d.bit. dumped %d times", i, n)
+		}
+	}
+}
+
+func TestZoneDumpETag(t *testing.T) {
+	rpc := newFakeZoneRPC()
+	srv, done := newZoneDumpTestServer(t, rpc)
+	defer done()
+
+	get := func(etag string) *http.Response {
+		req, _ := http.NewRequest("GET", srv.URL+"/api/v1/zone?limit=10", nil)
+		if etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		return res
+	}
+
+	etag := get("").Header.Get("ETag")
+	if etag == "" {
+		t.Fatal("no ETag")
+	}
+	if res := get(etag); res.StatusCode != http.StatusNotModified {
+		t.Errorf("unchanged page: status %d", res.StatusCode)
+	}
+
+	rpc.mu.Lock()
+	rpc.blockHash = strings.Repeat("0", 63) + "2"
+	rpc.mu.Unlock()
+	if res := get(etag); res.StatusCode != http.StatusOK || res.Header.Get("ETag") == etag {
+		t.Errorf("page after a new block: status %d, ETag %s", res.StatusCode, res.Header.Get("ETag"))
+	}
+}
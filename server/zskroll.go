@@ -0,0 +1,553 @@
+package server
+
+import (
+	"crypto"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+	madns "gopkg.in/hlandau/madns.v2"
+
+	"github.com/namecoin/ncdns/clock"
+)
+
+// The TTL of the DNSKEY records, which is also the longest TTL of the records
+// signed with a ZSK. A ZSK is published for this long before it starts
+// signing, so that resolvers which cached the DNSKEY RRset before it was
+// published have fetched it again, and remains published for this long after
+// it stops signing, so that they can still validate the signatures they've
+// cached.
+const zskRolloverTTL = 86400 * time.Second
+
+// When a ZSK in KeyStateDir is published, starts signing, stops signing and
+// stops being published. Each is saved in a .state file next to its key
+// files, so that a rollover in progress survives a restart.
+type zskTimes struct {
+	Created   time.Time `json:"created"`
+	Published time.Time `json:"published"`
+
+	Active time.Time `json:"active"`
+
+	// Zero until its successor has been generated.
+	Inactive time.Time `json:"inactive"`
+	Removed  time.Time `json:"removed"`
+}
+
+type managedZSK struct {
+	key     *dns.DNSKEY
+	private crypto.PrivateKey
+	times   zskTimes
+
+	// The path of its files without the extension, relative to ConfigDir
+	// like other paths.
+	path string
+}
+
+// Generates the ZSK of the global keys in KeyStateDir, and rolls it over
+// every ZSKLifetime by pre-publication (RFC 6781 section 4.1.1.1): its
+// successor is generated and published ZSKPrePublish before the rollover,
+// signs from the rollover on, and the old key is removed once the
+// signatures it made have expired from caches. The KSK is managed manually.
+type zskRoller struct {
+	s          *Server
+	zone       string
+	lifetime   time.Duration
+	prePublish time.Duration
+	clock      clock.Clock
+
+	mu   sync.Mutex
+	keys []*managedZSK // ordered by activation time
+
+	// Set once the zone's engine is built, and again by each reload, to be
+	// rebuilt with the keys signing at the time. Guarded by the server's
+	// stateMu.
+	engine    *swappableEngine
+	newEngine func(ks *keySet) (dns.Handler, error)
+}
+
+func newZSKRoller(s *Server, zone string, lifetime, prePublish time.Duration) *zskRoller {
+	return &zskRoller{
+		s:          s,
+		zone:       strings.ToLower(dns.Fqdn(zone)),
+		lifetime:   lifetime,
+		prePublish: prePublish,
+		clock:      clock.Or(s.clock),
+	}
+}
+
+// Loads the KSK and sets up the automatic ZSK, returning the global keys.
+func (s *Server) setupZSKRollover() (*keySet, error) {
+	cfg := &s.cfg
+	if cfg.DNSSEC.ZonePublicKey != "" {
+		return nil, configError("KeyStateDir can't be used with ZonePublicKey; a ZSK is either managed manually or generated in KeyStateDir")
+	}
+	if cfg.DNSSEC.PublicKey == "" {
+		return nil, configError("KeyStateDir requires PublicKey, as a generated ZSK is only of use under a KSK")
+	}
+	if time.Duration(cfg.DNSSEC.ZSKPrePublish)*time.Second < zskRolloverTTL {
+		return nil, configError("ZSKPrePublish must be at least the TTL of the DNSKEY records, %d", int(zskRolloverTTL/time.Second))
+	}
+	if time.Duration(cfg.ApexInfrastructureTTL)*time.Second > zskRolloverTTL {
+		return nil, configError("ApexInfrastructureTTL can't be more than %d with KeyStateDir, as ZSKs are rolled over on the assumption that DNSKEY records are cached no longer than that", int(zskRolloverTTL/time.Second))
+	}
+	if cfg.DNSSEC.ZSKLifetime < 0 || (cfg.DNSSEC.ZSKLifetime > 0 && cfg.DNSSEC.ZSKLifetime <= cfg.DNSSEC.ZSKPrePublish) {
+		return nil, configError("ZSKLifetime must be longer than ZSKPrePublish, or 0")
+	}
+
+	ks, err := s.loadKSK(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	r := newZSKRoller(s, ks.KSK.Hdr.Name, time.Duration(cfg.DNSSEC.ZSKLifetime)*time.Second, time.Duration(cfg.DNSSEC.ZSKPrePublish)*time.Second)
+	err = r.load()
+	if err != nil {
+		return nil, err
+	}
+	err = r.step(r.clock.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	s.zskRoller = r
+	return r.keySet(ks, r.clock.Now()), nil
+}
+
+// Loads the global KSK alone, the ZSK being generated in KeyStateDir.
+func (s *Server) loadKSK(cfg *Config) (*keySet, error) {
+	ks := &keySet{}
+
+	var err error
+	ks.KSK, ks.KSKPrivate, err = s.loadKey(cfg.DNSSEC.PublicKey, cfg.DNSSEC.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return ks, nil
+}
+
+// Returns the path, without the extension, of the files of the ZSK with the
+// given key tag, e.g. "bit.zsk.12345".
+func (r *zskRoller) keyPath(tag string) string {
+	name := strings.TrimSuffix(r.zone, ".")
+	if name == "" {
+		name = "root"
+	}
+
+	return filepath.Join(r.s.cfg.DNSSEC.KeyStateDir, name+".zsk."+tag)
+}
+
+// Loads the keys saved in KeyStateDir. Key files without a .state file are
+// of keys whose generation was interrupted, and are ignored.
+func (r *zskRoller) load() error {
+	states, err := filepath.Glob(r.s.cfg.cpath(r.keyPath("*")) + ".state")
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	prefix := filepath.Base(r.keyPath(""))
+	for _, fn := range states {
+		tag := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(fn), prefix), ".state")
+		path := r.keyPath(tag)
+
+		k := &managedZSK{path: path}
+		b, err := ioutil.ReadFile(fn)
+		if err != nil {
+			return err
+		}
+		err = json.Unmarshal(b, &k.times)
+		if err != nil {
+			return fmt.Errorf("Couldn't parse ZSK state file %s: %v", fn, err)
+		}
+
+		k.key, k.private, err = r.s.loadKey(path+".key", path+".private")
+		if err != nil {
+			return err
+		}
+
+		r.keys = append(r.keys, k)
+	}
+
+	sort.Slice(r.keys, func(i, j int) bool {
+		return r.keys[i].times.Active.Before(r.keys[j].times.Active)
+	})
+	return nil
+}
+
+// Advances the rollover to now: keys whose time has come are generated,
+// have their successors' times recorded, or are removed.
+func (r *zskRoller) step(now time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	keys := r.keys[:0]
+	for _, k := range r.keys {
+		if !k.times.Removed.IsZero() && !now.Before(k.times.Removed) {
+			err := r.remove(k)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		keys = append(keys, k)
+	}
+	r.keys = keys
+
+	if len(r.keys) == 0 {
+		err := r.generate(zskTimes{Created: now, Published: now, Active: now})
+		if err != nil {
+			return err
+		}
+	}
+
+	last := r.keys[len(r.keys)-1]
+	if r.lifetime > 0 && !now.Before(last.times.Active.Add(r.lifetime-r.prePublish)) {
+		// If ncdns wasn't running when the successor was due to be
+		// published, the rollover is put off until it's been published
+		// for long enough.
+		active := last.times.Active.Add(r.lifetime)
+		if min := now.Add(zskRolloverTTL); active.Before(min) {
+			active = min
+		}
+
+		err := r.generate(zskTimes{Created: now, Published: now, Active: active})
+		if err != nil {
+			return err
+		}
+	}
+
+	// The times of a key are only recorded once its successor has been
+	// saved, so this also finishes a rollover interrupted in between.
+	for i, k := range r.keys[:len(r.keys)-1] {
+		if !k.times.Inactive.IsZero() {
+			continue
+		}
+
+		next := r.keys[i+1].times.Active
+		k.times.Inactive, k.times.Removed = next, next.Add(zskRolloverTTL)
+		err := r.saveTimes(k)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Generates a ZSK with the given times, saving it in KeyStateDir. Must be
+// called with mu held.
+func (r *zskRoller) generate(times zskTimes) error {
+	// Keys are saved by key tag, which the successor must not share.
+	var key *dns.DNSKEY
+	var private crypto.PrivateKey
+	for key == nil || r.hasKeyTag(key.KeyTag()) {
+		var err error
+		key, private, err = generateKey(r.zone, 256)
+		if err != nil {
+			return err
+		}
+	}
+
+	k := &managedZSK{key: key, private: private, times: times, path: r.keyPath(strconv.Itoa(int(key.KeyTag())))}
+	err := os.MkdirAll(r.s.cfg.cpath(r.s.cfg.DNSSEC.KeyStateDir), 0700)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(r.s.cfg.cpath(k.path+".private"), []byte(key.PrivateKeyString(private)), 0600)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(r.s.cfg.cpath(k.path+".key"), []byte(key.String()+"\n"), 0644)
+	if err != nil {
+		return err
+	}
+	// The state is written last, so that a key with a state is complete.
+	err = r.saveTimes(k)
+	if err != nil {
+		return err
+	}
+
+	r.keys = append(r.keys, k)
+	log.Infof("Generated ZSK %d for %s in %s, published from %v and signing from %v",
+		key.KeyTag(), r.zone, r.s.cfg.cpath(k.path+".key"), times.Published.Format(time.RFC3339), times.Active.Format(time.RFC3339))
+	return nil
+}
+
+func (r *zskRoller) hasKeyTag(tag uint16) bool {
+	for _, k := range r.keys {
+		if k.key.KeyTag() == tag {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (r *zskRoller) saveTimes(k *managedZSK) error {
+	b, err := json.MarshalIndent(&k.times, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	fn := r.s.cfg.cpath(k.path + ".state")
+	err = ioutil.WriteFile(fn+".tmp", append(b, '\n'), 0644)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(fn+".tmp", fn)
+}
+
+// Deletes the files of a key which is no longer published, its state first,
+// so that a key whose deletion is interrupted isn't loaded again.
+func (r *zskRoller) remove(k *managedZSK) error {
+	for _, ext := range []string{".state", ".key", ".private"} {
+		err := os.Remove(r.s.cfg.cpath(k.path + ext))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	log.Infof("Removed ZSK %d for %s, which stopped signing at %v", k.key.KeyTag(), r.zone, k.times.Inactive.Format(time.RFC3339))
+	return nil
+}
+
+// Returns ks with the ZSK signing at now, and the other ZSKs published.
+func (r *zskRoller) keySet(ks *keySet, now time.Time) *keySet {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// Every key is active from when it's generated, other than a
+	// successor.
+	signing := r.keys[0]
+	for _, k := range r.keys[1:] {
+		if !now.Before(k.times.Active) {
+			signing = k
+		}
+	}
+
+	nks := &keySet{KSK: ks.KSK, KSKPrivate: ks.KSKPrivate, ZSK: signing.key, ZSKPrivate: signing.private}
+	for _, k := range r.keys {
+		if k != signing {
+			nks.PublishedZSKs = append(nks.PublishedZSKs, k.key)
+		}
+	}
+
+	return nks
+}
+
+// Returns when step next has something to do, or the keys signing change.
+func (r *zskRoller) next(now time.Time) time.Time {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var next time.Time
+	consider := func(t time.Time) {
+		if t.After(now) && (next.IsZero() || t.Before(next)) {
+			next = t
+		}
+	}
+	for _, k := range r.keys {
+		consider(k.times.Active)
+		consider(k.times.Removed)
+	}
+	if last := r.keys[len(r.keys)-1]; r.lifetime > 0 {
+		consider(last.times.Active.Add(r.lifetime - r.prePublish))
+	}
+
+	return next
+}
+
+// Wraps the engine serving the zone, which was built with backend, so that
+// it can be rebuilt whenever the keys signing change.
+func (r *zskRoller) wrapEngine(e madns.Engine, backend madns.Backend) dns.Handler {
+	se := &swappableEngine{}
+	se.set(e)
+	r.setEngine(se, func(ks *keySet) (dns.Handler, error) {
+		return newEngine(backend, ks)
+	})
+	return se
+}
+
+// Makes e the engine rebuilt by rollovers, with newEngine.
+func (r *zskRoller) setEngine(e *swappableEngine, newEngine func(ks *keySet) (dns.Handler, error)) {
+	r.engine = e
+	r.newEngine = newEngine
+}
+
+// Advances the rollover, and rebuilds the engine if the keys signing or
+// published have changed.
+func (r *zskRoller) roll() error {
+	now := r.clock.Now()
+	err := r.step(now)
+	if err != nil {
+		return err
+	}
+
+	// Published once the lock is released, as subscribers may need it.
+	var rolled *keysReloaded
+	defer func() {
+		if rolled != nil {
+			r.s.bus.publish(rolled)
+		}
+	}()
+
+	// Held throughout so that a reload can't replace the engine meanwhile.
+	r.s.stateMu.Lock()
+	defer r.s.stateMu.Unlock()
+
+	old := r.s.globalKeySet
+	ks := r.keySet(old, now)
+	if ks.ZSK == old.ZSK && sameKeys(ks.PublishedZSKs, old.PublishedZSKs) {
+		return nil
+	}
+
+	e, err := r.newEngine(ks)
+	if err != nil {
+		return err
+	}
+
+	r.s.globalKeySet = ks
+	r.engine.set(e)
+
+	if ks.ZSK != old.ZSK {
+		log.Infof("ZSK %d for %s is signing in place of ZSK %d", ks.ZSK.KeyTag(), r.zone, old.ZSK.KeyTag())
+		rolled = &keysReloaded{ZSKTag: ks.ZSK.KeyTag()}
+		if ks.KSK != nil {
+			rolled.KSKTag = ks.KSK.KeyTag()
+		}
+	}
+	return nil
+}
+
+func (r *zskRoller) run() {
+	for {
+		// Checked at least hourly in case the clock is stepped.
+		d := time.Hour
+		if next := r.next(r.clock.Now()); !next.IsZero() && next.Sub(r.clock.Now()) < d {
+			d = next.Sub(r.clock.Now()) + time.Second
+		}
+		<-r.clock.NewTimer(d).C()
+
+		log.Errore(r.roll(), "ZSK rollover")
+	}
+}
+
+func sameKeys(a, b []*dns.DNSKEY) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// A handler which can be replaced while it's serving.
+type swappableEngine struct {
+	v atomic.Value // dns.Handler
+}
+
+func (e *swappableEngine) set(h dns.Handler) {
+	e.v.Store(h)
+}
+
+func (e *swappableEngine) ServeDNS(rw dns.ResponseWriter, req *dns.Msg) {
+	e.v.Load().(dns.Handler).ServeDNS(rw, req)
+}
+
+// Wraps rw so that the DNSKEY RRset of the zone whose ZSK is being rolled
+// over includes the ZSKs published besides the one signing, which the
+// engine doesn't know of, signed again with the KSK.
+func (s *Server) dnskeyWriter(rw dns.ResponseWriter) dns.ResponseWriter {
+	if s.zskRoller == nil {
+		return rw
+	}
+
+	return &dnskeyWriter{ResponseWriter: rw, s: s}
+}
+
+type dnskeyWriter struct {
+	dns.ResponseWriter
+	s *Server
+}
+
+func (rw *dnskeyWriter) WriteMsg(m *dns.Msg) error {
+	ks := rw.s.globalKeys()
+	if len(ks.PublishedZSKs) > 0 {
+		m.Answer = publishKeys(m.Answer, rw.s.zskRoller.zone, ks)
+	}
+
+	return rw.ResponseWriter.WriteMsg(m)
+}
+
+// Adds the published ZSKs of ks to the DNSKEY RRset of zone in rrs, if there
+// is one, replacing its RRSIG by the KSK.
+func publishKeys(rrs []dns.RR, zone string, ks *keySet) []dns.RR {
+	var rrset []dns.RR
+	var sig *dns.RRSIG
+	var out []dns.RR
+	for _, rr := range rrs {
+		if !strings.EqualFold(rr.Header().Name, zone) {
+			out = append(out, rr)
+			continue
+		}
+		switch rr := rr.(type) {
+		case *dns.DNSKEY:
+			rrset = append(rrset, rr)
+			continue
+		case *dns.RRSIG:
+			if rr.TypeCovered == dns.TypeDNSKEY && rr.KeyTag == ks.KSK.KeyTag() {
+				sig = rr
+				continue
+			}
+		}
+		out = append(out, rr)
+	}
+	if len(rrset) == 0 {
+		return rrs
+	}
+
+	for _, k := range ks.PublishedZSKs {
+		if !containsDuplicate(rrset, k) {
+			rrset = append(rrset, k)
+		}
+	}
+	out = append(out, rrset...)
+
+	signer, ok := ks.KSKPrivate.(crypto.Signer)
+	if sig == nil || !ok {
+		return out
+	}
+
+	nsig := &dns.RRSIG{
+		Hdr:        sig.Hdr,
+		Algorithm:  sig.Algorithm,
+		KeyTag:     sig.KeyTag,
+		SignerName: sig.SignerName,
+		Inception:  sig.Inception,
+		Expiration: sig.Expiration,
+	}
+	err := nsig.Sign(signer, rrset)
+	if err != nil {
+		log.Errore(err, "couldn't sign DNSKEY records")
+		return rrs
+	}
+
+	return append(out, nsig)
+}
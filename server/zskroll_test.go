@@ -0,0 +1,215 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/namecoin/ncdns/backend"
+	"github.com/namecoin/ncdns/testutil"
+)
+
+const day = 24 * time.Hour
+
+func newTestZSKRoller(t *testing.T, dir string, clock *testutil.FakeClock) *zskRoller {
+	s := &Server{cfg: Config{ConfigDir: dir, DNSSEC: DNSSECConfig{KeyStateDir: "zsk"}}, clock: clock}
+	r := newZSKRoller(s, "bit.", 30*day, 7*day)
+	if err := r.load(); err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestZSKRollover(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ncdns-zskroll")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ksk, err := generateKeySet("bit.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ksk.ZSK, ksk.ZSKPrivate = nil, nil
+
+	t0 := time.Unix(1700000000, 0).UTC()
+	clock := testutil.NewFakeClock(t0)
+	r := newTestZSKRoller(t, dir, clock)
+
+	// The keys signing and published now, after the rollover has been
+	// advanced to it.
+	step := func() (signing uint16, published []uint16) {
+		t.Helper()
+		if err := r.step(clock.Now()); err != nil {
+			t.Fatal(err)
+		}
+		ks := r.keySet(ksk, clock.Now())
+		for _, k := range ks.PublishedZSKs {
+			published = append(published, k.KeyTag())
+		}
+		return ks.ZSK.KeyTag(), published
+	}
+
+	first, published := step()
+	if len(published) != 0 {
+		t.Fatalf("got ZSKs %v published besides the first", published)
+	}
+
+	clock.Set(t0.Add(23*day - time.Second))
+	if zsk, published := step(); zsk != first || len(published) != 0 {
+		t.Fatalf("before pre-publication: got ZSK %d, published %v", zsk, published)
+	}
+	if next := r.next(clock.Now()); !next.Equal(t0.Add(23 * day)) {
+		t.Errorf("next step at %v, expected pre-publication at %v", next, t0.Add(23*day))
+	}
+
+	// The successor is published a week before the rollover.
+	clock.Set(t0.Add(23 * day))
+	zsk, published := step()
+	if zsk != first || len(published) != 1 {
+		t.Fatalf("after pre-publication: got ZSK %d, published %v", zsk, published)
+	}
+	second := published[0]
+	if next := r.next(clock.Now()); !next.Equal(t0.Add(30 * day)) {
+		t.Errorf("next step at %v, expected the rollover at %v", next, t0.Add(30*day))
+	}
+
+	// The rollover survives a restart, including one which interrupted
+	// the recording of the first key's times.
+	r.keys[0].times.Inactive, r.keys[0].times.Removed = time.Time{}, time.Time{}
+	if err := r.saveTimes(r.keys[0]); err != nil {
+		t.Fatal(err)
+	}
+	r = newTestZSKRoller(t, dir, clock)
+	if zsk, published := step(); zsk != first || len(published) != 1 || published[0] != second {
+		t.Fatalf("after restart: got ZSK %d, published %v; expected %d, published %d", zsk, published, first, second)
+	}
+	if k := r.keys[0]; !k.times.Inactive.Equal(t0.Add(30*day)) || !k.times.Removed.Equal(t0.Add(31*day)) {
+		t.Errorf("first key inactive at %v and removed at %v", k.times.Inactive, k.times.Removed)
+	}
+
+	// The successor signs from the rollover, and the old key stays
+	// published for the TTL of the records it signed.
+	clock.Set(t0.Add(30 * day))
+	if zsk, published := step(); zsk != second || len(published) != 1 || published[0] != first {
+		t.Fatalf("after rollover: got ZSK %d, published %v", zsk, published)
+	}
+
+	clock.Set(t0.Add(31 * day))
+	if zsk, published := step(); zsk != second || len(published) != 0 {
+		t.Fatalf("after removal: got ZSK %d, published %v", zsk, published)
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "zsk", "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 3 {
+		t.Errorf("got key files %v, expected those of one key", files)
+	}
+	if next := r.next(clock.Now()); !next.Equal(t0.Add(53 * day)) {
+		t.Errorf("next step at %v, expected pre-publication at %v", next, t0.Add(53*day))
+	}
+}
+
+func TestZSKRolloverLate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ncdns-zskroll")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	t0 := time.Unix(1700000000, 0).UTC()
+	clock := testutil.NewFakeClock(t0)
+	r := newTestZSKRoller(t, dir, clock)
+	if err := r.step(clock.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	// If ncdns wasn't running at the time of the rollover, the successor
+	// still isn't used until resolvers have had time to fetch it.
+	clock.Set(t0.Add(40 * day))
+	if err := r.step(clock.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if len(r.keys) != 2 || !r.keys[1].times.Active.Equal(clock.Now().Add(zskRolloverTTL)) {
+		t.Fatalf("got keys %+v", r.keys)
+	}
+}
+
+func TestZSKRolloverServing(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ncdns-zskroll")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ks, err := generateKeySet("bit.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	be, err := backend.New(&backend.Config{CacheMaxEntries: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t0 := time.Unix(1700000000, 0).UTC()
+	clock := testutil.NewFakeClock(t0)
+	r := newTestZSKRoller(t, dir, clock)
+	s := r.s
+	s.zskRoller = r
+	s.mux = dns.NewServeMux()
+	if err := r.step(clock.Now()); err != nil {
+		t.Fatal(err)
+	}
+	s.globalKeySet = r.keySet(ks, clock.Now())
+	e, err := newEngine(be, s.globalKeySet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.mux.Handle(".", r.wrapEngine(e, be))
+	first := s.globalKeys().ZSK
+
+	clock.Set(t0.Add(23 * day))
+	if err := r.roll(); err != nil {
+		t.Fatal(err)
+	}
+	if ks := s.globalKeys(); ks.ZSK != first || len(ks.PublishedZSKs) != 1 {
+		t.Fatalf("after pre-publication: got keys %+v", ks)
+	}
+	second := s.globalKeys().PublishedZSKs[0]
+
+	// The engine doesn't know of the published key, so it's added to the
+	// DNSKEY RRset, which is signed again.
+	s.mux.Handle(".", &testSigningEngine{b: be, ks: s.globalKeys()})
+	req := new(dns.Msg)
+	req.SetQuestion("bit.", dns.TypeDNSKEY)
+	rw := &fakeResponseWriter{}
+	s.ServeDNS(rw, req)
+	if rw.msg == nil {
+		t.Fatal("no response")
+	}
+	keys := typeOnly(rw.msg.Answer, dns.TypeDNSKEY)
+	if len(keys) != 3 || !containsDuplicate(keys, second) {
+		t.Fatalf("got DNSKEY records %v", keys)
+	}
+	sigs := typeOnly(rw.msg.Answer, dns.TypeRRSIG)
+	if len(sigs) != 1 {
+		t.Fatalf("got signatures %v", sigs)
+	}
+	if err := sigs[0].(*dns.RRSIG).Verify(ks.KSK, keys); err != nil {
+		t.Errorf("DNSKEY RRset signature doesn't verify: %v", err)
+	}
+
+	clock.Set(t0.Add(30 * day))
+	if err := r.roll(); err != nil {
+		t.Fatal(err)
+	}
+	if ks := s.globalKeys(); ks.ZSK != second || len(ks.PublishedZSKs) != 1 || ks.PublishedZSKs[0] != first {
+		t.Fatalf("after rollover: got keys %+v", ks)
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/eventlog"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+// The name of the Windows service, and of its Event Log source.
+const serviceName = "ncdns"
+
+func init() {
+	subcommands["service"] = &subcommand{
+		usage: "service install|uninstall|start|stop|reload [options]: manage the ncdns Windows service; the options given to install are those it runs with",
+		run:   runService,
+	}
+}
+
+// The daemon as run by the service control manager: a request to stop or a
+// shutdown stops the server, and a change of parameters reloads its
+// configuration.
+type windowsService struct {
+	d *daemon
+}
+
+func (ws *windowsService) Execute(args []string, r <-chan svc.ChangeRequest, changes chan<- svc.Status) (ssec bool, errno uint32) {
+	changes <- svc.Status{State: svc.StartPending}
+
+	s, err := ws.d.newServer()
+	if err == nil {
+		err = s.Start()
+		if err != nil {
+			s.Stop()
+		}
+	}
+	if err != nil {
+		reportStartupError(err)
+		return true, uint32(exitCode(err))
+	}
+
+	changes <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown | svc.AcceptParamChange}
+	for c := range r {
+		switch c.Cmd {
+		case svc.Interrogate:
+			changes <- c.CurrentStatus
+		case svc.ParamChange:
+			if err := ws.d.reload(s); err != nil {
+				logEvent(eventlog.Warning, err.Error())
+			} else {
+				logEvent(eventlog.Info, "Reloaded the configuration")
+			}
+		case svc.Stop, svc.Shutdown:
+			changes <- svc.Status{State: svc.StopPending}
+			if err := s.Stop(); err != nil {
+				logEvent(eventlog.Warning, fmt.Sprintf("Stopping: %s", err))
+			}
+			return false, 0
+		}
+	}
+	return false, 0
+}
+
+func runService(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintf(os.Stderr, "Usage: ncdns service install|uninstall|start|stop|reload [options]\n")
+		return 2
+	}
+
+	var err error
+	switch args[0] {
+	case "install":
+		err = installService(args[1:])
+	case "uninstall":
+		err = uninstallService()
+	case "start":
+		err = withService(func(s *mgr.Service) error {
+			return s.Start()
+		})
+	case "stop":
+		err = controlService(svc.Stop)
+	case "reload":
+		err = controlService(svc.ParamChange)
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown service command %q\n", args[0])
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return 1
+	}
+	return 0
+}
+
+// Registers the service, to run ncdns with the given options at startup, and
+// the Event Log source it reports to.
+func installService(args []string) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	// The service runs in the system directory, so a relative path to the
+	// configuration file would be looked for there.
+	for i, arg := range args {
+		for _, prefix := range []string{"-conf=", "--conf="} {
+			if path := strings.TrimPrefix(arg, prefix); path != arg {
+				if abs, err := filepath.Abs(path); err == nil {
+					args[i] = prefix + abs
+				}
+			}
+		}
+	}
+
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("Couldn't connect to the service control manager: %s", err)
+	}
+	defer m.Disconnect()
+
+	if s, err := m.OpenService(serviceName); err == nil {
+		s.Close()
+		return fmt.Errorf("The %s service is already installed", serviceName)
+	}
+
+	s, err := m.CreateService(serviceName, exe, mgr.Config{
+		DisplayName: serviceName,
+		Description: serviceDescription,
+		StartType:   mgr.StartAutomatic,
+	}, args...)
+	if err != nil {
+		return fmt.Errorf("Couldn't install the %s service: %s", serviceName, err)
+	}
+	defer s.Close()
+
+	err = eventlog.InstallAsEventCreate(serviceName, eventlog.Error|eventlog.Warning|eventlog.Info)
+	if err != nil {
+		s.Delete()
+		return fmt.Errorf("Couldn't register the Event Log source: %s", err)
+	}
+	return nil
+}
+
+func uninstallService() error {
+	err := withService(func(s *mgr.Service) error {
+		return s.Delete()
+	})
+	if err != nil {
+		return err
+	}
+	return eventlog.Remove(serviceName)
+}
+
+func controlService(c svc.Cmd) error {
+	return withService(func(s *mgr.Service) error {
+		_, err := s.Control(c)
+		return err
+	})
+}
+
+// Calls f with the installed service.
+func withService(f func(s *mgr.Service) error) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("Couldn't connect to the service control manager: %s", err)
+	}
+	defer m.Disconnect()
+
+	s, err := m.OpenService(serviceName)
+	if err != nil {
+		return fmt.Errorf("The %s service isn't installed: %s", serviceName, err)
+	}
+	defer s.Close()
+
+	return f(s)
+}
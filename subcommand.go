@@ -0,0 +1,95 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/namecoin/ncdns/server"
+	"gopkg.in/hlandau/easyconfig.v1"
+)
+
+// A subcommand is an offline operation on the ncdns configuration which runs
+// instead of the daemon, e.g. "ncdns export-trust-anchor".
+type subcommand struct {
+	usage string
+	run   func(args []string) int
+}
+
+var subcommands = map[string]*subcommand{}
+
+func init() {
+	// Registered here rather than in the map literal because the help
+	// subcommand refers to the map.
+	subcommands["help"] = &subcommand{
+		usage: "help: list subcommands",
+		run:   runHelp,
+	}
+}
+
+func runHelp(args []string) int {
+	names := make([]string, 0, len(subcommands))
+	for name := range subcommands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintf(os.Stderr, "Usage: ncdns [options]            run the daemon\n")
+	fmt.Fprintf(os.Stderr, "       ncdns <subcommand> [options]\n\nSubcommands:\n")
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %s\n", subcommands[name].usage)
+	}
+	fmt.Fprintf(os.Stderr, "\n")
+	printExitCodes(os.Stderr)
+
+	return 2
+}
+
+// Creates a flag set for a subcommand, including the -conf flag used to
+// locate the ncdns configuration file.
+func newSubcommandFlags(name string) (*flag.FlagSet, *string) {
+	fs := flag.NewFlagSet("ncdns "+name, flag.ContinueOnError)
+	conf := fs.String("conf", "", "Path to the ncdns configuration file")
+	return fs, conf
+}
+
+// Loads the daemon configuration for use by a subcommand. Only the
+// configuration file, the environment (and defaults) are consulted; the
+// subcommand's own command line flags are not daemon options.
+func loadSubcommandConfig(confPath string) (*server.Config, error) {
+	cfg, _, err := parseSubcommandConfig(confPath)
+	return cfg, err
+}
+
+// Loads the daemon configuration as loadSubcommandConfig does, and returns
+// the path of the configuration file it was read from, which is "" if none
+// was found.
+func parseSubcommandConfig(confPath string) (*server.Config, string, error) {
+	flat := server.NewFlatConfig()
+
+	args := []string{os.Args[0]}
+	if confPath != "" {
+		args = append(args, "-conf="+confPath)
+	}
+
+	origArgs := os.Args
+	os.Args = args
+	defer func() { os.Args = origArgs }()
+
+	config := easyconfig.Configurator{
+		ProgramName: "ncdns",
+	}
+	err := config.Parse(flat)
+	if err != nil {
+		return nil, "", fmt.Errorf("Couldn't parse configuration: %s", err)
+	}
+
+	// Unlike flags, the sections of the configuration file and the
+	// environment hold daemon options.
+	cfg, err := loadConfig(&config, flat, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	return cfg, config.ConfigFilePath(), nil
+}
@@ -0,0 +1,26 @@
+//go:build go1.16 && !no_webserver
+// +build go1.16,!no_webserver
+
+package main
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+
+	"github.com/namecoin/ncdns/server"
+)
+
+// The templates are built in, so that ncdns needs no tpl directory alongside
+// it, e.g. in a container. TplPath still overrides them.
+//
+//go:embed _tpl/*/*.tpl
+var templates embed.FS
+
+func init() {
+	tpl, err := fs.Sub(templates, "_tpl")
+	if err != nil {
+		panic(err)
+	}
+	server.BuiltinTemplates = http.FS(tpl)
+}
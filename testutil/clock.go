@@ -0,0 +1,143 @@
+package testutil
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/namecoin/ncdns/clock"
+)
+
+// A FakeClock is a clock.Clock whose time only moves when Advance is called,
+// firing the timers and tickers which fall due. It may be used concurrently.
+type FakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []*fakeWaiter
+}
+
+// A pending timer, or a ticker.
+type fakeWaiter struct {
+	c      *FakeClock
+	ch     chan time.Time
+	at     time.Time
+	period time.Duration // zero for a timer
+}
+
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now: now}
+}
+
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// Moves the time forward by d, firing the timers and tickers due by then in
+// order. As with the real clock, a tick is dropped if the last one hasn't
+// been received yet.
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	end := c.now.Add(d)
+	for {
+		sort.SliceStable(c.waiters, func(i, j int) bool {
+			return c.waiters[i].at.Before(c.waiters[j].at)
+		})
+		if len(c.waiters) == 0 || c.waiters[0].at.After(end) {
+			break
+		}
+
+		w := c.waiters[0]
+		c.now = w.at
+		select {
+		case w.ch <- w.at:
+		default:
+		}
+		if w.period > 0 {
+			w.at = w.at.Add(w.period)
+		} else {
+			c.waiters = c.waiters[1:]
+		}
+	}
+	c.now = end
+}
+
+// Moves the time forward to t, as Advance does.
+func (c *FakeClock) Set(t time.Time) {
+	c.Advance(t.Sub(c.Now()))
+}
+
+// Waits until at least n timers and tickers are pending, e.g. for a goroutine
+// under test to reach the point where it waits for one.
+func (c *FakeClock) BlockUntil(n int) {
+	for {
+		c.mu.Lock()
+		pending := len(c.waiters)
+		c.mu.Unlock()
+		if pending >= n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func (c *FakeClock) NewTimer(d time.Duration) clock.Timer {
+	return c.add(d, 0)
+}
+
+func (c *FakeClock) NewTicker(d time.Duration) clock.Ticker {
+	if d <= 0 {
+		panic("non-positive interval for NewTicker")
+	}
+	return fakeTicker{c.add(d, d)}
+}
+
+func (c *FakeClock) add(d, period time.Duration) *fakeWaiter {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	w := &fakeWaiter{c: c, ch: make(chan time.Time, 1), at: c.now.Add(d), period: period}
+	c.waiters = append(c.waiters, w)
+	return w
+}
+
+// Removes w from the pending timers and tickers, returning whether it was
+// there. Must be called with c.mu held.
+func (c *FakeClock) remove(w *fakeWaiter) bool {
+	for i, x := range c.waiters {
+		if x == w {
+			c.waiters = append(c.waiters[:i], c.waiters[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (w *fakeWaiter) C() <-chan time.Time {
+	return w.ch
+}
+
+func (w *fakeWaiter) Stop() bool {
+	w.c.mu.Lock()
+	defer w.c.mu.Unlock()
+	return w.c.remove(w)
+}
+
+func (w *fakeWaiter) Reset(d time.Duration) bool {
+	w.c.mu.Lock()
+	defer w.c.mu.Unlock()
+
+	pending := w.c.remove(w)
+	w.at = w.c.now.Add(d)
+	w.c.waiters = append(w.c.waiters, w)
+	return pending
+}
+
+type fakeTicker struct{ *fakeWaiter }
+
+func (t fakeTicker) Stop() {
+	t.fakeWaiter.Stop()
+}
@@ -0,0 +1,73 @@
+package testutil
+
+import (
+	"testing"
+	"time"
+)
+
+func received(c <-chan time.Time) (time.Time, bool) {
+	select {
+	case t := <-c:
+		return t, true
+	default:
+		return time.Time{}, false
+	}
+}
+
+func TestFakeClockTimer(t *testing.T) {
+	t0 := time.Unix(1000, 0)
+	c := NewFakeClock(t0)
+	timer := c.NewTimer(time.Minute)
+
+	c.Advance(time.Minute - time.Second)
+	if _, ok := received(timer.C()); ok {
+		t.Fatal("timer fired early")
+	}
+
+	c.Advance(time.Hour)
+	if at, ok := received(timer.C()); !ok || !at.Equal(t0.Add(time.Minute)) {
+		t.Fatalf("got %v, %v; expected the timer to fire at %v", at, ok, t0.Add(time.Minute))
+	}
+	if !c.Now().Equal(t0.Add(time.Hour + time.Minute - time.Second)) {
+		t.Errorf("clock at %v after advancing", c.Now())
+	}
+	if timer.Stop() {
+		t.Error("stopped a timer which had fired")
+	}
+
+	if timer.Reset(time.Second) {
+		t.Error("reset reported a timer which had fired as pending")
+	}
+	if !timer.Stop() {
+		t.Error("reset timer wasn't pending")
+	}
+	c.Advance(time.Minute)
+	if _, ok := received(timer.C()); ok {
+		t.Error("stopped timer fired")
+	}
+}
+
+func TestFakeClockTicker(t *testing.T) {
+	c := NewFakeClock(time.Unix(1000, 0))
+	ticker := c.NewTicker(time.Second)
+
+	// Ticks which aren't received are dropped.
+	c.Advance(10 * time.Second)
+	if at, ok := received(ticker.C()); !ok || !at.Equal(time.Unix(1001, 0)) {
+		t.Fatalf("got %v, %v; expected the first tick", at, ok)
+	}
+	if _, ok := received(ticker.C()); ok {
+		t.Fatal("more than one tick was kept")
+	}
+
+	c.Advance(time.Second)
+	if at, ok := received(ticker.C()); !ok || !at.Equal(time.Unix(1011, 0)) {
+		t.Fatalf("got %v, %v; expected a tick a second later", at, ok)
+	}
+
+	ticker.Stop()
+	c.Advance(time.Minute)
+	if _, ok := received(ticker.C()); ok {
+		t.Error("stopped ticker ticked")
+	}
+}
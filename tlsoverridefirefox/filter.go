@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"net"
 	"strings"
+
+	"github.com/namecoin/ncdns/util"
 )
 
 // FilterOverrides accepts as input the contents of a Firefox cert_override.txt
@@ -37,8 +39,7 @@ func FilterOverrides(overrides, blacklistedHostSuffix string) (string, error) {
 			return "", fmt.Errorf("Error parsing hostport")
 		}
 
-		if host == blacklistedHostSuffix ||
-			strings.HasSuffix(host, "."+blacklistedHostSuffix) {
+		if util.IsInZone(host, blacklistedHostSuffix) {
 			// Host is blacklisted; don't include it in output
 			continue
 		}
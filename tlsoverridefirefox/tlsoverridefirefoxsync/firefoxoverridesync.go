@@ -37,11 +37,13 @@ var zoneDataMux sync.Mutex
 // situation, .bit domains must stop resolving until the issue is corrected.
 // Forcing ncdns to exit is the least complex way to achieve this.
 
-func watchZone(conn *namecoin.Client) {
+func watchZone(conn *namecoin.Client, pacer *ncdumpzone.Pacer) {
 	for {
 		var result bytes.Buffer
 
-		err := ncdumpzone.Dump(conn, &result, "firefox-override")
+		err := ncdumpzone.DumpWithOptions(conn, &result, "firefox-override", &ncdumpzone.Options{
+			Pacer: pacer,
+		})
 		log.Fatale(err, "Couldn't dump zone for Firefox override sync")
 
 		zoneDataMux.Lock()
@@ -124,10 +126,11 @@ func profileInUse() bool {
 
 // Start starts 2 background threads that synchronize the blockchain's TLSA
 // records to a Firefox profile's cert_override.txt.  It accepts a connection
-// to access Namecoin Core, as well as a host suffix (usually "bit").
-func Start(conn *namecoin.Client, suffix string) error {
+// to access Namecoin Core, as well as a host suffix (usually "bit"), and
+// dumps the zone at the rate allowed by pacer, which may be nil.
+func Start(conn *namecoin.Client, suffix string, pacer *ncdumpzone.Pacer) error {
 	if syncEnableFlag.Value() {
-		go watchZone(conn)
+		go watchZone(conn, pacer)
 		go watchProfile(suffix)
 	}
 	return nil
@@ -0,0 +1,95 @@
+// Package tracing provides optional tracing of the DNS query path.
+//
+// Unless ncdns is built with the "otel" build tag and Setup is called with an
+// OTLP endpoint, every operation in this package is a no-op, so instrumented
+// code costs no more than a few function calls when tracing is disabled.
+package tracing
+
+import "context"
+
+// A Span is a single timed operation within a trace.
+type Span interface {
+	// Sets an attribute on the span. value may be a string, bool or integer;
+	// other types are recorded using their default string formatting.
+	SetAttribute(key string, value interface{})
+
+	// Records that the operation failed with err. Does nothing if err is nil.
+	SetError(err error)
+
+	// Returns true iff the span is being recorded, i.e. tracing is enabled and
+	// the trace was sampled.
+	Recording() bool
+
+	// Ends the span.
+	End()
+}
+
+// Tracing configuration.
+type Config struct {
+	// URL of the OTLP/HTTP collector to export spans to, e.g.
+	// "http://localhost:4318". If empty, tracing is disabled.
+	Endpoint string
+
+	// Fraction of queries to trace, from 0 to 1.
+	SampleRate float64
+}
+
+type tracer interface {
+	start(ctx context.Context, name string) (context.Context, Span)
+	shutdown() error
+}
+
+var current tracer = noopTracer{}
+
+type rootSpanKey struct{}
+
+// Start begins a span named name as a child of any span in ctx. The returned
+// context carries the new span and should be passed to Start for any child
+// operations.
+func Start(ctx context.Context, name string) (context.Context, Span) {
+	ctx, span := current.start(ctx, name)
+	if _, ok := ctx.Value(rootSpanKey{}).(Span); !ok {
+		ctx = context.WithValue(ctx, rootSpanKey{}, span)
+	}
+
+	return ctx, span
+}
+
+// SetRootAttribute sets an attribute on the outermost span in ctx, if there is
+// one. This is used to annotate a query's span with facts learnt deep within
+// the query path, such as whether the name cache was hit.
+func SetRootAttribute(ctx context.Context, key string, value interface{}) {
+	if span, ok := ctx.Value(rootSpanKey{}).(Span); ok {
+		span.SetAttribute(key, value)
+	}
+}
+
+// Enabled returns true iff Setup has enabled tracing.
+func Enabled() bool {
+	_, ok := current.(noopTracer)
+	return !ok
+}
+
+// Shutdown flushes any spans not yet exported and disables tracing.
+func Shutdown() error {
+	t := current
+	current = noopTracer{}
+	return t.shutdown()
+}
+
+type noopTracer struct{}
+
+func (noopTracer) start(ctx context.Context, name string) (context.Context, Span) {
+	return ctx, noopSpan{}
+}
+
+func (noopTracer) shutdown() error {
+	return nil
+}
+
+type noopSpan struct{}
+
+func (noopSpan) SetAttribute(key string, value interface{}) {}
+func (noopSpan) SetError(err error)                         {}
+func (noopSpan) Recording() bool                            { return false }
+func (noopSpan) End()                                       {}
@@ -0,0 +1,20 @@
+//go:build !otel
+// +build !otel
+
+package tracing
+
+import "fmt"
+
+// Available is whether ncdns was built with OpenTelemetry support, without
+// which tracing can't be enabled.
+const Available = false
+
+// Setup enables tracing as configured. ncdns was built without the "otel"
+// build tag, so this fails if an endpoint is configured.
+func Setup(cfg *Config) error {
+	if cfg.Endpoint != "" {
+		return fmt.Errorf("Tracing is configured, but ncdns was built without OpenTelemetry support (build with -tags otel)")
+	}
+
+	return nil
+}
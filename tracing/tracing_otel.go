@@ -0,0 +1,110 @@
+//go:build otel
+// +build otel
+
+package tracing
+
+import (
+	"context"
+	"fmt"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Available is whether ncdns was built with OpenTelemetry support, without
+// which tracing can't be enabled.
+const Available = true
+
+// Setup enables tracing as configured, exporting spans via OTLP/HTTP. It does
+// nothing if no endpoint is configured.
+func Setup(cfg *Config) error {
+	if cfg.Endpoint == "" {
+		return nil
+	}
+
+	exp, err := otlptracehttp.New(context.Background(), otlptracehttp.WithEndpointURL(cfg.Endpoint))
+	if err != nil {
+		return fmt.Errorf("Couldn't create OTLP exporter: %v", err)
+	}
+
+	return SetupWithExporter(exp, cfg.SampleRate)
+}
+
+// SetupWithExporter enables tracing, exporting spans to exp. This is mainly
+// useful for testing with an in-memory exporter.
+func SetupWithExporter(exp sdktrace.SpanExporter, sampleRate float64) error {
+	if sampleRate < 0 || sampleRate > 1 {
+		return fmt.Errorf("Tracing sample rate must be between 0 and 1")
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exp),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(sampleRate))),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", "ncdns"))),
+	)
+
+	current = &otelTracer{
+		provider: tp,
+		tracer:   tp.Tracer("github.com/namecoin/ncdns"),
+	}
+	return nil
+}
+
+type otelTracer struct {
+	provider *sdktrace.TracerProvider
+	tracer   trace.Tracer
+}
+
+func (t *otelTracer) start(ctx context.Context, name string) (context.Context, Span) {
+	ctx, span := t.tracer.Start(ctx, name)
+	return ctx, otelSpan{span}
+}
+
+func (t *otelTracer) shutdown() error {
+	return t.provider.Shutdown(context.Background())
+}
+
+type otelSpan struct {
+	span trace.Span
+}
+
+func (s otelSpan) SetAttribute(key string, value interface{}) {
+	var kv attribute.KeyValue
+	switch v := value.(type) {
+	case string:
+		kv = attribute.String(key, v)
+	case bool:
+		kv = attribute.Bool(key, v)
+	case int:
+		kv = attribute.Int(key, v)
+	case uint16:
+		kv = attribute.Int(key, int(v))
+	case int64:
+		kv = attribute.Int64(key, v)
+	default:
+		kv = attribute.String(key, fmt.Sprint(v))
+	}
+
+	s.span.SetAttributes(kv)
+}
+
+func (s otelSpan) SetError(err error) {
+	if err == nil {
+		return
+	}
+
+	s.span.RecordError(err)
+	s.span.SetStatus(codes.Error, err.Error())
+}
+
+func (s otelSpan) Recording() bool {
+	return s.span.IsRecording()
+}
+
+func (s otelSpan) End() {
+	s.span.End()
+}
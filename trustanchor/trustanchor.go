@@ -0,0 +1,179 @@
+package trustanchor
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Formats lists the trust anchor formats supported by Format.
+var Formats = []string{"unbound", "bind", "knot", "dnsmasq", "ds"}
+
+// Format returns a trust anchor for ksk in the native syntax of the named
+// resolver.  Formats other than "ds" are complete configuration snippets; "ds"
+// is a bare DS record in zone file syntax.
+func Format(ksk *dns.DNSKEY, format string) (string, error) {
+	ds := ksk.ToDS(dns.SHA256)
+	if ds == nil {
+		return "", fmt.Errorf("Couldn't compute DS for key with tag %d", ksk.KeyTag())
+	}
+
+	zone := dns.Fqdn(ksk.Hdr.Name)
+	digest := strings.ToUpper(ds.Digest)
+
+	switch format {
+	case "unbound", "ds":
+		// Unbound's trust-anchor-file takes zone file syntax directly.
+		return fmt.Sprintf("%s IN DS %d %d %d %s\n", zone, ds.KeyTag,
+			ds.Algorithm, ds.DigestType, digest), nil
+	case "bind":
+		return fmt.Sprintf("trust-anchors {\n  \"%s\" static-ds %d %d %d \"%s\";\n};\n",
+			zone, ds.KeyTag, ds.Algorithm, ds.DigestType, digest), nil
+	case "knot":
+		return fmt.Sprintf("trust_anchors.add('%s IN DS %d %d %d %s')\n", zone,
+			ds.KeyTag, ds.Algorithm, ds.DigestType, digest), nil
+	case "dnsmasq":
+		return fmt.Sprintf("trust-anchor=%s,%d,%d,%d,%s\n", zone, ds.KeyTag,
+			ds.Algorithm, ds.DigestType, digest), nil
+	default:
+		return "", fmt.Errorf("Invalid trust anchor format: %s", format)
+	}
+}
+
+// An Anchor is a single trust anchor found in an anchor file.  Anchors
+// expressed as DNSKEY records are converted to DS form on parsing.
+type Anchor struct {
+	Zone string
+	DS   *dns.DS
+	Key  *dns.DNSKEY // nil unless the anchor was given as a DNSKEY
+}
+
+var (
+	// BIND: "zone" static-ds|initial-ds tag alg digesttype "digest";
+	reBINDDS = regexp.MustCompile(`"?([^"\s]+)"?\s+(?:static|initial)-ds\s+(\d+)\s+(\d+)\s+(\d+)\s+"([0-9A-Fa-f\s]+)"`)
+	// BIND: "zone" static-key|initial-key flags proto alg "key";
+	reBINDKey = regexp.MustCompile(`"?([^"\s]+)"?\s+(?:static|initial)-key\s+(\d+)\s+(\d+)\s+(\d+)\s+"([^"]+)"`)
+	// Knot Resolver: trust_anchors.add('zone-file syntax RR')
+	reKnot = regexp.MustCompile(`trust_anchors\.add\(\s*['"]([^'"]+)['"]\s*\)`)
+	// dnsmasq: trust-anchor=[class,]zone,tag,alg,digesttype,digest
+	reDnsmasq = regexp.MustCompile(`^trust-anchor=(?:[A-Za-z]+,)?([^,]+),(\d+),(\d+),(\d+),([0-9A-Fa-f]+)$`)
+)
+
+// Parse extracts the trust anchors from a file in any of the formats produced
+// by Format, or from a zone file of DS or DNSKEY records.  Lines which do not
+// contain a recognisable trust anchor are ignored.
+func Parse(r io.Reader) ([]Anchor, error) {
+	var anchors []Anchor
+
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, ";") || strings.HasPrefix(line, "#") ||
+			strings.HasPrefix(line, "//") || strings.HasPrefix(line, "--") {
+			continue
+		}
+
+		a, err := parseLine(line)
+		if err != nil {
+			return nil, err
+		}
+		if a != nil {
+			anchors = append(anchors, *a)
+		}
+	}
+
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+
+	return anchors, nil
+}
+
+func parseLine(line string) (*Anchor, error) {
+	if m := reDnsmasq.FindStringSubmatch(line); m != nil {
+		return dsAnchor(m[1], m[2], m[3], m[4], m[5])
+	}
+
+	if m := reBINDDS.FindStringSubmatch(line); m != nil {
+		return dsAnchor(m[1], m[2], m[3], m[4], m[5])
+	}
+
+	if m := reBINDKey.FindStringSubmatch(line); m != nil {
+		return rrAnchor(fmt.Sprintf("%s IN DNSKEY %s %s %s %s", dns.Fqdn(m[1]), m[2], m[3], m[4], m[5]))
+	}
+
+	if m := reKnot.FindStringSubmatch(line); m != nil {
+		return rrAnchor(m[1])
+	}
+
+	return rrAnchor(line)
+}
+
+func dsAnchor(zone, tag, alg, digestType, digest string) (*Anchor, error) {
+	return rrAnchor(fmt.Sprintf("%s IN DS %s %s %s %s", dns.Fqdn(zone), tag, alg,
+		digestType, strings.Join(strings.Fields(digest), "")))
+}
+
+func rrAnchor(s string) (*Anchor, error) {
+	rr, err := dns.NewRR(s)
+	if err != nil || rr == nil {
+		// Not every line in a resolver configuration file is a trust anchor.
+		return nil, nil
+	}
+
+	switch r := rr.(type) {
+	case *dns.DS:
+		return &Anchor{Zone: dns.Fqdn(r.Hdr.Name), DS: r}, nil
+	case *dns.DNSKEY:
+		ds := r.ToDS(dns.SHA256)
+		if ds == nil {
+			return nil, fmt.Errorf("Couldn't compute DS for trust anchor DNSKEY with tag %d", r.KeyTag())
+		}
+		return &Anchor{Zone: dns.Fqdn(r.Hdr.Name), DS: ds, Key: r}, nil
+	default:
+		return nil, nil
+	}
+}
+
+// Matches returns true iff the anchor designates ksk.
+func (a *Anchor) Matches(ksk *dns.DNSKEY) bool {
+	if !strings.EqualFold(a.Zone, dns.Fqdn(ksk.Hdr.Name)) {
+		return false
+	}
+
+	if a.Key != nil {
+		return a.Key.Algorithm == ksk.Algorithm && a.Key.PublicKey == ksk.PublicKey
+	}
+
+	ds := ksk.ToDS(a.DS.DigestType)
+	if ds == nil {
+		return false
+	}
+
+	return ds.KeyTag == a.DS.KeyTag && ds.Algorithm == a.DS.Algorithm &&
+		strings.EqualFold(ds.Digest, a.DS.Digest)
+}
+
+// Verify checks whether any of the anchors designates ksk.  If none does, the
+// returned error lists the key tags found alongside the expected key tag.
+func Verify(ksk *dns.DNSKEY, anchors []Anchor) error {
+	if len(anchors) == 0 {
+		return fmt.Errorf("No trust anchors found; expected key tag %d", ksk.KeyTag())
+	}
+
+	var found []string
+	for i := range anchors {
+		if anchors[i].Matches(ksk) {
+			return nil
+		}
+		found = append(found, anchors[i].Zone+" "+strconv.Itoa(int(anchors[i].DS.KeyTag)))
+	}
+
+	return fmt.Errorf("Trust anchor mismatch: expected %s %d, found %s",
+		dns.Fqdn(ksk.Hdr.Name), ksk.KeyTag(), strings.Join(found, ", "))
+}
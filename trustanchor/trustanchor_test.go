@@ -0,0 +1,90 @@
+package trustanchor_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+
+	"github.com/namecoin/ncdns/trustanchor"
+)
+
+func newKSK(t *testing.T) *dns.DNSKEY {
+	k := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: "bit.", Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags:     257,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+	if _, err := k.Generate(256); err != nil {
+		t.Fatalf("Couldn't generate key: %v", err)
+	}
+	return k
+}
+
+func TestFormatRoundTrip(t *testing.T) {
+	ksk := newKSK(t)
+	other := newKSK(t)
+
+	for _, format := range trustanchor.Formats {
+		s, err := trustanchor.Format(ksk, format)
+		if err != nil {
+			t.Errorf("%s: Format failed: %v", format, err)
+			continue
+		}
+
+		anchors, err := trustanchor.Parse(strings.NewReader(s))
+		if err != nil {
+			t.Errorf("%s: Parse failed: %v", format, err)
+			continue
+		}
+
+		if len(anchors) != 1 {
+			t.Errorf("%s: expected 1 anchor, got %d from %q", format, len(anchors), s)
+			continue
+		}
+
+		if err := trustanchor.Verify(ksk, anchors); err != nil {
+			t.Errorf("%s: anchor didn't verify against its own key: %v", format, err)
+		}
+
+		err = trustanchor.Verify(other, anchors)
+		if err == nil {
+			t.Errorf("%s: anchor verified against the wrong key", format)
+		} else if !strings.Contains(err.Error(), "found bit. ") {
+			t.Errorf("%s: mismatch error doesn't list the key tags found: %v", format, err)
+		}
+	}
+}
+
+func TestParseDNSKEYAnchor(t *testing.T) {
+	ksk := newKSK(t)
+
+	anchors, err := trustanchor.Parse(strings.NewReader("; KSK for bit.\n" + ksk.String() + "\n"))
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+
+	if err := trustanchor.Verify(ksk, anchors); err != nil {
+		t.Errorf("DNSKEY anchor didn't verify: %v", err)
+	}
+}
+
+func TestVerifyEmpty(t *testing.T) {
+	ksk := newKSK(t)
+
+	anchors, err := trustanchor.Parse(strings.NewReader("server:\n  do-not-query-localhost: no\n"))
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+
+	if trustanchor.Verify(ksk, anchors) == nil {
+		t.Errorf("empty anchor file verified")
+	}
+}
+
+func TestFormatInvalid(t *testing.T) {
+	if _, err := trustanchor.Format(newKSK(t), "nonsense"); err == nil {
+		t.Errorf("invalid format accepted")
+	}
+}
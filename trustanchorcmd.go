@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/miekg/dns"
+
+	"github.com/namecoin/ncdns/server"
+	"github.com/namecoin/ncdns/trustanchor"
+)
+
+func init() {
+	subcommands["export-trust-anchor"] = &subcommand{
+		usage: "export-trust-anchor [-format=" + strings.Join(trustanchor.Formats, "|") + "] [-suffix=SUFFIX] [-out=FILE]: " +
+			"write the configured KSK as a resolver trust anchor",
+		run: runExportTrustAnchor,
+	}
+	subcommands["verify-trust-anchor"] = &subcommand{
+		usage: "verify-trust-anchor [-suffix=SUFFIX] <file>: check that a trust anchor file matches the configured KSK",
+		run:   runVerifyTrustAnchor,
+	}
+}
+
+func runExportTrustAnchor(args []string) int {
+	fs, conf := newSubcommandFlags("export-trust-anchor")
+	format := fs.String("format", "ds", "Trust anchor format: "+strings.Join(trustanchor.Formats, ", "))
+	out := fs.String("out", "", "File to write the trust anchor to (default: stdout)")
+	suffix := fs.String("suffix", "", "Export the KSK used for this suffix (default: the global KSK)")
+	if fs.Parse(args) != nil {
+		return 2
+	}
+
+	cfg, err := loadSubcommandConfig(*conf)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return 2
+	}
+
+	ksk, err := loadKSK(cfg, *suffix)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Couldn't load KSK: %s\n", err)
+		return 2
+	}
+
+	anchor, err := trustanchor.Format(ksk, *format)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return 2
+	}
+
+	if *out == "" {
+		fmt.Print(anchor)
+		return 0
+	}
+
+	err = ioutil.WriteFile(*out, []byte(anchor), 0644)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Couldn't write trust anchor: %s\n", err)
+		return 2
+	}
+
+	return 0
+}
+
+// Exits 0 if the anchor file matches, 1 on mismatch and 2 on any other error.
+func runVerifyTrustAnchor(args []string) int {
+	fs, conf := newSubcommandFlags("verify-trust-anchor")
+	suffix := fs.String("suffix", "", "Verify against the KSK used for this suffix (default: the global KSK)")
+	if fs.Parse(args) != nil {
+		return 2
+	}
+
+	if fs.NArg() != 1 {
+		fmt.Fprintf(os.Stderr, "Usage: ncdns verify-trust-anchor [-conf=FILE] [-suffix=SUFFIX] <file>\n")
+		return 2
+	}
+
+	cfg, err := loadSubcommandConfig(*conf)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return 2
+	}
+
+	ksk, err := loadKSK(cfg, *suffix)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Couldn't load KSK: %s\n", err)
+		return 2
+	}
+
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Couldn't open trust anchor file: %s\n", err)
+		return 2
+	}
+	defer f.Close()
+
+	anchors, err := trustanchor.Parse(f)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Couldn't parse trust anchor file: %s\n", err)
+		return 2
+	}
+
+	err = trustanchor.Verify(ksk, anchors)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return 1
+	}
+
+	fmt.Printf("Trust anchor matches KSK %s %d\n", ksk.Hdr.Name, ksk.KeyTag())
+	return 0
+}
+
+func loadKSK(cfg *server.Config, suffix string) (*dns.DNSKEY, error) {
+	if suffix == "" {
+		return cfg.LoadKSK()
+	}
+
+	return cfg.LoadSuffixKSK(suffix)
+}
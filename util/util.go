@@ -1,6 +1,7 @@
 package util
 
 import "strings"
+import "github.com/miekg/dns"
 import "gopkg.in/hlandau/madns.v2/merr"
 import "fmt"
 import "regexp"
@@ -45,6 +46,8 @@ func SplitDomainTail(name string) (tail, rest string) {
 //
 // If no label corresponds to ANCHOR, an error is returned.
 // If ANCHOR is the first label, basename is an empty string.
+// Labels are compared with ANCHOR without regard to case, and an escaped dot
+// (as in a\.bit.) is part of a label rather than a separator.
 //
 // Examples, where anchor="bit":
 //
@@ -57,40 +60,94 @@ func SplitDomainTail(name string) (tail, rest string) {
 //	"c.d.bit.x.y.z."     -> subname="c",     basename="d", rootname="bit.x.y.z"
 //	"a.b.c.d.bit.x.y.z." -> subname="a.b.c",     basename="d", rootname="bit.x.y.z"
 func SplitDomainByFloatingAnchor(qname, anchor string) (subname, basename, rootname string, err error) {
-	qname = strings.TrimRight(qname, ".")
-	parts := strings.Split(qname, ".")
-	if len(parts) < 2 {
-		if parts[0] != anchor {
-			err = merr.ErrNotInZone
-			return
-		}
+	idx := splitLabels(qname)
 
-		rootname = parts[0]
-		return
-	}
+	// scanning for rootname
+	for partIndex := len(idx) - 1; partIndex >= 0; partIndex-- {
+		if !strings.EqualFold(domainLabel(qname, idx, partIndex), anchor) {
+			continue
+		}
 
-	for partIndex := len(parts) - 1; partIndex >= 0; partIndex-- {
-		v := parts[partIndex]
-
-		// scanning for rootname
-		if v == anchor {
-			if partIndex == 0 {
-				// partIndex is already zero, so we have something like bit.x.y.z.
-				rootname = qname
-				return
-			}
-
-			rootname = strings.Join(parts[partIndex:], ".")
-			basename = parts[partIndex-1]
-			subname = strings.Join(parts[0:partIndex-1], ".")
-			return
+		rootname = strings.TrimSuffix(qname[idx[partIndex]:], ".")
+		if partIndex > 0 {
+			basename = domainLabel(qname, idx, partIndex-1)
+			subname = domainLabels(qname, idx, partIndex-1)
 		}
+		return
 	}
 
 	err = merr.ErrNotInZone
 	return
 }
 
+// Returns the offsets of the labels of name, as dns.Split does, but none for
+// the empty name, as dns.SplitDomainName.
+func splitLabels(name string) []int {
+	if name == "" {
+		return nil
+	}
+	return dns.Split(name)
+}
+
+// Returns label i of name, whose labels start at the offsets idx (as returned
+// by dns.Split). Slicing name this way, rather than splitting it with
+// dns.SplitDomainName, saves allocating on every query.
+func domainLabel(name string, idx []int, i int) string {
+	if i+1 < len(idx) {
+		return name[idx[i] : idx[i+1]-1]
+	}
+	return strings.TrimSuffix(name[idx[i]:], ".")
+}
+
+// Returns the first n labels of name, as domainLabel does, separated by dots.
+func domainLabels(name string, idx []int, n int) string {
+	switch {
+	case n == 0:
+		return ""
+	case n < len(idx):
+		return name[:idx[n]-1]
+	default:
+		return strings.TrimSuffix(name, ".")
+	}
+}
+
+// Returns true if name is zone or a name under it. Names are compared label
+// by label, without regard to case, so "example.bit." is in the zone "BIT"
+// but "examplebit." isn't.
+func IsInZone(name, zone string) bool {
+	_, ok := TrimZone(name, zone)
+	return ok
+}
+
+// If name is zone or a name under it, returns the labels of name under the
+// zone, without a trailing dot (e.g. "www.example" for "www.example.bit." in
+// the zone "bit"), and true. Labels are compared as by IsInZone.
+func TrimZone(name, zone string) (string, bool) {
+	idx, n, ok := trimZoneLabels(name, zone)
+	if !ok {
+		return "", false
+	}
+	return domainLabels(name, idx, n), true
+}
+
+// If name is zone or a name under it, returns the offsets of name's labels,
+// as returned by dns.Split, the number of them under the zone, and true.
+func trimZoneLabels(name, zone string) ([]int, int, bool) {
+	idx := splitLabels(name)
+	n := len(idx) - len(splitLabels(zone))
+	if n < 0 {
+		return nil, 0, false
+	}
+
+	// Both have the same number of labels, so they're the same labels if
+	// they're the same text.
+	if n < len(idx) && !strings.EqualFold(strings.TrimSuffix(name[idx[n]:], "."), strings.TrimSuffix(zone, ".")) {
+		return nil, 0, false
+	}
+
+	return idx, n, true
+}
+
 // Convert a domain name basename (e.g. "example") to a Namecoin domain name
 // key name ("d/example").
 func BasenameToNamecoinKey(basename string) (string, error) {
@@ -119,6 +176,56 @@ func NamecoinKeyToBasename(key string) (string, error) {
 	return key, nil
 }
 
+// Returned by QnameToNamecoinKey for a name whose label under the suffix can't
+// be that of a Namecoin domain name.
+var ErrInvalidDomainName = fmt.Errorf("invalid domain name")
+
+// Maps a DNS name under suffix to the Namecoin domain name whose value holds
+// its records, and the path to them within the value: the labels below the
+// one directly under the suffix, nearest first. Each is looked up in the map
+// of the value found by the one before. For example, under the suffix "bit",
+// "www.foo.example.bit." maps to "d/example" and the path ["foo", "www"].
+//
+// Names are compared without regard to case, and the results are in lower
+// case, as Namecoin names are. Labels are split as by dns.SplitDomainName, so
+// an escaped dot is part of a label. The suffix must match the end of qname
+// exactly (as "bit.example.com" does for "www.example.bit.example.com."); to
+// find a "bit" label wherever it is in a name, as the backend does, use
+// SplitDomainByFloatingAnchor first.
+//
+// Returns:
+//
+//   - "", nil, nil if qname is the suffix itself, which isn't under any name;
+//   - merr.ErrNotInZone if qname isn't under the suffix;
+//   - ErrInvalidDomainName if the label under the suffix isn't a valid domain
+//     name label (see ValidateDomainLabel): at most 63 letters, digits and
+//     hyphens, not starting or ending with a hyphen, with two hyphens in a
+//     row only in an "xn--" prefix.
+//
+// The labels of the path aren't checked, since they needn't be hostnames
+// (e.g. "_tcp") and those which aren't in the value simply don't exist.
+func QnameToNamecoinKey(qname, suffix string) (nmcName string, subPath []string, err error) {
+	qname = strings.ToLower(qname)
+	idx, n, ok := trimZoneLabels(qname, strings.ToLower(suffix))
+	if !ok {
+		return "", nil, merr.ErrNotInZone
+	}
+	if n == 0 {
+		return "", nil, nil
+	}
+
+	basename := domainLabel(qname, idx, n-1)
+	if !ValidateDomainLabel(basename) {
+		return "", nil, ErrInvalidDomainName
+	}
+
+	for i := n - 2; i >= 0; i-- {
+		subPath = append(subPath, domainLabel(qname, idx, i))
+	}
+
+	return basenameToNamecoinKey(basename), subPath, nil
+}
+
 // An owner name is any technically valid DNS name. RFC 2181 permits binary
 // data in DNS labels (!), but this is ridiculous. The conventions which appear
 // to be enforced by web browsers are used.
@@ -231,6 +338,13 @@ func ValidateOwnerName(name string) bool {
 	return len(name) <= 255 && re_ownerName.MatchString(name)
 }*/
 
+// Reports whether any label of name begins with an underscore, as the labels
+// of service and attribute names such as "_dmarc" and "_443._tcp" do. Such
+// names are valid owner names but not hostnames, and so have no addresses.
+func HasUnderscoreLabel(name string) bool {
+	return strings.HasPrefix(name, "_") || strings.Contains(name, "._")
+}
+
 func ValidateEmail(email string) bool {
 	addr, err := mail.ParseAddress(email)
 	if addr == nil || err != nil {
@@ -245,17 +359,11 @@ func ParseFuzzyDomainName(name string) (string, error) {
 	if strings.HasPrefix(name, "d/") {
 		return NamecoinKeyToBasename(name)
 	}
-	if len(name) > 0 && name[len(name)-1] == '.' {
-		name = name[0 : len(name)-1]
-	}
-	if strings.HasSuffix(name, ".bit") {
-		name = name[0 : len(name)-4]
-		if !ValidateDomainLabel(name) {
-			return "", fmt.Errorf("invalid domain name")
-		}
-		return name, nil
+	key, subPath, err := QnameToNamecoinKey(name, "bit")
+	if err != nil || key == "" || len(subPath) > 0 {
+		return "", ErrInvalidDomainName
 	}
-	return "", fmt.Errorf("invalid domain name")
+	return key[len("d/"):], nil
 }
 
 func ParseFuzzyDomainNameNC(name string) (bareName string, namecoinKey string, err error) {
@@ -1,5 +1,7 @@
 package util_test
 
+import "reflect"
+import "strings"
 import "testing"
 import "github.com/namecoin/ncdns/util"
 import "gopkg.in/hlandau/madns.v2/merr"
@@ -62,6 +64,14 @@ var aitems = []aitem{
 	{"d.bit.x.y.z.", "bit", "", "d", "bit.x.y.z", nil},
 	{"c.d.bit.x.y.z.", "bit", "c", "d", "bit.x.y.z", nil},
 	{"a.b.c.d.bit.x.y.z.", "bit", "a.b.c", "d", "bit.x.y.z", nil},
+	{"bit", "bit", "", "", "bit", nil},
+	{"xbit.", "bit", "", "", "", merr.ErrNotInZone},
+	{"example.notbit.", "bit", "", "", "", merr.ErrNotInZone},
+	{"example.bitx.y.", "bit", "", "", "", merr.ErrNotInZone},
+	{"Example.BIT.", "bit", "", "Example", "BIT", nil},
+	{"a.bit.b.bit.", "bit", "a.bit", "b", "bit", nil},
+	{`a\.bit.`, "bit", "", "", "", merr.ErrNotInZone},
+	{`a.b\.c.bit.`, "bit", "a", `b\.c`, "bit", nil},
 }
 
 func TestSplitDomainByFloatingAnchor(t *testing.T) {
@@ -81,3 +91,143 @@ func TestSplitDomainByFloatingAnchor(t *testing.T) {
 		}
 	}
 }
+
+func TestTrimZone(t *testing.T) {
+	tests := []struct {
+		name, zone string
+		rest       string
+		ok         bool
+	}{
+		{"example.bit.", "bit", "example", true},
+		{"www.example.bit", "bit.", "www.example", true},
+		{"bit.", "bit", "", true},
+		{"BIT", "bit.", "", true},
+		{"Example.Bit.", "bit", "Example", true},
+		{"xbit.", "bit", "", false},
+		{"example.xbit.", "bit", "", false},
+		{"bit.example.com.", "bit", "", false},
+		{"example.bit.example.com.", "bit", "", false},
+		{"example.bit.example.com.", "bit.example.com", "example", true},
+		{"example.bit.example.com.", "BIT.Example.COM.", "example", true},
+		{"example.com.", "bit.example.com.", "", false},
+		{`a\.bit.`, "bit", "", false},
+		{`a.b\.c.bit.`, `b\.c.bit`, "a", true},
+		{`a.b\.c.bit.`, "c.bit", "", false},
+		{"example.bit.", ".", "example.bit", true},
+	}
+
+	for _, test := range tests {
+		rest, ok := util.TrimZone(test.name, test.zone)
+		if rest != test.rest || ok != test.ok {
+			t.Errorf("TrimZone(%q, %q) = %q, %v; expected %q, %v", test.name, test.zone, rest, ok, test.rest, test.ok)
+		}
+		if ok := util.IsInZone(test.name, test.zone); ok != test.ok {
+			t.Errorf("IsInZone(%q, %q) = %v", test.name, test.zone, ok)
+		}
+	}
+}
+
+func TestQnameToNamecoinKey(t *testing.T) {
+	label63 := strings.Repeat("a", 62) + "z"
+	tests := []struct {
+		qname, suffix string
+		nmcName       string
+		subPath       []string
+		err           error
+	}{
+		// The suffix itself.
+		{"bit.", "bit", "", nil, nil},
+		{"BIT", "bit.", "", nil, nil},
+		{"bit.example.com.", "bit.example.com", "", nil, nil},
+
+		// Names under the suffix, to 10 labels.
+		{"example.bit.", "bit", "d/example", nil, nil},
+		{"www.example.bit.", "bit", "d/example", []string{"www"}, nil},
+		{"www.foo.example.bit.", "bit", "d/example", []string{"foo", "www"}, nil},
+		{"a.b.c.d.e.f.g.h.example.bit", "bit", "d/example", []string{"h", "g", "f", "e", "d", "c", "b", "a"}, nil},
+		{"a.b.c.d.e.f.g.h.i.example.bit.", "bit", "d/example", []string{"i", "h", "g", "f", "e", "d", "c", "b", "a"}, nil},
+		{"WWW.Example.BIT.", "bit", "d/example", []string{"www"}, nil},
+		{"www.example.bit.example.com.", "bit.example.com.", "d/example", []string{"www"}, nil},
+		{"www.example.bit.example.com.", "BIT.Example.COM", "d/example", []string{"www"}, nil},
+		{"_443._tcp.example.bit.", "bit", "d/example", []string{"_tcp", "_443"}, nil},
+		{"*.example.bit.", "bit", "d/example", []string{"*"}, nil},
+		{"example.bit.bit.", "bit", "d/bit", []string{"example"}, nil},
+		{"example.bit.", ".", "d/bit", []string{"example"}, nil},
+
+		// Hyphens are allowed inside the label under the suffix, but not at
+		// either end of it, and not two together except in an IDN prefix.
+		// Labels further down are taken as they are.
+		{"ex-ample.bit.", "bit", "d/ex-ample", nil, nil},
+		{"e-x-a-m-p-l-e.bit.", "bit", "d/e-x-a-m-p-l-e", nil, nil},
+		{"xn--bcher-kva.bit.", "bit", "d/xn--bcher-kva", nil, nil},
+		{"-example.bit.", "bit", "", nil, util.ErrInvalidDomainName},
+		{"example-.bit.", "bit", "", nil, util.ErrInvalidDomainName},
+		{"ex--ample.bit.", "bit", "", nil, util.ErrInvalidDomainName},
+		{"-.bit.", "bit", "", nil, util.ErrInvalidDomainName},
+		{"www-.example.bit.", "bit", "d/example", []string{"www-"}, nil},
+		{"-www.-foo.example.bit.", "bit", "d/example", []string{"-foo", "-www"}, nil},
+		{"under_score.bit.", "bit", "", nil, util.ErrInvalidDomainName},
+		{"_tcp.bit.", "bit", "", nil, util.ErrInvalidDomainName},
+		{"x--nmc.bit.", "bit", "", nil, util.ErrInvalidDomainName},
+
+		// The longest Namecoin domain name which a DNS label can hold.
+		{label63 + ".bit.", "bit", "d/" + label63, nil, nil},
+		{"www." + label63 + ".bit.", "bit", "d/" + label63, []string{"www"}, nil},
+		{label63 + "a.bit.", "bit", "", nil, util.ErrInvalidDomainName},
+
+		// An escaped dot is part of a label.
+		{`a\.b.example.bit.`, "bit", "d/example", []string{`a\.b`}, nil},
+		{`a.b\.example.bit.`, "bit", "", nil, util.ErrInvalidDomainName},
+		{`example\.bit.`, "bit", "", nil, merr.ErrNotInZone},
+
+		// Names not under the suffix.
+		{"", "bit", "", nil, merr.ErrNotInZone},
+		{".", "bit", "", nil, merr.ErrNotInZone},
+		{"examplebit.", "bit", "", nil, merr.ErrNotInZone},
+		{"example.xbit.", "bit", "", nil, merr.ErrNotInZone},
+		{"example.bit.example.com.", "bit", "", nil, merr.ErrNotInZone},
+		{"example.com.", "bit.example.com", "", nil, merr.ErrNotInZone},
+	}
+
+	for _, test := range tests {
+		nmcName, subPath, err := util.QnameToNamecoinKey(test.qname, test.suffix)
+		if nmcName != test.nmcName || !reflect.DeepEqual(subPath, test.subPath) || err != test.err {
+			t.Errorf("QnameToNamecoinKey(%q, %q) = %q, %q, %v; expected %q, %q, %v",
+				test.qname, test.suffix, nmcName, subPath, err, test.nmcName, test.subPath, test.err)
+		}
+	}
+}
+
+func TestHasUnderscoreLabel(t *testing.T) {
+	for name, expected := range map[string]bool{
+		"_dmarc.example.bit.":     true,
+		"sel1._domainkey.bit.":    true,
+		"_443._tcp":               true,
+		"www.example.bit.":        false,
+		"a_b.example.bit.":        false,
+		"www.example.bit._local.": true,
+		"":                        false,
+	} {
+		if util.HasUnderscoreLabel(name) != expected {
+			t.Errorf("HasUnderscoreLabel(%q) != %v", name, expected)
+		}
+	}
+}
+
+func TestParseFuzzyDomainName(t *testing.T) {
+	for input, expected := range map[string]string{
+		"d/example":    "example",
+		"example.bit":  "example",
+		"Example.BIT.": "example",
+	} {
+		if got, err := util.ParseFuzzyDomainName(input); err != nil || got != expected {
+			t.Errorf("%q: got %q, %v", input, got, err)
+		}
+	}
+
+	for _, input := range []string{"examplebit", "example.xbit", "www.example.bit", "bit", "example.bit.com"} {
+		if got, err := util.ParseFuzzyDomainName(input); err == nil {
+			t.Errorf("%q: got %q, expected error", input, got)
+		}
+	}
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/namecoin/ncdns/ncdomain"
+)
+
+func init() {
+	subcommands["print-value-schema"] = &subcommand{
+		usage: "print-value-schema: print a JSON description of the name value fields this version understands",
+		run:   runPrintValueSchema,
+	}
+}
+
+func runPrintValueSchema(args []string) int {
+	fs, _ := newSubcommandFlags("print-value-schema")
+	if fs.Parse(args) != nil {
+		return 2
+	}
+
+	b, err := json.MarshalIndent(ncdomain.ValueSchema(), "", "  ")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return 1
+	}
+
+	fmt.Printf("%s\n", b)
+	return 0
+}